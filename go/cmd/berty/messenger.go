@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"moul.io/godev"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func messengerCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "messenger",
+		ShortUsage: "berty [global flags] messenger <subcommand> [flags]",
+		ShortHelp:  "inspect and repair the messenger database",
+		Options:    ffSubcommandOptions(),
+		UsageFunc:  usageFunc,
+		Subcommands: []*ffcli.Command{
+			messengerDoctorCommand(),
+			messengerRepairCommand(),
+			messengerStatsCommand(),
+			messengerRotateStorageKeyCommand(),
+		},
+		Exec: func(context.Context, []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+func messengerFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.String("config", "", "config file (optional)")
+	manager.SetupLoggingFlags(fs)              // also available at root level
+	manager.SetupLocalMessengerServerFlags(fs) // by default, start a new local messenger server,
+	manager.SetupRemoteNodeFlags(fs)           // but allow to set a remote server instead
+	return fs
+}
+
+func messengerDoctorCommand() *ffcli.Command {
+	var verifyChecksumsFlag bool
+
+	fsBuilder := func() (*flag.FlagSet, error) {
+		fs := messengerFlagSet("berty messenger doctor")
+		fs.BoolVar(&verifyChecksumsFlag, "verify-checksums", true, "read the locally available medias to verify their checksum")
+		return fs, nil
+	}
+
+	return &ffcli.Command{
+		Name:           "doctor",
+		ShortUsage:     "berty [global flags] messenger doctor [flags]",
+		ShortHelp:      "detect orphaned interactions, dangling medias and checksum mismatches",
+		FlagSetBuilder: fsBuilder,
+		Options:        ffSubcommandOptions(),
+		UsageFunc:      usageFunc,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return flag.ErrHelp
+			}
+
+			manager.DisableIPFSNetwork()
+
+			messenger, err := manager.GetMessengerClient()
+			if err != nil {
+				return err
+			}
+
+			ret, err := messenger.DatabaseDoctor(ctx, &messengertypes.DatabaseDoctor_Request{VerifyChecksums: verifyChecksumsFlag})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			if len(ret.GetIssues()) == 0 {
+				fmt.Println("no issue found")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tCID\tCONVERSATION\tDETAIL")
+			for _, issue := range ret.GetIssues() {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", issue.GetKind(), issue.GetCID(), issue.GetConversationPublicKey(), issue.GetDetail())
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+
+			return fmt.Errorf("%d issue(s) found", len(ret.GetIssues()))
+		},
+	}
+}
+
+func messengerRepairCommand() *ffcli.Command {
+	var (
+		replayGroupFlag   string
+		removeOrphansFlag bool
+	)
+
+	fsBuilder := func() (*flag.FlagSet, error) {
+		fs := messengerFlagSet("berty messenger repair")
+		fs.StringVar(&replayGroupFlag, "replay-group", "", "public key of a conversation whose logs are replayed")
+		fs.BoolVar(&removeOrphansFlag, "remove-orphans", false, "delete the orphaned interactions and the dangling medias")
+		return fs, nil
+	}
+
+	return &ffcli.Command{
+		Name:           "repair",
+		ShortUsage:     "berty [global flags] messenger repair [flags]",
+		ShortHelp:      "replay the logs of a group and remove the inconsistent records",
+		FlagSetBuilder: fsBuilder,
+		Options:        ffSubcommandOptions(),
+		UsageFunc:      usageFunc,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return flag.ErrHelp
+			}
+
+			if replayGroupFlag == "" && !removeOrphansFlag {
+				return fmt.Errorf("nothing to repair, use --replay-group or --remove-orphans")
+			}
+
+			manager.DisableIPFSNetwork()
+
+			messenger, err := manager.GetMessengerClient()
+			if err != nil {
+				return err
+			}
+
+			ret, err := messenger.DatabaseRepair(ctx, &messengertypes.DatabaseRepair_Request{
+				ReplayGroupPK: replayGroupFlag,
+				RemoveOrphans: removeOrphansFlag,
+			})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			if replayGroupFlag != "" {
+				fmt.Printf("replayed group %s\n", replayGroupFlag)
+			}
+			if removeOrphansFlag {
+				fmt.Printf("removed %d interaction(s) and %d media(s)\n", ret.GetRemovedInteractions(), ret.GetRemovedMedias())
+			}
+
+			return nil
+		},
+	}
+}
+
+func messengerStatsCommand() *ffcli.Command {
+	var jsonFlag bool
+
+	fsBuilder := func() (*flag.FlagSet, error) {
+		fs := messengerFlagSet("berty messenger stats")
+		fs.BoolVar(&jsonFlag, "json", false, "print the stats as JSON")
+		return fs, nil
+	}
+
+	return &ffcli.Command{
+		Name:           "stats",
+		ShortUsage:     "berty [global flags] messenger stats [flags]",
+		ShortHelp:      "display the size of the tables and of the conversations",
+		FlagSetBuilder: fsBuilder,
+		Options:        ffSubcommandOptions(),
+		UsageFunc:      usageFunc,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return flag.ErrHelp
+			}
+
+			manager.DisableIPFSNetwork()
+
+			messenger, err := manager.GetMessengerClient()
+			if err != nil {
+				return err
+			}
+
+			ret, err := messenger.DatabaseStats(ctx, &messengertypes.DatabaseStats_Request{})
+			if err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			if jsonFlag {
+				fmt.Println(godev.PrettyJSONPB(ret))
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "database size\t%d bytes\n\n", ret.GetDatabaseSize())
+
+			fmt.Fprintln(w, "TABLE\tROWS")
+			for _, table := range ret.GetTables() {
+				fmt.Fprintf(w, "%s\t%d\n", table.GetName(), table.GetRows())
+			}
+
+			fmt.Fprintln(w, "\nCONVERSATION\tNAME\tINTERACTIONS\tMEDIAS\tMEDIA SIZE")
+			for _, conv := range ret.GetConversations() {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", conv.GetConversationPublicKey(), conv.GetDisplayName(), conv.GetInteractions(), conv.GetMedias(), conv.GetMediaSize())
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+func messengerRotateStorageKeyCommand() *ffcli.Command {
+	var newStorageKeyFlag string
+
+	fsBuilder := func() (*flag.FlagSet, error) {
+		fs := flag.NewFlagSet("berty messenger rotate-storage-key", flag.ExitOnError)
+		fs.String("config", "", "config file (optional)")
+		manager.SetupLoggingFlags(fs)              // also available at root level
+		manager.SetupLocalMessengerServerFlags(fs) // the db is rekeyed locally, -node.storage-key is the current key
+		fs.StringVar(&newStorageKeyFlag, "new-storage-key", "", "base64 encoded new key of the account storage")
+		return fs, nil
+	}
+
+	return &ffcli.Command{
+		Name:           "rotate-storage-key",
+		ShortUsage:     "berty [global flags] messenger rotate-storage-key -node.storage-key=<current> -new-storage-key=<new>",
+		ShortHelp:      "encrypt the messenger database with a new storage key",
+		FlagSetBuilder: fsBuilder,
+		Options:        ffSubcommandOptions(),
+		UsageFunc:      usageFunc,
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return flag.ErrHelp
+			}
+
+			if newStorageKeyFlag == "" {
+				return fmt.Errorf("no new storage key specified")
+			}
+
+			storageKey, err := base64.StdEncoding.DecodeString(newStorageKeyFlag)
+			if err != nil {
+				return fmt.Errorf("invalid new storage key: %w", err)
+			}
+
+			// the db is opened with the current key
+			if _, err := manager.GetMessengerDB(); err != nil {
+				return err
+			}
+
+			if err := manager.RotateStorageKey(storageKey); err != nil {
+				return errcode.TODO.Wrap(err)
+			}
+
+			fmt.Println("the messenger database is encrypted with the new storage key")
+			return nil
+		},
+	}
+}
@@ -17,6 +17,7 @@ func systemInfoCommand() *ffcli.Command {
 	var (
 		refreshEveryFlag time.Duration
 		anonymizeFlag    bool
+		diagnosticsFlag  bool
 	)
 	fsBuilder := func() (*flag.FlagSet, error) {
 		fs := flag.NewFlagSet("info", flag.ExitOnError)
@@ -26,6 +27,7 @@ func systemInfoCommand() *ffcli.Command {
 		manager.SetupRemoteNodeFlags(fs)           // but allow to set a remote server instead
 		fs.DurationVar(&refreshEveryFlag, "info.refresh", refreshEveryFlag, "refresh every DURATION (0: no refresh)")
 		fs.BoolVar(&anonymizeFlag, "info.anonymize", false, "anonymize output for sharing")
+		fs.BoolVar(&diagnosticsFlag, "info.diagnostics", false, "report the replay health of the conversations")
 		return fs, nil
 	}
 
@@ -48,7 +50,7 @@ func systemInfoCommand() *ffcli.Command {
 			}
 
 			for {
-				ret, err := messenger.SystemInfo(ctx, &messengertypes.SystemInfo_Request{})
+				ret, err := messenger.SystemInfo(ctx, &messengertypes.SystemInfo_Request{Diagnostics: diagnosticsFlag})
 				if err != nil {
 					return errcode.TODO.Wrap(err)
 				}
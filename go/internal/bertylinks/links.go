@@ -54,6 +54,7 @@ func MarshalLink(link *messengertypes.BertyLink) (internal string, web string, e
 		machine.BertyID = &messengertypes.BertyID{
 			PublicRendezvousSeed: link.BertyID.PublicRendezvousSeed,
 			AccountPK:            link.BertyID.AccountPK,
+			ConnectionHints:      link.BertyID.ConnectionHints,
 		}
 		if link.BertyID.DisplayName != "" {
 			human.Add("name", link.BertyID.DisplayName)
@@ -71,6 +72,8 @@ func MarshalLink(link *messengertypes.BertyLink) (internal string, web string, e
 				GroupType: link.BertyGroup.Group.GroupType,
 				SignPub:   link.BertyGroup.Group.SignPub,
 			},
+			InvitationID:        link.BertyGroup.InvitationID,
+			InvitationExpiresAt: link.BertyGroup.InvitationExpiresAt,
 		}
 		if link.BertyGroup.DisplayName != "" {
 			human.Add("name", link.BertyGroup.DisplayName)
@@ -90,12 +93,15 @@ func MarshalLink(link *messengertypes.BertyLink) (internal string, web string, e
 		case messengertypes.BertyLink_ContactInviteV1Kind:
 			machine.Encrypted.ContactAccountPK = link.Encrypted.ContactAccountPK
 			machine.Encrypted.ContactPublicRendezvousSeed = link.Encrypted.ContactPublicRendezvousSeed
+			machine.Encrypted.ContactConnectionHints = link.Encrypted.ContactConnectionHints
 		case messengertypes.BertyLink_GroupV1Kind:
 			machine.Encrypted.GroupPublicKey = link.Encrypted.GroupPublicKey
 			machine.Encrypted.GroupSecret = link.Encrypted.GroupSecret
 			machine.Encrypted.GroupSecretSig = link.Encrypted.GroupSecretSig
 			machine.Encrypted.GroupSignPub = link.Encrypted.GroupSignPub
 			machine.Encrypted.GroupType = link.Encrypted.GroupType
+			machine.Encrypted.GroupInvitationID = link.Encrypted.GroupInvitationID
+			machine.Encrypted.GroupInvitationExpiresAt = link.Encrypted.GroupInvitationExpiresAt
 		}
 		*qrOptimized = *link
 	default:
@@ -278,6 +284,7 @@ func decryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		return nil, errcode.ErrInternal.Wrap(err)
 	}
 
+	var hints []byte
 	switch decrypted.Kind {
 	case messengertypes.BertyLink_ContactInviteV1Kind:
 		decrypted.BertyID = &messengertypes.BertyID{
@@ -288,6 +295,12 @@ func decryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		stream.XORKeyStream(decrypted.BertyID.AccountPK, link.Encrypted.ContactAccountPK)
 		decrypted.BertyID.DisplayName = link.Encrypted.DisplayName
 
+		// the hints are encrypted last, the links generated before they were added decrypt the same way
+		if len(link.Encrypted.ContactConnectionHints) > 0 {
+			hints = make([]byte, len(link.Encrypted.ContactConnectionHints))
+			stream.XORKeyStream(hints, link.Encrypted.ContactConnectionHints)
+		}
+
 	case messengertypes.BertyLink_GroupV1Kind:
 		decrypted.BertyGroup = &messengertypes.BertyGroup{
 			Group: &protocoltypes.Group{
@@ -303,6 +316,8 @@ func decryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		stream.XORKeyStream(decrypted.BertyGroup.Group.SecretSig, link.Encrypted.GroupSecretSig)
 		stream.XORKeyStream(decrypted.BertyGroup.Group.SignPub, link.Encrypted.GroupSignPub)
 		decrypted.BertyGroup.DisplayName = link.Encrypted.DisplayName
+		decrypted.BertyGroup.InvitationID = link.Encrypted.GroupInvitationID
+		decrypted.BertyGroup.InvitationExpiresAt = link.Encrypted.GroupInvitationExpiresAt
 	}
 
 	if link.Encrypted.Checksum != nil && len(link.Encrypted.Checksum) > 0 {
@@ -316,6 +331,13 @@ func decryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		}
 	}
 
+	if hints != nil {
+		decrypted.BertyID.ConnectionHints = &messengertypes.ConnectionHints{}
+		if err := proto.Unmarshal(hints, decrypted.BertyID.ConnectionHints); err != nil {
+			return nil, errcode.ErrMessengerDeepLinkInvalidPassphrase.Wrap(err)
+		}
+	}
+
 	return &decrypted, nil
 }
 
@@ -375,6 +397,15 @@ func EncryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		stream.XORKeyStream(encrypted.Encrypted.ContactAccountPK, link.BertyID.AccountPK)
 		encrypted.Encrypted.DisplayName = link.BertyID.DisplayName
 
+		if link.BertyID.ConnectionHints != nil {
+			hints, err := proto.Marshal(link.BertyID.ConnectionHints)
+			if err != nil {
+				return nil, errcode.ErrSerialization.Wrap(err)
+			}
+			encrypted.Encrypted.ContactConnectionHints = make([]byte, len(hints))
+			stream.XORKeyStream(encrypted.Encrypted.ContactConnectionHints, hints)
+		}
+
 	case messengertypes.BertyLink_GroupV1Kind:
 		if link.BertyGroup == nil || link.BertyGroup.Group == nil {
 			return nil, errcode.ErrInvalidInput
@@ -392,6 +423,8 @@ func EncryptLink(link *messengertypes.BertyLink, passphrase []byte) (*messengert
 		stream.XORKeyStream(encrypted.Encrypted.GroupSecretSig, link.BertyGroup.Group.SecretSig)
 		stream.XORKeyStream(encrypted.Encrypted.GroupSignPub, link.BertyGroup.Group.SignPub)
 		encrypted.Encrypted.DisplayName = link.BertyGroup.DisplayName
+		encrypted.Encrypted.GroupInvitationID = link.BertyGroup.InvitationID
+		encrypted.Encrypted.GroupInvitationExpiresAt = link.BertyGroup.InvitationExpiresAt
 
 	default:
 		return nil, errcode.ErrInvalidInput
@@ -240,6 +240,45 @@ func TestMarshalLinkFuzzing(t *testing.T) {
 	}
 }
 
+func TestMarshalLinkGroupInvitation(t *testing.T) {
+	link := &messengertypes.BertyLink{
+		Kind: messengertypes.BertyLink_GroupV1Kind,
+		BertyGroup: &messengertypes.BertyGroup{
+			DisplayName: "The Group Name!",
+			Group: &protocoltypes.Group{
+				PublicKey: []byte{3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
+				Secret:    []byte{4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4},
+				SecretSig: []byte{5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5},
+				GroupType: protocoltypes.GroupTypeMultiMember,
+				SignPub:   []byte{6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6},
+			},
+			InvitationID:        "invitation_1",
+			InvitationExpiresAt: 1234,
+		},
+	}
+
+	internal, web, err := bertylinks.MarshalLink(link)
+	require.NoError(t, err)
+
+	for _, uri := range []string{internal, web} {
+		parsed, err := bertylinks.UnmarshalLink(uri, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "invitation_1", parsed.BertyGroup.InvitationID)
+		assert.Equal(t, int64(1234), parsed.BertyGroup.InvitationExpiresAt)
+	}
+
+	encrypted, err := bertylinks.EncryptLink(link, []byte("s3cur3"))
+	require.NoError(t, err)
+
+	internal, _, err = bertylinks.MarshalLink(encrypted)
+	require.NoError(t, err)
+
+	parsed, err := bertylinks.UnmarshalLink(internal, []byte("s3cur3"))
+	require.NoError(t, err)
+	assert.Equal(t, "invitation_1", parsed.BertyGroup.InvitationID)
+	assert.Equal(t, int64(1234), parsed.BertyGroup.InvitationExpiresAt)
+}
+
 func TestEncryptLink(t *testing.T) {
 	cases := []struct {
 		name                string
@@ -370,6 +409,60 @@ func TestEncryptLink(t *testing.T) {
 	}
 }
 
+func TestLinkConnectionHints(t *testing.T) {
+	const peerMaddr = "/ip4/51.159.21.214/tcp/4040/p2p/QmdT7AmhhnbuwvCpa5PH1ySK9HJVB82jr3fo1bxMxBPW6p"
+	link := &messengertypes.BertyLink{
+		Kind: messengertypes.BertyLink_ContactInviteV1Kind,
+		BertyID: &messengertypes.BertyID{
+			DisplayName:          "Hello World!",
+			PublicRendezvousSeed: []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			AccountPK:            []byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+			ConnectionHints: &messengertypes.ConnectionHints{
+				RendezvousPoints: []string{peerMaddr},
+				Relays:           []string{"/ip4/1.2.3.4/udp/4001/quic/p2p/QmdT7AmhhnbuwvCpa5PH1ySK9HJVB82jr3fo1bxMxBPW6p"},
+			},
+		},
+	}
+
+	internal, web, err := bertylinks.MarshalLink(link)
+	require.NoError(t, err)
+	for _, uri := range []string{internal, web} {
+		parsed, err := bertylinks.UnmarshalLink(uri, nil)
+		require.NoError(t, err)
+		require.Equal(t, link.BertyID.ConnectionHints, parsed.BertyID.ConnectionHints)
+	}
+
+	// the hints are encrypted with the rest of the link
+	encrypted, err := bertylinks.EncryptLink(link, []byte("s3cur3"))
+	require.NoError(t, err)
+	require.NotContains(t, string(encrypted.Encrypted.ContactConnectionHints), "51.159.21.214")
+	internal, web, err = bertylinks.MarshalLink(encrypted)
+	require.NoError(t, err)
+	for _, uri := range []string{internal, web} {
+		parsed, err := bertylinks.UnmarshalLink(uri, []byte("s3cur3"))
+		require.NoError(t, err)
+		require.Equal(t, link, parsed)
+	}
+
+	// the links generated before the hints were added are still valid
+	parsed, err := bertylinks.UnmarshalLink(bertylinks.LinkWebPrefix+"contact/"+validContactBlob, nil)
+	require.NoError(t, err)
+	require.True(t, parsed.IsContact())
+	require.Nil(t, parsed.BertyID.ConnectionHints)
+
+	for _, hints := range []*messengertypes.ConnectionHints{
+		{RendezvousPoints: []string{"not a multiaddr"}},
+		// the peer can't be dialed without its id
+		{Relays: []string{"/ip4/1.2.3.4/tcp/4040"}},
+		{RendezvousPoints: []string{peerMaddr, peerMaddr, peerMaddr, peerMaddr, peerMaddr}},
+	} {
+		invalid := *link.BertyID
+		invalid.ConnectionHints = hints
+		_, _, err := bertylinks.MarshalLink(invalid.GetBertyLink())
+		require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+	}
+}
+
 func qrString(url string) string {
 	qrOut := new(bytes.Buffer)
 	qrterminal.GenerateHalfBlock(url, qrterminal.L, qrOut)
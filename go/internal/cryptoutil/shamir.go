@@ -0,0 +1,128 @@
+package cryptoutil
+
+import (
+	crand "crypto/rand"
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// MaxSecretShares is the maximum number of shares of a secret, the x coordinates of the shares are the non zero bytes
+const MaxSecretShares = 255
+
+// SplitSecret splits a secret in n shares with Shamir's secret sharing over GF(256), any threshold of them rebuild the
+// secret with CombineSecretShares while fewer of them reveal nothing about it. A share is the evaluation of a random
+// polynomial for each byte of the secret, followed by its x coordinate.
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the secret can't be empty"))
+	}
+
+	if threshold < 2 || n < threshold || n > MaxSecretShares {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid threshold %d of %d shares", threshold, n))
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold-1)
+	for j, b := range secret {
+		if _, err := crand.Read(coefficients); err != nil {
+			return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+		}
+
+		for _, share := range shares {
+			x := share[len(secret)]
+
+			// Horner's method, the constant term is the byte of the secret
+			y := byte(0)
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			share[j] = gfMul(y, x) ^ b
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineSecretShares rebuilds a secret from at least the threshold of its shares, a wrong secret is returned when
+// there are not enough of them
+func CombineSecretShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("at least 2 shares are required"))
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid share size"))
+	}
+
+	xs := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the shares don't have the same size"))
+		}
+
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid or duplicated share coordinate %d", x))
+		}
+
+		seen[x] = true
+		xs[i] = x
+	}
+
+	// Lagrange interpolation at x = 0, the subtraction is a xor in GF(256)
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for j, x := range xs {
+			if i != j {
+				basis = gfMul(basis, gfMul(x, gfInv(x^xs[i])))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= gfMul(share[k], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// gfMul multiplies in GF(256) with the polynomial of AES, x^8 + x^4 + x^3 + x + 1
+func gfMul(a, b byte) byte {
+	p := byte(0)
+	for i := 0; i < 8; i++ {
+		if b&1 == 1 {
+			p ^= a
+		}
+
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+
+	return p
+}
+
+// gfInv returns the inverse of a non zero element, a^254 since a^255 = 1
+func gfInv(a byte) byte {
+	result, base := byte(1), a
+	for e := 254; e > 0; e >>= 1 {
+		if e&1 == 1 {
+			result = gfMul(result, base)
+		}
+		base = gfMul(base, base)
+	}
+
+	return result
+}
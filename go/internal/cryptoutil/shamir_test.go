@@ -0,0 +1,55 @@
+package cryptoutil
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSecret(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+
+	shares, err := SplitSecret(secret, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	// any threshold of shares rebuilds the secret
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		selected := [][]byte(nil)
+		for _, i := range subset {
+			selected = append(selected, shares[i])
+		}
+
+		combined, err := CombineSecretShares(selected)
+		require.NoError(t, err)
+		require.Equal(t, secret, combined)
+	}
+
+	combined, err := CombineSecretShares(shares[:2])
+	require.NoError(t, err)
+	require.NotEqual(t, secret, combined)
+
+	_, err = CombineSecretShares([][]byte{shares[0], shares[0]})
+	require.Error(t, err)
+
+	_, err = CombineSecretShares([][]byte{shares[0], shares[1][1:]})
+	require.Error(t, err)
+
+	_, err = SplitSecret(secret, 2, 3)
+	require.Error(t, err)
+
+	_, err = SplitSecret(secret, 3, 1)
+	require.Error(t, err)
+
+	_, err = SplitSecret(nil, 3, 2)
+	require.Error(t, err)
+}
+
+func TestGFInv(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		require.Equal(t, byte(1), gfMul(byte(a), gfInv(byte(a))))
+	}
+}
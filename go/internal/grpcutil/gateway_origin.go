@@ -0,0 +1,38 @@
+package grpcutil
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// NewOriginHandler refuses the requests sent by the web pages of the origins not allowed, the requests without an
+// Origin header and the ones of the origin of the API itself are always accepted. "*" allows any origin
+func NewOriginHandler(h http.Handler, allowedOrigins []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isOriginAllowed(allowedOrigins, r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isOriginAllowed(allowedOrigins []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,124 @@
+package grpcutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const sseContentType = "text/event-stream"
+
+// NewSSEHandler wraps a gateway mux, the requests accepting text/event-stream receive each message of a server stream
+// as a Server-Sent Event. EventSource can only send GET requests, the ones to the streams are forwarded to the gateway
+// as POST requests with the JSON request read from the "request" query parameter. The streams must not change the
+// state of the node, a GET request can be sent by any web page.
+func NewSSEHandler(mux http.Handler, streams []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), sseContentType) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			if !isGatewayStream(streams, r.URL.Path) {
+				http.Error(w, "only the streams can be read with a GET request", http.StatusMethodNotAllowed)
+				return
+			}
+
+			r = gatewayStreamRequest(r, r.URL.Query().Get("request"))
+		}
+
+		sw := &sseWriter{ResponseWriter: w}
+		mux.ServeHTTP(sw, r)
+		sw.flushRemaining()
+	})
+}
+
+func isGatewayStream(streams []string, path string) bool {
+	for _, stream := range streams {
+		if stream == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gatewayStreamRequest turns a GET request to a stream into the POST request expected by the gateway
+func gatewayStreamRequest(r *http.Request, body string) *http.Request {
+	if body == "" {
+		body = "{}"
+	}
+
+	r = r.Clone(r.Context())
+	r.Method = http.MethodPost
+	r.Body = ioutil.NopCloser(strings.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Type", "application/json")
+
+	return r
+}
+
+// sseWriter converts the newline delimited messages written by the gateway to "data" fields
+type sseWriter struct {
+	http.ResponseWriter
+
+	buf         []byte
+	wroteHeader bool
+}
+
+func (w *sseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		if err := w.writeEvent(w.buf[:idx]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *sseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flushRemaining sends the last message, the unary replies and the errors are not followed by a delimiter
+func (w *sseWriter) flushRemaining() {
+	if len(bytes.TrimSpace(w.buf)) != 0 {
+		_ = w.writeEvent(w.buf)
+	}
+	w.buf = nil
+	w.Flush()
+}
+
+func (w *sseWriter) writeEvent(data []byte) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	_, err := w.ResponseWriter.Write(append(append([]byte("data: "), data...), '\n', '\n'))
+	return err
+}
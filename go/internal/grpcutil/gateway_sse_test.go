@@ -0,0 +1,111 @@
+package grpcutil
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSEHandler(t *testing.T) {
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"method":"` + r.Method + `","request":` + string(body) + "}\n"))
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(`{"result":2}` + "\n" + `{"result":3}`))
+	})
+	handler := NewSSEHandler(mux, []string{"/stream"})
+
+	// regular gateway requests are untouched
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stream", nil))
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, `{"method":"POST","request":}`+"\n"+`{"result":2}`+"\n"+`{"result":3}`, rec.Body.String())
+
+	req := httptest.NewRequest(http.MethodGet, "/stream?request="+url.QueryEscape(`{"a":1}`), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+	require.True(t, rec.Flushed)
+	require.Equal(t, `data: {"method":"POST","request":{"a":1}}`+"\n\n"+`data: {"result":2}`+"\n\n"+`data: {"result":3}`+"\n\n", rec.Body.String())
+
+	// the request defaults to an empty message
+	req = httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Contains(t, rec.Body.String(), `"request":{}`)
+
+	// the other routes can't be called with a GET request
+	req = httptest.NewRequest(http.MethodGet, "/send?request="+url.QueryEscape(`{"a":1}`), nil)
+	req.Header.Set("Accept", "text/event-stream")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestOriginHandler(t *testing.T) {
+	handler := NewOriginHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{"http://allowed.example"})
+
+	for _, tc := range []struct {
+		origin   string
+		expected int
+	}{
+		{"", http.StatusOK},
+		{"http://example.com", http.StatusOK},
+		{"http://allowed.example", http.StatusOK},
+		{"http://evil.example", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/send", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, tc.expected, rec.Code, tc.origin)
+	}
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	mux := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		_, _ = w.Write([]byte(`{"method":"` + r.Method + `","request":` + string(body) + "}\n"))
+		_, _ = w.Write([]byte(`{"result":2}`))
+	})
+	server := httptest.NewServer(NewWebSocketHandler(mux, []string{"/stream"}, nil))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/stream", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"a":1}`)))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, `{"method":"POST","request":{"a":1}}`, string(msg))
+	_, msg, err = conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, `{"result":2}`, string(msg))
+
+	// the other routes and the other origins are refused
+	_, res, err := websocket.DefaultDialer.Dial(wsURL+"/send", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+
+	_, res, err = websocket.DefaultDialer.Dial(wsURL+"/stream", http.Header{"Origin": []string{"http://evil.example"}})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
@@ -0,0 +1,122 @@
+package grpcutil
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewWebSocketHandler wraps a gateway mux, the WebSocket connections to the streams receive each message of the stream
+// as a text message. The JSON request is the first message sent by the client, or the "request" query parameter when
+// the client doesn't send any.
+func NewWebSocketHandler(mux http.Handler, streams []string, allowedOrigins []string) http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return isOriginAllowed(allowedOrigins, r) },
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		if !isGatewayStream(streams, r.URL.Path) {
+			http.Error(w, "only the streams can be read with a WebSocket", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body := r.URL.Query().Get("request")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already replied with an error
+			return
+		}
+		defer conn.Close()
+
+		if body == "" {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			body = string(msg)
+		}
+
+		req := gatewayStreamRequest(r, body)
+		// the upgraded request has no body and its headers are the ones of the handshake
+		req.Header.Del("Connection")
+		req.Header.Del("Upgrade")
+
+		// the stream is canceled once the client closes the connection
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+
+		ww := &wsWriter{conn: conn, header: http.Header{}}
+		mux.ServeHTTP(ww, req.WithContext(ctx))
+		ww.flushRemaining()
+	})
+}
+
+// wsWriter converts the newline delimited messages written by the gateway to WebSocket text messages
+type wsWriter struct {
+	mu     sync.Mutex
+	conn   *websocket.Conn
+	header http.Header
+	buf    []byte
+}
+
+func (w *wsWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsWriter) WriteHeader(int) {}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		idx := bytes.IndexByte(w.buf, '\n')
+		if idx < 0 {
+			break
+		}
+
+		if err := w.writeMessage(w.buf[:idx]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[idx+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush is a no-op, the messages are sent as soon as they are complete
+func (w *wsWriter) Flush() {}
+
+// flushRemaining sends the last message, the errors are not followed by a delimiter
+func (w *wsWriter) flushRemaining() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_ = w.writeMessage(w.buf)
+	w.buf = nil
+}
+
+func (w *wsWriter) writeMessage(data []byte) error {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+
+	return w.conn.WriteMessage(websocket.TextMessage, data)
+}
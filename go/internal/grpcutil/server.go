@@ -106,6 +106,11 @@ func (l *listener) GRPCMultiaddr() ma.Multiaddr {
 type Server struct {
 	GRPCServer *grpc.Server
 	GatewayMux *grpcgw.ServeMux
+	// GatewayStreams are the paths of the gateway streams which can be read with a GET request, by Server-Sent Events
+	// or WebSocket, they must not change the state of the node. The other routes only accept POST requests
+	GatewayStreams []string
+	// AllowedOrigins are the origins of the web pages allowed to call the API besides its own, "*" allows any origin
+	AllowedOrigins []string
 }
 
 func (s *Server) Serve(l Listener) error {
@@ -118,7 +123,14 @@ func (s *Server) Serve(l Listener) error {
 			serve = s.GRPCServer.Serve
 		case P_GRPC_WEB, P_GRPC_WEBSOCKET:
 			wgrpc := grpcweb.WrapServer(s.GRPCServer,
-				grpcweb.WithOriginFunc(func(string) bool { return true }), // @FIXME: this is very insecure
+				grpcweb.WithOriginFunc(func(origin string) bool {
+					for _, allowed := range s.AllowedOrigins {
+						if allowed == "*" || allowed == origin {
+							return true
+						}
+					}
+					return false
+				}),
 				grpcweb.WithWebsockets(P_GRPC_WEBSOCKET == c.Protocol().Code),
 			)
 
@@ -134,7 +146,7 @@ func (s *Server) Serve(l Listener) error {
 				return false
 			}
 			gatewayServer := http.Server{
-				Handler: s.GatewayMux,
+				Handler: NewOriginHandler(NewWebSocketHandler(NewSSEHandler(s.GatewayMux, s.GatewayStreams), s.GatewayStreams, s.AllowedOrigins), s.AllowedOrigins),
 			}
 
 			serve = gatewayServer.Serve
@@ -31,6 +31,7 @@ import (
 	"berty.tech/berty/v2/go/internal/tinder"
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
 	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
 	"berty.tech/berty/v2/go/pkg/tempdir"
 	tor "berty.tech/go-libp2p-tor-transport"
 	torcfg "berty.tech/go-libp2p-tor-transport/config"
@@ -501,3 +502,42 @@ func (m *Manager) torIsEnabled() bool {
 	}
 	return false
 }
+
+// getConnectionHints returns the rendezvous points and the relays embedded in the contact links of the node on request
+func (m *Manager) getConnectionHints() (*messengertypes.ConnectionHints, error) {
+	rdvpeers, err := m.getRdvpMaddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	hints := &messengertypes.ConnectionHints{}
+	for _, p := range rdvpeers {
+		if len(hints.RendezvousPoints) == messengertypes.ConnectionHintsMaxCount {
+			break
+		}
+
+		// a single address of each peer keeps the link short
+		addrs, err := peer.AddrInfoToP2pAddrs(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) > 0 {
+			hints.RendezvousPoints = append(hints.RendezvousPoints, addrs[0].String())
+		}
+	}
+
+	if m.Node.Protocol.RelayHack {
+		for _, relay := range config.Config.P2P.RelayHack {
+			if len(hints.Relays) == messengertypes.ConnectionHintsMaxCount {
+				break
+			}
+			hints.Relays = append(hints.Relays, relay)
+		}
+	}
+
+	if len(hints.RendezvousPoints) == 0 && len(hints.Relays) == 0 {
+		return nil, nil
+	}
+
+	return hints, hints.IsValid()
+}
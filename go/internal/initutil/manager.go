@@ -25,6 +25,7 @@ import (
 	"berty.tech/berty/v2/go/internal/ipfsutil"
 	"berty.tech/berty/v2/go/internal/lifecycle"
 	"berty.tech/berty/v2/go/internal/notification"
+	"berty.tech/berty/v2/go/internal/sqlcipher"
 	"berty.tech/berty/v2/go/internal/tinder"
 	"berty.tech/berty/v2/go/pkg/bertymessenger"
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
@@ -102,22 +103,46 @@ type Manager struct {
 			DisableNotifications bool   `json:"DisableNotifications,omitempty"`
 			RebuildSqlite        bool   `json:"RebuildSqlite,omitempty"`
 			MessengerSqliteOpts  string `json:"MessengerSqliteOpts,omitempty"`
+			DBDriver             string `json:"DBDriver,omitempty"`
+			DBDSN                string `json:"-"`
+			Ephemeral            bool   `json:"Ephemeral,omitempty"`
 			ExportPathToRestore  string `json:"ExportPathToRestore,omitempty"`
+			BackupPathToRestore  string `json:"BackupPathToRestore,omitempty"`
+			BackupPassphrase     string `json:"-"`
+			StorageKey           string `json:"-"`
+			MatrixHomeserver     string `json:"MatrixHomeserver,omitempty"`
+			MatrixServerName     string `json:"MatrixServerName,omitempty"`
+			MatrixListener       string `json:"MatrixListener,omitempty"`
+			MatrixASToken        string `json:"-"`
+			MatrixHSToken        string `json:"-"`
+			IRCListener          string `json:"IRCListener,omitempty"`
+			IRCConversation      string `json:"IRCConversation,omitempty"`
+			IRCPassword          string `json:"-"`
+			Tracer               string `json:"Tracer,omitempty"`
+			RateLimitMember      int    `json:"RateLimitMember,omitempty"`
+			RateLimitGroup       int    `json:"RateLimitGroup,omitempty"`
+			RateLimitDrop        bool   `json:"RateLimitDrop,omitempty"`
+			APITokenRequired     bool   `json:"APITokenRequired,omitempty"`
+			Profile              string `json:"Profile,omitempty"`
 
 			// internal
 			protocolClient      bertyprotocol.Client
 			server              bertymessenger.Service
+			profileRouter       *bertymessenger.ProfileRouter
 			lcmanager           *lifecycle.Manager
 			notificationManager notification.Manager
 			client              messengertypes.MessengerServiceClient
 			db                  *gorm.DB
 			dbCleanup           func()
+			tracerCleanup       func()
+			dbConnector         *sqlcipher.Connector
 			requiredByClient    bool
 			localDBState        *messengertypes.LocalDatabaseState
 		}
 		GRPC struct {
-			RemoteAddr string `json:"RemoteAddr,omitempty"`
-			Listeners  string `json:"Listeners,omitempty"`
+			RemoteAddr     string `json:"RemoteAddr,omitempty"`
+			Listeners      string `json:"Listeners,omitempty"`
+			AllowedOrigins string `json:"AllowedOrigins,omitempty"`
 
 			// internal
 			clientConn        *grpc.ClientConn
@@ -125,6 +150,8 @@ type Manager struct {
 			bufServer         *grpc.Server
 			bufServerListener *grpcutil.BufListener
 			gatewayMux        *runtime.ServeMux
+			gatewayListener   *grpcutil.BufListener
+			gatewayClientConn *grpc.ClientConn
 			listeners         []grpcutil.Listener
 		} `json:"GRPC,omitempty"`
 	} `json:"Node,omitempty"`
@@ -183,6 +210,11 @@ func (m *Manager) applyDefaults() {
 			m.initLogger = zap.NewNop()
 		}
 	}
+
+	// the keys of an ephemeral node are never stored
+	if m.Node.Messenger.Ephemeral {
+		m.Datastore.InMemory = true
+	}
 }
 
 func (m *Manager) GetContext() context.Context {
@@ -217,12 +249,14 @@ func (m *Manager) Close(prog *progress.Progress) error {
 	}
 	prog.AddStep("cancel-context")
 	prog.AddStep("close-client-conn")
+	prog.AddStep("close-gateway-client-conn")
 	prog.AddStep("stop-buf-server")
 	prog.AddStep("close-buf-listener")
 	prog.AddStep("stop-grpc-server")
 	prog.AddStep("close-messenger-server")
 	prog.AddStep("close-messenger-protocol-client")
 	prog.AddStep("cleanup-messenger-db")
+	prog.AddStep("cleanup-messenger-tracer")
 	prog.AddStep("close-protocol-server")
 	prog.AddStep("cleanup-ipfs-webui")
 	prog.AddStep("close-ipfs-node")
@@ -239,6 +273,14 @@ func (m *Manager) Close(prog *progress.Progress) error {
 		m.Node.GRPC.clientConn.Close()
 	}
 
+	prog.Get("close-gateway-client-conn").SetAsCurrent()
+	if m.Node.GRPC.gatewayClientConn != nil {
+		m.Node.GRPC.gatewayClientConn.Close()
+	}
+	if m.Node.GRPC.gatewayListener != nil {
+		m.Node.GRPC.gatewayListener.Close()
+	}
+
 	prog.Get("stop-buf-server").SetAsCurrent()
 	if m.Node.GRPC.bufServer != nil {
 		m.Node.GRPC.bufServer.Stop()
@@ -255,7 +297,10 @@ func (m *Manager) Close(prog *progress.Progress) error {
 	}
 
 	prog.Get("close-messenger-server").SetAsCurrent()
-	if m.Node.Messenger.server != nil {
+	if m.Node.Messenger.profileRouter != nil {
+		// the router closes the messenger of the node with the other profiles
+		m.Node.Messenger.profileRouter.Close()
+	} else if m.Node.Messenger.server != nil {
 		m.Node.Messenger.server.Close()
 	}
 
@@ -269,6 +314,11 @@ func (m *Manager) Close(prog *progress.Progress) error {
 		m.Node.Messenger.dbCleanup()
 	}
 
+	prog.Get("cleanup-messenger-tracer").SetAsCurrent()
+	if m.Node.Messenger.tracerCleanup != nil {
+		m.Node.Messenger.tracerCleanup()
+	}
+
 	prog.Get("close-protocol-server").SetAsCurrent()
 	if m.Node.Protocol.server != nil {
 		m.Node.Protocol.server.Close()
@@ -1,18 +1,24 @@
 package initutil_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"gorm.io/gorm"
 	"moul.io/u"
 
 	"berty.tech/berty/v2/go/internal/initutil"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
 )
 
@@ -376,3 +382,97 @@ func TestRacyClose(t *testing.T) {
 func TestStoreOnRealFS(t *testing.T) {
 	t.Skip("TODO")
 }
+
+func TestLocalMessengerProfileSwitch(t *testing.T) {
+	ctx := context.Background()
+	manager, err := initutil.New(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, manager)
+	defer manager.Close(nil)
+
+	// configure flags
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	manager.SetupLoggingFlags(fs)
+	manager.SetupLocalMessengerServerFlags(fs)
+	manager.SetupEmptyGRPCListenersFlags(fs)
+	err = fs.Parse([]string{"-store.inmem", "-log.filters="})
+	require.NoError(t, err)
+
+	client, err := manager.GetMessengerClient()
+	require.NoError(t, err)
+
+	nodeAccount, err := client.AccountGet(ctx, &messengertypes.AccountGet_Request{})
+	require.NoError(t, err)
+
+	list, err := client.ProfileList(ctx, &messengertypes.ProfileList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.GetProfiles(), 1)
+	require.Equal(t, "default", list.GetProfiles()[0].GetID())
+
+	// the new profile has its own account
+	switched, err := client.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "work"})
+	require.NoError(t, err)
+	require.True(t, switched.GetProfile().GetIsActive())
+
+	workAccount, err := client.AccountGet(ctx, &messengertypes.AccountGet_Request{})
+	require.NoError(t, err)
+	require.NotEqual(t, nodeAccount.GetAccount().GetPublicKey(), workAccount.GetAccount().GetPublicKey())
+
+	_, err = client.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "default"})
+	require.NoError(t, err)
+
+	account, err := client.AccountGet(ctx, &messengertypes.AccountGet_Request{})
+	require.NoError(t, err)
+	require.Equal(t, nodeAccount.GetAccount().GetPublicKey(), account.GetAccount().GetPublicKey())
+
+	_, err = client.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "../escape"})
+	require.Error(t, err)
+}
+
+func TestRotateStorageKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "berty-rotate-storage-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	openDB := func(storageKey string) (*initutil.Manager, *gorm.DB, error) {
+		manager, err := initutil.New(context.Background())
+		require.NoError(t, err)
+
+		fs := flag.NewFlagSet("test", flag.ExitOnError)
+		manager.SetupLoggingFlags(fs)
+		manager.SetupLocalMessengerServerFlags(fs)
+		require.NoError(t, fs.Parse([]string{"-store.dir=" + dir, "-node.storage-key=" + storageKey, "-log.filters="}))
+
+		db, err := manager.GetMessengerDB()
+		if err == nil {
+			// the key is only checked on the first read
+			err = db.Exec("SELECT count(*) FROM sqlite_master").Error
+		}
+		return manager, db, err
+	}
+
+	manager, db, err := openDB(oldKey)
+	require.NoError(t, err)
+	require.NoError(t, db.Exec("CREATE TABLE rotated (value TEXT)").Error)
+	require.NoError(t, db.Exec("INSERT INTO rotated (value) VALUES ('kept')").Error)
+
+	// the db is rekeyed while it is open
+	require.NoError(t, manager.RotateStorageKey(newKey))
+	require.NoError(t, db.Exec("INSERT INTO rotated (value) VALUES ('after')").Error)
+	manager.Close(nil)
+
+	manager, _, err = openDB(oldKey)
+	require.Error(t, err)
+	manager.Close(nil)
+
+	manager, db, err = openDB(base64.StdEncoding.EncodeToString(newKey))
+	require.NoError(t, err)
+	defer manager.Close(nil)
+
+	var values []string
+	require.NoError(t, db.Raw("SELECT value FROM rotated ORDER BY value").Scan(&values).Error)
+	require.Equal(t, []string{"after", "kept"}, values)
+}
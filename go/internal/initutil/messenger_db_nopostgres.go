@@ -0,0 +1,15 @@
+// +build !postgres
+
+package initutil
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+func openPostgresDialector(string) (gorm.Dialector, error) {
+	return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("this node has been built without the postgres tag"))
+}
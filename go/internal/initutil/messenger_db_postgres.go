@@ -0,0 +1,14 @@
+// +build postgres
+
+package initutil
+
+import (
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// openPostgresDialector opens the messenger db on a postgres server, the driver is only linked in the nodes built with
+// the postgres tag
+func openPostgresDialector(dsn string) (gorm.Dialector, error) {
+	return postgres.Open(dsn), nil
+}
@@ -3,6 +3,7 @@ package initutil
 import (
 	"context"
 	"crypto/ed25519"
+	"database/sql"
 	"encoding/base64"
 	"flag"
 	"fmt"
@@ -18,6 +19,7 @@ import (
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
 	grpcgw "github.com/grpc-ecosystem/grpc-gateway/runtime"
 	datastore "github.com/ipfs/go-datastore"
+	"go.opentelemetry.io/otel/api/trace"
 	grpc_trace "go.opentelemetry.io/otel/instrumentation/grpctrace"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -27,9 +29,11 @@ import (
 	"gorm.io/gorm"
 	"moul.io/zapgorm2"
 
+	"berty.tech/berty/v2/go/internal/cryptoutil"
 	"berty.tech/berty/v2/go/internal/grpcutil"
 	"berty.tech/berty/v2/go/internal/ipfsutil"
 	"berty.tech/berty/v2/go/internal/lifecycle"
+	"berty.tech/berty/v2/go/internal/sqlcipher"
 	"berty.tech/berty/v2/go/internal/tracer"
 	"berty.tech/berty/v2/go/pkg/bertymessenger"
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
@@ -62,11 +66,13 @@ func (m *Manager) SetupProtocolAuth(fs *flag.FlagSet) {
 
 func (m *Manager) SetupEmptyGRPCListenersFlags(fs *flag.FlagSet) {
 	fs.StringVar(&m.Node.GRPC.Listeners, "node.listeners", "", "gRPC API listeners")
+	fs.StringVar(&m.Node.GRPC.AllowedOrigins, "node.listeners-allowed-origins", "", "web origins allowed to call the gRPC-Web and gateway listeners, comma separated, * allows any")
 	fs.StringVar(&m.Node.Protocol.IPFSWebUIListener, "p2p.webui-listener", "", "IPFS WebUI listener")
 }
 
 func (m *Manager) SetupDefaultGRPCListenersFlags(fs *flag.FlagSet) {
 	fs.StringVar(&m.Node.GRPC.Listeners, "node.listeners", "/ip4/127.0.0.1/tcp/9091/grpc", "gRPC API listeners")
+	fs.StringVar(&m.Node.GRPC.AllowedOrigins, "node.listeners-allowed-origins", "", "web origins allowed to call the gRPC-Web and gateway listeners, comma separated, * allows any")
 	fs.StringVar(&m.Node.Protocol.IPFSWebUIListener, "p2p.webui-listener", ":3999", "IPFS WebUI listener")
 }
 
@@ -100,9 +106,29 @@ func (m *Manager) SetupLocalMessengerServerFlags(fs *flag.FlagSet) {
 	m.SetupLocalProtocolServerFlags(fs)
 	m.SetupNotificationManagerFlags(fs)
 	fs.StringVar(&m.Node.Messenger.ExportPathToRestore, "node.restore-export-path", "", "inits node from a specified export path")
+	fs.StringVar(&m.Node.Messenger.BackupPathToRestore, "node.restore-backup-path", "", "inits node from a specified encrypted backup path")
+	fs.StringVar(&m.Node.Messenger.BackupPassphrase, "node.restore-backup-passphrase", "", "passphrase of the backup to restore")
+	fs.StringVar(&m.Node.Messenger.StorageKey, "node.storage-key", "", "base64 encoded key of the account storage, the messenger db is encrypted at rest when set")
 	fs.BoolVar(&m.Node.Messenger.RebuildSqlite, "node.rebuild-db", false, "reconstruct messenger DB from OrbitDB logs")
+	fs.BoolVar(&m.Node.Messenger.Ephemeral, "node.ephemeral", false, "keep the messenger db and the account keys in memory, the db is rebuilt from the logs on each start")
+	fs.StringVar(&m.Node.Messenger.DBDriver, "node.db-driver", "sqlite", "storage backend of the messenger db: sqlite or postgres, postgres requires a node built with the postgres tag")
+	fs.StringVar(&m.Node.Messenger.DBDSN, "node.db-dsn", "", "connection string of the postgres messenger db, ie. \"host=localhost user=berty dbname=berty\"")
 	fs.BoolVar(&m.Node.Messenger.DisableGroupMonitor, "node.disable-group-monitor", false, "disable group monitoring")
 	fs.StringVar(&m.Node.Messenger.DisplayName, "node.display-name", safeDefaultDisplayName(), "display name")
+	fs.StringVar(&m.Node.Messenger.MatrixHomeserver, "node.matrix-homeserver", "", "url of the matrix homeserver, the matrix bridge is enabled when set")
+	fs.StringVar(&m.Node.Messenger.MatrixServerName, "node.matrix-server-name", "", "server name of the matrix user ids")
+	fs.StringVar(&m.Node.Messenger.MatrixListener, "node.matrix-listener", "127.0.0.1:9009", "address of the matrix application service api")
+	fs.StringVar(&m.Node.Messenger.MatrixASToken, "node.matrix-as-token", "", "application service token of the matrix registration")
+	fs.StringVar(&m.Node.Messenger.MatrixHSToken, "node.matrix-hs-token", "", "homeserver token of the matrix registration")
+	fs.StringVar(&m.Node.Messenger.IRCConversation, "node.irc-conversation", "", "public key of the conversation exposed over irc, the irc gateway is enabled when set")
+	fs.StringVar(&m.Node.Messenger.IRCListener, "node.irc-listener", "127.0.0.1:6667", "loopback address of the irc gateway")
+	fs.StringVar(&m.Node.Messenger.IRCPassword, "node.irc-password", "", "password required from the irc clients")
+	fs.IntVar(&m.Node.Messenger.RateLimitMember, "node.rate-limit-member", 0, "max message events per minute from each device of a group, the next ones are deferred, 0 to disable")
+	fs.IntVar(&m.Node.Messenger.RateLimitGroup, "node.rate-limit-group", 0, "max events per minute from each group, the next ones are deferred, 0 to disable")
+	fs.BoolVar(&m.Node.Messenger.RateLimitDrop, "node.rate-limit-drop", false, "drop the events exceeding the rate limits instead of deferring them")
+	fs.BoolVar(&m.Node.Messenger.APITokenRequired, "node.messenger-api-token-required", false, "refuse the calls to the messenger api without an api token")
+	fs.StringVar(&m.Node.Messenger.Profile, "node.profile", defaultProfileID, "id of the profile active at startup, the other profiles are stored in the profiles directory of the node")
+	fs.StringVar(&m.Node.Messenger.Tracer, "node.messenger-tracer", "", `exporter of the message delivery spans, "stdout" or <hostname:port> of jaeger, the -log.tracer exporter is used if empty`)
 	// node.db-opts // see https://github.com/mattn/go-sqlite3#connection-string
 }
 
@@ -268,8 +294,11 @@ func (m *Manager) getGRPCClientConn() (*grpc.ClientConn, error) {
 			}
 		}
 
-		// gRPC server
-		serverOpts := []grpc.ServerOption{} // FIXME: tracing
+		// gRPC server, the calls of the messenger are routed to the active profile
+		serverOpts := []grpc.ServerOption{ // FIXME: tracing
+			grpc.UnaryInterceptor(m.profileUnaryServerInterceptor()),
+			grpc.StreamInterceptor(m.profileStreamServerInterceptor()),
+		}
 		grpcServer := grpc.NewServer(serverOpts...)
 
 		// buffer-based client conn
@@ -418,6 +447,14 @@ func (m *Manager) getGRPCServer() (*grpc.Server, *grpcgw.ServeMux, error) {
 		authFunc = man.GRPCAuthInterceptor(bertyprotocol.ServiceReplicationID)
 	}
 
+	// the api tokens of the messenger are checked once the messenger is running, against the active profile
+	getMessenger := func() bertymessenger.Service {
+		if router := m.Node.Messenger.profileRouter; router != nil {
+			return router.Active()
+		}
+		return m.Node.Messenger.server
+	}
+
 	grpcOpts := []grpc.ServerOption{
 		grpc_middleware.WithUnaryServerChain(
 			grpc_recovery.UnaryServerInterceptor(recoverOpts...),
@@ -425,6 +462,8 @@ func (m *Manager) getGRPCServer() (*grpc.Server, *grpcgw.ServeMux, error) {
 			grpc_zap.UnaryServerInterceptor(grpcLogger, zapOpts...),
 			grpc_trace.UnaryServerInterceptor(tr),
 			grpc_auth.UnaryServerInterceptor(authFunc),
+			bertymessenger.APITokenUnaryServerInterceptor(getMessenger, m.Node.Messenger.APITokenRequired),
+			m.profileUnaryServerInterceptor(),
 		),
 		grpc_middleware.WithStreamServerChain(
 			grpc_recovery.StreamServerInterceptor(recoverOpts...),
@@ -432,6 +471,8 @@ func (m *Manager) getGRPCServer() (*grpc.Server, *grpcgw.ServeMux, error) {
 			grpc_trace.StreamServerInterceptor(tr),
 			grpc_zap.StreamServerInterceptor(grpcLogger, zapOpts...),
 			grpc_auth.StreamServerInterceptor(authFunc),
+			bertymessenger.APITokenStreamServerInterceptor(getMessenger, m.Node.Messenger.APITokenRequired),
+			m.profileStreamServerInterceptor(),
 		),
 	}
 
@@ -447,8 +488,12 @@ func (m *Manager) getGRPCServer() (*grpc.Server, *grpcgw.ServeMux, error) {
 		m.Node.GRPC.listeners = make([]grpcutil.Listener, len(maddrs))
 
 		server := grpcutil.Server{
-			GRPCServer: grpcServer,
-			GatewayMux: grpcGatewayMux,
+			GRPCServer:     grpcServer,
+			GatewayMux:     grpcGatewayMux,
+			GatewayStreams: messengerGatewayStreams,
+		}
+		if m.Node.GRPC.AllowedOrigins != "" {
+			server.AllowedOrigins = strings.Split(m.Node.GRPC.AllowedOrigins, ",")
 		}
 
 		for idx, maddr := range maddrs {
@@ -475,6 +520,37 @@ func (m *Manager) getGRPCServer() (*grpc.Server, *grpcgw.ServeMux, error) {
 	return m.Node.GRPC.server, m.Node.GRPC.gatewayMux, nil
 }
 
+// messengerGatewayStreams are the streams of the messenger which can be read from the gateway with a GET request, they
+// don't change the state of the account
+var messengerGatewayStreams = []string{
+	"/berty.messenger.v1/MessengerService/EventStream",
+	"/berty.messenger.v1/MessengerService/ConversationStream",
+}
+
+// getGatewayClientConn returns a connection to the gRPC server, served once the workers are started like the other
+// listeners
+func (m *Manager) getGatewayClientConn(grpcServer *grpc.Server) (*grpc.ClientConn, error) {
+	if m.Node.GRPC.gatewayClientConn != nil {
+		return m.Node.GRPC.gatewayClientConn, nil
+	}
+
+	bl := grpcutil.NewBufListener(m.getContext(), 256*1024)
+	cc, err := bl.NewClientConn()
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	m.workers.Add(func() error {
+		return grpcServer.Serve(bl)
+	}, func(error) {
+		bl.Close()
+	})
+
+	m.Node.GRPC.gatewayListener = bl
+	m.Node.GRPC.gatewayClientConn = cc
+	return cc, nil
+}
+
 func (m *Manager) GetGRPCListeners() []grpcutil.Listener {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -513,33 +589,136 @@ func (m *Manager) getMessengerDB() (*gorm.DB, error) {
 		Logger:                                   zapgorm2.New(logger.Named("gorm")),
 		DisableForeignKeyConstraintWhenMigrating: true,
 	}
-	db, err := gorm.Open(sqlite.Open(sqliteConn), cfg)
+
+	switch m.Node.Messenger.DBDriver {
+	case "", "sqlite":
+	case bertymessenger.PostgresStorageBackend:
+		return m.getPostgresMessengerDB(cfg)
+	default:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown db driver %q", m.Node.Messenger.DBDriver))
+	}
+
+	db, connector, err := m.openSqliteMessengerDB(sqliteConn, cfg)
 	if err != nil {
-		return nil, errcode.TODO.Wrap(err)
+		return nil, err
 	}
 
 	m.Node.Messenger.db = db
-	m.Node.Messenger.dbCleanup = func() {
-		sqlDB, _ := db.DB()
-		if sqlDB != nil {
-			sqlDB.Close()
+	m.Node.Messenger.dbConnector = connector
+	m.Node.Messenger.dbCleanup = func() { closeMessengerDB(db) }
+	return m.Node.Messenger.db, nil
+}
+
+// openSqliteMessengerDB opens a sqlite messenger db, the connector is nil when the db isn't encrypted
+func (m *Manager) openSqliteMessengerDB(sqliteConn string, cfg *gorm.Config) (*gorm.DB, *sqlcipher.Connector, error) {
+	var (
+		dialector = sqlite.Open(sqliteConn)
+		connector *sqlcipher.Connector
+	)
+
+	// an in memory db is never stored, it doesn't need to be encrypted
+	if m.Node.Messenger.StorageKey != "" && sqliteConn != ":memory:" {
+		storageKey, err := base64.StdEncoding.DecodeString(m.Node.Messenger.StorageKey)
+		if err != nil {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid storage key: %w", err))
+		}
+
+		var sqlDB *sql.DB
+		if sqlDB, connector, err = sqlcipher.Open(sqliteConn, messengerDBKey(storageKey)); err != nil {
+			return nil, nil, errcode.TODO.Wrap(err)
 		}
+
+		dialector = &sqlite.Dialector{Conn: sqlDB}
+	}
+
+	db, err := gorm.Open(dialector, cfg)
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	return db, connector, nil
+}
+
+func closeMessengerDB(db *gorm.DB) {
+	sqlDB, _ := db.DB()
+	if sqlDB != nil {
+		sqlDB.Close()
+	}
+}
+
+// getPostgresMessengerDB opens the messenger db on a postgres server, it can be shared by the nodes of a headless
+// deployment and is not encrypted by the storage key
+func (m *Manager) getPostgresMessengerDB(cfg *gorm.Config) (*gorm.DB, error) {
+	if m.Node.Messenger.DBDSN == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("a postgres connection string is required"))
 	}
+
+	dialector, err := openPostgresDialector(m.Node.Messenger.DBDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := gorm.Open(dialector, cfg)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	m.Node.Messenger.db = db
+	m.Node.Messenger.dbCleanup = func() { closeMessengerDB(db) }
 	return m.Node.Messenger.db, nil
 }
 
+// messengerDBKey derives the key of the messenger db from the key of the account storage
+func messengerDBKey(storageKey []byte) []byte {
+	key := cryptoutil.ConcatAndHashSha256(storageKey, []byte("messenger-db"))
+	return key[:]
+}
+
+// RotateStorageKey encrypts the messenger db with a key derived from a new storage key while the node is running
+func (m *Manager) RotateStorageKey(storageKey []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.Node.Messenger.db == nil || m.Node.Messenger.dbConnector == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the messenger db is not encrypted"))
+	}
+
+	sqlDB, err := m.Node.Messenger.db.DB()
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := m.Node.Messenger.dbConnector.Rekey(m.getContext(), sqlDB, messengerDBKey(storageKey)); err != nil {
+		return err
+	}
+
+	m.Node.Messenger.StorageKey = base64.StdEncoding.EncodeToString(storageKey)
+
+	return nil
+}
+
 func (m *Manager) restoreMessengerDataFromExport() error {
-	if m.Node.Messenger.ExportPathToRestore == "" {
+	if m.Node.Messenger.ExportPathToRestore == "" && m.Node.Messenger.BackupPathToRestore == "" {
 		return nil
 	}
 
-	f, err := os.Open(m.Node.Messenger.ExportPathToRestore)
+	path := m.Node.Messenger.ExportPathToRestore
+	if path == "" {
+		path = m.Node.Messenger.BackupPathToRestore
+	}
+
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = f.Close() }()
 
+	passphrase := m.Node.Messenger.BackupPassphrase
+	isBackup := m.Node.Messenger.ExportPathToRestore == ""
+
 	m.Node.Messenger.ExportPathToRestore = ""
+	m.Node.Messenger.BackupPathToRestore = ""
+	m.Node.Messenger.BackupPassphrase = ""
 
 	logger, err := m.getLogger()
 	if err != nil {
@@ -558,6 +737,14 @@ func (m *Manager) restoreMessengerDataFromExport() error {
 
 	m.Node.Messenger.localDBState = &messengertypes.LocalDatabaseState{}
 
+	if isBackup {
+		if err := bertymessenger.RestoreFromAccountBackup(m.ctx, f, []byte(passphrase), coreAPI, odb, m.Node.Messenger.localDBState, logger); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		return nil
+	}
+
 	if err := bertymessenger.RestoreFromAccountExport(m.ctx, f, coreAPI, odb, m.Node.Messenger.localDBState, logger); err != nil {
 		return errcode.ErrInternal.Wrap(err)
 	}
@@ -587,10 +774,12 @@ func (m *Manager) getLocalMessengerServer() (messengertypes.MessengerServiceServ
 		return nil, errcode.TODO.Wrap(err)
 	}
 
-	// messenger db
-	db, err := m.getMessengerDB()
-	if err != nil {
-		return nil, errcode.TODO.Wrap(err)
+	// messenger db, an ephemeral messenger opens its own one in memory
+	var db *gorm.DB
+	if !m.Node.Messenger.Ephemeral {
+		if db, err = m.getMessengerDB(); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
 	}
 
 	// grpc server
@@ -611,8 +800,15 @@ func (m *Manager) getLocalMessengerServer() (messengertypes.MessengerServiceServ
 		return nil, errcode.TODO.Wrap(err)
 	}
 
-	// protocol client
-	protocolClient, err := bertyprotocol.NewClient(m.getContext(), protocolServer, nil, nil) // FIXME: setup tracing
+	// protocol client, the interceptors pass the span context of the sent messages to the protocol
+	trClient, trServer := tracer.New("grpc-client"), tracer.New("grpc-server")
+	protocolClient, err := bertyprotocol.NewClient(m.getContext(), protocolServer, []grpc.DialOption{
+		grpc.WithUnaryInterceptor(grpc_trace.UnaryClientInterceptor(trClient)),
+		grpc.WithStreamInterceptor(grpc_trace.StreamClientInterceptor(trClient)),
+	}, []grpc.ServerOption{
+		grpc.UnaryInterceptor(grpc_trace.UnaryServerInterceptor(trServer)),
+		grpc.StreamInterceptor(grpc_trace.StreamServerInterceptor(trServer)),
+	})
 	if err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
@@ -620,6 +816,17 @@ func (m *Manager) getLocalMessengerServer() (messengertypes.MessengerServiceServ
 
 	lcmanager := m.getLifecycleManager()
 
+	// the messenger exports its spans apart from the other ones when a tracer is set
+	var tracerProvider trace.Provider
+	if m.Node.Messenger.Tracer != "" {
+		provider, cleanup, err := tracer.ConfigureProvider(tracer.ConfigFromFlag(m.Node.Messenger.Tracer, "berty-messenger"))
+		if err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+		tracerProvider = provider
+		m.Node.Messenger.tracerCleanup = cleanup
+	}
+
 	// messenger server
 	opts := bertymessenger.Opts{
 		EnableGroupMonitor:  !m.Node.Messenger.DisableGroupMonitor,
@@ -628,15 +835,59 @@ func (m *Manager) getLocalMessengerServer() (messengertypes.MessengerServiceServ
 		NotificationManager: notifmanager,
 		LifeCycleManager:    lcmanager,
 		StateBackup:         m.Node.Messenger.localDBState,
+		Ephemeral:           m.Node.Messenger.Ephemeral,
+		TracerProvider:      tracerProvider,
+	}
+	if m.Node.Messenger.MatrixHomeserver != "" {
+		opts.MatrixBridge = &bertymessenger.MatrixBridgeOpts{
+			HomeserverURL: m.Node.Messenger.MatrixHomeserver,
+			ServerName:    m.Node.Messenger.MatrixServerName,
+			ASToken:       m.Node.Messenger.MatrixASToken,
+			HSToken:       m.Node.Messenger.MatrixHSToken,
+			ListenAddr:    m.Node.Messenger.MatrixListener,
+		}
+	}
+	if m.Node.Messenger.RateLimitMember > 0 || m.Node.Messenger.RateLimitGroup > 0 {
+		opts.RateLimit = &bertymessenger.RateLimitOpts{
+			MemberEventsPerMinute: m.Node.Messenger.RateLimitMember,
+			GroupEventsPerMinute:  m.Node.Messenger.RateLimitGroup,
+			Drop:                  m.Node.Messenger.RateLimitDrop,
+		}
+	}
+	if hints, err := m.getConnectionHints(); err != nil {
+		logger.Warn("unable to get the connection hints of the contact links", zap.Error(err))
+	} else {
+		opts.ConnectionHints = hints
+	}
+	if m.Node.Messenger.IRCConversation != "" {
+		opts.IRCGateway = &bertymessenger.IRCGatewayOpts{
+			ListenAddr:            m.Node.Messenger.IRCListener,
+			ConversationPublicKey: m.Node.Messenger.IRCConversation,
+			Password:              m.Node.Messenger.IRCPassword,
+		}
 	}
 	messengerServer, err := bertymessenger.New(protocolClient, &opts)
 	if err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
+	// the messenger of the node is the first active profile, the others are opened on their first switch
+	router, err := m.newProfileRouter(messengerServer)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+	m.Node.Messenger.profileRouter = router
+
 	// register grpc service
 	messengertypes.RegisterMessengerServiceServer(grpcServer, messengerServer)
-	if err := messengertypes.RegisterMessengerServiceHandlerServer(m.getContext(), gatewayMux, messengerServer); err != nil {
+
+	// the in-process gateway transport doesn't support the streams, the gateway calls the gRPC server through a
+	// loopback connection instead
+	gatewayConn, err := m.getGatewayClientConn(grpcServer)
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+	if err := messengertypes.RegisterMessengerServiceHandlerClient(m.getContext(), gatewayMux, messengertypes.NewMessengerServiceClient(gatewayConn)); err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
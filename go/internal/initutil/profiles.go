@@ -0,0 +1,191 @@
+package initutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	datastore "github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"gorm.io/gorm"
+	"moul.io/zapgorm2"
+
+	"berty.tech/berty/v2/go/internal/ipfsutil"
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	defaultProfileID = "default"
+	// profilesDirectory holds the messenger db and the orbitdb directory of the profiles other than the one of the node
+	profilesDirectory = "profiles"
+)
+
+// the id of a profile is a directory and a datastore namespace
+var profileIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// profileUnaryServerInterceptor routes the calls of the messenger to the active profile once the messenger is running
+func (m *Manager) profileUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if router := m.Node.Messenger.profileRouter; router != nil {
+			return router.UnaryServerInterceptor()(ctx, req, info, handler)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// profileStreamServerInterceptor runs the streams of the messenger on the active profile once the messenger is running
+func (m *Manager) profileStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if router := m.Node.Messenger.profileRouter; router != nil {
+			return router.StreamServerInterceptor()(srv, ss, info, handler)
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// newProfileRouter makes the messenger of the node the active profile, it can't be opened again once it is closed
+// since its db and protocol are released with the node
+func (m *Manager) newProfileRouter(nodeMessenger bertymessenger.Service) (*bertymessenger.ProfileRouter, error) {
+	logger, err := m.getLogger()
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	nodeProfileID := m.Node.Messenger.Profile
+	if nodeProfileID == "" {
+		nodeProfileID = defaultProfileID
+	}
+
+	nodeProfileClosed := false
+	return bertymessenger.NewProfileRouter(m.getContext(), bertymessenger.ProfileRouterOpts{
+		Logger: logger.Named("profiles"),
+		Open: func(ctx context.Context, profileID string) (bertymessenger.Service, func(), error) {
+			if profileID != nodeProfileID {
+				// the profiles are opened while the node is running, like the other getters
+				m.mutex.Lock()
+				defer m.mutex.Unlock()
+
+				return m.openMessengerProfile(ctx, profileID)
+			}
+
+			if nodeProfileClosed {
+				return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the profile of the node has been closed"))
+			}
+
+			return nodeMessenger, func() { nodeProfileClosed = true }, nil
+		},
+	}, nodeProfileID)
+}
+
+// openMessengerProfile opens the messenger of a profile other than the one of the node, with its own messenger db and
+// protocol instance. They share the ipfs node of the node, the contact requests are only handled by the profile of the
+// node since the host accepts a single handler for them
+func (m *Manager) openMessengerProfile(ctx context.Context, profileID string) (bertymessenger.Service, func(), error) {
+	if !profileIDPattern.MatchString(profileID) {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid profile id %q", profileID))
+	}
+
+	if m.Node.Messenger.DBDriver == bertymessenger.PostgresStorageBackend {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the profiles require a sqlite messenger db"))
+	}
+
+	logger, err := m.getLogger()
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+	logger = logger.With(zap.String("profile-id", profileID))
+
+	dir, err := m.getDatastoreDir()
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	profileDir, sqliteConn := bertyprotocol.InMemoryDirectory, ":memory:"
+	if dir != InMemoryDir {
+		profileDir = filepath.Join(dir, profilesDirectory, profileID)
+		sqliteConn = filepath.Join(profileDir, "messenger.sqlite")
+
+		if err := os.MkdirAll(profileDir, 0o700); err != nil {
+			return nil, nil, errcode.TODO.Wrap(err)
+		}
+	}
+
+	rootDS, err := m.getRootDatastore()
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	ipfs, node, err := m.getLocalIPFS()
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	// the keys and the logs of the profile are stored apart from the ones of the node
+	protocolServer, err := bertyprotocol.New(ctx, bertyprotocol.Opts{
+		Host:          node.PeerHost,
+		PubSub:        m.Node.Protocol.pubsub,
+		IpfsCoreAPI:   ipfs,
+		Logger:        logger,
+		RootDatastore: ipfsutil.NewNamespacedDatastore(rootDS, datastore.NewKey(profilesDirectory).ChildString(profileID)),
+		DatastoreDir:  profileDir,
+	})
+	if err != nil {
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	protocolClient, err := bertyprotocol.NewClient(ctx, protocolServer, nil, nil)
+	if err != nil {
+		protocolServer.Close()
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	// an ephemeral messenger opens its own db in memory
+	var db *gorm.DB
+	if !m.Node.Messenger.Ephemeral {
+		db, _, err = m.openSqliteMessengerDB(sqliteConn, &gorm.Config{
+			Logger:                                   zapgorm2.New(logger.Named("gorm")),
+			DisableForeignKeyConstraintWhenMigrating: true,
+		})
+		if err != nil {
+			protocolClient.Close()
+			protocolServer.Close()
+			return nil, nil, err
+		}
+	}
+
+	cleanup := func() {
+		if db != nil {
+			closeMessengerDB(db)
+		}
+		protocolClient.Close()
+		protocolServer.Close()
+	}
+
+	notifmanager, err := m.getNotificationManager()
+	if err != nil {
+		cleanup()
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	svc, err := bertymessenger.New(protocolClient, &bertymessenger.Opts{
+		EnableGroupMonitor:  !m.Node.Messenger.DisableGroupMonitor,
+		DB:                  db,
+		Logger:              logger,
+		NotificationManager: notifmanager,
+		LifeCycleManager:    m.getLifecycleManager(),
+		Ephemeral:           m.Node.Messenger.Ephemeral,
+	})
+	if err != nil {
+		cleanup()
+		return nil, nil, errcode.TODO.Wrap(err)
+	}
+
+	return svc, cleanup, nil
+}
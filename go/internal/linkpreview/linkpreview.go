@@ -0,0 +1,244 @@
+// Package linkpreview extracts urls from a text and fetches their open graph metadata.
+package linkpreview
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	DefaultMaxBodySize  = 512 * 1024
+	DefaultMaxImageSize = 1024 * 1024
+	DefaultMaxURLs      = 3
+)
+
+var urlRegexp = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// FindURLs returns the distinct http(s) urls found in text, in order of appearance
+func FindURLs(text string, max int) []string {
+	seen := map[string]struct{}{}
+	urls := []string(nil)
+
+	for _, match := range urlRegexp.FindAllString(text, -1) {
+		// strip trailing punctuation that is most likely part of the sentence
+		match = strings.TrimRight(match, ".,;:!?)]}")
+
+		u, err := url.Parse(match)
+		if err != nil || u.Host == "" {
+			continue
+		}
+
+		if _, ok := seen[match]; ok {
+			continue
+		}
+		seen[match] = struct{}{}
+
+		urls = append(urls, match)
+		if max > 0 && len(urls) >= max {
+			break
+		}
+	}
+
+	return urls
+}
+
+// Preview contains the metadata of a web page
+type Preview struct {
+	URL         string
+	Title       string
+	Description string
+	SiteName    string
+	ImageURL    string
+}
+
+// Fetcher retrieves link previews over http
+type Fetcher struct {
+	Client       *http.Client
+	MaxBodySize  int64
+	MaxImageSize int64
+}
+
+func (f *Fetcher) client() *http.Client {
+	if f.Client == nil {
+		return http.DefaultClient
+	}
+	return f.Client
+}
+
+func (f *Fetcher) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := f.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	return res, nil
+}
+
+// Fetch downloads the page at target and extracts its preview
+func (f *Fetcher) Fetch(ctx context.Context, target string) (*Preview, error) {
+	res, err := f.get(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || mediaType != "text/html" {
+		return nil, fmt.Errorf("unsupported content type: %q", res.Header.Get("Content-Type"))
+	}
+
+	maxSize := f.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+
+	preview, err := Parse(io.LimitReader(res.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	preview.URL = target
+
+	// resolve relative image urls against the final page location
+	if preview.ImageURL != "" {
+		if u, err := res.Request.URL.Parse(preview.ImageURL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			preview.ImageURL = u.String()
+		} else {
+			preview.ImageURL = ""
+		}
+	}
+
+	return preview, nil
+}
+
+// FetchImage downloads the image at target and returns its content and mime type
+func (f *Fetcher) FetchImage(ctx context.Context, target string) ([]byte, string, error) {
+	res, err := f.get(ctx, target)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		return nil, "", fmt.Errorf("unsupported content type: %q", res.Header.Get("Content-Type"))
+	}
+
+	maxSize := f.MaxImageSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxImageSize
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("image exceeds max size of %d bytes", maxSize)
+	}
+
+	return data, mediaType, nil
+}
+
+// Parse extracts the preview metadata from an html document, open graph values take precedence over the standard ones
+func Parse(r io.Reader) (*Preview, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		preview         = &Preview{}
+		title, descr    string
+		ogTitle, ogDesc string
+	)
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if title == "" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+					title = n.FirstChild.Data
+				}
+			case "meta":
+				key, content := metaAttrs(n)
+				switch key {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDesc = content
+				case "og:site_name":
+					preview.SiteName = content
+				case "og:image", "og:image:url":
+					if preview.ImageURL == "" {
+						preview.ImageURL = content
+					}
+				case "description":
+					descr = content
+				}
+			case "body":
+				// metadata is expected in the head
+				return
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	preview.Title = strings.TrimSpace(firstNonEmpty(ogTitle, title))
+	preview.Description = strings.TrimSpace(firstNonEmpty(ogDesc, descr))
+	preview.SiteName = strings.TrimSpace(preview.SiteName)
+	preview.ImageURL = strings.TrimSpace(preview.ImageURL)
+
+	if preview.Title == "" && preview.Description == "" {
+		return nil, fmt.Errorf("no metadata found")
+	}
+
+	return preview, nil
+}
+
+func metaAttrs(n *html.Node) (string, string) {
+	key, content := "", ""
+	for _, attr := range n.Attr {
+		switch strings.ToLower(attr.Key) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(attr.Val)
+			}
+		case "content":
+			content = attr.Val
+		}
+	}
+	return key, content
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package linkpreview
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindURLs(t *testing.T) {
+	cases := []struct {
+		name     string
+		text     string
+		max      int
+		expected []string
+	}{
+		{"no url", "hello world", 0, nil},
+		{"single", "see https://berty.tech/docs.", 0, []string{"https://berty.tech/docs"}},
+		{"several", "http://a.com and (https://b.com/x?y=1), http://a.com", 0, []string{"http://a.com", "https://b.com/x?y=1"}},
+		{"limited", "http://a.com http://b.com http://c.com", 2, []string{"http://a.com", "http://b.com"}},
+		{"ignore other schemes", "ftp://a.com berty://id/abc", 0, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, FindURLs(c.text, c.max))
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	preview, err := Parse(strings.NewReader(`<html><head>
+<title>Fallback title</title>
+<meta name="description" content="Fallback description">
+<meta property="og:title" content=" Berty ">
+<meta property="og:site_name" content="berty.tech">
+<meta property="og:image" content="/logo.png">
+</head><body><p>content</p></body></html>`))
+	require.NoError(t, err)
+	require.Equal(t, "Berty", preview.Title)
+	require.Equal(t, "Fallback description", preview.Description)
+	require.Equal(t, "berty.tech", preview.SiteName)
+	require.Equal(t, "/logo.png", preview.ImageURL)
+
+	_, err = Parse(strings.NewReader(`<html><body>nothing</body></html>`))
+	require.Error(t, err)
+}
+
+func TestFetcher(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><title>Page</title><meta property="og:image" content="/img"></head></html>`))
+	})
+	mux.HandleFunc("/img", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("0123456789"))
+	})
+	mux.HandleFunc("/bin", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	f := &Fetcher{Client: srv.Client(), MaxImageSize: 10}
+
+	preview, err := f.Fetch(ctx, srv.URL+"/page")
+	require.NoError(t, err)
+	require.Equal(t, "Page", preview.Title)
+	require.Equal(t, srv.URL+"/img", preview.ImageURL)
+
+	data, mimeType, err := f.FetchImage(ctx, preview.ImageURL)
+	require.NoError(t, err)
+	require.Equal(t, "image/png", mimeType)
+	require.Len(t, data, 10)
+
+	_, err = f.Fetch(ctx, srv.URL+"/bin")
+	require.Error(t, err)
+
+	_, err = f.Fetch(ctx, srv.URL+"/missing")
+	require.Error(t, err)
+
+	f.MaxImageSize = 5
+	_, _, err = f.FetchImage(ctx, preview.ImageURL)
+	require.Error(t, err)
+}
@@ -0,0 +1,4 @@
+// Package sqlcipher opens SQLite databases encrypted at rest with SQLCipher.
+//
+// The sqlite3 library must be built with SQLCipher, ie. by linking against libsqlcipher with the `libsqlite3` build tag.
+package sqlcipher
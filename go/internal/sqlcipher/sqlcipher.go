@@ -0,0 +1,237 @@
+package sqlcipher
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const KeySize = 32
+
+// plaintextHeader is the header of the SQLite databases which are not encrypted
+var plaintextHeader = []byte("SQLite format 3\x00")
+
+// Connector opens the connections to an encrypted database, it implements driver.Connector so it can be given to
+// sql.OpenDB
+type Connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+
+	// mutex protects the key while it is rotated, the connections can't be opened meanwhile
+	mutex      sync.RWMutex
+	key        []byte
+	generation uint64
+}
+
+// conn is a connection opened with a key, it is discarded once the key has been rotated
+type conn struct {
+	*sqlite3.SQLiteConn
+
+	connector  *Connector
+	generation uint64
+}
+
+// Unwrap returns the underlying sqlite connection, ie. to use its backup API
+func (c *conn) Unwrap() *sqlite3.SQLiteConn {
+	return c.SQLiteConn
+}
+
+func (c *conn) isStale() bool {
+	c.connector.mutex.RLock()
+	defer c.connector.mutex.RUnlock()
+
+	return c.generation != c.connector.generation
+}
+
+// ResetSession is called by database/sql before reusing a connection
+func (c *conn) ResetSession(ctx context.Context) error {
+	if c.isStale() {
+		return driver.ErrBadConn
+	}
+
+	return nil
+}
+
+// IsValid is called by database/sql before putting a connection back in the pool
+func (c *conn) IsValid() bool {
+	return !c.isStale()
+}
+
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	dc, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	sc, ok := dc.(*sqlite3.SQLiteConn)
+	if !ok {
+		_ = dc.Close()
+		return nil, errcode.ErrInternal.Wrap(fmt.Errorf("unexpected sqlite connection type %T", dc))
+	}
+
+	if _, err := sc.Exec(keyPragma("key", c.key), nil); err != nil {
+		_ = sc.Close()
+		return nil, errcode.ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	return &conn{SQLiteConn: sc, connector: c, generation: c.generation}, nil
+}
+
+func (c *Connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Rekey encrypts the database with a new key while it is open, the connections opened with the previous key are
+// discarded by the pool before being used again
+func (c *Connector) Rekey(ctx context.Context, db *sql.DB, key []byte) error {
+	if len(key) != KeySize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid key size %d, expected %d", len(key), KeySize))
+	}
+
+	dbConn, err := db.Conn(ctx)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+	defer dbConn.Close()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, err := dbConn.ExecContext(ctx, keyPragma("rekey", key)); err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	c.key = append([]byte{}, key...)
+	c.generation++
+
+	return nil
+}
+
+// Open opens the database at path with a key, a plaintext database found at path is encrypted beforehand
+func Open(path string, key []byte) (*sql.DB, *Connector, error) {
+	if len(key) != KeySize {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid key size %d, expected %d", len(key), KeySize))
+	}
+
+	if plaintext, err := IsPlaintext(path); err != nil {
+		return nil, nil, err
+	} else if plaintext {
+		if err := encryptPlaintext(path, key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	c := &Connector{
+		dsn:    path,
+		driver: &sqlite3.SQLiteDriver{},
+		key:    append([]byte{}, key...),
+	}
+
+	db := sql.OpenDB(c)
+
+	if err := checkEncryption(db); err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+
+	return db, c, nil
+}
+
+// IsPlaintext returns true if a database which is not encrypted exists at path
+func IsPlaintext(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+	defer f.Close()
+
+	header := make([]byte, len(plaintextHeader))
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		// an empty file is initialized as an encrypted database
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	return bytes.Equal(header, plaintextHeader), nil
+}
+
+// encryptPlaintext exports a plaintext database to an encrypted copy which then replaces it
+func encryptPlaintext(path string, key []byte) error {
+	tmpPath := path + ".encrypting"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	err = func() error {
+		defer db.Close()
+
+		if _, err := db.Exec(fmt.Sprintf(`ATTACH DATABASE ? AS encrypted KEY "x'%s'"`, hex.EncodeToString(key)), tmpPath); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if _, err := db.Exec("SELECT sqlcipher_export('encrypted')"); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if _, err := db.Exec("DETACH DATABASE encrypted"); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// checkEncryption ensures the database is readable with the key and that sqlite has been built with SQLCipher, so the
+// data is never stored in plaintext by mistake
+func checkEncryption(db *sql.DB) error {
+	version := ""
+	if err := db.QueryRow("PRAGMA cipher_version").Scan(&version); err != nil && err != sql.ErrNoRows {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if version == "" {
+		return errcode.ErrNotImplemented.Wrap(fmt.Errorf("sqlite has not been built with SQLCipher"))
+	}
+
+	if _, err := db.Exec("SELECT count(*) FROM sqlite_master"); err != nil {
+		return errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to read the database with the key: %w", err))
+	}
+
+	return nil
+}
+
+func keyPragma(name string, key []byte) string {
+	return fmt.Sprintf(`PRAGMA %s = "x'%s'"`, name, hex.EncodeToString(key))
+}
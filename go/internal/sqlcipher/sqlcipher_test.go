@@ -0,0 +1,46 @@
+package sqlcipher
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+func TestIsPlaintext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlcipher")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	missing := path.Join(dir, "missing.sqlite")
+	plaintext, err := IsPlaintext(missing)
+	require.NoError(t, err)
+	require.False(t, plaintext)
+
+	empty := path.Join(dir, "empty.sqlite")
+	require.NoError(t, ioutil.WriteFile(empty, nil, 0o600))
+	plaintext, err = IsPlaintext(empty)
+	require.NoError(t, err)
+	require.False(t, plaintext)
+
+	clear := path.Join(dir, "clear.sqlite")
+	require.NoError(t, ioutil.WriteFile(clear, append(append([]byte{}, plaintextHeader...), make([]byte, 84)...), 0o600))
+	plaintext, err = IsPlaintext(clear)
+	require.NoError(t, err)
+	require.True(t, plaintext)
+
+	encrypted := path.Join(dir, "encrypted.sqlite")
+	require.NoError(t, ioutil.WriteFile(encrypted, make([]byte, 100), 0o600))
+	plaintext, err = IsPlaintext(encrypted)
+	require.NoError(t, err)
+	require.False(t, plaintext)
+}
+
+func TestOpenInvalidKey(t *testing.T) {
+	_, _, err := Open("unused.sqlite", []byte("too short"))
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
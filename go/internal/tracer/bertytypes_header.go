@@ -45,3 +45,14 @@ func SpanFromMessageHeaders(ctx context.Context, h *protocoltypes.MessageHeaders
 	sctx := trace.RemoteSpanContextFromContext(hctx)
 	return From(ctx).Start(hctx, name, trace.LinkedTo(sctx))
 }
+
+// ChildSpanFromMessageHeaders starts a span continuing the trace of the sender of a message, unlike
+// SpanFromMessageHeaders the span shares the trace ID of the sender
+func ChildSpanFromMessageHeaders(ctx context.Context, tr trace.Tracer, h *protocoltypes.MessageHeaders, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	hctx := ExtractSpanContextFromMessageHeaders(context.Background(), h)
+	if sctx := trace.RemoteSpanContextFromContext(hctx); sctx.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, sctx)
+	}
+
+	return tr.Start(ctx, name, trace.WithAttributes(attrs...))
+}
@@ -34,7 +34,9 @@ type Config struct {
 	JaegerHost string
 }
 
-func InitTracer(flag, service string) func() {
+// ConfigFromFlag parses a tracer flag, it is empty to disable the tracing, "stdout" to output the spans on stdout or
+// the <hostname:port> of a jaeger collector
+func ConfigFromFlag(flag, service string) *Config {
 	cfg := &Config{
 		RuntimeProvider: true,
 		ServiceName:     service,
@@ -42,7 +44,7 @@ func InitTracer(flag, service string) func() {
 
 	switch flag {
 	case "": // None
-		return func() {}
+		cfg.ExporterType = ExporterTypeNone
 	case "stdout": // Stdout
 		cfg.ExporterType = ExporterTypeStdout
 	default: // Jaeger
@@ -50,7 +52,15 @@ func InitTracer(flag, service string) func() {
 		cfg.JaegerHost = flag
 	}
 
-	pt, cl, err := ConfigureProvider(cfg)
+	return cfg
+}
+
+func InitTracer(flag, service string) func() {
+	if flag == "" {
+		return func() {}
+	}
+
+	pt, cl, err := ConfigureProvider(ConfigFromFlag(flag, service))
 	if err != nil {
 		log.Fatalf("unable to init tracer: `%s`", err)
 	}
@@ -65,6 +75,7 @@ func ConfigureProvider(cfg *Config) (pt trace.Provider, cl Cleanup, err error) {
 		pt, cl, err = NewJaegerProvider(cfg.JaegerHost, cfg.ServiceName)
 	case ExporterTypeStdout:
 		pt, err = NewStdoutProvider()
+		cl = func() {}
 	default:
 		pt, cl, err = &trace.NoopProvider{}, func() {}, nil
 		return
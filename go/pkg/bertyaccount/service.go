@@ -45,6 +45,7 @@ type service struct {
 	rootdir          string
 	muService        sync.RWMutex
 	initManager      *initutil.Manager
+	openedAccountID  string
 	lifecycleManager *lifecycle.Manager
 	sclients         bertybridge.ServiceClientRegister
 }
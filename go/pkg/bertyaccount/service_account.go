@@ -80,8 +80,22 @@ func (s *service) openAccount(req *OpenAccount_Request, prog *progress.Progress)
 	{
 		var err error
 		if initManager, err = s.openManager(logger, args...); err != nil {
+			// a wrong storage key is a failed unlock attempt
+			if isFailedUnlock(err) {
+				if _, wiped, err := s.recordUnlockAttempt(req.AccountID, false); err != nil {
+					return nil, err
+				} else if wiped {
+					return nil, errcode.ErrBertyAccountDataNotFound.Wrap(fmt.Errorf("the account has been wiped after too many failed unlock attempts"))
+				}
+			}
+
 			return nil, errcode.ErrBertyAccountManagerOpen.Wrap(err)
 		}
+
+		if meta, _, err = s.recordUnlockAttempt(req.AccountID, true); err != nil {
+			initManager.Close(nil)
+			return nil, err
+		}
 	}
 
 	// get manager client conn
@@ -107,6 +121,7 @@ func (s *service) openAccount(req *OpenAccount_Request, prog *progress.Progress)
 		}
 	}
 	s.initManager = initManager
+	s.openedAccountID = req.AccountID
 	prog.Get("setup-grpc").Done()
 
 	return meta, nil
@@ -189,6 +204,7 @@ func (s *service) CloseAccount(_ context.Context, req *CloseAccount_Request) (*C
 		return nil, errcode.ErrBertyAccountManagerClose.Wrap(err)
 	}
 	s.initManager = nil
+	s.openedAccountID = ""
 
 	return &CloseAccount_Reply{}, nil
 }
@@ -237,6 +253,7 @@ func (s *service) CloseAccountWithProgress(req *CloseAccountWithProgress_Request
 		return errcode.ErrBertyAccountManagerClose.Wrap(err)
 	}
 	s.initManager = nil
+	s.openedAccountID = ""
 
 	// wait
 	<-done
@@ -405,19 +422,27 @@ func (s *service) updateAccountMetadataLastOpened(accountID string) (*AccountMet
 
 	meta.LastOpened = time.Now().UnixNano() / 1000
 
+	if err := s.putAccountMetadata(accountID, meta); err != nil {
+		return nil, err
+	}
+
+	meta.AccountID = accountID
+
+	return meta, nil
+}
+
+func (s *service) putAccountMetadata(accountID string, meta *AccountMetadata) error {
 	metaBytes, err := proto.Marshal(meta)
 	if err != nil {
-		return nil, errcode.ErrSerialization.Wrap(err)
+		return errcode.ErrSerialization.Wrap(err)
 	}
 
 	metafileName := path.Join(s.rootdir, accountID, accountMetafileName)
 	if err := ioutil.WriteFile(metafileName, metaBytes, 0o600); err != nil {
-		return nil, errcode.ErrBertyAccountFSError.Wrap(err)
+		return errcode.ErrBertyAccountFSError.Wrap(err)
 	}
 
-	meta.AccountID = accountID
-
-	return meta, nil
+	return nil
 }
 
 func (s *service) createAccountMetadata(accountID string, name string) (*AccountMetadata, error) {
@@ -442,14 +467,8 @@ func (s *service) createAccountMetadata(accountID string, name string) (*Account
 
 	meta.LastOpened = time.Now().UnixNano() / 1000
 
-	metaBytes, err := proto.Marshal(meta)
-	if err != nil {
-		return nil, errcode.ErrSerialization.Wrap(err)
-	}
-
-	metafileName := path.Join(s.rootdir, accountID, accountMetafileName)
-	if err := ioutil.WriteFile(metafileName, metaBytes, 0o600); err != nil {
-		return nil, errcode.ErrBertyAccountFSError.Wrap(err)
+	if err := s.putAccountMetadata(accountID, meta); err != nil {
+		return nil, err
 	}
 
 	meta.AccountID = accountID
@@ -0,0 +1,225 @@
+package bertyaccount
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"moul.io/progress"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// wipeBufferSize is the size of the random chunks overwriting the files of a wiped account
+const wipeBufferSize = 32 * 1024
+
+// The data of an account are all stored in its directory: the messenger database with its outbox, the ipfs repository
+// with the keystore of the device and the media cache. A wipe overwrites each file with random bytes before removing
+// them, so they can't be recovered from the file system. The storage may still keep copies of the overwritten blocks,
+// as the flash storages do, and the key material stored outside of the account directory by the platform isn't wiped.
+
+// wipeAccount closes the account if it is opened and securely deletes its directory, muService must be held
+func (s *service) wipeAccount(accountID string, prog *progress.Progress) error {
+	if accountID == "" {
+		return errcode.ErrBertyAccountNoIDSpecified
+	}
+
+	if strings.ContainsAny(path.Clean(accountID), "/\\") {
+		return errcode.ErrBertyAccountInvalidIDFormat
+	}
+
+	if _, err := s.getAccountMetaForName(accountID); err != nil {
+		return err
+	}
+
+	if prog == nil {
+		prog = progress.New()
+	}
+	prog.AddStep("close-account")
+	prog.AddStep("overwrite-files")
+	prog.AddStep("remove-files")
+	prog.Get("close-account").Start()
+
+	if s.initManager != nil && s.openedAccountID == accountID {
+		if l, err := s.initManager.GetLogger(); err == nil {
+			_ = l.Sync() // cleanup logger
+		}
+
+		if err := s.initManager.Close(nil); err != nil {
+			return errcode.ErrBertyAccountManagerClose.Wrap(err)
+		}
+		s.initManager = nil
+		s.openedAccountID = ""
+	}
+
+	prog.Get("overwrite-files").SetAsCurrent()
+	accountStorePath := path.Join(s.rootdir, accountID)
+	if err := filepath.Walk(accountStorePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return overwriteFile(p, info.Size())
+	}); err != nil {
+		return errcode.ErrBertyAccountFSError.Wrap(err)
+	}
+
+	prog.Get("remove-files").SetAsCurrent()
+	if err := os.RemoveAll(accountStorePath); err != nil {
+		return errcode.ErrBertyAccountFSError.Wrap(err)
+	}
+	prog.Get("remove-files").Done()
+
+	s.logger.Info("account wiped", zap.String("account-id", accountID))
+
+	return nil
+}
+
+// overwriteFile replaces the content of a file with random bytes and flushes it to the storage
+func overwriteFile(p string, size int64) error {
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, wipeBufferSize)
+	for written := int64(0); written < size; {
+		chunk := buf
+		if remaining := size - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := io.ReadFull(rand.Reader, chunk); err != nil {
+			return err
+		}
+
+		n, err := f.Write(chunk)
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+
+	return f.Sync()
+}
+
+func (s *service) AccountWipe(req *AccountWipe_Request, server AccountService_AccountWipeServer) error {
+	s.muService.Lock()
+	defer s.muService.Unlock()
+
+	prog := progress.New()
+	ch := prog.Subscribe()
+	done := make(chan bool)
+
+	go func() {
+		for step := range ch {
+			_ = step
+			snapshot := prog.Snapshot()
+			err := server.Send(&AccountWipe_Reply{
+				Progress: &protocoltypes.Progress{
+					State:     string(snapshot.State),
+					Doing:     snapshot.Doing,
+					Progress:  float32(snapshot.Progress),
+					Completed: uint64(snapshot.Completed),
+					Total:     uint64(snapshot.Total),
+					Delay:     uint64(snapshot.TotalDuration.Microseconds()),
+				},
+			})
+			if err != nil {
+				// not sure it is worth logging something here
+				close(ch)
+				break
+			}
+		}
+		done <- true
+	}()
+
+	if err := s.wipeAccount(req.AccountID, prog); err != nil {
+		return err
+	}
+
+	// wait
+	<-done
+
+	// the confirmation is the last reply of the stream
+	return server.Send(&AccountWipe_Reply{Wiped: true})
+}
+
+func (s *service) AccountWipePolicySet(_ context.Context, req *AccountWipePolicySet_Request) (*AccountWipePolicySet_Reply, error) {
+	s.muService.Lock()
+	defer s.muService.Unlock()
+
+	if req.AccountID == "" {
+		return nil, errcode.ErrBertyAccountNoIDSpecified
+	}
+
+	if req.WipeAfterFailedUnlocks < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the number of failed unlock attempts can't be negative"))
+	}
+
+	meta, err := s.getAccountMetaForName(req.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.WipeAfterFailedUnlocks = req.WipeAfterFailedUnlocks
+	meta.FailedUnlocks = 0
+
+	if err := s.putAccountMetadata(req.AccountID, meta); err != nil {
+		return nil, errcode.ErrBertyAccountMetadataUpdate.Wrap(err)
+	}
+
+	return &AccountWipePolicySet_Reply{AccountMetadata: meta}, nil
+}
+
+// isFailedUnlock returns true when an account couldn't be opened because its storage key is wrong, the messenger db
+// can't be decrypted then
+func isFailedUnlock(err error) bool {
+	return errcode.Has(err, errcode.ErrCryptoDecrypt)
+}
+
+// recordUnlockAttempt counts the failed attempts to open an account, the account is wiped once they reach its policy
+// and a successful attempt resets them, muService must be held
+func (s *service) recordUnlockAttempt(accountID string, succeeded bool) (*AccountMetadata, bool, error) {
+	meta, err := s.getAccountMetaForName(accountID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if succeeded {
+		if meta.FailedUnlocks == 0 {
+			return meta, false, nil
+		}
+		meta.FailedUnlocks = 0
+	} else {
+		meta.FailedUnlocks++
+	}
+
+	if policy := meta.WipeAfterFailedUnlocks; policy > 0 && meta.FailedUnlocks >= policy {
+		s.logger.Warn("wiping account after too many failed unlock attempts", zap.String("account-id", accountID), zap.Int32("attempts", meta.FailedUnlocks))
+
+		if err := s.wipeAccount(accountID, nil); err != nil {
+			return nil, false, err
+		}
+
+		return meta, true, nil
+	}
+
+	if err := s.putAccountMetadata(accountID, meta); err != nil {
+		return nil, false, errcode.ErrBertyAccountMetadataUpdate.Wrap(err)
+	}
+
+	return meta, false, nil
+}
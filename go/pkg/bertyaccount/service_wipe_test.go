@@ -0,0 +1,97 @@
+package bertyaccount
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+func TestRecordUnlockAttempt(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "berty-account")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempdir)
+
+	ctx := context.Background()
+	s := &service{rootdir: tempdir, logger: zap.NewNop()}
+
+	_, err = s.createAccountMetadata("account_1", "")
+	require.NoError(t, err)
+
+	dbPath := path.Join(tempdir, "account_1", "messenger.sqlite")
+	require.NoError(t, ioutil.WriteFile(dbPath, []byte("secret"), 0o600))
+
+	_, err = s.AccountWipePolicySet(ctx, &AccountWipePolicySet_Request{AccountID: "account_1", WipeAfterFailedUnlocks: -1})
+	require.Error(t, err)
+
+	// the account is never wiped without a policy
+	meta, wiped, err := s.recordUnlockAttempt("account_1", false)
+	require.NoError(t, err)
+	require.False(t, wiped)
+	require.Equal(t, int32(1), meta.FailedUnlocks)
+
+	policy, err := s.AccountWipePolicySet(ctx, &AccountWipePolicySet_Request{AccountID: "account_1", WipeAfterFailedUnlocks: 2})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), policy.AccountMetadata.WipeAfterFailedUnlocks)
+	require.Zero(t, policy.AccountMetadata.FailedUnlocks)
+
+	meta, wiped, err = s.recordUnlockAttempt("account_1", false)
+	require.NoError(t, err)
+	require.False(t, wiped)
+	require.Equal(t, int32(1), meta.FailedUnlocks)
+
+	// a successful attempt resets the counter
+	meta, _, err = s.recordUnlockAttempt("account_1", true)
+	require.NoError(t, err)
+	require.Zero(t, meta.FailedUnlocks)
+
+	meta, err = s.getAccountMetaForName("account_1")
+	require.NoError(t, err)
+	require.Zero(t, meta.FailedUnlocks)
+
+	for i := 0; i < 2; i++ {
+		_, wiped, err = s.recordUnlockAttempt("account_1", false)
+		require.NoError(t, err)
+	}
+	require.True(t, wiped)
+
+	_, err = os.Stat(path.Join(tempdir, "account_1"))
+	require.True(t, os.IsNotExist(err))
+
+	_, _, err = s.recordUnlockAttempt("account_1", false)
+	require.Error(t, err)
+}
+
+func TestIsFailedUnlock(t *testing.T) {
+	// the error of a messenger db which can't be decrypted, as wrapped by the manager
+	err := fmt.Errorf("unable to setup Messenger Server: %w", errcode.TODO.Wrap(errcode.ErrCryptoDecrypt.Wrap(fmt.Errorf("file is not a database"))))
+	require.True(t, isFailedUnlock(err))
+
+	require.False(t, isFailedUnlock(fmt.Errorf("unable to setup Local IPFS Node: %w", errcode.TODO.Wrap(fmt.Errorf("repo locked")))))
+	require.False(t, isFailedUnlock(nil))
+}
+
+func TestOverwriteFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "berty-wipe")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	content := make([]byte, wipeBufferSize+10)
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, overwriteFile(f.Name(), int64(len(content))))
+
+	overwritten, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Len(t, overwritten, len(content))
+	require.NotEqual(t, content, overwritten)
+}
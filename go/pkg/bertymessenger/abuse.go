@@ -0,0 +1,297 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	abuseReportIDSize   = 16
+	contentFilterIDSize = 16
+)
+
+// handleAppMessageAbuseReport stores the reports shared with the admins of a group, the reports sent by the other
+// devices of the account are stored as well
+func (h *eventHandler) handleAppMessageAbuseReport(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_AbuseReport)
+
+	if i.GetConversation().GetType() != messengertypes.Conversation_MultiMemberType {
+		h.logger.Warn("ignoring abuse report sent outside of a group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if !i.GetIsMe() {
+		if admin, err := tx.isConversationAdmin(i.GetConversationPublicKey(), i.GetConversation().GetAccountMemberPublicKey()); err != nil {
+			return nil, false, err
+		} else if !admin {
+			return i, false, nil
+		}
+	}
+
+	id := payload.GetReportID()
+	if id == "" {
+		id = i.GetCID()
+	}
+
+	if _, err := tx.addAbuseReport(&messengertypes.AbuseReport{
+		ID:                      id,
+		ConversationPublicKey:   i.GetConversationPublicKey(),
+		TargetCID:               payload.GetTargetCID(),
+		TargetMemberPublicKey:   payload.GetMemberPublicKey(),
+		Reason:                  payload.GetReason(),
+		ReporterMemberPublicKey: interactionSenderMemberPK(i),
+		IsMe:                    i.GetIsMe(),
+		Shared:                  true,
+		ReportedDate:            i.GetSentDate(),
+	}); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+// applyContentFilters hides a received message matching one of the content filters until it is reviewed
+func (h *eventHandler) applyContentFilters(tx *dbWrapper, i *messengertypes.Interaction, body string) error {
+	if i.GetIsMe() || body == "" {
+		return nil
+	}
+
+	filters, err := tx.getContentFilters()
+	if err != nil {
+		return err
+	}
+
+	if filter := matchContentFilter(filters, body); filter != nil {
+		i.IsFiltered = true
+		i.FilteredBy = filter.GetID()
+	}
+
+	return nil
+}
+
+// matchContentFilter returns the first filter matched by a message body, the keywords are matched case insensitively
+func matchContentFilter(filters []*messengertypes.ContentFilter, body string) *messengertypes.ContentFilter {
+	lowerBody := strings.ToLower(body)
+
+	for _, filter := range filters {
+		if !filter.GetIsRegex() {
+			if strings.Contains(lowerBody, strings.ToLower(filter.GetPattern())) {
+				return filter
+			}
+			continue
+		}
+
+		// the patterns are validated when the filters are added
+		if re, err := regexp.Compile(filter.GetPattern()); err == nil && re.MatchString(body) {
+			return filter
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) AbuseReportCreate(ctx context.Context, req *messengertypes.AbuseReportCreate_Request) (*messengertypes.AbuseReportCreate_Reply, error) {
+	if req.GetConversationPublicKey() == "" || (req.GetInteractionCID() == "" && req.GetMemberPublicKey() == "") {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	memberPK := req.GetMemberPublicKey()
+	if cid := req.GetInteractionCID(); cid != "" {
+		i, err := svc.db.getInteractionByCID(cid)
+		if err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+
+		if i.GetConversationPublicKey() != conv.GetPublicKey() {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the message is not part of the conversation"))
+		}
+
+		if i.GetIsMe() {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't report your own message"))
+		}
+
+		if memberPK == "" {
+			memberPK = i.GetMemberPublicKey()
+			if conv.GetType() == messengertypes.Conversation_ContactType {
+				memberPK = conv.GetContactPublicKey()
+			}
+		}
+	}
+
+	if memberPK != "" && memberPK == conv.GetAccountMemberPublicKey() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't report yourself"))
+	}
+
+	if req.GetShare() && conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the reports of multi member groups can be shared"))
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(abuseReportIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	report := &messengertypes.AbuseReport{
+		ID:                      b64EncodeBytes(id),
+		ConversationPublicKey:   conv.GetPublicKey(),
+		TargetCID:               req.GetInteractionCID(),
+		TargetMemberPublicKey:   memberPK,
+		Reason:                  req.GetReason(),
+		ReporterMemberPublicKey: conv.GetAccountMemberPublicKey(),
+		IsMe:                    true,
+		Shared:                  req.GetShare(),
+		ReportedDate:            timestampMs(time.Now()),
+	}
+
+	// the report is sent before being stored, it is stored when received back if the storage fails
+	if req.GetShare() {
+		if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeAbuseReport, &messengertypes.AppMessage_AbuseReport{
+			ReportID:        report.GetID(),
+			TargetCID:       report.GetTargetCID(),
+			MemberPublicKey: report.GetTargetMemberPublicKey(),
+			Reason:          report.GetReason(),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := svc.db.addAbuseReport(report); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AbuseReportCreate_Reply{Report: report}, nil
+}
+
+func (svc *service) AbuseReportList(ctx context.Context, req *messengertypes.AbuseReportList_Request) (*messengertypes.AbuseReportList_Reply, error) {
+	reports, err := svc.db.getAbuseReports(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AbuseReportList_Reply{Reports: reports}, nil
+}
+
+func (svc *service) ContentFilterAdd(ctx context.Context, req *messengertypes.ContentFilterAdd_Request) (*messengertypes.ContentFilterAdd_Reply, error) {
+	if req.GetPattern() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetIsRegex() {
+		if _, err := regexp.Compile(req.GetPattern()); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(contentFilterIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	filter := &messengertypes.ContentFilter{
+		ID:          b64EncodeBytes(id),
+		Pattern:     req.GetPattern(),
+		IsRegex:     req.GetIsRegex(),
+		CreatedDate: timestampMs(time.Now()),
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.addContentFilter(filter); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContentFilterAdd_Reply{Filter: filter}, nil
+}
+
+func (svc *service) ContentFilterRemove(ctx context.Context, req *messengertypes.ContentFilterRemove_Request) (*messengertypes.ContentFilterRemove_Reply, error) {
+	if req.GetFilterID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.deleteContentFilter(req.GetFilterID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContentFilterRemove_Reply{}, nil
+}
+
+func (svc *service) ContentFilterList(ctx context.Context, req *messengertypes.ContentFilterList_Request) (*messengertypes.ContentFilterList_Reply, error) {
+	filters, err := svc.db.getContentFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContentFilterList_Reply{Filters: filters}, nil
+}
+
+func (svc *service) FilteredInteractionList(ctx context.Context, req *messengertypes.FilteredInteractionList_Request) (*messengertypes.FilteredInteractionList_Reply, error) {
+	interactions, err := svc.db.getFilteredInteractions(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.FilteredInteractionList_Reply{Interactions: interactions}, nil
+}
+
+func (svc *service) FilteredInteractionReview(ctx context.Context, req *messengertypes.FilteredInteractionReview_Request) (*messengertypes.FilteredInteractionReview_Reply, error) {
+	if req.GetCID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	i, err := svc.db.getInteractionByCID(req.GetCID())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if !i.GetIsFiltered() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the message is not filtered"))
+	}
+
+	if !req.GetApprove() {
+		if err := svc.db.deleteInteractions([]string{i.GetCID()}); err != nil {
+			return nil, errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: i.GetCID()}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		return &messengertypes.FilteredInteractionReview_Reply{}, nil
+	}
+
+	if i, err = svc.db.clearInteractionFiltered(i.GetCID()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	// the approved message counts as unread as if it was just received
+	if err := svc.eventHandler.dispatchVisibleInteraction(i); err != nil {
+		svc.logger.Error("unable to dispatch notification for interaction", zap.String("cid", i.GetCID()), zap.Error(err))
+	}
+
+	return &messengertypes.FilteredInteractionReview_Reply{}, nil
+}
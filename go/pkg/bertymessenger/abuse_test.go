@@ -0,0 +1,124 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_matchContentFilter(t *testing.T) {
+	filters := []*messengertypes.ContentFilter{
+		{ID: "keyword", Pattern: "Free Money"},
+		{ID: "regex", Pattern: `https?://\S+\.example`, IsRegex: true},
+		{ID: "invalid", Pattern: `(`, IsRegex: true},
+	}
+
+	require.Nil(t, matchContentFilter(nil, "free money"))
+	require.Nil(t, matchContentFilter(filters, "hello"))
+	require.Equal(t, "keyword", matchContentFilter(filters, "get FREE MONEY now").GetID())
+	require.Equal(t, "regex", matchContentFilter(filters, "see http://spam.example").GetID())
+
+	// the regular expressions are case sensitive unless their pattern says otherwise
+	require.Nil(t, matchContentFilter(filters, "see HTTP://spam.example"))
+}
+
+func Test_eventHandler_applyContentFilters(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addContentFilter(&messengertypes.ContentFilter{ID: "filter_1", Pattern: "spam", CreatedDate: 1}))
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+
+	received := &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 1}
+	require.NoError(t, h.applyContentFilters(db, received, "some spam"))
+	require.True(t, received.GetIsFiltered())
+	require.Equal(t, "filter_1", received.GetFilteredBy())
+
+	// the messages of the account are never filtered
+	sent := &messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 2, IsMe: true}
+	require.NoError(t, h.applyContentFilters(db, sent, "some spam"))
+	require.False(t, sent.GetIsFiltered())
+
+	for _, i := range []*messengertypes.Interaction{received, sent} {
+		_, _, err := db.addInteraction(*i)
+		require.NoError(t, err)
+	}
+
+	filtered, err := db.getFilteredInteractions("")
+	require.NoError(t, err)
+	require.Len(t, filtered, 1)
+	require.Equal(t, "cid_1", filtered[0].GetCID())
+
+	filtered, err = db.getFilteredInteractions("conv_2")
+	require.NoError(t, err)
+	require.Empty(t, filtered)
+
+	i, err := db.clearInteractionFiltered("cid_1")
+	require.NoError(t, err)
+	require.False(t, i.GetIsFiltered())
+	require.Empty(t, i.GetFilteredBy())
+
+	filtered, err = db.getFilteredInteractions("")
+	require.NoError(t, err)
+	require.Empty(t, filtered)
+
+	require.NoError(t, db.deleteContentFilter("filter_1"))
+	require.Error(t, db.deleteContentFilter("filter_1"))
+}
+
+func Test_eventHandler_handleAppMessageAbuseReport(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"})
+	_, err := db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+	report := func(cid string, isMe bool, sentDate int64) {
+		_, _, err := h.handleAppMessageAbuseReport(db, &messengertypes.Interaction{
+			CID:                   cid,
+			ConversationPublicKey: "conv_1",
+			Conversation:          conv,
+			MemberPublicKey:       "member_1",
+			IsMe:                  isMe,
+			SentDate:              sentDate,
+		}, &messengertypes.AppMessage_AbuseReport{ReportID: "report_" + cid, MemberPublicKey: "member_2", Reason: "spam"})
+		require.NoError(t, err)
+	}
+
+	// the reports are only kept by the admins
+	report("cid_1", false, 10)
+	reports, err := db.getAbuseReports("conv_1")
+	require.NoError(t, err)
+	require.Empty(t, reports)
+
+	// except the ones sent by the other devices of the account
+	report("cid_2", true, 20)
+	reports, err = db.getAbuseReports("conv_1")
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.True(t, reports[0].GetIsMe())
+	require.Equal(t, "member_me", reports[0].GetReporterMemberPublicKey())
+
+	_, err = db.addMember("member_me", "conv_1", "", "", true, true)
+	require.NoError(t, err)
+
+	report("cid_1", false, 30)
+	report("cid_1", false, 30)
+	reports, err = db.getAbuseReports("")
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	require.Equal(t, "report_cid_1", reports[1].GetID())
+	require.Equal(t, "member_1", reports[1].GetReporterMemberPublicKey())
+	require.Equal(t, "member_2", reports[1].GetTargetMemberPublicKey())
+	require.True(t, reports[1].GetShared())
+}
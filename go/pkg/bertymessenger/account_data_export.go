@@ -0,0 +1,433 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The personal data stored by the node is exported as JSON documents to answer a subject access request. Each section
+// of the data, ie. the contacts or the interactions, is written in a directory of files of at most
+// accountDataExportPageSize rows, the state of the export is persisted after each file so an interrupted export resumes
+// after the last file written. A manifest listing the files with their checksums is written once every section is.
+
+const (
+	accountDataExportPageSize     = 500
+	accountDataExportManifestName = "manifest.json"
+	accountDataExportVersion      = 1
+)
+
+type accountDataExportSection struct {
+	name        string
+	description string
+	// key is the column the rows are ordered and resumed by, the whole table is written in one file when empty
+	key   string
+	rows  func() interface{}
+	keyOf func(row interface{}) string
+	// record returns the exported document of a row, the row itself if nil
+	record func(row interface{}) interface{}
+}
+
+var accountDataExportSections = []accountDataExportSection{
+	{
+		name:        "account",
+		description: "the profile and the settings of the account",
+		rows:        func() interface{} { return &[]*messengertypes.Account{} },
+	},
+	{
+		name:        "notification_policies",
+		description: "the notification settings of the conversations",
+		rows:        func() interface{} { return &[]*messengertypes.NotificationPolicy{} },
+	},
+	{
+		name:        "contacts",
+		description: "the contacts and the contact requests",
+		key:         "public_key",
+		rows:        func() interface{} { return &[]*messengertypes.Contact{} },
+		keyOf:       func(row interface{}) string { return row.(*messengertypes.Contact).GetPublicKey() },
+	},
+	{
+		name:        "conversations",
+		description: "the conversations and the groups",
+		key:         "public_key",
+		rows:        func() interface{} { return &[]*messengertypes.Conversation{} },
+		keyOf:       func(row interface{}) string { return row.(*messengertypes.Conversation).GetPublicKey() },
+	},
+	{
+		name:        "interactions",
+		description: "the messages and the other interactions of the conversations, ordered by cid",
+		key:         "cid",
+		rows:        func() interface{} { return &[]*messengertypes.Interaction{} },
+		keyOf:       func(row interface{}) string { return row.(*messengertypes.Interaction).GetCID() },
+		record:      accountDataExportInteractionRecord,
+	},
+	{
+		name:        "medias",
+		description: "the index of the medias, their content isn't exported",
+		key:         "cid",
+		rows:        func() interface{} { return &[]*messengertypes.Media{} },
+		keyOf:       func(row interface{}) string { return row.(*messengertypes.Media).GetCID() },
+	},
+	{
+		name:        "service_tokens",
+		description: "the tokens of the replication and push services",
+		rows:        func() interface{} { return &[]*messengertypes.ServiceToken{} },
+	},
+	{
+		name:        "push_device_tokens",
+		description: "the push tokens of the devices of the account",
+		rows:        func() interface{} { return &[]*messengertypes.PushDeviceToken{} },
+	},
+	{
+		name:        "api_tokens",
+		description: "the API tokens, only their hash is stored",
+		rows:        func() interface{} { return &[]*messengertypes.APIToken{} },
+	},
+	{
+		name:        "bot_tokens",
+		description: "the bot tokens, only their hash is stored",
+		rows:        func() interface{} { return &[]*messengertypes.BotToken{} },
+	},
+}
+
+// accountDataExportInteraction is an exported interaction with its decoded payload
+type accountDataExportInteraction struct {
+	*messengertypes.Interaction
+	Content interface{} `json:"content,omitempty"`
+}
+
+func accountDataExportInteractionRecord(row interface{}) interface{} {
+	i := row.(*messengertypes.Interaction)
+	record := &accountDataExportInteraction{Interaction: i}
+	if content, err := i.UnmarshalPayload(); err == nil {
+		record.Content = content
+	}
+
+	return record
+}
+
+type accountDataExportManifest struct {
+	Version          int                                 `json:"version"`
+	ExportID         string                              `json:"export_id"`
+	AccountPublicKey string                              `json:"account_public_key"`
+	StartedDate      string                              `json:"started_date"`
+	CompletedDate    string                              `json:"completed_date"`
+	Sections         []*accountDataExportManifestSection `json:"sections"`
+}
+
+type accountDataExportManifestSection struct {
+	Name        string                           `json:"name"`
+	Description string                           `json:"description"`
+	Rows        int64                            `json:"rows"`
+	Files       []*accountDataExportManifestFile `json:"files"`
+}
+
+type accountDataExportManifestFile struct {
+	Path   string `json:"path"`
+	Rows   int64  `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// accountDataExportID identifies the export of a directory, the same directory exported again resumes its export
+func accountDataExportID(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:16])
+}
+
+func accountDataExportFileName(section string, index uint32) string {
+	return filepath.Join(section, fmt.Sprintf("%06d.json", index))
+}
+
+func (svc *service) AccountDataExportStart(ctx context.Context, req *messengertypes.AccountDataExportStart_Request) (*messengertypes.AccountDataExportStart_Reply, error) {
+	if req.GetPath() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	path, err := filepath.Abs(req.GetPath())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	export, err := func() (*messengertypes.AccountDataExport, error) {
+		defer svc.writer.enter()()
+
+		id := accountDataExportID(path)
+		export, err := svc.db.getAccountDataExport(id)
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			export = nil
+		case err != nil:
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		now := timestampMs(time.Now())
+		if export == nil || export.GetState() == messengertypes.AccountDataExport_StateCompleted {
+			// a completed export is written again from the start, the files of the previous one are removed
+			for _, section := range accountDataExportSections {
+				if err := os.RemoveAll(filepath.Join(path, section.name)); err != nil {
+					return nil, errcode.ErrInternal.Wrap(err)
+				}
+			}
+			if err := os.RemoveAll(filepath.Join(path, accountDataExportManifestName)); err != nil {
+				return nil, errcode.ErrInternal.Wrap(err)
+			}
+
+			export = &messengertypes.AccountDataExport{
+				ID:           id,
+				Path:         path,
+				SectionCount: uint32(len(accountDataExportSections)),
+				CreatedDate:  now,
+			}
+		}
+
+		export.State = messengertypes.AccountDataExport_StateRunning
+		export.Error = ""
+		export.UpdatedDate = now
+		if err := svc.db.upsertAccountDataExport(export); err != nil {
+			return nil, err
+		}
+
+		return export, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	svc.dispatchAccountDataExport(export)
+
+	go func() {
+		if _, err := svc.runAccountDataExport(svc.ctx, export.GetID()); err != nil {
+			svc.logger.Warn("unable to export the account data", zap.String("export", export.GetID()), zap.Error(err))
+		}
+	}()
+
+	return &messengertypes.AccountDataExportStart_Reply{Export: export}, nil
+}
+
+func (svc *service) AccountDataExportList(ctx context.Context, req *messengertypes.AccountDataExportList_Request) (*messengertypes.AccountDataExportList_Reply, error) {
+	exports, err := svc.db.getAccountDataExports(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AccountDataExportList_Reply{Exports: exports}, nil
+}
+
+// runAccountDataExport writes the sections of an export from its last file written then its manifest, it stops after
+// the current file when ctx is done and the export is resumed later
+func (svc *service) runAccountDataExport(ctx context.Context, id string) (*messengertypes.AccountDataExport, error) {
+	svc.accountDataExportsMu.Lock()
+	defer svc.accountDataExportsMu.Unlock()
+
+	export, err := svc.db.getAccountDataExport(id)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if export.GetState() != messengertypes.AccountDataExport_StateRunning {
+		return export, nil
+	}
+
+	svc.logger.Info("account data export resumed", zap.String("export", id), zap.Uint32("section", export.GetSection()), zap.Uint32("files", export.GetSectionFiles()))
+
+	for int(export.GetSection()) < len(accountDataExportSections) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		section := accountDataExportSections[export.GetSection()]
+		export.SectionName = section.name
+
+		done, err := svc.writeAccountDataExportFile(export, section)
+		if err != nil {
+			return nil, svc.failAccountDataExport(export, err)
+		}
+
+		if done {
+			export.Section++
+			export.SectionFiles = 0
+			export.LastKey = ""
+		}
+
+		if err := svc.saveAccountDataExport(export); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := svc.writeAccountDataExportManifest(export); err != nil {
+		return nil, svc.failAccountDataExport(export, err)
+	}
+
+	export.State = messengertypes.AccountDataExport_StateCompleted
+	export.SectionName = ""
+	if err := svc.saveAccountDataExport(export); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("account data export completed", zap.String("export", id), zap.Int64("rows", export.GetExportedRows()))
+
+	return export, nil
+}
+
+// writeAccountDataExportFile writes the next file of a section, done is set once the section is written
+func (svc *service) writeAccountDataExportFile(export *messengertypes.AccountDataExport, section accountDataExportSection) (bool, error) {
+	rows := section.rows()
+	if err := svc.db.getAccountDataExportRows(rows, section.key, export.GetLastKey(), accountDataExportPageSize); err != nil {
+		return false, err
+	}
+
+	values := reflect.ValueOf(rows).Elem()
+	if values.Len() == 0 && export.GetSectionFiles() > 0 {
+		return true, nil
+	}
+
+	records := make([]interface{}, values.Len())
+	for i := range records {
+		row := values.Index(i).Interface()
+		if section.record != nil {
+			records[i] = section.record(row)
+		} else {
+			records[i] = row
+		}
+	}
+
+	data, err := json.Marshal(records)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	// a file is written under a temporary name so an interrupted write is never taken for a complete file
+	name := filepath.Join(export.GetPath(), accountDataExportFileName(section.name, export.GetSectionFiles()))
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+	if err := ioutil.WriteFile(name+".tmp", data, 0o600); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+
+	export.SectionFiles++
+	export.ExportedRows += int64(len(records))
+	if section.key == "" || len(records) < accountDataExportPageSize {
+		return true, nil
+	}
+
+	export.LastKey = section.keyOf(values.Index(len(records) - 1).Interface())
+
+	return false, nil
+}
+
+// writeAccountDataExportManifest lists the files of the sections with their number of rows and their checksum
+func (svc *service) writeAccountDataExportManifest(export *messengertypes.AccountDataExport) error {
+	manifest := &accountDataExportManifest{
+		Version:       accountDataExportVersion,
+		ExportID:      export.GetID(),
+		StartedDate:   time.Unix(0, export.GetCreatedDate()*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+		CompletedDate: time.Now().UTC().Format(time.RFC3339),
+	}
+	if acc, err := svc.db.getAccount(); err == nil {
+		manifest.AccountPublicKey = acc.GetPublicKey()
+	}
+
+	for _, section := range accountDataExportSections {
+		entry := &accountDataExportManifestSection{Name: section.name, Description: section.description}
+		for index := uint32(0); ; index++ {
+			name := accountDataExportFileName(section.name, index)
+			data, err := ioutil.ReadFile(filepath.Join(export.GetPath(), name))
+			if os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return errcode.ErrInternal.Wrap(err)
+			}
+
+			records := []json.RawMessage(nil)
+			if err := json.Unmarshal(data, &records); err != nil {
+				return errcode.ErrDeserialization.Wrap(fmt.Errorf("%s: %w", name, err))
+			}
+
+			sum := sha256.Sum256(data)
+			entry.Files = append(entry.Files, &accountDataExportManifestFile{Path: filepath.ToSlash(name), Rows: int64(len(records)), SHA256: hex.EncodeToString(sum[:])})
+			entry.Rows += int64(len(records))
+		}
+		manifest.Sections = append(manifest.Sections, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(export.GetPath(), accountDataExportManifestName), data, 0o600); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+func (svc *service) saveAccountDataExport(export *messengertypes.AccountDataExport) error {
+	defer svc.writer.enter()()
+
+	export.UpdatedDate = timestampMs(time.Now())
+	if err := svc.db.upsertAccountDataExport(export); err != nil {
+		return err
+	}
+
+	svc.dispatchAccountDataExport(export)
+
+	return nil
+}
+
+// failAccountDataExport stops an export, it is resumed from its last file written when started again
+func (svc *service) failAccountDataExport(export *messengertypes.AccountDataExport, reason error) error {
+	export.State = messengertypes.AccountDataExport_StateFailed
+	export.Error = reason.Error()
+	if err := svc.saveAccountDataExport(export); err != nil {
+		svc.logger.Error("unable to save the failed account data export", zap.String("export", export.GetID()), zap.Error(err))
+	}
+
+	return reason
+}
+
+func (svc *service) dispatchAccountDataExport(export *messengertypes.AccountDataExport) {
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountDataExportUpdated, &messengertypes.StreamEvent_AccountDataExportUpdated{Export: export}, false); err != nil {
+		svc.logger.Error("unable to dispatch account data export", zap.String("export", export.GetID()), zap.Error(err))
+	}
+}
+
+// resumeAccountDataExports resumes the exports interrupted by the last stop, one at a time
+func (svc *service) resumeAccountDataExports(ctx context.Context) {
+	exports, err := svc.db.getAccountDataExports(true)
+	if err != nil {
+		svc.logger.Error("unable to list the interrupted account data exports", zap.Error(err))
+		return
+	}
+
+	for _, export := range exports {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, err := svc.runAccountDataExport(ctx, export.GetID()); err != nil {
+			svc.logger.Warn("unable to resume account data export", zap.String("export", export.GetID()), zap.Error(err))
+		}
+	}
+}
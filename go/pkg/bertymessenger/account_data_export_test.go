@@ -0,0 +1,96 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestAccountDataExport(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	dir, err := ioutil.TempDir("", "account-data-export-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writer := newCommandQueue()
+	defer writer.close()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), writer: writer}
+
+	require.NoError(t, db.db.Create(&messengertypes.Account{PublicKey: "account_1", DisplayName: "me"}).Error)
+	for i := 0; i < accountDataExportPageSize+2; i++ {
+		require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: fmt.Sprintf("contact_%04d", i)}).Error)
+	}
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(0, nil, &messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}).Error)
+
+	export := &messengertypes.AccountDataExport{ID: accountDataExportID(dir), Path: dir, State: messengertypes.AccountDataExport_StateRunning}
+	require.NoError(t, db.upsertAccountDataExport(export))
+
+	// an export interrupted after the first file of the contacts
+	ctx, cancel := context.WithCancel(context.Background())
+	for {
+		stored, err := db.getAccountDataExport(export.GetID())
+		require.NoError(t, err)
+		if stored.GetSectionName() == "contacts" && stored.GetSectionFiles() == 1 {
+			break
+		}
+
+		section := accountDataExportSections[stored.GetSection()]
+		stored.SectionName = section.name
+		done, err := svc.writeAccountDataExportFile(stored, section)
+		require.NoError(t, err)
+		if done {
+			stored.Section++
+			stored.SectionFiles = 0
+			stored.LastKey = ""
+		}
+		require.NoError(t, svc.saveAccountDataExport(stored))
+	}
+	cancel()
+
+	_, err = svc.runAccountDataExport(ctx, export.GetID())
+	require.Error(t, err)
+
+	// the export resumes after the last file written
+	export, err = svc.runAccountDataExport(context.Background(), export.GetID())
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.AccountDataExport_StateCompleted, export.GetState())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, accountDataExportManifestName))
+	require.NoError(t, err)
+
+	manifest := &accountDataExportManifest{}
+	require.NoError(t, json.Unmarshal(data, manifest))
+	require.Equal(t, "account_1", manifest.AccountPublicKey)
+	require.Len(t, manifest.Sections, len(accountDataExportSections))
+
+	sections := map[string]*accountDataExportManifestSection{}
+	for _, section := range manifest.Sections {
+		sections[section.Name] = section
+	}
+	require.Equal(t, int64(accountDataExportPageSize+2), sections["contacts"].Rows)
+	require.Len(t, sections["contacts"].Files, 2)
+	require.Equal(t, int64(1), sections["account"].Rows)
+
+	// the interactions are exported with their decoded content
+	data, err = ioutil.ReadFile(filepath.Join(dir, sections["interactions"].Files[0].Path))
+	require.NoError(t, err)
+
+	interactions := []map[string]interface{}(nil)
+	require.NoError(t, json.Unmarshal(data, &interactions))
+	require.Len(t, interactions, 1)
+	require.Equal(t, "hello", interactions[0]["content"].(map[string]interface{})["body"])
+}
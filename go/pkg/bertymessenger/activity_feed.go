@@ -0,0 +1,98 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The activity feed merges the visible interactions of all the conversations, the most recent first, it is read through
+// the index of the interactions on their sent date and cid so a page doesn't depend on the number of conversations.
+
+// visibleAppMessageTypes returns the types shown as interactions in the conversations, ordered by type
+func (h *eventHandler) visibleAppMessageTypes() []messengertypes.AppMessage_Type {
+	types := []messengertypes.AppMessage_Type(nil)
+	for t, handler := range h.appMessageHandlers {
+		if handler.isVisibleEvent {
+			types = append(types, t)
+		}
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+func (svc *service) ActivityFeed(ctx context.Context, req *messengertypes.ActivityFeed_Request) (*messengertypes.ActivityFeed_Reply, error) {
+	visible := svc.eventHandler.visibleAppMessageTypes()
+
+	types := req.GetTypes()
+	if len(types) == 0 {
+		types = visible
+	}
+
+	for _, t := range types {
+		known := false
+		for _, v := range visible {
+			known = known || t == v
+		}
+
+		if !known {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("%s isn't a visible type", t))
+		}
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	cursor, err := decodeActivityFeedCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	// one more interaction is read to know whether there is a next page
+	interactions, err := svc.db.getActivityFeed(types, req.GetIncludeMuted(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ActivityFeed_Reply{}
+	if len(interactions) > count {
+		interactions = interactions[:count]
+		if reply.NextCursor, err = encodeActivityFeedCursor(interactions[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	pks := []string(nil)
+	seen := map[string]bool{}
+	for _, i := range interactions {
+		if pk := i.GetConversationPublicKey(); !seen[pk] {
+			seen[pk] = true
+			pks = append(pks, pk)
+		}
+	}
+
+	convs, err := svc.db.getConversationsByPKs(pks)
+	if err != nil {
+		return nil, err
+	}
+
+	convsByPK := make(map[string]*messengertypes.Conversation, len(convs))
+	for _, conv := range convs {
+		convsByPK[conv.GetPublicKey()] = conv
+	}
+
+	for _, i := range interactions {
+		reply.Entries = append(reply.Entries, &messengertypes.ActivityFeed_Entry{Interaction: i, Conversation: convsByPK[i.GetConversationPublicKey()]})
+	}
+
+	applyNicknames(reply)
+
+	return reply, nil
+}
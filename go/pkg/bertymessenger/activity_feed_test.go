@@ -0,0 +1,68 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestActivityFeed(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, model := range []interface{}{
+		&messengertypes.Conversation{PublicKey: "conv_1", DisplayName: "first"},
+		&messengertypes.Conversation{PublicKey: "conv_2", DisplayName: "second"},
+		&messengertypes.Conversation{PublicKey: "conv_3", PushMuted: true},
+		&messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", SentDate: 10},
+		&messengertypes.Interaction{CID: "cid_2", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_2", SentDate: 20},
+		&messengertypes.Interaction{CID: "cid_3", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", SentDate: 20},
+		&messengertypes.Interaction{CID: "cid_4", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_3", SentDate: 30},
+		&messengertypes.Interaction{CID: "cid_5", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_2", SentDate: 40, IsMemberMuted: true},
+		&messengertypes.Interaction{CID: "cid_6", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_2", SentDate: 50, IsSenderBlocked: true},
+		&messengertypes.Interaction{CID: "cid_7", Type: messengertypes.AppMessage_TypeAcknowledge, ConversationPublicKey: "conv_1", SentDate: 60},
+	} {
+		require.NoError(t, db.db.Create(model).Error)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	svc.eventHandler = newEventHandler(ctx, db, nil, zap.NewNop(), svc, false)
+
+	feed := func(includeMuted bool, types ...messengertypes.AppMessage_Type) ([]string, []string) {
+		cids, convs := []string(nil), []string(nil)
+		cursor := ""
+		for {
+			reply, err := svc.ActivityFeed(ctx, &messengertypes.ActivityFeed_Request{Count: 1, Cursor: cursor, Types: types, IncludeMuted: includeMuted})
+			require.NoError(t, err)
+			for _, entry := range reply.GetEntries() {
+				cids = append(cids, entry.GetInteraction().GetCID())
+				convs = append(convs, entry.GetConversation().GetDisplayName())
+			}
+
+			if cursor = reply.GetNextCursor(); cursor == "" {
+				return cids, convs
+			}
+		}
+	}
+
+	// the ties on the sent date are ordered by cid, the conversation of each interaction is attached
+	cids, convs := feed(false)
+	require.Equal(t, []string{"cid_3", "cid_2", "cid_1"}, cids)
+	require.Equal(t, []string{"first", "second", "first"}, convs)
+
+	cids, _ = feed(true)
+	require.Equal(t, []string{"cid_5", "cid_4", "cid_3", "cid_2", "cid_1"}, cids)
+
+	// the acknowledges aren't shown in the conversations
+	_, err := svc.ActivityFeed(ctx, &messengertypes.ActivityFeed_Request{Types: []messengertypes.AppMessage_Type{messengertypes.AppMessage_TypeAcknowledge}})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.ActivityFeed(ctx, &messengertypes.ActivityFeed_Request{Cursor: "not a cursor"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
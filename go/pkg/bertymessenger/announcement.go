@@ -0,0 +1,309 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	scheduledAnnouncementIDSize = 16
+	// announcementCheckInterval is the delay between two checks of the scheduled announcements
+	announcementCheckInterval = time.Minute
+)
+
+// In announcement mode only the admins of a group can post, the other members can only react. The announcements are
+// sent on the message log like the user messages and are ignored when they are not sent by an admin, they can be pinned
+// to the top of the conversation until a date. The scheduled announcements are stored by the node which scheduled them
+// and are sent once their publish date is reached, they are lost if the node is not running anymore.
+
+func (h *eventHandler) handleAppMessageSetAnnouncementMode(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetAnnouncementMode)
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring announcement mode sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeAnnouncementModeChanged, "", strconv.FormatBool(payload.GetEnabled())); err != nil {
+		return nil, false, err
+	}
+
+	date := int64(0)
+	if payload.GetEnabled() {
+		date = i.GetSentDate()
+		if current := i.GetConversation().GetAnnouncementModeDate(); current != 0 {
+			date = current
+		}
+	}
+
+	conv, err := tx.setConversationAnnouncementModeDate(i.GetConversationPublicKey(), date)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageAnnouncement(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_Announcement)
+	if payload.GetBody() == "" {
+		h.logger.Warn("ignoring empty announcement", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring announcement sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	i, isNew, err := tx.addInteraction(*i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if payload.GetPinnedUntil() > i.GetSentDate() {
+		conv, updated, err := tx.setConversationPinnedAnnouncement(i.GetConversationPublicKey(), i.GetCID(), i.GetSentDate(), payload.GetPinnedUntil())
+		if err != nil {
+			return nil, false, err
+		}
+
+		if updated && h.svc != nil {
+			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if h.svc == nil {
+		return i, isNew, nil
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew); err != nil {
+		return nil, false, err
+	}
+
+	if !isNew {
+		return i, isNew, nil
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAnnouncementReceived, &messengertypes.StreamEvent_AnnouncementReceived{Interaction: i}, true); err != nil {
+		return nil, false, err
+	}
+
+	if i.IsMe || h.replay {
+		return i, isNew, nil
+	}
+
+	if err := h.sendAck(i); err != nil {
+		h.logger.Error("error while sending ack", logGroup(i.ConversationPublicKey), zap.String("cid", i.CID), zap.Error(err))
+	}
+
+	policy, err := tx.getNotificationPolicy(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, isNew, err
+	}
+
+	if !isNotificationAllowed(policy, i, payload.GetBody(), time.Now()) {
+		return i, isNew, nil
+	}
+
+	msgRecvd := messengertypes.StreamEvent_Notified_MessageReceived{
+		Interaction:  i,
+		Conversation: i.Conversation,
+	}
+	if err := h.svc.dispatcher.Notify(messengertypes.StreamEvent_Notified_TypeMessageReceived, i.GetConversation().GetDisplayName(), payload.GetBody(), &msgRecvd); err != nil {
+		h.logger.Error("failed to notify", zap.Error(err))
+	}
+
+	return i, isNew, nil
+}
+
+// sendAnnouncement sends an announcement on the message log of a group, it is pinned for pinDuration milliseconds if
+// not 0
+func (svc *service) sendAnnouncement(ctx context.Context, conv *messengertypes.Conversation, body string, pinDuration int64, now time.Time) error {
+	gpk, err := b64DecodeBytes(conv.GetPublicKey())
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	announcement := &messengertypes.AppMessage_Announcement{Body: body}
+	if pinDuration > 0 {
+		announcement.PinnedUntil = timestampMs(now) + pinDuration
+	}
+
+	payload, err := messengertypes.AppMessage_TypeAnnouncement.MarshalPayload(timestampMs(now), nil, announcement)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+		return errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	return nil
+}
+
+// monitorScheduledAnnouncements sends the scheduled announcements once their publish date is reached
+func (svc *service) monitorScheduledAnnouncements(ctx context.Context) {
+	ticker := time.NewTicker(announcementCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := svc.publishScheduledAnnouncements(ctx, time.Now()); err != nil {
+			svc.logger.Error("unable to publish the scheduled announcements", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishScheduledAnnouncements sends the announcements due at now, the ones which can't be sent anymore because the
+// account is not an admin of the group are dropped, the others are kept until they are sent
+func (svc *service) publishScheduledAnnouncements(ctx context.Context, now time.Time) error {
+	defer svc.writer.enter()()
+
+	due, err := svc.db.getDueScheduledAnnouncements(timestampMs(now))
+	if err != nil {
+		return err
+	}
+
+	for _, announcement := range due {
+		conv, err := svc.getModeratedConversation(announcement.GetConversationPublicKey())
+		if err != nil {
+			svc.logger.Warn("dropping a scheduled announcement", zap.String("id", announcement.GetID()), zap.Error(err))
+		} else if err := svc.sendAnnouncement(ctx, conv, announcement.GetBody(), announcement.GetPinDuration(), now); err != nil {
+			return err
+		}
+
+		if _, err := svc.db.deleteScheduledAnnouncement(announcement.GetID()); err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeScheduledAnnouncementUpdated, &messengertypes.StreamEvent_ScheduledAnnouncementUpdated{Announcement: announcement, Removed: true}, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) ConversationSetAnnouncementMode(ctx context.Context, req *messengertypes.ConversationSetAnnouncementMode_Request) (*messengertypes.ConversationSetAnnouncementMode_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetAnnouncementMode, &messengertypes.AppMessage_SetAnnouncementMode{
+		Enabled: req.GetEnabled(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetAnnouncementMode_Reply{}, nil
+}
+
+func (svc *service) ConversationAnnounce(ctx context.Context, req *messengertypes.ConversationAnnounce_Request) (*messengertypes.ConversationAnnounce_Reply, error) {
+	if req.GetBody() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetPinDuration() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the pin duration can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if req.GetPublishDate() <= timestampMs(now) {
+		if err := svc.sendAnnouncement(ctx, conv, req.GetBody(), req.GetPinDuration(), now); err != nil {
+			return nil, err
+		}
+
+		return &messengertypes.ConversationAnnounce_Reply{}, nil
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(scheduledAnnouncementIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	announcement := &messengertypes.ScheduledAnnouncement{
+		ID:                    b64EncodeBytes(id),
+		ConversationPublicKey: conv.GetPublicKey(),
+		Body:                  req.GetBody(),
+		PinDuration:           req.GetPinDuration(),
+		PublishDate:           req.GetPublishDate(),
+		CreatedDate:           timestampMs(now),
+	}
+	if err := svc.db.addScheduledAnnouncement(announcement); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeScheduledAnnouncementUpdated, &messengertypes.StreamEvent_ScheduledAnnouncementUpdated{Announcement: announcement}, true); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationAnnounce_Reply{Scheduled: announcement}, nil
+}
+
+func (svc *service) ScheduledAnnouncementList(ctx context.Context, req *messengertypes.ScheduledAnnouncementList_Request) (*messengertypes.ScheduledAnnouncementList_Reply, error) {
+	announcements, err := svc.db.getScheduledAnnouncements(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ScheduledAnnouncementList_Reply{Announcements: announcements}, nil
+}
+
+func (svc *service) ScheduledAnnouncementCancel(ctx context.Context, req *messengertypes.ScheduledAnnouncementCancel_Request) (*messengertypes.ScheduledAnnouncementCancel_Reply, error) {
+	if req.GetID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	announcement, err := svc.db.deleteScheduledAnnouncement(req.GetID())
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeScheduledAnnouncementUpdated, &messengertypes.StreamEvent_ScheduledAnnouncementUpdated{Announcement: announcement, Removed: true}, false); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ScheduledAnnouncementCancel_Reply{}, nil
+}
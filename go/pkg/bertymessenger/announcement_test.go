@@ -0,0 +1,123 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageAnnouncement(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	announce := func(cid, memberPK string, sentDate, pinnedUntil int64) (*messengertypes.Conversation, bool) {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, isNew, err := h.handleAppMessageAnnouncement(db, &messengertypes.Interaction{CID: cid, Type: messengertypes.AppMessage_TypeAnnouncement, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, SentDate: sentDate}, &messengertypes.AppMessage_Announcement{Body: "body", PinnedUntil: pinnedUntil})
+		require.NoError(t, err)
+
+		conv, err = db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv, isNew
+	}
+
+	// the announcements of the regular members are ignored
+	_, isNew := announce("cid_1", "member_1", 1000, 5000)
+	require.False(t, isNew)
+
+	_, err = db.getInteractionByCID("cid_1")
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	conv, isNew := announce("cid_2", "member_admin", 2000, 0)
+	require.True(t, isNew)
+	require.Empty(t, conv.GetPinnedAnnouncementCID())
+
+	conv, _ = announce("cid_3", "member_admin", 3000, 9000)
+	require.Equal(t, "cid_3", conv.GetPinnedAnnouncementCID())
+	require.Equal(t, int64(9000), conv.GetPinnedAnnouncementUntil())
+
+	// an older pinned announcement doesn't replace the current one
+	conv, _ = announce("cid_4", "member_admin", 2500, 9000)
+	require.Equal(t, "cid_3", conv.GetPinnedAnnouncementCID())
+
+	conv, _ = announce("cid_5", "member_admin", 4000, 6000)
+	require.Equal(t, "cid_5", conv.GetPinnedAnnouncementCID())
+	require.Equal(t, int64(6000), conv.GetPinnedAnnouncementUntil())
+}
+
+func Test_dbWrapper_isInteractionSenderAllowed_announcementMode(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	conv, err := db.setConversationAnnouncementModeDate("conv_1", 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), conv.GetAnnouncementModeDate())
+
+	for _, tc := range []struct {
+		memberPK string
+		t        messengertypes.AppMessage_Type
+		sentDate int64
+		allowed  bool
+	}{
+		{"member_1", messengertypes.AppMessage_TypeUserMessage, 90, true},
+		{"member_1", messengertypes.AppMessage_TypeUserMessage, 110, false},
+		{"member_1", messengertypes.AppMessage_TypePollCreate, 110, false},
+		{"member_1", messengertypes.AppMessage_TypeUserReaction, 110, true},
+		{"member_1", messengertypes.AppMessage_TypeSetUserInfo, 110, true},
+		{"member_admin", messengertypes.AppMessage_TypeUserMessage, 110, true},
+	} {
+		allowed, err := db.isInteractionSenderAllowed(&messengertypes.Interaction{Conversation: conv, Type: tc.t, MemberPublicKey: tc.memberPK, SentDate: tc.sentDate})
+		require.NoError(t, err)
+		require.Equal(t, tc.allowed, allowed, "%s %s %d", tc.memberPK, tc.t, tc.sentDate)
+	}
+}
+
+func Test_dbWrapper_scheduledAnnouncements(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addScheduledAnnouncement(&messengertypes.ScheduledAnnouncement{ID: "id_1", ConversationPublicKey: "conv_1", Body: "body_1", PublishDate: 3000}))
+	require.NoError(t, db.addScheduledAnnouncement(&messengertypes.ScheduledAnnouncement{ID: "id_2", ConversationPublicKey: "conv_2", Body: "body_2", PublishDate: 1000}))
+	require.NoError(t, db.addScheduledAnnouncement(&messengertypes.ScheduledAnnouncement{ID: "id_3", ConversationPublicKey: "conv_1", Body: "body_3", PublishDate: 2000}))
+	require.Error(t, db.addScheduledAnnouncement(&messengertypes.ScheduledAnnouncement{ConversationPublicKey: "conv_1"}))
+
+	announcements, err := db.getScheduledAnnouncements("")
+	require.NoError(t, err)
+	require.Len(t, announcements, 3)
+	require.Equal(t, "id_2", announcements[0].GetID())
+
+	announcements, err = db.getScheduledAnnouncements("conv_1")
+	require.NoError(t, err)
+	require.Len(t, announcements, 2)
+	require.Equal(t, "id_3", announcements[0].GetID())
+
+	due, err := db.getDueScheduledAnnouncements(2000)
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+
+	announcement, err := db.deleteScheduledAnnouncement("id_1")
+	require.NoError(t, err)
+	require.Equal(t, "body_1", announcement.GetBody())
+
+	_, err = db.deleteScheduledAnnouncement("id_1")
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+}
@@ -0,0 +1,160 @@
+package bertymessenger
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// antiEntropyInterval is the delay between two reconciliations of the message logs with the database
+	antiEntropyInterval = 10 * time.Minute
+	// antiEntropyGroupCount is the number of groups compared by a reconciliation, the next ones are compared by the
+	// following reconciliations
+	antiEntropyGroupCount = 3
+	// antiEntropySampleSize is the number of the most recent events read from each message log
+	antiEntropySampleSize = 100
+)
+
+// The reconciliations compare the most recent events of the message logs with the events handled by the messenger,
+// an event neither in the ledger nor stored as an interaction was lost, ie. on a crash or by a failed subscription.
+// The missing events are replayed, the ones still missing after it, as the refused messages, are only reported.
+
+func (svc *service) monitorAntiEntropy(ctx context.Context) {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := svc.reconcileGroups(ctx); err != nil {
+			svc.logger.Error("unable to reconcile the groups", zap.Error(err))
+		}
+	}
+}
+
+// reconcileGroups compares the next groups of the rotation with the database
+func (svc *service) reconcileGroups(ctx context.Context) error {
+	groupPKs, err := func() ([]string, error) {
+		defer svc.writer.enter()()
+
+		groupPKs, err := svc.getReplayedGroups()
+		if err != nil {
+			return nil, err
+		}
+
+		// the messages of the account group are not handled
+		return groupPKs[1:], nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < antiEntropyGroupCount && i < len(groupPKs); i++ {
+		convPK := groupPKs[(svc.antiEntropyOffset+i)%len(groupPKs)]
+		if err := svc.reconcileGroup(ctx, convPK); err != nil {
+			svc.logger.Warn("unable to reconcile group", logGroup(convPK), zap.Error(err))
+		}
+	}
+
+	if len(groupPKs) > 0 {
+		svc.antiEntropyOffset = (svc.antiEntropyOffset + antiEntropyGroupCount) % len(groupPKs)
+	}
+
+	return nil
+}
+
+// reconcileGroup replays the events of the sample of a message log missing from the database
+func (svc *service) reconcileGroup(ctx context.Context, convPK string) error {
+	groupPK, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	events, _, err := listMessageHistory(ctx, svc.protocolClient, groupPK, nil, antiEntropySampleSize, historyPageMaxSize)
+	if err != nil {
+		return err
+	}
+
+	defer svc.writer.enter()()
+
+	missing, err := svc.getMissingEvents(convPK, events)
+	if err != nil {
+		return err
+	}
+
+	unresolved := []string(nil)
+	if len(missing) > 0 {
+		report := &messengertypes.ReplayReport{}
+		handler := newEventHandler(ctx, svc.db, svc.protocolClient, svc.logger, svc, true)
+		handler.report = report
+
+		cids := make([]string, len(missing))
+		for i := len(missing) - 1; i >= 0; i-- {
+			cids[i] = eventCID(missing[i].GetEventContext())
+			if err := handleMessageEvent(handler, groupPK, missing[i]); err != nil {
+				return err
+			}
+		}
+
+		if unresolved, err = svc.db.getUnknownEventCIDs(cids); err != nil {
+			return err
+		}
+
+		svc.logger.Warn("replayed events missing from the database",
+			logGroup(convPK),
+			zap.Int("missing", len(missing)),
+			zap.Int("unresolved", len(unresolved)),
+			zap.Int64("failed", report.GetFailedEvents()),
+		)
+	}
+
+	svc.eventDiagnostics.reconciled(convPK, len(missing), unresolved, time.Now())
+
+	return nil
+}
+
+// getMissingEvents returns the events of a sample, newest first, missing from the database. The events more recent
+// than the last one handled are left to the subscription, the unresolved ones are ignored
+func (svc *service) getMissingEvents(convPK string, events []*protocoltypes.GroupMessageEvent) ([]*protocoltypes.GroupMessageEvent, error) {
+	lastHandledCID := svc.eventDiagnostics.snapshot(convPK).GetLastHandledCID()
+	for i, evt := range events {
+		if eventCID(evt.GetEventContext()) == lastHandledCID {
+			events = events[i:]
+			break
+		}
+	}
+
+	byCID := map[string]*protocoltypes.GroupMessageEvent{}
+	cids := []string(nil)
+	for _, evt := range events {
+		cid := eventCID(evt.GetEventContext())
+		if cid == "" || svc.eventDiagnostics.isUnresolved(cid) {
+			continue
+		}
+
+		byCID[cid] = evt
+		cids = append(cids, cid)
+	}
+
+	unknown, err := svc.db.getUnknownEventCIDs(cids)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]*protocoltypes.GroupMessageEvent, len(unknown))
+	for i, cid := range unknown {
+		missing[i] = byCID[cid]
+	}
+
+	return missing, nil
+}
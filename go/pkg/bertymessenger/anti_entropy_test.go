@@ -0,0 +1,75 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	ipfscid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_dbWrapper_getUnknownEventCIDs(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	unknown, err := db.getUnknownEventCIDs(nil)
+	require.NoError(t, err)
+	require.Empty(t, unknown)
+
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash", 1))
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_1"}).Error)
+
+	unknown, err = db.getUnknownEventCIDs([]string{"cid_4", "cid_3", "cid_2", "cid_1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_4", "cid_2"}, unknown)
+}
+
+func Test_service_getMissingEvents(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), eventDiagnostics: newEventDiagnostics()}
+
+	// the sample is ordered newest first
+	events := []*protocoltypes.GroupMessageEvent(nil)
+	cids := []string(nil)
+	for _, data := range []string{"event_4", "event_3", "event_2", "event_1"} {
+		cid, err := ipfscid.Prefix{Version: 1, Codec: ipfscid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte(data))
+		require.NoError(t, err)
+
+		events = append(events, &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{ID: cid.Bytes()}})
+		cids = append(cids, cid.String())
+	}
+
+	require.NoError(t, db.markEventProcessed(cids[2], "conv_1", "hash", 1))
+
+	missing, err := svc.getMissingEvents("conv_1", events)
+	require.NoError(t, err)
+	require.Equal(t, []*protocoltypes.GroupMessageEvent{events[0], events[1], events[3]}, missing)
+
+	// the events more recent than the last handled one are left to the subscription
+	svc.eventDiagnostics.messageHandled("conv_1", events[1].GetEventContext(), time.Now())
+	missing, err = svc.getMissingEvents("conv_1", events)
+	require.NoError(t, err)
+	require.Equal(t, []*protocoltypes.GroupMessageEvent{events[1], events[3]}, missing)
+
+	// the unresolved events are not replayed again
+	svc.eventDiagnostics.reconciled("conv_1", 2, []string{cids[3]}, time.Now())
+	missing, err = svc.getMissingEvents("conv_1", events)
+	require.NoError(t, err)
+	require.Equal(t, []*protocoltypes.GroupMessageEvent{events[1]}, missing)
+
+	group := svc.eventDiagnostics.snapshot("conv_1")
+	require.Equal(t, int64(2), group.GetMissingEvents())
+	require.Equal(t, int64(1), group.GetUnresolvedEvents())
+	require.Equal(t, int64(1), group.GetReconciliationReplays())
+
+	last, total := svc.eventDiagnostics.totalReconciled()
+	require.Equal(t, group.GetLastReconciliationDate(), last)
+	require.Equal(t, int64(2), total)
+}
@@ -1,7 +1,10 @@
 package bertymessenger
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -15,13 +18,14 @@ import (
 	ipfscid "github.com/ipfs/go-cid"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 
 	"berty.tech/berty/v2/go/internal/bertylinks"
+	"berty.tech/berty/v2/go/internal/cryptoutil"
 	"berty.tech/berty/v2/go/internal/discordlog"
 	"berty.tech/berty/v2/go/internal/streamutil"
 	"berty.tech/berty/v2/go/internal/sysutil"
 	"berty.tech/berty/v2/go/pkg/banner"
-	"berty.tech/berty/v2/go/pkg/bertyprotocol"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/berty/v2/go/pkg/messengertypes"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
@@ -29,8 +33,7 @@ import (
 )
 
 func (svc *service) DevShareInstanceBertyID(ctx context.Context, req *messengertypes.DevShareInstanceBertyID_Request) (*messengertypes.DevShareInstanceBertyID_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	ret, err := svc.internalInstanceShareableBertyID(ctx, &messengertypes.InstanceShareableBertyID_Request{
 		DisplayName: req.DisplayName,
@@ -48,8 +51,7 @@ func (svc *service) DevShareInstanceBertyID(ctx context.Context, req *messengert
 }
 
 func (svc *service) InstanceShareableBertyID(ctx context.Context, req *messengertypes.InstanceShareableBertyID_Request) (*messengertypes.InstanceShareableBertyID_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 	// need to split the function for internal calls to prevent deadlocks
 	return svc.internalInstanceShareableBertyID(ctx, req)
 }
@@ -101,6 +103,9 @@ func (svc *service) internalInstanceShareableBertyID(ctx context.Context, req *m
 		PublicRendezvousSeed: res.PublicRendezvousSeed,
 		AccountPK:            config.AccountPK,
 	}
+	if req.IncludeConnectionHints {
+		id.ConnectionHints = svc.connectionHints
+	}
 	link := id.GetBertyLink()
 
 	if req.Passphrase != nil && string(req.Passphrase) != "" {
@@ -143,8 +148,7 @@ func (svc *service) ShareableBertyGroup(ctx context.Context, req *messengertypes
 		return nil, errcode.ErrInvalidInput
 	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	grpInfo, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{
 		GroupPK: req.GroupPK,
@@ -176,9 +180,11 @@ func (svc *service) SendContactRequest(ctx context.Context, req *messengertypes.
 	if req == nil || req.BertyID == nil || req.BertyID.AccountPK == nil || req.BertyID.PublicRendezvousSeed == nil {
 		return nil, errcode.ErrMissingInput
 	}
+	if err := req.BertyID.ConnectionHints.IsValid(); err != nil {
+		return nil, err
+	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	contactRequest := protocoltypes.ContactRequestSend_Request{
 		Contact: &protocoltypes.ShareableContact{
@@ -186,7 +192,8 @@ func (svc *service) SendContactRequest(ctx context.Context, req *messengertypes.
 			PublicRendezvousSeed: req.BertyID.PublicRendezvousSeed,
 			Metadata:             req.Metadata,
 		},
-		OwnMetadata: req.OwnMetadata,
+		OwnMetadata:     req.OwnMetadata,
+		ConnectionHints: req.BertyID.GetConnectionHints().Addrs(),
 	}
 	_, err := svc.protocolClient.ContactRequestSend(ctx, &contactRequest)
 	if err != nil {
@@ -215,7 +222,6 @@ func (svc *service) autoReplicateContactGroupOnAllServers(contactPK []byte) {
 }
 
 func (svc *service) autoReplicateGroupOnAllServers(groupPK []byte) {
-	replicationServices := map[string]*messengertypes.ServiceToken{}
 	acc, err := svc.db.getAccount()
 	if err != nil {
 		svc.logger.Error("unable to fetch account", zap.Error(err))
@@ -226,10 +232,11 @@ func (svc *service) autoReplicateGroupOnAllServers(groupPK []byte) {
 		svc.logger.Warn("group auto replication is not enabled")
 		return
 	}
-	for _, s := range acc.ServiceTokens {
-		if s.ServiceType == bertyprotocol.ServiceReplicationID {
-			replicationServices[s.AuthenticationURL] = s
-		}
+
+	replicationServices, err := svc.replicationTokens()
+	if err != nil {
+		svc.logger.Error("unable to list the replication services", zap.Error(err))
+		return
 	}
 
 	if len(replicationServices) == 0 {
@@ -273,6 +280,41 @@ func (svc *service) SystemInfo(ctx context.Context, req *messengertypes.SystemIn
 		}
 	}
 
+	// replay health, it reads the logs of every conversation
+	if req.GetDiagnostics() {
+		diagnostics, err := svc.getDiagnostics(ctx)
+		errs = multierr.Append(errs, err)
+		reply.Messenger.Diagnostics = diagnostics
+	}
+
+	// delivery latency of the messages received since the start
+	if svc.deliveryLatencies != nil {
+		reply.Messenger.DeliveryLatencies = svc.deliveryLatencies.snapshot()
+	}
+
+	// space reclaimed by the media garbage collector since the start
+	reply.Messenger.MediaGC = svc.mediaGCStats.snapshot()
+
+	// last maintenance of the database since the start
+	reply.Messenger.Maintenance = svc.maintenanceStats.snapshot()
+
+	// check of the database made at startup and its repair
+	reply.Messenger.StartupCheck = svc.startupCheck.snapshot()
+	reply.Messenger.Dedup = svc.eventDedup.snapshot()
+	reply.Messenger.Validation = svc.validationStats.snapshot()
+
+	// writes to the database since the start
+	reply.Messenger.CommandQueue = svc.writer.snapshot()
+
+	// savings of the low-storage mode
+	if acc, err := svc.db.getAccount(); err != nil {
+		errs = multierr.Append(errs, err)
+	} else if lowStorage, err := svc.lowStorageInfo(acc); err != nil {
+		errs = multierr.Append(errs, err)
+	} else {
+		reply.Messenger.LowStorage = lowStorage
+	}
+
 	// protocol
 	protocol, err := svc.protocolClient.SystemInfo(ctx, &protocoltypes.SystemInfo_Request{})
 	errs = multierr.Append(errs, err)
@@ -296,8 +338,7 @@ func (svc *service) SystemInfo(ctx context.Context, req *messengertypes.SystemIn
 }
 
 func (svc *service) SendAck(ctx context.Context, req *messengertypes.SendAck_Request) (*messengertypes.SendAck_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	gInfo, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{
 		GroupPK: req.GroupPK,
@@ -310,14 +351,28 @@ func (svc *service) SendAck(ctx context.Context, req *messengertypes.SendAck_Req
 		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only %s groups are supported", protocoltypes.GroupTypeContact.String()))
 	}
 
-	am, err := messengertypes.AppMessage_TypeAcknowledge.MarshalPayload(0, nil, &messengertypes.AppMessage_Acknowledge{
+	// acks would leak our presence to a blocked contact or member, the sender is unknown until the message is received
+	target := &messengertypes.Interaction{}
+	if i, err := svc.db.getInteractionByCID(b64EncodeBytes(req.MessageID)); err == nil {
+		target = i
+	} else if len(req.MessageID) != 0 && err != gorm.ErrRecordNotFound {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if blocked, err := svc.db.isAckTargetBlocked(b64EncodeBytes(req.GroupPK), target.GetMemberPublicKey(), target.GetDevicePublicKey()); err != nil {
+		return nil, err
+	} else if blocked {
+		return &messengertypes.SendAck_Reply{}, nil
+	}
+
+	am, err := messengertypes.AppMessage_TypeAcknowledge.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_Acknowledge{
 		Target: b64EncodeBytes(req.MessageID),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = svc.protocolClient.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+	err = svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{
 		GroupPK: req.GroupPK,
 		Payload: am,
 	})
@@ -330,19 +385,32 @@ func (svc *service) SendAck(ctx context.Context, req *messengertypes.SendAck_Req
 }
 
 func (svc *service) SendMessage(ctx context.Context, req *messengertypes.SendMessage_Request) (*messengertypes.SendMessage_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	um := &messengertypes.AppMessage_UserMessage{Body: req.Message}
+	previewMedias := svc.attachLinkPreviews(ctx, um)
 
-	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_UserMessage{
-		Body: req.Message,
-	})
+	defer svc.writer.enter()()
+
+	previewCIDs, err := svc.addLinkPreviewMedias(previewMedias)
+	if err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	cids := make([][]byte, len(previewCIDs))
+	for i, mediaCID := range previewCIDs {
+		if cids[i], err = b64DecodeBytes(mediaCID); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+	}
+
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(timestampMs(time.Now()), previewMedias, um)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = svc.protocolClient.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
-		GroupPK: req.GroupPK,
-		Payload: payload,
+	err = svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPK:        req.GroupPK,
+		Payload:        payload,
+		AttachmentCIDs: cids,
 	})
 
 	return &messengertypes.SendMessage_Reply{}, err
@@ -395,7 +463,78 @@ func (svc *service) ConversationStream(req *messengertypes.ConversationStream_Re
 }
 
 func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub messengertypes.MessengerService_EventStreamServer) error {
-	// TODO: cursors
+	subscriber := newStreamEventSubscriber(req)
+
+	// subscribe before listing the existing models so no event is missed
+	notify, unsubscribe := svc.streamEvents.subscribe()
+	defer unsubscribe()
+
+	cursor := req.GetSinceOffset()
+	if cursor == 0 {
+		cursor = svc.streamEvents.last()
+
+		if err := svc.sendExistingModels(sub, subscriber.filter); err != nil {
+			return err
+		}
+	}
+
+	// stream new events, the events dispatched while sending are bounded by the overflow policy of the subscriber
+	for {
+		entries, dropped := svc.streamEvents.since(cursor)
+		pending, gap, err := subscriber.pending(cursor, entries, dropped)
+		if err != nil {
+			svc.logger.Warn("closing the stream of a slow subscriber", zap.Error(err))
+			return err
+		}
+
+		if len(entries) > 0 {
+			cursor = entries[len(entries)-1].offset
+		}
+
+		if gap != nil {
+			svc.logger.Debug("sending stream gap", zap.Uint64("missed", gap.GetMissed()))
+			payload, err := proto.Marshal(gap)
+			if err != nil {
+				return err
+			}
+
+			event := &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeStreamGap, Payload: payload}
+			if err := sub.Send(&messengertypes.EventStream_Reply{Event: event, Offset: gap.GetUntilOffset(), Missed: gap.GetMissed()}); err != nil {
+				return err
+			}
+		}
+
+		for _, entry := range pending {
+			svc.logger.Debug("sending stream event", zap.String("type", entry.event.GetType().String()))
+			if err := sub.Send(&messengertypes.EventStream_Reply{Event: entry.event, Offset: entry.offset}); err != nil {
+				return err
+			}
+		}
+
+		// don't return until we have a send error or the context is canceled
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case <-notify:
+		}
+	}
+}
+
+// sendExistingModels lists the models of the database matching filter to an EventStream subscriber, followed by a
+// ListEnded event
+func (svc *service) sendExistingModels(sub messengertypes.MessengerService_EventStreamServer, filter streamEventFilter) error {
+	send := func(typ messengertypes.StreamEvent_Type, conversationPK string, msg proto.Message) error {
+		if !filter.matches(typ, conversationPK) {
+			return nil
+		}
+
+		payload, err := proto.Marshal(withNicknames(msg))
+		if err != nil {
+			return err
+		}
+
+		return sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: typ, Payload: payload, IsNew: false}})
+	}
 
 	// send account
 	{
@@ -404,11 +543,7 @@ func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub mes
 		if err != nil {
 			return err
 		}
-		au, err := proto.Marshal(&messengertypes.StreamEvent_AccountUpdated{Account: acc})
-		if err != nil {
-			return err
-		}
-		if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeAccountUpdated, Payload: au, IsNew: false}}); err != nil {
+		if err := send(messengertypes.StreamEvent_TypeAccountUpdated, "", &messengertypes.StreamEvent_AccountUpdated{Account: acc}); err != nil {
 			return err
 		}
 	}
@@ -421,11 +556,7 @@ func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub mes
 		}
 		svc.logger.Info("sending existing contacts", zap.Int("count", len(contacts)))
 		for _, contact := range contacts {
-			cu, err := proto.Marshal(&messengertypes.StreamEvent_ContactUpdated{Contact: contact})
-			if err != nil {
-				return err
-			}
-			if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeContactUpdated, Payload: cu, IsNew: false}}); err != nil {
+			if err := send(messengertypes.StreamEvent_TypeContactUpdated, "", &messengertypes.StreamEvent_ContactUpdated{Contact: contact}); err != nil {
 				return err
 			}
 		}
@@ -439,29 +570,21 @@ func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub mes
 		}
 		svc.logger.Debug("sending existing conversations", zap.Int("count", len(convs)))
 		for _, conv := range convs {
-			cu, err := proto.Marshal(&messengertypes.StreamEvent_ConversationUpdated{Conversation: conv})
-			if err != nil {
-				return err
-			}
-			if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeConversationUpdated, Payload: cu, IsNew: false}}); err != nil {
+			if err := send(messengertypes.StreamEvent_TypeConversationUpdated, conv.GetPublicKey(), &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}); err != nil {
 				return err
 			}
 		}
 	}
 
 	// send members
-	{
+	if !filter.skipMembers {
 		members, err := svc.db.getAllMembers()
 		if err != nil {
 			return err
 		}
 		svc.logger.Info("sending existing members", zap.Int("count", len(members)))
 		for _, member := range members {
-			mu, err := proto.Marshal(&messengertypes.StreamEvent_MemberUpdated{Member: member})
-			if err != nil {
-				return err
-			}
-			if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeMemberUpdated, Payload: mu, IsNew: false}}); err != nil {
+			if err := send(messengertypes.StreamEvent_TypeMemberUpdated, member.GetConversationPublicKey(), &messengertypes.StreamEvent_MemberUpdated{Member: member}); err != nil {
 				return err
 			}
 		}
@@ -475,11 +598,7 @@ func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub mes
 		}
 		svc.logger.Info("sending existing interactions", zap.Int("count", len(interactions)))
 		for _, inte := range interactions {
-			iu, err := proto.Marshal(&messengertypes.StreamEvent_InteractionUpdated{Interaction: inte})
-			if err != nil {
-				return err
-			}
-			if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeInteractionUpdated, Payload: iu, IsNew: false}}); err != nil {
+			if err := send(messengertypes.StreamEvent_TypeInteractionUpdated, inte.GetConversationPublicKey(), &messengertypes.StreamEvent_InteractionUpdated{Interaction: inte}); err != nil {
 				return err
 			}
 		}
@@ -493,60 +612,27 @@ func (svc *service) EventStream(req *messengertypes.EventStream_Request, sub mes
 		}
 		svc.logger.Info("sending existing medias", zap.Int("count", len(medias)))
 		for _, media := range medias {
-			mu, err := proto.Marshal(&messengertypes.StreamEvent_MediaUpdated{Media: media})
-			if err != nil {
-				return err
-			}
-			if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeMediaUpdated, Payload: mu, IsNew: false}}); err != nil {
+			if err := send(messengertypes.StreamEvent_TypeMediaUpdated, "", &messengertypes.StreamEvent_MediaUpdated{Media: media}); err != nil {
 				return err
 			}
 		}
 	}
 
 	// signal that we're done sending existing models
-	{
-		p, err := proto.Marshal(&messengertypes.StreamEvent_ListEnded{})
-		if err != nil {
-			return err
-		}
-		if err := sub.Send(&messengertypes.EventStream_Reply{Event: &messengertypes.StreamEvent{Type: messengertypes.StreamEvent_TypeListEnded, Payload: p, IsNew: false}}); err != nil {
-			return err
-		}
-	}
-
-	// FIXME: case where a model is created/updated/deleted between the list and the stream
-	// dunno how to add a test to trigger, maybe it can never happen? don't know how to prove either way
+	return send(messengertypes.StreamEvent_TypeListEnded, "", &messengertypes.StreamEvent_ListEnded{})
+}
 
-	// stream new events
-	{
-		errch := make(chan error)
-		defer close(errch)
-		n := NotifieeBundle{StreamEventImpl: func(e *messengertypes.StreamEvent) error {
-			svc.logger.Debug("sending stream event", zap.String("type", e.GetType().String()))
-			err := sub.Send(&messengertypes.EventStream_Reply{Event: e})
-			if err != nil {
-				// next commmented line allows me to manually test the behavior on a send error. How to isolate into an automatic test?
-				// errch <- errors.New("TEST ERROR")
-				errch <- err
-			}
-			return nil
-		}}
-		unreg := svc.dispatcher.Register(&n)
-		defer unreg()
+func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.ConversationCreate_Request) (*messengertypes.ConversationCreate_Reply, error) {
+	if req.GetMaxMembers() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the maximum number of members can't be negative"))
+	}
 
-		// don't return until we have a send error or the context is canceled
-		select {
-		case err := <-errch:
-			return err
-		case <-sub.Context().Done():
-			return nil
-		}
+	// the creator is the first member of the group
+	if maxMembers := int(req.GetMaxMembers()); maxMembers != 0 && len(req.GetContactsToInvite())+1 > maxMembers {
+		return nil, errcode.ErrGroupFull.Wrap(fmt.Errorf("%d contacts can't be invited to a group of %d members", len(req.GetContactsToInvite()), maxMembers))
 	}
-}
 
-func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.ConversationCreate_Request) (*messengertypes.ConversationCreate_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	dn := req.GetDisplayName()
 
@@ -557,13 +643,13 @@ func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.
 	}
 	pk := cr.GetGroupPK()
 	pkStr := b64EncodeBytes(pk)
-	svc.logger.Info("Created conv", zap.String("dn", req.GetDisplayName()), zap.String("pk", pkStr))
+	svc.logger.Info("Created conv", zap.String("dn", req.GetDisplayName()), logGroup(pkStr))
 
 	// activate group
 	{
 		_, err := svc.protocolClient.ActivateGroup(svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: pk})
 		if err != nil {
-			svc.logger.Warn("failed to activate group", zap.String("pk", pkStr))
+			svc.logger.Warn("failed to activate group", logGroup(pkStr))
 		}
 	}
 
@@ -572,9 +658,11 @@ func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.
 		return nil, errcode.TODO.Wrap(err)
 	}
 
+	createdDate := timestampMs(time.Now())
 	group := &messengertypes.BertyGroup{
 		Group:       gir.GetGroup(),
 		DisplayName: req.GetDisplayName(),
+		CreatedDate: createdDate,
 	}
 	link := group.GetBertyLink()
 	_, webURL, err := bertylinks.MarshalLink(link)
@@ -590,7 +678,7 @@ func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.
 		Link:                   webURL,
 		Type:                   messengertypes.Conversation_MultiMemberType,
 		LocalDevicePublicKey:   b64EncodeBytes(gir.GetDevicePK()),
-		CreatedDate:            timestampMs(time.Now()),
+		CreatedDate:            createdDate,
 	}
 
 	// Update database
@@ -623,6 +711,12 @@ func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.
 		}
 	}
 
+	if req.GetMaxMembers() != 0 {
+		if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetMemberCap, &messengertypes.AppMessage_SetMemberCap{MaxMembers: req.GetMaxMembers()}); err != nil {
+			return nil, err
+		}
+	}
+
 	/* There is a tradoff between privacy and log size here, we could send the user name as a message but it would require
 	** to re-add the name to the log everytime a new user arrives in the conversation which is bad for large public groups
 	** It would make sense to offer it as an option for privacy sensitive groups of small sizes though
@@ -645,7 +739,7 @@ func (svc *service) ConversationCreate(ctx context.Context, req *messengertypes.
 		if err != nil {
 			return nil, err
 		}
-		_, err = svc.protocolClient.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: ginfo.GetGroup().GetPublicKey(), Payload: am})
+		err = svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: ginfo.GetGroup().GetPublicKey(), Payload: am})
 		if err != nil {
 			return nil, err
 		}
@@ -673,9 +767,11 @@ func (svc *service) ConversationJoin(ctx context.Context, req *messengertypes.Co
 	if !link.IsGroup() {
 		return nil, errcode.ErrInvalidInput
 	}
+	if expiresAt := link.GetBertyGroup().GetInvitationExpiresAt(); expiresAt != 0 && expiresAt < timestampMs(time.Now()) {
+		return nil, errcode.ErrMessengerInvalidDeepLink.Wrap(fmt.Errorf("the invitation link has expired"))
+	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	bgroup := link.GetBertyGroup()
 	gpkb := bgroup.GetGroup().GetPublicKey()
@@ -690,7 +786,7 @@ func (svc *service) ConversationJoin(ctx context.Context, req *messengertypes.Co
 	{
 		_, err := svc.protocolClient.ActivateGroup(svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: gpkb})
 		if err != nil {
-			svc.logger.Warn("failed to activate group", zap.String("pk", b64EncodeBytes(gpkb)))
+			svc.logger.Warn("failed to activate group", logGroup(b64EncodeBytes(gpkb)))
 		}
 	}
 
@@ -707,6 +803,7 @@ func (svc *service) ConversationJoin(ctx context.Context, req *messengertypes.Co
 		Type:                   messengertypes.Conversation_MultiMemberType,
 		LocalDevicePublicKey:   b64EncodeBytes(gir.GetDevicePK()),
 		CreatedDate:            timestampMs(time.Now()),
+		IsObserver:             req.GetObserver(),
 	}
 
 	// update db
@@ -730,6 +827,12 @@ func (svc *service) ConversationJoin(ctx context.Context, req *messengertypes.Co
 		}
 	}
 
+	if invitationID := bgroup.GetInvitationID(); invitationID != "" {
+		if err := svc.sendGroupInvitationLinkUsed(ctx, gpkb, invitationID); err != nil {
+			svc.logger.Error("failed to notify the use of the invitation link", zap.Error(err))
+		}
+	}
+
 	return &messengertypes.ConversationJoin_Reply{}, nil
 }
 
@@ -748,8 +851,7 @@ func ensureValidBase64CID(str string) error {
 }
 
 func (svc *service) AccountUpdate(ctx context.Context, req *messengertypes.AccountUpdate_Request) (*messengertypes.AccountUpdate_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	avatarCID := req.GetAvatarCID()
 	if avatarCID != "" {
@@ -760,6 +862,11 @@ func (svc *service) AccountUpdate(ctx context.Context, req *messengertypes.Accou
 		}
 	}
 
+	if err := ensureValidStatusText(req.GetStatusText()); err != nil {
+		return nil, err
+	}
+
+	updated := false
 	err := svc.db.tx(func(tx *dbWrapper) error {
 		acc, err := tx.getAccount()
 		if err != nil {
@@ -767,32 +874,49 @@ func (svc *service) AccountUpdate(ctx context.Context, req *messengertypes.Accou
 			return errcode.TODO.Wrap(err)
 		}
 
-		updated := false
+		infoUpdated := false
 		dn := req.GetDisplayName()
 		if dn != "" && dn != acc.GetDisplayName() {
-			updated = true
+			infoUpdated = true
 		}
 		if avatarCID != "" && avatarCID != acc.GetAvatarCID() {
-			updated = true
+			infoUpdated = true
+		}
+
+		statusText := acc.GetStatusText()
+		if req.GetClearStatusText() {
+			statusText = ""
+		} else if req.GetStatusText() != "" {
+			statusText = req.GetStatusText()
 		}
+		statusUpdated := statusText != acc.GetStatusText()
 
-		if !updated {
+		if !infoUpdated && !statusUpdated {
 			svc.logger.Debug("AccountUpdate: nothing to do")
 			return nil
 		}
 		svc.logger.Debug("AccountUpdate: updating account", zap.String("display_name", dn), zap.String("avatar_cid", avatarCID))
 
-		ret, err := svc.internalInstanceShareableBertyID(ctx, &messengertypes.InstanceShareableBertyID_Request{DisplayName: dn})
-		if err != nil {
-			svc.logger.Error("AccountUpdate: account link", zap.Error(err))
-			return err
+		if infoUpdated {
+			ret, err := svc.internalInstanceShareableBertyID(ctx, &messengertypes.InstanceShareableBertyID_Request{DisplayName: dn})
+			if err != nil {
+				svc.logger.Error("AccountUpdate: account link", zap.Error(err))
+				return err
+			}
+
+			if _, err = tx.updateAccount(acc.PublicKey, ret.GetWebURL(), dn, avatarCID); err != nil {
+				svc.logger.Error("AccountUpdate: updating account in db", zap.Error(err))
+				return err
+			}
 		}
 
-		acc, err = tx.updateAccount(acc.PublicKey, ret.GetWebURL(), dn, avatarCID)
+		// the profile is flagged as pending until the broadcast sends it
+		acc, err = tx.setAccountStatusText(acc.PublicKey, statusText)
 		if err != nil {
 			svc.logger.Error("AccountUpdate: updating account in db", zap.Error(err))
 			return err
 		}
+		updated = true
 
 		// dispatch event
 		err = svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false)
@@ -807,15 +931,9 @@ func (svc *service) AccountUpdate(ctx context.Context, req *messengertypes.Accou
 		return nil, err
 	}
 
-	convos, err := svc.db.getAllConversations()
-	if err != nil {
-		svc.logger.Error("AccountUpdate: get conversations", zap.Error(err))
-	} else {
-		for _, conv := range convos {
-			if err := svc.sendAccountUserInfo(conv.GetPublicKey()); err != nil {
-				svc.logger.Error("AccountUpdate: send user info", zap.Error(err))
-			}
-		}
+	// the conversations are sent the profile by the broadcast, the changes made before it are batched
+	if updated {
+		svc.profileBroadcast.schedule(time.Now())
 	}
 
 	svc.logger.Debug("AccountUpdate finished", zap.Error(err))
@@ -834,39 +952,68 @@ func (svc *service) ContactRequest(ctx context.Context, req *messengertypes.Cont
 		return nil, errcode.ErrMessengerInvalidDeepLink.Wrap(err)
 	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	ownMetadata := &messengertypes.ContactMetadata{
+		IntroMessage:   req.GetIntroMessage(),
+		Avatar:         req.GetAvatar(),
+		AvatarMimeType: req.GetAvatarMimeType(),
+	}
+	if err := ownMetadata.IsValidIntro(); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	if req.GetShareGroupMemberships() {
+		if ownMetadata.SharedGroups, err = svc.db.getOwnGroupMemberships(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := svc.sendContactRequest(ctx, link.BertyID, ownMetadata); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequest_Reply{}, nil
+}
 
+// sendContactRequest sends a contact request to the account of a contact link, the writer must be held
+func (svc *service) sendContactRequest(ctx context.Context, id *messengertypes.BertyID, ownMetadata *messengertypes.ContactMetadata) error {
 	acc, err := svc.db.getAccount()
 	if err != nil {
-		return nil, errcode.TODO.Wrap(err)
+		return errcode.TODO.Wrap(err)
 	}
-	om, err := proto.Marshal(&messengertypes.ContactMetadata{DisplayName: acc.GetDisplayName()})
+	ownMetadata.DisplayName = acc.GetDisplayName()
+	om, err := proto.Marshal(ownMetadata)
 	if err != nil {
-		return nil, errcode.ErrInternal.Wrap(err)
+		return errcode.ErrInternal.Wrap(err)
 	}
 
-	m, err := proto.Marshal(&messengertypes.ContactMetadata{DisplayName: link.BertyID.GetDisplayName()})
+	m, err := proto.Marshal(&messengertypes.ContactMetadata{DisplayName: id.GetDisplayName()})
 	if err != nil {
-		return nil, errcode.ErrInternal.Wrap(err)
+		return errcode.ErrInternal.Wrap(err)
 	}
 
 	contactRequest := protocoltypes.ContactRequestSend_Request{
 		Contact: &protocoltypes.ShareableContact{
-			PK:                   link.BertyID.GetAccountPK(),
-			PublicRendezvousSeed: link.BertyID.GetPublicRendezvousSeed(),
+			PK:                   id.GetAccountPK(),
+			PublicRendezvousSeed: id.GetPublicRendezvousSeed(),
 			Metadata:             m,
 		},
-		OwnMetadata: om,
+		OwnMetadata:     om,
+		ConnectionHints: id.GetConnectionHints().Addrs(),
 	}
 	_, err = svc.protocolClient.ContactRequestSend(ctx, &contactRequest)
 	if err != nil {
-		return nil, errcode.TODO.Wrap(err)
+		return errcode.TODO.Wrap(err)
+	}
+
+	if err := svc.trackOutgoingContactRequest(&contactRequest, time.Now()); err != nil {
+		svc.logger.Warn("unable to keep the outgoing contact request", zap.String("contact-pk", b64EncodeBytes(contactRequest.Contact.PK)), zap.Error(err))
 	}
 
 	go svc.autoReplicateContactGroupOnAllServers(contactRequest.Contact.PK)
 
-	return &messengertypes.ContactRequest_Reply{}, nil
+	return nil
 }
 
 func (svc *service) ContactAccept(ctx context.Context, req *messengertypes.ContactAccept_Request) (*messengertypes.ContactAccept_Reply, error) {
@@ -880,8 +1027,7 @@ func (svc *service) ContactAccept(ctx context.Context, req *messengertypes.Conta
 		return nil, errcode.ErrInvalidInput
 	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	svc.logger.Debug("retrieving contact", zap.String("contact_pk", pk))
 
@@ -890,7 +1036,7 @@ func (svc *service) ContactAccept(ctx context.Context, req *messengertypes.Conta
 		return nil, errcode.TODO.Wrap(err)
 	}
 
-	if c.State != messengertypes.Contact_IncomingRequest {
+	if c.State != messengertypes.Contact_IncomingRequest && c.State != messengertypes.Contact_IncomingRequestIgnored {
 		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact request status is not IncomingRequest %s)", c.State.String()))
 	}
 
@@ -910,49 +1056,202 @@ func (svc *service) Interact(ctx context.Context, req *messengertypes.Interact_R
 		return nil, errcode.ErrMissingInput
 	}
 
-	svc.logger.Info("interacting", zap.String("public-key", gpk))
+	svc.logger.Info("interacting", logGroup(gpk))
+
+	// the group of a paused conversation isn't active
+	if conv, err := svc.db.getConversationByPK(gpk); err == nil && conv.GetIsPaused() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation is paused"))
+	} else if err == nil && conv.GetIsObserver() {
+		return nil, errcode.ErrConversationObserved
+	} else if err == nil {
+		if err := checkNotesToSelfInteraction(conv, req.GetType()); err != nil {
+			return nil, err
+		}
+	}
+
+	// the span context is passed with ctx to the protocol, which injects it in the headers of the message
+	ctx, span := svc.startSendSpan(ctx, gpk, req.GetType())
+	defer span.End()
+
 	gpkb, err := b64DecodeBytes(gpk)
 	if err != nil {
 		return nil, errcode.ErrInvalidInput.Wrap(err)
 	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	if req.GetTTLMs() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the ttl of a message can't be negative"))
+	}
+	ttl := time.Duration(req.GetTTLMs()) * time.Millisecond
+
+	var (
+		um            messengertypes.AppMessage_UserMessage
+		previewMedias []*messengertypes.Media
+	)
+	if req.GetType() == messengertypes.AppMessage_TypeUserMessage {
+		if err := proto.Unmarshal(req.GetPayload(), &um); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if err := um.CheckFormatting(); err != nil {
+			return nil, err
+		}
+
+		// previews involve network requests, fetch them before locking
+		previewMedias = svc.attachLinkPreviews(ctx, &um)
+	}
+
+	// the receivers reject the reactions to the system events
+	if req.GetType() == messengertypes.AppMessage_TypeUserReaction {
+		var reaction messengertypes.AppMessage_UserReaction
+		if err := proto.Unmarshal(req.GetPayload(), &reaction); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if reason, err := checkReactionTarget(svc.db, gpk, reaction.GetTarget()); err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		} else if reason != "" {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the reaction can't be sent: %s", reason))
+		}
+	}
+
+	defer svc.writer.enter()()
+
+	// the mentions sent by the client are kept as is
+	if req.GetType() == messengertypes.AppMessage_TypeUserMessage && len(um.GetMentions()) == 0 {
+		members, err := svc.db.getMembersByConversation(gpk)
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		um.Mentions = parseMentions(um.GetBody(), members)
+	}
+
+	// the quote of a reply is built from the quoted message, the client only sets its cid
+	if req.GetType() == messengertypes.AppMessage_TypeUserMessage && um.GetQuote() != nil {
+		quote, err := svc.db.quoteInteraction(gpk, um.GetQuote().GetCID())
+		if err != nil {
+			return nil, err
+		}
+		um.Quote = quote
+	}
 
+	var (
+		outboxed *messengertypes.OutboxMessage
+		echo     *messengertypes.LocalEcho
+	)
 	switch req.GetType() {
 	case messengertypes.AppMessage_TypeUserMessage:
-		var p messengertypes.AppMessage_UserMessage
-		if err := proto.Unmarshal(req.GetPayload(), &p); err != nil {
-			return nil, errcode.ErrInvalidInput.Wrap(err)
+		now := time.Now()
+		contentHash := interactContentHash(req)
+		if !req.GetForceSend() {
+			if err := svc.checkDuplicateSend(gpk, contentHash, now); err != nil {
+				return nil, err
+			}
+		}
+
+		previewCIDs, err := svc.addLinkPreviewMedias(previewMedias)
+		if err != nil {
+			return nil, errcode.ErrDBWrite.Wrap(err)
 		}
-		medias, err := svc.db.getMedias(req.GetMediaCids())
+		mediaCIDs := append(append([]string(nil), req.GetMediaCids()...), previewCIDs...)
+		medias, err := svc.db.getMedias(mediaCIDs)
 		if err != nil {
 			return nil, errcode.ErrDBRead.Wrap(err)
 		}
-		fp, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(timestampMs(time.Now()), medias, &p)
+		if err := messengertypes.CheckExtensions(req.GetExtensions()); err != nil {
+			return nil, err
+		}
+		fp, err := messengertypes.AppMessage_TypeUserMessage.MarshalExtendedPayload(timestampMs(now), medias, &um, req.GetViaGateway(), req.GetExtensions())
 		if err != nil {
 			return nil, errcode.ErrInternal.Wrap(err)
 		}
-		cids := make([][]byte, len(req.GetMediaCids()))
-		for i, mediaCID := range req.GetMediaCids() {
-			cids[i], err = b64DecodeBytes(mediaCID)
+		// the chunks of the medias uploaded in chunks are attached with their manifest
+		chunkCIDs, err := svc.db.getMediaUploadChunkCIDs(mediaCIDs)
+		if err != nil {
+			return nil, err
+		}
+		cids := make([][]byte, 0, len(mediaCIDs)+len(chunkCIDs))
+		for _, attachmentCID := range append(append([]string(nil), mediaCIDs...), chunkCIDs...) {
+			cid, err := b64DecodeBytes(attachmentCID)
 			if err != nil {
 				return nil, errcode.ErrDeserialization.Wrap(err)
 			}
+			cids = append(cids, cid)
+		}
+		outboxed, echo, err = svc.sendWithLocalEcho(ctx, req.GetType(), contentHash, ttl, &protocoltypes.AppMessageSend_Request{GroupPK: gpkb, Payload: fp, AttachmentCIDs: cids})
+		if err != nil {
+			return nil, err
+		}
+		svc.recordSentContent(gpk, contentHash, now)
+	case messengertypes.AppMessage_TypeLocation:
+		var p messengertypes.AppMessage_Location
+		if err := proto.Unmarshal(req.GetPayload(), &p); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+		if err := p.IsValid(); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		if p.IsLive() && !p.GetStopped() {
+			if p.GetExpiresAt() <= timestampMs(now) {
+				return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("live location is already expired"))
+			}
+			if p.GetExpiresAt() > timestampMs(now.Add(messengertypes.MaxLiveLocationDuration)) {
+				return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("live location can't last more than %s", messengertypes.MaxLiveLocationDuration))
+			}
+		}
+		fp, err := messengertypes.AppMessage_TypeLocation.MarshalPayload(timestampMs(now), nil, &p)
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+		outboxed, echo, err = svc.sendWithLocalEcho(ctx, req.GetType(), "", ttl, &protocoltypes.AppMessageSend_Request{GroupPK: gpkb, Payload: fp})
+		if err != nil {
+			return nil, err
+		}
+	case messengertypes.AppMessage_TypePollCreate, messengertypes.AppMessage_TypePollVote, messengertypes.AppMessage_TypePollClose:
+		am := messengertypes.AppMessage{Type: req.GetType(), Payload: req.GetPayload()}
+		p, err := am.UnmarshalPayload()
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+		if err := p.(interface{ IsValid() error }).IsValid(); err != nil {
+			return nil, err
+		}
+		switch p := p.(type) {
+		case *messengertypes.AppMessage_PollVote:
+			if err := checkPollVote(svc.db, p); err != nil {
+				return nil, err
+			}
+		case *messengertypes.AppMessage_PollClose:
+			poll, err := svc.db.getPoll(p.GetPollCID())
+			if err != nil {
+				return nil, errcode.ErrInvalidInput.Wrap(err)
+			}
+			if !poll.GetIsMe() {
+				return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the author of a poll can close it"))
+			}
+		}
+		fp, err := req.GetType().MarshalPayload(timestampMs(time.Now()), nil, p)
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
 		}
-		_, err = svc.protocolClient.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpkb, Payload: fp, AttachmentCIDs: cids})
+		outboxed, echo, err = svc.sendWithLocalEcho(ctx, req.GetType(), "", ttl, &protocoltypes.AppMessageSend_Request{GroupPK: gpkb, Payload: fp})
 		if err != nil {
 			return nil, err
 		}
 	case messengertypes.AppMessage_TypeAcknowledge:
 		// trick gocritic
 	}
-	return &messengertypes.Interact_Reply{}, nil
+
+	if outboxed != nil {
+		return &messengertypes.Interact_Reply{Deferred: true, OutboxID: outboxed.GetID(), LocalEchoID: echo.GetID()}, nil
+	}
+
+	return &messengertypes.Interact_Reply{LocalEchoID: echo.GetID()}, nil
 }
 
 func (svc *service) AccountGet(ctx context.Context, req *messengertypes.AccountGet_Request) (*messengertypes.AccountGet_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	acc, err := svc.db.getAccount()
 	if err != nil {
@@ -1012,7 +1311,8 @@ func (svc *service) ConversationOpen(ctx context.Context, req *messengertypes.Co
 		return &ret, nil
 	}
 
-	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+	// opening the conversation reads it, on the other devices too
+	if _, err := svc.markConversationRead(ctx, conv.GetPublicKey(), 0); err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
 
@@ -1075,10 +1375,10 @@ func (svc *service) ReplicationServiceRegisterGroup(ctx context.Context, req *me
 		return nil, errcode.ErrMissingInput
 	}
 
-	svc.logger.Info("attempting replicating group", zap.String("public-key", gpk))
+	svc.logger.Info("attempting replicating group", logGroup(gpk))
 	gpkb, err := b64DecodeBytes(gpk)
 	if err != nil {
-		svc.logger.Error("failed to decode group pk", zap.String("public-key", gpk), zap.Error(err))
+		svc.logger.Error("failed to decode group pk", logGroup(gpk), zap.Error(err))
 		return nil, errcode.ErrInvalidInput.Wrap(err)
 	}
 
@@ -1088,11 +1388,11 @@ func (svc *service) ReplicationServiceRegisterGroup(ctx context.Context, req *me
 	})
 
 	if err != nil {
-		svc.logger.Error("failed to replicate group", zap.String("public-key", gpk), zap.String("token-id", req.TokenID), zap.Error(err))
+		svc.logger.Error("failed to replicate group", logGroup(gpk), zap.String("token-id", req.TokenID), zap.Error(err))
 		return nil, err
 	}
 
-	svc.logger.Info("replicating group", zap.String("public-key", gpk), zap.String("token-id", req.TokenID), zap.Error(err))
+	svc.logger.Info("replicating group", logGroup(gpk), zap.String("token-id", req.TokenID), zap.Error(err))
 
 	return &messengertypes.ReplicationServiceRegisterGroup_Reply{}, nil
 }
@@ -1118,15 +1418,14 @@ func (svc *service) GetUsername(ctx context.Context, req *messengertypes.GetUser
 }
 
 func (svc *service) SendReplyOptions(ctx context.Context, req *messengertypes.SendReplyOptions_Request) (*messengertypes.SendReplyOptions_Reply, error) {
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	payload, err := messengertypes.AppMessage_TypeReplyOptions.MarshalPayload(timestampMs(time.Now()), nil, req.Options)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = svc.protocolClient.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+	err = svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{
 		GroupPK: req.GroupPK,
 		Payload: payload,
 	})
@@ -1165,54 +1464,62 @@ func (svc *service) InstanceExportData(_ *messengertypes.InstanceExportData_Requ
 
 	defer os.Remove(tmpFile.Name())
 
-	cl, err := svc.protocolClient.InstanceExportData(server.Context(), &protocoltypes.InstanceExportData_Request{})
-	if err != nil {
+	if err := svc.writeAccountExport(server.Context(), tmpFile); err != nil {
+		return err
+	}
+
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
 		return errcode.ErrInternal.Wrap(err)
 	}
 
+	buffer := make([]byte, 1024)
 	for {
-		chunk, err := cl.Recv()
+		_, err := tmpFile.Read(buffer)
 		if err == io.EOF {
-			break
+			return nil
 		} else if err != nil {
 			return errcode.ErrInternal.Wrap(err)
 		}
 
-		if _, err := tmpFile.Write(chunk.ExportedData); err != nil {
+		if err := server.Send(&messengertypes.InstanceExportData_Reply{ExportedData: buffer}); err != nil {
 			return errcode.ErrInternal.Wrap(err)
 		}
 	}
+}
 
-	// Remove trailing headers to append messenger data
-	_, err = tmpFile.Seek(-1024, io.SeekEnd)
+// writeAccountExport writes the protocol export followed by the messenger data
+func (svc *service) writeAccountExport(ctx context.Context, tmpFile *os.File) error {
+	cl, err := svc.protocolClient.InstanceExportData(ctx, &protocoltypes.InstanceExportData_Request{})
 	if err != nil {
 		return errcode.ErrInternal.Wrap(err)
 	}
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
-
-	if err := exportMessengerData(tmpFile, svc.db.db, svc.logger); err != nil {
-		return errcode.ErrInternal.Wrap(err)
-	}
-
-	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
-		return errcode.ErrInternal.Wrap(err)
-	}
-
-	buffer := make([]byte, 1024)
 	for {
-		_, err := tmpFile.Read(buffer)
+		chunk, err := cl.Recv()
 		if err == io.EOF {
-			return nil
+			break
 		} else if err != nil {
 			return errcode.ErrInternal.Wrap(err)
 		}
 
-		if err := server.Send(&messengertypes.InstanceExportData_Reply{ExportedData: buffer}); err != nil {
+		if _, err := tmpFile.Write(chunk.ExportedData); err != nil {
 			return errcode.ErrInternal.Wrap(err)
 		}
 	}
+
+	// Remove trailing headers to append messenger data
+	_, err = tmpFile.Seek(-1024, io.SeekEnd)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	if err := exportMessengerData(tmpFile, svc.db.db, svc.logger); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return nil
 }
 
 func (svc *service) MediaPrepare(srv messengertypes.MessengerService_MediaPrepareServer) error {
@@ -1227,11 +1534,17 @@ func (svc *service) MediaPrepare(srv messengertypes.MessengerService_MediaPrepar
 	if header.GetInfo() == nil {
 		return errcode.ErrInvalidInput.Wrap(errors.New("nil info"))
 	}
+	if err := header.GetInfo().IsValidMetadata(); err != nil {
+		return err
+	}
 
-	var file io.ReadCloser
+	var (
+		file io.ReadCloser
+		path string
+	)
 	if header.GetUri() != "" {
 		// open uri file
-		path := header.GetUri()
+		path = header.GetUri()
 		u, err := url.Parse(header.GetUri())
 		if err == nil && u.Scheme == "file" {
 			path = u.Path
@@ -1249,20 +1562,51 @@ func (svc *service) MediaPrepare(srv messengertypes.MessengerService_MediaPrepar
 	}
 	defer file.Close()
 
+	// the metadata are removed and the content adapted to the quality of the conversation before the upload
+	quality, err := svc.mediaQuality(header.GetConversationPublicKey())
+	if err != nil {
+		return err
+	}
+
+	// the large files sent as they are are uploaded in chunks so an interrupted upload can be resumed
+	if f, ok := file.(*os.File); ok {
+		if stat, ok := svc.isChunkedUpload(f, header.GetInfo().GetMimeType(), quality); ok {
+			media, err := svc.prepareChunkedMedia(srv.Context(), header, path, stat)
+			if err != nil {
+				return err
+			}
+
+			if err := srv.SendAndClose(&messengertypes.MediaPrepare_Reply{Cid: media.GetCID()}); err != nil {
+				return errcode.ErrStreamSendAndClose.Wrap(err)
+			}
+
+			return nil
+		}
+	}
+
+	media := *header.Info
+	processed, err := svc.processMedia(srv.Context(), file, &media, quality)
+	if err != nil {
+		return err
+	}
+	defer processed.Close()
+
 	// upload media and get cid in return
-	cidBytes, err := svc.attachmentPrepare(file)
+	hash := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(processed, hash)}
+	cidBytes, err := svc.attachmentPrepare(counter)
 	if err != nil {
 		return errcode.ErrAttachmentPrepare.Wrap(err)
 	}
 	cid := b64EncodeBytes(cidBytes)
 
-	svc.handlerMutex.Lock()
-	defer svc.handlerMutex.Unlock()
+	defer svc.writer.enter()()
 
 	return svc.db.tx(func(tx *dbWrapper) error {
 		// add to db
-		media := *header.Info
 		media.CID = cid
+		media.Size_ = counter.count
+		media.Checksum = hex.EncodeToString(hash.Sum(nil))
 		media.State = messengertypes.Media_StatePrepared
 		added, err := tx.addMedias([]*messengertypes.Media{&media})
 		if err != nil {
@@ -1287,10 +1631,12 @@ func (svc *service) MediaPrepare(srv messengertypes.MessengerService_MediaPrepar
 }
 
 func (svc *service) MediaRetrieve(req *messengertypes.MediaRetrieve_Request, srv messengertypes.MessengerService_MediaRetrieveServer) error {
-	var attachment *io.PipeReader
+	var (
+		attachment io.ReadCloser
+		media      *messengertypes.Media
+	)
 	if err := func() error {
-		svc.handlerMutex.Lock()
-		defer svc.handlerMutex.Unlock()
+		defer svc.writer.enter()()
 
 		// prepare header
 		medias, err := svc.db.getMedias([]string{req.GetCid()})
@@ -1300,15 +1646,21 @@ func (svc *service) MediaRetrieve(req *messengertypes.MediaRetrieve_Request, srv
 		if len(medias) == 0 {
 			return errcode.ErrInternal.Wrap(err)
 		}
-		media := medias[0]
+		media = medias[0]
 
 		// send header
 		if err := srv.Send(&messengertypes.MediaRetrieve_Reply{Info: media}); err != nil {
 			return errcode.ErrStreamHeaderWrite.Wrap(err)
 		}
 
+		// the prefetched images are served from memory while they are still available on this device
+		if data := svc.prefetch.media(media.GetCID()); data != nil && isPrefetchableMedia(media) {
+			attachment = ioutil.NopCloser(bytes.NewReader(data))
+			return nil
+		}
+
 		// open download
-		if attachment, err = svc.attachmentRetrieve(req.GetCid()); err != nil {
+		if attachment, err = svc.mediaContentRetrieve(media); err != nil {
 			return errcode.ErrAttachmentRetrieve.Wrap(err)
 		}
 		return nil
@@ -1318,12 +1670,781 @@ func (svc *service) MediaRetrieve(req *messengertypes.MediaRetrieve_Request, srv
 	defer attachment.Close()
 
 	// stream to client
-	if err := streamutil.FuncSink(make([]byte, 64*1024), attachment, func(b []byte) error {
+	hash := sha256.New()
+	if err := streamutil.FuncSink(make([]byte, 64*1024), io.TeeReader(attachment, hash), func(b []byte) error {
 		return srv.Send(&messengertypes.MediaRetrieve_Reply{Block: b})
 	}); err != nil {
 		return errcode.ErrStreamSink.Wrap(err)
 	}
 
+	// the whole attachment has been fetched, it is now locally available
+	if media.GetState() == messengertypes.Media_StateNeverDownloaded || media.GetState() == messengertypes.Media_StatePartiallyDownloaded {
+		if err := svc.markMediaDownloaded(media.GetCID(), hex.EncodeToString(hash.Sum(nil))); err != nil {
+			svc.logger.Error("unable to update media state", zap.String("cid", media.GetCID()), zap.Error(err))
+		}
+	}
+
 	// success
 	return nil
 }
+
+func (svc *service) MediaDownloadPolicySet(ctx context.Context, req *messengertypes.MediaDownloadPolicySet_Request) (*messengertypes.MediaDownloadPolicySet_Reply, error) {
+	if req.GetMaxSize() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max size can't be negative"))
+	}
+
+	convPK := req.GetConversationPublicKey()
+
+	defer svc.writer.enter()()
+
+	if convPK == "" {
+		acc, err := svc.db.getAccount()
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if acc, err = svc.db.setAccountMediaDownloadPolicy(acc.GetPublicKey(), req.GetMode(), req.GetMaxSize()); err != nil {
+			return nil, err
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+	} else {
+		conv, err := svc.db.setConversationMediaDownloadPolicy(convPK, req.GetMode(), req.GetMaxSize())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+
+		svc.syncConversation(ctx, conv)
+	}
+
+	// a more permissive policy may allow pending medias to be fetched
+	go svc.mediaDownloader.enqueueNeverDownloaded()
+
+	return &messengertypes.MediaDownloadPolicySet_Reply{}, nil
+}
+
+func (svc *service) LinkPreviewSetEnabled(ctx context.Context, req *messengertypes.LinkPreviewSetEnabled_Request) (*messengertypes.LinkPreviewSetEnabled_Reply, error) {
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountLinkPreviewsEnabled(acc.GetPublicKey(), req.GetEnabled()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.LinkPreviewSetEnabled_Reply{}, nil
+}
+
+func (svc *service) ConversationLocationList(ctx context.Context, req *messengertypes.ConversationLocationList_Request) (*messengertypes.ConversationLocationList_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	locations, err := svc.db.getLocationsByConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationLocationList_Reply{Locations: locations}, nil
+}
+
+func (svc *service) PollList(ctx context.Context, req *messengertypes.PollList_Request) (*messengertypes.PollList_Reply, error) {
+	if req.GetPollCID() != "" {
+		result, err := getPollResult(svc.db, req.GetPollCID())
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if result.GetPoll().GetSentDate() == 0 {
+			return nil, errcode.ErrNotFound
+		}
+
+		return &messengertypes.PollList_Reply{Polls: []*messengertypes.PollResult{result}}, nil
+	}
+
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	polls, err := svc.db.getPollsByConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*messengertypes.PollResult, len(polls))
+	for i, poll := range polls {
+		votes, err := svc.db.getPollVotes(poll.GetCID())
+		if err != nil {
+			return nil, err
+		}
+
+		results[i] = computePollResult(poll, votes)
+	}
+
+	return &messengertypes.PollList_Reply{Polls: results}, nil
+}
+
+func (svc *service) ContactRequestPolicySet(ctx context.Context, req *messengertypes.ContactRequestPolicySet_Request) (*messengertypes.ContactRequestPolicySet_Reply, error) {
+	if req.GetMaxPerHour() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max per hour can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountContactRequestPolicy(acc.GetPublicKey(), req.GetMaxPerHour(), req.GetIgnoreWithoutIntro()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.ContactRequestPolicySet_Reply{}, nil
+}
+
+func (svc *service) ContactBlock(ctx context.Context, req *messengertypes.ContactBlock_Request) (*messengertypes.ContactBlock_Reply, error) {
+	if err := svc.setMemberBlocked(req.GetPublicKey(), true); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactBlock_Reply{}, nil
+}
+
+func (svc *service) ContactUnblock(ctx context.Context, req *messengertypes.ContactUnblock_Request) (*messengertypes.ContactUnblock_Reply, error) {
+	if err := svc.setMemberBlocked(req.GetPublicKey(), false); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactUnblock_Reply{}, nil
+}
+
+func (svc *service) setMemberBlocked(pk string, blocked bool) error {
+	if pk == "" {
+		return errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if acc, err := svc.db.getAccount(); err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	} else if acc.GetPublicKey() == pk {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't block yourself"))
+	}
+
+	interactions, err := svc.db.setMemberBlocked(pk, blocked)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range interactions {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+			svc.logger.Error("unable to dispatch interaction update", zap.String("cid", i.GetCID()), zap.Error(err))
+		}
+	}
+
+	svc.syncContact(svc.ctx, pk)
+
+	return nil
+}
+
+func (svc *service) BlockedMemberList(ctx context.Context, req *messengertypes.BlockedMemberList_Request) (*messengertypes.BlockedMemberList_Reply, error) {
+	members, err := svc.db.getBlockedMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BlockedMemberList_Reply{Members: members}, nil
+}
+
+func (svc *service) ConversationSetMemberRole(ctx context.Context, req *messengertypes.ConversationSetMemberRole_Request) (*messengertypes.ConversationSetMemberRole_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.checkModerationTarget(conv, req.GetMemberPublicKey()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetMemberRole, &messengertypes.AppMessage_SetMemberRole{
+		MemberPublicKey: req.GetMemberPublicKey(),
+		Role:            req.GetRole(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetMemberRole_Reply{}, nil
+}
+
+func (svc *service) ConversationRemoveMember(ctx context.Context, req *messengertypes.ConversationRemoveMember_Request) (*messengertypes.ConversationRemoveMember_Reply, error) {
+	defer svc.writer.enter()()
+
+	if err := svc.removeGroupMember(ctx, req.GetConversationPublicKey(), req.GetMemberPublicKey()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationRemoveMember_Reply{}, nil
+}
+
+func (svc *service) ConversationSetPostingRestricted(ctx context.Context, req *messengertypes.ConversationSetPostingRestricted_Request) (*messengertypes.ConversationSetPostingRestricted_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetPostingRestricted, &messengertypes.AppMessage_SetPostingRestricted{
+		Restricted: req.GetRestricted(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetPostingRestricted_Reply{}, nil
+}
+
+func (svc *service) ConversationSetInfo(ctx context.Context, req *messengertypes.ConversationSetInfo_Request) (*messengertypes.ConversationSetInfo_Reply, error) {
+	if req.GetDisplayName() == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("a display name is required"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	// the profile is replaced as a whole, keep the current topic and description
+	if err := svc.sendConversationProfile(ctx, conv, &messengertypes.AppMessage_SetGroupInfo{
+		DisplayName: req.GetDisplayName(),
+		AvatarCid:   req.GetAvatarCID(),
+		Topic:       conv.GetTopic(),
+		Description: conv.GetDescription(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetInfo_Reply{}, nil
+}
+
+func (svc *service) ConversationUpdateProfile(ctx context.Context, req *messengertypes.ConversationUpdateProfile_Request) (*messengertypes.ConversationUpdateProfile_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &messengertypes.AppMessage_SetGroupInfo{
+		DisplayName: req.GetDisplayName(),
+		AvatarCid:   req.GetAvatarCID(),
+		Topic:       req.GetTopic(),
+		Description: req.GetDescription(),
+	}
+	if profile.DisplayName == "" {
+		profile.DisplayName = conv.GetDisplayName()
+	}
+
+	if err := svc.sendConversationProfile(ctx, conv, profile); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationUpdateProfile_Reply{}, nil
+}
+
+func (svc *service) GroupInvitationCreate(ctx context.Context, req *messengertypes.GroupInvitationCreate_Request) (*messengertypes.GroupInvitationCreate_Reply, error) {
+	defer svc.writer.enter()()
+
+	invitation, link, err := svc.createGroupInvitationLink(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.GroupInvitationCreate_Reply{Invitation: invitation, Link: link}, nil
+}
+
+func (svc *service) GroupInvitationRevoke(ctx context.Context, req *messengertypes.GroupInvitationRevoke_Request) (*messengertypes.GroupInvitationRevoke_Reply, error) {
+	if req.GetInvitationID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	invitation, err := svc.revokeGroupInvitationLink(req.GetInvitationID())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.GroupInvitationRevoke_Reply{Invitation: invitation}, nil
+}
+
+func (svc *service) GroupInvitationList(ctx context.Context, req *messengertypes.GroupInvitationList_Request) (*messengertypes.GroupInvitationList_Reply, error) {
+	invitations, err := svc.db.getGroupInvitationLinks(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.GroupInvitationList_Reply{Invitations: invitations}, nil
+}
+
+func (svc *service) MemberProfileHistory(ctx context.Context, req *messengertypes.MemberProfileHistory_Request) (*messengertypes.MemberProfileHistory_Reply, error) {
+	if req.GetConversationPublicKey() == "" || req.GetMemberPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	changes, err := svc.db.getMemberProfileHistory(req.GetConversationPublicKey(), req.GetMemberPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &messengertypes.MemberProfileHistory_Reply{Changes: changes}
+
+	if req.GetAt() != 0 {
+		// the changes are sorted by date, keep the last one sent before the requested date
+		for _, change := range changes {
+			if change.GetSentDate() > req.GetAt() {
+				break
+			}
+			rep.ProfileAt = change
+		}
+	}
+
+	return rep, nil
+}
+
+func (svc *service) PresenceSetEnabled(ctx context.Context, req *messengertypes.PresenceSetEnabled_Request) (*messengertypes.PresenceSetEnabled_Reply, error) {
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountPresenceEnabled(acc.GetPublicKey(), req.GetEnabled()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.PresenceSetEnabled_Reply{}, nil
+}
+
+func (svc *service) ContactPresenceSetHidden(ctx context.Context, req *messengertypes.ContactPresenceSetHidden_Request) (*messengertypes.ContactPresenceSetHidden_Reply, error) {
+	if req.GetContactPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	contact, err := svc.db.setContactPresenceHidden(req.GetContactPublicKey(), req.GetHidden())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	svc.syncContact(ctx, contact.GetPublicKey())
+
+	return &messengertypes.ContactPresenceSetHidden_Reply{}, nil
+}
+
+func (svc *service) ContactPresenceSubscribe(req *messengertypes.ContactPresenceSubscribe_Request, sub messengertypes.MessengerService_ContactPresenceSubscribeServer) error {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	// presence is reciprocal, the presence of the contacts is only received while sharing it
+	if !acc.GetPresenceEnabled() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("presence is disabled"))
+	}
+
+	filter := map[string]struct{}{}
+	for _, pk := range req.GetContactPublicKeys() {
+		filter[pk] = struct{}{}
+	}
+
+	// subscribe before sending the current state so no change is missed
+	changes, unsubscribe := svc.presenceManager.subscribe()
+	defer unsubscribe()
+
+	for _, presence := range svc.presenceManager.get(req.GetContactPublicKeys()...) {
+		if err := sub.Send(&messengertypes.ContactPresenceSubscribe_Reply{Presence: presence}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case presence := <-changes:
+			if _, ok := filter[presence.GetContactPublicKey()]; len(filter) > 0 && !ok {
+				continue
+			}
+
+			if err := sub.Send(&messengertypes.ContactPresenceSubscribe_Reply{Presence: presence}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (svc *service) PushTokenRegister(ctx context.Context, req *messengertypes.PushTokenRegister_Request) (*messengertypes.PushTokenRegister_Reply, error) {
+	if req.GetToken() == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("a push token is required"))
+	}
+
+	if len(req.GetPublicKey()) != cryptoutil.KeySize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the public key of the device must be a curve25519 key"))
+	}
+
+	if req.GetPlatform() == messengertypes.PushDeviceToken_PlatformUnknown {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a push platform is required"))
+	}
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	token := &messengertypes.PushDeviceToken{
+		Token:            req.GetToken(),
+		AccountPublicKey: acc.GetPublicKey(),
+		Platform:         req.GetPlatform(),
+		BundleID:         req.GetBundleID(),
+		PublicKey:        req.GetPublicKey(),
+		RegisteredDate:   timestampMs(time.Now()),
+	}
+
+	if err := svc.db.addPushDeviceToken(token, req.GetReplaces()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.PushTokenRegister_Reply{Token: token}, nil
+}
+
+func (svc *service) PushTokenUnregister(ctx context.Context, req *messengertypes.PushTokenUnregister_Request) (*messengertypes.PushTokenUnregister_Reply, error) {
+	if req.GetToken() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := svc.db.removePushDeviceToken(req.GetToken()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.PushTokenUnregister_Reply{}, nil
+}
+
+func (svc *service) PushTokenList(ctx context.Context, req *messengertypes.PushTokenList_Request) (*messengertypes.PushTokenList_Reply, error) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	tokens, err := svc.db.getPushDeviceTokens(acc.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.PushTokenList_Reply{Tokens: tokens}, nil
+}
+
+func (svc *service) ConversationSetPushMuted(ctx context.Context, req *messengertypes.ConversationSetPushMuted_Request) (*messengertypes.ConversationSetPushMuted_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.setConversationPushMuted(req.GetConversationPublicKey(), req.GetMuted())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	svc.syncConversation(ctx, conv)
+
+	return &messengertypes.ConversationSetPushMuted_Reply{}, nil
+}
+
+func (svc *service) RetentionPolicySet(ctx context.Context, req *messengertypes.RetentionPolicySet_Request) (*messengertypes.RetentionPolicySet_Reply, error) {
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountRetentionPolicy(acc.GetPublicKey(), req.GetMaxAge(), req.GetMaxMessages(), req.GetMaxMediaSize()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	svc.triggerRetention()
+
+	return &messengertypes.RetentionPolicySet_Reply{}, nil
+}
+
+func (svc *service) ConversationLoadPruned(ctx context.Context, req *messengertypes.ConversationLoadPruned_Request) (*messengertypes.ConversationLoadPruned_Reply, error) {
+	convPK := req.GetConversationPublicKey()
+	if convPK == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > retentionLoadPrunedMaxCount {
+		count = retentionLoadPrunedMaxCount
+	}
+
+	before := req.GetBeforeDate()
+	if before == 0 {
+		prunedBefore, err := svc.db.getConversationPrunedBefore(convPK)
+		if err != nil {
+			return nil, err
+		}
+
+		if prunedBefore == 0 {
+			return &messengertypes.ConversationLoadPruned_Reply{}, nil
+		}
+
+		before = prunedBefore + 1
+	}
+
+	interactions, err := svc.loadPrunedInteractions(ctx, convPK, before, count)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationLoadPruned_Reply{Interactions: interactions}, nil
+}
+
+func (svc *service) NotificationPolicySet(ctx context.Context, req *messengertypes.NotificationPolicySet_Request) (*messengertypes.NotificationPolicySet_Reply, error) {
+	policy := req.GetPolicy()
+	if err := checkNotificationPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	if _, err := svc.db.getConversationByPK(policy.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if err := svc.db.setNotificationPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.NotificationPolicySet_Reply{}, nil
+}
+
+func (svc *service) NotificationPolicyGet(ctx context.Context, req *messengertypes.NotificationPolicyGet_Request) (*messengertypes.NotificationPolicyGet_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	policy, err := svc.db.getNotificationPolicy(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.NotificationPolicyGet_Reply{Policy: policy}, nil
+}
+
+func (svc *service) MentionsList(ctx context.Context, req *messengertypes.MentionsList_Request) (*messengertypes.MentionsList_Reply, error) {
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	interactions, err := svc.db.getMentionedInteractions(req.GetConversationPublicKey(), count)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.MentionsList_Reply{Interactions: interactions}
+	applyNicknames(reply)
+
+	return reply, nil
+}
+
+func (svc *service) ConversationMarkRead(ctx context.Context, req *messengertypes.ConversationMarkRead_Request) (*messengertypes.ConversationMarkRead_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetReadUntil() < 0 {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.markConversationRead(ctx, req.GetConversationPublicKey(), req.GetReadUntil())
+	if err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.ConversationMarkRead_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) InteractionList(ctx context.Context, req *messengertypes.InteractionList_Request) (*messengertypes.InteractionList_Reply, error) {
+	convPK := req.GetConversationPublicKey()
+	if convPK == "" && req.GetFilter() == nil {
+		return nil, errcode.ErrMissingInput
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	if req.GetFilter() == nil {
+		return svc.interactionsPage(convPK, req.GetIncludeMuted(), req.GetCursor(), count, false)
+	}
+
+	cursor, err := decodeInteractionCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := svc.db.getInteractionOrder()
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		order = cursor.GetOrder()
+	}
+
+	// one more interaction is read to know whether there is a next page
+	interactions, err := svc.db.getMatchingInteractions(convPK, req.GetIncludeMuted(), req.GetFilter(), order, cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.InteractionList_Reply{Interactions: interactions}
+	if len(interactions) > count {
+		reply.Interactions = interactions[:count]
+		if reply.NextCursor, err = encodeInteractionCursor(interactions[count-1], order); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := svc.db.fillInteractionsTags(reply.Interactions); err != nil {
+		return nil, err
+	}
+
+	applyNicknames(reply)
+
+	return reply, nil
+}
+
+func (svc *service) InteractionListByExtension(ctx context.Context, req *messengertypes.InteractionListByExtension_Request) (*messengertypes.InteractionListByExtension_Reply, error) {
+	if req.GetKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	cursor, err := decodeInteractionCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	// one more interaction is read to know whether there is a next page
+	interactions, err := svc.db.getInteractionsByExtension(req.GetKey(), req.GetConversationPublicKey(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.InteractionListByExtension_Reply{Interactions: interactions}
+	if len(interactions) > count {
+		reply.Interactions = interactions[:count]
+		if reply.NextCursor, err = encodeInteractionCursor(interactions[count-1], messengertypes.Account_OrderLogical); err != nil {
+			return nil, err
+		}
+	}
+
+	applyNicknames(reply)
+
+	return reply, nil
+}
+
+func (svc *service) ConversationLoad(ctx context.Context, req *messengertypes.ConversationLoad_Request) (*messengertypes.ConversationLoad_Reply, error) {
+	convPK := req.GetConversationPublicKey()
+	if convPK == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > historyLoadMaxCount {
+		count = historyLoadMaxCount
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.loadConversationHistory(ctx, convPK, count)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ConversationLoad_Reply{Conversation: conv}
+	applyNicknames(reply)
+
+	return reply, nil
+}
+
+func (svc *service) AccountDeviceList(ctx context.Context, req *messengertypes.AccountDeviceList_Request) (*messengertypes.AccountDeviceList_Reply, error) {
+	info, err := svc.getAccountGroupInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := svc.getLinkedDevices(info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AccountDeviceList_Reply{Devices: devices}, nil
+}
+
+func (svc *service) DeviceSyncSnapshotSend(ctx context.Context, req *messengertypes.DeviceSyncSnapshotSend_Request) (*messengertypes.DeviceSyncSnapshotSend_Reply, error) {
+	if err := svc.sendDeviceSyncSummary(); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.DeviceSyncSnapshotSend_Reply{}, nil
+}
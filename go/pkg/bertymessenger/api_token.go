@@ -0,0 +1,243 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	apiTokenSize = 32
+	// APITokenMetadataKey is the metadata of the calls bearing an API token, the authorization metadata is kept for the
+	// tokens of the protocol services
+	APITokenMetadataKey = "berty-api-token"
+	// messengerServicePrefix prefixes the full name of the methods of the messenger service
+	messengerServicePrefix = "/berty.messenger.v1.MessengerService/"
+)
+
+// apiTokenReadOnlyMethods are the methods allowed by the read-only tokens, they don't change the state of the account
+// and don't expose its secrets
+var apiTokenReadOnlyMethods = map[string]struct{}{
+	"ParseDeepLink":            {},
+	"SystemInfo":               {},
+	"EchoTest":                 {},
+	"EchoDuplexTest":           {},
+	"ConversationStream":       {},
+	"EventStream":              {},
+	"AccountGet":               {},
+	"BlockedMemberList":        {},
+	"BannerQuote":              {},
+	"GetUsername":              {},
+	"MediaRetrieve":            {},
+	"ConversationLocationList": {},
+	"PollList":                 {},
+	"MemberProfileHistory":     {},
+	"AccountDeviceList":        {},
+	"InteractionList":          {},
+	"MentionsList":             {},
+	"NotificationPolicyGet":    {},
+	"ContactVerificationGet":   {},
+	"BoardEntryList":           {},
+	"InteractionStarredList":   {},
+	"InteractionTagList":       {},
+	"ConversationFolderList":   {},
+	"ConversationList":         {},
+	"ConversationStats":        {},
+	"StorageUsage":             {},
+	"InteractionDeliveryInfo":  {},
+	"ConversationAuditLog":     {},
+	"DatabaseStats":            {},
+	"ProfileList":              {},
+	"ConversationMemberList":   {},
+	"InteractionAnchorGet":     {},
+	"ContactDuplicateList":     {},
+	"MediaUploadList":          {},
+	"ReplicationTokenList":     {},
+	"ConversationFilesList":    {},
+	"ActivityFeed":             {},
+	"ConversationPrefetch":     {},
+	"InteractionHiddenList":    {},
+	"ContactRequestList":       {},
+	"OutboxList":               {},
+	"GroupInvitationPreview":   {},
+}
+
+// apiTokenSendOnlyMethods are the methods allowed by the send-only tokens, they send messages to the conversations
+// without reading them
+var apiTokenSendOnlyMethods = map[string]struct{}{
+	"SendMessage":      {},
+	"SendReplyOptions": {},
+	"SendAck":          {},
+	"Interact":         {},
+	"MediaPrepare":     {},
+	"BotSendMessage":   {},
+}
+
+func apiTokenID(token string) string {
+	return botTokenID(token)
+}
+
+// isMethodAllowedByScope checks the scope of a token for a method of the messenger service, the unknown methods are
+// only allowed to the admin tokens
+func isMethodAllowedByScope(scope messengertypes.APIToken_Scope, method string) bool {
+	switch scope {
+	case messengertypes.APIToken_ScopeAdmin:
+		return true
+	case messengertypes.APIToken_ScopeReadOnly:
+		_, ok := apiTokenReadOnlyMethods[method]
+		return ok
+	case messengertypes.APIToken_ScopeSendOnly:
+		_, ok := apiTokenSendOnlyMethods[method]
+		return ok
+	default:
+		return false
+	}
+}
+
+// AuthorizeMethod checks the API token of a call to a method of the messenger service, the calls without a token are
+// refused once a token exists, until then they are allowed unless required is set, in which case only the creation of
+// the first token is allowed
+func (svc *service) AuthorizeMethod(ctx context.Context, fullMethod string, required bool) error {
+	if !strings.HasPrefix(fullMethod, messengerServicePrefix) {
+		return nil
+	}
+	method := strings.TrimPrefix(fullMethod, messengerServicePrefix)
+
+	token := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(APITokenMetadataKey); len(values) > 0 {
+			token = strings.TrimPrefix(values[0], "Bearer ")
+		}
+	}
+
+	if token == "" {
+		hasTokens, err := svc.db.hasAPITokens()
+		if err != nil {
+			return status.Errorf(codes.Internal, "unable to check the api tokens: %s", err)
+		}
+
+		// the first token is created without a token
+		if hasTokens || (required && method != "APITokenCreate") {
+			return status.Errorf(codes.Unauthenticated, "an api token is required")
+		}
+
+		return nil
+	}
+
+	apiToken, err := svc.db.getAPIToken(apiTokenID(token))
+	if err == gorm.ErrRecordNotFound {
+		return status.Errorf(codes.Unauthenticated, "unknown api token")
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "unable to check the api token: %s", err)
+	}
+
+	if apiToken.GetExpiresDate() != 0 && timestampMs(time.Now()) >= apiToken.GetExpiresDate() {
+		return status.Errorf(codes.Unauthenticated, "expired api token")
+	}
+
+	if !isMethodAllowedByScope(apiToken.GetScope(), method) {
+		svc.logger.Warn("api call refused", zap.String("token-id", apiToken.GetID()), zap.String("method", method), zap.String("scope", apiToken.GetScope().String()))
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed by the scope %s", method, apiToken.GetScope())
+	}
+
+	return nil
+}
+
+// APITokenUnaryServerInterceptor checks the API tokens of the calls to the messenger service, getService returns nil
+// when the messenger doesn't run in this process
+func APITokenUnaryServerInterceptor(getService func() Service, required bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if svc := getService(); svc != nil {
+			if err := svc.AuthorizeMethod(ctx, info.FullMethod, required); err != nil {
+				return nil, err
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// APITokenStreamServerInterceptor is the stream counterpart of APITokenUnaryServerInterceptor
+func APITokenStreamServerInterceptor(getService func() Service, required bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if svc := getService(); svc != nil {
+			if err := svc.AuthorizeMethod(ss.Context(), info.FullMethod, required); err != nil {
+				return err
+			}
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+func (svc *service) APITokenCreate(ctx context.Context, req *messengertypes.APITokenCreate_Request) (*messengertypes.APITokenCreate_Reply, error) {
+	if req.GetName() == "" || req.GetScope() == messengertypes.APIToken_ScopeUndefined {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if _, ok := messengertypes.APIToken_Scope_name[int32(req.GetScope())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown scope %d", req.GetScope()))
+	}
+
+	now := time.Now()
+	if req.GetExpiresDate() != 0 && req.GetExpiresDate() <= timestampMs(now) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the token is already expired"))
+	}
+
+	secret, err := cryptoutil.GenerateNonceSize(apiTokenSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+	token := b64EncodeBytes(secret)
+
+	apiToken := &messengertypes.APIToken{
+		ID:          apiTokenID(token),
+		Name:        req.GetName(),
+		Scope:       req.GetScope(),
+		CreatedDate: timestampMs(now),
+		ExpiresDate: req.GetExpiresDate(),
+	}
+
+	if err := svc.db.addAPIToken(apiToken); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("api token created", zap.String("token-id", apiToken.GetID()), zap.String("scope", apiToken.GetScope().String()))
+
+	return &messengertypes.APITokenCreate_Reply{APIToken: apiToken, Token: token}, nil
+}
+
+func (svc *service) APITokenRevoke(ctx context.Context, req *messengertypes.APITokenRevoke_Request) (*messengertypes.APITokenRevoke_Reply, error) {
+	if req.GetTokenID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := svc.db.deleteAPIToken(req.GetTokenID()); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("api token revoked", zap.String("token-id", req.GetTokenID()))
+
+	return &messengertypes.APITokenRevoke_Reply{}, nil
+}
+
+func (svc *service) APITokenList(ctx context.Context, req *messengertypes.APITokenList_Request) (*messengertypes.APITokenList_Reply, error) {
+	tokens, err := svc.db.getAPITokens()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.APITokenList_Reply{APITokens: tokens}, nil
+}
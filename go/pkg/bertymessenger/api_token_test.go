@@ -0,0 +1,73 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestAPITokenAuthorizeMethod(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	ctx := context.Background()
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	withToken := func(token string) context.Context {
+		return metadata.NewIncomingContext(ctx, metadata.Pairs(APITokenMetadataKey, token))
+	}
+	requireCode := func(c codes.Code, err error) {
+		require.Error(t, err)
+		require.Equal(t, c, status.Code(err))
+	}
+
+	// the calls without a token are allowed until the first token is created
+	require.NoError(t, svc.AuthorizeMethod(ctx, messengerServicePrefix+"Interact", false))
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(ctx, messengerServicePrefix+"Interact", true))
+	require.NoError(t, svc.AuthorizeMethod(ctx, messengerServicePrefix+"APITokenCreate", true))
+
+	readOnly, err := svc.APITokenCreate(ctx, &messengertypes.APITokenCreate_Request{Name: "dashboard", Scope: messengertypes.APIToken_ScopeReadOnly})
+	require.NoError(t, err)
+	sendOnly, err := svc.APITokenCreate(ctx, &messengertypes.APITokenCreate_Request{Name: "notifier", Scope: messengertypes.APIToken_ScopeSendOnly})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.AuthorizeMethod(withToken(readOnly.GetToken()), messengerServicePrefix+"InteractionList", false))
+	requireCode(codes.PermissionDenied, svc.AuthorizeMethod(withToken(readOnly.GetToken()), messengerServicePrefix+"Interact", false))
+	require.NoError(t, svc.AuthorizeMethod(withToken(sendOnly.GetToken()), messengerServicePrefix+"Interact", false))
+	requireCode(codes.PermissionDenied, svc.AuthorizeMethod(withToken(sendOnly.GetToken()), messengerServicePrefix+"InteractionList", false))
+	// the unknown methods require an admin token
+	requireCode(codes.PermissionDenied, svc.AuthorizeMethod(withToken(readOnly.GetToken()), messengerServicePrefix+"APITokenCreate", false))
+
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(withToken("unknown"), messengerServicePrefix+"InteractionList", false))
+
+	// the calls without a token are refused once a token exists
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(ctx, messengerServicePrefix+"Interact", false))
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(ctx, messengerServicePrefix+"APITokenCreate", true))
+	// the other services are not checked
+	require.NoError(t, svc.AuthorizeMethod(ctx, "/berty.protocol.v1.ProtocolService/AppMessageSend", true))
+
+	// expired token
+	require.NoError(t, db.db.Model(&messengertypes.APIToken{}).Where("id = ?", readOnly.GetAPIToken().GetID()).Update("expires_date", timestampMs(time.Now())-1).Error)
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(withToken(readOnly.GetToken()), messengerServicePrefix+"InteractionList", false))
+
+	// revoked token
+	_, err = svc.APITokenRevoke(ctx, &messengertypes.APITokenRevoke_Request{TokenID: sendOnly.GetAPIToken().GetID()})
+	require.NoError(t, err)
+	requireCode(codes.Unauthenticated, svc.AuthorizeMethod(withToken(sendOnly.GetToken()), messengerServicePrefix+"Interact", false))
+
+	list, err := svc.APITokenList(ctx, &messengertypes.APITokenList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.GetAPITokens(), 1)
+	require.Equal(t, readOnly.GetAPIToken().GetID(), list.GetAPITokens()[0].GetID())
+
+	_, err = svc.APITokenCreate(ctx, &messengertypes.APITokenCreate_Request{Name: "expired", Scope: messengertypes.APIToken_ScopeAdmin, ExpiresDate: timestampMs(time.Now()) - 1})
+	require.Error(t, err)
+}
@@ -0,0 +1,598 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The audit log records the events processed by the messenger, when they were processed, their outcome and the rows of
+// the database their handling changed, so the organizational deployments can show how the messages were handled. The
+// records are appended to a file separate from the database, each one is encrypted and holds the hash of the previous
+// one, a record removed or changed is detected when the log is exported. The file is rotated once it reaches its
+// maximum size, the chain goes on in the next file. The records are only written, they are never updated, a write
+// failure is logged without failing the handling of the event.
+
+// defaultAuditLogMaxFileSize is the size in bytes above which the file of the audit log is rotated
+const defaultAuditLogMaxFileSize = 16 * 1024 * 1024
+
+// auditLogFrameMaxSize bounds the size of a record read from the log, a larger size is a corrupted frame
+const auditLogFrameMaxSize = 1024 * 1024
+
+// AuditLogOpts configures the audit log of the processed events
+type AuditLogOpts struct {
+	// Path is the file the records are appended to, the rotated files are next to it suffixed with the sequence number
+	// of their first record
+	Path string
+	// Key is the AES-256 key the records are encrypted with, it must be kept to export the log
+	Key []byte
+	// MaxFileSize is the size in bytes above which the file is rotated, defaultAuditLogMaxFileSize is used if 0
+	MaxFileSize int64
+	// MaxFiles is the number of rotated files kept, the oldest ones are removed, they are all kept if 0
+	MaxFiles int
+}
+
+type auditLog struct {
+	mu     sync.Mutex
+	opts   AuditLogOpts
+	aead   cipher.AEAD
+	file   *os.File
+	size   int64
+	logger *zap.Logger
+	// first is the sequence number of the first record of the current file, 0 when it has none
+	first    uint64
+	sequence uint64
+	lastHash []byte
+}
+
+// openAuditLog opens the current file of the log and resumes the chain from its last record, a file ending with a
+// partial record interrupted by a crash is rotated without being appended to
+func openAuditLog(opts AuditLogOpts, logger *zap.Logger) (*auditLog, error) {
+	if opts.Path == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the audit log has no path"))
+	}
+
+	if len(opts.Key) != 32 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the key of the audit log must be 32 bytes long"))
+	}
+
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = defaultAuditLogMaxFileSize
+	}
+
+	block, err := aes.NewCipher(opts.Key)
+	if err != nil {
+		return nil, errcode.ErrCryptoCipherInit.Wrap(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errcode.ErrCryptoCipherInit.Wrap(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0o700); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	l := &auditLog{opts: opts, aead: aead, logger: logger}
+
+	// the chain goes on from the last record of the current file, or of the last rotated one when it is empty
+	paths, err := l.rotatedPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := len(paths) - 1; idx >= 0 && l.sequence == 0; idx-- {
+		if _, err := l.scan(paths[idx]); err != nil {
+			return nil, err
+		}
+	}
+
+	complete, err := l.scan(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.openCurrent(); err != nil {
+		return nil, err
+	}
+
+	if !complete {
+		logger.Warn("the audit log ends with a partial record, it is rotated", zap.String("path", opts.Path))
+		if _, err := l.rotateLocked(); err != nil {
+			l.file.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// scan reads the records of a file to resume the chain from its last one, complete is false when it ends with a
+// partial record
+func (l *auditLog) scan(path string) (complete bool, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, errcode.ErrInternal.Wrap(err)
+	}
+	defer f.Close()
+
+	records, complete, err := l.readFile(f, -1)
+	if err != nil {
+		return false, err
+	}
+
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		l.sequence, l.lastHash = last.record.GetSequence(), last.hash
+		if path == l.opts.Path {
+			l.first = records[0].record.GetSequence()
+		}
+	}
+
+	return complete, nil
+}
+
+func (l *auditLog) openCurrent() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// rotatedPaths returns the rotated files of the log from the oldest one
+func (l *auditLog) rotatedPaths() ([]string, error) {
+	paths, err := filepath.Glob(l.opts.Path + ".*")
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	// the suffixes are zero-padded, their order is the one of the sequence numbers
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// append writes the record of a processed event, it gets the next sequence number and the hash of the previous record
+func (l *auditLog) append(record *messengertypes.AuditRecord) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return errcode.ErrAuditLogUnavailable
+	}
+
+	record.Sequence = l.sequence + 1
+	record.PreviousHash = l.lastHash
+	if record.ProcessedDate == 0 {
+		record.ProcessedDate = timestampMs(time.Now())
+	}
+
+	data, err := proto.Marshal(record)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	nonce := make([]byte, l.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	sealed := l.aead.Seal(nonce, nonce, data, nil)
+	frame := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[4:], sealed)
+
+	if l.size > 0 && l.size+int64(len(frame)) > l.opts.MaxFileSize {
+		if _, err := l.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := l.file.Write(frame); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	hash := sha256.Sum256(data)
+	l.size += int64(len(frame))
+	l.sequence, l.lastHash = record.Sequence, hash[:]
+	if l.first == 0 {
+		l.first = record.Sequence
+	}
+
+	return nil
+}
+
+// rotate moves the current file next to it and starts a new one, it returns the path of the rotated file
+func (l *auditLog) rotate() (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return "", errcode.ErrAuditLogUnavailable
+	}
+
+	return l.rotateLocked()
+}
+
+// rotateLocked rotates the current file, the lock must be held, a file without any record isn't rotated
+func (l *auditLog) rotateLocked() (string, error) {
+	if l.size == 0 {
+		return "", nil
+	}
+
+	if err := l.file.Sync(); err != nil {
+		return "", errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := l.file.Close(); err != nil {
+		return "", errcode.ErrInternal.Wrap(err)
+	}
+	l.file = nil
+
+	// a file holding only a partial record is named after the record which follows it
+	rotated := fmt.Sprintf("%s.%020d", l.opts.Path, l.first)
+	if l.first == 0 {
+		rotated = fmt.Sprintf("%s.%020d.partial", l.opts.Path, l.sequence+1)
+	}
+
+	if err := os.Rename(l.opts.Path, rotated); err != nil {
+		return "", errcode.ErrInternal.Wrap(err)
+	}
+	l.first = 0
+
+	if err := l.openCurrent(); err != nil {
+		return "", err
+	}
+
+	if l.opts.MaxFiles > 0 {
+		paths, err := l.rotatedPaths()
+		if err != nil {
+			return "", err
+		}
+
+		for len(paths) > l.opts.MaxFiles {
+			if err := os.Remove(paths[0]); err != nil {
+				l.logger.Warn("unable to remove a rotated audit log", zap.String("path", paths[0]), zap.Error(err))
+			}
+			paths = paths[1:]
+		}
+	}
+
+	return rotated, nil
+}
+
+func (l *auditLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return
+	}
+
+	if err := l.file.Sync(); err != nil {
+		l.logger.Warn("unable to sync the audit log", zap.Error(err))
+	}
+
+	if err := l.file.Close(); err != nil {
+		l.logger.Warn("unable to close the audit log", zap.Error(err))
+	}
+	l.file = nil
+}
+
+type auditFrame struct {
+	record *messengertypes.AuditRecord
+	hash   []byte
+}
+
+// readFile decrypts the records of a file up to limit bytes, or to its end if limit is negative, complete is false
+// when it ends with a partial record
+func (l *auditLog) readFile(r io.Reader, limit int64) (frames []*auditFrame, complete bool, err error) {
+	if limit >= 0 {
+		r = io.LimitReader(r, limit)
+	}
+
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return frames, true, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return frames, false, nil
+		} else if err != nil {
+			return nil, false, errcode.ErrInternal.Wrap(err)
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size < uint32(l.aead.NonceSize()) || size > auditLogFrameMaxSize {
+			return nil, false, errcode.ErrAuditLogCorrupted.Wrap(fmt.Errorf("invalid record size %d", size))
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return frames, false, nil
+		} else if err != nil {
+			return nil, false, errcode.ErrInternal.Wrap(err)
+		}
+
+		nonce, ciphertext := sealed[:l.aead.NonceSize()], sealed[l.aead.NonceSize():]
+		data, err := l.aead.Open(nil, nonce, ciphertext, nil)
+		if err != nil {
+			return nil, false, errcode.ErrAuditLogCorrupted.Wrap(err)
+		}
+
+		record := &messengertypes.AuditRecord{}
+		if err := proto.Unmarshal(data, record); err != nil {
+			return nil, false, errcode.ErrAuditLogCorrupted.Wrap(err)
+		}
+
+		hash := sha256.Sum256(data)
+		frames = append(frames, &auditFrame{record: record, hash: hash[:]})
+	}
+}
+
+// export verifies the chain of the records and calls fn with the ones more recent than a sequence number. The files
+// are opened under the lock so a rotation doesn't move them, the records written after are exported by the next call
+func (l *auditLog) export(since uint64, fn func(*messengertypes.AuditRecord) error) error {
+	l.mu.Lock()
+	if l.file == nil {
+		l.mu.Unlock()
+		return errcode.ErrAuditLogUnavailable
+	}
+
+	paths, err := l.rotatedPaths()
+	if err != nil {
+		l.mu.Unlock()
+		return err
+	}
+
+	files := []*os.File(nil)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, path := range append(paths, l.opts.Path) {
+		f, err := os.Open(path)
+		if err != nil {
+			l.mu.Unlock()
+			return errcode.ErrInternal.Wrap(err)
+		}
+		files = append(files, f)
+	}
+	currentSize := l.size
+	l.mu.Unlock()
+
+	var (
+		sequence uint64
+		lastHash []byte
+	)
+	for idx, f := range files {
+		limit := int64(-1)
+		if idx == len(files)-1 {
+			limit = currentSize
+		}
+
+		frames, _, err := l.readFile(f, limit)
+		if err != nil {
+			return err
+		}
+
+		for _, frame := range frames {
+			record := frame.record
+
+			// the first record kept is trusted, the ones before it may have been removed by the rotation
+			if sequence != 0 && (record.GetSequence() != sequence+1 || !bytes.Equal(record.GetPreviousHash(), lastHash)) {
+				return errcode.ErrAuditLogCorrupted.Wrap(fmt.Errorf("the chain is broken at record %d", record.GetSequence()))
+			}
+			sequence, lastHash = record.GetSequence(), frame.hash
+
+			if record.GetSequence() <= since {
+				continue
+			}
+
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// auditMutations collects the rows changed by a transaction, they are counted by table and operation
+type auditMutations struct {
+	mu        sync.Mutex
+	mutations []*messengertypes.AuditRecord_Mutation
+}
+
+func (m *auditMutations) add(table, operation string, rows int64) {
+	if m == nil || rows <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, mutation := range m.mutations {
+		if mutation.Table == table && mutation.Operation == operation {
+			mutation.Rows += rows
+			return
+		}
+	}
+
+	m.mutations = append(m.mutations, &messengertypes.AuditRecord_Mutation{Table: table, Operation: operation, Rows: rows})
+}
+
+func (m *auditMutations) list() []*messengertypes.AuditRecord_Mutation {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*messengertypes.AuditRecord_Mutation(nil), m.mutations...)
+}
+
+type auditMutationsKey struct{}
+
+const auditCallbackName = "messenger:audit"
+
+// registerAuditCallbacks counts the rows changed by the statements run with a context holding an auditMutations
+func registerAuditCallbacks(db *gorm.DB) error {
+	callbacks := db.Callback()
+
+	if err := callbacks.Create().After("gorm:create").Register(auditCallbackName, recordAuditMutation("create")); err != nil {
+		return err
+	}
+
+	if err := callbacks.Update().After("gorm:update").Register(auditCallbackName, recordAuditMutation("update")); err != nil {
+		return err
+	}
+
+	if err := callbacks.Delete().After("gorm:delete").Register(auditCallbackName, recordAuditMutation("delete")); err != nil {
+		return err
+	}
+
+	return callbacks.Raw().After("gorm:raw").Register(auditCallbackName, recordAuditMutation("raw"))
+}
+
+func recordAuditMutation(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		if db.Error != nil || db.Statement.Context == nil {
+			return
+		}
+
+		mutations, ok := db.Statement.Context.Value(auditMutationsKey{}).(*auditMutations)
+		if !ok {
+			return
+		}
+
+		mutations.add(db.Statement.Table, operation, db.RowsAffected)
+	}
+}
+
+// withAuditMutations returns a wrapper whose statements count their changed rows in mutations
+func (d *dbWrapper) withAuditMutations(mutations *auditMutations) *dbWrapper {
+	return &dbWrapper{db: d.db.WithContext(context.WithValue(context.Background(), auditMutationsKey{}, mutations)), log: d.log}
+}
+
+// auditEvent appends the record of a processed event to the audit log of the service, if any
+func (h *eventHandler) auditEvent(record *messengertypes.AuditRecord) {
+	if h.svc == nil || h.svc.auditLog == nil {
+		return
+	}
+
+	record.Replay = h.replay
+	if err := h.svc.auditLog.append(record); err != nil {
+		h.logger.Error("unable to write the audit log", zap.String("cid", record.GetCID()), zap.Error(err))
+	}
+}
+
+// auditAppMessage records the outcome of the handling of an app message, the messages dropped as duplicates or
+// deferred aren't recorded, they are once handled
+func (h *eventHandler) auditAppMessage(evt *AppMessageEvent, err error) {
+	record := &messengertypes.AuditRecord{
+		ConversationPublicKey: evt.GroupPK,
+		CID:                   evt.CID,
+		EventType:             evt.AppMessage.GetType().String(),
+		EventHash:             evt.hash,
+		Mutations:             evt.mutations.list(),
+	}
+
+	switch {
+	case err != nil:
+		record.Outcome, record.Reason = messengertypes.AuditRecord_OutcomeFailed, err.Error()
+	case evt.rejection != "":
+		record.Outcome, record.Reason = messengertypes.AuditRecord_OutcomeRejected, evt.rejection
+	case evt.handled:
+		record.Outcome = messengertypes.AuditRecord_OutcomeHandled
+	default:
+		return
+	}
+
+	h.auditEvent(record)
+}
+
+// auditMetadataEvent records the outcome of the handling of a metadata event
+func (h *eventHandler) auditMetadataEvent(gme *protocoltypes.GroupMetadataEvent, cid, hash string, err error) {
+	record := &messengertypes.AuditRecord{
+		ConversationPublicKey: b64EncodeBytes(gme.GetEventContext().GetGroupPK()),
+		CID:                   cid,
+		EventType:             gme.GetMetadata().GetEventType().String(),
+		EventHash:             hash,
+		Outcome:               messengertypes.AuditRecord_OutcomeHandled,
+	}
+
+	if err != nil {
+		record.Outcome, record.Reason = messengertypes.AuditRecord_OutcomeFailed, err.Error()
+	}
+
+	h.auditEvent(record)
+}
+
+func (svc *service) AuditLogExport(req *messengertypes.AuditLogExport_Request, sub messengertypes.MessengerService_AuditLogExportServer) error {
+	if svc.auditLog == nil {
+		return errcode.ErrAuditLogUnavailable
+	}
+
+	return svc.auditLog.export(req.GetSinceSequence(), func(record *messengertypes.AuditRecord) error {
+		if err := sub.Context().Err(); err != nil {
+			return err
+		}
+
+		return sub.Send(&messengertypes.AuditLogExport_Reply{Record: record})
+	})
+}
+
+func (svc *service) AuditLogRotate(context.Context, *messengertypes.AuditLogRotate_Request) (*messengertypes.AuditLogRotate_Reply, error) {
+	if svc.auditLog == nil {
+		return nil, errcode.ErrAuditLogUnavailable
+	}
+
+	path, err := svc.auditLog.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AuditLogRotate_Reply{Path: path}, nil
+}
@@ -0,0 +1,145 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func exportAuditLog(t *testing.T, l *auditLog, since uint64) []*messengertypes.AuditRecord {
+	t.Helper()
+
+	records := []*messengertypes.AuditRecord(nil)
+	require.NoError(t, l.export(since, func(record *messengertypes.AuditRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+
+	return records
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := AuditLogOpts{Path: filepath.Join(dir, "audit.log"), Key: bytes.Repeat([]byte{1}, 32), MaxFileSize: 128}
+
+	_, err = openAuditLog(AuditLogOpts{Path: opts.Path, Key: []byte("short")}, zap.NewNop())
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	l, err := openAuditLog(opts, zap.NewNop())
+	require.NoError(t, err)
+
+	for _, cid := range []string{"cid_1", "cid_2", "cid_3", "cid_4", "cid_5"} {
+		require.NoError(t, l.append(&messengertypes.AuditRecord{CID: cid, Outcome: messengertypes.AuditRecord_OutcomeHandled}))
+	}
+
+	// the file is rotated once it reaches its maximum size
+	paths, err := l.rotatedPaths()
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	// the chain goes on after the log is opened again
+	l.close()
+	l, err = openAuditLog(opts, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, l.append(&messengertypes.AuditRecord{CID: "cid_6", Outcome: messengertypes.AuditRecord_OutcomeFailed, Reason: "failure"}))
+
+	records := exportAuditLog(t, l, 0)
+	require.Len(t, records, 6)
+	for idx, record := range records {
+		require.Equal(t, uint64(idx+1), record.GetSequence())
+	}
+	require.Empty(t, records[0].GetPreviousHash())
+	require.Equal(t, "cid_6", records[5].GetCID())
+	require.Equal(t, "failure", records[5].GetReason())
+
+	records = exportAuditLog(t, l, 4)
+	require.Len(t, records, 2)
+	require.Equal(t, "cid_5", records[0].GetCID())
+
+	// a file rotated on request isn't rotated again while no record is added
+	rotated, err := l.rotate()
+	require.NoError(t, err)
+	require.NotEmpty(t, rotated)
+	rotated, err = l.rotate()
+	require.NoError(t, err)
+	require.Empty(t, rotated)
+
+	// a record removed breaks the chain
+	l.close()
+	paths, err = l.rotatedPaths()
+	require.NoError(t, err)
+	require.True(t, len(paths) > 2)
+	require.NoError(t, os.Remove(paths[1]))
+
+	l, err = openAuditLog(opts, zap.NewNop())
+	require.NoError(t, err)
+	defer l.close()
+
+	err = l.export(0, func(*messengertypes.AuditRecord) error { return nil })
+	require.True(t, errcode.Is(err, errcode.ErrAuditLogCorrupted))
+}
+
+func TestAuditLogPartialRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := AuditLogOpts{Path: filepath.Join(dir, "audit.log"), Key: bytes.Repeat([]byte{2}, 32)}
+
+	l, err := openAuditLog(opts, zap.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, l.append(&messengertypes.AuditRecord{CID: "cid_1"}))
+	l.close()
+
+	// a write interrupted by a crash
+	f, err := os.OpenFile(opts.Path, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 64, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = openAuditLog(opts, zap.NewNop())
+	require.NoError(t, err)
+	defer l.close()
+	require.NoError(t, l.append(&messengertypes.AuditRecord{CID: "cid_2"}))
+
+	records := exportAuditLog(t, l, 0)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(2), records[1].GetSequence())
+}
+
+func TestAuditMutations(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, registerAuditCallbacks(db.db))
+
+	mutations := &auditMutations{}
+	require.NoError(t, db.withAuditMutations(mutations).tx(func(tx *dbWrapper) error {
+		if err := tx.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error; err != nil {
+			return err
+		}
+
+		return tx.db.Model(&messengertypes.Conversation{}).Where("public_key = ?", "conv_1").Update("display_name", "name").Error
+	}))
+
+	require.Equal(t, []*messengertypes.AuditRecord_Mutation{
+		{Table: "conversations", Operation: "create", Rows: 1},
+		{Table: "conversations", Operation: "update", Rows: 1},
+	}, mutations.list())
+
+	// the statements run without the context aren't recorded
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2"}).Error)
+	require.Len(t, mutations.list(), 2)
+}
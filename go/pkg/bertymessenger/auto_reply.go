@@ -0,0 +1,227 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	autoReplyDefaultCooldown = time.Hour
+	autoReplyMaxBodyLength   = 4096
+	autoReplyLogDefaultCount = 100
+)
+
+// The auto-replies are only sent in the contact conversations, in response to the new incoming messages. The messages
+// they send are flagged and never trigger an auto-reply on the other side, and a cooldown bounds the number of
+// auto-replies in a conversation when both sides are away.
+
+func checkAutoReply(rule *messengertypes.AutoReply) error {
+	if rule == nil || rule.GetBody() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	switch rule.GetScope() {
+	case messengertypes.AutoReply_ScopeGlobal:
+		if rule.GetTargetPublicKey() != "" {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the global rule has no target"))
+		}
+	case messengertypes.AutoReply_ScopeContact, messengertypes.AutoReply_ScopeConversation:
+		if rule.GetTargetPublicKey() == "" {
+			return errcode.ErrMissingInput
+		}
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown scope %d", rule.GetScope()))
+	}
+
+	if len(rule.GetBody()) > autoReplyMaxBodyLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the body must be at most %d bytes", autoReplyMaxBodyLength))
+	}
+
+	for _, minute := range []int32{rule.GetScheduleStart(), rule.GetScheduleEnd()} {
+		if minute < 0 || minute >= minutesPerDay {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the schedule must be between 0 and %d minutes", minutesPerDay-1))
+		}
+	}
+
+	if rule.GetCooldown() < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the cooldown can't be negative"))
+	}
+
+	return nil
+}
+
+// selectAutoReply returns the most specific rule of a conversation, nil when none has been set
+func selectAutoReply(rules []*messengertypes.AutoReply) *messengertypes.AutoReply {
+	var selected *messengertypes.AutoReply
+
+	priority := func(scope messengertypes.AutoReply_Scope) int {
+		switch scope {
+		case messengertypes.AutoReply_ScopeContact:
+			return 2
+		case messengertypes.AutoReply_ScopeConversation:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	for _, rule := range rules {
+		if selected == nil || priority(rule.GetScope()) > priority(selected.GetScope()) {
+			selected = rule
+		}
+	}
+
+	return selected
+}
+
+// isAutoReplyAllowed checks the schedule of a rule and its cooldown since the last auto-reply of the conversation
+func isAutoReplyAllowed(rule *messengertypes.AutoReply, last *messengertypes.AutoReplyLog, now time.Time) bool {
+	if rule == nil || !rule.GetEnabled() {
+		return false
+	}
+
+	// the schedule is the opposite of the quiet hours, the rule applies between its bounds
+	if rule.GetScheduleStart() != rule.GetScheduleEnd() && !isInQuietHours(rule.GetScheduleStart(), rule.GetScheduleEnd(), now) {
+		return false
+	}
+
+	if last == nil {
+		return true
+	}
+
+	cooldown := rule.GetCooldown()
+	if cooldown == 0 {
+		cooldown = autoReplyDefaultCooldown.Milliseconds()
+	}
+
+	return timestampMs(now)-last.GetSentDate() >= cooldown
+}
+
+// handleAutoReply evaluates the auto-reply rules for a new incoming message, the auto-reply is logged in the same
+// transaction and sent once it is committed
+func (h *eventHandler) handleAutoReply(tx *dbWrapper, i *messengertypes.Interaction, payload *messengertypes.AppMessage_UserMessage) error {
+	if payload.GetIsAutoReply() || i.Conversation == nil || i.Conversation.GetType() != messengertypes.Conversation_ContactType {
+		return nil
+	}
+
+	rules, err := tx.getConversationAutoReplies(i.GetConversationPublicKey(), i.Conversation.GetContactPublicKey())
+	if err != nil {
+		return err
+	}
+
+	rule := selectAutoReply(rules)
+	if rule == nil {
+		return nil
+	}
+
+	last, err := tx.getLastAutoReplyLog(i.GetConversationPublicKey())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !isAutoReplyAllowed(rule, last, now) {
+		return nil
+	}
+
+	if err := tx.addAutoReplyLog(&messengertypes.AutoReplyLog{
+		TriggerCID:            i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Scope:                 rule.GetScope(),
+		TargetPublicKey:       rule.GetTargetPublicKey(),
+		SentDate:              timestampMs(now),
+	}); err != nil {
+		return err
+	}
+
+	go h.svc.sendAutoReply(h.svc.ctx, i.GetConversationPublicKey(), rule.GetBody())
+
+	return nil
+}
+
+func (svc *service) sendAutoReply(ctx context.Context, convPK string, body string) {
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: body, IsAutoReply: true})
+	if err != nil {
+		svc.logger.Error("unable to marshal auto-reply", zap.Error(err))
+		return
+	}
+
+	if _, err := svc.Interact(ctx, &messengertypes.Interact_Request{
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		Payload:               payload,
+		ConversationPublicKey: convPK,
+	}); err != nil {
+		svc.logger.Warn("unable to send auto-reply", logGroup(convPK), zap.Error(err))
+	}
+}
+
+func (svc *service) AutoReplySet(ctx context.Context, req *messengertypes.AutoReplySet_Request) (*messengertypes.AutoReplySet_Reply, error) {
+	rule := req.GetRule()
+	if err := checkAutoReply(rule); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	switch rule.GetScope() {
+	case messengertypes.AutoReply_ScopeContact:
+		if _, err := svc.db.getContactByPK(rule.GetTargetPublicKey()); err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+	case messengertypes.AutoReply_ScopeConversation:
+		if _, err := svc.db.getConversationByPK(rule.GetTargetPublicKey()); err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+	}
+
+	rule.UpdatedDate = timestampMs(time.Now())
+	if err := svc.db.setAutoReply(rule); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AutoReplySet_Reply{Rule: rule}, nil
+}
+
+func (svc *service) AutoReplyRemove(ctx context.Context, req *messengertypes.AutoReplyRemove_Request) (*messengertypes.AutoReplyRemove_Reply, error) {
+	if req.GetScope() != messengertypes.AutoReply_ScopeGlobal && req.GetTargetPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.removeAutoReply(req.GetScope(), req.GetTargetPublicKey()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AutoReplyRemove_Reply{}, nil
+}
+
+func (svc *service) AutoReplyList(ctx context.Context, req *messengertypes.AutoReplyList_Request) (*messengertypes.AutoReplyList_Reply, error) {
+	rules, err := svc.db.getAutoReplies()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AutoReplyList_Reply{Rules: rules}, nil
+}
+
+func (svc *service) AutoReplyLogList(ctx context.Context, req *messengertypes.AutoReplyLogList_Request) (*messengertypes.AutoReplyLogList_Reply, error) {
+	count := int(req.GetCount())
+	if count <= 0 {
+		count = autoReplyLogDefaultCount
+	}
+
+	logs, err := svc.db.getAutoReplyLogs(req.GetConversationPublicKey(), count)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AutoReplyLogList_Reply{Logs: logs}, nil
+}
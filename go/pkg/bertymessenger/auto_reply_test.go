@@ -0,0 +1,115 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_checkAutoReply(t *testing.T) {
+	require.Error(t, checkAutoReply(nil))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{}))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", TargetPublicKey: "contact_1"}))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", Scope: messengertypes.AutoReply_ScopeContact}))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", Scope: 42}))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", ScheduleEnd: minutesPerDay}))
+	require.Error(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", Cooldown: -1}))
+	require.NoError(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", ScheduleStart: 18 * 60, ScheduleEnd: 9 * 60}))
+	require.NoError(t, checkAutoReply(&messengertypes.AutoReply{Body: "away", Scope: messengertypes.AutoReply_ScopeConversation, TargetPublicKey: "conv_1"}))
+}
+
+func Test_selectAutoReply(t *testing.T) {
+	require.Nil(t, selectAutoReply(nil))
+
+	global := &messengertypes.AutoReply{Scope: messengertypes.AutoReply_ScopeGlobal}
+	conv := &messengertypes.AutoReply{Scope: messengertypes.AutoReply_ScopeConversation, TargetPublicKey: "conv_1"}
+	contact := &messengertypes.AutoReply{Scope: messengertypes.AutoReply_ScopeContact, TargetPublicKey: "contact_1"}
+
+	require.Equal(t, global, selectAutoReply([]*messengertypes.AutoReply{global}))
+	require.Equal(t, conv, selectAutoReply([]*messengertypes.AutoReply{global, conv}))
+	require.Equal(t, contact, selectAutoReply([]*messengertypes.AutoReply{contact, global, conv}))
+}
+
+func Test_isAutoReplyAllowed(t *testing.T) {
+	now := time.Date(2021, 1, 1, 20, 0, 0, 0, time.Local)
+
+	require.False(t, isAutoReplyAllowed(nil, nil, now))
+	require.False(t, isAutoReplyAllowed(&messengertypes.AutoReply{}, nil, now))
+	require.True(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true}, nil, now))
+
+	// the schedule can span midnight
+	require.True(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true, ScheduleStart: 18 * 60, ScheduleEnd: 9 * 60}, nil, now))
+	require.False(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true, ScheduleStart: 9 * 60, ScheduleEnd: 18 * 60}, nil, now))
+
+	recent := &messengertypes.AutoReplyLog{SentDate: timestampMs(now.Add(-time.Minute))}
+	require.False(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true}, recent, now))
+	require.True(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true, Cooldown: time.Second.Milliseconds()}, recent, now))
+
+	old := &messengertypes.AutoReplyLog{SentDate: timestampMs(now.Add(-2 * autoReplyDefaultCooldown))}
+	require.True(t, isAutoReplyAllowed(&messengertypes.AutoReply{Enabled: true}, old, now))
+}
+
+func Test_dbWrapper_autoReplies(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.setAutoReply(&messengertypes.AutoReply{Scope: messengertypes.AutoReply_ScopeContact}))
+	require.NoError(t, db.setAutoReply(&messengertypes.AutoReply{Body: "away"}))
+	require.NoError(t, db.setAutoReply(&messengertypes.AutoReply{Body: "busy", Scope: messengertypes.AutoReply_ScopeContact, TargetPublicKey: "contact_1"}))
+	require.NoError(t, db.setAutoReply(&messengertypes.AutoReply{Body: "other", Scope: messengertypes.AutoReply_ScopeConversation, TargetPublicKey: "conv_2"}))
+
+	// the rules are replaced
+	require.NoError(t, db.setAutoReply(&messengertypes.AutoReply{Body: "on holidays"}))
+
+	rules, err := db.getAutoReplies()
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	require.Equal(t, "on holidays", rules[0].GetBody())
+
+	rules, err = db.getConversationAutoReplies("conv_1", "contact_1")
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "busy", selectAutoReply(rules).GetBody())
+
+	require.NoError(t, db.removeAutoReply(messengertypes.AutoReply_ScopeContact, "contact_1"))
+	require.Error(t, db.removeAutoReply(messengertypes.AutoReply_ScopeContact, "contact_1"))
+
+	rules, err = db.getConversationAutoReplies("conv_1", "contact_1")
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	require.Equal(t, messengertypes.AutoReply_ScopeGlobal, rules[0].GetScope())
+}
+
+func Test_dbWrapper_autoReplyLogs(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	last, err := db.getLastAutoReplyLog("conv_1")
+	require.NoError(t, err)
+	require.Nil(t, last)
+
+	require.Error(t, db.addAutoReplyLog(&messengertypes.AutoReplyLog{ConversationPublicKey: "conv_1"}))
+	require.NoError(t, db.addAutoReplyLog(&messengertypes.AutoReplyLog{TriggerCID: "cid_1", ConversationPublicKey: "conv_1", SentDate: 1}))
+	require.NoError(t, db.addAutoReplyLog(&messengertypes.AutoReplyLog{TriggerCID: "cid_2", ConversationPublicKey: "conv_1", SentDate: 2}))
+	require.NoError(t, db.addAutoReplyLog(&messengertypes.AutoReplyLog{TriggerCID: "cid_3", ConversationPublicKey: "conv_2", SentDate: 3}))
+
+	// a message only triggers one auto-reply
+	require.Error(t, db.addAutoReplyLog(&messengertypes.AutoReplyLog{TriggerCID: "cid_1", ConversationPublicKey: "conv_1", SentDate: 4}))
+
+	last, err = db.getLastAutoReplyLog("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, "cid_2", last.GetTriggerCID())
+
+	logs, err := db.getAutoReplyLogs("", autoReplyLogDefaultCount)
+	require.NoError(t, err)
+	require.Len(t, logs, 3)
+	require.Equal(t, "cid_3", logs[0].GetTriggerCID())
+
+	logs, err = db.getAutoReplyLogs("conv_1", 1)
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	require.Equal(t, "cid_2", logs[0].GetTriggerCID())
+}
@@ -0,0 +1,380 @@
+package bertymessenger
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/gogo/protobuf/proto"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	backupMagic   = "BERTYBAK"
+	backupVersion = byte(1)
+	// backupChunkSize is the size of the clear chunks, each one is authenticated on its own so a backup can be verified
+	// while it is streamed
+	backupChunkSize = 64 * 1024
+	// backupHeaderSize is the size of the magic, the version and the salt of the key
+	backupHeaderSize = len(backupMagic) + 1 + cryptoutil.ScryptKeyLen
+)
+
+// newBackupCipher derives the key of a backup from the passphrase, a new salt is generated when none is provided
+func newBackupCipher(passphrase, salt []byte) (cipher.AEAD, []byte, error) {
+	if len(passphrase) == 0 {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a passphrase is required"))
+	}
+
+	key, salt, err := cryptoutil.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	return aead, salt, nil
+}
+
+// backupChunkNonceAndData returns the nonce and the additional data of a chunk, they bind it to its position and to the
+// header so the chunks can't be reordered, removed or moved to another backup
+func backupChunkNonceAndData(aead cipher.AEAD, header []byte, index uint64, last bool) ([]byte, []byte) {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+
+	data := append([]byte{}, header...)
+	data = append(data, nonce[len(nonce)-8:]...)
+	if last {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+
+	return nonce, data
+}
+
+// encryptBackup writes an encrypted backup of the content of the reader
+func encryptBackup(w io.Writer, r io.Reader, passphrase []byte) error {
+	aead, salt, err := newBackupCipher(passphrase, nil)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(backupMagic), backupVersion)
+	header = append(header, salt...)
+
+	if _, err := w.Write(header); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	br := bufio.NewReaderSize(r, backupChunkSize)
+	chunk := make([]byte, backupChunkSize)
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		last := n < backupChunkSize
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return errcode.ErrStreamRead.Wrap(err)
+			}
+		}
+
+		nonce, data := backupChunkNonceAndData(aead, header, index, last)
+		sealed := aead.Seal(nil, nonce, chunk[:n], data)
+
+		frame := make([]byte, 5)
+		if last {
+			frame[0] = 1
+		}
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(sealed)))
+
+		if _, err := w.Write(append(frame, sealed...)); err != nil {
+			return errcode.ErrStreamWrite.Wrap(err)
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptBackup writes the content of an encrypted backup, every chunk is verified and an error is returned if the
+// backup has been truncated or altered
+func decryptBackup(w io.Writer, r io.Reader, passphrase []byte) error {
+	header := make([]byte, backupHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unable to read backup header: %w", err))
+	}
+
+	if !bytes.Equal(header[:len(backupMagic)], []byte(backupMagic)) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("not a backup"))
+	}
+
+	if header[len(backupMagic)] != backupVersion {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported backup version %d", header[len(backupMagic)]))
+	}
+
+	aead, _, err := newBackupCipher(passphrase, header[len(backupMagic)+1:])
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 5)
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("backup is truncated: %w", err))
+		}
+
+		last := frame[0] == 1
+		size := binary.BigEndian.Uint32(frame[1:])
+		if size > uint32(backupChunkSize+aead.Overhead()) {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid backup chunk size"))
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("backup is truncated: %w", err))
+		}
+
+		nonce, data := backupChunkNonceAndData(aead, header, index, last)
+		clear, err := aead.Open(nil, nonce, sealed, data)
+		if err != nil {
+			return errcode.ErrCryptoDecrypt.Wrap(err)
+		}
+
+		if _, err := w.Write(clear); err != nil {
+			return errcode.ErrStreamWrite.Wrap(err)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	if n, _ := r.Read(make([]byte, 1)); n != 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected data after the end of the backup"))
+	}
+
+	return nil
+}
+
+// readBackupLocalState reads the messenger state of a decrypted backup
+func readBackupLocalState(r io.Reader) (*messengertypes.LocalDatabaseState, error) {
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no messenger state found in backup"))
+		} else if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if header.Name != exportLocalDBState {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errcode.ErrStreamRead.Wrap(err)
+		}
+
+		state := &messengertypes.LocalDatabaseState{}
+		if err := proto.Unmarshal(data, state); err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		return state, nil
+	}
+}
+
+// RestoreFromAccountBackup decrypts a backup and restores the account it contains, the messenger state is loaded in
+// localDBState and should be given to the messenger when it is started
+func RestoreFromAccountBackup(ctx context.Context, reader io.Reader, passphrase []byte, coreAPI ipfs_interface.CoreAPI, odb *bertyprotocol.BertyOrbitDB, localDBState *messengertypes.LocalDatabaseState, logger *zap.Logger) error {
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "backup-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := decryptBackup(tmpFile, reader, passphrase); err != nil {
+		return err
+	}
+
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	return RestoreFromAccountExport(ctx, tmpFile, coreAPI, odb, localDBState, logger)
+}
+
+type backupStreamWriter struct {
+	server messengertypes.MessengerService_AccountBackupServer
+}
+
+func (w *backupStreamWriter) Write(p []byte) (int, error) {
+	if err := w.server.Send(&messengertypes.AccountBackup_Reply{BackupData: append([]byte{}, p...)}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (svc *service) AccountBackup(req *messengertypes.AccountBackup_Request, server messengertypes.MessengerService_AccountBackupServer) error {
+	if req.GetPassphrase() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "backup-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := svc.writeAccountExport(server.Context(), tmpFile); err != nil {
+		return err
+	}
+
+	size, err := tmpFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	if err := encryptBackup(&backupStreamWriter{server: server}, tmpFile, []byte(req.GetPassphrase())); err != nil {
+		return err
+	}
+
+	svc.addSystemNotice(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeBackupCompleted, Size_: size})
+
+	return nil
+}
+
+func (svc *service) AccountRestore(server messengertypes.MessengerService_AccountRestoreServer) error {
+	encrypted, err := ioutil.TempFile(os.TempDir(), "backup-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(encrypted.Name())
+	defer encrypted.Close()
+
+	passphrase := ""
+	for first := true; ; first = false {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if first {
+			passphrase = req.GetPassphrase()
+		}
+
+		if _, err := encrypted.Write(req.GetBackupData()); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if passphrase == "" {
+		return errcode.ErrMissingInput
+	}
+
+	if _, err := encrypted.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	state, err := svc.restoreAccountBackup(server.Context(), encrypted, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+
+	return server.SendAndClose(&messengertypes.AccountRestore_Reply{SnapshotDate: state.GetSnapshotDate()})
+}
+
+// restoreAccountBackup decrypts a backup of the account of the node and rebuilds the database from the logs with its
+// messenger state
+func (svc *service) restoreAccountBackup(ctx context.Context, encrypted io.Reader, passphrase []byte) (*messengertypes.LocalDatabaseState, error) {
+	decrypted, err := ioutil.TempFile(os.TempDir(), "backup-")
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(decrypted.Name())
+	defer decrypted.Close()
+
+	if err := decryptBackup(decrypted, encrypted, passphrase); err != nil {
+		return nil, err
+	}
+
+	if _, err := decrypted.Seek(0, io.SeekStart); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	state, err := readBackupLocalState(decrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	// the keys of the account are loaded by the protocol, they can't be replaced on a running node
+	if state.GetPublicKey() != acc.GetPublicKey() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the backup of another account must be restored when starting the node"))
+	}
+
+	// the database is rebuilt from the logs, the changes more recent than the snapshot are kept
+	if err := replayLogsWithLocalState(ctx, svc.protocolClient, svc.db, state, ReplayOptions{}); err != nil {
+		return nil, err
+	}
+
+	if acc, err = svc.db.getAccount(); err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,66 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+func TestBackupEncryption(t *testing.T) {
+	passphrase := []byte("passphrase")
+
+	for _, size := range []int{0, 1, backupChunkSize - 1, backupChunkSize, backupChunkSize*2 + 42} {
+		clear := make([]byte, size)
+		_, err := rand.Read(clear)
+		require.NoError(t, err)
+
+		encrypted := &bytes.Buffer{}
+		require.NoError(t, encryptBackup(encrypted, bytes.NewReader(clear), passphrase))
+
+		decrypted := &bytes.Buffer{}
+		require.NoError(t, decryptBackup(decrypted, bytes.NewReader(encrypted.Bytes()), passphrase))
+		require.Equal(t, clear, decrypted.Bytes())
+	}
+}
+
+func TestBackupEncryptionErrors(t *testing.T) {
+	passphrase := []byte("passphrase")
+
+	clear := make([]byte, backupChunkSize*2+42)
+	_, err := rand.Read(clear)
+	require.NoError(t, err)
+
+	encrypted := &bytes.Buffer{}
+	require.NoError(t, encryptBackup(encrypted, bytes.NewReader(clear), passphrase))
+	data := encrypted.Bytes()
+
+	// wrong passphrase
+	err = decryptBackup(&bytes.Buffer{}, bytes.NewReader(data), []byte("wrong"))
+	require.True(t, errcode.Is(err, errcode.ErrCryptoDecrypt))
+
+	// missing passphrase
+	err = encryptBackup(&bytes.Buffer{}, bytes.NewReader(clear), nil)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	// truncated after a full chunk
+	err = decryptBackup(&bytes.Buffer{}, bytes.NewReader(data[:backupHeaderSize+5+backupChunkSize+16]), passphrase)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	// altered chunk
+	altered := append([]byte{}, data...)
+	altered[len(altered)-1] ^= 1
+	err = decryptBackup(&bytes.Buffer{}, bytes.NewReader(altered), passphrase)
+	require.True(t, errcode.Is(err, errcode.ErrCryptoDecrypt))
+
+	// trailing data
+	err = decryptBackup(&bytes.Buffer{}, bytes.NewReader(append(append([]byte{}, data...), 0)), passphrase)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	// not a backup
+	err = decryptBackup(&bytes.Buffer{}, bytes.NewReader(clear), passphrase)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
@@ -0,0 +1,213 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"moul.io/zapgorm2"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// Opts are the optional outputs of a run
+type Opts struct {
+	Logger *zap.Logger
+	// CPUProfile receives the CPU profile of the handled and replayed events
+	CPUProfile io.Writer
+	// HeapProfile receives the heap profile taken at the end of the run
+	HeapProfile io.Writer
+}
+
+// Phase is the measure of one way of feeding the events to the messenger
+type Phase struct {
+	Events     int
+	Duration   time.Duration
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+func (p Phase) EventsPerSecond() float64 {
+	if p.Duration <= 0 {
+		return 0
+	}
+
+	return float64(p.Events) / p.Duration.Seconds()
+}
+
+func (p Phase) String() string {
+	if p.Events == 0 {
+		return "no events"
+	}
+
+	return fmt.Sprintf("%d events in %s, %.0f events/s, %d allocs/event, %d B/event",
+		p.Events, p.Duration, p.EventsPerSecond(), p.Allocs/uint64(p.Events), p.AllocBytes/uint64(p.Events))
+}
+
+// Report is the result of a run, Live is the handling of the events as they are received and Replay the rebuild of
+// the database from the logs
+type Report struct {
+	Config Config
+	Live   Phase
+	Replay Phase
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("live: %s\nreplay: %s", r.Live, r.Replay)
+}
+
+// Run generates logs following cfg, then handles them one by one and replays them, each on a new in-memory database
+func Run(ctx context.Context, cfg Config, opts *Opts) (*Report, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	logs, err := Generate(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CPUProfile != nil {
+		if err := pprof.StartCPUProfile(opts.CPUProfile); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	report := &Report{Config: cfg}
+
+	if report.Live, err = measure(func() (int, error) { return handleLogs(ctx, logs, opts.Logger) }); err != nil {
+		return nil, err
+	}
+
+	if report.Replay, err = measure(func() (int, error) { return replayLogs(ctx, logs, opts.Logger) }); err != nil {
+		return nil, err
+	}
+
+	if opts.HeapProfile != nil {
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(opts.HeapProfile); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	return report, nil
+}
+
+func measure(fn func() (int, error)) (Phase, error) {
+	var before, after runtime.MemStats
+
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	events, err := fn()
+	if err != nil {
+		return Phase{}, err
+	}
+
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return Phase{
+		Events:     events,
+		Duration:   duration,
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+// handleLogs feeds the events to the handlers in the order they would be received, the account group first
+func handleLogs(ctx context.Context, logs *Logs, log *zap.Logger) (int, error) {
+	pipeline, dispose, err := newPipeline(ctx, newLogsClient(logs), log)
+	if err != nil {
+		return 0, err
+	}
+	defer dispose()
+
+	count := 0
+	for _, gme := range logs.Metadata[string(logs.AccountGroupPK)] {
+		if err := pipeline.HandleMetadataEvent(gme); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	for _, groupPK := range logs.Groups {
+		for _, gme := range logs.Metadata[string(groupPK)] {
+			if err := pipeline.HandleMetadataEvent(gme); err != nil {
+				return 0, err
+			}
+			count++
+		}
+
+		for _, gme := range logs.Messages[string(groupPK)] {
+			if err := pipeline.HandleMessageEvent(gme); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// replayLogs rebuilds a database from the logs, only the most recent messages of each group are replayed so the
+// events are counted as they are listed
+func replayLogs(ctx context.Context, logs *Logs, log *zap.Logger) (int, error) {
+	client := newLogsClient(logs)
+
+	pipeline, dispose, err := newPipeline(ctx, client, log)
+	if err != nil {
+		return 0, err
+	}
+	defer dispose()
+
+	report, err := pipeline.Replay(ctx)
+	if err != nil {
+		return 0, err
+	} else if report.GetFailedEvents() > 0 {
+		return 0, fmt.Errorf("%d events failed during the replay", report.GetFailedEvents())
+	}
+
+	return int(atomic.LoadUint64(&client.served)), nil
+}
+
+var dbCounter uint64
+
+func newPipeline(ctx context.Context, client *logsClient, log *zap.Logger) (*bertymessenger.EventPipeline, func(), error) {
+	// the cache is shared by the connections of the pool, the name keeps the databases of the phases apart
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:bench%d?mode=memory&cache=shared", atomic.AddUint64(&dbCounter, 1))), &gorm.Config{
+		Logger:                                   zapgorm2.New(log.Named("gorm")),
+		DisableForeignKeyConstraintWhenMigrating: true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dispose := func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+
+	pipeline, err := bertymessenger.NewEventPipeline(ctx, db, client, log)
+	if err != nil {
+		dispose()
+		return nil, nil, err
+	}
+
+	return pipeline, dispose, nil
+}
@@ -0,0 +1,98 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestGenerate(t *testing.T) {
+	_, err := Generate(Config{Groups: 0, MembersPerGroup: 1})
+	require.Error(t, err)
+
+	cfg := Config{Groups: 3, MembersPerGroup: 2, MessagesPerGroup: 5, PayloadSize: 16, Seed: 1}
+	logs, err := Generate(cfg)
+	require.NoError(t, err)
+
+	// a group joined event in the account group and a device added event per member
+	require.Equal(t, cfg.Groups*(1+cfg.MembersPerGroup), logs.MetadataEvents())
+	require.Equal(t, cfg.Groups*cfg.MessagesPerGroup, logs.MessageEvents())
+
+	// the logs are reproducible
+	again, err := Generate(cfg)
+	require.NoError(t, err)
+	require.Equal(t, logs.Groups, again.Groups)
+}
+
+func TestRun(t *testing.T) {
+	cfg := Config{Groups: 2, MembersPerGroup: 3, MessagesPerGroup: 10, PayloadSize: 32, Seed: 1}
+
+	cpu, heap := &bytes.Buffer{}, &bytes.Buffer{}
+	report, err := Run(context.Background(), cfg, &Opts{CPUProfile: cpu, HeapProfile: heap})
+	require.NoError(t, err)
+
+	require.Equal(t, cfg.Groups*(1+cfg.MembersPerGroup+cfg.MessagesPerGroup), report.Live.Events)
+	require.NotZero(t, report.Live.Allocs)
+	require.NotZero(t, report.Replay.Events)
+	require.NotEmpty(t, heap.Bytes())
+	require.NotEmpty(t, cpu.Bytes())
+
+	t.Log(report)
+}
+
+func benchmarkConfigs() []Config {
+	return []Config{
+		{Groups: 1, MembersPerGroup: 2, MessagesPerGroup: 100, PayloadSize: 64},
+		{Groups: 10, MembersPerGroup: 5, MessagesPerGroup: 100, PayloadSize: 64},
+		{Groups: 1, MembersPerGroup: 2, MessagesPerGroup: 100, PayloadSize: 4096},
+	}
+}
+
+func BenchmarkHandle(b *testing.B) {
+	for _, cfg := range benchmarkConfigs() {
+		cfg := cfg
+		b.Run(fmt.Sprintf("groups=%d/messages=%d/payload=%d", cfg.Groups, cfg.MessagesPerGroup, cfg.PayloadSize), func(b *testing.B) {
+			logs, err := Generate(cfg)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			start, events := time.Now(), 0
+			for n := 0; n < b.N; n++ {
+				count, err := handleLogs(context.Background(), logs, zap.NewNop())
+				require.NoError(b, err)
+				events += count
+			}
+
+			b.ReportMetric(float64(events)/time.Since(start).Seconds(), "events/s")
+		})
+	}
+}
+
+func BenchmarkReplay(b *testing.B) {
+	for _, cfg := range benchmarkConfigs() {
+		cfg := cfg
+		b.Run(fmt.Sprintf("groups=%d/messages=%d/payload=%d", cfg.Groups, cfg.MessagesPerGroup, cfg.PayloadSize), func(b *testing.B) {
+			logs, err := Generate(cfg)
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			start, events := time.Now(), 0
+			for n := 0; n < b.N; n++ {
+				count, err := replayLogs(context.Background(), logs, zap.NewNop())
+				require.NoError(b, err)
+				events += count
+			}
+
+			b.ReportMetric(float64(events)/time.Since(start).Seconds(), "events/s")
+		})
+	}
+}
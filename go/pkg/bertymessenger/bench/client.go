@@ -0,0 +1,120 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// logsClient serves generated logs through the calls made by the messenger while handling and replaying events, the
+// other calls of the protocol are not implemented and panic
+type logsClient struct {
+	protocoltypes.ProtocolServiceClient
+
+	logs *Logs
+	// served is the number of events read from the lists
+	served uint64
+}
+
+// newLogsClient returns a protocol client serving the generated logs, the devices of the groups are not the one of
+// the account so the messages are never sent by the current device
+func newLogsClient(logs *Logs) *logsClient {
+	return &logsClient{logs: logs}
+}
+
+func (c *logsClient) InstanceGetConfiguration(context.Context, *protocoltypes.InstanceGetConfiguration_Request, ...grpc.CallOption) (*protocoltypes.InstanceGetConfiguration_Reply, error) {
+	return &protocoltypes.InstanceGetConfiguration_Reply{
+		AccountPK:      c.logs.AccountPK,
+		DevicePK:       c.logs.DevicePK,
+		AccountGroupPK: c.logs.AccountGroupPK,
+	}, nil
+}
+
+func (c *logsClient) GroupInfo(_ context.Context, req *protocoltypes.GroupInfo_Request, _ ...grpc.CallOption) (*protocoltypes.GroupInfo_Reply, error) {
+	return &protocoltypes.GroupInfo_Reply{
+		Group:    &protocoltypes.Group{PublicKey: req.GetGroupPK()},
+		MemberPK: c.logs.AccountPK,
+		DevicePK: c.logs.DevicePK,
+	}, nil
+}
+
+func (c *logsClient) ActivateGroup(context.Context, *protocoltypes.ActivateGroup_Request, ...grpc.CallOption) (*protocoltypes.ActivateGroup_Reply, error) {
+	return &protocoltypes.ActivateGroup_Reply{}, nil
+}
+
+func (c *logsClient) DeactivateGroup(context.Context, *protocoltypes.DeactivateGroup_Request, ...grpc.CallOption) (*protocoltypes.DeactivateGroup_Reply, error) {
+	return &protocoltypes.DeactivateGroup_Reply{}, nil
+}
+
+func (c *logsClient) GroupMetadataList(ctx context.Context, req *protocoltypes.GroupMetadataList_Request, _ ...grpc.CallOption) (protocoltypes.ProtocolService_GroupMetadataListClient, error) {
+	return &metadataListClient{ctx: ctx, client: c, events: c.logs.Metadata[string(req.GetGroupPK())]}, nil
+}
+
+// GroupMessageList lists the messages of a group, the most recent first, starting at req.UntilID when it is set
+func (c *logsClient) GroupMessageList(ctx context.Context, req *protocoltypes.GroupMessageList_Request, _ ...grpc.CallOption) (protocoltypes.ProtocolService_GroupMessageListClient, error) {
+	messages := c.logs.Messages[string(req.GetGroupPK())]
+
+	listed := []*protocoltypes.GroupMessageEvent(nil)
+	for idx := len(messages) - 1; idx >= 0; idx-- {
+		if req.GetUntilID() != nil && listed == nil && !bytes.Equal(messages[idx].GetEventContext().GetID(), req.GetUntilID()) {
+			continue
+		}
+
+		listed = append(listed, messages[idx])
+	}
+
+	return &messageListClient{ctx: ctx, client: c, events: listed}, nil
+}
+
+type metadataListClient struct {
+	grpc.ClientStream
+
+	ctx    context.Context
+	client *logsClient
+	events []*protocoltypes.GroupMetadataEvent
+}
+
+func (s *metadataListClient) Recv() (*protocoltypes.GroupMetadataEvent, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	atomic.AddUint64(&s.client.served, 1)
+
+	evt := s.events[0]
+	s.events = s.events[1:]
+	return evt, nil
+}
+
+type messageListClient struct {
+	grpc.ClientStream
+
+	ctx    context.Context
+	client *logsClient
+	events []*protocoltypes.GroupMessageEvent
+}
+
+func (s *messageListClient) Recv() (*protocoltypes.GroupMessageEvent, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	atomic.AddUint64(&s.client.served, 1)
+
+	evt := s.events[0]
+	s.events = s.events[1:]
+	return evt, nil
+}
@@ -0,0 +1,182 @@
+// Package bench generates synthetic protocol logs and measures how fast the messenger handles and replays them.
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/gogo/protobuf/proto"
+	ipfscid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// Config describes the volume of the generated logs
+type Config struct {
+	// Groups is the number of multi-member groups joined by the account
+	Groups int
+	// MembersPerGroup is the number of members with a single device added to each group, the account excluded
+	MembersPerGroup int
+	// MessagesPerGroup is the number of user messages sent to each group
+	MessagesPerGroup int
+	// PayloadSize is the size of the body of the user messages
+	PayloadSize int
+	// Seed makes the generated logs reproducible
+	Seed int64
+}
+
+func (c Config) validate() error {
+	if c.Groups < 1 || c.MembersPerGroup < 1 || c.MessagesPerGroup < 0 || c.PayloadSize < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("at least one group with one member is required and the volumes can't be negative"))
+	}
+
+	return nil
+}
+
+// Logs are the generated metadata and message logs of an account, indexed by the group public keys
+type Logs struct {
+	AccountGroupPK []byte
+	AccountPK      []byte
+	DevicePK       []byte
+	Metadata       map[string][]*protocoltypes.GroupMetadataEvent
+	Messages       map[string][]*protocoltypes.GroupMessageEvent
+	// Groups are the public keys of the groups in the order they are joined
+	Groups [][]byte
+}
+
+// MetadataEvents is the number of generated metadata events
+func (l *Logs) MetadataEvents() int {
+	count := 0
+	for _, events := range l.Metadata {
+		count += len(events)
+	}
+
+	return count
+}
+
+// MessageEvents is the number of generated message events
+func (l *Logs) MessageEvents() int {
+	count := 0
+	for _, events := range l.Messages {
+		count += len(events)
+	}
+
+	return count
+}
+
+type generator struct {
+	rand    *rand.Rand
+	counter uint64
+}
+
+func (g *generator) key() []byte {
+	k := make([]byte, 32)
+	g.rand.Read(k)
+	return k
+}
+
+func (g *generator) eventContext(groupPK []byte, lamport uint64) (*protocoltypes.EventContext, error) {
+	g.counter++
+
+	cid, err := ipfscid.Prefix{Version: 1, Codec: ipfscid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte(fmt.Sprintf("event_%d", g.counter)))
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return &protocoltypes.EventContext{ID: cid.Bytes(), GroupPK: groupPK, LamportTime: lamport}, nil
+}
+
+func (g *generator) metadataEvent(groupPK []byte, lamport uint64, et protocoltypes.EventType, event proto.Message) (*protocoltypes.GroupMetadataEvent, error) {
+	evtCtx, err := g.eventContext(groupPK, lamport)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := proto.Marshal(event)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return &protocoltypes.GroupMetadataEvent{
+		EventContext: evtCtx,
+		Metadata:     &protocoltypes.GroupMetadata{EventType: et},
+		Event:        payload,
+	}, nil
+}
+
+// Generate builds the logs of an account which joined cfg.Groups groups, the members of each group join it then send
+// their messages in turn
+func Generate(cfg Config) (*Logs, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	g := &generator{rand: rand.New(rand.NewSource(cfg.Seed))}
+	logs := &Logs{
+		AccountGroupPK: g.key(),
+		AccountPK:      g.key(),
+		DevicePK:       g.key(),
+		Metadata:       map[string][]*protocoltypes.GroupMetadataEvent{},
+		Messages:       map[string][]*protocoltypes.GroupMessageEvent{},
+	}
+
+	accountLamport := uint64(0)
+	for n := 0; n < cfg.Groups; n++ {
+		groupPK := g.key()
+		logs.Groups = append(logs.Groups, groupPK)
+
+		accountLamport++
+		joined, err := g.metadataEvent(logs.AccountGroupPK, accountLamport, protocoltypes.EventTypeAccountGroupJoined, &protocoltypes.AccountGroupJoined{
+			Group: &protocoltypes.Group{PublicKey: groupPK, GroupType: protocoltypes.GroupTypeMultiMember},
+		})
+		if err != nil {
+			return nil, err
+		}
+		logs.Metadata[string(logs.AccountGroupPK)] = append(logs.Metadata[string(logs.AccountGroupPK)], joined)
+
+		devices := make([][]byte, cfg.MembersPerGroup)
+		lamport := uint64(0)
+		for m := range devices {
+			devices[m] = g.key()
+
+			lamport++
+			added, err := g.metadataEvent(groupPK, lamport, protocoltypes.EventTypeGroupMemberDeviceAdded, &protocoltypes.GroupAddMemberDevice{
+				MemberPK: g.key(),
+				DevicePK: devices[m],
+			})
+			if err != nil {
+				return nil, err
+			}
+			logs.Metadata[string(groupPK)] = append(logs.Metadata[string(groupPK)], added)
+		}
+
+		for m := 0; m < cfg.MessagesPerGroup; m++ {
+			body := make([]byte, cfg.PayloadSize)
+			for idx := range body {
+				body[idx] = byte('a' + g.rand.Intn(26))
+			}
+
+			payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(int64(m+1), nil, &messengertypes.AppMessage_UserMessage{Body: string(body)})
+			if err != nil {
+				return nil, errcode.ErrSerialization.Wrap(err)
+			}
+
+			lamport++
+			evtCtx, err := g.eventContext(groupPK, lamport)
+			if err != nil {
+				return nil, err
+			}
+
+			logs.Messages[string(groupPK)] = append(logs.Messages[string(groupPK)], &protocoltypes.GroupMessageEvent{
+				EventContext: evtCtx,
+				Headers:      &protocoltypes.MessageHeaders{Counter: uint64(m), DevicePK: devices[m%len(devices)]},
+				Message:      payload,
+			})
+		}
+	}
+
+	return logs, nil
+}
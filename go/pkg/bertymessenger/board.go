@@ -0,0 +1,112 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	boardKeyMaxLength   = 64
+	boardValueMaxLength = 4096
+)
+
+// The board of a conversation is a map of last write wins registers: each update carries the clock of its group log
+// event and an entry keeps the update with the greatest clock, a deleted entry is kept as a tombstone. The updates are
+// sent as group metadata so the board is rebuilt from the logs on a replay.
+
+func validateBoardEntry(key, value string) error {
+	if key == "" {
+		return errcode.ErrMissingInput.Wrap(fmt.Errorf("a key is required"))
+	}
+
+	if len(key) > boardKeyMaxLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the key is longer than %d bytes", boardKeyMaxLength))
+	}
+
+	if len(value) > boardValueMaxLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the value is longer than %d bytes", boardValueMaxLength))
+	}
+
+	return nil
+}
+
+func (h *eventHandler) handleAppMessageBoardEntrySet(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_BoardEntrySet)
+	if err := validateBoardEntry(payload.GetKey(), payload.GetValue()); err != nil {
+		h.logger.Warn("ignoring invalid board entry", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	value := payload.GetValue()
+	if payload.GetDeleted() {
+		value = ""
+	}
+
+	entry, updated, err := tx.setBoardEntry(&messengertypes.BoardEntry{
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Key:                   payload.GetKey(),
+		Value:                 value,
+		Deleted:               payload.GetDeleted(),
+		AuthorMemberPublicKey: interactionSenderMemberPK(i),
+		UpdatedDate:           i.GetSentDate(),
+		Clock:                 interactionClock(i),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeBoardEntryUpdated, &messengertypes.StreamEvent_BoardEntryUpdated{Entry: entry}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (svc *service) BoardEntryList(ctx context.Context, req *messengertypes.BoardEntryList_Request) (*messengertypes.BoardEntryList_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	entries, err := svc.db.getBoardEntries(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BoardEntryList_Reply{Entries: entries}, nil
+}
+
+// BoardEntrySet sends the update of an entry to the group, it is applied when received back from the group
+func (svc *service) BoardEntrySet(ctx context.Context, req *messengertypes.BoardEntrySet_Request) (*messengertypes.BoardEntrySet_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := validateBoardEntry(req.GetKey(), req.GetValue()); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeBoardEntrySet, &messengertypes.AppMessage_BoardEntrySet{
+		Key:     req.GetKey(),
+		Value:   req.GetValue(),
+		Deleted: req.GetDelete(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BoardEntrySet_Reply{}, nil
+}
@@ -0,0 +1,97 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_validateBoardEntry(t *testing.T) {
+	require.NoError(t, validateBoardEntry("topic", "weekly sync"))
+	require.Error(t, validateBoardEntry("", "weekly sync"))
+	require.Error(t, validateBoardEntry(strings.Repeat("k", boardKeyMaxLength+1), ""))
+	require.Error(t, validateBoardEntry("topic", strings.Repeat("v", boardValueMaxLength+1)))
+}
+
+func Test_eventHandler_handleAppMessageBoardEntrySet(t *testing.T) {
+	updates := []struct {
+		lamport uint64
+		value   string
+		deleted bool
+	}{
+		{1, "first", false},
+		{2, "second", false},
+		{3, "", true},
+	}
+
+	// the board converges whatever the order of the updates, the deletion is the last one
+	for _, order := range [][]int{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}} {
+		db, dispose := getInMemoryTestDB(t)
+		h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+
+		set := func(lamport uint64, value string, deleted bool) {
+			_, _, err := h.handleAppMessageBoardEntrySet(db, &messengertypes.Interaction{
+				CID:                   fmt.Sprintf("cid_%d", lamport),
+				ConversationPublicKey: "conv_1",
+				MemberPublicKey:       "member_1",
+				LamportTime:           lamport,
+				SentDate:              int64(lamport),
+			}, &messengertypes.AppMessage_BoardEntrySet{Key: "topic", Value: value, Deleted: deleted})
+			require.NoError(t, err)
+		}
+
+		for _, idx := range order {
+			set(updates[idx].lamport, updates[idx].value, updates[idx].deleted)
+		}
+
+		entries, err := db.getBoardEntries("conv_1")
+		require.NoError(t, err)
+		require.Empty(t, entries)
+
+		// a more recent update brings the entry back
+		set(4, "fourth", false)
+		entries, err = db.getBoardEntries("conv_1")
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "fourth", entries[0].GetValue())
+		require.Equal(t, "member_1", entries[0].GetAuthorMemberPublicKey())
+
+		dispose()
+	}
+}
+
+func Test_dbWrapper_setBoardEntry(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, _, err := db.setBoardEntry(&messengertypes.BoardEntry{ConversationPublicKey: "conv_1"})
+	require.Error(t, err)
+
+	entry, updated, err := db.setBoardEntry(&messengertypes.BoardEntry{ConversationPublicKey: "conv_1", Key: "topic", Value: "new", Clock: testClock(2)})
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, "new", entry.GetValue())
+
+	// an older update returns the current entry
+	entry, updated, err = db.setBoardEntry(&messengertypes.BoardEntry{ConversationPublicKey: "conv_1", Key: "topic", Value: "old", Clock: testClock(1)})
+	require.NoError(t, err)
+	require.False(t, updated)
+	require.Equal(t, "new", entry.GetValue())
+
+	_, _, err = db.setBoardEntry(&messengertypes.BoardEntry{ConversationPublicKey: "conv_1", Key: "links", Value: "https://berty.tech", Clock: testClock(3)})
+	require.NoError(t, err)
+	_, _, err = db.setBoardEntry(&messengertypes.BoardEntry{ConversationPublicKey: "conv_2", Key: "topic", Value: "other", Clock: testClock(3)})
+	require.NoError(t, err)
+
+	entries, err := db.getBoardEntries("conv_1")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "links", entries[0].GetKey())
+	require.Equal(t, "topic", entries[1].GetKey())
+}
@@ -0,0 +1,298 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	botTokenSize         = 32
+	botWebhookIDSize     = 16
+	botWebhookSecretSize = 32
+	botWebhookTimeout    = 10 * time.Second
+	// botWebhookSignatureHeader is the hex encoded HMAC-SHA256 of the request body, keyed by the secret of the webhook
+	botWebhookSignatureHeader = "X-Berty-Signature"
+)
+
+// botWebhookEvent is the JSON body posted to the webhooks
+type botWebhookEvent struct {
+	WebhookID             string `json:"webhook_id"`
+	ConversationPublicKey string `json:"conversation_public_key"`
+	CID                   string `json:"cid"`
+	MemberPublicKey       string `json:"member_public_key,omitempty"`
+	SentDate              int64  `json:"sent_date"`
+	Body                  string `json:"body"`
+}
+
+func botTokenID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return b64EncodeBytes(hash[:])
+}
+
+func botTokenConversations(token *messengertypes.BotToken) []string {
+	return strings.Split(token.GetConversationPublicKeys(), "\n")
+}
+
+func isBotTokenConversation(token *messengertypes.BotToken, convPK string) bool {
+	for _, pk := range botTokenConversations(token) {
+		if pk != "" && pk == convPK {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBotWebhookMatching checks the filters of a webhook, the messages are only sent to the webhooks of the tokens
+// allowed to use their conversation
+func isBotWebhookMatching(token *messengertypes.BotToken, webhook *messengertypes.BotWebhook, convPK string, body string) bool {
+	if !isBotTokenConversation(token, convPK) {
+		return false
+	}
+
+	if webhook.GetConversationPublicKey() != "" && webhook.GetConversationPublicKey() != convPK {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(body), strings.ToLower(webhook.GetBodyContains()))
+}
+
+func signBotWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverBotWebhooks posts a new message to the matching webhooks once it is stored, the requests are sent in the
+// background and their failures are only logged
+func (svc *service) deliverBotWebhooks(db *dbWrapper, i *messengertypes.Interaction) error {
+	var message messengertypes.AppMessage_UserMessage
+	if err := proto.Unmarshal(i.GetPayload(), &message); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+	body := message.GetBody()
+
+	tokens, err := db.getBotTokens()
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		for _, webhook := range token.GetWebhooks() {
+			if !isBotWebhookMatching(token, webhook, i.GetConversationPublicKey(), body) {
+				continue
+			}
+
+			payload, err := json.Marshal(&botWebhookEvent{
+				WebhookID:             webhook.GetID(),
+				ConversationPublicKey: i.GetConversationPublicKey(),
+				CID:                   i.GetCID(),
+				MemberPublicKey:       i.GetMemberPublicKey(),
+				SentDate:              i.GetSentDate(),
+				Body:                  body,
+			})
+			if err != nil {
+				return errcode.ErrSerialization.Wrap(err)
+			}
+
+			go func(webhook *messengertypes.BotWebhook) {
+				if err := svc.postBotWebhook(svc.ctx, webhook, payload); err != nil {
+					svc.logger.Warn("unable to deliver webhook", zap.String("webhook-id", webhook.GetID()), zap.Error(err))
+				}
+			}(webhook)
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) postBotWebhook(ctx context.Context, webhook *messengertypes.BotWebhook, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, botWebhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.GetURL(), bytes.NewReader(payload))
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(botWebhookSignatureHeader, signBotWebhookBody(webhook.GetSecret(), payload))
+
+	res, err := svc.botHTTPClient.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errcode.ErrInternal.Wrap(fmt.Errorf("unexpected status %d", res.StatusCode))
+	}
+
+	return nil
+}
+
+func (svc *service) BotTokenCreate(ctx context.Context, req *messengertypes.BotTokenCreate_Request) (*messengertypes.BotTokenCreate_Reply, error) {
+	if req.GetName() == "" || len(req.GetConversationPublicKeys()) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	for _, pk := range req.GetConversationPublicKeys() {
+		if _, err := svc.db.getConversationByPK(pk); err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+	}
+
+	secret, err := cryptoutil.GenerateNonceSize(botTokenSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+	token := b64EncodeBytes(secret)
+
+	botToken := &messengertypes.BotToken{
+		ID:                     botTokenID(token),
+		Name:                   req.GetName(),
+		ConversationPublicKeys: strings.Join(req.GetConversationPublicKeys(), "\n"),
+		CreatedDate:            timestampMs(time.Now()),
+	}
+
+	if err := svc.db.addBotToken(botToken); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotTokenCreate_Reply{BotToken: botToken, Token: token}, nil
+}
+
+func (svc *service) BotTokenRevoke(ctx context.Context, req *messengertypes.BotTokenRevoke_Request) (*messengertypes.BotTokenRevoke_Reply, error) {
+	if req.GetTokenID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.deleteBotToken(req.GetTokenID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotTokenRevoke_Reply{}, nil
+}
+
+func (svc *service) BotTokenList(ctx context.Context, req *messengertypes.BotTokenList_Request) (*messengertypes.BotTokenList_Reply, error) {
+	tokens, err := svc.db.getBotTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotTokenList_Reply{BotTokens: tokens}, nil
+}
+
+func (svc *service) BotWebhookAdd(ctx context.Context, req *messengertypes.BotWebhookAdd_Request) (*messengertypes.BotWebhookAdd_Reply, error) {
+	if req.GetTokenID() == "" || req.GetURL() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	u, err := url.Parse(req.GetURL())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the webhook url must be an http or https url"))
+	}
+
+	defer svc.writer.enter()()
+
+	token, err := svc.db.getBotToken(req.GetTokenID())
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if req.GetConversationPublicKey() != "" && !isBotTokenConversation(token, req.GetConversationPublicKey()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation is not allowed for this token"))
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(botWebhookIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	secret, err := cryptoutil.GenerateNonceSize(botWebhookSecretSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	webhook := &messengertypes.BotWebhook{
+		ID:                    b64EncodeBytes(id),
+		TokenID:               token.GetID(),
+		URL:                   u.String(),
+		ConversationPublicKey: req.GetConversationPublicKey(),
+		BodyContains:          req.GetBodyContains(),
+		Secret:                b64EncodeBytes(secret),
+	}
+
+	if err := svc.db.addBotWebhook(webhook); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotWebhookAdd_Reply{Webhook: webhook}, nil
+}
+
+func (svc *service) BotWebhookRemove(ctx context.Context, req *messengertypes.BotWebhookRemove_Request) (*messengertypes.BotWebhookRemove_Reply, error) {
+	if req.GetWebhookID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.deleteBotWebhook(req.GetWebhookID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotWebhookRemove_Reply{}, nil
+}
+
+func (svc *service) BotSendMessage(ctx context.Context, req *messengertypes.BotSendMessage_Request) (*messengertypes.BotSendMessage_Reply, error) {
+	if req.GetToken() == "" || req.GetConversationPublicKey() == "" || req.GetBody() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	token, err := svc.db.getBotToken(botTokenID(req.GetToken()))
+	if err != nil {
+		// the unknown and the revoked tokens are not distinguished
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid bot token"))
+	}
+
+	if !isBotTokenConversation(token, req.GetConversationPublicKey()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation is not allowed for this token"))
+	}
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: req.GetBody()})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := svc.Interact(ctx, &messengertypes.Interact_Request{
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		Payload:               payload,
+		ConversationPublicKey: req.GetConversationPublicKey(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BotSendMessage_Reply{}, nil
+}
@@ -0,0 +1,127 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_isBotWebhookMatching(t *testing.T) {
+	token := &messengertypes.BotToken{ID: "token_1", ConversationPublicKeys: "conv_1\nconv_2"}
+
+	require.True(t, isBotTokenConversation(token, "conv_2"))
+	require.False(t, isBotTokenConversation(token, "conv_3"))
+	require.False(t, isBotTokenConversation(token, ""))
+
+	all := &messengertypes.BotWebhook{ID: "webhook_1", TokenID: "token_1"}
+	require.True(t, isBotWebhookMatching(token, all, "conv_1", "hello"))
+	require.True(t, isBotWebhookMatching(token, all, "conv_2", "hello"))
+	require.False(t, isBotWebhookMatching(token, all, "conv_3", "hello"))
+
+	filtered := &messengertypes.BotWebhook{ID: "webhook_2", TokenID: "token_1", ConversationPublicKey: "conv_1", BodyContains: "!Remind"}
+	require.True(t, isBotWebhookMatching(token, filtered, "conv_1", "!remind me tomorrow"))
+	require.False(t, isBotWebhookMatching(token, filtered, "conv_1", "hello"))
+	require.False(t, isBotWebhookMatching(token, filtered, "conv_2", "!remind me tomorrow"))
+}
+
+func Test_dbWrapper_botTokens(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.addBotToken(&messengertypes.BotToken{}))
+	require.Error(t, db.addBotWebhook(&messengertypes.BotWebhook{ID: "webhook_1"}))
+
+	require.NoError(t, db.addBotToken(&messengertypes.BotToken{ID: botTokenID("secret"), Name: "bot", ConversationPublicKeys: "conv_1", CreatedDate: 1}))
+	require.NoError(t, db.addBotToken(&messengertypes.BotToken{ID: "token_2", Name: "other", CreatedDate: 2}))
+	require.NoError(t, db.addBotWebhook(&messengertypes.BotWebhook{ID: "webhook_1", TokenID: botTokenID("secret"), URL: "http://localhost/1"}))
+	require.NoError(t, db.addBotWebhook(&messengertypes.BotWebhook{ID: "webhook_2", TokenID: botTokenID("secret"), URL: "http://localhost/2"}))
+	require.NoError(t, db.addBotWebhook(&messengertypes.BotWebhook{ID: "webhook_3", TokenID: "token_2", URL: "http://localhost/3"}))
+
+	token, err := db.getBotToken(botTokenID("secret"))
+	require.NoError(t, err)
+	require.Equal(t, "bot", token.GetName())
+	require.Len(t, token.GetWebhooks(), 2)
+
+	tokens, err := db.getBotTokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, "bot", tokens[0].GetName())
+
+	require.NoError(t, db.deleteBotWebhook("webhook_2"))
+	require.True(t, errcode.Is(db.deleteBotWebhook("webhook_2"), errcode.ErrNotFound))
+
+	// the webhooks are removed with their token
+	require.NoError(t, db.deleteBotToken(botTokenID("secret")))
+	require.True(t, errcode.Is(db.deleteBotToken(botTokenID("secret")), errcode.ErrNotFound))
+
+	webhooks := keepBotWebhooks(db.db, nil)
+	require.Len(t, webhooks, 1)
+	require.Equal(t, "webhook_3", webhooks[0].GetID())
+}
+
+func Test_service_postBotWebhook(t *testing.T) {
+	received := make(chan *botWebhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		if r.Header.Get(botWebhookSignatureHeader) != signBotWebhookBody("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		event := &botWebhookEvent{}
+		require.NoError(t, json.Unmarshal(body, event))
+		received <- event
+	}))
+	defer server.Close()
+
+	svc := &service{botHTTPClient: server.Client()}
+	payload, err := json.Marshal(&botWebhookEvent{WebhookID: "webhook_1", CID: "cid_1", Body: "hello"})
+	require.NoError(t, err)
+
+	require.NoError(t, svc.postBotWebhook(context.Background(), &messengertypes.BotWebhook{URL: server.URL, Secret: "secret"}, payload))
+	event := <-received
+	require.Equal(t, "cid_1", event.CID)
+	require.Equal(t, "hello", event.Body)
+
+	// wrong signature
+	require.Error(t, svc.postBotWebhook(context.Background(), &messengertypes.BotWebhook{URL: server.URL, Secret: "other"}, payload))
+}
+
+func Test_service_deliverBotWebhooks(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	received := make(chan *botWebhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &botWebhookEvent{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(event))
+		received <- event
+	}))
+	defer server.Close()
+
+	require.NoError(t, db.addBotToken(&messengertypes.BotToken{ID: "token_1", Name: "bot", ConversationPublicKeys: "conv_1", CreatedDate: 1}))
+	require.NoError(t, db.addBotWebhook(&messengertypes.BotWebhook{ID: "webhook_1", TokenID: "token_1", URL: server.URL, Secret: "secret"}))
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	svc := &service{ctx: context.Background(), logger: zap.NewNop(), botHTTPClient: server.Client()}
+	require.NoError(t, svc.deliverBotWebhooks(db, &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}))
+
+	event := <-received
+	require.Equal(t, "webhook_1", event.WebhookID)
+	require.Equal(t, "cid_1", event.CID)
+	require.Equal(t, "hello", event.Body)
+}
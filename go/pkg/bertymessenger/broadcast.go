@@ -0,0 +1,263 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// An audience is a list of contacts kept on this device. A message broadcast to an audience is sent as a user message
+// to the conversation of each contact, the copies are matched to their recipient by their hash until their event is
+// received, then by their cid to follow their acks.
+
+const audienceNameMaxLength = 64
+
+// validateAudience returns the name of an audience without the surrounding spaces and its contacts without duplicates
+func (svc *service) validateAudience(name string, contactPKs []string) (string, []string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("an audience name is required"))
+	}
+
+	if len(name) > audienceNameMaxLength {
+		return "", nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the audience name is longer than %d bytes", audienceNameMaxLength))
+	}
+
+	if len(contactPKs) > bulkOperationMaxCount {
+		return "", nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an audience has at most %d contacts", bulkOperationMaxCount))
+	}
+
+	seen := make(map[string]bool, len(contactPKs))
+	pks := []string(nil)
+	for _, pk := range contactPKs {
+		if seen[pk] {
+			continue
+		}
+		seen[pk] = true
+
+		if _, err := svc.db.getContactByPK(pk); err != nil {
+			return "", nil, errcode.ErrNotFound.Wrap(fmt.Errorf("unknown contact %s: %w", pk, err))
+		}
+
+		pks = append(pks, pk)
+	}
+
+	return name, pks, nil
+}
+
+func (svc *service) AudienceCreate(ctx context.Context, req *messengertypes.AudienceCreate_Request) (*messengertypes.AudienceCreate_Reply, error) {
+	id, err := cryptoutil.GenerateNonceSize(16)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	name, pks, err := svc.validateAudience(req.GetName(), req.GetContactPublicKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	audience := &messengertypes.Audience{
+		ID:          b64EncodeBytes(id),
+		Name:        name,
+		CreatedDate: timestampMs(time.Now()),
+	}
+	for _, pk := range pks {
+		audience.Members = append(audience.Members, &messengertypes.AudienceMember{ContactPublicKey: pk})
+	}
+
+	if err := svc.db.addAudience(audience); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AudienceCreate_Reply{Audience: audience}, nil
+}
+
+func (svc *service) AudienceUpdate(ctx context.Context, req *messengertypes.AudienceUpdate_Request) (*messengertypes.AudienceUpdate_Reply, error) {
+	if req.GetAudienceID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	name, pks, err := svc.validateAudience(req.GetName(), req.GetContactPublicKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	audience, err := svc.db.updateAudience(req.GetAudienceID(), name, pks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AudienceUpdate_Reply{Audience: audience}, nil
+}
+
+func (svc *service) AudienceDelete(ctx context.Context, req *messengertypes.AudienceDelete_Request) (*messengertypes.AudienceDelete_Reply, error) {
+	if req.GetAudienceID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.deleteAudience(req.GetAudienceID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AudienceDelete_Reply{}, nil
+}
+
+func (svc *service) AudienceList(ctx context.Context, req *messengertypes.AudienceList_Request) (*messengertypes.AudienceList_Reply, error) {
+	audiences, err := svc.db.getAudiences()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.AudienceList_Reply{Audiences: audiences}, nil
+}
+
+// broadcastRecipientConversation returns the conversation a broadcast is sent to for a contact
+func (svc *service) broadcastRecipientConversation(contactPK string) (string, error) {
+	contact, err := svc.db.getContactByPK(contactPK)
+	if err != nil {
+		return "", fmt.Errorf("unknown contact")
+	}
+
+	if contact.GetState() != messengertypes.Contact_Accepted || contact.GetConversationPublicKey() == "" {
+		return "", fmt.Errorf("the contact request hasn't been accepted")
+	}
+
+	conv, err := svc.db.getConversationByPK(contact.GetConversationPublicKey())
+	if err != nil {
+		return "", fmt.Errorf("unknown conversation")
+	}
+
+	if conv.GetIsPaused() {
+		return "", fmt.Errorf("the conversation is paused")
+	}
+
+	return conv.GetPublicKey(), nil
+}
+
+func (svc *service) BroadcastSend(ctx context.Context, req *messengertypes.BroadcastSend_Request) (*messengertypes.BroadcastSend_Reply, error) {
+	if req.GetAudienceID() == "" || req.GetBody() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(16)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	audience, err := svc.db.getAudience(req.GetAudienceID())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(audience.GetMembers()) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the audience has no contacts"))
+	}
+
+	// the copies are identical, each conversation has its own log
+	now := time.Now()
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(timestampMs(now), nil, &messengertypes.AppMessage_UserMessage{Body: req.GetBody()})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+	if payload, err = svc.packAppMessage(nil, payload); err != nil {
+		return nil, err
+	}
+	hash := processedEventHash(messengertypes.AppMessage_TypeUserMessage.String(), payload)
+
+	broadcast := &messengertypes.Broadcast{
+		ID:          b64EncodeBytes(id),
+		AudienceID:  audience.GetID(),
+		Body:        req.GetBody(),
+		CreatedDate: timestampMs(now),
+	}
+	for _, member := range audience.GetMembers() {
+		recipient := &messengertypes.BroadcastRecipient{ContactPublicKey: member.GetContactPublicKey(), MessageHash: hash}
+		if recipient.ConversationPublicKey, err = svc.broadcastRecipientConversation(member.GetContactPublicKey()); err != nil {
+			recipient.Status = messengertypes.BroadcastRecipient_StatusFailed
+			recipient.Error = err.Error()
+		}
+
+		broadcast.Recipients = append(broadcast.Recipients, recipient)
+	}
+
+	// the broadcast is stored first so the events of its copies find their recipient
+	if err := svc.db.addBroadcast(broadcast); err != nil {
+		return nil, err
+	}
+
+	for _, recipient := range broadcast.GetRecipients() {
+		if recipient.GetStatus() == messengertypes.BroadcastRecipient_StatusFailed {
+			continue
+		}
+
+		gpkb, err := b64DecodeBytes(recipient.GetConversationPublicKey())
+		if err == nil {
+			_, _, err = svc.sendWithLocalEcho(ctx, messengertypes.AppMessage_TypeUserMessage, "", 0, &protocoltypes.AppMessageSend_Request{GroupPK: gpkb, Payload: payload})
+		}
+
+		if err != nil {
+			svc.logger.Warn("unable to send broadcast copy", zap.String("broadcast-id", broadcast.GetID()), zap.String("contact-pk", recipient.GetContactPublicKey()), zap.Error(err))
+			if err := svc.db.setBroadcastRecipientFailed(broadcast.GetID(), recipient.GetContactPublicKey(), err.Error()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if broadcast, err = svc.db.getBroadcast(broadcast.GetID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BroadcastSend_Reply{Broadcast: broadcast}, nil
+}
+
+func (svc *service) BroadcastList(ctx context.Context, req *messengertypes.BroadcastList_Request) (*messengertypes.BroadcastList_Reply, error) {
+	broadcasts, err := svc.db.getBroadcasts(req.GetAudienceID())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.BroadcastList_Reply{Broadcasts: broadcasts}, nil
+}
+
+// reconcileBroadcastRecipient links a message sent by this account to the broadcast it is a copy of, it returns the id
+// of the broadcast if there is one
+func (h *eventHandler) reconcileBroadcastRecipient(tx *dbWrapper, i *messengertypes.Interaction, hash string) (string, error) {
+	if !i.GetIsMe() || i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return "", nil
+	}
+
+	return tx.markBroadcastRecipientSent(i.GetConversationPublicKey(), hash, i.GetCID())
+}
+
+// dispatchBroadcastUpdated streams the delivery status of a broadcast
+func (h *eventHandler) dispatchBroadcastUpdated(db *dbWrapper, id string) {
+	if id == "" || h.svc == nil {
+		return
+	}
+
+	broadcast, err := db.getBroadcast(id)
+	if err != nil {
+		h.logger.Error("unable to get broadcast", zap.String("id", id), zap.Error(err))
+		return
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeBroadcastUpdated, &messengertypes.StreamEvent_BroadcastUpdated{Broadcast: broadcast}, false); err != nil {
+		h.logger.Error("unable to dispatch broadcast update", zap.String("id", id), zap.Error(err))
+	}
+}
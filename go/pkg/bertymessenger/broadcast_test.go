@@ -0,0 +1,105 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_Audience(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	ctx := context.Background()
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "contact_1", State: messengertypes.Contact_Accepted}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "contact_2", State: messengertypes.Contact_OutgoingRequestSent}).Error)
+
+	_, err := svc.AudienceCreate(ctx, &messengertypes.AudienceCreate_Request{Name: "  "})
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+
+	_, err = svc.AudienceCreate(ctx, &messengertypes.AudienceCreate_Request{Name: "friends", ContactPublicKeys: []string{"contact_3"}})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	created, err := svc.AudienceCreate(ctx, &messengertypes.AudienceCreate_Request{Name: " close friends ", ContactPublicKeys: []string{"contact_1", "contact_1", "contact_2"}})
+	require.NoError(t, err)
+	require.Equal(t, "close friends", created.GetAudience().GetName())
+	require.Len(t, created.GetAudience().GetMembers(), 2)
+
+	updated, err := svc.AudienceUpdate(ctx, &messengertypes.AudienceUpdate_Request{AudienceID: created.GetAudience().GetID(), Name: "friends", ContactPublicKeys: []string{"contact_2"}})
+	require.NoError(t, err)
+	require.Equal(t, "friends", updated.GetAudience().GetName())
+	require.Len(t, updated.GetAudience().GetMembers(), 1)
+	require.Equal(t, "contact_2", updated.GetAudience().GetMembers()[0].GetContactPublicKey())
+
+	// the copy for a contact without an accepted request fails without being sent
+	sent, err := svc.BroadcastSend(ctx, &messengertypes.BroadcastSend_Request{AudienceID: created.GetAudience().GetID(), Body: "hello"})
+	require.NoError(t, err)
+	require.Len(t, sent.GetBroadcast().GetRecipients(), 1)
+	require.Equal(t, messengertypes.BroadcastRecipient_StatusFailed, sent.GetBroadcast().GetRecipients()[0].GetStatus())
+	require.NotEmpty(t, sent.GetBroadcast().GetRecipients()[0].GetError())
+
+	require.NoError(t, db.deleteAudience(created.GetAudience().GetID()))
+	require.True(t, errcode.Is(db.deleteAudience(created.GetAudience().GetID()), errcode.ErrNotFound))
+
+	list, err := svc.AudienceList(ctx, &messengertypes.AudienceList_Request{})
+	require.NoError(t, err)
+	require.Empty(t, list.GetAudiences())
+
+	// the broadcasts of a deleted audience are kept
+	broadcasts, err := svc.BroadcastList(ctx, &messengertypes.BroadcastList_Request{AudienceID: created.GetAudience().GetID()})
+	require.NoError(t, err)
+	require.Len(t, broadcasts.GetBroadcasts(), 1)
+}
+
+func Test_dbWrapper_markBroadcastRecipient(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addBroadcast(&messengertypes.Broadcast{
+		ID:         "broadcast_1",
+		AudienceID: "audience_1",
+		Body:       "hello",
+		Recipients: []*messengertypes.BroadcastRecipient{
+			{ContactPublicKey: "contact_1", ConversationPublicKey: "conv_1", MessageHash: "hash_1"},
+			{ContactPublicKey: "contact_2", ConversationPublicKey: "conv_2", MessageHash: "hash_1"},
+		},
+	}))
+
+	// an ack received before its message is found in the backlog
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "ack_1", Type: messengertypes.AppMessage_TypeAcknowledge, TargetCID: "cid_2", ConversationPublicKey: "conv_2"}).Error)
+
+	id, err := db.markBroadcastRecipientSent("conv_1", "hash_1", "cid_1")
+	require.NoError(t, err)
+	require.Equal(t, "broadcast_1", id)
+
+	id, err = db.markBroadcastRecipientSent("conv_2", "hash_1", "cid_2")
+	require.NoError(t, err)
+	require.Equal(t, "broadcast_1", id)
+
+	id, err = db.markBroadcastRecipientSent("conv_3", "hash_1", "cid_3")
+	require.NoError(t, err)
+	require.Empty(t, id)
+
+	id, err = db.markBroadcastRecipientAcknowledged("cid_1")
+	require.NoError(t, err)
+	require.Equal(t, "broadcast_1", id)
+
+	id, err = db.markBroadcastRecipientAcknowledged("cid_1")
+	require.NoError(t, err)
+	require.Empty(t, id)
+
+	broadcast, err := db.getBroadcast("broadcast_1")
+	require.NoError(t, err)
+	require.Len(t, broadcast.GetRecipients(), 2)
+	for _, recipient := range broadcast.GetRecipients() {
+		require.Equal(t, messengertypes.BroadcastRecipient_StatusAcknowledged, recipient.GetStatus())
+		require.NotEmpty(t, recipient.GetCID())
+	}
+}
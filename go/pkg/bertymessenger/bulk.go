@@ -0,0 +1,68 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// bulkOperationMaxCount is the maximum number of interactions handled by a single bulk operation
+const bulkOperationMaxCount = 500
+
+func (svc *service) ConversationMarkAllRead(ctx context.Context, req *messengertypes.ConversationMarkAllRead_Request) (*messengertypes.ConversationMarkAllRead_Reply, error) {
+	defer svc.writer.enter()()
+
+	updated, err := svc.db.markAllConversationsRead()
+	if err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if len(updated) > 0 {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeBatchUpdated, &messengertypes.StreamEvent_BatchUpdated{Conversations: updated}, false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, conv := range updated {
+		svc.syncConversation(ctx, conv)
+	}
+
+	return &messengertypes.ConversationMarkAllRead_Reply{Conversations: updated}, nil
+}
+
+func (svc *service) InteractionDeleteMultiple(_ context.Context, req *messengertypes.InteractionDeleteMultiple_Request) (*messengertypes.InteractionDeleteMultiple_Reply, error) {
+	if len(req.GetCIDs()) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if len(req.GetCIDs()) > bulkOperationMaxCount {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d interactions can be deleted at once", bulkOperationMaxCount))
+	}
+
+	defer svc.writer.enter()()
+
+	deleted := []string(nil)
+	if err := svc.db.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", req.GetCIDs()).Pluck("cid", &deleted).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(deleted) == 0 {
+			return nil
+		}
+
+		return tx.deleteInteractions(deleted)
+	}); err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if len(deleted) > 0 {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeBatchUpdated, &messengertypes.StreamEvent_BatchUpdated{DeletedInteractionCIDs: deleted}, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return &messengertypes.InteractionDeleteMultiple_Reply{DeletedCount: int64(len(deleted))}, nil
+}
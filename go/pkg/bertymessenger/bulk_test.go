@@ -0,0 +1,66 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_markAllConversationsRead(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for i, unreadCount := range []int32{2, 0, 1} {
+		pk := fmt.Sprintf("conv_%d", i)
+		require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: pk, UnreadCount: unreadCount}).Error)
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: fmt.Sprintf("cid_%d", i), ConversationPublicKey: pk, Type: messengertypes.AppMessage_TypeUserMessage, SentDate: int64(i+1) * 1000}).Error)
+	}
+
+	updated, err := db.markAllConversationsRead()
+	require.NoError(t, err)
+	require.Len(t, updated, 2)
+
+	for _, pk := range []string{"conv_0", "conv_2"} {
+		conv, err := db.getConversationByPK(pk)
+		require.NoError(t, err)
+		require.Equal(t, int32(0), conv.GetUnreadCount())
+		require.NotZero(t, conv.GetReadUntil())
+	}
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Zero(t, conv.GetReadUntil())
+
+	updated, err = db.markAllConversationsRead()
+	require.NoError(t, err)
+	require.Empty(t, updated)
+}
+
+func Test_service_InteractionDeleteMultiple(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	_, err := svc.InteractionDeleteMultiple(context.Background(), &messengertypes.InteractionDeleteMultiple_Request{})
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: fmt.Sprintf("cid_%d", i), ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage}).Error)
+	}
+
+	// the unknown cids are ignored
+	reply, err := svc.InteractionDeleteMultiple(context.Background(), &messengertypes.InteractionDeleteMultiple_Request{CIDs: []string{"cid_0", "cid_2", "cid_unknown"}})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), reply.GetDeletedCount())
+
+	remaining := []string(nil)
+	require.NoError(t, db.db.Model(&messengertypes.Interaction{}).Pluck("cid", &remaining).Error)
+	require.Equal(t, []string{"cid_1"}, remaining)
+}
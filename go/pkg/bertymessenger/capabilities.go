@@ -0,0 +1,91 @@
+package bertymessenger
+
+import (
+	"context"
+	"sort"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// messengerAPIVersion is increased when the API changes in a way the clients must know about
+const messengerAPIVersion = 1
+
+// localAppMessageTypesStart is the first of the types which are only used locally and never sent on the network
+const localAppMessageTypesStart = messengertypes.AppMessage_TypeMonitorMetadata
+
+// featureAppMessageTypes are the types a feature relies on, a feature is advertised when they are all handled
+var featureAppMessageTypes = map[messengertypes.ServiceCapabilities_Feature][]messengertypes.AppMessage_Type{
+	messengertypes.ServiceCapabilities_FeatureReactions:      {messengertypes.AppMessage_TypeUserReaction},
+	messengertypes.ServiceCapabilities_FeatureReplies:        {messengertypes.AppMessage_TypeUserMessage},
+	messengertypes.ServiceCapabilities_FeatureMediaChunking:  {messengertypes.AppMessage_TypeChunk},
+	messengertypes.ServiceCapabilities_FeatureFormatting:     {messengertypes.AppMessage_TypeUserMessage},
+	messengertypes.ServiceCapabilities_FeatureExtensions:     {},
+	messengertypes.ServiceCapabilities_FeaturePolls:          {messengertypes.AppMessage_TypePollCreate, messengertypes.AppMessage_TypePollVote, messengertypes.AppMessage_TypePollClose},
+	messengertypes.ServiceCapabilities_FeatureLocations:      {messengertypes.AppMessage_TypeLocation},
+	messengertypes.ServiceCapabilities_FeatureHistorySharing: {messengertypes.AppMessage_TypeHistoryBundle},
+	messengertypes.ServiceCapabilities_FeatureModeration:     {messengertypes.AppMessage_TypeSetMemberRole, messengertypes.AppMessage_TypeRemoveMember},
+	messengertypes.ServiceCapabilities_FeatureGroupRetention: {messengertypes.AppMessage_TypeSetConversationRetention},
+}
+
+// handledAppMessageTypes returns the types sent on the network which have a handler, ordered by type
+func (h *eventHandler) handledAppMessageTypes() []messengertypes.AppMessage_Type {
+	types := []messengertypes.AppMessage_Type(nil)
+	for t := range h.appMessageHandlers {
+		if t != messengertypes.AppMessage_Undefined && t < localAppMessageTypesStart {
+			types = append(types, t)
+		}
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return types
+}
+
+// supportedFeatures returns the features whose types are all handled, ordered by feature
+func supportedFeatures(handled []messengertypes.AppMessage_Type) []messengertypes.ServiceCapabilities_Feature {
+	handledSet := make(map[messengertypes.AppMessage_Type]bool, len(handled))
+	for _, t := range handled {
+		handledSet[t] = true
+	}
+
+	features := []messengertypes.ServiceCapabilities_Feature(nil)
+	for feature, types := range featureAppMessageTypes {
+		supported := true
+		for _, t := range types {
+			supported = supported && handledSet[t]
+		}
+
+		if supported {
+			features = append(features, feature)
+		}
+	}
+
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+
+	return features
+}
+
+func (svc *service) ServiceCapabilities(context.Context, *messengertypes.ServiceCapabilities_Request) (*messengertypes.ServiceCapabilities_Reply, error) {
+	handled := svc.eventHandler.handledAppMessageTypes()
+
+	rep := &messengertypes.ServiceCapabilities_Reply{
+		APIVersion:    messengerAPIVersion,
+		SchemaVersion: latestDBMigrationVersion(dbMigrations),
+		Features:      supportedFeatures(handled),
+		Limits: &messengertypes.ServiceCapabilities_Limits{
+			MaxExtensionsCount:    messengertypes.MaxExtensionsCount,
+			MaxExtensionKeySize:   messengertypes.MaxExtensionKeySize,
+			MaxExtensionsSize:     messengertypes.MaxExtensionsSize,
+			MaxFormattingEntities: messengertypes.MaxFormattingEntities,
+		},
+	}
+
+	for _, t := range handled {
+		rep.AppMessageTypes = append(rep.AppMessageTypes, &messengertypes.ServiceCapabilities_AppMessageType{
+			Type:           t,
+			PayloadVersion: t.PayloadVersion(),
+		})
+	}
+
+	return rep, nil
+}
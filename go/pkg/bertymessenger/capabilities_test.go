@@ -0,0 +1,48 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_ServiceCapabilities(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	ctx := context.Background()
+	svc := &service{db: db, logger: zap.NewNop(), eventHandler: newEventHandler(ctx, db, nil, zap.NewNop(), nil, false)}
+
+	rep, err := svc.ServiceCapabilities(ctx, &messengertypes.ServiceCapabilities_Request{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(messengerAPIVersion), rep.APIVersion)
+	require.Equal(t, latestDBMigrationVersion(dbMigrations), rep.SchemaVersion)
+	require.Equal(t, int32(messengertypes.MaxExtensionsCount), rep.Limits.MaxExtensionsCount)
+
+	types := map[messengertypes.AppMessage_Type]bool{}
+	for idx, typ := range rep.AppMessageTypes {
+		if idx > 0 {
+			require.Less(t, int32(rep.AppMessageTypes[idx-1].Type), int32(typ.Type))
+		}
+		types[typ.Type] = true
+	}
+	require.True(t, types[messengertypes.AppMessage_TypeUserMessage])
+	require.True(t, types[messengertypes.AppMessage_TypeChunk])
+	// the local types are never sent on the network
+	require.False(t, types[messengertypes.AppMessage_TypeSystemEvent])
+
+	require.Contains(t, rep.Features, messengertypes.ServiceCapabilities_FeatureReactions)
+	require.Contains(t, rep.Features, messengertypes.ServiceCapabilities_FeatureMediaChunking)
+}
+
+func Test_supportedFeatures(t *testing.T) {
+	features := supportedFeatures([]messengertypes.AppMessage_Type{messengertypes.AppMessage_TypePollCreate, messengertypes.AppMessage_TypeLocation})
+	require.Equal(t, []messengertypes.ServiceCapabilities_Feature{
+		messengertypes.ServiceCapabilities_FeatureExtensions,
+		messengertypes.ServiceCapabilities_FeatureLocations,
+	}, features)
+}
@@ -0,0 +1,239 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ipfscid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// defaultAppMessageMaxSize stays below the size limit of the pubsub messages, which also carry the envelope
+	defaultAppMessageMaxSize = 512 * 1024
+	// appMessageMinSize bounds the configured size so the chunks carry enough data
+	appMessageMinSize = 1024
+	// appMessageChunkOverhead is the size reserved in a chunk for its fields
+	appMessageChunkOverhead = 128
+	// appMessageMaxChunks bounds the number of chunks of a message, on both sides
+	appMessageMaxChunks = 64
+	// appMessageChunkMaxAge is the delay after which the chunks of an incomplete message are dropped
+	appMessageChunkMaxAge = 30 * 24 * time.Hour
+)
+
+// The app messages larger than the configured size are split in chunks, each one is sent as an app message of the
+// log. The receivers store the chunks of a device until they have all of them, whatever their order, the message is
+// then checked and handled as if it were received at once. Its cid is computed from its content, so it is the same on
+// all the devices and on each replay.
+
+// splitAppMessage returns the payloads to send for an app message, the message itself when it is not too large
+func splitAppMessage(payload []byte, maxSize int) ([][]byte, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAppMessageMaxSize
+	}
+
+	if len(payload) <= maxSize {
+		return [][]byte{payload}, nil
+	}
+
+	dataSize := maxSize - appMessageChunkOverhead
+	count := (len(payload) + dataSize - 1) / dataSize
+	if count > appMessageMaxChunks {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("message too large, %d bytes for at most %d", len(payload), appMessageMaxChunks*dataSize))
+	}
+
+	checksum := sha256.Sum256(payload)
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		end := (i + 1) * dataSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunk, err := messengertypes.AppMessage_TypeChunk.MarshalPayload(0, nil, &messengertypes.AppMessage_Chunk{
+			Checksum: checksum[:],
+			Index:    uint32(i),
+			Count:    uint32(count),
+			Data:     payload[i*dataSize : end],
+		})
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		chunks[i] = chunk
+	}
+
+	return chunks, nil
+}
+
+// sendAppMessage sends an app message on the message log of a group, in chunks when it is too large, the attachments
+// are announced with the first chunk. Nothing is sent to the groups observed by the account
+func (svc *service) sendAppMessage(ctx context.Context, req *protocoltypes.AppMessageSend_Request) error {
+	if err := svc.ensureConversationPostable(req.GetGroupPK()); err != nil {
+		return err
+	}
+
+	payload, err := svc.packAppMessage(req.GetGroupPK(), req.GetPayload())
+	if err != nil {
+		return err
+	}
+	req.Payload = payload
+
+	chunks, err := splitAppMessage(req.GetPayload(), svc.appMessageMaxSize)
+	if err != nil {
+		return err
+	}
+
+	if len(chunks) == 1 {
+		_, err := svc.protocolClient.AppMessageSend(ctx, req)
+		return err
+	}
+
+	svc.logger.Debug("sending app message in chunks", zap.Int("size", len(req.GetPayload())), zap.Int("chunks", len(chunks)))
+
+	for i, chunk := range chunks {
+		chunkReq := &protocoltypes.AppMessageSend_Request{GroupPK: req.GetGroupPK(), Payload: chunk}
+		if i == 0 {
+			chunkReq.AttachmentCIDs = req.GetAttachmentCIDs()
+		}
+
+		if _, err := svc.protocolClient.AppMessageSend(ctx, chunkReq); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkAppMessageChunk(chunk *messengertypes.AppMessage_Chunk) error {
+	switch {
+	case len(chunk.GetChecksum()) != sha256.Size:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid chunk checksum"))
+	case chunk.GetCount() < 2 || chunk.GetCount() > appMessageMaxChunks:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid chunk count %d", chunk.GetCount()))
+	case chunk.GetIndex() >= chunk.GetCount():
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid chunk index %d of %d", chunk.GetIndex(), chunk.GetCount()))
+	}
+
+	return nil
+}
+
+// assembleAppMessageChunks returns the message of the chunks once they are all received, nil until then
+func assembleAppMessageChunks(checksum []byte, count uint32, chunks []*messengertypes.AppMessageChunk) ([]byte, error) {
+	parts := make([][]byte, count)
+	received := uint32(0)
+	for _, chunk := range chunks {
+		if chunk.GetChunkCount() != count || chunk.GetChunkIndex() >= count || parts[chunk.GetChunkIndex()] != nil {
+			continue
+		}
+
+		parts[chunk.GetChunkIndex()] = chunk.GetData()
+		received++
+	}
+
+	if received < count {
+		return nil, nil
+	}
+
+	message := bytes.Join(parts, nil)
+	if sum := sha256.Sum256(message); !bytes.Equal(sum[:], checksum) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the checksum of the chunked message does not match"))
+	}
+
+	return message, nil
+}
+
+// handleAppMessageChunk stores a chunk and handles its message when it is the last one received
+func (h *eventHandler) handleAppMessageChunk(gpk string, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage, cid, hash string) error {
+	payload, err := am.UnmarshalPayload()
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	chunk := payload.(*messengertypes.AppMessage_Chunk)
+	if err := checkAppMessageChunk(chunk); err != nil {
+		return err
+	}
+
+	checksum := hex.EncodeToString(chunk.GetChecksum())
+	dpk := b64EncodeBytes(gme.GetHeaders().GetDevicePK())
+
+	var message []byte
+	if err := h.db.tx(func(tx *dbWrapper) error {
+		now := timestampMs(time.Now())
+		if _, err := tx.addAppMessageChunk(&messengertypes.AppMessageChunk{
+			Checksum:              checksum,
+			DevicePublicKey:       dpk,
+			ChunkIndex:            chunk.GetIndex(),
+			ChunkCount:            chunk.GetCount(),
+			Data:                  chunk.GetData(),
+			ConversationPublicKey: gpk,
+			ReceivedDate:          now,
+		}); err != nil {
+			return err
+		}
+
+		chunks, err := tx.getAppMessageChunks(checksum, dpk)
+		if err != nil {
+			return err
+		}
+
+		// the chunks of an invalid message are dropped, the device sent inconsistent chunks
+		message, err = assembleAppMessageChunks(chunk.GetChecksum(), chunk.GetCount(), chunks)
+		if err != nil {
+			h.logger.Warn("dropping chunked message", zap.String("device-pk", dpk), zap.String("checksum", checksum), zap.Error(err))
+		}
+
+		if message != nil || err != nil {
+			if err := tx.deleteAppMessageChunks(checksum, dpk); err != nil {
+				return err
+			}
+		}
+
+		if cid == "" {
+			return nil
+		}
+
+		return tx.markEventProcessed(cid, gpk, hash, now)
+	}); err != nil {
+		return err
+	}
+
+	if message == nil {
+		return nil
+	}
+
+	var assembled messengertypes.AppMessage
+	if err := proto.Unmarshal(message, &assembled); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if assembled.GetType() == messengertypes.AppMessage_TypeChunk {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a chunked message can't be a chunk"))
+	}
+
+	messageCID, err := ipfscid.Prefix{Version: 1, Codec: ipfscid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum(message)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	// the message takes the context of its last chunk with its own cid, and the headers of the device which sent it
+	evtContext := *gme.GetEventContext()
+	evtContext.ID = messageCID.Bytes()
+
+	return h.handleAppMessage(gpk, &protocoltypes.GroupMessageEvent{
+		EventContext: &evtContext,
+		Headers:      gme.GetHeaders(),
+		Message:      message,
+	}, &assembled)
+}
@@ -0,0 +1,119 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testChunkRecords(t *testing.T, payloads [][]byte) ([]*messengertypes.AppMessageChunk, *messengertypes.AppMessage_Chunk) {
+	t.Helper()
+
+	records := []*messengertypes.AppMessageChunk(nil)
+	var last *messengertypes.AppMessage_Chunk
+	for _, payload := range payloads {
+		am := &messengertypes.AppMessage{}
+		require.NoError(t, proto.Unmarshal(payload, am))
+		require.Equal(t, messengertypes.AppMessage_TypeChunk, am.GetType())
+
+		p, err := am.UnmarshalPayload()
+		require.NoError(t, err)
+
+		last = p.(*messengertypes.AppMessage_Chunk)
+		require.NoError(t, checkAppMessageChunk(last))
+		records = append(records, &messengertypes.AppMessageChunk{ChunkIndex: last.GetIndex(), ChunkCount: last.GetCount(), Data: last.GetData()})
+	}
+
+	return records, last
+}
+
+func Test_splitAppMessage(t *testing.T) {
+	small := bytes.Repeat([]byte{1}, appMessageMinSize)
+	payloads, err := splitAppMessage(small, appMessageMinSize)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{small}, payloads)
+
+	message := make([]byte, 5*appMessageMinSize)
+	for i := range message {
+		message[i] = byte(i)
+	}
+
+	payloads, err = splitAppMessage(message, appMessageMinSize)
+	require.NoError(t, err)
+	require.Len(t, payloads, 6)
+	for _, payload := range payloads {
+		require.True(t, len(payload) <= appMessageMinSize)
+	}
+
+	// the chunks are assembled whatever their order, once they are all received
+	records, chunk := testChunkRecords(t, payloads)
+	records[0], records[4] = records[4], records[0]
+
+	assembled, err := assembleAppMessageChunks(chunk.GetChecksum(), chunk.GetCount(), records[:5])
+	require.NoError(t, err)
+	require.Nil(t, assembled)
+
+	assembled, err = assembleAppMessageChunks(chunk.GetChecksum(), chunk.GetCount(), records)
+	require.NoError(t, err)
+	require.Equal(t, message, assembled)
+
+	// a corrupted chunk is detected
+	records[2].Data = append([]byte(nil), records[2].Data...)
+	records[2].Data[0]++
+	_, err = assembleAppMessageChunks(chunk.GetChecksum(), chunk.GetCount(), records)
+	require.Error(t, err)
+
+	_, err = splitAppMessage(make([]byte, appMessageMaxChunks*appMessageMinSize), appMessageMinSize)
+	require.Error(t, err)
+}
+
+func Test_checkAppMessageChunk(t *testing.T) {
+	checksum := make([]byte, 32)
+
+	require.NoError(t, checkAppMessageChunk(&messengertypes.AppMessage_Chunk{Checksum: checksum, Index: 1, Count: 2}))
+	require.Error(t, checkAppMessageChunk(&messengertypes.AppMessage_Chunk{Checksum: checksum[:4], Index: 1, Count: 2}))
+	require.Error(t, checkAppMessageChunk(&messengertypes.AppMessage_Chunk{Checksum: checksum, Index: 2, Count: 2}))
+	require.Error(t, checkAppMessageChunk(&messengertypes.AppMessage_Chunk{Checksum: checksum, Count: 1}))
+	require.Error(t, checkAppMessageChunk(&messengertypes.AppMessage_Chunk{Checksum: checksum, Count: appMessageMaxChunks + 1}))
+}
+
+func Test_dbWrapper_addAppMessageChunk(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.addAppMessageChunk(&messengertypes.AppMessageChunk{Checksum: "sum_1"})
+	require.Error(t, err)
+
+	for _, chunk := range []*messengertypes.AppMessageChunk{
+		{Checksum: "sum_1", DevicePublicKey: "device_1", ChunkIndex: 1, ReceivedDate: 2000},
+		{Checksum: "sum_1", DevicePublicKey: "device_1", ChunkIndex: 0, ReceivedDate: 3000},
+		{Checksum: "sum_1", DevicePublicKey: "device_2", ChunkIndex: 0, ReceivedDate: 1000},
+	} {
+		added, err := db.addAppMessageChunk(chunk)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+
+	added, err := db.addAppMessageChunk(&messengertypes.AppMessageChunk{Checksum: "sum_1", DevicePublicKey: "device_1", ChunkIndex: 1})
+	require.NoError(t, err)
+	require.False(t, added)
+
+	// the chunks of the other devices are kept apart
+	chunks, err := db.getAppMessageChunks("sum_1", "device_1")
+	require.NoError(t, err)
+	require.Len(t, chunks, 2)
+	require.Equal(t, uint32(0), chunks[0].GetChunkIndex())
+
+	count, err := db.deleteStaleAppMessageChunks(1500)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	require.NoError(t, db.deleteAppMessageChunks("sum_1", "device_1"))
+	chunks, err = db.getAppMessageChunks("sum_1", "device_1")
+	require.NoError(t, err)
+	require.Empty(t, chunks)
+}
@@ -0,0 +1,227 @@
+package bertymessenger
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// commandQueue is the single writer of the database, the commands of the api, of the event loops and of the replays are
+// queued and granted the database one at a time in the order they were queued. A command runs on the goroutine which
+// queued it while the writer loop waits for its end, so it can return its results as usual.
+//
+// The commands are queued in lanes, a command of the bulk lane is only granted when no interactive command waits so the
+// messages surfaced to the user aren't delayed by the acks and the reactions of a backlog. The events of a group are
+// handled one after the other by its subscription, the lanes only reorder the events of different groups
+type commandQueue struct {
+	lanes  [commandLanesCount]chan *queuedCommand
+	closed chan struct{}
+	once   sync.Once
+
+	// depth and laneDepths are accessed atomically
+	depth      int64
+	laneDepths [commandLanesCount]int64
+
+	mu        sync.Mutex
+	stats     commandQueueStats
+	laneStats [commandLanesCount]commandLaneStats
+}
+
+// commandLane is the priority of a command
+type commandLane int
+
+const (
+	// commandLaneInteractive is the lane of the api and of the events rendered to the user
+	commandLaneInteractive commandLane = iota
+	// commandLaneBulk is the lane of the events updating what is already rendered
+	commandLaneBulk
+
+	commandLanesCount
+)
+
+var commandLaneNames = [commandLanesCount]string{
+	commandLaneInteractive: "interactive",
+	commandLaneBulk:        "bulk",
+}
+
+// bulkAppMessageTypes are the app messages handled in the bulk lane
+var bulkAppMessageTypes = map[messengertypes.AppMessage_Type]bool{
+	messengertypes.AppMessage_TypeAcknowledge:  true,
+	messengertypes.AppMessage_TypeUserReaction: true,
+	messengertypes.AppMessage_TypePresence:     true,
+	messengertypes.AppMessage_TypePollVote:     true,
+}
+
+// appMessageCommandLane returns the lane in which an app message received is handled
+func appMessageCommandLane(t messengertypes.AppMessage_Type) commandLane {
+	if bulkAppMessageTypes[t] {
+		return commandLaneBulk
+	}
+
+	return commandLaneInteractive
+}
+
+type queuedCommand struct {
+	lane     commandLane
+	queuedAt time.Time
+	granted  chan struct{}
+	done     chan struct{}
+}
+
+type commandQueueStats struct {
+	processed                      int64
+	totalWaiting, maxWaiting       time.Duration
+	totalProcessing, maxProcessing time.Duration
+}
+
+type commandLaneStats struct {
+	processed  int64
+	maxWaiting time.Duration
+}
+
+func newCommandQueue() *commandQueue {
+	q := &commandQueue{
+		closed: make(chan struct{}),
+	}
+	for i := range q.lanes {
+		q.lanes[i] = make(chan *queuedCommand)
+	}
+
+	go q.loop()
+
+	return q
+}
+
+func (q *commandQueue) loop() {
+	for {
+		var cmd *queuedCommand
+
+		// a waiting interactive command goes first
+		select {
+		case cmd = <-q.lanes[commandLaneInteractive]:
+		default:
+			select {
+			case <-q.closed:
+				return
+			case cmd = <-q.lanes[commandLaneInteractive]:
+			case cmd = <-q.lanes[commandLaneBulk]:
+			}
+		}
+
+		grantedAt := time.Now()
+		close(cmd.granted)
+		<-cmd.done
+
+		q.processed(cmd.lane, grantedAt.Sub(cmd.queuedAt), time.Since(grantedAt))
+	}
+}
+
+// enter queues a command and waits for its turn, the returned function ends it and must be called once the command
+// doesn't write anymore:
+//
+//	defer svc.writer.enter()()
+//
+// The commands are not serialized anymore once the queue is closed, nor by a nil queue which is only used by the
+// services of the tests
+func (q *commandQueue) enter() func() {
+	return q.enterLane(commandLaneInteractive)
+}
+
+// enterLane queues a command in a lane like enter
+func (q *commandQueue) enterLane(lane commandLane) func() {
+	if q == nil {
+		return func() {}
+	}
+
+	atomic.AddInt64(&q.depth, 1)
+	atomic.AddInt64(&q.laneDepths[lane], 1)
+	leave := func() {
+		atomic.AddInt64(&q.depth, -1)
+		atomic.AddInt64(&q.laneDepths[lane], -1)
+	}
+
+	cmd := &queuedCommand{
+		lane:     lane,
+		queuedAt: time.Now(),
+		granted:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	select {
+	case q.lanes[lane] <- cmd:
+		<-cmd.granted
+	case <-q.closed:
+		leave()
+		return func() {}
+	}
+
+	return func() {
+		leave()
+		close(cmd.done)
+	}
+}
+
+func (q *commandQueue) processed(lane commandLane, waiting, processing time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.laneStats[lane].processed++
+	if waiting > q.laneStats[lane].maxWaiting {
+		q.laneStats[lane].maxWaiting = waiting
+	}
+
+	q.stats.processed++
+	q.stats.totalWaiting += waiting
+	q.stats.totalProcessing += processing
+	if waiting > q.stats.maxWaiting {
+		q.stats.maxWaiting = waiting
+	}
+	if processing > q.stats.maxProcessing {
+		q.stats.maxProcessing = processing
+	}
+}
+
+func (q *commandQueue) snapshot() *messengertypes.SystemInfo_CommandQueue {
+	if q == nil {
+		return &messengertypes.SystemInfo_CommandQueue{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	info := &messengertypes.SystemInfo_CommandQueue{
+		Depth:           atomic.LoadInt64(&q.depth),
+		Processed:       q.stats.processed,
+		MaxWaitingMs:    q.stats.maxWaiting.Milliseconds(),
+		MaxProcessingMs: q.stats.maxProcessing.Milliseconds(),
+	}
+
+	if q.stats.processed > 0 {
+		info.AverageWaitingMs = (q.stats.totalWaiting / time.Duration(q.stats.processed)).Milliseconds()
+		info.AverageProcessingMs = (q.stats.totalProcessing / time.Duration(q.stats.processed)).Milliseconds()
+	}
+
+	for lane, name := range commandLaneNames {
+		info.Lanes = append(info.Lanes, &messengertypes.SystemInfo_CommandQueue_Lane{
+			Name:         name,
+			Depth:        atomic.LoadInt64(&q.laneDepths[lane]),
+			Processed:    q.laneStats[lane].processed,
+			MaxWaitingMs: q.laneStats[lane].maxWaiting.Milliseconds(),
+		})
+	}
+
+	return info
+}
+
+// close stops the writer loop, the command being handled ends normally
+func (q *commandQueue) close() {
+	if q == nil {
+		return
+	}
+
+	q.once.Do(func() {
+		close(q.closed)
+	})
+}
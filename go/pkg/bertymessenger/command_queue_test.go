@@ -0,0 +1,107 @@
+package bertymessenger
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_commandQueue(t *testing.T) {
+	q := newCommandQueue()
+	defer q.close()
+
+	// the first command holds the writer while the others are queued
+	release := q.enter()
+
+	order := make(chan int, 3)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer q.enter()()
+
+			order <- i
+		}(i)
+
+		// the commands are queued one after the other
+		require.Eventually(t, func() bool { return q.snapshot().GetDepth() == int64(i+2) }, time.Second, time.Millisecond)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	require.Len(t, order, 0)
+
+	release()
+	wg.Wait()
+	close(order)
+
+	handled := []int(nil)
+	for i := range order {
+		handled = append(handled, i)
+	}
+	require.Equal(t, []int{0, 1, 2}, handled)
+
+	require.Eventually(t, func() bool { return q.snapshot().GetProcessed() == 4 }, time.Second, time.Millisecond)
+
+	stats := q.snapshot()
+	require.Equal(t, int64(0), stats.GetDepth())
+	require.True(t, stats.GetMaxProcessingMs() >= 10)
+	require.True(t, stats.GetMaxWaitingMs() >= 10)
+	require.True(t, stats.GetAverageProcessingMs() <= stats.GetMaxProcessingMs())
+
+	// the commands are not blocked once the queue is closed
+	q.close()
+	q.enter()()
+}
+
+func Test_commandQueue_lanes(t *testing.T) {
+	q := newCommandQueue()
+	defer q.close()
+
+	release := q.enter()
+
+	order := make(chan commandLane, 2)
+	wg := sync.WaitGroup{}
+	for i, lane := range []commandLane{commandLaneBulk, commandLaneInteractive} {
+		wg.Add(1)
+		go func(lane commandLane) {
+			defer wg.Done()
+			defer q.enterLane(lane)()
+
+			order <- lane
+		}(lane)
+
+		require.Eventually(t, func() bool { return q.snapshot().GetDepth() == int64(i+2) }, time.Second, time.Millisecond)
+	}
+
+	stats := q.snapshot()
+	require.Len(t, stats.GetLanes(), int(commandLanesCount))
+	require.Equal(t, int64(2), stats.GetLanes()[commandLaneInteractive].GetDepth())
+	require.Equal(t, int64(1), stats.GetLanes()[commandLaneBulk].GetDepth())
+
+	// the interactive command queued last is granted before the bulk one
+	release()
+	wg.Wait()
+	close(order)
+
+	handled := []commandLane(nil)
+	for lane := range order {
+		handled = append(handled, lane)
+	}
+	require.Equal(t, []commandLane{commandLaneInteractive, commandLaneBulk}, handled)
+
+	require.Eventually(t, func() bool { return q.snapshot().GetProcessed() == 3 }, time.Second, time.Millisecond)
+
+	stats = q.snapshot()
+	require.Equal(t, "bulk", stats.GetLanes()[commandLaneBulk].GetName())
+	require.Equal(t, int64(1), stats.GetLanes()[commandLaneBulk].GetProcessed())
+	require.Equal(t, int64(2), stats.GetLanes()[commandLaneInteractive].GetProcessed())
+	require.Equal(t, int64(0), stats.GetLanes()[commandLaneBulk].GetDepth())
+
+	require.Equal(t, commandLaneBulk, appMessageCommandLane(messengertypes.AppMessage_TypeAcknowledge))
+	require.Equal(t, commandLaneInteractive, appMessageCommandLane(messengertypes.AppMessage_TypeUserMessage))
+}
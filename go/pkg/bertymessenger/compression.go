@@ -0,0 +1,127 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The app messages announce the capabilities of the node which sent them, the large payloads are compressed for the
+// conversations whose devices all announced they can expand them. Only the payload is compressed, the type and the
+// other fields of the message stay readable. The messages are expanded before they are handled, so the interactions
+// keep the original payload, and the messages sent without compression, ie. by an older node, are handled as they are.
+
+const (
+	// appMessageCapabilities are the capabilities of this node
+	appMessageCapabilities = uint32(messengertypes.AppMessage_CapabilityCompressionGzip)
+	// appMessageCompressionThreshold is the size from which a payload is compressed, the smaller ones would barely shrink
+	appMessageCompressionThreshold = 2048
+	// appMessageMaxExpandedSize bounds the size of an expanded payload, it is the largest message which can be chunked
+	appMessageMaxExpandedSize = appMessageMaxChunks * defaultAppMessageMaxSize
+)
+
+// packAppMessage describes this node in an app message and compresses its payload when the devices of the
+// conversation of groupPK can expand it, the broadcasts sharing a payload between conversations are sent with a nil
+// groupPK and never compressed. The packed messages are returned as they are, ie. sent from the outbox after their
+// local echo
+func (svc *service) packAppMessage(groupPK []byte, payload []byte) ([]byte, error) {
+	payload, err := svc.stampAppMessageDevice(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var am messengertypes.AppMessage
+	if err := proto.Unmarshal(payload, &am); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if am.GetCapabilities() != 0 || am.GetCompression() != messengertypes.AppMessage_CompressionNone {
+		return payload, nil
+	}
+
+	am.Capabilities = appMessageCapabilities
+
+	if groupPK != nil && am.GetType() != messengertypes.AppMessage_TypeChunk && len(am.GetPayload()) >= appMessageCompressionThreshold {
+		capabilities, err := svc.db.getConversationCapabilities(b64EncodeBytes(groupPK))
+		if err != nil {
+			return nil, err
+		}
+
+		if capabilities&uint32(messengertypes.AppMessage_CapabilityCompressionGzip) != 0 {
+			compressed, err := compressAppMessagePayload(am.GetPayload())
+			if err != nil {
+				return nil, err
+			}
+
+			if len(compressed) < len(am.GetPayload()) {
+				am.Payload = compressed
+				am.Compression = messengertypes.AppMessage_CompressionGzip
+			}
+		}
+	}
+
+	packed, err := proto.Marshal(&am)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return packed, nil
+}
+
+// compressAppMessagePayload compresses a payload with gzip, the output only depends on the payload so the hash of the
+// message is known before it is sent
+func compressAppMessagePayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// expandAppMessage replaces the compressed payload of an app message by the original one
+func expandAppMessage(am *messengertypes.AppMessage) error {
+	switch am.GetCompression() {
+	case messengertypes.AppMessage_CompressionNone:
+		return nil
+	case messengertypes.AppMessage_CompressionGzip:
+	default:
+		return errcode.ErrDeserialization.Wrap(fmt.Errorf("unknown compression %d", am.GetCompression()))
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(am.GetPayload()))
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+	defer r.Close()
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r, appMessageMaxExpandedSize+1))
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if len(payload) > appMessageMaxExpandedSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the expanded payload exceeds %d bytes", appMessageMaxExpandedSize))
+	}
+
+	am.Payload = payload
+	am.Compression = messengertypes.AppMessage_CompressionNone
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestAppMessageCompression(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	convPK := b64EncodeBytes([]byte("conv_1"))
+	gzipCapability := uint32(messengertypes.AppMessage_CapabilityCompressionGzip)
+	for _, model := range []interface{}{
+		&messengertypes.Member{PublicKey: "member_1", ConversationPublicKey: convPK},
+		&messengertypes.Member{PublicKey: "member_2", ConversationPublicKey: convPK},
+		&messengertypes.Device{PublicKey: "device_1", MemberPublicKey: "member_1"},
+		&messengertypes.Device{PublicKey: "device_2", MemberPublicKey: "member_2", Capabilities: gzipCapability, CapabilitiesDate: 10},
+	} {
+		require.NoError(t, db.db.Create(model).Error)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	body := strings.Repeat("hello world ", 1000)
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(1000, nil, &messengertypes.AppMessage_UserMessage{Body: body})
+	require.NoError(t, err)
+
+	// a device of the conversation can't expand the payload
+	packed, err := svc.packAppMessage([]byte("conv_1"), payload)
+	require.NoError(t, err)
+
+	var am messengertypes.AppMessage
+	require.NoError(t, proto.Unmarshal(packed, &am))
+	require.Equal(t, appMessageCapabilities, am.GetCapabilities())
+	require.Equal(t, messengertypes.AppMessage_CompressionNone, am.GetCompression())
+
+	// the messages announcing nothing are ignored
+	require.NoError(t, db.setDeviceCapabilities("device_1", gzipCapability, 20))
+	require.NoError(t, db.setDeviceCapabilities("device_1", 0, 30))
+	capabilities, err := db.getConversationCapabilities(convPK)
+	require.NoError(t, err)
+	require.Equal(t, gzipCapability, capabilities)
+
+	packed, err = svc.packAppMessage([]byte("conv_1"), payload)
+	require.NoError(t, err)
+	require.Less(t, len(packed), len(payload))
+
+	am = messengertypes.AppMessage{}
+	require.NoError(t, proto.Unmarshal(packed, &am))
+	require.Equal(t, messengertypes.AppMessage_CompressionGzip, am.GetCompression())
+	require.Equal(t, int64(1000), am.GetSentDate())
+
+	// a packed message is sent as it is
+	again, err := svc.packAppMessage([]byte("conv_1"), packed)
+	require.NoError(t, err)
+	require.Equal(t, packed, again)
+
+	require.NoError(t, expandAppMessage(&am))
+	require.Equal(t, messengertypes.AppMessage_CompressionNone, am.GetCompression())
+
+	var um messengertypes.AppMessage_UserMessage
+	require.NoError(t, proto.Unmarshal(am.GetPayload(), &um))
+	require.Equal(t, body, um.GetBody())
+
+	// the broadcasts are never compressed
+	packed, err = svc.packAppMessage(nil, payload)
+	require.NoError(t, err)
+	am = messengertypes.AppMessage{}
+	require.NoError(t, proto.Unmarshal(packed, &am))
+	require.Equal(t, messengertypes.AppMessage_CompressionNone, am.GetCompression())
+
+	// a member without a known device can't expand the payloads
+	require.NoError(t, db.db.Create(&messengertypes.Member{PublicKey: "member_3", ConversationPublicKey: convPK}).Error)
+	capabilities, err = db.getConversationCapabilities(convPK)
+	require.NoError(t, err)
+	require.Zero(t, capabilities)
+}
+
+func Test_expandAppMessage(t *testing.T) {
+	// the legacy messages are unchanged
+	am := &messengertypes.AppMessage{Type: messengertypes.AppMessage_TypeUserMessage, Payload: []byte("payload")}
+	require.NoError(t, expandAppMessage(am))
+	require.Equal(t, []byte("payload"), am.GetPayload())
+
+	require.Error(t, expandAppMessage(&messengertypes.AppMessage{Payload: []byte("payload"), Compression: messengertypes.AppMessage_CompressionGzip}))
+	require.Error(t, expandAppMessage(&messengertypes.AppMessage{Payload: []byte("payload"), Compression: 42}))
+
+	// the payloads expanding beyond the limit are refused
+	bomb, err := compressAppMessagePayload(make([]byte, appMessageMaxExpandedSize+1))
+	require.NoError(t, err)
+	require.Error(t, expandAppMessage(&messengertypes.AppMessage{Payload: bomb, Compression: messengertypes.AppMessage_CompressionGzip}))
+}
@@ -0,0 +1,227 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The incoming contact requests are accepted without the user when a rule of the account vouches for the requester:
+// the requester is a member of enough groups of the account, or it was introduced by a verified contact. The group
+// memberships are disclosed by the requester along with its request, only the ones found in the groups of the account
+// are counted. The introductions are sent by a contact to both of the contacts it introduces.
+
+func (h *eventHandler) handleAppMessageContactIntroduction(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_ContactIntroduction)
+
+	if i.GetConversation().GetType() != messengertypes.Conversation_ContactType {
+		h.logger.Warn("ignoring contact introduction sent outside of a contact conversation", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	// the introductions sent by the account are only known by the introduced contacts
+	if i.GetIsMe() {
+		return i, false, nil
+	}
+
+	introducerPK := i.GetConversation().GetContactPublicKey()
+	if payload.GetContactPublicKey() == "" || payload.GetContactPublicKey() == introducerPK {
+		h.logger.Warn("ignoring invalid contact introduction", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	added, err := tx.addContactIntroduction(&messengertypes.ContactIntroduction{
+		ContactPublicKey:     payload.GetContactPublicKey(),
+		IntroducerPublicKey:  introducerPK,
+		DisplayName:          payload.GetDisplayName(),
+		PublicRendezvousSeed: payload.GetPublicRendezvousSeed(),
+		SentDate:             i.GetSentDate(),
+		InteractionCID:       i.GetCID(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if added {
+		h.logger.Info("contact introduced", zap.String("contact-pk", payload.GetContactPublicKey()), zap.String("introducer-pk", introducerPK))
+	}
+
+	return i, false, nil
+}
+
+// getContactRequestAutoAccept returns the rule of the account accepting a contact request, nil when none applies
+func (h *eventHandler) getContactRequestAutoAccept(contactPK string, m *messengertypes.ContactMetadata, now time.Time) (*messengertypes.ContactRequestAutoAccept, error) {
+	acc, err := h.db.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	if acc.GetContactRequestsAutoAcceptIntroduced() {
+		introductions, err := h.db.getContactIntroductions(contactPK)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, introduction := range introductions {
+			introducer, err := h.db.getContactByPK(introduction.GetIntroducerPublicKey())
+			if err != nil {
+				continue
+			}
+
+			if introducer.GetState() == messengertypes.Contact_Accepted && introducer.GetVerificationState() == messengertypes.Contact_VerificationVerified {
+				return &messengertypes.ContactRequestAutoAccept{
+					ContactPublicKey:    contactPK,
+					Rule:                messengertypes.ContactRequestAutoAccept_RuleIntroduced,
+					IntroducerPublicKey: introducer.GetPublicKey(),
+					AcceptedDate:        timestampMs(now),
+				}, nil
+			}
+		}
+	}
+
+	if minSharedGroups := acc.GetContactRequestsAutoAcceptMinSharedGroups(); minSharedGroups > 0 {
+		shared, err := h.db.countSharedGroups(m.GetSharedGroups())
+		if err != nil {
+			return nil, err
+		}
+
+		if shared >= minSharedGroups {
+			return &messengertypes.ContactRequestAutoAccept{
+				ContactPublicKey: contactPK,
+				Rule:             messengertypes.ContactRequestAutoAccept_RuleSharedGroups,
+				SharedGroups:     shared,
+				AcceptedDate:     timestampMs(now),
+			}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// autoAcceptContactRequest accepts an incoming contact request when a rule of the account applies, the rules are not
+// applied during replay as the requests have already been accepted or not
+func (h *eventHandler) autoAcceptContactRequest(contactPK []byte, m *messengertypes.ContactMetadata) (bool, error) {
+	if h.replay || h.svc == nil {
+		return false, nil
+	}
+
+	pk := b64EncodeBytes(contactPK)
+	accept, err := h.getContactRequestAutoAccept(pk, m, time.Now())
+	if err != nil || accept == nil {
+		return false, err
+	}
+
+	if _, err := h.protocolClient.ContactRequestAccept(h.ctx, &protocoltypes.ContactRequestAccept_Request{ContactPK: contactPK}); err != nil {
+		return false, errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	go h.svc.autoReplicateContactGroupOnAllServers(contactPK)
+
+	if err := h.db.addContactRequestAutoAccept(accept); err != nil {
+		return true, err
+	}
+
+	h.logger.Info("contact request accepted by policy", zap.String("contact-pk", pk), zap.String("rule", accept.GetRule().String()))
+
+	return true, nil
+}
+
+func (svc *service) ContactRequestAutoAcceptPolicySet(ctx context.Context, req *messengertypes.ContactRequestAutoAcceptPolicySet_Request) (*messengertypes.ContactRequestAutoAcceptPolicySet_Reply, error) {
+	if req.GetMinSharedGroups() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("min shared groups can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountContactRequestAutoAcceptPolicy(acc.GetPublicKey(), req.GetMinSharedGroups(), req.GetAcceptIntroduced()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.ContactRequestAutoAcceptPolicySet_Reply{}, nil
+}
+
+func (svc *service) ContactRequestAutoAcceptList(ctx context.Context, req *messengertypes.ContactRequestAutoAcceptList_Request) (*messengertypes.ContactRequestAutoAcceptList_Reply, error) {
+	accepts, err := svc.db.getContactRequestAutoAccepts()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequestAutoAcceptList_Reply{Accepts: accepts}, nil
+}
+
+func (svc *service) ContactIntroduce(ctx context.Context, req *messengertypes.ContactIntroduce_Request) (*messengertypes.ContactIntroduce_Reply, error) {
+	if req.GetContactPublicKey() == "" || req.GetToContactPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetContactPublicKey() == req.GetToContactPublicKey() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact can't be introduced to itself"))
+	}
+
+	defer svc.writer.enter()()
+
+	contacts := [2]*messengertypes.Contact{}
+	for i, pk := range []string{req.GetContactPublicKey(), req.GetToContactPublicKey()} {
+		contact, err := svc.db.getContactByPK(pk)
+		if err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+
+		if contact.GetState() != messengertypes.Contact_Accepted || contact.GetConversationPublicKey() == "" {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact %s is not accepted", pk))
+		}
+
+		contacts[i] = contact
+	}
+
+	// each contact receives the other one in its conversation
+	for i, contact := range contacts {
+		introduced := contacts[1-i]
+
+		gpk, err := b64DecodeBytes(contact.GetConversationPublicKey())
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		payload, err := messengertypes.AppMessage_TypeContactIntroduction.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_ContactIntroduction{
+			ContactPublicKey:     introduced.GetPublicKey(),
+			PublicRendezvousSeed: introduced.GetPublicRendezvousSeed(),
+			DisplayName:          introduced.GetDisplayName(),
+		})
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+			return nil, errcode.ErrProtocolSend.Wrap(err)
+		}
+	}
+
+	return &messengertypes.ContactIntroduce_Reply{}, nil
+}
+
+func (svc *service) ContactIntroductionList(ctx context.Context, req *messengertypes.ContactIntroductionList_Request) (*messengertypes.ContactIntroductionList_Reply, error) {
+	introductions, err := svc.db.getContactIntroductions("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactIntroductionList_Reply{Introductions: introductions}, nil
+}
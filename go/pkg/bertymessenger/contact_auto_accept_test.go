@@ -0,0 +1,130 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageContactIntroduction(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	conv := &messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_ContactType, ContactPublicKey: "introducer_1"}
+
+	introduce := func(cid string, isMe bool, contactPK string) error {
+		_, _, err := h.handleAppMessageContactIntroduction(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", IsMe: isMe, SentDate: 1000}, &messengertypes.AppMessage_ContactIntroduction{
+			ContactPublicKey:     contactPK,
+			DisplayName:          "Alice",
+			PublicRendezvousSeed: []byte("seed"),
+		})
+		return err
+	}
+
+	require.NoError(t, introduce("cid_1", false, "contact_1"))
+	require.NoError(t, introduce("cid_2", false, "contact_1"))
+
+	// the introductions sent by the account, of the introducer itself or outside of a contact conversation are ignored
+	require.NoError(t, introduce("cid_3", true, "contact_2"))
+	require.NoError(t, introduce("cid_4", false, "introducer_1"))
+	conv.Type = messengertypes.Conversation_MultiMemberType
+	require.NoError(t, introduce("cid_5", false, "contact_3"))
+
+	introductions, err := db.getContactIntroductions("")
+	require.NoError(t, err)
+	require.Len(t, introductions, 1)
+	require.Equal(t, "contact_1", introductions[0].GetContactPublicKey())
+	require.Equal(t, "introducer_1", introductions[0].GetIntroducerPublicKey())
+	require.Equal(t, "cid_1", introductions[0].GetInteractionCID())
+	require.Equal(t, []byte("seed"), introductions[0].GetPublicRendezvousSeed())
+}
+
+func Test_eventHandler_getContactRequestAutoAccept(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	now := time.Now()
+
+	require.NoError(t, db.addAccount("account_1", ""))
+
+	for _, conv := range []*messengertypes.Conversation{
+		{PublicKey: "group_1", Type: messengertypes.Conversation_MultiMemberType},
+		{PublicKey: "group_2", Type: messengertypes.Conversation_MultiMemberType},
+		{PublicKey: "contact_conv", Type: messengertypes.Conversation_ContactType},
+	} {
+		require.NoError(t, db.db.Create(conv).Error)
+	}
+
+	for _, member := range []*messengertypes.Member{
+		{PublicKey: "own_1", ConversationPublicKey: "group_1", IsMe: true},
+		{PublicKey: "own_2", ConversationPublicKey: "group_2", IsMe: true},
+		{PublicKey: "member_1", ConversationPublicKey: "group_1"},
+		{PublicKey: "member_2", ConversationPublicKey: "group_2", JoinState: messengertypes.Member_JoinPending},
+	} {
+		require.NoError(t, db.db.Create(member).Error)
+	}
+
+	memberships, err := db.getOwnGroupMemberships()
+	require.NoError(t, err)
+	require.Equal(t, []*messengertypes.ContactMetadata_GroupMembership{
+		{ConversationPublicKey: "group_1", MemberPublicKey: "own_1"},
+		{ConversationPublicKey: "group_2", MemberPublicKey: "own_2"},
+	}, memberships)
+
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "introducer_1", State: messengertypes.Contact_Accepted}).Error)
+	_, err = db.addContactIntroduction(&messengertypes.ContactIntroduction{ContactPublicKey: "requester_1", IntroducerPublicKey: "introducer_1", SentDate: 1000})
+	require.NoError(t, err)
+
+	metadata := &messengertypes.ContactMetadata{SharedGroups: []*messengertypes.ContactMetadata_GroupMembership{
+		{ConversationPublicKey: "group_1", MemberPublicKey: "member_1"},
+		{ConversationPublicKey: "group_1", MemberPublicKey: "member_1"},
+		// only the approved members of the groups are counted
+		{ConversationPublicKey: "group_2", MemberPublicKey: "member_2"},
+		{ConversationPublicKey: "unknown_group", MemberPublicKey: "member_3"},
+	}}
+
+	// no rule is enabled by default
+	accept, err := h.getContactRequestAutoAccept("requester_1", metadata, now)
+	require.NoError(t, err)
+	require.Nil(t, accept)
+
+	_, err = db.setAccountContactRequestAutoAcceptPolicy("account_1", 2, true)
+	require.NoError(t, err)
+
+	// the introducer isn't verified and a single group is shared
+	accept, err = h.getContactRequestAutoAccept("requester_1", metadata, now)
+	require.NoError(t, err)
+	require.Nil(t, accept)
+
+	_, err = db.setAccountContactRequestAutoAcceptPolicy("account_1", 1, true)
+	require.NoError(t, err)
+
+	accept, err = h.getContactRequestAutoAccept("requester_1", metadata, now)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.ContactRequestAutoAccept_RuleSharedGroups, accept.GetRule())
+	require.Equal(t, int32(1), accept.GetSharedGroups())
+	require.Equal(t, timestampMs(now), accept.GetAcceptedDate())
+
+	require.NoError(t, db.db.Model(&messengertypes.Contact{}).Where("public_key = ?", "introducer_1").Update("verification_state", messengertypes.Contact_VerificationVerified).Error)
+
+	accept, err = h.getContactRequestAutoAccept("requester_1", metadata, now)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.ContactRequestAutoAccept_RuleIntroduced, accept.GetRule())
+	require.Equal(t, "introducer_1", accept.GetIntroducerPublicKey())
+
+	// the audit trail keeps the last acceptance of a contact
+	require.NoError(t, db.addContactRequestAutoAccept(accept))
+	accept.AcceptedDate++
+	require.NoError(t, db.addContactRequestAutoAccept(accept))
+
+	accepts, err := db.getContactRequestAutoAccepts()
+	require.NoError(t, err)
+	require.Len(t, accepts, 1)
+	require.Equal(t, timestampMs(now)+1, accepts[0].GetAcceptedDate())
+}
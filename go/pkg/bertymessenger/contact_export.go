@@ -0,0 +1,366 @@
+package bertymessenger
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/bertylinks"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	// contactImportMaxCount bounds the number of contacts of an imported document
+	contactImportMaxCount = 500
+	// vCardLineMaxSize is the size in bytes after which the lines of a vCard are folded
+	vCardLineMaxSize   = 75
+	vCardPublicKeyProp = "X-BERTY-PUBLIC-KEY"
+)
+
+// The contact list is exported with the contact links of the contacts, they are built from the rendezvous seeds of
+// their contact requests. An imported document sends a contact request to each of its links, ie. to join the contacts
+// of an account from a new one.
+
+type contactExport struct {
+	ExportDate string                `json:"export_date"`
+	Contacts   []*contactExportEntry `json:"contacts"`
+}
+
+type contactExportEntry struct {
+	PublicKey   string `json:"public_key"`
+	DisplayName string `json:"display_name"`
+	Link        string `json:"link,omitempty"`
+}
+
+// buildContactExport lists the accepted contacts, only the ones of the public keys when some are given
+func buildContactExport(db *dbWrapper, publicKeys []string, now time.Time) (*contactExport, error) {
+	contacts, err := db.getContactsByState(messengertypes.Contact_Accepted)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	selected := map[string]bool{}
+	for _, pk := range publicKeys {
+		selected[pk] = true
+	}
+
+	export := &contactExport{ExportDate: now.UTC().Format(time.RFC3339)}
+	for _, contact := range contacts {
+		if len(selected) > 0 && !selected[contact.GetPublicKey()] {
+			continue
+		}
+
+		entry := &contactExportEntry{PublicKey: contact.GetPublicKey(), DisplayName: contact.GetDisplayName()}
+		if len(contact.GetPublicRendezvousSeed()) > 0 {
+			pk, err := b64DecodeBytes(contact.GetPublicKey())
+			if err != nil {
+				return nil, errcode.ErrDeserialization.Wrap(err)
+			}
+
+			id := &messengertypes.BertyID{
+				DisplayName:          contact.GetDisplayName(),
+				PublicRendezvousSeed: contact.GetPublicRendezvousSeed(),
+				AccountPK:            pk,
+			}
+			if _, entry.Link, err = bertylinks.MarshalLink(id.GetBertyLink()); err != nil {
+				return nil, errcode.ErrSerialization.Wrap(err)
+			}
+		}
+
+		export.Contacts = append(export.Contacts, entry)
+	}
+
+	sort.SliceStable(export.Contacts, func(i, j int) bool {
+		return strings.ToLower(export.Contacts[i].DisplayName) < strings.ToLower(export.Contacts[j].DisplayName)
+	})
+
+	return export, nil
+}
+
+func writeContactExport(w io.Writer, export *contactExport, format messengertypes.ContactExport_Format) error {
+	switch format {
+	case messengertypes.ContactExport_FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(export); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+	case messengertypes.ContactExport_FormatVCard:
+		for _, contact := range export.Contacts {
+			lines := []string{
+				"BEGIN:VCARD",
+				"VERSION:4.0",
+				"FN:" + escapeVCardValue(contact.DisplayName),
+				vCardPublicKeyProp + ":" + contact.PublicKey,
+			}
+			if contact.Link != "" {
+				lines = append(lines, "URL:"+contact.Link)
+			}
+			lines = append(lines, "END:VCARD")
+
+			for _, line := range lines {
+				if _, err := io.WriteString(w, foldVCardLine(line)+"\r\n"); err != nil {
+					return errcode.ErrStreamWrite.Wrap(err)
+				}
+			}
+		}
+
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", format))
+	}
+
+	return nil
+}
+
+// readContactImport reads a document exported as JSON or as vCard, or a list of contact links with one per line
+func readContactImport(document []byte) ([]*contactExportEntry, error) {
+	document = bytes.TrimSpace(document)
+
+	var entries []*contactExportEntry
+	switch {
+	case len(document) == 0:
+		return nil, errcode.ErrMissingInput
+
+	case document[0] == '{':
+		export := &contactExport{}
+		if err := json.Unmarshal(document, export); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+		entries = export.Contacts
+
+	case len(document) >= len("BEGIN:VCARD") && strings.EqualFold(string(document[:len("BEGIN:VCARD")]), "BEGIN:VCARD"):
+		var err error
+		if entries, err = readVCards(document); err != nil {
+			return nil, err
+		}
+
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(document))
+		for scanner.Scan() {
+			if link := strings.TrimSpace(scanner.Text()); link != "" {
+				entries = append(entries, &contactExportEntry{Link: link})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	if len(entries) > contactImportMaxCount {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("too many contacts, the maximum is %d", contactImportMaxCount))
+	}
+
+	return entries, nil
+}
+
+func readVCards(document []byte) ([]*contactExportEntry, error) {
+	// the folded lines are joined first
+	lines := []string(nil)
+	for _, line := range strings.Split(strings.ReplaceAll(string(document), "\r\n", "\n"), "\n") {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	entries := []*contactExportEntry(nil)
+	var entry *contactExportEntry
+	for _, line := range lines {
+		sep := strings.IndexByte(line, ':')
+		if sep < 0 {
+			continue
+		}
+
+		// the parameters and the group of the property are ignored
+		name := strings.ToUpper(strings.SplitN(line[:sep], ";", 2)[0])
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			name = name[dot+1:]
+		}
+		value := strings.TrimSpace(line[sep+1:])
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			entry = &contactExportEntry{}
+		case entry == nil:
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid vCard"))
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			entries = append(entries, entry)
+			entry = nil
+		case name == "FN":
+			entry.DisplayName = unescapeVCardValue(value)
+		case name == vCardPublicKeyProp:
+			entry.PublicKey = value
+		case name == "URL" && entry.Link == "":
+			entry.Link = value
+		}
+	}
+
+	if entry != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("truncated vCard"))
+	}
+
+	return entries, nil
+}
+
+var (
+	vCardEscaper   = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`, "\r", "")
+	vCardUnescaper = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n")
+)
+
+func escapeVCardValue(value string) string {
+	return vCardEscaper.Replace(value)
+}
+
+func unescapeVCardValue(value string) string {
+	return vCardUnescaper.Replace(value)
+}
+
+// foldVCardLine splits a line longer than the limit of the vCards, without splitting its characters
+func foldVCardLine(line string) string {
+	folded := strings.Builder{}
+	size := 0
+	for _, r := range line {
+		if size+utf8.RuneLen(r) > vCardLineMaxSize {
+			folded.WriteString("\r\n ")
+			size = 1
+		}
+		folded.WriteRune(r)
+		size += utf8.RuneLen(r)
+	}
+
+	return folded.String()
+}
+
+func (svc *service) ContactExport(ctx context.Context, req *messengertypes.ContactExport_Request) (*messengertypes.ContactExport_Reply, error) {
+	if _, ok := messengertypes.ContactExport_Format_name[int32(req.GetFormat())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", req.GetFormat()))
+	}
+
+	export, err := func() (*contactExport, error) {
+		defer svc.writer.enter()()
+
+		return buildContactExport(svc.db, req.GetContactPublicKeys(), time.Now())
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	document := &bytes.Buffer{}
+	if err := writeContactExport(document, export, req.GetFormat()); err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ContactExport_Reply{Document: document.Bytes()}
+	for _, contact := range export.Contacts {
+		reply.Contacts = append(reply.Contacts, &messengertypes.ContactExport_Contact{
+			PublicKey:   contact.PublicKey,
+			DisplayName: contact.DisplayName,
+			WebURL:      contact.Link,
+		})
+	}
+
+	return reply, nil
+}
+
+func (svc *service) ContactImport(ctx context.Context, req *messengertypes.ContactImport_Request) (*messengertypes.ContactImport_Reply, error) {
+	entries, err := readContactImport(req.GetDocument())
+	if err != nil {
+		return nil, err
+	}
+
+	ownMetadata := &messengertypes.ContactMetadata{IntroMessage: req.GetIntroMessage()}
+	if err := ownMetadata.IsValidIntro(); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	reply := &messengertypes.ContactImport_Reply{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		result := &messengertypes.ContactImport_Entry{PublicKey: entry.PublicKey, DisplayName: entry.DisplayName}
+		reply.Entries = append(reply.Entries, result)
+
+		id, err := contactImportID(entry)
+		if err != nil {
+			result.Status, result.Error = messengertypes.ContactImport_StatusInvalid, err.Error()
+			continue
+		}
+
+		result.PublicKey = b64EncodeBytes(id.GetAccountPK())
+		if result.DisplayName == "" {
+			result.DisplayName = id.GetDisplayName()
+		}
+
+		switch _, err := svc.db.getContactByPK(result.PublicKey); {
+		case seen[result.PublicKey]:
+			result.Status = messengertypes.ContactImport_StatusDuplicate
+			continue
+		case result.PublicKey == acc.GetPublicKey():
+			result.Status = messengertypes.ContactImport_StatusSelf
+			continue
+		case err == nil:
+			result.Status = messengertypes.ContactImport_StatusExisting
+			continue
+		case err != gorm.ErrRecordNotFound:
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+		seen[result.PublicKey] = true
+
+		if !req.GetDryRun() {
+			if err := svc.sendContactRequest(ctx, id, ownMetadata); err != nil {
+				result.Status, result.Error = messengertypes.ContactImport_StatusFailed, err.Error()
+				continue
+			}
+		}
+
+		result.Status = messengertypes.ContactImport_StatusRequested
+		reply.RequestedCount++
+	}
+
+	return reply, nil
+}
+
+// contactImportID reads the contact link of an imported contact, it must match the public key of the document
+func contactImportID(entry *contactExportEntry) (*messengertypes.BertyID, error) {
+	if entry.Link == "" {
+		return nil, fmt.Errorf("no contact link")
+	}
+
+	link, err := bertylinks.UnmarshalLink(entry.Link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !link.IsContact() {
+		return nil, fmt.Errorf("not a contact link")
+	}
+
+	if entry.PublicKey != "" && entry.PublicKey != b64EncodeBytes(link.BertyID.GetAccountPK()) {
+		return nil, fmt.Errorf("the contact link is for another account")
+	}
+
+	id := *link.BertyID
+	if entry.DisplayName != "" {
+		id.DisplayName = entry.DisplayName
+	}
+
+	return &id, nil
+}
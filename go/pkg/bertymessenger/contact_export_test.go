@@ -0,0 +1,128 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/bertylinks"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testContactExportDB(t *testing.T) (*dbWrapper, func()) {
+	t.Helper()
+
+	db, dispose := getInMemoryTestDB(t)
+
+	require.NoError(t, db.db.Create(&messengertypes.Account{PublicKey: b64EncodeBytes(bytes.Repeat([]byte{1}, 32))}).Error)
+	for _, c := range []*messengertypes.Contact{
+		{PublicKey: b64EncodeBytes(bytes.Repeat([]byte{2}, 32)), DisplayName: "bob, the builder", State: messengertypes.Contact_Accepted, PublicRendezvousSeed: bytes.Repeat([]byte{3}, 32)},
+		{PublicKey: b64EncodeBytes(bytes.Repeat([]byte{4}, 32)), DisplayName: "alice", State: messengertypes.Contact_Accepted},
+		{PublicKey: b64EncodeBytes(bytes.Repeat([]byte{5}, 32)), DisplayName: "carol", State: messengertypes.Contact_IncomingRequest, PublicRendezvousSeed: bytes.Repeat([]byte{6}, 32)},
+	} {
+		require.NoError(t, db.db.Create(c).Error)
+	}
+
+	return db, dispose
+}
+
+func Test_buildContactExport(t *testing.T) {
+	db, dispose := testContactExportDB(t)
+	defer dispose()
+
+	export, err := buildContactExport(db, nil, time.Now())
+	require.NoError(t, err)
+	require.Len(t, export.Contacts, 2)
+	require.Equal(t, "alice", export.Contacts[0].DisplayName)
+	require.Empty(t, export.Contacts[0].Link)
+	require.Equal(t, "bob, the builder", export.Contacts[1].DisplayName)
+	require.NotEmpty(t, export.Contacts[1].Link)
+
+	export, err = buildContactExport(db, []string{b64EncodeBytes(bytes.Repeat([]byte{4}, 32))}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, export.Contacts, 1)
+
+	for _, format := range []messengertypes.ContactExport_Format{messengertypes.ContactExport_FormatJSON, messengertypes.ContactExport_FormatVCard} {
+		export, err := buildContactExport(db, nil, time.Now())
+		require.NoError(t, err)
+
+		document := &bytes.Buffer{}
+		require.NoError(t, writeContactExport(document, export, format))
+
+		entries, err := readContactImport(document.Bytes())
+		require.NoError(t, err, format.String())
+		require.Equal(t, export.Contacts, entries, format.String())
+	}
+}
+
+func Test_readContactImport(t *testing.T) {
+	_, err := readContactImport([]byte("  \n"))
+	require.Error(t, err)
+
+	entries, err := readContactImport([]byte("https://berty.tech/id#a\n\n  https://berty.tech/id#b\n"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "https://berty.tech/id#b", entries[1].Link)
+
+	entries, err = readContactImport([]byte("BEGIN:VCARD\r\nVERSION:3.0\r\nitem1.FN;CHARSET=UTF-8:dave\\; jr\r\nURL:https://berty\r\n .tech/id#c\r\nURL:https://example.com\r\nEND:VCARD\r\n"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "dave; jr", entries[0].DisplayName)
+	require.Equal(t, "https://berty.tech/id#c", entries[0].Link)
+
+	_, err = readContactImport([]byte("BEGIN:VCARD\nFN:dave\n"))
+	require.Error(t, err)
+
+	_, err = readContactImport([]byte(strings.Repeat("link\n", contactImportMaxCount+1)))
+	require.Error(t, err)
+
+	// the multi-bytes characters are not split
+	for _, line := range strings.Split(foldVCardLine(strings.Repeat("é", 50)), "\r\n") {
+		require.True(t, len(line) <= vCardLineMaxSize)
+		require.True(t, utf8.ValidString(line))
+	}
+}
+
+func Test_service_ContactImport(t *testing.T) {
+	db, dispose := testContactExportDB(t)
+	defer dispose()
+
+	link := func(pk, seed byte, name string) string {
+		id := &messengertypes.BertyID{AccountPK: bytes.Repeat([]byte{pk}, 32), PublicRendezvousSeed: bytes.Repeat([]byte{seed}, 32), DisplayName: name}
+		_, web, err := bertylinks.MarshalLink(id.GetBertyLink())
+		require.NoError(t, err)
+		return web
+	}
+
+	document := strings.Join([]string{
+		link(7, 8, "erin"),
+		link(7, 8, "erin"),
+		link(2, 3, "bob"),
+		link(1, 9, "me"),
+		"https://berty.tech/id#invalid",
+	}, "\n")
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	reply, err := svc.ContactImport(context.Background(), &messengertypes.ContactImport_Request{Document: []byte(document), DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reply.GetRequestedCount())
+	require.Len(t, reply.GetEntries(), 5)
+
+	for i, status := range []messengertypes.ContactImport_Status{
+		messengertypes.ContactImport_StatusRequested,
+		messengertypes.ContactImport_StatusDuplicate,
+		messengertypes.ContactImport_StatusExisting,
+		messengertypes.ContactImport_StatusSelf,
+		messengertypes.ContactImport_StatusInvalid,
+	} {
+		require.Equal(t, status, reply.GetEntries()[i].GetStatus(), i)
+	}
+	require.Equal(t, "erin", reply.GetEntries()[0].GetDisplayName())
+	require.NotEmpty(t, reply.GetEntries()[4].GetError())
+}
@@ -0,0 +1,175 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// A contact can be added more than once after a restore, its key being stored in another base64 encoding or a new 1:1
+// conversation being created with it. The duplicates are merged into a single contact record whose key uses the
+// encoding of the messenger, the interactions of the other 1:1 conversations are moved to the kept one and these are
+// marked as migrated to it.
+
+// contactStateRanks orders the states of the records of a duplicate contact, the most advanced one is kept
+var contactStateRanks = map[messengertypes.Contact_State]int{
+	messengertypes.Contact_IncomingRequestIgnored:  1,
+	messengertypes.Contact_IncomingRequest:         2,
+	messengertypes.Contact_OutgoingRequestEnqueued: 3,
+	messengertypes.Contact_OutgoingRequestSent:     4,
+	messengertypes.Contact_Accepted:                5,
+}
+
+// contactReference is a column referencing a contact by its key, the rows of a primary key column are dropped rather
+// than moved when the kept contact already has one with the same other keys
+type contactReference struct {
+	model      interface{}
+	table      string
+	column     string
+	primaryKey bool
+	keys       []string
+}
+
+var contactReferences = []contactReference{
+	{model: &messengertypes.Conversation{}, table: "conversations", column: "contact_public_key"},
+	{model: &messengertypes.Device{}, table: "devices", column: "member_public_key"},
+	{model: &messengertypes.ContactRequestAutoAccept{}, table: "contact_request_auto_accepts", column: "contact_public_key", primaryKey: true},
+	{model: &messengertypes.ContactRequestAutoAccept{}, table: "contact_request_auto_accepts", column: "introducer_public_key"},
+	{model: &messengertypes.OutgoingContactRequest{}, table: "outgoing_contact_requests", column: "contact_public_key", primaryKey: true},
+	{model: &messengertypes.ContactIntroduction{}, table: "contact_introductions", column: "contact_public_key", primaryKey: true, keys: []string{"introducer_public_key"}},
+	{model: &messengertypes.ContactIntroduction{}, table: "contact_introductions", column: "introducer_public_key", primaryKey: true, keys: []string{"contact_public_key"}},
+	{model: &messengertypes.RecoveryTrustee{}, table: "recovery_trustees", column: "contact_public_key", primaryKey: true, keys: []string{"setup_id"}},
+	{model: &messengertypes.AudienceMember{}, table: "audience_members", column: "contact_public_key", primaryKey: true, keys: []string{"audience_id"}},
+	{model: &messengertypes.BroadcastRecipient{}, table: "broadcast_recipients", column: "contact_public_key", primaryKey: true, keys: []string{"broadcast_id"}},
+}
+
+// canonicalContactKey returns the key of a contact in the encoding of the messenger, the keys added through other paths
+// may use another base64 alphabet or padding
+func canonicalContactKey(pk string) string {
+	for _, encoding := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if raw, err := encoding.DecodeString(pk); err == nil {
+			return b64EncodeBytes(raw)
+		}
+	}
+
+	return pk
+}
+
+// keptContact returns the record kept among the ones of a duplicate contact, the one already using the canonical key,
+// or else the most advanced and then the oldest one
+func keptContact(pk string, contacts []*messengertypes.Contact) *messengertypes.Contact {
+	var kept *messengertypes.Contact
+	for _, c := range contacts {
+		switch {
+		case kept == nil:
+			kept = c
+		case (c.GetPublicKey() == pk) != (kept.GetPublicKey() == pk):
+			if c.GetPublicKey() == pk {
+				kept = c
+			}
+		case contactStateRanks[c.GetState()] != contactStateRanks[kept.GetState()]:
+			if contactStateRanks[c.GetState()] > contactStateRanks[kept.GetState()] {
+				kept = c
+			}
+		case c.GetCreatedDate() < kept.GetCreatedDate():
+			kept = c
+		}
+	}
+
+	return kept
+}
+
+// mergeContactRecord completes the kept record of a contact with a duplicate one, the most advanced state and the most
+// recent profile win, the local fields of the kept record are only filled when empty
+func mergeContactRecord(kept, other *messengertypes.Contact) {
+	if contactStateRanks[other.GetState()] > contactStateRanks[kept.GetState()] {
+		kept.State = other.GetState()
+		kept.SentDate = other.GetSentDate()
+		kept.RequestStatus = other.GetRequestStatus()
+		kept.RequestExpiresAt = other.GetRequestExpiresAt()
+	}
+
+	if other.GetInfoDate() > kept.GetInfoDate() {
+		kept.DisplayName = other.GetDisplayName()
+		kept.AvatarCID = other.GetAvatarCID()
+		kept.InfoDate = other.GetInfoDate()
+	}
+
+	if other.GetCreatedDate() != 0 && (kept.GetCreatedDate() == 0 || other.GetCreatedDate() < kept.GetCreatedDate()) {
+		kept.CreatedDate = other.GetCreatedDate()
+	}
+
+	if kept.GetNickname() == "" && kept.GetNote() == "" {
+		kept.Nickname = other.GetNickname()
+		kept.Note = other.GetNote()
+	}
+
+	if kept.GetVerificationState() == messengertypes.Contact_VerificationNone {
+		kept.VerificationState = other.GetVerificationState()
+		kept.VerifiedDate = other.GetVerifiedDate()
+		kept.VerifiedDevicesHash = other.GetVerifiedDevicesHash()
+	}
+
+	if len(kept.GetPublicRendezvousSeed()) == 0 {
+		kept.PublicRendezvousSeed = other.GetPublicRendezvousSeed()
+	}
+
+	kept.PresenceHidden = kept.GetPresenceHidden() || other.GetPresenceHidden()
+}
+
+func (svc *service) ContactDuplicateList(ctx context.Context, req *messengertypes.ContactDuplicateList_Request) (*messengertypes.ContactDuplicateList_Reply, error) {
+	duplicates, err := svc.db.getContactDuplicates()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactDuplicateList_Reply{Duplicates: duplicates}, nil
+}
+
+func (svc *service) ContactMerge(ctx context.Context, req *messengertypes.ContactMerge_Request) (*messengertypes.ContactMerge_Reply, error) {
+	defer svc.writer.enter()()
+
+	merged, err := svc.db.mergeContactDuplicates(req.GetContactPublicKey(), timestampMs(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetContactPublicKey() != "" && len(merged) == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("the contact has no duplicate"))
+	}
+
+	for _, duplicate := range merged {
+		svc.logger.Info("duplicate contact merged", zap.Int("duplicate-keys", len(duplicate.GetDuplicatePublicKeys())), zap.Int("duplicate-conversations", len(duplicate.GetDuplicateConversationPublicKeys())))
+		svc.dispatchContactMerged(duplicate)
+	}
+
+	return &messengertypes.ContactMerge_Reply{Merged: merged}, nil
+}
+
+// dispatchContactMerged streams the kept contact and the conversations of a duplicate contact once it is merged
+func (svc *service) dispatchContactMerged(duplicate *messengertypes.ContactDuplicate) {
+	if contact, err := svc.db.getContactByPK(duplicate.GetPublicKey()); err != nil {
+		svc.logger.Error("unable to get merged contact", zap.Error(err))
+	} else if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		svc.logger.Error("unable to dispatch merged contact", zap.Error(err))
+	}
+
+	convPKs := append([]string{duplicate.GetConversationPublicKey()}, duplicate.GetDuplicateConversationPublicKeys()...)
+	convs, err := svc.db.getConversationsByPKs(convPKs)
+	if err != nil {
+		svc.logger.Error("unable to get merged conversations", zap.Error(err))
+		return
+	}
+
+	for _, conv := range convs {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			svc.logger.Error("unable to dispatch merged conversation", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_canonicalContactKey(t *testing.T) {
+	raw := []byte{0xfb, 0xef, 0xbe, 0x01}
+	require.Equal(t, b64EncodeBytes(raw), canonicalContactKey(b64EncodeBytes(raw)))
+	require.Equal(t, b64EncodeBytes(raw), canonicalContactKey(base64.StdEncoding.EncodeToString(raw)))
+	require.Equal(t, b64EncodeBytes(raw), canonicalContactKey(base64.URLEncoding.EncodeToString(raw)))
+	require.Equal(t, "not a key!", canonicalContactKey("not a key!"))
+}
+
+func TestContactMerge(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	raw := []byte{0xfb, 0xef, 0xbe, 0x01}
+	canonical, std := b64EncodeBytes(raw), base64.StdEncoding.EncodeToString(raw)
+
+	for _, model := range []interface{}{
+		&messengertypes.Contact{PublicKey: canonical, State: messengertypes.Contact_OutgoingRequestSent, ConversationPublicKey: "conv_1", CreatedDate: 20},
+		&messengertypes.Contact{PublicKey: std, State: messengertypes.Contact_Accepted, ConversationPublicKey: "conv_2", CreatedDate: 10, Nickname: "bob", DisplayName: "Bob", InfoDate: 5},
+		&messengertypes.Contact{PublicKey: "contact_other", State: messengertypes.Contact_Accepted, ConversationPublicKey: "conv_3"},
+		&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_ContactType, ContactPublicKey: canonical, LastUpdate: 10, UnreadCount: 1},
+		&messengertypes.Conversation{PublicKey: "conv_2", Type: messengertypes.Conversation_ContactType, ContactPublicKey: std, LastUpdate: 30, UnreadCount: 2},
+		&messengertypes.Conversation{PublicKey: "conv_3", Type: messengertypes.Conversation_ContactType, ContactPublicKey: "contact_other"},
+		&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1"},
+		&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_2"},
+		&messengertypes.Device{PublicKey: "device_1", MemberPublicKey: std},
+		&messengertypes.AudienceMember{AudienceID: "audience_1", ContactPublicKey: canonical},
+		&messengertypes.AudienceMember{AudienceID: "audience_1", ContactPublicKey: std},
+		&messengertypes.AudienceMember{AudienceID: "audience_2", ContactPublicKey: std},
+	} {
+		require.NoError(t, db.db.Create(model).Error)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	list, err := svc.ContactDuplicateList(ctx, &messengertypes.ContactDuplicateList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.GetDuplicates(), 1)
+	duplicate := list.GetDuplicates()[0]
+	require.Equal(t, canonical, duplicate.GetPublicKey())
+	require.Equal(t, []string{std}, duplicate.GetDuplicatePublicKeys())
+	require.Equal(t, "conv_1", duplicate.GetConversationPublicKey())
+	require.Equal(t, []string{"conv_2"}, duplicate.GetDuplicateConversationPublicKeys())
+
+	_, err = svc.ContactMerge(ctx, &messengertypes.ContactMerge_Request{ContactPublicKey: "contact_other"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	merged, err := svc.ContactMerge(ctx, &messengertypes.ContactMerge_Request{ContactPublicKey: std})
+	require.NoError(t, err)
+	require.Len(t, merged.GetMerged(), 1)
+
+	// the most advanced state and the local fields of the duplicate are kept under the canonical key
+	contact, err := db.getContactByPK(canonical)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_Accepted, contact.GetState())
+	require.Equal(t, "bob", contact.GetNickname())
+	require.Equal(t, "Bob", contact.GetDisplayName())
+	require.Equal(t, int64(10), contact.GetCreatedDate())
+	require.Equal(t, "conv_1", contact.GetConversationPublicKey())
+
+	_, err = db.getContactByPK(std)
+	require.Error(t, err)
+
+	// the interactions are moved to the kept conversation, the other one is migrated to it
+	interactions, err := db.getPaginatedInteractions("conv_1", true, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int32(3), conv.GetUnreadCount())
+	require.Equal(t, int64(30), conv.GetLastUpdate())
+
+	conv, err = db.getConversationByPK("conv_2")
+	require.NoError(t, err)
+	require.Equal(t, "conv_1", conv.GetMigratedToPublicKey())
+	require.Equal(t, canonical, conv.GetContactPublicKey())
+	require.Equal(t, int32(0), conv.GetUnreadCount())
+
+	// the references to the duplicate key are moved, the ones already known for the kept key are dropped
+	device := &messengertypes.Device{}
+	require.NoError(t, db.db.First(device, &messengertypes.Device{PublicKey: "device_1"}).Error)
+	require.Equal(t, canonical, device.GetMemberPublicKey())
+
+	audienceMembers := []*messengertypes.AudienceMember(nil)
+	require.NoError(t, db.db.Order("audience_id").Find(&audienceMembers).Error)
+	require.Len(t, audienceMembers, 2)
+	for _, m := range audienceMembers {
+		require.Equal(t, canonical, m.GetContactPublicKey())
+	}
+
+	// nothing is left to merge
+	list, err = svc.ContactDuplicateList(ctx, &messengertypes.ContactDuplicateList_Request{})
+	require.NoError(t, err)
+	require.Empty(t, list.GetDuplicates())
+
+	all, err := db.mergeContactDuplicates("", 0)
+	require.NoError(t, err)
+	require.Empty(t, all)
+}
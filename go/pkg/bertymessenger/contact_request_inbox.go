@@ -0,0 +1,205 @@
+package bertymessenger
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The pending contact requests, incoming and outgoing, are kept in an inbox until they are accepted or canceled. The
+// incoming requests are unread until the user has seen them, the ones ignored by the user or by the contact request
+// policy are hidden from the inbox by default and can still be accepted.
+
+// contactRequestListMaxCount bounds the number of requests returned by a page of ContactRequestList
+const contactRequestListMaxCount = 100
+
+// pendingContactRequestFromContact builds the pending request of a contact which hasn't answered or been answered yet
+func pendingContactRequestFromContact(contact *messengertypes.Contact) *messengertypes.PendingContactRequest {
+	request := &messengertypes.PendingContactRequest{
+		ContactPublicKey: contact.GetPublicKey(),
+		Direction:        messengertypes.PendingContactRequest_DirectionOutgoing,
+		CreatedDate:      contact.GetCreatedDate(),
+		DisplayName:      contact.GetDisplayName(),
+		IntroMessage:     contact.GetIntroMessage(),
+		IsRead:           true,
+	}
+
+	switch contact.GetState() {
+	case messengertypes.Contact_IncomingRequest, messengertypes.Contact_IncomingRequestIgnored:
+		request.Direction = messengertypes.PendingContactRequest_DirectionIncoming
+		request.IsIgnored = contact.GetState() == messengertypes.Contact_IncomingRequestIgnored
+		request.IsRead = request.IsIgnored
+	}
+
+	return request
+}
+
+func (svc *service) ContactRequestList(ctx context.Context, req *messengertypes.ContactRequestList_Request) (*messengertypes.ContactRequestList_Reply, error) {
+	cursor, err := decodeContactRequestCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > contactRequestListMaxCount {
+		count = contactRequestListMaxCount
+	}
+
+	requests, err := svc.db.getPendingContactRequests(req.GetDirection(), req.GetIncludeIgnored(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ContactRequestList_Reply{Requests: requests}
+	if len(requests) > count {
+		reply.Requests = requests[:count]
+		if reply.NextCursor, err = encodeContactRequestCursor(reply.Requests[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if reply.UnreadCount, err = svc.db.countUnreadContactRequests(); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (svc *service) ContactRequestAcceptBulk(ctx context.Context, req *messengertypes.ContactRequestAcceptBulk_Request) (*messengertypes.ContactRequestAcceptBulk_Reply, error) {
+	if len(req.GetPublicKeys()) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	// the requests are accepted one by one so a failure doesn't prevent the next ones from being accepted, they leave
+	// the inbox once the protocol has accepted them
+	reply := &messengertypes.ContactRequestAcceptBulk_Reply{}
+	for _, pk := range req.GetPublicKeys() {
+		if _, err := svc.ContactAccept(ctx, &messengertypes.ContactAccept_Request{PublicKey: pk}); err != nil {
+			svc.logger.Warn("unable to accept a contact request", zap.String("contact-pk", pk), zap.Error(err))
+			reply.Failures = append(reply.Failures, &messengertypes.ContactRequestAcceptBulk_Failure{PublicKey: pk, Error: err.Error()})
+			continue
+		}
+
+		reply.Accepted = append(reply.Accepted, pk)
+	}
+
+	return reply, nil
+}
+
+func (svc *service) ContactRequestIgnoreBulk(ctx context.Context, req *messengertypes.ContactRequestIgnoreBulk_Request) (*messengertypes.ContactRequestIgnoreBulk_Reply, error) {
+	if len(req.GetPublicKeys()) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	ignored, err := svc.db.ignorePendingContactRequests(req.GetPublicKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pk := range ignored {
+		contact, err := svc.db.getContactByPK(pk)
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+			return nil, err
+		}
+
+		if err := svc.dispatchContactRequestUpdated(pk, false); err != nil {
+			return nil, err
+		}
+	}
+
+	unread, err := svc.db.countUnreadContactRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequestIgnoreBulk_Reply{IgnoredCount: int64(len(ignored)), UnreadCount: unread}, nil
+}
+
+func (svc *service) ContactRequestMarkRead(ctx context.Context, req *messengertypes.ContactRequestMarkRead_Request) (*messengertypes.ContactRequestMarkRead_Reply, error) {
+	if len(req.GetPublicKeys()) == 0 && !req.GetAll() {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	updated, err := svc.db.markContactRequestsRead(req.GetPublicKeys(), req.GetAll())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pk := range updated {
+		if err := svc.dispatchContactRequestUpdated(pk, false); err != nil {
+			return nil, err
+		}
+	}
+
+	unread, err := svc.db.countUnreadContactRequests()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequestMarkRead_Reply{UnreadCount: unread}, nil
+}
+
+// dispatchContactRequestUpdated streams a pending request with the unread count, isNew is set for the requests just
+// received so the clients can notify them
+func (svc *service) dispatchContactRequestUpdated(contactPK string, isNew bool) error {
+	request, err := svc.db.getPendingContactRequest(contactPK)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	return svc.streamContactRequestUpdated(request, false, isNew)
+}
+
+// removeContactRequest removes a canceled request from the inbox and streams its removal
+func (svc *service) removeContactRequest(contactPK string) error {
+	request, err := svc.db.removePendingContactRequest(contactPK)
+	if err != nil || request == nil {
+		return err
+	}
+
+	return svc.streamContactRequestUpdated(request, true, false)
+}
+
+// addContactRequest adds a request received or sent to the inbox, isNew is set for the requests just received
+func (h *eventHandler) addContactRequest(contact *messengertypes.Contact, isNew bool) error {
+	created, err := h.db.addPendingContactRequest(pendingContactRequestFromContact(contact))
+	if err != nil || !created || h.svc == nil {
+		return err
+	}
+
+	return h.svc.dispatchContactRequestUpdated(contact.GetPublicKey(), isNew)
+}
+
+// removeContactRequest removes an accepted request from the inbox
+func (h *eventHandler) removeContactRequest(contactPK string) error {
+	request, err := h.db.removePendingContactRequest(contactPK)
+	if err != nil || request == nil || h.svc == nil {
+		return err
+	}
+
+	return h.svc.streamContactRequestUpdated(request, true, false)
+}
+
+func (svc *service) streamContactRequestUpdated(request *messengertypes.PendingContactRequest, removed bool, isNew bool) error {
+	unread, err := svc.db.countUnreadContactRequests()
+	if err != nil {
+		return err
+	}
+
+	return svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactRequestUpdated, &messengertypes.StreamEvent_ContactRequestUpdated{
+		Request:     request,
+		Removed:     removed,
+		UnreadCount: unread,
+	}, isNew)
+}
@@ -0,0 +1,94 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestPendingContactRequests(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for i, contact := range []*messengertypes.Contact{
+		{PublicKey: "contact_1", State: messengertypes.Contact_IncomingRequest, CreatedDate: 1},
+		{PublicKey: "contact_2", State: messengertypes.Contact_IncomingRequest, CreatedDate: 2},
+		{PublicKey: "contact_3", State: messengertypes.Contact_IncomingRequestIgnored, CreatedDate: 3},
+		{PublicKey: "contact_4", State: messengertypes.Contact_OutgoingRequestSent, CreatedDate: 4},
+		{PublicKey: "contact_5", State: messengertypes.Contact_OutgoingRequestSent, CreatedDate: 5, RequestStatus: messengertypes.Contact_RequestCanceled},
+		{PublicKey: "contact_6", State: messengertypes.Contact_Accepted, CreatedDate: 6},
+	} {
+		require.NoError(t, db.db.Create(contact).Error, i)
+	}
+
+	require.NoError(t, db.backfillPendingContactRequests())
+	require.NoError(t, db.backfillPendingContactRequests())
+
+	requests, err := db.getPendingContactRequests(messengertypes.PendingContactRequest_DirectionUndefined, true, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, requests, 4)
+	require.Equal(t, "contact_4", requests[0].GetContactPublicKey())
+	require.Equal(t, messengertypes.Contact_OutgoingRequestSent, requests[0].GetContact().GetState())
+
+	// the ignored requests are hidden by default
+	requests, err = db.getPendingContactRequests(messengertypes.PendingContactRequest_DirectionIncoming, false, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, requests, 2)
+
+	requests, err = db.getPendingContactRequests(messengertypes.PendingContactRequest_DirectionIncoming, false, &messengertypes.ContactRequestList_Cursor{CreatedDate: 2, ContactPublicKey: "contact_2"}, 10)
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	require.Equal(t, "contact_1", requests[0].GetContactPublicKey())
+
+	count, err := db.countUnreadContactRequests()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+
+	updated, err := db.markContactRequestsRead([]string{"contact_1", "contact_4"}, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{"contact_1"}, updated)
+
+	count, err = db.countUnreadContactRequests()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	// an ignored request is kept ignored across the replays through its contact
+	ignored, err := db.ignorePendingContactRequests([]string{"contact_2", "contact_3"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"contact_2"}, ignored)
+
+	contact, err := db.getContactByPK("contact_2")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_IncomingRequestIgnored, contact.GetState())
+
+	count, err = db.countUnreadContactRequests()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), count)
+
+	removed, err := db.removePendingContactRequest("contact_4")
+	require.NoError(t, err)
+	require.Equal(t, "contact_4", removed.GetContactPublicKey())
+
+	removed, err = db.removePendingContactRequest("contact_4")
+	require.NoError(t, err)
+	require.Nil(t, removed)
+}
+
+func TestContactRequestCursor(t *testing.T) {
+	token, err := encodeContactRequestCursor(&messengertypes.PendingContactRequest{ContactPublicKey: "contact_1", CreatedDate: 42})
+	require.NoError(t, err)
+
+	cursor, err := decodeContactRequestCursor(token)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), cursor.GetCreatedDate())
+	require.Equal(t, "contact_1", cursor.GetContactPublicKey())
+
+	cursor, err = decodeContactRequestCursor("")
+	require.NoError(t, err)
+	require.Nil(t, cursor)
+
+	_, err = decodeContactRequestCursor("not a cursor")
+	require.Error(t, err)
+}
@@ -0,0 +1,232 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The outgoing contact requests are kept until they are answered. While a request hasn't been delivered to the contact
+// it is sent again with a growing delay, the request stops being sent once it expires or is canceled. The status of the
+// request is copied to the contact so the clients can show it.
+
+const (
+	defaultContactRequestExpiry  = 7 * 24 * time.Hour
+	contactRequestCheckInterval  = 10 * time.Minute
+	contactRequestResendMinDelay = time.Hour
+	contactRequestResendMaxDelay = 24 * time.Hour
+)
+
+// contactRequestResendDelay doubles the delay before sending a request again each time it is sent
+func contactRequestResendDelay(resendCount int32) time.Duration {
+	delay := contactRequestResendMinDelay
+	for i := int32(0); i < resendCount && delay < contactRequestResendMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > contactRequestResendMaxDelay {
+		delay = contactRequestResendMaxDelay
+	}
+
+	return delay
+}
+
+func (svc *service) ContactRequestCancel(ctx context.Context, req *messengertypes.ContactRequestCancel_Request) (*messengertypes.ContactRequestCancel_Reply, error) {
+	pk := req.GetContactPublicKey()
+	if pk == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	outgoing, err := svc.db.getOutgoingContactRequest(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	if status := outgoing.GetStatus(); status != messengertypes.Contact_RequestPending && status != messengertypes.Contact_RequestExpired {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the contact request isn't pending"))
+	}
+
+	if err := svc.db.updateOutgoingContactRequest(pk, map[string]interface{}{
+		"status":           messengertypes.Contact_RequestCanceled,
+		"next_resend_date": 0,
+	}); err != nil {
+		return nil, err
+	}
+
+	contact, err := svc.refreshContactRequestStatus(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.removeContactRequest(pk); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequestCancel_Reply{Contact: contact}, nil
+}
+
+func (svc *service) ContactRequestResend(ctx context.Context, req *messengertypes.ContactRequestResend_Request) (*messengertypes.ContactRequestResend_Reply, error) {
+	pk := req.GetContactPublicKey()
+	if pk == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	outgoing, err := svc.db.getOutgoingContactRequest(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	contact, err := svc.db.getContactByPK(pk)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if contact.GetState() != messengertypes.Contact_OutgoingRequestEnqueued {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the contact request has already been delivered"))
+	}
+
+	// a request sent manually restarts its expiry and its delays
+	now := time.Now()
+	outgoing.Status = messengertypes.Contact_RequestPending
+	outgoing.ExpiresAt = timestampMs(now.Add(svc.contactRequestExpiry))
+	outgoing.ResendCount = 0
+	if err := svc.resendContactRequest(ctx, outgoing, now); err != nil {
+		return nil, err
+	}
+
+	if contact, err = svc.refreshContactRequestStatus(pk); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ContactRequestResend_Reply{Contact: contact}, nil
+}
+
+// trackOutgoingContactRequest keeps a request just sent to send it again until it is delivered, the caller must hold
+// the writer
+func (svc *service) trackOutgoingContactRequest(req *protocoltypes.ContactRequestSend_Request, now time.Time) error {
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	pk := b64EncodeBytes(req.GetContact().GetPK())
+	if err := svc.db.upsertOutgoingContactRequest(&messengertypes.OutgoingContactRequest{
+		ContactPublicKey: pk,
+		Request:          raw,
+		Status:           messengertypes.Contact_RequestPending,
+		CreatedDate:      timestampMs(now),
+		ExpiresAt:        timestampMs(now.Add(svc.contactRequestExpiry)),
+		NextResendDate:   timestampMs(now.Add(contactRequestResendDelay(0))),
+	}); err != nil {
+		return err
+	}
+
+	_, err = svc.refreshContactRequestStatus(pk)
+	return err
+}
+
+// resendContactRequest sends a request again and schedules the next attempt
+func (svc *service) resendContactRequest(ctx context.Context, outgoing *messengertypes.OutgoingContactRequest, now time.Time) error {
+	var req protocoltypes.ContactRequestSend_Request
+	if err := proto.Unmarshal(outgoing.GetRequest(), &req); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := svc.protocolClient.ContactRequestSend(ctx, &req); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	outgoing.ResendCount++
+	outgoing.NextResendDate = timestampMs(now.Add(contactRequestResendDelay(outgoing.ResendCount)))
+
+	return svc.db.upsertOutgoingContactRequest(outgoing)
+}
+
+// refreshContactRequestStatus updates the request status of a contact and streams it when it has changed
+func (svc *service) refreshContactRequestStatus(contactPK string) (*messengertypes.Contact, error) {
+	contact, updated, err := svc.db.syncContactRequestStatus(contactPK)
+	if err != nil || !updated {
+		return contact, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		svc.logger.Error("unable to dispatch contact update", zap.String("contact-pk", contactPK), zap.Error(err))
+	}
+
+	return contact, nil
+}
+
+func (svc *service) monitorContactRequests(ctx context.Context) {
+	ticker := time.NewTicker(contactRequestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := svc.checkOutgoingContactRequests(ctx, time.Now()); err != nil {
+			svc.logger.Error("unable to check the outgoing contact requests", zap.Error(err))
+		}
+	}
+}
+
+// checkOutgoingContactRequests expires the requests past their expiry date then sends again the ones due at now
+func (svc *service) checkOutgoingContactRequests(ctx context.Context, now time.Time) error {
+	defer svc.writer.enter()()
+
+	expired, err := svc.db.getExpiredOutgoingContactRequests(timestampMs(now))
+	if err != nil {
+		return err
+	}
+
+	for _, outgoing := range expired {
+		pk := outgoing.GetContactPublicKey()
+		if err := svc.db.updateOutgoingContactRequest(pk, map[string]interface{}{
+			"status":           messengertypes.Contact_RequestExpired,
+			"next_resend_date": 0,
+		}); err != nil {
+			return err
+		}
+
+		if _, err := svc.refreshContactRequestStatus(pk); err != nil {
+			return err
+		}
+	}
+
+	due, err := svc.db.getDueOutgoingContactRequests(timestampMs(now))
+	if err != nil {
+		return err
+	}
+
+	for _, outgoing := range due {
+		pk := outgoing.GetContactPublicKey()
+
+		// the request may have been delivered while its event wasn't handled yet
+		if contact, err := svc.db.getContactByPK(pk); err == nil && contact.GetState() != messengertypes.Contact_OutgoingRequestEnqueued {
+			if err := svc.db.updateOutgoingContactRequest(pk, map[string]interface{}{"next_resend_date": 0}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := svc.resendContactRequest(ctx, outgoing, now); err != nil {
+			svc.logger.Warn("unable to send the contact request again", zap.String("contact-pk", pk), zap.Error(err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_contactRequestResendDelay(t *testing.T) {
+	require.Equal(t, time.Hour, contactRequestResendDelay(0))
+	require.Equal(t, 2*time.Hour, contactRequestResendDelay(1))
+	require.Equal(t, 16*time.Hour, contactRequestResendDelay(4))
+	require.Equal(t, contactRequestResendMaxDelay, contactRequestResendDelay(5))
+	require.Equal(t, contactRequestResendMaxDelay, contactRequestResendDelay(100))
+}
+
+func Test_service_checkOutgoingContactRequests(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "contact_1", State: messengertypes.Contact_OutgoingRequestEnqueued}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "contact_2", State: messengertypes.Contact_OutgoingRequestSent}).Error)
+
+	for _, req := range []*messengertypes.OutgoingContactRequest{
+		{ContactPublicKey: "contact_1", Status: messengertypes.Contact_RequestPending, ExpiresAt: timestampMs(now.Add(-time.Minute)), NextResendDate: timestampMs(now.Add(time.Hour))},
+		{ContactPublicKey: "contact_2", Status: messengertypes.Contact_RequestPending, ExpiresAt: timestampMs(now.Add(time.Hour)), NextResendDate: timestampMs(now.Add(-time.Minute))},
+	} {
+		require.NoError(t, db.upsertOutgoingContactRequest(req))
+	}
+
+	// the request status is copied to the contact
+	contact, updated, err := db.syncContactRequestStatus("contact_2")
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, messengertypes.Contact_RequestPending, contact.GetRequestStatus())
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), contactRequestExpiry: defaultContactRequestExpiry}
+	require.NoError(t, svc.checkOutgoingContactRequests(ctx, now))
+
+	contact, err = db.getContactByPK("contact_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_RequestExpired, contact.GetRequestStatus())
+
+	// the delivered request isn't sent again
+	req, err := db.getOutgoingContactRequest("contact_2")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_RequestPending, req.GetStatus())
+	require.Zero(t, req.GetNextResendDate())
+
+	due, err := db.getDueOutgoingContactRequests(timestampMs(now.Add(48 * time.Hour)))
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	// only the delivered request can't be sent manually
+	_, err = svc.ContactRequestResend(ctx, &messengertypes.ContactRequestResend_Request{ContactPublicKey: "contact_2"})
+	require.Error(t, err)
+
+	reply, err := svc.ContactRequestCancel(ctx, &messengertypes.ContactRequestCancel_Request{ContactPublicKey: "contact_1"})
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_RequestCanceled, reply.GetContact().GetRequestStatus())
+
+	_, err = svc.ContactRequestCancel(ctx, &messengertypes.ContactRequestCancel_Request{ContactPublicKey: "contact_1"})
+	require.Error(t, err)
+
+	_, err = svc.ContactRequestCancel(ctx, &messengertypes.ContactRequestCancel_Request{ContactPublicKey: "contact_3"})
+	require.Error(t, err)
+}
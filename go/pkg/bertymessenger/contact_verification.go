@@ -0,0 +1,221 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	safetyNumberContext = "berty-safety-number-v1"
+	// a safety number is made of safetyNumberGroups groups of 5 digits, each one taken from 5 bytes of the fingerprint
+	safetyNumberGroups = 12
+)
+
+// safetyFingerprint derives the fingerprint of two accounts, the keys are sorted so both sides get the same one
+func safetyFingerprint(accountPK, contactPK []byte) []byte {
+	keys := [][]byte{accountPK, contactPK}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	h := sha512.New()
+	h.Write([]byte(safetyNumberContext))
+	for _, key := range keys {
+		h.Write(key)
+	}
+
+	return h.Sum(nil)
+}
+
+// formatSafetyNumber returns the decimal representation of a fingerprint, ie. "12345 67890 ..."
+func formatSafetyNumber(fingerprint []byte) string {
+	groups := make([]string, 0, safetyNumberGroups)
+	for idx := 0; idx < safetyNumberGroups && (idx+1)*5 <= len(fingerprint); idx++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], fingerprint[idx*5:(idx+1)*5])
+		groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// normalizeSafetyNumber removes the separators of a safety number typed by the user
+func normalizeSafetyNumber(safetyNumber string) string {
+	return strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, safetyNumber)
+}
+
+// contactDevicesHash identifies the key material of a contact, its account key and the keys of its devices
+func contactDevicesHash(contactPK string, devices []*messengertypes.Device) string {
+	keys := make([]string, len(devices))
+	for idx, device := range devices {
+		keys[idx] = device.GetPublicKey()
+	}
+	sort.Strings(keys)
+
+	hash := sha256.Sum256([]byte(contactPK + "\n" + strings.Join(keys, "\n")))
+	return b64EncodeBytes(hash[:])
+}
+
+// getContactVerificationCode returns the verification code of the account for a contact
+func (svc *service) getContactVerificationCode(contactPK string) (*messengertypes.Contact, *messengertypes.ContactVerificationCode, error) {
+	if contactPK == "" {
+		return nil, nil, errcode.ErrMissingInput
+	}
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	contact, err := svc.db.getContactByPK(contactPK)
+	if err != nil {
+		return nil, nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if contact.GetState() != messengertypes.Contact_Accepted {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the accepted contacts can be verified"))
+	}
+
+	accountPKBytes, err := b64DecodeBytes(acc.GetPublicKey())
+	if err != nil {
+		return nil, nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	contactPKBytes, err := b64DecodeBytes(contactPK)
+	if err != nil {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	return contact, &messengertypes.ContactVerificationCode{
+		PublicKey:        acc.GetPublicKey(),
+		ContactPublicKey: contactPK,
+		Fingerprint:      safetyFingerprint(accountPKBytes, contactPKBytes),
+	}, nil
+}
+
+func (svc *service) ContactVerificationGet(ctx context.Context, req *messengertypes.ContactVerificationGet_Request) (*messengertypes.ContactVerificationGet_Reply, error) {
+	contact, code, err := svc.getContactVerificationCode(req.GetContactPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := proto.Marshal(code)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	contact.ApplyNickname()
+
+	return &messengertypes.ContactVerificationGet_Reply{
+		SafetyNumber: formatSafetyNumber(code.GetFingerprint()),
+		QrPayload:    b64EncodeBytes(payload),
+		Contact:      contact,
+	}, nil
+}
+
+func (svc *service) ContactVerify(ctx context.Context, req *messengertypes.ContactVerify_Request) (*messengertypes.ContactVerify_Reply, error) {
+	if req.GetSafetyNumber() == "" && req.GetQrPayload() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	_, code, err := svc.getContactVerificationCode(req.GetContactPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if req.GetQrPayload() != "" {
+		// the scanned code has been generated by the contact for this account
+		payload, err := b64DecodeBytes(req.GetQrPayload())
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		scanned := &messengertypes.ContactVerificationCode{}
+		if err := proto.Unmarshal(payload, scanned); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if scanned.GetPublicKey() != code.GetContactPublicKey() || scanned.GetContactPublicKey() != code.GetPublicKey() || !bytes.Equal(scanned.GetFingerprint(), code.GetFingerprint()) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the verification code doesn't match"))
+		}
+	} else if normalizeSafetyNumber(req.GetSafetyNumber()) != normalizeSafetyNumber(formatSafetyNumber(code.GetFingerprint())) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the safety number doesn't match"))
+	}
+
+	devices, err := svc.db.getDevicesByMember(code.GetContactPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	contact, err := svc.db.setContactVerification(code.GetContactPublicKey(), messengertypes.Contact_VerificationVerified, contactDevicesHash(code.GetContactPublicKey(), devices), timestampMs(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	contact.ApplyNickname()
+
+	return &messengertypes.ContactVerify_Reply{Contact: contact}, nil
+}
+
+// checkContactKeyChanged flags a verified contact when its devices are not the ones it had when it was verified, a
+// warning is streamed so the user can verify the contact again
+func (h *eventHandler) checkContactKeyChanged(contactPK, devicePK string) error {
+	contact, err := h.db.getContactByPK(contactPK)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if contact.GetVerificationState() != messengertypes.Contact_VerificationVerified {
+		return nil
+	}
+
+	devices, err := h.db.getDevicesByMember(contactPK)
+	if err != nil {
+		return err
+	}
+
+	if contactDevicesHash(contactPK, devices) == contact.GetVerifiedDevicesHash() {
+		return nil
+	}
+
+	h.logger.Warn("the key material of a verified contact changed", zap.String("contact-pk", contactPK), zap.String("device-pk", devicePK))
+
+	if contact, err = h.db.setContactVerification(contactPK, messengertypes.Contact_VerificationKeyChanged, "", 0); err != nil {
+		return err
+	}
+
+	if h.svc == nil {
+		return nil
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		return err
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactKeyChanged, &messengertypes.StreamEvent_ContactKeyChanged{Contact: contact, DevicePublicKey: devicePK}, false)
+}
@@ -0,0 +1,70 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_formatSafetyNumber(t *testing.T) {
+	alice, bob := []byte("alice_public_key"), []byte("bob_public_key")
+
+	safetyNumber := formatSafetyNumber(safetyFingerprint(alice, bob))
+	require.Len(t, safetyNumber, safetyNumberGroups*6-1)
+	require.Len(t, normalizeSafetyNumber(safetyNumber), safetyNumberGroups*5)
+
+	// both sides get the same safety number
+	require.Equal(t, safetyNumber, formatSafetyNumber(safetyFingerprint(bob, alice)))
+	require.NotEqual(t, safetyNumber, formatSafetyNumber(safetyFingerprint(alice, []byte("eve_public_key"))))
+
+	require.Equal(t, "1234567890", normalizeSafetyNumber("12345 67890\n"))
+}
+
+func Test_contactDevicesHash(t *testing.T) {
+	devices := []*messengertypes.Device{{PublicKey: "device_1"}, {PublicKey: "device_2"}}
+	reversed := []*messengertypes.Device{{PublicKey: "device_2"}, {PublicKey: "device_1"}}
+
+	require.Equal(t, contactDevicesHash("contact_1", devices), contactDevicesHash("contact_1", reversed))
+	require.NotEqual(t, contactDevicesHash("contact_1", devices), contactDevicesHash("contact_1", devices[:1]))
+	require.NotEqual(t, contactDevicesHash("contact_1", devices), contactDevicesHash("contact_2", devices))
+}
+
+func Test_eventHandler_checkContactKeyChanged(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+
+	// unknown contacts are ignored
+	require.NoError(t, h.checkContactKeyChanged("member_1", "device_1"))
+
+	db.db.Create(&messengertypes.Contact{PublicKey: "contact_1", State: messengertypes.Contact_Accepted})
+	_, err := db.addDevice("device_1", "contact_1")
+	require.NoError(t, err)
+
+	devices, err := db.getDevicesByMember("contact_1")
+	require.NoError(t, err)
+
+	contact, err := db.setContactVerification("contact_1", messengertypes.Contact_VerificationVerified, contactDevicesHash("contact_1", devices), 10)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_VerificationVerified, contact.GetVerificationState())
+
+	// the known devices don't change the verification
+	require.NoError(t, h.checkContactKeyChanged("contact_1", "device_1"))
+	contact, err = db.getContactByPK("contact_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_VerificationVerified, contact.GetVerificationState())
+
+	_, err = db.addDevice("device_2", "contact_1")
+	require.NoError(t, err)
+	require.NoError(t, h.checkContactKeyChanged("contact_1", "device_2"))
+
+	contact, err = db.getContactByPK("contact_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_VerificationKeyChanged, contact.GetVerificationState())
+	require.Equal(t, int64(10), contact.GetVerifiedDate())
+}
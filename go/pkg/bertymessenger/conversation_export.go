@@ -0,0 +1,267 @@
+package bertymessenger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/streamutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+type conversationExport struct {
+	PublicKey   string                       `json:"public_key"`
+	DisplayName string                       `json:"display_name"`
+	ExportDate  string                       `json:"export_date"`
+	Messages    []*conversationExportMessage `json:"messages"`
+}
+
+type conversationExportMessage struct {
+	CID       string                     `json:"cid"`
+	Author    string                     `json:"author"`
+	AuthorKey string                     `json:"author_public_key,omitempty"`
+	IsMe      bool                       `json:"is_me"`
+	SentDate  string                     `json:"sent_date"`
+	Body      string                     `json:"body"`
+	Medias    []*conversationExportMedia `json:"medias,omitempty"`
+	// the values of the client extensions are base64 encoded
+	Extensions map[string][]byte `json:"extensions,omitempty"`
+}
+
+type conversationExportMedia struct {
+	CID      string `json:"cid"`
+	Filename string `json:"filename"`
+	MimeType string `json:"mime_type"`
+}
+
+var conversationExportHTML = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.DisplayName}}</title>
+</head>
+<body>
+<h1>{{.DisplayName}}</h1>
+<p>Exported on {{.ExportDate}}</p>
+{{range .Messages}}<div class="message">
+<p><strong>{{.Author}}</strong> <time>{{.SentDate}}</time></p>
+<p>{{.Body}}</p>
+{{range .Medias}}<p class="media">{{.Filename}} ({{.MimeType}})</p>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func formatExportDate(ms int64) string {
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+// buildConversationExport reads the messages of a conversation sent between since and until, the oldest first
+func buildConversationExport(db *dbWrapper, convPK string, since, until int64, now time.Time) (*conversationExport, []*messengertypes.Media, error) {
+	conv, err := db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	account, err := db.getAccount()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contactName := ""
+	if conv.GetType() == messengertypes.Conversation_ContactType {
+		if contact, err := db.getContactByPK(conv.GetContactPublicKey()); err == nil {
+			contactName = contact.GetDisplayName()
+		}
+	}
+
+	interactions, err := db.getConversationExportInteractions(convPK, since, until)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	export := &conversationExport{
+		PublicKey:   conv.GetPublicKey(),
+		DisplayName: conv.GetDisplayName(),
+		ExportDate:  now.UTC().Format(time.RFC3339),
+	}
+	if export.DisplayName == "" {
+		export.DisplayName = contactName
+	}
+
+	medias := []*messengertypes.Media(nil)
+	for _, i := range interactions {
+		payload, err := i.UnmarshalPayload()
+		if err != nil {
+			return nil, nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		message := &conversationExportMessage{
+			CID:        i.GetCID(),
+			AuthorKey:  i.GetMemberPublicKey(),
+			IsMe:       i.GetIsMe(),
+			SentDate:   formatExportDate(i.GetSentDate()),
+			Body:       payload.(*messengertypes.AppMessage_UserMessage).GetBody(),
+			Extensions: i.ExtensionsMap(),
+		}
+
+		switch {
+		case i.GetIsMe():
+			message.Author = account.GetDisplayName()
+		case i.GetMember() != nil:
+			message.Author = i.GetMember().GetDisplayName()
+		case i.GetImportedAuthor() != "":
+			message.Author = i.GetImportedAuthor()
+		default:
+			message.Author = contactName
+		}
+
+		for _, media := range i.GetMedias() {
+			message.Medias = append(message.Medias, &conversationExportMedia{
+				CID:      media.GetCID(),
+				Filename: media.GetFilename(),
+				MimeType: media.GetMimeType(),
+			})
+			medias = append(medias, media)
+		}
+
+		export.Messages = append(export.Messages, message)
+	}
+
+	return export, medias, nil
+}
+
+func writeConversationExport(w io.Writer, export *conversationExport, format messengertypes.ConversationExport_Format) error {
+	switch format {
+	case messengertypes.ConversationExport_FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(export); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+	case messengertypes.ConversationExport_FormatHTML:
+		if err := conversationExportHTML.Execute(w, export); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+	case messengertypes.ConversationExport_FormatText:
+		if _, err := fmt.Fprintf(w, "%s\nExported on %s\n\n", export.DisplayName, export.ExportDate); err != nil {
+			return errcode.ErrStreamWrite.Wrap(err)
+		}
+
+		for _, message := range export.Messages {
+			if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", message.SentDate, message.Author, message.Body); err != nil {
+				return errcode.ErrStreamWrite.Wrap(err)
+			}
+
+			for _, media := range message.Medias {
+				if _, err := fmt.Fprintf(w, "    attachment: %s (%s)\n", media.Filename, media.MimeType); err != nil {
+					return errcode.ErrStreamWrite.Wrap(err)
+				}
+			}
+		}
+
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", format))
+	}
+
+	return nil
+}
+
+type conversationExportStreamWriter struct {
+	server messengertypes.MessengerService_ConversationExportServer
+}
+
+func (w *conversationExportStreamWriter) Write(p []byte) (int, error) {
+	if err := w.server.Send(&messengertypes.ConversationExport_Reply{Document: append([]byte{}, p...)}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (svc *service) ConversationExport(req *messengertypes.ConversationExport_Request, server messengertypes.MessengerService_ConversationExportServer) error {
+	if req.GetConversationPublicKey() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	if _, ok := messengertypes.ConversationExport_Format_name[int32(req.GetFormat())]; !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", req.GetFormat()))
+	}
+
+	if req.GetSince() < 0 || req.GetUntil() < 0 || (req.GetUntil() != 0 && req.GetUntil() <= req.GetSince()) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid date range"))
+	}
+
+	export, medias, err := func() (*conversationExport, []*messengertypes.Media, error) {
+		defer svc.writer.enter()()
+
+		return buildConversationExport(svc.db, req.GetConversationPublicKey(), req.GetSince(), req.GetUntil(), time.Now())
+	}()
+	if err != nil {
+		return err
+	}
+
+	buffer := bufio.NewWriterSize(&conversationExportStreamWriter{server: server}, 64*1024)
+	if err := writeConversationExport(buffer, export, req.GetFormat()); err != nil {
+		return err
+	}
+
+	if err := buffer.Flush(); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	if !req.GetIncludeMedias() {
+		return nil
+	}
+
+	for _, media := range medias {
+		if !isMediaAvailable(media) {
+			continue
+		}
+
+		if err := svc.sendConversationExportMedia(media, server); err != nil {
+			// a missing media doesn't prevent the export of the other ones
+			svc.logger.Warn("unable to export media", zap.String("cid", media.GetCID()), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) sendConversationExportMedia(media *messengertypes.Media, server messengertypes.MessengerService_ConversationExportServer) error {
+	attachment, err := svc.mediaContentRetrieve(media)
+	if err != nil {
+		return errcode.ErrAttachmentRetrieve.Wrap(err)
+	}
+	defer attachment.Close()
+
+	if err := server.Send(&messengertypes.ConversationExport_Reply{Media: media}); err != nil {
+		return errcode.ErrStreamHeaderWrite.Wrap(err)
+	}
+
+	if err := streamutil.FuncSink(make([]byte, 64*1024), attachment, func(b []byte) error {
+		return server.Send(&messengertypes.ConversationExport_Reply{MediaBlock: b})
+	}); err != nil {
+		return errcode.ErrStreamSink.Wrap(err)
+	}
+
+	return nil
+}
+
+// isMediaAvailable checks if the content of a media is stored on this device
+func isMediaAvailable(media *messengertypes.Media) bool {
+	switch media.GetState() {
+	case messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache, messengertypes.Media_StatePrepared, messengertypes.Media_StateAttached:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,88 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_buildConversationExport(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	require.NoError(t, db.db.Model(&messengertypes.Account{}).Where("public_key = ?", "account_1").Update("display_name", "alice").Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, DisplayName: "friends"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Member{PublicKey: "member_2", ConversationPublicKey: "conv_1", DisplayName: "bob"}).Error)
+
+	addMessage := func(cid string, sentDate int64, isMe bool, body string) {
+		payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: body})
+		require.NoError(t, err)
+
+		memberPK := "member_2"
+		if isMe {
+			memberPK = "member_1"
+		}
+
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{
+			CID:                   cid,
+			Type:                  messengertypes.AppMessage_TypeUserMessage,
+			ConversationPublicKey: "conv_1",
+			MemberPublicKey:       memberPK,
+			IsMe:                  isMe,
+			SentDate:              sentDate,
+			Payload:               payload,
+		}).Error)
+	}
+
+	addMessage("msg_1", 1000, true, "hello")
+	addMessage("msg_2", 2000, false, "<b>hi</b>")
+	addMessage("msg_3", 3000, true, "bye")
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "ack_1", Type: messengertypes.AppMessage_TypeAcknowledge, ConversationPublicKey: "conv_1", TargetCID: "msg_1", SentDate: 1500}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "msg_2", Filename: "photo.jpg", MimeType: "image/jpeg", State: messengertypes.Media_StateDownloaded}).Error)
+
+	_, _, err := buildConversationExport(db, "conv_2", 0, 0, time.Now())
+	require.Error(t, err)
+
+	export, medias, err := buildConversationExport(db, "conv_1", 0, 0, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "friends", export.DisplayName)
+	require.Len(t, export.Messages, 3)
+	require.Equal(t, "msg_1", export.Messages[0].CID)
+	require.Equal(t, "alice", export.Messages[0].Author)
+	require.Equal(t, "bob", export.Messages[1].Author)
+	require.Equal(t, "1970-01-01T00:00:02Z", export.Messages[1].SentDate)
+	require.Len(t, export.Messages[1].Medias, 1)
+	require.Len(t, medias, 1)
+	require.Equal(t, "media_1", medias[0].GetCID())
+
+	// date range
+	export, medias, err = buildConversationExport(db, "conv_1", 1500, 3000, time.Now())
+	require.NoError(t, err)
+	require.Len(t, export.Messages, 1)
+	require.Equal(t, "msg_2", export.Messages[0].CID)
+	require.Len(t, medias, 1)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, writeConversationExport(buf, export, messengertypes.ConversationExport_FormatJSON))
+	decoded := &conversationExport{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), decoded))
+	require.Equal(t, export, decoded)
+
+	buf.Reset()
+	require.NoError(t, writeConversationExport(buf, export, messengertypes.ConversationExport_FormatHTML))
+	require.Contains(t, buf.String(), "&lt;b&gt;hi&lt;/b&gt;")
+	require.Contains(t, buf.String(), "photo.jpg")
+
+	buf.Reset()
+	require.NoError(t, writeConversationExport(buf, export, messengertypes.ConversationExport_FormatText))
+	require.Contains(t, buf.String(), "[1970-01-01T00:00:02Z] bob: <b>hi</b>\n")
+
+	require.Error(t, writeConversationExport(buf, export, 42))
+}
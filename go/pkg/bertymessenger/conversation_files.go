@@ -0,0 +1,157 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The files attached to the user messages are indexed by the event handler when the messages are stored, with their
+// name, their size and their sender, so the files shared in a conversation are listed and sorted without reading its
+// messages. The entries are removed with their message.
+
+// conversationFilesListMaxCount bounds the number of files returned by a page of ConversationFilesList
+const conversationFilesListMaxCount = 200
+
+// conversationFiles returns the index entries of the files attached to a user message, the thumbnails of its link
+// previews are left out
+func conversationFiles(i *messengertypes.Interaction, um *messengertypes.AppMessage_UserMessage, medias []*messengertypes.Media) []*messengertypes.ConversationFile {
+	thumbnails := map[string]bool{}
+	for _, preview := range um.GetLinkPreviews() {
+		thumbnails[preview.GetThumbnailCID()] = true
+	}
+
+	files := []*messengertypes.ConversationFile(nil)
+	for _, media := range medias {
+		if media.GetCID() == "" || thumbnails[media.GetCID()] {
+			continue
+		}
+
+		name := media.GetDisplayName()
+		if name == "" {
+			name = media.GetFilename()
+		}
+
+		files = append(files, &messengertypes.ConversationFile{
+			InteractionCID:        i.GetCID(),
+			MediaCID:              media.GetCID(),
+			ConversationPublicKey: i.GetConversationPublicKey(),
+			Name:                  name,
+			MimeType:              media.GetMimeType(),
+			Size_:                 media.GetSize_(),
+			MemberPublicKey:       i.GetMemberPublicKey(),
+			IsMe:                  i.GetIsMe(),
+			SentDate:              i.GetSentDate(),
+		})
+	}
+
+	return files
+}
+
+func (svc *service) ConversationFilesList(ctx context.Context, req *messengertypes.ConversationFilesList_Request) (*messengertypes.ConversationFilesList_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if _, ok := messengertypes.ConversationFilesList_Sort_name[int32(req.GetSort())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown sort %d", req.GetSort()))
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > conversationFilesListMaxCount {
+		count = conversationFilesListMaxCount
+	}
+
+	cursor, err := decodeConversationFileCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	if cursor != nil && cursor.GetSort() != req.GetSort() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the cursor was returned for another sort"))
+	}
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	// one more file is read to know whether there is a next page
+	files, err := svc.db.getConversationFiles(req.GetConversationPublicKey(), req.GetSort(), req.GetFilter(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ConversationFilesList_Reply{Files: files}
+	if len(files) > count {
+		reply.Files = files[:count]
+		if reply.NextCursor, err = encodeConversationFileCursor(req.GetSort(), files[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+// migrateConversationFiles indexes the files of the messages stored before the index was kept
+func migrateConversationFiles(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&messengertypes.Interaction{}) || !tx.Migrator().HasTable(&messengertypes.Media{}) {
+		return nil
+	}
+
+	if !tx.Migrator().HasTable(&messengertypes.ConversationFile{}) {
+		if err := tx.Migrator().CreateTable(&messengertypes.ConversationFile{}); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	db := newDBWrapper(tx, nil)
+	last := ""
+	for {
+		batch := []*messengertypes.Interaction(nil)
+		if err := tx.
+			Select("cid, payload, conversation_public_key, member_public_key, is_me, sent_date").
+			Where("type = ? AND (has_files = ? OR has_media = ?) AND cid > ?", messengertypes.AppMessage_TypeUserMessage, true, true, last).
+			Order("cid").
+			Limit(contentFlagsMigrationBatchSize).
+			Find(&batch).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		cids := make([]string, len(batch))
+		for idx, i := range batch {
+			cids[idx] = i.GetCID()
+		}
+		last = cids[len(cids)-1]
+
+		medias := []*messengertypes.Media(nil)
+		if err := tx.Where("interaction_cid IN ?", cids).Find(&medias).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		mediasByCID := map[string][]*messengertypes.Media{}
+		for _, media := range medias {
+			mediasByCID[media.GetInteractionCID()] = append(mediasByCID[media.GetInteractionCID()], media)
+		}
+
+		for _, i := range batch {
+			var um messengertypes.AppMessage_UserMessage
+			if err := proto.Unmarshal(i.GetPayload(), &um); err != nil {
+				continue
+			}
+
+			if err := db.addConversationFiles(conversationFiles(i, &um, mediasByCID[i.GetCID()])); err != nil {
+				return err
+			}
+		}
+	}
+}
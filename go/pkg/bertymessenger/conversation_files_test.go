@@ -0,0 +1,111 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_conversationFiles(t *testing.T) {
+	i := &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", SentDate: 10}
+	um := &messengertypes.AppMessage_UserMessage{LinkPreviews: []*messengertypes.LinkPreview{{ThumbnailCID: "media_thumbnail"}}}
+
+	files := conversationFiles(i, um, []*messengertypes.Media{
+		{CID: "media_1", Filename: "report.pdf", MimeType: "application/pdf", Size_: 100},
+		{CID: "media_2", Filename: "img_42.jpg", DisplayName: "holidays", MimeType: "image/jpeg"},
+		{CID: "media_thumbnail", MimeType: "image/png"},
+	})
+	require.Len(t, files, 2)
+	require.Equal(t, "report.pdf", files[0].GetName())
+	require.Equal(t, int64(100), files[0].GetSize_())
+	require.Equal(t, "member_1", files[0].GetMemberPublicKey())
+	require.Equal(t, "holidays", files[1].GetName())
+	require.Equal(t, int64(10), files[1].GetSentDate())
+}
+
+func TestConversationFilesList(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	require.NoError(t, db.addConversationFiles([]*messengertypes.ConversationFile{
+		{InteractionCID: "cid_1", MediaCID: "media_1", ConversationPublicKey: "conv_1", Name: "Report.pdf", MimeType: "application/pdf", Size_: 300, MemberPublicKey: "member_1", SentDate: 10},
+		{InteractionCID: "cid_1", MediaCID: "media_2", ConversationPublicKey: "conv_1", Name: "notes_100%.txt", MimeType: "text/plain", Size_: 100, MemberPublicKey: "member_1", SentDate: 10},
+		{InteractionCID: "cid_2", MediaCID: "media_3", ConversationPublicKey: "conv_1", Name: "photo.jpg", MimeType: "IMAGE/JPEG", Size_: 200, MemberPublicKey: "member_2", SentDate: 20},
+		{InteractionCID: "cid_3", MediaCID: "media_4", ConversationPublicKey: "conv_2", Name: "other.pdf", SentDate: 30},
+	}))
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	list := func(sort messengertypes.ConversationFilesList_Sort, filter *messengertypes.ConversationFilesList_Filter) []string {
+		names := []string(nil)
+		cursor := ""
+		for {
+			reply, err := svc.ConversationFilesList(ctx, &messengertypes.ConversationFilesList_Request{ConversationPublicKey: "conv_1", Sort: sort, Filter: filter, Count: 1, Cursor: cursor})
+			require.NoError(t, err)
+			for _, file := range reply.GetFiles() {
+				names = append(names, file.GetName())
+			}
+
+			if cursor = reply.GetNextCursor(); cursor == "" {
+				return names
+			}
+		}
+	}
+
+	// the pages follow each other whatever the sort, the ties included
+	require.Equal(t, []string{"photo.jpg", "notes_100%.txt", "Report.pdf"}, list(messengertypes.ConversationFilesList_SortNewest, nil))
+	require.Equal(t, []string{"Report.pdf", "notes_100%.txt", "photo.jpg"}, list(messengertypes.ConversationFilesList_SortOldest, nil))
+	require.Equal(t, []string{"Report.pdf", "photo.jpg", "notes_100%.txt"}, list(messengertypes.ConversationFilesList_SortLargest, nil))
+	require.Equal(t, []string{"notes_100%.txt", "photo.jpg", "Report.pdf"}, list(messengertypes.ConversationFilesList_SortSmallest, nil))
+	require.Equal(t, []string{"Report.pdf", "notes_100%.txt", "photo.jpg"}, list(messengertypes.ConversationFilesList_SortName, nil))
+
+	require.Equal(t, []string{"photo.jpg"}, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{MimeTypePrefix: "image/"}))
+	require.Equal(t, []string{"photo.jpg"}, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{MemberPublicKey: "member_2"}))
+	require.Equal(t, []string{"Report.pdf"}, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{Name: "REPORT"}))
+	require.Equal(t, []string{"notes_100%.txt"}, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{Name: "0%"}))
+	require.Empty(t, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{Name: "e_"}))
+	require.Equal(t, []string{"notes_100%.txt", "Report.pdf"}, list(messengertypes.ConversationFilesList_SortNewest, &messengertypes.ConversationFilesList_Filter{UntilDate: 20}))
+
+	reply, err := svc.ConversationFilesList(ctx, &messengertypes.ConversationFilesList_Request{ConversationPublicKey: "conv_1", Count: 1})
+	require.NoError(t, err)
+	_, err = svc.ConversationFilesList(ctx, &messengertypes.ConversationFilesList_Request{ConversationPublicKey: "conv_1", Sort: messengertypes.ConversationFilesList_SortName, Cursor: reply.GetNextCursor()})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.ConversationFilesList(ctx, &messengertypes.ConversationFilesList_Request{ConversationPublicKey: "conv_unknown"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	// the files are removed with their message
+	require.NoError(t, db.deleteInteractions([]string{"cid_1"}))
+	require.Equal(t, []string{"photo.jpg"}, list(messengertypes.ConversationFilesList_SortNewest, nil))
+}
+
+func Test_migrateConversationFiles(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "the report"})
+	require.NoError(t, err)
+
+	for _, model := range []interface{}{
+		&messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", Payload: payload, HasFiles: true, SentDate: 10},
+		&messengertypes.Interaction{CID: "cid_2", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", Payload: payload},
+		&messengertypes.Media{CID: "media_1", InteractionCID: "cid_1", Filename: "report.pdf"},
+	} {
+		require.NoError(t, db.db.Create(model).Error)
+	}
+
+	require.NoError(t, migrateConversationFiles(db.db))
+
+	files, err := db.getConversationFiles("conv_1", messengertypes.ConversationFilesList_SortNewest, nil, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "report.pdf", files[0].GetName())
+	require.Equal(t, int64(10), files[0].GetSentDate())
+}
@@ -0,0 +1,92 @@
+package bertymessenger
+
+import (
+	"io"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The log archives hold the entries of the logs of a conversation as stored by the protocol, they are encrypted with
+// the keys of the group. Unlike ConversationExport they are not meant to be read, a member restores them on another
+// node and the messenger rebuilds the conversation from them.
+
+func (svc *service) ConversationLogExport(req *messengertypes.ConversationLogExport_Request, server messengertypes.MessengerService_ConversationLogExportServer) error {
+	if req.GetConversationPublicKey() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	gpk, err := b64DecodeBytes(req.GetConversationPublicKey())
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cl, err := svc.protocolClient.GroupLogExport(server.Context(), &protocoltypes.GroupLogExport_Request{GroupPK: gpk})
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for {
+		chunk, err := cl.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if err := server.Send(&messengertypes.ConversationLogExport_Reply{ExportedData: chunk.GetExportedData()}); err != nil {
+			return errcode.ErrStreamWrite.Wrap(err)
+		}
+	}
+}
+
+func (svc *service) ConversationLogImport(server messengertypes.MessengerService_ConversationLogImportServer) error {
+	cl, err := svc.protocolClient.GroupLogImport(server.Context())
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if err := cl.Send(&protocoltypes.GroupLogImport_Request{ExportedData: req.GetExportedData()}); err != nil {
+			return errcode.ErrStreamWrite.Wrap(err)
+		}
+	}
+
+	reply, err := cl.CloseAndRecv()
+	if err != nil {
+		return errcode.ErrStreamCloseAndRecv.Wrap(err)
+	}
+
+	convPK := b64EncodeBytes(reply.GetGroupPK())
+
+	defer svc.writer.enter()()
+
+	// only the imported group is replayed
+	report := &messengertypes.ReplayReport{}
+	if err := svc.replayGroup(server.Context(), convPK, replayFilter{}, report); err != nil {
+		return err
+	}
+	report.ReplayedGroups++
+
+	if conv, err := svc.db.getConversationByPK(convPK); err == nil {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			svc.logger.Error("unable to dispatch notification for conversation", logGroup(convPK), zap.Error(err))
+		}
+	}
+
+	return server.SendAndClose(&messengertypes.ConversationLogImport_Reply{ConversationPublicKey: convPK, Report: report})
+}
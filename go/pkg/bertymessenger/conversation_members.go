@@ -0,0 +1,114 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The members of a large group are listed by pages instead of being streamed at once, the counts of the group are kept
+// on its conversation by the event handler so they are known without loading the members.
+
+// conversationMemberListMaxCount bounds the number of members returned by a page of ConversationMemberList
+const conversationMemberListMaxCount = 500
+
+func (svc *service) ConversationMemberList(ctx context.Context, req *messengertypes.ConversationMemberList_Request) (*messengertypes.ConversationMemberList_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > conversationMemberListMaxCount {
+		count = conversationMemberListMaxCount
+	}
+
+	cursor, err := decodeMemberCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	conv, err := svc.db.getConversationByPK(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation isn't a group"))
+	}
+
+	// one more member is read to know whether there is a next page
+	members, err := svc.db.getConversationMembers(conv.GetPublicKey(), req.GetFilter(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ConversationMemberList_Reply{
+		Members:            members,
+		MemberCount:        conv.GetMemberCount(),
+		AdminCount:         conv.GetAdminCount(),
+		PendingMemberCount: conv.GetPendingMemberCount(),
+	}
+	if len(members) > count {
+		reply.Members = members[:count]
+		if reply.NextCursor, err = encodeMemberCursor(members[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	applyNicknames(reply)
+
+	return reply, nil
+}
+
+// migrateConversationMemberCounts counts the members of the groups joined before the counts were kept
+func migrateConversationMemberCounts(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&messengertypes.Conversation{}) || !tx.Migrator().HasTable(&messengertypes.Member{}) {
+		return nil
+	}
+
+	for _, field := range []string{"MemberCount", "AdminCount", "PendingMemberCount"} {
+		if tx.Migrator().HasColumn(&messengertypes.Conversation{}, field) {
+			continue
+		}
+
+		if err := tx.Migrator().AddColumn(&messengertypes.Conversation{}, field); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	convPKs := []string(nil)
+	if err := tx.Model(&messengertypes.Conversation{}).
+		Where("type = ?", messengertypes.Conversation_MultiMemberType).
+		Pluck("public_key", &convPKs).
+		Error; err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(convPKs) == 0 {
+		return nil
+	}
+
+	rows, err := countConversationMembers(tx, convPKs)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if err := tx.Model(&messengertypes.Conversation{}).
+			Where("public_key = ?", row.ConversationPublicKey).
+			Updates(map[string]interface{}{
+				"member_count":         row.MemberCount,
+				"admin_count":          row.AdminCount,
+				"pending_member_count": row.PendingMemberCount,
+			}).
+			Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
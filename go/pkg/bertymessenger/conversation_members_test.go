@@ -0,0 +1,153 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func createTestGroupMembers(t *testing.T, db *dbWrapper) {
+	t.Helper()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	for _, m := range []*messengertypes.Member{
+		{PublicKey: "member_1", Role: messengertypes.Member_RoleAdmin, JoinedDate: 100, LastActivityDate: 1000},
+		{PublicKey: "member_2", JoinedDate: 200, LastActivityDate: 3000},
+		{PublicKey: "member_3", JoinedDate: 300},
+		{PublicKey: "member_4", JoinedDate: 400, JoinState: messengertypes.Member_JoinPending},
+		{PublicKey: "member_5", JoinedDate: 500, RemovedDate: 600},
+		{PublicKey: "member_6", JoinedDate: 600, JoinState: messengertypes.Member_JoinDenied},
+	} {
+		m.ConversationPublicKey = "conv_1"
+		require.NoError(t, db.db.Create(m).Error)
+	}
+}
+
+func Test_dbWrapper_updateConversationMemberCounts(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	createTestGroupMembers(t, db)
+
+	conv, updated, err := db.updateConversationMemberCounts("conv_1")
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, int64(3), conv.GetMemberCount())
+	require.Equal(t, int64(1), conv.GetAdminCount())
+	require.Equal(t, int64(1), conv.GetPendingMemberCount())
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), conv.GetMemberCount())
+
+	_, updated, err = db.updateConversationMemberCounts("conv_1")
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	// the event handler updates the counts as the members change
+	err = db.setMemberModeration(&messengertypes.Member{PublicKey: "member_1", ConversationPublicKey: "conv_1", RemovedDate: 700, RemovedClock: testClock(700)})
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	require.NoError(t, h.refreshConversationMembers(db, "conv_1"))
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), conv.GetMemberCount())
+	require.Equal(t, int64(0), conv.GetAdminCount())
+
+	// nothing is done for an unknown conversation
+	conv, updated, err = db.updateConversationMemberCounts("conv_2")
+	require.NoError(t, err)
+	require.False(t, updated)
+	require.Nil(t, conv)
+}
+
+func Test_dbWrapper_setMemberLastActivity(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	createTestGroupMembers(t, db)
+
+	require.NoError(t, db.setMemberLastActivity("member_2", "conv_1", 2000))
+	member, err := db.getMemberByPK("member_2", "conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(3000), member.GetLastActivityDate())
+
+	require.NoError(t, db.setMemberLastActivity("member_2", "conv_1", 4000))
+	member, err = db.getMemberByPK("member_2", "conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(4000), member.GetLastActivityDate())
+}
+
+func TestConversationMemberList(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	createTestGroupMembers(t, db)
+	_, _, err := db.updateConversationMemberCounts("conv_1")
+	require.NoError(t, err)
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+	list := func(filter *messengertypes.ConversationMemberList_Filter, count uint32, cursor string) ([]string, *messengertypes.ConversationMemberList_Reply) {
+		reply, err := svc.ConversationMemberList(ctx, &messengertypes.ConversationMemberList_Request{ConversationPublicKey: "conv_1", Filter: filter, Count: count, Cursor: cursor})
+		require.NoError(t, err)
+
+		pks := []string(nil)
+		for _, m := range reply.GetMembers() {
+			pks = append(pks, m.GetPublicKey())
+		}
+
+		return pks, reply
+	}
+
+	pks, reply := list(nil, 2, "")
+	require.Equal(t, []string{"member_1", "member_2"}, pks)
+	require.Equal(t, int64(3), reply.GetMemberCount())
+	require.Equal(t, int64(1), reply.GetAdminCount())
+	require.Equal(t, int64(1), reply.GetPendingMemberCount())
+	require.NotEmpty(t, reply.GetNextCursor())
+
+	pks, reply = list(nil, 2, reply.GetNextCursor())
+	require.Equal(t, []string{"member_3"}, pks)
+	require.Empty(t, reply.GetNextCursor())
+
+	pks, _ = list(&messengertypes.ConversationMemberList_Filter{IncludePending: true}, 0, "")
+	require.Equal(t, []string{"member_1", "member_2", "member_3", "member_4"}, pks)
+
+	pks, _ = list(&messengertypes.ConversationMemberList_Filter{AdminsOnly: true}, 0, "")
+	require.Equal(t, []string{"member_1"}, pks)
+
+	pks, _ = list(&messengertypes.ConversationMemberList_Filter{ActiveSince: 2000}, 0, "")
+	require.Equal(t, []string{"member_2"}, pks)
+
+	pks, _ = list(&messengertypes.ConversationMemberList_Filter{JoinedAfter: 100}, 0, "")
+	require.Equal(t, []string{"member_2", "member_3"}, pks)
+
+	_, err = svc.ConversationMemberList(ctx, &messengertypes.ConversationMemberList_Request{ConversationPublicKey: "conv_1", Cursor: "invalid"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.ConversationMemberList(ctx, &messengertypes.ConversationMemberList_Request{ConversationPublicKey: "conv_2"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+}
+
+func Test_migrateConversationMemberCounts(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	createTestGroupMembers(t, db)
+
+	require.NoError(t, migrateConversationMemberCounts(db.db))
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), conv.GetMemberCount())
+	require.Equal(t, int64(1), conv.GetAdminCount())
+	require.Equal(t, int64(1), conv.GetPendingMemberCount())
+}
@@ -0,0 +1,149 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// A group can't get rid of a leaked invitation, it is replaced by a new group instead. The invitation of the new group
+// is sent to the invited contacts and posted on the message log of the old group once its keys are rotated, so the
+// excluded members can't read it. The members of the old group are not linked to contacts, they join the new group
+// from the pointer by themselves. The old group is kept read only, the latest migration wins.
+
+func (h *eventHandler) handleAppMessageConversationMigrated(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_ConversationMigrated)
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring conversation migration not sent by an admin", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if payload.GetConversationPublicKey() == "" || payload.GetLink() == "" {
+		h.logger.Warn("ignoring invalid conversation migration", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeMigrated, "", payload.GetConversationPublicKey()); err != nil {
+		return nil, false, err
+	}
+
+	i, isNew, err := tx.addInteraction(*i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conv, updated, err := tx.setConversationMigration(i.GetConversationPublicKey(), payload.GetConversationPublicKey(), payload.GetLink(), i.GetSentDate())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if h.svc == nil {
+		return i, isNew, nil
+	}
+
+	if updated {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew); err != nil {
+		return nil, false, err
+	}
+
+	return i, isNew, nil
+}
+
+func (svc *service) ConversationMigrate(ctx context.Context, req *messengertypes.ConversationMigrate_Request) (*messengertypes.ConversationMigrate_Reply, error) {
+	old, err := func() (*messengertypes.Conversation, error) {
+		defer svc.writer.enter()()
+
+		return svc.getModeratedConversation(req.GetConversationPublicKey())
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	if old.GetMigratedToPublicKey() != "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("conversation already migrated to %s", old.GetMigratedToPublicKey()))
+	}
+
+	displayName := req.GetDisplayName()
+	if displayName == "" {
+		displayName = old.GetDisplayName()
+	}
+
+	// the creation takes the writer by itself
+	created, err := svc.ConversationCreate(ctx, &messengertypes.ConversationCreate_Request{
+		DisplayName:      displayName,
+		ContactsToInvite: req.GetContactsToInvite(),
+		MaxMembers:       old.GetMaxMembers(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(created.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	marker, err := svc.rotateConversationKeys(ctx, old, req.GetExcludeMemberPublicKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	gpk, err := b64DecodeBytes(old.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	payload, err := messengertypes.AppMessage_TypeConversationMigrated.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_ConversationMigrated{
+		ConversationPublicKey: conv.GetPublicKey(),
+		Link:                  conv.GetLink(),
+	})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+		return nil, errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	rep := &messengertypes.ConversationMigrate_Reply{
+		ConversationPublicKey: conv.GetPublicKey(),
+		InvitedCount:          int64(len(req.GetContactsToInvite())),
+		ExcludedCount:         marker.GetExcludedCount(),
+	}
+
+	if req.GetSeedHistory() {
+		bundle, err := svc.db.getHistoryBundle(old.GetPublicKey(), 0, historyShareMaxCount)
+		if err != nil {
+			return nil, err
+		}
+
+		// the bundle is imported by every member of the new group
+		if len(bundle.GetMessages()) > 0 {
+			if err := svc.sendHistoryBundle(ctx, conv.GetPublicKey(), "", bundle); err != nil {
+				return nil, err
+			}
+			rep.SeededCount = int64(len(bundle.GetMessages()))
+		}
+	}
+
+	svc.logger.Info("conversation migrated", logGroup(old.GetPublicKey()), zap.String("migrated-to-pk", conv.GetPublicKey()), zap.Int64("seeded", rep.GetSeededCount()))
+
+	return rep, nil
+}
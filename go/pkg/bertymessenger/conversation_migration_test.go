@@ -0,0 +1,59 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageConversationMigrated(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	migrate := func(cid, memberPK string, sentDate int64, migratedToPK string) *messengertypes.Conversation {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageConversationMigrated(db, &messengertypes.Interaction{CID: cid, Type: messengertypes.AppMessage_TypeConversationMigrated, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, SentDate: sentDate}, &messengertypes.AppMessage_ConversationMigrated{ConversationPublicKey: migratedToPK, Link: "link_" + migratedToPK})
+		require.NoError(t, err)
+
+		conv, err = db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv
+	}
+
+	// the migrations of the regular members are ignored
+	conv := migrate("cid_1", "member_1", 1000, "conv_2")
+	require.Empty(t, conv.GetMigratedToPublicKey())
+
+	_, err = db.getInteractionByCID("cid_1")
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	conv = migrate("cid_2", "member_admin", 2000, "conv_3")
+	require.Equal(t, "conv_3", conv.GetMigratedToPublicKey())
+	require.Equal(t, "link_conv_3", conv.GetMigratedToLink())
+	require.Equal(t, int64(2000), conv.GetMigratedDate())
+
+	// an older migration doesn't replace the current one
+	conv = migrate("cid_3", "member_admin", 1500, "conv_4")
+	require.Equal(t, "conv_3", conv.GetMigratedToPublicKey())
+
+	conv = migrate("cid_4", "member_admin", 3000, "conv_5")
+	require.Equal(t, "conv_5", conv.GetMigratedToPublicKey())
+
+	events, err := db.getGroupAuditEvents("conv_1", []messengertypes.GroupAuditEvent_Type{messengertypes.GroupAuditEvent_TypeMigrated}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+}
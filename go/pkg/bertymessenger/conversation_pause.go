@@ -0,0 +1,145 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// A conversation can be paused on this node to save the bandwidth of a noisy group, its group is deactivated in the
+// protocol and the streams of its events are stopped. The events sent while it is paused are handled by a replay of its
+// logs when it is resumed, they are added without being notified.
+
+// groupSubscription is the context of the streams of a group
+type groupSubscription struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// groupContext returns the context of the streams of a group, it is canceled when the conversation is paused
+func (svc *service) groupContext(gpkb []byte) context.Context {
+	svc.groupSubscriptionsMu.Lock()
+	defer svc.groupSubscriptionsMu.Unlock()
+
+	pk := b64EncodeBytes(gpkb)
+	if sub, ok := svc.groupSubscriptions[pk]; ok {
+		return sub.ctx
+	}
+
+	parent := svc.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	if svc.groupSubscriptions == nil {
+		svc.groupSubscriptions = map[string]*groupSubscription{}
+	}
+	svc.groupSubscriptions[pk] = &groupSubscription{ctx: ctx, cancel: cancel}
+
+	return ctx
+}
+
+// stopGroupSubscriptions stops the streams of a group, the next subscriptions get a new context
+func (svc *service) stopGroupSubscriptions(pk string) {
+	svc.groupSubscriptionsMu.Lock()
+	defer svc.groupSubscriptionsMu.Unlock()
+
+	if sub, ok := svc.groupSubscriptions[pk]; ok {
+		sub.cancel()
+		delete(svc.groupSubscriptions, pk)
+	}
+}
+
+func (svc *service) getPausableConversation(pk string) (*messengertypes.Conversation, []byte, error) {
+	if pk == "" {
+		return nil, nil, errcode.ErrMissingInput
+	}
+
+	gpkb, err := b64DecodeBytes(pk)
+	if err != nil {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	conv, err := svc.db.getConversationByPK(pk)
+	if err != nil {
+		return nil, nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() == messengertypes.Conversation_AccountType {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the account conversation can't be paused"))
+	}
+
+	return conv, gpkb, nil
+}
+
+func (svc *service) ConversationPause(ctx context.Context, req *messengertypes.ConversationPause_Request) (*messengertypes.ConversationPause_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, gpkb, err := svc.getPausableConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if conv.GetIsPaused() {
+		return &messengertypes.ConversationPause_Reply{Conversation: conv}, nil
+	}
+
+	if conv, err = svc.db.setConversationPaused(conv.GetPublicKey(), true); err != nil {
+		return nil, err
+	}
+
+	svc.stopGroupSubscriptions(conv.GetPublicKey())
+
+	if _, err := svc.protocolClient.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{GroupPK: gpkb}); err != nil {
+		svc.logger.Warn("failed to deactivate group", logGroup(conv.GetPublicKey()), zap.Error(err))
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		svc.logger.Error("unable to dispatch conversation update", logGroup(conv.GetPublicKey()), zap.Error(err))
+	}
+
+	return &messengertypes.ConversationPause_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) ConversationResume(ctx context.Context, req *messengertypes.ConversationResume_Request) (*messengertypes.ConversationResume_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, gpkb, err := svc.getPausableConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if !conv.GetIsPaused() {
+		return &messengertypes.ConversationResume_Reply{Conversation: conv}, nil
+	}
+
+	if _, err := svc.protocolClient.ActivateGroup(svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: gpkb}); err != nil {
+		return nil, errcode.ErrGroupActivate.Wrap(err)
+	}
+
+	// the events missed while paused are caught up before the live ones
+	report := &messengertypes.ReplayReport{}
+	if err := svc.replayGroup(ctx, conv.GetPublicKey(), replayFilter{}, report); err != nil {
+		return nil, err
+	}
+
+	if conv, err = svc.db.setConversationPaused(conv.GetPublicKey(), false); err != nil {
+		return nil, err
+	}
+
+	if err := svc.subscribeToGroup(gpkb); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		svc.logger.Error("unable to dispatch conversation update", logGroup(conv.GetPublicKey()), zap.Error(err))
+	}
+
+	return &messengertypes.ConversationResume_Reply{Conversation: conv, Report: report}, nil
+}
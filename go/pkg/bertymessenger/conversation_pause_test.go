@@ -0,0 +1,56 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_groupContext(t *testing.T) {
+	svc := &service{logger: zap.NewNop()}
+
+	gpkb := []byte("group_1")
+	ctx := svc.groupContext(gpkb)
+	require.Equal(t, ctx, svc.groupContext(gpkb))
+	require.NoError(t, ctx.Err())
+
+	// the streams of a paused group are stopped, the next subscription gets a new context
+	svc.stopGroupSubscriptions(b64EncodeBytes(gpkb))
+	require.Equal(t, context.Canceled, ctx.Err())
+
+	resumed := svc.groupContext(gpkb)
+	require.NoError(t, resumed.Err())
+
+	svc.stopGroupSubscriptions("unknown")
+}
+
+func Test_dbWrapper_setConversationPaused(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: b64EncodeBytes([]byte("account_1")), Type: messengertypes.Conversation_AccountType}).Error)
+
+	conv, err := db.setConversationPaused("conv_1", true)
+	require.NoError(t, err)
+	require.True(t, conv.GetIsPaused())
+
+	conv, err = db.setConversationPaused("conv_1", false)
+	require.NoError(t, err)
+	require.False(t, conv.GetIsPaused())
+
+	_, err = db.setConversationPaused("conv_2", true)
+	require.Error(t, err)
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+	// the account conversation isn't a group
+	_, err = svc.ConversationPause(context.Background(), &messengertypes.ConversationPause_Request{ConversationPublicKey: b64EncodeBytes([]byte("account_1"))})
+	require.Error(t, err)
+
+	_, err = svc.ConversationPause(context.Background(), &messengertypes.ConversationPause_Request{})
+	require.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The preferences of a group are set by its admins and shared with the members as group metadata, the clients render
+// the content warnings according to them and the primary language is the default target of the translations. The
+// groups hiding the observers leave them out of their member counts.
+
+func (h *eventHandler) handleAppMessageSetConversationPreferences(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetConversationPreferences)
+	if language := payload.GetPrimaryLanguage(); language != "" && !translationLanguageRegexp.MatchString(language) {
+		h.logger.Warn("ignoring preferences with an invalid language", zap.String("cid", i.GetCID()), zap.String("language", language))
+		return i, false, nil
+	}
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring preferences sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	details := fmt.Sprintf("language=%s content-warnings=%t hide-observers=%t", payload.GetPrimaryLanguage(), payload.GetContentWarningsEnabled(), payload.GetHideObservers())
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypePreferencesChanged, "", details); err != nil {
+		return nil, false, err
+	}
+
+	conv, updated, err := tx.setConversationPreferences(i.GetConversationPublicKey(), payload, interactionClock(i))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated {
+		if conv, _, err = tx.updateConversationMemberCounts(i.GetConversationPublicKey()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (svc *service) ConversationSetPreferences(ctx context.Context, req *messengertypes.ConversationSetPreferences_Request) (*messengertypes.ConversationSetPreferences_Reply, error) {
+	if language := req.GetPrimaryLanguage(); language != "" && !translationLanguageRegexp.MatchString(language) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid language %q", language))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetConversationPreferences, &messengertypes.AppMessage_SetConversationPreferences{
+		PrimaryLanguage:        req.GetPrimaryLanguage(),
+		ContentWarningsEnabled: req.GetContentWarningsEnabled(),
+		HideObservers:          req.GetHideObservers(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetPreferences_Reply{}, nil
+}
@@ -0,0 +1,54 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageSetConversationPreferences(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	set := func(cid, memberPK string, lamportTime uint64, preferences *messengertypes.AppMessage_SetConversationPreferences) *messengertypes.Conversation {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageSetConversationPreferences(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, LamportTime: lamportTime}, preferences)
+		require.NoError(t, err)
+
+		conv, err = db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv
+	}
+
+	// the preferences of the regular members are ignored
+	conv := set("cid_1", "member_1", 1, &messengertypes.AppMessage_SetConversationPreferences{PrimaryLanguage: "fr"})
+	require.Empty(t, conv.GetPrimaryLanguage())
+
+	conv = set("cid_2", "member_admin", 3, &messengertypes.AppMessage_SetConversationPreferences{PrimaryLanguage: "pt-BR", ContentWarningsEnabled: true})
+	require.Equal(t, "pt-BR", conv.GetPrimaryLanguage())
+	require.True(t, conv.GetContentWarningsEnabled())
+
+	// an older change doesn't replace the current preferences
+	conv = set("cid_3", "member_admin", 2, &messengertypes.AppMessage_SetConversationPreferences{PrimaryLanguage: "de"})
+	require.Equal(t, "pt-BR", conv.GetPrimaryLanguage())
+
+	conv = set("cid_4", "member_admin", 4, &messengertypes.AppMessage_SetConversationPreferences{PrimaryLanguage: "not a language"})
+	require.Equal(t, "pt-BR", conv.GetPrimaryLanguage())
+
+	conv = set("cid_5", "member_admin", 5, &messengertypes.AppMessage_SetConversationPreferences{})
+	require.Empty(t, conv.GetPrimaryLanguage())
+	require.False(t, conv.GetContentWarningsEnabled())
+}
@@ -0,0 +1,100 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The retention of a group is suggested by its admins and shared with the members as group metadata. The members apply
+// it by default, each device can replace it locally, and the shortest of the retention of the conversation and of the
+// account policy is used by the pruner. The messages older than the retention of the conversation are not stored again
+// when the logs are replayed.
+
+func (h *eventHandler) handleAppMessageSetConversationRetention(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetConversationRetention)
+	if payload.GetMaxAge() < 0 {
+		h.logger.Warn("ignoring a negative retention", zap.String("cid", i.GetCID()), zap.Int64("max-age", payload.GetMaxAge()))
+		return i, false, nil
+	}
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring retention sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	details := strconv.FormatInt(payload.GetMaxAge(), 10)
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeRetentionChanged, "", details); err != nil {
+		return nil, false, err
+	}
+
+	conv, updated, err := tx.setConversationRetention(i.GetConversationPublicKey(), payload.GetMaxAge(), interactionClock(i))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+
+		h.svc.triggerRetention()
+	}
+
+	return i, false, nil
+}
+
+func (svc *service) ConversationSetRetention(ctx context.Context, req *messengertypes.ConversationSetRetention_Request) (*messengertypes.ConversationSetRetention_Reply, error) {
+	if req.GetMaxAge() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the retention can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetConversationRetention, &messengertypes.AppMessage_SetConversationRetention{
+		MaxAge: req.GetMaxAge(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetRetention_Reply{}, nil
+}
+
+func (svc *service) ConversationSetLocalRetention(ctx context.Context, req *messengertypes.ConversationSetLocalRetention_Request) (*messengertypes.ConversationSetLocalRetention_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetMaxAge() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the retention can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.setConversationLocalRetention(req.GetConversationPublicKey(), req.GetEnabled(), req.GetMaxAge())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	svc.triggerRetention()
+
+	return &messengertypes.ConversationSetLocalRetention_Reply{Conversation: conv}, nil
+}
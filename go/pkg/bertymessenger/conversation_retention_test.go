@@ -0,0 +1,108 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageSetConversationRetention(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	set := func(cid, memberPK string, lamportTime uint64, maxAge int64) *messengertypes.Conversation {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageSetConversationRetention(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, LamportTime: lamportTime}, &messengertypes.AppMessage_SetConversationRetention{MaxAge: maxAge})
+		require.NoError(t, err)
+
+		conv, err = db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv
+	}
+
+	conv := set("cid_1", "member_1", 1, 1000)
+	require.Zero(t, conv.GetRetentionMaxAge())
+
+	conv = set("cid_2", "member_admin", 3, 7000)
+	require.Equal(t, int64(7000), conv.GetRetentionMaxAge())
+
+	// an older change doesn't replace the current retention
+	conv = set("cid_3", "member_admin", 2, 1000)
+	require.Equal(t, int64(7000), conv.GetRetentionMaxAge())
+
+	conv = set("cid_4", "member_admin", 4, -1)
+	require.Equal(t, int64(7000), conv.GetRetentionMaxAge())
+
+	audit, err := db.getGroupAuditEvents("conv_1", []messengertypes.GroupAuditEvent_Type{messengertypes.GroupAuditEvent_TypeRetentionChanged}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, audit, 2)
+
+	// the local override replaces the suggestion until it is disabled
+	conv, err = db.setConversationLocalRetention("conv_1", true, 0)
+	require.NoError(t, err)
+	require.True(t, conv.GetLocalRetentionSet())
+	require.Zero(t, conversationRetentionMaxAge(conv))
+
+	conv, err = db.setConversationLocalRetention("conv_1", false, 3000)
+	require.NoError(t, err)
+	require.False(t, conv.GetLocalRetentionSet())
+	require.Zero(t, conv.GetLocalRetentionMaxAge())
+	require.Equal(t, int64(7000), conversationRetentionMaxAge(conv))
+
+	_, err = db.setConversationLocalRetention("conv_2", true, 0)
+	require.Error(t, err)
+}
+
+func Test_effectiveRetentionMaxAge(t *testing.T) {
+	require.Zero(t, effectiveRetentionMaxAge(0, &messengertypes.Conversation{}))
+	require.Equal(t, int64(5000), effectiveRetentionMaxAge(5000, &messengertypes.Conversation{}))
+	require.Equal(t, int64(3000), effectiveRetentionMaxAge(0, &messengertypes.Conversation{RetentionMaxAge: 3000}))
+
+	// the shortest retention is used
+	require.Equal(t, int64(3000), effectiveRetentionMaxAge(5000, &messengertypes.Conversation{RetentionMaxAge: 3000}))
+	require.Equal(t, int64(2000), effectiveRetentionMaxAge(2000, &messengertypes.Conversation{RetentionMaxAge: 3000}))
+
+	// the local override only replaces the suggestion of the admins
+	require.Equal(t, int64(5000), effectiveRetentionMaxAge(5000, &messengertypes.Conversation{RetentionMaxAge: 3000, LocalRetentionSet: true}))
+	require.Equal(t, int64(1000), effectiveRetentionMaxAge(0, &messengertypes.Conversation{RetentionMaxAge: 3000, LocalRetentionSet: true, LocalRetentionMaxAge: 1000}))
+}
+
+func Test_retentionCutoff(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	cutoff, err := retentionCutoff(db, "conv_1", 10000)
+	require.NoError(t, err)
+	require.Zero(t, cutoff)
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", PrunedBefore: 2000}).Error)
+
+	cutoff, err = retentionCutoff(db, "conv_1", 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), cutoff)
+
+	_, _, err = db.setConversationRetention("conv_1", 7000, "clock_1")
+	require.NoError(t, err)
+
+	cutoff, err = retentionCutoff(db, "conv_1", 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(3000), cutoff)
+
+	// the date of the pruned messages is kept when the retention is longer
+	cutoff, err = retentionCutoff(db, "conv_1", 8000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), cutoff)
+}
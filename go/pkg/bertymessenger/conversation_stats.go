@@ -0,0 +1,58 @@
+package bertymessenger
+
+import (
+	"context"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	// statsResponseMaxDelay bounds the delay of an answer, a message received later starts a new discussion
+	statsResponseMaxDelay = 24 * time.Hour
+	statsWeekSlots        = 7 * 24
+)
+
+// The statistics of the conversations are aggregated by the event handler as the user messages are added, they are
+// rebuilt with the database by the replay. The conversations created before the counters existed are aggregated once
+// from their interactions when their statistics are first requested.
+
+// statsActivitySlot returns the hour of the week of a date in the local time of the device
+func statsActivitySlot(sentDate int64) int32 {
+	t := time.Unix(0, sentDate*int64(time.Millisecond)).Local()
+	return int32(t.Weekday())*24 + int32(t.Hour())
+}
+
+func (svc *service) ConversationStats(ctx context.Context, req *messengertypes.ConversationStats_Request) (*messengertypes.ConversationStats_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	stats, err := svc.db.getConversationCounters(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if stats != nil {
+		return stats, nil
+	}
+
+	if err := svc.db.rebuildConversationCounters(req.GetConversationPublicKey()); err != nil {
+		return nil, err
+	}
+
+	if stats, err = svc.db.getConversationCounters(req.GetConversationPublicKey()); err != nil {
+		return nil, err
+	} else if stats == nil {
+		stats = &messengertypes.ConversationStats_Reply{Hours: make([]int64, 24), Weekdays: make([]int64, 7)}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,93 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_statsActivitySlot(t *testing.T) {
+	// 2021-01-03 is a sunday
+	require.Equal(t, int32(10), statsActivitySlot(timestampMs(time.Date(2021, 1, 3, 10, 30, 0, 0, time.Local))))
+	require.Equal(t, int32(6*24+23), statsActivitySlot(timestampMs(time.Date(2021, 1, 9, 23, 59, 0, 0, time.Local))))
+}
+
+func Test_dbWrapper_addConversationCounters(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	stats, err := db.getConversationCounters("conv_1")
+	require.NoError(t, err)
+	require.Nil(t, stats)
+
+	base := time.Date(2021, 1, 4, 9, 0, 0, 0, time.Local)
+	at := func(d time.Duration) int64 { return timestampMs(base.Add(d)) }
+
+	for _, m := range []struct {
+		member string
+		date   int64
+		medias []*messengertypes.Media
+	}{
+		{member: "member_1", date: at(0)},
+		{member: "member_2", date: at(10 * time.Minute), medias: []*messengertypes.Media{{Size_: 100}, {Size_: 50}}},
+		{member: "member_2", date: at(11 * time.Minute)},
+		{member: "member_1", date: at(41 * time.Minute)},
+		// a message received the day after starts a new discussion
+		{member: "member_2", date: at(48 * time.Hour)},
+	} {
+		require.NoError(t, db.addConversationCounters(&messengertypes.Interaction{ConversationPublicKey: "conv_1", MemberPublicKey: m.member, SentDate: m.date}, m.medias))
+	}
+
+	stats, err = db.getConversationCounters("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), stats.GetMessageCount())
+	require.Equal(t, int64(2), stats.GetMediaCount())
+	require.Equal(t, int64(150), stats.GetMediaSize())
+	require.Equal(t, at(0), stats.GetFirstMessageDate())
+	require.Equal(t, at(48*time.Hour), stats.GetLastMessageDate())
+	require.Equal(t, int64(5), stats.GetHours()[9])
+	require.Equal(t, int64(4), stats.GetWeekdays()[time.Monday])
+	require.Equal(t, int64(1), stats.GetWeekdays()[time.Wednesday])
+
+	require.Len(t, stats.GetMembers(), 2)
+	require.Equal(t, "member_2", stats.GetMembers()[0].GetMemberPublicKey())
+	require.Equal(t, int64(3), stats.GetMembers()[0].GetMessageCount())
+	require.Equal(t, int64(1), stats.GetMembers()[0].GetResponseCount())
+	require.Equal(t, (10 * time.Minute).Milliseconds(), stats.GetMembers()[0].GetAverageResponseTime())
+	require.Equal(t, int64(1), stats.GetMembers()[1].GetResponseCount())
+	require.Equal(t, (30 * time.Minute).Milliseconds(), stats.GetMembers()[1].GetAverageResponseTime())
+}
+
+func Test_dbWrapper_rebuildConversationCounters(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", MemberPublicKey: "member_1", SentDate: 1000, Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_2", MemberPublicKey: "member_2", SentDate: 3000, Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_3", MemberPublicKey: "member_2", SentDate: 4000, Type: messengertypes.AppMessage_TypeUserReaction},
+	} {
+		i.ConversationPublicKey = "conv_1"
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "cid_2", Size_: 42}).Error)
+
+	// the counters are replaced
+	require.NoError(t, db.addConversationCounters(&messengertypes.Interaction{ConversationPublicKey: "conv_1", MemberPublicKey: "member_3"}, nil))
+	require.NoError(t, db.rebuildConversationCounters("conv_1"))
+
+	stats, err := db.getConversationCounters("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.GetMessageCount())
+	require.Equal(t, int64(42), stats.GetMediaSize())
+	require.Len(t, stats.GetMembers(), 2)
+
+	for _, member := range stats.GetMembers() {
+		if member.GetMemberPublicKey() == "member_2" {
+			require.Equal(t, int64(2000), member.GetAverageResponseTime())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The groups without a display name are shown with the names of their members, the fallback name is computed here
+// and cached in the conversation so all the clients show the same one. It lists the names of the first members in the
+// alphabetical order, the nicknames replacing the display names, followed by the count of the other members.
+
+// fallbackDisplayNameMaxMembers is the number of member names in the fallback name of a group
+const fallbackDisplayNameMaxMembers = 3
+
+// conversationFallbackDisplayName builds the fallback name of a group from its members, the local member, the members
+// who left or were removed, the pending members and the members without a name are left out
+func conversationFallbackDisplayName(members []*messengertypes.Member) string {
+	names := []string(nil)
+	for _, member := range members {
+		if member.GetIsMe() || member.GetRemovedDate() != 0 || member.GetJoinState() != messengertypes.Member_JoinApproved {
+			continue
+		}
+
+		name := member.GetDisplayName()
+		if nickname := member.GetNickname(); nickname != "" {
+			name = nickname
+		}
+
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	if len(names) <= fallbackDisplayNameMaxMembers {
+		return strings.Join(names, ", ")
+	}
+
+	return fmt.Sprintf("%s +%d", strings.Join(names[:fallbackDisplayNameMaxMembers], ", "), len(names)-fallbackDisplayNameMaxMembers)
+}
+
+// updateConversationFallbackDisplayName computes again the fallback name of a group, it returns whether it changed,
+// nothing is done for the conversations not known yet
+func (d *dbWrapper) updateConversationFallbackDisplayName(convPK string) (*messengertypes.Conversation, bool, error) {
+	conv, err := d.getConversationByPK(convPK)
+	if err == gorm.ErrRecordNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return conv, false, nil
+	}
+
+	members, err := d.getMembersByConversation(convPK)
+	if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	name := conversationFallbackDisplayName(members)
+	if name == conv.GetFallbackDisplayName() {
+		return conv, false, nil
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Update("fallback_display_name", name).Error; err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	conv.FallbackDisplayName = name
+
+	return conv, true, nil
+}
+
+// fillConversationsFallbackDisplayName computes the fallback name of the groups which don't have one, ie. the groups
+// joined before the names were computed or restored from a backup
+func (d *dbWrapper) fillConversationsFallbackDisplayName() error {
+	pks := []string(nil)
+	if err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Where("type = ? AND COALESCE(fallback_display_name, '') = ''", messengertypes.Conversation_MultiMemberType).
+		Pluck("public_key", &pks).
+		Error; err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, pk := range pks {
+		if _, _, err := d.updateConversationFallbackDisplayName(pk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// refreshConversationMembers is called once the members of a group changed, the conversation is streamed when its
+// fallback name or its member counts changed
+func (h *eventHandler) refreshConversationMembers(tx *dbWrapper, convPK string) error {
+	_, renamed, err := tx.updateConversationFallbackDisplayName(convPK)
+	if err != nil {
+		return err
+	}
+
+	conv, counted, err := tx.updateConversationMemberCounts(convPK)
+	if err != nil {
+		return err
+	}
+
+	if !(renamed || counted) || h.svc == nil {
+		return nil
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false)
+}
@@ -0,0 +1,68 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_conversationFallbackDisplayName(t *testing.T) {
+	require.Empty(t, conversationFallbackDisplayName(nil))
+
+	members := []*messengertypes.Member{
+		{PublicKey: "member_me", DisplayName: "me", IsMe: true},
+		{PublicKey: "member_1", DisplayName: "dave"},
+		{PublicKey: "member_2", DisplayName: "bob"},
+		{PublicKey: "member_3", DisplayName: "carol", Nickname: "alice"},
+		{PublicKey: "member_4", DisplayName: "removed", RemovedDate: 1000},
+		{PublicKey: "member_5", DisplayName: "pending", JoinState: messengertypes.Member_JoinPending},
+		{PublicKey: "member_6"},
+	}
+	require.Equal(t, "alice, bob, dave", conversationFallbackDisplayName(members))
+
+	members = append(members, &messengertypes.Member{PublicKey: "member_7", DisplayName: "erin"}, &messengertypes.Member{PublicKey: "member_8", DisplayName: "frank"})
+	require.Equal(t, "alice, bob, dave +2", conversationFallbackDisplayName(members))
+}
+
+func Test_eventHandler_refreshConversationMembers(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", Type: messengertypes.Conversation_ContactType}).Error)
+	_, err := db.addMember("member_1", "conv_1", "bob", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_2", "conv_2", "carol", "", false, false)
+	require.NoError(t, err)
+
+	// the groups joined before the fallback names are filled on start
+	require.NoError(t, db.fillConversationsFallbackDisplayName())
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, "bob", conv.GetFallbackDisplayName())
+
+	conv, err = db.getConversationByPK("conv_2")
+	require.NoError(t, err)
+	require.Empty(t, conv.GetFallbackDisplayName())
+
+	_, err = db.addMember("member_3", "conv_1", "alice", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	require.NoError(t, h.refreshConversationMembers(db, "conv_1"))
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, "alice, bob", conv.GetFallbackDisplayName())
+
+	_, updated, err := db.updateConversationFallbackDisplayName("conv_1")
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	// nothing is done for an unknown conversation
+	require.NoError(t, h.refreshConversationMembers(db, "conv_3"))
+}
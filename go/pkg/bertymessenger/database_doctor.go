@@ -0,0 +1,321 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// checkDatabase lists the interactions and the medias which are not attached to a known record
+func checkDatabase(db *dbWrapper) ([]*messengertypes.DatabaseDoctor_Issue, error) {
+	account, err := db.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	interactions, err := db.getOrphanedInteractions(account.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	medias, err := db.getDanglingMedias()
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []*messengertypes.DatabaseDoctor_Issue(nil)
+	for _, i := range interactions {
+		issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+			Kind:                  messengertypes.DatabaseDoctor_KindOrphanedInteraction,
+			CID:                   i.GetCID(),
+			ConversationPublicKey: i.GetConversationPublicKey(),
+			Detail:                fmt.Sprintf("%s interaction of an unknown conversation", i.GetType()),
+		})
+	}
+
+	for _, media := range medias {
+		issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+			Kind:   messengertypes.DatabaseDoctor_KindDanglingMedia,
+			CID:    media.GetCID(),
+			Detail: fmt.Sprintf("media attached to the unknown interaction %s", media.GetInteractionCID()),
+		})
+	}
+
+	skipped, err := getReplaySkippedGroupIssues(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(issues, skipped...), nil
+}
+
+// verifyMediaChecksum reads the content of a media to compare it with its checksum
+func (svc *service) verifyMediaChecksum(media *messengertypes.Media) (*messengertypes.DatabaseDoctor_Issue, error) {
+	attachment, err := svc.mediaContentRetrieve(media)
+	if err != nil {
+		return nil, errcode.ErrAttachmentRetrieve.Wrap(err)
+	}
+	defer attachment.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, attachment); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != media.GetChecksum() {
+		return &messengertypes.DatabaseDoctor_Issue{
+			Kind:   messengertypes.DatabaseDoctor_KindChecksumMismatch,
+			CID:    media.GetCID(),
+			Detail: fmt.Sprintf("expected checksum %s, got %s", media.GetChecksum(), checksum),
+		}, nil
+	}
+
+	return nil, nil
+}
+
+func (svc *service) DatabaseDoctor(ctx context.Context, req *messengertypes.DatabaseDoctor_Request) (*messengertypes.DatabaseDoctor_Reply, error) {
+	issues, medias, err := func() ([]*messengertypes.DatabaseDoctor_Issue, []*messengertypes.Media, error) {
+		defer svc.writer.enter()()
+
+		issues, err := checkDatabase(svc.db)
+		if err != nil || !req.GetVerifyChecksums() {
+			return issues, nil, err
+		}
+
+		medias, err := svc.db.getChecksummedMedias()
+		return issues, medias, err
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	// the medias are read without holding the lock, it may take a while
+	for _, media := range medias {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		issue, err := svc.verifyMediaChecksum(media)
+		if err != nil {
+			svc.logger.Warn("unable to verify media checksum", zap.String("cid", media.GetCID()), zap.Error(err))
+			continue
+		}
+
+		if issue != nil {
+			issues = append(issues, issue)
+		}
+	}
+
+	return &messengertypes.DatabaseDoctor_Reply{Issues: issues}, nil
+}
+
+func (svc *service) DatabaseRepair(ctx context.Context, req *messengertypes.DatabaseRepair_Request) (*messengertypes.DatabaseRepair_Reply, error) {
+	if req.GetReplayGroupPK() == "" && !req.GetReplayAllGroups() && !req.GetRemoveOrphans() {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetReplayGroupPK() != "" && req.GetReplayAllGroups() {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a group can't be replayed with all the groups"))
+	}
+
+	if _, ok := messengertypes.DatabaseRepair_ReplayScope_name[int32(req.GetReplayScope())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown replay scope %d", req.GetReplayScope()))
+	}
+
+	if req.GetSince() < 0 || req.GetUntil() < 0 || (req.GetUntil() != 0 && req.GetSince() > req.GetUntil()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid replay window"))
+	}
+
+	filter := replayFilter{scope: req.GetReplayScope(), window: ReplayOptions{FullFidelity: req.GetFullFidelity()}}
+	if req.GetSince() != 0 {
+		filter.window.Since = time.Unix(0, req.GetSince()*int64(time.Millisecond))
+	}
+	if req.GetUntil() != 0 {
+		filter.window.Until = time.Unix(0, req.GetUntil()*int64(time.Millisecond))
+	}
+
+	defer svc.writer.enter()()
+
+	reply := &messengertypes.DatabaseRepair_Reply{}
+
+	groupPKs := []string(nil)
+	switch {
+	case req.GetReplayGroupPK() != "":
+		groupPKs = []string{req.GetReplayGroupPK()}
+	case req.GetReplayAllGroups():
+		var err error
+		if groupPKs, err = svc.getReplayedGroups(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(groupPKs) > 0 {
+		reply.Report = &messengertypes.ReplayReport{}
+	}
+
+	for _, groupPK := range groupPKs {
+		if err := svc.replayGroup(ctx, groupPK, filter, reply.Report); err != nil {
+			return nil, err
+		}
+
+		reply.ReplayedGroups++
+		reply.Report.ReplayedGroups++
+	}
+
+	if !req.GetRemoveOrphans() {
+		return reply, nil
+	}
+
+	issues, err := checkDatabase(svc.db)
+	if err != nil {
+		return nil, err
+	}
+
+	interactionCIDs, mediaCIDs := []string(nil), []string(nil)
+	for _, issue := range issues {
+		switch issue.GetKind() {
+		case messengertypes.DatabaseDoctor_KindOrphanedInteraction:
+			interactionCIDs = append(interactionCIDs, issue.GetCID())
+		case messengertypes.DatabaseDoctor_KindDanglingMedia:
+			mediaCIDs = append(mediaCIDs, issue.GetCID())
+		}
+	}
+
+	if err := svc.db.tx(func(tx *dbWrapper) error {
+		if len(interactionCIDs) > 0 {
+			if err := tx.deleteInteractions(interactionCIDs); err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		if len(mediaCIDs) > 0 {
+			// their content is removed by the garbage collector
+			medias := make([]*messengertypes.Media, len(mediaCIDs))
+			for i, cid := range mediaCIDs {
+				medias[i] = &messengertypes.Media{CID: cid}
+			}
+
+			if err := tx.addMediaTombstones(medias, messengertypes.MediaTombstone_ReasonInteractionDeleted, timestampMs(time.Now())); err != nil {
+				return err
+			}
+
+			return tx.deleteMedias(mediaCIDs)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	reply.RemovedInteractions = int64(len(interactionCIDs))
+	reply.RemovedMedias = int64(len(mediaCIDs))
+
+	return reply, nil
+}
+
+// getReplayedGroups returns the account group followed by the conversations not paused
+func (svc *service) getReplayedGroups() ([]string, error) {
+	return listReplayedGroups(svc.db)
+}
+
+func listReplayedGroups(db *dbWrapper) ([]string, error) {
+	account, err := db.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	convs, err := db.getAllConversations()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	groupPKs := []string{account.GetPublicKey()}
+	for _, conv := range convs {
+		// the groups of the paused conversations are not active, they are replayed once resumed
+		if conv.GetPublicKey() != account.GetPublicKey() && !conv.GetIsPaused() {
+			groupPKs = append(groupPKs, conv.GetPublicKey())
+		}
+	}
+
+	return groupPKs, nil
+}
+
+// replayGroup handles again the events of an active group in the scope, the events already in the database are
+// ignored and the missing ones are added without being notified. The events which fail are skipped and added to report
+func (svc *service) replayGroup(ctx context.Context, convPK string, filter replayFilter, report *messengertypes.ReplayReport) error {
+	groupPK, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	account, err := svc.db.getAccount()
+	if err != nil {
+		return err
+	}
+
+	isAccountGroup := convPK == account.GetPublicKey()
+	if !isAccountGroup {
+		if _, err := svc.db.getConversationByPK(convPK); err != nil {
+			return errcode.ErrNotFound.Wrap(err)
+		}
+	}
+
+	started := timestampMs(time.Now())
+	handler := newEventHandler(ctx, svc.db, svc.protocolClient, svc.logger, svc, true)
+	handler.report = report
+	handler.compact = !filter.window.FullFidelity
+	handler.failures = newEventFailureStreaks(filter.window.maxConsecutiveFailures())
+
+	if filter.metadata() {
+		if err := processMetadataList(ctx, groupPK, handler, filter.window); err != nil {
+			return errcode.ErrReplayProcessGroupMetadata.Wrap(err)
+		}
+	}
+
+	if !isAccountGroup && filter.messages() {
+		if err := replayGroupMessagesToDB(ctx, handler, svc.db, convPK, groupPK, filter.window); err != nil {
+			return err
+		}
+	}
+
+	svc.eventDiagnostics.replayed(convPK, time.Now())
+
+	// the quarantined events handled by a replay of the whole log of the group are released
+	if filter.metadata() && (isAccountGroup || filter.messages()) && filter.window.isZero() && !filter.window.HeadOnly {
+		if err := svc.db.deleteResolvedQuarantinedEvents(convPK, started); err != nil {
+			return err
+		}
+	}
+
+	// the group is not skipped anymore once it has been replayed
+	return svc.db.deleteReplaySkippedGroup(convPK)
+}
+
+func (svc *service) DatabaseStats(ctx context.Context, req *messengertypes.DatabaseStats_Request) (*messengertypes.DatabaseStats_Reply, error) {
+	defer svc.writer.enter()()
+
+	tables, err := svc.db.getTableStats()
+	if err != nil {
+		return nil, err
+	}
+
+	conversations, err := svc.db.getConversationStats()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := svc.db.getDatabaseSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.DatabaseStats_Reply{Tables: tables, Conversations: conversations, DatabaseSize: size}, nil
+}
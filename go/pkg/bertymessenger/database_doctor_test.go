@@ -0,0 +1,176 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_checkDatabase(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", DisplayName: "friends"}).Error)
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_2", ConversationPublicKey: "conv_2", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_3", ConversationPublicKey: "account_1", Type: messengertypes.AppMessage_TypeDeviceSyncSnapshot},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	_, err := db.addMedias([]*messengertypes.Media{
+		{CID: "media_1", InteractionCID: "cid_1", Size_: 10},
+		{CID: "media_2", InteractionCID: "cid_4"},
+		{CID: "media_3", State: messengertypes.Media_StatePrepared},
+	})
+	require.NoError(t, err)
+
+	issues, err := checkDatabase(db)
+	require.NoError(t, err)
+	require.Len(t, issues, 2)
+	require.Equal(t, messengertypes.DatabaseDoctor_KindOrphanedInteraction, issues[0].GetKind())
+	require.Equal(t, "cid_2", issues[0].GetCID())
+	require.Equal(t, messengertypes.DatabaseDoctor_KindDanglingMedia, issues[1].GetKind())
+	require.Equal(t, "media_2", issues[1].GetCID())
+
+	require.NoError(t, db.deleteInteractions([]string{"cid_2"}))
+	require.NoError(t, db.deleteMedias([]string{"media_2"}))
+
+	issues, err = checkDatabase(db)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+}
+
+func Test_dbWrapper_getChecksummedMedias(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.addMedias([]*messengertypes.Media{
+		{CID: "media_1", State: messengertypes.Media_StatePrepared},
+		{CID: "media_2", State: messengertypes.Media_StateNeverDownloaded},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.setMediaChecksum("media_1", "checksum_1"))
+	require.NoError(t, db.setMediaChecksum("media_2", "checksum_2"))
+
+	medias, err := db.getChecksummedMedias()
+	require.NoError(t, err)
+	require.Len(t, medias, 1)
+	require.Equal(t, "checksum_1", medias[0].GetChecksum())
+}
+
+func Test_dbWrapper_databaseStats(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", DisplayName: "small"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", DisplayName: "large"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_2"}).Error)
+
+	_, err := db.addMedias([]*messengertypes.Media{
+		{CID: "media_1", InteractionCID: "cid_2", Size_: 100},
+		{CID: "media_2", InteractionCID: "cid_2", Size_: 50},
+	})
+	require.NoError(t, err)
+
+	tables, err := db.getTableStats()
+	require.NoError(t, err)
+	require.Len(t, tables, len(getDBModels()))
+	for _, table := range tables {
+		if table.GetName() == "interactions" {
+			require.Equal(t, int64(2), table.GetRows())
+		}
+	}
+
+	stats, err := db.getConversationStats()
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	require.Equal(t, "conv_2", stats[0].GetConversationPublicKey())
+	require.Equal(t, int64(1), stats[0].GetInteractions())
+	require.Equal(t, int64(2), stats[0].GetMedias())
+	require.Equal(t, int64(150), stats[0].GetMediaSize())
+	require.Equal(t, int64(0), stats[1].GetMedias())
+
+	size, err := db.getDatabaseSize()
+	require.NoError(t, err)
+	require.True(t, size > 0)
+}
+
+func Test_replayFilter(t *testing.T) {
+	all := replayFilter{}
+	require.True(t, all.metadata())
+	require.True(t, all.messages())
+	require.True(t, all.includes("conv_1"))
+
+	metadata := replayFilter{scope: messengertypes.DatabaseRepair_ReplayMetadataOnly, groupPKs: []string{"conv_1"}}
+	require.True(t, metadata.metadata())
+	require.False(t, metadata.messages())
+	require.True(t, metadata.includes("conv_1"))
+	require.False(t, metadata.includes("conv_2"))
+
+	messages := replayFilter{scope: messengertypes.DatabaseRepair_ReplayMessagesOnly}
+	require.False(t, messages.metadata())
+	require.True(t, messages.messages())
+}
+
+func Test_eventHandler_replayFailed(t *testing.T) {
+	failure := fmt.Errorf("failure")
+
+	// without a report the failure stops the replay
+	h := &eventHandler{}
+	err := h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", failure)
+	require.Error(t, err)
+	require.Equal(t, errcode.ErrReplayAppMessageHandling, errcode.Code(err))
+	require.Contains(t, err.Error(), "TypeUserMessage")
+
+	h.report = &messengertypes.ReplayReport{}
+	for i := 0; i < replayReportMaxFailures+1; i++ {
+		require.NoError(t, h.replayFailed(errcode.ErrReplayMetadataHandling, []byte("group"), nil, "EventTypeGroupMemberDeviceAdded", failure))
+	}
+
+	require.Equal(t, int64(replayReportMaxFailures+1), h.report.GetFailedEvents())
+	require.Len(t, h.report.GetFailures(), replayReportMaxFailures)
+	require.Equal(t, b64EncodeBytes([]byte("group")), h.report.GetFailures()[0].GetGroupPK())
+	require.Equal(t, int32(errcode.ErrReplayMetadataHandling), h.report.GetFailures()[0].GetErrorCode())
+	require.Equal(t, "failure", h.report.GetFailures()[0].GetError())
+}
+
+func Test_ReplayOptions_contains(t *testing.T) {
+	require.True(t, ReplayOptions{}.isZero())
+	require.True(t, ReplayOptions{}.contains(1))
+
+	since, until := time.Unix(10, 0), time.Unix(20, 0)
+	window := ReplayOptions{Since: since, Until: until}
+	require.False(t, window.isZero())
+	require.False(t, window.contains(timestampMs(since)-1))
+	require.True(t, window.contains(timestampMs(since)))
+	require.True(t, window.contains(timestampMs(until)))
+	require.False(t, window.contains(timestampMs(until)+1))
+
+	require.True(t, ReplayOptions{Since: since}.contains(timestampMs(until)+1))
+}
+
+func Test_service_getReplayedGroups(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "account_1", Type: messengertypes.Conversation_AccountType}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", IsPaused: true}).Error)
+
+	svc := &service{db: db}
+	groupPKs, err := svc.getReplayedGroups()
+	require.NoError(t, err)
+	require.Equal(t, []string{"account_1", "conv_1"}, groupPKs)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	sqlite3 "github.com/mattn/go-sqlite3"
@@ -13,6 +15,7 @@ import (
 	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/berty/v2/go/pkg/messengertypes"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
@@ -49,19 +52,88 @@ func getDBModels() []interface{} {
 		&messengertypes.Device{},
 		&messengertypes.ConversationReplicationInfo{},
 		&messengertypes.Media{},
+		&messengertypes.Location{},
+		&messengertypes.Poll{},
+		&messengertypes.PollOption{},
+		&messengertypes.PollVote{},
+		&messengertypes.PollClose{},
+		&messengertypes.BlockedMember{},
+		&messengertypes.GroupInvitationLink{},
+		&messengertypes.GroupInvitationLinkUse{},
+		&messengertypes.MemberProfileChange{},
+		&messengertypes.PushDeviceToken{},
+		&messengertypes.Mention{},
+		&messengertypes.NotificationPolicy{},
+		&messengertypes.BotToken{},
+		&messengertypes.BotWebhook{},
+		&messengertypes.MatrixRoom{},
+		&messengertypes.MatrixGhost{},
+		&messengertypes.MatrixEvent{},
+		&messengertypes.ProcessedEvent{},
+		&messengertypes.AbuseReport{},
+		&messengertypes.ContentFilter{},
+		&messengertypes.BoardEntry{},
+		&messengertypes.StarredInteraction{},
+		&messengertypes.ConversationFolder{},
+		&messengertypes.AutoReply{},
+		&messengertypes.AutoReplyLog{},
+		&messengertypes.InteractionTranslation{},
+		&messengertypes.ConversationCounters{},
+		&messengertypes.MemberCounters{},
+		&messengertypes.ConversationActivity{},
+		&messengertypes.InteractionDelivery{},
+		&messengertypes.AppMessageChunk{},
+		&messengertypes.MediaTombstone{},
+		&messengertypes.GroupAuditEvent{},
+		&messengertypes.RecoveryShard{},
+		&messengertypes.RecoveryTrustee{},
+		&messengertypes.ScheduledAnnouncement{},
+		&messengertypes.OutboxMessage{},
+		&messengertypes.APIToken{},
+		&messengertypes.InteractionReaction{},
+		&messengertypes.ContactRequestAutoAccept{},
+		&messengertypes.ContactIntroduction{},
+		&messengertypes.InteractionExtension{},
+		&messengertypes.SentContentHash{},
+		&messengertypes.DBSnapshot{},
+		&messengertypes.LocalEcho{},
+		&messengertypes.MutedMember{},
+		&messengertypes.OutgoingContactRequest{},
+		&messengertypes.Audience{},
+		&messengertypes.AudienceMember{},
+		&messengertypes.Broadcast{},
+		&messengertypes.BroadcastRecipient{},
+		&messengertypes.MediaUpload{},
+		&messengertypes.MediaUploadChunk{},
+		&messengertypes.ConversationFile{},
+		&messengertypes.HiddenInteraction{},
+		&messengertypes.PendingContactRequest{},
+		&messengertypes.AccountDataExport{},
+		&messengertypes.ReplaySkippedGroup{},
+		&messengertypes.InteractionTag{},
+		&messengertypes.MediaHolder{},
+		&messengertypes.QuarantinedEvent{},
+		&messengertypes.ModerationEvent{},
 	}
 }
 
 func (d *dbWrapper) initDB(replayer func(d *dbWrapper) error) error {
-	if err := d.getUpdatedDB(getDBModels(), replayer, d.log); err != nil {
+	if err := d.getUpdatedDB(getDBModels(), dbMigrations, replayer, d.log); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (d *dbWrapper) getUpdatedDB(models []interface{}, replayer func(db *dbWrapper) error, logger *zap.Logger) error {
-	if err := ensureSeamlessDBUpdate(d.db, models); err != nil {
+// getUpdatedDB applies the migrations and updates the schema, the database is rebuilt from the logs when it can't be
+// done in place
+func (d *dbWrapper) getUpdatedDB(models []interface{}, migrations []*dbMigration, replayer func(db *dbWrapper) error, logger *zap.Logger) error {
+	err := applyDBMigrations(d.db, migrations, logger)
+	if err == nil {
+		err = d.backend().ensureSchema(d.db, models)
+	}
+
+	if err != nil {
 		logger.Info("couldn't update db sql schema automatically", zap.Error(err))
 
 		currentState := keepDatabaseLocalState(d.db, logger)
@@ -74,6 +146,10 @@ func (d *dbWrapper) getUpdatedDB(models []interface{}, replayer func(db *dbWrapp
 			return err
 		}
 
+		if err := restoreReplayLocalState(d, currentState); err != nil {
+			return err
+		}
+
 		if err := replayer(d); err != nil {
 			return err
 		}
@@ -81,6 +157,10 @@ func (d *dbWrapper) getUpdatedDB(models []interface{}, replayer func(db *dbWrapp
 		if err := restoreDatabaseLocalState(d, currentState); err != nil {
 			return err
 		}
+
+		if err := setDBSchemaVersion(d.db, latestDBMigrationVersion(migrations)); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -132,7 +212,7 @@ func (d *dbWrapper) addConversationForContact(groupPK, contactPK string) (*messe
 
 			if err := tx.db.
 				Model(&messengertypes.Conversation{}).
-				Where("(contact_public_key == ? AND public_key != ?) OR (contact_public_key != ? AND public_key == ?)", contactPK, groupPK, contactPK, groupPK).
+				Where("(contact_public_key = ? AND public_key != ?) OR (contact_public_key != ? AND public_key = ?)", contactPK, groupPK, contactPK, groupPK).
 				Count(&count).
 				Error; err != nil {
 				return err
@@ -166,7 +246,7 @@ func (d *dbWrapper) addConversation(groupPK string) (*messengertypes.Conversatio
 	}
 
 	if err := d.db.Create(&conversation).Error; err != nil {
-		if isSQLiteError(err, sqlite3.ErrConstraint) {
+		if d.backend().isConstraintError(err) {
 			return nil, errcode.ErrDBEntryAlreadyExists.Wrap(err)
 		}
 
@@ -182,7 +262,7 @@ func (d *dbWrapper) updateConversation(c messengertypes.Conversation) (bool, err
 	}
 
 	isNew := false
-	_, err := d.getConversationByPK(c.GetPublicKey())
+	existing, err := d.getConversationByPK(c.GetPublicKey())
 	if err == gorm.ErrRecordNotFound {
 		isNew = true
 	} else if err != nil {
@@ -194,7 +274,8 @@ func (d *dbWrapper) updateConversation(c messengertypes.Conversation) (bool, err
 		columns = append(columns, "link")
 	}
 
-	if c.DisplayName != "" {
+	// the name received in the group profile is more recent than the one of the invitation link
+	if c.DisplayName != "" && existing.GetInfoDate() == 0 {
 		columns = append(columns, "display_name")
 	}
 
@@ -206,6 +287,11 @@ func (d *dbWrapper) updateConversation(c messengertypes.Conversation) (bool, err
 		columns = append(columns, "account_member_public_key")
 	}
 
+	// a group joined again as an observer isn't posted to anymore
+	if c.IsObserver {
+		columns = append(columns, "is_observer")
+	}
+
 	db := d.db
 
 	if len(columns) > 0 {
@@ -270,7 +356,7 @@ func (d *dbWrapper) addAccount(pk, link string) error {
 			&messengertypes.Account{},
 			&messengertypes.Account{PublicKey: pk, Link: link},
 		).
-		Error; err != nil && !isSQLiteError(err, sqlite3.ErrConstraint) {
+		Error; err != nil && !d.backend().isConstraintError(err) {
 		return err
 	}
 
@@ -303,6 +389,77 @@ func (d *dbWrapper) updateAccount(pk, url, displayName, avatarCID string) (*mess
 	return acc, nil
 }
 
+// setAccountStatusText replaces the status of the account and flags its profile as not sent yet
+func (d *dbWrapper) setAccountStatusText(pk, statusText string) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	acc := &messengertypes.Account{}
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(map[string]interface{}{
+		"status_text":               statusText,
+		"profile_broadcast_pending": true,
+	}).First(&acc).Error; err != nil {
+		return nil, err
+	}
+
+	return acc, nil
+}
+
+func (d *dbWrapper) setAccountProfileBroadcastPending(pk string, pending bool) error {
+	if pk == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("profile_broadcast_pending", pending).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// setAccountLowStorage enables or disables the low-storage mode, the saved size is counted again from 0 when it is
+// enabled
+func (d *dbWrapper) setAccountLowStorage(pk string, enabled bool, maxInteractions int64) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	values := map[string]interface{}{"low_storage_enabled": enabled}
+	if enabled {
+		values["low_storage_max_interactions"] = maxInteractions
+		values["low_storage_saved_size"] = 0
+	}
+
+	acc := &messengertypes.Account{}
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(values).First(&acc).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return acc, nil
+}
+
+func (d *dbWrapper) setAccountMediaPeerSharing(pk string, enabled bool) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	acc := &messengertypes.Account{}
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("media_peer_sharing_enabled", enabled).First(&acc).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return acc, nil
+}
+
+func (d *dbWrapper) addAccountLowStorageSavedSize(pk string, size int64) error {
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("low_storage_saved_size", gorm.Expr("low_storage_saved_size + ?", size)).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
 func (d *dbWrapper) getAccount() (*messengertypes.Account, error) {
 	var (
 		account = &messengertypes.Account{}
@@ -363,6 +520,10 @@ func (d *dbWrapper) getConversationByPK(publicKey string) (*messengertypes.Conve
 		return nil, err
 	}
 
+	if err := d.fillGroupCapacityInfo(conversation); err != nil {
+		return nil, err
+	}
+
 	return conversation, nil
 }
 
@@ -385,8 +546,43 @@ func (d *dbWrapper) getMemberByPK(publicKey string, convPK string) (*messengerty
 
 func (d *dbWrapper) getAllConversations() ([]*messengertypes.Conversation, error) {
 	convs := []*messengertypes.Conversation(nil)
+	if err := d.db.Preload("ReplyOptions").Preload("ReplicationInfo").Find(&convs).Error; err != nil {
+		return nil, err
+	}
+
+	return convs, d.fillGroupCapacityInfo(convs...)
+}
+
+// getIncompleteHistoryConversationPKs returns the conversations whose history is not fully loaded, the paused ones
+// excepted, the most recently updated first
+func (d *dbWrapper) getIncompleteHistoryConversationPKs() ([]string, error) {
+	pks := []string(nil)
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Where("COALESCE(history_cursor, '') != '' AND is_paused = ?", false).
+		Order("last_update DESC").
+		Pluck("public_key", &pks).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return pks, nil
+}
+
+func (d *dbWrapper) getConversationsByPKs(pks []string) ([]*messengertypes.Conversation, error) {
+	convs := []*messengertypes.Conversation(nil)
+	if len(pks) == 0 {
+		return convs, nil
+	}
+
+	if err := d.db.Preload("ReplyOptions").Preload("ReplicationInfo").Where("public_key IN ?", pks).Find(&convs).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
 
-	return convs, d.db.Preload("ReplyOptions").Preload("ReplicationInfo").Find(&convs).Error
+	if err := d.fillGroupCapacityInfo(convs...); err != nil {
+		return nil, err
+	}
+
+	return convs, nil
 }
 
 func (d *dbWrapper) getAllMembers() ([]*messengertypes.Member, error) {
@@ -395,6 +591,16 @@ func (d *dbWrapper) getAllMembers() ([]*messengertypes.Member, error) {
 	return members, d.db.Find(&members).Error
 }
 
+func (d *dbWrapper) getMembersByConversation(convPK string) ([]*messengertypes.Member, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	members := []*messengertypes.Member(nil)
+
+	return members, d.db.Where(&messengertypes.Member{ConversationPublicKey: convPK}).Find(&members).Error
+}
+
 func (d *dbWrapper) getAllContacts() ([]*messengertypes.Contact, error) {
 	contacts := []*messengertypes.Contact(nil)
 
@@ -413,683 +619,7486 @@ func (d *dbWrapper) getAllInteractions() ([]*messengertypes.Interaction, error)
 	return interactions, d.db.Preload(clause.Associations).Find(&interactions).Error
 }
 
-func (d *dbWrapper) getInteractionByCID(cid string) (*messengertypes.Interaction, error) {
-	if cid == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+func (d *dbWrapper) setNotificationPolicy(policy *messengertypes.NotificationPolicy) error {
+	if policy.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
 	}
 
-	interaction := &messengertypes.Interaction{}
-	return interaction, d.db.Preload(clause.Associations).First(&interaction, &messengertypes.Interaction{CID: cid}).Error
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(policy).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
 }
 
-func (d *dbWrapper) addContactRequestOutgoingEnqueued(contactPK, displayName, convPK string) (*messengertypes.Contact, error) {
-	if contactPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+// getNotificationPolicy returns the notification policy of a conversation, the default policy when none has been set
+func (d *dbWrapper) getNotificationPolicy(convPK string) (*messengertypes.NotificationPolicy, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
 	}
 
-	ec, err := d.getContactByPK(contactPK)
-	if err == nil {
-		return ec, errcode.ErrDBEntryAlreadyExists
-	} else if err != nil && err != gorm.ErrRecordNotFound {
-		return nil, err
+	policy := &messengertypes.NotificationPolicy{}
+	err := d.db.Where(&messengertypes.NotificationPolicy{ConversationPublicKey: convPK}).First(policy).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return &messengertypes.NotificationPolicy{ConversationPublicKey: convPK}, nil
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	contact := &messengertypes.Contact{
-		PublicKey:             contactPK,
-		DisplayName:           displayName,
-		State:                 messengertypes.Contact_OutgoingRequestEnqueued,
-		CreatedDate:           timestampMs(time.Now()),
-		ConversationPublicKey: convPK,
-	}
+	return policy, nil
+}
 
-	tx := d.db.Where(&messengertypes.Contact{PublicKey: contactPK}).Create(&contact)
+// addImportedInteractions stores the messages imported from another messenger, the ones already imported are skipped
+func (d *dbWrapper) addImportedInteractions(interactions []*messengertypes.Interaction) (int64, error) {
+	count := int64(0)
 
-	// if tx.Error == nil && tx.RowsAffected == 0 {
-	// Maybe update DisplayName in some cases?
-	// TODO: better handle case where the state is "IncomingRequest", should end up as in "Established" state in this case IMO
-	// }
+	if err := d.db.Transaction(func(db *gorm.DB) error {
+		for _, i := range interactions {
+			// the dates of the imported messages can't be checked against a log
+			if i.NormalizedSentDate == 0 {
+				i.NormalizedSentDate = i.SentDate
+			}
 
-	return contact, tx.Error
-}
+			res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(i)
+			if res.Error != nil {
+				return res.Error
+			}
 
-func (d *dbWrapper) addContactRequestOutgoingSent(contactPK string) (*messengertypes.Contact, error) {
-	if contactPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+			count += res.RowsAffected
+		}
+
+		return nil
+	}); err != nil {
+		return 0, errcode.ErrDBWrite.Wrap(err)
 	}
 
-	contact := &messengertypes.Contact{}
+	return count, nil
+}
 
-	if res := d.db.
-		Where(&messengertypes.Contact{
-			PublicKey: contactPK,
-			State:     messengertypes.Contact_OutgoingRequestEnqueued,
-		}).
-		Updates(&messengertypes.Contact{
-			SentDate: timestampMs(time.Now()),
-			State:    messengertypes.Contact_OutgoingRequestSent,
-		}); res.Error != nil {
-		return nil, res.Error
-	} else if res.RowsAffected == 0 {
-		return nil, errcode.ErrDBAddContactRequestOutgoingSent.Wrap(fmt.Errorf("nothing found"))
+func (d *dbWrapper) addMentions(mentions []*messengertypes.Mention) error {
+	if len(mentions) == 0 {
+		return nil
 	}
 
-	return contact, d.db.Where(&messengertypes.Contact{PublicKey: contactPK}).First(&contact).Error
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&mentions).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
 }
 
-func (d *dbWrapper) addContactRequestIncomingReceived(contactPK, displayName, groupPk string) (*messengertypes.Contact, error) {
-	if contactPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+func (d *dbWrapper) addConversationFiles(files []*messengertypes.ConversationFile) error {
+	if len(files) == 0 {
+		return nil
 	}
 
-	ec, err := d.getContactByPK(contactPK)
-	if err == nil {
-		return ec, errcode.ErrDBEntryAlreadyExists
-	} else if err != nil && err != gorm.ErrRecordNotFound {
-		return nil, err
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&files).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	if err := d.db.
-		Create(&messengertypes.Contact{
-			DisplayName:           displayName,
-			PublicKey:             contactPK,
-			State:                 messengertypes.Contact_IncomingRequest,
-			CreatedDate:           timestampMs(time.Now()),
-			ConversationPublicKey: groupPk,
-		}).
-		Error; err != nil {
-		return nil, errcode.ErrDBWrite.Wrap(err)
+	return nil
+}
+
+// getConversationFiles returns the files of a conversation matching a filter in the order of a sort, starting after
+// the cursor when it is set, the ties are ordered by interaction then media cid
+func (d *dbWrapper) getConversationFiles(convPK string, sort messengertypes.ConversationFilesList_Sort, filter *messengertypes.ConversationFilesList_Filter, cursor *messengertypes.ConversationFilesList_Cursor, count int) ([]*messengertypes.ConversationFile, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
 	}
 
-	return d.getContactByPK(contactPK)
-}
+	query := d.db.Where("conversation_public_key = ?", convPK)
 
-func (d *dbWrapper) addContactRequestIncomingAccepted(contactPK, groupPK string) (*messengertypes.Contact, error) {
-	if contactPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(errors.New("a contact public key is required"))
+	if prefix := filter.GetMimeTypePrefix(); prefix != "" {
+		query = query.Where("LOWER(mime_type) LIKE ? ESCAPE '\\'", escapeLikePattern(strings.ToLower(prefix))+"%")
 	}
 
-	if groupPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(errors.New("a conversation public key is required"))
+	if memberPK := filter.GetMemberPublicKey(); memberPK != "" {
+		query = query.Where("member_public_key = ?", memberPK)
 	}
 
-	contact, err := d.getContactByPK(contactPK)
-	if err != nil {
-		return nil, err
+	if name := filter.GetName(); name != "" {
+		query = query.Where("LOWER(name) LIKE ? ESCAPE '\\'", "%"+escapeLikePattern(strings.ToLower(name))+"%")
 	}
 
-	if contact.State != messengertypes.Contact_IncomingRequest {
-		return nil, errcode.ErrInvalidInput.Wrap(errors.New("no incoming request"))
+	if since := filter.GetSinceDate(); since > 0 {
+		query = query.Where("sent_date >= ?", since)
 	}
 
-	if err := d.db.Transaction(func(db *gorm.DB) error {
-		contact.State = messengertypes.Contact_Accepted
-		contact.ConversationPublicKey = groupPK
+	if until := filter.GetUntilDate(); until > 0 {
+		query = query.Where("sent_date < ?", until)
+	}
 
-		if err := db.Save(&contact).Error; err != nil {
-			return errcode.ErrDBWrite.Wrap(err)
+	column, order := "sent_date", "DESC"
+	switch sort {
+	case messengertypes.ConversationFilesList_SortOldest:
+		order = "ASC"
+	case messengertypes.ConversationFilesList_SortLargest:
+		column = "size"
+	case messengertypes.ConversationFilesList_SortSmallest:
+		column, order = "size", "ASC"
+	case messengertypes.ConversationFilesList_SortName:
+		column, order = "name", "ASC"
+	}
+
+	if cursor != nil {
+		op := "<"
+		if order == "ASC" {
+			op = ">"
 		}
 
-		return db.
-			Clauses(clause.OnConflict{
-				Columns:   []clause.Column{{Name: "public_key"}},
-				DoUpdates: clause.AssignmentColumns([]string{"display_name", "link"}),
-			}).
-			Error
-	}); err != nil {
-		return nil, errcode.ErrDBWrite.Wrap(err)
+		value := interface{}(cursor.GetValue())
+		if column == "name" {
+			value = cursor.GetName()
+		}
+
+		query = query.Where(
+			fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND (interaction_cid %[2]s ? OR (interaction_cid = ? AND media_cid %[2]s ?))))", column, op),
+			value, value, cursor.GetInteractionCID(), cursor.GetInteractionCID(), cursor.GetMediaCID(),
+		)
 	}
 
-	return contact, nil
-}
+	if count > 0 {
+		query = query.Limit(count)
+	}
 
-func (d *dbWrapper) markInteractionAsAcknowledged(cid string) (*messengertypes.Interaction, error) {
-	if cid == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	files := []*messengertypes.ConversationFile(nil)
+	if err := query.Order(fmt.Sprintf("%[1]s %[2]s, interaction_cid %[2]s, media_cid %[2]s", column, order)).Find(&files).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	count := int64(0)
+	return files, nil
+}
 
-	if err := d.db.Model(&messengertypes.Interaction{}).Where(map[string]interface{}{"cid": cid}).Count(&count).Error; err != nil {
-		return nil, err
+// getMentionedInteractions returns the messages mentioning the account, the most recent first, the messages of the
+// blocked and muted members are left out
+func (d *dbWrapper) getMentionedInteractions(convPK string, count int) ([]*messengertypes.Interaction, error) {
+	mentions := d.db.Model(&messengertypes.Mention{}).Select("interaction_cid").Where("is_me = ?", true)
+	if convPK != "" {
+		mentions = mentions.Where("conversation_public_key = ?", convPK)
 	}
 
-	if count == 0 {
-		return nil, gorm.ErrRecordNotFound
+	interactions := []*messengertypes.Interaction(nil)
+	if err := d.db.
+		Preload(clause.Associations).
+		Where("cid IN (?) AND is_sender_blocked = ? AND is_member_muted = ? AND is_hidden = ?", mentions, false, false, false).
+		Order("sent_date DESC").
+		Limit(count).
+		Find(&interactions).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	res := d.db.Model(&messengertypes.Interaction{}).Where(map[string]interface{}{"cid": cid, "acknowledged": false}).Update("acknowledged", true)
+	return interactions, nil
+}
 
-	if res.Error != nil {
-		return nil, res.Error
+// getPaginatedInteractions returns the interactions of a conversation in the given order, the most recent first,
+// starting after the cursor when it is set
+func (d *dbWrapper) getPaginatedInteractions(convPK string, includeMuted bool, order messengertypes.Account_InteractionOrder, cursor *messengertypes.InteractionList_Cursor, count int) ([]*messengertypes.Interaction, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
 	}
 
-	if res.RowsAffected == 0 {
-		return nil, nil
+	query := d.db.Preload(clause.Associations).Where("conversation_public_key = ? AND is_hidden = ?", convPK, false)
+	if !includeMuted {
+		query = query.Where("is_member_muted = ?", false)
 	}
 
-	return d.getInteractionByCID(cid)
+	return paginateInteractions(query, order, cursor, count)
 }
 
-func (d *dbWrapper) getAcknowledgementsCIDsForInteraction(cid string) ([]string, error) {
-	if cid == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+// paginateInteractions reads a page of the interactions matched by query in the given order then by cid, the most
+// recent first, starting after the cursor when it is set, or at it when it is inclusive. The pages after the first
+// one keep the order of their cursor
+func paginateInteractions(query *gorm.DB, order messengertypes.Account_InteractionOrder, cursor *messengertypes.InteractionList_Cursor, count int) ([]*messengertypes.Interaction, error) {
+	if cursor != nil {
+		order = cursor.GetOrder()
 	}
+	column := interactionOrderColumn(order)
 
-	var cids []string
+	if cursor != nil {
+		cidOp := "<"
+		if cursor.GetInclusive() {
+			cidOp = "<="
+		}
 
-	if err := d.db.Model(&messengertypes.Interaction{}).Where(&messengertypes.Interaction{
-		Type:      messengertypes.AppMessage_TypeAcknowledge,
-		TargetCID: cid,
-	}).Pluck("cid", &cids).Error; err != nil {
-		return nil, err
-	}
+		value := interface{}(cursor.GetDate())
+		if order == messengertypes.Account_OrderLogical {
+			value = cursor.GetLamportTime()
+		}
 
-	return cids, nil
-}
+		query = query.Where("("+column+" < ? OR ("+column+" = ? AND cid "+cidOp+" ?))", value, value, cursor.GetCID())
+	}
 
-func (d *dbWrapper) deleteInteractions(cids []string) error {
-	if len(cids) == 0 {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of cids is required"))
+	interactions := []*messengertypes.Interaction(nil)
+	if err := query.Order(column + " DESC, cid DESC").Limit(count).Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	return d.db.Model(&messengertypes.Interaction{}).Delete(&messengertypes.Interaction{}, &cids).Error
+	return interactions, nil
 }
 
-func (d *dbWrapper) getDBInfo() (*messengertypes.SystemInfo_DB, error) {
-	var err, errs error
+// getInteractionAnchor returns the interaction of a conversation sent the closest to date, the older one on a tie, the
+// interactions sent before and after date are read through the index on the conversation and the sent date
+func (d *dbWrapper) getInteractionAnchor(convPK string, includeMuted bool, date int64) (*messengertypes.Interaction, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	nearest := func(cond string, order string) (*messengertypes.Interaction, error) {
+		query := d.db.Preload(clause.Associations).Where("conversation_public_key = ? AND is_hidden = ?", convPK, false).Where(cond, date)
+		if !includeMuted {
+			query = query.Where("is_member_muted = ?", false)
+		}
+
+		interactions := []*messengertypes.Interaction(nil)
+		if err := query.Order(order).Limit(1).Find(&interactions).Error; err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(interactions) == 0 {
+			return nil, nil
+		}
+
+		return interactions[0], nil
+	}
+
+	before, err := nearest("sent_date <= ?", "sent_date DESC, lamport_time DESC, cid DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := nearest("sent_date > ?", "sent_date ASC, lamport_time ASC, cid ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case before == nil && after == nil:
+		return nil, gorm.ErrRecordNotFound
+	case before == nil:
+		return after, nil
+	case after == nil || date-before.GetSentDate() <= after.GetSentDate()-date:
+		return before, nil
+	default:
+		return after, nil
+	}
+}
+
+// getMatchingInteractions returns the interactions matching a filter ordered as getPaginatedInteractions, in a single
+// conversation when convPK is set
+func (d *dbWrapper) getMatchingInteractions(convPK string, includeMuted bool, filter *messengertypes.InteractionList_Filter, order messengertypes.Account_InteractionOrder, cursor *messengertypes.InteractionList_Cursor, count int) ([]*messengertypes.Interaction, error) {
+	query := d.db.Preload(clause.Associations).Where("is_hidden = ?", false)
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+	if !includeMuted {
+		query = query.Where("is_member_muted = ?", false)
+	}
+
+	return paginateInteractions(filterInteractions(query, filter), order, cursor, count)
+}
+
+// getInteractionsByExtension returns the interactions carrying a client extension in the logical order, in a single
+// conversation when convPK is set
+func (d *dbWrapper) getInteractionsByExtension(key, convPK string, cursor *messengertypes.InteractionList_Cursor, count int) ([]*messengertypes.Interaction, error) {
+	if key == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an extension key is required"))
+	}
+
+	extensions := d.db.Model(&messengertypes.InteractionExtension{}).Where(&messengertypes.InteractionExtension{Key: key, ConversationPublicKey: convPK}).Select("interaction_cid")
+
+	return paginateInteractions(d.db.Preload(clause.Associations).Where("cid IN (?) AND is_hidden = ?", extensions, false), messengertypes.Account_OrderLogical, cursor, count)
+}
+
+// getActivityFeed returns the interactions of the given types of all the conversations ordered by sent date then cid,
+// the most recent first, starting after the cursor when it is set. The interactions of the blocked members, the
+// filtered and the hidden ones are left out, with the muted members and conversations unless includeMuted is set
+func (d *dbWrapper) getActivityFeed(types []messengertypes.AppMessage_Type, includeMuted bool, cursor *messengertypes.ActivityFeed_Cursor, count int) ([]*messengertypes.Interaction, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+
+	query := d.db.Preload(clause.Associations).Where("type IN ? AND is_sender_blocked = ? AND is_filtered = ? AND is_hidden = ?", types, false, false, false)
+	if !includeMuted {
+		muted := d.db.Model(&messengertypes.Conversation{}).Select("public_key").Where("push_muted = ?", true)
+		query = query.Where("is_member_muted = ? AND conversation_public_key NOT IN (?)", false, muted)
+	}
+
+	if cursor != nil {
+		query = query.Where("(sent_date < ? OR (sent_date = ? AND cid < ?))", cursor.GetSentDate(), cursor.GetSentDate(), cursor.GetCID())
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if err := query.Order("sent_date DESC, cid DESC").Limit(count).Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// getConversationExportInteractions returns the messages of a conversation sent between since and until, the oldest first
+func (d *dbWrapper) getConversationExportInteractions(convPK string, since, until int64) ([]*messengertypes.Interaction, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	query := d.db.Preload(clause.Associations).Where(&messengertypes.Interaction{ConversationPublicKey: convPK, Type: messengertypes.AppMessage_TypeUserMessage})
+	if since > 0 {
+		query = query.Where("sent_date >= ?", since)
+	}
+	if until > 0 {
+		query = query.Where("sent_date < ?", until)
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if err := query.Order("sent_date ASC, cid ASC").Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+func (d *dbWrapper) getInteractionByCID(cid string) (*messengertypes.Interaction, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	interaction := &messengertypes.Interaction{}
+	return interaction, d.db.Preload(clause.Associations).First(&interaction, &messengertypes.Interaction{CID: cid}).Error
+}
+
+func (d *dbWrapper) addContactRequestOutgoingEnqueued(contactPK, displayName, convPK string) (*messengertypes.Contact, error) {
+	if contactPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	ec, err := d.getContactByPK(contactPK)
+	if err == nil {
+		return ec, errcode.ErrDBEntryAlreadyExists
+	} else if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	contact := &messengertypes.Contact{
+		PublicKey:             contactPK,
+		DisplayName:           displayName,
+		State:                 messengertypes.Contact_OutgoingRequestEnqueued,
+		CreatedDate:           timestampMs(time.Now()),
+		ConversationPublicKey: convPK,
+	}
+
+	tx := d.db.Where(&messengertypes.Contact{PublicKey: contactPK}).Create(&contact)
+
+	// if tx.Error == nil && tx.RowsAffected == 0 {
+	// Maybe update DisplayName in some cases?
+	// TODO: better handle case where the state is "IncomingRequest", should end up as in "Established" state in this case IMO
+	// }
+
+	return contact, tx.Error
+}
+
+func (d *dbWrapper) addContactRequestOutgoingSent(contactPK string) (*messengertypes.Contact, error) {
+	if contactPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	contact := &messengertypes.Contact{}
+
+	if res := d.db.
+		Where(&messengertypes.Contact{
+			PublicKey: contactPK,
+			State:     messengertypes.Contact_OutgoingRequestEnqueued,
+		}).
+		Updates(&messengertypes.Contact{
+			SentDate: timestampMs(time.Now()),
+			State:    messengertypes.Contact_OutgoingRequestSent,
+		}); res.Error != nil {
+		return nil, res.Error
+	} else if res.RowsAffected == 0 {
+		return nil, errcode.ErrDBAddContactRequestOutgoingSent.Wrap(fmt.Errorf("nothing found"))
+	}
+
+	return contact, d.db.Where(&messengertypes.Contact{PublicKey: contactPK}).First(&contact).Error
+}
+
+func (d *dbWrapper) addContactRequestIncomingReceived(contactPK, displayName, groupPk string, intro *messengertypes.ContactMetadata, ignored bool) (*messengertypes.Contact, error) {
+	if contactPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	ec, err := d.getContactByPK(contactPK)
+	if err == nil {
+		return ec, errcode.ErrDBEntryAlreadyExists
+	} else if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	state := messengertypes.Contact_IncomingRequest
+	if ignored {
+		state = messengertypes.Contact_IncomingRequestIgnored
+	}
+
+	if err := d.db.
+		Create(&messengertypes.Contact{
+			DisplayName:           displayName,
+			PublicKey:             contactPK,
+			State:                 state,
+			CreatedDate:           timestampMs(time.Now()),
+			ConversationPublicKey: groupPk,
+			IntroMessage:          intro.GetIntroMessage(),
+			IntroAvatar:           intro.GetAvatar(),
+			IntroAvatarMimeType:   intro.GetAvatarMimeType(),
+		}).
+		Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return d.getContactByPK(contactPK)
+}
+
+// setContactRendezvousSeed stores the rendezvous seed of a contact known from its contact request
+func (d *dbWrapper) setContactRendezvousSeed(contactPK string, seed []byte) error {
+	if contactPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	if len(seed) == 0 {
+		return nil
+	}
+
+	if err := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: contactPK}).Update("public_rendezvous_seed", seed).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// countContactRequestsIncomingSince returns the number of pending incoming requests, including the ignored ones, received since the given date
+func (d *dbWrapper) countContactRequestsIncomingSince(sinceMs int64) (int64, error) {
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.Contact{}).
+		Where("state IN ? AND created_date >= ?", []messengertypes.Contact_State{messengertypes.Contact_IncomingRequest, messengertypes.Contact_IncomingRequestIgnored}, sinceMs).
+		Count(&count).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count, nil
+}
+
+func (d *dbWrapper) setAccountContactRequestPolicy(pk string, maxPerHour int32, ignoreWithoutIntro bool) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if maxPerHour < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max per hour can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(map[string]interface{}{
+		"contact_requests_max_per_hour":         maxPerHour,
+		"contact_requests_ignore_without_intro": ignoreWithoutIntro,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) setAccountContactRequestAutoAcceptPolicy(pk string, minSharedGroups int32, acceptIntroduced bool) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if minSharedGroups < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("min shared groups can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(map[string]interface{}{
+		"contact_requests_auto_accept_min_shared_groups": minSharedGroups,
+		"contact_requests_auto_accept_introduced":        acceptIntroduced,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) addContactRequestIncomingAccepted(contactPK, groupPK string) (*messengertypes.Contact, error) {
+	if contactPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(errors.New("a contact public key is required"))
+	}
+
+	if groupPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(errors.New("a conversation public key is required"))
+	}
+
+	contact, err := d.getContactByPK(contactPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if contact.State != messengertypes.Contact_IncomingRequest && contact.State != messengertypes.Contact_IncomingRequestIgnored {
+		return nil, errcode.ErrInvalidInput.Wrap(errors.New("no incoming request"))
+	}
+
+	if err := d.db.Transaction(func(db *gorm.DB) error {
+		contact.State = messengertypes.Contact_Accepted
+		contact.ConversationPublicKey = groupPK
+
+		if err := db.Save(&contact).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return db.
+			Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "public_key"}},
+				DoUpdates: clause.AssignmentColumns([]string{"display_name", "link"}),
+			}).
+			Error
+	}); err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return contact, nil
+}
+
+func (d *dbWrapper) markInteractionAsAcknowledged(cid string) (*messengertypes.Interaction, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	count := int64(0)
+
+	if err := d.db.Model(&messengertypes.Interaction{}).Where(map[string]interface{}{"cid": cid}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	res := d.db.Model(&messengertypes.Interaction{}).Where(map[string]interface{}{"cid": cid, "acknowledged": false}).Update("acknowledged", true)
+
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	return d.getInteractionByCID(cid)
+}
+
+// addAppMessageChunk stores a chunk of an app message, it returns false when the chunk is already known
+func (d *dbWrapper) addAppMessageChunk(chunk *messengertypes.AppMessageChunk) (bool, error) {
+	if chunk.GetChecksum() == "" || chunk.GetDevicePublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a checksum and a device public key are required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(chunk)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// getAppMessageChunks returns the chunks of an app message received from a device, in their order
+func (d *dbWrapper) getAppMessageChunks(checksum, devicePK string) ([]*messengertypes.AppMessageChunk, error) {
+	chunks := []*messengertypes.AppMessageChunk(nil)
+	if err := d.db.
+		Where("checksum = ? AND device_public_key = ?", checksum, devicePK).
+		Order("chunk_index").
+		Find(&chunks).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return chunks, nil
+}
+
+func (d *dbWrapper) deleteAppMessageChunks(checksum, devicePK string) error {
+	if err := d.db.Where("checksum = ? AND device_public_key = ?", checksum, devicePK).Delete(&messengertypes.AppMessageChunk{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// deleteStaleAppMessageChunks removes the chunks received before a date, their messages will not be completed
+func (d *dbWrapper) deleteStaleAppMessageChunks(before int64) (int64, error) {
+	res := d.db.Where("received_date < ?", before).Delete(&messengertypes.AppMessageChunk{})
+	if res.Error != nil {
+		return 0, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected, nil
+}
+
+// addInteractionDelivery stores the acknowledgment of an interaction by a device, it returns false when the device
+// already acknowledged it
+func (d *dbWrapper) addInteractionDelivery(delivery *messengertypes.InteractionDelivery) (bool, error) {
+	if delivery.GetInteractionCID() == "" || delivery.GetDevicePublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid and a device public key are required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(delivery)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// incrementInteractionDeliveryCount counts an ack of an interaction, the acks of the unknown interactions are counted
+// once their backlog is consumed
+func (d *dbWrapper) incrementInteractionDeliveryCount(cid string) error {
+	if cid == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Interaction{}).
+		Where("cid = ?", cid).
+		Update("delivery_count", gorm.Expr("COALESCE(delivery_count, 0) + 1")).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addInteractionReaction counts a reaction in the summary of its target and emoji
+func (d *dbWrapper) addInteractionReaction(targetCID, convPK, emoji string, isMe bool, date int64) error {
+	if targetCID == "" || emoji == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a target cid and an emoji are required"))
+	}
+
+	reaction := &messengertypes.InteractionReaction{
+		InteractionCID:        targetCID,
+		Emoji:                 emoji,
+		ConversationPublicKey: convPK,
+		Count:                 1,
+		OwnState:              isMe,
+		LastReactionDate:      date,
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "interaction_cid"}, {Name: "emoji"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"count":              gorm.Expr("count + 1"),
+			"own_state":          gorm.Expr("own_state OR ?", isMe),
+			"last_reaction_date": gorm.Expr("CASE WHEN last_reaction_date < ? THEN ? ELSE last_reaction_date END", date, date),
+		}),
+	}).Create(reaction).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getInteractionDeliveries returns the acknowledgments of an interaction, the earliest first
+func (d *dbWrapper) getInteractionDeliveries(cid string) ([]*messengertypes.InteractionDelivery, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	deliveries := []*messengertypes.InteractionDelivery(nil)
+	if err := d.db.Where("interaction_cid = ?", cid).Order("acknowledged_date, device_public_key").Find(&deliveries).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return deliveries, nil
+}
+
+func (d *dbWrapper) getAcknowledgementsCIDsForInteraction(cid string) ([]string, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	var cids []string
+
+	if err := d.db.Model(&messengertypes.Interaction{}).Where(&messengertypes.Interaction{
+		Type:      messengertypes.AppMessage_TypeAcknowledge,
+		TargetCID: cid,
+	}).Pluck("cid", &cids).Error; err != nil {
+		return nil, err
+	}
+
+	return cids, nil
+}
+
+func (d *dbWrapper) deleteInteractions(cids []string) error {
+	if len(cids) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of cids is required"))
+	}
+
+	// the medias of the interactions are collected once their grace period is over
+	medias := []*messengertypes.Media(nil)
+	if err := d.db.Where("interaction_cid IN ?", cids).Find(&medias).Error; err != nil {
+		return err
+	}
+
+	if err := d.addMediaTombstones(medias, messengertypes.MediaTombstone_ReasonInteractionDeleted, timestampMs(time.Now())); err != nil {
+		return err
+	}
+
+	if err := d.db.Where("interaction_cid IN ?", cids).Delete(&messengertypes.InteractionExtension{}).Error; err != nil {
+		return err
+	}
+
+	if err := d.db.Where("interaction_cid IN ?", cids).Delete(&messengertypes.ConversationFile{}).Error; err != nil {
+		return err
+	}
+
+	return d.db.Model(&messengertypes.Interaction{}).Delete(&messengertypes.Interaction{}, &cids).Error
+}
+
+// getUnsupportedInteractions returns the interactions stored from the messages this node couldn't read, in the order
+// of the logs
+func (d *dbWrapper) getUnsupportedInteractions() ([]*messengertypes.Interaction, error) {
+	interactions := []*messengertypes.Interaction(nil)
+
+	if err := d.db.Preload("Medias").Where("is_unsupported = true").Order("lamport_time").Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// deleteUnsupportedInteraction deletes the placeholder of an unsupported message before it is handled, its medias are
+// kept for the handled message
+func (d *dbWrapper) deleteUnsupportedInteraction(cid string) error {
+	if err := d.db.Where("cid = ? AND is_unsupported = true", cid).Delete(&messengertypes.Interaction{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getOrphanedInteractions returns the interactions of the conversations missing from the database, the interactions
+// of the account group are not attached to a conversation
+func (d *dbWrapper) getOrphanedInteractions(accountPK string) ([]*messengertypes.Interaction, error) {
+	interactions := []*messengertypes.Interaction(nil)
+
+	if err := d.db.
+		Where("conversation_public_key NOT IN (?) AND conversation_public_key != ?", d.db.Model(&messengertypes.Conversation{}).Select("public_key"), accountPK).
+		Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// getDanglingMedias returns the medias attached to an interaction missing from the database
+func (d *dbWrapper) getDanglingMedias() ([]*messengertypes.Media, error) {
+	medias := []*messengertypes.Media(nil)
+
+	if err := d.db.
+		Where("interaction_cid != '' AND interaction_cid NOT IN (?)", d.db.Model(&messengertypes.Interaction{}).Select("cid")).
+		Find(&medias).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return medias, nil
+}
+
+// getChecksummedMedias returns the medias stored on this device whose checksum is known
+func (d *dbWrapper) getChecksummedMedias() ([]*messengertypes.Media, error) {
+	medias := []*messengertypes.Media(nil)
+
+	if err := d.db.
+		Where("checksum != '' AND state IN ?", []messengertypes.Media_State{
+			messengertypes.Media_StateDownloaded,
+			messengertypes.Media_StateInCache,
+			messengertypes.Media_StatePrepared,
+			messengertypes.Media_StateAttached,
+		}).
+		Find(&medias).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return medias, nil
+}
+
+func (d *dbWrapper) deleteMedias(cids []string) error {
+	if len(cids) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of cids is required"))
+	}
+
+	if err := d.db.Where("cid IN ?", cids).Delete(&messengertypes.Media{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if err := d.db.Where("media_cid IN ?", cids).Delete(&messengertypes.ConversationFile{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getTableStats counts the rows of each table of the models
+func (d *dbWrapper) getTableStats() ([]*messengertypes.DatabaseStats_Table, error) {
+	tables := []*messengertypes.DatabaseStats_Table(nil)
+
+	for _, model := range getDBModels() {
+		stmt := &gorm.Statement{DB: d.db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		count, err := d.dbModelRowsCount(model)
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		tables = append(tables, &messengertypes.DatabaseStats_Table{Name: stmt.Schema.Table, Rows: count})
+	}
+
+	return tables, nil
+}
+
+// getConversationStats counts the interactions and the medias of each conversation, the largest ones first
+func (d *dbWrapper) getConversationStats() ([]*messengertypes.DatabaseStats_ConversationStats, error) {
+	stats := []*messengertypes.DatabaseStats_ConversationStats(nil)
+
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Select("conversations.public_key AS conversation_public_key, conversations.display_name AS display_name, " +
+			"(SELECT COUNT(*) FROM interactions WHERE interactions.conversation_public_key = conversations.public_key) AS interactions, " +
+			"(SELECT COUNT(*) FROM medias JOIN interactions ON medias.interaction_cid = interactions.cid WHERE interactions.conversation_public_key = conversations.public_key) AS medias, " +
+			"(SELECT COALESCE(SUM(medias.size), 0) FROM medias JOIN interactions ON medias.interaction_cid = interactions.cid WHERE interactions.conversation_public_key = conversations.public_key) AS media_size").
+		Order("media_size DESC, interactions DESC").
+		Scan(&stats).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return stats, nil
+}
+
+// getStorageUsage counts the interactions and the medias stored on the device of each conversation, the largest ones
+// first
+func (d *dbWrapper) getStorageUsage() ([]*messengertypes.StorageUsage_Conversation, error) {
+	stored := []messengertypes.Media_State{messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache, messengertypes.Media_StatePrepared, messengertypes.Media_StateAttached}
+	usage := []*messengertypes.StorageUsage_Conversation(nil)
+
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Select("conversations.public_key AS conversation_public_key, conversations.display_name AS display_name, "+
+			"(SELECT COUNT(*) FROM interactions WHERE interactions.conversation_public_key = conversations.public_key) AS interaction_count, "+
+			"(SELECT COUNT(*) FROM medias JOIN interactions ON medias.interaction_cid = interactions.cid WHERE interactions.conversation_public_key = conversations.public_key AND medias.state IN ?) AS media_count, "+
+			"(SELECT COALESCE(SUM(medias.size), 0) FROM medias JOIN interactions ON medias.interaction_cid = interactions.cid WHERE interactions.conversation_public_key = conversations.public_key AND medias.state IN ?) AS media_size", stored, stored).
+		Order("media_size DESC, interaction_count DESC").
+		Scan(&usage).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return usage, nil
+}
+
+// getConversationDownloadedMedias returns the medias received and downloaded in a conversation whose message was sent
+// before a date, all of them when the date is 0
+func (d *dbWrapper) getConversationDownloadedMedias(convPK string, before int64) ([]*messengertypes.Media, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	query := d.db.
+		Joins("JOIN interactions ON medias.interaction_cid = interactions.cid").
+		Where("interactions.conversation_public_key = ? AND medias.state IN ?", convPK, []messengertypes.Media_State{messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache})
+	if before > 0 {
+		query = query.Where("interactions.sent_date < ?", before)
+	}
+
+	medias := []*messengertypes.Media(nil)
+	if err := query.Order("interactions.sent_date").Find(&medias).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return medias, nil
+}
+
+// getDatabaseSize returns the size in bytes of the database file
+func (d *dbWrapper) getDatabaseSize() (int64, error) {
+	return d.backend().getDatabaseSize(d.db)
+}
+
+func (d *dbWrapper) getDBInfo() (*messengertypes.SystemInfo_DB, error) {
+	var err, errs error
 	infos := &messengertypes.SystemInfo_DB{}
 
-	infos.Accounts, err = d.dbModelRowsCount(messengertypes.Account{})
-	errs = multierr.Append(errs, err)
+	infos.Accounts, err = d.dbModelRowsCount(messengertypes.Account{})
+	errs = multierr.Append(errs, err)
+
+	infos.Contacts, err = d.dbModelRowsCount(messengertypes.Contact{})
+	errs = multierr.Append(errs, err)
+
+	infos.Interactions, err = d.dbModelRowsCount(messengertypes.Interaction{})
+	errs = multierr.Append(errs, err)
+
+	infos.Conversations, err = d.dbModelRowsCount(messengertypes.Conversation{})
+	errs = multierr.Append(errs, err)
+
+	infos.Members, err = d.dbModelRowsCount(messengertypes.Member{})
+	errs = multierr.Append(errs, err)
+
+	infos.Devices, err = d.dbModelRowsCount(messengertypes.Device{})
+	errs = multierr.Append(errs, err)
+
+	infos.ServiceTokens, err = d.dbModelRowsCount(messengertypes.ServiceToken{})
+	errs = multierr.Append(errs, err)
+
+	infos.ConversationReplicationInfo, err = d.dbModelRowsCount(messengertypes.ConversationReplicationInfo{})
+	errs = multierr.Append(errs, err)
+
+	infos.Locations, err = d.dbModelRowsCount(messengertypes.Location{})
+	errs = multierr.Append(errs, err)
+
+	infos.Polls, err = d.dbModelRowsCount(messengertypes.Poll{})
+	errs = multierr.Append(errs, err)
+
+	infos.PollVotes, err = d.dbModelRowsCount(messengertypes.PollVote{})
+	errs = multierr.Append(errs, err)
+
+	infos.BlockedMembers, err = d.dbModelRowsCount(messengertypes.BlockedMember{})
+	errs = multierr.Append(errs, err)
+
+	infos.GroupInvitationLinks, err = d.dbModelRowsCount(messengertypes.GroupInvitationLink{})
+	errs = multierr.Append(errs, err)
+
+	infos.GroupInvitationLinkUses, err = d.dbModelRowsCount(messengertypes.GroupInvitationLinkUse{})
+	errs = multierr.Append(errs, err)
+
+	infos.MemberProfileChanges, err = d.dbModelRowsCount(messengertypes.MemberProfileChange{})
+	errs = multierr.Append(errs, err)
+
+	infos.PushDeviceTokens, err = d.dbModelRowsCount(messengertypes.PushDeviceToken{})
+	errs = multierr.Append(errs, err)
+
+	infos.SchemaVersion, err = getDBSchemaVersion(d.db)
+	errs = multierr.Append(errs, err)
+
+	infos.Mentions, err = d.dbModelRowsCount(messengertypes.Mention{})
+	errs = multierr.Append(errs, err)
+
+	infos.NotificationPolicies, err = d.dbModelRowsCount(messengertypes.NotificationPolicy{})
+	errs = multierr.Append(errs, err)
+
+	infos.BotTokens, err = d.dbModelRowsCount(messengertypes.BotToken{})
+	errs = multierr.Append(errs, err)
+
+	infos.BotWebhooks, err = d.dbModelRowsCount(messengertypes.BotWebhook{})
+	errs = multierr.Append(errs, err)
+
+	infos.MatrixRooms, err = d.dbModelRowsCount(messengertypes.MatrixRoom{})
+	errs = multierr.Append(errs, err)
+
+	infos.MatrixGhosts, err = d.dbModelRowsCount(messengertypes.MatrixGhost{})
+	errs = multierr.Append(errs, err)
+
+	infos.MatrixEvents, err = d.dbModelRowsCount(messengertypes.MatrixEvent{})
+	errs = multierr.Append(errs, err)
+
+	infos.ProcessedEvents, err = d.dbModelRowsCount(messengertypes.ProcessedEvent{})
+	errs = multierr.Append(errs, err)
+
+	infos.AbuseReports, err = d.dbModelRowsCount(messengertypes.AbuseReport{})
+	errs = multierr.Append(errs, err)
+
+	infos.ContentFilters, err = d.dbModelRowsCount(messengertypes.ContentFilter{})
+	errs = multierr.Append(errs, err)
+
+	infos.BoardEntries, err = d.dbModelRowsCount(messengertypes.BoardEntry{})
+	errs = multierr.Append(errs, err)
+
+	infos.StarredInteractions, err = d.dbModelRowsCount(messengertypes.StarredInteraction{})
+	errs = multierr.Append(errs, err)
+
+	infos.ConversationFolders, err = d.dbModelRowsCount(messengertypes.ConversationFolder{})
+	errs = multierr.Append(errs, err)
+
+	infos.AutoReplies, err = d.dbModelRowsCount(messengertypes.AutoReply{})
+	errs = multierr.Append(errs, err)
+
+	infos.AutoReplyLogs, err = d.dbModelRowsCount(messengertypes.AutoReplyLog{})
+	errs = multierr.Append(errs, err)
+
+	infos.InteractionTranslations, err = d.dbModelRowsCount(messengertypes.InteractionTranslation{})
+	errs = multierr.Append(errs, err)
+
+	infos.ConversationCounters, err = d.dbModelRowsCount(messengertypes.ConversationCounters{})
+	errs = multierr.Append(errs, err)
+
+	infos.MemberCounters, err = d.dbModelRowsCount(messengertypes.MemberCounters{})
+	errs = multierr.Append(errs, err)
+
+	infos.ConversationActivities, err = d.dbModelRowsCount(messengertypes.ConversationActivity{})
+	errs = multierr.Append(errs, err)
+
+	infos.InteractionDeliveries, err = d.dbModelRowsCount(messengertypes.InteractionDelivery{})
+	errs = multierr.Append(errs, err)
+
+	infos.AppMessageChunks, err = d.dbModelRowsCount(messengertypes.AppMessageChunk{})
+	errs = multierr.Append(errs, err)
+
+	infos.MediaTombstones, err = d.dbModelRowsCount(messengertypes.MediaTombstone{})
+	errs = multierr.Append(errs, err)
+
+	infos.GroupAuditEvents, err = d.dbModelRowsCount(messengertypes.GroupAuditEvent{})
+	errs = multierr.Append(errs, err)
+
+	infos.RecoveryShards, err = d.dbModelRowsCount(messengertypes.RecoveryShard{})
+	errs = multierr.Append(errs, err)
+
+	infos.RecoveryTrustees, err = d.dbModelRowsCount(messengertypes.RecoveryTrustee{})
+	errs = multierr.Append(errs, err)
+
+	infos.ScheduledAnnouncements, err = d.dbModelRowsCount(messengertypes.ScheduledAnnouncement{})
+	errs = multierr.Append(errs, err)
+
+	infos.OutboxMessages, err = d.dbModelRowsCount(messengertypes.OutboxMessage{})
+	errs = multierr.Append(errs, err)
+
+	infos.APITokens, err = d.dbModelRowsCount(messengertypes.APIToken{})
+	errs = multierr.Append(errs, err)
+
+	infos.InteractionReactions, err = d.dbModelRowsCount(messengertypes.InteractionReaction{})
+	errs = multierr.Append(errs, err)
+
+	infos.ContactRequestAutoAccepts, err = d.dbModelRowsCount(messengertypes.ContactRequestAutoAccept{})
+	errs = multierr.Append(errs, err)
+
+	infos.ContactIntroductions, err = d.dbModelRowsCount(messengertypes.ContactIntroduction{})
+	errs = multierr.Append(errs, err)
+
+	infos.InteractionExtensions, err = d.dbModelRowsCount(messengertypes.InteractionExtension{})
+	errs = multierr.Append(errs, err)
+
+	infos.SentContentHashes, err = d.dbModelRowsCount(messengertypes.SentContentHash{})
+	errs = multierr.Append(errs, err)
+
+	infos.DBSnapshots, err = d.dbModelRowsCount(messengertypes.DBSnapshot{})
+	errs = multierr.Append(errs, err)
+
+	infos.LocalEchoes, err = d.dbModelRowsCount(messengertypes.LocalEcho{})
+	errs = multierr.Append(errs, err)
+
+	infos.MutedMembers, err = d.dbModelRowsCount(messengertypes.MutedMember{})
+	errs = multierr.Append(errs, err)
+
+	infos.OutgoingContactRequests, err = d.dbModelRowsCount(messengertypes.OutgoingContactRequest{})
+	errs = multierr.Append(errs, err)
+
+	infos.Audiences, err = d.dbModelRowsCount(messengertypes.Audience{})
+	errs = multierr.Append(errs, err)
+
+	infos.AudienceMembers, err = d.dbModelRowsCount(messengertypes.AudienceMember{})
+	errs = multierr.Append(errs, err)
+
+	infos.Broadcasts, err = d.dbModelRowsCount(messengertypes.Broadcast{})
+	errs = multierr.Append(errs, err)
+
+	infos.BroadcastRecipients, err = d.dbModelRowsCount(messengertypes.BroadcastRecipient{})
+	errs = multierr.Append(errs, err)
+
+	return infos, errs
+}
+
+// setDeviceInfo records the description announced by a device in a message sent at date, the older descriptions are
+// ignored. It returns the device when it is updated
+func (d *dbWrapper) setDeviceInfo(devicePK string, info *messengertypes.DeviceInfo, date int64) (*messengertypes.Device, error) {
+	if devicePK == "" || info == nil {
+		return nil, nil
+	}
+
+	res := d.db.
+		Model(&messengertypes.Device{}).
+		Where("public_key = ? AND info_date < ? AND (kind != ? OR name != ?)", devicePK, date, info.GetKind(), info.GetName()).
+		Updates(map[string]interface{}{"kind": info.GetKind(), "name": info.GetName(), "info_date": date})
+	if res.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	device, err := d.getDeviceByPK(devicePK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return device, nil
+}
+
+// setDeviceCapabilities stores the capabilities announced by a message of a device, unless a newer message announced
+// them already. The messages sent without the packing of the app messages, ie. the acks, announce nothing
+func (d *dbWrapper) setDeviceCapabilities(devicePK string, capabilities uint32, date int64) error {
+	if devicePK == "" || capabilities == 0 {
+		return nil
+	}
+
+	if err := d.db.
+		Model(&messengertypes.Device{}).
+		Where("public_key = ? AND capabilities_date < ? AND capabilities != ?", devicePK, date, capabilities).
+		Updates(map[string]interface{}{"capabilities": capabilities, "capabilities_date": date}).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getConversationCapabilities returns the capabilities shared by all the known devices of the members of a
+// conversation, none if a member has no known device
+func (d *dbWrapper) getConversationCapabilities(convPK string) (uint32, error) {
+	memberPKs := []string(nil)
+	if err := d.db.
+		Model(&messengertypes.Member{}).
+		Where("conversation_public_key = ? AND removed_date = ?", convPK, 0).
+		Pluck("public_key", &memberPKs).
+		Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(memberPKs) == 0 {
+		return 0, nil
+	}
+
+	devices := []*messengertypes.Device(nil)
+	if err := d.db.Where("member_public_key IN ?", memberPKs).Find(&devices).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	withDevice := make(map[string]bool, len(memberPKs))
+	capabilities := ^uint32(0)
+	for _, device := range devices {
+		withDevice[device.GetMemberPublicKey()] = true
+		capabilities &= device.GetCapabilities()
+	}
+
+	if len(withDevice) < len(memberPKs) {
+		return 0, nil
+	}
+
+	return capabilities, nil
+}
+
+func (d *dbWrapper) addDevice(devicePK string, memberPK string) (*messengertypes.Device, error) {
+	if devicePK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a device public key is required"))
+	}
+
+	if memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		// Check if this device already exists for another member
+		{
+			count := int64(0)
+
+			if err := tx.db.
+				Model(&messengertypes.Device{}).
+				Where("member_public_key != ? AND public_key = ?", memberPK, devicePK).
+				Count(&count).
+				Error; err != nil {
+				return err
+			}
+
+			if count > 0 {
+				return errcode.ErrDBWrite.Wrap(fmt.Errorf("the device already exists for another member"))
+			}
+		}
+
+		return tx.db.
+			Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&messengertypes.Device{
+				PublicKey:       devicePK,
+				MemberPublicKey: memberPK,
+			}).
+			Error
+	}); err != nil {
+		return nil, err
+	}
+
+	return d.getDeviceByPK(devicePK)
+}
+
+func (d *dbWrapper) updateContact(pk string, contact messengertypes.Contact) error {
+	if pk == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no public key specified"))
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: pk}).Count(&count).Error; err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact not found"))
+	}
+
+	return d.db.Model(&messengertypes.Contact{PublicKey: pk}).Updates(&contact).Error
+}
+
+func (d *dbWrapper) addInteraction(rawInte messengertypes.Interaction) (*messengertypes.Interaction, bool, error) {
+	if rawInte.CID == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	_, err := d.getInteractionByCID(rawInte.CID)
+	isNew := false
+	if err == gorm.ErrRecordNotFound {
+		if err := d.normalizeInteractionSentDate(&rawInte); err != nil {
+			return nil, false, err
+		}
+
+		if err := d.db.Create(&rawInte).Error; err != nil {
+			return nil, true, err
+		}
+		isNew = true
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	i, err := d.getInteractionByCID(rawInte.CID)
+	return i, isNew, err
+}
+
+func (d *dbWrapper) getReplyOptionsCIDForConversation(pk string) (string, error) {
+	if pk == "" {
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	cid := ""
+
+	order := d.backend().insertionOrder()
+	if err := d.db.Model(&messengertypes.Interaction{}).
+		Raw(`SELECT cid
+			FROM interactions
+			WHERE conversation_public_key = ?
+			AND COALESCE (`+order+` > (
+					SELECT MAX(`+order+`)
+					FROM interactions
+					WHERE conversation_public_key = ?
+					AND is_me = true
+				), true)
+			AND is_me = false
+			AND type = ?
+			ORDER BY `+order+` DESC
+			LIMIT 1
+		`, pk, pk, messengertypes.AppMessage_TypeReplyOptions).Scan(&cid).Error; err != nil {
+		return "", err
+	}
+
+	return cid, nil
+}
+
+func (d *dbWrapper) attributeBacklogInteractions(devicePK, groupPK, memberPK string) ([]*messengertypes.Interaction, error) {
+	if devicePK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing device public key"))
+	}
+
+	if groupPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing conversation public key"))
+	}
+
+	if memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing member public key"))
+	}
+
+	var (
+		backlog []*messengertypes.Interaction
+		cids    []string
+	)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		res := tx.db.
+			Model(&messengertypes.Interaction{}).
+			Where("device_public_key = ? AND conversation_public_key = ? AND member_public_key = \"\"", devicePK, groupPK).
+			Order("sent_date asc")
+
+		if err := res.
+			Pluck("cid", &cids).
+			Error; err != nil {
+			return err
+		}
+
+		if len(cids) == 0 {
+			return nil
+		}
+
+		if err := res.Update("member_public_key", memberPK).Error; err != nil {
+			return err
+		}
+
+		// the interactions received before the device of a blocked member was known must be hidden too
+		if blocked, err := tx.isMemberBlocked(memberPK); err != nil {
+			return err
+		} else if blocked {
+			if err := tx.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", cids).Update("is_sender_blocked", true).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.db.Preload(clause.Associations).Order(tx.backend().insertionOrder()+" asc").Find(&backlog, cids).Error; err != nil {
+			return err
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return backlog, nil
+}
+
+func (d *dbWrapper) addMember(memberPK, groupPK, displayName, avatarCID string, isMe bool, isCreator bool) (*messengertypes.Member, error) {
+	if memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("member public key cannot be empty"))
+	}
+
+	if groupPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("conversation public key cannot be empty"))
+	}
+
+	member := &messengertypes.Member{
+		PublicKey:             memberPK,
+		ConversationPublicKey: groupPK,
+		AvatarCID:             avatarCID,
+		IsCreator:             isCreator,
+		IsMe:                  isMe,
+		JoinedDate:            timestampMs(time.Now()),
+	}
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		// Check if member already exists
+		if m, err := tx.getMemberByPK(memberPK, groupPK); err == nil {
+			member = m
+			return errcode.ErrDBEntryAlreadyExists
+		} else if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+
+		// Ensure a display name
+		if displayName == "" {
+			nameSuffix := "1337"
+			if len(memberPK) >= 4 {
+				nameSuffix = memberPK[:4]
+			}
+			displayName = "anon#" + nameSuffix
+		}
+		member.DisplayName = displayName
+
+		return tx.db.Create(&member).Error
+	}); errcode.Is(err, errcode.ErrDBEntryAlreadyExists) {
+		return member, err
+	} else if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+func (d *dbWrapper) upsertMember(memberPK, groupPK string, m messengertypes.Member) (*messengertypes.Member, bool, error) {
+	if memberPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("member public key cannot be empty"))
+	}
+	if groupPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("conversation public key cannot be empty"))
+	}
+
+	isNew := false
+	em, err := d.getMemberByPK(memberPK, groupPK)
+	if err == gorm.ErrRecordNotFound {
+		isNew = true
+	} else if err != nil {
+		return nil, isNew, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if em.GetDisplayName() == "" && m.DisplayName == "" {
+		nameSuffix := "1337"
+		if len(memberPK) >= 4 {
+			nameSuffix = memberPK[:4]
+		}
+		m.DisplayName = "anon#" + nameSuffix
+	}
+
+	if isNew {
+		m.JoinedDate = m.InfoDate
+		if m.JoinedDate == 0 {
+			m.JoinedDate = timestampMs(time.Now())
+		}
+
+		err := d.db.Create(&m).Error
+		if err != nil {
+			return nil, isNew, errcode.ErrDBWrite.Wrap(err)
+		}
+	} else {
+		err := d.db.Model(em).Updates(&m).Error
+		if err != nil {
+			return nil, false, errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	um, err := d.getMemberByPK(memberPK, groupPK)
+	if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return um, isNew, nil
+}
+
+// setMemberIsObserver flags a member of a group as an observer, or as a participant again
+func (d *dbWrapper) setMemberIsObserver(memberPK, groupPK string, observer bool) (*messengertypes.Member, error) {
+	if err := d.db.Model(&messengertypes.Member{}).
+		Where(&messengertypes.Member{PublicKey: memberPK, ConversationPublicKey: groupPK}).
+		Update("is_observer", observer).
+		Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	member, err := d.getMemberByPK(memberPK, groupPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return member, nil
+}
+
+// setMemberStatusText replaces the status of a member, an empty status clears it
+func (d *dbWrapper) setMemberStatusText(memberPK, groupPK, statusText string) (*messengertypes.Member, error) {
+	if err := d.db.Model(&messengertypes.Member{}).
+		Where(&messengertypes.Member{PublicKey: memberPK, ConversationPublicKey: groupPK}).
+		Update("status_text", statusText).
+		Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	member, err := d.getMemberByPK(memberPK, groupPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return member, nil
+}
+
+// setContactStatusText replaces the status of a contact, an empty status clears it
+func (d *dbWrapper) setContactStatusText(contactPK, statusText string) error {
+	if err := d.db.Model(&messengertypes.Contact{}).
+		Where(&messengertypes.Contact{PublicKey: contactPK}).
+		Update("status_text", statusText).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) setConversationIsOpenStatus(conversationPK string, status bool) (*messengertypes.Conversation, bool, error) {
+	if conversationPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	conversation, err := d.getConversationByPK(conversationPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if conversation.IsOpen == status {
+		return conversation, false, nil
+	}
+
+	conversation.IsOpen = status
+	values := map[string]interface{}{
+		"is_open": status,
+	}
+
+	if status {
+		conversation.UnreadCount = 0
+		values["unread_count"] = 0
+	}
+
+	if err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Where(&messengertypes.Conversation{PublicKey: conversationPK}).
+		Updates(values).
+		Error; err != nil {
+		return nil, false, err
+	}
+
+	return conversation, true, err
+}
+
+func (d *dbWrapper) getConversationReadUntil(conversationPK string) (int64, error) {
+	if conversationPK == "" {
+		return 0, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	readUntil := []int64(nil)
+	if err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Where(&messengertypes.Conversation{PublicKey: conversationPK}).
+		Pluck("read_until", &readUntil).
+		Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(readUntil) == 0 {
+		return 0, nil
+	}
+
+	return readUntil[0], nil
+}
+
+func (d *dbWrapper) isConversationOpened(conversationPK string) (bool, error) {
+	if conversationPK == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	var ret int64
+
+	err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Where(&messengertypes.Conversation{PublicKey: conversationPK, IsOpen: true}).
+		Count(&ret).Error
+
+	return ret == 1, err
+}
+
+type dbLogWrapper struct {
+	logger.Interface
+}
+
+func (d *dbLogWrapper) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	// Mute gorm.ErrRecordNotFound errors
+	if err == gorm.ErrRecordNotFound {
+		err = nil
+	}
+
+	d.Interface.Trace(ctx, begin, fc, err)
+}
+
+func (d *dbWrapper) addServiceToken(accountPK string, serviceToken *protocoltypes.ServiceToken) error {
+	if accountPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if len(serviceToken.SupportedServices) == 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no services specified"))
+	}
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		for _, s := range serviceToken.SupportedServices {
+			res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&messengertypes.ServiceToken{
+				AccountPK:         accountPK,
+				TokenID:           serviceToken.TokenID(),
+				ServiceType:       s.ServiceType,
+				AuthenticationURL: serviceToken.AuthenticationURL,
+				Expiration:        serviceToken.Expiration,
+			})
+
+			if err := res.Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) accountSetReplicationAutoEnable(pk string, enabled bool) error {
+	updates := map[string]interface{}{
+		"replicate_new_groups_automatically": enabled,
+	}
+
+	// db update
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(updates)
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) saveConversationReplicationInfo(c messengertypes.ConversationReplicationInfo) error {
+	if c.CID == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	tx := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(c)
+	if tx.Error != nil {
+		return errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	return nil
+}
+
+// getReplicatedConversationsPKs returns the conversations registered on at least one replication service
+func (d *dbWrapper) getReplicatedConversationsPKs() ([]string, error) {
+	pks := []string(nil)
+	if err := d.db.Model(&messengertypes.ConversationReplicationInfo{}).Distinct().Pluck("conversation_public_key", &pks).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return pks, nil
+}
+
+// getConversationsPKsReplicatedOn returns the conversations registered on the replication services of an
+// authentication url
+func (d *dbWrapper) getConversationsPKsReplicatedOn(authURL string) ([]string, error) {
+	pks := []string(nil)
+	if err := d.db.
+		Model(&messengertypes.ConversationReplicationInfo{}).
+		Where(&messengertypes.ConversationReplicationInfo{AuthenticationURL: authURL}).
+		Distinct().
+		Pluck("conversation_public_key", &pks).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return pks, nil
+}
+
+// getReplicationServiceTokens returns the replication tokens of the account whatever their state, the oldest first
+func (d *dbWrapper) getReplicationServiceTokens() ([]*messengertypes.ServiceToken, error) {
+	tokens := []*messengertypes.ServiceToken(nil)
+	if err := d.db.
+		Where(&messengertypes.ServiceToken{ServiceType: bertyprotocol.ServiceReplicationID}).
+		Order("added_date, token_id").
+		Find(&tokens).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tokens, nil
+}
+
+func (d *dbWrapper) getReplicationServiceToken(tokenID string) (*messengertypes.ServiceToken, error) {
+	token := &messengertypes.ServiceToken{}
+	if err := d.db.First(token, &messengertypes.ServiceToken{TokenID: tokenID, ServiceType: bertyprotocol.ServiceReplicationID}).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// updateServiceToken updates the rows of all the services of a token and returns its replication one
+func (d *dbWrapper) updateServiceToken(tokenID string, values map[string]interface{}) (*messengertypes.ServiceToken, error) {
+	res := d.db.Model(&messengertypes.ServiceToken{}).Where(&messengertypes.ServiceToken{TokenID: tokenID}).Updates(values)
+	if res.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("unknown token %s", tokenID))
+	}
+
+	token, err := d.getReplicationServiceToken(tokenID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("token %s isn't a replication token", tokenID))
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return token, nil
+}
+
+// replaceReplicationTokens dates a token added to the account and, if it is a replication token, retires the older
+// replication tokens of its authentication url still in use, it returns the tokens replaced
+func (d *dbWrapper) replaceReplicationTokens(tokenID string, authURL string, date int64) ([]*messengertypes.ServiceToken, error) {
+	replaced := []*messengertypes.ServiceToken(nil)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.
+			Model(&messengertypes.ServiceToken{}).
+			Where("token_id = ? AND added_date = ?", tokenID, 0).
+			Update("added_date", date).
+			Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if _, err := tx.getReplicationServiceToken(tokenID); errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		query := tx.db.
+			Where("service_type = ? AND authentication_url = ? AND token_id != ? AND added_date <= ?", bertyprotocol.ServiceReplicationID, authURL, tokenID, date).
+			Where("state IN ?", []messengertypes.ServiceToken_State{messengertypes.ServiceToken_StateActive, messengertypes.ServiceToken_StateExpiring, messengertypes.ServiceToken_StateExpired})
+		if err := query.Find(&replaced).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, token := range replaced {
+			token.State = messengertypes.ServiceToken_StateRenewed
+			token.RenewedByTokenID = tokenID
+			if _, err := tx.updateServiceToken(token.GetTokenID(), map[string]interface{}{
+				"state":               messengertypes.ServiceToken_StateRenewed,
+				"renewed_by_token_id": tokenID,
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return replaced, nil
+}
+
+// getLatestInteractionAmongCIDs returns the most recent interaction of a conversation among cids, nil if none of them
+// is known
+func (d *dbWrapper) getLatestInteractionAmongCIDs(convPK string, cids []string) (*messengertypes.Interaction, error) {
+	if len(cids) == 0 {
+		return nil, nil
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if err := d.db.
+		Where("conversation_public_key = ? AND cid IN ?", convPK, cids).
+		Order("sent_date DESC").
+		Limit(1).
+		Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(interactions) == 0 {
+		return nil, nil
+	}
+
+	return interactions[0], nil
+}
+
+// setReplicationInfoLastSeenHead records the most recent message found on a replication service, an older head doesn't
+// replace the current one
+func (d *dbWrapper) setReplicationInfoLastSeenHead(infoCID string, head string, sentDate int64) (bool, error) {
+	if infoCID == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a replication info cid is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.ConversationReplicationInfo{}).
+		Where("cid = ? AND COALESCE(last_seen_head_date, 0) < ?", infoCID, sentDate).
+		Updates(map[string]interface{}{
+			"last_seen_head":      head,
+			"last_seen_head_date": sentDate,
+		})
+	if tx.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	return tx.RowsAffected > 0, nil
+}
+
+// getOldestInteractionSentAfter returns the oldest message of a conversation sent after date, the local interactions
+// are not in the logs and are ignored. It returns nil if there is none
+func (d *dbWrapper) getOldestInteractionSentAfter(convPK string, date int64) (*messengertypes.Interaction, error) {
+	interactions := []*messengertypes.Interaction(nil)
+	if err := d.db.
+		Where("conversation_public_key = ? AND sent_date > ? AND type < ?", convPK, date, messengertypes.AppMessage_TypeMonitorMetadata).
+		Order("sent_date ASC").
+		Limit(1).
+		Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(interactions) == 0 {
+		return nil, nil
+	}
+
+	return interactions[0], nil
+}
+
+// setConversationReplicationState updates the replication state of a conversation, it returns whether it changed
+func (d *dbWrapper) setConversationReplicationState(convPK string, lastReplicatedDate int64, isStale bool) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ? AND (COALESCE(last_replicated_date, 0) != ? OR COALESCE(is_replication_stale, 0) != ?)", convPK, lastReplicatedDate, isStale).
+		Updates(map[string]interface{}{
+			"last_replicated_date": lastReplicatedDate,
+			"is_replication_stale": isStale,
+		})
+	if tx.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, tx.RowsAffected > 0, nil
+}
+
+// setConversationMigration records the group replacing a conversation, the most recent migration wins
+func (d *dbWrapper) setConversationMigration(convPK, migratedToPK, link string, date int64) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" || migratedToPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a migrated to public key are required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ? AND COALESCE(migrated_date, 0) < ?", convPK, date).
+		Updates(map[string]interface{}{
+			"migrated_to_public_key": migratedToPK,
+			"migrated_to_link":       link,
+			"migrated_date":          date,
+		})
+	if tx.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, tx.RowsAffected > 0, nil
+}
+
+func (d *dbWrapper) addMedias(medias []*messengertypes.Media) ([]bool, error) {
+	if len(medias) == 0 {
+		return []bool{}, nil
+	}
+	for _, m := range medias {
+		if err := ensureValidBase64CID(m.GetCID()); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	var dbMedias []*messengertypes.Media
+	cids := make([]string, len(medias))
+	for i, m := range medias {
+		cids[i] = m.GetCID()
+	}
+	err := d.db.Model(&messengertypes.Media{}).Where("cid IN ?", cids).Find(&dbMedias).Error
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	willAdd := make([]bool, len(medias))
+	for i, m := range medias {
+		found := false
+		for _, n := range dbMedias {
+			if m.GetCID() == n.GetCID() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			willAdd[i] = true
+		}
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(medias).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	// the medias prepared are tracked until a message sent with them is received
+	prepared, referenced := []*messengertypes.Media(nil), []string(nil)
+	for i, m := range medias {
+		switch {
+		case m.GetInteractionCID() != "":
+			referenced = append(referenced, m.GetCID())
+		case willAdd[i] && m.GetState() == messengertypes.Media_StatePrepared:
+			prepared = append(prepared, m)
+		}
+	}
+
+	if err := d.addMediaTombstones(prepared, messengertypes.MediaTombstone_ReasonNotSent, timestampMs(time.Now())); err != nil {
+		return nil, err
+	}
+
+	if err := d.deleteMediaTombstones(referenced); err != nil {
+		return nil, err
+	}
+
+	return willAdd, nil
+}
+
+// addMediaTombstones marks medias which may not be referenced anymore, the existing marks are kept
+func (d *dbWrapper) addMediaTombstones(medias []*messengertypes.Media, reason messengertypes.MediaTombstone_Reason, date int64) error {
+	if len(medias) == 0 {
+		return nil
+	}
+
+	tombstones := make([]*messengertypes.MediaTombstone, len(medias))
+	for i, media := range medias {
+		tombstones[i] = &messengertypes.MediaTombstone{CID: media.GetCID(), Reason: reason, OrphanedDate: date}
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(tombstones).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) deleteMediaTombstones(cids []string) error {
+	if len(cids) == 0 {
+		return nil
+	}
+
+	if err := d.db.Where("cid IN ?", cids).Delete(&messengertypes.MediaTombstone{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getMediaTombstones returns the tombstones of the medias orphaned before a date, the oldest first
+func (d *dbWrapper) getMediaTombstones(before int64) ([]*messengertypes.MediaTombstone, error) {
+	tombstones := []*messengertypes.MediaTombstone(nil)
+	if err := d.db.Where("orphaned_date < ?", before).Order("orphaned_date, cid").Find(&tombstones).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tombstones, nil
+}
+
+// getMediasByCID returns the medias of cids found in the database
+func (d *dbWrapper) getMediasByCID(cids []string) (map[string]*messengertypes.Media, error) {
+	medias := []*messengertypes.Media(nil)
+	if len(cids) > 0 {
+		if err := d.db.Where("cid IN ?", cids).Find(&medias).Error; err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+	}
+
+	byCID := make(map[string]*messengertypes.Media, len(medias))
+	for _, media := range medias {
+		byCID[media.GetCID()] = media
+	}
+
+	return byCID, nil
+}
+
+// getReferencedMediaCIDs returns the cids still attached to an interaction or used as an avatar
+func (d *dbWrapper) getReferencedMediaCIDs(cids []string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	if len(cids) == 0 {
+		return referenced, nil
+	}
+
+	attached := []string(nil)
+	if err := d.db.Model(&messengertypes.Media{}).
+		Where("cid IN ? AND interaction_cid IN (?)", cids, d.db.Model(&messengertypes.Interaction{}).Select("cid")).
+		Pluck("cid", &attached).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, cid := range attached {
+		referenced[cid] = true
+	}
+
+	for _, model := range []interface{}{&messengertypes.Account{}, &messengertypes.Contact{}, &messengertypes.Conversation{}, &messengertypes.Member{}, &messengertypes.MemberProfileChange{}} {
+		avatars := []string(nil)
+		if err := d.db.Model(model).Where("avatar_cid IN ?", cids).Pluck("avatar_cid", &avatars).Error; err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, cid := range avatars {
+			referenced[cid] = true
+		}
+	}
+
+	return referenced, nil
+}
+
+func (d *dbWrapper) getMedias(cids []string) ([]*messengertypes.Media, error) {
+	if len(cids) == 0 {
+		return nil, nil
+	}
+	for _, c := range cids {
+		if err := ensureValidBase64CID(c); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	var dbMedias []*messengertypes.Media
+	err := d.db.Model(&messengertypes.Media{}).Where("cid IN ?", cids).Find(&dbMedias).Error
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	medias := make([]*messengertypes.Media, len(cids))
+	for i, cid := range cids {
+		medias[i] = &messengertypes.Media{CID: cid}
+		for _, dbMedia := range dbMedias {
+			if dbMedia.GetCID() == cid {
+				medias[i] = dbMedia
+			}
+		}
+	}
+	return medias, nil
+}
+
+func (d *dbWrapper) getAllMedias() ([]*messengertypes.Media, error) {
+	var medias []*messengertypes.Media
+	err := d.db.Find(&medias).Error
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+	return medias, nil
+}
+
+func (d *dbWrapper) getMediasByState(state messengertypes.Media_State) ([]*messengertypes.Media, error) {
+	var medias []*messengertypes.Media
+	if err := d.db.Where(&messengertypes.Media{State: state}).Find(&medias).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+	return medias, nil
+}
+
+// addMediaHolder records a device holding a media, the last announcement of the device is kept
+func (d *dbWrapper) addMediaHolder(holder *messengertypes.MediaHolder) error {
+	if err := validateMediaHolder(holder); err != nil {
+		return err
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "media_cid"}, {Name: "device_public_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"member_public_key", "conversation_public_key", "peer_id", "announced_date"}),
+		Where:     clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "media_holders.announced_date <= excluded.announced_date"}}},
+	}).Create(holder).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getMediaHolderPeerIDs returns the peers of the devices holding a media, the last announced first
+func (d *dbWrapper) getMediaHolderPeerIDs(cid string, count int) ([]string, error) {
+	peerIDs := []string(nil)
+	if err := d.db.
+		Model(&messengertypes.MediaHolder{}).
+		Where("media_cid = ?", cid).
+		Group("peer_id").
+		Order("MAX(announced_date) DESC").
+		Limit(count).
+		Pluck("peer_id", &peerIDs).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return peerIDs, nil
+}
+
+// getDownloadedMediaCIDsByConversation returns the downloaded medias of the messages received from the other members, by
+// conversation
+func (d *dbWrapper) getDownloadedMediaCIDsByConversation() (map[string][]string, error) {
+	rows := []struct {
+		CID                   string
+		ConversationPublicKey string
+	}(nil)
+	if err := d.db.
+		Table("medias").
+		Select("medias.cid AS cid, interactions.conversation_public_key AS conversation_public_key").
+		Joins("JOIN interactions ON interactions.cid = medias.interaction_cid").
+		Where("medias.state = ? AND interactions.is_me = ?", messengertypes.Media_StateDownloaded, false).
+		Order("medias.cid").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	cids := map[string][]string{}
+	for _, row := range rows {
+		cids[row.ConversationPublicKey] = append(cids[row.ConversationPublicKey], row.CID)
+	}
+
+	return cids, nil
+}
+
+func (d *dbWrapper) updateMediaState(cid string, state messengertypes.Media_State) (*messengertypes.Media, bool, error) {
+	if cid == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a media cid is required"))
+	}
+
+	res := d.db.
+		Model(&messengertypes.Media{}).
+		Where("cid = ? AND state != ?", cid, state).
+		Update("state", state)
+	if res.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	media := &messengertypes.Media{}
+	if err := d.db.First(&media, &messengertypes.Media{CID: cid}).Error; err != nil {
+		return nil, false, err
+	}
+
+	return media, res.RowsAffected > 0, nil
+}
+
+func (d *dbWrapper) setAccountLastReplayDate(pk string, date int64) error {
+	if pk == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("last_replay_date", date).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) setAccountLastMaintenanceDate(pk string, date int64) error {
+	if pk == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("last_maintenance_date", date).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) setMediaChecksum(cid string, checksum string) error {
+	if cid == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a media cid is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Media{}).Where(&messengertypes.Media{CID: cid}).Update("checksum", checksum).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addMediaUpload adds an upload unless it is already known, ie. the file is prepared again to resume its upload
+func (d *dbWrapper) addMediaUpload(upload *messengertypes.MediaUpload) error {
+	if upload.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an upload id is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(upload).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getMediaUpload(id string) (*messengertypes.MediaUpload, error) {
+	upload := &messengertypes.MediaUpload{}
+	if err := d.db.First(upload, &messengertypes.MediaUpload{ID: id}).Error; err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// getMediaUploads returns the uploads of a client id or of a conversation, all of them when both are empty
+func (d *dbWrapper) getMediaUploads(clientID string, convPK string) ([]*messengertypes.MediaUpload, error) {
+	uploads := []*messengertypes.MediaUpload(nil)
+	if err := d.db.Where(&messengertypes.MediaUpload{ClientID: clientID, ConversationPublicKey: convPK}).Order("created_date, id").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+
+	return uploads, nil
+}
+
+// getResumableMediaUploads returns the uploads whose manifest isn't published yet
+func (d *dbWrapper) getResumableMediaUploads() ([]*messengertypes.MediaUpload, error) {
+	uploads := []*messengertypes.MediaUpload(nil)
+	if err := d.db.
+		Where("state IN ?", []messengertypes.MediaUpload_State{messengertypes.MediaUpload_StateChunking, messengertypes.MediaUpload_StateChunksStored}).
+		Order("created_date, id").
+		Find(&uploads).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return uploads, nil
+}
+
+func (d *dbWrapper) getMediaUploadChunks(id string) ([]*messengertypes.MediaUploadChunk, error) {
+	chunks := []*messengertypes.MediaUploadChunk(nil)
+	if err := d.db.Where(&messengertypes.MediaUploadChunk{UploadID: id}).Order("chunk_index").Find(&chunks).Error; err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// getMediaUploadChunkCIDs returns the cids of the chunks of the medias uploaded in chunks, in the order of the medias
+func (d *dbWrapper) getMediaUploadChunkCIDs(mediaCIDs []string) ([]string, error) {
+	if len(mediaCIDs) == 0 {
+		return nil, nil
+	}
+
+	rows := []struct {
+		MediaCID string
+		CID      string
+	}(nil)
+	if err := d.db.
+		Table("media_upload_chunks").
+		Select("media_uploads.media_cid AS media_cid, media_upload_chunks.cid AS cid").
+		Joins("JOIN media_uploads ON media_uploads.id = media_upload_chunks.upload_id").
+		Where("media_uploads.media_cid IN ?", mediaCIDs).
+		Order("media_upload_chunks.chunk_index").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	byMedia := make(map[string][]string, len(mediaCIDs))
+	for _, row := range rows {
+		byMedia[row.MediaCID] = append(byMedia[row.MediaCID], row.CID)
+	}
+
+	cids := []string(nil)
+	for _, mediaCID := range mediaCIDs {
+		cids = append(cids, byMedia[mediaCID]...)
+		delete(byMedia, mediaCID)
+	}
+
+	return cids, nil
+}
+
+// addMediaUploadChunk records a chunk stored and returns the updated upload, the upload moves to
+// MediaUpload_StateChunksStored with its last chunk
+func (d *dbWrapper) addMediaUploadChunk(chunk *messengertypes.MediaUploadChunk, date int64) (*messengertypes.MediaUpload, error) {
+	var upload *messengertypes.MediaUpload
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		var err error
+		if upload, err = tx.getMediaUpload(chunk.GetUploadID()); err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if upload.GetState() != messengertypes.MediaUpload_StateChunking || chunk.GetChunkIndex() != upload.GetStoredChunks() {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unexpected chunk %d for upload %s", chunk.GetChunkIndex(), upload.GetID()))
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(chunk).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		upload.StoredChunks = chunk.GetChunkIndex() + 1
+		upload.UpdatedDate = date
+		if upload.StoredChunks >= upload.GetChunkCount() {
+			upload.State = messengertypes.MediaUpload_StateChunksStored
+		}
+
+		if err := tx.db.Model(&messengertypes.MediaUpload{}).Where(&messengertypes.MediaUpload{ID: upload.GetID()}).Updates(map[string]interface{}{
+			"stored_chunks": upload.GetStoredChunks(),
+			"state":         upload.GetState(),
+			"updated_date":  date,
+		}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (d *dbWrapper) setMediaUploadPublished(id string, mediaCID string, date int64) (*messengertypes.MediaUpload, error) {
+	return d.updateMediaUpload(id, map[string]interface{}{
+		"state":        messengertypes.MediaUpload_StatePublished,
+		"media_cid":    mediaCID,
+		"updated_date": date,
+	})
+}
+
+func (d *dbWrapper) setMediaUploadFailed(id string, reason string, date int64) (*messengertypes.MediaUpload, error) {
+	return d.updateMediaUpload(id, map[string]interface{}{
+		"state":        messengertypes.MediaUpload_StateFailed,
+		"error":        reason,
+		"updated_date": date,
+	})
+}
+
+func (d *dbWrapper) updateMediaUpload(id string, values map[string]interface{}) (*messengertypes.MediaUpload, error) {
+	if err := d.db.Model(&messengertypes.MediaUpload{}).Where(&messengertypes.MediaUpload{ID: id}).Updates(values).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	upload, err := d.getMediaUpload(id)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return upload, nil
+}
+
+func (d *dbWrapper) setAccountMediaDownloadPolicy(pk string, mode messengertypes.MediaDownloadPolicy_Mode, maxSize int64) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if maxSize < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max size can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(map[string]interface{}{
+		"media_download_mode":     mode,
+		"media_download_max_size": maxSize,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) setAccountLinkPreviewsEnabled(pk string, enabled bool) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("link_previews_enabled", enabled)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) setAccountPresenceEnabled(pk string, enabled bool) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("presence_enabled", enabled)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) setContactPresenceHidden(pk string, hidden bool) (*messengertypes.Contact, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: pk}).Update("presence_hidden", hidden)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("contact not found"))
+	}
+
+	return d.getContactByPK(pk)
+}
+
+// setContactVerification updates the verification of a contact, the date and the devices hash are kept when they are empty
+func (d *dbWrapper) setContactVerification(pk string, state messengertypes.Contact_VerificationState, devicesHash string, date int64) (*messengertypes.Contact, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	values := map[string]interface{}{"verification_state": state}
+	if devicesHash != "" {
+		values["verified_devices_hash"] = devicesHash
+	}
+	if date != 0 {
+		values["verified_date"] = date
+	}
+
+	tx := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: pk}).Updates(values)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("contact not found"))
+	}
+
+	return d.getContactByPK(pk)
+}
+
+func (d *dbWrapper) setContactNickname(pk, nickname, note string) (*messengertypes.Contact, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: pk}).Updates(map[string]interface{}{
+		"nickname": nickname,
+		"note":     note,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("contact not found"))
+	}
+
+	return d.getContactByPK(pk)
+}
+
+func (d *dbWrapper) setMemberNickname(memberPK, convPK, nickname, note string) (*messengertypes.Member, error) {
+	if memberPK == "" || convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key and a conversation public key are required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Member{}).Where(&messengertypes.Member{PublicKey: memberPK, ConversationPublicKey: convPK}).Updates(map[string]interface{}{
+		"nickname": nickname,
+		"note":     note,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("member not found"))
+	}
+
+	member, err := d.getMemberByPK(memberPK, convPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return member, nil
+}
+
+func (d *dbWrapper) setConversationMediaDownloadPolicy(pk string, mode messengertypes.MediaDownloadPolicy_Mode, maxSize int64) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if maxSize < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max size can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Updates(map[string]interface{}{
+		"media_download_mode":     mode,
+		"media_download_max_size": maxSize,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getConversationByPK(pk)
+}
+
+func (d *dbWrapper) setConversationPushMuted(pk string, muted bool) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Update("push_muted", muted)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(pk)
+}
+
+func (d *dbWrapper) setConversationHistorySharing(pk string, window int64) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if window < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the history sharing window can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Update("history_sharing_window", window)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(pk)
+}
+
+// getHistoryBundle returns the messages of a conversation sent since a date which can be shared with a new member, the
+// messages imported, shared by another member, filtered or sent by a blocked member are left out
+func (d *dbWrapper) getHistoryBundle(convPK string, since int64, count int) (*messengertypes.HistoryBundle, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if err := d.db.
+		Preload("Conversation").
+		Where(&messengertypes.Interaction{ConversationPublicKey: convPK, Type: messengertypes.AppMessage_TypeUserMessage}).
+		Where("sent_date >= ? AND is_imported = ? AND is_shared_history = ? AND is_filtered = ? AND is_sender_blocked = ?", since, false, false, false, false).
+		Order("sent_date DESC, cid DESC").
+		Limit(count).
+		Find(&interactions).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	bundle := &messengertypes.HistoryBundle{}
+	for idx := len(interactions) - 1; idx >= 0; idx-- {
+		i := interactions[idx]
+		bundle.Messages = append(bundle.Messages, &messengertypes.HistoryBundle_Message{
+			CID:             i.GetCID(),
+			MemberPublicKey: interactionSenderMemberPK(i),
+			SentDate:        i.GetSentDate(),
+			Payload:         i.GetPayload(),
+		})
+	}
+
+	return bundle, nil
+}
+
+// getPendingOutgoingInteractions returns the oldest messages of the given types sent by a device in a conversation which
+// have not been acknowledged yet, with their medias
+func (d *dbWrapper) getPendingOutgoingInteractions(convPK, devicePK string, types []messengertypes.AppMessage_Type, count int) ([]*messengertypes.Interaction, error) {
+	if convPK == "" || devicePK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation and a device public key are required"))
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if err := d.db.
+		Preload(clause.Associations).
+		Where("conversation_public_key = ? AND device_public_key = ? AND is_me = ? AND acknowledged = ? AND type IN ?", convPK, devicePK, true, false, types).
+		Order("sent_date ASC, cid ASC").
+		Limit(count).
+		Find(&interactions).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// countConversationUnreadAfter counts the messages received in a conversation after a sent date, the messages of the
+// muted members are not counted
+func (d *dbWrapper) countConversationUnreadAfter(pk string, date int64) (int32, error) {
+	count := int64(0)
+	if err := d.db.
+		Model(&messengertypes.Interaction{}).
+		Where("conversation_public_key = ? AND is_me = ? AND is_sender_blocked = ? AND is_member_muted = ? AND type = ? AND sent_date > ?", pk, false, false, false, messengertypes.AppMessage_TypeUserMessage, date).
+		Count(&count).
+		Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return int32(count), nil
+}
+
+// markConversationRead moves the read position of a conversation to a sent date, or to its most recent message when
+// readUntil is 0, the read position never moves backward
+func (d *dbWrapper) markConversationRead(pk string, readUntil int64) (*messengertypes.Conversation, bool, error) {
+	if pk == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	conv, err := d.getConversationByPK(pk)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if readUntil == 0 {
+		dates := []int64(nil)
+		if err := d.db.
+			Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ? AND type = ?", pk, messengertypes.AppMessage_TypeUserMessage).
+			Order("sent_date DESC").
+			Limit(1).
+			Pluck("sent_date", &dates).
+			Error; err != nil {
+			return nil, false, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(dates) > 0 {
+			readUntil = dates[0]
+		}
+	}
+
+	if readUntil < conv.GetReadUntil() {
+		readUntil = conv.GetReadUntil()
+	}
+
+	unreadCount, err := d.countConversationUnreadAfter(pk, readUntil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if readUntil == conv.GetReadUntil() && unreadCount >= conv.GetUnreadCount() {
+		return conv, false, nil
+	}
+
+	values := map[string]interface{}{"read_until": readUntil}
+	if unreadCount < conv.GetUnreadCount() {
+		values["unread_count"] = unreadCount
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Updates(values).Error; err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	conv, err = d.getConversationByPK(pk)
+	if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return conv, true, nil
+}
+
+// markAllConversationsRead marks the conversations with unread messages as read in a single transaction, it returns
+// the updated conversations
+func (d *dbWrapper) markAllConversationsRead() ([]*messengertypes.Conversation, error) {
+	updated := []*messengertypes.Conversation(nil)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		pks := []string(nil)
+		if err := tx.db.Model(&messengertypes.Conversation{}).Where("unread_count > 0").Pluck("public_key", &pks).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, pk := range pks {
+			conv, isUpdated, err := tx.markConversationRead(pk, 0)
+			if err != nil {
+				return err
+			}
+
+			if isUpdated {
+				updated = append(updated, conv)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (d *dbWrapper) setConversationHistoryCursor(pk string, cursor string) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Update("history_cursor", cursor)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(pk)
+}
+
+func (d *dbWrapper) setAccountRetentionPolicy(pk string, maxAge, maxMessages, maxMediaSize int64) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if maxAge < 0 || maxMessages < 0 || maxMediaSize < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("retention limits can't be negative"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(map[string]interface{}{
+		"retention_max_age":        maxAge,
+		"retention_max_messages":   maxMessages,
+		"retention_max_media_size": maxMediaSize,
+	})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+// getRetentionCutoff returns the sent date before which the messages of a conversation are pruned, 0 if none should be
+func (d *dbWrapper) getRetentionCutoff(convPK string, maxAge, maxMessages, now int64) (int64, error) {
+	cutoff := int64(0)
+	if maxAge > 0 {
+		cutoff = now - maxAge
+	}
+
+	if maxMessages > 0 {
+		dates := []int64(nil)
+		if err := d.db.
+			Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ? AND type = ?", convPK, messengertypes.AppMessage_TypeUserMessage).
+			Order("sent_date DESC").
+			Offset(int(maxMessages-1)).
+			Limit(1).
+			Pluck("sent_date", &dates).
+			Error; err != nil {
+			return 0, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(dates) > 0 && dates[0] > cutoff {
+			cutoff = dates[0]
+		}
+	}
+
+	return cutoff, nil
+}
+
+// getPrunableSize returns the size in bytes of the messages of a conversation sent before a date and of their
+// downloaded medias, the starred messages are left out as they are kept by the pruner
+func (d *dbWrapper) getPrunableSize(convPK string, before int64) (int64, error) {
+	if convPK == "" {
+		return 0, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	messages := func() *gorm.DB {
+		return d.db.
+			Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ? AND type = ? AND sent_date < ?", convPK, messengertypes.AppMessage_TypeUserMessage, before).
+			Where("cid NOT IN (SELECT interaction_cid FROM starred_interactions WHERE starred = ?)", true)
+	}
+
+	sizes := struct {
+		PayloadSize int64
+		MediaSize   int64
+	}{}
+
+	if err := messages().Select("COALESCE(SUM(LENGTH(payload)), 0) AS payload_size").Scan(&sizes).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if err := d.db.
+		Model(&messengertypes.Media{}).
+		Select("COALESCE(SUM(size), 0) AS media_size").
+		Where("state IN ? AND interaction_cid IN (?)", []messengertypes.Media_State{messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache}, messages().Select("cid")).
+		Scan(&sizes).
+		Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return sizes.PayloadSize + sizes.MediaSize, nil
+}
+
+// pruneConversationInteractions removes the messages of a conversation sent before a date with the interactions and
+// the medias attached to them, the conversation keeps the date of the most recent message pruned
+func (d *dbWrapper) pruneConversationInteractions(convPK string, before int64) ([]string, []*messengertypes.Media, *messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	var (
+		cids   []string
+		medias []*messengertypes.Media
+		conv   *messengertypes.Conversation
+	)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		// the starred messages are kept
+		pruned := []*messengertypes.Interaction(nil)
+		if err := tx.db.
+			Where("conversation_public_key = ? AND type = ? AND sent_date < ?", convPK, messengertypes.AppMessage_TypeUserMessage, before).
+			Where("cid NOT IN (SELECT interaction_cid FROM starred_interactions WHERE starred = ?)", true).
+			Find(&pruned).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(pruned) == 0 {
+			return nil
+		}
+
+		prunedBefore := int64(0)
+		messageCIDs := make([]string, len(pruned))
+		for i, inte := range pruned {
+			messageCIDs[i] = inte.GetCID()
+			if inte.GetSentDate() > prunedBefore {
+				prunedBefore = inte.GetSentDate()
+			}
+		}
+
+		// the acks and reactions of the pruned messages are removed too, the replies are pruned on their own
+		if err := tx.db.
+			Model(&messengertypes.Interaction{}).
+			Where("target_cid IN ? AND type != ?", messageCIDs, messengertypes.AppMessage_TypeUserMessage).
+			Pluck("cid", &cids).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+		cids = append(cids, messageCIDs...)
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Find(&medias).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.Media{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.Mention{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.InteractionDelivery{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.InteractionReaction{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.InteractionExtension{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("interaction_cid IN ?", messageCIDs).Delete(&messengertypes.ConversationFile{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("cid IN ?", cids).Delete(&messengertypes.Interaction{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.
+			Model(&messengertypes.Conversation{}).
+			Where("public_key = ? AND pruned_before < ?", convPK, prunedBefore).
+			Update("pruned_before", prunedBefore).
+			Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		var err error
+		conv, err = tx.getConversationByPK(convPK)
+		return err
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return cids, medias, conv, nil
+}
+
+// getDownloadedMedias returns the medias received and downloaded, the oldest first
+func (d *dbWrapper) getDownloadedMedias() ([]*messengertypes.Media, error) {
+	medias := []*messengertypes.Media(nil)
+	if err := d.db.
+		Where("state IN ?", []messengertypes.Media_State{messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache}).
+		Order(d.backend().insertionOrder()).
+		Find(&medias).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return medias, nil
+}
+
+func (d *dbWrapper) getConversationPrunedBefore(convPK string) (int64, error) {
+	prunedBefore := []int64(nil)
+	if err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Where("public_key = ?", convPK).
+		Pluck("pruned_before", &prunedBefore).
+		Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(prunedBefore) == 0 {
+		return 0, nil
+	}
+
+	return prunedBefore[0], nil
+}
+
+func (d *dbWrapper) getDevicesByMember(memberPK string) ([]*messengertypes.Device, error) {
+	if memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	devices := []*messengertypes.Device(nil)
+	if err := d.db.Where(&messengertypes.Device{MemberPublicKey: memberPK}).Find(&devices).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return devices, nil
+}
+
+func (d *dbWrapper) getMemberPKFromDevicePK(dpk string) (string, error) {
+	var dev messengertypes.Device
+	err := d.db.Where("public_key = ?", dpk).First(&dev).Error
+	switch err {
+	case nil:
+		if len(dev.PublicKey) == 0 {
+			return "", errcode.ErrNotFound
+		}
+		return dev.PublicKey, nil
+	case gorm.ErrRecordNotFound:
+		return "", errcode.ErrNotFound
+	default:
+		return "", errcode.ErrDBRead.Wrap(err)
+	}
+}
+
+func (d *dbWrapper) getLocation(convPK, devicePK string) (*messengertypes.Location, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if devicePK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a device public key is required"))
+	}
+
+	location := &messengertypes.Location{}
+	if err := d.db.First(&location, &messengertypes.Location{ConversationPublicKey: convPK, DevicePublicKey: devicePK}).Error; err != nil {
+		return nil, err
+	}
+
+	return location, nil
+}
+
+func (d *dbWrapper) getLocationsByConversation(convPK string) ([]*messengertypes.Location, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	locations := []*messengertypes.Location(nil)
+	if err := d.db.Where(&messengertypes.Location{ConversationPublicKey: convPK}).Order("sent_date DESC").Find(&locations).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return locations, nil
+}
+
+func (d *dbWrapper) upsertLocation(location *messengertypes.Location) error {
+	if location.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if location.GetDevicePublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a device public key is required"))
+	}
+
+	if err := d.db.Save(location).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// expireLiveLocations stops the live locations which expired before the given date and returns them
+func (d *dbWrapper) expireLiveLocations(nowMs int64) ([]*messengertypes.Location, error) {
+	expired := []*messengertypes.Location(nil)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Where("live = ? AND expires_at <= ?", true, nowMs).Find(&expired).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(expired) == 0 {
+			return nil
+		}
+
+		if err := tx.db.Model(&messengertypes.Location{}).Where("live = ? AND expires_at <= ?", true, nowMs).Update("live", false).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, location := range expired {
+		location.Live = false
+	}
+
+	return expired, nil
+}
+
+func (d *dbWrapper) getPoll(cid string) (*messengertypes.Poll, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	poll := &messengertypes.Poll{}
+	if err := d.db.Preload("Options", func(db *gorm.DB) *gorm.DB { return db.Order("`index`") }).First(&poll, &messengertypes.Poll{CID: cid}).Error; err != nil {
+		return nil, err
+	}
+
+	return poll, nil
+}
+
+func (d *dbWrapper) getPollsByConversation(convPK string) ([]*messengertypes.Poll, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	polls := []*messengertypes.Poll(nil)
+	if err := d.db.
+		Preload("Options", func(db *gorm.DB) *gorm.DB { return db.Order("`index`") }).
+		Where(&messengertypes.Poll{ConversationPublicKey: convPK}).
+		Where("sent_date > 0").
+		Order("sent_date DESC").
+		Find(&polls).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return polls, nil
+}
+
+// addPoll stores a poll, a close received before the poll itself is only kept if it was sent by the poll author
+func (d *dbWrapper) addPoll(poll *messengertypes.Poll) (bool, error) {
+	if poll.GetCID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	if poll.GetConversationPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	isNew := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(poll)
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if isNew = res.RowsAffected > 0; !isNew {
+			return nil
+		}
+
+		// the closes received before the poll can now be checked against its author
+		_, err := tx.resolvePollClose(poll.GetCID())
+		return err
+	}); err != nil {
+		return false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return isNew, nil
+}
+
+// closePoll records a close of a poll, it returns true when the poll is closed by it
+func (d *dbWrapper) closePoll(pollClose *messengertypes.PollClose) (bool, error) {
+	if pollClose.GetPollCID() == "" || pollClose.GetCloseCID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid and a close cid are required"))
+	}
+
+	if pollClose.GetMemberPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	updated := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(pollClose).Error; err != nil {
+			return err
+		}
+
+		var err error
+		updated, err = tx.resolvePollClose(pollClose.GetPollCID())
+		return err
+	}); err != nil {
+		return false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return updated, nil
+}
+
+// resolvePollClose closes a poll at the earliest close sent by its author from any of its devices, it returns false
+// when the poll is not known yet or when its close is unchanged
+func (d *dbWrapper) resolvePollClose(cid string) (bool, error) {
+	poll, err := d.getPoll(cid)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	pollClose := &messengertypes.PollClose{}
+	err = d.db.Where(&messengertypes.PollClose{PollCID: cid, MemberPublicKey: poll.GetMemberPublicKey()}).Order("closed_date, close_cid").First(pollClose).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return false, err
+	}
+
+	if poll.GetMemberPublicKey() == "" || (poll.GetClosedDate() == pollClose.GetClosedDate() && poll.GetClosedByDevicePublicKey() == pollClose.GetDevicePublicKey()) {
+		return false, nil
+	}
+
+	return true, d.db.Model(&messengertypes.Poll{}).Where(&messengertypes.Poll{CID: cid}).Updates(map[string]interface{}{
+		"closed_date":                 pollClose.GetClosedDate(),
+		"closed_by_device_public_key": pollClose.GetDevicePublicKey(),
+	}).Error
+}
+
+func (d *dbWrapper) getPollVotes(cid string) ([]*messengertypes.PollVote, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	votes := []*messengertypes.PollVote(nil)
+	if err := d.db.Where(&messengertypes.PollVote{PollCID: cid}).Order("member_public_key, option_index").Find(&votes).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return votes, nil
+}
+
+// setPollBallot replaces the votes of a member if the ballot is more recent than the stored one, whichever device of
+// the member sent them, ties are broken using the ballot cid so the result doesn't depend on the delivery order
+func (d *dbWrapper) setPollBallot(ballot *messengertypes.PollVote, optionIndexes []int32) (bool, error) {
+	if ballot.GetPollCID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	if ballot.GetMemberPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	applied := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		existing := &messengertypes.PollVote{}
+		err := tx.db.Where(&messengertypes.PollVote{PollCID: ballot.GetPollCID(), MemberPublicKey: ballot.GetMemberPublicKey()}).First(existing).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+		case err != nil:
+			return err
+		case existing.GetSentDate() > ballot.GetSentDate(),
+			existing.GetSentDate() == ballot.GetSentDate() && existing.GetBallotCID() >= ballot.GetBallotCID():
+			return nil
+		}
+
+		if err := tx.db.Where(&messengertypes.PollVote{PollCID: ballot.GetPollCID(), MemberPublicKey: ballot.GetMemberPublicKey()}).Delete(&messengertypes.PollVote{}).Error; err != nil {
+			return err
+		}
+
+		// a withdrawn vote is kept as a negative index to remember the date of the ballot
+		if len(optionIndexes) == 0 {
+			optionIndexes = []int32{-1}
+		}
+
+		votes := make([]*messengertypes.PollVote, len(optionIndexes))
+		for i, index := range optionIndexes {
+			vote := *ballot
+			vote.OptionIndex = index
+			votes[i] = &vote
+		}
+
+		applied = true
+		return tx.db.Create(votes).Error
+	}); err != nil {
+		return false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return applied, nil
+}
+
+func (d *dbWrapper) isMemberBlocked(pk string) (bool, error) {
+	if pk == "" {
+		return false, nil
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.BlockedMember{}).Where(&messengertypes.BlockedMember{PublicKey: pk}).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// isInteractionSenderBlocked checks the contact or the member who sent an interaction, the relations of the interaction must be fetched
+func (d *dbWrapper) isInteractionSenderBlocked(i *messengertypes.Interaction) (bool, error) {
+	if i.GetIsMe() {
+		return false, nil
+	}
+
+	if i.GetConversation().GetType() == messengertypes.Conversation_ContactType {
+		return d.isMemberBlocked(i.GetConversation().GetContactPublicKey())
+	}
+
+	return d.isMemberBlocked(i.GetMemberPublicKey())
+}
+
+// isConversationContactBlocked returns true if the conversation is a 1-1 conversation with a blocked contact
+func (d *dbWrapper) isConversationContactBlocked(convPK string) (bool, error) {
+	conv, err := d.getConversationByPK(convPK)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_ContactType {
+		return false, nil
+	}
+
+	return d.isMemberBlocked(conv.GetContactPublicKey())
+}
+
+// isAckTargetBlocked returns true if a message was sent by a blocked contact or by a blocked member of a group, the
+// member is looked up from the device when the message was received before the device info
+func (d *dbWrapper) isAckTargetBlocked(convPK, memberPK, devicePK string) (bool, error) {
+	if blocked, err := d.isConversationContactBlocked(convPK); err != nil || blocked {
+		return blocked, err
+	}
+
+	if memberPK == "" && devicePK != "" {
+		device, err := d.getDeviceByPK(devicePK)
+		if err == nil {
+			memberPK = device.GetMemberPublicKey()
+		} else if err != gorm.ErrRecordNotFound {
+			return false, errcode.ErrDBRead.Wrap(err)
+		}
+	}
+
+	return d.isMemberBlocked(memberPK)
+}
+
+// isConversationObserved returns whether the account joined a group as an observer, the unknown conversations are
+// not observed
+func (d *dbWrapper) isConversationObserved(convPK string) (bool, error) {
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.Conversation{}).Where("public_key = ? AND is_observer = ?", convPK, true).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbWrapper) getBlockedMembers() ([]*messengertypes.BlockedMember, error) {
+	members := []*messengertypes.BlockedMember(nil)
+	if err := d.db.Order("blocked_date").Find(&members).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return members, nil
+}
+
+// setMemberBlocked blocks or unblocks a contact or member and flags its existing interactions, it returns the updated interactions
+func (d *dbWrapper) setMemberBlocked(pk string, blocked bool) ([]*messengertypes.Interaction, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a public key is required"))
+	}
+
+	cids := []string(nil)
+	if err := d.tx(func(tx *dbWrapper) error {
+		if blocked {
+			if err := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&messengertypes.BlockedMember{PublicKey: pk, BlockedDate: timestampMs(time.Now())}).Error; err != nil {
+				return err
+			}
+		} else if err := tx.db.Where(&messengertypes.BlockedMember{PublicKey: pk}).Delete(&messengertypes.BlockedMember{}).Error; err != nil {
+			return err
+		}
+
+		res := tx.db.
+			Model(&messengertypes.Interaction{}).
+			Where("is_me = ? AND is_sender_blocked = ?", false, !blocked).
+			Where("member_public_key = ? OR conversation_public_key IN (?)", pk, tx.db.Model(&messengertypes.Conversation{}).Select("public_key").Where("contact_public_key = ?", pk))
+
+		if err := res.Pluck("cid", &cids).Error; err != nil {
+			return err
+		}
+
+		if len(cids) == 0 {
+			return nil
+		}
+
+		return tx.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", cids).Update("is_sender_blocked", blocked).Error
+	}); err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if len(cids) == 0 {
+		return interactions, nil
+	}
+
+	if err := d.db.Where("cid IN ?", cids).Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+func (d *dbWrapper) isConversationAdmin(convPK, memberPK string) (bool, error) {
+	if convPK == "" || memberPK == "" {
+		return false, nil
+	}
+
+	member, err := d.getMemberByPK(memberPK, convPK)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	// a removed admin can't moderate the group anymore
+	if member.GetRemovedDate() != 0 {
+		return false, nil
+	}
+
+	return member.GetIsCreator() || member.GetRole() == messengertypes.Member_RoleAdmin, nil
+}
+
+// ensureMember returns the member of a group, creating it if it is not known yet
+func (d *dbWrapper) ensureMember(memberPK, convPK string) (*messengertypes.Member, error) {
+	member, err := d.addMember(memberPK, convPK, "", "", false, false)
+	if errcode.Is(err, errcode.ErrDBEntryAlreadyExists) {
+		return member, nil
+	}
+
+	return member, err
+}
+
+// setMemberModeration writes the role and the removal of a member folded from the moderation log of its group
+func (d *dbWrapper) setMemberModeration(member *messengertypes.Member) error {
+	if member.GetPublicKey() == "" || member.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member and a conversation public key are required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Member{}).
+		Where(&messengertypes.Member{PublicKey: member.GetPublicKey(), ConversationPublicKey: member.GetConversationPublicKey()}).
+		Updates(map[string]interface{}{
+			"role":          member.GetRole(),
+			"role_date":     member.GetRoleDate(),
+			"role_clock":    member.GetRoleClock(),
+			"removed_date":  member.GetRemovedDate(),
+			"removed_clock": member.GetRemovedClock(),
+		}).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// setConversationModeration writes the posting restriction and the profile of a group folded from its moderation log
+func (d *dbWrapper) setConversationModeration(conv *messengertypes.Conversation) error {
+	if conv.GetPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Where(&messengertypes.Conversation{PublicKey: conv.GetPublicKey()}).
+		Updates(map[string]interface{}{
+			"posting_restricted_date":  conv.GetPostingRestrictedDate(),
+			"posting_restricted_clock": conv.GetPostingRestrictedClock(),
+			"display_name":             conv.GetDisplayName(),
+			"avatar_cid":               conv.GetAvatarCID(),
+			"topic":                    conv.GetTopic(),
+			"description":              conv.GetDescription(),
+			"info_date":                conv.GetInfoDate(),
+			"info_clock":               conv.GetInfoClock(),
+		}).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addModerationEvent records a moderation message of a group log, it returns false when it is already known
+func (d *dbWrapper) addModerationEvent(event *messengertypes.ModerationEvent) (bool, error) {
+	if event.GetCID() == "" || event.GetConversationPublicKey() == "" || event.GetClock() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid, a conversation public key and a clock are required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// getModerationEvents returns the moderation messages of a group in the order of its log, only the ones ordered before
+// the given position when it is set
+func (d *dbWrapper) getModerationEvents(convPK, before string) ([]*messengertypes.ModerationEvent, error) {
+	query := d.db.Where("conversation_public_key = ?", convPK)
+	if before != "" {
+		query = query.Where("clock < ?", before)
+	}
+
+	events := []*messengertypes.ModerationEvent(nil)
+	if err := query.Order("clock").Find(&events).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return events, nil
+}
+
+func (d *dbWrapper) setConversationJoinApprovalDate(convPK string, date int64) (*messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Update("join_approval_date", date).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return d.getConversationByPK(convPK)
+}
+
+func (d *dbWrapper) setConversationAnnouncementModeDate(convPK string, date int64) (*messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Update("announcement_mode_date", date).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return d.getConversationByPK(convPK)
+}
+
+// setConversationPinnedAnnouncement pins an announcement to the top of a conversation, it is ignored if the pinned
+// announcement was sent after it, it returns false when the conversation is not updated
+func (d *dbWrapper) setConversationPinnedAnnouncement(convPK, cid string, sentDate, until int64) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" || cid == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a cid are required"))
+	}
+
+	updated := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		conv, err := tx.getConversationByPK(convPK)
+		if err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if current := conv.GetPinnedAnnouncementCID(); current != "" && current != cid {
+			pinned, err := tx.getInteractionByCID(current)
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return errcode.ErrDBRead.Wrap(err)
+			}
+
+			if err == nil && pinned.GetSentDate() > sentDate {
+				return nil
+			}
+		}
+
+		if err := tx.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Updates(map[string]interface{}{
+			"pinned_announcement_cid":   cid,
+			"pinned_announcement_until": until,
+		}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		updated = true
+		return nil
+	}); err != nil {
+		return nil, false, err
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, updated, nil
+}
+
+// addPendingMember marks a member joining a group requiring the approval of the admins as pending, the members already
+// known by another device are not changed
+func (d *dbWrapper) addPendingMember(memberPK, convPK string, date int64) (*messengertypes.Member, bool, error) {
+	added := false
+	member := (*messengertypes.Member)(nil)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		conv, err := tx.getConversationByPK(convPK)
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if conv.GetType() != messengertypes.Conversation_MultiMemberType || conv.GetJoinApprovalDate() == 0 {
+			return nil
+		}
+
+		devices := int64(0)
+		if err := tx.db.Model(&messengertypes.Device{}).Where(&messengertypes.Device{MemberPublicKey: memberPK}).Count(&devices).Error; err != nil {
+			return err
+		} else if devices > 1 {
+			return nil
+		}
+
+		if member, err = tx.ensureMember(memberPK, convPK); err != nil {
+			return err
+		}
+
+		// the members already pending or decided are not changed
+		if member.GetIsMe() || member.GetIsCreator() || member.GetJoinState() != messengertypes.Member_JoinApproved || member.GetJoinStateDate() != 0 {
+			return nil
+		}
+
+		added = true
+		member.JoinState = messengertypes.Member_JoinPending
+		member.JoinStateDate = date
+
+		return tx.db.Model(&messengertypes.Member{}).
+			Where(&messengertypes.Member{PublicKey: memberPK, ConversationPublicKey: convPK}).
+			Updates(map[string]interface{}{"join_state": member.JoinState, "join_state_date": date}).
+			Error
+	}); err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return member, added, nil
+}
+
+// setMemberJoinState applies the decision of an admin on a pending member, the most recent decision wins
+func (d *dbWrapper) setMemberJoinState(memberPK, convPK string, state messengertypes.Member_JoinState, date int64) (*messengertypes.Member, bool, error) {
+	updated := false
+	member := (*messengertypes.Member)(nil)
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		var err error
+		if member, err = tx.ensureMember(memberPK, convPK); err != nil {
+			return err
+		}
+
+		// the date of a pending member is the date it was seen by this device, it doesn't order the decisions
+		if member.GetIsCreator() || member.GetJoinState() == state || (member.GetJoinState() != messengertypes.Member_JoinPending && member.GetJoinStateDate() > date) {
+			return nil
+		}
+
+		updated = true
+		member.JoinState = state
+		member.JoinStateDate = date
+
+		return tx.db.Model(&messengertypes.Member{}).
+			Where(&messengertypes.Member{PublicKey: memberPK, ConversationPublicKey: convPK}).
+			Updates(map[string]interface{}{"join_state": state, "join_state_date": date}).
+			Error
+	}); err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return member, updated, nil
+}
+
+func (d *dbWrapper) getPendingMembers(convPK string) ([]*messengertypes.Member, error) {
+	members := []*messengertypes.Member(nil)
+	if err := d.db.
+		Where(&messengertypes.Member{ConversationPublicKey: convPK, JoinState: messengertypes.Member_JoinPending}).
+		Order("join_state_date").
+		Find(&members).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return members, nil
+}
+
+// getExcludedMembers returns the members of a group who must not receive its new secrets, ie. the removed and the denied
+// members
+func (d *dbWrapper) getExcludedMembers(convPK string) ([]*messengertypes.Member, error) {
+	members := []*messengertypes.Member(nil)
+	if err := d.db.
+		Where("conversation_public_key = ? AND (removed_date != 0 OR join_state = ?)", convPK, messengertypes.Member_JoinDenied).
+		Find(&members).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return members, nil
+}
+
+// setConversationPreferences replaces the preferences of a group if the version of the change is greater than the
+// current one
+func (d *dbWrapper) setConversationPreferences(convPK string, preferences *messengertypes.AppMessage_SetConversationPreferences, clock string) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ? AND COALESCE(preferences_clock, '') < ?", convPK, clock).
+		Updates(map[string]interface{}{
+			"primary_language":         preferences.GetPrimaryLanguage(),
+			"content_warnings_enabled": preferences.GetContentWarningsEnabled(),
+			"hide_observers":           preferences.GetHideObservers(),
+			"preferences_clock":        clock,
+		})
+	if tx.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, tx.RowsAffected > 0, nil
+}
+
+// setConversationMemberCap replaces the maximum number of members of a group if the version of the change is greater
+// than the current one
+func (d *dbWrapper) setConversationMemberCap(convPK string, maxMembers int32, clock string) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ? AND COALESCE(member_cap_clock, '') < ?", convPK, clock).
+		Updates(map[string]interface{}{
+			"max_members":      maxMembers,
+			"member_cap_clock": clock,
+		})
+	if tx.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, tx.RowsAffected > 0, nil
+}
+
+// setConversationRetention replaces the retention suggested by the admins of a group if the version of the change is
+// greater than the current one
+func (d *dbWrapper) setConversationRetention(convPK string, maxAge int64, clock string) (*messengertypes.Conversation, bool, error) {
+	if convPK == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ? AND COALESCE(retention_clock, '') < ?", convPK, clock).
+		Updates(map[string]interface{}{
+			"retention_max_age": maxAge,
+			"retention_clock":   clock,
+		})
+	if tx.Error != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conv, tx.RowsAffected > 0, nil
+}
+
+func (d *dbWrapper) setConversationLocalRetention(convPK string, enabled bool, maxAge int64) (*messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if !enabled {
+		maxAge = 0
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ?", convPK).
+		Updates(map[string]interface{}{
+			"local_retention_set":     enabled,
+			"local_retention_max_age": maxAge,
+		})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(convPK)
+}
+
+// getConversationRetention returns the conversation with only its retention columns and the date of its most recent
+// pruned message, nil if not found
+func (d *dbWrapper) getConversationRetention(convPK string) (*messengertypes.Conversation, error) {
+	convs := []*messengertypes.Conversation(nil)
+	if err := d.db.
+		Select("public_key, pruned_before, retention_max_age, local_retention_set, local_retention_max_age").
+		Where("public_key = ?", convPK).
+		Limit(1).
+		Find(&convs).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(convs) == 0 {
+		return nil, nil
+	}
+
+	return convs[0], nil
+}
+
+// getGroupMemberCounts returns the number of members of the given groups who are neither removed nor denied, by
+// conversation public key
+func (d *dbWrapper) getGroupMemberCounts(convPKs []string) (map[string]int64, error) {
+	counts := map[string]int64{}
+	if len(convPKs) == 0 {
+		return counts, nil
+	}
+
+	rows := []struct {
+		ConversationPublicKey string
+		Count                 int64
+	}(nil)
+	if err := d.db.Model(&messengertypes.Member{}).
+		Select("conversation_public_key, COUNT(*) AS count").
+		Where("conversation_public_key IN ? AND removed_date = 0 AND join_state != ?", convPKs, messengertypes.Member_JoinDenied).
+		Group("conversation_public_key").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, row := range rows {
+		counts[row.ConversationPublicKey] = row.Count
+	}
+
+	return counts, nil
+}
+
+// memberCountsSelect counts the members of the groups as the member counts of the conversations
+var memberCountsSelect = fmt.Sprintf("conversation_public_key, "+
+	"SUM(CASE WHEN join_state = %[1]d THEN 1 ELSE 0 END) AS member_count, "+
+	"SUM(CASE WHEN join_state = %[1]d AND role = %[2]d THEN 1 ELSE 0 END) AS admin_count, "+
+	"SUM(CASE WHEN join_state = %[3]d THEN 1 ELSE 0 END) AS pending_member_count",
+	messengertypes.Member_JoinApproved, messengertypes.Member_RoleAdmin, messengertypes.Member_JoinPending)
+
+type conversationMemberCounts struct {
+	ConversationPublicKey string
+	MemberCount           int64
+	AdminCount            int64
+	PendingMemberCount    int64
+}
+
+// countConversationMembers counts the current members of the given groups, the groups without members are omitted. The
+// observers aren't counted in the groups hiding them, their columns are missing while the earlier migrations run
+func countConversationMembers(db *gorm.DB, convPKs []string) ([]*conversationMemberCounts, error) {
+	query := db.Model(&messengertypes.Member{}).Where("conversation_public_key IN ? AND removed_date = 0", convPKs)
+	if db.Migrator().HasColumn(&messengertypes.Member{}, "IsObserver") && db.Migrator().HasColumn(&messengertypes.Conversation{}, "HideObservers") {
+		hiding := db.Model(&messengertypes.Conversation{}).Select("public_key").Where("hide_observers = ?", true)
+		query = query.Where("(is_observer = ? OR conversation_public_key NOT IN (?))", false, hiding)
+	}
+
+	rows := []*conversationMemberCounts(nil)
+	if err := query.
+		Select(memberCountsSelect).
+		Group("conversation_public_key").
+		Scan(&rows).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return rows, nil
+}
+
+// updateConversationMemberCounts counts the members of a group again, it returns whether its counts changed, nothing
+// is done for the conversations not known yet
+func (d *dbWrapper) updateConversationMemberCounts(convPK string) (*messengertypes.Conversation, bool, error) {
+	conv, err := d.getConversationByPK(convPK)
+	if err == gorm.ErrRecordNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return conv, false, nil
+	}
+
+	rows, err := countConversationMembers(d.db, []string{convPK})
+	if err != nil {
+		return nil, false, err
+	}
+
+	counts := &conversationMemberCounts{}
+	if len(rows) > 0 {
+		counts = rows[0]
+	}
+
+	if counts.MemberCount == conv.GetMemberCount() && counts.AdminCount == conv.GetAdminCount() && counts.PendingMemberCount == conv.GetPendingMemberCount() {
+		return conv, false, nil
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Where(&messengertypes.Conversation{PublicKey: convPK}).
+		Updates(map[string]interface{}{
+			"member_count":         counts.MemberCount,
+			"admin_count":          counts.AdminCount,
+			"pending_member_count": counts.PendingMemberCount,
+		}).
+		Error; err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	conv.MemberCount, conv.AdminCount, conv.PendingMemberCount = counts.MemberCount, counts.AdminCount, counts.PendingMemberCount
+
+	return conv, true, nil
+}
+
+// setMemberLastActivity dates the last visible message of a member, the older dates are ignored
+func (d *dbWrapper) setMemberLastActivity(memberPK, convPK string, date int64) error {
+	if err := d.db.Model(&messengertypes.Member{}).
+		Where("public_key = ? AND conversation_public_key = ? AND last_activity_date < ?", memberPK, convPK, date).
+		Update("last_activity_date", date).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getConversationMembers returns a page of the members of a group ordered by public key, the members after the cursor
+// are returned
+func (d *dbWrapper) getConversationMembers(convPK string, filter *messengertypes.ConversationMemberList_Filter, cursor *messengertypes.ConversationMemberList_Cursor, count int) ([]*messengertypes.Member, error) {
+	query := d.db.Where("conversation_public_key = ? AND removed_date = 0", convPK)
+
+	if filter.GetIncludePending() {
+		query = query.Where("join_state IN ?", []messengertypes.Member_JoinState{messengertypes.Member_JoinApproved, messengertypes.Member_JoinPending})
+	} else {
+		query = query.Where("join_state = ?", messengertypes.Member_JoinApproved)
+	}
+
+	if filter.GetAdminsOnly() {
+		query = query.Where("role = ?", messengertypes.Member_RoleAdmin)
+	}
+
+	if since := filter.GetActiveSince(); since > 0 {
+		query = query.Where("last_activity_date >= ?", since)
+	}
+
+	if after := filter.GetJoinedAfter(); after > 0 {
+		query = query.Where("joined_date > ?", after)
+	}
+
+	if cursor != nil {
+		query = query.Where("public_key > ?", cursor.GetPublicKey())
+	}
+
+	if count > 0 {
+		query = query.Limit(count)
+	}
+
+	members := []*messengertypes.Member(nil)
+	if err := query.Order("public_key").Find(&members).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return members, nil
+}
+
+// fillGroupCapacityInfo computes the capacity info of the multi member conversations
+func (d *dbWrapper) fillGroupCapacityInfo(convs ...*messengertypes.Conversation) error {
+	groupPKs := []string(nil)
+	for _, conv := range convs {
+		if conv.GetType() == messengertypes.Conversation_MultiMemberType {
+			groupPKs = append(groupPKs, conv.GetPublicKey())
+		}
+	}
+
+	if len(groupPKs) == 0 {
+		return nil
+	}
+
+	counts, err := d.getGroupMemberCounts(groupPKs)
+	if err != nil {
+		return err
+	}
+
+	for _, conv := range convs {
+		if conv.GetType() == messengertypes.Conversation_MultiMemberType {
+			conv.CapacityInfo = groupCapacityInfo(conv.GetMaxMembers(), counts[conv.GetPublicKey()])
+		}
+	}
+
+	return nil
+}
+
+// isInteractionSenderAllowed checks the moderation state of a group, messages from removed members, messages from
+// members waiting for an approval, posting messages from regular members of a restricted group and messages other than
+// reactions from regular members of a group in announcement mode are refused
+//
+// The removal and the restriction are compared with the position of the message in the group log rather than with its
+// sent date, which is chosen by the sender and could be backdated.
+func (d *dbWrapper) isInteractionSenderAllowed(i *messengertypes.Interaction) (bool, error) {
+	conv := i.GetConversation()
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return true, nil
+	}
+
+	memberPK := interactionSenderMemberPK(i)
+	if memberPK == "" {
+		return true, nil
+	}
+
+	member, err := d.getMemberByPK(memberPK, conv.GetPublicKey())
+	if err == gorm.ErrRecordNotFound {
+		return true, nil
+	} else if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	clock := interactionClock(i)
+	if member.GetRemovedClock() != "" && clock >= member.GetRemovedClock() {
+		return false, nil
+	}
+
+	if _, ok := pendingMemberAppMessageTypes[i.GetType()]; !ok && member.GetJoinState() != messengertypes.Member_JoinApproved {
+		return false, nil
+	}
+
+	if _, ok := postingAppMessageTypes[i.GetType()]; !ok {
+		return true, nil
+	}
+
+	restricted := conv.GetPostingRestrictedClock() != "" && clock >= conv.GetPostingRestrictedClock()
+	announcing := conv.GetAnnouncementModeDate() != 0 && i.GetSentDate() >= conv.GetAnnouncementModeDate() && i.GetType() != messengertypes.AppMessage_TypeUserReaction
+	if !restricted && !announcing {
+		return true, nil
+	}
+
+	return member.GetIsCreator() || member.GetRole() == messengertypes.Member_RoleAdmin, nil
+}
+
+func (d *dbWrapper) addGroupInvitationLink(invitation *messengertypes.GroupInvitationLink) error {
+	if invitation.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an invitation id is required"))
+	}
+
+	if invitation.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Omit("Uses").Create(invitation).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) addBotToken(token *messengertypes.BotToken) error {
+	if token.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Omit("Webhooks").Create(token).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getBotToken(id string) (*messengertypes.BotToken, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	token := &messengertypes.BotToken{}
+	if err := d.db.Preload("Webhooks").First(&token, &messengertypes.BotToken{ID: id}).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (d *dbWrapper) getBotTokens() ([]*messengertypes.BotToken, error) {
+	tokens := []*messengertypes.BotToken(nil)
+
+	if err := d.db.Preload("Webhooks").Order("created_date").Find(&tokens).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tokens, nil
+}
+
+// deleteBotToken removes a bot token and its webhooks
+func (d *dbWrapper) deleteBotToken(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Delete(&messengertypes.BotToken{}, &messengertypes.BotToken{ID: id})
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
+
+		if res.RowsAffected == 0 {
+			return errcode.ErrNotFound
+		}
+
+		if err := tx.db.Where(&messengertypes.BotWebhook{TokenID: id}).Delete(&messengertypes.BotWebhook{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func (d *dbWrapper) addBotWebhook(webhook *messengertypes.BotWebhook) error {
+	if webhook.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a webhook id is required"))
+	}
+
+	if webhook.GetTokenID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(webhook).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) deleteBotWebhook(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a webhook id is required"))
+	}
+
+	res := d.db.Delete(&messengertypes.BotWebhook{}, &messengertypes.BotWebhook{ID: id})
+	if res.Error != nil {
+		return errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return errcode.ErrNotFound
+	}
+
+	return nil
+}
+
+// addMatrixRoom links a conversation to a room, replacing its previous room, a room can only be linked to a single
+// conversation
+func (d *dbWrapper) addMatrixRoom(room *messengertypes.MatrixRoom) error {
+	if room.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if room.GetRoomID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a room id is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		existing, err := tx.getMatrixRoomByRoomID(room.GetRoomID())
+		if err == nil && existing.GetConversationPublicKey() != room.GetConversationPublicKey() {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the room is already linked to another conversation"))
+		} else if err != nil && err != gorm.ErrRecordNotFound {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(room).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func (d *dbWrapper) getMatrixRoom(convPK string) (*messengertypes.MatrixRoom, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	room := &messengertypes.MatrixRoom{}
+	if err := d.db.First(&room, &messengertypes.MatrixRoom{ConversationPublicKey: convPK}).Error; err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+func (d *dbWrapper) getMatrixRoomByRoomID(roomID string) (*messengertypes.MatrixRoom, error) {
+	if roomID == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a room id is required"))
+	}
+
+	room := &messengertypes.MatrixRoom{}
+	if err := d.db.First(&room, &messengertypes.MatrixRoom{RoomID: roomID}).Error; err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+func (d *dbWrapper) getMatrixRooms() ([]*messengertypes.MatrixRoom, error) {
+	rooms := []*messengertypes.MatrixRoom(nil)
+
+	if err := d.db.Order("linked_date").Find(&rooms).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return rooms, nil
+}
+
+func (d *dbWrapper) deleteMatrixRoom(convPK string) error {
+	if convPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	res := d.db.Delete(&messengertypes.MatrixRoom{}, &messengertypes.MatrixRoom{ConversationPublicKey: convPK})
+	if res.Error != nil {
+		return errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return errcode.ErrNotFound
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getMatrixGhost(memberPK string) (*messengertypes.MatrixGhost, error) {
+	if memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	ghost := &messengertypes.MatrixGhost{}
+	if err := d.db.First(&ghost, &messengertypes.MatrixGhost{MemberPublicKey: memberPK}).Error; err != nil {
+		return nil, err
+	}
+
+	return ghost, nil
+}
+
+func (d *dbWrapper) addMatrixGhost(ghost *messengertypes.MatrixGhost) error {
+	if ghost.GetMemberPublicKey() == "" || ghost.GetUserID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key and a user id are required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(ghost).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) setMatrixGhostDisplayName(memberPK string, displayName string) error {
+	if memberPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.MatrixGhost{}).Where(&messengertypes.MatrixGhost{MemberPublicKey: memberPK}).Update("display_name", displayName).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addMatrixEvent records a relayed event, false is returned if it was already relayed
+func (d *dbWrapper) addMatrixEvent(evt *messengertypes.MatrixEvent) (bool, error) {
+	if evt.GetEventID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an event id is required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(evt)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected == 1, nil
+}
+
+// isMatrixInteractionRelayed checks if an interaction was already sent to its room
+func (d *dbWrapper) isMatrixInteractionRelayed(cid string) (bool, error) {
+	if cid == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.MatrixEvent{}).Where(&messengertypes.MatrixEvent{CID: cid}).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbWrapper) getGroupInvitationLink(id string) (*messengertypes.GroupInvitationLink, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an invitation id is required"))
+	}
+
+	invitation := &messengertypes.GroupInvitationLink{}
+	if err := d.db.Preload("Uses").First(&invitation, &messengertypes.GroupInvitationLink{ID: id}).Error; err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
+
+// getGroupInvitationLinks returns the invitation links of a group, or all of them if the conversation public key is empty
+func (d *dbWrapper) getGroupInvitationLinks(convPK string) ([]*messengertypes.GroupInvitationLink, error) {
+	invitations := []*messengertypes.GroupInvitationLink(nil)
+
+	if err := d.db.
+		Preload("Uses").
+		Where(&messengertypes.GroupInvitationLink{ConversationPublicKey: convPK}).
+		Order("created_date").
+		Find(&invitations).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return invitations, nil
+}
+
+func (d *dbWrapper) revokeGroupInvitationLink(id string, date int64) (*messengertypes.GroupInvitationLink, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an invitation id is required"))
+	}
+
+	if err := d.db.
+		Model(&messengertypes.GroupInvitationLink{}).
+		Where("id = ? AND revoked_date = 0", id).
+		Update("revoked_date", date).
+		Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return d.getGroupInvitationLink(id)
+}
+
+// addGroupInvitationLinkUse records that a member joined a group with an invitation link, only the first use of a member is kept
+func (d *dbWrapper) addGroupInvitationLinkUse(use *messengertypes.GroupInvitationLinkUse) (bool, error) {
+	if use.GetInvitationID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an invitation id is required"))
+	}
+
+	if use.GetMemberPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(use)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// addMemberProfileChange stores a profile sent by a member, all the changes are kept even when received out of order
+func (d *dbWrapper) addMemberProfileChange(change *messengertypes.MemberProfileChange) error {
+	if change.GetCID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	if change.GetConversationPublicKey() == "" || change.GetMemberPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation and a member public key are required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(change).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getMemberProfileHistory(convPK, memberPK string) ([]*messengertypes.MemberProfileChange, error) {
+	if convPK == "" || memberPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation and a member public key are required"))
+	}
+
+	changes := []*messengertypes.MemberProfileChange(nil)
+	if err := d.db.
+		Where(&messengertypes.MemberProfileChange{ConversationPublicKey: convPK, MemberPublicKey: memberPK}).
+		Order("sent_date, cid").
+		Find(&changes).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return changes, nil
+}
+
+// addPushDeviceToken registers a push token, the replaced token of a rotation is removed in the same transaction
+func (d *dbWrapper) addPushDeviceToken(token *messengertypes.PushDeviceToken, replaces string) error {
+	if token.GetToken() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a push token is required"))
+	}
+
+	if token.GetAccountPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		if replaces != "" && replaces != token.GetToken() {
+			if err := tx.db.Where(&messengertypes.PushDeviceToken{Token: replaces}).Delete(&messengertypes.PushDeviceToken{}).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(token).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func (d *dbWrapper) removePushDeviceToken(token string) error {
+	if token == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a push token is required"))
+	}
+
+	tx := d.db.Where(&messengertypes.PushDeviceToken{Token: token}).Delete(&messengertypes.PushDeviceToken{})
+	if tx.Error != nil {
+		return errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return errcode.ErrNotFound.Wrap(fmt.Errorf("push token not found"))
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getPushDeviceTokens(accountPK string) ([]*messengertypes.PushDeviceToken, error) {
+	if accountPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	tokens := []*messengertypes.PushDeviceToken(nil)
+	if err := d.db.
+		Where(&messengertypes.PushDeviceToken{AccountPublicKey: accountPK}).
+		Order("registered_date").
+		Find(&tokens).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tokens, nil
+}
+
+// applyConversationDeviceSync updates a conversation with the state sent by another device of the account, the lowest
+// unread count is kept, when merging a snapshot the settings are only applied if they are stricter than the local ones
+func (d *dbWrapper) applyConversationDeviceSync(state *messengertypes.AppMessage_DeviceSyncConversation, merge bool) (*messengertypes.Conversation, bool, error) {
+	conv, err := d.getConversationByPK(state.GetConversationPublicKey())
+	if err != nil {
+		return nil, false, err
+	}
+
+	values := map[string]interface{}{}
+
+	unreadCount := conv.GetUnreadCount()
+	if state.GetUnreadCount() < unreadCount {
+		unreadCount = state.GetUnreadCount()
+	}
+
+	// the messages sent before the read position of the other device have been read
+	if state.GetReadUntil() > conv.GetReadUntil() {
+		values["read_until"] = state.GetReadUntil()
+
+		count, err := d.countConversationUnreadAfter(conv.GetPublicKey(), state.GetReadUntil())
+		if err != nil {
+			return nil, false, err
+		}
+
+		if count < unreadCount {
+			unreadCount = count
+		}
+	}
+
+	if unreadCount != conv.GetUnreadCount() {
+		values["unread_count"] = unreadCount
+	}
+
+	if state.GetPushMuted() != conv.GetPushMuted() && (!merge || state.GetPushMuted()) {
+		values["push_muted"] = state.GetPushMuted()
+	}
+
+	if state.GetMediaDownloadMode() != conv.GetMediaDownloadMode() || state.GetMediaDownloadMaxSize() != conv.GetMediaDownloadMaxSize() {
+		if !merge || conv.GetMediaDownloadMode() == messengertypes.MediaDownloadPolicy_ModeUndefined {
+			values["media_download_mode"] = state.GetMediaDownloadMode()
+			values["media_download_max_size"] = state.GetMediaDownloadMaxSize()
+		}
+	}
+
+	if len(values) == 0 {
+		return conv, false, nil
+	}
+
+	if err := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: conv.GetPublicKey()}).Updates(values).Error; err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	conv, err = d.getConversationByPK(conv.GetPublicKey())
+	if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return conv, true, nil
+}
+
+func (d *dbWrapper) getDeviceSyncContact(pk string) (*messengertypes.AppMessage_DeviceSyncContact, error) {
+	blocked, err := d.isMemberBlocked(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &messengertypes.AppMessage_DeviceSyncContact{PublicKey: pk, Blocked: blocked}
+
+	contact, err := d.getContactByPK(pk)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
+	default:
+		state.PresenceHidden = contact.GetPresenceHidden()
+	}
+
+	return state, nil
+}
+
+// getDeviceSyncSnapshot returns the local state of all the conversations, and of the contacts and members with a local setting
+func (d *dbWrapper) getDeviceSyncSnapshot() (*messengertypes.AppMessage_DeviceSyncSnapshot, error) {
+	convs, err := d.getAllConversations()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	snapshot := &messengertypes.AppMessage_DeviceSyncSnapshot{}
+	for _, conv := range convs {
+		snapshot.Conversations = append(snapshot.Conversations, deviceSyncConversationFromConversation(conv))
+	}
+
+	blocked, err := d.getBlockedMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	pks := []string(nil)
+	for _, member := range blocked {
+		pks = append(pks, member.GetPublicKey())
+	}
+
+	hidden := []string(nil)
+	if err := d.db.Model(&messengertypes.Contact{}).Where("presence_hidden = ?", true).Pluck("public_key", &hidden).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	seen := map[string]struct{}{}
+	for _, pk := range append(pks, hidden...) {
+		if _, ok := seen[pk]; ok {
+			continue
+		}
+		seen[pk] = struct{}{}
+
+		state, err := d.getDeviceSyncContact(pk)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot.Contacts = append(snapshot.Contacts, state)
+	}
+
+	stars := []*messengertypes.StarredInteraction(nil)
+	if err := d.db.Find(&stars).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, star := range stars {
+		snapshot.Stars = append(snapshot.Stars, deviceSyncStarFromStarredInteraction(star))
+	}
+
+	tags := []*messengertypes.InteractionTag(nil)
+	if err := d.db.Find(&tags).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, tag := range tags {
+		snapshot.Tags = append(snapshot.Tags, deviceSyncTagFromInteractionTag(tag))
+	}
+
+	return snapshot, nil
+}
+
+// isEventProcessed checks if an event has already been handled with the same content
+func (d *dbWrapper) isEventProcessed(cid, resultHash string) (bool, error) {
+	if cid == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.ProcessedEvent{}).Where("cid = ? AND result_hash = ?", cid, resultHash).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// markEventProcessed adds an event to the ledger of the handled events, the entry of an event handled again is replaced
+func (d *dbWrapper) markEventProcessed(cid, convPK, resultHash string, date int64) error {
+	if cid == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&messengertypes.ProcessedEvent{
+		CID:                   cid,
+		ConversationPublicKey: convPK,
+		ResultHash:            resultHash,
+		ProcessedDate:         date,
+	}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getUnknownEventCIDs returns the cids neither in the ledger of the handled events nor stored as interactions, in the
+// order of cids
+func (d *dbWrapper) getUnknownEventCIDs(cids []string) ([]string, error) {
+	if len(cids) == 0 {
+		return nil, nil
+	}
+
+	known := []string(nil)
+	if err := d.db.Model(&messengertypes.ProcessedEvent{}).Where("cid IN ?", cids).Pluck("cid", &known).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	stored := []string(nil)
+	if err := d.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", cids).Pluck("cid", &stored).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	found := map[string]bool{}
+	for _, cid := range append(known, stored...) {
+		found[cid] = true
+	}
+
+	unknown := []string(nil)
+	for _, cid := range cids {
+		if !found[cid] {
+			unknown = append(unknown, cid)
+		}
+	}
+
+	return unknown, nil
+}
+
+// addAbuseReport stores a report, it returns false when the report is already known
+func (d *dbWrapper) addAbuseReport(report *messengertypes.AbuseReport) (bool, error) {
+	if report.GetID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a report id is required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(report)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// getAbuseReports returns the reports of a conversation, or all of them if the conversation public key is empty
+func (d *dbWrapper) getAbuseReports(convPK string) ([]*messengertypes.AbuseReport, error) {
+	reports := []*messengertypes.AbuseReport(nil)
+
+	query := d.db.Order("reported_date")
+	if convPK != "" {
+		query = query.Where(&messengertypes.AbuseReport{ConversationPublicKey: convPK})
+	}
+
+	if err := query.Find(&reports).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return reports, nil
+}
+
+func (d *dbWrapper) addContentFilter(filter *messengertypes.ContentFilter) error {
+	if filter.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a filter id is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(filter).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) deleteContentFilter(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a filter id is required"))
+	}
+
+	res := d.db.Delete(&messengertypes.ContentFilter{}, &messengertypes.ContentFilter{ID: id})
+	if res.Error != nil {
+		return errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return errcode.ErrNotFound
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getContentFilters() ([]*messengertypes.ContentFilter, error) {
+	filters := []*messengertypes.ContentFilter(nil)
+
+	if err := d.db.Order("created_date").Find(&filters).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return filters, nil
+}
+
+// getFilteredInteractions returns the messages hidden by the content filters, the oldest first
+func (d *dbWrapper) getFilteredInteractions(convPK string) ([]*messengertypes.Interaction, error) {
+	interactions := []*messengertypes.Interaction(nil)
+
+	query := d.db.Where("is_filtered = ?", true).Order("sent_date ASC, cid ASC")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	if err := query.Preload(clause.Associations).Find(&interactions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// clearInteractionFiltered shows a message hidden by the content filters and returns it
+func (d *dbWrapper) clearInteractionFiltered(cid string) (*messengertypes.Interaction, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.Interaction{}).Where("cid = ?", cid).Updates(map[string]interface{}{
+		"is_filtered": false,
+		"filtered_by": "",
+	}).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	i, err := d.getInteractionByCID(cid)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return i, nil
+}
+
+// setBoardEntry applies an update of an entry of a board, the update with the greatest clock wins so the replay and
+// the live processing converge whatever the order of the updates
+func (d *dbWrapper) setBoardEntry(entry *messengertypes.BoardEntry) (*messengertypes.BoardEntry, bool, error) {
+	if entry.GetConversationPublicKey() == "" || entry.GetKey() == "" {
+		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a key are required"))
+	}
+
+	updated := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		current := &messengertypes.BoardEntry{}
+		err := tx.db.First(current, &messengertypes.BoardEntry{ConversationPublicKey: entry.GetConversationPublicKey(), Key: entry.GetKey()}).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+		case err != nil:
+			return err
+		case current.GetClock() >= entry.GetClock():
+			entry = current
+			return nil
+		}
+
+		updated = true
+		return tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(entry).Error
+	}); err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return entry, updated, nil
+}
+
+// getBoardEntries returns the entries of the board of a conversation, the deleted ones are omitted
+func (d *dbWrapper) getBoardEntries(convPK string) ([]*messengertypes.BoardEntry, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	entries := []*messengertypes.BoardEntry(nil)
+	if err := d.db.
+		Where(&messengertypes.BoardEntry{ConversationPublicKey: convPK}).
+		Where("deleted = ?", false).
+		Order("entry_key").
+		Find(&entries).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return entries, nil
+}
+
+// setStarredInteraction applies a change of the starred state of a message, the most recent change wins, it returns
+// false when the change is older than the current state
+func (d *dbWrapper) setStarredInteraction(star *messengertypes.StarredInteraction) (bool, error) {
+	if star.GetInteractionCID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	updated := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		current := &messengertypes.StarredInteraction{}
+		err := tx.db.First(current, &messengertypes.StarredInteraction{InteractionCID: star.GetInteractionCID()}).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+		case err != nil:
+			return err
+		case current.GetStarredDate() >= star.GetStarredDate():
+			return nil
+		}
+
+		updated = true
+		return tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(star).Error
+	}); err != nil {
+		return false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return updated, nil
+}
+
+// isInteractionStarred checks whether a message is in the starred messages of the account
+func (d *dbWrapper) isInteractionStarred(cid string) (bool, error) {
+	count := int64(0)
+	if err := d.db.
+		Model(&messengertypes.StarredInteraction{}).
+		Where("interaction_cid = ? AND starred = ?", cid, true).
+		Count(&count).
+		Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// getStarredInteractions returns the starred messages known by this device, the last starred first, starting after
+// the cursor when it is set
+func (d *dbWrapper) getStarredInteractions(cursor *messengertypes.InteractionStarredList_Cursor, count int) ([]*messengertypes.StarredInteraction, error) {
+	query := d.db.Where("starred = ? AND interaction_cid IN (SELECT cid FROM interactions)", true)
+	if cursor != nil {
+		query = query.Where("(starred_date < ? OR (starred_date = ? AND interaction_cid < ?))", cursor.GetStarredDate(), cursor.GetStarredDate(), cursor.GetCID())
+	}
+
+	stars := []*messengertypes.StarredInteraction(nil)
+	if err := query.Order("starred_date DESC, interaction_cid DESC").Limit(count).Find(&stars).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return stars, nil
+}
+
+// setInteractionTag applies a change of a personal tag of a message, the most recent change wins, it returns false
+// when the change is older than the current state
+func (d *dbWrapper) setInteractionTag(tag *messengertypes.InteractionTag) (bool, error) {
+	if tag.GetInteractionCID() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	if tag.GetTag() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a tag is required"))
+	}
+
+	updated := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		current := &messengertypes.InteractionTag{}
+		err := tx.db.First(current, &messengertypes.InteractionTag{InteractionCID: tag.GetInteractionCID(), Tag: tag.GetTag()}).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+		case err != nil:
+			return err
+		case current.GetTaggedDate() >= tag.GetTaggedDate():
+			return nil
+		}
+
+		updated = true
+		return tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(tag).Error
+	}); err != nil {
+		return false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return updated, nil
+}
+
+// getInteractionsWithTag returns the current state of a personal tag on the messages tagged with it
+func (d *dbWrapper) getInteractionsWithTag(tag string) ([]*messengertypes.InteractionTag, error) {
+	tags := []*messengertypes.InteractionTag(nil)
+	if err := d.db.Where("tag = ? AND tagged = ?", tag, true).Order("interaction_cid").Find(&tags).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tags, nil
+}
+
+// getInteractionTagSummaries counts the messages received by this device for each personal tag in use, by name
+func (d *dbWrapper) getInteractionTagSummaries() ([]*messengertypes.InteractionTagList_TagSummary, error) {
+	summaries := []*messengertypes.InteractionTagList_TagSummary(nil)
+	if err := d.db.Model(&messengertypes.InteractionTag{}).
+		Select("tag, COUNT(*) AS count, MAX(tagged_date) AS last_tagged_date").
+		Where("tagged = ? AND interaction_cid IN (SELECT cid FROM interactions)", true).
+		Group("tag").
+		Order("tag").
+		Scan(&summaries).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return summaries, nil
+}
+
+// fillInteractionsTags sets the personal tags of the given interactions, sorted by name
+func (d *dbWrapper) fillInteractionsTags(interactions []*messengertypes.Interaction) error {
+	if len(interactions) == 0 {
+		return nil
+	}
+
+	cids := make([]string, len(interactions))
+	for idx, i := range interactions {
+		cids[idx] = i.GetCID()
+	}
+
+	tags := []*messengertypes.InteractionTag(nil)
+	if err := d.db.Where("interaction_cid IN ? AND tagged = ?", cids, true).Order("tag").Find(&tags).Error; err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	byCID := map[string][]string{}
+	for _, tag := range tags {
+		byCID[tag.GetInteractionCID()] = append(byCID[tag.GetInteractionCID()], tag.GetTag())
+	}
+
+	for _, i := range interactions {
+		i.Tags = byCID[i.GetCID()]
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) addConversationFolder(folder *messengertypes.ConversationFolder) error {
+	if folder.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a folder id is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(folder).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getConversationFolder(id string) (*messengertypes.ConversationFolder, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a folder id is required"))
+	}
+
+	folder := &messengertypes.ConversationFolder{}
+	if err := d.db.First(folder, &messengertypes.ConversationFolder{ID: id}).Error; err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return folder, nil
+}
+
+func (d *dbWrapper) renameConversationFolder(id, name string) (*messengertypes.ConversationFolder, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a folder id is required"))
+	}
+
+	res := d.db.Model(&messengertypes.ConversationFolder{}).Where(&messengertypes.ConversationFolder{ID: id}).Update("name", name)
+	if res.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound
+	}
+
+	return d.getConversationFolder(id)
+}
+
+// deleteConversationFolder removes a folder, it returns its conversations moved out of it
+func (d *dbWrapper) deleteConversationFolder(id string) ([]*messengertypes.Conversation, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a folder id is required"))
+	}
+
+	pks := []string(nil)
+	if err := d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Delete(&messengertypes.ConversationFolder{}, &messengertypes.ConversationFolder{ID: id})
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
+
+		if res.RowsAffected == 0 {
+			return errcode.ErrNotFound
+		}
+
+		if err := tx.db.Model(&messengertypes.Conversation{}).Where("folder_id = ?", id).Pluck("public_key", &pks).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if err := tx.db.Model(&messengertypes.Conversation{}).Where("folder_id = ?", id).Update("folder_id", "").Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return d.getConversationsByPKs(pks)
+}
+
+// getConversationFolders returns the folders ordered by creation date with the unread count of their conversations
+func (d *dbWrapper) getConversationFolders() ([]*messengertypes.ConversationFolder, error) {
+	folders := []*messengertypes.ConversationFolder(nil)
+	if err := d.db.Order("created_date").Find(&folders).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	counts := []struct {
+		FolderID    string
+		UnreadCount int32
+	}(nil)
+	if err := d.db.
+		Model(&messengertypes.Conversation{}).
+		Select("folder_id, SUM(unread_count) AS unread_count").
+		Where("folder_id != ?", "").
+		Group("folder_id").
+		Scan(&counts).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	unread := make(map[string]int32, len(counts))
+	for _, count := range counts {
+		unread[count.FolderID] = count.UnreadCount
+	}
+
+	for _, folder := range folders {
+		folder.UnreadCount = unread[folder.GetID()]
+	}
+
+	return folders, nil
+}
+
+// setConversationFolder moves a conversation into a folder, an empty folder id moves it out of its folder
+func (d *dbWrapper) setConversationFolder(convPK, folderID string) (*messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	if folderID != "" {
+		if _, err := d.getConversationFolder(folderID); err != nil {
+			return nil, err
+		}
+	}
+
+	res := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Update("folder_id", folderID)
+	if res.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(convPK)
+}
+
+// setConversationsPinnedOrder pins the conversations in the given order and unpins the others, it returns the
+// conversations whose position changed
+func (d *dbWrapper) setConversationsPinnedOrder(pks []string) ([]*messengertypes.Conversation, error) {
+	positions := make(map[string]int32, len(pks))
+	for i, pk := range pks {
+		if pk == "" {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+		}
+
+		if _, ok := positions[pk]; ok {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation %s is pinned twice", pk))
+		}
+
+		positions[pk] = int32(i + 1)
+	}
+
+	changed := []string(nil)
+	if err := d.tx(func(tx *dbWrapper) error {
+		if len(pks) > 0 {
+			count := int64(0)
+			if err := tx.db.Model(&messengertypes.Conversation{}).Where("public_key IN ?", pks).Count(&count).Error; err != nil {
+				return errcode.ErrDBRead.Wrap(err)
+			}
+
+			if count != int64(len(pks)) {
+				return errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+			}
+		}
+
+		current := []*messengertypes.Conversation(nil)
+		if err := tx.db.Where("pinned_position != ? OR public_key IN ?", 0, append(pks, "")).Find(&current).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, conv := range current {
+			position := positions[conv.GetPublicKey()]
+			if position == conv.GetPinnedPosition() {
+				continue
+			}
+
+			if err := tx.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: conv.GetPublicKey()}).Update("pinned_position", position).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+
+			changed = append(changed, conv.GetPublicKey())
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return d.getConversationsByPKs(changed)
+}
+
+func (d *dbWrapper) setAccountConversationSortOrder(pk string, order messengertypes.Account_ConversationSortOrder) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("conversation_sort_order", order)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+func (d *dbWrapper) setAccountInteractionOrder(pk string, order messengertypes.Account_InteractionOrder) (*messengertypes.Account, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("interaction_order", order)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	}
+
+	return d.getAccount()
+}
+
+// getInteractionOrder returns the order of the interactions set on the account, the logical order until the account
+// is created
+func (d *dbWrapper) getInteractionOrder() (messengertypes.Account_InteractionOrder, error) {
+	acc, err := d.getAccount()
+	if err == gorm.ErrRecordNotFound {
+		return messengertypes.Account_OrderLogical, nil
+	} else if err != nil {
+		return messengertypes.Account_OrderLogical, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return acc.GetInteractionOrder(), nil
+}
+
+// getSortedConversations returns the conversations of a folder, or all of them if the folder id is empty, in the
+// given order
+func (d *dbWrapper) getSortedConversations(folderID string, order messengertypes.Account_ConversationSortOrder) ([]*messengertypes.Conversation, error) {
+	query := d.db.Preload("ReplyOptions").Preload("ReplicationInfo")
+	if folderID != "" {
+		query = query.Where("folder_id = ?", folderID)
+	}
+
+	switch order {
+	case messengertypes.Account_SortManual:
+		query = query.Order("pinned_position = 0, pinned_position, last_update DESC")
+	default:
+		query = query.Order("last_update DESC")
+	}
+
+	convs := []*messengertypes.Conversation(nil)
+	if err := query.Order("public_key").Find(&convs).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if err := d.fillGroupCapacityInfo(convs...); err != nil {
+		return nil, err
+	}
+
+	return convs, nil
+}
+
+func (d *dbWrapper) setAutoReply(rule *messengertypes.AutoReply) error {
+	if rule.GetScope() != messengertypes.AutoReply_ScopeGlobal && rule.GetTargetPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a target public key is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(rule).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) removeAutoReply(scope messengertypes.AutoReply_Scope, targetPK string) error {
+	res := d.db.Where("scope = ? AND target_public_key = ?", scope, targetPK).Delete(&messengertypes.AutoReply{})
+	if res.Error != nil {
+		return errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return errcode.ErrNotFound
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getAutoReplies() ([]*messengertypes.AutoReply, error) {
+	rules := []*messengertypes.AutoReply(nil)
+	if err := d.db.Order("scope, target_public_key").Find(&rules).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return rules, nil
+}
+
+// getConversationAutoReplies returns the rules which may apply to a conversation, the global one, the one of the
+// conversation and the one of its contact
+func (d *dbWrapper) getConversationAutoReplies(convPK, contactPK string) ([]*messengertypes.AutoReply, error) {
+	rules := []*messengertypes.AutoReply(nil)
+	if err := d.db.
+		Where("(scope = ? AND target_public_key = ?) OR (scope = ? AND target_public_key = ?) OR (scope = ? AND target_public_key = ?)",
+			messengertypes.AutoReply_ScopeGlobal, "",
+			messengertypes.AutoReply_ScopeConversation, convPK,
+			messengertypes.AutoReply_ScopeContact, contactPK).
+		Find(&rules).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return rules, nil
+}
+
+func (d *dbWrapper) addAutoReplyLog(log *messengertypes.AutoReplyLog) error {
+	if log.GetTriggerCID() == "" || log.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a trigger cid and a conversation public key are required"))
+	}
+
+	if err := d.db.Create(log).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getLastAutoReplyLog returns the most recent auto-reply of a conversation, nil when none has been sent
+func (d *dbWrapper) getLastAutoReplyLog(convPK string) (*messengertypes.AutoReplyLog, error) {
+	log := &messengertypes.AutoReplyLog{}
+	err := d.db.Where("conversation_public_key = ?", convPK).Order("sent_date DESC").First(log).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return log, nil
+}
+
+// getAutoReplyLogs returns the auto-replies sent, the most recent first, only the ones of a conversation when its
+// public key is set
+func (d *dbWrapper) getAutoReplyLogs(convPK string, count int) ([]*messengertypes.AutoReplyLog, error) {
+	query := d.db
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	logs := []*messengertypes.AutoReplyLog(nil)
+	if err := query.Order("sent_date DESC, trigger_cid").Limit(count).Find(&logs).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return logs, nil
+}
+
+// getInteractionTranslation returns the cached translation of a message, nil when it hasn't been translated yet
+func (d *dbWrapper) getInteractionTranslation(cid, language string) (*messengertypes.InteractionTranslation, error) {
+	if cid == "" || language == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid and a language are required"))
+	}
+
+	translation := &messengertypes.InteractionTranslation{}
+	err := d.db.Where("interaction_cid = ? AND language = ?", cid, language).First(translation).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return translation, nil
+}
+
+func (d *dbWrapper) setInteractionTranslation(translation *messengertypes.InteractionTranslation) error {
+	if translation.GetInteractionCID() == "" || translation.GetLanguage() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid and a language are required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(translation).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addConversationCounters counts a new user message in the statistics of its conversation, a message answering another
+// member is counted as a response when it follows the previous message by less than statsResponseMaxDelay
+func (d *dbWrapper) addConversationCounters(i *messengertypes.Interaction, medias []*messengertypes.Media) error {
+	if i.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	mediaSize := int64(0)
+	for _, media := range medias {
+		mediaSize += media.GetSize_()
+	}
+
+	counters := &messengertypes.ConversationCounters{}
+	err := d.db.Where("conversation_public_key = ?", i.GetConversationPublicKey()).First(counters).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		counters = &messengertypes.ConversationCounters{ConversationPublicKey: i.GetConversationPublicKey()}
+	case err != nil:
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	responses, responseTime := int64(0), int64(0)
+	if last := counters.GetLastMemberPublicKey(); last != "" && last != i.GetMemberPublicKey() {
+		if delay := i.GetSentDate() - counters.GetLastMessageDate(); delay >= 0 && delay <= statsResponseMaxDelay.Milliseconds() {
+			responses, responseTime = 1, delay
+		}
+	}
+
+	counters.MessageCount++
+	counters.MediaCount += int64(len(medias))
+	counters.MediaSize += mediaSize
+	if counters.FirstMessageDate == 0 || i.GetSentDate() < counters.FirstMessageDate {
+		counters.FirstMessageDate = i.GetSentDate()
+	}
+	// the messages received out of order don't change the last sender
+	if i.GetSentDate() >= counters.LastMessageDate {
+		counters.LastMessageDate = i.GetSentDate()
+		counters.LastMemberPublicKey = i.GetMemberPublicKey()
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(counters).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "conversation_public_key"}, {Name: "member_public_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"message_count":       gorm.Expr("message_count + ?", 1),
+			"media_count":         gorm.Expr("media_count + ?", len(medias)),
+			"media_size":          gorm.Expr("media_size + ?", mediaSize),
+			"response_count":      gorm.Expr("response_count + ?", responses),
+			"response_time_total": gorm.Expr("response_time_total + ?", responseTime),
+		}),
+	}).Create(&messengertypes.MemberCounters{
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		MemberPublicKey:       i.GetMemberPublicKey(),
+		MessageCount:          1,
+		MediaCount:            int64(len(medias)),
+		MediaSize:             mediaSize,
+		ResponseCount:         responses,
+		ResponseTimeTotal:     responseTime,
+	}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "conversation_public_key"}, {Name: "slot"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"message_count": gorm.Expr("message_count + ?", 1)}),
+	}).Create(&messengertypes.ConversationActivity{
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Slot:                  statsActivitySlot(i.GetSentDate()),
+		MessageCount:          1,
+	}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// rebuildConversationCounters aggregates the statistics of a conversation from its user messages
+func (d *dbWrapper) rebuildConversationCounters(convPK string) error {
+	return d.tx(func(tx *dbWrapper) error {
+		for _, model := range []interface{}{&messengertypes.ConversationCounters{}, &messengertypes.MemberCounters{}, &messengertypes.ConversationActivity{}} {
+			if err := tx.db.Where("conversation_public_key = ?", convPK).Delete(model).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		interactions := []*messengertypes.Interaction(nil)
+		if err := tx.db.
+			Preload("Medias").
+			Where("conversation_public_key = ? AND type = ?", convPK, messengertypes.AppMessage_TypeUserMessage).
+			Order("sent_date, cid").
+			Find(&interactions).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, i := range interactions {
+			if err := tx.addConversationCounters(i, i.GetMedias()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// getConversationCounters returns the statistics of a conversation, nil when none of its messages has been counted yet
+func (d *dbWrapper) getConversationCounters(convPK string) (*messengertypes.ConversationStats_Reply, error) {
+	counters := &messengertypes.ConversationCounters{}
+	err := d.db.Where("conversation_public_key = ?", convPK).First(counters).Error
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil, nil
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	members := []*messengertypes.MemberCounters(nil)
+	if err := d.db.Where("conversation_public_key = ?", convPK).Order("message_count DESC, member_public_key").Find(&members).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	activities := []*messengertypes.ConversationActivity(nil)
+	if err := d.db.Where("conversation_public_key = ?", convPK).Find(&activities).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	reply := &messengertypes.ConversationStats_Reply{
+		MessageCount:     counters.GetMessageCount(),
+		MediaCount:       counters.GetMediaCount(),
+		MediaSize:        counters.GetMediaSize(),
+		FirstMessageDate: counters.GetFirstMessageDate(),
+		LastMessageDate:  counters.GetLastMessageDate(),
+		Hours:            make([]int64, 24),
+		Weekdays:         make([]int64, 7),
+	}
+
+	for _, m := range members {
+		member := &messengertypes.ConversationStats_Member{
+			MemberPublicKey: m.GetMemberPublicKey(),
+			MessageCount:    m.GetMessageCount(),
+			MediaCount:      m.GetMediaCount(),
+			MediaSize:       m.GetMediaSize(),
+			ResponseCount:   m.GetResponseCount(),
+		}
+		if m.GetResponseCount() > 0 {
+			member.AverageResponseTime = m.GetResponseTimeTotal() / m.GetResponseCount()
+		}
+
+		reply.Members = append(reply.Members, member)
+	}
+
+	for _, activity := range activities {
+		if activity.GetSlot() < 0 || activity.GetSlot() >= statsWeekSlots {
+			continue
+		}
+
+		reply.Hours[activity.GetSlot()%24] += activity.GetMessageCount()
+		reply.Weekdays[activity.GetSlot()/24] += activity.GetMessageCount()
+	}
+
+	return reply, nil
+}
+
+// addGroupAuditEvent adds an event to the audit log of a group, it returns false if the event is already known
+func (d *dbWrapper) addGroupAuditEvent(event *messengertypes.GroupAuditEvent) (bool, error) {
+	if event.GetID() == "" || event.GetConversationPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id and a conversation public key are required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// getGroupAuditEvents returns the audit log of a group, the most recent first, starting after the cursor when it is
+// set, all the events are returned when count is 0
+func (d *dbWrapper) getGroupAuditEvents(convPK string, types []messengertypes.GroupAuditEvent_Type, cursor *messengertypes.ConversationAuditLog_Cursor, count int) ([]*messengertypes.GroupAuditEvent, error) {
+	query := d.db.Where("conversation_public_key = ?", convPK)
+	if len(types) > 0 {
+		query = query.Where("type IN ?", types)
+	}
+
+	if cursor != nil {
+		query = query.Where("(date < ? OR (date = ? AND id < ?))", cursor.GetDate(), cursor.GetDate(), cursor.GetID())
+	}
+
+	if count > 0 {
+		query = query.Limit(count)
+	}
+
+	events := []*messengertypes.GroupAuditEvent(nil)
+	if err := query.Order("date DESC, id DESC").Find(&events).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return events, nil
+}
+
+// addRecoveryShard stores the shard of a contact, it replaces the shard of a previous setup and is ignored if a more
+// recent setup is known, it returns false when the shard is not stored
+func (d *dbWrapper) addRecoveryShard(shard *messengertypes.RecoveryShard) (bool, error) {
+	if shard.GetSetupID() == "" || shard.GetOwnerPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a setup id and an owner public key are required"))
+	}
+
+	added := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		count := int64(0)
+		if err := tx.db.Model(&messengertypes.RecoveryShard{}).
+			Where("owner_public_key = ? AND (setup_id = ? OR sent_date > ?)", shard.GetOwnerPublicKey(), shard.GetSetupID(), shard.GetSentDate()).
+			Count(&count).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if count > 0 {
+			return nil
+		}
+
+		if err := tx.db.Where("owner_public_key = ?", shard.GetOwnerPublicKey()).Delete(&messengertypes.RecoveryShard{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Create(shard).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		added = true
+		return nil
+	}); err != nil {
+		return false, err
+	}
+
+	return added, nil
+}
+
+func (d *dbWrapper) getRecoveryShard(ownerPK string) (*messengertypes.RecoveryShard, error) {
+	if ownerPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an owner public key is required"))
+	}
+
+	shard := &messengertypes.RecoveryShard{}
+	if err := d.db.Where("owner_public_key = ?", ownerPK).First(shard).Error; err != nil {
+		return nil, err
+	}
+
+	return shard, nil
+}
+
+func (d *dbWrapper) getRecoveryShards() ([]*messengertypes.RecoveryShard, error) {
+	shards := []*messengertypes.RecoveryShard(nil)
+	if err := d.db.Order("sent_date DESC").Find(&shards).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return shards, nil
+}
+
+// addRecoveryTrustee records a trusted contact of a setup, the trustees of the previous setups are removed and the ones
+// of the setups older than the last one are ignored, it returns false when the trustee is not stored
+func (d *dbWrapper) addRecoveryTrustee(trustee *messengertypes.RecoveryTrustee) (bool, error) {
+	if trustee.GetSetupID() == "" || trustee.GetContactPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a setup id and a contact public key are required"))
+	}
+
+	added := false
+	if err := d.tx(func(tx *dbWrapper) error {
+		count := int64(0)
+		if err := tx.db.Model(&messengertypes.RecoveryTrustee{}).
+			Where("setup_id <> ? AND created_date > ?", trustee.GetSetupID(), trustee.GetCreatedDate()).
+			Count(&count).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if count > 0 {
+			return nil
+		}
+
+		if err := tx.db.Where("setup_id <> ?", trustee.GetSetupID()).Delete(&messengertypes.RecoveryTrustee{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(trustee)
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
+
+		added = res.RowsAffected > 0
+		return nil
+	}); err != nil {
+		return false, err
+	}
+
+	return added, nil
+}
+
+func (d *dbWrapper) getRecoveryTrustees() ([]*messengertypes.RecoveryTrustee, error) {
+	trustees := []*messengertypes.RecoveryTrustee(nil)
+	if err := d.db.Order("contact_public_key").Find(&trustees).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return trustees, nil
+}
+
+func (d *dbWrapper) addScheduledAnnouncement(announcement *messengertypes.ScheduledAnnouncement) error {
+	if announcement.GetID() == "" || announcement.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id and a conversation public key are required"))
+	}
+
+	if err := d.db.Create(announcement).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getScheduledAnnouncements returns the scheduled announcements by publish date, of all the conversations if convPK is
+// empty
+func (d *dbWrapper) getScheduledAnnouncements(convPK string) ([]*messengertypes.ScheduledAnnouncement, error) {
+	query := d.db.Order("publish_date, id")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	announcements := []*messengertypes.ScheduledAnnouncement(nil)
+	if err := query.Find(&announcements).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return announcements, nil
+}
+
+func (d *dbWrapper) getDueScheduledAnnouncements(now int64) ([]*messengertypes.ScheduledAnnouncement, error) {
+	announcements := []*messengertypes.ScheduledAnnouncement(nil)
+	if err := d.db.Where("publish_date <= ?", now).Order("publish_date, id").Find(&announcements).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return announcements, nil
+}
+
+// deleteScheduledAnnouncement removes a scheduled announcement and returns it, gorm.ErrRecordNotFound is returned if it
+// doesn't exist
+func (d *dbWrapper) deleteScheduledAnnouncement(id string) (*messengertypes.ScheduledAnnouncement, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	announcement := &messengertypes.ScheduledAnnouncement{}
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Where("id = ?", id).First(announcement).Error; err != nil {
+			return err
+		}
+
+		return tx.db.Where("id = ?", id).Delete(&messengertypes.ScheduledAnnouncement{}).Error
+	}); err == gorm.ErrRecordNotFound {
+		return nil, err
+	} else if err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return announcement, nil
+}
+
+// addOutboxMessage adds a message at the end of the outbox
+func (d *dbWrapper) addOutboxMessage(message *messengertypes.OutboxMessage) error {
+	if message.GetID() == "" || message.GetConversationPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id and a conversation public key are required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		last := struct{ Position int64 }{}
+		if err := tx.db.Model(&messengertypes.OutboxMessage{}).Select("COALESCE(MAX(position), 0) AS position").Scan(&last).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		message.Position = last.Position + 1
+		if err := tx.db.Create(message).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+// getOutboxMessages returns the deferred messages in the order they have been accepted
+func (d *dbWrapper) getOutboxMessages() ([]*messengertypes.OutboxMessage, error) {
+	messages := []*messengertypes.OutboxMessage(nil)
+	if err := d.db.Order("position").Find(&messages).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return messages, nil
+}
+
+// getExpiredOutboxMessages returns the deferred messages whose deadline is past at now
+func (d *dbWrapper) getExpiredOutboxMessages(now int64) ([]*messengertypes.OutboxMessage, error) {
+	messages := []*messengertypes.OutboxMessage(nil)
+	if err := d.db.Where("expires_at > 0 AND expires_at <= ?", now).Order("position").Find(&messages).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return messages, nil
+}
+
+// getConversationOutboxMessages returns the deferred messages of a conversation in the order they will be sent, the
+// messages of all the conversations when convPK is empty
+func (d *dbWrapper) getConversationOutboxMessages(convPK string) ([]*messengertypes.OutboxMessage, error) {
+	query := d.db.Order("position")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	messages := []*messengertypes.OutboxMessage(nil)
+	if err := query.Find(&messages).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return messages, nil
+}
+
+func (d *dbWrapper) getOutboxMessage(id string) (*messengertypes.OutboxMessage, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	message := &messengertypes.OutboxMessage{}
+	if err := d.db.First(message, &messengertypes.OutboxMessage{ID: id}).Error; err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("outbox message not found"))
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return message, nil
+}
+
+// setOutboxMessageFailure keeps the error of a failed attempt to send a deferred message
+func (d *dbWrapper) setOutboxMessageFailure(id string, reason string, now int64) error {
+	if err := d.db.Model(&messengertypes.OutboxMessage{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"attempts":          gorm.Expr("attempts + 1"),
+		"last_error":        reason,
+		"last_attempt_date": now,
+	}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// moveOutboxMessage moves a deferred message before another one, or at the end of the outbox when beforeID is empty,
+// the positions of the outbox are renumbered
+func (d *dbWrapper) moveOutboxMessage(id, beforeID string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	if id == beforeID {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a message can't be moved before itself"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		messages, err := tx.getOutboxMessages()
+		if err != nil {
+			return err
+		}
+
+		var moved *messengertypes.OutboxMessage
+		ordered := make([]*messengertypes.OutboxMessage, 0, len(messages))
+		for _, message := range messages {
+			if message.GetID() == id {
+				moved = message
+				continue
+			}
+			ordered = append(ordered, message)
+		}
+
+		if moved == nil {
+			return errcode.ErrNotFound.Wrap(fmt.Errorf("outbox message not found"))
+		}
+
+		idx := len(ordered)
+		if beforeID != "" {
+			idx = -1
+			for i, message := range ordered {
+				if message.GetID() == beforeID {
+					idx = i
+					break
+				}
+			}
+
+			if idx < 0 {
+				return errcode.ErrNotFound.Wrap(fmt.Errorf("outbox message not found"))
+			}
+		}
+
+		ordered = append(ordered[:idx], append([]*messengertypes.OutboxMessage{moved}, ordered[idx:]...)...)
+		for i, message := range ordered {
+			if message.GetPosition() == int64(i+1) {
+				continue
+			}
+
+			if err := tx.db.Model(&messengertypes.OutboxMessage{}).Where("id = ?", message.GetID()).Update("position", int64(i+1)).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (d *dbWrapper) deleteOutboxMessage(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	if err := d.db.Where("id = ?", id).Delete(&messengertypes.OutboxMessage{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) addLocalEcho(echo *messengertypes.LocalEcho) error {
+	if echo.GetID() == "" || echo.GetConversationPublicKey() == "" || echo.GetMessageHash() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id, a conversation public key and a message hash are required"))
+	}
+
+	if err := d.db.Create(echo).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getLocalEchoByHash returns the oldest local echo of a message sent to a conversation, nil if none
+func (d *dbWrapper) getLocalEchoByHash(convPK, hash string) (*messengertypes.LocalEcho, error) {
+	echoes := []*messengertypes.LocalEcho(nil)
+	if err := d.db.
+		Where("conversation_public_key = ? AND message_hash = ?", convPK, hash).
+		Order("created_date, id").
+		Limit(1).
+		Find(&echoes).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(echoes) == 0 {
+		return nil, nil
+	}
+
+	return echoes[0], nil
+}
+
+// getLocalEchoes returns the local echoes of a conversation, or of all the conversations when convPK is empty, the
+// oldest first
+func (d *dbWrapper) getLocalEchoes(convPK string) ([]*messengertypes.LocalEcho, error) {
+	query := d.db.Order("created_date, id")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	echoes := []*messengertypes.LocalEcho(nil)
+	if err := query.Find(&echoes).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return echoes, nil
+}
+
+// setLocalEchoState changes the state of a local echo, nil is returned and nothing is updated when the echo has been
+// replaced by its interaction in the meantime
+func (d *dbWrapper) setLocalEchoState(id string, state messengertypes.LocalEcho_State, reason string) (*messengertypes.LocalEcho, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.LocalEcho{}).
+		Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"state": state,
+			"error": reason,
+		})
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	echo := &messengertypes.LocalEcho{}
+	if err := d.db.Where("id = ?", id).First(echo).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return echo, nil
+}
+
+func (d *dbWrapper) setLocalEchoOutboxID(id, outboxID string) error {
+	if err := d.db.Model(&messengertypes.LocalEcho{}).Where("id = ?", id).Update("outbox_id", outboxID).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getLocalEchoByOutboxID returns the local echo of a deferred message, nil if none
+func (d *dbWrapper) getLocalEchoByOutboxID(outboxID string) (*messengertypes.LocalEcho, error) {
+	echoes := []*messengertypes.LocalEcho(nil)
+	if err := d.db.Where("outbox_id = ?", outboxID).Limit(1).Find(&echoes).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(echoes) == 0 {
+		return nil, nil
+	}
+
+	return echoes[0], nil
+}
+
+// getInterruptedLocalEchoes returns the local echoes still pending which were created before a date and are not
+// waiting in the outbox, their message has not been sent
+func (d *dbWrapper) getInterruptedLocalEchoes(before int64) ([]*messengertypes.LocalEcho, error) {
+	echoes := []*messengertypes.LocalEcho(nil)
+	if err := d.db.
+		Where("state = ? AND created_date < ?", messengertypes.LocalEcho_StatePending, before).
+		Where("(COALESCE(outbox_id, '') = '' OR outbox_id NOT IN (?))", d.db.Model(&messengertypes.OutboxMessage{}).Select("id")).
+		Order("created_date, id").
+		Find(&echoes).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return echoes, nil
+}
+
+func (d *dbWrapper) deleteLocalEcho(id string) (bool, error) {
+	if id == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an id is required"))
+	}
+
+	tx := d.db.Where("id = ?", id).Delete(&messengertypes.LocalEcho{})
+	if tx.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	return tx.RowsAffected > 0, nil
+}
+
+// addSentContentHash records the hash of a content sent to a conversation, the hashes sent before expiredBefore are
+// removed
+func (d *dbWrapper) addSentContentHash(sent *messengertypes.SentContentHash, expiredBefore int64) error {
+	if sent.GetConversationPublicKey() == "" || sent.GetContentHash() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a content hash are required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Where("sent_date < ?", expiredBefore).Delete(&messengertypes.SentContentHash{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(sent).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+// isDuplicateSend returns whether a content has been sent to a conversation since a date, or is still deferred in the
+// outbox
+func (d *dbWrapper) isDuplicateSend(convPK, contentHash string, since int64) (bool, error) {
+	if convPK == "" || contentHash == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a content hash are required"))
+	}
+
+	sent := int64(0)
+	if err := d.db.Model(&messengertypes.SentContentHash{}).
+		Where("conversation_public_key = ? AND content_hash = ? AND sent_date >= ?", convPK, contentHash, since).
+		Count(&sent).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	deferred := int64(0)
+	if err := d.db.Model(&messengertypes.OutboxMessage{}).
+		Where("conversation_public_key = ? AND content_hash = ?", convPK, contentHash).
+		Count(&deferred).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return sent+deferred > 0, nil
+}
+
+// getRecentProcessedEvents returns the most recently handled events of the ledger
+func (d *dbWrapper) getRecentProcessedEvents(limit int) ([]*messengertypes.ProcessedEvent, error) {
+	events := []*messengertypes.ProcessedEvent(nil)
+	if err := d.db.Order("processed_date DESC").Limit(limit).Find(&events).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return events, nil
+}
+
+func (d *dbWrapper) addAPIToken(token *messengertypes.APIToken) error {
+	if token.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	if err := d.db.Create(token).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getAPIToken(id string) (*messengertypes.APIToken, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	token := &messengertypes.APIToken{}
+	if err := d.db.First(&token, &messengertypes.APIToken{ID: id}).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func (d *dbWrapper) getAPITokens() ([]*messengertypes.APIToken, error) {
+	tokens := []*messengertypes.APIToken(nil)
+	if err := d.db.Order("created_date").Find(&tokens).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tokens, nil
+}
+
+func (d *dbWrapper) hasAPITokens() (bool, error) {
+	var count int64
+	if err := d.db.Model(&messengertypes.APIToken{}).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+func (d *dbWrapper) deleteAPIToken(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a token id is required"))
+	}
+
+	res := d.db.Delete(&messengertypes.APIToken{}, &messengertypes.APIToken{ID: id})
+	if res.Error != nil {
+		return errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	if res.RowsAffected == 0 {
+		return errcode.ErrNotFound
+	}
+
+	return nil
+}
+
+// getOwnGroupMemberships returns the member keys of the account in its multi member groups
+func (d *dbWrapper) getOwnGroupMemberships() ([]*messengertypes.ContactMetadata_GroupMembership, error) {
+	memberships := []*messengertypes.ContactMetadata_GroupMembership(nil)
+	if err := d.db.Model(&messengertypes.Member{}).
+		Select("members.conversation_public_key, members.public_key AS member_public_key").
+		Joins("JOIN conversations ON conversations.public_key = members.conversation_public_key").
+		Where("members.is_me = ? AND conversations.type = ?", true, messengertypes.Conversation_MultiMemberType).
+		Order("members.conversation_public_key").
+		Scan(&memberships).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return memberships, nil
+}
+
+// countSharedGroups counts the multi member groups of the account in which the members of memberships are approved and
+// not removed, a group is counted once
+func (d *dbWrapper) countSharedGroups(memberships []*messengertypes.ContactMetadata_GroupMembership) (int32, error) {
+	shared := map[string]bool{}
+	for _, membership := range memberships {
+		convPK := membership.GetConversationPublicKey()
+		if convPK == "" || membership.GetMemberPublicKey() == "" || shared[convPK] {
+			continue
+		}
+
+		count := int64(0)
+		if err := d.db.Model(&messengertypes.Member{}).
+			Joins("JOIN conversations ON conversations.public_key = members.conversation_public_key").
+			Where("members.conversation_public_key = ? AND members.public_key = ? AND members.is_me = ? AND members.removed_date = 0 AND members.join_state = ? AND conversations.type = ?",
+				convPK, membership.GetMemberPublicKey(), false, messengertypes.Member_JoinApproved, messengertypes.Conversation_MultiMemberType).
+			Count(&count).Error; err != nil {
+			return 0, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if count > 0 {
+			shared[convPK] = true
+		}
+	}
+
+	return int32(len(shared)), nil
+}
+
+// addContactIntroduction stores an introduction, it returns false when the introducer had already introduced the contact
+func (d *dbWrapper) addContactIntroduction(introduction *messengertypes.ContactIntroduction) (bool, error) {
+	if introduction.GetContactPublicKey() == "" || introduction.GetIntroducerPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key and an introducer public key are required"))
+	}
+
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(introduction)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
+	}
+
+	return res.RowsAffected > 0, nil
+}
+
+// getContactIntroductions returns the introductions of a contact, or all of them when contactPK is empty, the most
+// recent first
+func (d *dbWrapper) getContactIntroductions(contactPK string) ([]*messengertypes.ContactIntroduction, error) {
+	query := d.db
+	if contactPK != "" {
+		query = query.Where("contact_public_key = ?", contactPK)
+	}
+
+	introductions := []*messengertypes.ContactIntroduction(nil)
+	if err := query.Order("sent_date DESC, introducer_public_key").Find(&introductions).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return introductions, nil
+}
+
+func (d *dbWrapper) addContactRequestAutoAccept(accept *messengertypes.ContactRequestAutoAccept) error {
+	if accept.GetContactPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	// a contact accepted again after being removed replaces the previous entry
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(accept).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getContactRequestAutoAccepts() ([]*messengertypes.ContactRequestAutoAccept, error) {
+	accepts := []*messengertypes.ContactRequestAutoAccept(nil)
+	if err := d.db.Order("accepted_date DESC, contact_public_key").Find(&accepts).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return accepts, nil
+}
+
+// addDBSnapshot records the lineage of a snapshot, its parent is the most recent snapshot taken before it
+func (d *dbWrapper) addDBSnapshot(snapshot *messengertypes.DBSnapshot) error {
+	if snapshot.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a snapshot id is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		parent := &messengertypes.DBSnapshot{}
+		err := tx.db.Where("created_date <= ?", snapshot.GetCreatedDate()).Order("created_date DESC").First(parent).Error
+		switch {
+		case err == nil:
+			snapshot.ParentID = parent.GetID()
+		case err != gorm.ErrRecordNotFound:
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if err := tx.db.Create(snapshot).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+// getDBSnapshots returns the snapshots, from the most recent
+func (d *dbWrapper) getDBSnapshots() ([]*messengertypes.DBSnapshot, error) {
+	snapshots := []*messengertypes.DBSnapshot(nil)
+	if err := d.db.Order("created_date DESC").Find(&snapshots).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return snapshots, nil
+}
+
+// getLastProcessedDate returns the date of the most recent processed event, 0 if none
+func (d *dbWrapper) getLastProcessedDate() (int64, error) {
+	date := int64(0)
+	if err := d.db.Model(&messengertypes.ProcessedEvent{}).Select("COALESCE(MAX(processed_date), 0)").Scan(&date).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return date, nil
+}
+
+func (d *dbWrapper) isMemberMuted(convPK, memberPK string) (bool, error) {
+	if convPK == "" || memberPK == "" {
+		return false, nil
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.MutedMember{}).Where(&messengertypes.MutedMember{ConversationPublicKey: convPK, MemberPublicKey: memberPK}).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// addMutedMember records a muted member, the messages already stored are left as they are
+func (d *dbWrapper) addMutedMember(member *messengertypes.MutedMember) error {
+	if member.GetConversationPublicKey() == "" || member.GetMemberPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a member public key are required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(member).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getMutedMembers returns the members muted in a conversation, or in all the conversations when convPK is empty
+func (d *dbWrapper) getMutedMembers(convPK string) ([]*messengertypes.MutedMember, error) {
+	members := []*messengertypes.MutedMember(nil)
+
+	query := d.db.Order("muted_date")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	if err := query.Find(&members).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return members, nil
+}
+
+// setMemberMuted mutes or unmutes a member of a conversation and flags its existing messages, the unread count of the
+// conversation is lowered when its unread messages are muted. It returns the conversation and the updated interactions
+func (d *dbWrapper) setMemberMuted(convPK, memberPK string, muted bool) (*messengertypes.Conversation, []*messengertypes.Interaction, error) {
+	if convPK == "" || memberPK == "" {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a member public key are required"))
+	}
+
+	cids := []string(nil)
+	if err := d.tx(func(tx *dbWrapper) error {
+		conv, err := tx.getConversationByPK(convPK)
+		if err == gorm.ErrRecordNotFound {
+			return errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+		} else if err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if muted {
+			if err := tx.addMutedMember(&messengertypes.MutedMember{ConversationPublicKey: convPK, MemberPublicKey: memberPK, MutedDate: timestampMs(time.Now())}); err != nil {
+				return err
+			}
+		} else if err := tx.db.Where(&messengertypes.MutedMember{ConversationPublicKey: convPK, MemberPublicKey: memberPK}).Delete(&messengertypes.MutedMember{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.
+			Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ? AND member_public_key = ? AND is_me = ? AND is_member_muted = ?", convPK, memberPK, false, !muted).
+			Pluck("cid", &cids).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(cids) == 0 {
+			return nil
+		}
+
+		if err := tx.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", cids).Update("is_member_muted", muted).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		// the messages shown again are not counted as unread, they may have been read elsewhere
+		if !muted {
+			return nil
+		}
+
+		unreadCount, err := tx.countConversationUnreadAfter(convPK, conv.GetReadUntil())
+		if err != nil {
+			return err
+		}
+
+		if unreadCount >= conv.GetUnreadCount() {
+			return nil
+		}
+
+		if err := tx.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: convPK}).Update("unread_count", unreadCount).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	if len(cids) == 0 {
+		return conv, interactions, nil
+	}
+
+	if err := d.db.Where("cid IN ?", cids).Find(&interactions).Error; err != nil {
+		return nil, nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return conv, interactions, nil
+}
+
+func (d *dbWrapper) isInteractionHidden(cid string) (bool, error) {
+	if cid == "" {
+		return false, nil
+	}
+
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.HiddenInteraction{}).Where(&messengertypes.HiddenInteraction{InteractionCID: cid}).Count(&count).Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// addHiddenInteraction records a hidden interaction, the interaction itself is flagged by setInteractionsHidden or
+// when it is received
+func (d *dbWrapper) addHiddenInteraction(hidden *messengertypes.HiddenInteraction) error {
+	if hidden.GetInteractionCID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(hidden).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getHiddenInteractions returns the interactions hidden in a conversation, or in all the conversations when convPK is
+// empty
+func (d *dbWrapper) getHiddenInteractions(convPK string) ([]*messengertypes.HiddenInteraction, error) {
+	hidden := []*messengertypes.HiddenInteraction(nil)
+
+	query := d.db.Order("hidden_date")
+	if convPK != "" {
+		query = query.Where("conversation_public_key = ?", convPK)
+	}
+
+	if err := query.Find(&hidden).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return hidden, nil
+}
+
+// setInteractionsHidden hides or shows stored interactions on this device, the unknown cids are skipped. It returns
+// the updated interactions
+func (d *dbWrapper) setInteractionsHidden(cids []string, hidden bool) ([]*messengertypes.Interaction, error) {
+	if len(cids) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of cids is required"))
+	}
+
+	updated := []*messengertypes.Interaction(nil)
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Where("cid IN ? AND is_hidden = ?", cids, !hidden).Find(&updated).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(updated) == 0 {
+			return nil
+		}
+
+		updatedCIDs := make([]string, len(updated))
+		now := timestampMs(time.Now())
+		for idx, i := range updated {
+			updatedCIDs[idx] = i.GetCID()
+			i.IsHidden = hidden
+
+			if !hidden {
+				continue
+			}
+
+			if err := tx.addHiddenInteraction(&messengertypes.HiddenInteraction{InteractionCID: i.GetCID(), ConversationPublicKey: i.GetConversationPublicKey(), HiddenDate: now}); err != nil {
+				return err
+			}
+		}
+
+		if !hidden {
+			if err := tx.db.Where("interaction_cid IN ?", updatedCIDs).Delete(&messengertypes.HiddenInteraction{}).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		if err := tx.db.Model(&messengertypes.Interaction{}).Where("cid IN ?", updatedCIDs).Update("is_hidden", hidden).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// isInteractionRetracted checks whether the sender of an interaction retracted it before it was received
+func (d *dbWrapper) isInteractionRetracted(i *messengertypes.Interaction) (bool, error) {
+	if i.GetCID() == "" {
+		return false, nil
+	}
+
+	count := int64(0)
+	if err := d.db.
+		Model(&messengertypes.Interaction{}).
+		Where("type = ? AND target_cid = ? AND conversation_public_key = ? AND member_public_key = ? AND is_me = ?", messengertypes.AppMessage_TypeInteractionRetract, i.GetCID(), i.GetConversationPublicKey(), i.GetMemberPublicKey(), i.GetIsMe()).
+		Count(&count).
+		Error; err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return count > 0, nil
+}
+
+// addAccountConversation adds the account conversation holding the system notices if it doesn't exist yet
+func (d *dbWrapper) addAccountConversation(accountPK string, createdDate int64) error {
+	if accountPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&messengertypes.Conversation{
+		PublicKey:   accountPK,
+		Type:        messengertypes.Conversation_AccountType,
+		CreatedDate: createdDate,
+	}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// addSystemNotice adds a system notice to the account conversation, which is created with the first notice. The notices
+// are ordered by their lamport time, which is the count of the notices
+func (d *dbWrapper) addSystemNotice(accountPK string, payload []byte, now time.Time) (*messengertypes.Conversation, *messengertypes.Interaction, error) {
+	if accountPK == "" {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+	}
+
+	var (
+		conv *messengertypes.Conversation
+		i    *messengertypes.Interaction
+	)
+	if err := d.tx(func(tx *dbWrapper) error {
+		if err := tx.addAccountConversation(accountPK, timestampMs(now)); err != nil {
+			return err
+		}
+
+		lamportTime := uint64(0)
+		if err := tx.db.
+			Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ?", accountPK).
+			Select("COALESCE(MAX(lamport_time), 0)").
+			Scan(&lamportTime).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+		lamportTime++
+
+		i = &messengertypes.Interaction{
+			CID:                   fmt.Sprintf("__system-notice-%d", lamportTime),
+			Type:                  messengertypes.AppMessage_TypeSystemNotice,
+			ConversationPublicKey: accountPK,
+			Payload:               payload,
+			SentDate:              timestampMs(now),
+			LamportTime:           lamportTime,
+			ReceivedDate:          timestampMs(now),
+			NormalizedSentDate:    timestampMs(now),
+		}
+		if err := tx.db.Create(i).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		opened, err := tx.isConversationOpened(accountPK)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.updateConversationReadState(accountPK, !opened, now); err != nil {
+			return err
+		}
+
+		conv, err = tx.getConversationByPK(accountPK)
+		if err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return conv, i, nil
+}
+
+// upsertOutgoingContactRequest records an outgoing contact request, a request sent again to the same contact replaces
+// the previous one
+func (d *dbWrapper) upsertOutgoingContactRequest(req *messengertypes.OutgoingContactRequest) error {
+	if req.GetContactPublicKey() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(req).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) getOutgoingContactRequest(contactPK string) (*messengertypes.OutgoingContactRequest, error) {
+	if contactPK == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	req := &messengertypes.OutgoingContactRequest{}
+	if err := d.db.First(req, &messengertypes.OutgoingContactRequest{ContactPublicKey: contactPK}).Error; err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("no outgoing contact request for this contact"))
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return req, nil
+}
+
+// getDueOutgoingContactRequests returns the pending requests not delivered yet which must be sent again at now
+func (d *dbWrapper) getDueOutgoingContactRequests(now int64) ([]*messengertypes.OutgoingContactRequest, error) {
+	reqs := []*messengertypes.OutgoingContactRequest(nil)
+
+	if err := d.db.
+		Where("status = ? AND next_resend_date > 0 AND next_resend_date <= ?", messengertypes.Contact_RequestPending, now).
+		Order("next_resend_date").
+		Find(&reqs).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return reqs, nil
+}
+
+// getExpiredOutgoingContactRequests returns the pending requests whose expiry date is past at now
+func (d *dbWrapper) getExpiredOutgoingContactRequests(now int64) ([]*messengertypes.OutgoingContactRequest, error) {
+	reqs := []*messengertypes.OutgoingContactRequest(nil)
+
+	if err := d.db.
+		Where("status = ? AND expires_at <= ?", messengertypes.Contact_RequestPending, now).
+		Find(&reqs).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return reqs, nil
+}
+
+func (d *dbWrapper) updateOutgoingContactRequest(contactPK string, values map[string]interface{}) error {
+	if contactPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
+	}
+
+	if err := d.db.Model(&messengertypes.OutgoingContactRequest{}).Where("contact_public_key = ?", contactPK).Updates(values).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) deleteOutgoingContactRequest(contactPK string) error {
+	if err := d.db.Where(&messengertypes.OutgoingContactRequest{ContactPublicKey: contactPK}).Delete(&messengertypes.OutgoingContactRequest{}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// syncContactRequestStatus copies the status and the expiry date of the outgoing request of a contact to the contact,
+// it returns a nil contact when either of them is unknown and whether the contact has been updated
+func (d *dbWrapper) syncContactRequestStatus(contactPK string) (*messengertypes.Contact, bool, error) {
+	req, err := d.getOutgoingContactRequest(contactPK)
+	if errcode.Is(err, errcode.ErrNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	contact, err := d.getContactByPK(contactPK)
+	if err == gorm.ErrRecordNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if contact.GetRequestStatus() == req.GetStatus() && contact.GetRequestExpiresAt() == req.GetExpiresAt() {
+		return contact, false, nil
+	}
+
+	if err := d.db.Model(&messengertypes.Contact{}).Where("public_key = ?", contactPK).Updates(map[string]interface{}{
+		"request_status":     req.GetStatus(),
+		"request_expires_at": req.GetExpiresAt(),
+	}).Error; err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	contact.RequestStatus = req.GetStatus()
+	contact.RequestExpiresAt = req.GetExpiresAt()
+
+	return contact, true, nil
+}
+
+// setConversationPaused pauses or resumes a conversation, the paused conversations are not activated on start
+func (d *dbWrapper) setConversationPaused(pk string, paused bool) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Update("is_paused", paused)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
+
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
+	}
+
+	return d.getConversationByPK(pk)
+}
+
+// getIntegrityCheckedInteractions returns the interactions of a conversation received from its group log, the local,
+// imported and shared ones have no event in the log
+func (d *dbWrapper) getIntegrityCheckedInteractions(convPK string) ([]*messengertypes.Interaction, error) {
+	interactions := []*messengertypes.Interaction(nil)
+
+	if err := d.db.
+		Select("cid, type, payload, device_public_key").
+		Where("conversation_public_key = ? AND type < ? AND is_imported = ? AND is_shared_history = ?", convPK, messengertypes.AppMessage_TypeMonitorMetadata, false, false).
+		Order("cid").
+		Find(&interactions).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return interactions, nil
+}
+
+// forgetInteraction removes an interaction and its entry of the ledger of the processed events, its event can then be
+// handled again
+func (d *dbWrapper) forgetInteraction(cid string) error {
+	if cid == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a cid is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		if err := tx.db.Where("cid = ?", cid).Delete(&messengertypes.Interaction{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Where("cid = ?", cid).Delete(&messengertypes.ProcessedEvent{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+// addAudience stores an audience with its contacts, an existing audience is kept as is
+func (d *dbWrapper) addAudience(audience *messengertypes.Audience) error {
+	if audience.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an audience id is required"))
+	}
+
+	return d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Omit("Members").Create(audience)
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
+
+		if res.RowsAffected == 0 || len(audience.GetMembers()) == 0 {
+			return nil
+		}
+
+		for _, member := range audience.GetMembers() {
+			member.AudienceID = audience.GetID()
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(audience.GetMembers()).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func (d *dbWrapper) getAudience(id string) (*messengertypes.Audience, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an audience id is required"))
+	}
+
+	audience := &messengertypes.Audience{}
+	if err := d.db.Preload("Members").First(audience, &messengertypes.Audience{ID: id}).Error; err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return audience, nil
+}
+
+// getAudiences returns the audiences ordered by creation date
+func (d *dbWrapper) getAudiences() ([]*messengertypes.Audience, error) {
+	audiences := []*messengertypes.Audience(nil)
+	if err := d.db.Preload("Members").Order("created_date, id").Find(&audiences).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return audiences, nil
+}
+
+// updateAudience replaces the name and the contacts of an audience
+func (d *dbWrapper) updateAudience(id, name string, contactPKs []string) (*messengertypes.Audience, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an audience id is required"))
+	}
+
+	if err := d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Model(&messengertypes.Audience{}).Where(&messengertypes.Audience{ID: id}).Update("name", name)
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
+
+		if res.RowsAffected == 0 {
+			return errcode.ErrNotFound
+		}
+
+		if err := tx.db.Where("audience_id = ?", id).Delete(&messengertypes.AudienceMember{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if len(contactPKs) == 0 {
+			return nil
+		}
+
+		members := make([]*messengertypes.AudienceMember, len(contactPKs))
+		for i, pk := range contactPKs {
+			members[i] = &messengertypes.AudienceMember{AudienceID: id, ContactPublicKey: pk}
+		}
+
+		if err := tx.db.Create(members).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return d.getAudience(id)
+}
 
-	infos.Contacts, err = d.dbModelRowsCount(messengertypes.Contact{})
-	errs = multierr.Append(errs, err)
+// deleteAudience removes an audience and its contacts, its broadcasts are kept
+func (d *dbWrapper) deleteAudience(id string) error {
+	if id == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an audience id is required"))
+	}
 
-	infos.Interactions, err = d.dbModelRowsCount(messengertypes.Interaction{})
-	errs = multierr.Append(errs, err)
+	return d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Delete(&messengertypes.Audience{}, &messengertypes.Audience{ID: id})
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
 
-	infos.Conversations, err = d.dbModelRowsCount(messengertypes.Conversation{})
-	errs = multierr.Append(errs, err)
+		if res.RowsAffected == 0 {
+			return errcode.ErrNotFound
+		}
 
-	infos.Members, err = d.dbModelRowsCount(messengertypes.Member{})
-	errs = multierr.Append(errs, err)
+		if err := tx.db.Where("audience_id = ?", id).Delete(&messengertypes.AudienceMember{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
 
-	infos.Devices, err = d.dbModelRowsCount(messengertypes.Device{})
-	errs = multierr.Append(errs, err)
+		return nil
+	})
+}
 
-	infos.ServiceTokens, err = d.dbModelRowsCount(messengertypes.ServiceToken{})
-	errs = multierr.Append(errs, err)
+// addBroadcast stores a broadcast with its recipients, an existing broadcast is kept as is
+func (d *dbWrapper) addBroadcast(broadcast *messengertypes.Broadcast) error {
+	if broadcast.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a broadcast id is required"))
+	}
 
-	infos.ConversationReplicationInfo, err = d.dbModelRowsCount(messengertypes.ConversationReplicationInfo{})
-	errs = multierr.Append(errs, err)
+	return d.tx(func(tx *dbWrapper) error {
+		res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Omit("Recipients").Create(broadcast)
+		if res.Error != nil {
+			return errcode.ErrDBWrite.Wrap(res.Error)
+		}
 
-	return infos, errs
+		if res.RowsAffected == 0 || len(broadcast.GetRecipients()) == 0 {
+			return nil
+		}
+
+		for _, recipient := range broadcast.GetRecipients() {
+			recipient.BroadcastID = broadcast.GetID()
+		}
+
+		if err := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(broadcast.GetRecipients()).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
 }
 
-func (d *dbWrapper) addDevice(devicePK string, memberPK string) (*messengertypes.Device, error) {
-	if devicePK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a device public key is required"))
+func (d *dbWrapper) getBroadcast(id string) (*messengertypes.Broadcast, error) {
+	if id == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a broadcast id is required"))
 	}
 
-	if memberPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a member public key is required"))
+	broadcast := &messengertypes.Broadcast{}
+	if err := d.db.Preload("Recipients").First(broadcast, &messengertypes.Broadcast{ID: id}).Error; err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	if err := d.tx(func(tx *dbWrapper) error {
-		// Check if this device already exists for another member
-		{
-			count := int64(0)
+	return broadcast, nil
+}
 
-			if err := tx.db.
-				Model(&messengertypes.Device{}).
-				Where("member_public_key != ? AND public_key == ?", memberPK, devicePK).
-				Count(&count).
-				Error; err != nil {
-				return err
-			}
+// getBroadcasts returns the broadcasts of an audience, or all of them if the audience id is empty, the last one first
+func (d *dbWrapper) getBroadcasts(audienceID string) ([]*messengertypes.Broadcast, error) {
+	query := d.db.Preload("Recipients").Order("created_date DESC, id")
+	if audienceID != "" {
+		query = query.Where("audience_id = ?", audienceID)
+	}
 
-			if count > 0 {
-				return errcode.ErrDBWrite.Wrap(fmt.Errorf("the device already exists for another member"))
-			}
-		}
+	broadcasts := []*messengertypes.Broadcast(nil)
+	if err := query.Find(&broadcasts).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
 
-		return tx.db.
-			Clauses(clause.OnConflict{DoNothing: true}).
-			Create(&messengertypes.Device{
-				PublicKey:       devicePK,
-				MemberPublicKey: memberPK,
-			}).
-			Error
-	}); err != nil {
-		return nil, err
+	return broadcasts, nil
+}
+
+func (d *dbWrapper) setBroadcastRecipientFailed(broadcastID, contactPK, reason string) error {
+	if err := d.db.Model(&messengertypes.BroadcastRecipient{}).
+		Where("broadcast_id = ? AND contact_public_key = ?", broadcastID, contactPK).
+		Updates(map[string]interface{}{
+			"status": messengertypes.BroadcastRecipient_StatusFailed,
+			"error":  reason,
+		}).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	return d.getDeviceByPK(devicePK)
+	return nil
 }
 
-func (d *dbWrapper) updateContact(pk string, contact messengertypes.Contact) error {
-	if pk == "" {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no public key specified"))
+// markBroadcastRecipientSent gives the cid of its event to the pending copy of a broadcast sent to a conversation, a
+// copy already acknowledged in the backlog is marked as such. It returns the id of the broadcast, or an empty string
+// if the message isn't a broadcast copy
+func (d *dbWrapper) markBroadcastRecipientSent(convPK, hash, cid string) (string, error) {
+	if convPK == "" || hash == "" || cid == "" {
+		return "", nil
 	}
 
-	count := int64(0)
-	if err := d.db.Model(&messengertypes.Contact{}).Where(&messengertypes.Contact{PublicKey: pk}).Count(&count).Error; err != nil {
-		return err
+	recipient := &messengertypes.BroadcastRecipient{}
+	if err := d.db.
+		Where("conversation_public_key = ? AND message_hash = ? AND status = ?", convPK, hash, messengertypes.BroadcastRecipient_StatusPending).
+		First(recipient).
+		Error; err == gorm.ErrRecordNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", errcode.ErrDBRead.Wrap(err)
 	}
 
-	if count == 0 {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("contact not found"))
+	var acks int64
+	if err := d.db.Model(&messengertypes.Interaction{}).
+		Where("target_cid = ? AND type = ? AND is_me = ?", cid, messengertypes.AppMessage_TypeAcknowledge, false).
+		Count(&acks).
+		Error; err != nil {
+		return "", errcode.ErrDBRead.Wrap(err)
 	}
 
-	return d.db.Model(&messengertypes.Contact{PublicKey: pk}).Updates(&contact).Error
+	status := messengertypes.BroadcastRecipient_StatusSent
+	if acks > 0 {
+		status = messengertypes.BroadcastRecipient_StatusAcknowledged
+	}
+
+	if err := d.db.Model(&messengertypes.BroadcastRecipient{}).
+		Where("broadcast_id = ? AND contact_public_key = ?", recipient.GetBroadcastID(), recipient.GetContactPublicKey()).
+		Updates(map[string]interface{}{
+			"cid":    cid,
+			"status": status,
+		}).Error; err != nil {
+		return "", errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return recipient.GetBroadcastID(), nil
 }
 
-func (d *dbWrapper) addInteraction(rawInte messengertypes.Interaction) (*messengertypes.Interaction, bool, error) {
-	if rawInte.CID == "" {
-		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+// markBroadcastRecipientAcknowledged marks as acknowledged the broadcast copy of a cid, it returns the id of the
+// broadcast, or an empty string if the message isn't a broadcast copy
+func (d *dbWrapper) markBroadcastRecipientAcknowledged(cid string) (string, error) {
+	if cid == "" {
+		return "", nil
 	}
 
-	_, err := d.getInteractionByCID(rawInte.CID)
-	isNew := false
-	if err == gorm.ErrRecordNotFound {
-		if err := d.db.Create(&rawInte).Error; err != nil {
-			return nil, true, err
-		}
-		isNew = true
+	recipient := &messengertypes.BroadcastRecipient{}
+	if err := d.db.
+		Where("cid = ? AND status = ?", cid, messengertypes.BroadcastRecipient_StatusSent).
+		First(recipient).
+		Error; err == gorm.ErrRecordNotFound {
+		return "", nil
 	} else if err != nil {
-		return nil, false, err
+		return "", errcode.ErrDBRead.Wrap(err)
 	}
 
-	i, err := d.getInteractionByCID(rawInte.CID)
-	return i, isNew, err
+	if err := d.db.Model(&messengertypes.BroadcastRecipient{}).
+		Where("broadcast_id = ? AND contact_public_key = ?", recipient.GetBroadcastID(), recipient.GetContactPublicKey()).
+		Update("status", messengertypes.BroadcastRecipient_StatusAcknowledged).
+		Error; err != nil {
+		return "", errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return recipient.GetBroadcastID(), nil
 }
 
-func (d *dbWrapper) getReplyOptionsCIDForConversation(pk string) (string, error) {
+func (d *dbWrapper) setAccountMediaQuality(pk string, quality messengertypes.MediaProcessingPolicy_Quality) (*messengertypes.Account, error) {
 	if pk == "" {
-		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
 	}
 
-	cid := ""
+	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Update("media_quality", quality)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
+	}
 
-	if err := d.db.Model(&messengertypes.Interaction{}).
-		Raw(`SELECT cid
-			FROM interactions
-			WHERE conversation_public_key = ?
-			AND ROWID >
-				IFNULL ((
-					SELECT MAX(ROWID)
-					FROM interactions
-					WHERE conversation_public_key = ?
-					AND is_me = true
-				), 0)
-			AND is_me = false
-			AND type = ?
-			ORDER BY ROWID DESC
-			LIMIT 1
-		`, pk, pk, messengertypes.AppMessage_TypeReplyOptions).Scan(&cid).Error; err != nil {
-		return "", err
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("account not found"))
 	}
 
-	return cid, nil
+	return d.getAccount()
 }
 
-func (d *dbWrapper) attributeBacklogInteractions(devicePK, groupPK, memberPK string) ([]*messengertypes.Interaction, error) {
-	if devicePK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing device public key"))
+func (d *dbWrapper) setConversationMediaQuality(pk string, quality messengertypes.MediaProcessingPolicy_Quality) (*messengertypes.Conversation, error) {
+	if pk == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
 	}
 
-	if groupPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing conversation public key"))
+	tx := d.db.Model(&messengertypes.Conversation{}).Where(&messengertypes.Conversation{PublicKey: pk}).Update("media_quality", quality)
+	if tx.Error != nil {
+		return nil, errcode.ErrDBWrite.Wrap(tx.Error)
 	}
 
-	if memberPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing member public key"))
+	if tx.RowsAffected == 0 {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("conversation not found"))
 	}
 
-	var (
-		backlog []*messengertypes.Interaction
-		cids    []string
-	)
+	return d.getConversationByPK(pk)
+}
 
-	if err := d.tx(func(tx *dbWrapper) error {
-		res := tx.db.
-			Model(&messengertypes.Interaction{}).
-			Where("device_public_key = ? AND conversation_public_key = ? AND member_public_key = \"\"", devicePK, groupPK).
-			Order("sent_date asc")
+// getContactDuplicates returns the contacts whose key is stored in several encodings or which have several 1:1
+// conversations, ordered by key. The conversations already migrated are left out, as well as the conversations of an
+// unknown contact.
+func (d *dbWrapper) getContactDuplicates() ([]*messengertypes.ContactDuplicate, error) {
+	contacts, err := d.getAllContacts()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
 
-		if err := res.
-			Pluck("cid", &cids).
-			Error; err != nil {
-			return err
+	convs := []*messengertypes.Conversation(nil)
+	if err := d.db.
+		Where("type = ? AND COALESCE(contact_public_key, '') != '' AND COALESCE(migrated_to_public_key, '') = ''", messengertypes.Conversation_ContactType).
+		Order("last_update DESC, public_key").
+		Find(&convs).
+		Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	contactsByKey := map[string][]*messengertypes.Contact{}
+	keys := []string(nil)
+	for _, c := range contacts {
+		key := canonicalContactKey(c.GetPublicKey())
+		if _, ok := contactsByKey[key]; !ok {
+			keys = append(keys, key)
 		}
+		contactsByKey[key] = append(contactsByKey[key], c)
+	}
 
-		if len(cids) == 0 {
-			return nil
+	convsByKey := map[string][]*messengertypes.Conversation{}
+	for _, conv := range convs {
+		key := canonicalContactKey(conv.GetContactPublicKey())
+		convsByKey[key] = append(convsByKey[key], conv)
+	}
+
+	sort.Strings(keys)
+
+	duplicates := []*messengertypes.ContactDuplicate(nil)
+	for _, key := range keys {
+		keyContacts, keyConvs := contactsByKey[key], convsByKey[key]
+		if len(keyContacts) < 2 && len(keyConvs) < 2 {
+			continue
 		}
 
-		if err := res.Update("member_public_key", memberPK).Error; err != nil {
-			return err
+		kept := keptContact(key, keyContacts)
+		duplicate := &messengertypes.ContactDuplicate{PublicKey: key, ConversationPublicKey: kept.GetConversationPublicKey()}
+		for _, c := range keyContacts {
+			if c.GetPublicKey() != key {
+				duplicate.DuplicatePublicKeys = append(duplicate.DuplicatePublicKeys, c.GetPublicKey())
+			}
 		}
 
-		if err := tx.db.Preload(clause.Associations).Order("ROWID asc").Find(&backlog, cids).Error; err != nil {
-			return err
+		// the conversation of the kept record is kept, or else the most recently updated one
+		keptConv := false
+		for _, conv := range keyConvs {
+			keptConv = keptConv || conv.GetPublicKey() == duplicate.GetConversationPublicKey()
+		}
+		if !keptConv && len(keyConvs) > 0 {
+			duplicate.ConversationPublicKey = keyConvs[0].GetPublicKey()
 		}
 
-		return nil
-	}); err != nil {
-		return nil, err
+		for _, conv := range keyConvs {
+			if conv.GetPublicKey() != duplicate.GetConversationPublicKey() {
+				duplicate.DuplicateConversationPublicKeys = append(duplicate.DuplicateConversationPublicKeys, conv.GetPublicKey())
+			}
+		}
+
+		duplicates = append(duplicates, duplicate)
 	}
 
-	return backlog, nil
+	return duplicates, nil
 }
 
-func (d *dbWrapper) addMember(memberPK, groupPK, displayName, avatarCID string, isMe bool, isCreator bool) (*messengertypes.Member, error) {
-	if memberPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("member public key cannot be empty"))
+// mergeContactDuplicates merges the duplicates of a contact, or all the duplicate contacts when contactPK is empty, and
+// returns the ones merged
+func (d *dbWrapper) mergeContactDuplicates(contactPK string, date int64) ([]*messengertypes.ContactDuplicate, error) {
+	duplicates, err := d.getContactDuplicates()
+	if err != nil {
+		return nil, err
 	}
 
-	if groupPK == "" {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("conversation public key cannot be empty"))
-	}
+	merged := []*messengertypes.ContactDuplicate(nil)
+	for _, duplicate := range duplicates {
+		if contactPK != "" && duplicate.GetPublicKey() != canonicalContactKey(contactPK) {
+			continue
+		}
 
-	member := &messengertypes.Member{
-		PublicKey:             memberPK,
-		ConversationPublicKey: groupPK,
-		AvatarCID:             avatarCID,
-		IsCreator:             isCreator,
-		IsMe:                  isMe,
+		if err := d.mergeContactDuplicate(duplicate, date); err != nil {
+			return merged, err
+		}
+
+		merged = append(merged, duplicate)
 	}
 
-	if err := d.tx(func(tx *dbWrapper) error {
-		// Check if member already exists
-		if m, err := tx.getMemberByPK(memberPK, groupPK); err == nil {
-			member = m
-			return errcode.ErrDBEntryAlreadyExists
-		} else if err != nil && err != gorm.ErrRecordNotFound {
-			return err
+	return merged, nil
+}
+
+// mergeContactDuplicate consolidates the records of a duplicate contact under its canonical key and moves the
+// interactions of its other 1:1 conversations to the kept one
+func (d *dbWrapper) mergeContactDuplicate(duplicate *messengertypes.ContactDuplicate, date int64) error {
+	return d.tx(func(tx *dbWrapper) error {
+		pks := append([]string{duplicate.GetPublicKey()}, duplicate.GetDuplicatePublicKeys()...)
+		contacts := []*messengertypes.Contact(nil)
+		if err := tx.db.Where("public_key IN ?", pks).Find(&contacts).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
 		}
 
-		// Ensure a display name
-		if displayName == "" {
-			nameSuffix := "1337"
-			if len(memberPK) >= 4 {
-				nameSuffix = memberPK[:4]
+		if len(contacts) == 0 {
+			return errcode.ErrNotFound.Wrap(fmt.Errorf("the duplicate contact is not known anymore"))
+		}
+
+		kept := keptContact(duplicate.GetPublicKey(), contacts)
+		for _, c := range contacts {
+			if c != kept {
+				mergeContactRecord(kept, c)
 			}
-			displayName = "anon#" + nameSuffix
 		}
-		member.DisplayName = displayName
+		kept.PublicKey = duplicate.GetPublicKey()
+		kept.ConversationPublicKey = duplicate.GetConversationPublicKey()
 
-		return tx.db.Create(&member).Error
-	}); errcode.Is(err, errcode.ErrDBEntryAlreadyExists) {
-		return member, err
-	} else if err != nil {
-		return nil, err
+		if err := tx.db.Where("public_key IN ?", pks).Delete(&messengertypes.Contact{}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Create(kept).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		for _, pk := range duplicate.GetDuplicatePublicKeys() {
+			if err := tx.moveContactReferences(pk, duplicate.GetPublicKey()); err != nil {
+				return err
+			}
+		}
+
+		for _, convPK := range duplicate.GetDuplicateConversationPublicKeys() {
+			if err := tx.moveConversationInteractions(convPK, duplicate.GetConversationPublicKey(), date); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// moveContactReferences replaces the key of a contact in the rows referencing it
+func (d *dbWrapper) moveContactReferences(from, to string) error {
+	for _, ref := range contactReferences {
+		if ref.primaryKey {
+			exists := fmt.Sprintf("EXISTS (SELECT 1 FROM %[1]s AS kept WHERE kept.%[2]s = ?", ref.table, ref.column)
+			for _, key := range ref.keys {
+				exists += fmt.Sprintf(" AND kept.%[1]s = %[2]s.%[1]s", key, ref.table)
+			}
+			exists += ")"
+
+			if err := d.db.Where(ref.column+" = ?", from).Where(exists, to).Delete(ref.model).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+
+		if err := d.db.Model(ref.model).Where(ref.column+" = ?", from).Update(ref.column, to).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
 	}
 
-	return member, nil
+	return nil
 }
 
-func (d *dbWrapper) upsertMember(memberPK, groupPK string, m messengertypes.Member) (*messengertypes.Member, bool, error) {
-	if memberPK == "" {
-		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("member public key cannot be empty"))
-	}
-	if groupPK == "" {
-		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("conversation public key cannot be empty"))
+// moveConversationInteractions moves the interactions of a duplicate 1:1 conversation to the kept one, the duplicate is
+// marked as migrated to it
+func (d *dbWrapper) moveConversationInteractions(from, to string, date int64) error {
+	if from == "" || to == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key and a kept public key are required"))
 	}
 
-	isNew := false
-	em, err := d.getMemberByPK(memberPK, groupPK)
-	if err == gorm.ErrRecordNotFound {
-		isNew = true
-	} else if err != nil {
-		return nil, isNew, errcode.ErrDBRead.Wrap(err)
+	conv, err := d.getConversationByPK(from)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
 	}
 
-	if em.GetDisplayName() == "" && m.DisplayName == "" {
-		nameSuffix := "1337"
-		if len(memberPK) >= 4 {
-			nameSuffix = memberPK[:4]
+	for _, model := range []interface{}{&messengertypes.Interaction{}, &messengertypes.InteractionReaction{}} {
+		if err := d.db.Model(model).Where("conversation_public_key = ?", from).Update("conversation_public_key", to).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
 		}
-		m.DisplayName = "anon#" + nameSuffix
 	}
 
-	if isNew {
-		err := d.db.Create(&m).Error
-		if err != nil {
-			return nil, isNew, errcode.ErrDBWrite.Wrap(err)
-		}
-	} else {
-		err := d.db.Model(em).Updates(&m).Error
-		if err != nil {
-			return nil, false, errcode.ErrDBWrite.Wrap(err)
-		}
+	// the unread interactions are counted in the kept conversation
+	if err := d.db.Model(&messengertypes.Conversation{}).
+		Where("public_key = ?", to).
+		Updates(map[string]interface{}{
+			"unread_count": gorm.Expr("unread_count + ?", conv.GetUnreadCount()),
+			"last_update":  gorm.Expr("CASE WHEN last_update < ? THEN ? ELSE last_update END", conv.GetLastUpdate(), conv.GetLastUpdate()),
+		}).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	um, err := d.getMemberByPK(memberPK, groupPK)
-	if err != nil {
-		return nil, false, errcode.ErrDBRead.Wrap(err)
+	if err := d.db.Model(&messengertypes.Conversation{}).Where("public_key = ?", from).Update("unread_count", 0).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	return um, isNew, nil
+	_, _, err = d.setConversationMigration(from, to, "", date)
+	return err
 }
 
-func (d *dbWrapper) setConversationIsOpenStatus(conversationPK string, status bool) (*messengertypes.Conversation, bool, error) {
-	if conversationPK == "" {
-		return nil, false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+// getUnverifiedQuotes returns the replies quoting an interaction which haven't been checked against it
+func (d *dbWrapper) getUnverifiedQuotes(cid string) ([]*messengertypes.Interaction, error) {
+	replies := []*messengertypes.Interaction(nil)
+	if err := d.db.Where("quoted_cid = ? AND quote_state = ?", cid, messengertypes.Interaction_QuoteUnverified).Find(&replies).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	conversation, err := d.getConversationByPK(conversationPK)
-	if err != nil {
-		return nil, false, err
+	return replies, nil
+}
+
+func (d *dbWrapper) setInteractionQuoteState(cid string, state messengertypes.Interaction_QuoteState) error {
+	if err := d.db.Model(&messengertypes.Interaction{}).Where("cid = ?", cid).Update("quote_state", state).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	if conversation.IsOpen == status {
-		return conversation, false, nil
+	return nil
+}
+
+// addPendingContactRequest adds a request to the pending ones, created is false when it was already pending
+func (d *dbWrapper) addPendingContactRequest(request *messengertypes.PendingContactRequest) (bool, error) {
+	if request.GetContactPublicKey() == "" {
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a contact public key is required"))
 	}
 
-	conversation.IsOpen = status
-	values := map[string]interface{}{
-		"is_open": status,
+	res := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(request)
+	if res.Error != nil {
+		return false, errcode.ErrDBWrite.Wrap(res.Error)
 	}
 
-	if status {
-		conversation.UnreadCount = 0
-		values["unread_count"] = 0
+	return res.RowsAffected > 0, nil
+}
+
+// removePendingContactRequest removes a request once it is accepted or canceled, it returns the removed request, nil
+// when it wasn't pending
+func (d *dbWrapper) removePendingContactRequest(contactPK string) (*messengertypes.PendingContactRequest, error) {
+	request, err := d.getPendingContactRequest(contactPK)
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	if err := d.db.
-		Model(&messengertypes.Conversation{}).
-		Where(&messengertypes.Conversation{PublicKey: conversationPK}).
-		Updates(values).
-		Error; err != nil {
-		return nil, false, err
+	if err := d.db.Where(&messengertypes.PendingContactRequest{ContactPublicKey: contactPK}).Delete(&messengertypes.PendingContactRequest{}).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
 	}
 
-	return conversation, true, err
+	return request, nil
 }
 
-func (d *dbWrapper) isConversationOpened(conversationPK string) (bool, error) {
-	if conversationPK == "" {
-		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a conversation public key is required"))
+func (d *dbWrapper) getPendingContactRequest(contactPK string) (*messengertypes.PendingContactRequest, error) {
+	request := &messengertypes.PendingContactRequest{}
+	return request, d.db.Preload("Contact").First(request, &messengertypes.PendingContactRequest{ContactPublicKey: contactPK}).Error
+}
+
+// getPendingContactRequests returns a page of the pending requests, the most recent first
+func (d *dbWrapper) getPendingContactRequests(direction messengertypes.PendingContactRequest_Direction, includeIgnored bool, cursor *messengertypes.ContactRequestList_Cursor, count int) ([]*messengertypes.PendingContactRequest, error) {
+	query := d.db.Preload("Contact")
+	if direction != messengertypes.PendingContactRequest_DirectionUndefined {
+		query = query.Where("direction = ?", direction)
 	}
 
-	var ret int64
+	if !includeIgnored {
+		query = query.Where("is_ignored = ?", false)
+	}
 
-	err := d.db.
-		Model(&messengertypes.Conversation{}).
-		Where(&messengertypes.Conversation{PublicKey: conversationPK, IsOpen: true}).
-		Count(&ret).Error
+	if cursor != nil {
+		query = query.Where("(created_date < ? OR (created_date = ? AND contact_public_key < ?))", cursor.GetCreatedDate(), cursor.GetCreatedDate(), cursor.GetContactPublicKey())
+	}
 
-	return ret == 1, err
-}
+	requests := []*messengertypes.PendingContactRequest(nil)
+	if err := query.Order("created_date DESC, contact_public_key DESC").Limit(count).Find(&requests).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
 
-type dbLogWrapper struct {
-	logger.Interface
+	return requests, nil
 }
 
-func (d *dbLogWrapper) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
-	// Mute gorm.ErrRecordNotFound errors
-	if err == gorm.ErrRecordNotFound {
-		err = nil
+// countUnreadContactRequests returns the number of unread incoming requests which aren't ignored
+func (d *dbWrapper) countUnreadContactRequests() (int64, error) {
+	count := int64(0)
+	if err := d.db.Model(&messengertypes.PendingContactRequest{}).
+		Where("direction = ? AND is_read = ? AND is_ignored = ?", messengertypes.PendingContactRequest_DirectionIncoming, false, false).
+		Count(&count).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
 	}
 
-	d.Interface.Trace(ctx, begin, fc, err)
+	return count, nil
 }
 
-func (d *dbWrapper) addServiceToken(accountPK string, serviceToken *protocoltypes.ServiceToken) error {
-	if accountPK == "" {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an account public key is required"))
+// markContactRequestsRead marks incoming requests as read, all of them when all is set, it returns the updated ones
+func (d *dbWrapper) markContactRequestsRead(contactPKs []string, all bool) ([]string, error) {
+	if len(contactPKs) == 0 && !all {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of contact public keys is required"))
 	}
 
-	if len(serviceToken.SupportedServices) == 0 {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("no services specified"))
+	unread := func() *gorm.DB {
+		query := d.db.Model(&messengertypes.PendingContactRequest{}).Where("direction = ? AND is_read = ?", messengertypes.PendingContactRequest_DirectionIncoming, false)
+		if !all {
+			query = query.Where("contact_public_key IN ?", contactPKs)
+		}
+		return query
+	}
+
+	updated := []string(nil)
+	if err := unread().Pluck("contact_public_key", &updated).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(updated) == 0 {
+		return nil, nil
+	}
+
+	if err := d.db.Model(&messengertypes.PendingContactRequest{}).Where("contact_public_key IN ?", updated).Update("is_read", true).Error; err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return updated, nil
+}
+
+// ignorePendingContactRequests ignores incoming requests, their contacts are marked as ignored so they are kept as such
+// across the replays, it returns the ignored ones
+func (d *dbWrapper) ignorePendingContactRequests(contactPKs []string) ([]string, error) {
+	if len(contactPKs) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a list of contact public keys is required"))
 	}
 
+	ignored := []string(nil)
 	if err := d.tx(func(tx *dbWrapper) error {
-		for _, s := range serviceToken.SupportedServices {
-			res := tx.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&messengertypes.ServiceToken{
-				AccountPK:         accountPK,
-				TokenID:           serviceToken.TokenID(),
-				ServiceType:       s.ServiceType,
-				AuthenticationURL: serviceToken.AuthenticationURL,
-				Expiration:        serviceToken.Expiration,
-			})
+		if err := tx.db.Model(&messengertypes.PendingContactRequest{}).
+			Where("contact_public_key IN ? AND direction = ? AND is_ignored = ?", contactPKs, messengertypes.PendingContactRequest_DirectionIncoming, false).
+			Pluck("contact_public_key", &ignored).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
 
-			if err := res.Error; err != nil {
-				return errcode.ErrDBWrite.Wrap(err)
-			}
+		if len(ignored) == 0 {
+			return nil
+		}
+
+		if err := tx.db.Model(&messengertypes.PendingContactRequest{}).Where("contact_public_key IN ?", ignored).
+			Updates(map[string]interface{}{"is_ignored": true, "is_read": true}).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.db.Model(&messengertypes.Contact{}).Where("public_key IN ? AND state = ?", ignored, messengertypes.Contact_IncomingRequest).
+			Update("state", messengertypes.Contact_IncomingRequestIgnored).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
 		}
 
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return ignored, nil
 }
 
-func (d *dbWrapper) accountSetReplicationAutoEnable(pk string, enabled bool) error {
-	updates := map[string]interface{}{
-		"replicate_new_groups_automatically": enabled,
-	}
-
-	// db update
-	tx := d.db.Model(&messengertypes.Account{}).Where(&messengertypes.Account{PublicKey: pk}).Updates(updates)
-
-	if tx.Error != nil {
-		return tx.Error
+// backfillPendingContactRequests adds the requests of the contacts stored before the pending requests were, the
+// requests already pending are kept as is
+func (d *dbWrapper) backfillPendingContactRequests() error {
+	contacts := []*messengertypes.Contact(nil)
+	if err := d.db.Where("state IN ?", []messengertypes.Contact_State{
+		messengertypes.Contact_IncomingRequest,
+		messengertypes.Contact_IncomingRequestIgnored,
+		messengertypes.Contact_OutgoingRequestEnqueued,
+		messengertypes.Contact_OutgoingRequestSent,
+	}).Where("request_status <> ?", messengertypes.Contact_RequestCanceled).Find(&contacts).Error; err != nil {
+		return errcode.ErrDBRead.Wrap(err)
 	}
 
-	if tx.RowsAffected == 0 {
-		return errcode.ErrDBWrite.Wrap(fmt.Errorf("record not found"))
+	for _, contact := range contacts {
+		if _, err := d.addPendingContactRequest(pendingContactRequestFromContact(contact)); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (d *dbWrapper) saveConversationReplicationInfo(c messengertypes.ConversationReplicationInfo) error {
-	if c.CID == "" {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an interaction cid is required"))
+// upsertAccountDataExport stores the state of an export of the personal data
+func (d *dbWrapper) upsertAccountDataExport(export *messengertypes.AccountDataExport) error {
+	if export.GetID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an export id is required"))
 	}
 
-	tx := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(c)
-	if tx.Error != nil {
-		return errcode.ErrDBWrite.Wrap(tx.Error)
+	if err := d.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(export).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
 	return nil
 }
 
-func (d *dbWrapper) addMedias(medias []*messengertypes.Media) ([]bool, error) {
-	if len(medias) == 0 {
-		return []bool{}, nil
-	}
-	for _, m := range medias {
-		if err := ensureValidBase64CID(m.GetCID()); err != nil {
-			return nil, errcode.ErrInvalidInput.Wrap(err)
-		}
+func (d *dbWrapper) getAccountDataExport(id string) (*messengertypes.AccountDataExport, error) {
+	export := &messengertypes.AccountDataExport{}
+	if err := d.db.First(export, &messengertypes.AccountDataExport{ID: id}).Error; err != nil {
+		return nil, err
 	}
 
-	var dbMedias []*messengertypes.Media
-	cids := make([]string, len(medias))
-	for i, m := range medias {
-		cids[i] = m.GetCID()
+	return export, nil
+}
+
+// getAccountDataExports returns the exports of the personal data, the running ones only when running is set
+func (d *dbWrapper) getAccountDataExports(running bool) ([]*messengertypes.AccountDataExport, error) {
+	query := d.db.Order("created_date, id")
+	if running {
+		query = query.Where("state = ?", messengertypes.AccountDataExport_StateRunning)
 	}
-	err := d.db.Model(&messengertypes.Media{}).Where("cid IN ?", cids).Find(&dbMedias).Error
-	if err != nil {
+
+	exports := []*messengertypes.AccountDataExport(nil)
+	if err := query.Find(&exports).Error; err != nil {
 		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	willAdd := make([]bool, len(medias))
-	for i, m := range medias {
-		found := false
-		for _, n := range dbMedias {
-			if m.GetCID() == n.GetCID() {
-				found = true
-				break
-			}
-		}
-		if !found {
-			willAdd[i] = true
-		}
+	return exports, nil
+}
+
+// getAccountDataExportRows reads into rows the next count rows of a table ordered by key after the key after, the
+// whole table is read when key is empty
+func (d *dbWrapper) getAccountDataExportRows(rows interface{}, key string, after string, count int) error {
+	query := d.db
+	if key != "" {
+		query = query.Where(key+" > ?", after).Order(key).Limit(count)
 	}
 
-	if err := d.db.Clauses(clause.OnConflict{DoNothing: true}).Create(medias).Error; err != nil {
-		return nil, errcode.ErrDBWrite.Wrap(err)
+	if err := query.Find(rows).Error; err != nil {
+		return errcode.ErrDBRead.Wrap(err)
 	}
 
-	return willAdd, nil
+	return nil
 }
 
-func (d *dbWrapper) getMedias(cids []string) ([]*messengertypes.Media, error) {
-	if len(cids) == 0 {
-		return nil, nil
+// addReplaySkippedGroup records a group skipped by a replay, the attempts are added to the ones of the previous replays
+func (d *dbWrapper) addReplaySkippedGroup(group *messengertypes.ReplaySkippedGroup) error {
+	if group.GetGroupPK() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a group public key is required"))
 	}
-	for _, c := range cids {
-		if err := ensureValidBase64CID(c); err != nil {
-			return nil, errcode.ErrInvalidInput.Wrap(err)
-		}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "group_pk"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"attempts":     gorm.Expr("attempts + ?", group.GetAttempts()),
+			"error_code":   group.GetErrorCode(),
+			"error":        group.GetError(),
+			"skipped_date": group.GetSkippedDate(),
+		}),
+	}).Create(group).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
 
-	var dbMedias []*messengertypes.Media
-	err := d.db.Model(&messengertypes.Media{}).Where("cid IN ?", cids).Find(&dbMedias).Error
-	if err != nil {
+	return nil
+}
+
+func (d *dbWrapper) getReplaySkippedGroups() ([]*messengertypes.ReplaySkippedGroup, error) {
+	groups := []*messengertypes.ReplaySkippedGroup(nil)
+	if err := d.db.Order("skipped_date, group_pk").Find(&groups).Error; err != nil {
 		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
-	medias := make([]*messengertypes.Media, len(cids))
-	for i, cid := range cids {
-		medias[i] = &messengertypes.Media{CID: cid}
-		for _, dbMedia := range dbMedias {
-			if dbMedia.GetCID() == cid {
-				medias[i] = dbMedia
-			}
-		}
+	return groups, nil
+}
+
+func (d *dbWrapper) deleteReplaySkippedGroup(groupPK string) error {
+	if err := d.db.Delete(&messengertypes.ReplaySkippedGroup{}, "group_pk = ?", groupPK).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
 	}
-	return medias, nil
+
+	return nil
 }
 
-func (d *dbWrapper) getAllMedias() ([]*messengertypes.Media, error) {
-	var medias []*messengertypes.Media
-	err := d.db.Find(&medias).Error
-	if err != nil {
+// addQuarantinedEvent records a protocol event whose handling failed, the attempts are added to the ones of its
+// previous failures
+func (d *dbWrapper) addQuarantinedEvent(event *messengertypes.QuarantinedEvent) error {
+	if event.GetCID() == "" || event.GetGroupPK() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("an event cid and a group public key are required"))
+	}
+
+	if err := d.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "cid"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"attempts":         gorm.Expr("attempts + ?", event.GetAttempts()),
+			"error":            event.GetError(),
+			"panicked":         event.GetPanicked(),
+			"last_failed_date": event.GetLastFailedDate(),
+		}),
+	}).Create(event).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// getQuarantinedEvents returns the quarantined events of a group, or all of them when groupPK is empty, the most
+// recently failed first
+func (d *dbWrapper) getQuarantinedEvents(groupPK string) ([]*messengertypes.QuarantinedEvent, error) {
+	query := d.db
+	if groupPK != "" {
+		query = query.Where("group_pk = ?", groupPK)
+	}
+
+	events := []*messengertypes.QuarantinedEvent(nil)
+	if err := query.Order("last_failed_date DESC, cid").Find(&events).Error; err != nil {
 		return nil, errcode.ErrDBRead.Wrap(err)
 	}
-	return medias, nil
+
+	return events, nil
 }
 
-func (d *dbWrapper) getMemberPKFromDevicePK(dpk string) (string, error) {
-	var dev messengertypes.Device
-	err := d.db.Where("public_key = ?", dpk).First(&dev).Error
-	switch err {
-	case nil:
-		if len(dev.PublicKey) == 0 {
-			return "", errcode.ErrNotFound
-		}
-		return dev.PublicKey, nil
-	case gorm.ErrRecordNotFound:
-		return "", errcode.ErrNotFound
-	default:
-		return "", errcode.ErrDBRead.Wrap(err)
+// deleteResolvedQuarantinedEvents removes the quarantined events of a group which didn't fail again since a date, ie.
+// the start of a replay of the group
+func (d *dbWrapper) deleteResolvedQuarantinedEvents(groupPK string, since int64) error {
+	if err := d.db.Delete(&messengertypes.QuarantinedEvent{}, "group_pk = ? AND last_failed_date < ?", groupPK, since).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (d *dbWrapper) countQuarantinedEvents() (int64, error) {
+	var count int64
+	if err := d.db.Model(&messengertypes.QuarantinedEvent{}).Count(&count).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
 	}
+
+	return count, nil
 }
@@ -0,0 +1,185 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// dbMigration changes the schema or the content of the database in a way AutoMigrate can't do, ie. renaming a column
+// or transforming values, the new columns and tables are still created by AutoMigrate after the migrations
+type dbMigration struct {
+	version int64
+	name    string
+	up      func(tx *gorm.DB) error
+	down    func(tx *gorm.DB) error
+}
+
+// dbMigrations must be ordered by version, a migration must never be modified or removed once released, a new one
+// should be added instead
+var dbMigrations = []*dbMigration{
+	{
+		version: 1,
+		name:    "baseline",
+		up:      func(tx *gorm.DB) error { return nil },
+		down:    func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 2,
+		name:    "interactions lamport time",
+		// the lamport clocks of the existing interactions are only known from the logs
+		up:   func(tx *gorm.DB) error { return errDBRebuildRequired },
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 3,
+		name:    "interactions content flags",
+		up:      migrateInteractionContentFlags,
+		// the flags are ignored by the previous versions
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 4,
+		name:    "conversations member counts",
+		up:      migrateConversationMemberCounts,
+		// the counts are ignored by the previous versions
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 5,
+		name:    "conversations files index",
+		up:      migrateConversationFiles,
+		// the index is ignored by the previous versions
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 6,
+		name:    "interactions normalized dates",
+		up:      migrateInteractionNormalizedDates,
+		// the dates are ignored by the previous versions
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 7,
+		name:    "moderation log",
+		// the moderation messages and their positions in the group logs are only known from the logs
+		up:   func(tx *gorm.DB) error { return errDBRebuildRequired },
+		down: func(tx *gorm.DB) error { return nil },
+	},
+	{
+		version: 8,
+		name:    "poll ballots by member",
+		// the ballots were kept by device and only the close of the author device was kept
+		up:   func(tx *gorm.DB) error { return errDBRebuildRequired },
+		down: func(tx *gorm.DB) error { return nil },
+	},
+}
+
+func latestDBMigrationVersion(migrations []*dbMigration) int64 {
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].version
+}
+
+// getDBSchemaVersion returns the version of the last migration applied to the database, it is kept by the storage
+// backend so it is not lost when the tables are dropped
+func getDBSchemaVersion(db *gorm.DB) (int64, error) {
+	return getStorageBackend(db).getSchemaVersion(db)
+}
+
+func setDBSchemaVersion(db *gorm.DB, version int64) error {
+	return getStorageBackend(db).setSchemaVersion(db, version)
+}
+
+func hasDBTables(db *gorm.DB) (bool, error) {
+	tables, err := getStorageBackend(db).listTables(db)
+	if err != nil {
+		return false, err
+	}
+
+	return len(tables) > 0, nil
+}
+
+// applyDBMigrations brings the database to the latest version, a new database already has the latest schema and is
+// only marked as up to date
+func applyDBMigrations(db *gorm.DB, migrations []*dbMigration, logger *zap.Logger) error {
+	latest := latestDBMigrationVersion(migrations)
+
+	if hasTables, err := hasDBTables(db); err != nil {
+		return err
+	} else if !hasTables {
+		return setDBSchemaVersion(db, latest)
+	}
+
+	current, err := getDBSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	if current > latest {
+		// the database has been migrated by a more recent version, its down steps are unknown
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("unknown database schema version %d, latest known is %d", current, latest))
+	}
+
+	applied := []*dbMigration(nil)
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		logger.Info("applying database migration", zap.Int64("version", m.version), zap.String("name", m.name))
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.up(tx); err != nil {
+				return err
+			}
+
+			return setDBSchemaVersion(tx, m.version)
+		}); err != nil {
+			// the database is left at the version it had before, in case the rebuild fails too
+			if revertErr := revertDBMigrations(db, applied, current, logger); revertErr != nil {
+				logger.Error("unable to revert database migrations", zap.Error(revertErr))
+			}
+
+			return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to apply migration %d (%s): %w", m.version, m.name, err))
+		}
+
+		applied = append(applied, m)
+	}
+
+	return nil
+}
+
+// revertDBMigrations runs the down steps of the migrations more recent than version, from the most recent one
+func revertDBMigrations(db *gorm.DB, migrations []*dbMigration, version int64, logger *zap.Logger) error {
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= version {
+			continue
+		}
+
+		logger.Info("reverting database migration", zap.Int64("version", m.version), zap.String("name", m.name))
+
+		previous := version
+		if i > 0 && migrations[i-1].version > version {
+			previous = migrations[i-1].version
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+
+			return setDBSchemaVersion(tx, previous)
+		}); err != nil {
+			return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to revert migration %d (%s): %w", m.version, m.name, err))
+		}
+	}
+
+	return nil
+}
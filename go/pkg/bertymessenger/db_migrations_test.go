@@ -0,0 +1,129 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+type modelMigrationV1 struct {
+	ID   string `gorm:"primaryKey"`
+	Name string
+}
+
+func (modelMigrationV1) TableName() string { return "migration_items" }
+
+type modelMigrationV2 struct {
+	ID          string `gorm:"primaryKey"`
+	DisplayName string
+}
+
+func (modelMigrationV2) TableName() string { return "migration_items" }
+
+func testDBMigrations(failing bool) []*dbMigration {
+	return []*dbMigration{
+		{
+			version: 1,
+			name:    "baseline",
+			up:      func(tx *gorm.DB) error { return nil },
+			down:    func(tx *gorm.DB) error { return nil },
+		},
+		{
+			version: 2,
+			name:    "rename name to display_name",
+			up: func(tx *gorm.DB) error {
+				if failing {
+					return fmt.Errorf("failing migration")
+				}
+				return tx.Migrator().RenameColumn("migration_items", "name", "display_name")
+			},
+			down: func(tx *gorm.DB) error {
+				return tx.Migrator().RenameColumn("migration_items", "display_name", "name")
+			},
+		},
+	}
+}
+
+func Test_applyDBMigrations(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t, getInMemoryTestDBOptsNoInit)
+	defer dispose()
+
+	log := zap.NewNop()
+
+	// a new database is marked as up to date
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelMigrationV1{}}, testDBMigrations(false)[:1], noopReplayer, log))
+	version, err := getDBSchemaVersion(db.db)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+
+	require.NoError(t, db.db.Create(&modelMigrationV1{ID: "id_1", Name: "name_1"}).Error)
+
+	// the column is renamed in place, the content is kept
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelMigrationV2{}}, testDBMigrations(false), noopReplayer, log))
+	version, err = getDBSchemaVersion(db.db)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+
+	item := &modelMigrationV2{}
+	require.NoError(t, db.db.First(item, "id = ?", "id_1").Error)
+	require.Equal(t, "name_1", item.DisplayName)
+
+	// applying the migrations again does nothing
+	require.NoError(t, applyDBMigrations(db.db, testDBMigrations(true), log))
+
+	// the down steps are applied in reverse order
+	require.NoError(t, revertDBMigrations(db.db, testDBMigrations(false), 1, log))
+	version, err = getDBSchemaVersion(db.db)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+
+	itemV1 := &modelMigrationV1{}
+	require.NoError(t, db.db.First(itemV1, "id = ?", "id_1").Error)
+	require.Equal(t, "name_1", itemV1.Name)
+
+	// a database more recent than the known migrations can't be migrated
+	require.NoError(t, setDBSchemaVersion(db.db, 3))
+	require.Error(t, applyDBMigrations(db.db, testDBMigrations(false), log))
+}
+
+func Test_applyDBMigrations_fallbackToReplay(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t, getInMemoryTestDBOptsNoInit)
+	defer dispose()
+
+	log := zap.NewNop()
+
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelMigrationV1{}}, testDBMigrations(false)[:1], noopReplayer, log))
+	require.NoError(t, db.db.Create(&modelAccountV1{PublicKey: "pk_account_1", DisplayName: "user_display_name_1"}).Error)
+	require.NoError(t, db.db.Create(&modelMigrationV1{ID: "id_1", Name: "name_1"}).Error)
+
+	replayed := false
+	replayer := func(db *dbWrapper) error {
+		replayed = true
+
+		if err := db.db.Create(&modelAccountV1{PublicKey: "pk_account_1"}).Error; err != nil {
+			return err
+		}
+
+		return db.db.Create(&modelMigrationV2{ID: "id_1", DisplayName: "name_1"}).Error
+	}
+
+	// the failing migration is reverted and the database is rebuilt from the logs
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelMigrationV2{}}, testDBMigrations(true), replayer, log))
+	require.True(t, replayed)
+
+	version, err := getDBSchemaVersion(db.db)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+
+	item := &modelMigrationV2{}
+	require.NoError(t, db.db.First(item, "id = ?", "id_1").Error)
+	require.Equal(t, "name_1", item.DisplayName)
+
+	// the local state is restored after the replay
+	account := &modelAccountV1{}
+	require.NoError(t, db.db.First(account, "public_key = ?", "pk_account_1").Error)
+	require.Equal(t, "user_display_name_1", account.DisplayName)
+}
@@ -1,6 +1,8 @@
 package bertymessenger
 
 import (
+	"time"
+
 	"go.uber.org/zap"
 	"gorm.io/gorm"
 
@@ -15,7 +17,7 @@ func keepDisplayName(db *gorm.DB, logger *zap.Logger) string {
 	result := ""
 	count := int64(0)
 
-	if err := db.Table("accounts").Count(&count).Order("ROWID").Limit(1).Pluck("display_name", &result).Error; err == nil {
+	if err := db.Table("accounts").Count(&count).Order(getStorageBackend(db).insertionOrder()).Limit(1).Pluck("display_name", &result).Error; err == nil {
 		if count != 1 {
 			logger.Warn("expected one result", zap.Int64("count", count))
 		}
@@ -40,7 +42,7 @@ func keepAutoReplicateFlag(db *gorm.DB, logger *zap.Logger) bool {
 	result := int64(0)
 	count := int64(0)
 
-	if err := db.Table("accounts").Count(&count).Order("ROWID").Limit(1).Pluck("replicate_new_groups_automatically", &result).Error; err == nil {
+	if err := db.Table("accounts").Count(&count).Order(getStorageBackend(db).insertionOrder()).Limit(1).Pluck("replicate_new_groups_automatically", &result).Error; err == nil {
 		if count != 1 {
 			logger.Warn("expected one result", zap.Int64("count", count))
 		}
@@ -75,37 +77,843 @@ func keepConversationsLocalData(db *gorm.DB, logger *zap.Logger) []*messengertyp
 	return nil
 }
 
-func keepAccountStringField(db *gorm.DB, field string, logger *zap.Logger) string {
+func keepIgnoredContactRequests(db *gorm.DB, logger *zap.Logger) []string {
 	if logger == nil {
 		logger = zap.NewNop()
 	}
 
-	result := ""
-	count := int64(0)
+	result := []string(nil)
 
-	if err := db.Table("accounts").Count(&count).Order("ROWID").Limit(1).Pluck(field, &result).Error; err == nil {
-		if count != 1 {
-			logger.Warn("expected one result", zap.Int64("count", count))
-		}
+	err := db.Table("contacts").Where("state = ?", messengertypes.Contact_IncomingRequestIgnored).Pluck("public_key", &result).Error
 
-		if result != "" && count > 0 {
-			return result
-		}
-	} else {
-		logger.Warn("attempt at retrieving field failed", zap.String("field-name", field), zap.Error(err))
+	if err == nil {
+		return result
 	}
 
-	logger.Warn("nothing found returning an empty value")
+	logger.Warn("attempt at retrieving ignored contact requests", zap.Error(err))
 
-	return ""
+	return nil
+}
+
+func keepReadContactRequests(db *gorm.DB, logger *zap.Logger) []string {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []string(nil)
+
+	err := db.Table("pending_contact_requests").
+		Where("direction = ? AND is_read = ?", messengertypes.PendingContactRequest_DirectionIncoming, true).
+		Pluck("contact_public_key", &result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving read contact requests", zap.Error(err))
+
+	return nil
+}
+
+func keepBlockedMembers(db *gorm.DB, logger *zap.Logger) []string {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []string(nil)
+
+	err := db.Table("blocked_members").Pluck("public_key", &result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving blocked members", zap.Error(err))
+
+	return nil
+}
+
+func keepVerifiedContacts(db *gorm.DB, logger *zap.Logger) []*messengertypes.Contact {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Contact(nil)
+
+	err := db.Table("contacts").Where("verification_state != ?", messengertypes.Contact_VerificationNone).Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving verified contacts", zap.Error(err))
+
+	return nil
+}
+
+func keepPresenceHiddenContacts(db *gorm.DB, logger *zap.Logger) []string {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []string(nil)
+
+	err := db.Table("contacts").Where("presence_hidden = ?", true).Pluck("public_key", &result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving presence hidden contacts", zap.Error(err))
+
+	return nil
+}
+
+func keepNotificationPolicies(db *gorm.DB, logger *zap.Logger) []*messengertypes.NotificationPolicy {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.NotificationPolicy(nil)
+
+	err := db.Table("notification_policies").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving notification policies", zap.Error(err))
+
+	return nil
+}
+
+func keepImportedInteractions(db *gorm.DB, logger *zap.Logger) []*messengertypes.Interaction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Interaction(nil)
+
+	err := db.Table("interactions").Where("is_imported = ?", true).Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving imported interactions", zap.Error(err))
+
+	return nil
+}
+
+func keepSystemNotices(db *gorm.DB, logger *zap.Logger) []*messengertypes.Interaction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Interaction(nil)
+
+	err := db.Table("interactions").Where("type = ?", messengertypes.AppMessage_TypeSystemNotice).Order("lamport_time").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving system notices", zap.Error(err))
+
+	return nil
+}
+
+func keepSharedHistoryInteractions(db *gorm.DB, logger *zap.Logger) []*messengertypes.Interaction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Interaction(nil)
+
+	err := db.Table("interactions").Where("is_shared_history = ?", true).Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving shared history interactions", zap.Error(err))
+
+	return nil
+}
+
+func keepBotTokens(db *gorm.DB, logger *zap.Logger) []*messengertypes.BotToken {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.BotToken(nil)
+
+	err := db.Table("bot_tokens").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving bot tokens", zap.Error(err))
+
+	return nil
+}
+
+func keepBotWebhooks(db *gorm.DB, logger *zap.Logger) []*messengertypes.BotWebhook {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.BotWebhook(nil)
+
+	err := db.Table("bot_webhooks").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving bot webhooks", zap.Error(err))
+
+	return nil
+}
+
+func keepMatrixRooms(db *gorm.DB, logger *zap.Logger) []*messengertypes.MatrixRoom {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.MatrixRoom(nil)
+
+	err := db.Table("matrix_rooms").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving matrix rooms", zap.Error(err))
+
+	return nil
+}
+
+func keepMatrixGhosts(db *gorm.DB, logger *zap.Logger) []*messengertypes.MatrixGhost {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.MatrixGhost(nil)
+
+	err := db.Table("matrix_ghosts").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving matrix ghosts", zap.Error(err))
+
+	return nil
+}
+
+func keepMatrixEvents(db *gorm.DB, logger *zap.Logger) []*messengertypes.MatrixEvent {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.MatrixEvent(nil)
+
+	err := db.Table("matrix_events").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving matrix events", zap.Error(err))
+
+	return nil
+}
+
+func keepAbuseReports(db *gorm.DB, logger *zap.Logger) []*messengertypes.AbuseReport {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.AbuseReport(nil)
+
+	err := db.Table("abuse_reports").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving abuse reports", zap.Error(err))
+
+	return nil
+}
+
+func keepStarredInteractions(db *gorm.DB, logger *zap.Logger) []*messengertypes.StarredInteraction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.StarredInteraction(nil)
+
+	err := db.Table("starred_interactions").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving starred interactions", zap.Error(err))
+
+	return nil
+}
+
+func keepInteractionTags(db *gorm.DB, logger *zap.Logger) []*messengertypes.InteractionTag {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.InteractionTag(nil)
+
+	err := db.Table("interaction_tags").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving interaction tags", zap.Error(err))
+
+	return nil
+}
+
+func keepConversationFolders(db *gorm.DB, logger *zap.Logger) []*messengertypes.ConversationFolder {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.ConversationFolder(nil)
+
+	err := db.Table("conversation_folders").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving conversation folders", zap.Error(err))
+
+	return nil
+}
+
+func keepAutoReplies(db *gorm.DB, logger *zap.Logger) []*messengertypes.AutoReply {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.AutoReply(nil)
+
+	err := db.Table("auto_replies").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving auto-replies", zap.Error(err))
+
+	return nil
+}
+
+func keepContactNicknames(db *gorm.DB, logger *zap.Logger) []*messengertypes.Contact {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Contact(nil)
+
+	err := db.Table("contacts").Select("public_key, nickname, note").Where("nickname != ? OR note != ?", "", "").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving contact nicknames", zap.Error(err))
+
+	return nil
+}
+
+func keepMemberNicknames(db *gorm.DB, logger *zap.Logger) []*messengertypes.Member {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Member(nil)
+
+	err := db.Table("members").Select("public_key, conversation_public_key, nickname, note").Where("nickname != ? OR note != ?", "", "").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving member nicknames", zap.Error(err))
+
+	return nil
+}
+
+func keepContentFilters(db *gorm.DB, logger *zap.Logger) []*messengertypes.ContentFilter {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.ContentFilter(nil)
+
+	err := db.Table("content_filters").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving content filters", zap.Error(err))
+
+	return nil
+}
+
+func keepMutedMembers(db *gorm.DB, logger *zap.Logger) []*messengertypes.MutedMember {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.MutedMember(nil)
+
+	err := db.Table("muted_members").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving muted members", zap.Error(err))
+
+	return nil
+}
+
+func keepHiddenInteractions(db *gorm.DB, logger *zap.Logger) []*messengertypes.HiddenInteraction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.HiddenInteraction(nil)
+
+	err := db.Table("hidden_interactions").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving hidden interactions", zap.Error(err))
+
+	return nil
+}
+
+func keepOutgoingContactRequests(db *gorm.DB, logger *zap.Logger) []*messengertypes.OutgoingContactRequest {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.OutgoingContactRequest(nil)
+
+	err := db.Table("outgoing_contact_requests").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving outgoing contact requests", zap.Error(err))
+
+	return nil
+}
+
+func keepAudiences(db *gorm.DB, logger *zap.Logger) []*messengertypes.Audience {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Audience(nil)
+
+	err := db.Preload("Members").Find(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving audiences", zap.Error(err))
+
+	return nil
+}
+
+func keepBroadcasts(db *gorm.DB, logger *zap.Logger) []*messengertypes.Broadcast {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Broadcast(nil)
+
+	err := db.Preload("Recipients").Find(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving broadcasts", zap.Error(err))
+
+	return nil
+}
+
+func keepPushDeviceTokens(db *gorm.DB, logger *zap.Logger) []*messengertypes.PushDeviceToken {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.PushDeviceToken(nil)
+
+	err := db.Table("push_device_tokens").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving push device tokens", zap.Error(err))
+
+	return nil
+}
+
+func keepGroupInvitationLinks(db *gorm.DB, logger *zap.Logger) []*messengertypes.GroupInvitationLink {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.GroupInvitationLink(nil)
+
+	err := db.Table("group_invitation_links").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving group invitation links", zap.Error(err))
+
+	return nil
+}
+
+func keepMedias(db *gorm.DB, logger *zap.Logger) []*messengertypes.Media {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.Media(nil)
+
+	err := db.Table("medias").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving medias", zap.Error(err))
+
+	return nil
+}
+
+func keepRecoveryTrustees(db *gorm.DB, logger *zap.Logger) []*messengertypes.RecoveryTrustee {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.RecoveryTrustee(nil)
+
+	err := db.Table("recovery_trustees").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving recovery trustees", zap.Error(err))
+
+	return nil
+}
+
+func keepRecoveryShards(db *gorm.DB, logger *zap.Logger) []*messengertypes.RecoveryShard {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.RecoveryShard(nil)
+
+	err := db.Table("recovery_shards").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving recovery shards", zap.Error(err))
+
+	return nil
+}
+
+func keepScheduledAnnouncements(db *gorm.DB, logger *zap.Logger) []*messengertypes.ScheduledAnnouncement {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.ScheduledAnnouncement(nil)
+
+	err := db.Table("scheduled_announcements").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving scheduled announcements", zap.Error(err))
+
+	return nil
+}
+
+func keepOutboxMessages(db *gorm.DB, logger *zap.Logger) []*messengertypes.OutboxMessage {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.OutboxMessage(nil)
+
+	err := db.Table("outbox_messages").Order("position").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving outbox messages", zap.Error(err))
+
+	return nil
+}
+
+func keepAPITokens(db *gorm.DB, logger *zap.Logger) []*messengertypes.APIToken {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.APIToken(nil)
+
+	err := db.Table("api_tokens").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving api tokens", zap.Error(err))
+
+	return nil
+}
+
+func keepContactRequestAutoAccepts(db *gorm.DB, logger *zap.Logger) []*messengertypes.ContactRequestAutoAccept {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.ContactRequestAutoAccept(nil)
+
+	err := db.Table("contact_request_auto_accepts").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving contact request auto accepts", zap.Error(err))
+
+	return nil
+}
+
+func keepContactIntroductions(db *gorm.DB, logger *zap.Logger) []*messengertypes.ContactIntroduction {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.ContactIntroduction(nil)
+
+	err := db.Table("contact_introductions").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving contact introductions", zap.Error(err))
+
+	return nil
+}
+
+func keepMediaUploads(db *gorm.DB, logger *zap.Logger) []*messengertypes.MediaUpload {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.MediaUpload(nil)
+
+	err := db.Preload("Chunks").Find(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving media uploads", zap.Error(err))
+
+	return nil
+}
+
+func keepAccountDataExports(db *gorm.DB, logger *zap.Logger) []*messengertypes.AccountDataExport {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.AccountDataExport(nil)
+
+	err := db.Table("account_data_exports").Order("created_date").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving account data exports", zap.Error(err))
+
+	return nil
+}
+
+func keepDBSnapshots(db *gorm.DB, logger *zap.Logger) []*messengertypes.DBSnapshot {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := []*messengertypes.DBSnapshot(nil)
+
+	err := db.Table("db_snapshots").Order("created_date").Scan(&result).Error
+
+	if err == nil {
+		return result
+	}
+
+	logger.Warn("attempt at retrieving db snapshots", zap.Error(err))
+
+	return nil
+}
+
+func keepAccountStringField(db *gorm.DB, field string, logger *zap.Logger) string {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := ""
+	count := int64(0)
+
+	if err := db.Table("accounts").Count(&count).Order(getStorageBackend(db).insertionOrder()).Limit(1).Pluck(field, &result).Error; err == nil {
+		if count != 1 {
+			logger.Warn("expected one result", zap.Int64("count", count))
+		}
+
+		if result != "" && count > 0 {
+			return result
+		}
+	} else {
+		logger.Warn("attempt at retrieving field failed", zap.String("field-name", field), zap.Error(err))
+	}
+
+	logger.Warn("nothing found returning an empty value")
+
+	return ""
+}
+
+func keepAccountInt64Field(db *gorm.DB, field string, logger *zap.Logger) int64 {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	result := int64(0)
+	count := int64(0)
+
+	if err := db.Table("accounts").Count(&count).Order(getStorageBackend(db).insertionOrder()).Limit(1).Pluck(field, &result).Error; err == nil {
+		if count != 1 {
+			logger.Warn("expected one result", zap.Int64("count", count))
+		}
+
+		if count > 0 {
+			return result
+		}
+	} else {
+		logger.Warn("attempt at retrieving field failed", zap.String("field-name", field), zap.Error(err))
+	}
+
+	logger.Warn("nothing found returning a default value")
+
+	return 0
 }
 
 func keepDatabaseLocalState(db *gorm.DB, logger *zap.Logger) *messengertypes.LocalDatabaseState {
 	return &messengertypes.LocalDatabaseState{
-		PublicKey:               keepAccountStringField(db, "public_key", logger),
-		DisplayName:             keepDisplayName(db, logger),
-		ReplicateFlag:           keepAutoReplicateFlag(db, logger),
-		LocalConversationsState: keepConversationsLocalData(db, logger),
-		AccountLink:             keepAccountStringField(db, "link", logger),
+		PublicKey:                                keepAccountStringField(db, "public_key", logger),
+		DisplayName:                              keepDisplayName(db, logger),
+		ReplicateFlag:                            keepAutoReplicateFlag(db, logger),
+		LocalConversationsState:                  keepConversationsLocalData(db, logger),
+		AccountLink:                              keepAccountStringField(db, "link", logger),
+		MediaDownloadMode:                        messengertypes.MediaDownloadPolicy_Mode(keepAccountInt64Field(db, "media_download_mode", logger)),
+		MediaDownloadMaxSize:                     keepAccountInt64Field(db, "media_download_max_size", logger),
+		LinkPreviewsEnabled:                      keepAccountInt64Field(db, "link_previews_enabled", logger) != 0,
+		ContactRequestsMaxPerHour:                int32(keepAccountInt64Field(db, "contact_requests_max_per_hour", logger)),
+		ContactRequestsIgnoreWithoutIntro:        keepAccountInt64Field(db, "contact_requests_ignore_without_intro", logger) != 0,
+		IgnoredContactRequests:                   keepIgnoredContactRequests(db, logger),
+		BlockedMemberPublicKeys:                  keepBlockedMembers(db, logger),
+		GroupInvitationLinks:                     keepGroupInvitationLinks(db, logger),
+		PresenceEnabled:                          keepAccountInt64Field(db, "presence_enabled", logger) != 0,
+		PresenceHiddenContacts:                   keepPresenceHiddenContacts(db, logger),
+		PushDeviceTokens:                         keepPushDeviceTokens(db, logger),
+		Medias:                                   keepMedias(db, logger),
+		SnapshotDate:                             timestampMs(time.Now()),
+		RetentionMaxAge:                          keepAccountInt64Field(db, "retention_max_age", logger),
+		RetentionMaxMessages:                     keepAccountInt64Field(db, "retention_max_messages", logger),
+		RetentionMaxMediaSize:                    keepAccountInt64Field(db, "retention_max_media_size", logger),
+		NotificationPolicies:                     keepNotificationPolicies(db, logger),
+		ImportedInteractions:                     keepImportedInteractions(db, logger),
+		BotTokens:                                keepBotTokens(db, logger),
+		BotWebhooks:                              keepBotWebhooks(db, logger),
+		MatrixRooms:                              keepMatrixRooms(db, logger),
+		MatrixGhosts:                             keepMatrixGhosts(db, logger),
+		MatrixEvents:                             keepMatrixEvents(db, logger),
+		AbuseReports:                             keepAbuseReports(db, logger),
+		ContentFilters:                           keepContentFilters(db, logger),
+		VerifiedContacts:                         keepVerifiedContacts(db, logger),
+		StarredInteractions:                      keepStarredInteractions(db, logger),
+		ConversationFolders:                      keepConversationFolders(db, logger),
+		ConversationSortOrder:                    messengertypes.Account_ConversationSortOrder(keepAccountInt64Field(db, "conversation_sort_order", logger)),
+		InteractionOrder:                         messengertypes.Account_InteractionOrder(keepAccountInt64Field(db, "interaction_order", logger)),
+		SharedHistoryInteractions:                keepSharedHistoryInteractions(db, logger),
+		AutoReplies:                              keepAutoReplies(db, logger),
+		ContactNicknames:                         keepContactNicknames(db, logger),
+		MemberNicknames:                          keepMemberNicknames(db, logger),
+		ContactRequestsAutoAcceptMinSharedGroups: int32(keepAccountInt64Field(db, "contact_requests_auto_accept_min_shared_groups", logger)),
+		ContactRequestsAutoAcceptIntroduced:      keepAccountInt64Field(db, "contact_requests_auto_accept_introduced", logger) != 0,
+		MutedMembers:                             keepMutedMembers(db, logger),
+		SystemNotices:                            keepSystemNotices(db, logger),
+		OutgoingContactRequests:                  keepOutgoingContactRequests(db, logger),
+		Audiences:                                keepAudiences(db, logger),
+		Broadcasts:                               keepBroadcasts(db, logger),
+		MediaQuality:                             messengertypes.MediaProcessingPolicy_Quality(keepAccountInt64Field(db, "media_quality", logger)),
+		HiddenInteractions:                       keepHiddenInteractions(db, logger),
+		StatusText:                               keepAccountStringField(db, "status_text", logger),
+		LowStorageEnabled:                        keepAccountInt64Field(db, "low_storage_enabled", logger) != 0,
+		LowStorageMaxInteractions:                keepAccountInt64Field(db, "low_storage_max_interactions", logger),
+		ReadContactRequests:                      keepReadContactRequests(db, logger),
+		InteractionTags:                          keepInteractionTags(db, logger),
+		MediaPeerSharingEnabled:                  keepAccountInt64Field(db, "media_peer_sharing_enabled", logger) != 0,
+		RecoveryTrustees:                         keepRecoveryTrustees(db, logger),
+		RecoveryShards:                           keepRecoveryShards(db, logger),
+		ScheduledAnnouncements:                   keepScheduledAnnouncements(db, logger),
+		OutboxMessages:                           keepOutboxMessages(db, logger),
+		APITokens:                                keepAPITokens(db, logger),
+		ContactRequestAutoAccepts:                keepContactRequestAutoAccepts(db, logger),
+		ContactIntroductions:                     keepContactIntroductions(db, logger),
+		MediaUploads:                             keepMediaUploads(db, logger),
+		AccountDataExports:                       keepAccountDataExports(db, logger),
+		DBSnapshots:                              keepDBSnapshots(db, logger),
 	}
 }
@@ -138,3 +138,54 @@ func hasRecord(query *gorm.DB, logger *zap.Logger) bool {
 
 	return count == 1
 }
+
+func Test_keepDatabaseState_restoreOutbox(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("pk_1", ""))
+	for _, id := range []string{"msg_1", "msg_2", "msg_3"} {
+		require.NoError(t, db.addOutboxMessage(&messengertypes.OutboxMessage{ID: id, ConversationPublicKey: "conv_1"}))
+	}
+	require.NoError(t, db.moveOutboxMessage("msg_3", "msg_1"))
+
+	state := keepDatabaseLocalState(db.db, zap.NewNop())
+
+	require.NoError(t, dropAllTables(db.db))
+	require.NoError(t, db.db.AutoMigrate(getDBModels()...))
+	require.NoError(t, db.addAccount("pk_1", ""))
+	require.NoError(t, restoreDatabaseLocalState(db, state))
+
+	// the unsent messages are kept in their order
+	messages, err := db.getOutboxMessages()
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	require.Equal(t, "msg_3", messages[0].GetID())
+	require.Equal(t, "msg_1", messages[1].GetID())
+	require.Equal(t, "msg_2", messages[2].GetID())
+}
+
+func Test_keepDatabaseState_restoreDBSnapshots(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("pk_1", ""))
+	require.NoError(t, db.addDBSnapshot(&messengertypes.DBSnapshot{ID: "snapshot_1", CreatedDate: 10, Path: "snapshot_1.sqlite"}))
+	require.NoError(t, db.addDBSnapshot(&messengertypes.DBSnapshot{ID: "snapshot_2", CreatedDate: 20}))
+
+	state := keepDatabaseLocalState(db.db, zap.NewNop())
+
+	require.NoError(t, dropAllTables(db.db))
+	require.NoError(t, db.db.AutoMigrate(getDBModels()...))
+	require.NoError(t, db.addAccount("pk_1", ""))
+	require.NoError(t, restoreDatabaseLocalState(db, state))
+
+	// the lineage of the snapshots is kept
+	snapshots, err := db.getDBSnapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	require.Equal(t, "snapshot_2", snapshots[0].GetID())
+	require.Equal(t, "snapshot_1", snapshots[0].GetParentID())
+	require.Equal(t, "snapshot_1.sqlite", snapshots[1].GetPath())
+	require.Empty(t, snapshots[1].GetParentID())
+}
@@ -212,12 +212,12 @@ func Test_dbWrapper_addContactRequestIncomingReceived(t *testing.T) {
 
 	defer dispose()
 
-	contactErr, err := db.addContactRequestIncomingReceived("", "some name", "")
+	contactErr, err := db.addContactRequestIncomingReceived("", "some name", "", nil, false)
 	require.Error(t, err)
 	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
 	require.Nil(t, contactErr)
 
-	contact, err := db.addContactRequestIncomingReceived(contact1PK, contact1Name, "")
+	contact, err := db.addContactRequestIncomingReceived(contact1PK, contact1Name, "", nil, false)
 	require.NoError(t, err)
 	require.NotEmpty(t, contact)
 	require.Equal(t, contact1PK, contact.PublicKey)
@@ -225,12 +225,23 @@ func Test_dbWrapper_addContactRequestIncomingReceived(t *testing.T) {
 
 	createdDate := contact.CreatedDate
 
-	contact, err = db.addContactRequestIncomingReceived(contact1PK, "contact1OtherName", "")
+	contact, err = db.addContactRequestIncomingReceived(contact1PK, "contact1OtherName", "", nil, false)
 	require.True(t, errcode.Is(err, errcode.ErrDBEntryAlreadyExists))
 	require.NotEmpty(t, contact)
 	require.Equal(t, contact1PK, contact.PublicKey)
 	require.Equal(t, contact1Name, contact.DisplayName)
 	require.Equal(t, createdDate, contact.CreatedDate)
+
+	contact, err = db.addContactRequestIncomingReceived("contactPK2", "contactName2", "", &messengertypes.ContactMetadata{IntroMessage: "hello", Avatar: []byte{1}, AvatarMimeType: "image/png"}, true)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Contact_IncomingRequestIgnored, contact.State)
+	require.Equal(t, "hello", contact.IntroMessage)
+	require.Equal(t, []byte{1}, contact.IntroAvatar)
+	require.Equal(t, "image/png", contact.IntroAvatarMimeType)
+
+	count, err := db.countContactRequestsIncomingSince(0)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
 }
 
 func Test_dbWrapper_addContactRequestIncomingAccepted(t *testing.T) {
@@ -1059,7 +1070,7 @@ func Test_dbWrapper_getDBInfo(t *testing.T) {
 	tables := []string(nil)
 	err = db.db.Raw("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'").Scan(&tables).Error
 	require.NoError(t, err)
-	require.Equal(t, 9, len(tables))
+	require.Equal(t, 71, len(tables))
 }
 
 func Test_dbWrapper_getMemberByPK(t *testing.T) {
@@ -1541,3 +1552,215 @@ func Test_dbWrapper_getMedias_mix(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, testMedias, medias)
 }
+
+func Test_dbWrapper_setAccountLinkPreviewsEnabled(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setAccountLinkPreviewsEnabled("", true)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = db.setAccountLinkPreviewsEnabled("pk_1", true)
+	require.Error(t, err)
+
+	db.db.Create(&messengertypes.Account{PublicKey: "pk_1"})
+
+	acc, err := db.setAccountLinkPreviewsEnabled("pk_1", true)
+	require.NoError(t, err)
+	require.True(t, acc.LinkPreviewsEnabled)
+
+	acc, err = db.setAccountLinkPreviewsEnabled("pk_1", false)
+	require.NoError(t, err)
+	require.False(t, acc.LinkPreviewsEnabled)
+}
+
+func Test_dbWrapper_setContactPresenceHidden(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setContactPresenceHidden("", true)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = db.setContactPresenceHidden("pk_1", true)
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	db.db.Create(&messengertypes.Contact{PublicKey: "pk_1"})
+
+	contact, err := db.setContactPresenceHidden("pk_1", true)
+	require.NoError(t, err)
+	require.True(t, contact.PresenceHidden)
+
+	contact, err = db.setContactPresenceHidden("pk_1", false)
+	require.NoError(t, err)
+	require.False(t, contact.PresenceHidden)
+}
+
+func Test_dbWrapper_setMemberBlocked(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setMemberBlocked("", true)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_contact", Type: messengertypes.Conversation_ContactType, ContactPublicKey: "contact_1"})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_contact"})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_contact", IsMe: true})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_group", MemberPublicKey: "contact_1"})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_4", ConversationPublicKey: "conv_group", MemberPublicKey: "member_2"})
+
+	interactions, err := db.setMemberBlocked("contact_1", true)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	for _, i := range interactions {
+		require.True(t, i.IsSenderBlocked)
+	}
+
+	blocked, err := db.isMemberBlocked("contact_1")
+	require.NoError(t, err)
+	require.True(t, blocked)
+
+	blocked, err = db.isConversationContactBlocked("conv_contact")
+	require.NoError(t, err)
+	require.True(t, blocked)
+
+	blocked, err = db.isInteractionSenderBlocked(&messengertypes.Interaction{ConversationPublicKey: "conv_group", MemberPublicKey: "member_2"})
+	require.NoError(t, err)
+	require.False(t, blocked)
+
+	// the acks of a group are skipped for a blocked member, even before the member of the device is known
+	blocked, err = db.isAckTargetBlocked("conv_group", "contact_1", "")
+	require.NoError(t, err)
+	require.True(t, blocked)
+
+	blocked, err = db.isAckTargetBlocked("conv_group", "", "device_unknown")
+	require.NoError(t, err)
+	require.False(t, blocked)
+
+	db.db.Create(&messengertypes.Device{PublicKey: "device_1", MemberPublicKey: "contact_1"})
+	blocked, err = db.isAckTargetBlocked("conv_group", "", "device_1")
+	require.NoError(t, err)
+	require.True(t, blocked)
+
+	blocked, err = db.isAckTargetBlocked("conv_group", "member_2", "")
+	require.NoError(t, err)
+	require.False(t, blocked)
+
+	members, err := db.getBlockedMembers()
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+
+	interactions, err = db.setMemberBlocked("contact_1", false)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+
+	blocked, err = db.isMemberBlocked("contact_1")
+	require.NoError(t, err)
+	require.False(t, blocked)
+}
+
+func Test_dbWrapper_memberProfileHistory(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{ConversationPublicKey: "conv_1", MemberPublicKey: "member_1"}))
+	require.Error(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{CID: "cid_1", MemberPublicKey: "member_1"}))
+
+	// changes are received out of order
+	require.NoError(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{CID: "cid_2", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", DisplayName: "name_2", SentDate: 20}))
+	require.NoError(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", DisplayName: "name_1", SentDate: 10}))
+	require.NoError(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{CID: "cid_3", ConversationPublicKey: "conv_1", MemberPublicKey: "member_2", DisplayName: "other", SentDate: 15}))
+
+	// replaying the same change is a no-op
+	require.NoError(t, db.addMemberProfileChange(&messengertypes.MemberProfileChange{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", DisplayName: "name_1", SentDate: 10}))
+
+	_, err := db.getMemberProfileHistory("conv_1", "")
+	require.Error(t, err)
+
+	changes, err := db.getMemberProfileHistory("conv_1", "member_1")
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	require.Equal(t, "name_1", changes[0].DisplayName)
+	require.Equal(t, "name_2", changes[1].DisplayName)
+}
+
+func Test_dbWrapper_processedEvents(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	processed, err := db.isEventProcessed("", "hash_1")
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+	require.False(t, processed)
+
+	require.True(t, errcode.Is(db.markEventProcessed("", "conv_1", "hash_1", 10), errcode.ErrInvalidInput))
+
+	processed, err = db.isEventProcessed("cid_1", "hash_1")
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash_1", 10))
+
+	processed, err = db.isEventProcessed("cid_1", "hash_1")
+	require.NoError(t, err)
+	require.True(t, processed)
+
+	processed, err = db.isEventProcessed("cid_1", "hash_2")
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	// the entry is replaced when the event is handled again
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash_2", 20))
+
+	processed, err = db.isEventProcessed("cid_1", "hash_1")
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	processed, err = db.isEventProcessed("cid_1", "hash_2")
+	require.NoError(t, err)
+	require.True(t, processed)
+}
+
+func Test_dbWrapper_getInteractionsByExtension(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for idx, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", LamportTime: 1, Extensions: []*messengertypes.InteractionExtension{{InteractionCID: "cid_1", Key: "bridge.id", ConversationPublicKey: "conv_1", Value: []byte("1")}}},
+		{CID: "cid_2", ConversationPublicKey: "conv_2", LamportTime: 2, Extensions: []*messengertypes.InteractionExtension{{InteractionCID: "cid_2", Key: "bridge.id", ConversationPublicKey: "conv_2", Value: []byte("2")}}},
+		{CID: "cid_3", ConversationPublicKey: "conv_1", LamportTime: 3, Extensions: []*messengertypes.InteractionExtension{{InteractionCID: "cid_3", Key: "format", ConversationPublicKey: "conv_1"}}},
+		{CID: "cid_4", ConversationPublicKey: "conv_1", LamportTime: 4},
+	} {
+		_, isNew, err := db.addInteraction(*i)
+		require.NoError(t, err, idx)
+		require.True(t, isNew)
+	}
+
+	_, err := db.getInteractionsByExtension("", "", nil, 10)
+	require.Error(t, err)
+
+	interactions, err := db.getInteractionsByExtension("bridge.id", "", nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.Equal(t, "cid_2", interactions[0].GetCID())
+	require.Equal(t, map[string][]byte{"bridge.id": []byte("2")}, interactions[0].ExtensionsMap())
+
+	interactions, err = db.getInteractionsByExtension("bridge.id", "", &messengertypes.InteractionList_Cursor{LamportTime: 2, CID: "cid_2"}, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+
+	interactions, err = db.getInteractionsByExtension("bridge.id", "conv_1", nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+
+	// the extensions are deleted with their interaction
+	require.NoError(t, db.deleteInteractions([]string{"cid_1"}))
+
+	interactions, err = db.getInteractionsByExtension("bridge.id", "", nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+
+	count, err := db.dbModelRowsCount(messengertypes.InteractionExtension{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), count)
+}
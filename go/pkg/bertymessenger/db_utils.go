@@ -39,9 +39,9 @@ func ensureSeamlessDBUpdate(db *gorm.DB, models []interface{}) error {
 }
 
 func dropAllTables(db *gorm.DB) error {
-	tables := []string(nil)
-	if err := db.Raw("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'").Scan(&tables).Error; err != nil {
-		return errcode.ErrDBRead.Wrap(err)
+	tables, err := getStorageBackend(db).listTables(db)
+	if err != nil {
+		return err
 	}
 
 	for _, table := range tables {
@@ -103,6 +103,71 @@ func compareDBSchema(dbA map[string][]*ColumnInfo, dbB map[string][]*ColumnInfo)
 	return errs
 }
 
+// restoreReplayLocalState must be called before replaying the logs, so the events of the blocked members are ignored
+// and the uses of the invitation links are counted again
+func restoreReplayLocalState(db *dbWrapper, state *messengertypes.LocalDatabaseState) error {
+	if state == nil {
+		return nil
+	}
+
+	for _, pk := range state.BlockedMemberPublicKeys {
+		if _, err := db.setMemberBlocked(pk, true); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore blocked member: %w", err))
+		}
+	}
+
+	for _, invitation := range state.GroupInvitationLinks {
+		invitation.Uses = nil
+		if err := db.addGroupInvitationLink(invitation); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore group invitation link: %w", err))
+		}
+	}
+
+	// the muted members are restored before the replay so their replayed messages are hidden again
+	for _, member := range state.MutedMembers {
+		if err := db.addMutedMember(member); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore muted member: %w", err))
+		}
+	}
+
+	// the hidden interactions are restored before the replay so the replayed interactions are hidden again
+	for _, hidden := range state.HiddenInteractions {
+		if err := db.addHiddenInteraction(hidden); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore hidden interaction: %w", err))
+		}
+	}
+
+	// the outgoing requests are restored before the replay so the replayed contacts get their request status again
+	for _, req := range state.OutgoingContactRequests {
+		if err := db.upsertOutgoingContactRequest(req); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore outgoing contact request: %w", err))
+		}
+	}
+
+	// the filters are restored before the replay so the replayed messages are filtered again
+	for _, filter := range state.ContentFilters {
+		if err := db.addContentFilter(filter); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore content filter: %w", err))
+		}
+	}
+
+	// the starred messages are restored before the replay so the older changes synced by the other devices are ignored
+	for _, star := range state.StarredInteractions {
+		if _, err := db.setStarredInteraction(star); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore starred interaction: %w", err))
+		}
+	}
+
+	// the tags are restored before the replay so the older changes synced by the other devices are ignored
+	for _, tag := range state.InteractionTags {
+		if _, err := db.setInteractionTag(tag); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore interaction tag: %w", err))
+		}
+	}
+
+	return nil
+}
+
 func restoreDatabaseLocalState(db *dbWrapper, state *messengertypes.LocalDatabaseState) error {
 	if state == nil {
 		return nil
@@ -111,24 +176,291 @@ func restoreDatabaseLocalState(db *dbWrapper, state *messengertypes.LocalDatabas
 	if res := db.db.
 		Table("accounts").
 		Where("public_key", state.PublicKey).
-		Updates(map[string]interface{}{
-			"display_name":                       state.DisplayName,
-			"link":                               state.AccountLink,
-			"replicate_new_groups_automatically": state.ReplicateFlag,
-		}); res.Error != nil {
+		Updates(existingColumns(db.db, "accounts", map[string]interface{}{
+			"display_name":                                   state.DisplayName,
+			"link":                                           state.AccountLink,
+			"replicate_new_groups_automatically":             state.ReplicateFlag,
+			"media_download_mode":                            state.MediaDownloadMode,
+			"media_download_max_size":                        state.MediaDownloadMaxSize,
+			"link_previews_enabled":                          state.LinkPreviewsEnabled,
+			"contact_requests_max_per_hour":                  state.ContactRequestsMaxPerHour,
+			"contact_requests_ignore_without_intro":          state.ContactRequestsIgnoreWithoutIntro,
+			"presence_enabled":                               state.PresenceEnabled,
+			"retention_max_age":                              state.RetentionMaxAge,
+			"retention_max_messages":                         state.RetentionMaxMessages,
+			"retention_max_media_size":                       state.RetentionMaxMediaSize,
+			"conversation_sort_order":                        state.ConversationSortOrder,
+			"interaction_order":                              state.InteractionOrder,
+			"contact_requests_auto_accept_min_shared_groups": state.ContactRequestsAutoAcceptMinSharedGroups,
+			"contact_requests_auto_accept_introduced":        state.ContactRequestsAutoAcceptIntroduced,
+			"media_quality":                                  state.MediaQuality,
+			"status_text":                                    state.StatusText,
+			"low_storage_enabled":                            state.LowStorageEnabled,
+			"low_storage_max_interactions":                   state.LowStorageMaxInteractions,
+			"media_peer_sharing_enabled":                     state.MediaPeerSharingEnabled,
+		})); res.Error != nil {
 		return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update account: %w", res.Error))
 	} else if res.RowsAffected == 0 {
 		return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update account: account not found"))
 	}
 
+	if len(state.IgnoredContactRequests) > 0 {
+		if res := db.db.
+			Table("contacts").
+			Where("public_key IN ? AND state = ?", state.IgnoredContactRequests, messengertypes.Contact_IncomingRequest).
+			Update("state", messengertypes.Contact_IncomingRequestIgnored); res.Error != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update contacts: %w", res.Error))
+		}
+
+		if res := db.db.
+			Table("pending_contact_requests").
+			Where("contact_public_key IN ?", state.IgnoredContactRequests).
+			Updates(map[string]interface{}{"is_ignored": true, "is_read": true}); res.Error != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update contact requests: %w", res.Error))
+		}
+	}
+
+	if len(state.ReadContactRequests) > 0 {
+		if res := db.db.
+			Table("pending_contact_requests").
+			Where("contact_public_key IN ?", state.ReadContactRequests).
+			Update("is_read", true); res.Error != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update contact requests: %w", res.Error))
+		}
+	}
+
+	if len(state.PresenceHiddenContacts) > 0 {
+		if res := db.db.
+			Table("contacts").
+			Where("public_key IN ?", state.PresenceHiddenContacts).
+			Update("presence_hidden", true); res.Error != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update contacts: %w", res.Error))
+		}
+	}
+
+	// the devices added while the database was rebuilt are compared with the verified ones
+	for _, contact := range state.VerifiedContacts {
+		verificationState := contact.GetVerificationState()
+
+		devices, err := db.getDevicesByMember(contact.GetPublicKey())
+		if err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore contact verification: %w", err))
+		}
+
+		if contactDevicesHash(contact.GetPublicKey(), devices) != contact.GetVerifiedDevicesHash() {
+			verificationState = messengertypes.Contact_VerificationKeyChanged
+		}
+
+		if _, err := db.setContactVerification(contact.GetPublicKey(), verificationState, contact.GetVerifiedDevicesHash(), contact.GetVerifiedDate()); err != nil && !errcode.Is(err, errcode.ErrNotFound) {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore contact verification: %w", err))
+		}
+	}
+
+	for _, token := range state.PushDeviceTokens {
+		if err := db.addPushDeviceToken(token, ""); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore push device token: %w", err))
+		}
+	}
+
+	if _, err := db.addImportedInteractions(state.ImportedInteractions); err != nil {
+		return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore imported interactions: %w", err))
+	}
+
+	if _, err := db.addImportedInteractions(state.SharedHistoryInteractions); err != nil {
+		return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore shared history interactions: %w", err))
+	}
+
+	// the account conversation is local, it isn't replayed from the logs
+	if len(state.SystemNotices) > 0 {
+		if err := db.addAccountConversation(state.PublicKey, state.SystemNotices[0].GetSentDate()); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore account conversation: %w", err))
+		}
+
+		if _, err := db.addImportedInteractions(state.SystemNotices); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore system notices: %w", err))
+		}
+	}
+
+	for _, token := range state.BotTokens {
+		if err := db.addBotToken(token); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore bot token: %w", err))
+		}
+	}
+
+	for _, webhook := range state.BotWebhooks {
+		if err := db.addBotWebhook(webhook); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore bot webhook: %w", err))
+		}
+	}
+
+	for _, room := range state.MatrixRooms {
+		if err := db.addMatrixRoom(room); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore matrix room: %w", err))
+		}
+	}
+
+	for _, ghost := range state.MatrixGhosts {
+		if err := db.addMatrixGhost(ghost); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore matrix ghost: %w", err))
+		}
+	}
+
+	for _, evt := range state.MatrixEvents {
+		if _, err := db.addMatrixEvent(evt); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore matrix event: %w", err))
+		}
+	}
+
+	for _, report := range state.AbuseReports {
+		if _, err := db.addAbuseReport(report); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore abuse report: %w", err))
+		}
+	}
+
+	for _, folder := range state.ConversationFolders {
+		if err := db.addConversationFolder(folder); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore conversation folder: %w", err))
+		}
+	}
+
+	for _, audience := range state.Audiences {
+		if err := db.addAudience(audience); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore audience: %w", err))
+		}
+	}
+
+	// the broadcasts are restored with the delivery status they had, the acks already handled are not replayed on them
+	for _, broadcast := range state.Broadcasts {
+		if err := db.addBroadcast(broadcast); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore broadcast: %w", err))
+		}
+	}
+
+	// the trustees are only known by the device which set up the recovery
+	for _, trustee := range state.RecoveryTrustees {
+		if _, err := db.addRecoveryTrustee(trustee); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore recovery trustee: %w", err))
+		}
+	}
+
+	// the shards of a setup already replayed are kept as is
+	for _, shard := range state.RecoveryShards {
+		if _, err := db.addRecoveryShard(shard); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore recovery shard: %w", err))
+		}
+	}
+
+	// the announcements not published yet are local until their publish date
+	for _, announcement := range state.ScheduledAnnouncements {
+		if err := db.addScheduledAnnouncement(announcement); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore scheduled announcement: %w", err))
+		}
+	}
+
+	// the outbox is restored in its order, the messages are sent once the node is online
+	for _, message := range state.OutboxMessages {
+		if err := db.addOutboxMessage(message); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore outbox message: %w", err))
+		}
+	}
+
+	// the api tokens are restored so the clients using them are still authorized after a rebuild
+	for _, token := range state.APITokens {
+		if err := db.addAPIToken(token); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore api token: %w", err))
+		}
+	}
+
+	// the auto accepted contact requests are restored so the rule that accepted them is still shown
+	for _, accept := range state.ContactRequestAutoAccepts {
+		if err := db.addContactRequestAutoAccept(accept); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore contact request auto accept: %w", err))
+		}
+	}
+
+	// the introductions are rebuilt by the replay, the ones of the events left out of its window are restored
+	for _, introduction := range state.ContactIntroductions {
+		if _, err := db.addContactIntroduction(introduction); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore contact introduction: %w", err))
+		}
+	}
+
+	// the uploads are restored with their stored chunks so the interrupted ones are resumed from the last chunk
+	for _, upload := range state.MediaUploads {
+		if err := db.addMediaUpload(upload); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore media upload: %w", err))
+		}
+	}
+
+	// the exports are restored so the interrupted ones are resumed from their last written row
+	for _, export := range state.AccountDataExports {
+		if err := db.upsertAccountDataExport(export); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore account data export: %w", err))
+		}
+	}
+
+	// the snapshots are restored from the oldest so their lineage is recorded again, their copies are still on disk
+	for _, snapshot := range state.DBSnapshots {
+		if err := db.addDBSnapshot(snapshot); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore db snapshot: %w", err))
+		}
+	}
+
+	// the nicknames are restored on the contacts and the members rebuilt by the replay, the others are dropped
+	for _, contact := range state.ContactNicknames {
+		if _, err := db.setContactNickname(contact.GetPublicKey(), contact.GetNickname(), contact.GetNote()); err != nil && !errcode.Is(err, errcode.ErrNotFound) {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore contact nickname: %w", err))
+		}
+	}
+
+	for _, member := range state.MemberNicknames {
+		if _, err := db.setMemberNickname(member.GetPublicKey(), member.GetConversationPublicKey(), member.GetNickname(), member.GetNote()); err != nil && !errcode.Is(err, errcode.ErrNotFound) {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore member nickname: %w", err))
+		}
+	}
+
+	for _, rule := range state.AutoReplies {
+		if err := db.setAutoReply(rule); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore auto-reply: %w", err))
+		}
+	}
+
+	for _, policy := range state.NotificationPolicies {
+		if err := db.setNotificationPolicy(policy); err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore notification policy: %w", err))
+		}
+	}
+
+	if err := restoreMediasIndex(db, state.Medias); err != nil {
+		return err
+	}
+
 	for _, c := range state.LocalConversationsState {
+		unreadCount, err := countUnreadSince(db, c.PublicKey, state.SnapshotDate)
+		if err != nil {
+			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to count unread interactions: %w", err))
+		}
+
 		if res := db.db.
 			Table("conversations").
 			Where("public_key", c.PublicKey).
-			Updates(map[string]interface{}{
-				"is_open":      c.IsOpen,
-				"unread_count": c.UnreadCount,
-			}); res.Error != nil {
+			Updates(existingColumns(db.db, "conversations", map[string]interface{}{
+				"is_open":                 c.IsOpen,
+				"unread_count":            c.UnreadCount + int32(unreadCount),
+				"media_download_mode":     c.MediaDownloadMode,
+				"media_download_max_size": c.MediaDownloadMaxSize,
+				"push_muted":              c.PushMuted,
+				"pruned_before":           c.PrunedBefore,
+				"read_until":              c.ReadUntil,
+				"folder_id":               c.FolderID,
+				"pinned_position":         c.PinnedPosition,
+				"history_sharing_window":  c.HistorySharingWindow,
+				"local_retention_set":     c.LocalRetentionSet,
+				"local_retention_max_age": c.LocalRetentionMaxAge,
+				"is_paused":               c.IsPaused,
+				"media_quality":           c.MediaQuality,
+				"is_observer":             c.IsObserver,
+			})); res.Error != nil {
 			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update conversation: %w", res.Error))
 		} else if res.RowsAffected == 0 {
 			return errcode.ErrInternal.Wrap(fmt.Errorf("unable to update conversation: conversation not found"))
@@ -138,6 +470,55 @@ func restoreDatabaseLocalState(db *dbWrapper, state *messengertypes.LocalDatabas
 	return nil
 }
 
+// existingColumns drops the values of the columns missing from a table, the local state is restored on the schema of
+// the models given to getUpdatedDB which may not have all of them
+func existingColumns(db *gorm.DB, table string, values map[string]interface{}) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(values))
+	for column, value := range values {
+		if db.Migrator().HasColumn(table, column) {
+			filtered[column] = value
+		}
+	}
+
+	return filtered
+}
+
+// restoreMediasIndex adds the medias missing after the replay, their content has to be downloaded again
+func restoreMediasIndex(db *dbWrapper, medias []*messengertypes.Media) error {
+	missing := []*messengertypes.Media(nil)
+	for _, m := range medias {
+		if ensureValidBase64CID(m.GetCID()) != nil {
+			continue
+		}
+
+		m.State = messengertypes.Media_StateNeverDownloaded
+		missing = append(missing, m)
+	}
+
+	if _, err := db.addMedias(missing); err != nil {
+		return errcode.ErrInternal.Wrap(fmt.Errorf("unable to restore medias: %w", err))
+	}
+
+	return nil
+}
+
+// countUnreadSince counts the messages received in a conversation after a snapshot, they have been replayed from the
+// logs but are not part of the unread count of the snapshot
+func countUnreadSince(db *dbWrapper, conversationPK string, snapshotDate int64) (int64, error) {
+	if snapshotDate == 0 || !db.db.Migrator().HasTable("interactions") {
+		return 0, nil
+	}
+
+	count := int64(0)
+	err := db.db.
+		Model(&messengertypes.Interaction{}).
+		Where("conversation_public_key = ? AND is_me = ? AND is_sender_blocked = ? AND is_member_muted = ? AND type = ? AND sent_date > ?", conversationPK, false, false, false, messengertypes.AppMessage_TypeUserMessage, snapshotDate).
+		Count(&count).
+		Error
+
+	return count, err
+}
+
 func getDBTablesSchemas(db *gorm.DB) (map[string][]*ColumnInfo, error) {
 	type NameSQL struct {
 		Name string
@@ -131,27 +131,27 @@ func Test_ensureSeamlessDBUpdate(t *testing.T) {
 	}
 
 	// Case 1 : Model created, no mig
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelConversationV1{}}, noopReplayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV1{}, &modelConversationV1{}}, nil, noopReplayer, log))
 	require.NoError(t, initialPlay(db))
 	hasExpectedValues(db.db)
 
 	// Case 2 : Model added
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV2{}, &modelConversationV2{}, &modelInteractionV2{}}, replayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV2{}, &modelConversationV2{}, &modelInteractionV2{}}, nil, replayer, log))
 	hasExpectedValues(db.db)
 
 	// Case 3 : Model removed
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV3{}, &modelConversationV3{}}, replayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV3{}, &modelConversationV3{}}, nil, replayer, log))
 	hasExpectedValues(db.db)
 
 	// Case 4 : Field added
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV4{}, &modelConversationV4{}}, replayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV4{}, &modelConversationV4{}}, nil, replayer, log))
 	hasExpectedValues(db.db)
 
 	// Case 5 : Field removed
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV5{}, &modelConversationV5{}}, replayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV5{}, &modelConversationV5{}}, nil, replayer, log))
 	hasExpectedValues(db.db)
 
 	// Case 6 : Introduce some conflict
-	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV6{}, &modelConversationV6{}}, replayer, log))
+	require.NoError(t, db.getUpdatedDB([]interface{}{&modelAccountV6{}, &modelConversationV6{}}, nil, replayer, log))
 	hasExpectedValues(db.db)
 }
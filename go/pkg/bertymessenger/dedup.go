@@ -0,0 +1,157 @@
+package bertymessenger
+
+import (
+	"container/list"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// eventDedupCacheSize is the number of recently handled events kept in memory
+const eventDedupCacheSize = 4096
+
+// eventDedupCache is a rolling window of the recently handled events in front of the ledger of the processed events,
+// the duplicate deliveries of the overlapping subscriptions and of the reconnections are dropped without reading the
+// database, and an event delivered again while it is being handled is dropped instead of being handled twice. The
+// cache is warmed from the ledger on start so the window is kept across the restarts.
+type eventDedupCache struct {
+	mu       sync.Mutex
+	size     int
+	order    *list.List
+	entries  map[string]*list.Element
+	inFlight map[string]struct{}
+	stats    messengertypes.SystemInfo_Dedup
+}
+
+func newEventDedupCache(size int) *eventDedupCache {
+	return &eventDedupCache{
+		size:     size,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+		inFlight: map[string]struct{}{},
+	}
+}
+
+func eventDedupKey(cid, hash string) string {
+	return cid + "/" + hash
+}
+
+// claim returns false if the event is a duplicate, the caller must release a claimed event once handled
+func (c *eventDedupCache) claim(key string) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		c.stats.CacheHits++
+		return false
+	}
+
+	if _, ok := c.inFlight[key]; ok {
+		c.stats.ConcurrentHits++
+		return false
+	}
+
+	c.inFlight[key] = struct{}{}
+	c.stats.Misses++
+	return true
+}
+
+// release ends the handling of a claimed event, it is added to the cache if it has been processed, otherwise it can
+// be delivered again, ie. when it has been deferred or refused
+func (c *eventDedupCache) release(key string, processed bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inFlight, key)
+	if processed {
+		c.add(key)
+	}
+}
+
+// ledgerHit records a duplicate found in the ledger, the event is added to the cache
+func (c *eventDedupCache) ledgerHit(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.LedgerHits++
+	c.add(key)
+}
+
+// forget removes an event from the cache so it can be handled again
+func (c *eventDedupCache) forget(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// add inserts an event in the cache and evicts the least recently seen one when the cache is full, the mutex must be
+// held
+func (c *eventDedupCache) add(key string) {
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(key)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(string))
+	}
+}
+
+// warm fills the cache with the most recent events of the ledger
+func (c *eventDedupCache) warm(db *dbWrapper) error {
+	if c == nil {
+		return nil
+	}
+
+	events, err := db.getRecentProcessedEvents(c.size)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the events are the most recent first, the most recent ones are the last evicted
+	for i := len(events) - 1; i >= 0; i-- {
+		c.add(eventDedupKey(events[i].GetCID(), events[i].GetResultHash()))
+	}
+
+	return nil
+}
+
+func (c *eventDedupCache) snapshot() *messengertypes.SystemInfo_Dedup {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.CacheSize = int64(c.order.Len())
+	return &stats
+}
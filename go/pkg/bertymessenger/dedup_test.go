@@ -0,0 +1,63 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventDedupCache(t *testing.T) {
+	c := newEventDedupCache(2)
+
+	require.True(t, c.claim("event_1"))
+	// delivered again while it is handled
+	require.False(t, c.claim("event_1"))
+	c.release("event_1", true)
+	require.False(t, c.claim("event_1"))
+
+	// an event which is not processed can be delivered again
+	require.True(t, c.claim("event_2"))
+	c.release("event_2", false)
+	require.True(t, c.claim("event_2"))
+	c.release("event_2", true)
+
+	// the least recently seen event is evicted
+	require.False(t, c.claim("event_1"))
+	c.ledgerHit("event_3")
+	require.False(t, c.claim("event_1"))
+	require.True(t, c.claim("event_2"))
+	c.release("event_2", false)
+
+	stats := c.snapshot()
+	require.Equal(t, int64(3), stats.GetCacheHits())
+	require.Equal(t, int64(1), stats.GetConcurrentHits())
+	require.Equal(t, int64(1), stats.GetLedgerHits())
+	require.Equal(t, int64(4), stats.GetMisses())
+	require.Equal(t, int64(2), stats.GetCacheSize())
+
+	// a handler without a cache never drops an event
+	var none *eventDedupCache
+	require.True(t, none.claim("event_1"))
+	none.release("event_1", true)
+	require.True(t, none.claim("event_1"))
+}
+
+func TestEventDedupCache_warm(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash_1", 1000))
+	require.NoError(t, db.markEventProcessed("cid_2", "conv_1", "hash_2", 3000))
+	require.NoError(t, db.markEventProcessed("cid_3", "conv_1", "hash_3", 2000))
+
+	// only the most recent events fit in the cache
+	c := newEventDedupCache(2)
+	require.NoError(t, c.warm(db))
+
+	require.False(t, c.claim(eventDedupKey("cid_2", "hash_2")))
+	require.False(t, c.claim(eventDedupKey("cid_3", "hash_3")))
+	require.True(t, c.claim(eventDedupKey("cid_1", "hash_1")))
+	require.True(t, c.claim(eventDedupKey("cid_2", "hash_other")))
+
+	require.Equal(t, int64(2), c.snapshot().GetCacheSize())
+}
@@ -0,0 +1,146 @@
+package bertymessenger
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+
+	"berty.tech/berty/v2/go/internal/tracer"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// messengerTracerName is the name of the tracer of the spans started by the messenger
+const messengerTracerName = "berty.messenger"
+
+// deliveryLatencySamples is the number of the most recent latencies kept for each conversation
+const deliveryLatencySamples = 256
+
+// The spans of a message share a trace ID from the sending device to the receiving ones: the send span started by
+// Interact is propagated to the protocol by the gRPC interceptors, the protocol injects it in the headers of the
+// message, and the handling of the message on the receiving devices continues the trace from these headers. The
+// spans are exported out of the device, so the conversations are only referenced by the hash used in the logs.
+
+// messengerTracer returns the tracer of the service, the events handled without a service are not traced
+func (svc *service) messengerTracer() trace.Tracer {
+	if svc == nil || svc.tracer == nil {
+		return trace.NoopTracer{}
+	}
+
+	return svc.tracer
+}
+
+// startSendSpan starts the span of the sending of a message, the span context is passed to the protocol with ctx
+func (svc *service) startSendSpan(ctx context.Context, convPK string, amType messengertypes.AppMessage_Type) (context.Context, trace.Span) {
+	return svc.messengerTracer().Start(ctx, "Send Message", trace.WithAttributes(
+		kv.String("group-hash", hashIdentifier(convPK)),
+		kv.String("app-message-type", amType.String()),
+	))
+}
+
+// startHandleSpan starts the span of the handling of a received message, it continues the trace of its sender
+func (h *eventHandler) startHandleSpan(gpk string, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage) (context.Context, trace.Span) {
+	return tracer.ChildSpanFromMessageHeaders(h.ctx, h.svc.messengerTracer(), gme.GetHeaders(), "Handle App Message",
+		kv.String("group-hash", hashIdentifier(gpk)),
+		kv.String("cid", eventCID(gme.GetEventContext())),
+		kv.String("app-message-type", am.GetType().String()),
+		kv.Bool("replay", h.replay),
+	)
+}
+
+// recordDeliveryLatency measures the time between the sending of a message and its handling, the clocks of the
+// devices are not synchronized so the negative latencies are counted as null
+func (h *eventHandler) recordDeliveryLatency(span trace.Span, i *messengertypes.Interaction, now time.Time) {
+	if h.svc == nil || h.svc.deliveryLatencies == nil || h.replay || i.GetIsMe() || i.GetSentDate() == 0 {
+		return
+	}
+
+	latency := timestampMs(now) - i.GetSentDate()
+	if latency < 0 {
+		latency = 0
+	}
+
+	span.SetAttributes(kv.Int64("delivery-latency-ms", latency))
+	h.svc.deliveryLatencies.record(i.GetConversationPublicKey(), latency)
+}
+
+// deliveryLatencies keeps the last delivery latencies of each conversation since the messenger started
+type deliveryLatencies struct {
+	mu    sync.Mutex
+	size  int
+	convs map[string]*latencySamples
+}
+
+type latencySamples struct {
+	values []int64
+	next   int
+}
+
+func newDeliveryLatencies(size int) *deliveryLatencies {
+	return &deliveryLatencies{size: size, convs: map[string]*latencySamples{}}
+}
+
+func (d *deliveryLatencies) record(convPK string, latency int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	samples, ok := d.convs[convPK]
+	if !ok {
+		samples = &latencySamples{}
+		d.convs[convPK] = samples
+	}
+
+	// the oldest sample is replaced once the buffer is full
+	if len(samples.values) < d.size {
+		samples.values = append(samples.values, latency)
+	} else {
+		samples.values[samples.next] = latency
+	}
+	samples.next = (samples.next + 1) % d.size
+}
+
+// snapshot returns the latency percentiles of the conversations, the slowest first
+func (d *deliveryLatencies) snapshot() []*messengertypes.SystemInfo_DeliveryLatency {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	latencies := []*messengertypes.SystemInfo_DeliveryLatency(nil)
+	for convPK, samples := range d.convs {
+		sorted := append([]int64(nil), samples.values...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		latencies = append(latencies, &messengertypes.SystemInfo_DeliveryLatency{
+			ConversationPublicKey: convPK,
+			Samples:               int64(len(sorted)),
+			P50Ms:                 percentile(sorted, 50),
+			P95Ms:                 percentile(sorted, 95),
+		})
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		if latencies[i].GetP95Ms() != latencies[j].GetP95Ms() {
+			return latencies[i].GetP95Ms() > latencies[j].GetP95Ms()
+		}
+		return latencies[i].GetConversationPublicKey() < latencies[j].GetConversationPublicKey()
+	})
+
+	return latencies
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,73 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_percentile(t *testing.T) {
+	require.Equal(t, int64(0), percentile(nil, 50))
+	require.Equal(t, int64(7), percentile([]int64{7}, 95))
+
+	values := make([]int64, 100)
+	for idx := range values {
+		values[idx] = int64(idx + 1)
+	}
+	require.Equal(t, int64(50), percentile(values, 50))
+	require.Equal(t, int64(95), percentile(values, 95))
+}
+
+func Test_deliveryLatencies(t *testing.T) {
+	latencies := newDeliveryLatencies(4)
+	require.Empty(t, latencies.snapshot())
+
+	for _, latency := range []int64{10, 20, 30, 40} {
+		latencies.record("conv_fast", latency)
+	}
+	latencies.record("conv_slow", 500)
+
+	// the oldest samples are replaced once the buffer is full
+	latencies.record("conv_fast", 1)
+	latencies.record("conv_fast", 2)
+
+	snapshot := latencies.snapshot()
+	require.Len(t, snapshot, 2)
+	require.Equal(t, "conv_slow", snapshot[0].GetConversationPublicKey())
+	require.Equal(t, int64(500), snapshot[0].GetP50Ms())
+
+	require.Equal(t, "conv_fast", snapshot[1].GetConversationPublicKey())
+	require.Equal(t, int64(4), snapshot[1].GetSamples())
+	require.Equal(t, int64(2), snapshot[1].GetP50Ms())
+	require.Equal(t, int64(40), snapshot[1].GetP95Ms())
+}
+
+func Test_eventHandler_recordDeliveryLatency(t *testing.T) {
+	svc := &service{deliveryLatencies: newDeliveryLatencies(deliveryLatencySamples)}
+	now := time.Now()
+	received := &messengertypes.Interaction{ConversationPublicKey: "conv_1", SentDate: timestampMs(now.Add(-time.Second))}
+
+	// the replayed messages and the messages of the account are not measured
+	newEventHandler(context.Background(), nil, nil, zap.NewNop(), svc, true).recordDeliveryLatency(trace.NoopSpan{}, received, now)
+	sent := &messengertypes.Interaction{ConversationPublicKey: "conv_1", SentDate: timestampMs(now), IsMe: true}
+	h := newEventHandler(context.Background(), nil, nil, zap.NewNop(), svc, false)
+	h.recordDeliveryLatency(trace.NoopSpan{}, sent, now)
+	require.Empty(t, svc.deliveryLatencies.snapshot())
+
+	h.recordDeliveryLatency(trace.NoopSpan{}, received, now)
+
+	// the clock of the sender is ahead
+	h.recordDeliveryLatency(trace.NoopSpan{}, &messengertypes.Interaction{ConversationPublicKey: "conv_1", SentDate: timestampMs(now.Add(time.Minute))}, now)
+
+	snapshot := svc.deliveryLatencies.snapshot()
+	require.Len(t, snapshot, 1)
+	require.Equal(t, int64(2), snapshot[0].GetSamples())
+	require.Equal(t, int64(0), snapshot[0].GetP50Ms())
+	require.Equal(t, int64(1000), snapshot[0].GetP95Ms())
+}
@@ -0,0 +1,68 @@
+package bertymessenger
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The app messages sent by this node describe its device as given in the options, so the interactions can be
+// attributed to a device of their sender, ie. sent from a phone, and the echoes between the devices of an account can be
+// followed. The device description is announced by the device itself, it is only informative: the device public key of
+// the event is the one which is verified.
+
+// deviceInfoMaxNameLength bounds the name of a device, in runes
+const deviceInfoMaxNameLength = 64
+
+// sanitizeDeviceInfo returns a device description with a known kind and a bounded single line name, nil if it
+// describes nothing
+func sanitizeDeviceInfo(info *messengertypes.DeviceInfo) *messengertypes.DeviceInfo {
+	if info == nil {
+		return nil
+	}
+
+	kind := info.GetKind()
+	if _, ok := messengertypes.DeviceInfo_Kind_name[int32(kind)]; !ok {
+		kind = messengertypes.DeviceInfo_KindUnknown
+	}
+
+	name := strings.Join(strings.Fields(strings.ToValidUTF8(info.GetName(), "")), " ")
+	if utf8.RuneCountInString(name) > deviceInfoMaxNameLength {
+		name = string([]rune(name)[:deviceInfoMaxNameLength])
+	}
+
+	if kind == messengertypes.DeviceInfo_KindUnknown && name == "" {
+		return nil
+	}
+
+	return &messengertypes.DeviceInfo{Kind: kind, Name: name}
+}
+
+// stampAppMessageDevice adds the description of this device to an app message, the messages already describing their
+// device are returned as they are so the payload of a message doesn't change once its local echo is stored
+func (svc *service) stampAppMessageDevice(payload []byte) ([]byte, error) {
+	if svc.deviceInfo == nil {
+		return payload, nil
+	}
+
+	var am messengertypes.AppMessage
+	if err := proto.Unmarshal(payload, &am); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if am.GetDevice() != nil {
+		return payload, nil
+	}
+
+	am.Device = svc.deviceInfo
+	stamped, err := proto.Marshal(&am)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	return stamped, nil
+}
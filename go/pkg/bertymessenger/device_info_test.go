@@ -0,0 +1,81 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_sanitizeDeviceInfo(t *testing.T) {
+	require.Nil(t, sanitizeDeviceInfo(nil))
+	require.Nil(t, sanitizeDeviceInfo(&messengertypes.DeviceInfo{Name: " \n "}))
+	require.Nil(t, sanitizeDeviceInfo(&messengertypes.DeviceInfo{Kind: 42}))
+
+	info := sanitizeDeviceInfo(&messengertypes.DeviceInfo{Kind: messengertypes.DeviceInfo_KindPhone, Name: " my\nphone "})
+	require.Equal(t, messengertypes.DeviceInfo_KindPhone, info.GetKind())
+	require.Equal(t, "my phone", info.GetName())
+
+	info = sanitizeDeviceInfo(&messengertypes.DeviceInfo{Name: strings.Repeat("é", deviceInfoMaxNameLength+1)})
+	require.Equal(t, strings.Repeat("é", deviceInfoMaxNameLength), info.GetName())
+}
+
+func Test_stampAppMessageDevice(t *testing.T) {
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(1000, nil, &messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	// nothing is added without a device description
+	stamped, err := (&service{}).stampAppMessageDevice(payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, stamped)
+
+	svc := &service{deviceInfo: &messengertypes.DeviceInfo{Kind: messengertypes.DeviceInfo_KindDesktop, Name: "laptop"}}
+	stamped, err = svc.stampAppMessageDevice(payload)
+	require.NoError(t, err)
+
+	var am messengertypes.AppMessage
+	require.NoError(t, proto.Unmarshal(stamped, &am))
+	require.Equal(t, messengertypes.DeviceInfo_KindDesktop, am.GetDevice().GetKind())
+	require.Equal(t, "laptop", am.GetDevice().GetName())
+	require.Equal(t, int64(1000), am.GetSentDate())
+
+	// a message already describing its device is unchanged, ie. sent from the outbox after its local echo
+	again, err := svc.stampAppMessageDevice(stamped)
+	require.NoError(t, err)
+	require.Equal(t, stamped, again)
+}
+
+func TestDeviceInfoUpdate(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.addDevice("device_1", "member_1")
+	require.NoError(t, err)
+
+	phone := &messengertypes.DeviceInfo{Kind: messengertypes.DeviceInfo_KindPhone, Name: "phone"}
+	device, err := db.setDeviceInfo("device_1", phone, 1000)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.DeviceInfo_KindPhone, device.GetKind())
+	require.Equal(t, "phone", device.GetName())
+
+	// the same description and the older ones don't update the device
+	device, err = db.setDeviceInfo("device_1", phone, 2000)
+	require.NoError(t, err)
+	require.Nil(t, device)
+
+	device, err = db.setDeviceInfo("device_1", &messengertypes.DeviceInfo{Kind: messengertypes.DeviceInfo_KindTablet}, 500)
+	require.NoError(t, err)
+	require.Nil(t, device)
+
+	device, err = db.setDeviceInfo("device_1", &messengertypes.DeviceInfo{Kind: messengertypes.DeviceInfo_KindTablet, Name: "tablet"}, 3000)
+	require.NoError(t, err)
+	require.Equal(t, "tablet", device.GetName())
+	require.Equal(t, int64(3000), device.GetInfoDate())
+
+	device, err = db.setDeviceInfo("device_unknown", phone, 4000)
+	require.NoError(t, err)
+	require.Nil(t, device)
+}
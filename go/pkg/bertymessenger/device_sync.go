@@ -0,0 +1,318 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// isDeviceSyncMessage checks that a device sync message has been sent in the account group by another device of the account,
+// only the devices of the account are members of this group
+func (h *eventHandler) isDeviceSyncMessage(tx *dbWrapper, i *messengertypes.Interaction) (bool, error) {
+	if i.GetIsMe() {
+		return false, nil
+	}
+
+	acc, err := tx.getAccount()
+	if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return i.GetConversationPublicKey() == acc.GetPublicKey(), nil
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncSnapshot(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncSnapshot)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync snapshot sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyDeviceSyncSnapshot(tx, payload); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+// applyDeviceSyncSnapshot merges the items of a snapshot with the local state
+func (h *eventHandler) applyDeviceSyncSnapshot(tx *dbWrapper, snapshot *messengertypes.AppMessage_DeviceSyncSnapshot) error {
+	for _, conv := range snapshot.GetConversations() {
+		if err := h.applyConversationDeviceSync(tx, conv, true); err != nil {
+			return err
+		}
+	}
+
+	for _, contact := range snapshot.GetContacts() {
+		if err := h.applyContactDeviceSync(tx, contact, true); err != nil {
+			return err
+		}
+	}
+
+	for _, star := range snapshot.GetStars() {
+		if err := h.applyStarDeviceSync(tx, star); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range snapshot.GetTags() {
+		if err := h.applyTagDeviceSync(tx, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncConversation(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncConversation)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync conversation sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyConversationDeviceSync(tx, payload, false); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncContact(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncContact)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync contact sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyContactDeviceSync(tx, payload, false); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) applyConversationDeviceSync(tx *dbWrapper, state *messengertypes.AppMessage_DeviceSyncConversation, merge bool) error {
+	conv, updated, err := tx.applyConversationDeviceSync(state, merge)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		// the conversation has not been joined by this device yet
+		h.logger.Debug("ignoring device sync of an unknown conversation", logGroup(state.GetConversationPublicKey()))
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyContactDeviceSync updates the local state of a contact or a member, when merging a snapshot the blocked members
+// and the hidden presences are only added
+func (h *eventHandler) applyContactDeviceSync(tx *dbWrapper, state *messengertypes.AppMessage_DeviceSyncContact, merge bool) error {
+	pk := state.GetPublicKey()
+	if pk == "" {
+		return nil
+	}
+
+	blocked, err := tx.isMemberBlocked(pk)
+	if err != nil {
+		return err
+	}
+
+	if state.GetBlocked() != blocked && (!merge || state.GetBlocked()) {
+		interactions, err := tx.setMemberBlocked(pk, state.GetBlocked())
+		if err != nil {
+			return err
+		}
+
+		if h.svc != nil {
+			for _, i := range interactions {
+				if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	contact, err := tx.getContactByPK(pk)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if state.GetPresenceHidden() == contact.GetPresenceHidden() || (merge && !state.GetPresenceHidden()) {
+		return nil
+	}
+
+	if contact, err = tx.setContactPresenceHidden(pk, state.GetPresenceHidden()); err != nil {
+		return err
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deviceSyncConversationFromConversation(conv *messengertypes.Conversation) *messengertypes.AppMessage_DeviceSyncConversation {
+	return &messengertypes.AppMessage_DeviceSyncConversation{
+		ConversationPublicKey: conv.GetPublicKey(),
+		UnreadCount:           conv.GetUnreadCount(),
+		PushMuted:             conv.GetPushMuted(),
+		MediaDownloadMode:     conv.GetMediaDownloadMode(),
+		MediaDownloadMaxSize:  conv.GetMediaDownloadMaxSize(),
+		ReadUntil:             conv.GetReadUntil(),
+	}
+}
+
+// getAccountGroupInfo returns the account group and the keys of the current device in it
+func (svc *service) getAccountGroupInfo(ctx context.Context) (*protocoltypes.GroupInfo_Reply, error) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	gpk, err := b64DecodeBytes(acc.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	info, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		return nil, errcode.ErrGroupInfo.Wrap(err)
+	}
+
+	return info, nil
+}
+
+// getLinkedDevices returns the other devices of the account, known from the account group
+func (svc *service) getLinkedDevices(info *protocoltypes.GroupInfo_Reply) ([]*messengertypes.Device, error) {
+	devices, err := svc.db.getDevicesByMember(b64EncodeBytes(info.GetMemberPK()))
+	if err != nil {
+		return nil, err
+	}
+
+	ownDevicePK := b64EncodeBytes(info.GetDevicePK())
+
+	linked := []*messengertypes.Device(nil)
+	for _, device := range devices {
+		if device.GetPublicKey() != ownDevicePK {
+			linked = append(linked, device)
+		}
+	}
+
+	return linked, nil
+}
+
+// sendDeviceSync sends a device sync message in the account group, nothing is sent if the account has a single device
+func (svc *service) sendDeviceSync(ctx context.Context, t messengertypes.AppMessage_Type, payload proto.Message) error {
+	info, err := svc.getAccountGroupInfo(ctx)
+	if err != nil {
+		return err
+	}
+
+	if devices, err := svc.getLinkedDevices(info); err != nil {
+		return err
+	} else if len(devices) == 0 {
+		return nil
+	}
+
+	am, err := t.MarshalPayload(timestampMs(time.Now()), nil, payload)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := svc.protocolClient.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{GroupPK: info.GetGroup().GetPublicKey(), Payload: am}); err != nil {
+		return errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	return nil
+}
+
+// syncConversation sends the local state of a conversation to the other devices, the local change is kept on failure
+func (svc *service) syncConversation(ctx context.Context, conv *messengertypes.Conversation) {
+	if err := svc.sendDeviceSync(ctx, messengertypes.AppMessage_TypeDeviceSyncConversation, deviceSyncConversationFromConversation(conv)); err != nil {
+		svc.logger.Warn("unable to sync conversation with the other devices", logGroup(conv.GetPublicKey()), zap.Error(err))
+	}
+}
+
+// markConversationRead moves the read position of a conversation forward, the other devices are updated when it changed
+func (svc *service) markConversationRead(ctx context.Context, pk string, readUntil int64) (*messengertypes.Conversation, error) {
+	conv, updated, err := svc.db.markConversationRead(pk, readUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, err
+	}
+
+	if updated {
+		svc.syncConversation(ctx, conv)
+	}
+
+	return conv, nil
+}
+
+// syncContact sends the local state of a contact or a member to the other devices, the local change is kept on failure
+func (svc *service) syncContact(ctx context.Context, pk string) {
+	state, err := svc.db.getDeviceSyncContact(pk)
+	if err == nil {
+		err = svc.sendDeviceSync(ctx, messengertypes.AppMessage_TypeDeviceSyncContact, state)
+	}
+
+	if err != nil {
+		svc.logger.Warn("unable to sync contact with the other devices", logContact(pk), zap.Error(err))
+	}
+}
+
+// onAccountDeviceAdded sends the summary of the local state to a device which joined the account, the device then asks
+// for the items it lacks, gi is the info of the group the device has been added to
+func (h *eventHandler) onAccountDeviceAdded(gi *protocoltypes.GroupInfo_Reply, memberPK, devicePK []byte) {
+	if h.svc == nil || h.replay || !bytes.Equal(gi.GetMemberPK(), memberPK) || bytes.Equal(gi.GetDevicePK(), devicePK) {
+		return
+	}
+
+	acc, err := h.db.getAccount()
+	if err != nil || acc.GetPublicKey() != b64EncodeBytes(gi.GetGroup().GetPublicKey()) {
+		return
+	}
+
+	h.logger.Info("new device linked to the account, sending the local state", zap.String("device-pk", b64EncodeBytes(devicePK)))
+
+	h.svc.addSystemNotice(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeDeviceLinked, DevicePublicKey: b64EncodeBytes(devicePK)})
+
+	go func() {
+		if err := h.svc.sendDeviceSyncSummary(); err != nil {
+			h.logger.Error("unable to send device sync summary", zap.Error(err))
+		}
+	}()
+}
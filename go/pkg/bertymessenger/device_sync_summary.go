@@ -0,0 +1,374 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The devices of the account compare the Merkle summaries of their local state instead of sending the whole of it: each
+// item of the state, ie. the local state of a conversation, of a contact, of a starred message or of a tag of a message,
+// is hashed in a bucket chosen by the hash of its key. A device sends the hashes of its buckets, the other devices answer with the digests of
+// the items of the buckets which differ, and only the items which differ are then sent both ways and merged as the items
+// of a snapshot are.
+
+// deviceSyncBucketCount is the number of buckets of a summary
+const deviceSyncBucketCount = 16
+
+const (
+	deviceSyncConversationKeyPrefix = "conversation/"
+	deviceSyncContactKeyPrefix      = "contact/"
+	deviceSyncStarKeyPrefix         = "star/"
+	deviceSyncTagKeyPrefix          = "tag/"
+)
+
+type deviceSyncItem struct {
+	key  string
+	hash []byte
+	// message is the DeviceSyncConversation, DeviceSyncContact, DeviceSyncStar or DeviceSyncTag of the item
+	message proto.Message
+}
+
+// deviceSyncState indexes the items of the local state of a device by key and by bucket, the items of a bucket are
+// sorted by key
+type deviceSyncState struct {
+	items   map[string]*deviceSyncItem
+	buckets [deviceSyncBucketCount][]*deviceSyncItem
+}
+
+func newDeviceSyncState(snapshot *messengertypes.AppMessage_DeviceSyncSnapshot) (*deviceSyncState, error) {
+	s := &deviceSyncState{items: map[string]*deviceSyncItem{}}
+
+	for _, conv := range snapshot.GetConversations() {
+		if err := s.add(deviceSyncConversationKeyPrefix+conv.GetConversationPublicKey(), conv); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, contact := range snapshot.GetContacts() {
+		if err := s.add(deviceSyncContactKeyPrefix+contact.GetPublicKey(), contact); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, star := range snapshot.GetStars() {
+		if err := s.add(deviceSyncStarKeyPrefix+star.GetCID(), star); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tag := range snapshot.GetTags() {
+		if err := s.add(deviceSyncTagKeyPrefix+tag.GetCID()+"/"+tag.GetTag(), tag); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, bucket := range s.buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].key < bucket[j].key })
+	}
+
+	return s, nil
+}
+
+func (s *deviceSyncState) add(key string, message proto.Message) error {
+	raw, err := proto.Marshal(message)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	hash := sha256.Sum256(raw)
+	item := &deviceSyncItem{key: key, hash: hash[:], message: message}
+
+	s.items[key] = item
+	bucket := deviceSyncBucket(key)
+	s.buckets[bucket] = append(s.buckets[bucket], item)
+
+	return nil
+}
+
+// deviceSyncBucket returns the bucket of an item, chosen by the hash of its key so the devices agree on it
+func deviceSyncBucket(key string) uint32 {
+	hash := sha256.Sum256([]byte(key))
+	return uint32(hash[0]) % deviceSyncBucketCount
+}
+
+// bucketHash hashes the keys and the hashes of the items of a bucket
+func (s *deviceSyncState) bucketHash(bucket uint32) []byte {
+	h := sha256.New()
+	for _, item := range s.buckets[bucket] {
+		_, _ = h.Write([]byte(item.key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write(item.hash)
+	}
+
+	return h.Sum(nil)
+}
+
+func (s *deviceSyncState) summary() *messengertypes.AppMessage_DeviceSyncSummary {
+	summary := &messengertypes.AppMessage_DeviceSyncSummary{}
+
+	root := sha256.New()
+	for bucket := uint32(0); bucket < deviceSyncBucketCount; bucket++ {
+		hash := s.bucketHash(bucket)
+		summary.Buckets = append(summary.Buckets, hash)
+		_, _ = root.Write(hash)
+	}
+	summary.Root = root.Sum(nil)
+
+	return summary
+}
+
+// differingBuckets returns the buckets whose hash differs from the ones of a summary
+func (s *deviceSyncState) differingBuckets(summary *messengertypes.AppMessage_DeviceSyncSummary) []uint32 {
+	local := s.summary()
+	if bytes.Equal(local.GetRoot(), summary.GetRoot()) {
+		return nil
+	}
+
+	buckets := []uint32(nil)
+	for bucket := uint32(0); bucket < deviceSyncBucketCount; bucket++ {
+		if int(bucket) >= len(summary.GetBuckets()) || !bytes.Equal(local.GetBuckets()[bucket], summary.GetBuckets()[bucket]) {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	return buckets
+}
+
+// digest returns the digests of the items of some buckets
+func (s *deviceSyncState) digest(buckets []uint32) []*messengertypes.AppMessage_DeviceSyncItemDigest {
+	items := []*messengertypes.AppMessage_DeviceSyncItemDigest(nil)
+	for _, bucket := range buckets {
+		if bucket >= deviceSyncBucketCount {
+			continue
+		}
+
+		for _, item := range s.buckets[bucket] {
+			items = append(items, &messengertypes.AppMessage_DeviceSyncItemDigest{Key: item.key, Hash: item.hash})
+		}
+	}
+
+	return items
+}
+
+// diff compares the digest of another device with the local items of the same buckets, it returns the local items which
+// differ or are missing on the other device and the keys of the items of the other device which differ or are missing
+// locally
+func (s *deviceSyncState) diff(digest *messengertypes.AppMessage_DeviceSyncDigest) (*messengertypes.AppMessage_DeviceSyncSnapshot, []string) {
+	remote := map[string][]byte{}
+	for _, item := range digest.GetItems() {
+		remote[item.GetKey()] = item.GetHash()
+	}
+
+	keys := []string(nil)
+	for _, item := range s.digest(digest.GetBuckets()) {
+		if hash, ok := remote[item.GetKey()]; !ok || !bytes.Equal(hash, item.GetHash()) {
+			keys = append(keys, item.GetKey())
+		}
+	}
+
+	wanted := []string(nil)
+	for _, item := range digest.GetItems() {
+		if local, ok := s.items[item.GetKey()]; !ok || !bytes.Equal(local.hash, item.GetHash()) {
+			wanted = append(wanted, item.GetKey())
+		}
+	}
+
+	return s.snapshotOf(keys), wanted
+}
+
+// snapshotOf returns the known items of some keys
+func (s *deviceSyncState) snapshotOf(keys []string) *messengertypes.AppMessage_DeviceSyncSnapshot {
+	snapshot := &messengertypes.AppMessage_DeviceSyncSnapshot{}
+	for _, key := range keys {
+		item, ok := s.items[key]
+		if !ok {
+			continue
+		}
+
+		switch message := item.message.(type) {
+		case *messengertypes.AppMessage_DeviceSyncConversation:
+			snapshot.Conversations = append(snapshot.Conversations, message)
+		case *messengertypes.AppMessage_DeviceSyncContact:
+			snapshot.Contacts = append(snapshot.Contacts, message)
+		case *messengertypes.AppMessage_DeviceSyncStar:
+			snapshot.Stars = append(snapshot.Stars, message)
+		case *messengertypes.AppMessage_DeviceSyncTag:
+			snapshot.Tags = append(snapshot.Tags, message)
+		}
+	}
+
+	return snapshot
+}
+
+func isDeviceSyncSnapshotEmpty(snapshot *messengertypes.AppMessage_DeviceSyncSnapshot) bool {
+	return len(snapshot.GetConversations()) == 0 && len(snapshot.GetContacts()) == 0 && len(snapshot.GetStars()) == 0 && len(snapshot.GetTags()) == 0
+}
+
+func (d *dbWrapper) getDeviceSyncState() (*deviceSyncState, error) {
+	snapshot, err := d.getDeviceSyncSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return newDeviceSyncState(snapshot)
+}
+
+// sendDeviceSyncSummary sends the summary of the local state to the other devices of the account
+func (svc *service) sendDeviceSyncSummary() error {
+	state, err := svc.db.getDeviceSyncState()
+	if err != nil {
+		return err
+	}
+
+	return svc.sendDeviceSync(svc.ctx, messengertypes.AppMessage_TypeDeviceSyncSummary, state.summary())
+}
+
+// answerDeviceSyncSummary sends the digests of the buckets which differ from the summary of another device
+func (svc *service) answerDeviceSyncSummary(devicePK string, summary *messengertypes.AppMessage_DeviceSyncSummary) error {
+	state, err := svc.db.getDeviceSyncState()
+	if err != nil {
+		return err
+	}
+
+	buckets := state.differingBuckets(summary)
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	return svc.sendDeviceSync(svc.ctx, messengertypes.AppMessage_TypeDeviceSyncDigest, &messengertypes.AppMessage_DeviceSyncDigest{
+		DevicePublicKey: devicePK,
+		Buckets:         buckets,
+		Items:           state.digest(buckets),
+	})
+}
+
+// answerDeviceSyncDigest sends the items which differ from the digest of another device and asks for its own ones,
+// the digests answering the summaries of the other devices are ignored
+func (svc *service) answerDeviceSyncDigest(devicePK string, digest *messengertypes.AppMessage_DeviceSyncDigest) error {
+	if ok, err := svc.isOwnAccountDevice(digest.GetDevicePublicKey()); err != nil || !ok {
+		return err
+	}
+
+	state, err := svc.db.getDeviceSyncState()
+	if err != nil {
+		return err
+	}
+
+	items, wanted := state.diff(digest)
+	if isDeviceSyncSnapshotEmpty(items) && len(wanted) == 0 {
+		return nil
+	}
+
+	return svc.sendDeviceSync(svc.ctx, messengertypes.AppMessage_TypeDeviceSyncDiff, &messengertypes.AppMessage_DeviceSyncDiff{
+		DevicePublicKey: devicePK,
+		Items:           items,
+		WantedKeys:      wanted,
+	})
+}
+
+// answerDeviceSyncDiff sends the items asked by the diff of another device, the diffs answering the digests of the
+// other devices are ignored
+func (svc *service) answerDeviceSyncDiff(devicePK string, diff *messengertypes.AppMessage_DeviceSyncDiff) error {
+	if ok, err := svc.isOwnAccountDevice(diff.GetDevicePublicKey()); err != nil || !ok {
+		return err
+	}
+
+	state, err := svc.db.getDeviceSyncState()
+	if err != nil {
+		return err
+	}
+
+	items := state.snapshotOf(diff.GetWantedKeys())
+	if isDeviceSyncSnapshotEmpty(items) {
+		return nil
+	}
+
+	return svc.sendDeviceSync(svc.ctx, messengertypes.AppMessage_TypeDeviceSyncDiff, &messengertypes.AppMessage_DeviceSyncDiff{
+		DevicePublicKey: devicePK,
+		Items:           items,
+	})
+}
+
+// isOwnAccountDevice checks that a device public key is the one of the current device in the account group
+func (svc *service) isOwnAccountDevice(devicePK string) (bool, error) {
+	info, err := svc.getAccountGroupInfo(svc.ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return b64EncodeBytes(info.GetDevicePK()) == devicePK, nil
+}
+
+// answerDeviceSync runs the answer to a device sync message once it has been handled, nothing is answered during the
+// replays
+func (h *eventHandler) answerDeviceSync(name string, answer func() error) {
+	if h.svc == nil || h.replay {
+		return
+	}
+
+	go func() {
+		if err := answer(); err != nil {
+			h.logger.Warn("unable to answer device sync "+name, zap.Error(err))
+		}
+	}()
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncSummary(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncSummary)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync summary sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	h.answerDeviceSync("summary", func() error { return h.svc.answerDeviceSyncSummary(i.GetDevicePublicKey(), payload) })
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncDigest(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncDigest)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync digest sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	h.answerDeviceSync("digest", func() error { return h.svc.answerDeviceSyncDigest(i.GetDevicePublicKey(), payload) })
+
+	return i, false, nil
+}
+
+// handleAppMessageDeviceSyncDiff merges the items of a diff whichever device it answers, as the snapshots are merged,
+// the items it asks for are only sent back by the device it answers
+func (h *eventHandler) handleAppMessageDeviceSyncDiff(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncDiff)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync diff sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyDeviceSyncSnapshot(tx, payload.GetItems()); err != nil {
+		return nil, false, err
+	}
+
+	if len(payload.GetWantedKeys()) > 0 {
+		h.answerDeviceSync("diff", func() error { return h.svc.answerDeviceSyncDiff(i.GetDevicePublicKey(), payload) })
+	}
+
+	return i, false, nil
+}
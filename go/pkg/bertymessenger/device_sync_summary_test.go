@@ -0,0 +1,95 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_deviceSyncState_diff(t *testing.T) {
+	local, err := newDeviceSyncState(&messengertypes.AppMessage_DeviceSyncSnapshot{
+		Conversations: []*messengertypes.AppMessage_DeviceSyncConversation{
+			{ConversationPublicKey: "conv_1", UnreadCount: 2},
+			{ConversationPublicKey: "conv_2", PushMuted: true},
+		},
+		Contacts: []*messengertypes.AppMessage_DeviceSyncContact{{PublicKey: "contact_1", Blocked: true}},
+	})
+	require.NoError(t, err)
+
+	same, err := newDeviceSyncState(&messengertypes.AppMessage_DeviceSyncSnapshot{
+		Contacts: []*messengertypes.AppMessage_DeviceSyncContact{{PublicKey: "contact_1", Blocked: true}},
+		Conversations: []*messengertypes.AppMessage_DeviceSyncConversation{
+			{ConversationPublicKey: "conv_2", PushMuted: true},
+			{ConversationPublicKey: "conv_1", UnreadCount: 2},
+		},
+	})
+	require.NoError(t, err)
+
+	// the summaries don't depend on the order of the items
+	require.Equal(t, local.summary(), same.summary())
+	require.Empty(t, local.differingBuckets(same.summary()))
+
+	remote, err := newDeviceSyncState(&messengertypes.AppMessage_DeviceSyncSnapshot{
+		Conversations: []*messengertypes.AppMessage_DeviceSyncConversation{
+			{ConversationPublicKey: "conv_1", UnreadCount: 0},
+			{ConversationPublicKey: "conv_2", PushMuted: true},
+		},
+		Stars: []*messengertypes.AppMessage_DeviceSyncStar{{CID: "cid_1", ConversationPublicKey: "conv_1", Starred: true, StarredDate: 1}},
+	})
+	require.NoError(t, err)
+
+	// only the buckets of the items which differ are compared
+	buckets := remote.differingBuckets(local.summary())
+	require.NotEmpty(t, buckets)
+	require.NotContains(t, buckets, deviceSyncBucket(deviceSyncConversationKeyPrefix+"conv_2"))
+
+	digest := &messengertypes.AppMessage_DeviceSyncDigest{DevicePublicKey: "device_local", Buckets: buckets, Items: remote.digest(buckets)}
+	items, wanted := local.diff(digest)
+
+	require.Len(t, items.GetConversations(), 1)
+	require.Equal(t, "conv_1", items.GetConversations()[0].GetConversationPublicKey())
+	require.Len(t, items.GetContacts(), 1)
+	require.Empty(t, items.GetStars())
+	require.ElementsMatch(t, []string{deviceSyncConversationKeyPrefix + "conv_1", deviceSyncStarKeyPrefix + "cid_1"}, wanted)
+
+	back := remote.snapshotOf(wanted)
+	require.Len(t, back.GetConversations(), 1)
+	require.Equal(t, int32(0), back.GetConversations()[0].GetUnreadCount())
+	require.Len(t, back.GetStars(), 1)
+}
+
+func Test_eventHandler_handleAppMessageDeviceSyncDiff(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Account{PublicKey: "account_pk"})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", UnreadCount: 5})
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	diff := &messengertypes.AppMessage_DeviceSyncDiff{
+		DevicePublicKey: "device_other",
+		Items: &messengertypes.AppMessage_DeviceSyncSnapshot{
+			Conversations: []*messengertypes.AppMessage_DeviceSyncConversation{{ConversationPublicKey: "conv_1", UnreadCount: 1}},
+		},
+		WantedKeys: []string{deviceSyncConversationKeyPrefix + "conv_1"},
+	}
+
+	// the diffs sent outside of the account group are ignored
+	_, _, err := h.handleAppMessageDeviceSyncDiff(db, &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1"}, diff)
+	require.NoError(t, err)
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int32(5), conv.GetUnreadCount())
+
+	// the items of a diff are merged whichever device it answers
+	_, _, err = h.handleAppMessageDeviceSyncDiff(db, &messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "account_pk"}, diff)
+	require.NoError(t, err)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), conv.GetUnreadCount())
+}
@@ -0,0 +1,128 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_applyConversationDeviceSync(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, _, err := db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_unknown"}, false)
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", UnreadCount: 5})
+
+	// the lowest unread count is kept
+	conv, updated, err := db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", UnreadCount: 10}, false)
+	require.NoError(t, err)
+	require.False(t, updated)
+	require.Equal(t, int32(5), conv.UnreadCount)
+
+	conv, updated, err = db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", UnreadCount: 0, PushMuted: true}, false)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, int32(0), conv.UnreadCount)
+	require.True(t, conv.PushMuted)
+
+	// a snapshot doesn't loosen the local settings
+	conv, updated, err = db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeManual}, true)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.True(t, conv.PushMuted)
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeManual, conv.MediaDownloadMode)
+
+	_, updated, err = db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeAlways}, true)
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	conv, updated, err = db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeAlways}, false)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.False(t, conv.PushMuted)
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeAlways, conv.MediaDownloadMode)
+}
+
+func Test_dbWrapper_getDeviceSyncSnapshot(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", UnreadCount: 2})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", PushMuted: true})
+	db.db.Create(&messengertypes.Contact{PublicKey: "contact_1", PresenceHidden: true})
+	db.db.Create(&messengertypes.Contact{PublicKey: "contact_2"})
+
+	_, err := db.setMemberBlocked("contact_1", true)
+	require.NoError(t, err)
+
+	_, err = db.setMemberBlocked("member_1", true)
+	require.NoError(t, err)
+
+	snapshot, err := db.getDeviceSyncSnapshot()
+	require.NoError(t, err)
+	require.Len(t, snapshot.Conversations, 2)
+	require.Len(t, snapshot.Contacts, 2)
+
+	contacts := map[string]*messengertypes.AppMessage_DeviceSyncContact{}
+	for _, contact := range snapshot.Contacts {
+		contacts[contact.PublicKey] = contact
+	}
+
+	require.True(t, contacts["contact_1"].Blocked)
+	require.True(t, contacts["contact_1"].PresenceHidden)
+	require.True(t, contacts["member_1"].Blocked)
+	require.False(t, contacts["member_1"].PresenceHidden)
+}
+
+func Test_dbWrapper_markConversationRead(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, _, err := db.markConversationRead("", 0)
+	require.Error(t, err)
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", UnreadCount: 3})
+	for i, date := range []int64{1000, 2000, 3000} {
+		db.db.Create(&messengertypes.Interaction{CID: fmt.Sprintf("cid_%d", i), ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: date})
+	}
+
+	conv, updated, err := db.markConversationRead("conv_1", 2000)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, int64(2000), conv.ReadUntil)
+	require.Equal(t, int32(1), conv.UnreadCount)
+
+	// the read position never moves backward
+	conv, updated, err = db.markConversationRead("conv_1", 1000)
+	require.NoError(t, err)
+	require.False(t, updated)
+	require.Equal(t, int64(2000), conv.ReadUntil)
+
+	// all the messages are read
+	conv, updated, err = db.markConversationRead("conv_1", 0)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, int64(3000), conv.ReadUntil)
+	require.Equal(t, int32(0), conv.UnreadCount)
+
+	// the read position of another device resets the unread count
+	db.db.Create(&messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 4000})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_4", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 5000})
+	db.db.Model(&messengertypes.Conversation{}).Where("public_key = ?", "conv_1").Update("unread_count", 2)
+
+	conv, updated, err = db.applyConversationDeviceSync(&messengertypes.AppMessage_DeviceSyncConversation{ConversationPublicKey: "conv_1", UnreadCount: 5, ReadUntil: 4000}, false)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, int64(4000), conv.ReadUntil)
+	require.Equal(t, int32(1), conv.UnreadCount)
+
+	readUntil, err := db.getConversationReadUntil("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(4000), readUntil)
+}
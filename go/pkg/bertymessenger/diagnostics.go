@@ -0,0 +1,208 @@
+package bertymessenger
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	ipfscid "github.com/ipfs/go-cid"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// diagnosticsMaxLag bounds the number of events read from each message log to compute its lag
+const diagnosticsMaxLag = 100
+
+// eventDiagnostics tracks the handling of the protocol events since the messenger started
+type eventDiagnostics struct {
+	mu     sync.Mutex
+	groups map[string]*messengertypes.SystemInfo_GroupDiagnostics
+	// unresolved are the cids of the events still missing after their replay by a reconciliation
+	unresolved map[string]bool
+}
+
+func newEventDiagnostics() *eventDiagnostics {
+	return &eventDiagnostics{
+		groups:     map[string]*messengertypes.SystemInfo_GroupDiagnostics{},
+		unresolved: map[string]bool{},
+	}
+}
+
+func (d *eventDiagnostics) group(groupPK string) *messengertypes.SystemInfo_GroupDiagnostics {
+	group, ok := d.groups[groupPK]
+	if !ok {
+		group = &messengertypes.SystemInfo_GroupDiagnostics{ConversationPublicKey: groupPK}
+		d.groups[groupPK] = group
+	}
+
+	return group
+}
+
+func eventCID(evt *protocoltypes.EventContext) string {
+	cid, err := ipfscid.Cast(evt.GetID())
+	if err != nil {
+		return ""
+	}
+
+	return cid.String()
+}
+
+// messageHandled records the last message event handled for a group
+func (d *eventDiagnostics) messageHandled(groupPK string, evt *protocoltypes.EventContext, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group := d.group(groupPK)
+	group.LastHandledCID = eventCID(evt)
+	group.LastHandledDate = timestampMs(now)
+}
+
+// quarantined counts an event whose handling failed since the messenger started, the event itself is stored by
+// eventFailed
+func (d *eventDiagnostics) quarantined(groupPK string, evt *protocoltypes.EventContext, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group := d.group(groupPK)
+	group.QuarantinedEvents++
+	group.LastQuarantinedCID = eventCID(evt)
+	group.LastError = err.Error()
+}
+
+func (d *eventDiagnostics) replayed(groupPK string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.group(groupPK).LastReplayDate = timestampMs(now)
+}
+
+// reconciled records the comparison of a message log with the database, the unresolved events are not replayed again
+func (d *eventDiagnostics) reconciled(groupPK string, missing int, unresolved []string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group := d.group(groupPK)
+	group.LastReconciliationDate = timestampMs(now)
+	group.MissingEvents += int64(missing)
+	group.UnresolvedEvents += int64(len(unresolved))
+	if missing > 0 {
+		group.ReconciliationReplays++
+	}
+
+	for _, cid := range unresolved {
+		d.unresolved[cid] = true
+	}
+}
+
+func (d *eventDiagnostics) isUnresolved(cid string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.unresolved[cid]
+}
+
+// totalReconciled returns the date of the last reconciliation and the number of missing events found by them
+func (d *eventDiagnostics) totalReconciled() (int64, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, missing := int64(0), int64(0)
+	for _, group := range d.groups {
+		if group.GetLastReconciliationDate() > last {
+			last = group.GetLastReconciliationDate()
+		}
+		missing += group.GetMissingEvents()
+	}
+
+	return last, missing
+}
+
+func (d *eventDiagnostics) totalQuarantined() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	total := int64(0)
+	for _, group := range d.groups {
+		total += group.GetQuarantinedEvents()
+	}
+
+	return total
+}
+
+// snapshot copies the diagnostics of a group
+func (d *eventDiagnostics) snapshot(groupPK string) *messengertypes.SystemInfo_GroupDiagnostics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group := *d.group(groupPK)
+	return &group
+}
+
+// groupLag counts the events of a message log more recent than the last handled one, or than the most recent one
+// stored as an interaction when no event was handled yet
+func groupLag(ctx context.Context, client protocoltypes.ProtocolServiceClient, db *dbWrapper, groupPK []byte, lastHandledCID string) (string, int64, bool, error) {
+	events, _, err := listMessageHistory(ctx, client, groupPK, nil, diagnosticsMaxLag, historyPageMaxSize)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	head := ""
+	for idx, evt := range events {
+		cid := eventCID(evt.GetEventContext())
+		if idx == 0 {
+			head = cid
+		}
+
+		if cid == lastHandledCID {
+			return head, int64(idx), false, nil
+		}
+
+		if _, err := db.getInteractionByCID(cid); err == nil {
+			return head, int64(idx), false, nil
+		}
+	}
+
+	return head, int64(len(events)), len(events) == diagnosticsMaxLag, nil
+}
+
+// getDiagnostics reports the replay health of the conversations
+func (svc *service) getDiagnostics(ctx context.Context) (*messengertypes.SystemInfo_Diagnostics, error) {
+	account, err := svc.db.getAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	convs, err := svc.db.getAllConversations()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	diagnostics := &messengertypes.SystemInfo_Diagnostics{
+		LastReplayDate:    account.GetLastReplayDate(),
+		QuarantinedEvents: svc.eventDiagnostics.totalQuarantined(),
+	}
+	diagnostics.LastReconciliationDate, diagnostics.MissingEvents = svc.eventDiagnostics.totalReconciled()
+	for _, conv := range convs {
+		groupPK, err := b64DecodeBytes(conv.GetPublicKey())
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		group := svc.eventDiagnostics.snapshot(conv.GetPublicKey())
+		if group.HeadCID, group.Lag, group.LagCapped, err = groupLag(ctx, svc.protocolClient, svc.db, groupPK, group.GetLastHandledCID()); err != nil {
+			group.LastError = err.Error()
+		}
+
+		diagnostics.Groups = append(diagnostics.Groups, group)
+	}
+
+	// the most lagging groups first
+	sort.SliceStable(diagnostics.Groups, func(i, j int) bool {
+		return diagnostics.Groups[i].GetLag() > diagnostics.Groups[j].GetLag()
+	})
+
+	return diagnostics, nil
+}
@@ -0,0 +1,51 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_eventDiagnostics(t *testing.T) {
+	d := newEventDiagnostics()
+	now := time.Unix(1600000000, 0)
+
+	// an invalid event id is not reported
+	d.messageHandled("conv_1", &protocoltypes.EventContext{ID: []byte("invalid")}, now)
+	d.quarantined("conv_1", nil, fmt.Errorf("first"))
+	d.quarantined("conv_1", nil, fmt.Errorf("second"))
+	d.quarantined("conv_2", nil, fmt.Errorf("third"))
+	d.replayed("conv_2", now)
+
+	group := d.snapshot("conv_1")
+	require.Equal(t, "", group.GetLastHandledCID())
+	require.Equal(t, timestampMs(now), group.GetLastHandledDate())
+	require.Equal(t, int64(2), group.GetQuarantinedEvents())
+	require.Equal(t, "second", group.GetLastError())
+
+	// the snapshots are copies
+	group.QuarantinedEvents = 0
+	require.Equal(t, int64(2), d.snapshot("conv_1").GetQuarantinedEvents())
+
+	require.Equal(t, timestampMs(now), d.snapshot("conv_2").GetLastReplayDate())
+	require.Equal(t, int64(3), d.totalQuarantined())
+	require.Equal(t, int64(0), d.snapshot("conv_3").GetQuarantinedEvents())
+}
+
+func Test_dbWrapper_setAccountLastReplayDate(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.setAccountLastReplayDate("", 1))
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	require.NoError(t, db.setAccountLastReplayDate("account_1", 42))
+
+	account, err := db.getAccount()
+	require.NoError(t, err)
+	require.Equal(t, int64(42), account.GetLastReplayDate())
+}
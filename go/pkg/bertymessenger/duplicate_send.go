@@ -0,0 +1,96 @@
+package bertymessenger
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// duplicateSendWindow is the delay during which the same content sent again to a conversation is refused
+const duplicateSendWindow = 10 * time.Second
+
+// A flaky UI may send a message twice, ie. when the send button is tapped again while the first request is pending.
+// The hashes of the user messages sent with Interact are kept for a short window, the same content sent again to the
+// same conversation is refused unless the client forces it, as is the content of a message still in the outbox. The
+// hash covers what the client sent, not the date stamped by the node.
+
+// interactContentHash returns the hash of the content of an Interact request
+func interactContentHash(req *messengertypes.Interact_Request) string {
+	h := sha256.New()
+
+	writeHashField(h, []byte(req.GetConversationPublicKey()))
+	writeHashField(h, []byte(req.GetType().String()))
+	writeHashField(h, req.GetPayload())
+
+	writeHashCount(h, len(req.GetMediaCids()))
+	for _, cid := range req.GetMediaCids() {
+		writeHashField(h, []byte(cid))
+	}
+
+	keys := make([]string, 0, len(req.GetExtensions()))
+	for key := range req.GetExtensions() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHashCount(h, len(keys))
+	for _, key := range keys {
+		writeHashField(h, []byte(key))
+		writeHashField(h, req.GetExtensions()[key])
+	}
+
+	if req.GetViaGateway() {
+		writeHashCount(h, 1)
+	} else {
+		writeHashCount(h, 0)
+	}
+
+	return b64EncodeBytes(h.Sum(nil))
+}
+
+// writeHashField writes a length prefixed field, so the fields can't be shifted into one another
+func writeHashField(h hash.Hash, field []byte) {
+	writeHashCount(h, len(field))
+	_, _ = h.Write(field)
+}
+
+func writeHashCount(h hash.Hash, count int) {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(count))
+	_, _ = h.Write(raw[:])
+}
+
+// checkDuplicateSend refuses a content sent to a conversation within the window or deferred in the outbox, the writer
+// must be held
+func (svc *service) checkDuplicateSend(convPK, contentHash string, now time.Time) error {
+	duplicate, err := svc.db.isDuplicateSend(convPK, contentHash, timestampMs(now.Add(-duplicateSendWindow)))
+	if err != nil {
+		return err
+	}
+
+	if duplicate {
+		svc.logger.Info("refusing a duplicate send", logGroup(convPK))
+		return errcode.ErrDuplicateSend
+	}
+
+	return nil
+}
+
+// recordSentContent keeps the hash of a content sent to a conversation for the window, the writer must be held
+func (svc *service) recordSentContent(convPK, contentHash string, now time.Time) {
+	if err := svc.db.addSentContentHash(&messengertypes.SentContentHash{
+		ConversationPublicKey: convPK,
+		ContentHash:           contentHash,
+		SentDate:              timestampMs(now),
+	}, timestampMs(now.Add(-duplicateSendWindow))); err != nil {
+		// the message is sent, only the detection of the next duplicate is lost
+		svc.logger.Warn("unable to record a sent content", logGroup(convPK), zap.Error(err))
+	}
+}
@@ -0,0 +1,72 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_interactContentHash(t *testing.T) {
+	req := &messengertypes.Interact_Request{
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		Payload:               []byte("payload"),
+		ConversationPublicKey: "conv_1",
+		MediaCids:             []string{"media_1"},
+		Extensions:            map[string][]byte{"a": []byte("1"), "b": []byte("2")},
+	}
+	hash := interactContentHash(req)
+
+	// the force flag isn't part of the content
+	require.Equal(t, hash, interactContentHash(&messengertypes.Interact_Request{
+		Type:                  req.Type,
+		Payload:               req.Payload,
+		ConversationPublicKey: req.ConversationPublicKey,
+		MediaCids:             req.MediaCids,
+		Extensions:            map[string][]byte{"b": []byte("2"), "a": []byte("1")},
+		ForceSend:             true,
+	}))
+
+	for _, other := range []*messengertypes.Interact_Request{
+		{Type: req.Type, Payload: req.Payload, ConversationPublicKey: "conv_2", MediaCids: req.MediaCids, Extensions: req.Extensions},
+		{Type: req.Type, Payload: []byte("payload2"), ConversationPublicKey: req.ConversationPublicKey, Extensions: req.Extensions},
+		{Type: req.Type, Payload: req.Payload, ConversationPublicKey: req.ConversationPublicKey, MediaCids: req.MediaCids},
+		{Type: req.Type, Payload: req.Payload, ConversationPublicKey: req.ConversationPublicKey, MediaCids: req.MediaCids, Extensions: req.Extensions, ViaGateway: true},
+	} {
+		require.NotEqual(t, hash, interactContentHash(other))
+	}
+}
+
+func Test_service_checkDuplicateSend(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	now := time.Now()
+
+	require.NoError(t, svc.checkDuplicateSend("conv_1", "hash_1", now))
+
+	svc.recordSentContent("conv_1", "hash_1", now)
+	require.True(t, errcode.Is(svc.checkDuplicateSend("conv_1", "hash_1", now.Add(time.Second)), errcode.ErrDuplicateSend))
+	require.NoError(t, svc.checkDuplicateSend("conv_2", "hash_1", now.Add(time.Second)))
+
+	// the content can be sent again once the window is over, the expired hashes are removed
+	later := now.Add(duplicateSendWindow + time.Second)
+	require.NoError(t, svc.checkDuplicateSend("conv_1", "hash_1", later))
+
+	svc.recordSentContent("conv_2", "hash_2", later)
+	info, err := db.getDBInfo()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), info.GetSentContentHashes())
+
+	// a content deferred in the outbox is a duplicate until it is sent
+	require.NoError(t, db.addOutboxMessage(&messengertypes.OutboxMessage{ID: "outbox_1", ConversationPublicKey: "conv_1", ContentHash: "hash_3"}))
+	require.True(t, errcode.Is(svc.checkDuplicateSend("conv_1", "hash_3", later.Add(time.Hour)), errcode.ErrDuplicateSend))
+
+	require.NoError(t, db.deleteOutboxMessage("outbox_1"))
+	require.NoError(t, svc.checkDuplicateSend("conv_1", "hash_3", later.Add(time.Hour)))
+}
@@ -1,6 +1,7 @@
 package bertymessenger
 
 import (
+	"errors"
 	"io"
 
 	"go.uber.org/zap"
@@ -8,6 +9,18 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// errSenderBlocked is used to rollback the processing of an event sent by a blocked member
+var errSenderBlocked = errors.New("sender is blocked")
+
+// errSenderNotAllowed is used to rollback the processing of an event refused by the moderation rules of a group
+var errSenderNotAllowed = errors.New("sender is not allowed")
+
+// errDBRebuildRequired is returned by a migration whose data can only be recovered by replaying the logs
+var errDBRebuildRequired = errors.New("database must be rebuilt from the logs")
+
+// errInteractionPruned is used to rollback the processing of an interaction removed by the retention policy
+var errInteractionPruned = errors.New("interaction has been pruned")
+
 func isGRPCCanceledError(err error) bool {
 	grpcStatus, ok := status.FromError(err)
 	return ok && grpcStatus.Code() == codes.Canceled
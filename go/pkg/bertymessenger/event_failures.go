@@ -0,0 +1,178 @@
+package bertymessenger
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// A panic of a handler only fails the event which caused it: the failed events are quarantined and skipped, live and
+// during the replays, and the clients are warned with an EventHandlingFailed event. Many events failing in a row rather
+// reveal a broken database or handler than poisoned events, the handling of their group is then aborted so it can be
+// repaired instead of skipping its whole history.
+
+const (
+	// defaultMaxConsecutiveEventFailures is the number of events of a group which can fail in a row before the handling
+	// of the group is aborted
+	defaultMaxConsecutiveEventFailures = 50
+	// quarantineMaxStartupReplays is the number of failures of a quarantined event after which its group isn't replayed
+	// again at startup, the event is left in the quarantine
+	quarantineMaxStartupReplays = 3
+)
+
+// errHandlerPanicked is wrapped by the errors of the handlers which panicked
+var errHandlerPanicked = errors.New("handler panicked")
+
+// eventFailureStreaks counts the events of each group which failed in a row, a nil one counts nothing and never aborts
+type eventFailureStreaks struct {
+	mu sync.Mutex
+	// max is the length of the streak aborting the handling of a group, it is never aborted when max isn't positive
+	max    int
+	groups map[string]int
+}
+
+func newEventFailureStreaks(max int) *eventFailureStreaks {
+	return &eventFailureStreaks{max: max, groups: map[string]int{}}
+}
+
+// failed records a failed event of a group, it returns the number of its events which failed in a row and whether
+// its handling must be aborted
+func (s *eventFailureStreaks) failed(groupPK string) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[groupPK]++
+	streak := s.groups[groupPK]
+
+	return int64(streak), s.max > 0 && streak >= s.max
+}
+
+// handled ends the streak of a group
+func (s *eventFailureStreaks) handled(groupPK string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.groups, groupPK)
+}
+
+// eventFailed quarantines an event whose handling failed and warns the clients, it returns an ErrEventHandlingAborted
+// error once too many events of the group failed in a row
+func (h *eventHandler) eventFailed(groupPK string, evt *protocoltypes.EventContext, eventType string, err error) error {
+	consecutive, aborted := h.failures.failed(groupPK)
+
+	// the quarantine is stored in the database the handler writes to, the one being rebuilt during a replay
+	if cid := eventCID(evt); h.db != nil && cid != "" {
+		now := timestampMs(time.Now())
+		if err := h.db.addQuarantinedEvent(&messengertypes.QuarantinedEvent{
+			CID:             cid,
+			GroupPK:         groupPK,
+			EventType:       eventType,
+			Error:           err.Error(),
+			Panicked:        errors.Is(err, errHandlerPanicked),
+			Attempts:        1,
+			QuarantinedDate: now,
+			LastFailedDate:  now,
+		}); err != nil {
+			h.logger.Warn("unable to store the quarantined event", logGroup(groupPK), zap.String("cid", cid), zap.Error(err))
+		}
+	}
+
+	if h.svc != nil {
+		if h.svc.eventDiagnostics != nil {
+			h.svc.eventDiagnostics.quarantined(groupPK, evt, err)
+		}
+
+		if h.svc.dispatcher != nil {
+			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeEventHandlingFailed, &messengertypes.StreamEvent_EventHandlingFailed{
+				ConversationPublicKey: groupPK,
+				EventCID:              eventCID(evt),
+				EventType:             eventType,
+				Error:                 err.Error(),
+				Panicked:              errors.Is(err, errHandlerPanicked),
+				ConsecutiveFailures:   consecutive,
+				Aborted:               aborted,
+			}, false); err != nil {
+				h.logger.Warn("unable to dispatch the event handling failure", zap.Error(err))
+			}
+		}
+	}
+
+	if aborted {
+		return errcode.ErrEventHandlingAborted.Wrap(fmt.Errorf("%d events of group %s failed in a row: %w", consecutive, groupPK, err))
+	}
+
+	return nil
+}
+
+// handleLiveEvent handles an event received from the subscriptions of a group, its panics included. A failed event is
+// logged and quarantined, the error returned is an ErrEventHandlingAborted error once too many events of the group
+// failed in a row, the subscriptions of the group are then stopped
+func (svc *service) handleLiveEvent(groupPK string, evt *protocoltypes.EventContext, eventType string, handle func() error) error {
+	err := svc.eventHandler.recoverHandling(evt, handle)
+	if err == nil {
+		svc.eventHandler.failures.handled(groupPK)
+		return nil
+	}
+
+	svc.logger.Error("failed to handle protocol event", logGroup(groupPK), zap.String("event-type", eventType), zap.Error(errcode.ErrInternal.Wrap(err)))
+
+	if err := svc.eventHandler.eventFailed(groupPK, evt, eventType, err); err != nil {
+		svc.logger.Error("too many events failed in a row, the group isn't handled anymore", logGroup(groupPK), zap.Error(err))
+		svc.stopGroupSubscriptions(groupPK)
+		return err
+	}
+
+	return err
+}
+
+// getQuarantineBacklogIssues lists the groups with quarantined events as issues of the database, the events which
+// failed too many times are left out so a group broken for good isn't replayed at each start
+func getQuarantineBacklogIssues(db *dbWrapper) ([]*messengertypes.DatabaseDoctor_Issue, error) {
+	events, err := db.getQuarantinedEvents("")
+	if err != nil {
+		return nil, err
+	}
+
+	groupPKs := []string(nil)
+	counts := map[string]int{}
+	// the events are listed the most recently failed first, the issue of a group details its last failure
+	last := map[string]*messengertypes.QuarantinedEvent{}
+	for _, event := range events {
+		if event.GetAttempts() >= quarantineMaxStartupReplays {
+			continue
+		}
+
+		if _, ok := last[event.GetGroupPK()]; !ok {
+			last[event.GetGroupPK()] = event
+			groupPKs = append(groupPKs, event.GetGroupPK())
+		}
+		counts[event.GetGroupPK()]++
+	}
+
+	issues := []*messengertypes.DatabaseDoctor_Issue(nil)
+	for _, groupPK := range groupPKs {
+		issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+			Kind:                  messengertypes.DatabaseDoctor_KindQuarantinedEvents,
+			CID:                   last[groupPK].GetCID(),
+			ConversationPublicKey: groupPK,
+			Detail:                fmt.Sprintf("%d quarantined events, the last one failed with: %s", counts[groupPK], last[groupPK].GetError()),
+		})
+	}
+
+	return issues, nil
+}
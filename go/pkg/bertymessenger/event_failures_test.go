@@ -0,0 +1,156 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ipfscid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_eventFailureStreaks(t *testing.T) {
+	s := newEventFailureStreaks(2)
+
+	consecutive, aborted := s.failed("conv_1")
+	require.Equal(t, int64(1), consecutive)
+	require.False(t, aborted)
+
+	// the streaks are counted by group and end with a handled event
+	s.handled("conv_1")
+	_, aborted = s.failed("conv_1")
+	require.False(t, aborted)
+	_, aborted = s.failed("conv_2")
+	require.False(t, aborted)
+
+	consecutive, aborted = s.failed("conv_1")
+	require.Equal(t, int64(2), consecutive)
+	require.True(t, aborted)
+
+	// without a threshold the handling is never aborted
+	s = newEventFailureStreaks(-1)
+	for i := 0; i < defaultMaxConsecutiveEventFailures; i++ {
+		_, aborted = s.failed("conv_1")
+		require.False(t, aborted)
+	}
+}
+
+func TestService_handleLiveEvent(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), eventDiagnostics: newEventDiagnostics(), eventFailures: newEventFailureStreaks(2)}
+	svc.eventHandler = newEventHandler(context.Background(), db, nil, zap.NewNop(), svc, false)
+
+	events := []*messengertypes.StreamEvent_EventHandlingFailed(nil)
+	var n NotifieeBundle
+	n.StreamEventImpl = func(e *messengertypes.StreamEvent) error {
+		if e.GetType() == messengertypes.StreamEvent_TypeEventHandlingFailed {
+			payload, err := e.UnmarshalPayload()
+			require.NoError(t, err)
+			events = append(events, payload.(*messengertypes.StreamEvent_EventHandlingFailed))
+		}
+		return nil
+	}
+	svc.dispatcher.Register(&n)
+	defer svc.dispatcher.Unregister(&n)
+
+	groupPK := b64EncodeBytes([]byte("group"))
+
+	// a panic only fails its event
+	err := svc.handleLiveEvent(groupPK, nil, "TypeUserMessage", func() error { panic("poison") })
+	require.Error(t, err)
+	require.False(t, errcode.Is(err, errcode.ErrEventHandlingAborted))
+	require.NoError(t, svc.handleLiveEvent(groupPK, nil, "TypeUserMessage", func() error { return nil }))
+
+	require.Len(t, events, 1)
+	require.Equal(t, groupPK, events[0].GetConversationPublicKey())
+	require.True(t, events[0].GetPanicked())
+	require.Equal(t, int64(1), events[0].GetConsecutiveFailures())
+	require.Equal(t, int64(1), svc.eventDiagnostics.snapshot(groupPK).GetQuarantinedEvents())
+
+	// the subscriptions of the group are stopped once too many events failed in a row
+	ctx := svc.groupContext([]byte("group"))
+	for i := 0; i < 2; i++ {
+		err = svc.handleLiveEvent(groupPK, nil, "TypeUserMessage", func() error { return fmt.Errorf("failure") })
+	}
+	require.True(t, errcode.Is(err, errcode.ErrEventHandlingAborted))
+	require.Error(t, ctx.Err())
+
+	require.Len(t, events, 3)
+	require.False(t, events[2].GetPanicked())
+	require.True(t, events[2].GetAborted())
+	require.Equal(t, int64(3), svc.eventDiagnostics.snapshot(groupPK).GetQuarantinedEvents())
+}
+
+func Test_eventHandler_replayFailed_aborted(t *testing.T) {
+	h := &eventHandler{report: &messengertypes.ReplayReport{}, failures: newEventFailureStreaks(3)}
+
+	// the replay goes on while the events don't fail in a row
+	for i := 0; i < 4; i++ {
+		require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", fmt.Errorf("failure")))
+		h.failures.handled(b64EncodeBytes([]byte("group")))
+	}
+
+	require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", fmt.Errorf("failure")))
+	require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", fmt.Errorf("failure")))
+	err := h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", fmt.Errorf("failure"))
+	require.True(t, errcode.Is(err, errcode.ErrEventHandlingAborted))
+	require.Equal(t, int64(7), h.report.GetFailedEvents())
+}
+
+func Test_eventHandler_eventFailed_quarantine(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, true)
+	h.report = &messengertypes.ReplayReport{}
+	h.failures = newEventFailureStreaks(-1)
+
+	cid, err := ipfscid.Prefix{Version: 1, Codec: ipfscid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte("event_1"))
+	require.NoError(t, err)
+	evt := &protocoltypes.EventContext{ID: cid.Bytes()}
+	groupPK := b64EncodeBytes([]byte("group"))
+
+	// the failures of an event are added up
+	require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), evt, "TypeUserMessage", fmt.Errorf("first")))
+	require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), evt, "TypeUserMessage", fmt.Errorf("%w: second", errHandlerPanicked)))
+
+	// the events without a cid can't be quarantined
+	require.NoError(t, h.replayFailed(errcode.ErrReplayAppMessageHandling, []byte("group"), nil, "TypeUserMessage", fmt.Errorf("failure")))
+
+	events, err := db.getQuarantinedEvents(groupPK)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, cid.String(), events[0].GetCID())
+	require.Equal(t, "TypeUserMessage", events[0].GetEventType())
+	require.Equal(t, int32(2), events[0].GetAttempts())
+	require.True(t, events[0].GetPanicked())
+	require.Contains(t, events[0].GetError(), "second")
+
+	count, err := db.countQuarantinedEvents()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	events, err = db.getQuarantinedEvents(b64EncodeBytes([]byte("other")))
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// the events which didn't fail again since a replay are released
+	require.NoError(t, db.deleteResolvedQuarantinedEvents(groupPK, 1))
+	count, err = db.countQuarantinedEvents()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), count)
+
+	require.NoError(t, db.deleteResolvedQuarantinedEvents(groupPK, timestampMs(time.Now())+1))
+	count, err = db.countQuarantinedEvents()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), count)
+}
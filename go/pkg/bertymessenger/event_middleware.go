@@ -0,0 +1,225 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The app messages received by the event handler, live or during a replay, run through an ordered chain of stages:
+// the duplicates are dropped, the messages breaking the rules of their type are rejected, the floods are limited, the
+// messages are traced and tapped and they are eventually stored. The embedders insert their own middlewares around
+// these stages, ie. to log the messages for compliance, without changing the handler.
+
+// The built-in stages of the chain, in their order
+const (
+	EventStageDedup      = "dedup"
+	EventStageValidation = "validation"
+	EventStageRateLimit  = "rate-limit"
+	EventStageMetrics    = "metrics"
+	EventStageStorage    = "storage"
+)
+
+var builtinEventStages = []string{EventStageDedup, EventStageValidation, EventStageRateLimit, EventStageMetrics, EventStageStorage}
+
+// AppMessageEvent is an app message going through the middleware chain, its payload is already expanded
+type AppMessageEvent struct {
+	GroupPK    string
+	CID        string
+	Message    *protocoltypes.GroupMessageEvent
+	AppMessage *messengertypes.AppMessage
+	// Replay is set when the message is handled by a replay of the logs
+	Replay bool
+
+	// hash identifies the content of the message in the ledger of the processed events
+	hash    string
+	logger  *zap.Logger
+	spanCtx context.Context
+	span    trace.Span
+	// handled is set once the message doesn't need to be handled again, the rate limited or refused messages are not
+	handled bool
+	// rejection is the rule the message has been rejected by, if any
+	rejection string
+	// mutations collects the rows changed by the transaction of the message when the audit log is enabled
+	mutations *auditMutations
+}
+
+// EventMiddleware wraps the handling of an app message, it calls next to go on with the chain and returns without
+// calling it to drop the message. The middlewares after the storage stage only see the stored messages
+type EventMiddleware func(evt *AppMessageEvent, next func() error) error
+
+// EventMiddlewareRegistration inserts a middleware in the chain before the stage Before or after the stage After, the
+// stages being the built-in ones or the registered middlewares. The middleware is inserted right before the storage
+// when none is set
+type EventMiddlewareRegistration struct {
+	Name       string
+	Before     string
+	After      string
+	Middleware EventMiddleware
+}
+
+type eventStage struct {
+	name       string
+	middleware EventMiddleware
+}
+
+// orderEventMiddlewares checks the registrations and returns their names in the order of the chain, the built-in stages
+// included. The registrations are inserted in their order, one can refer to a registration made before it
+func orderEventMiddlewares(registrations []EventMiddlewareRegistration) ([]string, map[string]EventMiddleware, error) {
+	order := append([]string(nil), builtinEventStages...)
+	middlewares := map[string]EventMiddleware{}
+
+	indexOf := func(name string) int {
+		for idx, stage := range order {
+			if stage == name {
+				return idx
+			}
+		}
+		return -1
+	}
+
+	for _, reg := range registrations {
+		switch {
+		case reg.Name == "":
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an event middleware has no name"))
+		case reg.Middleware == nil:
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("event middleware %s has no function", reg.Name))
+		case reg.Before != "" && reg.After != "":
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("event middleware %s is set both before and after a stage", reg.Name))
+		case indexOf(reg.Name) != -1:
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("event stage %s is already registered", reg.Name))
+		}
+
+		position := indexOf(EventStageStorage)
+		if reg.Before != "" {
+			position = indexOf(reg.Before)
+		} else if reg.After != "" {
+			if position = indexOf(reg.After); position != -1 {
+				position++
+			}
+		}
+
+		if position == -1 {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("event middleware %s refers to an unknown stage", reg.Name))
+		}
+
+		order = append(order[:position], append([]string{reg.Name}, order[position:]...)...)
+		middlewares[reg.Name] = reg.Middleware
+	}
+
+	return order, middlewares, nil
+}
+
+// newEventStages builds the chain of a handler, the middlewares of the service are inserted around the built-in stages
+func (h *eventHandler) newEventStages(order []string, middlewares map[string]EventMiddleware) []eventStage {
+	builtins := map[string]EventMiddleware{
+		EventStageDedup:      h.dedupAppMessage,
+		EventStageValidation: h.rejectInvalidAppMessage,
+		EventStageRateLimit:  h.rateLimitAppMessage,
+		EventStageMetrics:    h.traceAppMessage,
+		EventStageStorage:    h.storeAppMessage,
+	}
+
+	if order == nil {
+		order = builtinEventStages
+	}
+
+	stages := []eventStage(nil)
+	for _, name := range order {
+		middleware, ok := builtins[name]
+		if !ok {
+			middleware = middlewares[name]
+		}
+
+		stages = append(stages, eventStage{name: name, middleware: middleware})
+	}
+
+	return stages
+}
+
+// runEventStages runs an app message through the stages of the chain from the given one
+func (h *eventHandler) runEventStages(evt *AppMessageEvent, stage int) error {
+	if stage >= len(h.stages) {
+		return nil
+	}
+
+	return h.stages[stage].middleware(evt, func() error { return h.runEventStages(evt, stage+1) })
+}
+
+// dedupAppMessage drops the messages already handled, before building the interaction which requires a call to the
+// protocol
+func (h *eventHandler) dedupAppMessage(evt *AppMessageEvent, next func() error) error {
+	if evt.CID == "" {
+		return next()
+	}
+
+	key := eventDedupKey(evt.CID, evt.hash)
+	if !h.dedup.claim(key) {
+		evt.logger.Debug("duplicate app message delivery dropped", zap.String("type", evt.AppMessage.GetType().String()))
+		return nil
+	}
+	defer func() { h.dedup.release(key, evt.handled) }()
+
+	if processed, err := h.db.isEventProcessed(evt.CID, evt.hash); err != nil {
+		return err
+	} else if processed {
+		h.dedup.ledgerHit(key)
+		evt.logger.Debug("app message already processed", zap.String("type", evt.AppMessage.GetType().String()))
+		return nil
+	}
+
+	return next()
+}
+
+// rejectInvalidAppMessage marks the messages rejected by the rules of their type as processed, the rules are checked by
+// the storage in the transaction of the message
+func (h *eventHandler) rejectInvalidAppMessage(evt *AppMessageEvent, next func() error) error {
+	err := next()
+
+	rejection, ok := err.(*appMessageRejection)
+	if !ok {
+		return err
+	}
+
+	// the message stays invalid, it is marked as processed without being handled
+	evt.logger.Warn("rejecting invalid app message", zap.String("type", evt.AppMessage.GetType().String()), zap.String("rule", rejection.rule), zap.String("reason", rejection.reason))
+	h.validation.reject(rejection.rule)
+	evt.rejection = rejection.rule
+
+	if evt.CID != "" {
+		if err := h.db.markEventProcessed(evt.CID, evt.GroupPK, evt.hash, timestampMs(time.Now())); err != nil {
+			return err
+		}
+	}
+
+	evt.handled = true
+	return nil
+}
+
+// rateLimitAppMessage defers or drops the live messages exceeding the rate limits
+func (h *eventHandler) rateLimitAppMessage(evt *AppMessageEvent, next func() error) error {
+	if limited, err := h.rateLimited(&deferredEvent{groupPK: evt.GroupPK, message: evt.Message, am: evt.AppMessage}); err != nil {
+		return err
+	} else if limited {
+		return nil
+	}
+
+	return next()
+}
+
+// traceAppMessage streams the message to the event tap and traces its handling
+func (h *eventHandler) traceAppMessage(evt *AppMessageEvent, next func() error) error {
+	h.tapEvent(&messengertypes.TappedEvent{ConversationPublicKey: evt.GroupPK, CID: evt.CID, Message: evt.Message, AppMessage: evt.AppMessage})
+
+	evt.spanCtx, evt.span = h.startHandleSpan(evt.GroupPK, evt.Message, evt.AppMessage)
+	defer evt.span.End()
+
+	return next()
+}
@@ -0,0 +1,75 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_orderEventMiddlewares(t *testing.T) {
+	noop := func(evt *AppMessageEvent, next func() error) error { return next() }
+
+	order, middlewares, err := orderEventMiddlewares([]EventMiddlewareRegistration{
+		{Name: "compliance", Middleware: noop},
+		{Name: "audit", Before: EventStageDedup, Middleware: noop},
+		{Name: "sampling", After: "audit", Middleware: noop},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"audit", "sampling", EventStageDedup, EventStageValidation, EventStageRateLimit, EventStageMetrics, "compliance", EventStageStorage}, order)
+	require.Len(t, middlewares, 3)
+
+	for _, reg := range []EventMiddlewareRegistration{
+		{Middleware: noop},
+		{Name: "compliance"},
+		{Name: EventStageStorage, Middleware: noop},
+		{Name: "compliance", Before: "unknown", Middleware: noop},
+		{Name: "compliance", Before: EventStageDedup, After: EventStageStorage, Middleware: noop},
+	} {
+		_, _, err := orderEventMiddlewares([]EventMiddlewareRegistration{reg})
+		require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+	}
+}
+
+func Test_eventHandler_runEventStages(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	seen := []string(nil)
+	order, middlewares, err := orderEventMiddlewares([]EventMiddlewareRegistration{
+		{Name: "filter", Before: EventStageDedup, Middleware: func(evt *AppMessageEvent, next func() error) error {
+			if evt.CID == "cid_filtered" {
+				return nil
+			}
+			return next()
+		}},
+		{Name: "compliance", After: EventStageDedup, Middleware: func(evt *AppMessageEvent, next func() error) error {
+			seen = append(seen, evt.CID)
+			return nil
+		}},
+	})
+	require.NoError(t, err)
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+	h.stages = h.newEventStages(order, middlewares)
+
+	am := &messengertypes.AppMessage{Type: messengertypes.AppMessage_TypeUserMessage}
+	handle := func(cid string) {
+		gme := &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{ID: []byte(cid)}, Message: []byte("message")}
+		require.NoError(t, h.runEventStages(&AppMessageEvent{GroupPK: "conv_1", CID: cid, Message: gme, AppMessage: am, hash: processedEventHash(am.GetType().String(), gme.GetMessage()), logger: zap.NewNop()}, 0))
+	}
+
+	hash := processedEventHash(am.GetType().String(), []byte("message"))
+	require.NoError(t, db.markEventProcessed("cid_processed", "conv_1", hash, 1))
+
+	// the middlewares run in the order of the chain, the messages dropped by a stage don't reach the next ones
+	handle("cid_filtered")
+	handle("cid_processed")
+	handle("cid_new")
+	require.Equal(t, []string{"cid_new"}, seen)
+}
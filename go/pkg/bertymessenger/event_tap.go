@@ -0,0 +1,120 @@
+package bertymessenger
+
+import (
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// eventTapBufferSize is the number of handled events kept in memory for the consumers resuming from an offset
+const eventTapBufferSize = 1024
+
+// eventTap buffers the protocol events handled by the messenger, the consumers read them from an offset and are
+// notified when new ones are published
+type eventTap struct {
+	mutex       sync.Mutex
+	events      []*messengertypes.TappedEvent
+	next        uint64
+	subscribers map[chan struct{}]struct{}
+}
+
+func newEventTap(size int) *eventTap {
+	return &eventTap{
+		events:      make([]*messengertypes.TappedEvent, size),
+		next:        1,
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// publish assigns the next offset to an event and notifies the consumers, the oldest event is dropped when the
+// buffer is full
+func (t *eventTap) publish(evt *messengertypes.TappedEvent) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	evt.Offset = t.next
+	t.events[(t.next-1)%uint64(len(t.events))] = evt
+	t.next++
+
+	for notify := range t.subscribers {
+		select {
+		case notify <- struct{}{}:
+		default: // already notified
+		}
+	}
+}
+
+// oldest returns the offset of the oldest buffered event
+func (t *eventTap) oldest() uint64 {
+	if size := uint64(len(t.events)); t.next > size {
+		return t.next - size
+	}
+
+	return 1
+}
+
+// since returns the buffered events more recent than an offset, and the number of events more recent than it which
+// have already been dropped
+func (t *eventTap) since(offset uint64) ([]*messengertypes.TappedEvent, uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	first, missed := offset+1, uint64(0)
+	if oldest := t.oldest(); first < oldest {
+		missed = oldest - first
+		first = oldest
+	}
+
+	events := []*messengertypes.TappedEvent(nil)
+	for o := first; o < t.next; o++ {
+		events = append(events, t.events[(o-1)%uint64(len(t.events))])
+	}
+
+	return events, missed
+}
+
+func (t *eventTap) subscribe() (<-chan struct{}, func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	notify := make(chan struct{}, 1)
+	t.subscribers[notify] = struct{}{}
+
+	return notify, func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		delete(t.subscribers, notify)
+	}
+}
+
+func (svc *service) EventTap(req *messengertypes.EventTap_Request, sub messengertypes.MessengerService_EventTapServer) error {
+	// subscribe before reading the buffer so no event is missed
+	notify, unsubscribe := svc.eventTap.subscribe()
+	defer unsubscribe()
+
+	cursor, missed := req.GetSinceOffset(), uint64(0)
+	for {
+		events, dropped := svc.eventTap.since(cursor)
+		missed += dropped
+
+		for _, evt := range events {
+			cursor = evt.GetOffset()
+
+			if convPK := req.GetConversationPublicKey(); convPK != "" && evt.GetConversationPublicKey() != convPK {
+				continue
+			}
+
+			if err := sub.Send(&messengertypes.EventTap_Reply{Event: evt, Missed: missed}); err != nil {
+				return err
+			}
+			missed = 0
+		}
+
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case <-notify:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventTap_since(t *testing.T) {
+	tap := newEventTap(3)
+
+	events, missed := tap.since(0)
+	require.Empty(t, events)
+	require.Equal(t, uint64(0), missed)
+
+	for _, convPK := range []string{"conv_1", "conv_2"} {
+		tap.publish(&messengertypes.TappedEvent{ConversationPublicKey: convPK})
+	}
+
+	events, missed = tap.since(0)
+	require.Len(t, events, 2)
+	require.Equal(t, uint64(1), events[0].GetOffset())
+	require.Equal(t, uint64(0), missed)
+
+	events, _ = tap.since(1)
+	require.Len(t, events, 1)
+	require.Equal(t, "conv_2", events[0].GetConversationPublicKey())
+
+	// the oldest events are dropped once the buffer is full
+	for _, convPK := range []string{"conv_3", "conv_4", "conv_5"} {
+		tap.publish(&messengertypes.TappedEvent{ConversationPublicKey: convPK})
+	}
+
+	events, missed = tap.since(1)
+	require.Len(t, events, 3)
+	require.Equal(t, uint64(3), events[0].GetOffset())
+	require.Equal(t, "conv_5", events[2].GetConversationPublicKey())
+	require.Equal(t, uint64(1), missed)
+
+	events, missed = tap.since(5)
+	require.Empty(t, events)
+	require.Equal(t, uint64(0), missed)
+}
+
+type eventTapTestServer struct {
+	grpc.ServerStream
+	ctx     context.Context
+	replies chan *messengertypes.EventTap_Reply
+}
+
+func (s *eventTapTestServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *eventTapTestServer) Send(reply *messengertypes.EventTap_Reply) error {
+	s.replies <- reply
+	return nil
+}
+
+func Test_service_EventTap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	svc := &service{eventTap: newEventTap(2)}
+	for _, convPK := range []string{"conv_1", "conv_2", "conv_1"} {
+		svc.eventTap.publish(&messengertypes.TappedEvent{ConversationPublicKey: convPK})
+	}
+
+	sub := &eventTapTestServer{ctx: ctx, replies: make(chan *messengertypes.EventTap_Reply, 10)}
+	done := make(chan error)
+	go func() {
+		done <- svc.EventTap(&messengertypes.EventTap_Request{ConversationPublicKey: "conv_1"}, sub)
+	}()
+
+	receive := func() *messengertypes.EventTap_Reply {
+		select {
+		case reply := <-sub.replies:
+			return reply
+		case <-time.After(time.Second):
+			require.FailNow(t, "no event received")
+			return nil
+		}
+	}
+
+	// the first event has been dropped, the second one belongs to another conversation
+	reply := receive()
+	require.Equal(t, uint64(3), reply.GetEvent().GetOffset())
+	require.Equal(t, uint64(1), reply.GetMissed())
+
+	svc.eventTap.publish(&messengertypes.TappedEvent{ConversationPublicKey: "conv_2"})
+	svc.eventTap.publish(&messengertypes.TappedEvent{ConversationPublicKey: "conv_1"})
+
+	reply = receive()
+	require.Equal(t, uint64(5), reply.GetEvent().GetOffset())
+	require.Equal(t, uint64(0), reply.GetMissed())
+
+	cancel()
+	require.NoError(t, <-done)
+}
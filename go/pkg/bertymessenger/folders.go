@@ -0,0 +1,186 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const folderNameMaxLength = 64
+
+// validateFolderName returns the name of a folder without the surrounding spaces
+func validateFolderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errcode.ErrMissingInput.Wrap(fmt.Errorf("a folder name is required"))
+	}
+
+	if len(name) > folderNameMaxLength {
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("the folder name is longer than %d bytes", folderNameMaxLength))
+	}
+
+	return name, nil
+}
+
+func (svc *service) dispatchConversationsUpdated(convs []*messengertypes.Conversation) error {
+	for _, conv := range convs {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return errcode.TODO.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) ConversationFolderCreate(ctx context.Context, req *messengertypes.ConversationFolderCreate_Request) (*messengertypes.ConversationFolderCreate_Reply, error) {
+	name, err := validateFolderName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(16)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	folder := &messengertypes.ConversationFolder{
+		ID:          b64EncodeBytes(id),
+		Name:        name,
+		CreatedDate: timestampMs(time.Now()),
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.addConversationFolder(folder); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationFolderCreate_Reply{Folder: folder}, nil
+}
+
+func (svc *service) ConversationFolderRename(ctx context.Context, req *messengertypes.ConversationFolderRename_Request) (*messengertypes.ConversationFolderRename_Reply, error) {
+	if req.GetFolderID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	name, err := validateFolderName(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	folder, err := svc.db.renameConversationFolder(req.GetFolderID(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationFolderRename_Reply{Folder: folder}, nil
+}
+
+func (svc *service) ConversationFolderDelete(ctx context.Context, req *messengertypes.ConversationFolderDelete_Request) (*messengertypes.ConversationFolderDelete_Reply, error) {
+	if req.GetFolderID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	convs, err := svc.db.deleteConversationFolder(req.GetFolderID())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatchConversationsUpdated(convs); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationFolderDelete_Reply{}, nil
+}
+
+func (svc *service) ConversationFolderList(ctx context.Context, req *messengertypes.ConversationFolderList_Request) (*messengertypes.ConversationFolderList_Reply, error) {
+	folders, err := svc.db.getConversationFolders()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationFolderList_Reply{Folders: folders}, nil
+}
+
+func (svc *service) ConversationSetFolder(ctx context.Context, req *messengertypes.ConversationSetFolder_Request) (*messengertypes.ConversationSetFolder_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.setConversationFolder(req.GetConversationPublicKey(), req.GetFolderID())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatchConversationsUpdated([]*messengertypes.Conversation{conv}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetFolder_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) ConversationSetPinnedOrder(ctx context.Context, req *messengertypes.ConversationSetPinnedOrder_Request) (*messengertypes.ConversationSetPinnedOrder_Reply, error) {
+	defer svc.writer.enter()()
+
+	convs, err := svc.db.setConversationsPinnedOrder(req.GetConversationPublicKeys())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatchConversationsUpdated(convs); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetPinnedOrder_Reply{}, nil
+}
+
+func (svc *service) ConversationSetSortOrder(ctx context.Context, req *messengertypes.ConversationSetSortOrder_Request) (*messengertypes.ConversationSetSortOrder_Reply, error) {
+	if _, ok := messengertypes.Account_ConversationSortOrder_name[int32(req.GetSortOrder())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown sort order %d", req.GetSortOrder()))
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountConversationSortOrder(acc.GetPublicKey(), req.GetSortOrder()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.ConversationSetSortOrder_Reply{}, nil
+}
+
+func (svc *service) ConversationList(ctx context.Context, req *messengertypes.ConversationList_Request) (*messengertypes.ConversationList_Reply, error) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	convs, err := svc.db.getSortedConversations(req.GetFolderID(), acc.GetConversationSortOrder())
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ConversationList_Reply{Conversations: convs}
+	applyNicknames(reply)
+
+	return reply, nil
+}
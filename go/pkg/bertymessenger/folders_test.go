@@ -0,0 +1,104 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_validateFolderName(t *testing.T) {
+	name, err := validateFolderName("  Work ")
+	require.NoError(t, err)
+	require.Equal(t, "Work", name)
+
+	_, err = validateFolderName("   ")
+	require.Error(t, err)
+}
+
+func Test_dbWrapper_conversationFolders(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addConversationFolder(&messengertypes.ConversationFolder{ID: "work", Name: "Work", CreatedDate: 1}))
+	require.NoError(t, db.addConversationFolder(&messengertypes.ConversationFolder{ID: "family", Name: "Family", CreatedDate: 2}))
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", UnreadCount: 2})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", UnreadCount: 3})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_3", UnreadCount: 5})
+
+	_, err := db.setConversationFolder("conv_1", "unknown")
+	require.Error(t, err)
+
+	for _, pk := range []string{"conv_1", "conv_2"} {
+		conv, err := db.setConversationFolder(pk, "work")
+		require.NoError(t, err)
+		require.Equal(t, "work", conv.GetFolderID())
+	}
+
+	folders, err := db.getConversationFolders()
+	require.NoError(t, err)
+	require.Len(t, folders, 2)
+	require.Equal(t, "work", folders[0].GetID())
+	require.Equal(t, int32(5), folders[0].GetUnreadCount())
+	require.Equal(t, int32(0), folders[1].GetUnreadCount())
+
+	folder, err := db.renameConversationFolder("family", "Home")
+	require.NoError(t, err)
+	require.Equal(t, "Home", folder.GetName())
+
+	// the conversations of a deleted folder are moved out of it
+	convs, err := db.deleteConversationFolder("work")
+	require.NoError(t, err)
+	require.Len(t, convs, 2)
+	for _, conv := range convs {
+		require.Empty(t, conv.GetFolderID())
+	}
+
+	_, err = db.deleteConversationFolder("work")
+	require.Error(t, err)
+}
+
+func Test_dbWrapper_getSortedConversations(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", LastUpdate: 1})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", LastUpdate: 2})
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_3", LastUpdate: 3})
+
+	_, err := db.setConversationsPinnedOrder([]string{"conv_1", "conv_1"})
+	require.Error(t, err)
+	_, err = db.setConversationsPinnedOrder([]string{"conv_unknown"})
+	require.Error(t, err)
+
+	changed, err := db.setConversationsPinnedOrder([]string{"conv_2", "conv_1"})
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+
+	publicKeys := func(convs []*messengertypes.Conversation) []string {
+		pks := []string(nil)
+		for _, conv := range convs {
+			pks = append(pks, conv.GetPublicKey())
+		}
+		return pks
+	}
+
+	convs, err := db.getSortedConversations("", messengertypes.Account_SortLastActivity)
+	require.NoError(t, err)
+	require.Equal(t, []string{"conv_3", "conv_2", "conv_1"}, publicKeys(convs))
+
+	convs, err = db.getSortedConversations("", messengertypes.Account_SortManual)
+	require.NoError(t, err)
+	require.Equal(t, []string{"conv_2", "conv_1", "conv_3"}, publicKeys(convs))
+
+	// the conversations left out are unpinned
+	changed, err = db.setConversationsPinnedOrder([]string{"conv_1"})
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+
+	convs, err = db.getSortedConversations("", messengertypes.Account_SortManual)
+	require.NoError(t, err)
+	require.Equal(t, []string{"conv_1", "conv_3", "conv_2"}, publicKeys(convs))
+}
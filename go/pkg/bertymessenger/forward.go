@@ -0,0 +1,220 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// forwardedUserMessage returns the message sent in place of a forwarded one, the mentions only make sense in the
+// original conversation and are dropped
+func forwardedUserMessage(i *messengertypes.Interaction, um *messengertypes.AppMessage_UserMessage, cids map[string]string) *messengertypes.AppMessage_UserMessage {
+	provenance := &messengertypes.AppMessage_UserMessage_Forwarded{
+		OriginalSentDate: i.GetSentDate(),
+		ForwardCount:     um.GetForwarded().GetForwardCount() + 1,
+	}
+	if date := um.GetForwarded().GetOriginalSentDate(); date != 0 {
+		provenance.OriginalSentDate = date
+	}
+
+	previews := make([]*messengertypes.LinkPreview, len(um.GetLinkPreviews()))
+	for idx, preview := range um.GetLinkPreviews() {
+		previews[idx] = &messengertypes.LinkPreview{
+			Url:          preview.GetUrl(),
+			Title:        preview.GetTitle(),
+			Description:  preview.GetDescription(),
+			SiteName:     preview.GetSiteName(),
+			ThumbnailCID: cids[preview.GetThumbnailCID()],
+		}
+	}
+
+	return &messengertypes.AppMessage_UserMessage{
+		Body:         um.GetBody(),
+		LinkPreviews: previews,
+		Forwarded:    provenance,
+		Formatting:   um.GetFormatting(),
+	}
+}
+
+// recryptMedias prepares the medias of a forwarded message again, the attachments are encrypted with new keys so the
+// target conversation can't be linked to the original one. It returns the new medias and their cids by original cid
+func (svc *service) recryptMedias(medias []*messengertypes.Media) ([]*messengertypes.Media, map[string]string, error) {
+	recrypted := make([]*messengertypes.Media, len(medias))
+	cids := make(map[string]string, len(medias))
+
+	for idx, media := range medias {
+		if !isMediaAvailable(media) {
+			return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the media %s must be downloaded before being forwarded", media.GetCID()))
+		}
+
+		attachment, err := svc.mediaContentRetrieve(media)
+		if err != nil {
+			return nil, nil, errcode.ErrAttachmentRetrieve.Wrap(err)
+		}
+
+		cidBytes, err := svc.attachmentPrepare(attachment)
+		attachment.Close()
+		if err != nil {
+			return nil, nil, errcode.ErrAttachmentPrepare.Wrap(err)
+		}
+
+		recrypted[idx] = &messengertypes.Media{
+			CID:         b64EncodeBytes(cidBytes),
+			MimeType:    media.GetMimeType(),
+			Filename:    media.GetFilename(),
+			DisplayName: media.GetDisplayName(),
+			Size_:       media.GetSize_(),
+			Kind:        media.GetKind(),
+			DurationMs:  media.GetDurationMs(),
+			Waveform:    media.GetWaveform(),
+			State:       messengertypes.Media_StatePrepared,
+			Checksum:    media.GetChecksum(),
+		}
+		cids[media.GetCID()] = recrypted[idx].GetCID()
+	}
+
+	return recrypted, cids, nil
+}
+
+func (svc *service) InteractionForward(ctx context.Context, req *messengertypes.InteractionForward_Request) (*messengertypes.InteractionForward_Reply, error) {
+	if req.GetCID() == "" || req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := svc.forwardMessages(ctx, []string{req.GetCID()}, req.GetConversationPublicKey(), func(medias []*messengertypes.Media) {
+		for _, media := range medias {
+			if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, true); err != nil {
+				svc.logger.Error("unable to dispatch notification for media", zap.String("cid", media.GetCID()), zap.Error(err))
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionForward_Reply{}, nil
+}
+
+func (svc *service) InteractionForwardMultiple(ctx context.Context, req *messengertypes.InteractionForwardMultiple_Request) (*messengertypes.InteractionForwardMultiple_Reply, error) {
+	if len(req.GetCIDs()) == 0 || req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if len(req.GetCIDs()) > bulkOperationMaxCount {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d messages can be forwarded at once", bulkOperationMaxCount))
+	}
+
+	if err := svc.forwardMessages(ctx, req.GetCIDs(), req.GetConversationPublicKey(), func(medias []*messengertypes.Media) {
+		if len(medias) == 0 {
+			return
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeBatchUpdated, &messengertypes.StreamEvent_BatchUpdated{Medias: medias}, true); err != nil {
+			svc.logger.Error("unable to dispatch notification for medias", zap.Int("count", len(medias)), zap.Error(err))
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionForwardMultiple_Reply{}, nil
+}
+
+// forwardMessages sends the user messages in order to a conversation, they are all checked before the first one is
+// sent. The medias added to the database are passed to dispatchMedias before the messages are sent
+func (svc *service) forwardMessages(ctx context.Context, cids []string, convPK string, dispatchMedias func(medias []*messengertypes.Media)) error {
+	ctx, span := svc.startSendSpan(ctx, convPK, messengertypes.AppMessage_TypeUserMessage)
+	defer span.End()
+
+	interactions := make([]*messengertypes.Interaction, len(cids))
+	messages := make([]*messengertypes.AppMessage_UserMessage, len(cids))
+	if err := func() error {
+		defer svc.writer.enter()()
+
+		if _, err := svc.db.getConversationByPK(convPK); err != nil {
+			return errcode.ErrNotFound.Wrap(err)
+		}
+
+		for idx, cid := range cids {
+			i, err := svc.db.getInteractionByCID(cid)
+			if err != nil {
+				return errcode.ErrNotFound.Wrap(err)
+			}
+
+			if i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+				return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the user messages can be forwarded"))
+			}
+
+			payload, err := i.UnmarshalPayload()
+			if err != nil {
+				return errcode.ErrDeserialization.Wrap(err)
+			}
+
+			interactions[idx], messages[idx] = i, payload.(*messengertypes.AppMessage_UserMessage)
+		}
+
+		return nil
+	}(); err != nil {
+		return err
+	}
+
+	// the attachments are transferred without holding the lock, as in MediaPrepare
+	medias := make([][]*messengertypes.Media, len(cids))
+	mediaCIDs := make([]map[string]string, len(cids))
+	for idx, i := range interactions {
+		var err error
+		if medias[idx], mediaCIDs[idx], err = svc.recryptMedias(i.GetMedias()); err != nil {
+			return err
+		}
+	}
+
+	gpk, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	allMedias := []*messengertypes.Media(nil)
+	for _, m := range medias {
+		allMedias = append(allMedias, m...)
+	}
+
+	added, err := svc.db.addMedias(allMedias)
+	if err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	addedMedias := []*messengertypes.Media(nil)
+	for idx, media := range allMedias {
+		if added[idx] {
+			addedMedias = append(addedMedias, media)
+		}
+	}
+	dispatchMedias(addedMedias)
+
+	for idx, i := range interactions {
+		attachmentCIDs := make([][]byte, len(medias[idx]))
+		for j, media := range medias[idx] {
+			if attachmentCIDs[j], err = b64DecodeBytes(media.GetCID()); err != nil {
+				return errcode.ErrDeserialization.Wrap(err)
+			}
+		}
+
+		// the client extensions are forwarded along with the message
+		am, err := messengertypes.AppMessage_TypeUserMessage.MarshalExtendedPayload(timestampMs(time.Now()), medias[idx], forwardedUserMessage(i, messages[idx], mediaCIDs[idx]), false, i.ExtensionsMap())
+		if err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: am, AttachmentCIDs: attachmentCIDs}); err != nil {
+			return errcode.ErrProtocolSend.Wrap(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_forwardedUserMessage(t *testing.T) {
+	i := &messengertypes.Interaction{SentDate: 100}
+	um := &messengertypes.AppMessage_UserMessage{
+		Body:         "meeting at noon",
+		LinkPreviews: []*messengertypes.LinkPreview{{Url: "https://berty.tech", ThumbnailCID: "thumbnail_1"}},
+		Mentions:     []*messengertypes.AppMessage_UserMessage_Mention{{MemberPublicKey: "member_1"}},
+	}
+
+	forwarded := forwardedUserMessage(i, um, map[string]string{"thumbnail_1": "thumbnail_2"})
+	require.Equal(t, "meeting at noon", forwarded.GetBody())
+	require.Empty(t, forwarded.GetMentions())
+	require.Equal(t, "thumbnail_2", forwarded.GetLinkPreviews()[0].GetThumbnailCID())
+	require.Equal(t, int64(100), forwarded.GetForwarded().GetOriginalSentDate())
+	require.Equal(t, uint32(1), forwarded.GetForwarded().GetForwardCount())
+
+	// the provenance of a message forwarded again is kept
+	again := forwardedUserMessage(&messengertypes.Interaction{SentDate: 200}, forwarded, nil)
+	require.Equal(t, int64(100), again.GetForwarded().GetOriginalSentDate())
+	require.Equal(t, uint32(2), again.GetForwarded().GetForwardCount())
+	require.Empty(t, again.GetLinkPreviews()[0].GetThumbnailCID())
+}
+
+func Test_service_recryptMedias(t *testing.T) {
+	svc := &service{}
+
+	medias, cids, err := svc.recryptMedias(nil)
+	require.NoError(t, err)
+	require.Empty(t, medias)
+	require.Empty(t, cids)
+
+	// the medias not downloaded yet can't be forwarded
+	_, _, err = svc.recryptMedias([]*messengertypes.Media{{CID: "media_1", State: messengertypes.Media_StateNeverDownloaded}})
+	require.Error(t, err)
+
+	require.True(t, isMediaAvailable(&messengertypes.Media{State: messengertypes.Media_StateDownloaded}))
+	require.False(t, isMediaAvailable(&messengertypes.Media{State: messengertypes.Media_StatePruned}))
+}
@@ -0,0 +1,255 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// groupAuditLogMaxCount bounds the number of events returned by a page of ConversationAuditLog
+const groupAuditLogMaxCount = 200
+
+// The audit log of a group is assembled by the event handler from the membership and moderation events of its logs,
+// the events already known are skipped when the logs are replayed. The moderation messages are recorded once they
+// are allowed, even when a more recent change made them obsolete. The metadata events are not dated, the joins are
+// dated by their first handling.
+
+// addGroupAuditEvent records a moderation message of a group in its audit log, the sender is the actor
+func (h *eventHandler) addGroupAuditEvent(tx *dbWrapper, i *messengertypes.Interaction, t messengertypes.GroupAuditEvent_Type, targetPK, details string) error {
+	if i.GetCID() == "" {
+		return nil
+	}
+
+	_, err := tx.addGroupAuditEvent(&messengertypes.GroupAuditEvent{
+		ID:                    i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Type:                  t,
+		ActorMemberPublicKey:  interactionSenderMemberPK(i),
+		TargetMemberPublicKey: targetPK,
+		Date:                  i.GetSentDate(),
+		Details:               details,
+	})
+
+	return err
+}
+
+// addGroupMembershipAuditEvent records the creation of a group or the first device of a member
+func (h *eventHandler) addGroupMembershipAuditEvent(gme *protocoltypes.GroupMetadataEvent, t messengertypes.GroupAuditEvent_Type, memberPK string) {
+	cid := eventCID(gme.GetEventContext())
+	if cid == "" {
+		return
+	}
+
+	if _, err := h.db.addGroupAuditEvent(&messengertypes.GroupAuditEvent{
+		ID:                    cid,
+		ConversationPublicKey: b64EncodeBytes(gme.GetEventContext().GetGroupPK()),
+		Type:                  t,
+		ActorMemberPublicKey:  memberPK,
+		TargetMemberPublicKey: memberPK,
+		Date:                  timestampMs(time.Now()),
+	}); err != nil {
+		h.logger.Error("unable to add the audit event", zap.String("type", t.String()), zap.String("member-pk", memberPK), zap.Error(err))
+	}
+}
+
+// addGroupInvitationLinkAuditEvent records a change of an invitation link made by this device
+func (svc *service) addGroupInvitationLinkAuditEvent(invitation *messengertypes.GroupInvitationLink, t messengertypes.GroupAuditEvent_Type, date int64) error {
+	conv, err := svc.db.getConversationByPK(invitation.GetConversationPublicKey())
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	_, err = svc.db.addGroupAuditEvent(&messengertypes.GroupAuditEvent{
+		ID:                    fmt.Sprintf("%s/%s", invitation.GetID(), t.String()),
+		ConversationPublicKey: conv.GetPublicKey(),
+		Type:                  t,
+		ActorMemberPublicKey:  conv.GetAccountMemberPublicKey(),
+		Date:                  date,
+		Details:               invitation.GetID(),
+	})
+
+	return err
+}
+
+func (svc *service) ConversationAuditLog(ctx context.Context, req *messengertypes.ConversationAuditLog_Request) (*messengertypes.ConversationAuditLog_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	for _, t := range req.GetTypes() {
+		if _, ok := messengertypes.GroupAuditEvent_Type_name[int32(t)]; !ok {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown audit event type %d", t))
+		}
+	}
+
+	count := int(req.GetCount())
+	if count == 0 || count > groupAuditLogMaxCount {
+		count = groupAuditLogMaxCount
+	}
+
+	cursor, err := decodeGroupAuditCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	// one more event is read to know whether there is a next page
+	events, err := svc.db.getGroupAuditEvents(req.GetConversationPublicKey(), req.GetTypes(), cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.ConversationAuditLog_Reply{Events: events}
+	if len(events) > count {
+		reply.Events = events[:count]
+		if reply.NextCursor, err = encodeGroupAuditCursor(events[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+type groupAuditExport struct {
+	PublicKey   string                   `json:"public_key"`
+	DisplayName string                   `json:"display_name"`
+	ExportDate  string                   `json:"export_date"`
+	Events      []*groupAuditExportEvent `json:"events"`
+}
+
+type groupAuditExportEvent struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Date      string `json:"date"`
+	Actor     string `json:"actor,omitempty"`
+	ActorKey  string `json:"actor_public_key,omitempty"`
+	Target    string `json:"target,omitempty"`
+	TargetKey string `json:"target_public_key,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// buildGroupAuditExport reads the audit log of a group between since and until, the oldest events first
+func buildGroupAuditExport(db *dbWrapper, convPK string, since, until int64, now time.Time) (*groupAuditExport, error) {
+	conv, err := db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	events, err := db.getGroupAuditEvents(convPK, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := db.getMembersByConversation(convPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	names := map[string]string{}
+	for _, member := range members {
+		names[member.GetPublicKey()] = member.GetDisplayName()
+	}
+
+	export := &groupAuditExport{
+		PublicKey:   conv.GetPublicKey(),
+		DisplayName: conv.GetDisplayName(),
+		ExportDate:  now.UTC().Format(time.RFC3339),
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.GetDate() < since || (until != 0 && event.GetDate() >= until) {
+			continue
+		}
+
+		export.Events = append(export.Events, &groupAuditExportEvent{
+			ID:        event.GetID(),
+			Type:      strings.TrimPrefix(event.GetType().String(), "Type"),
+			Date:      formatExportDate(event.GetDate()),
+			Actor:     names[event.GetActorMemberPublicKey()],
+			ActorKey:  event.GetActorMemberPublicKey(),
+			Target:    names[event.GetTargetMemberPublicKey()],
+			TargetKey: event.GetTargetMemberPublicKey(),
+			Details:   event.GetDetails(),
+		})
+	}
+
+	return export, nil
+}
+
+func writeGroupAuditExport(w io.Writer, export *groupAuditExport, format messengertypes.ConversationAuditLogExport_Format) error {
+	switch format {
+	case messengertypes.ConversationAuditLogExport_FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(export); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+	case messengertypes.ConversationAuditLogExport_FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"date", "type", "actor", "actor_public_key", "target", "target_public_key", "details", "id"}); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		for _, event := range export.Events {
+			if err := writer.Write([]string{event.Date, event.Type, event.Actor, event.ActorKey, event.Target, event.TargetKey, event.Details, event.ID}); err != nil {
+				return errcode.ErrSerialization.Wrap(err)
+			}
+		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+	default:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", format))
+	}
+
+	return nil
+}
+
+func (svc *service) ConversationAuditLogExport(ctx context.Context, req *messengertypes.ConversationAuditLogExport_Request) (*messengertypes.ConversationAuditLogExport_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if _, ok := messengertypes.ConversationAuditLogExport_Format_name[int32(req.GetFormat())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown export format %d", req.GetFormat()))
+	}
+
+	if req.GetSince() < 0 || req.GetUntil() < 0 || (req.GetUntil() != 0 && req.GetUntil() <= req.GetSince()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid date range"))
+	}
+
+	export, err := func() (*groupAuditExport, error) {
+		defer svc.writer.enter()()
+
+		return buildGroupAuditExport(svc.db, req.GetConversationPublicKey(), req.GetSince(), req.GetUntil(), time.Now())
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	document := &bytes.Buffer{}
+	if err := writeGroupAuditExport(document, export, req.GetFormat()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationAuditLogExport_Reply{Document: document.Bytes(), EventCount: int64(len(export.Events))}, nil
+}
@@ -0,0 +1,121 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_groupAuditEvents(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+
+	// the messages of a regular member are not recorded
+	_, _, err = h.handleAppMessageRemoveMember(db, &messengertypes.Interaction{CID: "cid_1", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", SentDate: 1000}, &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_2"})
+	require.NoError(t, err)
+
+	_, _, err = h.handleAppMessageRemoveMember(db, &messengertypes.Interaction{CID: "cid_2", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_admin", SentDate: 2000}, &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_2"})
+	require.NoError(t, err)
+
+	_, _, err = h.handleAppMessageRemoveMember(db, &messengertypes.Interaction{CID: "cid_3", Conversation: conv, ConversationPublicKey: "conv_1", IsMe: true, SentDate: 3000}, &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_me"})
+	require.NoError(t, err)
+
+	// a replayed message is recorded once
+	_, _, err = h.handleAppMessageRemoveMember(db, &messengertypes.Interaction{CID: "cid_2", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_admin", SentDate: 2000}, &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_2"})
+	require.NoError(t, err)
+
+	events, err := db.getGroupAuditEvents("conv_1", nil, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, messengertypes.GroupAuditEvent_TypeMemberLeft, events[0].GetType())
+	require.Equal(t, "member_me", events[0].GetActorMemberPublicKey())
+	require.Equal(t, messengertypes.GroupAuditEvent_TypeMemberRemoved, events[1].GetType())
+	require.Equal(t, "member_admin", events[1].GetActorMemberPublicKey())
+	require.Equal(t, "member_2", events[1].GetTargetMemberPublicKey())
+}
+
+func Test_service_ConversationAuditLog(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, DisplayName: "group"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Member{PublicKey: "member_1", ConversationPublicKey: "conv_1", DisplayName: "alice"}).Error)
+	for _, event := range []*messengertypes.GroupAuditEvent{
+		{ID: "cid_1", Type: messengertypes.GroupAuditEvent_TypeGroupCreated, ActorMemberPublicKey: "member_1", Date: 1000},
+		{ID: "cid_2", Type: messengertypes.GroupAuditEvent_TypeMemberJoined, ActorMemberPublicKey: "member_2", TargetMemberPublicKey: "member_2", Date: 2000},
+		{ID: "cid_3", Type: messengertypes.GroupAuditEvent_TypeGroupInfoChanged, ActorMemberPublicKey: "member_1", Date: 3000, Details: "group, renamed"},
+		{ID: "cid_4", Type: messengertypes.GroupAuditEvent_TypeMemberRemoved, ActorMemberPublicKey: "member_1", TargetMemberPublicKey: "member_2", Date: 3000},
+	} {
+		event.ConversationPublicKey = "conv_1"
+		added, err := db.addGroupAuditEvent(event)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	_, err := svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{})
+	require.Error(t, err)
+
+	_, err = svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{ConversationPublicKey: "conv_unknown"})
+	require.Error(t, err)
+
+	// the events of the same date are ordered by id
+	reply, err := svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{ConversationPublicKey: "conv_1", Count: 3})
+	require.NoError(t, err)
+	require.Len(t, reply.GetEvents(), 3)
+	require.Equal(t, "cid_4", reply.GetEvents()[0].GetID())
+	require.NotEmpty(t, reply.GetNextCursor())
+
+	reply, err = svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{ConversationPublicKey: "conv_1", Count: 3, Cursor: reply.GetNextCursor()})
+	require.NoError(t, err)
+	require.Len(t, reply.GetEvents(), 1)
+	require.Equal(t, "cid_1", reply.GetEvents()[0].GetID())
+	require.Empty(t, reply.GetNextCursor())
+
+	reply, err = svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{ConversationPublicKey: "conv_1", Types: []messengertypes.GroupAuditEvent_Type{messengertypes.GroupAuditEvent_TypeMemberJoined}})
+	require.NoError(t, err)
+	require.Len(t, reply.GetEvents(), 1)
+	require.Equal(t, "cid_2", reply.GetEvents()[0].GetID())
+
+	_, err = svc.ConversationAuditLog(context.Background(), &messengertypes.ConversationAuditLog_Request{ConversationPublicKey: "conv_1", Cursor: "invalid"})
+	require.Error(t, err)
+
+	// the export lists the oldest events first, with the names of the members
+	export, err := svc.ConversationAuditLogExport(context.Background(), &messengertypes.ConversationAuditLogExport_Request{ConversationPublicKey: "conv_1", Since: 2000})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), export.GetEventCount())
+
+	document := &groupAuditExport{}
+	require.NoError(t, json.Unmarshal(export.GetDocument(), document))
+	require.Equal(t, "group", document.DisplayName)
+	require.Equal(t, "MemberJoined", document.Events[0].Type)
+	require.Equal(t, "alice", document.Events[1].Actor)
+
+	export, err = svc.ConversationAuditLogExport(context.Background(), &messengertypes.ConversationAuditLogExport_Request{ConversationPublicKey: "conv_1", Format: messengertypes.ConversationAuditLogExport_FormatCSV})
+	require.NoError(t, err)
+
+	records, err := csv.NewReader(strings.NewReader(string(export.GetDocument()))).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	require.Equal(t, "group, renamed", records[3][6])
+
+	_, err = svc.ConversationAuditLogExport(context.Background(), &messengertypes.ConversationAuditLogExport_Request{ConversationPublicKey: "conv_1", Format: 42})
+	require.Error(t, err)
+}
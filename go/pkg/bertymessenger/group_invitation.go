@@ -0,0 +1,222 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/bertylinks"
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const groupInvitationIDSize = 16
+
+// handleAppMessageGroupInvitationLinkUsed counts the uses of the invitation links created by this node,
+// the members who joined with an expired, revoked or exhausted link, or who joined a full group, are removed from the
+// group
+func (h *eventHandler) handleAppMessageGroupInvitationLinkUsed(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_GroupInvitationLinkUsed)
+
+	if i.GetIsMe() || payload.GetInvitationID() == "" {
+		return i, false, nil
+	}
+
+	invitation, err := tx.getGroupInvitationLink(payload.GetInvitationID())
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		// the invitation has been created by another member
+		return i, false, nil
+	case err != nil:
+		return nil, false, err
+	}
+
+	if invitation.GetConversationPublicKey() != i.GetConversationPublicKey() {
+		h.logger.Warn("ignoring invitation link used in another group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if i.GetMemberPublicKey() == "" {
+		h.logger.Warn("ignoring invitation link used by an unknown member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	overCapacity, err := isGroupOverCapacity(tx, i.GetConversation())
+	if err != nil {
+		return nil, false, err
+	}
+
+	use := &messengertypes.GroupInvitationLinkUse{
+		InvitationID:    invitation.GetID(),
+		MemberPublicKey: i.GetMemberPublicKey(),
+		UsedDate:        i.GetSentDate(),
+		Rejected:        overCapacity || !isGroupInvitationLinkUsable(invitation, i.GetSentDate()),
+	}
+
+	added, err := tx.addGroupInvitationLinkUse(use)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeInvitationLinkUsed, use.GetMemberPublicKey(), invitation.GetID()); err != nil {
+		return nil, false, err
+	}
+
+	// the removal is stored in the group log, it doesn't need to be sent again when replaying it
+	if added && use.GetRejected() && !h.replay && h.svc != nil {
+		h.logger.Info("removing member who joined with an invalid invitation link", zap.String("invitation-id", invitation.GetID()), zap.String("member-pk", use.GetMemberPublicKey()))
+		go h.svc.removeGroupMemberAsync(use.GetMemberPublicKey(), i.GetConversationPublicKey())
+	}
+
+	return i, false, nil
+}
+
+// isGroupInvitationLinkUsable checks the limits of an invitation link at the given date
+func isGroupInvitationLinkUsable(invitation *messengertypes.GroupInvitationLink, date int64) bool {
+	if invitation.GetRevokedDate() != 0 && date >= invitation.GetRevokedDate() {
+		return false
+	}
+
+	if invitation.GetExpiresAt() != 0 && date > invitation.GetExpiresAt() {
+		return false
+	}
+
+	if invitation.GetMaxUses() == 0 {
+		return true
+	}
+
+	accepted := int32(0)
+	for _, use := range invitation.GetUses() {
+		if !use.GetRejected() {
+			accepted++
+		}
+	}
+
+	return accepted < invitation.GetMaxUses()
+}
+
+func (svc *service) removeGroupMemberAsync(memberPK, convPK string) {
+	defer svc.writer.enter()()
+
+	if err := svc.removeGroupMember(svc.ctx, convPK, memberPK); err != nil {
+		svc.logger.Error("unable to remove group member", logGroup(convPK), zap.String("member-pk", memberPK), zap.Error(err))
+	}
+}
+
+func (svc *service) createGroupInvitationLink(ctx context.Context, req *messengertypes.GroupInvitationCreate_Request) (*messengertypes.GroupInvitationLink, *messengertypes.BertyLink, error) {
+	now := timestampMs(time.Now())
+
+	if req.GetExpiresAt() != 0 && req.GetExpiresAt() <= now {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the expiry date must be in the future"))
+	}
+
+	if req.GetMaxUses() < 0 {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the max number of uses can't be negative"))
+	}
+
+	// the limits are enforced by removing the members, it requires to be an admin
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkGroupCapacity(conv, 1); err != nil {
+		return nil, nil, err
+	}
+
+	gpk, err := b64DecodeBytes(conv.GetPublicKey())
+	if err != nil {
+		return nil, nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	grpInfo, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		return nil, nil, errcode.ErrGroupInfo.Wrap(err)
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(groupInvitationIDSize)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	group := &messengertypes.BertyGroup{
+		Group:               grpInfo.GetGroup(),
+		DisplayName:         conv.GetDisplayName(),
+		InvitationID:        b64EncodeBytes(id),
+		InvitationExpiresAt: req.GetExpiresAt(),
+		MemberCount:         conv.GetMemberCount(),
+		AvatarCID:           conv.GetAvatarCID(),
+		CreatedDate:         conv.GetCreatedDate(),
+	}
+	link := group.GetBertyLink()
+
+	internal, web, err := bertylinks.MarshalLink(link)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	invitation := &messengertypes.GroupInvitationLink{
+		ID:                    group.GetInvitationID(),
+		ConversationPublicKey: conv.GetPublicKey(),
+		WebURL:                web,
+		InternalURL:           internal,
+		CreatedDate:           now,
+		ExpiresAt:             req.GetExpiresAt(),
+		MaxUses:               req.GetMaxUses(),
+	}
+
+	if err := svc.db.addGroupInvitationLink(invitation); err != nil {
+		return nil, nil, err
+	}
+
+	if err := svc.addGroupInvitationLinkAuditEvent(invitation, messengertypes.GroupAuditEvent_TypeInvitationLinkCreated, now); err != nil {
+		return nil, nil, err
+	}
+
+	if req.GetRequiresApproval() && conv.GetJoinApprovalDate() == 0 {
+		if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetJoinApproval, &messengertypes.AppMessage_SetJoinApproval{Required: true}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return invitation, link, nil
+}
+
+// sendGroupInvitationLinkUsed notifies the inviter that this node joined a group with one of its invitation links
+func (svc *service) sendGroupInvitationLinkUsed(ctx context.Context, gpk []byte, invitationID string) error {
+	am, err := messengertypes.AppMessage_TypeGroupInvitationLinkUsed.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_GroupInvitationLinkUsed{InvitationID: invitationID})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := svc.protocolClient.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{GroupPK: gpk, Payload: am}); err != nil {
+		return errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	return nil
+}
+
+func (svc *service) revokeGroupInvitationLink(id string) (*messengertypes.GroupInvitationLink, error) {
+	if _, err := svc.db.getGroupInvitationLink(id); err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	invitation, err := svc.db.revokeGroupInvitationLink(id, timestampMs(time.Now()))
+	if err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if err := svc.addGroupInvitationLinkAuditEvent(invitation, messengertypes.GroupAuditEvent_TypeInvitationLinkRevoked, invitation.GetRevokedDate()); err != nil {
+		return nil, err
+	}
+
+	return invitation, nil
+}
@@ -0,0 +1,72 @@
+package bertymessenger
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/bertylinks"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The preview of a group is carried by its invitation links, it is set by the inviter when the link is created. It is
+// read without activating the group nor fetching anything from its members, so an invitation can be declined without
+// the group knowing the link has been opened.
+
+func (svc *service) GroupInvitationPreview(ctx context.Context, req *messengertypes.GroupInvitationPreview_Request) (*messengertypes.GroupInvitationPreview_Reply, error) {
+	if req.GetLink() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	link, err := bertylinks.UnmarshalLink(req.GetLink(), req.GetPassphrase())
+	if err != nil {
+		return nil, errcode.ErrMessengerInvalidDeepLink.Wrap(err)
+	}
+	if link.Kind == messengertypes.BertyLink_EncryptedV1Kind {
+		return nil, errcode.ErrMessengerDeepLinkRequiresPassphrase
+	}
+	if !link.IsGroup() {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	bgroup := link.GetBertyGroup()
+
+	conv, err := svc.db.getConversationByPK(b64EncodeBytes(bgroup.GetGroup().GetPublicKey()))
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		conv = nil
+	case err != nil:
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return groupInvitationPreview(bgroup, conv, timestampMs(time.Now())), nil
+}
+
+// groupInvitationPreview returns the preview of the group of an invitation link, the conversation of the group is set
+// when the account is already in it
+func groupInvitationPreview(bgroup *messengertypes.BertyGroup, conv *messengertypes.Conversation, now int64) *messengertypes.GroupInvitationPreview_Reply {
+	preview := &messengertypes.GroupInvitationPreview_Reply{
+		ConversationPublicKey: b64EncodeBytes(bgroup.GetGroup().GetPublicKey()),
+		DisplayName:           bgroup.GetDisplayName(),
+		MemberCount:           bgroup.GetMemberCount(),
+		AvatarCID:             bgroup.GetAvatarCID(),
+		CreatedDate:           bgroup.GetCreatedDate(),
+		IsExpired:             bgroup.GetInvitationExpiresAt() != 0 && bgroup.GetInvitationExpiresAt() < now,
+	}
+
+	if conv == nil {
+		return preview
+	}
+
+	preview.IsJoined = true
+	if conv.GetDisplayName() != "" {
+		preview.DisplayName = conv.GetDisplayName()
+	}
+	preview.MemberCount = conv.GetMemberCount()
+	preview.AvatarCID = conv.GetAvatarCID()
+	preview.CreatedDate = conv.GetCreatedDate()
+
+	return preview
+}
@@ -0,0 +1,108 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_dbWrapper_groupInvitationLinks(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ConversationPublicKey: "conv_1"}))
+	require.Error(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ID: "invitation_1"}))
+
+	require.NoError(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ID: "invitation_1", ConversationPublicKey: "conv_1", CreatedDate: 10, MaxUses: 1}))
+	require.NoError(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ID: "invitation_2", ConversationPublicKey: "conv_1", CreatedDate: 20}))
+	require.NoError(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ID: "invitation_3", ConversationPublicKey: "conv_2", CreatedDate: 30}))
+
+	_, err := db.getGroupInvitationLink("invitation_unknown")
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	invitations, err := db.getGroupInvitationLinks("conv_1")
+	require.NoError(t, err)
+	require.Len(t, invitations, 2)
+	require.Equal(t, "invitation_1", invitations[0].ID)
+
+	invitations, err = db.getGroupInvitationLinks("")
+	require.NoError(t, err)
+	require.Len(t, invitations, 3)
+
+	added, err := db.addGroupInvitationLinkUse(&messengertypes.GroupInvitationLinkUse{InvitationID: "invitation_1", MemberPublicKey: "member_1", UsedDate: 100})
+	require.NoError(t, err)
+	require.True(t, added)
+
+	added, err = db.addGroupInvitationLinkUse(&messengertypes.GroupInvitationLinkUse{InvitationID: "invitation_1", MemberPublicKey: "member_1", UsedDate: 200})
+	require.NoError(t, err)
+	require.False(t, added)
+
+	invitation, err := db.getGroupInvitationLink("invitation_1")
+	require.NoError(t, err)
+	require.Len(t, invitation.Uses, 1)
+	require.False(t, isGroupInvitationLinkUsable(invitation, 300))
+
+	invitation, err = db.revokeGroupInvitationLink("invitation_2", 500)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), invitation.RevokedDate)
+
+	// the first revocation is kept
+	invitation, err = db.revokeGroupInvitationLink("invitation_2", 600)
+	require.NoError(t, err)
+	require.Equal(t, int64(500), invitation.RevokedDate)
+}
+
+func Test_isGroupInvitationLinkUsable(t *testing.T) {
+	require.True(t, isGroupInvitationLinkUsable(&messengertypes.GroupInvitationLink{}, 100))
+
+	require.True(t, isGroupInvitationLinkUsable(&messengertypes.GroupInvitationLink{ExpiresAt: 100}, 100))
+	require.False(t, isGroupInvitationLinkUsable(&messengertypes.GroupInvitationLink{ExpiresAt: 100}, 101))
+
+	require.True(t, isGroupInvitationLinkUsable(&messengertypes.GroupInvitationLink{RevokedDate: 100}, 99))
+	require.False(t, isGroupInvitationLinkUsable(&messengertypes.GroupInvitationLink{RevokedDate: 100}, 100))
+
+	limited := &messengertypes.GroupInvitationLink{
+		MaxUses: 2,
+		Uses: []*messengertypes.GroupInvitationLinkUse{
+			{MemberPublicKey: "member_1"},
+			{MemberPublicKey: "member_2", Rejected: true},
+		},
+	}
+	require.True(t, isGroupInvitationLinkUsable(limited, 100))
+
+	limited.Uses = append(limited.Uses, &messengertypes.GroupInvitationLinkUse{MemberPublicKey: "member_3"})
+	require.False(t, isGroupInvitationLinkUsable(limited, 100))
+}
+
+func Test_groupInvitationPreview(t *testing.T) {
+	bgroup := &messengertypes.BertyGroup{
+		Group:               &protocoltypes.Group{PublicKey: []byte("group_1")},
+		DisplayName:         "friends",
+		InvitationExpiresAt: 100,
+		MemberCount:         4,
+		AvatarCID:           "avatar_1",
+		CreatedDate:         10,
+	}
+
+	preview := groupInvitationPreview(bgroup, nil, 50)
+	require.Equal(t, b64EncodeBytes([]byte("group_1")), preview.GetConversationPublicKey())
+	require.Equal(t, "friends", preview.GetDisplayName())
+	require.Equal(t, int64(4), preview.GetMemberCount())
+	require.Equal(t, "avatar_1", preview.GetAvatarCID())
+	require.Equal(t, int64(10), preview.GetCreatedDate())
+	require.False(t, preview.GetIsJoined())
+	require.False(t, preview.GetIsExpired())
+
+	require.True(t, groupInvitationPreview(bgroup, nil, 200).GetIsExpired())
+
+	// the group already joined is described as known locally
+	preview = groupInvitationPreview(bgroup, &messengertypes.Conversation{DisplayName: "family", MemberCount: 6, CreatedDate: 10}, 50)
+	require.True(t, preview.GetIsJoined())
+	require.Equal(t, "family", preview.GetDisplayName())
+	require.Equal(t, int64(6), preview.GetMemberCount())
+	require.Empty(t, preview.GetAvatarCID())
+}
@@ -3,6 +3,8 @@ package bertymessenger
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -29,6 +31,21 @@ type eventHandler struct {
 		handler        func(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error)
 		isVisibleEvent bool
 	}
+	// report collects the failures of the events of a replay, the first failure stops the replay when it is nil
+	report *messengertypes.ReplayReport
+	// dedup is shared by the handlers of a service, the events handled by one of them are skipped by the others
+	dedup *eventDedupCache
+	// validation counts the app messages rejected by their rules, it is shared by the handlers of a service
+	validation *appMessageValidationStats
+	// compact aggregates the acks and the reactions of a replay into the summaries of their targets, they are not
+	// stored one by one
+	compact bool
+	// hook is called before each event of a replay or of a history load is handled
+	hook func(evt *protocoltypes.EventContext)
+	// failures counts the events of each group which failed in a row, it is shared by the live handlers of a service
+	failures *eventFailureStreaks
+	// stages is the middleware chain of the app messages, the built-in stages and the middlewares of the service
+	stages []eventStage
 }
 
 func newEventHandler(ctx context.Context, db *dbWrapper, protocolClient protocoltypes.ProtocolServiceClient, logger *zap.Logger, svc *service, replay bool) *eventHandler {
@@ -43,6 +60,27 @@ func newEventHandler(ctx context.Context, db *dbWrapper, protocolClient protocol
 		logger:         logger,
 		svc:            svc,
 		replay:         replay,
+		dedup:          newEventDedupCache(eventDedupCacheSize),
+		validation:     newAppMessageValidationStats(),
+		failures:       newEventFailureStreaks(defaultMaxConsecutiveEventFailures),
+	}
+
+	if svc != nil && svc.eventDedup != nil {
+		h.dedup = svc.eventDedup
+	}
+
+	if svc != nil && svc.validationStats != nil {
+		h.validation = svc.validationStats
+	}
+
+	if svc != nil && svc.eventFailures != nil {
+		h.failures = svc.eventFailures
+	}
+
+	if svc != nil {
+		h.stages = h.newEventStages(svc.eventStageOrder, svc.eventMiddlewares)
+	} else {
+		h.stages = h.newEventStages(nil, nil)
 	}
 
 	h.metadataHandlers = map[protocoltypes.EventType]func(gme *protocoltypes.GroupMetadataEvent) error{
@@ -54,6 +92,7 @@ func newEventHandler(ctx context.Context, db *dbWrapper, protocolClient protocol
 		protocoltypes.EventTypeGroupMemberDeviceAdded:                 h.groupMemberDeviceAdded,
 		protocoltypes.EventTypeGroupMetadataPayloadSent:               h.groupMetadataPayloadSent,
 		protocoltypes.EventTypeAccountServiceTokenAdded:               h.accountServiceTokenAdded,
+		protocoltypes.EventTypeAccountServiceTokenRemoved:             h.accountServiceTokenRemoved,
 		protocoltypes.EventTypeGroupReplicating:                       h.groupReplicating,
 		protocoltypes.EventTypeMultiMemberGroupInitialMemberAnnounced: h.multiMemberGroupInitialMemberAnnounced,
 	}
@@ -62,33 +101,180 @@ func newEventHandler(ctx context.Context, db *dbWrapper, protocolClient protocol
 		handler        func(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error)
 		isVisibleEvent bool
 	}{
-		messengertypes.AppMessage_TypeAcknowledge:     {h.handleAppMessageAcknowledge, false},
-		messengertypes.AppMessage_TypeGroupInvitation: {h.handleAppMessageGroupInvitation, true},
-		messengertypes.AppMessage_TypeUserMessage:     {h.handleAppMessageUserMessage, true},
-		messengertypes.AppMessage_TypeSetUserInfo:     {h.handleAppMessageSetUserInfo, false},
-		messengertypes.AppMessage_TypeReplyOptions:    {h.handleAppMessageReplyOptions, true},
+		messengertypes.AppMessage_TypeAcknowledge:                {h.handleAppMessageAcknowledge, false},
+		messengertypes.AppMessage_TypeGroupInvitation:            {h.handleAppMessageGroupInvitation, true},
+		messengertypes.AppMessage_TypeUserMessage:                {h.handleAppMessageUserMessage, true},
+		messengertypes.AppMessage_TypeSetUserInfo:                {h.handleAppMessageSetUserInfo, false},
+		messengertypes.AppMessage_TypeReplyOptions:               {h.handleAppMessageReplyOptions, true},
+		messengertypes.AppMessage_TypeLocation:                   {h.handleAppMessageLocation, true},
+		messengertypes.AppMessage_TypePollCreate:                 {h.handleAppMessagePollCreate, true},
+		messengertypes.AppMessage_TypePollVote:                   {h.handleAppMessagePollVote, false},
+		messengertypes.AppMessage_TypePollClose:                  {h.handleAppMessagePollClose, false},
+		messengertypes.AppMessage_TypeSetGroupInfo:               {h.handleAppMessageSetGroupInfo, false},
+		messengertypes.AppMessage_TypeSetMemberRole:              {h.handleAppMessageSetMemberRole, false},
+		messengertypes.AppMessage_TypeRemoveMember:               {h.handleAppMessageRemoveMember, false},
+		messengertypes.AppMessage_TypeSetPostingRestricted:       {h.handleAppMessageSetPostingRestricted, false},
+		messengertypes.AppMessage_TypeGroupInvitationLinkUsed:    {h.handleAppMessageGroupInvitationLinkUsed, false},
+		messengertypes.AppMessage_TypeDeviceSyncSnapshot:         {h.handleAppMessageDeviceSyncSnapshot, false},
+		messengertypes.AppMessage_TypeDeviceSyncConversation:     {h.handleAppMessageDeviceSyncConversation, false},
+		messengertypes.AppMessage_TypeDeviceSyncContact:          {h.handleAppMessageDeviceSyncContact, false},
+		messengertypes.AppMessage_TypeAbuseReport:                {h.handleAppMessageAbuseReport, false},
+		messengertypes.AppMessage_TypeBoardEntrySet:              {h.handleAppMessageBoardEntrySet, false},
+		messengertypes.AppMessage_TypeDeviceSyncStar:             {h.handleAppMessageDeviceSyncStar, false},
+		messengertypes.AppMessage_TypeDeviceSyncTag:              {h.handleAppMessageDeviceSyncTag, false},
+		messengertypes.AppMessage_TypeHistoryBundle:              {h.handleAppMessageHistoryBundle, false},
+		messengertypes.AppMessage_TypeSetJoinApproval:            {h.handleAppMessageSetJoinApproval, false},
+		messengertypes.AppMessage_TypeMemberJoinDecision:         {h.handleAppMessageMemberJoinDecision, false},
+		messengertypes.AppMessage_TypeRecoveryShard:              {h.handleAppMessageRecoveryShard, false},
+		messengertypes.AppMessage_TypeSetAnnouncementMode:        {h.handleAppMessageSetAnnouncementMode, false},
+		messengertypes.AppMessage_TypeAnnouncement:               {h.handleAppMessageAnnouncement, true},
+		messengertypes.AppMessage_TypeKeyRotation:                {h.handleAppMessageKeyRotation, false},
+		messengertypes.AppMessage_TypeSetConversationPreferences: {h.handleAppMessageSetConversationPreferences, false},
+		messengertypes.AppMessage_TypeUserReaction:               {h.handleAppMessageUserReaction, false},
+		messengertypes.AppMessage_TypeContactIntroduction:        {h.handleAppMessageContactIntroduction, false},
+		messengertypes.AppMessage_TypeConversationMigrated:       {h.handleAppMessageConversationMigrated, true},
+		messengertypes.AppMessage_TypeSetMemberCap:               {h.handleAppMessageSetMemberCap, false},
+		messengertypes.AppMessage_TypeSetConversationRetention:   {h.handleAppMessageSetConversationRetention, false},
+		messengertypes.AppMessage_TypeDeviceSyncSummary:          {h.handleAppMessageDeviceSyncSummary, false},
+		messengertypes.AppMessage_TypeDeviceSyncDigest:           {h.handleAppMessageDeviceSyncDigest, false},
+		messengertypes.AppMessage_TypeDeviceSyncDiff:             {h.handleAppMessageDeviceSyncDiff, false},
+		messengertypes.AppMessage_TypeInteractionRetract:         {h.handleAppMessageInteractionRetract, false},
+		messengertypes.AppMessage_TypeMediaAvailability:          {h.handleAppMessageMediaAvailability, false},
 	}
 
 	return h
 }
 
-func (h *eventHandler) handleMetadataEvent(gme *protocoltypes.GroupMetadataEvent) error {
+func (h *eventHandler) handleMetadataEvent(gme *protocoltypes.GroupMetadataEvent) (err error) {
 	et := gme.GetMetadata().GetEventType()
-	h.logger.Info("received protocol event", zap.String("type", et.String()))
+
+	// like the app messages, the events handled again by the replay are only logged when debugging
+	logEvent := h.logger.Info
+	if h.replay {
+		logEvent = h.logger.Debug
+	}
+	logEvent("received protocol event", zap.String("type", et.String()))
 
 	handler, ok := h.metadataHandlers[et]
 
 	if !ok {
-		h.logger.Info("event ignored", zap.String("type", et.String()))
+		logEvent("event ignored", zap.String("type", et.String()))
 		return nil
 	}
 
-	return handler(gme)
+	cid := eventCID(gme.GetEventContext())
+	hash := processedEventHash(et.String(), gme.GetEvent())
+	handled := false
+	defer func() {
+		if handled || err != nil {
+			h.auditMetadataEvent(gme, cid, hash, err)
+		}
+	}()
+	if cid != "" {
+		key := eventDedupKey(cid, hash)
+		if !h.dedup.claim(key) {
+			h.logger.Debug("duplicate event delivery dropped", zap.String("type", et.String()), zap.String("cid", cid))
+			return nil
+		}
+		defer func() { h.dedup.release(key, handled) }()
+
+		if processed, err := h.db.isEventProcessed(cid, hash); err != nil {
+			return err
+		} else if processed {
+			h.dedup.ledgerHit(key)
+			h.logger.Debug("event already processed", zap.String("type", et.String()), zap.String("cid", cid))
+			return nil
+		}
+	}
+
+	if limited, err := h.rateLimited(&deferredEvent{groupPK: b64EncodeBytes(gme.GetEventContext().GetGroupPK()), metadata: gme}); err != nil {
+		return err
+	} else if limited {
+		return nil
+	}
+
+	h.tapEvent(&messengertypes.TappedEvent{ConversationPublicKey: b64EncodeBytes(gme.GetEventContext().GetGroupPK()), CID: cid, Metadata: gme})
+
+	if err := handler(gme); err != nil {
+		return err
+	}
+
+	if cid == "" {
+		handled = true
+		return nil
+	}
+
+	if err := h.db.markEventProcessed(cid, b64EncodeBytes(gme.GetEventContext().GetGroupPK()), hash, timestampMs(time.Now())); err != nil {
+		return err
+	}
+
+	handled = true
+	return nil
+}
+
+// tapEvent streams an event to the consumers of the event tap, the events replayed without a service are not streamed
+func (h *eventHandler) tapEvent(evt *messengertypes.TappedEvent) {
+	if h.svc == nil || h.svc.eventTap == nil {
+		return
+	}
+
+	evt.HandledDate = timestampMs(time.Now())
+	h.svc.eventTap.publish(evt)
+}
+
+// processedEventHash identifies the content of a handled event in the ledger of the processed events
+func processedEventHash(eventType string, payload []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(eventType))
+	hash.Write(payload)
+	return hex.EncodeToString(hash.Sum(nil))
 }
 
 func (h *eventHandler) handleAppMessage(gpk string, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage) error {
+	cid := eventCID(gme.GetEventContext())
+	logger := h.logger.With(logGroup(gpk), zap.String("cid", cid))
 	if am.GetType() != messengertypes.AppMessage_TypeAcknowledge {
-		h.logger.Info("handling app message", zap.String("type", am.GetType().String()))
+		// the replay handles every event of the logs again, its entries are only useful when debugging
+		logEvent := logger.Info
+		if h.replay {
+			logEvent = logger.Debug
+		}
+		logEvent("handling app message", zap.String("type", am.GetType().String()))
+	}
+
+	// the hash is the one of the message as sent, the handlers only see the expanded payload
+	if err := expandAppMessage(am); err != nil {
+		return err
+	}
+
+	evt := &AppMessageEvent{
+		GroupPK:    gpk,
+		CID:        cid,
+		Message:    gme,
+		AppMessage: am,
+		Replay:     h.replay,
+		hash:       processedEventHash(am.GetType().String(), gme.GetMessage()),
+		logger:     logger,
+	}
+
+	err := h.runEventStages(evt, 0)
+	h.auditAppMessage(evt, err)
+
+	return err
+}
+
+// storeAppMessage is the storage stage of the chain, it builds the interaction of a message and stores it with its
+// handler, the next stages are only run once the message is handled
+func (h *eventHandler) storeAppMessage(evt *AppMessageEvent, next func() error) error {
+	gpk, gme, am, cid, hash, logger := evt.GroupPK, evt.Message, evt.AppMessage, evt.CID, evt.hash, evt.logger
+
+	// the chunks are stored until their message is complete, it is then handled as any message
+	if am.GetType() == messengertypes.AppMessage_TypeChunk {
+		if err := h.handleAppMessageChunk(gpk, gme, am, cid, hash); err != nil {
+			return err
+		}
+		evt.handled = true
+		return next()
 	}
 
 	// build interaction
@@ -97,10 +283,27 @@ func (h *eventHandler) handleAppMessage(gpk string, gme *protocoltypes.GroupMess
 		return err
 	}
 
+	isNoteFromOtherDevice, err := h.isNoteFromOtherDevice(i)
+	if err != nil {
+		return err
+	}
+	if isNoteFromOtherDevice {
+		i.IsMe = true
+	}
+
+	// the messages sent by a newer version are kept until this node understands them
+	if !am.IsPayloadSupported() {
+		if err := h.handleUnsupportedAppMessage(i, am, cid, hash); err != nil {
+			return err
+		}
+		evt.handled = true
+		return next()
+	}
+
 	handler, ok := h.appMessageHandlers[i.GetType()]
 
 	if !ok {
-		h.logger.Warn("unsupported app message type", zap.String("type", i.GetType().String()))
+		logger.Warn("unsupported app message type", zap.String("type", i.GetType().String()))
 
 		return nil
 	}
@@ -108,52 +311,127 @@ func (h *eventHandler) handleAppMessage(gpk string, gme *protocoltypes.GroupMess
 	medias := i.GetMedias()
 	var mediasAdded []bool
 
+	// the rows changed by the transaction are recorded in the audit log
+	db := h.db
+	if h.svc != nil && h.svc.auditLog != nil {
+		evt.mutations = &auditMutations{}
+		db = h.db.withAuditMutations(evt.mutations)
+	}
+
 	// start a transaction
-	var isNew bool
-	if err := h.db.tx(func(tx *dbWrapper) error {
+	var (
+		isNew       bool
+		echo        *messengertypes.LocalEcho
+		broadcastID string
+		device      *messengertypes.Device
+	)
+	if err := db.tx(func(tx *dbWrapper) error {
 		if mediasAdded, err = tx.addMedias(medias); err != nil {
 			return err
 		}
 
-		if err := h.interactionFetchRelations(tx, i); err != nil {
+		// the interaction takes the id of the local echo it replaces before being stored
+		if echo, err = h.reconcileLocalEcho(tx, i, hash); err != nil {
 			return err
 		}
 
-		if err := h.interactionConsumeAck(tx, i); err != nil {
+		if broadcastID, err = h.reconcileBroadcastRecipient(tx, i, hash); err != nil {
 			return err
 		}
 
-		// parse payload
-		amPayload, err := am.UnmarshalPayload()
+		// i is kept on failure, it is logged below
+		handledI, handledIsNew, err := h.handleInteraction(tx, i, am, handler.handler, handler.isVisibleEvent)
 		if err != nil {
 			return err
 		}
+		i, isNew = handledI, handledIsNew
 
-		i, isNew, err = handler.handler(tx, i, amPayload)
-		if err != nil {
-			return err
+		if isNew && handler.isVisibleEvent && i.GetMemberPublicKey() != "" {
+			if err := tx.setMemberLastActivity(i.GetMemberPublicKey(), i.GetConversationPublicKey(), i.GetSentDate()); err != nil {
+				return err
+			}
+		}
+
+		if isNew {
+			if device, err = tx.setDeviceInfo(i.GetDevicePublicKey(), sanitizeDeviceInfo(am.GetDevice()), i.GetSentDate()); err != nil {
+				return err
+			}
+
+			if err := tx.setDeviceCapabilities(i.GetDevicePublicKey(), am.GetCapabilities(), i.GetSentDate()); err != nil {
+				return err
+			}
+		}
+
+		// the refused messages are not added to the ledger, they are handled again once the sender is allowed
+		if cid == "" {
+			return nil
 		}
 
+		return tx.markEventProcessed(cid, gpk, hash, timestampMs(time.Now()))
+	}); err == errSenderBlocked {
+		logger.Debug("ignoring app message from blocked sender", zap.String("type", i.GetType().String()), zap.String("device-pk", i.GetDevicePublicKey()))
 		return nil
-	}); err != nil {
+	} else if err == errSenderNotAllowed {
+		logger.Debug("ignoring app message refused by group moderation", zap.String("type", i.GetType().String()), zap.String("device-pk", i.GetDevicePublicKey()))
+		return nil
+	} else if err == errInteractionPruned {
+		return nil
+	} else if err != nil {
 		return err
 	}
+	evt.handled = true
+
+	// the interaction itself is streamed by its handler, the span covers the updates streamed once it is stored
+	_, streamSpan := h.svc.messengerTracer().Start(evt.spanCtx, "Stream Event")
+	defer streamSpan.End()
+
+	if echo != nil && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: echo.GetID()}, false); err != nil {
+			h.logger.Error("unable to dispatch local echo removal", zap.String("id", echo.GetID()), zap.Error(err))
+		}
+	}
+
+	h.dispatchBroadcastUpdated(h.db, broadcastID)
+
+	if device != nil && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeDeviceUpdated, &messengertypes.StreamEvent_DeviceUpdated{Device: device}, false); err != nil {
+			h.logger.Error("unable to dispatch device update", zap.String("device-pk", device.GetPublicKey()), zap.Error(err))
+		}
+	}
 
 	if handler.isVisibleEvent && isNew {
-		if err := h.dispatchVisibleInteraction(i); err != nil {
-			h.logger.Error("unable to dispatch notification for interaction", zap.String("cid", i.CID), zap.Error(err))
+		h.recordDeliveryLatency(evt.span, i, time.Now())
+
+		// the filtered messages are counted as unread once approved, the messages of the muted members never are
+		if !i.GetIsFiltered() && !i.GetIsMemberMuted() {
+			if err := h.dispatchVisibleInteraction(i); err != nil {
+				h.logger.Error("unable to dispatch notification for interaction", zap.String("cid", i.CID), zap.Error(err))
+			}
 		}
 	}
 
+	var newMedias []*messengertypes.Media
 	for i, media := range medias {
 		if mediasAdded[i] {
+			newMedias = append(newMedias, media)
 			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, true); err != nil {
 				h.logger.Error("unable to dispatch notification for media", zap.String("cid", media.CID), zap.Error(err))
 			}
 		}
 	}
 
-	return nil
+	if h.svc != nil && !h.replay && (!i.GetIsMe() || isNoteFromOtherDevice) {
+		h.svc.mediaDownloader.enqueue(i.GetConversationPublicKey(), newMedias)
+	}
+
+	// the webhooks are posted once the message is committed, the bots never see a message which has been rolled back
+	if h.svc != nil && isNew && !h.replay && !i.GetIsMe() && !i.GetIsFiltered() && i.GetType() == messengertypes.AppMessage_TypeUserMessage {
+		if err := h.svc.deliverBotWebhooks(h.db, i); err != nil {
+			h.logger.Error("unable to deliver bot webhooks", zap.String("cid", i.CID), zap.Error(err))
+		}
+	}
+
+	return next()
 }
 
 func (h *eventHandler) accountServiceTokenAdded(gme *protocoltypes.GroupMetadataEvent) error {
@@ -171,6 +449,17 @@ func (h *eventHandler) accountServiceTokenAdded(gme *protocoltypes.GroupMetadata
 		return errcode.ErrDBWrite.Wrap(err)
 	}
 
+	tokenID, authURL := ev.ServiceToken.TokenID(), ev.ServiceToken.GetAuthenticationURL()
+	replaced, err := h.db.replaceReplicationTokens(tokenID, authURL, timestampMs(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	// the conversations replicated with the replaced tokens are registered again, the replayed tokens were already
+	if h.svc != nil && !h.replay && len(replaced) > 0 {
+		go h.svc.replicateWithRenewedToken(h.svc.ctx, tokenID, authURL)
+	}
+
 	// dispatch event
 	if h.svc != nil {
 		acc, err := h.db.getAccount()
@@ -186,6 +475,27 @@ func (h *eventHandler) accountServiceTokenAdded(gme *protocoltypes.GroupMetadata
 	return nil
 }
 
+func (h *eventHandler) accountServiceTokenRemoved(gme *protocoltypes.GroupMetadataEvent) error {
+	var ev protocoltypes.AccountServiceTokenRemoved
+	if err := proto.Unmarshal(gme.GetEvent(), &ev); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if h.svc == nil || h.replay {
+		if _, err := h.db.updateServiceToken(ev.GetTokenID(), map[string]interface{}{"state": messengertypes.ServiceToken_StateRevoked}); err != nil && !errcode.Is(err, errcode.ErrNotFound) {
+			return err
+		}
+
+		return nil
+	}
+
+	if _, err := h.svc.revokeReplicationToken(ev.GetTokenID(), time.Now()); err != nil && !errcode.Is(err, errcode.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
 func (h *eventHandler) groupReplicating(gme *protocoltypes.GroupMetadataEvent) error {
 	var ev protocoltypes.GroupReplicating
 	if err := proto.Unmarshal(gme.GetEvent(), &ev); err != nil {
@@ -214,7 +524,7 @@ func (h *eventHandler) groupReplicating(gme *protocoltypes.GroupMetadataEvent) e
 	}
 
 	if conv, err := h.db.getConversationByPK(convPK); err != nil {
-		h.logger.Warn("unknown conversation", zap.String("conversation-pk", convPK))
+		h.logger.Warn("unknown conversation", logGroup(convPK))
 	} else if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
 		return err
 	}
@@ -274,7 +584,7 @@ func (h *eventHandler) accountGroupJoined(gme *protocoltypes.GroupMetadataEvent)
 	// activate group
 	if h.svc != nil {
 		if _, err := h.protocolClient.ActivateGroup(h.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: gpkb}); err != nil {
-			h.logger.Warn("failed to activate group", zap.String("pk", b64EncodeBytes(gpkb)))
+			h.logger.Warn("failed to activate group", logGroup(b64EncodeBytes(gpkb)))
 		}
 
 		// subscribe to group
@@ -282,7 +592,7 @@ func (h *eventHandler) accountGroupJoined(gme *protocoltypes.GroupMetadataEvent)
 			return err
 		}
 
-		h.logger.Info("AccountGroupJoined", zap.String("pk", groupPK), zap.String("known-as", conversation.GetDisplayName()))
+		h.logger.Info("AccountGroupJoined", logGroup(groupPK), zap.String("known-as", conversation.GetDisplayName()))
 	}
 
 	return nil
@@ -319,6 +629,19 @@ func (h *eventHandler) accountContactRequestOutgoingEnqueued(gme *protocoltypes.
 		return errcode.ErrDBAddContactRequestOutgoingEnqueud.Wrap(err)
 	}
 
+	if err := h.db.setContactRendezvousSeed(contactPK, ev.GetContact().GetPublicRendezvousSeed()); err != nil {
+		return err
+	}
+	contact.PublicRendezvousSeed = ev.GetContact().GetPublicRendezvousSeed()
+
+	// the request may have been kept before its contact was added
+	if synced, _, err := h.db.syncContactRequestStatus(contactPK); err != nil {
+		return err
+	} else if synced != nil {
+		contact.RequestStatus = synced.GetRequestStatus()
+		contact.RequestExpiresAt = synced.GetRequestExpiresAt()
+	}
+
 	// create new contact conversation
 	var conversation *messengertypes.Conversation
 
@@ -346,7 +669,7 @@ func (h *eventHandler) accountContactRequestOutgoingEnqueued(gme *protocoltypes.
 		}
 	}
 
-	return nil
+	return h.addContactRequest(contact, false)
 }
 
 func (h *eventHandler) accountContactRequestOutgoingSent(gme *protocoltypes.GroupMetadataEvent) error {
@@ -362,6 +685,11 @@ func (h *eventHandler) accountContactRequestOutgoingSent(gme *protocoltypes.Grou
 		return errcode.ErrDBAddContactRequestOutgoingSent.Wrap(err)
 	}
 
+	// the request is delivered, it is kept pending until accepted but isn't sent again
+	if err := h.db.updateOutgoingContactRequest(contactPK, map[string]interface{}{"next_resend_date": 0}); err != nil {
+		return err
+	}
+
 	// dispatch event and subscribe to group metadata
 	if h.svc != nil {
 		err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false)
@@ -385,7 +713,7 @@ func (h *eventHandler) accountContactRequestOutgoingSent(gme *protocoltypes.Grou
 		}
 
 		if _, err = h.protocolClient.ActivateGroup(h.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: groupPK}); err != nil {
-			h.logger.Warn("failed to activate group", zap.String("pk", b64EncodeBytes(groupPK)))
+			h.logger.Warn("failed to activate group", logGroup(b64EncodeBytes(groupPK)))
 		}
 
 		if err := h.svc.sendAccountUserInfo(b64EncodeBytes(groupPK)); err != nil {
@@ -405,6 +733,13 @@ func (h *eventHandler) accountContactRequestIncomingReceived(gme *protocoltypes.
 	}
 	contactPK := b64EncodeBytes(ev.GetContactPK())
 
+	if blocked, err := h.db.isMemberBlocked(contactPK); err != nil {
+		return err
+	} else if blocked {
+		h.logger.Info("ignoring contact request from blocked contact", zap.String("contact-pk", contactPK))
+		return nil
+	}
+
 	var m messengertypes.ContactMetadata
 	err := proto.Unmarshal(ev.GetContactMetadata(), &m)
 	if err != nil {
@@ -417,13 +752,25 @@ func (h *eventHandler) accountContactRequestIncomingReceived(gme *protocoltypes.
 	}
 	groupPKBytes := b64EncodeBytes(groupPK)
 
-	contact, err := h.db.addContactRequestIncomingReceived(contactPK, m.GetDisplayName(), groupPKBytes)
+	m.SanitizeIntro()
+
+	ignored, err := h.shouldIgnoreContactRequest(&m)
+	if err != nil {
+		return err
+	}
+
+	contact, err := h.db.addContactRequestIncomingReceived(contactPK, m.GetDisplayName(), groupPKBytes, &m, ignored)
 	if errcode.Is(err, errcode.ErrDBEntryAlreadyExists) {
 		return nil
 	} else if err != nil {
 		return errcode.ErrDBAddContactRequestIncomingReceived.Wrap(err)
 	}
 
+	if err := h.db.setContactRendezvousSeed(contactPK, ev.GetContactRendezvousSeed()); err != nil {
+		return err
+	}
+	contact.PublicRendezvousSeed = ev.GetContactRendezvousSeed()
+
 	// create new contact conversation
 	var conversation *messengertypes.Conversation
 
@@ -449,6 +796,23 @@ func (h *eventHandler) accountContactRequestIncomingReceived(gme *protocoltypes.
 		if err = h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conversation}, true); err != nil {
 			return err
 		}
+	}
+
+	if err := h.addContactRequest(contact, !ignored); err != nil {
+		return err
+	}
+
+	if h.svc != nil {
+		if ignored {
+			h.logger.Info("contact request ignored by policy", zap.String("contact-pk", contactPK))
+			return nil
+		}
+
+		if accepted, err := h.autoAcceptContactRequest(ev.GetContactPK(), &m); err != nil {
+			h.logger.Error("unable to apply the auto-accept policy", zap.String("contact-pk", contactPK), zap.Error(err))
+		} else if accepted {
+			return nil
+		}
 
 		err = h.svc.dispatcher.Notify(
 			messengertypes.StreamEvent_Notified_TypeContactRequestReceived,
@@ -464,6 +828,36 @@ func (h *eventHandler) accountContactRequestIncomingReceived(gme *protocoltypes.
 	return nil
 }
 
+// shouldIgnoreContactRequest applies the account contact request policy to an incoming request,
+// the policy is not applied during replay as the reception date of the requests is unknown, ignored requests are restored from the local state instead
+func (h *eventHandler) shouldIgnoreContactRequest(m *messengertypes.ContactMetadata) (bool, error) {
+	if h.replay {
+		return false, nil
+	}
+
+	acc, err := h.db.getAccount()
+	if err != nil {
+		return false, err
+	}
+
+	if acc.GetContactRequestsIgnoreWithoutIntro() && m.GetIntroMessage() == "" {
+		return true, nil
+	}
+
+	if maxPerHour := acc.GetContactRequestsMaxPerHour(); maxPerHour > 0 {
+		count, err := h.db.countContactRequestsIncomingSince(timestampMs(time.Now().Add(-time.Hour)))
+		if err != nil {
+			return false, err
+		}
+
+		if count >= int64(maxPerHour) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (h *eventHandler) accountContactRequestIncomingAccepted(gme *protocoltypes.GroupMetadataEvent) error {
 	var ev protocoltypes.AccountContactRequestAccepted
 	if err := proto.Unmarshal(gme.GetEvent(), &ev); err != nil {
@@ -484,6 +878,10 @@ func (h *eventHandler) accountContactRequestIncomingAccepted(gme *protocoltypes.
 		return errcode.ErrDBAddContactRequestIncomingAccepted.Wrap(err)
 	}
 
+	if err := h.removeContactRequest(contactPK); err != nil {
+		return err
+	}
+
 	if h.svc != nil {
 		// dispatch event to subscribers
 		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
@@ -492,7 +890,7 @@ func (h *eventHandler) accountContactRequestIncomingAccepted(gme *protocoltypes.
 
 		// activate group
 		if _, err := h.protocolClient.ActivateGroup(h.svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: groupPK}); err != nil {
-			h.svc.logger.Warn("failed to activate group", zap.String("pk", b64EncodeBytes(groupPK)))
+			h.svc.logger.Warn("failed to activate group", logGroup(b64EncodeBytes(groupPK)))
 		}
 
 		if err := h.svc.sendAccountUserInfo(b64EncodeBytes(groupPK)); err != nil {
@@ -517,6 +915,7 @@ func (h *eventHandler) contactRequestAccepted(contact *messengertypes.Contact, m
 		}
 
 		contact.State = messengertypes.Contact_Accepted
+		contact.RequestStatus = messengertypes.Contact_RequestAccepted
 		contact.ConversationPublicKey = b64EncodeBytes(groupPK)
 	}
 
@@ -529,11 +928,20 @@ func (h *eventHandler) contactRequestAccepted(contact *messengertypes.Contact, m
 			return err
 		}
 
+		// the answered request isn't needed anymore
+		if err = tx.deleteOutgoingContactRequest(contact.GetPublicKey()); err != nil {
+			return err
+		}
+
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	if err := h.removeContactRequest(contact.GetPublicKey()); err != nil {
+		return err
+	}
+
 	if h.svc != nil {
 		// dispatch events
 		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
@@ -542,7 +950,7 @@ func (h *eventHandler) contactRequestAccepted(contact *messengertypes.Contact, m
 
 		// activate group and subscribe to message events
 		if _, err := h.protocolClient.ActivateGroup(h.svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: groupPK}); err != nil {
-			h.svc.logger.Warn("failed to activate group", zap.String("pk", b64EncodeBytes(groupPK)))
+			h.svc.logger.Warn("failed to activate group", logGroup(b64EncodeBytes(groupPK)))
 		}
 
 		return h.svc.subscribeToMessages(groupPK)
@@ -587,11 +995,18 @@ func (h *eventHandler) multiMemberGroupInitialMemberAnnounced(gme *protocoltypes
 			}
 		}
 
-		return nil
+		// the moderation messages of the creator received before this event are now authorized
+		return h.applyModeration(tx, gpk)
 	}); err != nil {
 		return errcode.ErrDBWrite.Wrap(err)
 	}
 
+	if err := h.refreshConversationMembers(h.db, gpk); err != nil {
+		return err
+	}
+
+	h.addGroupMembershipAuditEvent(gme, messengertypes.GroupAuditEvent_TypeGroupCreated, mpk)
+
 	// dispatch update
 	{
 		member, err := h.db.getMemberByPK(mpk, gpk)
@@ -654,6 +1069,18 @@ func (h *eventHandler) groupMemberDeviceAdded(gme *protocoltypes.GroupMetadataEv
 				h.logger.Error("error dispatching device updated", zap.Error(err))
 			}
 		}
+
+		h.onAccountDeviceAdded(gi, mpkb, dpkb)
+
+		if !isMe {
+			if err := h.checkContactKeyChanged(mpk, dpk); err != nil {
+				h.logger.Error("unable to check the verification of the contact", zap.String("member-pk", mpk), zap.Error(err))
+			}
+
+			if err := h.checkMemberJoinPending(gpk, mpk); err != nil {
+				h.logger.Error("unable to check the approval of the member", zap.String("member-pk", mpk), zap.Error(err))
+			}
+		}
 	}
 
 	// Check whether a contact request has been accepted (a device from the contact has been added to the group)
@@ -687,6 +1114,10 @@ func (h *eventHandler) groupMemberDeviceAdded(gme *protocoltypes.GroupMetadataEv
 
 				userInfo = &payload
 
+				if err := h.db.addMemberProfileChange(memberProfileChangeFromUserInfo(elem, &payload)); err != nil {
+					return err
+				}
+
 				if err := h.db.deleteInteractions([]string{elem.CID}); err != nil {
 					return err
 				}
@@ -725,13 +1156,57 @@ func (h *eventHandler) groupMemberDeviceAdded(gme *protocoltypes.GroupMetadataEv
 
 			h.logger.Info("dispatched member update", zap.Any("member", member), zap.Bool("isNew", isNew))
 		}
+
+		if err := h.refreshConversationMembers(h.db, gpk); err != nil {
+			return err
+		}
+
+		if isNew && gi.GetGroup().GetGroupType() == protocoltypes.GroupTypeMultiMember {
+			h.addGroupMembershipAuditEvent(gme, messengertypes.GroupAuditEvent_TypeMemberJoined, mpk)
+
+			// the metadata events are not dated, the join is dated by its first handling
+			if err := h.addSystemInteraction(h.db, eventCID(gme.GetEventContext()), gpk, gme.GetEventContext().GetLamportTime(), timestampMs(time.Now()), &messengertypes.AppMessage_SystemEvent{
+				Type:                 messengertypes.AppMessage_SystemEvent_TypeMemberJoined,
+				MemberPublicKey:      mpk,
+				ActorMemberPublicKey: mpk,
+			}); err != nil {
+				return err
+			}
+		}
+
+		if isNew && !isMe {
+			h.onMemberJoined(gpk, mpk)
+		}
 	}
 
 	return nil
 }
 
+func memberProfileChangeFromUserInfo(i *messengertypes.Interaction, payload *messengertypes.AppMessage_SetUserInfo) *messengertypes.MemberProfileChange {
+	return &messengertypes.MemberProfileChange{
+		CID:                   i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		MemberPublicKey:       i.GetMemberPublicKey(),
+		DisplayName:           payload.GetDisplayName(),
+		AvatarCID:             payload.GetAvatarCID(),
+		SentDate:              i.GetSentDate(),
+	}
+}
+
 func (h *eventHandler) handleAppMessageAcknowledge(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
 	payload := amPayload.(*messengertypes.AppMessage_Acknowledge)
+
+	if !h.compact {
+		if err := h.addInteractionDelivery(tx, i, payload.GetTarget()); err != nil {
+			return nil, false, err
+		}
+	} else if payload.GetTarget() != "" && i.GetDevicePublicKey() != "" {
+		// the compacted acks are only counted, they are not listed by InteractionDeliveryInfo
+		if err := tx.incrementInteractionDeliveryCount(payload.GetTarget()); err != nil {
+			return nil, false, err
+		}
+	}
+
 	target, err := tx.markInteractionAsAcknowledged(payload.Target)
 
 	switch {
@@ -751,12 +1226,136 @@ func (h *eventHandler) handleAppMessageAcknowledge(tx *dbWrapper, i *messengerty
 	default:
 		if target != nil && h.svc != nil {
 			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: target}, false); err != nil {
-				h.logger.Error("error while sending stream event", zap.String("public-key", i.ConversationPublicKey), zap.String("cid", i.CID), zap.Error(err))
+				h.logger.Error("error while sending stream event", logGroup(i.ConversationPublicKey), zap.String("cid", i.CID), zap.Error(err))
 			}
 		}
 
+		// the acks of the contacts are followed on the broadcast of their message
+		if !i.GetIsMe() {
+			broadcastID, err := tx.markBroadcastRecipientAcknowledged(payload.GetTarget())
+			if err != nil {
+				return nil, false, err
+			}
+			h.dispatchBroadcastUpdated(tx, broadcastID)
+		}
+
+		return i, false, nil
+	}
+}
+
+// addInteractionDelivery records the device of an ack, the deliveries are kept apart from the acks so the ones of the
+// interactions not received yet are not lost when the backlog is consumed
+func (h *eventHandler) addInteractionDelivery(tx *dbWrapper, i *messengertypes.Interaction, target string) error {
+	if target == "" || i.GetDevicePublicKey() == "" {
+		return nil
+	}
+
+	// the acks of the older versions are not dated
+	date := i.GetSentDate()
+	if date == 0 {
+		date = timestampMs(time.Now())
+	}
+
+	delivery := &messengertypes.InteractionDelivery{
+		InteractionCID:        target,
+		DevicePublicKey:       i.GetDevicePublicKey(),
+		MemberPublicKey:       i.GetMemberPublicKey(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		AcknowledgedDate:      date,
+		AckCID:                i.GetCID(),
+		IsMe:                  i.GetIsMe(),
+	}
+
+	added, err := tx.addInteractionDelivery(delivery)
+	if err != nil || !added {
+		return err
+	}
+
+	if err := tx.incrementInteractionDeliveryCount(target); err != nil {
+		return err
+	}
+
+	if h.svc == nil {
+		return nil
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDelivered, &messengertypes.StreamEvent_InteractionDelivered{Delivery: delivery}, false)
+}
+
+// handleAppMessageUserReaction counts a reaction in the summary of its target, the reactions to the interactions not
+// received yet are counted once they are
+func (h *eventHandler) handleAppMessageUserReaction(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_UserReaction)
+	if payload.GetTarget() == "" || payload.GetEmoji() == "" {
+		h.logger.Warn("ignoring invalid reaction", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := tx.addInteractionReaction(payload.GetTarget(), i.GetConversationPublicKey(), payload.GetEmoji(), i.GetIsMe(), i.GetSentDate()); err != nil {
+		return nil, false, err
+	}
+
+	isNew := false
+	if !h.compact {
+		var err error
+		i.TargetCID = payload.GetTarget()
+		if i, isNew, err = tx.addInteraction(*i); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if h.svc == nil {
+		return i, isNew, nil
+	}
+
+	target, err := tx.getInteractionByCID(payload.GetTarget())
+	if err == gorm.ErrRecordNotFound {
+		return i, isNew, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: target}, false); err != nil {
+		return nil, false, err
+	}
+
+	return i, isNew, nil
+}
+
+// handleAppMessageInteractionRetract deletes the message retracted by its sender, the retraction is stored so the
+// message is dropped if it is received later
+func (h *eventHandler) handleAppMessageInteractionRetract(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_InteractionRetract)
+	if payload.GetTarget() == "" {
+		h.logger.Warn("ignoring invalid retraction", zap.String("cid", i.GetCID()))
 		return i, false, nil
 	}
+
+	i.TargetCID = payload.GetTarget()
+	i, isNew, err := tx.addInteraction(*i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the author of a stored target is checked by the retract-author rule
+	target, err := tx.getInteractionByCID(payload.GetTarget())
+	if err == gorm.ErrRecordNotFound {
+		return i, isNew, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if err := tx.deleteInteractions([]string{target.GetCID()}); err != nil {
+		return nil, false, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: target.GetCID()}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, isNew, nil
 }
 
 func (h *eventHandler) handleAppMessageGroupInvitation(tx *dbWrapper, i *messengertypes.Interaction, _ proto.Message) (*messengertypes.Interaction, bool, error) {
@@ -775,11 +1374,61 @@ func (h *eventHandler) handleAppMessageGroupInvitation(tx *dbWrapper, i *messeng
 }
 
 func (h *eventHandler) handleAppMessageUserMessage(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	// the interaction is stored with the valid formatting entities only, so the clients don't have to check them
+	if um := amPayload.(*messengertypes.AppMessage_UserMessage); um.SanitizeFormatting() {
+		h.logger.Warn("dropping invalid formatting entities", zap.String("cid", i.GetCID()))
+
+		payload, err := proto.Marshal(um)
+		if err != nil {
+			return nil, false, errcode.ErrSerialization.Wrap(err)
+		}
+		i.Payload = payload
+	}
+
+	mentions, err := h.getInteractionMentions(i, amPayload.(*messengertypes.AppMessage_UserMessage))
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, mention := range mentions {
+		if mention.GetIsMe() && !i.GetIsMe() {
+			i.MentionsMe = true
+		}
+	}
+
+	if err := h.applyContentFilters(tx, i, amPayload.(*messengertypes.AppMessage_UserMessage).GetBody()); err != nil {
+		return nil, false, err
+	}
+
+	if err := h.applyQuote(tx, i, amPayload.(*messengertypes.AppMessage_UserMessage)); err != nil {
+		return nil, false, err
+	}
+
+	medias := i.GetMedias()
+	setInteractionContentFlags(i, amPayload.(*messengertypes.AppMessage_UserMessage), medias)
 	i, isNew, err := tx.addInteraction(*i)
 	if err != nil {
 		return nil, isNew, err
 	}
 
+	if isNew {
+		if err := tx.addMentions(mentions); err != nil {
+			return nil, isNew, err
+		}
+
+		if err := tx.addConversationFiles(conversationFiles(i, amPayload.(*messengertypes.AppMessage_UserMessage), medias)); err != nil {
+			return nil, isNew, err
+		}
+
+		if err := tx.addConversationCounters(i, medias); err != nil {
+			return nil, isNew, err
+		}
+
+		if err := h.verifyQuotesOf(tx, i); err != nil {
+			return nil, isNew, err
+		}
+	}
+
 	if h.svc == nil {
 		return i, isNew, nil
 	}
@@ -788,12 +1437,36 @@ func (h *eventHandler) handleAppMessageUserMessage(tx *dbWrapper, i *messengerty
 		return nil, isNew, err
 	}
 
+	if h.svc.ircGateway != nil && isNew && !h.replay && !i.GetIsFiltered() {
+		h.svc.ircGateway.relayInteraction(tx, i, amPayload.(*messengertypes.AppMessage_UserMessage).GetBody())
+	}
+
 	if i.IsMe || h.replay || !isNew {
 		return i, isNew, nil
 	}
 
-	if err := h.sendAck(i.CID, i.ConversationPublicKey); err != nil {
-		h.logger.Error("error while sending ack", zap.String("public-key", i.ConversationPublicKey), zap.String("cid", i.CID), zap.Error(err))
+	if err := h.sendAck(i); err != nil {
+		h.logger.Error("error while sending ack", logGroup(i.ConversationPublicKey), zap.String("cid", i.CID), zap.Error(err))
+	}
+
+	// the filtered messages are hidden until reviewed, they are neither relayed nor notified
+	if i.GetIsFiltered() {
+		return i, isNew, nil
+	}
+
+	if h.svc.matrixBridge != nil {
+		if err := h.svc.matrixBridge.relayInteraction(tx, i, amPayload.(*messengertypes.AppMessage_UserMessage).GetBody()); err != nil {
+			h.logger.Error("unable to relay message to matrix", zap.String("cid", i.CID), zap.Error(err))
+		}
+	}
+
+	if err := h.handleAutoReply(tx, i, amPayload.(*messengertypes.AppMessage_UserMessage)); err != nil {
+		h.logger.Error("unable to handle auto-reply", zap.String("cid", i.CID), zap.Error(err))
+	}
+
+	// the messages of the muted members are stored but never notified
+	if i.GetIsMemberMuted() {
+		return i, isNew, nil
 	}
 
 	// notify
@@ -804,12 +1477,23 @@ func (h *eventHandler) handleAppMessageUserMessage(tx *dbWrapper, i *messengerty
 		return i, isNew, nil
 	}
 
+	// the notification rules of the conversation apply to the notification and to the pushes
+	policy, err := tx.getNotificationPolicy(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, isNew, err
+	}
+
+	if !isNotificationAllowed(policy, i, amPayload.(*messengertypes.AppMessage_UserMessage).GetBody(), time.Now()) {
+		return i, isNew, nil
+	}
+
 	// fetch contact from db
 	var contact *messengertypes.Contact
 	if i.Conversation.Type == messengertypes.Conversation_ContactType {
 		if contact, err = tx.getContactByPK(i.Conversation.ContactPublicKey); err != nil {
-			h.logger.Warn("1to1 message contact not found", zap.String("public-key", i.Conversation.ContactPublicKey), zap.Error(err))
+			h.logger.Warn("1to1 message contact not found", logContact(i.Conversation.ContactPublicKey), zap.Error(err))
 		}
+		contact.ApplyNickname()
 	}
 
 	payload := amPayload.(*messengertypes.AppMessage_UserMessage)
@@ -819,7 +1503,13 @@ func (h *eventHandler) handleAppMessageUserMessage(tx *dbWrapper, i *messengerty
 		title = contact.GetDisplayName()
 	} else {
 		title = i.Conversation.GetDisplayName()
+		if title == "" {
+			title = i.Conversation.GetFallbackDisplayName()
+		}
 		memberName := i.Member.GetDisplayName()
+		if nickname := i.Member.GetNickname(); nickname != "" {
+			memberName = nickname
+		}
 		if memberName != "" {
 			body = memberName + ": " + payload.GetBody()
 		}
@@ -836,6 +1526,13 @@ func (h *eventHandler) handleAppMessageUserMessage(tx *dbWrapper, i *messengerty
 		h.logger.Error("failed to notify", zap.Error(err))
 	}
 
+	// the push only contains the references of the interaction, the devices fetch its content by themselves
+	if pushes, err := h.preparePushes(tx, i); err != nil {
+		h.logger.Error("unable to prepare pushes", zap.Error(err))
+	} else if len(pushes) > 0 {
+		go h.svc.sendPushes(pushes)
+	}
+
 	return i, isNew, nil
 }
 
@@ -861,6 +1558,10 @@ func (h *eventHandler) handleAppMessageSetUserInfo(tx *dbWrapper, i *messengerty
 			return nil, false, err
 		}
 
+		if err := tx.setContactStatusText(cpk, sanitizeStatusText(payload.GetStatusText())); err != nil {
+			return nil, false, err
+		}
+
 		c, err = tx.getContactByPK(i.GetConversation().GetContactPublicKey())
 		if err != nil {
 			return nil, false, err
@@ -887,6 +1588,10 @@ func (h *eventHandler) handleAppMessageSetUserInfo(tx *dbWrapper, i *messengerty
 		return ni, isNew, nil
 	}
 
+	if err := tx.addMemberProfileChange(memberProfileChangeFromUserInfo(i, payload)); err != nil {
+		return nil, false, err
+	}
+
 	isNew := false
 	existingMember, err := tx.getMemberByPK(i.MemberPublicKey, i.ConversationPublicKey)
 	if err == gorm.ErrRecordNotFound {
@@ -895,7 +1600,8 @@ func (h *eventHandler) handleAppMessageSetUserInfo(tx *dbWrapper, i *messengerty
 		return nil, false, err
 	}
 
-	if !isNew && existingMember.GetInfoDate() > i.GetSentDate() {
+	clock := interactionClock(i)
+	if !isNew && existingMember.GetInfoClock() >= clock {
 		return i, false, nil
 	}
 	h.logger.Debug("interesting member SetUserInfo")
@@ -903,12 +1609,24 @@ func (h *eventHandler) handleAppMessageSetUserInfo(tx *dbWrapper, i *messengerty
 	member, isNew, err := tx.upsertMember(
 		i.MemberPublicKey,
 		i.ConversationPublicKey,
-		messengertypes.Member{DisplayName: payload.GetDisplayName(), AvatarCID: payload.GetAvatarCID(), InfoDate: i.GetSentDate()},
+		messengertypes.Member{DisplayName: payload.GetDisplayName(), AvatarCID: payload.GetAvatarCID(), InfoDate: i.GetSentDate(), InfoClock: clock},
 	)
 	if err != nil {
 		return nil, false, err
 	}
 
+	if member.GetIsObserver() != payload.GetIsObserver() {
+		if member, err = tx.setMemberIsObserver(i.MemberPublicKey, i.ConversationPublicKey, payload.GetIsObserver()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if statusText := sanitizeStatusText(payload.GetStatusText()); member.GetStatusText() != statusText {
+		if member, err = tx.setMemberStatusText(i.MemberPublicKey, i.ConversationPublicKey, statusText); err != nil {
+			return nil, false, err
+		}
+	}
+
 	if h.svc != nil {
 		err = h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberUpdated, &messengertypes.StreamEvent_MemberUpdated{Member: member}, isNew)
 		if err != nil {
@@ -918,9 +1636,92 @@ func (h *eventHandler) handleAppMessageSetUserInfo(tx *dbWrapper, i *messengerty
 		h.logger.Info("dispatched member update", zap.Any("member", member), zap.Bool("isNew", isNew))
 	}
 
+	if err := h.refreshConversationMembers(tx, i.GetConversationPublicKey()); err != nil {
+		return nil, false, err
+	}
+
 	return i, false, nil
 }
 
+// handleInteraction checks the sender of an interaction built from an app message and passes it to the handler of its
+// type, it is called within the transaction of the message
+func (h *eventHandler) handleInteraction(tx *dbWrapper, i *messengertypes.Interaction, am *messengertypes.AppMessage, handler func(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error), isVisibleEvent bool) (*messengertypes.Interaction, bool, error) {
+	if err := h.interactionFetchRelations(tx, i); err != nil {
+		return nil, false, err
+	}
+
+	if blocked, err := tx.isInteractionSenderBlocked(i); err != nil {
+		return nil, false, err
+	} else if blocked {
+		return nil, false, errSenderBlocked
+	}
+
+	if allowed, err := tx.isInteractionSenderAllowed(i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		return nil, false, errSenderNotAllowed
+	}
+
+	if !i.GetIsMe() {
+		if muted, err := tx.isMemberMuted(i.GetConversationPublicKey(), i.GetMemberPublicKey()); err != nil {
+			return nil, false, err
+		} else if muted {
+			i.IsMemberMuted = true
+		}
+	}
+
+	// the hides are kept by a local overlay, the interactions hidden before a replay are hidden again
+	if hidden, err := tx.isInteractionHidden(i.GetCID()); err != nil {
+		return nil, false, err
+	} else if hidden {
+		i.IsHidden = true
+	}
+
+	// a message retracted by its sender before it was received is dropped
+	if isVisibleEvent {
+		if retracted, err := tx.isInteractionRetracted(i); err != nil {
+			return nil, false, err
+		} else if retracted {
+			return nil, false, errInteractionPruned
+		}
+	}
+
+	// the logs are listed again on each start, the messages pruned by the retention policy or older than the retention
+	// of the conversation must not come back, the starred messages and their reactions are kept
+	if isVisibleEvent || i.GetTargetCID() != "" {
+		keptCID := i.GetCID()
+		if !isVisibleEvent {
+			keptCID = i.GetTargetCID()
+		}
+
+		if cutoff, err := retentionCutoff(tx, i.GetConversationPublicKey(), timestampMs(time.Now())); err != nil {
+			return nil, false, err
+		} else if i.GetSentDate() <= cutoff {
+			if starred, err := tx.isInteractionStarred(keptCID); err != nil {
+				return nil, false, err
+			} else if !starred {
+				return nil, false, errInteractionPruned
+			}
+		}
+	}
+
+	if err := h.interactionConsumeAck(tx, i); err != nil {
+		return nil, false, err
+	}
+
+	// parse payload
+	amPayload, err := am.UnmarshalPayload()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := validateAppMessage(tx, i, amPayload); err != nil {
+		return nil, false, err
+	}
+
+	return handler(tx, i, amPayload)
+}
+
 func interactionFromAppMessage(h *eventHandler, gpk string, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage) (*messengertypes.Interaction, error) {
 	amt := am.GetType()
 	cid, err := ipfscid.Cast(gme.GetEventContext().GetID())
@@ -954,11 +1755,27 @@ func interactionFromAppMessage(h *eventHandler, gpk string, gme *protocoltypes.G
 		DevicePublicKey:       dpk,
 		Medias:                am.GetMedias(),
 		MemberPublicKey:       mpk,
+		LamportTime:           gme.GetEventContext().GetLamportTime(),
+		ViaGateway:            am.GetViaGateway(),
+		ReceivedDate:          timestampMs(time.Now()),
+	}
+
+	if device := sanitizeDeviceInfo(am.GetDevice()); device != nil {
+		i.DeviceKind = device.GetKind()
+		i.DeviceName = device.GetName()
+	}
+
+	// the message is kept without its extensions when they exceed the limits
+	if err := messengertypes.CheckExtensions(am.GetExtensions()); err != nil {
+		h.logger.Warn("dropping the extensions of an app message", zap.String("cid", i.CID), zap.Error(err))
+	} else {
+		i.Extensions = am.InteractionExtensions(i.CID, gpk)
 	}
 
 	for _, media := range i.Medias {
 		media.InteractionCID = i.CID
 		media.State = messengertypes.Media_StateNeverDownloaded
+		media.SanitizeMetadata()
 	}
 
 	return &i, nil
@@ -994,7 +1811,7 @@ func (h *eventHandler) interactionFetchRelations(tx *dbWrapper, i *messengertype
 		// fetch member from db
 		member, err := tx.getMemberByPK(i.MemberPublicKey, i.ConversationPublicKey)
 		if err != nil {
-			h.logger.Warn("multimember message member not found", zap.String("public-key", i.MemberPublicKey), zap.Error(err))
+			h.logger.Warn("multimember message member not found", logContact(i.MemberPublicKey), zap.Error(err))
 		}
 
 		i.Member = member
@@ -1016,7 +1833,13 @@ func (h *eventHandler) dispatchVisibleInteraction(i *messengertypes.Interaction)
 			return err
 		}
 
-		newUnread := !h.replay && !i.IsMe && !opened
+		readUntil, err := tx.getConversationReadUntil(i.ConversationPublicKey)
+		if err != nil {
+			return err
+		}
+
+		// a message sent before the read position has already been read on another device
+		newUnread := !h.replay && !i.IsMe && !opened && i.GetSentDate() > readUntil
 
 		// db update
 		if err := tx.updateConversationReadState(i.ConversationPublicKey, newUnread, time.Now()); err != nil {
@@ -1039,12 +1862,28 @@ func (h *eventHandler) dispatchVisibleInteraction(i *messengertypes.Interaction)
 	})
 }
 
-func (h *eventHandler) sendAck(cid, conversationPK string) error {
+func (h *eventHandler) sendAck(i *messengertypes.Interaction) error {
+	cid, conversationPK := i.GetCID(), i.GetConversationPublicKey()
+
+	// acks would leak our presence to a blocked contact or member
+	if blocked, err := h.db.isAckTargetBlocked(conversationPK, i.GetMemberPublicKey(), i.GetDevicePublicKey()); err != nil {
+		return err
+	} else if blocked {
+		return nil
+	}
+
+	// an observer doesn't acknowledge the messages of the group
+	if observed, err := h.db.isConversationObserved(conversationPK); err != nil {
+		return err
+	} else if observed {
+		return nil
+	}
+
 	h.logger.Debug("sending ack", zap.String("target", cid))
 
 	// Don't send ack if message is already acked to prevent spam in multimember groups
 	// Maybe wait a few seconds before checking since we're likely to receive the message before any ack
-	amp, err := messengertypes.AppMessage_TypeAcknowledge.MarshalPayload(0, nil, &messengertypes.AppMessage_Acknowledge{Target: cid})
+	amp, err := messengertypes.AppMessage_TypeAcknowledge.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_Acknowledge{Target: cid})
 	if err != nil {
 		return err
 	}
@@ -1075,6 +1914,7 @@ func (h *eventHandler) interactionConsumeAck(tx *dbWrapper, i *messengertypes.In
 	}
 
 	i.Acknowledged = true
+	i.DeliveryCount += int64(len(cids))
 
 	if err := tx.deleteInteractions(cids); err != nil {
 		return err
@@ -4,10 +4,15 @@ import (
 	"context"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
+	ipfscid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
 	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
 )
 
 type getEventHandlerForTestsOptions int
@@ -136,9 +141,81 @@ func Test_eventHandler_handleAppMessageUserMessage(t *testing.T) {
 	t.Skip("TODO")
 }
 
+func Test_eventHandler_handleAppMessageUserMessageFormatting(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	um := &messengertypes.AppMessage_UserMessage{
+		Body: "héllo world",
+		Formatting: []*messengertypes.AppMessage_UserMessage_Formatting{
+			{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeItalic, Offset: 6, Length: 5},
+			{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeBold, Offset: 0, Length: 5},
+			// out of the body
+			{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeCode, Offset: 6, Length: 6},
+			// a block quote must start a line
+			{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeBlockQuote, Offset: 6, Length: 5},
+		},
+	}
+	payload, err := proto.Marshal(um)
+	require.NoError(t, err)
+
+	_, _, err = h.handleAppMessageUserMessage(db, &messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", Payload: payload}, um)
+	require.NoError(t, err)
+
+	i, err := db.getInteractionByCID("cid_1")
+	require.NoError(t, err)
+
+	stored, err := i.UnmarshalPayload()
+	require.NoError(t, err)
+	require.Equal(t, []*messengertypes.AppMessage_UserMessage_Formatting{
+		{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeBold, Offset: 0, Length: 5},
+		{Type: messengertypes.AppMessage_UserMessage_Formatting_TypeItalic, Offset: 6, Length: 5},
+	}, stored.(*messengertypes.AppMessage_UserMessage).GetFormatting())
+}
+
 func Test_eventHandler_handleMetadataEvent(t *testing.T) {
-	// TODO
-	t.Skip("TODO")
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	handler := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, true)
+
+	handled := 0
+	handler.metadataHandlers[protocoltypes.EventTypeGroupReplicating] = func(gme *protocoltypes.GroupMetadataEvent) error {
+		handled++
+		return nil
+	}
+
+	cid, err := ipfscid.Prefix{Version: 1, Codec: ipfscid.Raw, MhType: mh.SHA2_256, MhLength: -1}.Sum([]byte("event_1"))
+	require.NoError(t, err)
+
+	gme := &protocoltypes.GroupMetadataEvent{
+		EventContext: &protocoltypes.EventContext{ID: cid.Bytes(), GroupPK: []byte("group_1")},
+		Metadata:     &protocoltypes.GroupMetadata{EventType: protocoltypes.EventTypeGroupReplicating},
+		Event:        []byte("content_1"),
+	}
+
+	// the events delivered again are skipped
+	require.NoError(t, handler.handleMetadataEvent(gme))
+	require.NoError(t, handler.handleMetadataEvent(gme))
+	require.Equal(t, 1, handled)
+
+	// unless their content changed
+	gme.Event = []byte("content_2")
+	require.NoError(t, handler.handleMetadataEvent(gme))
+	require.Equal(t, 2, handled)
+
+	// the events without a valid cid are always handled
+	gme.EventContext.ID = []byte("invalid")
+	require.NoError(t, handler.handleMetadataEvent(gme))
+	require.NoError(t, handler.handleMetadataEvent(gme))
+	require.Equal(t, 4, handled)
+
+	info, err := db.getDBInfo()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), info.GetProcessedEvents())
 }
 
 func Test_eventHandler_hydrateInteraction(t *testing.T) {
@@ -150,3 +227,63 @@ func Test_interactionFromAppMessage(t *testing.T) {
 	// TODO
 	t.Skip("TODO")
 }
+
+func Test_eventHandler_compactAcksAndReactions(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		db, dispose := getInMemoryTestDB(t)
+
+		require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_message", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1"}).Error)
+
+		h := &eventHandler{db: db, logger: zap.NewNop(), compact: compact}
+		interaction := func(cid string, isMe bool, devicePK string, sentDate int64) *messengertypes.Interaction {
+			return &messengertypes.Interaction{CID: cid, ConversationPublicKey: "conv_1", IsMe: isMe, DevicePublicKey: devicePK, SentDate: sentDate}
+		}
+
+		_, _, err := h.handleAppMessageAcknowledge(db, interaction("cid_ack_1", false, "device_1", 1000), &messengertypes.AppMessage_Acknowledge{Target: "cid_message"})
+		require.NoError(t, err)
+		_, _, err = h.handleAppMessageAcknowledge(db, interaction("cid_ack_2", false, "device_2", 2000), &messengertypes.AppMessage_Acknowledge{Target: "cid_message"})
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageUserReaction(db, interaction("cid_reaction_1", false, "device_1", 1000), &messengertypes.AppMessage_UserReaction{Target: "cid_message", Emoji: "👍"})
+		require.NoError(t, err)
+		_, _, err = h.handleAppMessageUserReaction(db, interaction("cid_reaction_2", true, "device_me", 3000), &messengertypes.AppMessage_UserReaction{Target: "cid_message", Emoji: "👍"})
+		require.NoError(t, err)
+		_, _, err = h.handleAppMessageUserReaction(db, interaction("cid_reaction_3", false, "device_2", 2000), &messengertypes.AppMessage_UserReaction{Target: "cid_message", Emoji: "🎉"})
+		require.NoError(t, err)
+
+		// the summaries are the same whether the events are compacted or not
+		i, err := db.getInteractionByCID("cid_message")
+		require.NoError(t, err)
+		require.True(t, i.GetAcknowledged())
+		require.Equal(t, int64(2), i.GetDeliveryCount())
+		require.Len(t, i.GetReactions(), 2)
+		for _, reaction := range i.GetReactions() {
+			switch reaction.GetEmoji() {
+			case "👍":
+				require.Equal(t, int64(2), reaction.GetCount())
+				require.True(t, reaction.GetOwnState())
+				require.Equal(t, int64(3000), reaction.GetLastReactionDate())
+			case "🎉":
+				require.Equal(t, int64(1), reaction.GetCount())
+				require.False(t, reaction.GetOwnState())
+			}
+		}
+
+		deliveries, err := db.getInteractionDeliveries("cid_message")
+		require.NoError(t, err)
+
+		reactions := int64(0)
+		require.NoError(t, db.db.Model(&messengertypes.Interaction{}).Where("target_cid = ?", "cid_message").Count(&reactions).Error)
+
+		if compact {
+			require.Empty(t, deliveries)
+			require.Zero(t, reactions)
+		} else {
+			require.Len(t, deliveries, 2)
+			require.Equal(t, int64(3), reactions)
+		}
+
+		dispose()
+	}
+}
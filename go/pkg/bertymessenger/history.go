@@ -0,0 +1,287 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// historyInitialLoadCount is the number of most recent message events of each group replayed when the database is
+	// rebuilt, the older ones are loaded on demand
+	historyInitialLoadCount = 100
+	// historyLoadMaxCount bounds the number of message events loaded at once by ConversationLoad
+	historyLoadMaxCount = 100
+	// historyPageMaxSize is the default bound to the size in bytes of the message events held in memory at once, the
+	// next events are loaded with the next page
+	historyPageMaxSize = 16 * 1024 * 1024
+)
+
+// listMessageHistory reads up to count message events of a group log, the most recent first, starting before until
+// when it is set. The events read stop once their size exceeds maxSize, at least one is returned. complete is true
+// when the beginning of the log is reached
+func listMessageHistory(ctx context.Context, client protocoltypes.ProtocolServiceClient, groupPK []byte, until []byte, count int, maxSize int64) ([]*protocoltypes.GroupMessageEvent, bool, error) {
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	msgList, err := client.GroupMessageList(subCtx, &protocoltypes.GroupMessageList_Request{
+		GroupPK:      groupPK,
+		UntilID:      until,
+		UntilNow:     until == nil,
+		ReverseOrder: true,
+	})
+	if err != nil {
+		return nil, false, errcode.ErrEventListMessage.Wrap(err)
+	}
+
+	events := []*protocoltypes.GroupMessageEvent(nil)
+	size := int64(0)
+	for {
+		message, err := msgList.Recv()
+		if err == io.EOF {
+			return events, true, nil
+		} else if err != nil {
+			return nil, false, errcode.ErrEventListMessage.Wrap(err)
+		}
+
+		// the range is inclusive, the event at the cursor is already loaded
+		if until != nil && bytes.Equal(message.GetEventContext().GetID(), until) {
+			continue
+		}
+
+		// an event past the requested count means the history is not complete yet
+		if len(events) == count {
+			return events, false, nil
+		}
+
+		size += int64(len(message.GetMessage()))
+		if len(events) > 0 && size > maxSize {
+			return events, false, nil
+		}
+
+		events = append(events, message)
+	}
+}
+
+// handleMessageEvent handles a message event of a group, the failures are added to the report of a replay with the
+// context of the event
+func handleMessageEvent(handler *eventHandler, groupPK []byte, evt *protocoltypes.GroupMessageEvent) error {
+	var appMsg messengertypes.AppMessage
+	if err := proto.Unmarshal(evt.GetMessage(), &appMsg); err != nil {
+		return handler.replayFailed(errcode.ErrDeserialization, groupPK, evt.GetEventContext(), "", err)
+	}
+
+	if err := handler.recoverHandling(evt.GetEventContext(), func() error { return handler.handleAppMessage(b64EncodeBytes(groupPK), evt, &appMsg) }); err != nil {
+		return handler.replayFailed(errcode.ErrReplayAppMessageHandling, groupPK, evt.GetEventContext(), appMsg.GetType().String(), err)
+	}
+	handler.failures.handled(b64EncodeBytes(groupPK))
+
+	return nil
+}
+
+// processMessageHistory handles up to count message events older than until, in chronological order, it returns the
+// new history cursor, nil once the whole log has been handled
+func processMessageHistory(ctx context.Context, groupPK []byte, until []byte, count int, maxSize int64, handler *eventHandler) ([]byte, error) {
+	events, complete, err := listMessageHistory(ctx, handler.protocolClient, groupPK, until, count, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		if err := handleMessageEvent(handler, groupPK, events[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if complete {
+		return nil, nil
+	}
+
+	return events[len(events)-1].GetEventContext().GetID(), nil
+}
+
+// processMessageWindow handles the message events of a group sent within window, in chronological order, or the most
+// recent ones when the window is not set. It returns the history cursor from which the older events are loaded on
+// demand, nil once the whole log has been handled
+func processMessageWindow(ctx context.Context, groupPK []byte, window ReplayOptions, handler *eventHandler) ([]byte, error) {
+	if window.isZero() {
+		count := historyInitialLoadCount
+		if window.HeadOnly {
+			count = 1
+		}
+
+		return processMessageHistory(ctx, groupPK, nil, count, window.maxSize(), handler)
+	}
+
+	// the bounds of the window are first found from the headers of the events, the events are then streamed
+	// between them so their payloads are not held in memory at once
+	newestID, oldestID, complete, err := findMessageWindow(ctx, handler.protocolClient, groupPK, window)
+	if err != nil || newestID == nil {
+		return nil, err
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	msgList, err := handler.protocolClient.GroupMessageList(subCtx, &protocoltypes.GroupMessageList_Request{
+		GroupPK: groupPK,
+		SinceID: oldestID,
+		UntilID: newestID,
+	})
+	if err != nil {
+		return nil, errcode.ErrEventListMessage.Wrap(err)
+	}
+
+	for {
+		message, err := msgList.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errcode.ErrEventListMessage.Wrap(err)
+		}
+
+		if err := handleMessageEvent(handler, groupPK, message); err != nil {
+			return nil, err
+		}
+	}
+
+	if complete {
+		return nil, nil
+	}
+
+	return oldestID, nil
+}
+
+// findMessageWindow returns the IDs of the newest and of the oldest message events of a group sent within window, only
+// the headers of the messages are decoded. When the events older than the window are reached first, the most recent
+// of them is returned as both bounds so the history cursor points to a handled event. complete is true when the
+// beginning of the log is within the window
+func findMessageWindow(ctx context.Context, client protocoltypes.ProtocolServiceClient, groupPK []byte, window ReplayOptions) ([]byte, []byte, bool, error) {
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	msgList, err := client.GroupMessageList(subCtx, &protocoltypes.GroupMessageList_Request{
+		GroupPK:      groupPK,
+		UntilNow:     true,
+		ReverseOrder: true,
+	})
+	if err != nil {
+		return nil, nil, false, errcode.ErrEventListMessage.Wrap(err)
+	}
+
+	newestID, oldestID := []byte(nil), []byte(nil)
+	for {
+		message, err := msgList.Recv()
+		if err == io.EOF {
+			return newestID, oldestID, true, nil
+		} else if err != nil {
+			return nil, nil, false, errcode.ErrEventListMessage.Wrap(err)
+		}
+
+		var header messengertypes.AppMessageHeader
+		if err := proto.Unmarshal(message.GetMessage(), &header); err != nil {
+			return nil, nil, false, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if !window.Until.IsZero() && header.GetSentDate() > timestampMs(window.Until) {
+			continue
+		}
+
+		id := message.GetEventContext().GetID()
+		if !window.contains(header.GetSentDate()) {
+			if newestID == nil {
+				return id, id, false, nil
+			}
+
+			return newestID, oldestID, false, nil
+		}
+
+		if newestID == nil {
+			newestID = id
+		}
+		oldestID = id
+	}
+}
+
+// loadConversationHistory handles the next page of message events older than the history cursor of a conversation
+func (svc *service) loadConversationHistory(ctx context.Context, convPK string, count int) (*messengertypes.Conversation, error) {
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if conv.GetHistoryCursor() == "" {
+		return conv, nil
+	}
+
+	gpk, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	until, err := b64DecodeBytes(conv.GetHistoryCursor())
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	// the old messages are handled like a replay, they are neither acknowledged nor notified
+	handler := newEventHandler(ctx, svc.db, svc.protocolClient, svc.logger, svc, true)
+	cursor, err := processMessageHistory(ctx, gpk, until, count, historyPageMaxSize, handler)
+	if err != nil {
+		return nil, errcode.ErrReplayProcessGroupMessage.Wrap(err)
+	}
+
+	conv, err = svc.db.setConversationHistoryCursor(convPK, b64EncodeBytes(cursor))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, err
+	}
+
+	return conv, nil
+}
+
+// completeHistories loads the history of the conversations left incomplete by a head-only replay, the most recently
+// updated first. The history is loaded a page at a time so the live events are handled in between,
+// ConversationConsistent is streamed once the history of a conversation is complete
+func (svc *service) completeHistories(ctx context.Context) {
+	pks, err := svc.db.getIncompleteHistoryConversationPKs()
+	if err != nil {
+		svc.logger.Error("unable to list the conversations to replay", zap.Error(err))
+		return
+	}
+
+	for _, pk := range pks {
+		for ctx.Err() == nil {
+			conv, err := func() (*messengertypes.Conversation, error) {
+				defer svc.writer.enter()()
+
+				return svc.loadConversationHistory(ctx, pk, historyLoadMaxCount)
+			}()
+			if err != nil {
+				svc.logger.Warn("unable to replay the history of a conversation", logGroup(pk), zap.Error(err))
+				break
+			}
+
+			if conv.GetHistoryCursor() != "" {
+				continue
+			}
+
+			if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationConsistent, &messengertypes.StreamEvent_ConversationConsistent{Conversation: conv}, false); err != nil {
+				svc.logger.Error("unable to dispatch conversation consistency", logGroup(pk), zap.Error(err))
+			}
+
+			break
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package bertymessenger
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// importedMessage is a message read from the chat export of another messenger
+type importedMessage struct {
+	sender   string
+	sentDate int64
+	outgoing bool
+	body     string
+}
+
+// whatsAppHeaderRegexp matches the first line of a WhatsApp message, both the Android format
+// "31/12/20, 21:41 - Alice: hello" and the iOS format "[31/12/2020, 9:41:05 PM] Alice: hello"
+var whatsAppHeaderRegexp = regexp.MustCompile(`^\[?(\d{1,2})[/.-](\d{1,2})[/.-](\d{2,4}),? (\d{1,2}):(\d{2})(?::(\d{2}))? ?([AaPp][Mm])?\]?(?: -)? (.*)$`)
+
+// parseWhatsAppExport reads a WhatsApp .txt chat export, the lines not starting with a date belong to the previous
+// message and the system messages, without a sender, are skipped
+func parseWhatsAppExport(r io.Reader, dayFirst bool, loc *time.Location) ([]*importedMessage, error) {
+	messages := []*importedMessage(nil)
+	var current *importedMessage
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.NewReplacer("\u200e", "", "\u202f", " ", "\u00a0", " ").Replace(scanner.Text())
+
+		match := whatsAppHeaderRegexp.FindStringSubmatch(line)
+		if match == nil {
+			if current != nil {
+				current.body += "\n" + line
+			}
+			continue
+		}
+
+		sentDate, err := parseWhatsAppDate(match[1:8], dayFirst, loc)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid date in %q: %w", line, err))
+		}
+
+		current = nil
+		sep := strings.Index(match[8], ": ")
+		if sep <= 0 {
+			continue
+		}
+
+		current = &importedMessage{
+			sender:   match[8][:sep],
+			sentDate: sentDate,
+			body:     match[8][sep+2:],
+		}
+		messages = append(messages, current)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	return messages, nil
+}
+
+// parseWhatsAppDate converts the day, month, year, hour, minute, second and AM/PM parts of a WhatsApp header in
+// milliseconds
+func parseWhatsAppDate(parts []string, dayFirst bool, loc *time.Location) (int64, error) {
+	values := make([]int, 6)
+	for i, part := range parts[:6] {
+		if part == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return 0, err
+		}
+		values[i] = value
+	}
+
+	day, month, year, hour, minute, second := values[0], values[1], values[2], values[3], values[4], values[5]
+	if !dayFirst {
+		day, month = month, day
+	}
+
+	if year < 100 {
+		year += 2000
+	}
+
+	switch strings.ToUpper(parts[6]) {
+	case "AM":
+		hour %= 12
+	case "PM":
+		hour = hour%12 + 12
+	}
+
+	if day < 1 || day > 31 || month < 1 || month > 12 || hour > 23 || minute > 59 || second > 59 {
+		return 0, fmt.Errorf("out of range")
+	}
+
+	return time.Date(year, time.Month(month), day, hour, minute, second, 0, loc).UnixNano() / int64(time.Millisecond), nil
+}
+
+type signalExportMessage struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	SentAt int64  `json:"sent_at"`
+	Body   string `json:"body"`
+}
+
+// parseSignalExport reads the JSON array of the messages of a Signal Desktop conversation, only the incoming and
+// outgoing messages with a body are kept
+func parseSignalExport(r io.Reader) ([]*importedMessage, error) {
+	exported := []*signalExportMessage(nil)
+	if err := json.NewDecoder(r).Decode(&exported); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	messages := []*importedMessage(nil)
+	for _, message := range exported {
+		if message.Body == "" || (message.Type != "incoming" && message.Type != "outgoing") {
+			continue
+		}
+
+		messages = append(messages, &importedMessage{
+			sender:   message.Source,
+			sentDate: message.SentAt,
+			outgoing: message.Type == "outgoing",
+			body:     message.Body,
+		})
+	}
+
+	return messages, nil
+}
+
+// importedInteraction converts an imported message, its cid is derived from its content so importing the same export
+// twice doesn't duplicate it
+func importedInteraction(convPK string, message *importedMessage, mappings map[string]*messengertypes.ConversationImport_SenderMapping) (*messengertypes.Interaction, error) {
+	um := &messengertypes.AppMessage_UserMessage{Body: message.body}
+	payload, err := proto.Marshal(um)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	hash := sha256.Sum256([]byte(fmt.Sprintf("import\x00%s\x00%d\x00%s\x00%s", convPK, message.sentDate, message.sender, message.body)))
+
+	i := &messengertypes.Interaction{
+		CID:                   b64EncodeBytes(hash[:]),
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		ConversationPublicKey: convPK,
+		Payload:               payload,
+		IsMe:                  message.outgoing,
+		SentDate:              message.sentDate,
+		Acknowledged:          true,
+		IsImported:            true,
+		ImportedAuthor:        message.sender,
+	}
+	setInteractionContentFlags(i, um, nil)
+
+	if mapping, ok := mappings[message.sender]; ok {
+		i.MemberPublicKey = mapping.GetMemberPublicKey()
+		i.IsMe = i.IsMe || mapping.GetIsMe()
+	}
+
+	return i, nil
+}
+
+func (svc *service) ConversationImport(server messengertypes.MessengerService_ConversationImportServer) error {
+	exportFile, err := ioutil.TempFile(os.TempDir(), "import-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(exportFile.Name())
+	defer exportFile.Close()
+
+	var header *messengertypes.ConversationImport_Request
+	for {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if header == nil {
+			header = req
+		}
+
+		if _, err := exportFile.Write(req.GetExportData()); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	if header.GetConversationPublicKey() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	if _, err := exportFile.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	var messages []*importedMessage
+	switch header.GetFormat() {
+	case messengertypes.ConversationImport_FormatWhatsApp:
+		messages, err = parseWhatsAppExport(exportFile, header.GetDayFirst(), time.Local)
+	case messengertypes.ConversationImport_FormatSignal:
+		messages, err = parseSignalExport(exportFile)
+	default:
+		err = errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown import format %d", header.GetFormat()))
+	}
+	if err != nil {
+		return err
+	}
+
+	mappings := map[string]*messengertypes.ConversationImport_SenderMapping{}
+	for _, mapping := range header.GetSenderMappings() {
+		mappings[mapping.GetForeignId()] = mapping
+	}
+
+	interactions := make([]*messengertypes.Interaction, len(messages))
+	for idx, message := range messages {
+		if interactions[idx], err = importedInteraction(header.GetConversationPublicKey(), message, mappings); err != nil {
+			return err
+		}
+	}
+
+	defer svc.writer.enter()()
+
+	if _, err := svc.db.getConversationByPK(header.GetConversationPublicKey()); err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	count, err := svc.db.addImportedInteractions(interactions)
+	if err != nil {
+		return err
+	}
+
+	return server.SendAndClose(&messengertypes.ConversationImport_Reply{ImportedCount: count})
+}
@@ -0,0 +1,106 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_parseWhatsAppExport(t *testing.T) {
+	android := `31/12/20, 21:41 - Messages and calls are end-to-end encrypted.
+31/12/20, 21:41 - Alice: hello
+how are you?
+31/12/20, 21:42 - Bob: fine: thanks
+`
+
+	messages, err := parseWhatsAppExport(strings.NewReader(android), true, time.UTC)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "Alice", messages[0].sender)
+	require.Equal(t, "hello\nhow are you?", messages[0].body)
+	require.Equal(t, time.Date(2020, 12, 31, 21, 41, 0, 0, time.UTC).UnixNano()/int64(time.Millisecond), messages[0].sentDate)
+	require.Equal(t, "Bob", messages[1].sender)
+	require.Equal(t, "fine: thanks", messages[1].body)
+
+	ios := "[12/31/2020, 9:41:05 PM] Alice: hello\n\u200e[1/1/2021, 12:00:00 AM] Bob: happy new year\n"
+
+	messages, err = parseWhatsAppExport(strings.NewReader(ios), false, time.UTC)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, time.Date(2020, 12, 31, 21, 41, 5, 0, time.UTC).UnixNano()/int64(time.Millisecond), messages[0].sentDate)
+	require.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()/int64(time.Millisecond), messages[1].sentDate)
+	require.Equal(t, "happy new year", messages[1].body)
+
+	// the month can't be greater than 12
+	_, err = parseWhatsAppExport(strings.NewReader(android), false, time.UTC)
+	require.Error(t, err)
+}
+
+func Test_parseSignalExport(t *testing.T) {
+	export := `[
+		{"type": "outgoing", "sent_at": 1000, "body": "hello"},
+		{"type": "incoming", "source": "+33600000000", "sent_at": 2000, "body": "hi"},
+		{"type": "incoming", "source": "+33600000000", "sent_at": 3000, "body": ""},
+		{"type": "keychange", "source": "+33600000000", "sent_at": 4000}
+	]`
+
+	messages, err := parseSignalExport(strings.NewReader(export))
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.True(t, messages[0].outgoing)
+	require.Equal(t, int64(1000), messages[0].sentDate)
+	require.False(t, messages[1].outgoing)
+	require.Equal(t, "+33600000000", messages[1].sender)
+
+	_, err = parseSignalExport(strings.NewReader("not json"))
+	require.Error(t, err)
+}
+
+func Test_dbWrapper_addImportedInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	mappings := map[string]*messengertypes.ConversationImport_SenderMapping{
+		"Alice": {ForeignId: "Alice", IsMe: true},
+		"Bob":   {ForeignId: "Bob", MemberPublicKey: "member_2"},
+	}
+
+	messages := []*importedMessage{
+		{sender: "Alice", sentDate: 1000, body: "hello"},
+		{sender: "Bob", sentDate: 2000, body: "hi"},
+		{sender: "Carol", sentDate: 3000, body: "hey"},
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	for _, message := range messages {
+		i, err := importedInteraction("conv_1", message, mappings)
+		require.NoError(t, err)
+		interactions = append(interactions, i)
+	}
+
+	require.True(t, interactions[0].GetIsMe())
+	require.Equal(t, "member_2", interactions[1].GetMemberPublicKey())
+	require.False(t, interactions[2].GetIsMe())
+	require.Equal(t, "Carol", interactions[2].GetImportedAuthor())
+
+	count, err := db.addImportedInteractions(interactions)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), count)
+
+	// importing the same messages again doesn't duplicate them
+	again, err := importedInteraction("conv_1", messages[0], mappings)
+	require.NoError(t, err)
+	count, err = db.addImportedInteractions([]*messengertypes.Interaction{again})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), count)
+
+	kept := keepImportedInteractions(db.db, nil)
+	require.Len(t, kept, 3)
+	for _, i := range kept {
+		require.True(t, i.GetIsImported())
+	}
+}
@@ -0,0 +1,247 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// historyShareMaxCount bounds the number of messages of a history bundle, the most recent ones are shared
+	historyShareMaxCount = 500
+	// historyBundleMaxSize bounds the size of a history bundle read by a new member
+	historyBundleMaxSize = 16 * 1024 * 1024
+)
+
+// The history of a group is shared by the members who opted in with ConversationSetHistorySharing: when a new member
+// joins, they send the recent messages of the group as an attachment in a history bundle message. The new member
+// imports them as shared history, distinct from the messages read from the group log, and keeps them in the local
+// state as the bundle is not imported again on a replay.
+
+func (h *eventHandler) handleAppMessageHistoryBundle(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_HistoryBundle)
+
+	if i.GetIsMe() || (payload.GetMemberPublicKey() != "" && payload.GetMemberPublicKey() != i.GetConversation().GetAccountMemberPublicKey()) {
+		return i, false, nil
+	}
+
+	if payload.GetBundleCID() == "" {
+		h.logger.Warn("ignoring history bundle without attachment", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if h.replay || h.svc == nil {
+		return i, false, nil
+	}
+
+	// the bundle is retrieved without holding the lock
+	convPK, bundleCID := i.GetConversationPublicKey(), payload.GetBundleCID()
+	go func() {
+		count, err := h.svc.importHistoryBundle(convPK, bundleCID)
+		if err != nil {
+			h.logger.Error("unable to import history bundle", zap.String("bundle-cid", bundleCID), zap.Error(err))
+			return
+		}
+
+		h.logger.Info("imported shared history", logGroup(convPK), zap.Int64("count", count))
+	}()
+
+	return i, false, nil
+}
+
+// onMemberJoined shares the history of a group with a new member when the account opted in
+func (h *eventHandler) onMemberJoined(convPK, memberPK string) {
+	if h.svc == nil || h.replay {
+		return
+	}
+
+	go func() {
+		if err := h.svc.shareHistory(h.svc.ctx, convPK, memberPK); err != nil {
+			h.logger.Error("unable to share history", logGroup(convPK), zap.String("member-pk", memberPK), zap.Error(err))
+		}
+	}()
+}
+
+// shareHistory sends the recent messages of a group to a new member, nothing is sent when the history is not shared
+func (svc *service) shareHistory(ctx context.Context, convPK, memberPK string) error {
+	bundle, err := func() (*messengertypes.HistoryBundle, error) {
+		defer svc.writer.enter()()
+
+		conv, err := svc.db.getConversationByPK(convPK)
+		if err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+
+		if conv.GetType() != messengertypes.Conversation_MultiMemberType || conv.GetHistorySharingWindow() <= 0 {
+			return nil, nil
+		}
+
+		return svc.db.getHistoryBundle(convPK, timestampMs(time.Now())-conv.GetHistorySharingWindow(), historyShareMaxCount)
+	}()
+	if err != nil || len(bundle.GetMessages()) == 0 {
+		return err
+	}
+
+	if err := svc.sendHistoryBundle(ctx, convPK, memberPK, bundle); err != nil {
+		return err
+	}
+
+	svc.logger.Info("shared history with a new member", logGroup(convPK), zap.Int("count", len(bundle.GetMessages())))
+
+	return nil
+}
+
+// sendHistoryBundle sends a history bundle as an attachment in a group, to a member or to every member when memberPK is
+// empty
+func (svc *service) sendHistoryBundle(ctx context.Context, convPK, memberPK string, bundle *messengertypes.HistoryBundle) error {
+	raw, err := proto.Marshal(bundle)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	cid, err := svc.attachmentPrepare(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	gpk, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	am, err := messengertypes.AppMessage_TypeHistoryBundle.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_HistoryBundle{
+		MemberPublicKey: memberPK,
+		BundleCID:       b64EncodeBytes(cid),
+	})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: am, AttachmentCIDs: [][]byte{cid}}); err != nil {
+		return errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	return nil
+}
+
+// sharedHistoryInteractions converts the messages of a history bundle, the ones which are not user messages are
+// dropped
+func sharedHistoryInteractions(conv *messengertypes.Conversation, bundle *messengertypes.HistoryBundle) []*messengertypes.Interaction {
+	interactions := []*messengertypes.Interaction(nil)
+	for _, message := range bundle.GetMessages() {
+		if message.GetCID() == "" {
+			continue
+		}
+
+		if err := proto.Unmarshal(message.GetPayload(), &messengertypes.AppMessage_UserMessage{}); err != nil {
+			continue
+		}
+
+		interactions = append(interactions, &messengertypes.Interaction{
+			CID:                   message.GetCID(),
+			Type:                  messengertypes.AppMessage_TypeUserMessage,
+			ConversationPublicKey: conv.GetPublicKey(),
+			MemberPublicKey:       message.GetMemberPublicKey(),
+			Payload:               message.GetPayload(),
+			IsMe:                  message.GetMemberPublicKey() == conv.GetAccountMemberPublicKey(),
+			SentDate:              message.GetSentDate(),
+			Acknowledged:          true,
+			IsSharedHistory:       true,
+		})
+	}
+
+	return interactions
+}
+
+// importHistoryBundle reads a history bundle and adds its messages to a conversation, the messages already known are
+// skipped. It returns the number of messages added
+func (svc *service) importHistoryBundle(convPK, bundleCID string) (int64, error) {
+	attachment, err := svc.attachmentRetrieve(bundleCID)
+	if err != nil {
+		return 0, err
+	}
+	defer attachment.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(attachment, historyBundleMaxSize+1))
+	if err != nil {
+		return 0, errcode.ErrAttachmentRetrieve.Wrap(err)
+	}
+
+	if len(raw) > historyBundleMaxSize {
+		return 0, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the history bundle is larger than %d bytes", historyBundleMaxSize))
+	}
+
+	bundle := &messengertypes.HistoryBundle{}
+	if err := proto.Unmarshal(raw, bundle); err != nil {
+		return 0, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return 0, errcode.ErrNotFound.Wrap(err)
+	}
+
+	count := int64(0)
+	for _, i := range sharedHistoryInteractions(conv, bundle) {
+		if blocked, err := svc.db.isInteractionSenderBlocked(i); err != nil {
+			return count, err
+		} else if blocked {
+			continue
+		}
+
+		added, err := svc.db.addImportedInteractions([]*messengertypes.Interaction{i})
+		if err != nil {
+			return count, err
+		} else if added == 0 {
+			continue
+		}
+
+		count += added
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+func (svc *service) ConversationSetHistorySharing(ctx context.Context, req *messengertypes.ConversationSetHistorySharing_Request) (*messengertypes.ConversationSetHistorySharing_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the history can only be shared in a group"))
+	}
+
+	if conv, err = svc.db.setConversationHistorySharing(conv.GetPublicKey(), req.GetWindow()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.ConversationSetHistorySharing_Reply{Conversation: conv}, nil
+}
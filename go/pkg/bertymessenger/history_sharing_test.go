@@ -0,0 +1,61 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_getHistoryBundle(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", AccountMemberPublicKey: "member_me"})
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_old", SentDate: 1, MemberPublicKey: "member_1"},
+		{CID: "cid_1", SentDate: 10, MemberPublicKey: "member_1"},
+		{CID: "cid_2", SentDate: 11, IsMe: true},
+		{CID: "cid_3", SentDate: 12, MemberPublicKey: "member_1"},
+		{CID: "cid_imported", SentDate: 13, IsImported: true},
+		{CID: "cid_filtered", SentDate: 14, MemberPublicKey: "member_2", IsFiltered: true},
+		{CID: "cid_shared", SentDate: 15, MemberPublicKey: "member_2", IsSharedHistory: true},
+	} {
+		i.ConversationPublicKey = "conv_1"
+		i.Type = messengertypes.AppMessage_TypeUserMessage
+		db.db.Create(i)
+	}
+
+	// the most recent messages are kept, the oldest first
+	bundle, err := db.getHistoryBundle("conv_1", 5, 2)
+	require.NoError(t, err)
+	require.Len(t, bundle.GetMessages(), 2)
+	require.Equal(t, "cid_2", bundle.GetMessages()[0].GetCID())
+	require.Equal(t, "member_me", bundle.GetMessages()[0].GetMemberPublicKey())
+	require.Equal(t, "cid_3", bundle.GetMessages()[1].GetCID())
+
+	bundle, err = db.getHistoryBundle("conv_1", 5, historyShareMaxCount)
+	require.NoError(t, err)
+	require.Len(t, bundle.GetMessages(), 3)
+}
+
+func Test_sharedHistoryInteractions(t *testing.T) {
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	conv := &messengertypes.Conversation{PublicKey: "conv_1", AccountMemberPublicKey: "member_me"}
+	interactions := sharedHistoryInteractions(conv, &messengertypes.HistoryBundle{Messages: []*messengertypes.HistoryBundle_Message{
+		{CID: "cid_1", MemberPublicKey: "member_1", SentDate: 1, Payload: payload},
+		{CID: "cid_2", MemberPublicKey: "member_me", SentDate: 2, Payload: payload},
+		{MemberPublicKey: "member_1", SentDate: 3, Payload: payload},
+		{CID: "cid_4", MemberPublicKey: "member_1", SentDate: 4, Payload: []byte("not a message")},
+	}})
+
+	require.Len(t, interactions, 2)
+	require.False(t, interactions[0].GetIsMe())
+	require.True(t, interactions[0].GetIsSharedHistory())
+	require.Equal(t, "conv_1", interactions[0].GetConversationPublicKey())
+	require.True(t, interactions[1].GetIsMe())
+}
@@ -0,0 +1,138 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+type historyTestClient struct {
+	protocoltypes.ProtocolServiceClient
+	ids         [][]byte
+	payloadSize int
+}
+
+func (c *historyTestClient) GroupMessageList(ctx context.Context, in *protocoltypes.GroupMessageList_Request, opts ...grpc.CallOption) (protocoltypes.ProtocolService_GroupMessageListClient, error) {
+	events := []*protocoltypes.GroupMessageEvent(nil)
+	for _, id := range c.ids {
+		events = append(events, &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{ID: id}, Message: make([]byte, c.payloadSize)})
+		if in.GetUntilID() != nil && bytes.Equal(id, in.GetUntilID()) {
+			break
+		}
+	}
+
+	if in.GetReverseOrder() {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+
+	return &historyTestStream{events: events}, nil
+}
+
+type historyTestStream struct {
+	grpc.ClientStream
+	events []*protocoltypes.GroupMessageEvent
+}
+
+func (s *historyTestStream) Recv() (*protocoltypes.GroupMessageEvent, error) {
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	evt := s.events[0]
+	s.events = s.events[1:]
+	return evt, nil
+}
+
+func Test_listMessageHistory(t *testing.T) {
+	ctx := context.Background()
+	client := &historyTestClient{ids: [][]byte{{1}, {2}, {3}, {4}, {5}}}
+
+	ids := func(events []*protocoltypes.GroupMessageEvent) [][]byte {
+		ret := [][]byte(nil)
+		for _, evt := range events {
+			ret = append(ret, evt.GetEventContext().GetID())
+		}
+		return ret
+	}
+
+	// the most recent events first
+	events, complete, err := listMessageHistory(ctx, client, []byte("group"), nil, 2, historyPageMaxSize)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, [][]byte{{5}, {4}}, ids(events))
+
+	// the event at the cursor is excluded
+	events, complete, err = listMessageHistory(ctx, client, []byte("group"), []byte{4}, 2, historyPageMaxSize)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, [][]byte{{3}, {2}}, ids(events))
+
+	events, complete, err = listMessageHistory(ctx, client, []byte("group"), []byte{2}, 2, historyPageMaxSize)
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Equal(t, [][]byte{{1}}, ids(events))
+
+	// the whole log fits in a page
+	events, complete, err = listMessageHistory(ctx, client, []byte("group"), nil, 5, historyPageMaxSize)
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Len(t, events, 5)
+
+	// the events held in memory are bounded, an event larger than the bound is still returned alone
+	client.payloadSize = 10
+	events, complete, err = listMessageHistory(ctx, client, []byte("group"), nil, 5, 25)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, [][]byte{{5}, {4}}, ids(events))
+
+	events, complete, err = listMessageHistory(ctx, client, []byte("group"), nil, 5, 5)
+	require.NoError(t, err)
+	require.False(t, complete)
+	require.Equal(t, [][]byte{{5}}, ids(events))
+}
+
+func Test_dbWrapper_setConversationHistoryCursor(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setConversationHistoryCursor("", "cursor")
+	require.Error(t, err)
+
+	_, err = db.setConversationHistoryCursor("conv_1", "cursor")
+	require.Error(t, err)
+
+	_, err = db.addConversation("conv_1")
+	require.NoError(t, err)
+
+	conv, err := db.setConversationHistoryCursor("conv_1", "cursor")
+	require.NoError(t, err)
+	require.Equal(t, "cursor", conv.GetHistoryCursor())
+
+	conv, err = db.setConversationHistoryCursor("conv_1", "")
+	require.NoError(t, err)
+	require.Equal(t, "", conv.GetHistoryCursor())
+}
+
+func Test_dbWrapper_getIncompleteHistoryConversationPKs(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", HistoryCursor: "cursor", LastUpdate: 1}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", HistoryCursor: "cursor", LastUpdate: 2}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_3", LastUpdate: 3}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_4", HistoryCursor: "cursor", LastUpdate: 4, IsPaused: true}).Error)
+
+	// the most recently updated first, the complete and the paused conversations are left out
+	pks, err := db.getIncompleteHistoryConversationPKs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"conv_2", "conv_1"}, pks)
+}
@@ -0,0 +1,216 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/gogo/protobuf/proto"
+	ipfscid "github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The integrity check lists the group log of a conversation, whose events are verified by the protocol, and compares
+// them with the stored interactions of the same cid. A row which doesn't match its event has been altered since it was
+// handled, it is repaired by removing it and handling its event again.
+
+func (svc *service) IntegrityCheck(ctx context.Context, req *messengertypes.IntegrityCheck_Request) (*messengertypes.IntegrityCheck_Reply, error) {
+	defer svc.writer.enter()()
+
+	convPKs := []string(nil)
+	if pk := req.GetConversationPublicKey(); pk != "" {
+		conv, err := svc.db.getConversationByPK(pk)
+		if err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+
+		if conv.GetIsPaused() {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation is paused"))
+		}
+
+		convPKs = append(convPKs, pk)
+	} else {
+		convs, err := svc.db.getAllConversations()
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		for _, conv := range convs {
+			if conv.GetType() != messengertypes.Conversation_AccountType && !conv.GetIsPaused() {
+				convPKs = append(convPKs, conv.GetPublicKey())
+			}
+		}
+	}
+
+	handler := newEventHandler(ctx, svc.db, svc.protocolClient, svc.logger, svc, true)
+	reply := &messengertypes.IntegrityCheck_Reply{}
+	for _, convPK := range convPKs {
+		if err := svc.checkConversationIntegrity(ctx, handler, convPK, req.GetRepair(), reply); err != nil {
+			return nil, err
+		}
+	}
+
+	svc.logger.Info("integrity check done", zap.Int64("checked", reply.GetCheckedCount()), zap.Int("issues", len(reply.GetIssues())), zap.Int64("repaired", reply.GetRepairedCount()))
+
+	return reply, nil
+}
+
+func (svc *service) checkConversationIntegrity(ctx context.Context, handler *eventHandler, convPK string, repair bool, reply *messengertypes.IntegrityCheck_Reply) error {
+	groupPK, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	interactions, err := svc.db.getIntegrityCheckedInteractions(convPK)
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[string]*messengertypes.Interaction, len(interactions))
+	for _, i := range interactions {
+		stored[i.GetCID()] = i
+	}
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	defer subCancel()
+
+	list, err := svc.protocolClient.GroupMessageList(subCtx, &protocoltypes.GroupMessageList_Request{GroupPK: groupPK, UntilNow: true})
+	if err != nil {
+		return errcode.ErrEventListMessage.Wrap(err)
+	}
+
+	for {
+		gme, err := list.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrEventListMessage.Wrap(err)
+		}
+
+		cid := eventCID(gme.GetEventContext())
+		i, ok := stored[cid]
+		if !ok {
+			continue
+		}
+		delete(stored, cid)
+
+		var am messengertypes.AppMessage
+		if err := proto.Unmarshal(gme.GetMessage(), &am); err != nil || expandAppMessage(&am) != nil {
+			continue
+		}
+
+		// the messages this node can't read are stored apart
+		if _, ok := handler.appMessageHandlers[am.GetType()]; !ok {
+			continue
+		}
+
+		reply.CheckedCount++
+
+		issue := checkInteractionIntegrity(i, gme, &am)
+		if issue == nil {
+			continue
+		}
+		issue.ConversationPublicKey = convPK
+
+		if repair {
+			if err := svc.repairInteraction(handler, convPK, gme, &am); err != nil {
+				svc.logger.Warn("unable to repair interaction", zap.String("cid", cid), zap.Error(err))
+			} else {
+				issue.Repaired = true
+				reply.RepairedCount++
+			}
+		}
+
+		reply.Issues = append(reply.Issues, issue)
+	}
+
+	// the interactions left have no event in the log, the messages assembled from chunks have the cid of their content
+	for _, i := range interactions {
+		if _, ok := stored[i.GetCID()]; !ok || isAssembledMessageCID(i.GetCID()) {
+			continue
+		}
+
+		reply.Issues = append(reply.Issues, &messengertypes.IntegrityCheck_Issue{
+			Kind:                  messengertypes.IntegrityCheck_KindMissingEvent,
+			CID:                   i.GetCID(),
+			ConversationPublicKey: convPK,
+			Detail:                fmt.Sprintf("%s interaction not found in the group log", i.GetType()),
+		})
+	}
+
+	return nil
+}
+
+// checkInteractionIntegrity compares an interaction with the event it has been built from
+func checkInteractionIntegrity(i *messengertypes.Interaction, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage) *messengertypes.IntegrityCheck_Issue {
+	if i.GetType() != am.GetType() {
+		return &messengertypes.IntegrityCheck_Issue{
+			Kind:   messengertypes.IntegrityCheck_KindTypeMismatch,
+			CID:    i.GetCID(),
+			Detail: fmt.Sprintf("stored as %s, %s in the log", i.GetType(), am.GetType()),
+		}
+	}
+
+	if devicePK := b64EncodeBytes(gme.GetHeaders().GetDevicePK()); i.GetDevicePublicKey() != "" && i.GetDevicePublicKey() != devicePK {
+		return &messengertypes.IntegrityCheck_Issue{
+			Kind:   messengertypes.IntegrityCheck_KindSenderMismatch,
+			CID:    i.GetCID(),
+			Detail: fmt.Sprintf("stored from %s, signed by %s", i.GetDevicePublicKey(), devicePK),
+		}
+	}
+
+	expected := sha256.Sum256(storedInteractionPayload(am))
+	if actual := sha256.Sum256(i.GetPayload()); !bytes.Equal(expected[:], actual[:]) {
+		return &messengertypes.IntegrityCheck_Issue{
+			Kind:   messengertypes.IntegrityCheck_KindPayloadMismatch,
+			CID:    i.GetCID(),
+			Detail: fmt.Sprintf("expected payload hash %x, got %x", expected, actual),
+		}
+	}
+
+	return nil
+}
+
+// storedInteractionPayload returns the payload of an app message as the handlers store it, the invalid formatting
+// entities of the user messages are dropped
+func storedInteractionPayload(am *messengertypes.AppMessage) []byte {
+	if am.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return am.GetPayload()
+	}
+
+	var um messengertypes.AppMessage_UserMessage
+	if err := proto.Unmarshal(am.GetPayload(), &um); err != nil || !um.SanitizeFormatting() {
+		return am.GetPayload()
+	}
+
+	payload, err := proto.Marshal(&um)
+	if err != nil {
+		return am.GetPayload()
+	}
+
+	return payload
+}
+
+// isAssembledMessageCID returns whether a cid is the one of a message assembled from its chunks
+func isAssembledMessageCID(cid string) bool {
+	c, err := ipfscid.Decode(cid)
+	return err == nil && c.Prefix().Codec == ipfscid.Raw
+}
+
+// repairInteraction removes an altered interaction and handles its event again
+func (svc *service) repairInteraction(handler *eventHandler, convPK string, gme *protocoltypes.GroupMessageEvent, am *messengertypes.AppMessage) error {
+	cid := eventCID(gme.GetEventContext())
+	if err := svc.db.forgetInteraction(cid); err != nil {
+		return err
+	}
+
+	svc.eventDedup.forget(eventDedupKey(cid, processedEventHash(am.GetType().String(), gme.GetMessage())))
+
+	return handler.handleAppMessage(convPK, gme, am)
+}
@@ -0,0 +1,68 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_checkInteractionIntegrity(t *testing.T) {
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	am := &messengertypes.AppMessage{Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}
+	gme := &protocoltypes.GroupMessageEvent{Headers: &protocoltypes.MessageHeaders{DevicePK: []byte("device_1")}}
+	i := &messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload, DevicePublicKey: b64EncodeBytes([]byte("device_1"))}
+
+	require.Nil(t, checkInteractionIntegrity(i, gme, am))
+
+	// a single flipped bit is found
+	altered := append([]byte(nil), payload...)
+	altered[len(altered)-1] ^= 1
+	issue := checkInteractionIntegrity(&messengertypes.Interaction{CID: "cid_1", Type: i.GetType(), Payload: altered}, gme, am)
+	require.NotNil(t, issue)
+	require.Equal(t, messengertypes.IntegrityCheck_KindPayloadMismatch, issue.GetKind())
+
+	issue = checkInteractionIntegrity(&messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeLocation, Payload: payload}, gme, am)
+	require.Equal(t, messengertypes.IntegrityCheck_KindTypeMismatch, issue.GetKind())
+
+	issue = checkInteractionIntegrity(&messengertypes.Interaction{CID: "cid_1", Type: i.GetType(), Payload: payload, DevicePublicKey: "device_2"}, gme, am)
+	require.Equal(t, messengertypes.IntegrityCheck_KindSenderMismatch, issue.GetKind())
+
+	require.False(t, isAssembledMessageCID("cid_1"))
+}
+
+func Test_dbWrapper_forgetInteraction(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_2", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, IsImported: true},
+		{CID: "cid_3", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeSystemEvent},
+		{CID: "cid_4", ConversationPublicKey: "conv_2", Type: messengertypes.AppMessage_TypeUserMessage},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash_1", 1000))
+
+	// the local and imported interactions have no event to be compared with
+	interactions, err := db.getIntegrityCheckedInteractions("conv_1")
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+
+	require.NoError(t, db.forgetInteraction("cid_1"))
+
+	processed, err := db.isEventProcessed("cid_1", "hash_1")
+	require.NoError(t, err)
+	require.False(t, processed)
+
+	interactions, err = db.getIntegrityCheckedInteractions("conv_1")
+	require.NoError(t, err)
+	require.Empty(t, interactions)
+}
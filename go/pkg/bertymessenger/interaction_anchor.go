@@ -0,0 +1,37 @@
+package bertymessenger
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func (svc *service) InteractionAnchorGet(ctx context.Context, req *messengertypes.InteractionAnchorGet_Request) (*messengertypes.InteractionAnchorGet_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	i, err := svc.db.getInteractionAnchor(req.GetConversationPublicKey(), req.GetIncludeMuted(), req.GetDate())
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	order, err := svc.db.getInteractionOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.InteractionAnchorGet_Reply{Interaction: i}
+	if reply.Cursor, err = encodeInteractionAnchorCursor(i, order); err != nil {
+		return nil, err
+	}
+
+	applyNicknames(reply)
+
+	return reply, nil
+}
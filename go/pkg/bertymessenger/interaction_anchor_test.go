@@ -0,0 +1,63 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestInteractionAnchorGet(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_a", LamportTime: 1, SentDate: 1000},
+		{CID: "cid_b", LamportTime: 2, SentDate: 2000},
+		{CID: "cid_c", LamportTime: 3, SentDate: 3000, IsMemberMuted: true},
+		{CID: "cid_d", LamportTime: 4, SentDate: 4000},
+	} {
+		i.ConversationPublicKey = "conv_1"
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_other", ConversationPublicKey: "conv_2", LamportTime: 10, SentDate: 2900}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+	anchor := func(date int64, includeMuted bool) string {
+		t.Helper()
+
+		reply, err := svc.InteractionAnchorGet(ctx, &messengertypes.InteractionAnchorGet_Request{ConversationPublicKey: "conv_1", Date: date, IncludeMuted: includeMuted})
+		require.NoError(t, err)
+		return reply.GetInteraction().GetCID()
+	}
+
+	require.Equal(t, "cid_b", anchor(2400, false))
+	require.Equal(t, "cid_d", anchor(3600, false))
+	require.Equal(t, "cid_a", anchor(0, false))
+	require.Equal(t, "cid_d", anchor(5000, false))
+
+	// the older interaction wins a tie, the muted ones are only considered when requested
+	require.Equal(t, "cid_b", anchor(3000, false))
+	require.Equal(t, "cid_c", anchor(3000, true))
+
+	// the cursor lists the interactions from the anchor
+	reply, err := svc.InteractionAnchorGet(ctx, &messengertypes.InteractionAnchorGet_Request{ConversationPublicKey: "conv_1", Date: 2000})
+	require.NoError(t, err)
+
+	list, err := svc.InteractionList(ctx, &messengertypes.InteractionList_Request{ConversationPublicKey: "conv_1", Cursor: reply.GetCursor()})
+	require.NoError(t, err)
+	require.Len(t, list.GetInteractions(), 2)
+	require.Equal(t, "cid_b", list.GetInteractions()[0].GetCID())
+	require.Equal(t, "cid_a", list.GetInteractions()[1].GetCID())
+
+	_, err = svc.InteractionAnchorGet(ctx, &messengertypes.InteractionAnchorGet_Request{ConversationPublicKey: "conv_3", Date: 2000})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	_, err = svc.InteractionAnchorGet(ctx, &messengertypes.InteractionAnchorGet_Request{})
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+}
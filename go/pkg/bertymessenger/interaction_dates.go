@@ -0,0 +1,139 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The sent date of an interaction is the one claimed by its sender, it is kept as is while a normalized sent date
+// corrects the skew of the clock of the sender. The normalized date is bounded by the date the interaction has been
+// received and by the normalized dates of the interactions around it in the group log, so the messages listed by date
+// keep the order of the log even when a member's clock is wrong, on every replay.
+
+// interactionOrderColumn returns the column the interactions are ordered by
+func interactionOrderColumn(order messengertypes.Account_InteractionOrder) string {
+	switch order {
+	case messengertypes.Account_OrderNormalizedDate:
+		return "normalized_sent_date"
+	case messengertypes.Account_OrderSentDate:
+		return "sent_date"
+	default:
+		return "lamport_time"
+	}
+}
+
+// interactionOrderDate returns the date of an interaction the given order uses, 0 for the logical order
+func interactionOrderDate(i *messengertypes.Interaction, order messengertypes.Account_InteractionOrder) int64 {
+	switch order {
+	case messengertypes.Account_OrderNormalizedDate:
+		return i.GetNormalizedSentDate()
+	case messengertypes.Account_OrderSentDate:
+		return i.GetSentDate()
+	default:
+		return 0
+	}
+}
+
+// normalizeInteractionSentDate sets the normalized sent date of an interaction about to be stored, a sender whose
+// clock is ahead can't have sent it after it has been received, nor before the interactions it had seen in the log
+func (d *dbWrapper) normalizeInteractionSentDate(i *messengertypes.Interaction) error {
+	date := i.GetSentDate()
+	if received := i.GetReceivedDate(); received > 0 && date > received {
+		date = received
+	}
+
+	// the interactions which aren't in a group log, like the system events, are only bounded by their receipt
+	if i.GetLamportTime() == 0 || i.GetConversationPublicKey() == "" {
+		i.NormalizedSentDate = date
+		return nil
+	}
+
+	bound := func(aggregate string, cond string) (int64, error) {
+		value := int64(0)
+		if err := d.db.Model(&messengertypes.Interaction{}).
+			Where("conversation_public_key = ? AND lamport_time > 0 AND normalized_sent_date > 0", i.GetConversationPublicKey()).
+			Where(cond, i.GetLamportTime(), i.GetLamportTime(), i.GetCID()).
+			Select("COALESCE(" + aggregate + "(normalized_sent_date), 0)").
+			Scan(&value).
+			Error; err != nil {
+			return 0, errcode.ErrDBRead.Wrap(err)
+		}
+
+		return value, nil
+	}
+
+	// an interaction received after the ones following it in the log is sent before them
+	after, err := bound("MIN", "(lamport_time > ? OR (lamport_time = ? AND cid > ?))")
+	if err != nil {
+		return err
+	}
+	if after > 0 && date > after {
+		date = after
+	}
+
+	before, err := bound("MAX", "(lamport_time < ? OR (lamport_time = ? AND cid < ?))")
+	if err != nil {
+		return err
+	}
+	if date < before {
+		date = before
+	}
+
+	i.NormalizedSentDate = date
+	return nil
+}
+
+func (svc *service) InteractionSetOrder(ctx context.Context, req *messengertypes.InteractionSetOrder_Request) (*messengertypes.InteractionSetOrder_Reply, error) {
+	if _, ok := messengertypes.Account_InteractionOrder_name[int32(req.GetOrder())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown interaction order %d", req.GetOrder()))
+	}
+
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if acc, err = svc.db.setAccountInteractionOrder(acc.GetPublicKey(), req.GetOrder()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.InteractionSetOrder_Reply{}, nil
+}
+
+// migrateInteractionNormalizedDates sets the normalized sent date of the existing interactions to their sent date,
+// their receipt is unknown. They are normalized by the next replay of the logs
+func migrateInteractionNormalizedDates(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&messengertypes.Interaction{}) {
+		return nil
+	}
+
+	for _, field := range []string{"ReceivedDate", "NormalizedSentDate"} {
+		if tx.Migrator().HasColumn(&messengertypes.Interaction{}, field) {
+			continue
+		}
+
+		if err := tx.Migrator().AddColumn(&messengertypes.Interaction{}, field); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := tx.Model(&messengertypes.Interaction{}).
+		Where("normalized_sent_date IS NULL OR normalized_sent_date = ?", 0).
+		UpdateColumn("normalized_sent_date", gorm.Expr("sent_date")).
+		Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
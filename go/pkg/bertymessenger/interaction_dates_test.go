@@ -0,0 +1,79 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_normalizeInteractionSentDate(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	add := func(cid string, lamportTime uint64, sentDate, receivedDate int64) *messengertypes.Interaction {
+		i, isNew, err := db.addInteraction(messengertypes.Interaction{CID: cid, ConversationPublicKey: "conv_1", LamportTime: lamportTime, SentDate: sentDate, ReceivedDate: receivedDate})
+		require.NoError(t, err)
+		require.True(t, isNew)
+		return i
+	}
+
+	require.Equal(t, int64(100), add("cid_1", 1, 100, 110).GetNormalizedSentDate())
+
+	// the clock of the sender is ahead
+	i := add("cid_2", 2, 500, 120)
+	require.Equal(t, int64(500), i.GetSentDate())
+	require.Equal(t, int64(120), i.GetNormalizedSentDate())
+
+	// the clock of the sender is behind the messages it answers
+	require.Equal(t, int64(120), add("cid_3", 3, 50, 130).GetNormalizedSentDate())
+
+	// a message received late, as after a replay, stays between its neighbours in the log
+	require.Equal(t, int64(100), add("cid_0", 1, 200, 1000).GetNormalizedSentDate())
+
+	// the interactions out of the logs are only bounded by their receipt
+	require.Equal(t, int64(10), add("cid_system", 0, 10, 20).GetNormalizedSentDate())
+
+	interactions, err := db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderNormalizedDate, nil, 2)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.Equal(t, "cid_3", interactions[0].GetCID())
+	require.Equal(t, "cid_2", interactions[1].GetCID())
+
+	token, err := encodeInteractionCursor(interactions[1], messengertypes.Account_OrderNormalizedDate)
+	require.NoError(t, err)
+	cursor, err := decodeInteractionCursor(token)
+	require.NoError(t, err)
+	require.Equal(t, int64(120), cursor.GetDate())
+
+	// the next pages keep the order of their cursor
+	interactions, err = db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderSentDate, cursor, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 3)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+	require.Equal(t, "cid_0", interactions[1].GetCID())
+	require.Equal(t, "cid_system", interactions[2].GetCID())
+
+	interactions, err = db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderSentDate, nil, 1)
+	require.NoError(t, err)
+	require.Equal(t, "cid_2", interactions[0].GetCID())
+}
+
+func Test_dbWrapper_setAccountInteractionOrder(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	order, err := db.getInteractionOrder()
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Account_OrderLogical, order)
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	acc, err := db.setAccountInteractionOrder("account_1", messengertypes.Account_OrderNormalizedDate)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Account_OrderNormalizedDate, acc.GetInteractionOrder())
+
+	order, err = db.getInteractionOrder()
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Account_OrderNormalizedDate, order)
+}
@@ -0,0 +1,76 @@
+package bertymessenger
+
+import (
+	"context"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func (svc *service) InteractionDeliveryInfo(ctx context.Context, req *messengertypes.InteractionDeliveryInfo_Request) (*messengertypes.InteractionDeliveryInfo_Reply, error) {
+	if req.GetCID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	i, err := svc.db.getInteractionByCID(req.GetCID())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	deliveries, err := svc.db.getInteractionDeliveries(i.GetCID())
+	if err != nil {
+		return nil, err
+	}
+
+	conv, err := svc.db.getConversationByPK(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	// the members of a contact conversation are not stored, the contact names its devices
+	names := map[string]string{}
+	if conv.GetType() == messengertypes.Conversation_ContactType {
+		if contact, err := svc.db.getContactByPK(conv.GetContactPublicKey()); err == nil {
+			for _, delivery := range deliveries {
+				if !delivery.GetIsMe() {
+					names[delivery.GetMemberPublicKey()] = contact.GetDisplayName()
+				}
+			}
+		}
+	}
+
+	members, err := svc.db.getMembersByConversation(conv.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	for _, member := range members {
+		names[member.GetPublicKey()] = member.GetDisplayName()
+	}
+
+	reply := &messengertypes.InteractionDeliveryInfo_Reply{Interaction: i}
+	delivered := map[string]bool{}
+	for _, delivery := range deliveries {
+		delivered[delivery.GetMemberPublicKey()] = true
+		reply.Deliveries = append(reply.Deliveries, &messengertypes.InteractionDeliveryInfo_Delivery{
+			DevicePublicKey:  delivery.GetDevicePublicKey(),
+			MemberPublicKey:  delivery.GetMemberPublicKey(),
+			DisplayName:      names[delivery.GetMemberPublicKey()],
+			AcknowledgedDate: delivery.GetAcknowledgedDate(),
+			IsMe:             delivery.GetIsMe(),
+		})
+	}
+
+	for _, member := range members {
+		pk := member.GetPublicKey()
+		if delivered[pk] || pk == i.GetMemberPublicKey() || pk == conv.GetAccountMemberPublicKey() {
+			continue
+		}
+
+		reply.PendingMemberPublicKeys = append(reply.PendingMemberPublicKeys, pk)
+	}
+
+	return reply, nil
+}
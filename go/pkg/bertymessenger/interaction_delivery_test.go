@@ -0,0 +1,86 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_addInteractionDelivery(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.addInteractionDelivery(&messengertypes.InteractionDelivery{InteractionCID: "cid_1"})
+	require.Error(t, err)
+
+	for _, delivery := range []*messengertypes.InteractionDelivery{
+		{InteractionCID: "cid_1", DevicePublicKey: "device_2", AcknowledgedDate: 2000},
+		{InteractionCID: "cid_1", DevicePublicKey: "device_1", AcknowledgedDate: 1000},
+		{InteractionCID: "cid_2", DevicePublicKey: "device_1", AcknowledgedDate: 3000},
+	} {
+		added, err := db.addInteractionDelivery(delivery)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+
+	// the first ack of a device is kept
+	added, err := db.addInteractionDelivery(&messengertypes.InteractionDelivery{InteractionCID: "cid_1", DevicePublicKey: "device_1", AcknowledgedDate: 4000})
+	require.NoError(t, err)
+	require.False(t, added)
+
+	deliveries, err := db.getInteractionDeliveries("cid_1")
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, "device_1", deliveries[0].GetDevicePublicKey())
+	require.Equal(t, int64(1000), deliveries[0].GetAcknowledgedDate())
+}
+
+func Test_service_InteractionDeliveryInfo(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"}).Error)
+	for _, member := range []*messengertypes.Member{
+		{PublicKey: "member_me", DisplayName: "me"},
+		{PublicKey: "member_1", DisplayName: "alice"},
+		{PublicKey: "member_2", DisplayName: "bob"},
+		{PublicKey: "member_3", DisplayName: "carol"},
+	} {
+		member.ConversationPublicKey = "conv_1"
+		require.NoError(t, db.db.Create(member).Error)
+	}
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1"}).Error)
+
+	for _, delivery := range []*messengertypes.InteractionDelivery{
+		{DevicePublicKey: "device_2a", MemberPublicKey: "member_2", AcknowledgedDate: 1000},
+		{DevicePublicKey: "device_2b", MemberPublicKey: "member_2", AcknowledgedDate: 2000},
+		{DevicePublicKey: "device_me", MemberPublicKey: "member_me", AcknowledgedDate: 3000, IsMe: true},
+	} {
+		delivery.InteractionCID = "cid_1"
+		_, err := db.addInteractionDelivery(delivery)
+		require.NoError(t, err)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	_, err := svc.InteractionDeliveryInfo(context.Background(), &messengertypes.InteractionDeliveryInfo_Request{})
+	require.Error(t, err)
+
+	_, err = svc.InteractionDeliveryInfo(context.Background(), &messengertypes.InteractionDeliveryInfo_Request{CID: "unknown"})
+	require.Error(t, err)
+
+	reply, err := svc.InteractionDeliveryInfo(context.Background(), &messengertypes.InteractionDeliveryInfo_Request{CID: "cid_1"})
+	require.NoError(t, err)
+	require.Equal(t, "cid_1", reply.GetInteraction().GetCID())
+	require.Len(t, reply.GetDeliveries(), 3)
+	require.Equal(t, "device_2a", reply.GetDeliveries()[0].GetDevicePublicKey())
+	require.Equal(t, "bob", reply.GetDeliveries()[0].GetDisplayName())
+	require.True(t, reply.GetDeliveries()[2].GetIsMe())
+
+	// neither the sender nor this account are waited for
+	require.Equal(t, []string{"member_3"}, reply.GetPendingMemberPublicKeys())
+}
@@ -0,0 +1,157 @@
+package bertymessenger
+
+import (
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/linkpreview"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The content of the user messages is summarized by indexed flags when they are stored, so the clients can list the
+// medias, the files or the links shared in a conversation without reading its whole history.
+
+// contentFlagsMigrationBatchSize bounds the number of messages read at once when the flags of the existing messages
+// are computed
+const contentFlagsMigrationBatchSize = 500
+
+// setInteractionContentFlags sets the content flags of a user message from its medias and its body
+func setInteractionContentFlags(i *messengertypes.Interaction, um *messengertypes.AppMessage_UserMessage, medias []*messengertypes.Media) {
+	thumbnails := map[string]bool{}
+	for _, preview := range um.GetLinkPreviews() {
+		thumbnails[preview.GetThumbnailCID()] = true
+	}
+
+	for _, media := range medias {
+		if thumbnails[media.GetCID()] {
+			continue
+		}
+
+		if isVisualMedia(media) {
+			i.HasMedia = true
+		} else {
+			i.HasFiles = true
+		}
+	}
+
+	i.HasLinks = len(um.GetLinkPreviews()) > 0 || len(linkpreview.FindURLs(um.GetBody(), 1)) > 0
+}
+
+// isVisualMedia returns whether a media is rendered in the media gallery, an image or a video
+func isVisualMedia(media *messengertypes.Media) bool {
+	mimeType := strings.ToLower(media.GetMimeType())
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "video/")
+}
+
+// migrateInteractionContentFlags adds the content flags to the interactions table and computes them for the messages
+// already stored
+func migrateInteractionContentFlags(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&messengertypes.Interaction{}) {
+		return nil
+	}
+
+	for _, field := range []string{"HasMedia", "HasFiles", "HasLinks"} {
+		if tx.Migrator().HasColumn(&messengertypes.Interaction{}, field) {
+			continue
+		}
+
+		if err := tx.Migrator().AddColumn(&messengertypes.Interaction{}, field); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+	}
+
+	last := ""
+	for {
+		batch := []*messengertypes.Interaction(nil)
+		if err := tx.
+			Select("cid, payload").
+			Where("type = ? AND cid > ?", messengertypes.AppMessage_TypeUserMessage, last).
+			Order("cid").
+			Limit(contentFlagsMigrationBatchSize).
+			Find(&batch).
+			Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		cids := make([]string, len(batch))
+		for idx, i := range batch {
+			cids[idx] = i.GetCID()
+		}
+		last = cids[len(cids)-1]
+
+		medias := []*messengertypes.Media(nil)
+		if err := tx.Where("interaction_cid IN ?", cids).Find(&medias).Error; err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		mediasByCID := map[string][]*messengertypes.Media{}
+		for _, media := range medias {
+			mediasByCID[media.GetInteractionCID()] = append(mediasByCID[media.GetInteractionCID()], media)
+		}
+
+		for _, i := range batch {
+			var um messengertypes.AppMessage_UserMessage
+			if err := proto.Unmarshal(i.GetPayload(), &um); err != nil {
+				continue
+			}
+
+			setInteractionContentFlags(i, &um, mediasByCID[i.GetCID()])
+			if !i.GetHasMedia() && !i.GetHasFiles() && !i.GetHasLinks() {
+				continue
+			}
+
+			if err := tx.Model(&messengertypes.Interaction{}).Where("cid = ?", i.GetCID()).Updates(map[string]interface{}{
+				"has_media": i.GetHasMedia(),
+				"has_files": i.GetHasFiles(),
+				"has_links": i.GetHasLinks(),
+			}).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(err)
+			}
+		}
+	}
+}
+
+// filterInteractions restricts a query of the interactions to the ones matching a filter
+func filterInteractions(query *gorm.DB, filter *messengertypes.InteractionList_Filter) *gorm.DB {
+	if types := filter.GetTypes(); len(types) > 0 {
+		query = query.Where("type IN ?", types)
+	}
+
+	switch filter.GetContent() {
+	case messengertypes.InteractionList_ContentMedia:
+		query = query.Where("has_media = ?", true)
+	case messengertypes.InteractionList_ContentLinks:
+		query = query.Where("has_links = ?", true)
+	case messengertypes.InteractionList_ContentFiles:
+		query = query.Where("has_files = ?", true)
+	}
+
+	if memberPK := filter.GetMemberPublicKey(); memberPK != "" {
+		query = query.Where("member_public_key = ?", memberPK)
+	}
+
+	if since := filter.GetSinceDate(); since > 0 {
+		query = query.Where("sent_date >= ?", since)
+	}
+
+	if until := filter.GetUntilDate(); until > 0 {
+		query = query.Where("sent_date < ?", until)
+	}
+
+	if tags := filter.GetTags(); len(tags) > 0 {
+		normalized := make([]string, len(tags))
+		for idx, tag := range tags {
+			normalized[idx] = normalizeInteractionTag(tag)
+		}
+		query = query.Where("cid IN (SELECT interaction_cid FROM interaction_tags WHERE tag IN ? AND tagged = ?)", normalized, true)
+	}
+
+	return query
+}
@@ -0,0 +1,102 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_setInteractionContentFlags(t *testing.T) {
+	i := &messengertypes.Interaction{}
+	setInteractionContentFlags(i, &messengertypes.AppMessage_UserMessage{Body: "hello"}, nil)
+	require.False(t, i.GetHasMedia() || i.GetHasFiles() || i.GetHasLinks())
+
+	i = &messengertypes.Interaction{}
+	setInteractionContentFlags(i, &messengertypes.AppMessage_UserMessage{Body: "see https://berty.tech"}, []*messengertypes.Media{
+		{CID: "media_1", MimeType: "image/png"},
+	})
+	require.True(t, i.GetHasMedia())
+	require.False(t, i.GetHasFiles())
+	require.True(t, i.GetHasLinks())
+
+	// the thumbnails of the link previews are not counted as medias
+	i = &messengertypes.Interaction{}
+	setInteractionContentFlags(i, &messengertypes.AppMessage_UserMessage{
+		Body:         "a preview",
+		LinkPreviews: []*messengertypes.LinkPreview{{Url: "https://berty.tech", ThumbnailCID: "thumbnail_1"}},
+	}, []*messengertypes.Media{
+		{CID: "thumbnail_1", MimeType: "image/jpeg"},
+		{CID: "media_2", MimeType: "application/pdf"},
+	})
+	require.False(t, i.GetHasMedia())
+	require.True(t, i.GetHasFiles())
+	require.True(t, i.GetHasLinks())
+}
+
+func Test_dbWrapper_getMatchingInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_a", ConversationPublicKey: "conv_1", LamportTime: 1, SentDate: 1000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage, HasMedia: true},
+		{CID: "cid_b", ConversationPublicKey: "conv_1", LamportTime: 2, SentDate: 2000, MemberPublicKey: "member_2", Type: messengertypes.AppMessage_TypeUserMessage, HasLinks: true},
+		{CID: "cid_c", ConversationPublicKey: "conv_1", LamportTime: 3, SentDate: 3000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage, HasMedia: true, HasFiles: true},
+		{CID: "cid_d", ConversationPublicKey: "conv_1", LamportTime: 4, SentDate: 4000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeLocation},
+		{CID: "cid_e", ConversationPublicKey: "conv_2", LamportTime: 1, SentDate: 5000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage, HasMedia: true},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	list := func(convPK string, filter *messengertypes.InteractionList_Filter, cursor *messengertypes.InteractionList_Cursor) []string {
+		interactions, err := db.getMatchingInteractions(convPK, false, filter, messengertypes.Account_OrderLogical, cursor, 10)
+		require.NoError(t, err)
+
+		cids := []string(nil)
+		for _, i := range interactions {
+			cids = append(cids, i.GetCID())
+		}
+		return cids
+	}
+
+	require.Equal(t, []string{"cid_c", "cid_a"}, list("conv_1", &messengertypes.InteractionList_Filter{Content: messengertypes.InteractionList_ContentMedia}, nil))
+	require.Equal(t, []string{"cid_b"}, list("conv_1", &messengertypes.InteractionList_Filter{Content: messengertypes.InteractionList_ContentLinks}, nil))
+	require.Equal(t, []string{"cid_c"}, list("conv_1", &messengertypes.InteractionList_Filter{Content: messengertypes.InteractionList_ContentFiles}, nil))
+	require.Equal(t, []string{"cid_d"}, list("conv_1", &messengertypes.InteractionList_Filter{Types: []messengertypes.AppMessage_Type{messengertypes.AppMessage_TypeLocation}}, nil))
+	require.Equal(t, []string{"cid_b"}, list("conv_1", &messengertypes.InteractionList_Filter{MemberPublicKey: "member_2"}, nil))
+	require.Equal(t, []string{"cid_c", "cid_b"}, list("conv_1", &messengertypes.InteractionList_Filter{SinceDate: 2000, UntilDate: 4000}, nil))
+
+	// all the conversations are listed without a conversation
+	require.ElementsMatch(t, []string{"cid_a", "cid_c", "cid_e"}, list("", &messengertypes.InteractionList_Filter{Content: messengertypes.InteractionList_ContentMedia}, nil))
+
+	// the filters are kept with the cursor
+	require.Equal(t, []string{"cid_a"}, list("conv_1", &messengertypes.InteractionList_Filter{Content: messengertypes.InteractionList_ContentMedia}, &messengertypes.InteractionList_Cursor{LamportTime: 3, CID: "cid_c"}))
+}
+
+func Test_migrateInteractionContentFlags(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "look at https://berty.tech"})
+	require.NoError(t, err)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}).Error)
+
+	payload, err = proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "a picture"})
+	require.NoError(t, err)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_2", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "cid_2", MimeType: "video/mp4"}).Error)
+
+	require.NoError(t, migrateInteractionContentFlags(db.db))
+
+	first, err := db.getInteractionByCID("cid_1")
+	require.NoError(t, err)
+	require.True(t, first.GetHasLinks())
+	require.False(t, first.GetHasMedia())
+
+	second, err := db.getInteractionByCID("cid_2")
+	require.NoError(t, err)
+	require.False(t, second.GetHasLinks())
+	require.True(t, second.GetHasMedia())
+}
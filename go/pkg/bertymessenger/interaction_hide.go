@@ -0,0 +1,104 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// An interaction can be removed in two ways. A hide only applies to this device, the interaction is still stored but
+// is flagged as hidden and left out of the lists, the hides are kept in a local overlay which survives the rebuilds of
+// the database, so the replayed interactions are hidden again. A retraction is sent to the group by the author of a
+// message and deletes it on every device, it is kept in the logs so the rebuilt databases drop the message too.
+
+func (svc *service) InteractionHide(ctx context.Context, req *messengertypes.InteractionHide_Request) (*messengertypes.InteractionHide_Reply, error) {
+	interactions, err := svc.setInteractionsHidden(req.GetCIDs(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionHide_Reply{HiddenCount: int64(len(interactions))}, nil
+}
+
+func (svc *service) InteractionUnhide(ctx context.Context, req *messengertypes.InteractionUnhide_Request) (*messengertypes.InteractionUnhide_Reply, error) {
+	interactions, err := svc.setInteractionsHidden(req.GetCIDs(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionUnhide_Reply{UnhiddenCount: int64(len(interactions))}, nil
+}
+
+func (svc *service) InteractionHiddenList(ctx context.Context, req *messengertypes.InteractionHiddenList_Request) (*messengertypes.InteractionHiddenList_Reply, error) {
+	hidden, err := svc.db.getHiddenInteractions(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionHiddenList_Reply{Interactions: hidden}, nil
+}
+
+func (svc *service) setInteractionsHidden(cids []string, hidden bool) ([]*messengertypes.Interaction, error) {
+	if len(cids) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if len(cids) > bulkOperationMaxCount {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d interactions can be hidden at once", bulkOperationMaxCount))
+	}
+
+	defer svc.writer.enter()()
+
+	interactions, err := svc.db.setInteractionsHidden(cids, hidden)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range interactions {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+			svc.logger.Error("unable to dispatch interaction update", zap.String("cid", i.GetCID()), zap.Error(err))
+		}
+	}
+
+	return interactions, nil
+}
+
+func (svc *service) InteractionRetract(ctx context.Context, req *messengertypes.InteractionRetract_Request) (*messengertypes.InteractionRetract_Reply, error) {
+	if req.GetCID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	i, err := svc.db.getInteractionByCID(req.GetCID())
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if !i.GetIsMe() || i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the messages sent by the account can be retracted"))
+	}
+
+	gpk, err := b64DecodeBytes(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	payload, err := messengertypes.AppMessage_TypeInteractionRetract.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_InteractionRetract{Target: i.GetCID()})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionRetract_Reply{}, nil
+}
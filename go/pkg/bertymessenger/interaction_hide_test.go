@@ -0,0 +1,96 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_setInteractionsHidden(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", LamportTime: 1, Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_2", ConversationPublicKey: "conv_1", LamportTime: 2, Type: messengertypes.AppMessage_TypeUserMessage},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	interactions, err := db.setInteractionsHidden([]string{"cid_1", "unknown"}, true)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+	require.True(t, interactions[0].GetIsHidden())
+
+	listed, err := db.getPaginatedInteractions("conv_1", true, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.Equal(t, "cid_2", listed[0].GetCID())
+
+	hidden, err := db.getHiddenInteractions("conv_1")
+	require.NoError(t, err)
+	require.Len(t, hidden, 1)
+	require.Equal(t, "cid_1", hidden[0].GetInteractionCID())
+
+	// the hides are kept when the database is rebuilt and flag the replayed interactions again
+	state := keepDatabaseLocalState(db.db, zap.NewNop())
+	require.Len(t, state.GetHiddenInteractions(), 1)
+
+	rebuilt, disposeRebuilt := getInMemoryTestDB(t)
+	defer disposeRebuilt()
+
+	require.NoError(t, restoreReplayLocalState(rebuilt, state))
+	isHidden, err := rebuilt.isInteractionHidden("cid_1")
+	require.NoError(t, err)
+	require.True(t, isHidden)
+
+	interactions, err = db.setInteractionsHidden([]string{"cid_1", "cid_2"}, false)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+
+	isHidden, err = db.isInteractionHidden("cid_1")
+	require.NoError(t, err)
+	require.False(t, isHidden)
+
+	listed, err = db.getPaginatedInteractions("conv_1", true, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 2)
+}
+
+func Test_eventHandler_handleAppMessageInteractionRetract(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage}).Error)
+
+	// the messages can only be retracted by their sender
+	other := &messengertypes.Interaction{CID: "retract_0", ConversationPublicKey: "conv_1", MemberPublicKey: "member_2", Type: messengertypes.AppMessage_TypeInteractionRetract}
+	require.Error(t, validateAppMessage(db, other, &messengertypes.AppMessage_InteractionRetract{Target: "cid_1"}))
+
+	retract := &messengertypes.Interaction{CID: "retract_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeInteractionRetract}
+	require.NoError(t, validateAppMessage(db, retract, &messengertypes.AppMessage_InteractionRetract{Target: "cid_1"}))
+
+	_, _, err := h.handleAppMessageInteractionRetract(db, retract, &messengertypes.AppMessage_InteractionRetract{Target: "cid_1"})
+	require.NoError(t, err)
+
+	_, err = db.getInteractionByCID("cid_1")
+	require.Error(t, err)
+
+	// a message whose retraction was received first is dropped
+	retract = &messengertypes.Interaction{CID: "retract_2", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeInteractionRetract}
+	_, _, err = h.handleAppMessageInteractionRetract(db, retract, &messengertypes.AppMessage_InteractionRetract{Target: "cid_2"})
+	require.NoError(t, err)
+
+	retracted, err := db.isInteractionRetracted(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1"})
+	require.NoError(t, err)
+	require.True(t, retracted)
+
+	retracted, err = db.isInteractionRetracted(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_1", MemberPublicKey: "member_2"})
+	require.NoError(t, err)
+	require.False(t, retracted)
+}
@@ -0,0 +1,277 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The personal tags organize the messages across the conversations, e.g. receipts or todo. They are never sent to the
+// other members, only to the other devices of the account, and a removed tag is kept with its date so the most recent
+// change wins on all the devices.
+
+// interactionTagMaxLength is the maximum number of characters of a tag
+const interactionTagMaxLength = 64
+
+// normalizeInteractionTag trims and lower cases a tag so the same tag typed differently is merged
+func normalizeInteractionTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func validateInteractionTag(tag string) (string, error) {
+	tag = normalizeInteractionTag(tag)
+	switch {
+	case tag == "":
+		return "", errcode.ErrMissingInput
+	case utf8.RuneCountInString(tag) > interactionTagMaxLength:
+		return "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("a tag is limited to %d characters", interactionTagMaxLength))
+	}
+
+	return tag, nil
+}
+
+func deviceSyncTagFromInteractionTag(tag *messengertypes.InteractionTag) *messengertypes.AppMessage_DeviceSyncTag {
+	return &messengertypes.AppMessage_DeviceSyncTag{
+		CID:                   tag.GetInteractionCID(),
+		ConversationPublicKey: tag.GetConversationPublicKey(),
+		Tag:                   tag.GetTag(),
+		Tagged:                tag.GetTagged(),
+		TaggedDate:            tag.GetTaggedDate(),
+	}
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncTag(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncTag)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync tag sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyTagDeviceSync(tx, payload); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+// applyTagDeviceSync updates a personal tag of a message, the message may not have been received by this device yet
+func (h *eventHandler) applyTagDeviceSync(tx *dbWrapper, state *messengertypes.AppMessage_DeviceSyncTag) error {
+	tag := normalizeInteractionTag(state.GetTag())
+	if state.GetCID() == "" || tag == "" {
+		return nil
+	}
+
+	updated, err := tx.setInteractionTag(&messengertypes.InteractionTag{
+		InteractionCID:        state.GetCID(),
+		ConversationPublicKey: state.GetConversationPublicKey(),
+		Tag:                   tag,
+		Tagged:                state.GetTagged(),
+		TaggedDate:            state.GetTaggedDate(),
+	})
+	if err != nil || !updated || h.svc == nil {
+		return err
+	}
+
+	return h.svc.streamInteractionTagsUpdated(tx, state.GetCID())
+}
+
+// streamInteractionTagsUpdated dispatches a message whose tags changed, nothing is dispatched when the message has not
+// been received by this device
+func (svc *service) streamInteractionTagsUpdated(db *dbWrapper, cid string) error {
+	i, err := db.getInteractionByCID(cid)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil
+	case err != nil:
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if err := db.fillInteractionsTags([]*messengertypes.Interaction{i}); err != nil {
+		return err
+	}
+
+	return svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false)
+}
+
+// setInteractionTagged adds or removes a personal tag of a message, the other devices are updated when it changed
+func (svc *service) setInteractionTagged(ctx context.Context, cid, tag string, tagged bool) error {
+	if cid == "" {
+		return errcode.ErrMissingInput
+	}
+
+	tag, err := validateInteractionTag(tag)
+	if err != nil {
+		return err
+	}
+
+	defer svc.writer.enter()()
+
+	i, err := svc.db.getInteractionByCID(cid)
+	if err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	if i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the user messages can be tagged"))
+	}
+
+	state := &messengertypes.InteractionTag{
+		InteractionCID:        i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Tag:                   tag,
+		Tagged:                tagged,
+		TaggedDate:            timestampMs(time.Now()),
+	}
+
+	updated, err := svc.db.setInteractionTag(state)
+	if err != nil || !updated {
+		return err
+	}
+
+	if err := svc.streamInteractionTagsUpdated(svc.db, cid); err != nil {
+		return err
+	}
+
+	if err := svc.sendDeviceSync(ctx, messengertypes.AppMessage_TypeDeviceSyncTag, deviceSyncTagFromInteractionTag(state)); err != nil {
+		svc.logger.Warn("unable to sync message tag with the other devices", zap.String("cid", cid), zap.Error(err))
+	}
+
+	return nil
+}
+
+// replaceInteractionTag removes a personal tag from all the messages, it is replaced by newTag when it is set, the
+// changes are sent to the other devices at once, it returns the number of messages changed
+func (svc *service) replaceInteractionTag(ctx context.Context, tag, newTag string) (int64, error) {
+	defer svc.writer.enter()()
+
+	current, err := svc.db.getInteractionsWithTag(tag)
+	if err != nil {
+		return 0, err
+	}
+
+	now := timestampMs(time.Now())
+	snapshot := &messengertypes.AppMessage_DeviceSyncSnapshot{}
+	count := int64(0)
+	for _, state := range current {
+		changes := []*messengertypes.InteractionTag{{
+			InteractionCID:        state.GetInteractionCID(),
+			ConversationPublicKey: state.GetConversationPublicKey(),
+			Tag:                   tag,
+			Tagged:                false,
+			TaggedDate:            now,
+		}}
+		if newTag != "" {
+			changes = append(changes, &messengertypes.InteractionTag{
+				InteractionCID:        state.GetInteractionCID(),
+				ConversationPublicKey: state.GetConversationPublicKey(),
+				Tag:                   newTag,
+				Tagged:                true,
+				TaggedDate:            now,
+			})
+		}
+
+		changed := false
+		for _, change := range changes {
+			updated, err := svc.db.setInteractionTag(change)
+			if err != nil {
+				return count, err
+			}
+
+			if updated {
+				changed = true
+				snapshot.Tags = append(snapshot.Tags, deviceSyncTagFromInteractionTag(change))
+			}
+		}
+
+		if !changed {
+			continue
+		}
+		count++
+
+		if err := svc.streamInteractionTagsUpdated(svc.db, state.GetInteractionCID()); err != nil {
+			return count, err
+		}
+	}
+
+	if len(snapshot.GetTags()) > 0 {
+		if err := svc.sendDeviceSync(ctx, messengertypes.AppMessage_TypeDeviceSyncSnapshot, snapshot); err != nil {
+			svc.logger.Warn("unable to sync message tags with the other devices", zap.String("tag", tag), zap.Error(err))
+		}
+	}
+
+	return count, nil
+}
+
+func (svc *service) InteractionTagAdd(ctx context.Context, req *messengertypes.InteractionTagAdd_Request) (*messengertypes.InteractionTagAdd_Reply, error) {
+	if err := svc.setInteractionTagged(ctx, req.GetCID(), req.GetTag(), true); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionTagAdd_Reply{}, nil
+}
+
+func (svc *service) InteractionTagRemove(ctx context.Context, req *messengertypes.InteractionTagRemove_Request) (*messengertypes.InteractionTagRemove_Reply, error) {
+	if err := svc.setInteractionTagged(ctx, req.GetCID(), req.GetTag(), false); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionTagRemove_Reply{}, nil
+}
+
+func (svc *service) InteractionTagList(ctx context.Context, req *messengertypes.InteractionTagList_Request) (*messengertypes.InteractionTagList_Reply, error) {
+	tags, err := svc.db.getInteractionTagSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionTagList_Reply{Tags: tags}, nil
+}
+
+func (svc *service) InteractionTagRename(ctx context.Context, req *messengertypes.InteractionTagRename_Request) (*messengertypes.InteractionTagRename_Reply, error) {
+	tag, err := validateInteractionTag(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+
+	newTag, err := validateInteractionTag(req.GetNewTag())
+	if err != nil {
+		return nil, err
+	}
+
+	if tag == newTag {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the new name of the tag is the same"))
+	}
+
+	count, err := svc.replaceInteractionTag(ctx, tag, newTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionTagRename_Reply{Count: count}, nil
+}
+
+func (svc *service) InteractionTagDelete(ctx context.Context, req *messengertypes.InteractionTagDelete_Request) (*messengertypes.InteractionTagDelete_Reply, error) {
+	tag, err := validateInteractionTag(req.GetTag())
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := svc.replaceInteractionTag(ctx, tag, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionTagDelete_Reply{Count: count}, nil
+}
@@ -0,0 +1,102 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_validateInteractionTag(t *testing.T) {
+	tag, err := validateInteractionTag("  Receipts ")
+	require.NoError(t, err)
+	require.Equal(t, "receipts", tag)
+
+	_, err = validateInteractionTag(" ")
+	require.Error(t, err)
+
+	_, err = validateInteractionTag(strings.Repeat("a", interactionTagMaxLength+1))
+	require.Error(t, err)
+}
+
+func Test_dbWrapper_setInteractionTag(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setInteractionTag(&messengertypes.InteractionTag{Tag: "todo"})
+	require.Error(t, err)
+
+	_, err = db.setInteractionTag(&messengertypes.InteractionTag{InteractionCID: "cid_1"})
+	require.Error(t, err)
+
+	updated, err := db.setInteractionTag(&messengertypes.InteractionTag{InteractionCID: "cid_1", Tag: "todo", Tagged: true, TaggedDate: 2})
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	// an older change synced from another device is ignored
+	updated, err = db.setInteractionTag(&messengertypes.InteractionTag{InteractionCID: "cid_1", Tag: "todo", Tagged: false, TaggedDate: 1})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	tags, err := db.getInteractionsWithTag("todo")
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+
+	updated, err = db.setInteractionTag(&messengertypes.InteractionTag{InteractionCID: "cid_1", Tag: "todo", Tagged: false, TaggedDate: 3})
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	tags, err = db.getInteractionsWithTag("todo")
+	require.NoError(t, err)
+	require.Empty(t, tags)
+}
+
+func Test_dbWrapper_interactionTags_list(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, cid := range []string{"cid_a", "cid_b", "cid_c"} {
+		db.db.Create(&messengertypes.Interaction{CID: cid, ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage})
+	}
+
+	for date, tag := range []*messengertypes.InteractionTag{
+		{InteractionCID: "cid_a", Tag: "todo", Tagged: true},
+		{InteractionCID: "cid_a", Tag: "receipts", Tagged: true},
+		{InteractionCID: "cid_b", Tag: "todo", Tagged: true},
+		{InteractionCID: "cid_c", Tag: "todo", Tagged: false},
+		{InteractionCID: "cid_unknown", Tag: "todo", Tagged: true},
+	} {
+		tag.ConversationPublicKey = "conv_1"
+		tag.TaggedDate = int64(date + 1)
+		_, err := db.setInteractionTag(tag)
+		require.NoError(t, err)
+	}
+
+	// the messages not received yet are not counted
+	summaries, err := db.getInteractionTagSummaries()
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	require.Equal(t, "receipts", summaries[0].GetTag())
+	require.Equal(t, int64(1), summaries[0].GetCount())
+	require.Equal(t, "todo", summaries[1].GetTag())
+	require.Equal(t, int64(2), summaries[1].GetCount())
+	require.Equal(t, int64(3), summaries[1].GetLastTaggedDate())
+
+	interactions, err := db.getMatchingInteractions("", false, &messengertypes.InteractionList_Filter{Tags: []string{"Todo"}}, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+
+	require.NoError(t, db.fillInteractionsTags(interactions))
+	for _, i := range interactions {
+		switch i.GetCID() {
+		case "cid_a":
+			require.Equal(t, []string{"receipts", "todo"}, i.GetTags())
+		case "cid_b":
+			require.Equal(t, []string{"todo"}, i.GetTags())
+		default:
+			require.Fail(t, "unexpected interaction", i.GetCID())
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package bertymessenger
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	ircServerName      = "berty"
+	ircDefaultChannel  = "#berty"
+	ircMaxLineSize     = 8 * 1024
+	ircMaxNickLength   = 30
+	ircWriteTimeout    = 5 * time.Second
+	ircInteractTimeout = time.Minute
+)
+
+// IRCGatewayOpts configures the IRC server relaying a single conversation, the server is only reachable from this
+// device so the clients are not authenticated unless a password is set
+type IRCGatewayOpts struct {
+	// ListenAddr is the address of the IRC server, it must be a loopback address
+	ListenAddr string
+	// ConversationPublicKey is the conversation joined by the IRC clients
+	ConversationPublicKey string
+	// Password is required from the clients with the PASS command if set
+	Password string
+}
+
+type ircGateway struct {
+	svc      *service
+	opts     IRCGatewayOpts
+	listener net.Listener
+	logger   *zap.Logger
+
+	muClients sync.Mutex
+	clients   map[*ircClient]struct{}
+}
+
+type ircClient struct {
+	gateway *ircGateway
+	conn    net.Conn
+	muWrite sync.Mutex
+
+	nick       string
+	password   string
+	hasUser    bool
+	registered bool
+	channel    string
+}
+
+func newIRCGateway(svc *service, opts IRCGatewayOpts) (*ircGateway, error) {
+	if opts.ConversationPublicKey == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	host, _, err := net.SplitHostPort(opts.ListenAddr)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the irc gateway must listen on a loopback address"))
+	}
+
+	return &ircGateway{
+		svc:     svc,
+		opts:    opts,
+		logger:  svc.logger.Named("irc"),
+		clients: map[*ircClient]struct{}{},
+	}, nil
+}
+
+func (g *ircGateway) start() error {
+	l, err := net.Listen("tcp", g.opts.ListenAddr)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	g.listener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				g.logger.Debug("irc gateway stopped", zap.Error(err))
+				return
+			}
+
+			go g.serve(conn)
+		}
+	}()
+
+	return nil
+}
+
+func (g *ircGateway) close() {
+	if g.listener != nil {
+		_ = g.listener.Close()
+	}
+
+	g.muClients.Lock()
+	defer g.muClients.Unlock()
+
+	for c := range g.clients {
+		_ = c.conn.Close()
+	}
+}
+
+func (g *ircGateway) serve(conn net.Conn) {
+	c := &ircClient{gateway: g, conn: conn}
+
+	g.muClients.Lock()
+	g.clients[c] = struct{}{}
+	g.muClients.Unlock()
+
+	defer func() {
+		g.muClients.Lock()
+		delete(g.clients, c)
+		g.muClients.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), ircMaxLineSize)
+	for scanner.Scan() {
+		command, params := parseIRCMessage(scanner.Text())
+		if command == "" {
+			continue
+		}
+
+		if !c.handle(command, params) {
+			return
+		}
+	}
+}
+
+// parseIRCMessage splits a line in its command and parameters, the prefix sent by the clients is ignored
+func parseIRCMessage(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		if idx := strings.Index(line, " "); idx >= 0 {
+			line = line[idx+1:]
+		} else {
+			return "", nil
+		}
+	}
+
+	trailing, hasTrailing := "", false
+	if strings.HasPrefix(line, ":") {
+		return "", nil
+	} else if idx := strings.Index(line, " :"); idx >= 0 {
+		trailing, hasTrailing = line[idx+2:], true
+		line = line[:idx]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	params := fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+
+	return strings.ToUpper(fields[0]), params
+}
+
+// ircNick converts a display name to a valid nickname
+func ircNick(name string) string {
+	nick := strings.Builder{}
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("[]\\`_^{|}-", r):
+			nick.WriteRune(r)
+		case unicode.IsSpace(r):
+			nick.WriteRune('_')
+		}
+	}
+
+	result := []rune(nick.String())
+	if len(result) > ircMaxNickLength {
+		result = result[:ircMaxNickLength]
+	}
+
+	if len(result) == 0 || unicode.IsDigit(result[0]) || result[0] == '-' {
+		return "b" + string(result)
+	}
+
+	return string(result)
+}
+
+func (c *ircClient) send(format string, args ...interface{}) {
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	if _, err := fmt.Fprintf(c.conn, format+"\r\n", args...); err != nil {
+		c.gateway.logger.Debug("unable to write to irc client", zap.Error(err))
+	}
+}
+
+// numeric sends a numeric reply, the last param is sent as the trailing one
+func (c *ircClient) numeric(code string, params ...string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	if len(params) > 0 {
+		params[len(params)-1] = ":" + params[len(params)-1]
+	}
+
+	c.send(":%s %s %s %s", ircServerName, code, nick, strings.Join(params, " "))
+}
+
+func (c *ircClient) prefix() string {
+	return c.nick + "!" + c.nick + "@" + ircServerName
+}
+
+// handle processes a command of the client, false is returned when the connection must be closed
+func (c *ircClient) handle(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			c.send(":%s CAP * LS :", ircServerName)
+		}
+		return true
+	case "PASS":
+		if len(params) > 0 {
+			c.password = params[0]
+		}
+		return true
+	case "NICK":
+		if len(params) == 0 || ircNick(params[0]) != params[0] {
+			c.numeric("432", "Erroneous nickname")
+			return true
+		}
+
+		if c.registered {
+			c.send(":%s NICK :%s", c.prefix(), params[0])
+		}
+
+		// the nick and the registration are read when relaying the messages
+		c.gateway.muClients.Lock()
+		c.nick = params[0]
+		c.gateway.muClients.Unlock()
+
+		return c.register()
+	case "USER":
+		c.hasUser = true
+		return c.register()
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		c.send(":%s PONG %s :%s", ircServerName, ircServerName, token)
+		return true
+	case "QUIT":
+		return false
+	}
+
+	if !c.registered {
+		c.numeric("451", "You have not registered")
+		return true
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) == 0 || params[0] != c.channel {
+			c.numeric("403", strings.Join(params, " "), "No such channel")
+			return true
+		}
+		c.join()
+	case "PART":
+		if len(params) > 0 && params[0] == c.channel {
+			c.send(":%s PART %s", c.prefix(), c.channel)
+		}
+	case "NAMES":
+		c.names()
+	case "TOPIC":
+		c.numeric("331", c.channel, "No topic is set")
+	case "MODE":
+		if len(params) > 0 && params[0] == c.channel {
+			c.numeric("324", c.channel, "+nt")
+		} else {
+			c.numeric("221", "+i")
+		}
+	case "WHO":
+		c.numeric("315", strings.Join(params, " "), "End of WHO list")
+	case "PRIVMSG":
+		if len(params) < 2 {
+			c.numeric("412", "No text to send")
+			return true
+		}
+
+		if params[0] != c.channel {
+			c.numeric("401", params[0], "No such nick/channel")
+			return true
+		}
+
+		if err := c.gateway.sendToBerty(c.nick, params[1]); err != nil {
+			c.send(":%s NOTICE %s :unable to send the message: %s", ircServerName, c.nick, strings.ReplaceAll(err.Error(), "\n", " "))
+		}
+	case "NOTICE":
+		// notices are not relayed
+	default:
+		c.numeric("421", command, "Unknown command")
+	}
+
+	return true
+}
+
+// register welcomes the client once its nick and user are known, and joins it to the channel of the conversation
+func (c *ircClient) register() bool {
+	if c.registered || c.nick == "" || !c.hasUser {
+		return true
+	}
+
+	if password := c.gateway.opts.Password; password != "" && subtle.ConstantTimeCompare([]byte(c.password), []byte(password)) != 1 {
+		c.numeric("464", "Password incorrect")
+		return false
+	}
+
+	channel := c.gateway.channelName()
+
+	c.gateway.muClients.Lock()
+	c.registered = true
+	c.channel = channel
+	c.gateway.muClients.Unlock()
+
+	c.numeric("001", "Welcome to the Berty IRC gateway "+c.nick)
+	c.numeric("002", "Your host is "+ircServerName)
+	c.numeric("003", "This server relays a single Berty conversation")
+	c.numeric("004", ircServerName+" berty i nt")
+	c.numeric("422", "MOTD File is missing")
+
+	c.join()
+
+	return true
+}
+
+func (c *ircClient) join() {
+	c.send(":%s JOIN %s", c.prefix(), c.channel)
+	c.numeric("331", c.channel, "No topic is set")
+	c.names()
+}
+
+func (c *ircClient) names() {
+	nicks := append([]string{c.nick}, c.gateway.memberNicks()...)
+	c.numeric("353", "=", c.channel, strings.Join(nicks, " "))
+	c.numeric("366", c.channel, "End of NAMES list")
+}
+
+func (g *ircGateway) channelName() string {
+	conv, err := g.svc.db.getConversationByPK(g.opts.ConversationPublicKey)
+	if err != nil || conv.GetDisplayName() == "" {
+		return ircDefaultChannel
+	}
+
+	return "#" + ircNick(conv.GetDisplayName())
+}
+
+func (g *ircGateway) memberNicks() []string {
+	members, err := g.svc.db.getMembersByConversation(g.opts.ConversationPublicKey)
+	if err != nil {
+		g.logger.Warn("unable to list the members", zap.Error(err))
+		return nil
+	}
+
+	nicks := []string(nil)
+	for _, member := range members {
+		if !member.GetIsMe() {
+			nicks = append(nicks, ircNick(member.GetDisplayName()))
+		}
+	}
+
+	return nicks
+}
+
+// sendToBerty sends a message of an IRC client to the conversation, the CTCP actions are converted to "* nick text"
+func (g *ircGateway) sendToBerty(nick string, text string) error {
+	if strings.HasPrefix(text, "\x01") {
+		action := strings.TrimSuffix(strings.TrimPrefix(text, "\x01"), "\x01")
+		if !strings.HasPrefix(action, "ACTION ") {
+			return nil
+		}
+		text = "* " + nick + " " + strings.TrimPrefix(action, "ACTION ")
+	}
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: text})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	ctx, cancel := context.WithTimeout(g.svc.ctx, ircInteractTimeout)
+	defer cancel()
+
+	_, err = g.svc.Interact(ctx, &messengertypes.Interact_Request{
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		Payload:               payload,
+		ConversationPublicKey: g.opts.ConversationPublicKey,
+		ViaGateway:            true,
+	})
+	return err
+}
+
+// relayInteraction sends a new message of the conversation to the IRC clients, the messages sent by the account from
+// another device are shown as sent by the nick of each client, the ones sent through a gateway are not echoed
+func (g *ircGateway) relayInteraction(tx *dbWrapper, i *messengertypes.Interaction, body string) {
+	if i.GetConversationPublicKey() != g.opts.ConversationPublicKey || (i.GetIsMe() && i.GetViaGateway()) {
+		return
+	}
+
+	nick := ""
+	if !i.GetIsMe() {
+		switch conv := i.GetConversation(); {
+		case i.GetMember().GetDisplayName() != "":
+			nick = ircNick(i.GetMember().GetDisplayName())
+		case conv.GetType() == messengertypes.Conversation_ContactType:
+			if contact, err := tx.getContactByPK(conv.GetContactPublicKey()); err == nil {
+				nick = ircNick(contact.GetDisplayName())
+			}
+		}
+
+		if nick == "" || nick == "b" {
+			nick = ircNick("berty-" + i.GetMemberPublicKey())
+			if len(nick) > len("berty-")+8 {
+				nick = nick[:len("berty-")+8]
+			}
+		}
+	}
+
+	lines := []string(nil)
+	for _, line := range strings.Split(body, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	for _, media := range i.GetMedias() {
+		lines = append(lines, fmt.Sprintf("[attachment: %s]", media.GetFilename()))
+	}
+
+	g.muClients.Lock()
+	defer g.muClients.Unlock()
+
+	for c := range g.clients {
+		if !c.registered {
+			continue
+		}
+
+		sender := nick
+		if sender == "" {
+			sender = c.nick
+		}
+
+		for _, line := range lines {
+			c.send(":%s!%s@%s PRIVMSG %s :%s", sender, sender, ircServerName, c.channel, line)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package bertymessenger
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_parseIRCMessage(t *testing.T) {
+	command, params := parseIRCMessage("privmsg #berty :hello world\r")
+	require.Equal(t, "PRIVMSG", command)
+	require.Equal(t, []string{"#berty", "hello world"}, params)
+
+	command, params = parseIRCMessage(":alice!alice@host NICK bob")
+	require.Equal(t, "NICK", command)
+	require.Equal(t, []string{"bob"}, params)
+
+	command, _ = parseIRCMessage("   ")
+	require.Equal(t, "", command)
+}
+
+func Test_ircNick(t *testing.T) {
+	require.Equal(t, "Alice_Smith", ircNick("Alice Smith"))
+	require.Equal(t, "b42", ircNick("42"))
+	require.Equal(t, "b", ircNick("!!!"))
+	require.Equal(t, "élodie", ircNick("élodie"))
+	require.Len(t, []rune(ircNick(strings.Repeat("a", 50))), ircMaxNickLength)
+}
+
+func Test_newIRCGateway(t *testing.T) {
+	svc := &service{logger: zap.NewNop()}
+
+	_, err := newIRCGateway(svc, IRCGatewayOpts{ListenAddr: "127.0.0.1:6667"})
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+
+	_, err = newIRCGateway(svc, IRCGatewayOpts{ListenAddr: "0.0.0.0:6667", ConversationPublicKey: "conv_1"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = newIRCGateway(svc, IRCGatewayOpts{ListenAddr: "localhost:6667", ConversationPublicKey: "conv_1"})
+	require.NoError(t, err)
+}
+
+func testIRCClient(t *testing.T, g *ircGateway) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	go g.serve(server)
+
+	return client, bufio.NewReader(client)
+}
+
+func readIRCLineUntil(t *testing.T, reader *bufio.Reader, substr string) string {
+	t.Helper()
+
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+
+		if strings.Contains(line, substr) {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+func Test_ircGateway(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	g, err := newIRCGateway(&service{logger: zap.NewNop(), db: db}, IRCGatewayOpts{ListenAddr: "127.0.0.1:0", ConversationPublicKey: "conv_1", Password: "secret"})
+	require.NoError(t, err)
+
+	// a wrong password closes the connection
+	conn, reader := testIRCClient(t, g)
+	go func() { _, _ = conn.Write([]byte("PASS wrong\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n")) }()
+	require.Contains(t, readIRCLineUntil(t, reader, " 464 "), "Password incorrect")
+	conn.Close()
+
+	conn, reader = testIRCClient(t, g)
+	defer conn.Close()
+
+	go func() { _, _ = conn.Write([]byte("PASS secret\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n")) }()
+	require.Contains(t, readIRCLineUntil(t, reader, " 001 "), "alice")
+	require.Equal(t, ":alice!alice@berty JOIN #berty", readIRCLineUntil(t, reader, "JOIN"))
+	readIRCLineUntil(t, reader, " 366 ")
+
+	go func() { _, _ = conn.Write([]byte("PING :token\r\n")) }()
+	require.Equal(t, ":berty PONG berty :token", readIRCLineUntil(t, reader, "PONG"))
+
+	go g.relayInteraction(db, &messengertypes.Interaction{
+		CID:                   "cid_1",
+		ConversationPublicKey: "conv_1",
+		Member:                &messengertypes.Member{DisplayName: "Bob Smith"},
+		Medias:                []*messengertypes.Media{{Filename: "cat.png"}},
+	}, "hello\nworld")
+	require.Equal(t, ":Bob_Smith!Bob_Smith@berty PRIVMSG #berty :hello", readIRCLineUntil(t, reader, "PRIVMSG"))
+	require.Equal(t, ":Bob_Smith!Bob_Smith@berty PRIVMSG #berty :world", readIRCLineUntil(t, reader, "PRIVMSG"))
+	require.Equal(t, ":Bob_Smith!Bob_Smith@berty PRIVMSG #berty :[attachment: cat.png]", readIRCLineUntil(t, reader, "PRIVMSG"))
+
+	// the messages of the account are shown with the nick of the client, except the ones sent through a gateway
+	go func() {
+		g.relayInteraction(db, &messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_1", IsMe: true, ViaGateway: true}, "echo")
+		g.relayInteraction(db, &messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_1", IsMe: true}, "from my phone")
+	}()
+	require.Equal(t, ":alice!alice@berty PRIVMSG #berty :from my phone", readIRCLineUntil(t, reader, "PRIVMSG"))
+}
@@ -0,0 +1,241 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The members joining a group which requires an approval are pending from their first device, every member applies the
+// decisions of the admins and ignores the messages of the pending members. The refused messages are not marked as
+// processed, they are handled again once the member is approved.
+
+func (h *eventHandler) handleAppMessageSetJoinApproval(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetJoinApproval)
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring join approval sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeJoinApprovalChanged, "", strconv.FormatBool(payload.GetRequired())); err != nil {
+		return nil, false, err
+	}
+
+	date := int64(0)
+	if payload.GetRequired() {
+		date = i.GetSentDate()
+		if current := i.GetConversation().GetJoinApprovalDate(); current != 0 {
+			date = current
+		}
+	}
+
+	conv, err := tx.setConversationJoinApprovalDate(i.GetConversationPublicKey(), date)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageMemberJoinDecision(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_MemberJoinDecision)
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring join decision sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	state, auditType := messengertypes.Member_JoinDenied, messengertypes.GroupAuditEvent_TypeMemberJoinDenied
+	if payload.GetApproved() {
+		state, auditType = messengertypes.Member_JoinApproved, messengertypes.GroupAuditEvent_TypeMemberJoinApproved
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, auditType, payload.GetMemberPublicKey(), ""); err != nil {
+		return nil, false, err
+	}
+
+	member, updated, err := tx.setMemberJoinState(payload.GetMemberPublicKey(), i.GetConversationPublicKey(), state, i.GetSentDate())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberUpdated, &messengertypes.StreamEvent_MemberUpdated{Member: member}, false); err != nil {
+			return nil, false, err
+		}
+
+		// the replay handles the messages of the member once the transaction is committed
+		if payload.GetApproved() && !h.replay {
+			go h.svc.replayApprovedMember(i.GetConversationPublicKey(), member.GetPublicKey())
+		}
+	}
+
+	if updated {
+		if err := h.refreshConversationMembers(tx, i.GetConversationPublicKey()); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+// checkMemberJoinPending is called when the first device of a member is added to a group, the admins are notified
+// when the member must be approved
+func (h *eventHandler) checkMemberJoinPending(convPK, memberPK string) error {
+	member, added, err := h.db.addPendingMember(memberPK, convPK, timestampMs(time.Now()))
+	if err != nil || !added {
+		return err
+	}
+
+	// the pending members are not named in the fallback name of the group
+	if err := h.refreshConversationMembers(h.db, convPK); err != nil {
+		return err
+	}
+
+	if h.svc == nil {
+		return nil
+	}
+
+	h.logger.Info("member waiting for approval", logGroup(convPK), zap.String("member-pk", memberPK))
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberUpdated, &messengertypes.StreamEvent_MemberUpdated{Member: member}, true); err != nil {
+		return err
+	}
+
+	conv, err := h.db.getConversationByPK(convPK)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if admin, err := h.db.isConversationAdmin(convPK, conv.GetAccountMemberPublicKey()); err != nil || !admin {
+		return err
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberJoinRequested, &messengertypes.StreamEvent_MemberJoinRequested{Member: member}, false)
+}
+
+// replayApprovedMember handles again the messages of a group refused while a member was pending
+func (svc *service) replayApprovedMember(convPK, memberPK string) {
+	defer svc.writer.enter()()
+
+	report := &messengertypes.ReplayReport{}
+	if err := svc.replayGroup(svc.ctx, convPK, replayFilter{groupPKs: []string{convPK}}, report); err != nil {
+		svc.logger.Error("unable to replay the messages of an approved member", logGroup(convPK), zap.String("member-pk", memberPK), zap.Error(err))
+	}
+}
+
+// getPendingMember returns a member of a moderated group waiting for an approval
+func (svc *service) getPendingMember(conv *messengertypes.Conversation, memberPK string) (*messengertypes.Member, error) {
+	if err := svc.checkModerationTarget(conv, memberPK); err != nil {
+		return nil, err
+	}
+
+	member, err := svc.db.getMemberByPK(memberPK, conv.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if member.GetJoinState() != messengertypes.Member_JoinPending {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the member is not waiting for an approval"))
+	}
+
+	return member, nil
+}
+
+func (svc *service) ConversationSetJoinApproval(ctx context.Context, req *messengertypes.ConversationSetJoinApproval_Request) (*messengertypes.ConversationSetJoinApproval_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetJoinApproval, &messengertypes.AppMessage_SetJoinApproval{
+		Required: req.GetRequired(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetJoinApproval_Reply{}, nil
+}
+
+func (svc *service) ConversationJoinRequestList(ctx context.Context, req *messengertypes.ConversationJoinRequestList_Request) (*messengertypes.ConversationJoinRequestList_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	members, err := svc.db.getPendingMembers(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationJoinRequestList_Reply{Members: members}, nil
+}
+
+func (svc *service) ConversationJoinRequestApprove(ctx context.Context, req *messengertypes.ConversationJoinRequestApprove_Request) (*messengertypes.ConversationJoinRequestApprove_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svc.getPendingMember(conv, req.GetMemberPublicKey()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeMemberJoinDecision, &messengertypes.AppMessage_MemberJoinDecision{
+		MemberPublicKey: req.GetMemberPublicKey(),
+		Approved:        true,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationJoinRequestApprove_Reply{}, nil
+}
+
+func (svc *service) ConversationJoinRequestDeny(ctx context.Context, req *messengertypes.ConversationJoinRequestDeny_Request) (*messengertypes.ConversationJoinRequestDeny_Reply, error) {
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svc.getPendingMember(conv, req.GetMemberPublicKey()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeMemberJoinDecision, &messengertypes.AppMessage_MemberJoinDecision{
+		MemberPublicKey: req.GetMemberPublicKey(),
+	}); err != nil {
+		return nil, err
+	}
+
+	// the member is also removed, the members who missed the decision ignore its messages as well
+	if err := svc.removeGroupMember(ctx, conv.GetPublicKey(), req.GetMemberPublicKey()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationJoinRequestDeny_Reply{}, nil
+}
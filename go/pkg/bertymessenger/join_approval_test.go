@@ -0,0 +1,81 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_joinApproval(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"}).Error)
+	_, err := db.addMember("member_creator", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+
+	// the members are not pending until the approval is required
+	require.NoError(t, db.db.Create(&messengertypes.Device{PublicKey: "device_1", MemberPublicKey: "member_1"}).Error)
+	_, added, err := db.addPendingMember("member_1", "conv_1", 10)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	conv, err := db.setConversationJoinApprovalDate("conv_1", 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), conv.GetJoinApprovalDate())
+
+	// a second device of a known member doesn't make it pending
+	require.NoError(t, db.db.Create(&messengertypes.Device{PublicKey: "device_2", MemberPublicKey: "member_1"}).Error)
+	_, added, err = db.addPendingMember("member_1", "conv_1", 20)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	_, added, err = db.addPendingMember("member_creator", "conv_1", 20)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	require.NoError(t, db.db.Create(&messengertypes.Device{PublicKey: "device_3", MemberPublicKey: "member_2"}).Error)
+	member, added, err := db.addPendingMember("member_2", "conv_1", 30)
+	require.NoError(t, err)
+	require.True(t, added)
+	require.Equal(t, messengertypes.Member_JoinPending, member.GetJoinState())
+
+	members, err := db.getPendingMembers("conv_1")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+	require.Equal(t, "member_2", members[0].GetPublicKey())
+
+	// only the messages identifying the member are accepted
+	allowed, err := db.isInteractionSenderAllowed(&messengertypes.Interaction{Conversation: conv, Type: messengertypes.AppMessage_TypeUserMessage, MemberPublicKey: "member_2", SentDate: 40})
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	allowed, err = db.isInteractionSenderAllowed(&messengertypes.Interaction{Conversation: conv, Type: messengertypes.AppMessage_TypeSetUserInfo, MemberPublicKey: "member_2", SentDate: 40})
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// a decision sent before the member was seen by this device still applies
+	member, updated, err := db.setMemberJoinState("member_2", "conv_1", messengertypes.Member_JoinApproved, 25)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, messengertypes.Member_JoinApproved, member.GetJoinState())
+
+	allowed, err = db.isInteractionSenderAllowed(&messengertypes.Interaction{Conversation: conv, Type: messengertypes.AppMessage_TypeUserMessage, MemberPublicKey: "member_2", SentDate: 40})
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// the most recent decision wins and a decided member is not pending again
+	_, updated, err = db.setMemberJoinState("member_2", "conv_1", messengertypes.Member_JoinDenied, 20)
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	_, added, err = db.addPendingMember("member_2", "conv_1", 50)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	members, err = db.getPendingMembers("conv_1")
+	require.NoError(t, err)
+	require.Empty(t, members)
+}
@@ -0,0 +1,124 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The secrets of a group are per device, a rotation replaces the secret of the local device and sends it to the
+// members of the group except the removed and the denied ones, they can still read the previous messages but not the
+// ones sent afterwards. The rotation marker is sent on the message log with the new secret, it is listed again with
+// the logs so it is kept in the timeline when the database is rebuilt.
+
+func (h *eventHandler) handleAppMessageKeyRotation(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_KeyRotation)
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeKeysRotated, "", strconv.FormatInt(payload.GetExcludedCount(), 10)); err != nil {
+		return nil, false, err
+	}
+
+	i, isNew, err := tx.addInteraction(*i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if h.svc == nil {
+		return i, isNew, nil
+	}
+
+	if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew); err != nil {
+		return nil, false, err
+	}
+
+	return i, isNew, nil
+}
+
+func (svc *service) ConversationRotateKeys(ctx context.Context, req *messengertypes.ConversationRotateKeys_Request) (*messengertypes.ConversationRotateKeys_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	marker, err := svc.rotateConversationKeys(ctx, conv, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationRotateKeys_Reply{MembersCount: marker.GetMembersCount(), ExcludedCount: marker.GetExcludedCount()}, nil
+}
+
+// rotateConversationKeys rotates the secret of the current device for a group and sends the rotation marker, the
+// removed and the denied members are excluded along with the members of excludedPKs. The writer must be held
+func (svc *service) rotateConversationKeys(ctx context.Context, conv *messengertypes.Conversation, excludedPKs []string) (*messengertypes.AppMessage_KeyRotation, error) {
+	gpk, err := b64DecodeBytes(conv.GetPublicKey())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	members, err := svc.db.getExcludedMembers(conv.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	memberPKs := make(map[string]bool, len(members)+len(excludedPKs))
+	for _, member := range members {
+		// the protocol refuses to exclude the local member
+		if !member.GetIsMe() {
+			memberPKs[member.GetPublicKey()] = true
+		}
+	}
+	for _, pk := range excludedPKs {
+		if pk != conv.GetAccountMemberPublicKey() {
+			memberPKs[pk] = true
+		}
+	}
+
+	excluded := [][]byte(nil)
+	for memberPK := range memberPKs {
+		pk, err := b64DecodeBytes(memberPK)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+		excluded = append(excluded, pk)
+	}
+
+	rotated, err := svc.protocolClient.GroupDeviceSecretRotate(ctx, &protocoltypes.GroupDeviceSecretRotate_Request{GroupPK: gpk, ExcludedMemberPKs: excluded})
+	if err != nil {
+		return nil, errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	marker := &messengertypes.AppMessage_KeyRotation{
+		MembersCount:  rotated.GetMembersCount(),
+		ExcludedCount: int64(len(excluded)),
+	}
+
+	payload, err := messengertypes.AppMessage_TypeKeyRotation.MarshalPayload(timestampMs(time.Now()), nil, marker)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+		return nil, errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	svc.logger.Info("group keys rotated", logGroup(conv.GetPublicKey()), zap.Int64("members", marker.GetMembersCount()), zap.Int64("excluded", marker.GetExcludedCount()))
+
+	svc.addSystemNotice(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeKeysRotated, ConversationPublicKey: conv.GetPublicKey()})
+
+	return marker, nil
+}
@@ -0,0 +1,70 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_getExcludedMembers(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, pk := range []string{"member_1", "member_removed", "member_denied", "member_pending"} {
+		_, err := db.addMember(pk, "conv_1", "", "", false, false)
+		require.NoError(t, err)
+	}
+	_, err := db.addMember("member_removed", "conv_2", "", "", false, false)
+	require.NoError(t, err)
+
+	err = db.setMemberModeration(&messengertypes.Member{PublicKey: "member_removed", ConversationPublicKey: "conv_1", RemovedDate: 10, RemovedClock: testClock(10)})
+	require.NoError(t, err)
+	_, _, err = db.setMemberJoinState("member_denied", "conv_1", messengertypes.Member_JoinDenied, 20)
+	require.NoError(t, err)
+	_, _, err = db.setMemberJoinState("member_pending", "conv_1", messengertypes.Member_JoinPending, 30)
+	require.NoError(t, err)
+
+	members, err := db.getExcludedMembers("conv_1")
+	require.NoError(t, err)
+
+	pks := []string(nil)
+	for _, member := range members {
+		pks = append(pks, member.GetPublicKey())
+	}
+	require.ElementsMatch(t, []string{"member_removed", "member_denied"}, pks)
+
+	members, err = db.getExcludedMembers("conv_2")
+	require.NoError(t, err)
+	require.Empty(t, members)
+}
+
+func Test_eventHandler_handleAppMessageKeyRotation(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	i := &messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeKeyRotation, ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", SentDate: 1000}
+
+	_, isNew, err := h.handleAppMessageKeyRotation(db, i, &messengertypes.AppMessage_KeyRotation{MembersCount: 3, ExcludedCount: 1})
+	require.NoError(t, err)
+	require.True(t, isNew)
+
+	// the marker is kept once when the logs are replayed
+	_, isNew, err = h.handleAppMessageKeyRotation(db, i, &messengertypes.AppMessage_KeyRotation{MembersCount: 3, ExcludedCount: 1})
+	require.NoError(t, err)
+	require.False(t, isNew)
+
+	stored, err := db.getInteractionByCID("cid_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.AppMessage_TypeKeyRotation, stored.GetType())
+
+	events, err := db.getGroupAuditEvents("conv_1", []messengertypes.GroupAuditEvent_Type{messengertypes.GroupAuditEvent_TypeKeysRotated}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, "1", events[0].GetDetails())
+}
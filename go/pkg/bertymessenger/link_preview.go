@@ -0,0 +1,116 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/linkpreview"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const linkPreviewFetchTimeout = 5 * time.Second
+
+// attachLinkPreviews fetches the previews of the urls found in a user message and embeds them into it,
+// it returns the thumbnails medias that must be sent along with the message.
+// It performs network requests and must not be called while holding the writer.
+func (svc *service) attachLinkPreviews(ctx context.Context, um *messengertypes.AppMessage_UserMessage) []*messengertypes.Media {
+	if len(um.GetLinkPreviews()) > 0 {
+		return nil
+	}
+
+	acc, err := svc.db.getAccount()
+	if err != nil || !acc.GetLinkPreviewsEnabled() {
+		return nil
+	}
+
+	medias := []*messengertypes.Media(nil)
+	for _, target := range linkpreview.FindURLs(um.GetBody(), linkpreview.DefaultMaxURLs) {
+		preview, thumbnail := svc.fetchLinkPreview(ctx, target)
+		if preview == nil {
+			continue
+		}
+
+		um.LinkPreviews = append(um.LinkPreviews, preview)
+		if thumbnail != nil {
+			medias = append(medias, thumbnail)
+		}
+	}
+
+	return medias
+}
+
+func (svc *service) fetchLinkPreview(ctx context.Context, target string) (*messengertypes.LinkPreview, *messengertypes.Media) {
+	ctx, cancel := context.WithTimeout(ctx, linkPreviewFetchTimeout)
+	defer cancel()
+
+	logger := svc.logger.With(zap.String("url", target))
+
+	p, err := svc.linkPreviewFetcher.Fetch(ctx, target)
+	if err != nil {
+		logger.Debug("unable to fetch link preview", zap.Error(err))
+		return nil, nil
+	}
+
+	preview := &messengertypes.LinkPreview{
+		Url:         p.URL,
+		Title:       p.Title,
+		Description: p.Description,
+		SiteName:    p.SiteName,
+	}
+
+	if p.ImageURL == "" {
+		return preview, nil
+	}
+
+	data, mimeType, err := svc.linkPreviewFetcher.FetchImage(ctx, p.ImageURL)
+	if err != nil {
+		logger.Debug("unable to fetch link preview thumbnail", zap.Error(err))
+		return preview, nil
+	}
+
+	cidBytes, err := svc.attachmentPrepare(bytes.NewReader(data))
+	if err != nil {
+		logger.Warn("unable to prepare link preview thumbnail", zap.Error(err))
+		return preview, nil
+	}
+
+	preview.ThumbnailCID = b64EncodeBytes(cidBytes)
+
+	return preview, &messengertypes.Media{
+		CID:         preview.ThumbnailCID,
+		MimeType:    mimeType,
+		DisplayName: p.Title,
+		Size_:       int64(len(data)),
+		State:       messengertypes.Media_StatePrepared,
+	}
+}
+
+// addLinkPreviewMedias stores the thumbnails of the link previews and notifies the clients, it returns their cids
+func (svc *service) addLinkPreviewMedias(medias []*messengertypes.Media) ([]string, error) {
+	if len(medias) == 0 {
+		return nil, nil
+	}
+
+	added, err := svc.db.addMedias(medias)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]string, len(medias))
+	for i, media := range medias {
+		cids[i] = media.GetCID()
+
+		if !added[i] {
+			continue
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, true); err != nil {
+			svc.logger.Error("unable to dispatch notification for media", zap.String("cid", media.GetCID()), zap.Error(err))
+		}
+	}
+
+	return cids, nil
+}
@@ -0,0 +1,227 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const localEchoIDSize = 16
+
+// The visible messages sent with Interact are stored as local echoes before being sent, the clients render them at
+// once as interactions identified by the id of the echo. The echo is found again with the hash of the message when it
+// is received back from the group log, the interaction replaces it and carries its id, whether the message arrives
+// live or through a replay. A message which fails to send keeps its echo as failed until it is discarded, the echoes
+// still pending on start whose message never left this node are failed too.
+
+// localEchoAppMessageTypes are the types of the messages echoed, the other interactions are not rendered on their own
+var localEchoAppMessageTypes = map[messengertypes.AppMessage_Type]bool{
+	messengertypes.AppMessage_TypeUserMessage: true,
+	messengertypes.AppMessage_TypeLocation:    true,
+	messengertypes.AppMessage_TypePollCreate:  true,
+}
+
+// localEchoInteraction renders a local echo as the interaction of its message
+func localEchoInteraction(echo *messengertypes.LocalEcho) (*messengertypes.Interaction, error) {
+	var am messengertypes.AppMessage
+	if err := proto.Unmarshal(echo.GetMessage(), &am); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if err := expandAppMessage(&am); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.Interaction{
+		CID:                   echo.GetID(),
+		Type:                  echo.GetType(),
+		Payload:               am.GetPayload(),
+		IsMe:                  true,
+		ConversationPublicKey: echo.GetConversationPublicKey(),
+		SentDate:              am.GetSentDate(),
+		Medias:                am.GetMedias(),
+		LocalEchoID:           echo.GetID(),
+		LocalEchoState:        echo.GetState(),
+	}, nil
+}
+
+func (svc *service) streamLocalEcho(echo *messengertypes.LocalEcho, isNew bool) error {
+	i, err := localEchoInteraction(echo)
+	if err != nil {
+		return err
+	}
+
+	return svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew)
+}
+
+// sendWithLocalEcho sends or defers an app message like sendOrDeferAppMessage, the message of a visible type is echoed
+// first, the echo is returned with the outbox message. The writer must be held
+func (svc *service) sendWithLocalEcho(ctx context.Context, t messengertypes.AppMessage_Type, contentHash string, ttl time.Duration, req *protocoltypes.AppMessageSend_Request) (*messengertypes.OutboxMessage, *messengertypes.LocalEcho, error) {
+	if !localEchoAppMessageTypes[t] {
+		outboxed, err := svc.sendOrDeferAppMessage(ctx, t, contentHash, ttl, req)
+		return outboxed, nil, err
+	}
+
+	// the echo is matched with the hash of the message as it is received, the message is packed before
+	payload, err := svc.packAppMessage(req.GetGroupPK(), req.GetPayload())
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Payload = payload
+
+	id, err := cryptoutil.GenerateNonceSize(localEchoIDSize)
+	if err != nil {
+		return nil, nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	echo := &messengertypes.LocalEcho{
+		ID:                    b64EncodeBytes(id),
+		ConversationPublicKey: b64EncodeBytes(req.GetGroupPK()),
+		Type:                  t,
+		Message:               req.GetPayload(),
+		MessageHash:           processedEventHash(t.String(), req.GetPayload()),
+		CreatedDate:           timestampMs(time.Now()),
+		State:                 messengertypes.LocalEcho_StatePending,
+	}
+	if err := svc.db.addLocalEcho(echo); err != nil {
+		return nil, nil, err
+	}
+
+	if err := svc.streamLocalEcho(echo, true); err != nil {
+		svc.logger.Error("unable to stream local echo", zap.String("id", echo.GetID()), zap.Error(err))
+	}
+
+	outboxed, err := svc.sendOrDeferAppMessage(ctx, t, contentHash, ttl, req)
+	if err != nil {
+		svc.setLocalEchoState(echo.GetID(), messengertypes.LocalEcho_StateFailed, err.Error())
+		return nil, nil, err
+	}
+
+	if outboxed != nil {
+		echo.OutboxID = outboxed.GetID()
+		if err := svc.db.setLocalEchoOutboxID(echo.GetID(), outboxed.GetID()); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		svc.setLocalEchoState(echo.GetID(), messengertypes.LocalEcho_StateSent, "")
+	}
+
+	return outboxed, echo, nil
+}
+
+// setLocalEchoState updates and streams a local echo, nothing is done when the interaction of the message has already
+// replaced it
+func (svc *service) setLocalEchoState(id string, state messengertypes.LocalEcho_State, reason string) {
+	echo, err := svc.db.setLocalEchoState(id, state, reason)
+	if err != nil {
+		svc.logger.Error("unable to update local echo", zap.String("id", id), zap.Error(err))
+		return
+	}
+
+	if echo == nil {
+		return
+	}
+
+	if err := svc.streamLocalEcho(echo, false); err != nil {
+		svc.logger.Error("unable to stream local echo", zap.String("id", id), zap.Error(err))
+	}
+}
+
+// updateOutboxLocalEcho updates the echo of a deferred message once it leaves the outbox
+func (svc *service) updateOutboxLocalEcho(outboxID string, state messengertypes.LocalEcho_State, reason string) {
+	echo, err := svc.db.getLocalEchoByOutboxID(outboxID)
+	if err != nil {
+		svc.logger.Error("unable to get local echo", zap.String("outbox-id", outboxID), zap.Error(err))
+		return
+	}
+
+	if echo != nil {
+		svc.setLocalEchoState(echo.GetID(), state, reason)
+	}
+}
+
+// failInterruptedLocalEchoes fails the echoes of the messages which were being sent when the node stopped
+func (svc *service) failInterruptedLocalEchoes() error {
+	echoes, err := svc.db.getInterruptedLocalEchoes(timestampMs(svc.startedAt))
+	if err != nil {
+		return err
+	}
+
+	for _, echo := range echoes {
+		svc.setLocalEchoState(echo.GetID(), messengertypes.LocalEcho_StateFailed, "the node stopped before the message was sent")
+	}
+
+	return nil
+}
+
+// reconcileLocalEcho finds the echo of a message sent by this device and removes it, the interaction of the message
+// takes its id. It is called within the transaction of the message
+func (h *eventHandler) reconcileLocalEcho(tx *dbWrapper, i *messengertypes.Interaction, hash string) (*messengertypes.LocalEcho, error) {
+	if !i.GetIsMe() || !localEchoAppMessageTypes[i.GetType()] {
+		return nil, nil
+	}
+
+	echo, err := tx.getLocalEchoByHash(i.GetConversationPublicKey(), hash)
+	if err != nil || echo == nil {
+		return nil, err
+	}
+
+	if _, err := tx.deleteLocalEcho(echo.GetID()); err != nil {
+		return nil, err
+	}
+
+	i.LocalEchoID = echo.GetID()
+
+	return echo, nil
+}
+
+func (svc *service) LocalEchoList(ctx context.Context, req *messengertypes.LocalEchoList_Request) (*messengertypes.LocalEchoList_Reply, error) {
+	echoes, err := svc.db.getLocalEchoes(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.LocalEchoList_Reply{}
+	for _, echo := range echoes {
+		i, err := localEchoInteraction(echo)
+		if err != nil {
+			svc.logger.Warn("unable to read local echo", zap.String("id", echo.GetID()), zap.Error(err))
+			continue
+		}
+
+		reply.Interactions = append(reply.Interactions, i)
+	}
+
+	return reply, nil
+}
+
+func (svc *service) LocalEchoDiscard(ctx context.Context, req *messengertypes.LocalEchoDiscard_Request) (*messengertypes.LocalEchoDiscard_Reply, error) {
+	if req.GetID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	deleted, err := svc.db.deleteLocalEcho(req.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	if !deleted {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("local echo not found"))
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: req.GetID()}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.LocalEchoDiscard_Reply{}, nil
+}
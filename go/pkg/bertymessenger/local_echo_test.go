@@ -0,0 +1,124 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_service_sendWithLocalEcho(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	online := false
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), isOnline: func() bool { return online }}
+
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(1000, nil, &messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	outboxed, echo, err := svc.sendWithLocalEcho(context.Background(), messengertypes.AppMessage_TypeUserMessage, "hash_1", 0, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_1"), Payload: payload})
+	require.NoError(t, err)
+	require.NotNil(t, outboxed)
+	require.NotNil(t, echo)
+	require.Equal(t, outboxed.GetID(), echo.GetOutboxID())
+	require.Equal(t, messengertypes.LocalEcho_StatePending, echo.GetState())
+
+	// the messages which are not rendered are not echoed
+	ackOutboxed, ack, err := svc.sendWithLocalEcho(context.Background(), messengertypes.AppMessage_TypeAcknowledge, "", 0, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_1"), Payload: []byte("ack")})
+	require.NoError(t, err)
+	require.Nil(t, ack)
+	require.NoError(t, db.deleteOutboxMessage(ackOutboxed.GetID()))
+
+	rep, err := svc.LocalEchoList(context.Background(), &messengertypes.LocalEchoList_Request{ConversationPublicKey: b64EncodeBytes([]byte("group_1"))})
+	require.NoError(t, err)
+	require.Len(t, rep.GetInteractions(), 1)
+	require.Equal(t, echo.GetID(), rep.GetInteractions()[0].GetCID())
+	require.Equal(t, int64(1000), rep.GetInteractions()[0].GetSentDate())
+
+	var um messengertypes.AppMessage_UserMessage
+	require.NoError(t, proto.Unmarshal(rep.GetInteractions()[0].GetPayload(), &um))
+	require.Equal(t, "hello", um.GetBody())
+
+	// the deferred messages are not interrupted while they wait in the outbox
+	interrupted, err := db.getInterruptedLocalEchoes(echo.GetCreatedDate() + 1)
+	require.NoError(t, err)
+	require.Empty(t, interrupted)
+
+	// the echo of a message dropped from the outbox fails
+	require.NoError(t, db.db.Model(&messengertypes.OutboxMessage{}).Where("id = ?", outboxed.GetID()).Update("request", []byte{0xff}).Error)
+
+	online = true
+	require.NoError(t, svc.flushOutbox(context.Background()))
+
+	echoes, err := db.getLocalEchoes("")
+	require.NoError(t, err)
+	require.Len(t, echoes, 1)
+	require.Equal(t, messengertypes.LocalEcho_StateFailed, echoes[0].GetState())
+	require.NotEmpty(t, echoes[0].GetError())
+}
+
+func Test_dbWrapper_getInterruptedLocalEchoes(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addOutboxMessage(&messengertypes.OutboxMessage{ID: "outbox_1", ConversationPublicKey: "conv_1"}))
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_1", ConversationPublicKey: "conv_1", MessageHash: "hash_1", CreatedDate: 10, State: messengertypes.LocalEcho_StatePending}))
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_2", ConversationPublicKey: "conv_1", MessageHash: "hash_2", CreatedDate: 20, State: messengertypes.LocalEcho_StatePending, OutboxID: "outbox_1"}))
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_3", ConversationPublicKey: "conv_1", MessageHash: "hash_3", CreatedDate: 30, State: messengertypes.LocalEcho_StatePending, OutboxID: "outbox_2"}))
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_4", ConversationPublicKey: "conv_1", MessageHash: "hash_4", CreatedDate: 40, State: messengertypes.LocalEcho_StateSent}))
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_5", ConversationPublicKey: "conv_1", MessageHash: "hash_5", CreatedDate: 100, State: messengertypes.LocalEcho_StatePending}))
+
+	echoes, err := db.getInterruptedLocalEchoes(50)
+	require.NoError(t, err)
+	require.Len(t, echoes, 2)
+	require.Equal(t, "echo_1", echoes[0].GetID())
+	require.Equal(t, "echo_3", echoes[1].GetID())
+
+	echo, err := db.setLocalEchoState("echo_1", messengertypes.LocalEcho_StateFailed, "interrupted")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.LocalEcho_StateFailed, echo.GetState())
+
+	// the echoes already replaced are not updated
+	echo, err = db.setLocalEchoState("echo_6", messengertypes.LocalEcho_StateFailed, "interrupted")
+	require.NoError(t, err)
+	require.Nil(t, echo)
+}
+
+func Test_eventHandler_reconcileLocalEcho(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addLocalEcho(&messengertypes.LocalEcho{ID: "echo_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, MessageHash: "hash_1", CreatedDate: 10, State: messengertypes.LocalEcho_StateFailed}))
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+
+	// the messages of the other members never replace an echo
+	i := &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage}
+	echo, err := h.reconcileLocalEcho(db, i, "hash_1")
+	require.NoError(t, err)
+	require.Nil(t, echo)
+
+	// a failed echo is replaced too, its message may have been sent anyway
+	i.IsMe = true
+	echo, err = h.reconcileLocalEcho(db, i, "hash_1")
+	require.NoError(t, err)
+	require.Equal(t, "echo_1", echo.GetID())
+	require.Equal(t, "echo_1", i.GetLocalEchoID())
+
+	echoes, err := db.getLocalEchoes("conv_1")
+	require.NoError(t, err)
+	require.Empty(t, echoes)
+
+	// the message received again doesn't find an echo
+	i = &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, IsMe: true}
+	echo, err = h.reconcileLocalEcho(db, i, "hash_1")
+	require.NoError(t, err)
+	require.Nil(t, echo)
+	require.Empty(t, i.GetLocalEchoID())
+}
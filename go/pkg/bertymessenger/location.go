@@ -0,0 +1,128 @@
+package bertymessenger
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const liveLocationExpiryInterval = 30 * time.Second
+
+func (h *eventHandler) handleAppMessageLocation(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_Location)
+	if err := payload.IsValid(); err != nil {
+		h.logger.Warn("ignoring invalid location", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	existing, err := tx.getLocation(i.GetConversationPublicKey(), i.GetDevicePublicKey())
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		existing = nil
+	case err != nil:
+		return nil, false, err
+	}
+
+	// only the first message of a live share is kept as an interaction, the next ones only move the position
+	isUpdate := payload.IsLive() && existing != nil && existing.GetShareID() == payload.GetShareID()
+
+	isNew := false
+	if !isUpdate {
+		if i, isNew, err = tx.addInteraction(*i); err != nil {
+			return nil, false, err
+		}
+
+		if h.svc != nil {
+			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	// messages can be received out of order, only the most recent position is kept
+	if existing != nil && existing.GetSentDate() > i.GetSentDate() {
+		return i, isNew, nil
+	}
+
+	location := &messengertypes.Location{
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		DevicePublicKey:       i.GetDevicePublicKey(),
+		MemberPublicKey:       i.GetMemberPublicKey(),
+		IsMe:                  i.GetIsMe(),
+		InteractionCID:        i.GetCID(),
+		ShareID:               payload.GetShareID(),
+		Latitude:              payload.GetLatitude(),
+		Longitude:             payload.GetLongitude(),
+		Accuracy:              payload.GetAccuracy(),
+		SentDate:              i.GetSentDate(),
+		ExpiresAt:             payload.GetExpiresAt(),
+		Live:                  payload.IsLive() && !payload.GetStopped() && payload.GetExpiresAt() > timestampMs(time.Now()),
+	}
+
+	if isUpdate {
+		location.InteractionCID = existing.GetInteractionCID()
+
+		// an expired share can't be revived by a late update
+		if !existing.GetLive() {
+			location.Live = false
+		}
+
+		if payload.GetStopped() {
+			location.Latitude = existing.GetLatitude()
+			location.Longitude = existing.GetLongitude()
+			location.Accuracy = existing.GetAccuracy()
+		}
+	}
+
+	if err := tx.upsertLocation(location); err != nil {
+		return nil, false, err
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeLocationUpdated, &messengertypes.StreamEvent_LocationUpdated{Location: location}, !isUpdate); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, isNew, nil
+}
+
+// monitorLiveLocations periodically stops the live locations that have expired, including the ones that expired while the node was offline
+func (svc *service) monitorLiveLocations(ctx context.Context) {
+	ticker := time.NewTicker(liveLocationExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := svc.expireLiveLocations(); err != nil {
+			svc.logger.Error("unable to expire live locations", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (svc *service) expireLiveLocations() error {
+	defer svc.writer.enter()()
+
+	expired, err := svc.db.expireLiveLocations(timestampMs(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	for _, location := range expired {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeLocationUpdated, &messengertypes.StreamEvent_LocationUpdated{Location: location}, false); err != nil {
+			svc.logger.Error("unable to dispatch location update", logGroup(location.GetConversationPublicKey()), zap.Error(err))
+		}
+	}
+
+	return nil
+}
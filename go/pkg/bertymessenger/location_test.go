@@ -0,0 +1,50 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_locations(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.getLocation("", "device_1")
+	require.Error(t, err)
+
+	_, err = db.getLocation("conv_1", "device_1")
+	require.Equal(t, gorm.ErrRecordNotFound, err)
+
+	require.Error(t, db.upsertLocation(&messengertypes.Location{DevicePublicKey: "device_1"}))
+
+	require.NoError(t, db.upsertLocation(&messengertypes.Location{ConversationPublicKey: "conv_1", DevicePublicKey: "device_1", ShareID: "share_1", Live: true, ExpiresAt: 1000, SentDate: 10}))
+	require.NoError(t, db.upsertLocation(&messengertypes.Location{ConversationPublicKey: "conv_1", DevicePublicKey: "device_2", ShareID: "share_2", Live: true, ExpiresAt: 3000, SentDate: 20}))
+	require.NoError(t, db.upsertLocation(&messengertypes.Location{ConversationPublicKey: "conv_1", DevicePublicKey: "device_1", ShareID: "share_1", Live: true, ExpiresAt: 1000, SentDate: 30, Latitude: 12}))
+
+	location, err := db.getLocation("conv_1", "device_1")
+	require.NoError(t, err)
+	require.Equal(t, float64(12), location.Latitude)
+
+	locations, err := db.getLocationsByConversation("conv_1")
+	require.NoError(t, err)
+	require.Len(t, locations, 2)
+	require.Equal(t, "device_1", locations[0].DevicePublicKey)
+
+	expired, err := db.expireLiveLocations(2000)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	require.Equal(t, "device_1", expired[0].DevicePublicKey)
+	require.False(t, expired[0].Live)
+
+	expired, err = db.expireLiveLocations(2000)
+	require.NoError(t, err)
+	require.Empty(t, expired)
+
+	location, err = db.getLocation("conv_1", "device_2")
+	require.NoError(t, err)
+	require.True(t, location.Live)
+}
@@ -0,0 +1,202 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The logs of the messenger are scoped by subsystem, ie. the event handlers or the replay, the level of each subsystem
+// can be changed at runtime with LogLevelSet. The entries are tagged with a hash of the public key of their group so
+// the entries of a group can be followed without exposing it, the redaction mode replaces the fields which may carry
+// the content of the messages or the names of the users.
+
+const (
+	logSubsystemService = "service"
+	logSubsystemHandler = "handler"
+	logSubsystemReplay  = "replay"
+	// logRootName is the name of the logger of the service, the subsystems are its children
+	logRootName = "msg"
+	// logGroupHashSize is the number of bytes of the hash of a group public key logged
+	logGroupHashSize = 8
+	logRedacted      = "[redacted]"
+)
+
+// logSubsystems are the subsystems whose level can be changed, the entries of the other loggers use the level of the
+// service
+var logSubsystems = []string{logSubsystemService, logSubsystemHandler, logSubsystemReplay, "media-dl", "irc", "matrix"}
+
+// logRedactedKeys are the fields which may carry the content of the messages or the names of the users, the reflected,
+// the stringified and the binary fields are redacted too, ie. the models logged with zap.Any
+var logRedactedKeys = map[string]struct{}{
+	"name":         {},
+	"dn":           {},
+	"display_name": {},
+	"url":          {},
+	"body":         {},
+	"payload":      {},
+	"known-as":     {},
+	"tag":          {},
+	"rule":         {},
+}
+
+// logLevels are the levels of the subsystems, they can only filter the entries accepted by the base logger
+type logLevels map[string]zap.AtomicLevel
+
+func newLogLevels() logLevels {
+	levels := logLevels{}
+	for _, subsystem := range logSubsystems {
+		levels[subsystem] = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	}
+
+	return levels
+}
+
+func (l logLevels) level(subsystem string) zap.AtomicLevel {
+	if level, ok := l[subsystem]; ok {
+		return level
+	}
+
+	return l[logSubsystemService]
+}
+
+// logSubsystem returns the subsystem of a logger from its name, ie. bty.msg.replay
+func logSubsystem(loggerName string) string {
+	parts := strings.Split(loggerName, ".")
+	for i, part := range parts {
+		if part == logRootName && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+
+	return logSubsystemService
+}
+
+// logHash logs a hash of a value which must not be logged as is
+func logHash(key string, value string) zap.Field {
+	return zap.String(key, hashIdentifier(value))
+}
+
+// hashIdentifier returns the hash by which a public key or a token is referenced in the logs and the traces
+func hashIdentifier(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:logGroupHashSize])
+}
+
+// logGroup tags an entry with a hash of the public key of a group
+func logGroup(pk string) zap.Field {
+	return logHash("group-hash", pk)
+}
+
+// logContact tags an entry with a hash of the public key of a contact or a member
+func logContact(pk string) zap.Field {
+	return logHash("contact-hash", pk)
+}
+
+// logPushToken tags an entry with a hash of a push device token, the token itself allows to push to the device
+func logPushToken(token string) zap.Field {
+	return logHash("token-hash", token)
+}
+
+// logCore filters the entries by the level of their subsystem and redacts their fields when enabled
+type logCore struct {
+	zapcore.Core
+	levels logLevels
+	redact bool
+}
+
+func newLogCore(core zapcore.Core, levels logLevels, redact bool) zapcore.Core {
+	return &logCore{Core: core, levels: levels, redact: redact}
+}
+
+func (c *logCore) With(fields []zapcore.Field) zapcore.Core {
+	return &logCore{Core: c.Core.With(c.redactFields(fields)), levels: c.levels, redact: c.redact}
+}
+
+func (c *logCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.level(logSubsystem(ent.LoggerName)).Enabled(ent.Level) {
+		return ce
+	}
+
+	// the wrapped core keeps its own filters, the entry is written through this core so its fields are redacted
+	if c.Core.Check(ent, nil) == nil {
+		return ce
+	}
+
+	return ce.AddCore(ent, c)
+}
+
+func (c *logCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, c.redactFields(fields))
+}
+
+func (c *logCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	if !c.redact {
+		return fields
+	}
+
+	redacted := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		redacted[i] = field
+		if isRedactedLogField(field) {
+			redacted[i] = zap.String(field.Key, logRedacted)
+		}
+	}
+
+	return redacted
+}
+
+func isRedactedLogField(field zapcore.Field) bool {
+	if _, ok := logRedactedKeys[field.Key]; ok {
+		return true
+	}
+
+	switch field.Type {
+	case zapcore.ReflectType, zapcore.StringerType, zapcore.BinaryType, zapcore.ByteStringType, zapcore.ObjectMarshalerType, zapcore.ArrayMarshalerType:
+		return true
+	default:
+		return false
+	}
+}
+
+func (svc *service) LogLevelSet(ctx context.Context, req *messengertypes.LogLevelSet_Request) (*messengertypes.LogLevelSet_Reply, error) {
+	subsystems := logSubsystems
+	if subsystem := req.GetSubsystem(); subsystem != "" {
+		if _, ok := svc.logLevels[subsystem]; !ok {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown log subsystem %q", subsystem))
+		}
+		subsystems = []string{subsystem}
+	}
+
+	// the levels are only listed when no level is given
+	if req.GetLevel() != "" {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(req.GetLevel())); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		for _, subsystem := range subsystems {
+			svc.logLevels[subsystem].SetLevel(level)
+		}
+
+		svc.logger.Info("log level changed", zap.Strings("subsystems", subsystems), zap.String("level", level.String()))
+	}
+
+	reply := &messengertypes.LogLevelSet_Reply{Redacted: svc.redactLogs}
+	for subsystem, level := range svc.logLevels {
+		reply.Levels = append(reply.Levels, &messengertypes.LogLevelSet_Level{Subsystem: subsystem, Level: level.Level().String()})
+	}
+
+	sort.Slice(reply.Levels, func(i, j int) bool { return reply.Levels[i].GetSubsystem() < reply.Levels[j].GetSubsystem() })
+
+	return reply, nil
+}
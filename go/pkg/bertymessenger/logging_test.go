@@ -0,0 +1,88 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_logSubsystem(t *testing.T) {
+	require.Equal(t, logSubsystemService, logSubsystem(""))
+	require.Equal(t, logSubsystemService, logSubsystem("bty.msg"))
+	require.Equal(t, logSubsystemReplay, logSubsystem("bty.msg.replay"))
+	require.Equal(t, "media-dl", logSubsystem("bty.msg.media-dl"))
+	require.Equal(t, logSubsystemService, logSubsystem("bty.gorm"))
+}
+
+func Test_logCore(t *testing.T) {
+	newLogger := func(redact bool) (*zap.Logger, *observer.ObservedLogs, logLevels) {
+		core, logs := observer.New(zapcore.DebugLevel)
+		levels := newLogLevels()
+		logger := zap.New(core).Named(logRootName).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return newLogCore(core, levels, redact)
+		}))
+
+		return logger, logs, levels
+	}
+
+	logger, logs, levels := newLogger(false)
+	levels[logSubsystemReplay].SetLevel(zapcore.WarnLevel)
+
+	logger.Named(logSubsystemReplay).Info("filtered")
+	logger.Named(logSubsystemReplay).Warn("kept")
+	logger.Named(logSubsystemHandler).Debug("kept")
+	require.Equal(t, 2, logs.Len())
+
+	// the group public keys are hashed
+	logger.With(logGroup("group_1")).Info("scoped", zap.String("name", "alice"))
+	entry := logs.All()[2]
+	require.NotContains(t, entry.ContextMap()["group-hash"], "group_1")
+	require.Len(t, entry.ContextMap()["group-hash"], 2*logGroupHashSize)
+	require.Equal(t, hashIdentifier("group_1"), entry.ContextMap()["group-hash"])
+	require.Equal(t, "alice", entry.ContextMap()["name"])
+
+	// the contents are redacted in both the context and the fields of the entries
+	logger, logs, _ = newLogger(true)
+	logger.With(zap.Any("member", &messengertypes.Member{DisplayName: "alice"})).Info("redacted", zap.String("name", "alice"), zap.String("known-as", "alice"), zap.String("cid", "cid_1"), zap.Binary("raw", []byte("secret")))
+	fields := logs.All()[0].ContextMap()
+	require.Equal(t, logRedacted, fields["member"])
+	require.Equal(t, logRedacted, fields["name"])
+	require.Equal(t, logRedacted, fields["known-as"])
+	require.Equal(t, logRedacted, fields["raw"])
+	require.Equal(t, "cid_1", fields["cid"])
+}
+
+func TestLogLevelSet(t *testing.T) {
+	ctx := context.Background()
+	svc := &service{logger: zap.NewNop(), logLevels: newLogLevels(), redactLogs: true}
+
+	reply, err := svc.LogLevelSet(ctx, &messengertypes.LogLevelSet_Request{})
+	require.NoError(t, err)
+	require.Len(t, reply.GetLevels(), len(logSubsystems))
+	require.True(t, reply.GetRedacted())
+	for _, level := range reply.GetLevels() {
+		require.Equal(t, "debug", level.GetLevel())
+	}
+
+	_, err = svc.LogLevelSet(ctx, &messengertypes.LogLevelSet_Request{Subsystem: logSubsystemReplay, Level: "warn"})
+	require.NoError(t, err)
+	require.Equal(t, zapcore.WarnLevel, svc.logLevels[logSubsystemReplay].Level())
+	require.Equal(t, zapcore.DebugLevel, svc.logLevels[logSubsystemHandler].Level())
+
+	_, err = svc.LogLevelSet(ctx, &messengertypes.LogLevelSet_Request{Level: "error"})
+	require.NoError(t, err)
+	require.Equal(t, zapcore.ErrorLevel, svc.logLevels[logSubsystemHandler].Level())
+
+	_, err = svc.LogLevelSet(ctx, &messengertypes.LogLevelSet_Request{Subsystem: "unknown", Level: "info"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.LogLevelSet(ctx, &messengertypes.LogLevelSet_Request{Level: "verbose"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
@@ -0,0 +1,103 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// In low-storage mode the footprint of the messenger on the device is reduced: the medias are only downloaded on
+// demand, the retention keeps only the latest messages of each conversation, the older ones stay readable from the
+// logs with ConversationLoadPruned, and the in-memory caches are shrunk. The messages pruned while the mode is enabled
+// are not stored again once it is disabled.
+
+const (
+	lowStorageDefaultMaxInteractions = 200
+	lowStorageMaxInteractionsLimit   = 100000
+)
+
+// lowStorageMaxInteractions returns the number of messages kept per conversation in low-storage mode
+func lowStorageMaxInteractions(acc *messengertypes.Account) int64 {
+	if n := acc.GetLowStorageMaxInteractions(); n > 0 {
+		return n
+	}
+
+	return lowStorageDefaultMaxInteractions
+}
+
+func (svc *service) LowStorageModeSet(ctx context.Context, req *messengertypes.LowStorageModeSet_Request) (*messengertypes.LowStorageModeSet_Reply, error) {
+	if req.GetMaxInteractions() < 0 || req.GetMaxInteractions() > lowStorageMaxInteractionsLimit {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("max interactions must be between 0 and %d", lowStorageMaxInteractionsLimit))
+	}
+
+	acc, err := func() (*messengertypes.Account, error) {
+		defer svc.writer.enter()()
+
+		acc, err := svc.db.getAccount()
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		return svc.db.setAccountLowStorage(acc.GetPublicKey(), req.GetEnabled(), req.GetMaxInteractions())
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	svc.prefetch.setLowStorage(acc.GetLowStorageEnabled())
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	// the projection is computed before the pruner runs
+	info, err := svc.lowStorageInfo(acc)
+	if err != nil {
+		return nil, err
+	}
+
+	if acc.GetLowStorageEnabled() {
+		svc.triggerRetention()
+	}
+
+	return &messengertypes.LowStorageModeSet_Reply{LowStorage: info}, nil
+}
+
+// lowStorageInfo reports the savings of the low-storage mode, the projection is the size of the messages beyond the
+// latest of each conversation, with their downloaded medias
+func (svc *service) lowStorageInfo(acc *messengertypes.Account) (*messengertypes.SystemInfo_LowStorage, error) {
+	info := &messengertypes.SystemInfo_LowStorage{
+		Enabled:         acc.GetLowStorageEnabled(),
+		MaxInteractions: lowStorageMaxInteractions(acc),
+		ActualSavings:   acc.GetLowStorageSavedSize(),
+	}
+
+	convs, err := svc.db.getAllConversations()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	now := timestampMs(time.Now())
+	for _, conv := range convs {
+		cutoff, err := svc.db.getRetentionCutoff(conv.GetPublicKey(), 0, info.GetMaxInteractions(), now)
+		if err != nil {
+			return nil, err
+		}
+
+		if cutoff <= 0 {
+			continue
+		}
+
+		size, err := svc.db.getPrunableSize(conv.GetPublicKey(), cutoff)
+		if err != nil {
+			return nil, err
+		}
+
+		info.ProjectedSavings += size
+	}
+
+	return info, nil
+}
@@ -0,0 +1,60 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_effectiveRetentionMaxMessages(t *testing.T) {
+	require.Equal(t, int64(0), effectiveRetentionMaxMessages(&messengertypes.Account{}))
+	require.Equal(t, int64(500), effectiveRetentionMaxMessages(&messengertypes.Account{RetentionMaxMessages: 500}))
+	require.Equal(t, int64(lowStorageDefaultMaxInteractions), effectiveRetentionMaxMessages(&messengertypes.Account{RetentionMaxMessages: 500, LowStorageEnabled: true}))
+	require.Equal(t, int64(50), effectiveRetentionMaxMessages(&messengertypes.Account{RetentionMaxMessages: 50, LowStorageEnabled: true, LowStorageMaxInteractions: 100}))
+
+	// the medias are only downloaded on demand
+	mode, _ := resolveMediaDownloadPolicy(&messengertypes.Account{MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeAlways, LowStorageEnabled: true}, &messengertypes.Conversation{MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeAlways})
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeManual, mode)
+}
+
+func Test_service_lowStorageInfo(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", SentDate: 1000, Type: messengertypes.AppMessage_TypeUserMessage, Payload: []byte("0123456789")},
+		{CID: "cid_2", ConversationPublicKey: "conv_1", SentDate: 2000, Type: messengertypes.AppMessage_TypeUserMessage, Payload: []byte("01234")},
+		{CID: "cid_3", ConversationPublicKey: "conv_1", SentDate: 3000, Type: messengertypes.AppMessage_TypeUserMessage, Payload: []byte("0")},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "cid_1", Size_: 100, State: messengertypes.Media_StateDownloaded}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_2", InteractionCID: "cid_2", Size_: 1000, State: messengertypes.Media_StateNeverDownloaded}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	// only the latest message is kept, the older ones and the downloaded medias are saved
+	info, err := svc.lowStorageInfo(&messengertypes.Account{LowStorageMaxInteractions: 1, LowStorageSavedSize: 42})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), info.GetMaxInteractions())
+	require.Equal(t, int64(10+5+100), info.GetProjectedSavings())
+	require.Equal(t, int64(42), info.GetActualSavings())
+}
+
+func Test_prefetchCache_setLowStorage(t *testing.T) {
+	c := newPrefetchCache()
+	for i := 0; i < prefetchPageCacheSize; i++ {
+		c.putPage("conv_1", prefetchPageKey("conv_1", false, string(rune('a'+i)), 10), 0, &messengertypes.InteractionList_Reply{})
+	}
+	c.putMedia("media_1", make([]byte, prefetchLowStorageMediaCacheMaxSize))
+	c.putMedia("media_2", make([]byte, 1024))
+
+	c.setLowStorage(true)
+	require.Equal(t, prefetchLowStoragePageCacheSize, c.pages.Len())
+	require.Nil(t, c.media("media_1"))
+	require.NotNil(t, c.media("media_2"))
+}
@@ -0,0 +1,18 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// interactionClock returns the version of the update carried by an interaction, the group profile, the member
+// profiles and the member roles keep the update with the greatest version.
+//
+// The lamport clock of the group log orders the causally related updates, the member public key of the sender then
+// the cid break the ties between concurrent ones. The versions are compared as strings, the lamport clock is padded
+// so that the lexicographical order matches the numerical one. Since the winner doesn't depend on the order in which
+// the events are handled, the replay and the live processing converge to the same state on every device.
+func interactionClock(i *messengertypes.Interaction) string {
+	return fmt.Sprintf("%020d/%s/%s", i.GetLamportTime(), interactionSenderMemberPK(i), i.GetCID())
+}
@@ -0,0 +1,173 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testClock(lamport uint64) string {
+	return interactionClock(&messengertypes.Interaction{LamportTime: lamport, MemberPublicKey: "member_creator", CID: fmt.Sprintf("cid_%d", lamport)})
+}
+
+func Test_interactionClock(t *testing.T) {
+	// the lamport clock is compared numerically
+	require.True(t, testClock(9) < testClock(10))
+	require.True(t, "" < testClock(0))
+
+	// then the member public key, then the cid
+	require.True(t, interactionClock(&messengertypes.Interaction{LamportTime: 3, MemberPublicKey: "member_a", CID: "cid_b"}) <
+		interactionClock(&messengertypes.Interaction{LamportTime: 3, MemberPublicKey: "member_b", CID: "cid_a"}))
+	require.True(t, interactionClock(&messengertypes.Interaction{LamportTime: 3, MemberPublicKey: "member_a", CID: "cid_a"}) <
+		interactionClock(&messengertypes.Interaction{LamportTime: 3, MemberPublicKey: "member_a", CID: "cid_b"}))
+
+	// the messages of the account are versioned with its member public key
+	conv := &messengertypes.Conversation{AccountMemberPublicKey: "member_me"}
+	require.Equal(t, interactionClock(&messengertypes.Interaction{LamportTime: 1, MemberPublicKey: "member_me", CID: "cid_1"}),
+		interactionClock(&messengertypes.Interaction{LamportTime: 1, IsMe: true, Conversation: conv, CID: "cid_1"}))
+}
+
+type lwwTestEvent struct {
+	interaction *messengertypes.Interaction
+	payload     interface{}
+}
+
+var (
+	lwwTestCreators = []string{"member_a", "member_b"}
+	// member_c is a regular member, its moderation messages only apply while it is an admin
+	lwwTestWriters = []string{"member_a", "member_b", "member_c"}
+	lwwTestTargets = []string{"member_c", "member_target"}
+)
+
+// randomLWWTestEvents generates group profile, member role, member removal, posting restriction and member profile
+// updates, the lamport clocks are drawn from a small range so that many of them are concurrent
+func randomLWWTestEvents(r *rand.Rand, conv *messengertypes.Conversation) []lwwTestEvent {
+	events := make([]lwwTestEvent, 5+r.Intn(15))
+	for idx := range events {
+		i := &messengertypes.Interaction{
+			CID:                   fmt.Sprintf("cid_%d", idx),
+			ConversationPublicKey: conv.GetPublicKey(),
+			Conversation:          conv,
+			MemberPublicKey:       lwwTestWriters[r.Intn(len(lwwTestWriters))],
+			LamportTime:           uint64(r.Intn(4)),
+			// the sent dates aren't synchronized between the devices
+			SentDate: r.Int63n(1000),
+		}
+
+		var payload interface{}
+		switch r.Intn(5) {
+		case 0:
+			i.Type = messengertypes.AppMessage_TypeSetGroupInfo
+			payload = &messengertypes.AppMessage_SetGroupInfo{DisplayName: fmt.Sprintf("name_%d", idx), Topic: fmt.Sprintf("topic_%d", idx)}
+		case 1:
+			i.Type = messengertypes.AppMessage_TypeSetMemberRole
+			payload = &messengertypes.AppMessage_SetMemberRole{MemberPublicKey: lwwTestTargets[r.Intn(len(lwwTestTargets))], Role: messengertypes.Member_Role(r.Intn(2))}
+		case 2:
+			i.Type = messengertypes.AppMessage_TypeSetUserInfo
+			payload = &messengertypes.AppMessage_SetUserInfo{DisplayName: fmt.Sprintf("user_%d", idx), AvatarCID: fmt.Sprintf("avatar_%d", idx)}
+		case 3:
+			i.Type = messengertypes.AppMessage_TypeRemoveMember
+			payload = &messengertypes.AppMessage_RemoveMember{MemberPublicKey: lwwTestTargets[r.Intn(len(lwwTestTargets))]}
+		case 4:
+			i.Type = messengertypes.AppMessage_TypeSetPostingRestricted
+			payload = &messengertypes.AppMessage_SetPostingRestricted{Restricted: r.Intn(2) == 0}
+		}
+
+		events[idx] = lwwTestEvent{interaction: i, payload: payload}
+	}
+
+	return events
+}
+
+// applyLWWTestEvents handles the events in the given order on a new database and returns the resulting state
+func applyLWWTestEvents(t *testing.T, conv *messengertypes.Conversation, events []lwwTestEvent, order []int) []string {
+	t.Helper()
+
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(conv).Error)
+	for _, creator := range lwwTestCreators {
+		_, err := db.addMember(creator, conv.GetPublicKey(), creator, "", false, true)
+		require.NoError(t, err)
+	}
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+	for _, idx := range order {
+		i, err := events[idx].interaction, error(nil)
+		switch payload := events[idx].payload.(type) {
+		case *messengertypes.AppMessage_SetGroupInfo:
+			_, _, err = h.handleAppMessageSetGroupInfo(db, i, payload)
+		case *messengertypes.AppMessage_SetMemberRole:
+			_, _, err = h.handleAppMessageSetMemberRole(db, i, payload)
+		case *messengertypes.AppMessage_SetUserInfo:
+			_, _, err = h.handleAppMessageSetUserInfo(db, i, payload)
+		case *messengertypes.AppMessage_RemoveMember:
+			_, _, err = h.handleAppMessageRemoveMember(db, i, payload)
+		case *messengertypes.AppMessage_SetPostingRestricted:
+			_, _, err = h.handleAppMessageSetPostingRestricted(db, i, payload)
+		}
+		require.NoError(t, err)
+	}
+
+	c, err := db.getConversationByPK(conv.GetPublicKey())
+	require.NoError(t, err)
+
+	members, err := db.getMembersByConversation(conv.GetPublicKey())
+	require.NoError(t, err)
+
+	state := []string{fmt.Sprintf("%s %s %s %s", c.GetDisplayName(), c.GetTopic(), c.GetInfoClock(), c.GetPostingRestrictedClock())}
+	for _, m := range members {
+		state = append(state, fmt.Sprintf("%s %s %s %s %s %s", m.GetPublicKey(), m.GetDisplayName(), m.GetAvatarCID(), m.GetRole(), m.GetRoleClock(), m.GetRemovedClock()))
+	}
+
+	// the members are listed in their creation order, which depends on the order of the events
+	sort.Strings(state[1:])
+
+	return state
+}
+
+// Test_lwwConvergence checks that handling the same metadata updates in any order leads to the same state
+func Test_lwwConvergence(t *testing.T) {
+	property := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		conv := &messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"}
+		events := randomLWWTestEvents(r, conv)
+
+		order := make([]int, len(events))
+		for idx := range order {
+			order[idx] = idx
+		}
+		expected := applyLWWTestEvents(t, conv, events, order)
+
+		for n := 0; n < 4; n++ {
+			r.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+			if state := applyLWWTestEvents(t, conv, events, order); !assertLWWStateEqual(t, expected, state, seed) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 25, Rand: rand.New(rand.NewSource(42))}))
+}
+
+func assertLWWStateEqual(t *testing.T, expected, actual []string, seed int64) bool {
+	t.Helper()
+
+	if fmt.Sprint(expected) == fmt.Sprint(actual) {
+		return true
+	}
+
+	t.Logf("seed %d diverged:\nexpected %q\nactual   %q", seed, expected, actual)
+	return false
+}
@@ -0,0 +1,237 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	// defaultMaintenanceInterval is the delay between two scheduled maintenances of the database
+	defaultMaintenanceInterval = 7 * 24 * time.Hour
+	// maintenanceCheckInterval is the delay between two checks of the maintenance window
+	maintenanceCheckInterval = 15 * time.Minute
+)
+
+// maintenanceSteps are the steps of a maintenance run, in their order
+var maintenanceSteps = []messengertypes.MaintenanceRun_Step{
+	messengertypes.MaintenanceRun_StepReindex,
+	messengertypes.MaintenanceRun_StepVacuum,
+	messengertypes.MaintenanceRun_StepAnalyze,
+}
+
+// MaintenanceOpts schedules the maintenance of the database, it runs at most once per interval during an idle window
+type MaintenanceOpts struct {
+	// Disabled only runs the maintenance on the request of MaintenanceRun
+	Disabled bool
+	// Interval is the minimum delay between two scheduled runs, defaultMaintenanceInterval is used if 0
+	Interval time.Duration
+	// WindowStart and WindowEnd are the local hours between which a scheduled run can start, ie. 2 and 5, the window
+	// wraps around midnight when WindowEnd is before WindowStart, the runs can start at any hour when they are equal
+	WindowStart int
+	WindowEnd   int
+	// InactiveOnly only starts the scheduled runs while the application is inactive, ie. in background
+	InactiveOnly bool
+}
+
+func (opts *MaintenanceOpts) applyDefaults() error {
+	if opts.Interval == 0 {
+		opts.Interval = defaultMaintenanceInterval
+	} else if opts.Interval < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the maintenance interval can't be negative"))
+	}
+
+	if opts.WindowStart < 0 || opts.WindowStart > 23 || opts.WindowEnd < 0 || opts.WindowEnd > 23 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the maintenance window must be between 0 and 23 hours"))
+	}
+
+	return nil
+}
+
+// inWindow returns whether a scheduled run can start at t
+func (opts MaintenanceOpts) inWindow(t time.Time) bool {
+	hour := t.Hour()
+
+	switch {
+	case opts.WindowStart == opts.WindowEnd:
+		return true
+	case opts.WindowStart < opts.WindowEnd:
+		return hour >= opts.WindowStart && hour < opts.WindowEnd
+	default:
+		return hour >= opts.WindowStart || hour < opts.WindowEnd
+	}
+}
+
+// maintenanceStats describes the runs of the maintenance since the messenger started
+type maintenanceStats struct {
+	mu    sync.Mutex
+	stats messengertypes.SystemInfo_Maintenance
+}
+
+func (s *maintenanceStats) ran(reply *messengertypes.MaintenanceRun_Reply, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Runs++
+	s.stats.LastRunDate = timestampMs(now)
+	s.stats.LastDuration = reply.GetDuration()
+	s.stats.LastReclaimedSize = reply.GetReclaimedSize()
+	s.stats.LastError = ""
+	if err != nil {
+		s.stats.LastError = err.Error()
+	}
+}
+
+func (s *maintenanceStats) scheduled(next int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.NextRunDate = next
+}
+
+func (s *maintenanceStats) snapshot() *messengertypes.SystemInfo_Maintenance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	return &stats
+}
+
+// monitorMaintenance runs the scheduled maintenance once its interval is over, during the idle window
+func (svc *service) monitorMaintenance(ctx context.Context) {
+	if svc.maintenanceOpts.Disabled {
+		return
+	}
+
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if due, err := svc.isMaintenanceDue(time.Now()); err != nil {
+			svc.logger.Error("unable to check the maintenance schedule", zap.Error(err))
+		} else if due {
+			if _, err := svc.runMaintenance(ctx, maintenanceSteps); err != nil {
+				svc.logger.Error("unable to maintain the database", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isMaintenanceDue checks the interval since the last run and the idle window, the last run is stored with the account
+// so the interval is kept across the restarts
+func (svc *service) isMaintenanceDue(now time.Time) (bool, error) {
+	account, err := svc.db.getAccount()
+	if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	next := account.GetLastMaintenanceDate() + svc.maintenanceOpts.Interval.Milliseconds()
+	svc.maintenanceStats.scheduled(next)
+
+	if timestampMs(now) < next || !svc.maintenanceOpts.inWindow(now) {
+		return false, nil
+	}
+
+	if svc.maintenanceOpts.InactiveOnly && svc.lcmanager.GetCurrentState() != StateInactive {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// runMaintenance runs the steps supported by the storage backend while the events are not handled, the statements
+// can't run in a transaction
+func (svc *service) runMaintenance(ctx context.Context, steps []messengertypes.MaintenanceRun_Step) (*messengertypes.MaintenanceRun_Reply, error) {
+	defer svc.writer.enter()()
+
+	start := time.Now()
+	reply := &messengertypes.MaintenanceRun_Reply{}
+
+	err := func() error {
+		backend := svc.db.backend()
+
+		sizeBefore, err := backend.getDatabaseSize(svc.db.db)
+		if err != nil {
+			return err
+		}
+		reply.SizeBefore = sizeBefore
+
+		for _, step := range steps {
+			statement := backend.maintenanceStatement(step)
+			if statement == "" {
+				continue
+			}
+
+			stepStart := time.Now()
+			if err := svc.db.db.WithContext(ctx).Exec(statement).Error; err != nil {
+				return errcode.ErrDBWrite.Wrap(fmt.Errorf("%s: %w", step, err))
+			}
+
+			svc.logger.Debug("maintenance step done", zap.String("step", step.String()), zap.Duration("duration", time.Since(stepStart)))
+			reply.Steps = append(reply.Steps, step)
+		}
+
+		sizeAfter, err := backend.getDatabaseSize(svc.db.db)
+		if err != nil {
+			return err
+		}
+		reply.SizeAfter = sizeAfter
+
+		if sizeAfter < sizeBefore {
+			reply.ReclaimedSize = sizeBefore - sizeAfter
+		}
+
+		account, err := svc.db.getAccount()
+		if err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+
+		return svc.db.setAccountLastMaintenanceDate(account.GetPublicKey(), timestampMs(start))
+	}()
+
+	reply.Duration = time.Since(start).Milliseconds()
+	svc.maintenanceStats.ran(reply, err, start)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("database maintained", zap.Int64("duration", reply.GetDuration()), zap.Int64("reclaimed-size", reply.GetReclaimedSize()))
+
+	return reply, nil
+}
+
+func (svc *service) MaintenanceRun(ctx context.Context, req *messengertypes.MaintenanceRun_Request) (*messengertypes.MaintenanceRun_Reply, error) {
+	steps := maintenanceSteps
+	if len(req.GetSteps()) > 0 {
+		requested := map[messengertypes.MaintenanceRun_Step]bool{}
+		for _, step := range req.GetSteps() {
+			if _, ok := messengertypes.MaintenanceRun_Step_name[int32(step)]; !ok || step == messengertypes.MaintenanceRun_StepUnknown {
+				return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown maintenance step %d", step))
+			}
+
+			requested[step] = true
+		}
+
+		// the steps are run in their order whatever the order of the request
+		steps = nil
+		for _, step := range maintenanceSteps {
+			if requested[step] {
+				steps = append(steps, step)
+			}
+		}
+	}
+
+	return svc.runMaintenance(ctx, steps)
+}
@@ -0,0 +1,83 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestMaintenanceOpts_inWindow(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2021, 3, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	opts := MaintenanceOpts{}
+	require.NoError(t, opts.applyDefaults())
+	require.Equal(t, defaultMaintenanceInterval, opts.Interval)
+	require.True(t, opts.inWindow(at(14)))
+
+	opts = MaintenanceOpts{WindowStart: 2, WindowEnd: 5}
+	require.True(t, opts.inWindow(at(2)))
+	require.True(t, opts.inWindow(at(4)))
+	require.False(t, opts.inWindow(at(5)))
+	require.False(t, opts.inWindow(at(1)))
+
+	// the window wraps around midnight
+	opts = MaintenanceOpts{WindowStart: 22, WindowEnd: 3}
+	require.True(t, opts.inWindow(at(23)))
+	require.True(t, opts.inWindow(at(0)))
+	require.False(t, opts.inWindow(at(3)))
+	require.False(t, opts.inWindow(at(12)))
+
+	require.Error(t, (&MaintenanceOpts{WindowStart: 24}).applyDefaults())
+	require.Error(t, (&MaintenanceOpts{Interval: -time.Hour}).applyDefaults())
+}
+
+func Test_service_MaintenanceRun(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("account_1", "link"))
+
+	opts := MaintenanceOpts{}
+	require.NoError(t, opts.applyDefaults())
+	svc := &service{db: db, logger: zap.NewNop(), maintenanceOpts: opts}
+
+	now := time.Now()
+	due, err := svc.isMaintenanceDue(now)
+	require.NoError(t, err)
+	require.True(t, due)
+
+	_, err = svc.MaintenanceRun(context.Background(), &messengertypes.MaintenanceRun_Request{Steps: []messengertypes.MaintenanceRun_Step{42}})
+	require.Error(t, err)
+
+	reply, err := svc.MaintenanceRun(context.Background(), &messengertypes.MaintenanceRun_Request{Steps: []messengertypes.MaintenanceRun_Step{
+		messengertypes.MaintenanceRun_StepAnalyze,
+		messengertypes.MaintenanceRun_StepReindex,
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []messengertypes.MaintenanceRun_Step{messengertypes.MaintenanceRun_StepReindex, messengertypes.MaintenanceRun_StepAnalyze}, reply.GetSteps())
+
+	reply, err = svc.MaintenanceRun(context.Background(), &messengertypes.MaintenanceRun_Request{})
+	require.NoError(t, err)
+	require.Len(t, reply.GetSteps(), 3)
+	require.NotZero(t, reply.GetSizeAfter())
+
+	// the next scheduled run waits for the interval
+	due, err = svc.isMaintenanceDue(now.Add(time.Hour))
+	require.NoError(t, err)
+	require.False(t, due)
+
+	due, err = svc.isMaintenanceDue(now.Add(opts.Interval + time.Hour))
+	require.NoError(t, err)
+	require.True(t, due)
+
+	stats := svc.maintenanceStats.snapshot()
+	require.Equal(t, int64(2), stats.GetRuns())
+	require.Empty(t, stats.GetLastError())
+}
@@ -0,0 +1,493 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	matrixDefaultBotLocalpart = "berty"
+	matrixDefaultGhostPrefix  = "berty_"
+	matrixRelayTimeout        = 2 * time.Minute
+)
+
+// MatrixBridgeOpts configures the Matrix application service relaying the linked conversations, the homeserver must
+// be configured with a registration using the same tokens, the bot localpart and a user namespace matching the ghosts
+type MatrixBridgeOpts struct {
+	// HomeserverURL is the base URL of the client-server API, ie. https://matrix.example.org
+	HomeserverURL string
+	// ServerName is the domain of the Matrix user ids, ie. example.org
+	ServerName string
+	// ASToken authenticates the bridge to the homeserver
+	ASToken string
+	// HSToken authenticates the homeserver to the bridge
+	HSToken string
+	// ListenAddr is the address of the application service API called by the homeserver
+	ListenAddr string
+	// BotLocalpart is the sender_localpart of the registration, "berty" if empty
+	BotLocalpart string
+	// GhostPrefix prefixes the localpart of the ghost users, "berty_" if empty
+	GhostPrefix string
+	// HTTPClient is used to call the homeserver, http.DefaultClient is used if nil
+	HTTPClient *http.Client
+}
+
+type matrixBridge struct {
+	svc    *service
+	opts   MatrixBridgeOpts
+	client *matrixClient
+	server *http.Server
+	logger *zap.Logger
+}
+
+type matrixRoomEvent struct {
+	Type    string          `json:"type"`
+	RoomID  string          `json:"room_id"`
+	Sender  string          `json:"sender"`
+	EventID string          `json:"event_id"`
+	Content json.RawMessage `json:"content"`
+}
+
+type matrixMessageContent struct {
+	MsgType string             `json:"msgtype"`
+	Body    string             `json:"body"`
+	URL     string             `json:"url,omitempty"`
+	Info    *matrixContentInfo `json:"info,omitempty"`
+}
+
+type matrixContentInfo struct {
+	MimeType string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+func newMatrixBridge(svc *service, opts MatrixBridgeOpts) (*matrixBridge, error) {
+	if opts.HomeserverURL == "" || opts.ServerName == "" || opts.ASToken == "" || opts.HSToken == "" || opts.ListenAddr == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the homeserver url, server name, tokens and listen address of the matrix bridge are required"))
+	}
+
+	if opts.BotLocalpart == "" {
+		opts.BotLocalpart = matrixDefaultBotLocalpart
+	}
+	if opts.GhostPrefix == "" {
+		opts.GhostPrefix = matrixDefaultGhostPrefix
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+
+	b := &matrixBridge{
+		svc:    svc,
+		opts:   opts,
+		client: &matrixClient{homeserver: opts.HomeserverURL, asToken: opts.ASToken, httpClient: opts.HTTPClient},
+		logger: svc.logger.Named("matrix"),
+	}
+	b.server = &http.Server{Handler: b}
+
+	return b, nil
+}
+
+func (b *matrixBridge) start() error {
+	l, err := net.Listen("tcp", b.opts.ListenAddr)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	go func() {
+		if err := b.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			b.logger.Error("matrix application service stopped", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (b *matrixBridge) close() {
+	if err := b.server.Close(); err != nil {
+		b.logger.Warn("unable to close matrix application service", zap.Error(err))
+	}
+}
+
+func (b *matrixBridge) botUserID() string {
+	return "@" + b.opts.BotLocalpart + ":" + b.opts.ServerName
+}
+
+func (b *matrixBridge) ghostUserID(memberPK string) string {
+	hash := sha256.Sum256([]byte(memberPK))
+	return "@" + b.opts.GhostPrefix + hex.EncodeToString(hash[:12]) + ":" + b.opts.ServerName
+}
+
+// isBridgeUser checks if a Matrix user is managed by the bridge, their messages are the relayed ones
+func (b *matrixBridge) isBridgeUser(userID string) bool {
+	return userID == b.botUserID() ||
+		(strings.HasPrefix(userID, "@"+b.opts.GhostPrefix) && strings.HasSuffix(userID, ":"+b.opts.ServerName))
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(&matrixError{ErrCode: code, Message: message})
+}
+
+// ServeHTTP implements the application service API called by the homeserver
+func (b *matrixBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(b.opts.HSToken)) != 1 {
+		writeMatrixError(w, http.StatusForbidden, "M_FORBIDDEN", "invalid homeserver token")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1")
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/transactions/"):
+		b.handleTransaction(w, r)
+	case r.Method == http.MethodGet && (strings.HasPrefix(path, "/users/") || strings.HasPrefix(path, "/rooms/")):
+		// the ghosts and the rooms are only created by the bridge
+		writeMatrixError(w, http.StatusNotFound, "M_NOT_FOUND", "not found")
+	default:
+		writeMatrixError(w, http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized request")
+	}
+}
+
+func (b *matrixBridge) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	txn := struct {
+		Events []*matrixRoomEvent `json:"events"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeMatrixError(w, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+
+	for _, evt := range txn.Events {
+		if err := b.handleMatrixEvent(r.Context(), evt); err != nil {
+			b.logger.Error("unable to relay matrix event", zap.String("event-id", evt.EventID), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte("{}"))
+}
+
+// handleMatrixEvent relays a message of a linked room to its conversation, the homeserver retries the transactions
+// so the relayed events are recorded and skipped afterwards
+func (b *matrixBridge) handleMatrixEvent(ctx context.Context, evt *matrixRoomEvent) error {
+	if evt.Type != "m.room.message" || b.isBridgeUser(evt.Sender) {
+		return nil
+	}
+
+	room, err := b.svc.db.getMatrixRoomByRoomID(evt.RoomID)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	content := &matrixMessageContent{}
+	if err := json.Unmarshal(evt.Content, content); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	added, err := b.svc.db.addMatrixEvent(&messengertypes.MatrixEvent{
+		EventID:               evt.EventID,
+		ConversationPublicKey: room.GetConversationPublicKey(),
+		Incoming:              true,
+	})
+	if err != nil || !added {
+		return err
+	}
+
+	name, err := b.client.getDisplayName(ctx, evt.Sender)
+	if err != nil || name == "" {
+		name = evt.Sender
+	}
+
+	var (
+		body      string
+		mediaCIDs []string
+	)
+	switch content.MsgType {
+	case "m.text", "m.notice":
+		body = name + ": " + content.Body
+	case "m.emote":
+		body = "* " + name + " " + content.Body
+	case "m.image", "m.file", "m.audio", "m.video":
+		cid, err := b.importMatrixMedia(ctx, content)
+		if err != nil {
+			return err
+		}
+		body = name + ": " + content.Body
+		mediaCIDs = []string{cid}
+	default:
+		return nil
+	}
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: body})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	_, err = b.svc.Interact(ctx, &messengertypes.Interact_Request{
+		Type:                  messengertypes.AppMessage_TypeUserMessage,
+		Payload:               payload,
+		ConversationPublicKey: room.GetConversationPublicKey(),
+		MediaCids:             mediaCIDs,
+	})
+	return err
+}
+
+// importMatrixMedia downloads the file of a message and prepares it as a Berty attachment
+func (b *matrixBridge) importMatrixMedia(ctx context.Context, content *matrixMessageContent) (string, error) {
+	file, contentType, err := b.client.downloadMedia(ctx, content.URL)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	counter := &countingReader{reader: file}
+	cidBytes, err := b.svc.attachmentPrepare(counter)
+	if err != nil {
+		return "", errcode.ErrAttachmentPrepare.Wrap(err)
+	}
+
+	media := &messengertypes.Media{
+		CID:         b64EncodeBytes(cidBytes),
+		MimeType:    contentType,
+		Filename:    content.Body,
+		DisplayName: content.Body,
+		Size_:       counter.count,
+		State:       messengertypes.Media_StatePrepared,
+	}
+	if content.Info != nil && content.Info.MimeType != "" {
+		media.MimeType = content.Info.MimeType
+	}
+
+	defer b.svc.writer.enter()()
+
+	if _, err := b.svc.db.addMedias([]*messengertypes.Media{media}); err != nil {
+		return "", errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return media.GetCID(), nil
+}
+
+// relayInteraction sends a message of a linked conversation to its room, as the ghost of its sender. The messages of
+// the account are not relayed, they include the ones relayed from Matrix
+func (b *matrixBridge) relayInteraction(tx *dbWrapper, i *messengertypes.Interaction, body string) error {
+	if i.GetIsMe() {
+		return nil
+	}
+
+	room, err := tx.getMatrixRoom(i.GetConversationPublicKey())
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	// the sender of the contact conversations is the contact
+	senderPK, displayName := i.GetMemberPublicKey(), ""
+	if member, err := tx.getMemberByPK(senderPK, i.GetConversationPublicKey()); err == nil {
+		displayName = member.GetDisplayName()
+	} else if conv := i.GetConversation(); conv.GetType() == messengertypes.Conversation_ContactType {
+		senderPK, displayName = conv.GetContactPublicKey(), conv.GetDisplayName()
+	}
+
+	if senderPK == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown sender"))
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(b.svc.ctx, matrixRelayTimeout)
+		defer cancel()
+
+		if err := b.sendToMatrix(ctx, room, i, senderPK, displayName, body); err != nil {
+			b.logger.Error("unable to relay message to matrix", zap.String("cid", i.GetCID()), zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (b *matrixBridge) sendToMatrix(ctx context.Context, room *messengertypes.MatrixRoom, i *messengertypes.Interaction, senderPK string, displayName string, body string) error {
+	relayed, err := b.svc.db.isMatrixInteractionRelayed(i.GetCID())
+	if err != nil || relayed {
+		return err
+	}
+
+	ghost, err := b.ensureGhost(ctx, senderPK, displayName)
+	if err != nil {
+		return err
+	}
+
+	if err := b.client.joinRoom(ctx, room.GetRoomID(), ghost.GetUserID()); err != nil {
+		return err
+	}
+
+	contents := []*matrixMessageContent(nil)
+	if body != "" {
+		contents = append(contents, &matrixMessageContent{MsgType: "m.text", Body: body})
+	}
+
+	for _, media := range i.GetMedias() {
+		content, err := b.exportMedia(ctx, ghost.GetUserID(), media)
+		if err != nil {
+			b.logger.Warn("unable to relay media to matrix", zap.String("cid", media.GetCID()), zap.Error(err))
+			continue
+		}
+		contents = append(contents, content)
+	}
+
+	for idx, content := range contents {
+		// the transaction id makes the retries idempotent
+		eventID, err := b.client.sendMessage(ctx, room.GetRoomID(), ghost.GetUserID(), fmt.Sprintf("%s.%d", i.GetCID(), idx), content)
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.svc.db.addMatrixEvent(&messengertypes.MatrixEvent{
+			EventID:               eventID,
+			CID:                   i.GetCID(),
+			ConversationPublicKey: room.GetConversationPublicKey(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *matrixBridge) exportMedia(ctx context.Context, userID string, media *messengertypes.Media) (*matrixMessageContent, error) {
+	file, err := b.svc.mediaContentRetrieve(media)
+	if err != nil {
+		return nil, errcode.ErrAttachmentRetrieve.Wrap(err)
+	}
+	defer file.Close()
+
+	mxc, err := b.client.uploadMedia(ctx, userID, media.GetMimeType(), media.GetFilename(), file)
+	if err != nil {
+		return nil, err
+	}
+
+	msgType := "m.file"
+	switch {
+	case strings.HasPrefix(media.GetMimeType(), "image/"):
+		msgType = "m.image"
+	case strings.HasPrefix(media.GetMimeType(), "video/"):
+		msgType = "m.video"
+	case strings.HasPrefix(media.GetMimeType(), "audio/"):
+		msgType = "m.audio"
+	}
+
+	return &matrixMessageContent{
+		MsgType: msgType,
+		Body:    media.GetFilename(),
+		URL:     mxc,
+		Info:    &matrixContentInfo{MimeType: media.GetMimeType(), Size: media.GetSize_()},
+	}, nil
+}
+
+// ensureGhost registers the Matrix user of a member and keeps its display name up to date
+func (b *matrixBridge) ensureGhost(ctx context.Context, memberPK string, displayName string) (*messengertypes.MatrixGhost, error) {
+	ghost, err := b.svc.db.getMatrixGhost(memberPK)
+	if err == gorm.ErrRecordNotFound {
+		ghost = &messengertypes.MatrixGhost{MemberPublicKey: memberPK, UserID: b.ghostUserID(memberPK)}
+
+		localpart := strings.TrimPrefix(strings.TrimSuffix(ghost.GetUserID(), ":"+b.opts.ServerName), "@")
+		if err := b.client.registerGhost(ctx, localpart); err != nil {
+			return nil, err
+		}
+
+		if err := b.svc.db.addMatrixGhost(ghost); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if displayName != "" && displayName != ghost.GetDisplayName() {
+		if err := b.client.setDisplayName(ctx, ghost.GetUserID(), displayName); err != nil {
+			return nil, err
+		}
+
+		if err := b.svc.db.setMatrixGhostDisplayName(memberPK, displayName); err != nil {
+			return nil, err
+		}
+		ghost.DisplayName = displayName
+	}
+
+	return ghost, nil
+}
+
+func (svc *service) MatrixBridgeLink(ctx context.Context, req *messengertypes.MatrixBridgeLink_Request) (*messengertypes.MatrixBridgeLink_Reply, error) {
+	if svc.matrixBridge == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the matrix bridge is not enabled"))
+	}
+
+	if req.GetConversationPublicKey() == "" || req.GetRoomID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if err := svc.matrixBridge.client.joinRoom(ctx, req.GetRoomID(), ""); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	room := &messengertypes.MatrixRoom{
+		ConversationPublicKey: req.GetConversationPublicKey(),
+		RoomID:                req.GetRoomID(),
+		LinkedDate:            timestampMs(time.Now()),
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.addMatrixRoom(room); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MatrixBridgeLink_Reply{Room: room}, nil
+}
+
+func (svc *service) MatrixBridgeUnlink(ctx context.Context, req *messengertypes.MatrixBridgeUnlink_Request) (*messengertypes.MatrixBridgeUnlink_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.deleteMatrixRoom(req.GetConversationPublicKey()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MatrixBridgeUnlink_Reply{}, nil
+}
+
+func (svc *service) MatrixBridgeList(ctx context.Context, req *messengertypes.MatrixBridgeList_Request) (*messengertypes.MatrixBridgeList_Reply, error) {
+	rooms, err := svc.db.getMatrixRooms()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MatrixBridgeList_Reply{Rooms: rooms}, nil
+}
@@ -0,0 +1,162 @@
+package bertymessenger
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testMatrixBridge(t *testing.T, homeserver string) *matrixBridge {
+	t.Helper()
+
+	bridge, err := newMatrixBridge(&service{logger: zap.NewNop()}, MatrixBridgeOpts{
+		HomeserverURL: homeserver,
+		ServerName:    "example.org",
+		ASToken:       "as_token",
+		HSToken:       "hs_token",
+		ListenAddr:    "127.0.0.1:0",
+	})
+	require.NoError(t, err)
+
+	return bridge
+}
+
+func Test_newMatrixBridge(t *testing.T) {
+	_, err := newMatrixBridge(&service{logger: zap.NewNop()}, MatrixBridgeOpts{HomeserverURL: "http://localhost"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	bridge := testMatrixBridge(t, "http://localhost")
+	require.Equal(t, "@berty:example.org", bridge.botUserID())
+
+	ghost := bridge.ghostUserID("member_1")
+	require.True(t, strings.HasPrefix(ghost, "@berty_"))
+	require.Equal(t, ghost, bridge.ghostUserID("member_1"))
+	require.NotEqual(t, ghost, bridge.ghostUserID("member_2"))
+
+	require.True(t, bridge.isBridgeUser(ghost))
+	require.True(t, bridge.isBridgeUser("@berty:example.org"))
+	require.False(t, bridge.isBridgeUser("@alice:example.org"))
+	require.False(t, bridge.isBridgeUser("@berty_1:other.org"))
+}
+
+func Test_matrixBridge_ServeHTTP(t *testing.T) {
+	bridge := testMatrixBridge(t, "http://localhost")
+
+	req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/1", strings.NewReader(`{"events":[]}`))
+	rec := httptest.NewRecorder()
+	bridge.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	req = httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/1?access_token=hs_token", strings.NewReader(`{"events":[]}`))
+	rec = httptest.NewRecorder()
+	bridge.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "{}", rec.Body.String())
+
+	req = httptest.NewRequest(http.MethodGet, "/_matrix/app/v1/users/@alice:example.org", nil)
+	req.Header.Set("Authorization", "Bearer hs_token")
+	rec = httptest.NewRecorder()
+	bridge.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func Test_matrixClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer as_token", r.Header.Get("Authorization"))
+
+		switch {
+		case r.URL.Path == "/_matrix/client/r0/register":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"errcode":"M_USER_IN_USE","error":"taken"}`))
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/r0/rooms/!room:example.org/send/m.room.message/"):
+			require.Equal(t, "@berty_1:example.org", r.URL.Query().Get("user_id"))
+			content := &matrixMessageContent{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(content))
+			require.Equal(t, "hello", content.Body)
+			_, _ = w.Write([]byte(`{"event_id":"$event_1"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"forbidden"}`))
+		}
+	}))
+	defer server.Close()
+
+	client := testMatrixBridge(t, server.URL).client
+	ctx := context.Background()
+
+	require.NoError(t, client.registerGhost(ctx, "berty_1"))
+
+	eventID, err := client.sendMessage(ctx, "!room:example.org", "@berty_1:example.org", "cid.0", &matrixMessageContent{MsgType: "m.text", Body: "hello"})
+	require.NoError(t, err)
+	require.Equal(t, "$event_1", eventID)
+
+	err = client.joinRoom(ctx, "!other:example.org", "")
+	mErr, ok := err.(*matrixError)
+	require.True(t, ok)
+	require.Equal(t, "M_FORBIDDEN", mErr.ErrCode)
+
+	_, _, err = client.downloadMedia(ctx, "https://example.org/file")
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
+
+func Test_dbWrapper_matrixBridge(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.addMatrixRoom(&messengertypes.MatrixRoom{RoomID: "!room_1:example.org"}))
+	require.NoError(t, db.addMatrixRoom(&messengertypes.MatrixRoom{ConversationPublicKey: "conv_1", RoomID: "!room_1:example.org", LinkedDate: 1}))
+	require.NoError(t, db.addMatrixRoom(&messengertypes.MatrixRoom{ConversationPublicKey: "conv_2", RoomID: "!room_2:example.org", LinkedDate: 2}))
+
+	// a room is linked to a single conversation
+	require.True(t, errcode.Is(db.addMatrixRoom(&messengertypes.MatrixRoom{ConversationPublicKey: "conv_2", RoomID: "!room_1:example.org"}), errcode.ErrInvalidInput))
+
+	// relinking a conversation replaces its room
+	require.NoError(t, db.addMatrixRoom(&messengertypes.MatrixRoom{ConversationPublicKey: "conv_2", RoomID: "!room_3:example.org", LinkedDate: 3}))
+
+	room, err := db.getMatrixRoomByRoomID("!room_3:example.org")
+	require.NoError(t, err)
+	require.Equal(t, "conv_2", room.GetConversationPublicKey())
+
+	rooms, err := db.getMatrixRooms()
+	require.NoError(t, err)
+	require.Len(t, rooms, 2)
+
+	require.NoError(t, db.deleteMatrixRoom("conv_1"))
+	require.True(t, errcode.Is(db.deleteMatrixRoom("conv_1"), errcode.ErrNotFound))
+
+	require.NoError(t, db.addMatrixGhost(&messengertypes.MatrixGhost{MemberPublicKey: "member_1", UserID: "@berty_1:example.org"}))
+	require.NoError(t, db.setMatrixGhostDisplayName("member_1", "alice"))
+
+	ghost, err := db.getMatrixGhost("member_1")
+	require.NoError(t, err)
+	require.Equal(t, "alice", ghost.GetDisplayName())
+
+	// the replayed events are only relayed once
+	added, err := db.addMatrixEvent(&messengertypes.MatrixEvent{EventID: "$event_1", ConversationPublicKey: "conv_2", Incoming: true})
+	require.NoError(t, err)
+	require.True(t, added)
+
+	added, err = db.addMatrixEvent(&messengertypes.MatrixEvent{EventID: "$event_1", ConversationPublicKey: "conv_2", Incoming: true})
+	require.NoError(t, err)
+	require.False(t, added)
+
+	relayed, err := db.isMatrixInteractionRelayed("cid_1")
+	require.NoError(t, err)
+	require.False(t, relayed)
+
+	_, err = db.addMatrixEvent(&messengertypes.MatrixEvent{EventID: "$event_2", CID: "cid_1", ConversationPublicKey: "conv_2"})
+	require.NoError(t, err)
+
+	relayed, err = db.isMatrixInteractionRelayed("cid_1")
+	require.NoError(t, err)
+	require.True(t, relayed)
+}
@@ -0,0 +1,189 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// matrixClient is a minimal client of the Matrix client-server API authenticated as an application service, the
+// requests are sent on behalf of the bot or of a ghost user with the user_id parameter
+type matrixClient struct {
+	homeserver string
+	asToken    string
+	httpClient *http.Client
+}
+
+type matrixError struct {
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix: %s: %s", e.ErrCode, e.Message)
+}
+
+func (c *matrixClient) url(path string, userID string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	if userID != "" {
+		query.Set("user_id", userID)
+	}
+
+	u := strings.TrimSuffix(c.homeserver, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	return u
+}
+
+func (c *matrixClient) do(ctx context.Context, method string, u string, contentType string, body io.Reader, reply interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errcode.ErrStreamRead.Wrap(err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		mErr := &matrixError{}
+		if err := json.Unmarshal(data, mErr); err != nil || mErr.ErrCode == "" {
+			mErr.ErrCode = "M_UNKNOWN"
+			mErr.Message = fmt.Sprintf("unexpected status %d", res.StatusCode)
+		}
+		return mErr
+	}
+
+	if reply == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, reply); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return nil
+}
+
+func (c *matrixClient) doJSON(ctx context.Context, method string, u string, body interface{}, reply interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return c.do(ctx, method, u, "application/json", bytes.NewReader(data), reply)
+}
+
+// registerGhost creates a user in the namespace of the application service, registering an existing user succeeds
+func (c *matrixClient) registerGhost(ctx context.Context, localpart string) error {
+	err := c.doJSON(ctx, http.MethodPost, c.url("/_matrix/client/r0/register", "", nil), map[string]string{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+
+	if mErr, ok := err.(*matrixError); ok && mErr.ErrCode == "M_USER_IN_USE" {
+		return nil
+	}
+
+	return err
+}
+
+func (c *matrixClient) setDisplayName(ctx context.Context, userID string, displayName string) error {
+	return c.doJSON(ctx, http.MethodPut, c.url("/_matrix/client/r0/profile/"+url.PathEscape(userID)+"/displayname", userID, nil), map[string]string{
+		"displayname": displayName,
+	}, nil)
+}
+
+func (c *matrixClient) getDisplayName(ctx context.Context, userID string) (string, error) {
+	reply := struct {
+		DisplayName string `json:"displayname"`
+	}{}
+
+	if err := c.do(ctx, http.MethodGet, c.url("/_matrix/client/r0/profile/"+url.PathEscape(userID)+"/displayname", "", nil), "", nil, &reply); err != nil {
+		return "", err
+	}
+
+	return reply.DisplayName, nil
+}
+
+// joinRoom joins a room as userID, an empty userID joins as the bot of the application service
+func (c *matrixClient) joinRoom(ctx context.Context, roomID string, userID string) error {
+	return c.doJSON(ctx, http.MethodPost, c.url("/_matrix/client/r0/join/"+url.PathEscape(roomID), userID, nil), struct{}{}, nil)
+}
+
+// sendMessage sends an m.room.message event, the transaction id makes the request idempotent
+func (c *matrixClient) sendMessage(ctx context.Context, roomID string, userID string, txnID string, content interface{}) (string, error) {
+	reply := struct {
+		EventID string `json:"event_id"`
+	}{}
+
+	u := c.url("/_matrix/client/r0/rooms/"+url.PathEscape(roomID)+"/send/m.room.message/"+url.PathEscape(txnID), userID, nil)
+	if err := c.doJSON(ctx, http.MethodPut, u, content, &reply); err != nil {
+		return "", err
+	}
+
+	return reply.EventID, nil
+}
+
+// uploadMedia uploads a file to the media repository and returns its mxc:// uri
+func (c *matrixClient) uploadMedia(ctx context.Context, userID string, contentType string, filename string, content io.Reader) (string, error) {
+	reply := struct {
+		ContentURI string `json:"content_uri"`
+	}{}
+
+	u := c.url("/_matrix/media/r0/upload", userID, url.Values{"filename": []string{filename}})
+	if err := c.do(ctx, http.MethodPost, u, contentType, content, &reply); err != nil {
+		return "", err
+	}
+
+	return reply.ContentURI, nil
+}
+
+// downloadMedia fetches the content of an mxc:// uri, the caller closes the returned reader
+func (c *matrixClient) downloadMedia(ctx context.Context, mxc string) (io.ReadCloser, string, error) {
+	u, err := url.Parse(mxc)
+	if err != nil || u.Scheme != "mxc" || u.Host == "" || len(u.Path) < 2 {
+		return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid mxc uri %q", mxc))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/_matrix/media/r0/download/"+u.Host+u.Path, "", nil), nil)
+	if err != nil {
+		return nil, "", errcode.ErrInvalidInput.Wrap(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", errcode.ErrInternal.Wrap(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, "", errcode.ErrInternal.Wrap(fmt.Errorf("unexpected status %d", res.StatusCode))
+	}
+
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
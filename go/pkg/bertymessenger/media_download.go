@@ -0,0 +1,258 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const mediaDownloadQueueSize = 256
+
+// mediaFetchFirstBlockTimeout bounds the wait for the first bytes of a media downloaded in background, the media is
+// then fetched from the members holding it
+const mediaFetchFirstBlockTimeout = 30 * time.Second
+
+// resolveMediaDownloadPolicy returns the effective download mode and max size for a conversation,
+// the conversation values take precedence over the account ones when set, the medias are only downloaded manually in
+// low-storage mode
+func resolveMediaDownloadPolicy(acc *messengertypes.Account, conv *messengertypes.Conversation) (messengertypes.MediaDownloadPolicy_Mode, int64) {
+	if acc.GetLowStorageEnabled() {
+		return messengertypes.MediaDownloadPolicy_ModeManual, acc.GetMediaDownloadMaxSize()
+	}
+
+	mode := acc.GetMediaDownloadMode()
+	if m := conv.GetMediaDownloadMode(); m != messengertypes.MediaDownloadPolicy_ModeUndefined {
+		mode = m
+	}
+
+	if mode == messengertypes.MediaDownloadPolicy_ModeUndefined {
+		mode = messengertypes.MediaDownloadPolicy_ModeWifiOnly
+	}
+
+	maxSize := acc.GetMediaDownloadMaxSize()
+	if s := conv.GetMediaDownloadMaxSize(); s != 0 {
+		maxSize = s
+	}
+
+	return mode, maxSize
+}
+
+// shouldDownloadMedia checks whether a media can be fetched in background given the effective policy
+func shouldDownloadMedia(mode messengertypes.MediaDownloadPolicy_Mode, maxSize int64, media *messengertypes.Media, unmetered bool) bool {
+	if media.GetState() != messengertypes.Media_StateNeverDownloaded {
+		return false
+	}
+
+	// media with an unknown size are only fetched when no limit is set
+	if maxSize > 0 && (media.GetSize_() <= 0 || media.GetSize_() > maxSize) {
+		return false
+	}
+
+	switch mode {
+	case messengertypes.MediaDownloadPolicy_ModeAlways:
+		return true
+	case messengertypes.MediaDownloadPolicy_ModeWifiOnly:
+		return unmetered
+	default:
+		return false
+	}
+}
+
+// mediaDownloader fetches attachments in background according to the media download policies
+type mediaDownloader struct {
+	svc         *service
+	logger      *zap.Logger
+	queue       chan *messengertypes.Media
+	isUnmetered func() bool
+
+	muPending sync.Mutex
+	pending   map[string]struct{}
+}
+
+func newMediaDownloader(svc *service, isUnmetered func() bool) *mediaDownloader {
+	if isUnmetered == nil {
+		// without a connectivity provider we assume the node is not on a metered connection (ie. desktop)
+		isUnmetered = func() bool { return true }
+	}
+
+	return &mediaDownloader{
+		svc:         svc,
+		logger:      svc.logger.Named("media-dl"),
+		queue:       make(chan *messengertypes.Media, mediaDownloadQueueSize),
+		isUnmetered: isUnmetered,
+		pending:     make(map[string]struct{}),
+	}
+}
+
+func (md *mediaDownloader) start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case media := <-md.queue:
+				md.download(media)
+			}
+		}
+	}()
+}
+
+// enqueue evaluates the policies for the given medias and schedules the eligible ones for download
+func (md *mediaDownloader) enqueue(conversationPK string, medias []*messengertypes.Media) {
+	if len(medias) == 0 {
+		return
+	}
+
+	acc, err := md.svc.db.getAccount()
+	if err != nil {
+		md.logger.Error("unable to fetch account", zap.Error(err))
+		return
+	}
+
+	conv, err := md.svc.db.getConversationByPK(conversationPK)
+	if err != nil {
+		md.logger.Warn("unable to fetch conversation", logGroup(conversationPK), zap.Error(err))
+	}
+
+	mode, maxSize := resolveMediaDownloadPolicy(acc, conv)
+	unmetered := md.isUnmetered()
+
+	for _, media := range medias {
+		if !shouldDownloadMedia(mode, maxSize, media, unmetered) {
+			continue
+		}
+
+		md.muPending.Lock()
+		if _, ok := md.pending[media.GetCID()]; ok {
+			md.muPending.Unlock()
+			continue
+		}
+		md.pending[media.GetCID()] = struct{}{}
+		md.muPending.Unlock()
+
+		select {
+		case md.queue <- media:
+		default:
+			md.logger.Warn("media download queue is full, skipping", zap.String("cid", media.GetCID()))
+			md.release(media.GetCID())
+		}
+	}
+}
+
+// enqueueNeverDownloaded schedules the download of all known medias that have not been fetched yet
+func (md *mediaDownloader) enqueueNeverDownloaded() {
+	medias, err := md.svc.db.getMediasByState(messengertypes.Media_StateNeverDownloaded)
+	if err != nil {
+		md.logger.Error("unable to list pending medias", zap.Error(err))
+		return
+	}
+
+	byConversation := map[string][]*messengertypes.Media{}
+	for _, media := range medias {
+		i, err := md.svc.db.getInteractionByCID(media.GetInteractionCID())
+		if err != nil {
+			continue
+		}
+
+		convPK := i.GetConversationPublicKey()
+		byConversation[convPK] = append(byConversation[convPK], media)
+	}
+
+	for convPK, medias := range byConversation {
+		md.enqueue(convPK, medias)
+	}
+}
+
+func (md *mediaDownloader) release(cid string) {
+	md.muPending.Lock()
+	delete(md.pending, cid)
+	md.muPending.Unlock()
+}
+
+func (md *mediaDownloader) download(media *messengertypes.Media) {
+	defer md.release(media.GetCID())
+
+	checksum, err := md.fetch(media, nil)
+	if err != nil {
+		// the sender may be offline, the media is fetched from the members which announced they hold it
+		providers, perr := md.svc.db.getMediaHolderPeerIDs(media.GetCID(), mediaFetchMaxProviders)
+		if perr != nil || len(providers) == 0 {
+			md.logger.Error("unable to download attachment", zap.String("cid", media.GetCID()), zap.Error(err))
+			return
+		}
+
+		md.logger.Info("fetching attachment from its holders", zap.String("cid", media.GetCID()), zap.Int("holders", len(providers)), zap.Error(err))
+		if checksum, err = md.fetch(media, providers); err != nil {
+			md.logger.Error("unable to download attachment from its holders", zap.String("cid", media.GetCID()), zap.Error(err))
+			return
+		}
+	}
+
+	if err := md.svc.markMediaDownloaded(media.GetCID(), checksum); err != nil {
+		md.logger.Error("unable to update media state", zap.String("cid", media.GetCID()), zap.Error(err))
+	}
+}
+
+// fetch reads the whole content of a media and returns its checksum, the fetch is given up when its first bytes are
+// not received in time, a large media keeps downloading afterwards
+func (md *mediaDownloader) fetch(media *messengertypes.Media, providers []string) (string, error) {
+	ctx, cancel := context.WithCancel(md.svc.ctx)
+	defer cancel()
+
+	timer := time.AfterFunc(mediaFetchFirstBlockTimeout, cancel)
+	defer timer.Stop()
+
+	reader, err := md.svc.mediaContentRetrieveFrom(ctx, media, providers)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// the protocol keeps the fetched blocks, reading the whole attachment is enough to make it locally available
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(hash, timerStopWriter{timer}), reader); err != nil {
+		return "", errcode.ErrStreamRead.Wrap(err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// timerStopWriter stops a timer once something is written
+type timerStopWriter struct {
+	timer *time.Timer
+}
+
+func (w timerStopWriter) Write(p []byte) (int, error) {
+	w.timer.Stop()
+	return len(p), nil
+}
+
+// markMediaDownloaded flags a media as locally available, records the checksum of its content and notifies the clients
+func (svc *service) markMediaDownloaded(cid string, checksum string) error {
+	defer svc.writer.enter()()
+
+	if err := svc.db.setMediaChecksum(cid, checksum); err != nil {
+		return err
+	}
+
+	media, updated, err := svc.db.updateMediaState(cid, messengertypes.Media_StateDownloaded)
+	if err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	if !updated {
+		return nil
+	}
+
+	go svc.announceMediaAvailability(media)
+
+	return svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, false)
+}
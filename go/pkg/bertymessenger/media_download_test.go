@@ -0,0 +1,82 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_resolveMediaDownloadPolicy(t *testing.T) {
+	mode, maxSize := resolveMediaDownloadPolicy(nil, nil)
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeWifiOnly, mode)
+	require.Equal(t, int64(0), maxSize)
+
+	acc := &messengertypes.Account{MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeAlways, MediaDownloadMaxSize: 1000}
+
+	mode, maxSize = resolveMediaDownloadPolicy(acc, &messengertypes.Conversation{})
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeAlways, mode)
+	require.Equal(t, int64(1000), maxSize)
+
+	mode, maxSize = resolveMediaDownloadPolicy(acc, &messengertypes.Conversation{MediaDownloadMode: messengertypes.MediaDownloadPolicy_ModeManual, MediaDownloadMaxSize: 10})
+	require.Equal(t, messengertypes.MediaDownloadPolicy_ModeManual, mode)
+	require.Equal(t, int64(10), maxSize)
+}
+
+func Test_shouldDownloadMedia(t *testing.T) {
+	pending := &messengertypes.Media{State: messengertypes.Media_StateNeverDownloaded, Size_: 100}
+	unknownSize := &messengertypes.Media{State: messengertypes.Media_StateNeverDownloaded}
+	downloaded := &messengertypes.Media{State: messengertypes.Media_StateDownloaded, Size_: 100}
+
+	cases := []struct {
+		name      string
+		mode      messengertypes.MediaDownloadPolicy_Mode
+		maxSize   int64
+		media     *messengertypes.Media
+		unmetered bool
+		expected  bool
+	}{
+		{"always", messengertypes.MediaDownloadPolicy_ModeAlways, 0, pending, false, true},
+		{"always under limit", messengertypes.MediaDownloadPolicy_ModeAlways, 100, pending, false, true},
+		{"always over limit", messengertypes.MediaDownloadPolicy_ModeAlways, 99, pending, false, false},
+		{"always unknown size with limit", messengertypes.MediaDownloadPolicy_ModeAlways, 100, unknownSize, false, false},
+		{"always unknown size without limit", messengertypes.MediaDownloadPolicy_ModeAlways, 0, unknownSize, false, true},
+		{"wifi only on metered", messengertypes.MediaDownloadPolicy_ModeWifiOnly, 0, pending, false, false},
+		{"wifi only on unmetered", messengertypes.MediaDownloadPolicy_ModeWifiOnly, 0, pending, true, true},
+		{"manual", messengertypes.MediaDownloadPolicy_ModeManual, 0, pending, true, false},
+		{"already downloaded", messengertypes.MediaDownloadPolicy_ModeAlways, 0, downloaded, true, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.expected, shouldDownloadMedia(c.mode, c.maxSize, c.media, c.unmetered))
+		})
+	}
+}
+
+func Test_dbWrapper_updateMediaState(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, _, err := db.updateMediaState("", messengertypes.Media_StateDownloaded)
+	require.Error(t, err)
+
+	cid := "EiBnLu1b0PFzPcVd_QPPfhzIs0kmzAH2g0VUfiAqvIXMLg"
+	added, err := db.addMedias([]*messengertypes.Media{{CID: cid, State: messengertypes.Media_StateNeverDownloaded}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true}, added)
+
+	media, updated, err := db.updateMediaState(cid, messengertypes.Media_StateDownloaded)
+	require.NoError(t, err)
+	require.True(t, updated)
+	require.Equal(t, messengertypes.Media_StateDownloaded, media.State)
+
+	_, updated, err = db.updateMediaState(cid, messengertypes.Media_StateDownloaded)
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	medias, err := db.getMediasByState(messengertypes.Media_StateNeverDownloaded)
+	require.NoError(t, err)
+	require.Empty(t, medias)
+}
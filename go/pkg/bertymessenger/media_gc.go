@@ -0,0 +1,163 @@
+package bertymessenger
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// mediaGCGracePeriod is the delay during which an unreferenced media is kept, ie. so a failed send can be retried
+const mediaGCGracePeriod = 24 * time.Hour
+
+// The medias which may not be referenced anymore are marked by a tombstone: the medias prepared until a message sent
+// with them is received, and the medias of the deleted interactions. Once the grace period of a tombstone is over, the
+// media is checked again and its content is removed if neither an interaction nor an avatar references it. The
+// medias of the older versions, prepared before the tombstones existed, are never collected.
+
+// mediaGCStats sums the runs of the collector since the messenger started
+type mediaGCStats struct {
+	mu    sync.Mutex
+	stats messengertypes.SystemInfo_MediaGC
+}
+
+func (s *mediaGCStats) collected(reply *messengertypes.MediaGarbageCollect_Reply, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stats.Runs++
+	s.stats.RemovedMedias += reply.GetRemovedCount()
+	s.stats.ReclaimedSize += reply.GetReclaimedSize()
+	s.stats.LastRunDate = timestampMs(now)
+}
+
+func (s *mediaGCStats) snapshot() *messengertypes.SystemInfo_MediaGC {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats
+	return &stats
+}
+
+// collectMediaGarbage removes the medias whose tombstone is older than the grace period, it only reports them if
+// dryRun is set
+func (svc *service) collectMediaGarbage(ctx context.Context, dryRun bool, now time.Time) (*messengertypes.MediaGarbageCollect_Reply, error) {
+	reply, removed, err := svc.collectMediaTombstones(dryRun, now)
+	if err != nil || dryRun {
+		return reply, err
+	}
+
+	svc.removeAttachments(ctx, removed)
+	svc.mediaGCStats.collected(reply, now)
+
+	if reply.GetRemovedCount() > 0 {
+		svc.logger.Info("collected unreferenced medias", zap.Int64("count", reply.GetRemovedCount()), zap.Int64("size", reply.GetReclaimedSize()))
+	}
+
+	return reply, nil
+}
+
+// collectMediaTombstones removes the expired tombstones and the medias they mark, it returns the medias whose content
+// must be removed
+func (svc *service) collectMediaTombstones(dryRun bool, now time.Time) (*messengertypes.MediaGarbageCollect_Reply, []*messengertypes.Media, error) {
+	defer svc.writer.enter()()
+
+	// the medias of the interactions deleted by the older versions are found by their link
+	if !dryRun {
+		dangling, err := svc.db.getDanglingMedias()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := svc.db.addMediaTombstones(dangling, messengertypes.MediaTombstone_ReasonInteractionDeleted, timestampMs(now)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cutoff := timestampMs(now.Add(-mediaGCGracePeriod))
+	tombstones, err := svc.db.getMediaTombstones(timestampMs(now) + 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reply := &messengertypes.MediaGarbageCollect_Reply{}
+	expired := []*messengertypes.MediaTombstone(nil)
+	cids := []string(nil)
+	for _, tombstone := range tombstones {
+		if tombstone.GetOrphanedDate() >= cutoff {
+			reply.PendingCount++
+			continue
+		}
+
+		expired = append(expired, tombstone)
+		cids = append(cids, tombstone.GetCID())
+	}
+
+	referenced, err := svc.db.getReferencedMediaCIDs(cids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	medias, err := svc.db.getMediasByCID(cids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removed := []*messengertypes.Media(nil)
+	removedCIDs := []string(nil)
+	for _, tombstone := range expired {
+		if referenced[tombstone.GetCID()] {
+			continue
+		}
+
+		// the media of a deleted row may still be stored, its size is not known
+		media, ok := medias[tombstone.GetCID()]
+		if !ok {
+			media = &messengertypes.Media{CID: tombstone.GetCID(), State: messengertypes.Media_StateDownloaded}
+		}
+
+		entry := &messengertypes.MediaGarbageCollect_Entry{
+			CID:          tombstone.GetCID(),
+			Reason:       tombstone.GetReason(),
+			OrphanedDate: tombstone.GetOrphanedDate(),
+		}
+		if isMediaAvailable(media) {
+			entry.Size_ = media.GetSize_()
+			removed = append(removed, media)
+		}
+
+		reply.Entries = append(reply.Entries, entry)
+		reply.RemovedCount++
+		reply.ReclaimedSize += entry.GetSize_()
+
+		if ok {
+			removedCIDs = append(removedCIDs, media.GetCID())
+		}
+	}
+
+	if dryRun {
+		return reply, nil, nil
+	}
+
+	// the tombstones of the medias referenced again are removed as well
+	if err := svc.db.tx(func(tx *dbWrapper) error {
+		if len(removedCIDs) > 0 {
+			if err := tx.deleteMedias(removedCIDs); err != nil {
+				return err
+			}
+		}
+
+		return tx.deleteMediaTombstones(cids)
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return reply, removed, nil
+}
+
+func (svc *service) MediaGarbageCollect(ctx context.Context, req *messengertypes.MediaGarbageCollect_Request) (*messengertypes.MediaGarbageCollect_Reply, error) {
+	return svc.collectMediaGarbage(ctx, req.GetDryRun(), time.Now())
+}
@@ -0,0 +1,113 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_addMediaTombstones(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	// a prepared media is tracked until a message sent with it is received
+	_, err := db.addMedias([]*messengertypes.Media{
+		{CID: "media_1", State: messengertypes.Media_StatePrepared},
+		{CID: "media_2", State: messengertypes.Media_StatePrepared},
+		{CID: "media_3", InteractionCID: "cid_1"},
+	})
+	require.NoError(t, err)
+
+	tombstones, err := db.getMediaTombstones(timestampMs(time.Now()) + 1)
+	require.NoError(t, err)
+	require.Len(t, tombstones, 2)
+	require.Equal(t, messengertypes.MediaTombstone_ReasonNotSent, tombstones[0].GetReason())
+
+	_, err = db.addMedias([]*messengertypes.Media{{CID: "media_1", InteractionCID: "cid_2", State: messengertypes.Media_StateNeverDownloaded}})
+	require.NoError(t, err)
+
+	// the medias of a deleted interaction are marked
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1"}).Error)
+	require.NoError(t, db.deleteInteractions([]string{"cid_1"}))
+
+	tombstones, err = db.getMediaTombstones(timestampMs(time.Now()) + 1)
+	require.NoError(t, err)
+	require.Len(t, tombstones, 2)
+	for _, tombstone := range tombstones {
+		switch tombstone.GetCID() {
+		case "media_2":
+			require.Equal(t, messengertypes.MediaTombstone_ReasonNotSent, tombstone.GetReason())
+		case "media_3":
+			require.Equal(t, messengertypes.MediaTombstone_ReasonInteractionDeleted, tombstone.GetReason())
+		default:
+			require.Fail(t, "unexpected tombstone", tombstone.GetCID())
+		}
+	}
+}
+
+func Test_service_collectMediaTombstones(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	now := time.Now()
+	expired := timestampMs(now.Add(-2 * mediaGCGracePeriod))
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Account{PublicKey: "account_1", AvatarCID: "media_3"}).Error)
+	for _, media := range []*messengertypes.Media{
+		{CID: "media_1", State: messengertypes.Media_StatePrepared, Size_: 100},
+		{CID: "media_2", InteractionCID: "cid_1", State: messengertypes.Media_StateDownloaded, Size_: 200},
+		{CID: "media_3", State: messengertypes.Media_StatePrepared, Size_: 300},
+		{CID: "media_4", State: messengertypes.Media_StatePrepared, Size_: 400},
+		{CID: "media_5", InteractionCID: "cid_2", State: messengertypes.Media_StateNeverDownloaded, Size_: 500},
+	} {
+		require.NoError(t, db.db.Create(media).Error)
+	}
+
+	// media_2 is referenced again, media_3 is an avatar and media_4 is still in its grace period
+	require.NoError(t, db.addMediaTombstones([]*messengertypes.Media{{CID: "media_1"}, {CID: "media_2"}, {CID: "media_3"}}, messengertypes.MediaTombstone_ReasonNotSent, expired))
+	require.NoError(t, db.addMediaTombstones([]*messengertypes.Media{{CID: "media_4"}}, messengertypes.MediaTombstone_ReasonNotSent, timestampMs(now)))
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	reply, err := svc.collectMediaGarbage(context.Background(), true, now)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), reply.GetRemovedCount())
+	require.Equal(t, int64(100), reply.GetReclaimedSize())
+	require.Equal(t, "media_1", reply.GetEntries()[0].GetCID())
+	require.Equal(t, int64(1), reply.GetPendingCount())
+
+	// the dry run changes nothing
+	medias, err := db.getMediasByCID([]string{"media_1"})
+	require.NoError(t, err)
+	require.Len(t, medias, 1)
+
+	reply, removed, err := svc.collectMediaTombstones(false, now)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Equal(t, int64(100), reply.GetReclaimedSize())
+
+	// media_5 has lost its interaction, it is collected after its grace period
+	require.Equal(t, int64(2), reply.GetPendingCount())
+
+	medias, err = db.getMediasByCID([]string{"media_1", "media_2", "media_3", "media_4", "media_5"})
+	require.NoError(t, err)
+	require.Len(t, medias, 4)
+	require.NotContains(t, medias, "media_1")
+
+	tombstones, err := db.getMediaTombstones(timestampMs(now) + 1)
+	require.NoError(t, err)
+	require.Len(t, tombstones, 2)
+
+	reply, removed, err = svc.collectMediaTombstones(false, now.Add(2*mediaGCGracePeriod))
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Equal(t, "media_4", removed[0].GetCID())
+	require.Equal(t, int64(2), reply.GetRemovedCount())
+	require.Equal(t, int64(400), reply.GetReclaimedSize())
+}
@@ -0,0 +1,168 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The members which agreed to share the medias they downloaded announce them in their conversations with their peer.
+// A media which can't be fetched from its sender, usually because the sender is offline, is fetched again after
+// connecting to the peers which announced it, the blocks are encrypted and addressed by their content so any holder
+// can provide them.
+
+const (
+	// mediaAvailabilityMaxCIDs is the maximum number of medias announced by a single message
+	mediaAvailabilityMaxCIDs = 64
+	// mediaFetchMaxProviders is the maximum number of holders connected to fetch a media, the last announced first
+	mediaFetchMaxProviders = 8
+)
+
+func (h *eventHandler) handleAppMessageMediaAvailability(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_MediaAvailability)
+
+	if payload.GetPeerID() == "" || len(payload.GetCIDs()) == 0 || len(payload.GetCIDs()) > mediaAvailabilityMaxCIDs || i.GetDevicePublicKey() == "" {
+		h.logger.Warn("ignoring invalid media availability", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	for _, cid := range payload.GetCIDs() {
+		if err := tx.addMediaHolder(&messengertypes.MediaHolder{
+			MediaCID:              cid,
+			DevicePublicKey:       i.GetDevicePublicKey(),
+			MemberPublicKey:       interactionSenderMemberPK(i),
+			ConversationPublicKey: i.GetConversationPublicKey(),
+			PeerID:                payload.GetPeerID(),
+			AnnouncedDate:         i.GetSentDate(),
+		}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+// announceMediaAvailability announces a downloaded media in its conversation when the account agreed to share it
+func (svc *service) announceMediaAvailability(media *messengertypes.Media) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		svc.logger.Warn("unable to fetch account", zap.Error(err))
+		return
+	}
+
+	if !acc.GetMediaPeerSharingEnabled() {
+		return
+	}
+
+	i, err := svc.db.getInteractionByCID(media.GetInteractionCID())
+	if err != nil {
+		svc.logger.Debug("unable to find the interaction of a media", zap.String("cid", media.GetCID()), zap.Error(err))
+		return
+	}
+
+	if err := svc.sendMediaAvailability(svc.ctx, i.GetConversationPublicKey(), []string{media.GetCID()}); err != nil {
+		svc.logger.Warn("unable to announce media", zap.String("cid", media.GetCID()), zap.Error(err))
+	}
+}
+
+// announceDownloadedMedias announces the medias already downloaded in each conversation
+func (svc *service) announceDownloadedMedias(ctx context.Context) {
+	cids, err := svc.db.getDownloadedMediaCIDsByConversation()
+	if err != nil {
+		svc.logger.Warn("unable to list the downloaded medias", zap.Error(err))
+		return
+	}
+
+	for convPK, convCIDs := range cids {
+		for len(convCIDs) > 0 {
+			batch := convCIDs
+			if len(batch) > mediaAvailabilityMaxCIDs {
+				batch = batch[:mediaAvailabilityMaxCIDs]
+			}
+			convCIDs = convCIDs[len(batch):]
+
+			if err := svc.sendMediaAvailability(ctx, convPK, batch); err != nil {
+				svc.logger.Warn("unable to announce medias", logGroup(convPK), zap.Error(err))
+				break
+			}
+		}
+	}
+}
+
+// sendMediaAvailability announces medias held by this device in a conversation, the medias of the account
+// conversation are never announced
+func (svc *service) sendMediaAvailability(ctx context.Context, convPK string, cids []string) error {
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() == messengertypes.Conversation_AccountType {
+		return nil
+	}
+
+	config, err := svc.protocolClient.InstanceGetConfiguration(ctx, &protocoltypes.InstanceGetConfiguration_Request{})
+	if err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeMediaAvailability, &messengertypes.AppMessage_MediaAvailability{
+		CIDs:   cids,
+		PeerID: config.GetPeerID(),
+	})
+}
+
+func (svc *service) MediaPeerSharingSet(ctx context.Context, req *messengertypes.MediaPeerSharingSet_Request) (*messengertypes.MediaPeerSharingSet_Reply, error) {
+	acc, updated, err := func() (*messengertypes.Account, bool, error) {
+		defer svc.writer.enter()()
+
+		acc, err := svc.db.getAccount()
+		if err != nil {
+			return nil, false, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if acc.GetMediaPeerSharingEnabled() == req.GetEnabled() {
+			return acc, false, nil
+		}
+
+		acc, err = svc.db.setAccountMediaPeerSharing(acc.GetPublicKey(), req.GetEnabled())
+		return acc, true, err
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	if !updated {
+		return &messengertypes.MediaPeerSharingSet_Reply{}, nil
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	// the medias downloaded before the agreement are announced too
+	if acc.GetMediaPeerSharingEnabled() {
+		go svc.announceDownloadedMedias(svc.ctx)
+	}
+
+	return &messengertypes.MediaPeerSharingSet_Reply{}, nil
+}
+
+func validateMediaHolder(holder *messengertypes.MediaHolder) error {
+	switch {
+	case holder.GetMediaCID() == "":
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a media cid is required"))
+	case holder.GetDevicePublicKey() == "":
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a device public key is required"))
+	case holder.GetPeerID() == "":
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a peer id is required"))
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_addMediaHolder(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.Error(t, db.addMediaHolder(&messengertypes.MediaHolder{DevicePublicKey: "device_1", PeerID: "peer_1"}))
+	require.Error(t, db.addMediaHolder(&messengertypes.MediaHolder{MediaCID: "media_1", PeerID: "peer_1"}))
+	require.Error(t, db.addMediaHolder(&messengertypes.MediaHolder{MediaCID: "media_1", DevicePublicKey: "device_1"}))
+
+	require.NoError(t, db.addMediaHolder(&messengertypes.MediaHolder{MediaCID: "media_1", DevicePublicKey: "device_1", PeerID: "peer_1", AnnouncedDate: 2}))
+	require.NoError(t, db.addMediaHolder(&messengertypes.MediaHolder{MediaCID: "media_1", DevicePublicKey: "device_2", PeerID: "peer_2", AnnouncedDate: 3}))
+
+	// an older announcement of the same device is ignored
+	require.NoError(t, db.addMediaHolder(&messengertypes.MediaHolder{MediaCID: "media_1", DevicePublicKey: "device_1", PeerID: "peer_old", AnnouncedDate: 1}))
+
+	peerIDs, err := db.getMediaHolderPeerIDs("media_1", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"peer_2", "peer_1"}, peerIDs)
+
+	peerIDs, err = db.getMediaHolderPeerIDs("media_1", 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"peer_2"}, peerIDs)
+
+	peerIDs, err = db.getMediaHolderPeerIDs("media_2", 10)
+	require.NoError(t, err)
+	require.Empty(t, peerIDs)
+}
+
+func Test_dbWrapper_getDownloadedMediaCIDsByConversation(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_2"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_2", IsMe: true}).Error)
+
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "cid_1", State: messengertypes.Media_StateDownloaded}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_2", InteractionCID: "cid_2", State: messengertypes.Media_StateDownloaded}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_3", InteractionCID: "cid_2", State: messengertypes.Media_StateNeverDownloaded}).Error)
+	// the medias sent by the account are held by their sender already
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_4", InteractionCID: "cid_3", State: messengertypes.Media_StateDownloaded}).Error)
+
+	cids, err := db.getDownloadedMediaCIDsByConversation()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{"conv_1": {"media_1"}, "conv_2": {"media_2"}}, cids)
+}
+
+func Test_eventHandler_handleAppMessageMediaAvailability(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+
+	i := &messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", MemberPublicKey: "member_1", DevicePublicKey: "device_1", SentDate: 1}
+
+	// the announcements without a peer are ignored
+	_, _, err := h.handleAppMessageMediaAvailability(db, i, &messengertypes.AppMessage_MediaAvailability{CIDs: []string{"media_1"}})
+	require.NoError(t, err)
+
+	peerIDs, err := db.getMediaHolderPeerIDs("media_1", 10)
+	require.NoError(t, err)
+	require.Empty(t, peerIDs)
+
+	_, _, err = h.handleAppMessageMediaAvailability(db, i, &messengertypes.AppMessage_MediaAvailability{CIDs: []string{"media_1", "media_2"}, PeerID: "peer_1"})
+	require.NoError(t, err)
+
+	for _, cid := range []string{"media_1", "media_2"} {
+		peerIDs, err := db.getMediaHolderPeerIDs(cid, 10)
+		require.NoError(t, err)
+		require.Equal(t, []string{"peer_1"}, peerIDs)
+	}
+}
@@ -0,0 +1,157 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The images are sent with a small thumbnail and a blurhash in their metadata, both generated from the processed image,
+// so the receivers show a placeholder as soon as the message is received, before the attachment is downloaded.
+
+const (
+	mediaThumbnailMaxDimension = 96
+	mediaThumbnailJPEGQuality  = 60
+	// mediaBlurhashDimension is the size of the image the blurhash is computed from, the blurhash only keeps its
+	// lowest frequencies
+	mediaBlurhashDimension   = 32
+	mediaBlurhashComponentsX = 4
+	mediaBlurhashComponentsY = 3
+)
+
+// setMediaPreview sets the thumbnail, the blurhash and the dimensions of an image from its processed content
+func setMediaPreview(media *messengertypes.Media, data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if config.Width*config.Height > mediaProcessingMaxPixels {
+		return fmt.Errorf("the image has more than %d pixels", mediaProcessingMaxPixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	thumbnail := downscaleImage(toRGBA(img), mediaThumbnailMaxDimension)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: mediaThumbnailJPEGQuality}); err != nil {
+		return err
+	}
+
+	if buf.Len() <= messengertypes.MaxThumbnailSize {
+		media.Thumbnail = buf.Bytes()
+	}
+
+	media.Blurhash = encodeBlurhash(downscaleImage(thumbnail, mediaBlurhashDimension), mediaBlurhashComponentsX, mediaBlurhashComponentsY)
+	media.Width = int32(config.Width)
+	media.Height = int32(config.Height)
+
+	return nil
+}
+
+const blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// encodeBlurhash computes the blurhash of an image with the given number of components on each axis, from 1 to 9
+func encodeBlurhash(img *image.RGBA, componentsX, componentsY int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := y*img.Stride + x*4
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * srgbToLinear(img.Pix[p+c])
+					}
+				}
+			}
+
+			scale := normalisation / float64(w*h)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, factor := range factors[1:] {
+			for _, v := range factor {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		hash.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, factor := range factors[1:] {
+		quantised := [3]int{}
+		for c, v := range factor {
+			quantised[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantised[0]*19*19+quantised[1]*19+quantised[2], 2))
+	}
+
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = blurhashCharacters[value%83]
+		value /= 83
+	}
+
+	return string(digits)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
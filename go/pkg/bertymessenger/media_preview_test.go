@@ -0,0 +1,56 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_encodeBlurhash(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			img.Set(x, y, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+		}
+	}
+
+	require.Equal(t, "LWTSUA~qfQ~q~qt7fQt7fQfQfQfQ", encodeBlurhash(img, 4, 3))
+
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if x < 5 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+
+	require.Equal(t, "L~LjfL|T,SO0w$sRn~a~fQfQfQfQ", encodeBlurhash(img, 4, 3))
+}
+
+func Test_setMediaPreview(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(300, 200)))
+
+	media := &messengertypes.Media{MimeType: "image/png"}
+	require.NoError(t, setMediaPreview(media, buf.Bytes()))
+	require.Equal(t, int32(300), media.GetWidth())
+	require.Equal(t, int32(200), media.GetHeight())
+	require.Len(t, media.GetBlurhash(), 28)
+	require.NoError(t, media.IsValidMetadata())
+
+	thumbnail, err := jpeg.DecodeConfig(bytes.NewReader(media.GetThumbnail()))
+	require.NoError(t, err)
+	require.Equal(t, mediaThumbnailMaxDimension, thumbnail.Width)
+	require.Equal(t, 64, thumbnail.Height)
+
+	require.Error(t, setMediaPreview(&messengertypes.Media{MimeType: "image/png"}, []byte("not an image")))
+}
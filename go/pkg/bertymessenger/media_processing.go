@@ -0,0 +1,572 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The medias are processed before being prepared so the clients don't each have to: the metadata of the images, which
+// may contain the location and the device of a picture, are always removed, then the images are downscaled and the
+// videos re-encoded according to the quality of the conversation. An image step failing leaves the image as it is, the
+// preview of the images is generated from their processed content.
+
+const (
+	// mediaProcessingMaxSize is the size of the largest image processed, the larger ones are kept in memory otherwise
+	mediaProcessingMaxSize = 64 * 1024 * 1024
+	// mediaProcessingMaxPixels protects the decoder from the images of a huge size, they are only stripped
+	mediaProcessingMaxPixels = 64 * 1024 * 1024
+
+	mediaStandardImageMaxDimension = 2048
+	mediaLowImageMaxDimension      = 1024
+	mediaOriginalJPEGQuality       = 95
+	mediaStandardJPEGQuality       = 85
+	mediaLowJPEGQuality            = 70
+)
+
+// MediaTranscoder re-encodes the videos before they are sent, it is provided by the application (ie. the encoder of
+// the platform) and is expected to drop the metadata of the videos, the videos are sent as is if nil
+type MediaTranscoder interface {
+	// Transcode returns the video re-encoded for the quality and its mime type
+	Transcode(ctx context.Context, r io.Reader, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) (io.ReadCloser, string, error)
+}
+
+// mediaImageProcessor is a step of the processing of the images, it returns the image unchanged when it doesn't apply
+type mediaImageProcessor struct {
+	name    string
+	process func(data []byte, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) ([]byte, error)
+}
+
+// mediaImageProcessors are applied in order, the metadata are read by the transform before being stripped
+var mediaImageProcessors = []mediaImageProcessor{
+	{name: "transform", process: transformImage},
+	{name: "strip metadata", process: stripImageMetadata},
+}
+
+// resolveMediaQuality returns the effective quality of the medias of a conversation, the conversation value takes
+// precedence over the account one when set
+func resolveMediaQuality(acc *messengertypes.Account, conv *messengertypes.Conversation) messengertypes.MediaProcessingPolicy_Quality {
+	quality := acc.GetMediaQuality()
+	if q := conv.GetMediaQuality(); q != messengertypes.MediaProcessingPolicy_QualityUndefined {
+		quality = q
+	}
+
+	if quality == messengertypes.MediaProcessingPolicy_QualityUndefined {
+		quality = messengertypes.MediaProcessingPolicy_QualityStandard
+	}
+
+	return quality
+}
+
+// mediaQuality returns the quality of the medias prepared for a conversation, the account one if it is empty
+func (svc *service) mediaQuality(convPK string) (messengertypes.MediaProcessingPolicy_Quality, error) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return messengertypes.MediaProcessingPolicy_QualityUndefined, errcode.ErrDBRead.Wrap(err)
+	}
+
+	var conv *messengertypes.Conversation
+	if convPK != "" {
+		if conv, err = svc.db.getConversationByPK(convPK); err != nil {
+			return messengertypes.MediaProcessingPolicy_QualityUndefined, errcode.ErrNotFound.Wrap(err)
+		}
+	}
+
+	return resolveMediaQuality(acc, conv), nil
+}
+
+func (svc *service) MediaProcessingPolicySet(ctx context.Context, req *messengertypes.MediaProcessingPolicySet_Request) (*messengertypes.MediaProcessingPolicySet_Reply, error) {
+	if _, ok := messengertypes.MediaProcessingPolicy_Quality_name[int32(req.GetQuality())]; !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown media quality %d", req.GetQuality()))
+	}
+
+	convPK := req.GetConversationPublicKey()
+
+	defer svc.writer.enter()()
+
+	if convPK == "" {
+		acc, err := svc.db.getAccount()
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		if acc, err = svc.db.setAccountMediaQuality(acc.GetPublicKey(), req.GetQuality()); err != nil {
+			return nil, err
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+	} else {
+		conv, err := svc.db.setConversationMediaQuality(convPK, req.GetQuality())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+	}
+
+	return &messengertypes.MediaProcessingPolicySet_Reply{}, nil
+}
+
+// processMedia returns the content of a media as it is sent, the mime type of the media is updated when it changes
+func (svc *service) processMedia(ctx context.Context, r io.Reader, media *messengertypes.Media, quality messengertypes.MediaProcessingPolicy_Quality) (io.ReadCloser, error) {
+	mimeType := strings.ToLower(media.GetMimeType())
+
+	switch {
+	case isProcessedImage(mimeType):
+		data, err := ioutil.ReadAll(io.LimitReader(r, mediaProcessingMaxSize+1))
+		if err != nil {
+			return nil, errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if len(data) > mediaProcessingMaxSize {
+			svc.logger.Debug("image too large to be processed", zap.String("mime-type", mimeType))
+			return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), r)), nil
+		}
+
+		processed := processImage(data, mimeType, quality, svc.logger)
+		if err := setMediaPreview(media, processed); err != nil {
+			svc.logger.Debug("unable to generate image preview", zap.String("mime-type", mimeType), zap.Error(err))
+		}
+
+		return ioutil.NopCloser(bytes.NewReader(processed)), nil
+
+	case svc.isTranscodedVideo(mimeType, quality):
+		transcoded, transcodedType, err := svc.mediaTranscoder.Transcode(ctx, r, mimeType, quality)
+		if err != nil {
+			return nil, errcode.ErrMediaTranscode.Wrap(err)
+		}
+
+		if transcodedType != "" {
+			media.MimeType = transcodedType
+		}
+
+		return transcoded, nil
+
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+func isProcessedImage(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png"
+}
+
+func (svc *service) isTranscodedVideo(mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) bool {
+	return strings.HasPrefix(mimeType, "video/") && svc.mediaTranscoder != nil && quality != messengertypes.MediaProcessingPolicy_QualityOriginal
+}
+
+// isMediaPassthrough reports whether processMedia sends the content of a media as it is
+func (svc *service) isMediaPassthrough(mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) bool {
+	mimeType = strings.ToLower(mimeType)
+	return !isProcessedImage(mimeType) && !svc.isTranscodedVideo(mimeType, quality)
+}
+
+// processImage applies the image processors to an image, the steps failing are skipped
+func processImage(data []byte, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality, logger *zap.Logger) []byte {
+	for _, processor := range mediaImageProcessors {
+		processed, err := processor.process(data, mimeType, quality)
+		if err != nil {
+			logger.Warn("unable to process image", zap.String("step", processor.name), zap.String("mime-type", mimeType), zap.Error(err))
+			continue
+		}
+
+		data = processed
+	}
+
+	return data
+}
+
+func mediaImageMaxDimension(quality messengertypes.MediaProcessingPolicy_Quality) int {
+	switch quality {
+	case messengertypes.MediaProcessingPolicy_QualityOriginal:
+		return 0
+	case messengertypes.MediaProcessingPolicy_QualityLow:
+		return mediaLowImageMaxDimension
+	default:
+		return mediaStandardImageMaxDimension
+	}
+}
+
+func mediaJPEGQuality(quality messengertypes.MediaProcessingPolicy_Quality) int {
+	switch quality {
+	case messengertypes.MediaProcessingPolicy_QualityOriginal:
+		return mediaOriginalJPEGQuality
+	case messengertypes.MediaProcessingPolicy_QualityLow:
+		return mediaLowJPEGQuality
+	default:
+		return mediaStandardJPEGQuality
+	}
+}
+
+// transformImage rotates an image according to its Exif orientation, which is lost with the metadata, and downscales
+// it to the dimension of the quality. The image is only decoded when it has to be changed
+func transformImage(data []byte, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) ([]byte, error) {
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Width*config.Height > mediaProcessingMaxPixels {
+		return nil, fmt.Errorf("the image has more than %d pixels", mediaProcessingMaxPixels)
+	}
+
+	maxDimension := mediaImageMaxDimension(quality)
+	if orientation == 1 && (maxDimension == 0 || (config.Width <= maxDimension && config.Height <= maxDimension)) {
+		return data, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	rgba := orientImage(toRGBA(img), orientation)
+	if maxDimension > 0 {
+		rgba = downscaleImage(rgba, maxDimension)
+	}
+
+	var buf bytes.Buffer
+	if mimeType == "image/png" {
+		err = png.Encode(&buf, rgba)
+	} else {
+		err = jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: mediaJPEGQuality(quality)})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// toRGBA copies an image in an RGBA image whose bounds start at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+
+	return rgba
+}
+
+// orientImage applies an Exif orientation to an image so it is displayed the same without it
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated by 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated by 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:sy*src.Stride+sx*4+4])
+		}
+	}
+
+	return dst
+}
+
+// downscaleImage reduces an image so its largest side is at most maxDimension, each pixel is the average of the area
+// it covers in the original image
+func downscaleImage(src *image.RGBA, maxDimension int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxDimension && h <= maxDimension {
+		return src
+	}
+
+	dw, dh := maxDimension, maxDimension
+	if w >= h {
+		dh = h * maxDimension / w
+	} else {
+		dw = w * maxDimension / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				i := sy*src.Stride + x0*4
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += uint64(src.Pix[i+c])
+					}
+					i += 4
+				}
+			}
+
+			n := uint64((x1 - x0) * (y1 - y0))
+			j := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
+
+// stripImageMetadata removes the metadata of an image without decoding it
+func stripImageMetadata(data []byte, mimeType string, _ messengertypes.MediaProcessingPolicy_Quality) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// jpegSegment is a marker segment of a JPEG found before its image data, raw contains the marker
+type jpegSegment struct {
+	marker byte
+	raw    []byte
+}
+
+func (s jpegSegment) payload() []byte {
+	if len(s.raw) < 4 {
+		return nil
+	}
+
+	return s.raw[4:]
+}
+
+// jpegSegments splits a JPEG in its marker segments and the data starting by its first scan
+func jpegSegments(data []byte) ([]jpegSegment, []byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, fmt.Errorf("not a jpeg")
+	}
+
+	segments := []jpegSegment(nil)
+	pos := 2
+	for {
+		if pos+2 > len(data) || data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+
+		marker := data[pos+1]
+		switch {
+		// the markers can be preceded by fill bytes
+		case marker == 0xFF:
+			pos++
+			continue
+
+		// the entropy-coded data follow the start of scan up to the end of the image
+		case marker == 0xDA || marker == 0xD9:
+			return segments, data[pos:], nil
+
+		// the standalone markers have no length
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			segments = append(segments, jpegSegment{marker: marker, raw: data[pos : pos+2]})
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, nil, fmt.Errorf("truncated jpeg segment at %d", pos)
+		}
+
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end < pos+4 || end > len(data) {
+			return nil, nil, fmt.Errorf("invalid jpeg segment length at %d", pos)
+		}
+
+		segments = append(segments, jpegSegment{marker: marker, raw: data[pos:end]})
+		pos = end
+	}
+}
+
+// isJPEGMetadataSegment returns whether a segment of a JPEG holds metadata, the JFIF header, the color profile and the
+// Adobe segment are needed to render the image the same
+func isJPEGMetadataSegment(marker byte) bool {
+	switch marker {
+	case 0xE0, 0xE2, 0xEE:
+		return false
+	case 0xFE: // comment
+		return true
+	default:
+		// Exif and XMP in APP1, IPTC in APP13 and the vendor segments
+		return marker >= 0xE1 && marker <= 0xEF
+	}
+}
+
+// stripJPEGMetadata removes the segments holding metadata from a JPEG
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := bytes.NewBuffer(make([]byte, 0, len(data)))
+	stripped.Write(data[:2])
+	for _, segment := range segments {
+		if !isJPEGMetadataSegment(segment.marker) {
+			stripped.Write(segment.raw)
+		}
+	}
+	stripped.Write(scan)
+
+	return stripped.Bytes(), nil
+}
+
+// jpegOrientation returns the Exif orientation of a JPEG, 1 if it has none
+func jpegOrientation(data []byte) int {
+	segments, _, err := jpegSegments(data)
+	if err != nil {
+		return 1
+	}
+
+	for _, segment := range segments {
+		if payload := segment.payload(); segment.marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return exifOrientation(payload[6:])
+		}
+	}
+
+	return 1
+}
+
+// exifOrientation reads the orientation tag of the first IFD of an Exif TIFF structure, 1 if it has none
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		// the orientation is a short stored in the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+
+	return 1
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the ancillary chunks of a PNG holding text, Exif or the modification time
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata removes the chunks holding metadata from a PNG
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png")
+	}
+
+	stripped := bytes.NewBuffer(make([]byte, 0, len(data)))
+	stripped.Write(pngSignature)
+
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("truncated png chunk at %d", pos)
+		}
+
+		// length, type, data and crc
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end < pos+12 || end > len(data) {
+			return nil, fmt.Errorf("invalid png chunk length at %d", pos)
+		}
+
+		chunkType := string(data[pos+4 : pos+8])
+		if !pngMetadataChunks[chunkType] {
+			stripped.Write(data[pos:end])
+		}
+		pos = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return stripped.Bytes(), nil
+}
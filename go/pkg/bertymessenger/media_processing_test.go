@@ -0,0 +1,185 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	return img
+}
+
+// testExifSegment returns an APP1 segment with an Exif orientation
+func testExifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	payload := append(append([]byte("Exif\x00\x00"), tiff...), entry...)
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+
+	return append(segment, payload...)
+}
+
+func testJPEG(t *testing.T, w, h int, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, testImage(w, h), nil))
+
+	data := append([]byte(nil), buf.Bytes()[:2]...)
+	for _, segment := range segments {
+		data = append(data, segment...)
+	}
+
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func Test_resolveMediaQuality(t *testing.T) {
+	require.Equal(t, messengertypes.MediaProcessingPolicy_QualityStandard, resolveMediaQuality(nil, nil))
+
+	acc := &messengertypes.Account{MediaQuality: messengertypes.MediaProcessingPolicy_QualityLow}
+	require.Equal(t, messengertypes.MediaProcessingPolicy_QualityLow, resolveMediaQuality(acc, &messengertypes.Conversation{}))
+
+	conv := &messengertypes.Conversation{MediaQuality: messengertypes.MediaProcessingPolicy_QualityOriginal}
+	require.Equal(t, messengertypes.MediaProcessingPolicy_QualityOriginal, resolveMediaQuality(acc, conv))
+}
+
+func Test_stripJPEGMetadata(t *testing.T) {
+	comment := append([]byte{0xFF, 0xFE, 0x00, 0x07}, []byte("where")...)
+	data := testJPEG(t, 4, 2, testExifSegment(6), comment)
+	require.Equal(t, 6, jpegOrientation(data))
+
+	stripped, err := stripJPEGMetadata(data)
+	require.NoError(t, err)
+	require.Equal(t, 1, jpegOrientation(stripped))
+	require.False(t, bytes.Contains(stripped, []byte("Exif")))
+	require.False(t, bytes.Contains(stripped, []byte("where")))
+
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	require.NoError(t, err)
+
+	_, err = stripJPEGMetadata([]byte("not a jpeg"))
+	require.Error(t, err)
+}
+
+func Test_stripPNGMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(4, 2)))
+
+	// a text chunk is added before the end of the image
+	text := []byte("Author\x00alice")
+	chunk := make([]byte, 8, 12+len(text))
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, text...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc...)
+
+	data := buf.Bytes()
+	data = append(append(append([]byte(nil), data[:len(data)-12]...), chunk...), data[len(data)-12:]...)
+	_, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	stripped, err := stripPNGMetadata(data)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), stripped)
+}
+
+func Test_transformImage(t *testing.T) {
+	// an image rotated by the camera is rotated back
+	data := testJPEG(t, 4, 2, testExifSegment(6))
+	transformed, err := transformImage(data, "image/jpeg", messengertypes.MediaProcessingPolicy_QualityOriginal)
+	require.NoError(t, err)
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(transformed))
+	require.NoError(t, err)
+	require.Equal(t, 2, config.Width)
+	require.Equal(t, 4, config.Height)
+
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, testImage(3000, 1000)))
+
+	transformed, err = transformImage(buf.Bytes(), "image/png", messengertypes.MediaProcessingPolicy_QualityStandard)
+	require.NoError(t, err)
+
+	config, err = png.DecodeConfig(bytes.NewReader(transformed))
+	require.NoError(t, err)
+	require.Equal(t, mediaStandardImageMaxDimension, config.Width)
+	require.Equal(t, 682, config.Height)
+
+	// the original quality keeps the dimensions
+	transformed, err = transformImage(buf.Bytes(), "image/png", messengertypes.MediaProcessingPolicy_QualityOriginal)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), transformed)
+}
+
+type testMediaTranscoder struct {
+	quality messengertypes.MediaProcessingPolicy_Quality
+}
+
+func (tr *testMediaTranscoder) Transcode(ctx context.Context, r io.Reader, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) (io.ReadCloser, string, error) {
+	tr.quality = quality
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(data))), "video/mp4", nil
+}
+
+func Test_service_processMedia(t *testing.T) {
+	transcoder := &testMediaTranscoder{}
+	svc := &service{logger: zap.NewNop(), mediaTranscoder: transcoder}
+	ctx := context.Background()
+
+	media := &messengertypes.Media{MimeType: "video/quicktime"}
+	processed, err := svc.processMedia(ctx, strings.NewReader("video"), media, messengertypes.MediaProcessingPolicy_QualityLow)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(processed)
+	require.NoError(t, err)
+	require.Equal(t, "VIDEO", string(data))
+	require.Equal(t, "video/mp4", media.GetMimeType())
+	require.Equal(t, messengertypes.MediaProcessingPolicy_QualityLow, transcoder.quality)
+
+	// the original videos and the other files are kept as is
+	media = &messengertypes.Media{MimeType: "video/quicktime"}
+	processed, err = svc.processMedia(ctx, strings.NewReader("video"), media, messengertypes.MediaProcessingPolicy_QualityOriginal)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(processed)
+	require.NoError(t, err)
+	require.Equal(t, "video", string(data))
+
+	// the invalid images are sent as they are
+	media = &messengertypes.Media{MimeType: "image/jpeg"}
+	processed, err = svc.processMedia(ctx, strings.NewReader("image"), media, messengertypes.MediaProcessingPolicy_QualityStandard)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(processed)
+	require.NoError(t, err)
+	require.Equal(t, "image", string(data))
+}
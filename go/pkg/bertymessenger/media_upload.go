@@ -0,0 +1,422 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The large files prepared from an uri and sent as they are, ie. the videos not transcoded and the documents, are
+// uploaded in chunks: each chunk is encrypted and stored as its own attachment and the state of the upload is persisted
+// after each one, then a manifest listing the chunks is prepared as the attachment of the media. An interrupted upload
+// resumes from its last stored chunk when the file is prepared again or when the messenger restarts, the processed
+// medias are read again from the start.
+
+const (
+	mediaUploadChunkSize = 4 * 1024 * 1024
+	// mediaUploadMinSize is the size from which the files are uploaded in chunks
+	mediaUploadMinSize = 2 * mediaUploadChunkSize
+	// mediaManifestMaxSize bounds the manifest read before the chunks of a media are retrieved
+	mediaManifestMaxSize = 1024 * 1024
+)
+
+// mediaUploadLocks serializes the runs of each upload, ie. a file prepared again while its upload is being resumed
+type mediaUploadLocks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+// lock waits until the upload isn't run anymore, the returned func releases it
+func (l *mediaUploadLocks) lock(id string) func() {
+	for {
+		l.mu.Lock()
+		if l.held == nil {
+			l.held = map[string]chan struct{}{}
+		}
+
+		held, ok := l.held[id]
+		if !ok {
+			released := make(chan struct{})
+			l.held[id] = released
+			l.mu.Unlock()
+
+			return func() {
+				l.mu.Lock()
+				delete(l.held, id)
+				l.mu.Unlock()
+				close(released)
+			}
+		}
+		l.mu.Unlock()
+
+		<-held
+	}
+}
+
+// mediaUploadID identifies the upload of a file, the same file prepared again for the same client id and conversation
+// resumes it while it hasn't changed
+func mediaUploadID(clientID string, convPK string, path string, size int64, modTime int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%d", clientID, convPK, path, size, modTime)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// isChunkedUpload reports whether a file prepared from an uri is uploaded in chunks
+func (svc *service) isChunkedUpload(file *os.File, mimeType string, quality messengertypes.MediaProcessingPolicy_Quality) (os.FileInfo, bool) {
+	if !svc.isMediaPassthrough(mimeType, quality) {
+		return nil, false
+	}
+
+	stat, err := file.Stat()
+	if err != nil || !stat.Mode().IsRegular() || stat.Size() < mediaUploadMinSize {
+		return nil, false
+	}
+
+	return stat, true
+}
+
+// prepareChunkedMedia uploads a large file in chunks, resuming its previous upload if any, and returns its media
+func (svc *service) prepareChunkedMedia(ctx context.Context, header *messengertypes.MediaPrepare_Request, path string, stat os.FileInfo) (*messengertypes.Media, error) {
+	id := mediaUploadID(header.GetClientID(), header.GetConversationPublicKey(), path, stat.Size(), stat.ModTime().UnixNano())
+
+	if err := func() error {
+		defer svc.writer.enter()()
+
+		info, err := proto.Marshal(header.GetInfo())
+		if err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		now := timestampMs(time.Now())
+		return svc.db.addMediaUpload(&messengertypes.MediaUpload{
+			ID:                    id,
+			ClientID:              header.GetClientID(),
+			ConversationPublicKey: header.GetConversationPublicKey(),
+			Path:                  path,
+			FileSize:              stat.Size(),
+			FileModTime:           stat.ModTime().UnixNano(),
+			Info:                  info,
+			ChunkSize:             mediaUploadChunkSize,
+			ChunkCount:            uint32((stat.Size() + mediaUploadChunkSize - 1) / mediaUploadChunkSize),
+			State:                 messengertypes.MediaUpload_StateChunking,
+			CreatedDate:           now,
+			UpdatedDate:           now,
+		})
+	}(); err != nil {
+		return nil, err
+	}
+
+	upload, err := svc.runMediaUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	medias, err := svc.db.getMedias([]string{upload.GetMediaCID()})
+	if err != nil || len(medias) == 0 {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return medias[0], nil
+}
+
+// runMediaUpload moves an upload through its states until its manifest is published, it stops after the current chunk
+// when ctx is done and the upload is resumed later
+func (svc *service) runMediaUpload(ctx context.Context, id string) (*messengertypes.MediaUpload, error) {
+	defer svc.mediaUploads.lock(id)()
+
+	upload, err := svc.db.getMediaUpload(id)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if upload.GetState() == messengertypes.MediaUpload_StatePublished {
+		return upload, nil
+	}
+	if upload.GetState() == messengertypes.MediaUpload_StateFailed {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the upload can't be resumed: %s", upload.GetError()))
+	}
+
+	file, err := svc.openMediaUploadFile(upload)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	svc.logger.Info("media upload resumed", zap.String("upload", id), zap.Uint32("stored-chunks", upload.GetStoredChunks()), zap.Uint32("chunks", upload.GetChunkCount()))
+
+	for upload.GetState() != messengertypes.MediaUpload_StatePublished {
+		if err := ctx.Err(); err != nil {
+			return nil, errcode.ErrAttachmentPrepare.Wrap(err)
+		}
+
+		switch upload.GetState() {
+		case messengertypes.MediaUpload_StateChunking:
+			upload, err = svc.storeMediaUploadChunk(upload, file)
+		case messengertypes.MediaUpload_StateChunksStored:
+			upload, err = svc.publishMediaUpload(upload, file)
+		default:
+			err = errcode.ErrInternal.Wrap(fmt.Errorf("unexpected upload state %s", upload.GetState()))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		svc.dispatchMediaUpload(upload)
+	}
+
+	return upload, nil
+}
+
+// openMediaUploadFile opens the file of an upload, the upload fails if the file has been changed or removed since its
+// first chunk was stored
+func (svc *service) openMediaUploadFile(upload *messengertypes.MediaUpload) (*os.File, error) {
+	file, err := os.Open(upload.GetPath())
+	if os.IsNotExist(err) {
+		return nil, svc.failMediaUpload(upload, "the file has been removed")
+	}
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if stat.Size() != upload.GetFileSize() || stat.ModTime().UnixNano() != upload.GetFileModTime() {
+		file.Close()
+		return nil, svc.failMediaUpload(upload, "the file has been changed")
+	}
+
+	return file, nil
+}
+
+// storeMediaUploadChunk encrypts and stores the next chunk of an upload
+func (svc *service) storeMediaUploadChunk(upload *messengertypes.MediaUpload, file *os.File) (*messengertypes.MediaUpload, error) {
+	index := upload.GetStoredChunks()
+	if _, err := file.Seek(int64(index)*upload.GetChunkSize(), io.SeekStart); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	counter := &countingReader{reader: io.LimitReader(file, upload.GetChunkSize())}
+	cidBytes, err := svc.attachmentPrepare(counter)
+	if err != nil {
+		return nil, errcode.ErrAttachmentPrepare.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	return svc.db.addMediaUploadChunk(&messengertypes.MediaUploadChunk{
+		UploadID:   upload.GetID(),
+		ChunkIndex: index,
+		CID:        b64EncodeBytes(cidBytes),
+		Size_:      counter.count,
+	}, timestampMs(time.Now()))
+}
+
+// publishMediaUpload prepares the manifest of an upload whose chunks are stored and adds its media
+func (svc *service) publishMediaUpload(upload *messengertypes.MediaUpload, file *os.File) (*messengertypes.MediaUpload, error) {
+	// the checksum of the whole content is computed once, the file is local
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	chunks, err := svc.db.getMediaUploadChunks(upload.GetID())
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	manifest := &messengertypes.MediaManifest{Size_: upload.GetFileSize(), Checksum: hex.EncodeToString(hash.Sum(nil))}
+	for _, chunk := range chunks {
+		manifest.ChunkCIDs = append(manifest.ChunkCIDs, chunk.GetCID())
+	}
+
+	data, err := proto.Marshal(manifest)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	cidBytes, err := svc.attachmentPrepare(bytes.NewReader(data))
+	if err != nil {
+		return nil, errcode.ErrAttachmentPrepare.Wrap(err)
+	}
+
+	media := &messengertypes.Media{}
+	if err := proto.Unmarshal(upload.GetInfo(), media); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+	media.CID = b64EncodeBytes(cidBytes)
+	media.Size_ = manifest.GetSize_()
+	media.Checksum = manifest.GetChecksum()
+	media.Chunked = true
+	media.State = messengertypes.Media_StatePrepared
+
+	defer svc.writer.enter()()
+
+	var added []bool
+	if err := svc.db.tx(func(tx *dbWrapper) error {
+		if added, err = tx.addMedias([]*messengertypes.Media{media}); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		upload, err = tx.setMediaUploadPublished(upload.GetID(), media.GetCID(), timestampMs(time.Now()))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	if added[0] {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, true); err != nil {
+			svc.logger.Error("unable to dispatch notification for media", zap.String("cid", media.GetCID()), zap.Error(err))
+		}
+	}
+
+	svc.logger.Info("media upload published", zap.String("upload", upload.GetID()), zap.Uint32("chunks", upload.GetChunkCount()))
+
+	return upload, nil
+}
+
+// failMediaUpload marks an upload as not resumable, the returned error tells why
+func (svc *service) failMediaUpload(upload *messengertypes.MediaUpload, reason string) error {
+	defer svc.writer.enter()()
+
+	failed, err := svc.db.setMediaUploadFailed(upload.GetID(), reason, timestampMs(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	svc.dispatchMediaUpload(failed)
+
+	return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the upload can't be resumed: %s", reason))
+}
+
+func (svc *service) dispatchMediaUpload(upload *messengertypes.MediaUpload) {
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUploadUpdated, &messengertypes.StreamEvent_MediaUploadUpdated{Upload: upload}, false); err != nil {
+		svc.logger.Error("unable to dispatch media upload", zap.String("upload", upload.GetID()), zap.Error(err))
+	}
+}
+
+// resumeMediaUploads resumes the uploads interrupted by the last stop, one at a time
+func (svc *service) resumeMediaUploads(ctx context.Context) {
+	uploads, err := svc.db.getResumableMediaUploads()
+	if err != nil {
+		svc.logger.Error("unable to list the interrupted media uploads", zap.Error(err))
+		return
+	}
+
+	for _, upload := range uploads {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, err := svc.runMediaUpload(ctx, upload.GetID()); err != nil {
+			svc.logger.Warn("unable to resume media upload", zap.String("upload", upload.GetID()), zap.Error(err))
+		}
+	}
+}
+
+func (svc *service) MediaUploadList(ctx context.Context, req *messengertypes.MediaUploadList_Request) (*messengertypes.MediaUploadList_Reply, error) {
+	uploads, err := svc.db.getMediaUploads(req.GetClientID(), req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return &messengertypes.MediaUploadList_Reply{Uploads: uploads}, nil
+}
+
+// mediaContentRetrieve returns the content of a media, the attachments of the chunks of a chunked media are retrieved
+// one after the other
+func (svc *service) mediaContentRetrieve(media *messengertypes.Media) (io.ReadCloser, error) {
+	return svc.mediaContentRetrieveFrom(svc.ctx, media, nil)
+}
+
+// mediaContentRetrieveFrom returns the content of a media until ctx is done, providers are the peers known to hold it
+func (svc *service) mediaContentRetrieveFrom(ctx context.Context, media *messengertypes.Media, providers []string) (io.ReadCloser, error) {
+	attachment, err := svc.attachmentRetrieveFrom(ctx, media.GetCID(), providers)
+	if err != nil {
+		return nil, err
+	}
+	if !media.GetChunked() {
+		return attachment, nil
+	}
+	defer attachment.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(attachment, mediaManifestMaxSize))
+	if err != nil {
+		return nil, errcode.ErrStreamRead.Wrap(err)
+	}
+
+	manifest := &messengertypes.MediaManifest{}
+	if err := proto.Unmarshal(data, manifest); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return &mediaChunksReader{
+		cids: manifest.GetChunkCIDs(),
+		retrieve: func(cid string) (io.ReadCloser, error) {
+			return svc.attachmentRetrieveFrom(ctx, cid, providers)
+		},
+	}, nil
+}
+
+// mediaChunksReader reads the attachments of the chunks of a media in order, each one is only retrieved once the
+// previous one is read
+type mediaChunksReader struct {
+	cids     []string
+	retrieve func(cid string) (io.ReadCloser, error)
+	current  io.ReadCloser
+}
+
+func (r *mediaChunksReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.cids) == 0 {
+				return 0, io.EOF
+			}
+
+			current, err := r.retrieve(r.cids[0])
+			if err != nil {
+				return 0, errcode.ErrAttachmentRetrieve.Wrap(err)
+			}
+			r.current, r.cids = current, r.cids[1:]
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (r *mediaChunksReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+
+	return r.current.Close()
+}
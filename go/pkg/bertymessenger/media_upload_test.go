@@ -0,0 +1,155 @@
+package bertymessenger
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestMediaUploadStates(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	upload := &messengertypes.MediaUpload{ID: "upload_1", ClientID: "draft_1", ConversationPublicKey: "conv_1", ChunkCount: 2, State: messengertypes.MediaUpload_StateChunking}
+	require.NoError(t, db.addMediaUpload(upload))
+
+	// adding it again to resume it keeps its progress
+	_, err := db.addMediaUploadChunk(&messengertypes.MediaUploadChunk{UploadID: "upload_1", ChunkIndex: 0, CID: "chunk_1"}, 10)
+	require.NoError(t, err)
+	require.NoError(t, db.addMediaUpload(&messengertypes.MediaUpload{ID: "upload_1", State: messengertypes.MediaUpload_StateChunking}))
+
+	upload, err = db.getMediaUpload("upload_1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), upload.GetStoredChunks())
+	require.Equal(t, messengertypes.MediaUpload_StateChunking, upload.GetState())
+
+	// the chunks are stored in order
+	_, err = db.addMediaUploadChunk(&messengertypes.MediaUploadChunk{UploadID: "upload_1", ChunkIndex: 0, CID: "chunk_1"}, 20)
+	require.Error(t, err)
+
+	upload, err = db.addMediaUploadChunk(&messengertypes.MediaUploadChunk{UploadID: "upload_1", ChunkIndex: 1, CID: "chunk_2"}, 20)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.MediaUpload_StateChunksStored, upload.GetState())
+	require.Equal(t, int64(20), upload.GetUpdatedDate())
+
+	resumable, err := db.getResumableMediaUploads()
+	require.NoError(t, err)
+	require.Len(t, resumable, 1)
+
+	upload, err = db.setMediaUploadPublished("upload_1", "media_1", 30)
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.MediaUpload_StatePublished, upload.GetState())
+	require.Equal(t, "media_1", upload.GetMediaCID())
+
+	resumable, err = db.getResumableMediaUploads()
+	require.NoError(t, err)
+	require.Empty(t, resumable)
+
+	cids, err := db.getMediaUploadChunkCIDs([]string{"media_other", "media_1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"chunk_1", "chunk_2"}, cids)
+
+	uploads, err := db.getMediaUploads("draft_1", "")
+	require.NoError(t, err)
+	require.Len(t, uploads, 1)
+
+	uploads, err = db.getMediaUploads("", "conv_2")
+	require.NoError(t, err)
+	require.Empty(t, uploads)
+}
+
+func TestMediaUploadChangedFile(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	f, err := ioutil.TempFile("", "media-upload")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("content")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	stat, err := os.Stat(f.Name())
+	require.NoError(t, err)
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+	upload := &messengertypes.MediaUpload{ID: "upload_1", Path: f.Name(), FileSize: stat.Size(), FileModTime: stat.ModTime().UnixNano(), ChunkCount: 1, State: messengertypes.MediaUpload_StateChunking}
+	require.NoError(t, db.addMediaUpload(upload))
+
+	file, err := svc.openMediaUploadFile(upload)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// a file changed since its upload started can't be resumed
+	require.NoError(t, os.Chtimes(f.Name(), time.Now(), stat.ModTime().Add(time.Hour)))
+	_, err = svc.openMediaUploadFile(upload)
+	require.Error(t, err)
+
+	upload, err = db.getMediaUpload("upload_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.MediaUpload_StateFailed, upload.GetState())
+	require.Equal(t, "the file has been changed", upload.GetError())
+
+	_, err = svc.runMediaUpload(context.Background(), "upload_1")
+	require.Error(t, err)
+}
+
+func Test_mediaChunksReader(t *testing.T) {
+	chunks := map[string]string{"chunk_1": "hello ", "chunk_2": "", "chunk_3": "world"}
+	retrieved := []string(nil)
+
+	reader := &mediaChunksReader{
+		cids: []string{"chunk_1", "chunk_2", "chunk_3"},
+		retrieve: func(cid string) (io.ReadCloser, error) {
+			retrieved = append(retrieved, cid)
+			return ioutil.NopCloser(strings.NewReader(chunks[cid])), nil
+		},
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(content))
+	require.Equal(t, []string{"chunk_1", "chunk_2", "chunk_3"}, retrieved)
+	require.NoError(t, reader.Close())
+}
+
+func Test_mediaUploadLocks(t *testing.T) {
+	var locks mediaUploadLocks
+
+	release := locks.lock("upload_1")
+	locks.lock("upload_2")()
+
+	acquired := make(chan struct{})
+	go func() {
+		locks.lock("upload_1")()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("the upload is run twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-acquired
+}
+
+func Test_isMediaPassthrough(t *testing.T) {
+	svc := &service{}
+	require.True(t, svc.isMediaPassthrough("application/pdf", messengertypes.MediaProcessingPolicy_QualityStandard))
+	require.True(t, svc.isMediaPassthrough("video/mp4", messengertypes.MediaProcessingPolicy_QualityStandard))
+	require.False(t, svc.isMediaPassthrough("IMAGE/JPEG", messengertypes.MediaProcessingPolicy_QualityOriginal))
+
+	require.Equal(t, mediaUploadID("draft_1", "conv_1", "/file", 10, 1), mediaUploadID("draft_1", "conv_1", "/file", 10, 1))
+	require.NotEqual(t, mediaUploadID("draft_1", "conv_1", "/file", 10, 1), mediaUploadID("draft_1", "conv_1", "/file", 10, 2))
+}
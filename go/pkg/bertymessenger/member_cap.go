@@ -0,0 +1,112 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The maximum number of members of a group is set by its admins and shared with the members as group metadata. It is
+// enforced when inviting: the contacts can't be invited and the invitation links can't be created once the group is
+// full, and the members who joined a full group with a link of this node are removed. Lowering the maximum below the
+// current count keeps the existing members, the group stays full until enough of them leave.
+
+// groupCapacityInfo returns the capacity info of a group with the given maximum and count of members
+func groupCapacityInfo(maxMembers int32, memberCount int64) *messengertypes.GroupCapacityInfo {
+	return &messengertypes.GroupCapacityInfo{
+		MaxMembers:  maxMembers,
+		MemberCount: memberCount,
+		IsFull:      maxMembers > 0 && memberCount >= int64(maxMembers),
+	}
+}
+
+// checkGroupCapacity refuses to invite the given number of new members to a full group
+func checkGroupCapacity(conv *messengertypes.Conversation, invited int) error {
+	capacity := conv.GetCapacityInfo()
+	if capacity.GetMaxMembers() == 0 {
+		return nil
+	}
+
+	if capacity.GetMemberCount()+int64(invited) > int64(capacity.GetMaxMembers()) {
+		return errcode.ErrGroupFull.Wrap(fmt.Errorf("the group has %d members out of %d", capacity.GetMemberCount(), capacity.GetMaxMembers()))
+	}
+
+	return nil
+}
+
+// isGroupOverCapacity checks whether a group has more members than its maximum, the member who just joined included
+func isGroupOverCapacity(tx *dbWrapper, conv *messengertypes.Conversation) (bool, error) {
+	if conv.GetMaxMembers() == 0 {
+		return false, nil
+	}
+
+	counts, err := tx.getGroupMemberCounts([]string{conv.GetPublicKey()})
+	if err != nil {
+		return false, err
+	}
+
+	return counts[conv.GetPublicKey()] > int64(conv.GetMaxMembers()), nil
+}
+
+func (h *eventHandler) handleAppMessageSetMemberCap(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetMemberCap)
+	if payload.GetMaxMembers() < 0 {
+		h.logger.Warn("ignoring a negative member cap", zap.String("cid", i.GetCID()), zap.Int32("max-members", payload.GetMaxMembers()))
+		return i, false, nil
+	}
+
+	if allowed, err := h.isModerationMessageAllowed(tx, i); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("ignoring member cap sent by a non admin member", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	details := strconv.Itoa(int(payload.GetMaxMembers()))
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeMemberCapChanged, "", details); err != nil {
+		return nil, false, err
+	}
+
+	conv, updated, err := tx.setConversationMemberCap(i.GetConversationPublicKey(), payload.GetMaxMembers(), interactionClock(i))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated && h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (svc *service) ConversationSetMemberCap(ctx context.Context, req *messengertypes.ConversationSetMemberCap_Request) (*messengertypes.ConversationSetMemberCap_Reply, error) {
+	if req.GetMaxMembers() < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the maximum number of members can't be negative"))
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.getModeratedConversation(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetMemberCap, &messengertypes.AppMessage_SetMemberCap{
+		MaxMembers: req.GetMaxMembers(),
+	}); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationSetMemberCap_Reply{
+		CapacityInfo: groupCapacityInfo(req.GetMaxMembers(), conv.GetCapacityInfo().GetMemberCount()),
+	}, nil
+}
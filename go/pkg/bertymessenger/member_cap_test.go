@@ -0,0 +1,103 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageSetMemberCap(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+	_, err = db.addMember("member_2", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	set := func(cid, memberPK string, lamportTime uint64, maxMembers int32) *messengertypes.Conversation {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageSetMemberCap(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, LamportTime: lamportTime}, &messengertypes.AppMessage_SetMemberCap{MaxMembers: maxMembers})
+		require.NoError(t, err)
+
+		conv, err = db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv
+	}
+
+	conv := set("cid_1", "member_1", 1, 2)
+	require.Zero(t, conv.GetMaxMembers())
+	require.Equal(t, &messengertypes.GroupCapacityInfo{MemberCount: 3}, conv.GetCapacityInfo())
+	require.NoError(t, checkGroupCapacity(conv, 10))
+
+	conv = set("cid_2", "member_admin", 3, 4)
+	require.Equal(t, &messengertypes.GroupCapacityInfo{MaxMembers: 4, MemberCount: 3}, conv.GetCapacityInfo())
+	require.NoError(t, checkGroupCapacity(conv, 1))
+	require.True(t, errcode.Is(checkGroupCapacity(conv, 2), errcode.ErrGroupFull))
+
+	// an older change doesn't replace the current cap
+	conv = set("cid_3", "member_admin", 2, 10)
+	require.Equal(t, int32(4), conv.GetMaxMembers())
+
+	// the existing members are kept when the cap is lowered below their count
+	conv = set("cid_4", "member_admin", 4, 2)
+	require.Equal(t, &messengertypes.GroupCapacityInfo{MaxMembers: 2, MemberCount: 3, IsFull: true}, conv.GetCapacityInfo())
+
+	conv = set("cid_5", "member_admin", 5, -1)
+	require.Equal(t, int32(2), conv.GetMaxMembers())
+
+	// the removed members don't count
+	err = db.setMemberModeration(&messengertypes.Member{PublicKey: "member_2", ConversationPublicKey: "conv_1", RemovedDate: 100, RemovedClock: testClock(100)})
+	require.NoError(t, err)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, &messengertypes.GroupCapacityInfo{MaxMembers: 2, MemberCount: 2, IsFull: true}, conv.GetCapacityInfo())
+
+	audit, err := db.getGroupAuditEvents("conv_1", []messengertypes.GroupAuditEvent_Type{messengertypes.GroupAuditEvent_TypeMemberCapChanged}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, audit, 3)
+}
+
+func Test_eventHandler_handleAppMessageGroupInvitationLinkUsedOverCapacity(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, MaxMembers: 2}).Error)
+	require.NoError(t, db.addGroupInvitationLink(&messengertypes.GroupInvitationLink{ID: "invitation_1", ConversationPublicKey: "conv_1", CreatedDate: 10}))
+	_, err := db.addMember("member_admin", "conv_1", "", "", true, true)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	join := func(cid, memberPK string) {
+		_, err := db.addMember(memberPK, "conv_1", "", "", false, false)
+		require.NoError(t, err)
+
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		_, _, err = h.handleAppMessageGroupInvitationLinkUsed(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, SentDate: 100}, &messengertypes.AppMessage_GroupInvitationLinkUsed{InvitationID: "invitation_1"})
+		require.NoError(t, err)
+	}
+
+	join("cid_1", "member_1")
+	join("cid_2", "member_2")
+
+	invitation, err := db.getGroupInvitationLink("invitation_1")
+	require.NoError(t, err)
+	require.Len(t, invitation.Uses, 2)
+	for _, use := range invitation.Uses {
+		require.Equal(t, use.MemberPublicKey == "member_2", use.Rejected, use.MemberPublicKey)
+	}
+}
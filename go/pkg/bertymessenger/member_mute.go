@@ -0,0 +1,80 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The members of a group can be muted on this node only, their messages are still received and stored but are flagged
+// as muted, they are neither counted as unread nor notified and the interaction lists leave them out unless requested.
+// Unlike a block, the mute is scoped to a single conversation and the member isn't told.
+
+func (svc *service) MemberMute(ctx context.Context, req *messengertypes.MemberMute_Request) (*messengertypes.MemberMute_Reply, error) {
+	conv, err := svc.setMemberMuted(req.GetConversationPublicKey(), req.GetMemberPublicKey(), true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MemberMute_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) MemberUnmute(ctx context.Context, req *messengertypes.MemberUnmute_Request) (*messengertypes.MemberUnmute_Reply, error) {
+	conv, err := svc.setMemberMuted(req.GetConversationPublicKey(), req.GetMemberPublicKey(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MemberUnmute_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) MemberMuteList(ctx context.Context, req *messengertypes.MemberMuteList_Request) (*messengertypes.MemberMuteList_Reply, error) {
+	members, err := svc.db.getMutedMembers(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.MemberMuteList_Reply{Members: members}, nil
+}
+
+func (svc *service) setMemberMuted(convPK, memberPK string, muted bool) (*messengertypes.Conversation, error) {
+	if convPK == "" || memberPK == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the members of a group can be muted"))
+	}
+
+	if conv.GetAccountMemberPublicKey() == memberPK {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("can't mute yourself"))
+	}
+
+	conv, interactions, err := svc.db.setMemberMuted(convPK, memberPK, muted)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range interactions {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, false); err != nil {
+			svc.logger.Error("unable to dispatch interaction update", zap.String("cid", i.GetCID()), zap.Error(err))
+		}
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		svc.logger.Error("unable to dispatch conversation update", logGroup(convPK), zap.Error(err))
+	}
+
+	return conv, nil
+}
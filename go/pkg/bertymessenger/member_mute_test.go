@@ -0,0 +1,61 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_setMemberMuted(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, UnreadCount: 3}).Error)
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", LamportTime: 1, SentDate: 1000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_2", ConversationPublicKey: "conv_1", LamportTime: 2, SentDate: 2000, MemberPublicKey: "member_2", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "cid_3", ConversationPublicKey: "conv_1", LamportTime: 3, SentDate: 3000, MemberPublicKey: "member_1", Type: messengertypes.AppMessage_TypeUserMessage},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	conv, interactions, err := db.setMemberMuted("conv_1", "member_1", true)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.True(t, interactions[0].GetIsMemberMuted())
+	require.Equal(t, int32(1), conv.GetUnreadCount())
+
+	muted, err := db.isMemberMuted("conv_1", "member_1")
+	require.NoError(t, err)
+	require.True(t, muted)
+
+	members, err := db.getMutedMembers("")
+	require.NoError(t, err)
+	require.Len(t, members, 1)
+
+	// the messages of the muted members are only listed when requested
+	listed, err := db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.Equal(t, "cid_2", listed[0].GetCID())
+
+	listed, err = db.getPaginatedInteractions("conv_1", true, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, listed, 3)
+
+	// the unread count isn't raised again when the member is unmuted
+	conv, interactions, err = db.setMemberMuted("conv_1", "member_1", false)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.False(t, interactions[0].GetIsMemberMuted())
+	require.Equal(t, int32(1), conv.GetUnreadCount())
+
+	muted, err = db.isMemberMuted("conv_1", "member_1")
+	require.NoError(t, err)
+	require.False(t, muted)
+
+	_, _, err = db.setMemberMuted("conv_2", "member_1", true)
+	require.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package bertymessenger
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// parseMentions finds the @display_name of the members in a message body, a mention starts the body or follows a space
+// and can't be followed by a letter or a digit
+func parseMentions(body string, members []*messengertypes.Member) []*messengertypes.AppMessage_UserMessage_Mention {
+	candidates := []*messengertypes.Member(nil)
+	for _, member := range members {
+		if !member.GetIsMe() && member.GetDisplayName() != "" {
+			candidates = append(candidates, member)
+		}
+	}
+
+	// the longest names first, a name prefixing another one doesn't hide it
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return len([]rune(candidates[i].GetDisplayName())) > len([]rune(candidates[j].GetDisplayName()))
+	})
+
+	runes := []rune(body)
+	mentions := []*messengertypes.AppMessage_UserMessage_Mention(nil)
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && !unicode.IsSpace(runes[i-1])) {
+			continue
+		}
+
+		for _, member := range candidates {
+			name := []rune(member.GetDisplayName())
+			end := i + 1 + len(name)
+			if end > len(runes) || !strings.EqualFold(string(runes[i+1:end]), string(name)) {
+				continue
+			}
+
+			if end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end])) {
+				continue
+			}
+
+			mentions = append(mentions, &messengertypes.AppMessage_UserMessage_Mention{
+				MemberPublicKey: member.GetPublicKey(),
+				Offset:          uint32(i),
+				Length:          uint32(end - i),
+			})
+			i = end - 1
+			break
+		}
+	}
+
+	return mentions
+}
+
+// getInteractionMentions returns the index entries of the members mentioned by a message
+func (h *eventHandler) getInteractionMentions(i *messengertypes.Interaction, um *messengertypes.AppMessage_UserMessage) ([]*messengertypes.Mention, error) {
+	if len(um.GetMentions()) == 0 {
+		return nil, nil
+	}
+
+	gpk, err := b64DecodeBytes(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	gi, err := h.protocolClient.GroupInfo(h.ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		return nil, errcode.ErrGroupInfo.Wrap(err)
+	}
+
+	ownMemberPK := b64EncodeBytes(gi.GetMemberPK())
+
+	mentions := []*messengertypes.Mention(nil)
+	seen := map[string]bool{}
+	for _, mention := range um.GetMentions() {
+		pk := mention.GetMemberPublicKey()
+		if pk == "" || seen[pk] {
+			continue
+		}
+		seen[pk] = true
+
+		mentions = append(mentions, &messengertypes.Mention{
+			InteractionCID:        i.GetCID(),
+			MemberPublicKey:       pk,
+			ConversationPublicKey: i.GetConversationPublicKey(),
+			IsMe:                  pk == ownMemberPK,
+			SentDate:              i.GetSentDate(),
+		})
+	}
+
+	return mentions, nil
+}
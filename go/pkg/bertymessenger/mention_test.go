@@ -0,0 +1,74 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestParseMentions(t *testing.T) {
+	members := []*messengertypes.Member{
+		{PublicKey: "pk_me", DisplayName: "Me", IsMe: true},
+		{PublicKey: "pk_alice", DisplayName: "Alice"},
+		{PublicKey: "pk_alice_b", DisplayName: "Alice B"},
+		{PublicKey: "pk_bob", DisplayName: "Bob"},
+		{PublicKey: "pk_empty"},
+	}
+
+	cases := []struct {
+		body     string
+		expected []*messengertypes.AppMessage_UserMessage_Mention
+	}{
+		{"hello", nil},
+		{"@Bob hi", []*messengertypes.AppMessage_UserMessage_Mention{{MemberPublicKey: "pk_bob", Offset: 0, Length: 4}}},
+		{"hi @bob!", []*messengertypes.AppMessage_UserMessage_Mention{{MemberPublicKey: "pk_bob", Offset: 3, Length: 4}}},
+		{"hi @Alice B and @Alice", []*messengertypes.AppMessage_UserMessage_Mention{
+			{MemberPublicKey: "pk_alice_b", Offset: 3, Length: 8},
+			{MemberPublicKey: "pk_alice", Offset: 16, Length: 6},
+		}},
+		{"été @Bob", []*messengertypes.AppMessage_UserMessage_Mention{{MemberPublicKey: "pk_bob", Offset: 4, Length: 4}}},
+		{"mail@Bob @Bobby @Me", nil},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, parseMentions(c.body, members), c.body)
+	}
+}
+
+func Test_dbWrapper_getMentionedInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", SentDate: 1000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_2", SentDate: 2000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_1", SentDate: 3000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_4", ConversationPublicKey: "conv_1", SentDate: 4000, IsSenderBlocked: true}).Error)
+
+	require.NoError(t, db.addMentions([]*messengertypes.Mention{
+		{InteractionCID: "cid_1", MemberPublicKey: "pk_me", ConversationPublicKey: "conv_1", IsMe: true},
+		{InteractionCID: "cid_1", MemberPublicKey: "pk_bob", ConversationPublicKey: "conv_1"},
+		{InteractionCID: "cid_2", MemberPublicKey: "pk_me", ConversationPublicKey: "conv_2", IsMe: true},
+		{InteractionCID: "cid_3", MemberPublicKey: "pk_bob", ConversationPublicKey: "conv_1"},
+		{InteractionCID: "cid_4", MemberPublicKey: "pk_me", ConversationPublicKey: "conv_1", IsMe: true},
+	}))
+
+	// adding the same mentions again is a noop
+	require.NoError(t, db.addMentions([]*messengertypes.Mention{{InteractionCID: "cid_1", MemberPublicKey: "pk_me", ConversationPublicKey: "conv_1", IsMe: true}}))
+
+	interactions, err := db.getMentionedInteractions("", 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.Equal(t, "cid_2", interactions[0].GetCID())
+	require.Equal(t, "cid_1", interactions[1].GetCID())
+
+	interactions, err = db.getMentionedInteractions("conv_1", 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+
+	interactions, err = db.getMentionedInteractions("", 1)
+	require.NoError(t, err)
+	require.Len(t, interactions, 1)
+}
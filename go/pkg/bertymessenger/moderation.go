@@ -0,0 +1,305 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// postingAppMessageTypes are the app messages refused from regular members when the posting is restricted
+var postingAppMessageTypes = map[messengertypes.AppMessage_Type]struct{}{
+	messengertypes.AppMessage_TypeUserMessage:     {},
+	messengertypes.AppMessage_TypeUserReaction:    {},
+	messengertypes.AppMessage_TypeGroupInvitation: {},
+	messengertypes.AppMessage_TypeReplyOptions:    {},
+	messengertypes.AppMessage_TypeLocation:        {},
+	messengertypes.AppMessage_TypePollCreate:      {},
+	messengertypes.AppMessage_TypeBoardEntrySet:   {},
+}
+
+// pendingMemberAppMessageTypes are the app messages accepted from the members waiting for an approval, the admins
+// know who they are and which link they used
+var pendingMemberAppMessageTypes = map[messengertypes.AppMessage_Type]struct{}{
+	messengertypes.AppMessage_TypeSetUserInfo:             {},
+	messengertypes.AppMessage_TypeGroupInvitationLinkUsed: {},
+}
+
+// interactionSenderMemberPK returns the member public key of the sender of an interaction in a multi member group
+func interactionSenderMemberPK(i *messengertypes.Interaction) string {
+	if i.GetIsMe() {
+		return i.GetConversation().GetAccountMemberPublicKey()
+	}
+
+	return i.GetMemberPublicKey()
+}
+
+// isModerationMessageAllowed checks that a moderation message has been sent by an admin of the group at its position
+// in the group log, the messages sent by the local node have already been checked before being sent
+func (h *eventHandler) isModerationMessageAllowed(tx *dbWrapper, i *messengertypes.Interaction) (bool, error) {
+	if i.GetConversation().GetType() != messengertypes.Conversation_MultiMemberType {
+		return false, nil
+	}
+
+	if i.GetIsMe() {
+		return true, nil
+	}
+
+	return tx.isConversationAdminAt(i.GetConversationPublicKey(), i.GetMemberPublicKey(), interactionClock(i))
+}
+
+// applyModerationMessage records a moderation message in the moderation log of its group then applies the state
+// folded from the whole log, it returns false when the sender wasn't an admin at the position of the message in the
+// log, the message still applies later if a role change ordered before it is received
+func (h *eventHandler) applyModerationMessage(tx *dbWrapper, i *messengertypes.Interaction, t messengertypes.AppMessage_Type, payload proto.Message) (bool, error) {
+	if i.GetConversation().GetType() != messengertypes.Conversation_MultiMemberType {
+		return false, nil
+	}
+
+	data, err := proto.Marshal(payload)
+	if err != nil {
+		return false, errcode.ErrSerialization.Wrap(err)
+	}
+
+	clock := interactionClock(i)
+	if _, err := tx.addModerationEvent(&messengertypes.ModerationEvent{
+		CID:                   i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Clock:                 clock,
+		MemberPublicKey:       interactionSenderMemberPK(i),
+		Type:                  t,
+		Payload:               data,
+		SentDate:              i.GetSentDate(),
+	}); err != nil {
+		return false, err
+	}
+
+	allowed, err := tx.isConversationAdminAt(i.GetConversationPublicKey(), interactionSenderMemberPK(i), clock)
+	if err != nil {
+		return false, err
+	}
+
+	if err := h.applyModeration(tx, i.GetConversationPublicKey()); err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// applyModeration applies the moderation state folded from the log of a group and streams the changes
+func (h *eventHandler) applyModeration(tx *dbWrapper, convPK string) error {
+	members, conv, err := tx.resolveModeration(convPK)
+	if err != nil {
+		return err
+	}
+
+	if h.svc != nil {
+		for _, member := range members {
+			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberUpdated, &messengertypes.StreamEvent_MemberUpdated{Member: member}, false); err != nil {
+				return err
+			}
+		}
+
+		if conv != nil {
+			if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(members) > 0 {
+		return h.refreshConversationMembers(tx, convPK)
+	}
+
+	return nil
+}
+
+func (h *eventHandler) handleAppMessageSetGroupInfo(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetGroupInfo)
+	if err := payload.IsValid(); err != nil {
+		h.logger.Warn("ignoring invalid group info", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	previousName := i.GetConversation().GetDisplayName()
+	if allowed, err := h.applyModerationMessage(tx, i, messengertypes.AppMessage_TypeSetGroupInfo, payload); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("group info sent by a non admin member, kept until a role change makes it valid", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeGroupInfoChanged, "", payload.GetDisplayName()); err != nil {
+		return nil, false, err
+	}
+
+	conv, err := tx.getConversationByPK(i.GetConversationPublicKey())
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the profile is replaced as a whole, only the changes of the name are rendered in the timeline
+	if conv.GetInfoClock() == interactionClock(i) && payload.GetDisplayName() != previousName {
+		if err := h.addInteractionSystemEvent(tx, i, &messengertypes.AppMessage_SystemEvent{Type: messengertypes.AppMessage_SystemEvent_TypeGroupRenamed, DisplayName: payload.GetDisplayName()}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageSetMemberRole(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetMemberRole)
+
+	if allowed, err := h.applyModerationMessage(tx, i, messengertypes.AppMessage_TypeSetMemberRole, payload); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("member role sent by a non admin member, kept until a role change makes it valid", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypeMemberRoleChanged, payload.GetMemberPublicKey(), payload.GetRole().String()); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageRemoveMember(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_RemoveMember)
+
+	if allowed, err := h.applyModerationMessage(tx, i, messengertypes.AppMessage_TypeRemoveMember, payload); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("member removal sent by a non admin member, kept until a role change makes it valid", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	auditType, systemType := messengertypes.GroupAuditEvent_TypeMemberRemoved, messengertypes.AppMessage_SystemEvent_TypeMemberRemoved
+	if payload.GetMemberPublicKey() == interactionSenderMemberPK(i) {
+		auditType, systemType = messengertypes.GroupAuditEvent_TypeMemberLeft, messengertypes.AppMessage_SystemEvent_TypeMemberLeft
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, auditType, payload.GetMemberPublicKey(), ""); err != nil {
+		return nil, false, err
+	}
+
+	if err := h.addInteractionSystemEvent(tx, i, &messengertypes.AppMessage_SystemEvent{Type: systemType, MemberPublicKey: payload.GetMemberPublicKey()}); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessageSetPostingRestricted(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_SetPostingRestricted)
+
+	if allowed, err := h.applyModerationMessage(tx, i, messengertypes.AppMessage_TypeSetPostingRestricted, payload); err != nil {
+		return nil, false, err
+	} else if !allowed {
+		h.logger.Warn("posting restriction sent by a non admin member, kept until a role change makes it valid", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.addGroupAuditEvent(tx, i, messengertypes.GroupAuditEvent_TypePostingRestrictionChanged, "", strconv.FormatBool(payload.GetRestricted())); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+// getModeratedConversation returns a group the local account is an admin of
+func (svc *service) getModeratedConversation(convPK string) (*messengertypes.Conversation, error) {
+	if convPK == "" {
+		return nil, errcode.ErrMissingInput.Wrap(fmt.Errorf("a conversation public key is required"))
+	}
+
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if conv.GetType() != messengertypes.Conversation_MultiMemberType {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only multi member groups can be moderated"))
+	}
+
+	if admin, err := svc.db.isConversationAdmin(convPK, conv.GetAccountMemberPublicKey()); err != nil {
+		return nil, err
+	} else if !admin {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the admins of a group can moderate it"))
+	}
+
+	return conv, nil
+}
+
+// sendModerationMessage sends a moderation message, or any app message shared with the whole group, as group
+// metadata, it is applied when received back from the group
+func (svc *service) sendModerationMessage(ctx context.Context, conv *messengertypes.Conversation, t messengertypes.AppMessage_Type, payload proto.Message) error {
+	gpk, err := b64DecodeBytes(conv.GetPublicKey())
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	am, err := t.MarshalPayload(timestampMs(time.Now()), nil, payload)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	if _, err := svc.protocolClient.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{GroupPK: gpk, Payload: am}); err != nil {
+		return errcode.ErrProtocolSend.Wrap(err)
+	}
+
+	return nil
+}
+
+func (svc *service) sendConversationProfile(ctx context.Context, conv *messengertypes.Conversation, profile *messengertypes.AppMessage_SetGroupInfo) error {
+	if err := profile.IsValid(); err != nil {
+		return err
+	}
+
+	return svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeSetGroupInfo, profile)
+}
+
+func (svc *service) removeGroupMember(ctx context.Context, convPK, memberPK string) error {
+	conv, err := svc.getModeratedConversation(convPK)
+	if err != nil {
+		return err
+	}
+
+	if err := svc.checkModerationTarget(conv, memberPK); err != nil {
+		return err
+	}
+
+	return svc.sendModerationMessage(ctx, conv, messengertypes.AppMessage_TypeRemoveMember, &messengertypes.AppMessage_RemoveMember{
+		MemberPublicKey: memberPK,
+	})
+}
+
+// checkModerationTarget ensures a moderation action can be applied to a member of the group
+func (svc *service) checkModerationTarget(conv *messengertypes.Conversation, memberPK string) error {
+	if memberPK == "" {
+		return errcode.ErrMissingInput.Wrap(fmt.Errorf("a member public key is required"))
+	}
+
+	if memberPK == conv.GetAccountMemberPublicKey() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("cannot moderate yourself"))
+	}
+
+	member, err := svc.db.getMemberByPK(memberPK, conv.GetPublicKey())
+	if err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	if member.GetIsCreator() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the creator of a group cannot be moderated"))
+	}
+
+	return nil
+}
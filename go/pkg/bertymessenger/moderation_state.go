@@ -0,0 +1,255 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// moderationVersion is the sent date and the position in the group log of the message which set a moderation value
+type moderationVersion struct {
+	date  int64
+	clock string
+}
+
+// moderationState is the moderation state of a group folded from its moderation messages in the order of the group
+// log, each message is authorized against the state resulting from the messages ordered before it.
+//
+// A message received late, a role change for example, can change the authorization of the messages ordered after it,
+// so the state is folded again from the whole log instead of being updated in place, every device then ends up with
+// the same roles, removals, posting restriction and group profile whatever the order in which it received them.
+type moderationState struct {
+	creators map[string]bool
+	// members are the senders and the targets of the moderation messages
+	members map[string]bool
+
+	roles        map[string]messengertypes.Member_Role
+	roleVersions map[string]moderationVersion
+	removals     map[string]moderationVersion
+
+	// restriction is the version of the first restriction still in effect, its clock is empty when posting is open
+	restriction moderationVersion
+
+	// profile is nil when no group profile has been authorized
+	profile        *messengertypes.AppMessage_SetGroupInfo
+	profileVersion moderationVersion
+}
+
+func newModerationState(members []*messengertypes.Member) *moderationState {
+	state := &moderationState{
+		creators:     make(map[string]bool),
+		members:      make(map[string]bool),
+		roles:        make(map[string]messengertypes.Member_Role),
+		roleVersions: make(map[string]moderationVersion),
+		removals:     make(map[string]moderationVersion),
+	}
+
+	for _, member := range members {
+		if member.GetIsCreator() {
+			state.creators[member.GetPublicKey()] = true
+		}
+	}
+
+	return state
+}
+
+// isAdmin returns true for the creators and the admins who haven't been removed
+func (s *moderationState) isAdmin(memberPK string) bool {
+	if _, ok := s.removals[memberPK]; ok {
+		return false
+	}
+
+	return s.creators[memberPK] || s.roles[memberPK] == messengertypes.Member_RoleAdmin
+}
+
+// apply folds a moderation message into the state, it returns false when its sender wasn't an admin at its position
+// in the log
+func (s *moderationState) apply(event *messengertypes.ModerationEvent) (bool, error) {
+	am := messengertypes.AppMessage{Type: event.GetType(), Payload: event.GetPayload()}
+	payload, err := am.UnmarshalPayload()
+	if err != nil {
+		return false, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	// the members are known from the messages even when they don't apply, so that the members of the group don't
+	// depend on the order of the messages either
+	s.members[event.GetMemberPublicKey()] = true
+	if target, ok := payload.(interface{ GetMemberPublicKey() string }); ok {
+		s.members[target.GetMemberPublicKey()] = true
+	}
+
+	if !s.isAdmin(event.GetMemberPublicKey()) {
+		return false, nil
+	}
+
+	version := moderationVersion{date: event.GetSentDate(), clock: event.GetClock()}
+
+	switch payload := payload.(type) {
+	case *messengertypes.AppMessage_SetGroupInfo:
+		s.profile, s.profileVersion = payload, version
+
+	case *messengertypes.AppMessage_SetMemberRole:
+		// the creator always stays an admin
+		if !s.creators[payload.GetMemberPublicKey()] {
+			s.roles[payload.GetMemberPublicKey()] = payload.GetRole()
+			s.roleVersions[payload.GetMemberPublicKey()] = version
+		}
+
+	case *messengertypes.AppMessage_RemoveMember:
+		// the creator can't be removed, the earliest removal wins
+		if _, ok := s.removals[payload.GetMemberPublicKey()]; !ok && !s.creators[payload.GetMemberPublicKey()] {
+			s.removals[payload.GetMemberPublicKey()] = version
+		}
+
+	case *messengertypes.AppMessage_SetPostingRestricted:
+		// a restricted group stays restricted from its first restriction until it is opened again
+		if !payload.GetRestricted() {
+			s.restriction = moderationVersion{}
+		} else if s.restriction.clock == "" {
+			s.restriction = version
+		}
+
+	default:
+		return false, errcode.ErrInvalidInput.Wrap(fmt.Errorf("%s is not a moderation message", event.GetType()))
+	}
+
+	return true, nil
+}
+
+// moderateMember sets the role and the removal of a member from the state, it returns false when they are unchanged
+func (s *moderationState) moderateMember(member *messengertypes.Member) bool {
+	role, roleVersion := messengertypes.Member_RoleMember, s.roleVersions[member.GetPublicKey()]
+	if roleVersion.clock != "" {
+		role = s.roles[member.GetPublicKey()]
+	} else if member.GetRoleClock() == "" {
+		// the role isn't known from the log, it was set before the moderation messages were recorded
+		role = member.GetRole()
+	}
+
+	removal := s.removals[member.GetPublicKey()]
+
+	if member.GetRole() == role && member.GetRoleDate() == roleVersion.date && member.GetRoleClock() == roleVersion.clock &&
+		member.GetRemovedDate() == removal.date && member.GetRemovedClock() == removal.clock {
+		return false
+	}
+
+	member.Role, member.RoleDate, member.RoleClock = role, roleVersion.date, roleVersion.clock
+	member.RemovedDate, member.RemovedClock = removal.date, removal.clock
+
+	return true
+}
+
+// moderateConversation sets the posting restriction and the profile of a group from the state, it returns false when
+// they are unchanged
+func (s *moderationState) moderateConversation(conv *messengertypes.Conversation) bool {
+	updated := false
+
+	if conv.GetPostingRestrictedDate() != s.restriction.date || conv.GetPostingRestrictedClock() != s.restriction.clock {
+		updated = true
+		conv.PostingRestrictedDate, conv.PostingRestrictedClock = s.restriction.date, s.restriction.clock
+	}
+
+	// the profile set by the invitation is kept until a profile is authorized, a profile which is no longer
+	// authorized is cleared
+	profile := s.profile
+	if profile == nil {
+		if conv.GetInfoClock() == "" {
+			return updated
+		}
+		profile = &messengertypes.AppMessage_SetGroupInfo{}
+	}
+
+	if conv.GetInfoClock() != s.profileVersion.clock || conv.GetInfoDate() != s.profileVersion.date {
+		updated = true
+		conv.DisplayName, conv.AvatarCID = profile.GetDisplayName(), profile.GetAvatarCid()
+		conv.Topic, conv.Description = profile.GetTopic(), profile.GetDescription()
+		conv.InfoDate, conv.InfoClock = s.profileVersion.date, s.profileVersion.clock
+	}
+
+	return updated
+}
+
+// getModerationState folds the moderation messages of a group ordered before the given position of its log, the whole
+// log when the position is empty
+func (d *dbWrapper) getModerationState(convPK, before string) (*moderationState, error) {
+	members, err := d.getMembersByConversation(convPK)
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	events, err := d.getModerationEvents(convPK, before)
+	if err != nil {
+		return nil, err
+	}
+
+	state := newModerationState(members)
+	for _, event := range events {
+		if _, err := state.apply(event); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// isConversationAdminAt checks that a member was an admin of a group at the given position of its log
+func (d *dbWrapper) isConversationAdminAt(convPK, memberPK, clock string) (bool, error) {
+	if convPK == "" || memberPK == "" {
+		return false, nil
+	}
+
+	state, err := d.getModerationState(convPK, clock)
+	if err != nil {
+		return false, err
+	}
+
+	return state.isAdmin(memberPK), nil
+}
+
+// resolveModeration folds the whole moderation log of a group and applies the result, it returns the members and the
+// conversation updated, the conversation is nil when it is unchanged
+func (d *dbWrapper) resolveModeration(convPK string) ([]*messengertypes.Member, *messengertypes.Conversation, error) {
+	state, err := d.getModerationState(convPK, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for memberPK := range state.members {
+		if _, err := d.ensureMember(memberPK, convPK); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	members, err := d.getMembersByConversation(convPK)
+	if err != nil {
+		return nil, nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	updated := []*messengertypes.Member(nil)
+	for _, member := range members {
+		if !state.moderateMember(member) {
+			continue
+		}
+
+		if err := d.setMemberModeration(member); err != nil {
+			return nil, nil, err
+		}
+		updated = append(updated, member)
+	}
+
+	conv, err := d.getConversationByPK(convPK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !state.moderateConversation(conv) {
+		return updated, nil, nil
+	}
+
+	if err := d.setConversationModeration(conv); err != nil {
+		return nil, nil, err
+	}
+
+	return updated, conv, nil
+}
@@ -0,0 +1,190 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_moderation(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, AccountMemberPublicKey: "member_me"})
+	_, err := db.addMember("member_creator", "conv_1", "", "", false, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	admin, err := db.isConversationAdmin("conv_1", "member_creator")
+	require.NoError(t, err)
+	require.True(t, admin)
+
+	admin, err = db.isConversationAdmin("conv_1", "member_1")
+	require.NoError(t, err)
+	require.False(t, admin)
+
+	admin, err = db.isConversationAdmin("conv_1", "member_unknown")
+	require.NoError(t, err)
+	require.False(t, admin)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	interaction := func(cid, memberPK string, lamportTime uint64, sentDate int64) *messengertypes.Interaction {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return &messengertypes.Interaction{CID: cid, Type: messengertypes.AppMessage_TypeUserMessage, Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: memberPK, LamportTime: lamportTime, SentDate: sentDate}
+	}
+	setRole := func(cid, memberPK string, lamportTime uint64, target string, role messengertypes.Member_Role) {
+		_, _, err := h.handleAppMessageSetMemberRole(db, interaction(cid, memberPK, lamportTime, int64(lamportTime)), &messengertypes.AppMessage_SetMemberRole{MemberPublicKey: target, Role: role})
+		require.NoError(t, err)
+	}
+	remove := func(cid, memberPK string, lamportTime uint64, target string) {
+		_, _, err := h.handleAppMessageRemoveMember(db, interaction(cid, memberPK, lamportTime, int64(lamportTime)), &messengertypes.AppMessage_RemoveMember{MemberPublicKey: target})
+		require.NoError(t, err)
+	}
+	restrict := func(cid, memberPK string, lamportTime uint64, restricted bool) {
+		_, _, err := h.handleAppMessageSetPostingRestricted(db, interaction(cid, memberPK, lamportTime, int64(lamportTime)), &messengertypes.AppMessage_SetPostingRestricted{Restricted: restricted})
+		require.NoError(t, err)
+	}
+
+	// roles are last write wins
+	setRole("cid_20", "member_creator", 20, "member_1", messengertypes.Member_RoleAdmin)
+	setRole("cid_10", "member_creator", 10, "member_1", messengertypes.Member_RoleMember)
+
+	member, err := db.getMemberByPK("member_1", "conv_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Member_RoleAdmin, member.GetRole())
+	require.Equal(t, interactionClock(interaction("cid_20", "member_creator", 20, 0)), member.GetRoleClock())
+
+	admin, err = db.isConversationAdmin("conv_1", "member_1")
+	require.NoError(t, err)
+	require.True(t, admin)
+
+	// the authorization is checked at the position of the message in the log
+	admin, err = db.isConversationAdminAt("conv_1", "member_1", testClock(15))
+	require.NoError(t, err)
+	require.False(t, admin)
+
+	admin, err = db.isConversationAdminAt("conv_1", "member_1", testClock(25))
+	require.NoError(t, err)
+	require.True(t, admin)
+
+	// the creator can't be demoted nor removed
+	setRole("cid_30", "member_1", 30, "member_creator", messengertypes.Member_RoleMember)
+	remove("cid_31", "member_1", 31, "member_creator")
+
+	admin, err = db.isConversationAdmin("conv_1", "member_creator")
+	require.NoError(t, err)
+	require.True(t, admin)
+
+	// unknown members are created, the earliest removal wins
+	remove("cid_60", "member_creator", 60, "member_2")
+	remove("cid_50", "member_1", 50, "member_2")
+
+	member, err = db.getMemberByPK("member_2", "conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(50), member.GetRemovedDate())
+
+	allowed, err := db.isInteractionSenderAllowed(interaction("cid_m40", "member_2", 40, 40))
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m51", "member_2", 51, 50))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// the position in the group log is used, a backdated message is still refused
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m55", "member_2", 55, 10))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// a moderation message of a regular member is kept, it applies once a role change ordered before it is received
+	_, err = db.addMember("member_3", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+	_, err = db.addMember("member_4", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	restrict("cid_100", "member_3", 100, true)
+
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Zero(t, conv.GetPostingRestrictedDate())
+
+	setRole("cid_90", "member_creator", 90, "member_3", messengertypes.Member_RoleAdmin)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), conv.GetPostingRestrictedDate())
+	require.Equal(t, interactionClock(interaction("cid_100", "member_3", 100, 0)), conv.GetPostingRestrictedClock())
+
+	// a restricted group stays restricted from its first restriction
+	restrict("cid_110", "member_creator", 110, true)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), conv.GetPostingRestrictedDate())
+
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m95", "member_4", 95, 95))
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m105", "member_4", 105, 105))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m106", "member_4", 106, 90))
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	i := interaction("cid_m107", "member_4", 107, 107)
+	i.Type = messengertypes.AppMessage_TypeSetUserInfo
+	allowed, err = db.isInteractionSenderAllowed(i)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	allowed, err = db.isInteractionSenderAllowed(interaction("cid_m108", "member_3", 108, 108))
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// a removed admin can't moderate the group anymore, its messages ordered after the removal don't apply
+	remove("cid_120", "member_creator", 120, "member_3")
+	restrict("cid_130", "member_3", 130, false)
+
+	admin, err = db.isConversationAdmin("conv_1", "member_3")
+	require.NoError(t, err)
+	require.False(t, admin)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(100), conv.GetPostingRestrictedDate())
+
+	// group profile is last write wins
+	setInfo := func(cid string, lamportTime uint64, info *messengertypes.AppMessage_SetGroupInfo) *messengertypes.Conversation {
+		_, _, err := h.handleAppMessageSetGroupInfo(db, interaction(cid, "member_creator", lamportTime, int64(lamportTime)), info)
+		require.NoError(t, err)
+
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return conv
+	}
+
+	conv = setInfo("cid_220", 220, &messengertypes.AppMessage_SetGroupInfo{DisplayName: "name_2", Topic: "topic_2", Description: "description_2"})
+	require.Equal(t, "name_2", conv.DisplayName)
+	require.Equal(t, "topic_2", conv.Topic)
+	require.Equal(t, "description_2", conv.Description)
+
+	conv = setInfo("cid_210", 210, &messengertypes.AppMessage_SetGroupInfo{DisplayName: "name_1", Topic: "topic_1"})
+	require.Equal(t, "name_2", conv.DisplayName)
+	require.Equal(t, "topic_2", conv.Topic)
+
+	// the whole profile is replaced
+	conv = setInfo("cid_230", 230, &messengertypes.AppMessage_SetGroupInfo{DisplayName: "name_3", AvatarCid: "avatar_3"})
+	require.Equal(t, "avatar_3", conv.AvatarCID)
+	require.Empty(t, conv.Topic)
+	require.Empty(t, conv.Description)
+}
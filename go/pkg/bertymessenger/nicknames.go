@@ -0,0 +1,132 @@
+package bertymessenger
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The nicknames and the notes of the contacts and the members are only stored on this device. The contacts and the
+// members are stored with the display name they sent, their nickname replaces it in the events and in the replies so
+// the stored models can still be updated and saved by the handlers.
+
+type nicknamed interface {
+	GetNickname() string
+	ApplyNickname()
+}
+
+// visitNicknamed calls visit on each contact and member contained in a value
+func visitNicknamed(v reflect.Value, visit func(nicknamed)) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+
+		if n, ok := v.Interface().(nicknamed); ok {
+			visit(n)
+		}
+
+		visitNicknamed(v.Elem(), visit)
+	case reflect.Interface:
+		if !v.IsNil() {
+			visitNicknamed(v.Elem(), visit)
+		}
+	case reflect.Struct:
+		for idx := 0; idx < v.NumField(); idx++ {
+			if v.Type().Field(idx).PkgPath == "" {
+				visitNicknamed(v.Field(idx), visit)
+			}
+		}
+	case reflect.Slice:
+		if kind := v.Type().Elem().Kind(); kind != reflect.Ptr && kind != reflect.Struct {
+			return
+		}
+
+		for idx := 0; idx < v.Len(); idx++ {
+			visitNicknamed(v.Index(idx), visit)
+		}
+	}
+}
+
+// applyNicknames replaces the display names of the contacts and the members of a message by their nickname
+func applyNicknames(msg proto.Message) {
+	visitNicknamed(reflect.ValueOf(msg), func(n nicknamed) { n.ApplyNickname() })
+}
+
+// withNicknames returns a copy of a message with the nicknames applied, or the message itself when it doesn't contain
+// any nickname, the message is not modified
+func withNicknames(msg proto.Message) proto.Message {
+	found := false
+	visitNicknamed(reflect.ValueOf(msg), func(n nicknamed) { found = found || n.GetNickname() != "" })
+	if !found {
+		return msg
+	}
+
+	clone := proto.Clone(msg)
+	applyNicknames(clone)
+
+	return clone
+}
+
+func (svc *service) ContactSetNickname(ctx context.Context, req *messengertypes.ContactSetNickname_Request) (*messengertypes.ContactSetNickname_Reply, error) {
+	if req.GetContactPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := messengertypes.IsValidNickname(req.GetNickname(), req.GetNote()); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	contact, err := svc.db.setContactNickname(req.GetContactPublicKey(), req.GetNickname(), req.GetNote())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{Contact: contact}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	contact.ApplyNickname()
+
+	return &messengertypes.ContactSetNickname_Reply{Contact: contact}, nil
+}
+
+func (svc *service) MemberSetNickname(ctx context.Context, req *messengertypes.MemberSetNickname_Request) (*messengertypes.MemberSetNickname_Reply, error) {
+	if req.GetConversationPublicKey() == "" || req.GetMemberPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if err := messengertypes.IsValidNickname(req.GetNickname(), req.GetNote()); err != nil {
+		return nil, err
+	}
+
+	defer svc.writer.enter()()
+
+	member, err := svc.db.setMemberNickname(req.GetMemberPublicKey(), req.GetConversationPublicKey(), req.GetNickname(), req.GetNote())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMemberUpdated, &messengertypes.StreamEvent_MemberUpdated{Member: member}, false); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	if conv, updated, err := svc.db.updateConversationFallbackDisplayName(req.GetConversationPublicKey()); err != nil {
+		return nil, err
+	} else if updated {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+			return nil, errcode.TODO.Wrap(err)
+		}
+	}
+
+	member.ApplyNickname()
+
+	return &messengertypes.MemberSetNickname_Reply{Member: member}, nil
+}
@@ -0,0 +1,94 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_withNicknames(t *testing.T) {
+	msg := &messengertypes.StreamEvent_ConversationUpdated{
+		Conversation: &messengertypes.Conversation{
+			PublicKey: "conv_1",
+			Contact:   &messengertypes.Contact{PublicKey: "contact_1", DisplayName: "alice", Nickname: "mom"},
+			Members: []*messengertypes.Member{
+				{PublicKey: "member_1", DisplayName: "bob", Nickname: "coworker"},
+				{PublicKey: "member_2", DisplayName: "carol"},
+			},
+		},
+	}
+
+	// the message itself is not modified
+	ret := withNicknames(msg).(*messengertypes.StreamEvent_ConversationUpdated)
+	require.Equal(t, "alice", msg.GetConversation().GetContact().GetDisplayName())
+	require.Empty(t, msg.GetConversation().GetContact().GetOriginalDisplayName())
+
+	require.Equal(t, "mom", ret.GetConversation().GetContact().GetDisplayName())
+	require.Equal(t, "alice", ret.GetConversation().GetContact().GetOriginalDisplayName())
+	require.Equal(t, "coworker", ret.GetConversation().GetMembers()[0].GetDisplayName())
+	require.Equal(t, "bob", ret.GetConversation().GetMembers()[0].GetOriginalDisplayName())
+	require.Equal(t, "carol", ret.GetConversation().GetMembers()[1].GetDisplayName())
+
+	// the nicknames are only applied once
+	applyNicknames(ret)
+	require.Equal(t, "alice", ret.GetConversation().GetContact().GetOriginalDisplayName())
+
+	plain := &messengertypes.StreamEvent_InteractionUpdated{Interaction: &messengertypes.Interaction{Member: &messengertypes.Member{DisplayName: "dave"}}}
+	require.True(t, plain == withNicknames(plain))
+
+	reply := &messengertypes.InteractionList_Reply{Interactions: []*messengertypes.Interaction{{Member: &messengertypes.Member{DisplayName: "dave", Nickname: "neighbour"}}}}
+	applyNicknames(reply)
+	require.Equal(t, "neighbour", reply.GetInteractions()[0].GetMember().GetDisplayName())
+}
+
+func Test_dbWrapper_setNicknames(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setContactNickname("", "mom", "")
+	require.Error(t, err)
+
+	_, err = db.setContactNickname("contact_1", "mom", "")
+	require.Error(t, err)
+
+	require.NoError(t, db.db.Create(&messengertypes.Contact{PublicKey: "contact_1", DisplayName: "alice"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Member{PublicKey: "member_1", ConversationPublicKey: "conv_1", DisplayName: "bob"}).Error)
+
+	contact, err := db.setContactNickname("contact_1", "mom", "birthday in june")
+	require.NoError(t, err)
+	require.Equal(t, "alice", contact.GetDisplayName())
+	require.Equal(t, "mom", contact.GetNickname())
+	require.Equal(t, "birthday in june", contact.GetNote())
+
+	_, err = db.setMemberNickname("member_1", "conv_2", "coworker", "")
+	require.Error(t, err)
+
+	member, err := db.setMemberNickname("member_1", "conv_1", "coworker", "")
+	require.NoError(t, err)
+	require.Equal(t, "bob", member.GetDisplayName())
+	require.Equal(t, "coworker", member.GetNickname())
+
+	// the nicknames are kept when the database is rebuilt
+	contacts := keepContactNicknames(db.db, nil)
+	require.Len(t, contacts, 1)
+	require.Equal(t, "mom", contacts[0].GetNickname())
+
+	members := keepMemberNicknames(db.db, nil)
+	require.Len(t, members, 1)
+	require.Equal(t, "conv_1", members[0].GetConversationPublicKey())
+
+	contact, err = db.setContactNickname("contact_1", "", "")
+	require.NoError(t, err)
+	require.Empty(t, contact.GetNickname())
+	require.Empty(t, keepContactNicknames(db.db, nil))
+}
+
+func Test_IsValidNickname(t *testing.T) {
+	require.NoError(t, messengertypes.IsValidNickname("", ""))
+	require.NoError(t, messengertypes.IsValidNickname("mom", "birthday in june"))
+	require.Error(t, messengertypes.IsValidNickname(strings.Repeat("a", messengertypes.MaxNicknameLength+1), ""))
+	require.Error(t, messengertypes.IsValidNickname("", strings.Repeat("a", messengertypes.MaxNicknameNoteLength+1)))
+}
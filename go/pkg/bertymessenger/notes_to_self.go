@@ -0,0 +1,56 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The conversation of the account type is the notes to self of the user, it is backed by the account group whose only
+// members are the devices of the account. The notes are sent with Interact like any message and are synced across the
+// devices, the profile and the other contact-facing metadata are never sent in this group.
+
+// notesToSelfAppMessageTypes are the messages the clients can send to the notes to self, the ones sent by the other
+// devices of the account are stored as sent by the user
+var notesToSelfAppMessageTypes = map[messengertypes.AppMessage_Type]struct{}{
+	messengertypes.AppMessage_TypeUserMessage:        {},
+	messengertypes.AppMessage_TypeUserReaction:       {},
+	messengertypes.AppMessage_TypeLocation:           {},
+	messengertypes.AppMessage_TypePollCreate:         {},
+	messengertypes.AppMessage_TypePollVote:           {},
+	messengertypes.AppMessage_TypePollClose:          {},
+	messengertypes.AppMessage_TypeInteractionRetract: {},
+}
+
+// checkNotesToSelfInteraction rejects the messages which can't be sent to the notes to self
+func checkNotesToSelfInteraction(conv *messengertypes.Conversation, amt messengertypes.AppMessage_Type) error {
+	if conv.GetType() != messengertypes.Conversation_AccountType {
+		return nil
+	}
+
+	if _, ok := notesToSelfAppMessageTypes[amt]; !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a message of type %s can't be sent to the notes to self", amt.String()))
+	}
+
+	return nil
+}
+
+// isNoteFromOtherDevice checks that a message has been sent to the notes to self by another device of the account, it
+// is then shown as sent by the user while its medias are still downloaded
+func (h *eventHandler) isNoteFromOtherDevice(i *messengertypes.Interaction) (bool, error) {
+	if i.GetIsMe() {
+		return false, nil
+	}
+
+	if _, ok := notesToSelfAppMessageTypes[i.GetType()]; !ok {
+		return false, nil
+	}
+
+	acc, err := h.db.getAccount()
+	if err != nil {
+		return false, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return i.GetConversationPublicKey() == acc.GetPublicKey(), nil
+}
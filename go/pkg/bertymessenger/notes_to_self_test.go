@@ -0,0 +1,49 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestNotesToSelf(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.addAccount("account_1", ""))
+	require.NoError(t, db.addAccountConversation("account_1", 1))
+	require.NoError(t, db.addAccountConversation("account_1", 2))
+
+	conv, err := db.getConversationByPK("account_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Conversation_AccountType, conv.GetType())
+	require.Equal(t, int64(1), conv.GetCreatedDate())
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+
+	// a note sent by another device of the account
+	ok, err := h.isNoteFromOtherDevice(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "account_1"})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = h.isNoteFromOtherDevice(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "account_1", IsMe: true})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the device sync messages are still told apart from the notes
+	ok, err = h.isNoteFromOtherDevice(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypeDeviceSyncSnapshot, ConversationPublicKey: "account_1"})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = h.isNoteFromOtherDevice(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1"})
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// the contact-facing messages can't be sent to the notes to self
+	require.NoError(t, checkNotesToSelfInteraction(conv, messengertypes.AppMessage_TypeUserMessage))
+	require.Error(t, checkNotesToSelfInteraction(conv, messengertypes.AppMessage_TypeSetUserInfo))
+	require.NoError(t, checkNotesToSelfInteraction(&messengertypes.Conversation{Type: messengertypes.Conversation_ContactType}, messengertypes.AppMessage_TypeSetUserInfo))
+}
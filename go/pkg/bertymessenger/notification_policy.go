@@ -0,0 +1,77 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const minutesPerDay = 24 * 60
+
+func checkNotificationPolicy(policy *messengertypes.NotificationPolicy) error {
+	if policy.GetConversationPublicKey() == "" {
+		return errcode.ErrMissingInput
+	}
+
+	if _, ok := messengertypes.NotificationPolicy_Mode_name[int32(policy.GetMode())]; !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown mode %d", policy.GetMode()))
+	}
+
+	for _, minute := range []int32{policy.GetQuietHoursStart(), policy.GetQuietHoursEnd()} {
+		if minute < 0 || minute >= minutesPerDay {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("quiet hours must be between 0 and %d minutes", minutesPerDay-1))
+		}
+	}
+
+	return nil
+}
+
+// isNotificationAllowed evaluates the notification policy of a conversation for an incoming message, the quiet hours
+// are checked first then the keywords and the mode
+func isNotificationAllowed(policy *messengertypes.NotificationPolicy, i *messengertypes.Interaction, body string, now time.Time) bool {
+	if isInQuietHours(policy.GetQuietHoursStart(), policy.GetQuietHoursEnd(), now) {
+		return false
+	}
+
+	if containsKeyword(body, policy.GetKeywords()) {
+		return true
+	}
+
+	switch policy.GetMode() {
+	case messengertypes.NotificationPolicy_ModeMentions:
+		return i.GetMentionsMe()
+	case messengertypes.NotificationPolicy_ModeNone:
+		return false
+	default:
+		return true
+	}
+}
+
+// isInQuietHours checks the local time of the device, the quiet hours can span midnight
+func isInQuietHours(start, end int32, now time.Time) bool {
+	if start == end {
+		return false
+	}
+
+	minute := int32(now.Hour()*60 + now.Minute())
+	if start < end {
+		return minute >= start && minute < end
+	}
+
+	return minute >= start || minute < end
+}
+
+func containsKeyword(body string, keywords string) bool {
+	body = strings.ToLower(body)
+	for _, keyword := range strings.Split(keywords, "\n") {
+		keyword = strings.TrimSpace(keyword)
+		if keyword != "" && strings.Contains(body, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_isNotificationAllowed(t *testing.T) {
+	noon := time.Date(2021, 1, 1, 12, 0, 0, 0, time.Local)
+	message := &messengertypes.Interaction{}
+	mention := &messengertypes.Interaction{MentionsMe: true}
+
+	all := &messengertypes.NotificationPolicy{Mode: messengertypes.NotificationPolicy_ModeAll}
+	require.True(t, isNotificationAllowed(all, message, "hello", noon))
+	require.True(t, isNotificationAllowed(nil, message, "hello", noon))
+
+	mentions := &messengertypes.NotificationPolicy{Mode: messengertypes.NotificationPolicy_ModeMentions}
+	require.False(t, isNotificationAllowed(mentions, message, "hello", noon))
+	require.True(t, isNotificationAllowed(mentions, mention, "hello", noon))
+
+	none := &messengertypes.NotificationPolicy{Mode: messengertypes.NotificationPolicy_ModeNone, Keywords: "release\n\n Urgent "}
+	require.False(t, isNotificationAllowed(none, mention, "hello", noon))
+	require.True(t, isNotificationAllowed(none, message, "this is URGENT", noon))
+	require.True(t, isNotificationAllowed(none, message, "new release", noon))
+
+	// nothing is notified during the quiet hours, even the keywords
+	none.QuietHoursStart, none.QuietHoursEnd = 11*60, 13*60
+	require.False(t, isNotificationAllowed(none, message, "this is urgent", noon))
+}
+
+func Test_isInQuietHours(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2021, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	require.False(t, isInQuietHours(0, 0, at(12, 0)))
+	require.False(t, isInQuietHours(600, 600, at(10, 0)))
+
+	require.True(t, isInQuietHours(9*60, 17*60, at(9, 0)))
+	require.True(t, isInQuietHours(9*60, 17*60, at(16, 59)))
+	require.False(t, isInQuietHours(9*60, 17*60, at(17, 0)))
+	require.False(t, isInQuietHours(9*60, 17*60, at(8, 59)))
+
+	// spanning midnight
+	require.True(t, isInQuietHours(22*60, 7*60, at(23, 30)))
+	require.True(t, isInQuietHours(22*60, 7*60, at(3, 0)))
+	require.False(t, isInQuietHours(22*60, 7*60, at(7, 0)))
+	require.False(t, isInQuietHours(22*60, 7*60, at(12, 0)))
+}
+
+func Test_checkNotificationPolicy(t *testing.T) {
+	require.Error(t, checkNotificationPolicy(nil))
+	require.Error(t, checkNotificationPolicy(&messengertypes.NotificationPolicy{}))
+	require.Error(t, checkNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", Mode: 42}))
+	require.Error(t, checkNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", QuietHoursStart: -1}))
+	require.Error(t, checkNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", QuietHoursEnd: minutesPerDay}))
+	require.NoError(t, checkNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", Mode: messengertypes.NotificationPolicy_ModeMentions, QuietHoursStart: 22 * 60, QuietHoursEnd: 7 * 60}))
+}
+
+func Test_dbWrapper_notificationPolicy(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.getNotificationPolicy("")
+	require.Error(t, err)
+
+	require.Error(t, db.setNotificationPolicy(&messengertypes.NotificationPolicy{}))
+
+	// default policy
+	policy, err := db.getNotificationPolicy("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, "conv_1", policy.GetConversationPublicKey())
+	require.Equal(t, messengertypes.NotificationPolicy_ModeAll, policy.GetMode())
+
+	require.NoError(t, db.setNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", Mode: messengertypes.NotificationPolicy_ModeMentions, Keywords: "urgent"}))
+
+	policy, err = db.getNotificationPolicy("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.NotificationPolicy_ModeMentions, policy.GetMode())
+	require.Equal(t, "urgent", policy.GetKeywords())
+
+	// replaced
+	require.NoError(t, db.setNotificationPolicy(&messengertypes.NotificationPolicy{ConversationPublicKey: "conv_1", Mode: messengertypes.NotificationPolicy_ModeNone, QuietHoursStart: 60, QuietHoursEnd: 120}))
+
+	policy, err = db.getNotificationPolicy("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.NotificationPolicy_ModeNone, policy.GetMode())
+	require.Equal(t, "", policy.GetKeywords())
+	require.Equal(t, int32(60), policy.GetQuietHoursStart())
+	require.Equal(t, int32(120), policy.GetQuietHoursEnd())
+}
@@ -42,7 +42,7 @@ func (d *Dispatcher) UnregisterAll() {
 }
 
 func (d *Dispatcher) StreamEvent(typ messengertypes.StreamEvent_Type, msg proto.Message, isNew bool) error {
-	payload, err := proto.Marshal(msg)
+	payload, err := proto.Marshal(withNicknames(msg))
 	if err != nil {
 		return err
 	}
@@ -69,7 +69,7 @@ func (d *Dispatcher) Notify(typ messengertypes.StreamEvent_Notified_Type, title,
 	var payload []byte
 	if msg != nil {
 		var err error
-		if payload, err = proto.Marshal(msg); err != nil {
+		if payload, err = proto.Marshal(withNicknames(msg)); err != nil {
 			return err
 		}
 	}
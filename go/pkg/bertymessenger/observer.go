@@ -0,0 +1,24 @@
+package bertymessenger
+
+import (
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// A group can be joined as an observer, ie. by an audit or a logging node or by a reader of a public announcement
+// group: its messages are handled as usual but nothing is posted to it nor acknowledged. The observer still announces
+// its profile, flagged as an observer, so the groups whose admins opted in leave it out of their member counts.
+
+// ensureConversationPostable fails with ErrConversationObserved when the account only observes the group, the unknown
+// conversations, ie. the account group, can be posted to
+func (svc *service) ensureConversationPostable(groupPK []byte) error {
+	observed, err := svc.db.isConversationObserved(b64EncodeBytes(groupPK))
+	if err != nil {
+		return err
+	}
+
+	if observed {
+		return errcode.ErrConversationObserved
+	}
+
+	return nil
+}
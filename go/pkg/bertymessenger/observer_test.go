@@ -0,0 +1,78 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func TestService_ensureConversationPostable(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	observedPK := b64EncodeBytes([]byte("observed"))
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: observedPK, Type: messengertypes.Conversation_MultiMemberType, IsObserver: true}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: b64EncodeBytes([]byte("joined")), Type: messengertypes.Conversation_MultiMemberType}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	require.True(t, errcode.Is(svc.ensureConversationPostable([]byte("observed")), errcode.ErrConversationObserved))
+	require.NoError(t, svc.ensureConversationPostable([]byte("joined")))
+	require.NoError(t, svc.ensureConversationPostable([]byte("unknown")))
+
+	// nothing is sent to an observed group
+	require.True(t, errcode.Is(svc.sendAppMessage(context.Background(), &protocoltypes.AppMessageSend_Request{GroupPK: []byte("observed")}), errcode.ErrConversationObserved))
+
+	_, err := svc.Interact(context.Background(), &messengertypes.Interact_Request{ConversationPublicKey: observedPK, Type: messengertypes.AppMessage_TypeUserMessage})
+	require.True(t, errcode.Is(err, errcode.ErrConversationObserved))
+
+	// the messages of the group aren't acknowledged
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	require.NoError(t, h.sendAck(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: observedPK}))
+}
+
+func TestObserversMemberCounts(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	_, err := db.addMember("member_admin", "conv_1", "admin", "", false, true)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	conv, err := db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+
+	_, _, err = h.handleAppMessageSetUserInfo(db, &messengertypes.Interaction{CID: "cid_1", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_observer", LamportTime: 1}, &messengertypes.AppMessage_SetUserInfo{DisplayName: "audit", IsObserver: true})
+	require.NoError(t, err)
+
+	member, err := db.getMemberByPK("member_observer", "conv_1")
+	require.NoError(t, err)
+	require.True(t, member.GetIsObserver())
+
+	// the observers are counted until the group hides them
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), conv.GetMemberCount())
+
+	_, _, err = h.handleAppMessageSetConversationPreferences(db, &messengertypes.Interaction{CID: "cid_2", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_admin", LamportTime: 2}, &messengertypes.AppMessage_SetConversationPreferences{HideObservers: true})
+	require.NoError(t, err)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.True(t, conv.GetHideObservers())
+	require.Equal(t, int64(1), conv.GetMemberCount())
+
+	// a member taking part again is counted
+	_, _, err = h.handleAppMessageSetUserInfo(db, &messengertypes.Interaction{CID: "cid_3", Conversation: conv, ConversationPublicKey: "conv_1", MemberPublicKey: "member_observer", LamportTime: 3}, &messengertypes.AppMessage_SetUserInfo{DisplayName: "audit"})
+	require.NoError(t, err)
+
+	conv, err = db.getConversationByPK("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), conv.GetMemberCount())
+}
@@ -0,0 +1,253 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	ipfscid "github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	offlineBundleMagic   = "BERTYOFB"
+	offlineBundleVersion = byte(2)
+	// offlineBundleHeaderSize is the size of the magic, the version and the public key of the group
+	offlineBundleHeaderSize = len(offlineBundleMagic) + 1 + cryptoutil.KeySize
+	// offlineBundleMaxCount bounds the number of messages of a bundle, the oldest pending ones are exported first
+	offlineBundleMaxCount = 500
+)
+
+// The offline bundles carry the messages of a conversation to a device without a network path, ie. on a USB stick or
+// with a sequence of QR codes. The entries of the pending messages of the device are exported with the signature of the
+// device, the other side checks that they have been written by a device of a member of the group, handles them like the
+// events of the group log and skips them once the log is synchronized. The ids of the events are the hashes of the
+// entries so a bundle can't replace a message. A bundle is encrypted with a key derived from the secret of the group so
+// only the members of the group can read it.
+
+func offlineBundleKey(group *protocoltypes.Group) ([]byte, error) {
+	if len(group.GetSecret()) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the secret of the group is unknown"))
+	}
+
+	key := cryptoutil.ConcatAndHashSha256([]byte(offlineBundleMagic), group.GetSecret())
+
+	return key[:], nil
+}
+
+// sealOfflineBundle encrypts a bundle, the public key of the group is kept in clear so the other side can find the key
+func sealOfflineBundle(group *protocoltypes.Group, bundle *messengertypes.OfflineBundle) ([]byte, error) {
+	if len(group.GetPublicKey()) != cryptoutil.KeySize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid group public key"))
+	}
+
+	key, err := offlineBundleKey(group)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := proto.Marshal(bundle)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sealed, err := cryptoutil.AESGCMEncrypt(key, raw)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	data := append([]byte(offlineBundleMagic), offlineBundleVersion)
+	data = append(data, group.GetPublicKey()...)
+
+	return append(data, sealed...), nil
+}
+
+// offlineBundleGroupPK returns the public key of the group of a bundle read from its header
+func offlineBundleGroupPK(data []byte) ([]byte, error) {
+	if len(data) < offlineBundleHeaderSize || !bytes.Equal(data[:len(offlineBundleMagic)], []byte(offlineBundleMagic)) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("not an offline bundle"))
+	}
+
+	if version := data[len(offlineBundleMagic)]; version != offlineBundleVersion {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("unsupported offline bundle version %d", version))
+	}
+
+	return data[len(offlineBundleMagic)+1 : offlineBundleHeaderSize], nil
+}
+
+// openOfflineBundle decrypts a bundle, an error is returned if it has been altered or if it is not for the group
+func openOfflineBundle(group *protocoltypes.Group, data []byte) (*messengertypes.OfflineBundle, error) {
+	groupPK, err := offlineBundleGroupPK(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(groupPK, group.GetPublicKey()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the offline bundle is for another group"))
+	}
+
+	key, err := offlineBundleKey(group)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := data[offlineBundleHeaderSize:]
+	if len(sealed) < cryptoutil.NonceSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the offline bundle is truncated"))
+	}
+
+	raw, err := cryptoutil.AESGCMDecrypt(key, sealed)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	bundle := &messengertypes.OfflineBundle{}
+	if err := proto.Unmarshal(raw, bundle); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if bundle.GetConversationPublicKey() != b64EncodeBytes(group.GetPublicKey()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the offline bundle is for another group"))
+	}
+
+	return bundle, nil
+}
+
+func (svc *service) OfflineBundleExport(ctx context.Context, req *messengertypes.OfflineBundleExport_Request) (*messengertypes.OfflineBundleExport_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	gpk, err := b64DecodeBytes(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	gi, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		return nil, errcode.ErrGroupInfo.Wrap(err)
+	}
+
+	types := []messengertypes.AppMessage_Type(nil)
+	for typ, handler := range svc.eventHandler.appMessageHandlers {
+		if handler.isVisibleEvent {
+			types = append(types, typ)
+		}
+	}
+
+	interactions, err := svc.db.getPendingOutgoingInteractions(req.GetConversationPublicKey(), b64EncodeBytes(gi.GetDevicePK()), types, offlineBundleMaxCount)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([][]byte, len(interactions))
+	for n, i := range interactions {
+		cid, err := ipfscid.Decode(i.GetCID())
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		cids[n] = cid.Bytes()
+	}
+
+	entries, err := svc.protocolClient.GroupLogEntriesExport(ctx, &protocoltypes.GroupLogEntriesExport_Request{GroupPK: gpk, CIDs: cids})
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	bundle := &messengertypes.OfflineBundle{
+		ConversationPublicKey: req.GetConversationPublicKey(),
+		DevicePK:              entries.GetDevicePK(),
+		CreatedDate:           timestampMs(time.Now()),
+		Entries:               entries.GetEntries(),
+		Sig:                   entries.GetSig(),
+	}
+
+	data, err := sealOfflineBundle(gi.GetGroup(), bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.OfflineBundleExport_Reply{Bundle: data, Count: int64(len(bundle.GetEntries()))}, nil
+}
+
+func (svc *service) OfflineBundleImport(ctx context.Context, req *messengertypes.OfflineBundleImport_Request) (*messengertypes.OfflineBundleImport_Reply, error) {
+	if len(req.GetBundle()) == 0 {
+		return nil, errcode.ErrMissingInput
+	}
+
+	gpk, err := offlineBundleGroupPK(req.GetBundle())
+	if err != nil {
+		return nil, err
+	}
+
+	convPK := b64EncodeBytes(gpk)
+	if _, err := svc.db.getConversationByPK(convPK); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	gi, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		return nil, errcode.ErrGroupInfo.Wrap(err)
+	}
+
+	bundle, err := openOfflineBundle(gi.GetGroup(), req.GetBundle())
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(bundle.GetDevicePK(), gi.GetDevicePK()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the offline bundle has been exported by this device"))
+	}
+
+	// the entries are checked by the protocol, an altered bundle is rejected as a whole
+	opened, err := svc.protocolClient.GroupLogEntriesOpen(ctx, &protocoltypes.GroupLogEntriesOpen_Request{
+		GroupPK:  gpk,
+		DevicePK: bundle.GetDevicePK(),
+		Entries:  bundle.GetEntries(),
+		Sig:      bundle.GetSig(),
+	})
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	defer svc.writer.enter()()
+
+	imported := int64(0)
+	for _, gme := range opened.GetEvents() {
+		var am messengertypes.AppMessage
+		if err := proto.Unmarshal(gme.GetMessage(), &am); err != nil {
+			svc.logger.Warn("ignoring invalid offline bundle event", zap.Error(err))
+			continue
+		}
+
+		cid := eventCID(gme.GetEventContext())
+		if cid == "" {
+			svc.logger.Warn("ignoring offline bundle event without a valid id")
+			continue
+		}
+
+		if processed, err := svc.db.isEventProcessed(cid, processedEventHash(am.GetType().String(), gme.GetMessage())); err != nil {
+			return nil, err
+		} else if processed {
+			continue
+		}
+
+		if err := svc.eventHandler.handleAppMessage(convPK, gme, &am); err != nil {
+			return nil, err
+		}
+
+		imported++
+	}
+
+	svc.logger.Info("imported offline bundle", logGroup(convPK), zap.Int64("imported", imported))
+
+	return &messengertypes.OfflineBundleImport_Reply{ConversationPublicKey: convPK, Imported: imported}, nil
+}
@@ -0,0 +1,80 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_sealOfflineBundle(t *testing.T) {
+	group := &protocoltypes.Group{PublicKey: bytes.Repeat([]byte{1}, 32), Secret: []byte("secret")}
+	bundle := &messengertypes.OfflineBundle{
+		ConversationPublicKey: b64EncodeBytes(group.GetPublicKey()),
+		DevicePK:              []byte("device"),
+		Entries:               [][]byte{[]byte("entry")},
+		Sig:                   []byte("sig"),
+	}
+
+	data, err := sealOfflineBundle(group, bundle)
+	require.NoError(t, err)
+
+	groupPK, err := offlineBundleGroupPK(data)
+	require.NoError(t, err)
+	require.Equal(t, group.GetPublicKey(), groupPK)
+
+	opened, err := openOfflineBundle(group, data)
+	require.NoError(t, err)
+	require.Equal(t, []byte("device"), opened.GetDevicePK())
+	require.Equal(t, [][]byte{[]byte("entry")}, opened.GetEntries())
+	require.Equal(t, []byte("sig"), opened.GetSig())
+
+	// the bundle can't be read without the secret of the group
+	_, err = openOfflineBundle(&protocoltypes.Group{PublicKey: group.GetPublicKey(), Secret: []byte("other")}, data)
+	require.Error(t, err)
+
+	_, err = openOfflineBundle(&protocoltypes.Group{PublicKey: bytes.Repeat([]byte{2}, 32), Secret: group.GetSecret()}, data)
+	require.Error(t, err)
+
+	altered := append([]byte{}, data...)
+	altered[len(altered)-1] ^= 1
+	_, err = openOfflineBundle(group, altered)
+	require.Error(t, err)
+
+	_, err = openOfflineBundle(group, data[:offlineBundleHeaderSize+1])
+	require.Error(t, err)
+
+	_, err = offlineBundleGroupPK([]byte("not a bundle"))
+	require.Error(t, err)
+}
+
+func Test_dbWrapper_getPendingOutgoingInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_2", SentDate: 2, IsMe: true, DevicePublicKey: "device_me"},
+		{CID: "cid_1", SentDate: 1, IsMe: true, DevicePublicKey: "device_me"},
+		{CID: "cid_acked", SentDate: 3, IsMe: true, DevicePublicKey: "device_me", Acknowledged: true},
+		{CID: "cid_other_device", SentDate: 4, IsMe: true, DevicePublicKey: "device_other"},
+		{CID: "cid_received", SentDate: 5, DevicePublicKey: "device_peer"},
+	} {
+		i.ConversationPublicKey = "conv_1"
+		i.Type = messengertypes.AppMessage_TypeUserMessage
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_info", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeSetUserInfo, IsMe: true, DevicePublicKey: "device_me"}).Error)
+
+	interactions, err := db.getPendingOutgoingInteractions("conv_1", "device_me", []messengertypes.AppMessage_Type{messengertypes.AppMessage_TypeUserMessage}, offlineBundleMaxCount)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.Equal(t, "cid_1", interactions[0].GetCID())
+	require.Equal(t, "cid_2", interactions[1].GetCID())
+
+	_, err = db.getPendingOutgoingInteractions("conv_1", "", nil, offlineBundleMaxCount)
+	require.Error(t, err)
+}
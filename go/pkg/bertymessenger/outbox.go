@@ -0,0 +1,290 @@
+package bertymessenger
+
+import (
+	"context"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	outboxMessageIDSize = 16
+	// connectivityCheckInterval is the delay between two checks of the connectivity of the node
+	connectivityCheckInterval = 10 * time.Second
+)
+
+// The messages sent with Interact while the node is offline are accepted in the outbox instead of failing, they are
+// sent in order once the node is online again. The messages sent while the outbox is not empty are sent after it so
+// the order of the conversation is kept.
+
+// isNodeOnline returns whether the node is online, it is always online without a connectivity provider
+func (svc *service) isNodeOnline() bool {
+	return svc.isOnline == nil || svc.isOnline()
+}
+
+// sendOrDeferAppMessage sends an app message of Interact or adds it to the outbox when the node is offline, the
+// message of the outbox is returned if it is deferred. The content hash of a user message is kept with it in the
+// outbox, the deferred message is cancelled if it isn't sent within ttl unless ttl is 0. The writer must be held
+func (svc *service) sendOrDeferAppMessage(ctx context.Context, t messengertypes.AppMessage_Type, contentHash string, ttl time.Duration, req *protocoltypes.AppMessageSend_Request) (*messengertypes.OutboxMessage, error) {
+	if svc.isNodeOnline() {
+		if err := svc.flushOutbox(ctx); err != nil {
+			return nil, err
+		}
+
+		return nil, svc.sendAppMessage(ctx, req)
+	}
+
+	id, err := cryptoutil.GenerateNonceSize(outboxMessageIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	raw, err := proto.Marshal(req)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	now := time.Now()
+	message := &messengertypes.OutboxMessage{
+		ID:                    b64EncodeBytes(id),
+		ConversationPublicKey: b64EncodeBytes(req.GetGroupPK()),
+		Type:                  t,
+		Request:               raw,
+		CreatedDate:           timestampMs(now),
+		ContentHash:           contentHash,
+	}
+	if ttl > 0 {
+		message.ExpiresAt = timestampMs(now.Add(ttl))
+	}
+	if err := svc.db.addOutboxMessage(message); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Debug("node offline, message deferred", zap.String("id", message.GetID()), zap.String("type", t.String()))
+
+	return message, nil
+}
+
+// flushOutbox sends the deferred messages in order, a message is removed once sent and the flush stops at the first
+// failure, the writer must be held
+func (svc *service) flushOutbox(ctx context.Context) error {
+	// the messages past their deadline are cancelled instead of being sent late
+	if err := svc.expireOutboxMessages(time.Now()); err != nil {
+		return err
+	}
+
+	messages, err := svc.db.getOutboxMessages()
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+
+	svc.logger.Info("sending the outbox", zap.Int("count", len(messages)))
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeOutboxFlushing, &messengertypes.StreamEvent_OutboxFlushing{Count: int64(len(messages))}, false); err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		if err := svc.sendOutboxMessage(ctx, message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendOutboxMessage sends a deferred message and removes it from the outbox, the error of a failed attempt is kept
+// with the message. The writer must be held
+func (svc *service) sendOutboxMessage(ctx context.Context, message *messengertypes.OutboxMessage) error {
+	req := &protocoltypes.AppMessageSend_Request{}
+	state, reason := messengertypes.LocalEcho_StateSent, ""
+	if err := proto.Unmarshal(message.GetRequest(), req); err != nil {
+		// an unreadable message would block the outbox forever
+		svc.logger.Error("dropping an invalid deferred message", zap.String("id", message.GetID()), zap.Error(err))
+		state, reason = messengertypes.LocalEcho_StateFailed, err.Error()
+	} else if err := svc.sendAppMessage(ctx, req); err != nil {
+		if err := svc.db.setOutboxMessageFailure(message.GetID(), err.Error(), timestampMs(time.Now())); err != nil {
+			svc.logger.Error("unable to keep the error of a deferred message", zap.String("id", message.GetID()), zap.Error(err))
+		}
+
+		return err
+	}
+
+	if err := svc.db.deleteOutboxMessage(message.GetID()); err != nil {
+		return err
+	}
+
+	svc.updateOutboxLocalEcho(message.GetID(), state, reason)
+
+	return nil
+}
+
+// expireOutboxMessages cancels the deferred messages whose deadline is past at now, their echoes are marked as expired
+// and the clients are told. The writer must be held
+func (svc *service) expireOutboxMessages(now time.Time) error {
+	messages, err := svc.db.getExpiredOutboxMessages(timestampMs(now))
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+
+	for _, message := range messages {
+		if err := svc.db.deleteOutboxMessage(message.GetID()); err != nil {
+			return err
+		}
+
+		echo, err := svc.db.getLocalEchoByOutboxID(message.GetID())
+		if err != nil {
+			return err
+		}
+
+		ev := &messengertypes.StreamEvent_OutboxMessageExpired{
+			OutboxID:              message.GetID(),
+			ConversationPublicKey: message.GetConversationPublicKey(),
+			Type:                  message.GetType(),
+		}
+		if echo != nil {
+			ev.LocalEchoID = echo.GetID()
+			svc.setLocalEchoState(echo.GetID(), messengertypes.LocalEcho_StateExpired, "the message was not sent before its deadline")
+		}
+
+		svc.logger.Debug("deferred message expired", zap.String("id", message.GetID()), zap.String("type", message.GetType().String()))
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeOutboxMessageExpired, ev, false); err != nil {
+			svc.logger.Error("unable to dispatch expired outbox message", zap.String("id", message.GetID()), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// monitorConnectivity sends the outbox when the node is online again, and on start if it is online. The deadlines of
+// the deferred messages are checked while the node is offline
+func (svc *service) monitorConnectivity(ctx context.Context) {
+	if svc.isOnline == nil {
+		return
+	}
+
+	ticker := time.NewTicker(connectivityCheckInterval)
+	defer ticker.Stop()
+
+	wasOnline := false
+	for {
+		online := svc.isOnline()
+		if online && !wasOnline {
+			release := svc.writer.enter()
+			err := svc.flushOutbox(ctx)
+			release()
+
+			// the flush is tried again on the next check
+			if err != nil {
+				svc.logger.Error("unable to send the outbox", zap.Error(err))
+				online = false
+			}
+		} else if !online {
+			release := svc.writer.enter()
+			err := svc.expireOutboxMessages(time.Now())
+			release()
+
+			if err != nil {
+				svc.logger.Error("unable to expire the outbox", zap.Error(err))
+			}
+		}
+		wasOnline = online
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (svc *service) OutboxList(ctx context.Context, req *messengertypes.OutboxList_Request) (*messengertypes.OutboxList_Reply, error) {
+	messages, err := svc.db.getConversationOutboxMessages(req.GetConversationPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.OutboxList_Reply{}
+	for _, message := range messages {
+		entry := &messengertypes.OutboxList_Entry{
+			Message: message,
+			State:   messengertypes.OutboxList_StateQueued,
+			Size_:   int64(len(message.GetRequest())),
+		}
+		if message.GetLastError() != "" {
+			entry.State = messengertypes.OutboxList_StateFailed
+		}
+
+		echo, err := svc.db.getLocalEchoByOutboxID(message.GetID())
+		if err != nil {
+			return nil, err
+		}
+		entry.LocalEchoID = echo.GetID()
+
+		// the request holds the whole payload of the message
+		message.Request = nil
+		reply.Entries = append(reply.Entries, entry)
+	}
+
+	return reply, nil
+}
+
+func (svc *service) OutboxRetry(ctx context.Context, req *messengertypes.OutboxRetry_Request) (*messengertypes.OutboxRetry_Reply, error) {
+	if req.GetOutboxID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	message, err := svc.db.getOutboxMessage(req.GetOutboxID())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := svc.sendOutboxMessage(ctx, message); err != nil {
+		return nil, errcode.TODO.Wrap(err)
+	}
+
+	return &messengertypes.OutboxRetry_Reply{}, nil
+}
+
+func (svc *service) OutboxCancel(ctx context.Context, req *messengertypes.OutboxCancel_Request) (*messengertypes.OutboxCancel_Reply, error) {
+	if req.GetOutboxID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if _, err := svc.db.getOutboxMessage(req.GetOutboxID()); err != nil {
+		return nil, err
+	}
+
+	if err := svc.db.deleteOutboxMessage(req.GetOutboxID()); err != nil {
+		return nil, err
+	}
+
+	svc.updateOutboxLocalEcho(req.GetOutboxID(), messengertypes.LocalEcho_StateFailed, "the message was removed from the outbox")
+
+	return &messengertypes.OutboxCancel_Reply{}, nil
+}
+
+func (svc *service) OutboxMove(ctx context.Context, req *messengertypes.OutboxMove_Request) (*messengertypes.OutboxMove_Reply, error) {
+	if req.GetOutboxID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	if err := svc.db.moveOutboxMessage(req.GetOutboxID(), req.GetBeforeOutboxID()); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.OutboxMove_Reply{}, nil
+}
@@ -0,0 +1,135 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_service_sendOrDeferAppMessage(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	online := false
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), isOnline: func() bool { return online }}
+
+	first, err := svc.sendOrDeferAppMessage(context.Background(), messengertypes.AppMessage_TypeUserMessage, "hash_1", 0, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_1"), Payload: []byte("payload_1")})
+	require.NoError(t, err)
+	require.NotNil(t, first)
+	require.Equal(t, b64EncodeBytes([]byte("group_1")), first.GetConversationPublicKey())
+
+	second, err := svc.sendOrDeferAppMessage(context.Background(), messengertypes.AppMessage_TypeLocation, "", 0, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_2"), Payload: []byte("payload_2")})
+	require.NoError(t, err)
+	require.NotNil(t, second)
+
+	messages, err := db.getOutboxMessages()
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, first.GetID(), messages[0].GetID())
+	require.Equal(t, second.GetID(), messages[1].GetID())
+	require.Less(t, messages[0].GetPosition(), messages[1].GetPosition())
+
+	// the unreadable messages are dropped instead of blocking the outbox
+	require.NoError(t, db.deleteOutboxMessage(second.GetID()))
+	require.NoError(t, db.db.Model(&messengertypes.OutboxMessage{}).Where("id = ?", first.GetID()).Update("request", []byte{0xff}).Error)
+
+	online = true
+	require.NoError(t, svc.flushOutbox(context.Background()))
+
+	messages, err = db.getOutboxMessages()
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func Test_service_expireOutboxMessages(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), isOnline: func() bool { return false }}
+
+	payload, err := messengertypes.AppMessage_TypeUserMessage.MarshalPayload(1000, nil, &messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	expiring, echo, err := svc.sendWithLocalEcho(context.Background(), messengertypes.AppMessage_TypeUserMessage, "hash_1", time.Minute, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_1"), Payload: payload})
+	require.NoError(t, err)
+	require.NotZero(t, expiring.GetExpiresAt())
+
+	kept, err := svc.sendOrDeferAppMessage(context.Background(), messengertypes.AppMessage_TypeLocation, "", 0, &protocoltypes.AppMessageSend_Request{GroupPK: []byte("group_1"), Payload: []byte("payload_2")})
+	require.NoError(t, err)
+	require.Zero(t, kept.GetExpiresAt())
+
+	require.NoError(t, svc.expireOutboxMessages(time.Now()))
+
+	messages, err := db.getOutboxMessages()
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	// only the message past its deadline is cancelled
+	require.NoError(t, svc.expireOutboxMessages(time.Now().Add(2*time.Minute)))
+
+	messages, err = db.getOutboxMessages()
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, kept.GetID(), messages[0].GetID())
+
+	echoes, err := db.getLocalEchoes("")
+	require.NoError(t, err)
+	require.Len(t, echoes, 1)
+	require.Equal(t, echo.GetID(), echoes[0].GetID())
+	require.Equal(t, messengertypes.LocalEcho_StateExpired, echoes[0].GetState())
+}
+
+func Test_dbWrapper_moveOutboxMessage(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	for _, id := range []string{"id_1", "id_2", "id_3"} {
+		require.NoError(t, db.addOutboxMessage(&messengertypes.OutboxMessage{ID: id, ConversationPublicKey: "conv_1", Request: []byte(id)}))
+	}
+	require.NoError(t, db.addOutboxMessage(&messengertypes.OutboxMessage{ID: "id_4", ConversationPublicKey: "conv_2"}))
+
+	order := func() []string {
+		messages, err := db.getOutboxMessages()
+		require.NoError(t, err)
+
+		ids := []string(nil)
+		for _, message := range messages {
+			ids = append(ids, message.GetID())
+		}
+		return ids
+	}
+
+	require.NoError(t, db.moveOutboxMessage("id_3", "id_1"))
+	require.Equal(t, []string{"id_3", "id_1", "id_2", "id_4"}, order())
+
+	require.NoError(t, db.moveOutboxMessage("id_3", ""))
+	require.Equal(t, []string{"id_1", "id_2", "id_4", "id_3"}, order())
+
+	require.Error(t, db.moveOutboxMessage("id_1", "id_1"))
+	require.Error(t, db.moveOutboxMessage("id_1", "unknown"))
+	require.Error(t, db.moveOutboxMessage("unknown", ""))
+
+	// the failed attempts are listed with their error
+	require.NoError(t, db.setOutboxMessageFailure("id_2", "attachment too large", 42))
+
+	reply, err := svc.OutboxList(context.Background(), &messengertypes.OutboxList_Request{ConversationPublicKey: "conv_1"})
+	require.NoError(t, err)
+	require.Len(t, reply.GetEntries(), 3)
+	require.Equal(t, messengertypes.OutboxList_StateQueued, reply.GetEntries()[0].GetState())
+	require.Equal(t, int64(4), reply.GetEntries()[0].GetSize_())
+	require.Empty(t, reply.GetEntries()[0].GetMessage().GetRequest())
+
+	failed := reply.GetEntries()[1]
+	require.Equal(t, messengertypes.OutboxList_StateFailed, failed.GetState())
+	require.Equal(t, "attachment too large", failed.GetMessage().GetLastError())
+	require.Equal(t, int32(1), failed.GetMessage().GetAttempts())
+	require.Equal(t, int64(42), failed.GetMessage().GetLastAttemptDate())
+}
@@ -0,0 +1,291 @@
+package bertymessenger
+
+import (
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// interactionListMaxCount bounds the number of interactions returned by a page of InteractionList
+const interactionListMaxCount = 200
+
+// encodeInteractionCursor returns the opaque token used to list the interactions older than i in the given order
+func encodeInteractionCursor(i *messengertypes.Interaction, order messengertypes.Account_InteractionOrder) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.InteractionList_Cursor{
+		LamportTime: i.GetLamportTime(),
+		CID:         i.GetCID(),
+		Order:       order,
+		Date:        interactionOrderDate(i, order),
+	})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// encodeInteractionAnchorCursor returns the opaque token used to list the interactions from i included in the given order
+func encodeInteractionAnchorCursor(i *messengertypes.Interaction, order messengertypes.Account_InteractionOrder) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.InteractionList_Cursor{
+		LamportTime: i.GetLamportTime(),
+		CID:         i.GetCID(),
+		Inclusive:   true,
+		Order:       order,
+		Date:        interactionOrderDate(i, order),
+	})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeInteractionCursor parses a token returned by encodeInteractionCursor or encodeInteractionAnchorCursor, nil is returned for an empty token
+func decodeInteractionCursor(token string) (*messengertypes.InteractionList_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.InteractionList_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetCID() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	if _, ok := messengertypes.Account_InteractionOrder_name[int32(cursor.GetOrder())]; !ok {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeStarredCursor returns the opaque token used to list the interactions starred before star
+func encodeStarredCursor(star *messengertypes.StarredInteraction) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.InteractionStarredList_Cursor{
+		StarredDate: star.GetStarredDate(),
+		CID:         star.GetInteractionCID(),
+	})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeStarredCursor parses a token returned by encodeStarredCursor, nil is returned for an empty token
+func decodeStarredCursor(token string) (*messengertypes.InteractionStarredList_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.InteractionStarredList_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetCID() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeGroupAuditCursor returns the opaque token used to list the audit events older than event
+func encodeGroupAuditCursor(event *messengertypes.GroupAuditEvent) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.ConversationAuditLog_Cursor{
+		Date: event.GetDate(),
+		ID:   event.GetID(),
+	})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeGroupAuditCursor parses a token returned by encodeGroupAuditCursor, nil is returned for an empty token
+func decodeGroupAuditCursor(token string) (*messengertypes.ConversationAuditLog_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.ConversationAuditLog_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetID() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeConversationFileCursor returns the opaque token used to list the files after file for a sort
+func encodeConversationFileCursor(sort messengertypes.ConversationFilesList_Sort, file *messengertypes.ConversationFile) (string, error) {
+	c := &messengertypes.ConversationFilesList_Cursor{
+		Sort:           sort,
+		InteractionCID: file.GetInteractionCID(),
+		MediaCID:       file.GetMediaCID(),
+	}
+	switch sort {
+	case messengertypes.ConversationFilesList_SortLargest, messengertypes.ConversationFilesList_SortSmallest:
+		c.Value = file.GetSize_()
+	case messengertypes.ConversationFilesList_SortName:
+		c.Name = file.GetName()
+	default:
+		c.Value = file.GetSentDate()
+	}
+
+	cursor, err := proto.Marshal(c)
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeConversationFileCursor parses a token returned by encodeConversationFileCursor, nil is returned for an empty
+// token
+func decodeConversationFileCursor(token string) (*messengertypes.ConversationFilesList_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.ConversationFilesList_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetInteractionCID() == "" || cursor.GetMediaCID() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeActivityFeedCursor returns the opaque token used to read the activity feed after i
+func encodeActivityFeedCursor(i *messengertypes.Interaction) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.ActivityFeed_Cursor{SentDate: i.GetSentDate(), CID: i.GetCID()})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+func decodeActivityFeedCursor(token string) (*messengertypes.ActivityFeed_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.ActivityFeed_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetCID() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeMemberCursor returns the opaque token used to list the members after m
+func encodeMemberCursor(m *messengertypes.Member) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.ConversationMemberList_Cursor{PublicKey: m.GetPublicKey()})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeMemberCursor parses a token returned by encodeMemberCursor, nil is returned for an empty token
+func decodeMemberCursor(token string) (*messengertypes.ConversationMemberList_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.ConversationMemberList_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetPublicKey() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
+
+// encodeContactRequestCursor returns the opaque token used to list the contact requests older than request
+func encodeContactRequestCursor(request *messengertypes.PendingContactRequest) (string, error) {
+	cursor, err := proto.Marshal(&messengertypes.ContactRequestList_Cursor{
+		CreatedDate:      request.GetCreatedDate(),
+		ContactPublicKey: request.GetContactPublicKey(),
+	})
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(cursor), nil
+}
+
+// decodeContactRequestCursor parses a token returned by encodeContactRequestCursor, nil is returned for an empty token
+func decodeContactRequestCursor(token string) (*messengertypes.ContactRequestList_Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	raw, err := b64DecodeBytes(token)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	cursor := &messengertypes.ContactRequestList_Cursor{}
+	if err := proto.Unmarshal(raw, cursor); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if cursor.GetContactPublicKey() == "" {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	return cursor, nil
+}
@@ -0,0 +1,75 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestInteractionCursor(t *testing.T) {
+	cursor, err := decodeInteractionCursor("")
+	require.NoError(t, err)
+	require.Nil(t, cursor)
+
+	_, err = decodeInteractionCursor("not a cursor!")
+	require.Error(t, err)
+
+	token, err := encodeInteractionCursor(&messengertypes.Interaction{CID: "cid_1", LamportTime: 42}, messengertypes.Account_OrderLogical)
+	require.NoError(t, err)
+
+	cursor, err = decodeInteractionCursor(token)
+	require.NoError(t, err)
+	require.Equal(t, uint64(42), cursor.GetLamportTime())
+	require.Equal(t, "cid_1", cursor.GetCID())
+}
+
+func Test_dbWrapper_getPaginatedInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.getPaginatedInteractions("", false, messengertypes.Account_OrderLogical, nil, 10)
+	require.Error(t, err)
+
+	// the rows are inserted out of order, as after a replay
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_c", LamportTime: 2},
+		{CID: "cid_a", LamportTime: 1},
+		{CID: "cid_e", LamportTime: 3},
+		{CID: "cid_b", LamportTime: 2},
+		{CID: "cid_d", LamportTime: 3},
+	} {
+		i.ConversationPublicKey = "conv_1"
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_other", ConversationPublicKey: "conv_2", LamportTime: 10}).Error)
+
+	cids := func(interactions []*messengertypes.Interaction) []string {
+		ret := []string(nil)
+		for _, i := range interactions {
+			ret = append(ret, i.GetCID())
+		}
+		return ret
+	}
+
+	interactions, err := db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderLogical, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_e", "cid_d"}, cids(interactions))
+
+	// a new interaction doesn't shift the next page
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_f", ConversationPublicKey: "conv_1", LamportTime: 4}).Error)
+
+	interactions, err = db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderLogical, &messengertypes.InteractionList_Cursor{LamportTime: 3, CID: "cid_d"}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_c", "cid_b"}, cids(interactions))
+
+	interactions, err = db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderLogical, &messengertypes.InteractionList_Cursor{LamportTime: 2, CID: "cid_b"}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_a"}, cids(interactions))
+
+	// the interaction of an inclusive cursor is listed too
+	interactions, err = db.getPaginatedInteractions("conv_1", false, messengertypes.Account_OrderLogical, &messengertypes.InteractionList_Cursor{LamportTime: 2, CID: "cid_c", Inclusive: true}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_c", "cid_b"}, cids(interactions))
+}
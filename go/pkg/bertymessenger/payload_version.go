@@ -0,0 +1,148 @@
+package bertymessenger
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The messages sent by a newer version may use a type or a payload version this node doesn't understand yet. They are
+// stored as unsupported interactions, rendered by the clients as a prompt to upgrade, and handled in place once the
+// node is upgraded: the interaction keeps everything needed to rebuild the app message.
+
+func (h *eventHandler) handleUnsupportedAppMessage(i *messengertypes.Interaction, am *messengertypes.AppMessage, cid, hash string) error {
+	h.logger.Info("storing unsupported app message", zap.Int32("type", int32(am.GetType())), zap.Uint32("payload-version", am.GetPayloadVersion()))
+
+	i.IsUnsupported = true
+	i.PayloadVersion = am.GetPayloadVersion()
+
+	var isNew bool
+	if err := h.db.tx(func(tx *dbWrapper) error {
+		if err := h.interactionFetchRelations(tx, i); err != nil {
+			return err
+		}
+
+		if blocked, err := tx.isInteractionSenderBlocked(i); err != nil {
+			return err
+		} else if blocked {
+			return errSenderBlocked
+		}
+
+		var err error
+		if i, isNew, err = tx.addInteraction(*i); err != nil {
+			return err
+		}
+
+		if cid == "" {
+			return nil
+		}
+
+		return tx.markEventProcessed(cid, i.GetConversationPublicKey(), hash, timestampMs(time.Now()))
+	}); err == errSenderBlocked {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !isNew || h.svc == nil {
+		return nil
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, true)
+}
+
+// appMessageFromUnsupportedInteraction rebuilds the app message an unsupported interaction has been stored from
+func appMessageFromUnsupportedInteraction(i *messengertypes.Interaction) *messengertypes.AppMessage {
+	return &messengertypes.AppMessage{
+		Type:           i.GetType(),
+		Payload:        i.GetPayload(),
+		SentDate:       i.GetSentDate(),
+		Medias:         i.GetMedias(),
+		ViaGateway:     i.GetViaGateway(),
+		PayloadVersion: i.GetPayloadVersion(),
+		Extensions:     i.ExtensionsMap(),
+	}
+}
+
+// upgradeUnsupportedInteractions handles the unsupported interactions this node now understands, each one is replaced
+// by what its handler stores
+func (h *eventHandler) upgradeUnsupportedInteractions() error {
+	interactions, err := h.db.getUnsupportedInteractions()
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range interactions {
+		am := appMessageFromUnsupportedInteraction(stored)
+		if !am.IsPayloadSupported() {
+			continue
+		}
+
+		handler, ok := h.appMessageHandlers[am.GetType()]
+		if !ok {
+			h.logger.Warn("unsupported app message type", zap.String("type", am.GetType().String()))
+			continue
+		}
+
+		i := &messengertypes.Interaction{
+			CID:                   stored.GetCID(),
+			Type:                  stored.GetType(),
+			Payload:               stored.GetPayload(),
+			IsMe:                  stored.GetIsMe(),
+			ConversationPublicKey: stored.GetConversationPublicKey(),
+			SentDate:              stored.GetSentDate(),
+			DevicePublicKey:       stored.GetDevicePublicKey(),
+			Medias:                stored.GetMedias(),
+			MemberPublicKey:       stored.GetMemberPublicKey(),
+			LamportTime:           stored.GetLamportTime(),
+			ViaGateway:            stored.GetViaGateway(),
+			Extensions:            stored.GetExtensions(),
+		}
+
+		var isNew bool
+		if err := h.db.tx(func(tx *dbWrapper) error {
+			if err := tx.deleteUnsupportedInteraction(i.GetCID()); err != nil {
+				return err
+			}
+
+			if _, err := tx.addMedias(i.GetMedias()); err != nil {
+				return err
+			}
+
+			handledI, handledIsNew, err := h.handleInteraction(tx, i, am, handler.handler, handler.isVisibleEvent)
+			if err != nil {
+				return err
+			}
+			i, isNew = handledI, handledIsNew
+
+			return nil
+		}); err == errSenderBlocked || err == errSenderNotAllowed || err == errInteractionPruned {
+			// the placeholder is kept, it is hidden as any message refused on its first delivery
+			continue
+		} else if err != nil {
+			h.logger.Error("unable to upgrade unsupported interaction", zap.String("cid", stored.GetCID()), zap.Error(err))
+			continue
+		}
+
+		h.logger.Info("unsupported interaction upgraded", zap.String("cid", stored.GetCID()), zap.String("type", am.GetType().String()))
+
+		if h.svc == nil {
+			continue
+		}
+
+		// the handlers of the events which aren't visible may only update another interaction
+		if handler.isVisibleEvent && isNew {
+			if err := h.dispatchVisibleInteraction(i); err != nil {
+				h.logger.Error("unable to dispatch notification for interaction", zap.String("cid", i.GetCID()), zap.Error(err))
+			}
+		} else if isNew && i.GetCID() == stored.GetCID() {
+			continue
+		} else if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: stored.GetCID()}, false); err != nil {
+			h.logger.Error("unable to dispatch notification for interaction", zap.String("cid", stored.GetCID()), zap.Error(err))
+		}
+	}
+
+	return nil
+}
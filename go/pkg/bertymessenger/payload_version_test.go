@@ -0,0 +1,67 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_unsupportedAppMessages(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_ContactType}).Error)
+
+	h := newEventHandler(context.Background(), db, nil, zap.NewNop(), nil, false)
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+
+	messages := []*messengertypes.AppMessage{
+		// a type added by a newer version
+		{Type: messengertypes.AppMessage_Type(999), Payload: []byte("opaque"), SentDate: 1000, PayloadVersion: 1},
+		// a newer version of a known payload
+		{Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload, SentDate: 2000, PayloadVersion: messengertypes.AppMessage_TypeUserMessage.PayloadVersion() + 1},
+	}
+	for n, am := range messages {
+		require.False(t, am.IsPayloadSupported())
+
+		cid := []string{"cid_type", "cid_version"}[n]
+		i := &messengertypes.Interaction{CID: cid, Type: am.GetType(), Payload: am.GetPayload(), ConversationPublicKey: "conv_1", SentDate: am.GetSentDate(), IsMe: true, LamportTime: uint64(n + 1)}
+		require.NoError(t, h.handleUnsupportedAppMessage(i, am, "", ""))
+	}
+
+	// the messages without a version were sent before the versioning
+	require.True(t, (&messengertypes.AppMessage{Type: messengertypes.AppMessage_TypeUserMessage}).IsPayloadSupported())
+
+	unsupported, err := db.getUnsupportedInteractions()
+	require.NoError(t, err)
+	require.Len(t, unsupported, 2)
+
+	// nothing is understood yet
+	require.NoError(t, h.upgradeUnsupportedInteractions())
+	unsupported, err = db.getUnsupportedInteractions()
+	require.NoError(t, err)
+	require.Len(t, unsupported, 2)
+
+	// once upgraded, the node understands the newer version of the user messages
+	require.NoError(t, db.db.Model(&messengertypes.Interaction{}).Where("cid = ?", "cid_version").Update("payload_version", messengertypes.AppMessage_TypeUserMessage.PayloadVersion()).Error)
+	require.NoError(t, h.upgradeUnsupportedInteractions())
+
+	unsupported, err = db.getUnsupportedInteractions()
+	require.NoError(t, err)
+	require.Len(t, unsupported, 1)
+	require.Equal(t, "cid_type", unsupported[0].GetCID())
+
+	i, err := db.getInteractionByCID("cid_version")
+	require.NoError(t, err)
+	require.False(t, i.GetIsUnsupported())
+	require.Equal(t, messengertypes.AppMessage_TypeUserMessage, i.GetType())
+	require.Equal(t, int64(2000), i.GetSentDate())
+}
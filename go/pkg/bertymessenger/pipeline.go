@@ -0,0 +1,66 @@
+package bertymessenger
+
+import (
+	"context"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// EventPipeline exposes the handling of the protocol events and the replay of the logs without a running service, it
+// is used to measure the handler and database layers
+type EventPipeline struct {
+	db      *dbWrapper
+	client  protocoltypes.ProtocolServiceClient
+	handler *eventHandler
+}
+
+// NewEventPipeline initializes the messenger schema on db, the events are handled like live events but nothing is
+// dispatched nor sent back to the protocol
+func NewEventPipeline(ctx context.Context, db *gorm.DB, client protocoltypes.ProtocolServiceClient, logger *zap.Logger) (*EventPipeline, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	wrappedDB := newDBWrapper(db, logger)
+	if err := wrappedDB.initDB(getEventsReplayerForDB(ctx, client, ReplayOptions{})); err != nil {
+		return nil, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return &EventPipeline{
+		db:      wrappedDB,
+		client:  client,
+		handler: newEventHandler(ctx, wrappedDB, client, logger, nil, false),
+	}, nil
+}
+
+func (p *EventPipeline) HandleMetadataEvent(gme *protocoltypes.GroupMetadataEvent) error {
+	return p.handler.handleMetadataEvent(gme)
+}
+
+func (p *EventPipeline) HandleMessageEvent(gme *protocoltypes.GroupMessageEvent) error {
+	var am messengertypes.AppMessage
+	if err := proto.Unmarshal(gme.GetMessage(), &am); err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return p.handler.handleAppMessage(b64EncodeBytes(gme.GetEventContext().GetGroupPK()), gme, &am)
+}
+
+// Replay rebuilds the database from the logs of the protocol client, like on the first start of an account, the events
+// which fail are skipped and listed in the report
+func (p *EventPipeline) Replay(ctx context.Context) (*messengertypes.ReplayReport, error) {
+	return replayLogsToDB(ctx, p.client, p.db, replayFilter{})
+}
+
+// ReplayWithOptions handles the events of the logs of the account, the messages sent outside of the window of opts
+// are skipped
+func (p *EventPipeline) ReplayWithOptions(ctx context.Context, opts ReplayOptions) (*messengertypes.ReplayReport, error) {
+	return replayLogsToDB(ctx, p.client, p.db, replayFilter{window: opts})
+}
@@ -0,0 +1,229 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// pollParticipantPK returns the key identifying the author of a poll, a ballot or a close: the member public key in a
+// group so that all the devices of a member share the same ballot, the device public key elsewhere
+func pollParticipantPK(i *messengertypes.Interaction) string {
+	if memberPK := interactionSenderMemberPK(i); memberPK != "" {
+		return memberPK
+	}
+
+	return i.GetDevicePublicKey()
+}
+
+func (h *eventHandler) handleAppMessagePollCreate(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_PollCreate)
+	if err := payload.IsValid(); err != nil {
+		h.logger.Warn("ignoring invalid poll", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	i, isNew, err := tx.addInteraction(*i)
+	if err != nil {
+		return nil, false, err
+	}
+
+	poll := &messengertypes.Poll{
+		CID:                   i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		DevicePublicKey:       i.GetDevicePublicKey(),
+		MemberPublicKey:       pollParticipantPK(i),
+		IsMe:                  i.GetIsMe(),
+		Question:              payload.GetQuestion(),
+		MultipleChoice:        payload.GetMultipleChoice(),
+		Visibility:            payload.GetVisibility(),
+		SentDate:              i.GetSentDate(),
+	}
+	for index, label := range payload.GetOptions() {
+		poll.Options = append(poll.Options, &messengertypes.PollOption{PollCID: poll.CID, Index: int32(index), Label: label})
+	}
+
+	if _, err := tx.addPoll(poll); err != nil {
+		return nil, false, err
+	}
+
+	if h.svc != nil {
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if err := h.dispatchPollUpdated(tx, poll.GetCID(), isNew); err != nil {
+		return nil, false, err
+	}
+
+	return i, isNew, nil
+}
+
+func (h *eventHandler) handleAppMessagePollVote(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_PollVote)
+	if err := payload.IsValid(); err != nil {
+		h.logger.Warn("ignoring invalid poll vote", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	// votes are stored even if the poll is not known yet, they are checked against it when computing the results
+	applied, err := tx.setPollBallot(&messengertypes.PollVote{
+		PollCID:         payload.GetPollCID(),
+		DevicePublicKey: i.GetDevicePublicKey(),
+		MemberPublicKey: pollParticipantPK(i),
+		IsMe:            i.GetIsMe(),
+		BallotCID:       i.GetCID(),
+		SentDate:        i.GetSentDate(),
+	}, payload.GetOptionIndexes())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if applied {
+		if err := h.dispatchPollUpdated(tx, payload.GetPollCID(), false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) handleAppMessagePollClose(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_PollClose)
+	if err := payload.IsValid(); err != nil {
+		h.logger.Warn("ignoring invalid poll close", zap.String("cid", i.GetCID()), zap.Error(err))
+		return i, false, nil
+	}
+
+	// the close is kept even if the poll is not known yet, it only applies if it was sent by the author of the poll
+	updated, err := tx.closePoll(&messengertypes.PollClose{
+		PollCID:         payload.GetPollCID(),
+		CloseCID:        i.GetCID(),
+		MemberPublicKey: pollParticipantPK(i),
+		DevicePublicKey: i.GetDevicePublicKey(),
+		ClosedDate:      i.GetSentDate(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if updated {
+		if err := h.dispatchPollUpdated(tx, payload.GetPollCID(), false); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return i, false, nil
+}
+
+func (h *eventHandler) dispatchPollUpdated(tx *dbWrapper, pollCID string, isNew bool) error {
+	if h.svc == nil {
+		return nil
+	}
+
+	result, err := getPollResult(tx, pollCID)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypePollUpdated, &messengertypes.StreamEvent_PollUpdated{Poll: result}, isNew)
+}
+
+func getPollResult(db *dbWrapper, pollCID string) (*messengertypes.PollResult, error) {
+	poll, err := db.getPoll(pollCID)
+	if err != nil {
+		return nil, err
+	}
+
+	votes, err := db.getPollVotes(pollCID)
+	if err != nil {
+		return nil, err
+	}
+
+	return computePollResult(poll, votes), nil
+}
+
+// computePollResult aggregates the votes of a poll, it only depends on the stored ballots so the result is the same whatever the delivery order
+func computePollResult(poll *messengertypes.Poll, votes []*messengertypes.PollVote) *messengertypes.PollResult {
+	// only the closes sent by the author are applied to the poll
+	result := &messengertypes.PollResult{
+		Poll:   poll,
+		Closed: poll.GetClosedDate() != 0,
+	}
+
+	options := make(map[int32]*messengertypes.PollResult_Option, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		o := &messengertypes.PollResult_Option{Index: option.GetIndex(), Label: option.GetLabel()}
+		options[option.GetIndex()] = o
+		result.Options = append(result.Options, o)
+	}
+
+	counted := map[string]bool{}
+	for _, vote := range votes {
+		// votes sent after the poll was closed are ignored
+		if result.Closed && vote.GetSentDate() > poll.GetClosedDate() {
+			continue
+		}
+
+		option, ok := options[vote.GetOptionIndex()]
+		if !ok {
+			continue
+		}
+
+		// votes are sorted by option index, only the first choice of a member is kept for single choice polls
+		if !poll.GetMultipleChoice() && counted[vote.GetMemberPublicKey()] {
+			continue
+		}
+
+		if !counted[vote.GetMemberPublicKey()] {
+			counted[vote.GetMemberPublicKey()] = true
+			result.Voters++
+		}
+
+		option.Votes++
+		if poll.GetVisibility() == messengertypes.Poll_VisibilityPublic {
+			option.VoterDevicePublicKeys = append(option.VoterDevicePublicKeys, vote.GetDevicePublicKey())
+		}
+
+		if vote.GetIsMe() {
+			result.MyVotes = append(result.MyVotes, vote.GetOptionIndex())
+		}
+	}
+
+	return result
+}
+
+// checkPollVote ensures a vote sent by the local node matches the poll
+func checkPollVote(db *dbWrapper, vote *messengertypes.AppMessage_PollVote) error {
+	poll, err := db.getPoll(vote.GetPollCID())
+	if err == gorm.ErrRecordNotFound {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown poll"))
+	} else if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	if !poll.GetMultipleChoice() && len(vote.GetOptionIndexes()) > 1 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("poll only accepts a single choice"))
+	}
+
+	for _, index := range vote.GetOptionIndexes() {
+		if int(index) >= len(poll.GetOptions()) {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid option index %d", index))
+		}
+	}
+
+	if poll.GetClosedDate() != 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("poll is closed"))
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testPoll(multipleChoice bool) *messengertypes.Poll {
+	return &messengertypes.Poll{
+		CID:                   "poll_1",
+		ConversationPublicKey: "conv_1",
+		DevicePublicKey:       "author_device",
+		MemberPublicKey:       "author",
+		Question:              "?",
+		MultipleChoice:        multipleChoice,
+		SentDate:              10,
+		Options: []*messengertypes.PollOption{
+			{PollCID: "poll_1", Index: 0, Label: "a"},
+			{PollCID: "poll_1", Index: 1, Label: "b"},
+		},
+	}
+}
+
+func Test_computePollResult(t *testing.T) {
+	votes := []*messengertypes.PollVote{
+		{MemberPublicKey: "m1", DevicePublicKey: "d1", OptionIndex: 0, SentDate: 20},
+		{MemberPublicKey: "m1", DevicePublicKey: "d1", OptionIndex: 1, SentDate: 20},
+		{MemberPublicKey: "m2", DevicePublicKey: "d2", OptionIndex: 1, SentDate: 40, IsMe: true},
+		{MemberPublicKey: "m3", DevicePublicKey: "d3", OptionIndex: -1, SentDate: 20},
+		{MemberPublicKey: "m4", DevicePublicKey: "d4", OptionIndex: 5, SentDate: 20},
+	}
+
+	result := computePollResult(testPoll(true), votes)
+	require.False(t, result.Closed)
+	require.Equal(t, int64(2), result.Voters)
+	require.Equal(t, int64(1), result.Options[0].Votes)
+	require.Equal(t, int64(2), result.Options[1].Votes)
+	require.Equal(t, []string{"d1", "d2"}, result.Options[1].VoterDevicePublicKeys)
+	require.Equal(t, []int32{1}, result.MyVotes)
+
+	result = computePollResult(testPoll(false), votes)
+	require.Equal(t, int64(1), result.Options[0].Votes)
+	require.Equal(t, int64(1), result.Options[1].Votes)
+
+	poll := testPoll(true)
+	poll.Visibility = messengertypes.Poll_VisibilityAnonymous
+	poll.ClosedDate = 30
+	poll.ClosedByDevicePublicKey = "author_device"
+	result = computePollResult(poll, votes)
+	require.True(t, result.Closed)
+	require.Equal(t, int64(1), result.Voters)
+	require.Empty(t, result.Options[0].VoterDevicePublicKeys)
+}
+
+func Test_dbWrapper_polls(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	// votes and closes may be received before the poll
+	applied, err := db.setPollBallot(&messengertypes.PollVote{PollCID: "poll_1", MemberPublicKey: "m1", DevicePublicKey: "d1", BallotCID: "b2", SentDate: 20}, []int32{1})
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	// the ballots of the devices of a member replace each other
+	applied, err = db.setPollBallot(&messengertypes.PollVote{PollCID: "poll_1", MemberPublicKey: "m1", DevicePublicKey: "d1_bis", BallotCID: "b1", SentDate: 15}, []int32{0})
+	require.NoError(t, err)
+	require.False(t, applied)
+
+	// every close is kept until the author of the poll is known
+	updated, err := db.closePoll(&messengertypes.PollClose{PollCID: "poll_1", CloseCID: "c1", MemberPublicKey: "m1", DevicePublicKey: "d1", ClosedDate: 40})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	updated, err = db.closePoll(&messengertypes.PollClose{PollCID: "poll_1", CloseCID: "c2", MemberPublicKey: "author", DevicePublicKey: "author_other_device", ClosedDate: 50})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	polls, err := db.getPollsByConversation("conv_1")
+	require.NoError(t, err)
+	require.Empty(t, polls)
+
+	isNew, err := db.addPoll(testPoll(false))
+	require.NoError(t, err)
+	require.True(t, isNew)
+
+	isNew, err = db.addPoll(testPoll(false))
+	require.NoError(t, err)
+	require.False(t, isNew)
+
+	// the close sent by another device of the author applies, the earlier one of another member doesn't
+	result, err := getPollResult(db, "poll_1")
+	require.NoError(t, err)
+	require.True(t, result.Closed)
+	require.Equal(t, int64(50), result.Poll.ClosedDate)
+	require.Equal(t, "author_other_device", result.Poll.ClosedByDevicePublicKey)
+	require.Len(t, result.Options, 2)
+	require.Equal(t, int64(1), result.Options[1].Votes)
+
+	// the earliest close of the author wins
+	updated, err = db.closePoll(&messengertypes.PollClose{PollCID: "poll_1", CloseCID: "c3", MemberPublicKey: "author", DevicePublicKey: "author_device", ClosedDate: 45})
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	updated, err = db.closePoll(&messengertypes.PollClose{PollCID: "poll_1", CloseCID: "c4", MemberPublicKey: "m1", DevicePublicKey: "d1", ClosedDate: 30})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	result, err = getPollResult(db, "poll_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(45), result.Poll.ClosedDate)
+
+	// a withdrawn vote is kept to order the next ballots
+	applied, err = db.setPollBallot(&messengertypes.PollVote{PollCID: "poll_1", MemberPublicKey: "m1", DevicePublicKey: "d1_bis", BallotCID: "b3", SentDate: 30}, nil)
+	require.NoError(t, err)
+	require.True(t, applied)
+
+	votes, err := db.getPollVotes("poll_1")
+	require.NoError(t, err)
+	require.Len(t, votes, 1)
+	require.Equal(t, int32(-1), votes[0].OptionIndex)
+
+	polls, err = db.getPollsByConversation("conv_1")
+	require.NoError(t, err)
+	require.Len(t, polls, 1)
+}
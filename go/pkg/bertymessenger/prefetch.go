@@ -0,0 +1,375 @@
+package bertymessenger
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The clients hint the page of a conversation they show with ConversationPrefetch, the page and the older ones next to
+// it are then read in the background with their small images, so the pages are already in memory when the user
+// scrolls. The pages of a conversation are dropped from the cache on any event of the conversation, and all of them on
+// the events changing the interactions without being tied to a conversation. The images are kept as their content
+// never changes.
+
+const (
+	// prefetchPageCacheSize is the number of pages of interactions kept in memory
+	prefetchPageCacheSize = 64
+	// prefetchMediaCacheMaxSize bounds the total size in bytes of the images kept in memory
+	prefetchMediaCacheMaxSize = 8 * 1024 * 1024
+	// prefetchMediaMaxSize is the size in bytes above which an image isn't prefetched, ie. the thumbnails of the link
+	// previews and the small pictures are
+	prefetchMediaMaxSize = 256 * 1024
+	prefetchDefaultPages = 2
+	prefetchMaxPages     = 5
+	// the caches are shrunk in low-storage mode
+	prefetchLowStoragePageCacheSize     = 16
+	prefetchLowStorageMediaCacheMaxSize = 1024 * 1024
+)
+
+type prefetchCache struct {
+	mu sync.Mutex
+	// generations are bumped on each event of a conversation and epoch on the events of all of them, a page read
+	// before an event isn't cached after it
+	generations  map[string]uint64
+	epoch        uint64
+	pages        *list.List
+	pageEntries  map[string]*list.Element
+	medias       *list.List
+	mediaEntries map[string]*list.Element
+	mediaSize    int
+	pageLimit    int
+	mediaLimit   int
+}
+
+type prefetchPage struct {
+	key    string
+	convPK string
+	reply  *messengertypes.InteractionList_Reply
+}
+
+type prefetchMedia struct {
+	cid  string
+	data []byte
+}
+
+func newPrefetchCache() *prefetchCache {
+	return &prefetchCache{
+		generations:  map[string]uint64{},
+		pages:        list.New(),
+		pageEntries:  map[string]*list.Element{},
+		medias:       list.New(),
+		mediaEntries: map[string]*list.Element{},
+		pageLimit:    prefetchPageCacheSize,
+		mediaLimit:   prefetchMediaCacheMaxSize,
+	}
+}
+
+// setLowStorage shrinks the limits of the cache in low-storage mode, the oldest entries above them are dropped
+func (c *prefetchCache) setLowStorage(enabled bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pageLimit, c.mediaLimit = prefetchPageCacheSize, prefetchMediaCacheMaxSize
+	if enabled {
+		c.pageLimit, c.mediaLimit = prefetchLowStoragePageCacheSize, prefetchLowStorageMediaCacheMaxSize
+	}
+
+	c.evict()
+}
+
+// evict drops the oldest pages and medias above the limits, the lock must be held
+func (c *prefetchCache) evict() {
+	for c.pages.Len() > c.pageLimit {
+		oldest := c.pages.Back()
+		c.pages.Remove(oldest)
+		delete(c.pageEntries, oldest.Value.(*prefetchPage).key)
+	}
+
+	for c.mediaSize > c.mediaLimit {
+		oldest := c.medias.Back()
+		c.medias.Remove(oldest)
+		media := oldest.Value.(*prefetchMedia)
+		delete(c.mediaEntries, media.cid)
+		c.mediaSize -= len(media.data)
+	}
+}
+
+func prefetchPageKey(convPK string, includeMuted bool, cursor string, count int) string {
+	return fmt.Sprintf("%s/%t/%d/%s", convPK, includeMuted, count, cursor)
+}
+
+func (c *prefetchCache) generation(convPK string) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.epoch + c.generations[convPK]
+}
+
+// page returns a copy of a cached page, nil when it isn't cached
+func (c *prefetchCache) page(key string) *messengertypes.InteractionList_Reply {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.pageEntries[key]
+	if !ok {
+		return nil
+	}
+	c.pages.MoveToFront(elem)
+
+	return proto.Clone(elem.Value.(*prefetchPage).reply).(*messengertypes.InteractionList_Reply)
+}
+
+// putPage caches a page read at the given generation of its conversation, it is dropped if an event of the
+// conversation has been dispatched since
+func (c *prefetchCache) putPage(convPK, key string, generation uint64, reply *messengertypes.InteractionList_Reply) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch+c.generations[convPK] != generation {
+		return
+	}
+
+	if elem, ok := c.pageEntries[key]; ok {
+		c.pages.Remove(elem)
+	}
+
+	c.pageEntries[key] = c.pages.PushFront(&prefetchPage{key: key, convPK: convPK, reply: proto.Clone(reply).(*messengertypes.InteractionList_Reply)})
+	c.evict()
+}
+
+func (c *prefetchCache) media(cid string) []byte {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.mediaEntries[cid]
+	if !ok {
+		return nil
+	}
+	c.medias.MoveToFront(elem)
+
+	return elem.Value.(*prefetchMedia).data
+}
+
+func (c *prefetchCache) putMedia(cid string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.mediaEntries[cid]; ok || len(data) > c.mediaLimit {
+		return
+	}
+
+	c.mediaEntries[cid] = c.medias.PushFront(&prefetchMedia{cid: cid, data: data})
+	c.mediaSize += len(data)
+	c.evict()
+}
+
+// StreamEvent drops the cached pages of the conversation of a dispatched event
+func (c *prefetchCache) StreamEvent(e *messengertypes.StreamEvent) error {
+	convPK := streamEventConversation(e)
+	if convPK == "" {
+		switch e.GetType() {
+		// the first pages depend on the order of the interactions set on the account
+		case messengertypes.StreamEvent_TypeInteractionDeleted, messengertypes.StreamEvent_TypeMediaUpdated, messengertypes.StreamEvent_TypeContactUpdated, messengertypes.StreamEvent_TypeAccountUpdated:
+		default:
+			return nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if convPK == "" {
+		c.epoch++
+	} else {
+		c.generations[convPK]++
+	}
+
+	for elem := c.pages.Front(); elem != nil; {
+		next := elem.Next()
+		if page := elem.Value.(*prefetchPage); convPK == "" || page.convPK == convPK {
+			c.pages.Remove(elem)
+			delete(c.pageEntries, page.key)
+		}
+		elem = next
+	}
+
+	return nil
+}
+
+var _ Notifiee = (*prefetchCache)(nil)
+
+// isPrefetchableMedia checks that a media is a small image available on this device, the medias which would have to
+// be downloaded aren't prefetched
+func isPrefetchableMedia(media *messengertypes.Media) bool {
+	if !strings.HasPrefix(media.GetMimeType(), "image/") || media.GetSize_() <= 0 || media.GetSize_() > prefetchMediaMaxSize {
+		return false
+	}
+
+	switch media.GetState() {
+	case messengertypes.Media_StateDownloaded, messengertypes.Media_StateInCache, messengertypes.Media_StatePrepared, messengertypes.Media_StateAttached:
+		return true
+	}
+
+	return false
+}
+
+// interactionsPage reads a page of the interactions of a conversation, served from the cache when it is prefetched, the
+// page read is cached when prefetch is set
+func (svc *service) interactionsPage(convPK string, includeMuted bool, token string, count int, prefetch bool) (*messengertypes.InteractionList_Reply, error) {
+	key := prefetchPageKey(convPK, includeMuted, token, count)
+	if reply := svc.prefetch.page(key); reply != nil {
+		return reply, nil
+	}
+
+	cursor, err := decodeInteractionCursor(token)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := svc.db.getInteractionOrder()
+	if err != nil {
+		return nil, err
+	}
+	if cursor != nil {
+		order = cursor.GetOrder()
+	}
+
+	generation := svc.prefetch.generation(convPK)
+
+	// one more interaction is read to know whether there is a next page
+	interactions, err := svc.db.getPaginatedInteractions(convPK, includeMuted, order, cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.InteractionList_Reply{Interactions: interactions}
+	if len(interactions) > count {
+		reply.Interactions = interactions[:count]
+		if reply.NextCursor, err = encodeInteractionCursor(interactions[count-1], order); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := svc.db.fillInteractionsTags(reply.Interactions); err != nil {
+		return nil, err
+	}
+
+	applyNicknames(reply)
+
+	if prefetch {
+		svc.prefetch.putPage(convPK, key, generation, reply)
+	}
+
+	return reply, nil
+}
+
+// prefetchConversation reads the page shown by the client and the older ones next to it with their small images
+func (svc *service) prefetchConversation(req *messengertypes.ConversationPrefetch_Request) error {
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	pages := int(req.GetPages())
+	if pages == 0 {
+		pages = prefetchDefaultPages
+	} else if pages > prefetchMaxPages {
+		pages = prefetchMaxPages
+	}
+
+	token := req.GetCursor()
+	for page := 0; page <= pages; page++ {
+		reply, err := svc.interactionsPage(req.GetConversationPublicKey(), req.GetIncludeMuted(), token, count, true)
+		if err != nil {
+			return err
+		}
+
+		for _, i := range reply.GetInteractions() {
+			for _, media := range i.GetMedias() {
+				svc.prefetchMedia(media)
+			}
+		}
+
+		if token = reply.GetNextCursor(); token == "" {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// prefetchMedia reads the content of a small image into the cache, the failures only make the client read it later
+func (svc *service) prefetchMedia(media *messengertypes.Media) {
+	if !isPrefetchableMedia(media) || svc.prefetch.media(media.GetCID()) != nil {
+		return
+	}
+
+	attachment, err := svc.mediaContentRetrieve(media)
+	if err != nil {
+		svc.logger.Debug("unable to prefetch media", zap.String("cid", media.GetCID()), zap.Error(err))
+		return
+	}
+	defer attachment.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(attachment, prefetchMediaMaxSize+1))
+	if err != nil || len(data) > prefetchMediaMaxSize {
+		return
+	}
+
+	svc.prefetch.putMedia(media.GetCID(), data)
+}
+
+func (svc *service) ConversationPrefetch(ctx context.Context, req *messengertypes.ConversationPrefetch_Request) (*messengertypes.ConversationPrefetch_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	// the cursor is checked now, the pages are read in the background
+	if _, err := decodeInteractionCursor(req.GetCursor()); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := svc.prefetchConversation(req); err != nil {
+			svc.logger.Debug("unable to prefetch conversation", logGroup(req.GetConversationPublicKey()), zap.Error(err))
+		}
+	}()
+
+	return &messengertypes.ConversationPrefetch_Reply{}, nil
+}
@@ -0,0 +1,63 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestConversationPrefetch(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", LamportTime: 1},
+		{CID: "cid_2", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", LamportTime: 2},
+		{CID: "cid_3", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", LamportTime: 3},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop(), prefetch: newPrefetchCache()}
+	require.NoError(t, svc.prefetchConversation(&messengertypes.ConversationPrefetch_Request{ConversationPublicKey: "conv_1", Count: 2}))
+
+	// the prefetched pages are served from memory
+	require.NoError(t, db.db.Where("cid = ?", "cid_1").Delete(&messengertypes.Interaction{}).Error)
+
+	first, err := svc.InteractionList(ctx, &messengertypes.InteractionList_Request{ConversationPublicKey: "conv_1", Count: 2})
+	require.NoError(t, err)
+	require.Len(t, first.GetInteractions(), 2)
+
+	second, err := svc.InteractionList(ctx, &messengertypes.InteractionList_Request{ConversationPublicKey: "conv_1", Count: 2, Cursor: first.GetNextCursor()})
+	require.NoError(t, err)
+	require.Len(t, second.GetInteractions(), 1)
+	require.Equal(t, "cid_1", second.GetInteractions()[0].GetCID())
+
+	// the replies don't share the cached pages
+	second.Interactions[0].CID = "changed"
+	second, err = svc.InteractionList(ctx, &messengertypes.InteractionList_Request{ConversationPublicKey: "conv_1", Count: 2, Cursor: first.GetNextCursor()})
+	require.NoError(t, err)
+	require.Equal(t, "cid_1", second.GetInteractions()[0].GetCID())
+
+	// an event of the conversation drops its pages, a page read before the event isn't cached
+	generation := svc.prefetch.generation("conv_1")
+	require.NoError(t, svc.prefetch.StreamEvent(testStreamEvent(t, messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: &messengertypes.Interaction{CID: "cid_3", ConversationPublicKey: "conv_1"}})))
+	svc.prefetch.putPage("conv_1", prefetchPageKey("conv_1", false, first.GetNextCursor(), 2), generation, second)
+
+	second, err = svc.InteractionList(ctx, &messengertypes.InteractionList_Request{ConversationPublicKey: "conv_1", Count: 2, Cursor: first.GetNextCursor()})
+	require.NoError(t, err)
+	require.Empty(t, second.GetInteractions())
+}
+
+func Test_isPrefetchableMedia(t *testing.T) {
+	require.True(t, isPrefetchableMedia(&messengertypes.Media{MimeType: "image/png", Size_: 1024, State: messengertypes.Media_StateDownloaded}))
+	require.False(t, isPrefetchableMedia(&messengertypes.Media{MimeType: "image/png", Size_: 1024, State: messengertypes.Media_StateNeverDownloaded}))
+	require.False(t, isPrefetchableMedia(&messengertypes.Media{MimeType: "image/png", Size_: prefetchMediaMaxSize + 1, State: messengertypes.Media_StateDownloaded}))
+	require.False(t, isPrefetchableMedia(&messengertypes.Media{MimeType: "video/mp4", Size_: 1024, State: messengertypes.Media_StateDownloaded}))
+}
@@ -0,0 +1,354 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	presenceHeartbeatInterval = 30 * time.Second
+	// presenceTimeout is the delay after which a contact who stopped sending its presence is considered offline
+	presenceTimeout = 75 * time.Second
+	// presenceOfflineTimeout bounds the last presence sent when the service is closed
+	presenceOfflineTimeout   = 5 * time.Second
+	presenceSubscriberBuffer = 16
+)
+
+// presenceManager aggregates the presence of the contacts, it is kept in memory and never stored
+type presenceManager struct {
+	mutex       sync.Mutex
+	presences   map[string]*messengertypes.Presence
+	subscribers map[chan *messengertypes.Presence]struct{}
+}
+
+func newPresenceManager() *presenceManager {
+	return &presenceManager{
+		presences:   map[string]*messengertypes.Presence{},
+		subscribers: map[chan *messengertypes.Presence]struct{}{},
+	}
+}
+
+func (m *presenceManager) update(contactPK string, status messengertypes.Presence_Status, lastActive int64, now int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	presence := &messengertypes.Presence{
+		ContactPublicKey: contactPK,
+		Status:           status,
+		LastActive:       lastActive,
+		UpdatedAt:        now,
+	}
+
+	// the last activity can't go back in time if an older presence is received
+	if current, ok := m.presences[contactPK]; ok && current.GetLastActive() > presence.GetLastActive() {
+		presence.LastActive = current.GetLastActive()
+	}
+
+	m.presences[contactPK] = presence
+	m.notify(presence)
+}
+
+// expire marks as offline the contacts who didn't send their presence since the timeout
+func (m *presenceManager) expire(now int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, presence := range m.presences {
+		if presence.GetStatus() == messengertypes.Presence_StatusOffline || now-presence.GetUpdatedAt() < presenceTimeout.Milliseconds() {
+			continue
+		}
+
+		expired := *presence
+		expired.Status = messengertypes.Presence_StatusOffline
+		m.presences[presence.GetContactPublicKey()] = &expired
+		m.notify(&expired)
+	}
+}
+
+// remove forgets the presence of a contact, the subscribers receive an unknown status
+func (m *presenceManager) remove(contactPK string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.presences[contactPK]; !ok {
+		return
+	}
+
+	delete(m.presences, contactPK)
+	m.notify(&messengertypes.Presence{ContactPublicKey: contactPK, Status: messengertypes.Presence_StatusUnknown})
+}
+
+// clear forgets the presence of all the contacts, the subscribers receive an unknown status
+func (m *presenceManager) clear() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for contactPK := range m.presences {
+		m.notify(&messengertypes.Presence{ContactPublicKey: contactPK, Status: messengertypes.Presence_StatusUnknown})
+	}
+
+	m.presences = map[string]*messengertypes.Presence{}
+}
+
+func (m *presenceManager) get(contactPKs ...string) []*messengertypes.Presence {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	presences := []*messengertypes.Presence(nil)
+
+	if len(contactPKs) == 0 {
+		for _, presence := range m.presences {
+			presences = append(presences, presence)
+		}
+
+		return presences
+	}
+
+	for _, contactPK := range contactPKs {
+		if presence, ok := m.presences[contactPK]; ok {
+			presences = append(presences, presence)
+		}
+	}
+
+	return presences
+}
+
+// subscribe returns a channel receiving the presence changes, the changes are dropped if the subscriber is too slow
+func (m *presenceManager) subscribe() (<-chan *messengertypes.Presence, func()) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ch := make(chan *messengertypes.Presence, presenceSubscriberBuffer)
+	m.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+
+		delete(m.subscribers, ch)
+	}
+}
+
+// notify must be called with the mutex locked
+func (m *presenceManager) notify(presence *messengertypes.Presence) {
+	for ch := range m.subscribers {
+		select {
+		case ch <- presence:
+		default:
+		}
+	}
+}
+
+type presenceSubscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (s *presenceSubscription) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// monitorPresence sends the presence of the account to its contacts and listens to theirs while presence is enabled
+func (svc *service) monitorPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceHeartbeatInterval)
+	defer ticker.Stop()
+
+	// subscriptions are the ephemeral channels listened to, by contact public key
+	subscriptions := map[string]*presenceSubscription{}
+	// sentTo are the contact groups the presence has been sent to, by contact public key
+	sentTo := map[string][]byte{}
+	// lastActive is the last time the app has been seen in the foreground
+	lastActive := int64(0)
+
+	stop := func(sendCtx context.Context) {
+		for contactPK, subscription := range subscriptions {
+			subscription.cancel()
+			delete(subscriptions, contactPK)
+		}
+
+		for contactPK, gpk := range sentTo {
+			svc.sendPresence(sendCtx, gpk, messengertypes.Presence_StatusOffline, lastActive)
+			delete(sentTo, contactPK)
+		}
+
+		svc.presenceManager.clear()
+	}
+
+	for {
+		if svc.lcmanager.GetCurrentState() == StateActive {
+			lastActive = timestampMs(time.Now())
+		}
+
+		if err := svc.tickPresence(ctx, subscriptions, sentTo, lastActive); err != nil {
+			svc.logger.Error("unable to update presence", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			// the service context is done, use a short lived one to notify the contacts
+			offlineCtx, cancel := context.WithTimeout(context.Background(), presenceOfflineTimeout)
+			stop(offlineCtx)
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tickPresence updates the subscriptions and sends the presence according to the settings, the contacts are all
+// unsubscribed and notified as offline when presence is disabled
+func (svc *service) tickPresence(ctx context.Context, subscriptions map[string]*presenceSubscription, sentTo map[string][]byte, lastActive int64) error {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	contacts := []*messengertypes.Contact(nil)
+	if acc.GetPresenceEnabled() {
+		if contacts, err = svc.db.getContactsByState(messengertypes.Contact_Accepted); err != nil {
+			return errcode.ErrDBRead.Wrap(err)
+		}
+	}
+
+	status := messengertypes.Presence_StatusAway
+	if svc.lcmanager.GetCurrentState() == StateActive {
+		status = messengertypes.Presence_StatusOnline
+	}
+
+	current := map[string]struct{}{}
+	for _, contact := range contacts {
+		contactPK := contact.GetPublicKey()
+
+		if blocked, err := svc.db.isMemberBlocked(contactPK); err != nil {
+			return err
+		} else if blocked {
+			continue
+		}
+
+		gpk, err := b64DecodeBytes(contact.GetConversationPublicKey())
+		if err != nil {
+			svc.logger.Warn("invalid contact conversation public key", zap.String("contact-pk", contactPK), zap.Error(err))
+			continue
+		}
+
+		current[contactPK] = struct{}{}
+
+		// the subscriptions interrupted by an error are started again
+		if subscription, ok := subscriptions[contactPK]; !ok || subscription.isDone() {
+			if ok {
+				subscription.cancel()
+			}
+
+			subCtx, cancel := context.WithCancel(ctx)
+			subscription = &presenceSubscription{cancel: cancel, done: make(chan struct{})}
+			subscriptions[contactPK] = subscription
+
+			go func() {
+				defer close(subscription.done)
+				svc.subscribeToPresence(subCtx, contactPK, gpk)
+			}()
+		}
+
+		if contact.GetPresenceHidden() {
+			// the contact stops seeing the account online from now on
+			if _, ok := sentTo[contactPK]; ok {
+				svc.sendPresence(ctx, gpk, messengertypes.Presence_StatusOffline, lastActive)
+				delete(sentTo, contactPK)
+			}
+			continue
+		}
+
+		svc.sendPresence(ctx, gpk, status, lastActive)
+		sentTo[contactPK] = gpk
+	}
+
+	for contactPK, subscription := range subscriptions {
+		if _, ok := current[contactPK]; ok {
+			continue
+		}
+
+		subscription.cancel()
+		delete(subscriptions, contactPK)
+		svc.presenceManager.remove(contactPK)
+
+		if gpk, ok := sentTo[contactPK]; ok {
+			svc.sendPresence(ctx, gpk, messengertypes.Presence_StatusOffline, lastActive)
+			delete(sentTo, contactPK)
+		}
+	}
+
+	svc.presenceManager.expire(timestampMs(time.Now()))
+
+	return nil
+}
+
+// sendPresence sends the presence of the account over the ephemeral channel of a contact group, it is never stored in the group log
+func (svc *service) sendPresence(ctx context.Context, gpk []byte, status messengertypes.Presence_Status, lastActive int64) {
+	am, err := messengertypes.AppMessage_TypePresence.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_Presence{Status: status, LastActive: lastActive})
+	if err != nil {
+		svc.logger.Error("unable to marshal presence", zap.Error(err))
+		return
+	}
+
+	if _, err := svc.protocolClient.GroupEphemeralSend(ctx, &protocoltypes.GroupEphemeralSend_Request{GroupPK: gpk, Payload: am}); err != nil {
+		svc.logger.Debug("unable to send presence", zap.String("group-pk", b64EncodeBytes(gpk)), zap.Error(err))
+	}
+}
+
+func (svc *service) subscribeToPresence(ctx context.Context, contactPK string, gpk []byte) {
+	info, err := svc.protocolClient.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPK: gpk})
+	if err != nil {
+		svc.logger.Warn("unable to get contact group info", zap.String("contact-pk", contactPK), zap.Error(err))
+		return
+	}
+
+	cl, err := svc.protocolClient.GroupEphemeralSubscribe(ctx, &protocoltypes.GroupEphemeralSubscribe_Request{GroupPK: gpk})
+	if err != nil {
+		svc.logger.Warn("unable to subscribe to contact presence", zap.String("contact-pk", contactPK), zap.Error(err))
+		return
+	}
+
+	for {
+		evt, err := cl.Recv()
+		switch {
+		case err == nil:
+		case err == io.EOF, ctx.Err() != nil:
+			return
+		default:
+			svc.logger.Warn("error while receiving contact presence", zap.String("contact-pk", contactPK), zap.Error(err))
+			return
+		}
+
+		// the other devices of the account are members of the contact group too
+		if bytes.Equal(evt.GetMemberPK(), info.GetMemberPK()) {
+			continue
+		}
+
+		payload, am, err := messengertypes.UnmarshalAppMessage(evt.GetPayload())
+		if err != nil {
+			svc.logger.Debug("unable to unmarshal ephemeral payload", zap.Error(err))
+			continue
+		}
+
+		if am.GetType() != messengertypes.AppMessage_TypePresence {
+			continue
+		}
+
+		presence := payload.(*messengertypes.AppMessage_Presence)
+		svc.presenceManager.update(contactPK, presence.GetStatus(), presence.GetLastActive(), timestampMs(time.Now()))
+	}
+}
@@ -0,0 +1,52 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_presenceManager(t *testing.T) {
+	m := newPresenceManager()
+
+	changes, unsubscribe := m.subscribe()
+	defer unsubscribe()
+
+	m.update("contact_1", messengertypes.Presence_StatusOnline, 100, 100)
+	presence := <-changes
+	require.Equal(t, "contact_1", presence.ContactPublicKey)
+	require.Equal(t, messengertypes.Presence_StatusOnline, presence.Status)
+
+	// the last activity never goes back in time
+	m.update("contact_1", messengertypes.Presence_StatusAway, 50, 200)
+	presence = <-changes
+	require.Equal(t, messengertypes.Presence_StatusAway, presence.Status)
+	require.Equal(t, int64(100), presence.LastActive)
+	require.Equal(t, int64(200), presence.UpdatedAt)
+
+	m.update("contact_2", messengertypes.Presence_StatusOnline, 300, 300)
+	<-changes
+
+	require.Len(t, m.get(), 2)
+	require.Len(t, m.get("contact_2", "contact_3"), 1)
+
+	// only the contacts who stopped sending their presence are marked offline
+	m.expire(200 + presenceTimeout.Milliseconds())
+	presence = <-changes
+	require.Equal(t, "contact_1", presence.ContactPublicKey)
+	require.Equal(t, messengertypes.Presence_StatusOffline, presence.Status)
+	require.Equal(t, messengertypes.Presence_StatusOnline, m.get("contact_2")[0].Status)
+
+	m.remove("contact_2")
+	presence = <-changes
+	require.Equal(t, messengertypes.Presence_StatusUnknown, presence.Status)
+	require.Len(t, m.get(), 1)
+
+	m.clear()
+	presence = <-changes
+	require.Equal(t, "contact_1", presence.ContactPublicKey)
+	require.Equal(t, messengertypes.Presence_StatusUnknown, presence.Status)
+	require.Empty(t, m.get())
+}
@@ -0,0 +1,182 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// The profile of the account, its name, avatar and status, is sent to all its conversations when it changes. The
+// changes are batched, the profile is sent a short delay after the first change and at most once per interval, so a
+// user editing it repeatedly only sends the last version. The pending broadcast is flagged on the account and sent on
+// the next start if the node is stopped before. The receivers keep the most recent profile of each contact and member
+// by sent date and clock, so the replays apply the same profile.
+
+const (
+	// profileBroadcastDelay batches the changes made right after each other
+	profileBroadcastDelay = 3 * time.Second
+	// profileBroadcastInterval is the minimum time between two broadcasts of the profile
+	profileBroadcastInterval   = time.Minute
+	profileStatusTextMaxLength = 140
+)
+
+type profileBroadcaster struct {
+	mu        sync.Mutex
+	pending   bool
+	requested time.Time
+	lastSent  time.Time
+	wake      chan struct{}
+}
+
+func newProfileBroadcaster() *profileBroadcaster {
+	return &profileBroadcaster{wake: make(chan struct{}, 1)}
+}
+
+// schedule requests a broadcast of the profile, the requests made before it is sent are batched
+func (b *profileBroadcaster) schedule(now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	if !b.pending {
+		b.pending = true
+		b.requested = now
+	}
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns the date the pending broadcast must be sent at, ok is false when there is none
+func (b *profileBroadcaster) due() (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.pending {
+		return time.Time{}, false
+	}
+
+	return b.dueDate(), true
+}
+
+func (b *profileBroadcaster) dueDate() time.Time {
+	due := b.requested.Add(profileBroadcastDelay)
+	if next := b.lastSent.Add(profileBroadcastInterval); next.After(due) {
+		due = next
+	}
+
+	return due
+}
+
+// take clears the pending broadcast when it is due, the caller must then send the profile
+func (b *profileBroadcaster) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.pending || now.Before(b.dueDate()) {
+		return false
+	}
+
+	b.pending = false
+	b.lastSent = now
+
+	return true
+}
+
+// monitorProfileBroadcast sends the profile of the account to its conversations once the pending broadcast is due
+func (svc *service) monitorProfileBroadcast(ctx context.Context) {
+	// the broadcast interrupted by the last stop is sent again
+	if acc, err := svc.db.getAccount(); err != nil {
+		svc.logger.Warn("unable to get account", zap.Error(err))
+	} else if acc.GetProfileBroadcastPending() {
+		svc.profileBroadcast.schedule(time.Now())
+	}
+
+	for {
+		var timer *time.Timer
+		var fired <-chan time.Time
+		if due, ok := svc.profileBroadcast.due(); ok {
+			timer = time.NewTimer(time.Until(due))
+			fired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-svc.profileBroadcast.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <-fired:
+			if svc.profileBroadcast.take(time.Now()) {
+				svc.broadcastAccountProfile()
+			}
+		}
+	}
+}
+
+// broadcastAccountProfile sends the profile of the account to all its conversations, the changes made while it is sent
+// are sent by the next broadcast
+func (svc *service) broadcastAccountProfile() {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		svc.logger.Error("unable to get account", zap.Error(err))
+		return
+	}
+
+	if err := svc.db.setAccountProfileBroadcastPending(acc.GetPublicKey(), false); err != nil {
+		svc.logger.Error("unable to update account", zap.Error(err))
+	}
+
+	convs, err := svc.db.getAllConversations()
+	if err != nil {
+		svc.logger.Error("unable to get conversations", zap.Error(err))
+		return
+	}
+
+	for _, conv := range convs {
+		if err := svc.sendAccountUserInfo(conv.GetPublicKey()); err != nil {
+			svc.logger.Error("unable to send user info", logGroup(conv.GetPublicKey()), zap.Error(err))
+		}
+	}
+}
+
+// ensureValidStatusText checks the status of the account before it is sent
+func ensureValidStatusText(statusText string) error {
+	if !utf8.ValidString(statusText) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the status text isn't valid utf-8"))
+	}
+
+	if utf8.RuneCountInString(statusText) > profileStatusTextMaxLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the status text is longer than %d characters", profileStatusTextMaxLength))
+	}
+
+	return nil
+}
+
+// sanitizeStatusText truncates a received status, the statuses sent by other implementations may be longer
+func sanitizeStatusText(statusText string) string {
+	if !utf8.ValidString(statusText) {
+		return ""
+	}
+
+	runes := []rune(statusText)
+	if len(runes) > profileStatusTextMaxLength {
+		return string(runes[:profileStatusTextMaxLength])
+	}
+
+	return statusText
+}
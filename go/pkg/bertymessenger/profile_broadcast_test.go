@@ -0,0 +1,48 @@
+package bertymessenger
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+func Test_profileBroadcaster(t *testing.T) {
+	b := newProfileBroadcaster()
+	now := time.Unix(1000, 0)
+
+	_, ok := b.due()
+	require.False(t, ok)
+
+	// the changes made before the broadcast are batched
+	b.schedule(now)
+	b.schedule(now.Add(time.Second))
+
+	due, ok := b.due()
+	require.True(t, ok)
+	require.Equal(t, now.Add(profileBroadcastDelay), due)
+	require.False(t, b.take(now.Add(time.Second)))
+	require.True(t, b.take(due))
+	require.False(t, b.take(due))
+
+	// the next broadcast waits for the interval
+	b.schedule(due.Add(time.Second))
+	next, ok := b.due()
+	require.True(t, ok)
+	require.Equal(t, due.Add(profileBroadcastInterval), next)
+	require.False(t, b.take(due.Add(profileBroadcastDelay+time.Second)))
+	require.True(t, b.take(next))
+}
+
+func Test_sanitizeStatusText(t *testing.T) {
+	require.NoError(t, ensureValidStatusText("away"))
+	require.True(t, errcode.Is(ensureValidStatusText(strings.Repeat("é", profileStatusTextMaxLength+1)), errcode.ErrInvalidInput))
+	require.True(t, errcode.Is(ensureValidStatusText("\xff"), errcode.ErrInvalidInput))
+
+	require.Equal(t, "away", sanitizeStatusText("away"))
+	require.Equal(t, strings.Repeat("é", profileStatusTextMaxLength), sanitizeStatusText(strings.Repeat("é", profileStatusTextMaxLength+10)))
+	require.Empty(t, sanitizeStatusText("\xff"))
+}
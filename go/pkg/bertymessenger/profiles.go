@@ -0,0 +1,309 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// A messenger server can host several profiles, ie. a work and a personal account, each profile is a messenger
+// service with its own database and protocol instance. The interceptors of the ProfileRouter route the calls of the
+// MessengerService to the active profile, the streams opened on a profile end when another one becomes active so no
+// event of a profile is sent to the client of another.
+
+// ProfileOpener opens the messenger service of a profile, cleanup releases its database and protocol instance once the
+// service is closed
+type ProfileOpener func(ctx context.Context, profileID string) (svc Service, cleanup func(), err error)
+
+type ProfileRouterOpts struct {
+	Logger *zap.Logger
+	// Open opens a profile on its first switch
+	Open ProfileOpener
+}
+
+type openedProfile struct {
+	id      string
+	svc     Service
+	cleanup func()
+	// ctx is canceled when the profile stops being active, it ends the streams opened on it
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// ProfileRouter routes the calls of a messenger server to the active profile, its interceptors must be the last ones
+// of the chains of the gRPC server
+type ProfileRouter struct {
+	logger *zap.Logger
+	open   ProfileOpener
+
+	mu       sync.RWMutex
+	profiles map[string]*openedProfile
+	active   *openedProfile
+}
+
+// NewProfileRouter opens the profile used until the first switch
+func NewProfileRouter(ctx context.Context, opts ProfileRouterOpts, profileID string) (*ProfileRouter, error) {
+	if opts.Open == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("a profile opener is required"))
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+
+	r := &ProfileRouter{
+		logger:   opts.Logger,
+		open:     opts.Open,
+		profiles: map[string]*openedProfile{},
+	}
+
+	if _, err := r.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: profileID}); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Active returns the service of the active profile, nil once the router is closed
+func (r *ProfileRouter) Active() Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.active == nil {
+		return nil
+	}
+
+	return r.active.svc
+}
+
+func (r *ProfileRouter) activeProfile() (*openedProfile, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.active == nil {
+		return nil, errcode.ErrProfileInactive.Wrap(fmt.Errorf("no profile is active"))
+	}
+
+	return r.active, nil
+}
+
+// profileInfo returns the description of a profile, the account is unknown while it isn't created yet
+func (r *ProfileRouter) profileInfo(ctx context.Context, profile *openedProfile) *messengertypes.Profile {
+	info := &messengertypes.Profile{ID: profile.id, IsActive: profile == r.active}
+
+	if reply, err := profile.svc.AccountGet(ctx, &messengertypes.AccountGet_Request{}); err != nil {
+		r.logger.Debug("unable to get the account of a profile", zap.String("profile-id", profile.id), zap.Error(err))
+	} else {
+		info.AccountPublicKey = reply.GetAccount().GetPublicKey()
+		info.DisplayName = reply.GetAccount().GetDisplayName()
+	}
+
+	return info
+}
+
+func (r *ProfileRouter) ProfileList(ctx context.Context, req *messengertypes.ProfileList_Request) (*messengertypes.ProfileList_Reply, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reply := &messengertypes.ProfileList_Reply{}
+	for _, profile := range r.profiles {
+		reply.Profiles = append(reply.Profiles, r.profileInfo(ctx, profile))
+	}
+
+	sort.Slice(reply.Profiles, func(i, j int) bool { return reply.Profiles[i].GetID() < reply.Profiles[j].GetID() })
+
+	return reply, nil
+}
+
+func (r *ProfileRouter) ProfileSwitch(ctx context.Context, req *messengertypes.ProfileSwitch_Request) (*messengertypes.ProfileSwitch_Reply, error) {
+	id := req.GetProfileID()
+	if id == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	profile, ok := r.profiles[id]
+	if !ok {
+		svc, cleanup, err := r.open(ctx, id)
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(fmt.Errorf("unable to open profile %s: %w", id, err))
+		}
+
+		profile = &openedProfile{id: id, svc: svc, cleanup: cleanup}
+		r.profiles[id] = profile
+	}
+
+	if profile != r.active {
+		if r.active != nil {
+			r.active.cancel()
+		}
+
+		profile.ctx, profile.cancel = context.WithCancel(context.Background())
+		r.active = profile
+
+		r.logger.Info("profile switched", zap.String("profile-id", id))
+	}
+
+	return &messengertypes.ProfileSwitch_Reply{Profile: r.profileInfo(ctx, profile)}, nil
+}
+
+func (r *ProfileRouter) ProfileClose(ctx context.Context, req *messengertypes.ProfileClose_Request) (*messengertypes.ProfileClose_Reply, error) {
+	id := req.GetProfileID()
+	if id == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	r.mu.Lock()
+	profile, ok := r.profiles[id]
+	if ok && profile == r.active {
+		r.mu.Unlock()
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the active profile can't be closed"))
+	}
+	delete(r.profiles, id)
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("profile %s isn't opened", id))
+	}
+
+	closeProfile(profile)
+
+	return &messengertypes.ProfileClose_Reply{}, nil
+}
+
+func closeProfile(profile *openedProfile) {
+	profile.svc.Close()
+	if profile.cleanup != nil {
+		profile.cleanup()
+	}
+}
+
+// Close closes all the profiles, the calls received after fail
+func (r *ProfileRouter) Close() {
+	r.mu.Lock()
+	profiles := r.profiles
+	if r.active != nil {
+		r.active.cancel()
+	}
+	r.profiles, r.active = map[string]*openedProfile{}, nil
+	r.mu.Unlock()
+
+	for _, profile := range profiles {
+		closeProfile(profile)
+	}
+}
+
+// UnaryServerInterceptor calls the methods of the MessengerService on the active profile, the profile methods are
+// handled by the router
+func (r *ProfileRouter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasPrefix(info.FullMethod, messengerServicePrefix) {
+			return handler(ctx, req)
+		}
+
+		switch req := req.(type) {
+		case *messengertypes.ProfileList_Request:
+			return r.ProfileList(ctx, req)
+		case *messengertypes.ProfileSwitch_Request:
+			return r.ProfileSwitch(ctx, req)
+		case *messengertypes.ProfileClose_Request:
+			return r.ProfileClose(ctx, req)
+		}
+
+		profile, err := r.activeProfile()
+		if err != nil {
+			return nil, err
+		}
+
+		return callProfileMethod(ctx, profile.svc, path.Base(info.FullMethod), req)
+	}
+}
+
+// StreamServerInterceptor runs the streams of the MessengerService on the active profile, they end with
+// ErrProfileInactive when the profile stops being active
+func (r *ProfileRouter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasPrefix(info.FullMethod, messengerServicePrefix) {
+			return handler(srv, ss)
+		}
+
+		profile, err := r.activeProfile()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(ss.Context())
+		defer cancel()
+
+		go func() {
+			select {
+			case <-profile.ctx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		err = handler(profile.svc, &profileServerStream{ServerStream: ss, ctx: ctx})
+		if profile.ctx.Err() != nil && ss.Context().Err() == nil {
+			return errcode.ErrProfileInactive.Wrap(fmt.Errorf("the profile %s isn't active anymore", profile.id))
+		}
+
+		return err
+	}
+}
+
+// profileServerStream is a stream whose context ends when its profile stops being active
+type profileServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *profileServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// callProfileMethod calls a unary method of the messenger service of a profile, its request has already been decoded
+// by the gRPC handler
+func callProfileMethod(ctx context.Context, svc Service, name string, req interface{}) (interface{}, error) {
+	method := reflect.ValueOf(svc).MethodByName(name)
+	if !method.IsValid() {
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("unknown method %s", name))
+	}
+
+	out := method.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(req)})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+
+	return out[0].Interface(), nil
+}
+
+func (svc *service) ProfileList(ctx context.Context, req *messengertypes.ProfileList_Request) (*messengertypes.ProfileList_Reply, error) {
+	profile := &messengertypes.Profile{IsActive: true}
+	if acc, err := svc.db.getAccount(); err == nil {
+		profile.AccountPublicKey = acc.GetPublicKey()
+		profile.DisplayName = acc.GetDisplayName()
+	}
+
+	return &messengertypes.ProfileList_Reply{Profiles: []*messengertypes.Profile{profile}}, nil
+}
+
+func (svc *service) ProfileSwitch(ctx context.Context, req *messengertypes.ProfileSwitch_Request) (*messengertypes.ProfileSwitch_Reply, error) {
+	return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("the messenger server hosts a single profile"))
+}
+
+func (svc *service) ProfileClose(ctx context.Context, req *messengertypes.ProfileClose_Request) (*messengertypes.ProfileClose_Reply, error) {
+	return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("the messenger server hosts a single profile"))
+}
@@ -0,0 +1,144 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+type testProfileService struct {
+	Service
+	name   string
+	closed bool
+}
+
+func (s *testProfileService) AccountGet(context.Context, *messengertypes.AccountGet_Request) (*messengertypes.AccountGet_Reply, error) {
+	return &messengertypes.AccountGet_Reply{Account: &messengertypes.Account{PublicKey: "pk_" + s.name, DisplayName: s.name}}, nil
+}
+
+func (s *testProfileService) Close() {
+	s.closed = true
+}
+
+type testProfileServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testProfileServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func newTestProfileRouter(t *testing.T, opened map[string]*testProfileService) *ProfileRouter {
+	t.Helper()
+
+	open := func(ctx context.Context, id string) (Service, func(), error) {
+		svc := &testProfileService{name: id}
+		opened[id] = svc
+		return svc, nil, nil
+	}
+
+	r, err := NewProfileRouter(context.Background(), ProfileRouterOpts{Open: open}, "work")
+	require.NoError(t, err)
+
+	return r
+}
+
+func TestProfileRouter_Switch(t *testing.T) {
+	ctx := context.Background()
+	opened := map[string]*testProfileService{}
+	r := newTestProfileRouter(t, opened)
+	require.Equal(t, opened["work"], r.Active())
+
+	reply, err := r.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "personal"})
+	require.NoError(t, err)
+	require.True(t, reply.GetProfile().GetIsActive())
+	require.Equal(t, "pk_personal", reply.GetProfile().GetAccountPublicKey())
+	require.Equal(t, opened["personal"], r.Active())
+
+	list, err := r.ProfileList(ctx, &messengertypes.ProfileList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.GetProfiles(), 2)
+	require.Equal(t, "personal", list.GetProfiles()[0].GetID())
+	require.True(t, list.GetProfiles()[0].GetIsActive())
+	require.Equal(t, "work", list.GetProfiles()[1].GetID())
+	require.False(t, list.GetProfiles()[1].GetIsActive())
+
+	// the active profile stays opened
+	_, err = r.ProfileClose(ctx, &messengertypes.ProfileClose_Request{ProfileID: "personal"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = r.ProfileClose(ctx, &messengertypes.ProfileClose_Request{ProfileID: "work"})
+	require.NoError(t, err)
+	require.True(t, opened["work"].closed)
+
+	_, err = r.ProfileClose(ctx, &messengertypes.ProfileClose_Request{ProfileID: "work"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	r.Close()
+	require.True(t, opened["personal"].closed)
+	require.Nil(t, r.Active())
+}
+
+func TestProfileRouter_UnaryServerInterceptor(t *testing.T) {
+	ctx := context.Background()
+	opened := map[string]*testProfileService{}
+	r := newTestProfileRouter(t, opened)
+	defer r.Close()
+
+	interceptor := r.UnaryServerInterceptor()
+	unexpected := func(context.Context, interface{}) (interface{}, error) {
+		t.Fatal("the handler of the default service has been called")
+		return nil, nil
+	}
+
+	res, err := interceptor(ctx, &messengertypes.AccountGet_Request{}, &grpc.UnaryServerInfo{FullMethod: messengerServicePrefix + "AccountGet"}, unexpected)
+	require.NoError(t, err)
+	require.Equal(t, "work", res.(*messengertypes.AccountGet_Reply).GetAccount().GetDisplayName())
+
+	_, err = interceptor(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "personal"}, &grpc.UnaryServerInfo{FullMethod: messengerServicePrefix + "ProfileSwitch"}, unexpected)
+	require.NoError(t, err)
+
+	res, err = interceptor(ctx, &messengertypes.AccountGet_Request{}, &grpc.UnaryServerInfo{FullMethod: messengerServicePrefix + "AccountGet"}, unexpected)
+	require.NoError(t, err)
+	require.Equal(t, "personal", res.(*messengertypes.AccountGet_Reply).GetAccount().GetDisplayName())
+
+	// the other services are left to their handler
+	called := false
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/berty.protocol.v1.ProtocolService/ServiceGetConfiguration"}, func(context.Context, interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.True(t, called)
+}
+
+func TestProfileRouter_StreamServerInterceptor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opened := map[string]*testProfileService{}
+	r := newTestProfileRouter(t, opened)
+	defer r.Close()
+
+	started := make(chan interface{})
+	done := make(chan error)
+	go func() {
+		done <- r.StreamServerInterceptor()(nil, &testProfileServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: messengerServicePrefix + "EventStream"}, func(srv interface{}, ss grpc.ServerStream) error {
+			started <- srv
+			<-ss.Context().Done()
+			return ss.Context().Err()
+		})
+	}()
+	require.Equal(t, opened["work"], <-started)
+
+	// the streams of a profile end when another one becomes active
+	_, err := r.ProfileSwitch(ctx, &messengertypes.ProfileSwitch_Request{ProfileID: "personal"})
+	require.NoError(t, err)
+	require.True(t, errcode.Is(<-done, errcode.ErrProfileInactive))
+}
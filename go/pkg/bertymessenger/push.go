@@ -0,0 +1,134 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/box"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const pushSendTimeout = 10 * time.Second
+
+// PushSender delivers the sealed push payloads to the push service of the devices (ie. APNS or FCM)
+type PushSender interface {
+	SendPush(ctx context.Context, token *messengertypes.PushDeviceToken, payload []byte) error
+}
+
+type pendingPush struct {
+	token   *messengertypes.PushDeviceToken
+	payload []byte
+}
+
+// preparePushes seals a push payload for each device of the account, it returns nothing when the devices are online
+// or when the conversation is muted and the account is not mentioned
+func (h *eventHandler) preparePushes(tx *dbWrapper, i *messengertypes.Interaction) ([]*pendingPush, error) {
+	if h.svc == nil || h.svc.pushSender == nil {
+		return nil, nil
+	}
+
+	// the mentions of the account are pushed even if the conversation is muted
+	if (i.GetConversation().GetPushMuted() && !i.GetMentionsMe()) || h.svc.lcmanager.GetCurrentState() == StateActive {
+		return nil, nil
+	}
+
+	acc, err := tx.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	tokens, err := tx.getPushDeviceTokens(acc.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	pushes := []*pendingPush(nil)
+	for _, token := range tokens {
+		payload, err := sealPushPayload(token.GetPublicKey(), &messengertypes.PushPayload{
+			ConversationPublicKey: i.GetConversationPublicKey(),
+			InteractionCID:        i.GetCID(),
+		})
+		if err != nil {
+			h.logger.Warn("unable to seal push payload", logPushToken(token.GetToken()), zap.Error(err))
+			continue
+		}
+
+		pushes = append(pushes, &pendingPush{token: token, payload: payload})
+	}
+
+	return pushes, nil
+}
+
+func (svc *service) sendPushes(pushes []*pendingPush) {
+	for _, push := range pushes {
+		ctx, cancel := context.WithTimeout(svc.ctx, pushSendTimeout)
+		if err := svc.pushSender.SendPush(ctx, push.token, push.payload); err != nil {
+			svc.logger.Warn("unable to send push", zap.Stringer("platform", push.token.GetPlatform()), zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// sealPushPayload encrypts a payload for the curve25519 key of a device with an ephemeral key, so neither the push
+// service nor the sender can link the pushes together
+func sealPushPayload(publicKey []byte, payload *messengertypes.PushPayload) ([]byte, error) {
+	recipientKey, err := cryptoutil.KeySliceToArray(publicKey)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	clear, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	ephemeralPublicKey, ephemeralSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errcode.ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	sealed := append(ephemeralPublicKey[:], nonce[:]...)
+
+	return box.Seal(sealed, clear, nonce, recipientKey, ephemeralSecretKey), nil
+}
+
+// OpenPushPayload decrypts a payload received in a push with the curve25519 secret key of the device
+func OpenPushPayload(data []byte, secretKey *[cryptoutil.KeySize]byte) (*messengertypes.PushPayload, error) {
+	if len(data) < cryptoutil.KeySize+cryptoutil.NonceSize+box.Overhead {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("push payload is too short"))
+	}
+
+	ephemeralPublicKey, err := cryptoutil.KeySliceToArray(data[:cryptoutil.KeySize])
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(data[cryptoutil.KeySize : cryptoutil.KeySize+cryptoutil.NonceSize])
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	clear, ok := box.Open(nil, data[cryptoutil.KeySize+cryptoutil.NonceSize:], nonce, ephemeralPublicKey, secretKey)
+	if !ok {
+		return nil, errcode.ErrCryptoDecrypt
+	}
+
+	payload := &messengertypes.PushPayload{}
+	if err := proto.Unmarshal(clear, payload); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return payload, nil
+}
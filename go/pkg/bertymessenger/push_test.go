@@ -0,0 +1,89 @@
+package bertymessenger
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestSealPushPayload(t *testing.T) {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	payload := &messengertypes.PushPayload{ConversationPublicKey: "conv_1", InteractionCID: "cid_1"}
+
+	sealed, err := sealPushPayload(pk[:], payload)
+	require.NoError(t, err)
+
+	opened, err := OpenPushPayload(sealed, sk)
+	require.NoError(t, err)
+	require.Equal(t, payload.ConversationPublicKey, opened.ConversationPublicKey)
+	require.Equal(t, payload.InteractionCID, opened.InteractionCID)
+
+	// each push is sealed with a new ephemeral key
+	other, err := sealPushPayload(pk[:], payload)
+	require.NoError(t, err)
+	require.NotEqual(t, sealed, other)
+
+	_, otherSK, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	_, err = OpenPushPayload(sealed, otherSK)
+	require.True(t, errcode.Is(err, errcode.ErrCryptoDecrypt))
+
+	_, err = OpenPushPayload(sealed[:10], sk)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = sealPushPayload([]byte("invalid"), payload)
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
+
+func Test_dbWrapper_pushDeviceTokens(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	err := db.addPushDeviceToken(&messengertypes.PushDeviceToken{AccountPublicKey: "account_1"}, "")
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	err = db.addPushDeviceToken(&messengertypes.PushDeviceToken{Token: "token_1"}, "")
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	require.NoError(t, db.addPushDeviceToken(&messengertypes.PushDeviceToken{Token: "token_1", AccountPublicKey: "account_1", RegisteredDate: 1}, ""))
+	require.NoError(t, db.addPushDeviceToken(&messengertypes.PushDeviceToken{Token: "token_2", AccountPublicKey: "account_1", RegisteredDate: 2}, ""))
+	require.NoError(t, db.addPushDeviceToken(&messengertypes.PushDeviceToken{Token: "token_3", AccountPublicKey: "account_2", RegisteredDate: 3}, ""))
+
+	tokens, err := db.getPushDeviceTokens("account_1")
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, "token_1", tokens[0].Token)
+
+	// the rotated token replaces the previous one
+	require.NoError(t, db.addPushDeviceToken(&messengertypes.PushDeviceToken{Token: "token_4", AccountPublicKey: "account_1", RegisteredDate: 4}, "token_1"))
+
+	tokens, err = db.getPushDeviceTokens("account_1")
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	require.Equal(t, "token_2", tokens[0].Token)
+	require.Equal(t, "token_4", tokens[1].Token)
+
+	require.NoError(t, db.removePushDeviceToken("token_2"))
+	require.True(t, errcode.Is(db.removePushDeviceToken("token_2"), errcode.ErrNotFound))
+
+	tokens, err = db.getPushDeviceTokens("account_1")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+
+	_, err = db.setConversationPushMuted("conv_1", true)
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"})
+
+	conv, err := db.setConversationPushMuted("conv_1", true)
+	require.NoError(t, err)
+	require.True(t, conv.PushMuted)
+}
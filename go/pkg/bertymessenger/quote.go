@@ -0,0 +1,108 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The replies embed a quote of the message they reply to, its cid, the hash of its body, an excerpt and its sender, so
+// they are shown with the quote by the members which haven't received the message yet or have pruned it. The members
+// having the message check the quote against it, when the reply is received or once the message is, and the quotes
+// which don't match it are marked as tampered.
+
+// quoteInteraction builds the quote of a user message of a conversation, only the messages received can be quoted
+func (d *dbWrapper) quoteInteraction(convPK, cid string) (*messengertypes.AppMessage_UserMessage_Quote, error) {
+	if cid == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the quote has no cid"))
+	}
+
+	quoted, err := d.getInteractionByCID(cid)
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the quoted message isn't available"))
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if quoted.GetConversationPublicKey() != convPK || quoted.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the user messages of the conversation can be quoted"))
+	}
+
+	var um messengertypes.AppMessage_UserMessage
+	if err := proto.Unmarshal(quoted.GetPayload(), &um); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return messengertypes.NewQuote(quoted.GetCID(), quoted.GetDevicePublicKey(), quoted.GetSentDate(), um.GetBody()), nil
+}
+
+// quoteState checks a quote against the quoted message, it is unverified while the message isn't stored
+func quoteState(quote *messengertypes.AppMessage_UserMessage_Quote, convPK string, quoted *messengertypes.Interaction) messengertypes.Interaction_QuoteState {
+	switch {
+	case quoted == nil:
+		return messengertypes.Interaction_QuoteUnverified
+	case quoted.GetConversationPublicKey() != convPK || !quote.Matches(quoted):
+		return messengertypes.Interaction_QuoteTampered
+	}
+
+	return messengertypes.Interaction_QuoteVerified
+}
+
+// applyQuote sets the quoted message of a reply and checks its quote if the message is stored
+func (h *eventHandler) applyQuote(tx *dbWrapper, i *messengertypes.Interaction, um *messengertypes.AppMessage_UserMessage) error {
+	quote := um.GetQuote()
+	if quote == nil {
+		return nil
+	}
+
+	quoted, err := tx.getInteractionByCID(quote.GetCID())
+	if err == gorm.ErrRecordNotFound {
+		quoted = nil
+	} else if err != nil {
+		return err
+	}
+
+	i.QuotedCID = quote.GetCID()
+	i.QuoteState = quoteState(quote, i.GetConversationPublicKey(), quoted)
+	if i.QuoteState == messengertypes.Interaction_QuoteTampered {
+		h.logger.Warn("the quote of a reply doesn't match the quoted message", zap.String("cid", i.GetCID()), zap.String("quoted-cid", quote.GetCID()))
+	}
+
+	return nil
+}
+
+// verifyQuotesOf checks the replies received before the message they quote
+func (h *eventHandler) verifyQuotesOf(tx *dbWrapper, quoted *messengertypes.Interaction) error {
+	replies, err := tx.getUnverifiedQuotes(quoted.GetCID())
+	if err != nil {
+		return err
+	}
+
+	for _, reply := range replies {
+		var um messengertypes.AppMessage_UserMessage
+		if err := proto.Unmarshal(reply.GetPayload(), &um); err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+
+		reply.QuoteState = quoteState(um.GetQuote(), reply.GetConversationPublicKey(), quoted)
+		if err := tx.setInteractionQuoteState(reply.GetCID(), reply.GetQuoteState()); err != nil {
+			return err
+		}
+
+		if h.svc == nil {
+			continue
+		}
+
+		if err := h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: reply}, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
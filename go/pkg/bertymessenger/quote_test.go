@@ -0,0 +1,61 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func TestQuoteVerification(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "the original message"})
+	require.NoError(t, err)
+	original := &messengertypes.Interaction{CID: "cid_1", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1", DevicePublicKey: "device_1", SentDate: 42, Payload: payload}
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+
+	// the reply is received before the message it quotes
+	quote := messengertypes.NewQuote(original.CID, original.DevicePublicKey, original.SentDate, "the original message")
+	reply := &messengertypes.Interaction{CID: "cid_2", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1"}
+	um := &messengertypes.AppMessage_UserMessage{Body: "reply", Quote: quote}
+	require.NoError(t, h.applyQuote(db, reply, um))
+	require.Equal(t, "cid_1", reply.GetQuotedCID())
+	require.Equal(t, messengertypes.Interaction_QuoteUnverified, reply.GetQuoteState())
+
+	reply.Payload, err = proto.Marshal(um)
+	require.NoError(t, err)
+	require.NoError(t, db.db.Create(reply).Error)
+
+	require.NoError(t, db.db.Create(original).Error)
+	require.NoError(t, h.verifyQuotesOf(db, original))
+
+	stored, err := db.getInteractionByCID("cid_2")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Interaction_QuoteVerified, stored.GetQuoteState())
+
+	// the quote built by Interact matches the message
+	built, err := db.quoteInteraction("conv_1", "cid_1")
+	require.NoError(t, err)
+	require.True(t, proto.Equal(quote, built))
+
+	_, err = db.quoteInteraction("conv_2", "cid_1")
+	require.Error(t, err)
+
+	// a quote changed by the sender of the reply
+	tampered := &messengertypes.Interaction{CID: "cid_3", Type: messengertypes.AppMessage_TypeUserMessage, ConversationPublicKey: "conv_1"}
+	changed := messengertypes.NewQuote(original.CID, original.DevicePublicKey, original.SentDate, "a forged message")
+	require.NoError(t, h.applyQuote(db, tampered, &messengertypes.AppMessage_UserMessage{Body: "reply", Quote: changed}))
+	require.Equal(t, messengertypes.Interaction_QuoteTampered, tampered.GetQuoteState())
+
+	// the malformed quotes are rejected
+	reason, err := checkQuoteFormatRule(db, tampered, &messengertypes.AppMessage_UserMessage{Quote: &messengertypes.AppMessage_UserMessage_Quote{CID: "cid_1"}})
+	require.NoError(t, err)
+	require.NotEmpty(t, reason)
+}
@@ -0,0 +1,276 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// rateLimitRetryInterval is the delay between two attempts to handle the deferred events
+	rateLimitRetryInterval = time.Second
+	// rateLimitDeferredMaxCount bounds the number of deferred events kept in memory, the next ones are dropped
+	rateLimitDeferredMaxCount = 1000
+)
+
+// RateLimitOpts configures the limits applied to the live events of the groups, the events exceeding them are deferred
+// until the rate of their sender decreases. The events read from the logs on a replay are not limited, neither are
+// the ones sent by this device.
+type RateLimitOpts struct {
+	// MemberEventsPerMinute is the rate of the message events of each device of a group, 0 disables the limit
+	MemberEventsPerMinute int
+	// MemberBurst is the number of events a device can send at once, a tenth of the rate per minute if 0
+	MemberBurst int
+	// GroupEventsPerMinute is the rate of the message and metadata events of each group, 0 disables the limit
+	GroupEventsPerMinute int
+	// GroupBurst is the number of events a group can receive at once, a tenth of the rate per minute if 0
+	GroupBurst int
+	// Drop drops the events exceeding the limits instead of deferring them, they are handled again when the group
+	// is replayed
+	Drop bool
+}
+
+func (opts *RateLimitOpts) applyDefaults() {
+	if opts.MemberBurst == 0 {
+		opts.MemberBurst = defaultBurst(opts.MemberEventsPerMinute)
+	}
+
+	if opts.GroupBurst == 0 {
+		opts.GroupBurst = defaultBurst(opts.GroupEventsPerMinute)
+	}
+}
+
+func defaultBurst(perMinute int) int {
+	if burst := perMinute / 10; burst > 1 {
+		return burst
+	}
+
+	return 1
+}
+
+// tokenBucket allows an event per token, the tokens are refilled at a fixed rate up to the burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time, perMinute, burst int) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Minutes()*float64(perMinute))
+	b.last = now
+}
+
+type deferredEvent struct {
+	groupPK  string
+	metadata *protocoltypes.GroupMetadataEvent
+	message  *protocoltypes.GroupMessageEvent
+	am       *messengertypes.AppMessage
+}
+
+func (evt *deferredEvent) lamportTime() uint64 {
+	if evt.message != nil {
+		return evt.message.GetEventContext().GetLamportTime()
+	}
+
+	return evt.metadata.GetEventContext().GetLamportTime()
+}
+
+// rateLimiter keeps a token bucket for each group and each device of a group, in memory
+type rateLimiter struct {
+	mu       sync.Mutex
+	opts     RateLimitOpts
+	buckets  map[string]*tokenBucket
+	limited  map[string]bool
+	deferred []*deferredEvent
+}
+
+func newRateLimiter(opts RateLimitOpts) *rateLimiter {
+	opts.applyDefaults()
+
+	return &rateLimiter{
+		opts:    opts,
+		buckets: map[string]*tokenBucket{},
+		limited: map[string]bool{},
+	}
+}
+
+func (l *rateLimiter) bucket(key string, perMinute, burst int, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now, perMinute, burst)
+	return b
+}
+
+// allow takes a token of the group and of the device of an event, devicePK is empty for the metadata events. It
+// returns false when one of them is exhausted, notice is set when the refused event is the first one since the
+// device, or the group, went over its limit
+func (l *rateLimiter) allow(groupPK, devicePK string, now time.Time) (allowed bool, notice bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buckets := []*tokenBucket(nil)
+	key := groupPK
+	if l.opts.GroupEventsPerMinute > 0 {
+		buckets = append(buckets, l.bucket(groupPK, l.opts.GroupEventsPerMinute, l.opts.GroupBurst, now))
+	}
+	if devicePK != "" && l.opts.MemberEventsPerMinute > 0 {
+		key = groupPK + "/" + devicePK
+		buckets = append(buckets, l.bucket(key, l.opts.MemberEventsPerMinute, l.opts.MemberBurst, now))
+	}
+
+	for _, b := range buckets {
+		if b.tokens < 1 {
+			notice = !l.limited[key]
+			l.limited[key] = true
+			return false, notice
+		}
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	delete(l.limited, key)
+
+	return true, false
+}
+
+// deferEvent queues an event to be handled later, it returns false when the queue is full
+func (l *rateLimiter) deferEvent(evt *deferredEvent) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.deferred) >= rateLimitDeferredMaxCount {
+		return false
+	}
+
+	l.deferred = append(l.deferred, evt)
+	return true
+}
+
+func (l *rateLimiter) takeDeferred() []*deferredEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.deferred
+	l.deferred = nil
+	return events
+}
+
+// rateLimited applies the rate limits to a live event, it returns true when the event must not be handled now
+func (h *eventHandler) rateLimited(evt *deferredEvent) (bool, error) {
+	if h.svc == nil || h.svc.rateLimiter == nil || h.replay {
+		return false, nil
+	}
+
+	devicePK := ""
+	if evt.message != nil {
+		isMe, err := checkDeviceIsMe(h.ctx, h.protocolClient, evt.message)
+		if err != nil {
+			return false, err
+		} else if isMe {
+			return false, nil
+		}
+
+		devicePK = b64EncodeBytes(evt.message.GetHeaders().GetDevicePK())
+	}
+
+	allowed, notice := h.svc.rateLimiter.allow(evt.groupPK, devicePK, time.Now())
+	if allowed {
+		return false, nil
+	}
+
+	dropped := h.svc.rateLimiter.opts.Drop || !h.svc.rateLimiter.deferEvent(evt)
+	h.logger.Debug("event exceeding the rate limits", zap.String("group", evt.groupPK), zap.String("device-pk", devicePK), zap.Bool("dropped", dropped))
+
+	if notice {
+		if err := h.addRateLimitNotice(evt, devicePK, dropped); err != nil {
+			h.logger.Error("unable to add rate limit notice", zap.String("group", evt.groupPK), zap.Error(err))
+		}
+	}
+
+	return true, nil
+}
+
+// addRateLimitNotice adds a local interaction telling that the events of a device, or of the whole group when
+// devicePK is empty, are limited. It is ordered with the first refused event
+func (h *eventHandler) addRateLimitNotice(evt *deferredEvent, devicePK string, dropped bool) error {
+	memberPK := ""
+	if devicePK != "" {
+		var err error
+		if memberPK, err = h.db.getMemberPKFromDevicePK(devicePK); err != nil {
+			memberPK = ""
+		}
+	}
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_RateLimitNotice{MemberPublicKey: memberPK, DevicePublicKey: devicePK, Dropped: dropped})
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	now := time.Now()
+	i, isNew, err := h.db.addInteraction(messengertypes.Interaction{
+		CID:                   fmt.Sprintf("__rate-limit-%s-%s-%d", evt.groupPK, devicePK, now.UnixNano()),
+		Type:                  messengertypes.AppMessage_TypeRateLimitNotice,
+		ConversationPublicKey: evt.groupPK,
+		MemberPublicKey:       memberPK,
+		DevicePublicKey:       devicePK,
+		Payload:               payload,
+		SentDate:              timestampMs(now),
+		LamportTime:           evt.lamportTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, isNew)
+}
+
+// monitorDeferredEvents handles the deferred events again, they are deferred once more while their sender exceeds
+// its rate
+func (svc *service) monitorDeferredEvents(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		events := svc.rateLimiter.takeDeferred()
+		if len(events) == 0 {
+			continue
+		}
+
+		release := svc.writer.enter()
+		for _, evt := range events {
+			if evt.metadata != nil {
+				_ = svc.handleLiveEvent(evt.groupPK, evt.metadata.GetEventContext(), evt.metadata.GetMetadata().GetEventType().String(), func() error {
+					return svc.eventHandler.handleMetadataEvent(evt.metadata)
+				})
+				continue
+			}
+
+			if err := svc.handleLiveEvent(evt.groupPK, evt.message.GetEventContext(), evt.am.GetType().String(), func() error {
+				return svc.eventHandler.handleAppMessage(evt.groupPK, evt.message, evt.am)
+			}); err == nil {
+				svc.eventDiagnostics.messageHandled(evt.groupPK, evt.message.GetEventContext(), time.Now())
+			}
+		}
+		release()
+	}
+}
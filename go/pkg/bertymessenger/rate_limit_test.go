@@ -0,0 +1,122 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_rateLimiter_allow(t *testing.T) {
+	l := newRateLimiter(RateLimitOpts{MemberEventsPerMinute: 60, MemberBurst: 2, GroupEventsPerMinute: 600})
+	now := time.Now()
+
+	for n := 0; n < 2; n++ {
+		allowed, _ := l.allow("group_1", "device_1", now)
+		require.True(t, allowed)
+	}
+
+	// a single notice while the device is over its limit
+	allowed, notice := l.allow("group_1", "device_1", now)
+	require.False(t, allowed)
+	require.True(t, notice)
+	allowed, notice = l.allow("group_1", "device_1", now)
+	require.False(t, allowed)
+	require.False(t, notice)
+
+	// the other devices are not limited
+	allowed, _ = l.allow("group_1", "device_2", now)
+	require.True(t, allowed)
+
+	// a token is refilled each second
+	allowed, _ = l.allow("group_1", "device_1", now.Add(time.Second))
+	require.True(t, allowed)
+	allowed, notice = l.allow("group_1", "device_1", now.Add(time.Second))
+	require.False(t, allowed)
+	require.True(t, notice)
+}
+
+func Test_rateLimiter_allowGroup(t *testing.T) {
+	// the group burst defaults to a tenth of its rate
+	l := newRateLimiter(RateLimitOpts{GroupEventsPerMinute: 30})
+	now := time.Now()
+
+	for n := 0; n < 3; n++ {
+		allowed, _ := l.allow("group_1", "", now)
+		require.True(t, allowed)
+	}
+
+	allowed, notice := l.allow("group_1", "device_1", now)
+	require.False(t, allowed)
+	require.True(t, notice)
+
+	allowed, _ = l.allow("group_2", "", now)
+	require.True(t, allowed)
+}
+
+type rateLimitTestClient struct {
+	protocoltypes.ProtocolServiceClient
+}
+
+func (c *rateLimitTestClient) GroupInfo(context.Context, *protocoltypes.GroupInfo_Request, ...grpc.CallOption) (*protocoltypes.GroupInfo_Reply, error) {
+	return &protocoltypes.GroupInfo_Reply{DevicePK: []byte("device_me")}, nil
+}
+
+func Test_eventHandler_rateLimited(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		db, dispose := getInMemoryTestDB(t)
+
+		svc := &service{dispatcher: NewDispatcher(), rateLimiter: newRateLimiter(RateLimitOpts{MemberEventsPerMinute: 1, Drop: drop})}
+		h := newEventHandler(context.Background(), db, &rateLimitTestClient{}, zap.NewNop(), svc, false)
+
+		event := func(devicePK string) *deferredEvent {
+			return &deferredEvent{groupPK: "group_1", message: &protocoltypes.GroupMessageEvent{
+				EventContext: &protocoltypes.EventContext{GroupPK: []byte("group_1")},
+				Headers:      &protocoltypes.MessageHeaders{DevicePK: []byte(devicePK)},
+			}}
+		}
+
+		limited, err := h.rateLimited(event("device_1"))
+		require.NoError(t, err)
+		require.False(t, limited)
+
+		for n := 0; n < 3; n++ {
+			limited, err = h.rateLimited(event("device_1"))
+			require.NoError(t, err)
+			require.True(t, limited)
+		}
+
+		// the messages of this device are never limited
+		limited, err = h.rateLimited(event("device_me"))
+		require.NoError(t, err)
+		require.False(t, limited)
+
+		// nor the replayed ones
+		limited, err = newEventHandler(context.Background(), db, &rateLimitTestClient{}, zap.NewNop(), svc, true).rateLimited(event("device_1"))
+		require.NoError(t, err)
+		require.False(t, limited)
+
+		if drop {
+			require.Empty(t, svc.rateLimiter.takeDeferred())
+		} else {
+			require.Len(t, svc.rateLimiter.takeDeferred(), 3)
+		}
+
+		notices := []*messengertypes.Interaction(nil)
+		require.NoError(t, db.db.Where("type = ?", messengertypes.AppMessage_TypeRateLimitNotice).Find(&notices).Error)
+		require.Len(t, notices, 1)
+		require.Equal(t, b64EncodeBytes([]byte("device_1")), notices[0].GetDevicePublicKey())
+
+		payload, err := (&messengertypes.AppMessage{Type: notices[0].GetType(), Payload: notices[0].GetPayload()}).UnmarshalPayload()
+		require.NoError(t, err)
+		require.Equal(t, drop, payload.(*messengertypes.AppMessage_RateLimitNotice).GetDropped())
+
+		dispose()
+	}
+}
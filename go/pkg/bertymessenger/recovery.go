@@ -0,0 +1,400 @@
+package bertymessenger
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	// recoverySecretSize is the size of the secret from which the passphrase of a recovery backup is derived
+	recoverySecretSize  = 32
+	recoverySetupIDSize = 16
+)
+
+// The recovery of an account relies on its trusted contacts: a random secret is split in shards with Shamir's secret
+// sharing, each trusted contact receives one in its conversation and a backup encrypted with the secret is given to the
+// user. On a new device, the user gathers the recovery codes of a quorum of the contacts, they rebuild the passphrase of
+// the backup which is then restored like any other backup. The shards sent by the account are handled by its devices
+// to know the trusted contacts, so they are rebuilt with the rest of the database when the logs are replayed.
+
+func (h *eventHandler) handleAppMessageRecoveryShard(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_RecoveryShard)
+
+	if i.GetConversation().GetType() != messengertypes.Conversation_ContactType {
+		h.logger.Warn("ignoring recovery shard sent outside of a contact conversation", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if payload.GetSetupID() == "" || payload.GetThreshold() < 2 || len(payload.GetShare()) < 2 || len(payload.GetChecksum()) != sha256.Size {
+		h.logger.Warn("ignoring invalid recovery shard", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	contactPK := i.GetConversation().GetContactPublicKey()
+
+	if i.GetIsMe() {
+		_, err := tx.addRecoveryTrustee(&messengertypes.RecoveryTrustee{
+			SetupID:          payload.GetSetupID(),
+			ContactPublicKey: contactPK,
+			Threshold:        payload.GetThreshold(),
+			CreatedDate:      i.GetSentDate(),
+		})
+
+		return i, false, err
+	}
+
+	added, err := tx.addRecoveryShard(&messengertypes.RecoveryShard{
+		SetupID:        payload.GetSetupID(),
+		OwnerPublicKey: contactPK,
+		Threshold:      payload.GetThreshold(),
+		Share:          payload.GetShare(),
+		Checksum:       payload.GetChecksum(),
+		SentDate:       i.GetSentDate(),
+		InteractionCID: i.GetCID(),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if added {
+		h.logger.Info("holding a recovery shard", zap.String("owner-pk", contactPK), zap.String("setup-id", payload.GetSetupID()))
+	}
+
+	return i, false, nil
+}
+
+func encodeRecoveryCode(code *messengertypes.RecoveryCode) (string, error) {
+	raw, err := proto.Marshal(code)
+	if err != nil {
+		return "", errcode.ErrSerialization.Wrap(err)
+	}
+
+	return b64EncodeBytes(raw), nil
+}
+
+func decodeRecoveryCode(encoded string) (*messengertypes.RecoveryCode, error) {
+	raw, err := b64DecodeBytes(encoded)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	code := &messengertypes.RecoveryCode{}
+	if err := proto.Unmarshal(raw, code); err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	if code.GetSetupID() == "" || code.GetAccountPublicKey() == "" || code.GetThreshold() < 2 || len(code.GetShare()) < 2 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid recovery code"))
+	}
+
+	return code, nil
+}
+
+// combineRecoveryCodes checks that the codes belong to the same setup and returns the passphrase of its backup once
+// they reach the quorum, the passphrase is empty until then
+func combineRecoveryCodes(encoded []string) (*messengertypes.AccountRecoveryCheck_Reply, string, error) {
+	if len(encoded) == 0 {
+		return nil, "", errcode.ErrMissingInput
+	}
+
+	reply := &messengertypes.AccountRecoveryCheck_Reply{}
+	checksum := []byte(nil)
+	shares := [][]byte(nil)
+	seen := map[byte]bool{}
+	for _, e := range encoded {
+		code, err := decodeRecoveryCode(e)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if reply.SetupID == "" {
+			reply.SetupID, reply.AccountPublicKey, reply.Threshold, checksum = code.GetSetupID(), code.GetAccountPublicKey(), code.GetThreshold(), code.GetChecksum()
+		} else if code.GetSetupID() != reply.GetSetupID() || code.GetAccountPublicKey() != reply.GetAccountPublicKey() {
+			return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("the recovery codes belong to different setups"))
+		}
+
+		// the last byte of a share is its coordinate, a contact may give its code twice
+		if x := code.GetShare()[len(code.GetShare())-1]; !seen[x] {
+			seen[x] = true
+			shares = append(shares, code.GetShare())
+		}
+	}
+
+	reply.CodeCount = uint32(len(shares))
+	if reply.GetCodeCount() < reply.GetThreshold() {
+		return reply, "", nil
+	}
+
+	secret, err := cryptoutil.CombineSecretShares(shares)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if sum := sha256.Sum256(secret); !bytes.Equal(sum[:], checksum) {
+		return nil, "", errcode.ErrInvalidInput.Wrap(fmt.Errorf("the recovery codes don't rebuild the recovery secret"))
+	}
+
+	reply.Complete = true
+	return reply, b64EncodeBytes(secret), nil
+}
+
+// RecoverFromAccountBackup restores a recovery backup with the codes of the trusted contacts, the messenger state is
+// loaded in localDBState and should be given to the messenger when it is started
+func RecoverFromAccountBackup(ctx context.Context, reader io.Reader, codes []string, coreAPI ipfs_interface.CoreAPI, odb *bertyprotocol.BertyOrbitDB, localDBState *messengertypes.LocalDatabaseState, logger *zap.Logger) error {
+	check, passphrase, err := combineRecoveryCodes(codes)
+	if err != nil {
+		return err
+	}
+
+	if !check.GetComplete() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("%d recovery codes of %d", check.GetCodeCount(), check.GetThreshold()))
+	}
+
+	return RestoreFromAccountBackup(ctx, reader, []byte(passphrase), coreAPI, odb, localDBState, logger)
+}
+
+// getRecoveryContacts returns the contacts of a new setup, they must be distinct accepted contacts
+func (svc *service) getRecoveryContacts(contactPKs []string, threshold uint32) ([]*messengertypes.Contact, error) {
+	if threshold < 2 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the threshold must be at least 2"))
+	}
+
+	if len(contactPKs) < int(threshold) || len(contactPKs) > cryptoutil.MaxSecretShares {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("%d contacts for a threshold of %d", len(contactPKs), threshold))
+	}
+
+	defer svc.writer.enter()()
+
+	contacts := make([]*messengertypes.Contact, len(contactPKs))
+	seen := map[string]bool{}
+	for i, pk := range contactPKs {
+		if seen[pk] {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("duplicated contact %s", pk))
+		}
+		seen[pk] = true
+
+		contact, err := svc.db.getContactByPK(pk)
+		if err != nil {
+			return nil, errcode.ErrNotFound.Wrap(err)
+		}
+
+		if contact.GetState() != messengertypes.Contact_Accepted || contact.GetConversationPublicKey() == "" {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the contact %s is not accepted", pk))
+		}
+
+		contacts[i] = contact
+	}
+
+	return contacts, nil
+}
+
+type recoverySetupStreamWriter struct {
+	server messengertypes.MessengerService_RecoverySetupServer
+}
+
+func (w *recoverySetupStreamWriter) Write(p []byte) (int, error) {
+	if err := w.server.Send(&messengertypes.RecoverySetup_Reply{BackupData: append([]byte{}, p...)}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (svc *service) RecoverySetup(req *messengertypes.RecoverySetup_Request, server messengertypes.MessengerService_RecoverySetupServer) error {
+	ctx := server.Context()
+
+	contacts, err := svc.getRecoveryContacts(req.GetContactPublicKeys(), req.GetThreshold())
+	if err != nil {
+		return err
+	}
+
+	secret, err := cryptoutil.GenerateNonceSize(recoverySecretSize)
+	if err != nil {
+		return errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	shares, err := cryptoutil.SplitSecret(secret, len(contacts), int(req.GetThreshold()))
+	if err != nil {
+		return err
+	}
+
+	rawID, err := cryptoutil.GenerateNonceSize(recoverySetupIDSize)
+	if err != nil {
+		return errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+	setupID := b64EncodeBytes(rawID)
+	checksum := sha256.Sum256(secret)
+
+	// the backup is made before the shards are sent, a failed export doesn't replace the current setup
+	tmpFile, err := ioutil.TempFile(os.TempDir(), "recovery-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := svc.writeAccountExport(ctx, tmpFile); err != nil {
+		return err
+	}
+
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	for i, contact := range contacts {
+		gpk, err := b64DecodeBytes(contact.GetConversationPublicKey())
+		if err != nil {
+			return errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		payload, err := messengertypes.AppMessage_TypeRecoveryShard.MarshalPayload(timestampMs(time.Now()), nil, &messengertypes.AppMessage_RecoveryShard{
+			SetupID:   setupID,
+			Threshold: req.GetThreshold(),
+			Share:     shares[i],
+			Checksum:  checksum[:],
+		})
+		if err != nil {
+			return errcode.ErrSerialization.Wrap(err)
+		}
+
+		if err := svc.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{GroupPK: gpk, Payload: payload}); err != nil {
+			return errcode.ErrProtocolSend.Wrap(err)
+		}
+	}
+
+	svc.logger.Info("recovery set up", zap.String("setup-id", setupID), zap.Int("trustees", len(contacts)), zap.Uint32("threshold", req.GetThreshold()))
+
+	if err := server.Send(&messengertypes.RecoverySetup_Reply{SetupID: setupID}); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	return encryptBackup(&recoverySetupStreamWriter{server: server}, tmpFile, []byte(b64EncodeBytes(secret)))
+}
+
+func (svc *service) RecoveryStatus(ctx context.Context, req *messengertypes.RecoveryStatus_Request) (*messengertypes.RecoveryStatus_Reply, error) {
+	defer svc.writer.enter()()
+
+	trustees, err := svc.db.getRecoveryTrustees()
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := svc.db.getRecoveryShards()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.RecoveryStatus_Reply{}
+	for _, trustee := range trustees {
+		reply.SetupID, reply.Threshold, reply.CreatedDate = trustee.GetSetupID(), trustee.GetThreshold(), trustee.GetCreatedDate()
+		reply.TrusteePublicKeys = append(reply.TrusteePublicKeys, trustee.GetContactPublicKey())
+	}
+
+	for _, shard := range shards {
+		shard.Share = nil
+		reply.HeldShards = append(reply.HeldShards, shard)
+	}
+
+	return reply, nil
+}
+
+func (svc *service) RecoveryShardExport(ctx context.Context, req *messengertypes.RecoveryShardExport_Request) (*messengertypes.RecoveryShardExport_Reply, error) {
+	if req.GetOwnerPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	shard, err := svc.db.getRecoveryShard(req.GetOwnerPublicKey())
+	if err == gorm.ErrRecordNotFound {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	code, err := encodeRecoveryCode(&messengertypes.RecoveryCode{
+		SetupID:          shard.GetSetupID(),
+		AccountPublicKey: shard.GetOwnerPublicKey(),
+		Threshold:        shard.GetThreshold(),
+		Share:            shard.GetShare(),
+		Checksum:         shard.GetChecksum(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("exported recovery code", zap.String("owner-pk", shard.GetOwnerPublicKey()), zap.String("setup-id", shard.GetSetupID()))
+
+	return &messengertypes.RecoveryShardExport_Reply{Code: code}, nil
+}
+
+func (svc *service) AccountRecoveryCheck(ctx context.Context, req *messengertypes.AccountRecoveryCheck_Request) (*messengertypes.AccountRecoveryCheck_Reply, error) {
+	reply, _, err := combineRecoveryCodes(req.GetCodes())
+	return reply, err
+}
+
+func (svc *service) AccountRecover(server messengertypes.MessengerService_AccountRecoverServer) error {
+	encrypted, err := ioutil.TempFile(os.TempDir(), "recovery-")
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	defer os.Remove(encrypted.Name())
+	defer encrypted.Close()
+
+	codes := []string(nil)
+	for first := true; ; first = false {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if first {
+			codes = req.GetCodes()
+		}
+
+		if _, err := encrypted.Write(req.GetBackupData()); err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+	}
+
+	check, passphrase, err := combineRecoveryCodes(codes)
+	if err != nil {
+		return err
+	}
+
+	if !check.GetComplete() {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("%d recovery codes of %d", check.GetCodeCount(), check.GetThreshold()))
+	}
+
+	if _, err := encrypted.Seek(0, io.SeekStart); err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	state, err := svc.restoreAccountBackup(server.Context(), encrypted, []byte(passphrase))
+	if err != nil {
+		return err
+	}
+
+	return server.SendAndClose(&messengertypes.AccountRecover_Reply{SnapshotDate: state.GetSnapshotDate()})
+}
@@ -0,0 +1,147 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_handleAppMessageRecoveryShard(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	conv := &messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_ContactType, ContactPublicKey: "contact_1"}
+	checksum := make([]byte, sha256.Size)
+
+	shard := func(cid string, isMe bool, setupID string, sentDate int64) error {
+		_, _, err := h.handleAppMessageRecoveryShard(db, &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", IsMe: isMe, SentDate: sentDate}, &messengertypes.AppMessage_RecoveryShard{
+			SetupID:   setupID,
+			Threshold: 2,
+			Share:     []byte{1, 2, 3},
+			Checksum:  checksum,
+		})
+		return err
+	}
+
+	// the shards of the contacts are held, the most recent setup replaces the previous ones
+	require.NoError(t, shard("cid_1", false, "setup_1", 1000))
+	require.NoError(t, shard("cid_2", false, "setup_2", 2000))
+	require.NoError(t, shard("cid_3", false, "setup_0", 500))
+
+	shards, err := db.getRecoveryShards()
+	require.NoError(t, err)
+	require.Len(t, shards, 1)
+	require.Equal(t, "setup_2", shards[0].GetSetupID())
+	require.Equal(t, "contact_1", shards[0].GetOwnerPublicKey())
+	require.Equal(t, "cid_2", shards[0].GetInteractionCID())
+
+	// the shards sent by the account record its trustees
+	require.NoError(t, shard("cid_4", true, "setup_3", 3000))
+	require.NoError(t, shard("cid_4", true, "setup_3", 3000))
+
+	trustees, err := db.getRecoveryTrustees()
+	require.NoError(t, err)
+	require.Len(t, trustees, 1)
+	require.Equal(t, "contact_1", trustees[0].GetContactPublicKey())
+	require.Equal(t, int64(3000), trustees[0].GetCreatedDate())
+
+	// the invalid shards are ignored
+	require.NoError(t, shard("cid_5", false, "", 4000))
+	conv.Type = messengertypes.Conversation_MultiMemberType
+	require.NoError(t, shard("cid_6", false, "setup_4", 5000))
+
+	shards, err = db.getRecoveryShards()
+	require.NoError(t, err)
+	require.Len(t, shards, 1)
+	require.Equal(t, "setup_2", shards[0].GetSetupID())
+}
+
+func Test_combineRecoveryCodes(t *testing.T) {
+	secret := []byte("a recovery secret of 32 bytes..!")
+	checksum := sha256.Sum256(secret)
+
+	shares, err := cryptoutil.SplitSecret(secret, 3, 2)
+	require.NoError(t, err)
+
+	codes := make([]string, len(shares))
+	for i, share := range shares {
+		codes[i], err = encodeRecoveryCode(&messengertypes.RecoveryCode{SetupID: "setup_1", AccountPublicKey: "account_1", Threshold: 2, Share: share, Checksum: checksum[:]})
+		require.NoError(t, err)
+	}
+
+	// the same code given twice doesn't reach the threshold
+	reply, passphrase, err := combineRecoveryCodes([]string{codes[0], codes[0]})
+	require.NoError(t, err)
+	require.False(t, reply.GetComplete())
+	require.Equal(t, uint32(1), reply.GetCodeCount())
+	require.Empty(t, passphrase)
+
+	reply, passphrase, err = combineRecoveryCodes([]string{codes[2], codes[0]})
+	require.NoError(t, err)
+	require.True(t, reply.GetComplete())
+	require.Equal(t, "account_1", reply.GetAccountPublicKey())
+	require.Equal(t, "setup_1", reply.GetSetupID())
+	require.Equal(t, b64EncodeBytes(secret), passphrase)
+
+	other, err := encodeRecoveryCode(&messengertypes.RecoveryCode{SetupID: "setup_2", AccountPublicKey: "account_1", Threshold: 2, Share: shares[1], Checksum: checksum[:]})
+	require.NoError(t, err)
+
+	_, _, err = combineRecoveryCodes([]string{codes[0], other})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	// a code of another secret doesn't match the checksum
+	forged := append([]byte{}, shares[1]...)
+	forged[0] ^= 1
+	forgedCode, err := encodeRecoveryCode(&messengertypes.RecoveryCode{SetupID: "setup_1", AccountPublicKey: "account_1", Threshold: 2, Share: forged, Checksum: checksum[:]})
+	require.NoError(t, err)
+
+	_, _, err = combineRecoveryCodes([]string{codes[0], forgedCode})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, _, err = combineRecoveryCodes([]string{"invalid"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, _, err = combineRecoveryCodes(nil)
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+}
+
+func Test_service_RecoveryShardExport(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	_, err := svc.RecoveryShardExport(context.Background(), &messengertypes.RecoveryShardExport_Request{OwnerPublicKey: "contact_1"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	secret := []byte("a recovery secret of 32 bytes..!")
+	checksum := sha256.Sum256(secret)
+	shares, err := cryptoutil.SplitSecret(secret, 2, 2)
+	require.NoError(t, err)
+
+	_, err = db.addRecoveryShard(&messengertypes.RecoveryShard{SetupID: "setup_1", OwnerPublicKey: "contact_1", Threshold: 2, Share: shares[0], Checksum: checksum[:], SentDate: 1000})
+	require.NoError(t, err)
+
+	reply, err := svc.RecoveryShardExport(context.Background(), &messengertypes.RecoveryShardExport_Request{OwnerPublicKey: "contact_1"})
+	require.NoError(t, err)
+
+	code, err := decodeRecoveryCode(reply.GetCode())
+	require.NoError(t, err)
+	require.Equal(t, "contact_1", code.GetAccountPublicKey())
+	require.Equal(t, shares[0], code.GetShare())
+
+	// the status doesn't expose the held shares
+	status, err := svc.RecoveryStatus(context.Background(), &messengertypes.RecoveryStatus_Request{})
+	require.NoError(t, err)
+	require.Len(t, status.GetHeldShards(), 1)
+	require.Empty(t, status.GetHeldShards()[0].GetShare())
+	require.Empty(t, status.GetTrusteePublicKeys())
+}
@@ -3,7 +3,9 @@ package bertymessenger
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
 	"github.com/golang/protobuf/proto"
@@ -14,150 +16,418 @@ import (
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
 )
 
-func getEventsReplayerForDB(ctx context.Context, client protocoltypes.ProtocolServiceClient) func(db *dbWrapper) error {
+// ReplayOptions bounds a replay to the messages sent within a time window, the zero value replays the whole history.
+// The protocol events are not dated: the membership and the other protocol events are always handled, only the
+// messages are filtered on their sent date
+type ReplayOptions struct {
+	// Since excludes the messages sent before it when set
+	Since time.Time
+	// Until excludes the messages sent after it when set
+	Until time.Time
+	// MaxSize bounds the size in bytes of the message events held in memory at once by the replay, the next ones are
+	// loaded on demand. historyPageMaxSize is used if not set
+	MaxSize int64
+	// FullFidelity stores the acks and the reactions one by one as when they are handled live, they are only
+	// aggregated into the summaries of their targets otherwise
+	FullFidelity bool
+	// HandlerHook is called before each replayed event is handled, the test harnesses use it to inject faults
+	HandlerHook func(evt *protocoltypes.EventContext)
+	// HeadOnly replays only the most recent message of each conversation so the conversation list is available as
+	// soon as the metadata is handled, the rest of the history is replayed in the background by the service and
+	// ConversationConsistent is streamed once a conversation is complete. It is ignored when Since or Until is set
+	HeadOnly bool
+	// MaxConsecutiveFailures aborts the replay once as many events of a group failed in a row,
+	// defaultMaxConsecutiveEventFailures is used if 0 and the replay is never aborted if it is negative
+	MaxConsecutiveFailures int
+	// ActivationAttempts is the number of times the activation of a group is tried before the group is skipped,
+	// defaultReplayActivationAttempts is used if not set
+	ActivationAttempts int
+}
+
+// isZero returns whether the replay is not bounded to a time window
+func (o ReplayOptions) isZero() bool {
+	return o.Since.IsZero() && o.Until.IsZero()
+}
+
+func (o ReplayOptions) maxSize() int64 {
+	if o.MaxSize <= 0 {
+		return historyPageMaxSize
+	}
+
+	return o.MaxSize
+}
+
+func (o ReplayOptions) maxConsecutiveFailures() int {
+	if o.MaxConsecutiveFailures == 0 {
+		return defaultMaxConsecutiveEventFailures
+	}
+
+	return o.MaxConsecutiveFailures
+}
+
+func (o ReplayOptions) activationAttempts() int {
+	if o.ActivationAttempts <= 0 {
+		return defaultReplayActivationAttempts
+	}
+
+	return o.ActivationAttempts
+}
+
+// contains returns whether a message sent at sentDate, in milliseconds, is within the window
+func (o ReplayOptions) contains(sentDate int64) bool {
+	if !o.Since.IsZero() && sentDate < timestampMs(o.Since) {
+		return false
+	}
+
+	if !o.Until.IsZero() && sentDate > timestampMs(o.Until) {
+		return false
+	}
+
+	return true
+}
+
+// replayFilter selects the events handled by a replay, the zero value replays all the events of all the groups
+type replayFilter struct {
+	scope messengertypes.DatabaseRepair_ReplayScope
+	// groupPKs restricts the replay to some groups, all of them are replayed when empty
+	groupPKs []string
+	window   ReplayOptions
+}
+
+func (f replayFilter) metadata() bool {
+	return f.scope != messengertypes.DatabaseRepair_ReplayMessagesOnly
+}
+
+func (f replayFilter) messages() bool {
+	return f.scope != messengertypes.DatabaseRepair_ReplayMetadataOnly
+}
+
+func (f replayFilter) includes(groupPK string) bool {
+	if len(f.groupPKs) == 0 {
+		return true
+	}
+
+	for _, pk := range f.groupPKs {
+		if pk == groupPK {
+			return true
+		}
+	}
+
+	return false
+}
+
+// replayReportMaxFailures bounds the number of failures detailed by a replay report, the next ones are only counted
+const replayReportMaxFailures = 100
+
+// replayFailed records the failure of an event in the report of the replay and quarantines it, nil is returned so the
+// next events are handled until too many of them failed in a row. The failure is returned with its context when no
+// report is collected
+func (h *eventHandler) replayFailed(code errcode.ErrCode, groupPK []byte, evt *protocoltypes.EventContext, eventType string, err error) error {
+	cid := eventCID(evt)
+	if h.report == nil {
+		return code.Wrap(fmt.Errorf("group %s, event %s (%s): %w", b64EncodeBytes(groupPK), cid, eventType, err))
+	}
+
+	h.report.FailedEvents++
+	if len(h.report.Failures) < replayReportMaxFailures {
+		h.report.Failures = append(h.report.Failures, &messengertypes.ReplayReport_Failure{
+			GroupPK:   b64EncodeBytes(groupPK),
+			EventCID:  cid,
+			EventType: eventType,
+			ErrorCode: int32(code),
+			Error:     err.Error(),
+		})
+	}
+
+	return h.eventFailed(b64EncodeBytes(groupPK), evt, eventType, err)
+}
+
+// recoverHandling handles an event with its panics turned into errors, so a faulty handler only fails its event
+func (h *eventHandler) recoverHandling(evt *protocoltypes.EventContext, handle func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errHandlerPanicked, r)
+		}
+	}()
+
+	if h.hook != nil {
+		h.hook(evt)
+	}
+
+	return handle()
+}
+
+func logReplayReport(logger *zap.Logger, report *messengertypes.ReplayReport) {
+	for _, group := range report.GetSkippedGroups() {
+		logger.Warn("a group was skipped by the replay",
+			logGroup(group.GetGroupPK()),
+			zap.Int32("attempts", group.GetAttempts()),
+			zap.String("error", group.GetError()),
+		)
+	}
+
+	if report.GetFailedEvents() == 0 {
+		return
+	}
+
+	logger.Warn("some events were skipped by the replay",
+		zap.Int64("failed-events", report.GetFailedEvents()),
+		zap.Int64("replayed-groups", report.GetReplayedGroups()),
+	)
+}
+
+func getEventsReplayerForDB(ctx context.Context, client protocoltypes.ProtocolServiceClient, window ReplayOptions) func(db *dbWrapper) error {
 	return func(db *dbWrapper) error {
-		return replayLogsToDB(ctx, client, db)
+		report, err := replayLogsToDB(ctx, client, db, replayFilter{window: window})
+		if err != nil {
+			return err
+		}
+
+		logReplayReport(db.log, report)
+
+		return nil
+	}
+}
+
+// replayLogsWithLocalState rebuilds the database from the logs and restores the local state which is not part of them
+func replayLogsWithLocalState(ctx context.Context, client protocoltypes.ProtocolServiceClient, db *dbWrapper, state *messengertypes.LocalDatabaseState, window ReplayOptions) error {
+	if err := dropAllTables(db.db); err != nil {
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to drop database schema: %w", err))
+	}
+
+	if err := db.db.AutoMigrate(getDBModels()...); err != nil {
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to create database schema: %w", err))
+	}
+
+	if err := restoreReplayLocalState(db, state); err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	report, err := replayLogsToDB(ctx, client, db, replayFilter{window: window})
+	if err != nil {
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to replay logs to database: %w", err))
 	}
+
+	logReplayReport(db.log, report)
+
+	if err := restoreDatabaseLocalState(db, state); err != nil {
+		return errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to restore database local state: %w", err))
+	}
+
+	return setDBSchemaVersion(db.db, latestDBMigrationVersion(dbMigrations))
 }
 
-func replayLogsToDB(ctx context.Context, client protocoltypes.ProtocolServiceClient, wrappedDB *dbWrapper) error {
+// replayLogsToDB handles the events of the logs of the account, the filter allows to only rebuild a part of the
+// database without reprocessing all the events. The events and the groups which fail are skipped and listed in the
+// report, an error is only returned when the logs can't be read
+func replayLogsToDB(ctx context.Context, client protocoltypes.ProtocolServiceClient, wrappedDB *dbWrapper, filter replayFilter) (*messengertypes.ReplayReport, error) {
 	// Get account infos
 	cfg, err := client.InstanceGetConfiguration(ctx, &protocoltypes.InstanceGetConfiguration_Request{})
 	if err != nil {
-		return errcode.TODO.Wrap(err)
+		return nil, errcode.ErrInternal.Wrap(err)
 	}
 	pk := b64EncodeBytes(cfg.GetAccountGroupPK())
 
 	if err := wrappedDB.addAccount(pk, ""); err != nil {
-		return errcode.ErrDBWrite.Wrap(err)
+		return nil, errcode.ErrDBWrite.Wrap(err)
 	}
 
-	handler := newEventHandler(ctx, wrappedDB, client, zap.NewNop(), nil, true)
+	// the notes to self are replayed with the messages of the account group
+	if err := wrappedDB.addAccountConversation(pk, timestampMs(time.Now())); err != nil {
+		return nil, err
+	}
+
+	report := &messengertypes.ReplayReport{}
+	// the handler logs with the scope of the group being replayed
+	logger := wrappedDB.log.Named(logSubsystemReplay)
+	handler := newEventHandler(ctx, wrappedDB, client, logger.With(logGroup(pk)), nil, true)
+	handler.report = report
+	handler.compact = !filter.window.FullFidelity
+	handler.hook = filter.window.HandlerHook
+	handler.failures = newEventFailureStreaks(filter.window.maxConsecutiveFailures())
 
 	// Replay all account group metadata events
 	// TODO: We should have a toggle to "lock" orbitDB while we replaying events
 	// So we don't miss events that occurred during the replay
-	if err := processMetadataList(ctx, cfg.GetAccountGroupPK(), handler); err != nil {
-		return errcode.ErrReplayProcessGroupMetadata.Wrap(err)
+	if filter.metadata() && filter.includes(pk) {
+		if err := processMetadataList(ctx, cfg.GetAccountGroupPK(), handler, filter.window); err != nil {
+			return nil, errcode.ErrReplayProcessGroupMetadata.Wrap(err)
+		}
 	}
 
 	// Get all groups the account is member of
 	convs, err := wrappedDB.getAllConversations()
 	if err != nil {
-		return errcode.ErrDBRead.Wrap(err)
+		return nil, errcode.ErrDBRead.Wrap(err)
 	}
 
 	for _, conv := range convs {
+		if !filter.includes(conv.GetPublicKey()) {
+			continue
+		}
+
 		// Replay all other group metadata events
 		groupPK, err := b64DecodeBytes(conv.GetPublicKey())
 		if err != nil {
-			return errcode.ErrDeserialization.Wrap(err)
+			return nil, errcode.ErrDeserialization.Wrap(err)
 		}
+		handler.logger = logger.With(logGroup(conv.GetPublicKey()))
 
 		// Group account metadata was already replayed above and account group
 		// is always activated
 		// TODO: check with @glouvigny if we could launch the protocol
 		// without activating the account group
-		if !bytes.Equal(groupPK, cfg.GetAccountGroupPK()) {
-			if _, err := client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{
-				GroupPK:   groupPK,
-				LocalOnly: true,
-			}); err != nil {
-				return errcode.ErrGroupActivate.Wrap(err)
-			}
+		isAccountGroup := bytes.Equal(groupPK, cfg.GetAccountGroupPK())
+		if !isAccountGroup {
+			attempts, err := activateReplayedGroup(ctx, client, groupPK, filter.window.activationAttempts())
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, errcode.ErrReplayGroupActivation.Wrap(err)
+				}
 
-			if err := processMetadataList(ctx, groupPK, handler); err != nil {
-				return errcode.ErrReplayProcessGroupMetadata.Wrap(err)
+				if err := skipReplayedGroup(wrappedDB, report, conv.GetPublicKey(), attempts, errcode.ErrReplayGroupActivation.Wrap(err)); err != nil {
+					return nil, err
+				}
+				continue
 			}
 		}
 
-		// Replay all group message events
-		if err := processMessageList(ctx, groupPK, handler); err != nil {
-			return errcode.ErrReplayProcessGroupMessage.Wrap(err)
+		// a group which fails is skipped, the replay of the account group is required by the others
+		if err := replayGroupEventsToDB(ctx, handler, wrappedDB, conv.GetPublicKey(), groupPK, isAccountGroup, filter); err != nil {
+			if isAccountGroup || ctx.Err() != nil {
+				return nil, err
+			}
+
+			if err := skipReplayedGroup(wrappedDB, report, conv.GetPublicKey(), 1, err); err != nil {
+				return nil, err
+			}
+		} else {
+			report.ReplayedGroups++
+
+			if err := wrappedDB.deleteReplaySkippedGroup(conv.GetPublicKey()); err != nil {
+				return nil, err
+			}
 		}
 
 		// Deactivate non-account groups
-		if !bytes.Equal(groupPK, cfg.GetAccountGroupPK()) {
+		if !isAccountGroup {
 			if _, err := client.DeactivateGroup(ctx, &protocoltypes.DeactivateGroup_Request{
 				GroupPK: groupPK,
 			}); err != nil {
-				return errcode.ErrGroupDeactivate.Wrap(err)
+				if err := handler.replayFailed(errcode.ErrReplayGroupDeactivation, groupPK, nil, "", err); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	return nil
+	// the contacts added again through a restore are merged once all the groups are known
+	merged, err := wrappedDB.mergeContactDuplicates("", timestampMs(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	report.MergedContacts = int64(len(merged))
+
+	if err := wrappedDB.setAccountLastReplayDate(pk, timestampMs(time.Now())); err != nil {
+		return nil, err
+	}
+
+	return report, nil
 }
 
-func processMetadataList(ctx context.Context, groupPK []byte, handler *eventHandler) error {
-	subCtx, subCancel := context.WithCancel(ctx)
-	defer subCancel()
+// replayGroupEventsToDB replays the events of a group in the scope of the filter, the metadata of the account group
+// is replayed before the other groups
+func replayGroupEventsToDB(ctx context.Context, handler *eventHandler, db *dbWrapper, convPK string, groupPK []byte, isAccountGroup bool, filter replayFilter) error {
+	if !isAccountGroup && filter.metadata() {
+		if err := processMetadataList(ctx, groupPK, handler, filter.window); err != nil {
+			return errcode.ErrReplayProcessGroupMetadata.Wrap(err)
+		}
+	}
 
-	metaList, err := handler.protocolClient.GroupMetadataList(
-		subCtx,
-		&protocoltypes.GroupMetadataList_Request{
-			GroupPK:  groupPK,
-			UntilNow: true,
-		},
-	)
+	if filter.messages() {
+		return replayGroupMessagesToDB(ctx, handler, db, convPK, groupPK, filter.window)
+	}
+
+	return nil
+}
+
+// replayGroupMessagesToDB replays the most recent group message events, or the ones of the window when it is set, the
+// older ones are loaded on demand
+func replayGroupMessagesToDB(ctx context.Context, handler *eventHandler, db *dbWrapper, convPK string, groupPK []byte, window ReplayOptions) error {
+	cursor, err := processMessageWindow(ctx, groupPK, window, handler)
 	if err != nil {
-		return errcode.ErrEventListMetadata.Wrap(err)
+		return errcode.ErrReplayProcessGroupMessage.Wrap(err)
 	}
 
-	for {
-		if subCtx.Err() != nil {
-			return errcode.ErrEventListMetadata.Wrap(err)
-		}
+	if _, err := db.setConversationHistoryCursor(convPK, b64EncodeBytes(cursor)); err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
 
-		metadata, err := metaList.Recv()
-		if err == io.EOF {
-			return nil
-		} else if err != nil {
-			return errcode.ErrEventListMetadata.Wrap(err)
-		}
+	return nil
+}
 
-		if err := handler.handleMetadataEvent(metadata); err != nil {
-			return err
-		}
+// isMetadataEventInWindow returns whether a metadata event is handled by a replay bounded to window, only the visible
+// messages sent outside of it are skipped as the other ones carry a state which is not found elsewhere
+func (h *eventHandler) isMetadataEventInWindow(gme *protocoltypes.GroupMetadataEvent, window ReplayOptions) bool {
+	if window.isZero() || gme.GetMetadata().GetEventType() != protocoltypes.EventTypeGroupMetadataPayloadSent {
+		return true
 	}
+
+	var appMetadata protocoltypes.AppMetadata
+	if err := proto.Unmarshal(gme.GetEvent(), &appMetadata); err != nil {
+		return true
+	}
+
+	// the payload is only decoded when the event is handled
+	var header messengertypes.AppMessageHeader
+	if err := proto.Unmarshal(appMetadata.GetMessage(), &header); err != nil {
+		return true
+	}
+
+	if !h.appMessageHandlers[header.GetType()].isVisibleEvent {
+		return true
+	}
+
+	return window.contains(header.GetSentDate())
 }
 
-func processMessageList(ctx context.Context, groupPK []byte, handler *eventHandler) error {
+func processMetadataList(ctx context.Context, groupPK []byte, handler *eventHandler, window ReplayOptions) error {
 	subCtx, subCancel := context.WithCancel(ctx)
 	defer subCancel()
 
-	groupPKStr := b64EncodeBytes(groupPK)
-
-	msgList, err := handler.protocolClient.GroupMessageList(
+	metaList, err := handler.protocolClient.GroupMetadataList(
 		subCtx,
-		&protocoltypes.GroupMessageList_Request{
+		&protocoltypes.GroupMetadataList_Request{
 			GroupPK:  groupPK,
 			UntilNow: true,
 		},
 	)
 	if err != nil {
-		return errcode.ErrEventListMessage.Wrap(err)
+		return errcode.ErrEventListMetadata.Wrap(err)
 	}
 
 	for {
 		if subCtx.Err() != nil {
-			return errcode.ErrEventListMessage.Wrap(err)
+			return errcode.ErrEventListMetadata.Wrap(err)
 		}
 
-		message, err := msgList.Recv()
+		metadata, err := metaList.Recv()
 		if err == io.EOF {
 			return nil
 		} else if err != nil {
-			return errcode.ErrEventListMessage.Wrap(err)
+			return errcode.ErrEventListMetadata.Wrap(err)
 		}
 
-		var appMsg messengertypes.AppMessage
-		if err := proto.Unmarshal(message.GetMessage(), &appMsg); err != nil {
-			return errcode.ErrDeserialization.Wrap(err)
+		if !handler.isMetadataEventInWindow(metadata, window) {
+			continue
 		}
 
-		if err := handler.handleAppMessage(groupPKStr, message, &appMsg); err != nil {
-			return errcode.TODO.Wrap(err)
+		if err := handler.recoverHandling(metadata.GetEventContext(), func() error { return handler.handleMetadataEvent(metadata) }); err != nil {
+			if err := handler.replayFailed(errcode.ErrReplayMetadataHandling, groupPK, metadata.GetEventContext(), metadata.GetMetadata().GetEventType().String(), err); err != nil {
+				return err
+			}
+		} else {
+			handler.failures.handled(b64EncodeBytes(groupPK))
 		}
 	}
 }
@@ -0,0 +1,141 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// A group whose activation or whose events keep failing doesn't abort the replay of the others: it is skipped, listed
+// in the report of the replay and recorded in the database. The recorded groups are replayed again once the service
+// is started, and are reported by the database doctor until one of their replays succeeds.
+
+const (
+	// defaultReplayActivationAttempts is the number of times the activation of a group is tried by a replay
+	defaultReplayActivationAttempts = 3
+	// replayActivationBackoff is the delay before the second activation of a group, it doubles after each attempt
+	replayActivationBackoff = 100 * time.Millisecond
+	// replayActivationMaxBackoff bounds the delay between two activations of a group
+	replayActivationMaxBackoff = 2 * time.Second
+)
+
+// activateReplayedGroup activates a group to read its logs, it is tried again with backoff until its attempts are
+// spent. The number of attempts made is returned with the last error
+func activateReplayedGroup(ctx context.Context, client protocoltypes.ProtocolServiceClient, groupPK []byte, attempts int) (int, error) {
+	backoff := replayActivationBackoff
+
+	for attempt := 1; ; attempt++ {
+		_, err := client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{
+			GroupPK:   groupPK,
+			LocalOnly: true,
+		})
+		if err == nil || attempt >= attempts {
+			return attempt, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > replayActivationMaxBackoff {
+			backoff = replayActivationMaxBackoff
+		}
+	}
+}
+
+// skipReplayedGroup lists a group in the skipped groups of the report and records it to be replayed again later
+func skipReplayedGroup(db *dbWrapper, report *messengertypes.ReplayReport, convPK string, attempts int, err error) error {
+	group := &messengertypes.ReplaySkippedGroup{
+		GroupPK:     convPK,
+		Attempts:    int32(attempts),
+		ErrorCode:   int32(errcode.Code(err)),
+		Error:       err.Error(),
+		SkippedDate: timestampMs(time.Now()),
+	}
+
+	report.SkippedGroups = append(report.SkippedGroups, group)
+
+	return db.addReplaySkippedGroup(group)
+}
+
+// retryReplaySkippedGroups replays again the groups skipped by the previous replays, they are activated with the
+// other conversations by the start of the service. The groups which still fail stay recorded with their attempts, the
+// ones of the paused conversations are replayed once resumed
+func (svc *service) retryReplaySkippedGroups(ctx context.Context) {
+	groups, err := svc.db.getReplaySkippedGroups()
+	if err != nil {
+		svc.logger.Error("unable to list the groups skipped by the replay", zap.Error(err))
+		return
+	}
+
+	active, err := svc.getReplayedGroups()
+	if err != nil {
+		svc.logger.Error("unable to list the replayed groups", zap.Error(err))
+		return
+	}
+
+	isActive := make(map[string]bool, len(active))
+	for _, groupPK := range active {
+		isActive[groupPK] = true
+	}
+
+	for _, group := range groups {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !isActive[group.GetGroupPK()] {
+			continue
+		}
+
+		if err := svc.retryReplaySkippedGroup(ctx, group.GetGroupPK()); err != nil {
+			svc.logger.Warn("unable to replay a group skipped by the replay", logGroup(group.GetGroupPK()), zap.Error(err))
+		}
+	}
+}
+
+func (svc *service) retryReplaySkippedGroup(ctx context.Context, convPK string) error {
+	defer svc.writer.enter()()
+
+	report := &messengertypes.ReplayReport{}
+	err := svc.replayGroup(ctx, convPK, replayFilter{}, report)
+	if err == nil {
+		logReplayReport(svc.logger, report)
+		return nil
+	}
+
+	if ctx.Err() == nil {
+		if err := skipReplayedGroup(svc.db, report, convPK, 1, err); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// getReplaySkippedGroupIssues lists the groups skipped by the replays as issues of the database
+func getReplaySkippedGroupIssues(db *dbWrapper) ([]*messengertypes.DatabaseDoctor_Issue, error) {
+	groups, err := db.getReplaySkippedGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []*messengertypes.DatabaseDoctor_Issue(nil)
+	for _, group := range groups {
+		issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+			Kind:                  messengertypes.DatabaseDoctor_KindSkippedReplayGroup,
+			ConversationPublicKey: group.GetGroupPK(),
+			Detail:                fmt.Sprintf("group skipped by the replay after %d attempts: %s", group.GetAttempts(), group.GetError()),
+		})
+	}
+
+	return issues, nil
+}
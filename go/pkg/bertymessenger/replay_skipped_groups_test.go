@@ -0,0 +1,82 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+type replayActivationTestClient struct {
+	protocoltypes.ProtocolServiceClient
+	failures    int
+	activations int
+}
+
+func (c *replayActivationTestClient) ActivateGroup(context.Context, *protocoltypes.ActivateGroup_Request, ...grpc.CallOption) (*protocoltypes.ActivateGroup_Reply, error) {
+	c.activations++
+	if c.activations <= c.failures {
+		return nil, fmt.Errorf("activation failed")
+	}
+
+	return &protocoltypes.ActivateGroup_Reply{}, nil
+}
+
+func Test_activateReplayedGroup(t *testing.T) {
+	// the activation succeeds once retried
+	client := &replayActivationTestClient{failures: 1}
+	attempts, err := activateReplayedGroup(context.Background(), client, []byte("group"), 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+
+	// the group keeps failing
+	client = &replayActivationTestClient{failures: 5}
+	attempts, err = activateReplayedGroup(context.Background(), client, []byte("group"), 2)
+	require.Error(t, err)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, 2, client.activations)
+
+	// the retries stop with the replay
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client = &replayActivationTestClient{failures: 5}
+	attempts, err = activateReplayedGroup(ctx, client, []byte("group"), 3)
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+}
+
+func Test_skipReplayedGroup(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	report := &messengertypes.ReplayReport{}
+	require.NoError(t, skipReplayedGroup(db, report, "conv_1", 3, errcode.ErrReplayGroupActivation.Wrap(fmt.Errorf("activation failed"))))
+	require.NoError(t, skipReplayedGroup(db, report, "conv_1", 1, errcode.ErrReplayProcessGroupMetadata.Wrap(fmt.Errorf("metadata failed"))))
+
+	require.Len(t, report.GetSkippedGroups(), 2)
+	require.Equal(t, int32(errcode.ErrReplayGroupActivation), report.GetSkippedGroups()[0].GetErrorCode())
+
+	// the attempts of the replays add up
+	groups, err := db.getReplaySkippedGroups()
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	require.Equal(t, int32(4), groups[0].GetAttempts())
+	require.Equal(t, int32(errcode.ErrReplayProcessGroupMetadata), groups[0].GetErrorCode())
+
+	issues, err := getReplaySkippedGroupIssues(db)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	require.Equal(t, messengertypes.DatabaseDoctor_KindSkippedReplayGroup, issues[0].GetKind())
+	require.Equal(t, "conv_1", issues[0].GetConversationPublicKey())
+
+	require.NoError(t, db.deleteReplaySkippedGroup("conv_1"))
+	groups, err = db.getReplaySkippedGroups()
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
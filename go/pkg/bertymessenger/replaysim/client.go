@@ -0,0 +1,229 @@
+package replaysim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+
+	"google.golang.org/grpc"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// Faults are the faults injected in a replay, the zero value replays the fixture as recorded. The groups and the
+// events are keyed by their public key and their ID as strings.
+type Faults struct {
+	// MetadataStreamErrors fails the first listing of the metadata of a group once the given number of events has been
+	// listed, the replay is then started again
+	MetadataStreamErrors map[string]int
+	// MessageStreamErrors fails the first listing of the messages of a group in the same way
+	MessageStreamErrors map[string]int
+	// DuplicateEvery lists every nth event of a listing twice
+	DuplicateEvery int
+	// ReorderWindow shuffles the events of a listing within consecutive windows of this size, following Seed
+	ReorderWindow int
+	Seed          int64
+	// PanicEvents makes the handler panic on these events
+	PanicEvents map[string]bool
+}
+
+// faultyClient serves a fixture through the calls made by the messenger while replaying the logs, with the faults
+// injected, the other calls of the protocol are not implemented and panic
+type faultyClient struct {
+	protocoltypes.ProtocolServiceClient
+
+	fixture *Fixture
+	faults  Faults
+
+	mu sync.Mutex
+	// failed are the listings which already failed, keyed by kind and group
+	failed map[string]bool
+}
+
+func newFaultyClient(fixture *Fixture, faults Faults) *faultyClient {
+	return &faultyClient{fixture: fixture, faults: faults, failed: map[string]bool{}}
+}
+
+func (c *faultyClient) InstanceGetConfiguration(context.Context, *protocoltypes.InstanceGetConfiguration_Request, ...grpc.CallOption) (*protocoltypes.InstanceGetConfiguration_Reply, error) {
+	return &protocoltypes.InstanceGetConfiguration_Reply{
+		AccountPK:      c.fixture.AccountPK,
+		DevicePK:       c.fixture.DevicePK,
+		AccountGroupPK: c.fixture.AccountGroupPK,
+	}, nil
+}
+
+func (c *faultyClient) GroupInfo(_ context.Context, req *protocoltypes.GroupInfo_Request, _ ...grpc.CallOption) (*protocoltypes.GroupInfo_Reply, error) {
+	return &protocoltypes.GroupInfo_Reply{
+		Group:    &protocoltypes.Group{PublicKey: req.GetGroupPK()},
+		MemberPK: c.fixture.AccountPK,
+		DevicePK: c.fixture.DevicePK,
+	}, nil
+}
+
+func (c *faultyClient) ActivateGroup(context.Context, *protocoltypes.ActivateGroup_Request, ...grpc.CallOption) (*protocoltypes.ActivateGroup_Reply, error) {
+	return &protocoltypes.ActivateGroup_Reply{}, nil
+}
+
+func (c *faultyClient) DeactivateGroup(context.Context, *protocoltypes.DeactivateGroup_Request, ...grpc.CallOption) (*protocoltypes.DeactivateGroup_Reply, error) {
+	return &protocoltypes.DeactivateGroup_Reply{}, nil
+}
+
+func (c *faultyClient) GroupMetadataList(ctx context.Context, req *protocoltypes.GroupMetadataList_Request, _ ...grpc.CallOption) (protocoltypes.ProtocolService_GroupMetadataListClient, error) {
+	events := c.fixture.group(req.GetGroupPK()).Metadata
+
+	listed := []*protocoltypes.GroupMetadataEvent(nil)
+	for _, idx := range c.deliveryOrder(len(events)) {
+		listed = append(listed, events[idx])
+	}
+
+	return &metadataListClient{ctx: ctx, events: listed, failAfter: c.failAfter("metadata", req.GetGroupPK(), c.faults.MetadataStreamErrors)}, nil
+}
+
+// GroupMessageList lists the messages of a group, the most recent first, starting at req.UntilID when it is set
+func (c *faultyClient) GroupMessageList(ctx context.Context, req *protocoltypes.GroupMessageList_Request, _ ...grpc.CallOption) (protocoltypes.ProtocolService_GroupMessageListClient, error) {
+	messages := c.fixture.group(req.GetGroupPK()).Messages
+
+	ordered := []*protocoltypes.GroupMessageEvent(nil)
+	for idx := len(messages) - 1; idx >= 0; idx-- {
+		if req.GetUntilID() != nil && ordered == nil && !bytes.Equal(messages[idx].GetEventContext().GetID(), req.GetUntilID()) {
+			continue
+		}
+
+		ordered = append(ordered, messages[idx])
+	}
+
+	listed := []*protocoltypes.GroupMessageEvent(nil)
+	for _, idx := range c.deliveryOrder(len(ordered)) {
+		listed = append(listed, ordered[idx])
+	}
+
+	return &messageListClient{ctx: ctx, events: listed, failAfter: c.failAfter("messages", req.GetGroupPK(), c.faults.MessageStreamErrors)}, nil
+}
+
+// deliveryOrder returns the indexes of the events of a listing of n events as they are delivered, shuffled and
+// duplicated following the faults
+func (c *faultyClient) deliveryOrder(n int) []int {
+	order := make([]int, n)
+	for idx := range order {
+		order[idx] = idx
+	}
+
+	if window := c.faults.ReorderWindow; window > 1 {
+		r := rand.New(rand.NewSource(c.faults.Seed))
+		for start := 0; start < n; start += window {
+			end := start + window
+			if end > n {
+				end = n
+			}
+
+			part := order[start:end]
+			r.Shuffle(len(part), func(i, j int) { part[i], part[j] = part[j], part[i] })
+		}
+	}
+
+	if every := c.faults.DuplicateEvery; every > 0 {
+		duplicated := make([]int, 0, n+n/every)
+		for pos, idx := range order {
+			duplicated = append(duplicated, idx)
+			if (pos+1)%every == 0 {
+				duplicated = append(duplicated, idx)
+			}
+		}
+		order = duplicated
+	}
+
+	return order
+}
+
+// failAfter returns the number of events listed before a listing fails, -1 when it doesn't fail, each listing fails
+// once
+func (c *faultyClient) failAfter(kind string, groupPK []byte, streamErrors map[string]int) int {
+	after, ok := streamErrors[string(groupPK)]
+	if !ok {
+		return -1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := kind + "/" + string(groupPK)
+	if c.failed[key] {
+		return -1
+	}
+	c.failed[key] = true
+
+	return after
+}
+
+// handlerHook panics on the events listed by the faults
+func (c *faultyClient) handlerHook(evt *protocoltypes.EventContext) {
+	if c.faults.PanicEvents[string(evt.GetID())] {
+		panic(fmt.Sprintf("injected panic on event %x", evt.GetID()))
+	}
+}
+
+func injectedStreamError() error {
+	return errcode.ErrStreamRead.Wrap(fmt.Errorf("injected stream error"))
+}
+
+type metadataListClient struct {
+	grpc.ClientStream
+
+	ctx       context.Context
+	events    []*protocoltypes.GroupMetadataEvent
+	served    int
+	failAfter int
+}
+
+func (s *metadataListClient) Recv() (*protocoltypes.GroupMetadataEvent, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.served == s.failAfter {
+		return nil, injectedStreamError()
+	}
+
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	s.served++
+
+	evt := s.events[0]
+	s.events = s.events[1:]
+	return evt, nil
+}
+
+type messageListClient struct {
+	grpc.ClientStream
+
+	ctx       context.Context
+	events    []*protocoltypes.GroupMessageEvent
+	served    int
+	failAfter int
+}
+
+func (s *messageListClient) Recv() (*protocoltypes.GroupMessageEvent, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.served == s.failAfter {
+		return nil, injectedStreamError()
+	}
+
+	if len(s.events) == 0 {
+		return nil, io.EOF
+	}
+
+	s.served++
+
+	evt := s.events[0]
+	s.events = s.events[1:]
+	return evt, nil
+}
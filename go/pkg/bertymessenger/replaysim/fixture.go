@@ -0,0 +1,101 @@
+// Package replaysim replays recorded protocol logs through the messenger with injected faults, and compares the
+// resulting databases to golden snapshots.
+package replaysim
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger/bench"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// GroupLog is the recorded metadata and message logs of a group, in the order of the logs
+type GroupLog struct {
+	GroupPK  []byte                              `json:"group_pk"`
+	Metadata []*protocoltypes.GroupMetadataEvent `json:"metadata,omitempty"`
+	Messages []*protocoltypes.GroupMessageEvent  `json:"messages,omitempty"`
+}
+
+// Fixture is the recorded logs of an account, the groups are listed in the order they were joined
+type Fixture struct {
+	AccountGroupPK []byte      `json:"account_group_pk"`
+	AccountPK      []byte      `json:"account_pk"`
+	DevicePK       []byte      `json:"device_pk"`
+	Groups         []*GroupLog `json:"groups"`
+}
+
+// FixtureFromLogs records generated logs, the account group first
+func FixtureFromLogs(logs *bench.Logs) *Fixture {
+	f := &Fixture{
+		AccountGroupPK: logs.AccountGroupPK,
+		AccountPK:      logs.AccountPK,
+		DevicePK:       logs.DevicePK,
+	}
+
+	for _, groupPK := range append([][]byte{logs.AccountGroupPK}, logs.Groups...) {
+		f.Groups = append(f.Groups, &GroupLog{
+			GroupPK:  groupPK,
+			Metadata: logs.Metadata[string(groupPK)],
+			Messages: logs.Messages[string(groupPK)],
+		})
+	}
+
+	return f
+}
+
+// LoadFixture reads a fixture written by Fixture.Write
+func LoadFixture(r io.Reader) (*Fixture, error) {
+	f := &Fixture{}
+	if err := json.NewDecoder(r).Decode(f); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return f, nil
+}
+
+func (f *Fixture) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	if err := enc.Encode(f); err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// Without returns a copy of the fixture without the event of the given ID
+func (f *Fixture) Without(id []byte) *Fixture {
+	copied := *f
+	copied.Groups = nil
+
+	for _, group := range f.Groups {
+		log := &GroupLog{GroupPK: group.GroupPK}
+		for _, evt := range group.Metadata {
+			if !bytes.Equal(evt.GetEventContext().GetID(), id) {
+				log.Metadata = append(log.Metadata, evt)
+			}
+		}
+		for _, evt := range group.Messages {
+			if !bytes.Equal(evt.GetEventContext().GetID(), id) {
+				log.Messages = append(log.Messages, evt)
+			}
+		}
+		copied.Groups = append(copied.Groups, log)
+	}
+
+	return &copied
+}
+
+func (f *Fixture) group(groupPK []byte) *GroupLog {
+	for _, group := range f.Groups {
+		if bytes.Equal(group.GroupPK, groupPK) {
+			return group
+		}
+	}
+
+	return &GroupLog{GroupPK: groupPK}
+}
@@ -0,0 +1,175 @@
+package replaysim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// Dump is the content of a database, the rows of each table are encoded as JSON objects and sorted so two dumps of
+// the same content are equal whatever the insertion order
+type Dump map[string][]string
+
+// DefaultIgnoredColumns are the columns set to the current date by a replay, they differ from one replay to another
+var DefaultIgnoredColumns = map[string][]string{
+	"accounts":         {"last_replay_date"},
+	"processed_events": {"processed_date"},
+}
+
+// DumpDB dumps the non empty tables of a sqlite database without the ignored columns of each table
+func DumpDB(db *gorm.DB, ignored map[string][]string) (Dump, error) {
+	tables := []string(nil)
+	if err := db.Raw("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'").Scan(&tables).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	dump := Dump{}
+	for _, table := range tables {
+		rows, err := dumpTable(db, table, ignored[table])
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rows) > 0 {
+			dump[table] = rows
+		}
+	}
+
+	return dump, nil
+}
+
+func dumpTable(db *gorm.DB, table string, ignored []string) ([]string, error) {
+	rows, err := db.Raw(fmt.Sprintf("SELECT * FROM %q", table)).Rows()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	skipped := map[string]bool{}
+	for _, column := range ignored {
+		skipped[column] = true
+	}
+
+	dumped := []string(nil)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for idx := range values {
+			pointers[idx] = &values[idx]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		row := map[string]interface{}{}
+		for idx, column := range columns {
+			if skipped[column] {
+				continue
+			}
+
+			// the text columns may be scanned as bytes
+			if raw, ok := values[idx].([]byte); ok {
+				row[column] = string(raw)
+			} else {
+				row[column] = values[idx]
+			}
+		}
+
+		encoded, err := json.Marshal(row)
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+		dumped = append(dumped, string(encoded))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	sort.Strings(dumped)
+
+	return dumped, nil
+}
+
+// Diff lists the rows found in only one of the dumps, prefixed by - for the ones of d and + for the ones of other
+func (d Dump) Diff(other Dump) []string {
+	tables := map[string]bool{}
+	for table := range d {
+		tables[table] = true
+	}
+	for table := range other {
+		tables[table] = true
+	}
+
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	diff := []string(nil)
+	for _, table := range names {
+		current, expected := rowSet(d[table]), rowSet(other[table])
+		for _, row := range d[table] {
+			if !expected[row] {
+				diff = append(diff, fmt.Sprintf("- %s: %s", table, row))
+			}
+		}
+		for _, row := range other[table] {
+			if !current[row] {
+				diff = append(diff, fmt.Sprintf("+ %s: %s", table, row))
+			}
+		}
+	}
+
+	return diff
+}
+
+func rowSet(rows []string) map[string]bool {
+	set := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		set[row] = true
+	}
+
+	return set
+}
+
+// CheckGolden compares a dump to the golden snapshot stored at path, the snapshot is replaced by the dump when update
+// is set
+func CheckGolden(path string, dump Dump, update bool) ([]string, error) {
+	if update {
+		encoded, err := json.MarshalIndent(dump, "", "  ")
+		if err != nil {
+			return nil, errcode.ErrSerialization.Wrap(err)
+		}
+
+		if err := ioutil.WriteFile(path, append(encoded, '\n'), 0o644); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		return nil, nil
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	golden := Dump{}
+	if err := json.Unmarshal(encoded, &golden); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return golden.Diff(dump), nil
+}
@@ -0,0 +1,77 @@
+package replaysim
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"moul.io/zapgorm2"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// maxAttempts bounds the number of replays of a run, a replay failing on a stream error is started again on the same
+// database as on the next start of a node
+const maxAttempts = 8
+
+// Result is the outcome of a run, Report is the report of its last replay
+type Result struct {
+	Report   *messengertypes.ReplayReport
+	Attempts int
+	Dump     Dump
+}
+
+var dbCounter uint64
+
+// Run replays a fixture on a new in-memory database with the faults injected, then dumps the database without the
+// columns of DefaultIgnoredColumns
+func Run(ctx context.Context, fixture *Fixture, faults Faults, logger *zap.Logger) (*Result, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	// the cache is shared by the connections of the pool, the name keeps the databases of the runs apart
+	db, err := gorm.Open(sqlite.Open(fmt.Sprintf("file:replaysim%d?mode=memory&cache=shared", atomic.AddUint64(&dbCounter, 1))), &gorm.Config{
+		Logger:                                   zapgorm2.New(logger.Named("gorm")),
+		DisableForeignKeyConstraintWhenMigrating: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	client := newFaultyClient(fixture, faults)
+
+	pipeline, err := bertymessenger.NewEventPipeline(ctx, db, client, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := bertymessenger.ReplayOptions{HandlerHook: client.handlerHook}
+	for attempt := 1; ; attempt++ {
+		report, err := pipeline.ReplayWithOptions(ctx, opts)
+		if err != nil {
+			if attempt < maxAttempts {
+				logger.Debug("replay failed, starting it again", zap.Int("attempt", attempt), zap.Error(err))
+				continue
+			}
+
+			return nil, err
+		}
+
+		dump, err := DumpDB(db, DefaultIgnoredColumns)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Result{Report: report, Attempts: attempt, Dump: dump}, nil
+	}
+}
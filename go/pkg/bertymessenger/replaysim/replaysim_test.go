@@ -0,0 +1,121 @@
+package replaysim
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/bertymessenger/bench"
+)
+
+func testFixture(t *testing.T) *Fixture {
+	t.Helper()
+
+	logs, err := bench.Generate(bench.Config{Groups: 2, MembersPerGroup: 2, MessagesPerGroup: 5, PayloadSize: 16, Seed: 1})
+	require.NoError(t, err)
+
+	return FixtureFromLogs(logs)
+}
+
+func TestFixtureRoundTrip(t *testing.T) {
+	fixture := testFixture(t)
+	require.Len(t, fixture.Groups, 3)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, fixture.Write(buf))
+
+	loaded, err := LoadFixture(buf)
+	require.NoError(t, err)
+	require.Equal(t, fixture.AccountGroupPK, loaded.AccountGroupPK)
+	require.Len(t, loaded.Groups, 3)
+	require.Equal(t, len(fixture.Groups[1].Messages), len(loaded.Groups[1].Messages))
+
+	without := fixture.Without(fixture.Groups[1].Messages[0].EventContext.ID)
+	require.Len(t, without.Groups[1].Messages, len(fixture.Groups[1].Messages)-1)
+	require.Len(t, fixture.Groups[1].Messages, 5)
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	fixture := testFixture(t)
+
+	clean, err := Run(ctx, fixture, Faults{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, clean.Attempts)
+	require.Zero(t, clean.Report.FailedEvents)
+	require.NotEmpty(t, clean.Dump["interactions"])
+
+	// the duplicates are dropped
+	duplicated, err := Run(ctx, fixture, Faults{DuplicateEvery: 2}, nil)
+	require.NoError(t, err)
+	require.Empty(t, clean.Dump.Diff(duplicated.Dump))
+
+	// the replays interrupted by the stream errors are started again and converge
+	groupPK := string(fixture.Groups[1].GroupPK)
+	interrupted, err := Run(ctx, fixture, Faults{
+		MetadataStreamErrors: map[string]int{groupPK: 1},
+		MessageStreamErrors:  map[string]int{groupPK: 2},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, interrupted.Attempts)
+	require.Empty(t, clean.Dump.Diff(interrupted.Dump))
+
+	// a panicking handler only skips its event
+	panicked := fixture.Groups[1].Messages[0].EventContext.ID
+	withPanic, err := Run(ctx, fixture, Faults{PanicEvents: map[string]bool{string(panicked): true}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), withPanic.Report.FailedEvents)
+
+	skipped, err := Run(ctx, fixture.Without(panicked), Faults{}, nil)
+	require.NoError(t, err)
+	require.Empty(t, skipped.Dump.Diff(withPanic.Dump))
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	c := newFaultyClient(&Fixture{}, Faults{ReorderWindow: 3, Seed: 42})
+
+	order := c.deliveryOrder(7)
+	require.Equal(t, order, c.deliveryOrder(7))
+
+	// the events are only shuffled within their window
+	for pos, idx := range order {
+		require.Equal(t, pos/3, idx/3)
+	}
+
+	sorted := append([]int(nil), order...)
+	sort.Ints(sorted)
+	require.Equal(t, []int{0, 1, 2, 3, 4, 5, 6}, sorted)
+
+	c = newFaultyClient(&Fixture{}, Faults{DuplicateEvery: 2})
+	require.Equal(t, []int{0, 1, 1, 2, 3, 3, 4}, c.deliveryOrder(5))
+}
+
+func TestCheckGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysim")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "golden.json")
+	dump := Dump{"conversations": {`{"public_key":"conv_1"}`}}
+
+	diff, err := CheckGolden(path, dump, true)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+
+	diff, err = CheckGolden(path, dump, false)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+
+	diff, err = CheckGolden(path, Dump{"conversations": {`{"public_key":"conv_2"}`}}, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		`- conversations: {"public_key":"conv_1"}`,
+		`+ conversations: {"public_key":"conv_2"}`,
+	}, diff)
+}
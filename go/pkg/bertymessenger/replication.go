@@ -0,0 +1,239 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The replication services distribute the logs of the conversations while the members are offline, the heads of their
+// logs are compared with the local messages to know up to which message a conversation is replicated.
+
+const (
+	defaultReplicationStaleAfter = 24 * time.Hour
+	replicationCheckInterval     = time.Hour
+)
+
+// replicationTokens returns the usable replication service tokens of the account by authentication url, the most
+// recently added one of an url
+func (svc *service) replicationTokens() (map[string]*messengertypes.ServiceToken, error) {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	now := timestampMs(time.Now())
+	tokens := map[string]*messengertypes.ServiceToken{}
+	for _, t := range acc.GetServiceTokens() {
+		if t.GetServiceType() != bertyprotocol.ServiceReplicationID || !isServiceTokenUsable(t, now) {
+			continue
+		}
+
+		if known, ok := tokens[t.GetAuthenticationURL()]; !ok || known.GetAddedDate() <= t.GetAddedDate() {
+			tokens[t.GetAuthenticationURL()] = t
+		}
+	}
+
+	return tokens, nil
+}
+
+func (svc *service) ConversationReplicate(ctx context.Context, req *messengertypes.ConversationReplicate_Request) (*messengertypes.ConversationReplicate_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if _, err := svc.db.getConversationByPK(req.GetConversationPublicKey()); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	tokenIDs := req.GetTokenIDs()
+	if len(tokenIDs) == 0 {
+		tokens, err := svc.replicationTokens()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range tokens {
+			tokenIDs = append(tokenIDs, t.GetTokenID())
+		}
+	}
+
+	if len(tokenIDs) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no replication service available"))
+	}
+
+	// the conversation is registered on as many services as possible, a failing service doesn't stop the others
+	var errs error
+	for _, tokenID := range tokenIDs {
+		if _, err := svc.ReplicationServiceRegisterGroup(ctx, &messengertypes.ReplicationServiceRegisterGroup_Request{
+			TokenID:               tokenID,
+			ConversationPublicKey: req.GetConversationPublicKey(),
+		}); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+
+	if errs != nil {
+		return nil, errcode.ErrServiceReplicationServer.Wrap(errs)
+	}
+
+	return &messengertypes.ConversationReplicate_Reply{}, nil
+}
+
+func (svc *service) ConversationReplicationCheck(ctx context.Context, req *messengertypes.ConversationReplicationCheck_Request) (*messengertypes.ConversationReplicationCheck_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	conv, err := svc.checkConversationReplication(ctx, req.GetConversationPublicKey(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ConversationReplicationCheck_Reply{Conversation: conv}, nil
+}
+
+func (svc *service) monitorReplication(ctx context.Context) {
+	ticker := time.NewTicker(replicationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		svc.checkReplicationTokens(ctx, time.Now())
+
+		pks, err := svc.db.getReplicatedConversationsPKs()
+		if err != nil {
+			svc.logger.Error("unable to list the replicated conversations", zap.Error(err))
+			continue
+		}
+
+		for _, pk := range pks {
+			if _, err := svc.checkConversationReplication(ctx, pk, time.Now()); err != nil {
+				svc.logger.Warn("unable to check the replication of the conversation", logGroup(pk), zap.Error(err))
+			}
+		}
+	}
+}
+
+// checkConversationReplication asks the heads of the conversation to the replication services reachable with the
+// tokens of the account, the services registered by the other members are only known by their last seen head
+func (svc *service) checkConversationReplication(ctx context.Context, convPK string, now time.Time) (*messengertypes.Conversation, error) {
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if len(conv.GetReplicationInfo()) == 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the conversation is not replicated"))
+	}
+
+	gpk, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	tokens, err := svc.replicationTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	heads := map[string][]string{}
+	for _, info := range conv.GetReplicationInfo() {
+		token, ok := tokens[info.GetAuthenticationURL()]
+		if !ok {
+			continue
+		}
+
+		reply, err := svc.protocolClient.ReplicationServiceGroupStatus(ctx, &protocoltypes.ReplicationServiceGroupStatus_Request{
+			TokenID: token.GetTokenID(),
+			GroupPK: gpk,
+		})
+		if err != nil {
+			svc.logger.Warn("unable to retrieve the heads of the replication service", logGroup(convPK), zap.String("server", info.GetReplicationServer()), zap.Error(err))
+			continue
+		}
+
+		heads[info.GetCID()] = reply.GetMessageHeads()
+	}
+
+	defer svc.writer.enter()()
+
+	return svc.updateConversationReplication(convPK, heads, now)
+}
+
+// updateConversationReplication records the heads of the replication services of a conversation by replication info
+// cid, the conversation is stale when a message was sent more than replicationStaleAfter before now and none of the
+// services has it
+func (svc *service) updateConversationReplication(convPK string, heads map[string][]string, now time.Time) (*messengertypes.Conversation, error) {
+	for infoCID, cids := range heads {
+		head, err := svc.db.getLatestInteractionAmongCIDs(convPK, cids)
+		if err != nil {
+			return nil, err
+		}
+
+		if head == nil {
+			continue
+		}
+
+		if _, err := svc.db.setReplicationInfoLastSeenHead(infoCID, head.GetCID(), head.GetSentDate()); err != nil {
+			return nil, err
+		}
+	}
+
+	conv, err := svc.db.getConversationByPK(convPK)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	lastReplicatedDate := int64(0)
+	for _, info := range conv.GetReplicationInfo() {
+		if info.GetLastSeenHeadDate() > lastReplicatedDate {
+			lastReplicatedDate = info.GetLastSeenHeadDate()
+		}
+	}
+
+	unreplicated, err := svc.db.getOldestInteractionSentAfter(convPK, lastReplicatedDate)
+	if err != nil {
+		return nil, err
+	}
+
+	wasStale := conv.GetIsReplicationStale()
+	isStale := unreplicated != nil && timestampMs(now)-unreplicated.GetSentDate() > svc.replicationStaleAfter.Milliseconds()
+
+	conv, updated, err := svc.db.setConversationReplicationState(convPK, lastReplicatedDate, isStale)
+	if err != nil {
+		return nil, err
+	}
+
+	if !updated {
+		return conv, nil
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		svc.logger.Error("unable to dispatch notification for conversation", logGroup(convPK), zap.Error(err))
+	}
+
+	// the alert is sent once, until a replication service catches up
+	if isStale && !wasStale {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationReplicationStale, &messengertypes.StreamEvent_ConversationReplicationStale{Conversation: conv}, false); err != nil {
+			svc.logger.Error("unable to dispatch the stale replication alert", logGroup(convPK), zap.Error(err))
+		}
+
+		svc.addSystemNotice(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeReplicationLagging, ConversationPublicKey: convPK, Lag: timestampMs(now) - unreplicated.GetSentDate()})
+	}
+
+	return conv, nil
+}
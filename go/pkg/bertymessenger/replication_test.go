@@ -0,0 +1,70 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_updateConversationReplication(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), replicationStaleAfter: 30 * time.Minute}
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType}).Error)
+	require.NoError(t, db.saveConversationReplicationInfo(messengertypes.ConversationReplicationInfo{CID: "info_1", ConversationPublicKey: "conv_1", AuthenticationURL: "https://auth_1"}))
+	require.NoError(t, db.saveConversationReplicationInfo(messengertypes.ConversationReplicationInfo{CID: "info_2", ConversationPublicKey: "conv_1", AuthenticationURL: "https://auth_2"}))
+
+	now := time.Now()
+	for idx, cid := range []string{"cid_1", "cid_2", "cid_3"} {
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{
+			CID:                   cid,
+			Type:                  messengertypes.AppMessage_TypeUserMessage,
+			ConversationPublicKey: "conv_1",
+			SentDate:              timestampMs(now.Add(time.Duration(idx-3) * time.Hour)),
+		}).Error)
+	}
+	// the local interactions are not replicated
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_local", Type: messengertypes.AppMessage_TypeSystemEvent, ConversationPublicKey: "conv_1", SentDate: timestampMs(now)}).Error)
+
+	// the first service has an old message, the second one heads unknown locally
+	conv, err := svc.updateConversationReplication("conv_1", map[string][]string{"info_1": {"cid_1", "unknown"}, "info_2": {"unknown"}}, now)
+	require.NoError(t, err)
+	require.Equal(t, timestampMs(now.Add(-3*time.Hour)), conv.GetLastReplicatedDate())
+	require.True(t, conv.GetIsReplicationStale())
+
+	// the unknown heads don't replace the last seen one
+	conv, err = svc.updateConversationReplication("conv_1", map[string][]string{"info_1": {"unknown"}, "info_2": {"cid_2"}}, now)
+	require.NoError(t, err)
+	require.Equal(t, timestampMs(now.Add(-2*time.Hour)), conv.GetLastReplicatedDate())
+	require.True(t, conv.GetIsReplicationStale())
+
+	conv, err = svc.updateConversationReplication("conv_1", map[string][]string{"info_1": {"cid_2"}}, now)
+	require.NoError(t, err)
+	require.True(t, conv.GetIsReplicationStale())
+
+	// an older head doesn't replace the last seen one, and the last message was sent less than the stale delay ago
+	conv, err = svc.updateConversationReplication("conv_1", map[string][]string{"info_1": {"cid_1"}, "info_2": {"cid_2", "cid_1"}}, now.Add(-45*time.Minute))
+	require.NoError(t, err)
+	require.False(t, conv.GetIsReplicationStale())
+
+	conv, err = svc.updateConversationReplication("conv_1", map[string][]string{"info_1": {"cid_3"}}, now)
+	require.NoError(t, err)
+	require.Equal(t, timestampMs(now.Add(-time.Hour)), conv.GetLastReplicatedDate())
+	require.False(t, conv.GetIsReplicationStale())
+
+	infos := []*messengertypes.ConversationReplicationInfo(nil)
+	require.NoError(t, db.db.Order("cid").Find(&infos).Error)
+	require.Len(t, infos, 2)
+	require.Equal(t, "cid_3", infos[0].GetLastSeenHead())
+	require.Equal(t, "cid_2", infos[1].GetLastSeenHead())
+
+	pks, err := db.getReplicatedConversationsPKs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"conv_1"}, pks)
+}
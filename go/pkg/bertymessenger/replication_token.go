@@ -0,0 +1,238 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The replication tokens are issued by the authentication flow of a replication service and added to the account by
+// the protocol, the messenger follows their lifecycle. The renewal of a token is started before its expiration, the
+// flow needs the user so a system notice gives the url to complete it. A token added for an authentication url replaces
+// the older ones of the url once the replicated conversations are registered with it. The expired and revoked tokens
+// aren't used anymore, the protocol has no removal of a token yet so a token is revoked locally.
+
+const (
+	defaultReplicationTokenRenewBefore = 7 * 24 * time.Hour
+	// replicationTokenWarnInterval is the delay between the notices about a token not renewed yet
+	replicationTokenWarnInterval = 24 * time.Hour
+)
+
+// isServiceTokenUsable tells if a token can be used to register a conversation at the date now, in ms
+func isServiceTokenUsable(t *messengertypes.ServiceToken, now int64) bool {
+	switch t.GetState() {
+	case messengertypes.ServiceToken_StateActive, messengertypes.ServiceToken_StateExpiring:
+		return t.GetExpiration() <= 0 || now < t.GetExpiration()
+	default:
+		return false
+	}
+}
+
+func replicationTokenNotice(noticeType messengertypes.AppMessage_SystemNotice_Type, t *messengertypes.ServiceToken) *messengertypes.AppMessage_SystemNotice {
+	return &messengertypes.AppMessage_SystemNotice{
+		Type:              noticeType,
+		TokenID:           t.GetTokenID(),
+		AuthenticationURL: t.GetAuthenticationURL(),
+		RenewalURL:        t.GetRenewalURL(),
+		Expiration:        t.GetExpiration(),
+	}
+}
+
+// checkReplicationTokens updates the state of the replication tokens reaching their expiration
+func (svc *service) checkReplicationTokens(ctx context.Context, now time.Time) {
+	tokens, err := svc.db.getReplicationServiceTokens()
+	if err != nil {
+		svc.logger.Error("unable to list the replication tokens", zap.Error(err))
+		return
+	}
+
+	for _, t := range tokens {
+		if err := svc.checkReplicationToken(ctx, t, now); err != nil {
+			svc.logger.Warn("unable to check the replication token", zap.String("token-id", t.GetTokenID()), zap.Error(err))
+		}
+	}
+}
+
+func (svc *service) checkReplicationToken(ctx context.Context, t *messengertypes.ServiceToken, now time.Time) error {
+	date := timestampMs(now)
+	state := t.GetState()
+	if t.GetExpiration() <= 0 || (state != messengertypes.ServiceToken_StateActive && state != messengertypes.ServiceToken_StateExpiring) {
+		return nil
+	}
+
+	var values map[string]interface{}
+	var noticeType messengertypes.AppMessage_SystemNotice_Type
+	switch {
+	case date >= t.GetExpiration():
+		values = map[string]interface{}{"state": messengertypes.ServiceToken_StateExpired, "warned_date": date}
+		noticeType = messengertypes.AppMessage_SystemNotice_TypeReplicationTokenExpired
+
+	case state == messengertypes.ServiceToken_StateActive && t.GetExpiration()-date <= svc.replicationTokenRenew.Milliseconds():
+		// the renewal is started once, the notices sent again afterwards give the same url
+		values = map[string]interface{}{"state": messengertypes.ServiceToken_StateExpiring, "warned_date": date}
+		if renewalURL, err := svc.startReplicationTokenRenewal(ctx, t); err != nil {
+			svc.logger.Warn("unable to start the renewal of the replication token", zap.String("token-id", t.GetTokenID()), zap.Error(err))
+		} else {
+			values["renewal_url"] = renewalURL
+		}
+		noticeType = messengertypes.AppMessage_SystemNotice_TypeReplicationTokenExpiring
+
+	case state == messengertypes.ServiceToken_StateExpiring && date-t.GetWarnedDate() >= replicationTokenWarnInterval.Milliseconds():
+		values = map[string]interface{}{"warned_date": date}
+		noticeType = messengertypes.AppMessage_SystemNotice_TypeReplicationTokenExpiring
+
+	default:
+		return nil
+	}
+
+	t, err := svc.db.updateServiceToken(t.GetTokenID(), values)
+	if err != nil {
+		return err
+	}
+
+	svc.dispatchReplicationTokenUpdate()
+	svc.addSystemNotice(replicationTokenNotice(noticeType, t))
+
+	return nil
+}
+
+// startReplicationTokenRenewal starts the authentication flow of the service of a token and returns the url the user
+// has to open to complete it
+func (svc *service) startReplicationTokenRenewal(ctx context.Context, t *messengertypes.ServiceToken) (string, error) {
+	if svc.protocolClient == nil {
+		return "", errcode.ErrServiceReplication.Wrap(fmt.Errorf("no protocol client"))
+	}
+
+	reply, err := svc.protocolClient.AuthServiceInitFlow(ctx, &protocoltypes.AuthServiceInitFlow_Request{AuthURL: t.GetAuthenticationURL()})
+	if err != nil {
+		return "", err
+	}
+
+	return reply.GetURL(), nil
+}
+
+// dispatchReplicationTokenUpdate sends the account, the tokens being a part of it
+func (svc *service) dispatchReplicationTokenUpdate() {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		svc.logger.Error("unable to get the account", zap.Error(err))
+		return
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{Account: acc}, false); err != nil {
+		svc.logger.Error("unable to dispatch the account", zap.Error(err))
+	}
+}
+
+// replicateWithRenewedToken registers the conversations replicated on the services of an authentication url with the
+// token replacing the previous ones
+func (svc *service) replicateWithRenewedToken(ctx context.Context, tokenID string, authURL string) {
+	pks, err := svc.db.getConversationsPKsReplicatedOn(authURL)
+	if err != nil {
+		svc.logger.Error("unable to list the replicated conversations", zap.String("authentication-url", authURL), zap.Error(err))
+		return
+	}
+
+	for _, pk := range pks {
+		if _, err := svc.ReplicationServiceRegisterGroup(ctx, &messengertypes.ReplicationServiceRegisterGroup_Request{
+			TokenID:               tokenID,
+			ConversationPublicKey: pk,
+		}); err != nil {
+			svc.logger.Warn("unable to register the conversation with the renewed token", logGroup(pk), zap.String("token-id", tokenID), zap.Error(err))
+		}
+	}
+}
+
+func (svc *service) ReplicationTokenList(ctx context.Context, req *messengertypes.ReplicationTokenList_Request) (*messengertypes.ReplicationTokenList_Reply, error) {
+	tokens, err := svc.db.getReplicationServiceTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ReplicationTokenList_Reply{Tokens: tokens}, nil
+}
+
+func (svc *service) ReplicationTokenIssue(ctx context.Context, req *messengertypes.ReplicationTokenIssue_Request) (*messengertypes.ReplicationTokenIssue_Reply, error) {
+	if req.GetAuthURL() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	reply, err := svc.protocolClient.AuthServiceInitFlow(ctx, &protocoltypes.AuthServiceInitFlow_Request{AuthURL: req.GetAuthURL()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ReplicationTokenIssue_Reply{URL: reply.GetURL(), SecureURL: reply.GetSecureURL()}, nil
+}
+
+func (svc *service) ReplicationTokenRenew(ctx context.Context, req *messengertypes.ReplicationTokenRenew_Request) (*messengertypes.ReplicationTokenRenew_Reply, error) {
+	if req.GetTokenID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	t, err := svc.db.getReplicationServiceToken(req.GetTokenID())
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	switch t.GetState() {
+	case messengertypes.ServiceToken_StateRevoked, messengertypes.ServiceToken_StateRenewed:
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the token is %s", t.GetState()))
+	}
+
+	reply, err := svc.protocolClient.AuthServiceInitFlow(ctx, &protocoltypes.AuthServiceInitFlow_Request{AuthURL: t.GetAuthenticationURL()})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := svc.db.updateServiceToken(t.GetTokenID(), map[string]interface{}{"renewal_url": reply.GetURL()}); err != nil {
+		return nil, err
+	}
+
+	svc.dispatchReplicationTokenUpdate()
+
+	return &messengertypes.ReplicationTokenRenew_Reply{URL: reply.GetURL(), SecureURL: reply.GetSecureURL()}, nil
+}
+
+func (svc *service) ReplicationTokenRevoke(ctx context.Context, req *messengertypes.ReplicationTokenRevoke_Request) (*messengertypes.ReplicationTokenRevoke_Reply, error) {
+	if req.GetTokenID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	t, err := svc.revokeReplicationToken(req.GetTokenID(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.ReplicationTokenRevoke_Reply{Token: t}, nil
+}
+
+// revokeReplicationToken stops the use of a token, on request or when it is removed from the account
+func (svc *service) revokeReplicationToken(tokenID string, now time.Time) (*messengertypes.ServiceToken, error) {
+	t, err := svc.db.getReplicationServiceToken(tokenID)
+	if err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	if t.GetState() == messengertypes.ServiceToken_StateRevoked {
+		return t, nil
+	}
+
+	t, err = svc.db.updateServiceToken(tokenID, map[string]interface{}{"state": messengertypes.ServiceToken_StateRevoked, "revoked_date": timestampMs(now)})
+	if err != nil {
+		return nil, err
+	}
+
+	svc.dispatchReplicationTokenUpdate()
+	svc.addSystemNotice(replicationTokenNotice(messengertypes.AppMessage_SystemNotice_TypeReplicationTokenRevoked, t))
+
+	return t, nil
+}
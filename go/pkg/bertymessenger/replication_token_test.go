@@ -0,0 +1,114 @@
+package bertymessenger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/bertyprotocol"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_isServiceTokenUsable(t *testing.T) {
+	require.True(t, isServiceTokenUsable(&messengertypes.ServiceToken{Expiration: -1}, 1000))
+	require.True(t, isServiceTokenUsable(&messengertypes.ServiceToken{State: messengertypes.ServiceToken_StateExpiring, Expiration: 2000}, 1000))
+	require.False(t, isServiceTokenUsable(&messengertypes.ServiceToken{Expiration: 1000}, 1000))
+	require.False(t, isServiceTokenUsable(&messengertypes.ServiceToken{State: messengertypes.ServiceToken_StateRevoked}, 1000))
+	require.False(t, isServiceTokenUsable(&messengertypes.ServiceToken{State: messengertypes.ServiceToken_StateRenewed}, 1000))
+}
+
+func TestReplicationTokenReplace(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, token := range []*messengertypes.ServiceToken{
+		{AccountPK: "acc_1", TokenID: "tok_1", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url1/", AddedDate: 10},
+		{AccountPK: "acc_1", TokenID: "tok_1", ServiceType: "srv_other", AuthenticationURL: "https://url1/", AddedDate: 10},
+		{AccountPK: "acc_1", TokenID: "tok_2", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url2/", AddedDate: 10},
+		{AccountPK: "acc_1", TokenID: "tok_3", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url1/"},
+	} {
+		require.NoError(t, db.db.Create(token).Error)
+	}
+
+	replaced, err := db.replaceReplicationTokens("tok_3", "https://url1/", 20)
+	require.NoError(t, err)
+	require.Len(t, replaced, 1)
+	require.Equal(t, "tok_1", replaced[0].GetTokenID())
+
+	// all the services of the replaced token are retired
+	others := []*messengertypes.ServiceToken(nil)
+	require.NoError(t, db.db.Where(&messengertypes.ServiceToken{TokenID: "tok_1"}).Find(&others).Error)
+	require.Len(t, others, 2)
+	for _, token := range others {
+		require.Equal(t, messengertypes.ServiceToken_StateRenewed, token.GetState())
+		require.Equal(t, "tok_3", token.GetRenewedByTokenID())
+	}
+
+	tokens, err := db.getReplicationServiceTokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 3)
+	require.Equal(t, "tok_3", tokens[2].GetTokenID())
+	require.Equal(t, int64(20), tokens[2].GetAddedDate())
+
+	// the replay of the token keeps its date and replaces nothing
+	replaced, err = db.replaceReplicationTokens("tok_3", "https://url1/", 30)
+	require.NoError(t, err)
+	require.Empty(t, replaced)
+
+	token, err := db.getReplicationServiceToken("tok_3")
+	require.NoError(t, err)
+	require.Equal(t, int64(20), token.GetAddedDate())
+
+	_, err = db.updateServiceToken("tok_unknown", map[string]interface{}{"state": messengertypes.ServiceToken_StateRevoked})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+}
+
+func TestReplicationTokenLifecycle(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	now := time.Now()
+	expired := timestampMs(now.Add(-time.Minute))
+	for _, token := range []*messengertypes.ServiceToken{
+		{AccountPK: "acc_1", TokenID: "tok_1", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url1/", Expiration: expired},
+		{AccountPK: "acc_1", TokenID: "tok_2", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url2/", Expiration: -1},
+		{AccountPK: "acc_1", TokenID: "tok_3", ServiceType: bertyprotocol.ServiceReplicationID, AuthenticationURL: "https://url3/", Expiration: timestampMs(now.Add(time.Hour)), State: messengertypes.ServiceToken_StateExpiring, WarnedDate: timestampMs(now.Add(-time.Hour))},
+	} {
+		require.NoError(t, db.db.Create(token).Error)
+	}
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher(), replicationTokenRenew: defaultReplicationTokenRenewBefore}
+	svc.checkReplicationTokens(ctx, now)
+
+	list, err := svc.ReplicationTokenList(ctx, &messengertypes.ReplicationTokenList_Request{})
+	require.NoError(t, err)
+	require.Len(t, list.GetTokens(), 3)
+
+	states := map[string]*messengertypes.ServiceToken{}
+	for _, token := range list.GetTokens() {
+		states[token.GetTokenID()] = token
+	}
+
+	require.Equal(t, messengertypes.ServiceToken_StateExpired, states["tok_1"].GetState())
+	require.Equal(t, messengertypes.ServiceToken_StateActive, states["tok_2"].GetState())
+
+	// an expiring token is warned again once a day at most
+	require.Equal(t, messengertypes.ServiceToken_StateExpiring, states["tok_3"].GetState())
+	require.Equal(t, timestampMs(now.Add(-time.Hour)), states["tok_3"].GetWarnedDate())
+
+	revoked, err := svc.ReplicationTokenRevoke(ctx, &messengertypes.ReplicationTokenRevoke_Request{TokenID: "tok_2"})
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.ServiceToken_StateRevoked, revoked.GetToken().GetState())
+	require.NotZero(t, revoked.GetToken().GetRevokedDate())
+
+	_, err = svc.ReplicationTokenRevoke(ctx, &messengertypes.ReplicationTokenRevoke_Request{TokenID: "tok_unknown"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	_, err = svc.ReplicationTokenRenew(ctx, &messengertypes.ReplicationTokenRenew_Request{TokenID: "tok_2"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+}
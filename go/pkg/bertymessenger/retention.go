@@ -0,0 +1,331 @@
+package bertymessenger
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	retentionPruneInterval = time.Hour
+	// retentionLoadPrunedMaxCount bounds the number of pruned messages read from the logs at once
+	retentionLoadPrunedMaxCount = 100
+)
+
+// monitorRetention prunes the storage according to the retention policy, periodically and when the policy changes
+func (svc *service) monitorRetention(ctx context.Context) {
+	ticker := time.NewTicker(retentionPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := svc.pruneStorage(ctx); err != nil {
+			svc.logger.Error("unable to prune storage", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-svc.retentionTrigger:
+		}
+	}
+}
+
+// triggerRetention runs the pruner without waiting for the next interval
+func (svc *service) triggerRetention() {
+	select {
+	case svc.retentionTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func (svc *service) pruneStorage(ctx context.Context) error {
+	removed, err := svc.pruneDatabase()
+	if err != nil {
+		return err
+	}
+
+	svc.removeAttachments(ctx, removed)
+
+	// the medias no longer referenced are collected with the same interval
+	_, err = svc.collectMediaGarbage(ctx, false, time.Now())
+	return err
+}
+
+// removeAttachments removes the content of the medias from the protocol once they are not referenced anymore
+func (svc *service) removeAttachments(ctx context.Context, medias []*messengertypes.Media) {
+	for _, media := range medias {
+		cid, err := b64DecodeBytes(media.GetCID())
+		if err != nil {
+			continue
+		}
+
+		if _, err := svc.protocolClient.AttachmentRemove(ctx, &protocoltypes.AttachmentRemove_Request{AttachmentCID: cid}); err != nil {
+			svc.logger.Warn("unable to remove attachment", zap.String("cid", media.GetCID()), zap.Error(err))
+		}
+	}
+}
+
+// pruneDatabase removes the messages and the medias exceeding the retention policy, it returns the medias received
+// whose content can be removed
+func (svc *service) pruneDatabase() ([]*messengertypes.Media, error) {
+	defer svc.writer.enter()()
+
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	removed := []*messengertypes.Media(nil)
+
+	// the retention of a conversation can apply without an account policy
+	convs, err := svc.db.getAllConversations()
+	if err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	maxMessages := effectiveRetentionMaxMessages(acc)
+	saved := int64(0)
+
+	now := timestampMs(time.Now())
+	for _, conv := range convs {
+		maxAge := effectiveRetentionMaxAge(acc.GetRetentionMaxAge(), conv)
+		if maxAge == 0 && maxMessages == 0 {
+			continue
+		}
+
+		medias, size, err := svc.pruneConversation(conv.GetPublicKey(), maxAge, maxMessages, now)
+		if err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, medias...)
+		saved += size
+	}
+
+	if acc.GetLowStorageEnabled() && saved > 0 {
+		if err := svc.db.addAccountLowStorageSavedSize(acc.GetPublicKey(), saved); err != nil {
+			return nil, err
+		}
+	}
+
+	if acc.GetRetentionMaxMediaSize() > 0 {
+		medias, err := svc.pruneMedias(acc.GetRetentionMaxMediaSize())
+		if err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, medias...)
+	}
+
+	// the chunks of the messages never completed are dropped
+	if _, err := svc.db.deleteStaleAppMessageChunks(timestampMs(time.Now().Add(-appMessageChunkMaxAge))); err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// effectiveRetentionMaxMessages returns the number of messages kept per conversation, the lowest of the account policy
+// and of the low-storage mode, 0 if none
+func effectiveRetentionMaxMessages(acc *messengertypes.Account) int64 {
+	maxMessages := acc.GetRetentionMaxMessages()
+	if !acc.GetLowStorageEnabled() {
+		return maxMessages
+	}
+
+	if n := lowStorageMaxInteractions(acc); maxMessages == 0 || n < maxMessages {
+		maxMessages = n
+	}
+
+	return maxMessages
+}
+
+// conversationRetentionMaxAge returns the retention of a conversation, the local override when set or else the one
+// suggested by the admins, 0 if none
+func conversationRetentionMaxAge(conv *messengertypes.Conversation) int64 {
+	if conv.GetLocalRetentionSet() {
+		return conv.GetLocalRetentionMaxAge()
+	}
+
+	return conv.GetRetentionMaxAge()
+}
+
+// effectiveRetentionMaxAge returns the age after which the messages of a conversation are pruned, the shortest of the
+// account policy and of the retention of the conversation
+func effectiveRetentionMaxAge(accountMaxAge int64, conv *messengertypes.Conversation) int64 {
+	maxAge := conversationRetentionMaxAge(conv)
+	if accountMaxAge > 0 && (maxAge == 0 || accountMaxAge < maxAge) {
+		maxAge = accountMaxAge
+	}
+
+	return maxAge
+}
+
+// retentionCutoff returns the date up to which the messages of a conversation are not stored, the date of its most
+// recent pruned message or the one set by the retention of the conversation, the account policy only applies through
+// the pruner
+func retentionCutoff(tx *dbWrapper, convPK string, now int64) (int64, error) {
+	conv, err := tx.getConversationRetention(convPK)
+	if err != nil || conv == nil {
+		return 0, err
+	}
+
+	cutoff := conv.GetPrunedBefore()
+	if maxAge := conversationRetentionMaxAge(conv); maxAge > 0 && now-maxAge > cutoff {
+		cutoff = now - maxAge
+	}
+
+	return cutoff, nil
+}
+
+// pruneConversation removes the messages of a conversation exceeding the retention, it returns the medias received
+// whose content can be removed and the size in bytes of the messages and of the downloaded medias removed
+func (svc *service) pruneConversation(convPK string, maxAge, maxMessages, now int64) ([]*messengertypes.Media, int64, error) {
+	cutoff, err := svc.db.getRetentionCutoff(convPK, maxAge, maxMessages, now)
+	if err != nil || cutoff <= 0 {
+		return nil, 0, err
+	}
+
+	size, err := svc.db.getPrunableSize(convPK, cutoff)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cids, medias, conv, err := svc.db.pruneConversationInteractions(convPK, cutoff)
+	if err != nil || len(cids) == 0 {
+		return nil, 0, err
+	}
+
+	svc.logger.Info("pruned conversation history", logGroup(convPK), zap.Int("count", len(cids)))
+
+	for _, cid := range cids {
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: cid}, false); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return nil, 0, err
+	}
+
+	return receivedMedias(medias), size, nil
+}
+
+// pruneMedias removes the oldest downloaded medias until their total size is under the limit, they stay listed and
+// can be retrieved again
+func (svc *service) pruneMedias(maxSize int64) ([]*messengertypes.Media, error) {
+	medias, err := svc.db.getDownloadedMedias()
+	if err != nil {
+		return nil, err
+	}
+
+	total := int64(0)
+	for _, media := range medias {
+		total += media.GetSize_()
+	}
+
+	removed := []*messengertypes.Media(nil)
+	for _, media := range medias {
+		if total <= maxSize {
+			break
+		}
+
+		media, updated, err := svc.db.updateMediaState(media.GetCID(), messengertypes.Media_StatePruned)
+		if err != nil {
+			return nil, errcode.ErrDBWrite.Wrap(err)
+		}
+
+		total -= media.GetSize_()
+
+		if !updated {
+			continue
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, false); err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, media)
+	}
+
+	return removed, nil
+}
+
+// receivedMedias filters out the medias sent by the account, the other members may still fetch them from this device
+func receivedMedias(medias []*messengertypes.Media) []*messengertypes.Media {
+	received := []*messengertypes.Media(nil)
+	for _, media := range medias {
+		switch media.GetState() {
+		case messengertypes.Media_StatePrepared, messengertypes.Media_StateAttached:
+		default:
+			received = append(received, media)
+		}
+	}
+
+	return received
+}
+
+// loadPrunedInteractions reads the messages of a conversation sent before a date from its message log, the most recent
+// first
+func (svc *service) loadPrunedInteractions(ctx context.Context, convPK string, before int64, count int) ([]*messengertypes.Interaction, error) {
+	gpk, err := b64DecodeBytes(convPK)
+	if err != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cl, err := svc.protocolClient.GroupMessageList(subCtx, &protocoltypes.GroupMessageList_Request{
+		GroupPK:      gpk,
+		UntilNow:     true,
+		ReverseOrder: true,
+	})
+	if err != nil {
+		return nil, errcode.ErrEventListMessage.Wrap(err)
+	}
+
+	interactions := []*messengertypes.Interaction(nil)
+	for len(interactions) < count {
+		gme, err := cl.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errcode.ErrEventListMessage.Wrap(err)
+		}
+
+		var am messengertypes.AppMessage
+		if err := proto.Unmarshal(gme.GetMessage(), &am); err != nil {
+			svc.logger.Warn("failed to unmarshal AppMessage", zap.Error(err))
+			continue
+		}
+
+		if am.GetType() != messengertypes.AppMessage_TypeUserMessage || am.GetSentDate() >= before {
+			continue
+		}
+
+		i, err := interactionFromAppMessage(svc.eventHandler, convPK, gme, &am)
+		if err != nil {
+			svc.logger.Warn("unable to read pruned message", zap.Error(err))
+			continue
+		}
+
+		if blocked, err := svc.db.isInteractionSenderBlocked(i); err != nil {
+			return nil, err
+		} else if blocked {
+			continue
+		}
+
+		interactions = append(interactions, i)
+	}
+
+	return interactions, nil
+}
@@ -0,0 +1,100 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_getRetentionCutoff(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for i := int64(1); i <= 5; i++ {
+		require.NoError(t, db.db.Create(&messengertypes.Interaction{
+			CID:                   "cid_" + string(rune('0'+i)),
+			ConversationPublicKey: "conv_1",
+			Type:                  messengertypes.AppMessage_TypeUserMessage,
+			SentDate:              i * 1000,
+		}).Error)
+	}
+
+	cutoff, err := db.getRetentionCutoff("conv_1", 0, 0, 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), cutoff)
+
+	// by age
+	cutoff, err = db.getRetentionCutoff("conv_1", 7500, 0, 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2500), cutoff)
+
+	// by count, the 2 most recent messages are kept
+	cutoff, err = db.getRetentionCutoff("conv_1", 0, 2, 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(4000), cutoff)
+
+	// the most restrictive limit is used
+	cutoff, err = db.getRetentionCutoff("conv_1", 7500, 4, 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2500), cutoff)
+
+	// less messages than the limit
+	cutoff, err = db.getRetentionCutoff("conv_1", 0, 10, 10000)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), cutoff)
+}
+
+func Test_dbWrapper_pruneConversationInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.addConversation("conv_1")
+	require.NoError(t, err)
+
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "msg_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 1000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "msg_2", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 2000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "msg_3", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 3000}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "ack_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeAcknowledge, TargetCID: "msg_1", SentDate: 1500}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "ack_3", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeAcknowledge, TargetCID: "msg_3", SentDate: 3500}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_1", InteractionCID: "msg_1", State: messengertypes.Media_StateDownloaded}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Media{CID: "media_3", InteractionCID: "msg_3", State: messengertypes.Media_StateDownloaded}).Error)
+
+	cids, medias, conv, err := db.pruneConversationInteractions("conv_1", 2500)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"msg_1", "msg_2", "ack_1"}, cids)
+	require.Len(t, medias, 1)
+	require.Equal(t, "media_1", medias[0].GetCID())
+	require.Equal(t, int64(2000), conv.GetPrunedBefore())
+
+	remaining := []string(nil)
+	require.NoError(t, db.db.Model(&messengertypes.Interaction{}).Order("cid").Pluck("cid", &remaining).Error)
+	require.Equal(t, []string{"ack_3", "msg_3"}, remaining)
+
+	remaining = nil
+	require.NoError(t, db.db.Model(&messengertypes.Media{}).Pluck("cid", &remaining).Error)
+	require.Equal(t, []string{"media_3"}, remaining)
+
+	// nothing left to prune, the date is kept
+	cids, _, _, err = db.pruneConversationInteractions("conv_1", 2500)
+	require.NoError(t, err)
+	require.Empty(t, cids)
+
+	prunedBefore, err := db.getConversationPrunedBefore("conv_1")
+	require.NoError(t, err)
+	require.Equal(t, int64(2000), prunedBefore)
+}
+
+func Test_receivedMedias(t *testing.T) {
+	medias := receivedMedias([]*messengertypes.Media{
+		{CID: "sent", State: messengertypes.Media_StateAttached},
+		{CID: "prepared", State: messengertypes.Media_StatePrepared},
+		{CID: "received", State: messengertypes.Media_StateDownloaded},
+		{CID: "pending", State: messengertypes.Media_StateNeverDownloaded},
+	})
+
+	require.Len(t, medias, 2)
+	require.Equal(t, "received", medias[0].GetCID())
+	require.Equal(t, "pending", medias[1].GetCID())
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,13 +15,17 @@ import (
 	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
 	"github.com/golang/protobuf/proto"
 	ipfs_interface "github.com/ipfs/interface-go-ipfs-core"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"moul.io/u"
 	"moul.io/zapgorm2"
 
 	"berty.tech/berty/v2/go/internal/lifecycle"
+	"berty.tech/berty/v2/go/internal/linkpreview"
 	"berty.tech/berty/v2/go/internal/notification"
 	"berty.tech/berty/v2/go/internal/streamutil"
 	"berty.tech/berty/v2/go/pkg/bertyprotocol"
@@ -32,6 +37,7 @@ import (
 
 type Service interface {
 	messengertypes.MessengerServiceServer
+	AuthorizeMethod(ctx context.Context, fullMethod string, required bool) error
 	Close()
 }
 
@@ -48,10 +54,55 @@ type service struct {
 	cancelFn              func()
 	optsCleanup           func()
 	ctx                   context.Context
-	handlerMutex          sync.Mutex
+	// writer serializes the writes to db
+	writer                *commandQueue
 	notifmanager          notification.Manager
 	lcmanager             *lifecycle.Manager
 	eventHandler          *eventHandler
+	mediaDownloader       *mediaDownloader
+	linkPreviewFetcher    *linkpreview.Fetcher
+	presenceManager       *presenceManager
+	pushSender            PushSender
+	retentionTrigger      chan struct{}
+	botHTTPClient         *http.Client
+	matrixBridge          *matrixBridge
+	ircGateway            *ircGateway
+	eventDiagnostics      *eventDiagnostics
+	eventFailures         *eventFailureStreaks
+	antiEntropyOffset     int
+	eventTap              *eventTap
+	streamEvents          *streamEventLog
+	tracer                trace.Tracer
+	deliveryLatencies     *deliveryLatencies
+	rateLimiter           *rateLimiter
+	translator            Translator
+	mediaTranscoder       MediaTranscoder
+	appMessageMaxSize     int
+	mediaGCStats          mediaGCStats
+	maintenanceOpts       MaintenanceOpts
+	maintenanceStats      maintenanceStats
+	startupCheck          startupCheckStatus
+	isOnline              func() bool
+	eventDedup            *eventDedupCache
+	validationStats       *appMessageValidationStats
+	mediaUploads          mediaUploadLocks
+	accountDataExportsMu  sync.Mutex
+	connectionHints       *messengertypes.ConnectionHints
+	replicationStaleAfter time.Duration
+	replicationTokenRenew time.Duration
+	contactRequestExpiry  time.Duration
+	logLevels             logLevels
+	redactLogs            bool
+	deviceInfo            *messengertypes.DeviceInfo
+	eventStageOrder       []string
+	eventMiddlewares      map[string]EventMiddleware
+	prefetch              *prefetchCache
+	profileBroadcast      *profileBroadcaster
+	auditLog              *auditLog
+	// groupSubscriptions are the contexts of the streams of the groups by public key, they are canceled when the
+	// conversation is paused
+	groupSubscriptionsMu sync.Mutex
+	groupSubscriptions   map[string]*groupSubscription
 }
 
 type Opts struct {
@@ -61,19 +112,91 @@ type Opts struct {
 	NotificationManager notification.Manager
 	LifeCycleManager    *lifecycle.Manager
 	StateBackup         *messengertypes.LocalDatabaseState
+	// IsUnmeteredConnection reports whether the device is on an unmetered network (ie. Wi-Fi), used by the media download policies
+	IsUnmeteredConnection func() bool
+	// IsOnline reports whether the node has a network connection, the messages sent with Interact while it returns
+	// false are kept in the outbox, the node is assumed to be always online if nil
+	IsOnline func() bool
+	// LinkPreviewHTTPClient is used to fetch the link previews of sent messages, http.DefaultClient is used if nil
+	LinkPreviewHTTPClient *http.Client
+	// PushSender delivers the push payloads to the registered devices, no push is prepared if nil
+	PushSender PushSender
+	// BotHTTPClient is used to call the bot webhooks, a client with a timeout is used if nil
+	BotHTTPClient *http.Client
+	// MatrixBridge enables the relay of the linked conversations to Matrix rooms if set
+	MatrixBridge *MatrixBridgeOpts
+	// IRCGateway exposes a conversation to the IRC clients of this device if set
+	IRCGateway *IRCGatewayOpts
+	// Ephemeral keeps the database in memory, it is rebuilt from the logs on each start and lost when the service is
+	// closed, DB must not be set
+	Ephemeral bool
+	// TracerProvider exports the spans of the delivery of the messages, the global provider is used if nil
+	TracerProvider trace.Provider
+	// RateLimit protects the device from the groups flooded by a member if set
+	RateLimit *RateLimitOpts
+	// Replay bounds the messages replayed and the memory used when the database is rebuilt from the logs, the whole
+	// history is replayed if not set, the rest of the history is replayed in the background when HeadOnly is set
+	Replay ReplayOptions
+	// Translator translates the messages on the request of the user, InteractionTranslate fails if nil
+	Translator Translator
+	// MediaTranscoder re-encodes the videos prepared with MediaPrepare, the videos are sent as is if nil
+	MediaTranscoder MediaTranscoder
+	// AppMessageMaxSize is the size in bytes above which the app messages are sent in chunks, defaultAppMessageMaxSize
+	// is used if 0
+	AppMessageMaxSize int
+	// Maintenance schedules the maintenance of the database, it runs weekly at any hour if not set
+	Maintenance MaintenanceOpts
+	// StartupCheck sets the thresholds of the repair of the database decided when the messenger starts, the database
+	// is rebuilt when more than half of the groups or more than 10 groups are broken if not set
+	StartupCheck StartupCheckOpts
+	// ConnectionHints are the rendezvous points and the relays of the node, embedded in the contact links on request
+	ConnectionHints *messengertypes.ConnectionHints
+	// ReplicationStaleAfter is the delay after which a conversation is reported as stale when none of its replication
+	// services has the new messages, defaultReplicationStaleAfter is used if 0
+	ReplicationStaleAfter time.Duration
+	// MaxConsecutiveEventFailures stops the subscriptions of a group once as many of its events failed in a row,
+	// defaultMaxConsecutiveEventFailures is used if 0 and they are never stopped if it is negative
+	MaxConsecutiveEventFailures int
+	// ReplicationTokenRenewBefore is the delay before the expiration of a replication token at which its renewal is
+	// started, defaultReplicationTokenRenewBefore is used if 0
+	ReplicationTokenRenewBefore time.Duration
+	// ContactRequestExpiry is the delay after which an outgoing contact request not answered isn't sent again anymore,
+	// defaultContactRequestExpiry is used if 0
+	ContactRequestExpiry time.Duration
+	// RedactLogs replaces the fields of the logs which may carry the content of the messages or the names of the users
+	RedactLogs bool
+	// DeviceInfo describes this device in the messages it sends so they are attributed to it, ie. sent from a phone,
+	// the messages don't describe their device if nil
+	DeviceInfo *messengertypes.DeviceInfo
+	// EventMiddlewares are inserted in the chain handling the received app messages, ie. to log them for compliance,
+	// the built-in stages are named by the EventStage constants
+	EventMiddlewares []EventMiddlewareRegistration
+	// AuditLog records the processed events in an encrypted append-only file if set, ie. for the deployments which
+	// must show how the messages were handled
+	AuditLog *AuditLogOpts
 }
 
+// volatileDBCounter names the in memory databases, each service gets its own one
+var volatileDBCounter uint64
+
 func (opts *Opts) applyDefaults() (func(), error) {
 	cleanup := func() {}
 
 	if opts.Logger == nil {
 		opts.Logger = zap.NewNop()
 	}
+	if opts.Ephemeral && opts.DB != nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("an ephemeral messenger can't use an existing database"))
+	}
 	if opts.DB == nil {
-		opts.Logger.Warn("Messenger started without database, creating a volatile one in memory")
+		if !opts.Ephemeral {
+			opts.Logger.Warn("Messenger started without database, creating a volatile one in memory")
+		}
 		zapLogger := zapgorm2.New(opts.Logger.Named("gorm"))
 		zapLogger.SetAsDefault()
-		db, err := gorm.Open(sqlite.Open("file::memory:?cache=shared"), &gorm.Config{
+		// the cache is shared by the connections of the pool, the name keeps the databases of the services apart
+		name := fmt.Sprintf("file:messenger%d?mode=memory&cache=shared", atomic.AddUint64(&volatileDBCounter, 1))
+		db, err := gorm.Open(sqlite.Open(name), &gorm.Config{
 			Logger:                                   zapLogger,
 			DisableForeignKeyConstraintWhenMigrating: true,
 		})
@@ -95,6 +218,53 @@ func (opts *Opts) applyDefaults() (func(), error) {
 		opts.LifeCycleManager = lifecycle.NewManager(StateActive)
 	}
 
+	if opts.BotHTTPClient == nil {
+		opts.BotHTTPClient = &http.Client{Timeout: botWebhookTimeout}
+	}
+
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = global.TraceProvider()
+	}
+
+	if err := opts.ConnectionHints.IsValid(); err != nil {
+		return nil, err
+	}
+	if opts.AppMessageMaxSize == 0 {
+		opts.AppMessageMaxSize = defaultAppMessageMaxSize
+	} else if opts.AppMessageMaxSize < appMessageMinSize {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the app messages can't be limited to less than %d bytes", appMessageMinSize))
+	}
+
+	if opts.ReplicationStaleAfter == 0 {
+		opts.ReplicationStaleAfter = defaultReplicationStaleAfter
+	} else if opts.ReplicationStaleAfter < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the replication stale delay can't be negative"))
+	}
+
+	if opts.MaxConsecutiveEventFailures == 0 {
+		opts.MaxConsecutiveEventFailures = defaultMaxConsecutiveEventFailures
+	}
+
+	if opts.ReplicationTokenRenewBefore == 0 {
+		opts.ReplicationTokenRenewBefore = defaultReplicationTokenRenewBefore
+	} else if opts.ReplicationTokenRenewBefore < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the replication token renewal delay can't be negative"))
+	}
+
+	if opts.ContactRequestExpiry == 0 {
+		opts.ContactRequestExpiry = defaultContactRequestExpiry
+	} else if opts.ContactRequestExpiry < 0 {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the contact request expiry can't be negative"))
+	}
+
+	if err := opts.Maintenance.applyDefaults(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.StartupCheck.applyDefaults(); err != nil {
+		return nil, err
+	}
+
 	return cleanup, nil
 }
 
@@ -132,36 +302,76 @@ func RestoreFromAccountExport(ctx context.Context, reader io.Reader, coreAPI ipf
 }
 
 func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error) {
+	stageOrder, middlewares, err := orderEventMiddlewares(opts.EventMiddlewares)
+	if err != nil {
+		return nil, err
+	}
+
 	optsCleanup, err := opts.applyDefaults()
 	if err != nil {
 		return nil, errcode.TODO.Wrap(err)
 	}
-	opts.Logger = opts.Logger.Named("msg")
+	logLevels := newLogLevels()
+	opts.Logger = opts.Logger.Named(logRootName).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return newLogCore(core, logLevels, opts.RedactLogs)
+	}))
 	opts.Logger.Debug("initializing messenger", zap.String("version", bertyversion.Version))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	db := newDBWrapper(opts.DB, opts.Logger)
 
-	if opts.StateBackup != nil {
-		opts.Logger.Info("restoring db state")
+	// the startup replay is the first command of the writer, the events are handled once it is done
+	writer := newCommandQueue()
+	startupCheck := &messengertypes.SystemInfo_StartupCheck{
+		Decision: messengertypes.SystemInfo_StartupCheck_DecisionSkipped,
+		State:    messengertypes.SystemInfo_StartupCheck_StateDone,
+		Reason:   "the database has been rebuilt from the logs",
+	}
+	if err := func() error {
+		defer writer.enter()()
 
-		if err := dropAllTables(db.db); err != nil {
-			return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to drop database schema: %w", err))
+		if opts.StateBackup != nil {
+			opts.Logger.Info("restoring db state")
+
+			return replayLogsWithLocalState(ctx, client, db, opts.StateBackup, opts.Replay)
 		}
 
-		if err := db.db.AutoMigrate(getDBModels()...); err != nil {
-			return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to create database schema: %w", err))
+		if err := db.initDB(getEventsReplayerForDB(ctx, client, opts.Replay)); err != nil {
+			return errcode.TODO.Wrap(err)
 		}
 
-		if err := replayLogsToDB(ctx, client, db); err != nil {
-			return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to replay logs to database: %w", err))
+		if opts.Ephemeral {
+			// the events are stored without being notified, the ledger skips them once the groups are subscribed
+			opts.Logger.Info("rebuilding ephemeral db from the logs")
+
+			report, err := replayLogsToDB(ctx, client, db, replayFilter{window: opts.Replay})
+			if err != nil {
+				return err
+			}
+
+			logReplayReport(opts.Logger, report)
+
+			return nil
 		}
 
-		if err := restoreDatabaseLocalState(db, opts.StateBackup); err != nil {
-			return nil, errcode.ErrDBWrite.Wrap(fmt.Errorf("unable to restore database local state: %w", err))
+		if opts.StartupCheck.Disabled {
+			startupCheck.Reason = "the startup check is disabled"
+			return nil
 		}
-	} else if err := db.initDB(getEventsReplayerForDB(ctx, client)); err != nil {
-		return nil, errcode.TODO.Wrap(err)
+
+		// the database is rebuilt here when it is the decided repair, before the groups are subscribed
+		check, err := runStartupCheck(ctx, client, db, opts.StartupCheck, opts.Replay, opts.Logger)
+		if err != nil {
+			return err
+		}
+		startupCheck = check
+
+		return nil
+	}(); err != nil {
+		writer.close()
+		cancel()
+		optsCleanup()
+		return nil, err
 	}
 
 	cancel()
@@ -179,10 +389,80 @@ func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error
 		cancelFn:              cancel,
 		optsCleanup:           optsCleanup,
 		ctx:                   ctx,
-		handlerMutex:          sync.Mutex{},
+		writer:                writer,
+		pushSender:            opts.PushSender,
+		retentionTrigger:      make(chan struct{}, 1),
+		botHTTPClient:         opts.BotHTTPClient,
+		eventDiagnostics:      newEventDiagnostics(),
+		eventFailures:         newEventFailureStreaks(opts.MaxConsecutiveEventFailures),
+		eventTap:              newEventTap(eventTapBufferSize),
+		streamEvents:          newStreamEventLog(streamEventBufferSize),
+		tracer:                opts.TracerProvider.Tracer(messengerTracerName),
+		deliveryLatencies:     newDeliveryLatencies(deliveryLatencySamples),
+		translator:            opts.Translator,
+		mediaTranscoder:       opts.MediaTranscoder,
+		appMessageMaxSize:     opts.AppMessageMaxSize,
+		maintenanceOpts:       opts.Maintenance,
+		isOnline:              opts.IsOnline,
+		eventDedup:            newEventDedupCache(eventDedupCacheSize),
+		validationStats:       newAppMessageValidationStats(),
+		connectionHints:       opts.ConnectionHints,
+		replicationStaleAfter: opts.ReplicationStaleAfter,
+		replicationTokenRenew: opts.ReplicationTokenRenewBefore,
+		contactRequestExpiry:  opts.ContactRequestExpiry,
+		logLevels:             logLevels,
+		redactLogs:            opts.RedactLogs,
+		deviceInfo:            sanitizeDeviceInfo(opts.DeviceInfo),
+		eventStageOrder:       stageOrder,
+		eventMiddlewares:      middlewares,
+		prefetch:              newPrefetchCache(),
+		profileBroadcast:      newProfileBroadcaster(),
 	}
+	svc.startupCheck.set(startupCheck)
 
-	svc.eventHandler = newEventHandler(ctx, db, client, opts.Logger, &svc, false)
+	// the goroutines, the audit log and the bridges started below are stopped if the messenger fails to start
+	started := false
+	defer func() {
+		if !started {
+			svc.Close()
+		}
+	}()
+
+	if err := svc.eventDedup.warm(db); err != nil {
+		opts.Logger.Warn("unable to load the recently handled events", zap.Error(err))
+	}
+
+	if err := svc.failInterruptedLocalEchoes(); err != nil {
+		opts.Logger.Warn("unable to fail the interrupted local echoes", zap.Error(err))
+	}
+
+	if err := db.fillConversationsFallbackDisplayName(); err != nil {
+		opts.Logger.Warn("unable to compute the fallback names of the groups", zap.Error(err))
+	}
+
+	if err := db.backfillPendingContactRequests(); err != nil {
+		opts.Logger.Warn("unable to add the contact requests stored before the inbox", zap.Error(err))
+	}
+
+	if opts.RateLimit != nil {
+		svc.rateLimiter = newRateLimiter(*opts.RateLimit)
+	}
+
+	// the audit log is opened before the handler, the events are recorded from the first one
+	if opts.AuditLog != nil {
+		if err := registerAuditCallbacks(db.db); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		if svc.auditLog, err = openAuditLog(*opts.AuditLog, opts.Logger.Named("audit")); err != nil {
+			return nil, err
+		}
+	}
+
+	svc.eventHandler = newEventHandler(ctx, db, client, opts.Logger.Named(logSubsystemHandler), &svc, false)
+	svc.mediaDownloader = newMediaDownloader(&svc, opts.IsUnmeteredConnection)
+	svc.linkPreviewFetcher = &linkpreview.Fetcher{Client: opts.LinkPreviewHTTPClient}
+	svc.presenceManager = newPresenceManager()
 
 	icr, err := client.InstanceGetConfiguration(ctx, &protocoltypes.InstanceGetConfiguration_Request{})
 	if err != nil {
@@ -195,7 +475,7 @@ func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error
 		acc, err := svc.db.getAccount()
 		switch {
 		case err == gorm.ErrRecordNotFound: // account not found, create a new one
-			svc.logger.Debug("account not found, creating a new one", zap.String("pk", pkStr))
+			svc.logger.Debug("account not found, creating a new one", logGroup(pkStr))
 			ret, err := svc.internalInstanceShareableBertyID(ctx, &messengertypes.InstanceShareableBertyID_Request{})
 			if err != nil {
 				return nil, err
@@ -212,11 +492,101 @@ func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error
 		default: // account exists, and public keys match
 			// noop
 		}
+
+		// the notes to self are kept in the account conversation
+		if err := svc.db.addAccountConversation(pkStr, timestampMs(time.Now())); err != nil {
+			return nil, err
+		}
+	}
+
+	// handle the messages stored as unsupported by a previous version
+	if err := svc.eventHandler.upgradeUnsupportedInteractions(); err != nil {
+		svc.logger.Warn("unable to upgrade the unsupported interactions", zap.Error(err))
+	}
+
+	// the caches are shrunk in low-storage mode
+	if acc, err := svc.db.getAccount(); err == nil {
+		svc.prefetch.setLowStorage(acc.GetLowStorageEnabled())
 	}
 
 	// monitor messenger lifecycle
 	go svc.monitorState(ctx)
 
+	// fetch medias in background according to download policies
+	svc.mediaDownloader.start(ctx)
+
+	// resume the uploads of the large medias interrupted by the last stop
+	go svc.resumeMediaUploads(ctx)
+
+	// resume the exports of the personal data interrupted by the last stop
+	go svc.resumeAccountDataExports(ctx)
+
+	// stop live locations at expiry
+	go svc.monitorLiveLocations(ctx)
+
+	// share and receive the presence of the contacts if enabled
+	go svc.monitorPresence(ctx)
+
+	// prune the history and the medias according to the retention policy
+	go svc.monitorRetention(ctx)
+
+	// replay the events of the logs missing from the database
+	go svc.monitorAntiEntropy(ctx)
+
+	// compact the database during the idle windows
+	go svc.monitorMaintenance(ctx)
+
+	// send the scheduled announcements once their publish date is reached
+	go svc.monitorScheduledAnnouncements(ctx)
+
+	// send the batched changes of the profile of the account to its conversations
+	go svc.monitorProfileBroadcast(ctx)
+
+	// send the outbox once the node is online again
+	go svc.monitorConnectivity(ctx)
+
+	// check the replication services of the conversations and alert when they are stale
+	go svc.monitorReplication(ctx)
+
+	// replay the history left out by a head-only replay
+	if opts.Replay.HeadOnly {
+		go svc.completeHistories(ctx)
+	}
+
+	// send again the outgoing contact requests not delivered yet and expire the ones not answered
+	go svc.monitorContactRequests(ctx)
+
+	// handle the events deferred by the rate limits
+	if svc.rateLimiter != nil {
+		go svc.monitorDeferredEvents(ctx)
+	}
+
+	// relay the linked conversations to matrix if enabled
+	if opts.MatrixBridge != nil {
+		if svc.matrixBridge, err = newMatrixBridge(&svc, *opts.MatrixBridge); err != nil {
+			return nil, err
+		}
+
+		if err := svc.matrixBridge.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	// expose a conversation over irc if enabled
+	if opts.IRCGateway != nil {
+		if svc.ircGateway, err = newIRCGateway(&svc, *opts.IRCGateway); err != nil {
+			return nil, err
+		}
+
+		if err := svc.ircGateway.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the EventStream subscribers read the dispatched events from the log at their own pace
+	svc.dispatcher.Register(svc.streamEvents)
+	svc.dispatcher.Register(svc.prefetch)
+
 	// Dispatch app notifications to native manager
 	svc.dispatcher.Register(&NotifieeBundle{StreamEventImpl: func(se *messengertypes.StreamEvent) error {
 		if se.GetType() != messengertypes.StreamEvent_TypeNotified {
@@ -258,11 +628,24 @@ func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error
 			return nil, err
 		}
 		for _, cv := range convs {
+			// the paused conversations are activated once resumed
+			if cv.GetIsPaused() {
+				continue
+			}
+
 			gpkb, err := b64DecodeBytes(cv.GetPublicKey())
 			if err != nil {
 				return nil, err
 			}
 
+			// the account group is always active and its metadata is already subscribed
+			if cv.GetType() == messengertypes.Conversation_AccountType {
+				if err := svc.subscribeToMessages(gpkb); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
 			_, err = svc.protocolClient.ActivateGroup(svc.ctx, &protocoltypes.ActivateGroup_Request{GroupPK: gpkb})
 			if err != nil {
 				return nil, err
@@ -297,13 +680,23 @@ func New(client protocoltypes.ProtocolServiceClient, opts *Opts) (Service, error
 		}
 	}
 
+	// resume pending media downloads
+	go svc.mediaDownloader.enqueueNeverDownloaded()
+
+	// report the startup check and replay the groups it found broken, or the ones skipped by the last replay, once
+	// they are active
+	go svc.completeStartupCheck(ctx)
+
+	started = true
 	return &svc, nil
 }
 
 func (svc *service) subscribeToMetadata(gpkb []byte) error {
+	ctx := svc.groupContext(gpkb)
+
 	// subscribe
 	s, err := svc.protocolClient.GroupMetadataList(
-		svc.ctx,
+		ctx,
 		&protocoltypes.GroupMetadataList_Request{GroupPK: gpkb},
 	)
 	if err != nil {
@@ -317,21 +710,39 @@ func (svc *service) subscribeToMetadata(gpkb []byte) error {
 				return
 			}
 
-			svc.handlerMutex.Lock()
-			if err := svc.eventHandler.handleMetadataEvent(gme); err != nil {
-				svc.logger.Error("failed to handle protocol event", zap.Error(errcode.ErrInternal.Wrap(err)))
+			release := svc.writer.enter()
+
+			// the group has been paused while the event was waiting
+			if ctx.Err() != nil {
+				release()
+				return
+			}
+
+			err = svc.handleLiveEvent(b64EncodeBytes(gpkb), gme.GetEventContext(), gme.GetMetadata().GetEventType().String(), func() error {
+				return svc.eventHandler.handleMetadataEvent(gme)
+			})
+			release()
+
+			if errcode.Is(err, errcode.ErrEventHandlingAborted) {
+				return
 			}
-			svc.handlerMutex.Unlock()
 		}
 	}()
 	return nil
 }
 
 func (svc *service) subscribeToMessages(gpkb []byte) error {
-	ms, err := svc.protocolClient.GroupMessageList(
-		svc.ctx,
-		&protocoltypes.GroupMessageList_Request{GroupPK: gpkb},
-	)
+	req := &protocoltypes.GroupMessageList_Request{GroupPK: gpkb}
+
+	// the events older than the history cursor are not listed again, they are loaded on demand
+	if conv, err := svc.db.getConversationByPK(b64EncodeBytes(gpkb)); err == nil && conv.GetHistoryCursor() != "" {
+		if cursor, err := b64DecodeBytes(conv.GetHistoryCursor()); err == nil {
+			req.SinceID = cursor
+		}
+	}
+
+	ctx := svc.groupContext(gpkb)
+	ms, err := svc.protocolClient.GroupMessageList(ctx, req)
 	if err != nil {
 		return errcode.ErrEventListMessage.Wrap(err)
 	}
@@ -349,11 +760,26 @@ func (svc *service) subscribeToMessages(gpkb []byte) error {
 				return
 			}
 
-			svc.handlerMutex.Lock()
-			if err := svc.eventHandler.handleAppMessage(b64EncodeBytes(gpkb), gme, &am); err != nil {
-				svc.logger.Error("failed to handle app message", zap.Error(errcode.ErrInternal.Wrap(err)))
+			// the acks and the reactions of a backlog wait for the messages of the other groups
+			release := svc.writer.enterLane(appMessageCommandLane(am.GetType()))
+
+			// the group has been paused while the event was waiting
+			if ctx.Err() != nil {
+				release()
+				return
+			}
+
+			err = svc.handleLiveEvent(b64EncodeBytes(gpkb), gme.GetEventContext(), am.GetType().String(), func() error {
+				return svc.eventHandler.handleAppMessage(b64EncodeBytes(gpkb), gme, &am)
+			})
+			if err == nil {
+				svc.eventDiagnostics.messageHandled(b64EncodeBytes(gpkb), gme.GetEventContext(), time.Now())
+			}
+			release()
+
+			if errcode.Is(err, errcode.ErrEventHandlingAborted) {
+				return
 			}
-			svc.handlerMutex.Unlock()
 		}
 	}()
 	return nil
@@ -362,7 +788,7 @@ func (svc *service) subscribeToMessages(gpkb []byte) error {
 var monitorCounter uint64 = 0
 
 func (svc *service) subscribeToGroupMonitor(groupPK []byte) error {
-	cl, err := svc.protocolClient.MonitorGroup(svc.ctx, &protocoltypes.MonitorGroup_Request{
+	cl, err := svc.protocolClient.MonitorGroup(svc.groupContext(groupPK), &protocoltypes.MonitorGroup_Request{
 		GroupPK: groupPK,
 	})
 	if err != nil {
@@ -456,12 +882,17 @@ func (svc *service) attachmentPrepare(attachment io.Reader) ([]byte, error) {
 }
 
 func (svc *service) attachmentRetrieve(cid string) (*io.PipeReader, error) {
+	return svc.attachmentRetrieveFrom(svc.ctx, cid, nil)
+}
+
+// attachmentRetrieveFrom retrieves an attachment until ctx is done, providers are the peers known to hold its blocks
+func (svc *service) attachmentRetrieveFrom(ctx context.Context, cid string, providers []string) (*io.PipeReader, error) {
 	cidBytes, err := b64DecodeBytes(cid)
 	if err != nil {
 		return nil, errcode.ErrDeserialization.Wrap(err)
 	}
 
-	stream, err := svc.protocolClient.AttachmentRetrieve(svc.ctx, &protocoltypes.AttachmentRetrieve_Request{AttachmentCID: cidBytes})
+	stream, err := svc.protocolClient.AttachmentRetrieve(ctx, &protocoltypes.AttachmentRetrieve_Request{AttachmentCID: cidBytes, ProviderPeerIDs: providers})
 	if err != nil {
 		return nil, errcode.ErrAttachmentRetrieve.Wrap(err)
 	}
@@ -478,6 +909,17 @@ func (svc *service) sendAccountUserInfo(groupPK string) error {
 		return errcode.ErrDBRead.Wrap(err)
 	}
 
+	// the profile is only sent to the contacts, never to the notes to self
+	if groupPK == acc.GetPublicKey() {
+		return nil
+	}
+
+	// the observers announce their profile too, so they can be told apart from the members
+	isObserver, err := svc.db.isConversationObserved(groupPK)
+	if err != nil {
+		return err
+	}
+
 	var avatarCID string
 	var attachmentCIDs [][]byte
 	var medias []*messengertypes.Media
@@ -506,7 +948,7 @@ func (svc *service) sendAccountUserInfo(groupPK string) error {
 	am, err := messengertypes.AppMessage_TypeSetUserInfo.MarshalPayload(
 		timestampMs(time.Now()),
 		medias,
-		&messengertypes.AppMessage_SetUserInfo{DisplayName: acc.GetDisplayName(), AvatarCID: avatarCID},
+		&messengertypes.AppMessage_SetUserInfo{DisplayName: acc.GetDisplayName(), AvatarCID: avatarCID, IsObserver: isObserver, StatusText: acc.GetStatusText()},
 	)
 	if err != nil {
 		return errcode.ErrSerialization.Wrap(err)
@@ -527,5 +969,13 @@ func (svc *service) Close() {
 	svc.logger.Debug("closing service")
 	svc.dispatcher.UnregisterAll()
 	svc.cancelFn()
+	if svc.matrixBridge != nil {
+		svc.matrixBridge.close()
+	}
+	if svc.ircGateway != nil {
+		svc.ircGateway.close()
+	}
 	svc.optsCleanup()
+	svc.writer.close()
+	svc.auditLog.close()
 }
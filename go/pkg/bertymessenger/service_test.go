@@ -1731,3 +1731,27 @@ func Test_exportMessengerData(t *testing.T) {
 	require.Equal(t, "display_name", state.DisplayName)
 	require.Equal(t, true, state.ReplicateFlag)
 }
+
+func TestOptsApplyDefaultsEphemeral(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := (&Opts{Ephemeral: true, DB: db.db}).applyDefaults()
+	require.Error(t, err)
+
+	// each service gets its own volatile database
+	optsA, optsB := &Opts{Ephemeral: true}, &Opts{Ephemeral: true}
+	cleanupA, err := optsA.applyDefaults()
+	require.NoError(t, err)
+	defer cleanupA()
+
+	cleanupB, err := optsB.applyDefaults()
+	require.NoError(t, err)
+	defer cleanupB()
+
+	require.NoError(t, optsA.DB.AutoMigrate(&messengertypes.Account{}))
+	require.NoError(t, optsA.DB.Create(&messengertypes.Account{PublicKey: "account_1"}).Error)
+
+	require.True(t, optsA.DB.Migrator().HasTable(&messengertypes.Account{}))
+	require.False(t, optsB.DB.Migrator().HasTable(&messengertypes.Account{}))
+}
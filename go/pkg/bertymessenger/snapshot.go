@@ -0,0 +1,150 @@
+package bertymessenger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const dbSnapshotIDSize = 16
+
+// A snapshot is a copy of the messenger database taken without stopping the node, the writer isn't held so the events
+// keep being handled meanwhile. Each snapshot records the date of the last processed event and its parent, a restore
+// can then start from a snapshot and only replay the events processed after it.
+
+// takeDBSnapshot copies the database to a new file and records its lineage, the path isn't recorded for a streamed copy
+func (svc *service) takeDBSnapshot(ctx context.Context, path string, streamed bool) (*messengertypes.DBSnapshot, error) {
+	rawID, err := cryptoutil.GenerateNonceSize(dbSnapshotIDSize)
+	if err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	schemaVersion, err := svc.db.backend().getSchemaVersion(svc.db.db)
+	if err != nil {
+		return nil, err
+	}
+
+	// read before the copy, the events processed meanwhile are replayed again rather than missed
+	lastProcessedDate, err := svc.db.getLastProcessedDate()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &messengertypes.DBSnapshot{
+		ID:                b64EncodeBytes(rawID),
+		CreatedDate:       timestampMs(time.Now()),
+		SchemaVersion:     schemaVersion,
+		LastProcessedDate: lastProcessedDate,
+	}
+	if !streamed {
+		snapshot.Path = path
+	}
+
+	if err := svc.db.backend().snapshot(ctx, svc.db.db, path); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+
+	if snapshot.Size_, snapshot.SHA256, err = hashDBSnapshotFile(path); err != nil {
+		return nil, err
+	}
+
+	if err := svc.db.addDBSnapshot(snapshot); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Info("database snapshot taken", zap.String("id", snapshot.GetID()), zap.Int64("size", snapshot.GetSize_()))
+
+	return snapshot, nil
+}
+
+func hashDBSnapshotFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", errcode.ErrInternal.Wrap(err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", errcode.ErrInternal.Wrap(err)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (svc *service) SnapshotNow(req *messengertypes.SnapshotNow_Request, server messengertypes.MessengerService_SnapshotNowServer) error {
+	path := req.GetPath()
+	streamed := path == ""
+
+	if streamed {
+		dir, err := ioutil.TempDir("", "snapshot-")
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path = filepath.Join(dir, "messenger.sqlite")
+	} else if _, err := os.Stat(path); err == nil {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the snapshot file already exists"))
+	} else if !os.IsNotExist(err) {
+		return errcode.ErrInternal.Wrap(err)
+	}
+
+	snapshot, err := svc.takeDBSnapshot(server.Context(), path, streamed)
+	if err != nil {
+		return err
+	}
+
+	if streamed {
+		f, err := os.Open(path)
+		if err != nil {
+			return errcode.ErrInternal.Wrap(err)
+		}
+		defer f.Close()
+
+		buf := make([]byte, backupChunkSize)
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				if err := server.Send(&messengertypes.SnapshotNow_Reply{SnapshotData: append([]byte{}, buf[:n]...)}); err != nil {
+					return errcode.ErrStreamWrite.Wrap(err)
+				}
+			}
+
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return errcode.ErrInternal.Wrap(err)
+			}
+		}
+	}
+
+	if err := server.Send(&messengertypes.SnapshotNow_Reply{Snapshot: snapshot}); err != nil {
+		return errcode.ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (svc *service) SnapshotList(context.Context, *messengertypes.SnapshotList_Request) (*messengertypes.SnapshotList_Reply, error) {
+	snapshots, err := svc.db.getDBSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.SnapshotList_Reply{Snapshots: snapshots}, nil
+}
@@ -0,0 +1,60 @@
+package bertymessenger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_takeDBSnapshot(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.ProcessedEvent{CID: "cid_1", ProcessedDate: 100}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop()}
+	ctx := context.Background()
+
+	first, err := svc.takeDBSnapshot(ctx, filepath.Join(dir, "first.sqlite"), false)
+	require.NoError(t, err)
+	require.Empty(t, first.ParentID)
+	require.Equal(t, int64(100), first.LastProcessedDate)
+	require.NotZero(t, first.Size_)
+	require.NotEmpty(t, first.SHA256)
+
+	// the events are still handled after the copy
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2"}).Error)
+
+	copied, err := gorm.Open(sqlite.Open(first.Path), &gorm.Config{})
+	require.NoError(t, err)
+	convs := []*messengertypes.Conversation(nil)
+	require.NoError(t, copied.Find(&convs).Error)
+	require.Len(t, convs, 1)
+	require.Equal(t, "conv_1", convs[0].PublicKey)
+	if sqlDB, err := copied.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	second, err := svc.takeDBSnapshot(ctx, filepath.Join(dir, "second.sqlite"), true)
+	require.NoError(t, err)
+	require.Equal(t, first.ID, second.ParentID)
+	require.Empty(t, second.Path)
+
+	snapshots, err := svc.SnapshotList(ctx, &messengertypes.SnapshotList_Request{})
+	require.NoError(t, err)
+	require.Len(t, snapshots.Snapshots, 2)
+}
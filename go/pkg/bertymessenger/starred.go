@@ -0,0 +1,146 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func deviceSyncStarFromStarredInteraction(star *messengertypes.StarredInteraction) *messengertypes.AppMessage_DeviceSyncStar {
+	return &messengertypes.AppMessage_DeviceSyncStar{
+		CID:                   star.GetInteractionCID(),
+		ConversationPublicKey: star.GetConversationPublicKey(),
+		Starred:               star.GetStarred(),
+		StarredDate:           star.GetStarredDate(),
+	}
+}
+
+func (h *eventHandler) handleAppMessageDeviceSyncStar(tx *dbWrapper, i *messengertypes.Interaction, amPayload proto.Message) (*messengertypes.Interaction, bool, error) {
+	payload := amPayload.(*messengertypes.AppMessage_DeviceSyncStar)
+
+	if ok, err := h.isDeviceSyncMessage(tx, i); err != nil {
+		return nil, false, err
+	} else if !ok {
+		h.logger.Warn("ignoring device sync star sent outside of the account group", zap.String("cid", i.GetCID()))
+		return i, false, nil
+	}
+
+	if err := h.applyStarDeviceSync(tx, payload); err != nil {
+		return nil, false, err
+	}
+
+	return i, false, nil
+}
+
+// applyStarDeviceSync updates the starred state of a message, the message may not have been received by this device yet
+func (h *eventHandler) applyStarDeviceSync(tx *dbWrapper, state *messengertypes.AppMessage_DeviceSyncStar) error {
+	if state.GetCID() == "" {
+		return nil
+	}
+
+	_, err := tx.setStarredInteraction(&messengertypes.StarredInteraction{
+		InteractionCID:        state.GetCID(),
+		ConversationPublicKey: state.GetConversationPublicKey(),
+		Starred:               state.GetStarred(),
+		StarredDate:           state.GetStarredDate(),
+	})
+
+	return err
+}
+
+// setInteractionStarred changes the starred state of a message, the other devices are updated when it changed
+func (svc *service) setInteractionStarred(ctx context.Context, cid string, starred bool) error {
+	if cid == "" {
+		return errcode.ErrMissingInput
+	}
+
+	defer svc.writer.enter()()
+
+	i, err := svc.db.getInteractionByCID(cid)
+	if err != nil {
+		return errcode.ErrNotFound.Wrap(err)
+	}
+
+	if i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the user messages can be starred"))
+	}
+
+	star := &messengertypes.StarredInteraction{
+		InteractionCID:        i.GetCID(),
+		ConversationPublicKey: i.GetConversationPublicKey(),
+		Starred:               starred,
+		StarredDate:           timestampMs(time.Now()),
+	}
+
+	updated, err := svc.db.setStarredInteraction(star)
+	if err != nil {
+		return err
+	}
+
+	if updated {
+		if err := svc.sendDeviceSync(ctx, messengertypes.AppMessage_TypeDeviceSyncStar, deviceSyncStarFromStarredInteraction(star)); err != nil {
+			svc.logger.Warn("unable to sync starred message with the other devices", zap.String("cid", cid), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+func (svc *service) InteractionStar(ctx context.Context, req *messengertypes.InteractionStar_Request) (*messengertypes.InteractionStar_Reply, error) {
+	if err := svc.setInteractionStarred(ctx, req.GetCID(), true); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionStar_Reply{}, nil
+}
+
+func (svc *service) InteractionUnstar(ctx context.Context, req *messengertypes.InteractionUnstar_Request) (*messengertypes.InteractionUnstar_Reply, error) {
+	if err := svc.setInteractionStarred(ctx, req.GetCID(), false); err != nil {
+		return nil, err
+	}
+
+	return &messengertypes.InteractionUnstar_Reply{}, nil
+}
+
+func (svc *service) InteractionStarredList(ctx context.Context, req *messengertypes.InteractionStarredList_Request) (*messengertypes.InteractionStarredList_Reply, error) {
+	count := int(req.GetCount())
+	if count == 0 || count > interactionListMaxCount {
+		count = interactionListMaxCount
+	}
+
+	cursor, err := decodeStarredCursor(req.GetCursor())
+	if err != nil {
+		return nil, err
+	}
+
+	// one more interaction is read to know whether there is a next page
+	stars, err := svc.db.getStarredInteractions(cursor, count+1)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.InteractionStarredList_Reply{}
+	if len(stars) > count {
+		stars = stars[:count]
+		if reply.NextCursor, err = encodeStarredCursor(stars[count-1]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, star := range stars {
+		i, err := svc.db.getInteractionByCID(star.GetInteractionCID())
+		if err != nil {
+			return nil, errcode.ErrDBRead.Wrap(err)
+		}
+
+		reply.Interactions = append(reply.Interactions, i)
+	}
+
+	return reply, nil
+}
@@ -0,0 +1,83 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_dbWrapper_setStarredInteraction(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	_, err := db.setStarredInteraction(&messengertypes.StarredInteraction{})
+	require.Error(t, err)
+
+	updated, err := db.setStarredInteraction(&messengertypes.StarredInteraction{InteractionCID: "cid_1", Starred: true, StarredDate: 2})
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	// an older change synced from another device is ignored
+	updated, err = db.setStarredInteraction(&messengertypes.StarredInteraction{InteractionCID: "cid_1", Starred: false, StarredDate: 1})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	starred, err := db.isInteractionStarred("cid_1")
+	require.NoError(t, err)
+	require.True(t, starred)
+
+	updated, err = db.setStarredInteraction(&messengertypes.StarredInteraction{InteractionCID: "cid_1", Starred: false, StarredDate: 3})
+	require.NoError(t, err)
+	require.True(t, updated)
+
+	starred, err = db.isInteractionStarred("cid_1")
+	require.NoError(t, err)
+	require.False(t, starred)
+}
+
+func Test_dbWrapper_getStarredInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, cid := range []string{"cid_a", "cid_b", "cid_c"} {
+		db.db.Create(&messengertypes.Interaction{CID: cid, ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage})
+	}
+
+	for date, cid := range []string{"cid_a", "cid_b", "cid_c", "cid_unknown"} {
+		_, err := db.setStarredInteraction(&messengertypes.StarredInteraction{InteractionCID: cid, ConversationPublicKey: "conv_1", Starred: true, StarredDate: int64(date + 1)})
+		require.NoError(t, err)
+	}
+
+	// the messages not received yet are not listed
+	stars, err := db.getStarredInteractions(nil, 10)
+	require.NoError(t, err)
+	require.Len(t, stars, 3)
+	require.Equal(t, "cid_c", stars[0].GetInteractionCID())
+
+	stars, err = db.getStarredInteractions(&messengertypes.InteractionStarredList_Cursor{StarredDate: 3, CID: "cid_c"}, 1)
+	require.NoError(t, err)
+	require.Len(t, stars, 1)
+	require.Equal(t, "cid_b", stars[0].GetInteractionCID())
+}
+
+func Test_dbWrapper_pruneConversationInteractions_starred(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 1})
+	db.db.Create(&messengertypes.Interaction{CID: "cid_2", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, SentDate: 2})
+
+	_, err := db.setStarredInteraction(&messengertypes.StarredInteraction{InteractionCID: "cid_1", ConversationPublicKey: "conv_1", Starred: true, StarredDate: 1})
+	require.NoError(t, err)
+
+	cids, _, _, err := db.pruneConversationInteractions("conv_1", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cid_2"}, cids)
+
+	i, err := db.getInteractionByCID("cid_1")
+	require.NoError(t, err)
+	require.Equal(t, "cid_1", i.GetCID())
+}
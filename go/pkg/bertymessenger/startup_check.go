@@ -0,0 +1,281 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+// The database is checked once the migrations are applied, before the events are handled: the integrity of its
+// indexes, the ledger of the processed events, the groups skipped by the last replay and the quarantined events. The
+// schema itself is validated by the migrations, the database is rebuilt by initDB when it can't be updated in place.
+// The cheapest repair fixing the issues found is chosen, the broken groups are replayed one by one while they are few,
+// the database is rebuilt from the logs when its structure is damaged or when most of its groups are broken.
+
+const (
+	// defaultStartupMaxGroupReplays is the number of broken groups above which the database is rebuilt
+	defaultStartupMaxGroupReplays = 10
+	// defaultStartupMaxGroupReplayRatio is the share of broken groups above which the database is rebuilt
+	defaultStartupMaxGroupReplayRatio = 0.5
+)
+
+// StartupCheckOpts sets the thresholds of the repair decided by the check of the database made at startup
+type StartupCheckOpts struct {
+	// Disabled starts the messenger without checking its database
+	Disabled bool
+	// MaxGroupReplays is the number of broken groups above which the database is rebuilt from the logs instead of
+	// replaying them one by one, defaultStartupMaxGroupReplays is used if 0
+	MaxGroupReplays int
+	// MaxGroupReplayRatio is the share of the groups above which the database is rebuilt, ie. 0.5,
+	// defaultStartupMaxGroupReplayRatio is used if 0
+	MaxGroupReplayRatio float64
+	// SkipIntegrityCheck doesn't verify the pages and the indexes, the check reads the whole database file
+	SkipIntegrityCheck bool
+}
+
+func (opts *StartupCheckOpts) applyDefaults() error {
+	if opts.MaxGroupReplays == 0 {
+		opts.MaxGroupReplays = defaultStartupMaxGroupReplays
+	} else if opts.MaxGroupReplays < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the maximum number of group replays can't be negative"))
+	}
+
+	if opts.MaxGroupReplayRatio == 0 {
+		opts.MaxGroupReplayRatio = defaultStartupMaxGroupReplayRatio
+	} else if opts.MaxGroupReplayRatio < 0 || opts.MaxGroupReplayRatio > 1 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the group replay ratio must be between 0 and 1"))
+	}
+
+	return nil
+}
+
+// startupCheckStatus keeps the last state of the startup check for SystemInfo
+type startupCheckStatus struct {
+	mu    sync.Mutex
+	check *messengertypes.SystemInfo_StartupCheck
+}
+
+func (s *startupCheckStatus) set(check *messengertypes.SystemInfo_StartupCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.check = proto.Clone(check).(*messengertypes.SystemInfo_StartupCheck)
+}
+
+func (s *startupCheckStatus) snapshot() *messengertypes.SystemInfo_StartupCheck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.check == nil {
+		return nil
+	}
+
+	return proto.Clone(s.check).(*messengertypes.SystemInfo_StartupCheck)
+}
+
+// checkStartupDatabase lists the issues of the database, the active groups to replay to fix them and the number of
+// active groups
+func checkStartupDatabase(db *dbWrapper, opts StartupCheckOpts) ([]*messengertypes.DatabaseDoctor_Issue, []string, int, error) {
+	issues := []*messengertypes.DatabaseDoctor_Issue(nil)
+
+	if !opts.SkipIntegrityCheck {
+		problems, err := db.backend().checkIntegrity(db.db)
+		if err != nil {
+			// a database too damaged to be checked is rebuilt too
+			problems = []string{err.Error()}
+		}
+
+		for _, problem := range problems {
+			issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+				Kind:   messengertypes.DatabaseDoctor_KindCorruptedIndex,
+				Detail: problem,
+			})
+		}
+	}
+
+	// the other checks read the tables, the database is rebuilt anyway
+	if len(issues) > 0 {
+		return issues, nil, 0, nil
+	}
+
+	// a snapshot records the last event processed before its copy, the ledger can't be older unless events were lost
+	snapshots, err := db.getDBSnapshots()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(snapshots) > 0 {
+		lastProcessed, err := db.getLastProcessedDate()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		if checkpoint := snapshots[0].GetLastProcessedDate(); lastProcessed < checkpoint {
+			issues = append(issues, &messengertypes.DatabaseDoctor_Issue{
+				Kind:   messengertypes.DatabaseDoctor_KindCheckpointBehind,
+				Detail: fmt.Sprintf("last event processed at %d, before the one of the snapshot %s at %d", lastProcessed, snapshots[0].GetID(), checkpoint),
+			})
+
+			return issues, nil, 0, nil
+		}
+	}
+
+	broken, err := getReplaySkippedGroupIssues(db)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	quarantined, err := getQuarantineBacklogIssues(db)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	broken = append(broken, quarantined...)
+	if len(broken) == 0 {
+		return issues, nil, 0, nil
+	}
+
+	active, err := listReplayedGroups(db)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	isActive := make(map[string]bool, len(active))
+	for _, groupPK := range active {
+		isActive[groupPK] = true
+	}
+
+	groupPKs := []string(nil)
+	isBroken := map[string]bool{}
+	for _, issue := range broken {
+		// the groups of the paused conversations are replayed once resumed
+		if !isActive[issue.GetConversationPublicKey()] {
+			continue
+		}
+
+		issues = append(issues, issue)
+
+		// a group both skipped and with quarantined events is replayed once
+		if !isBroken[issue.GetConversationPublicKey()] {
+			isBroken[issue.GetConversationPublicKey()] = true
+			groupPKs = append(groupPKs, issue.GetConversationPublicKey())
+		}
+	}
+
+	return issues, groupPKs, len(active), nil
+}
+
+// decideStartupRepair chooses the cheapest repair fixing the issues, replaying a group only reads its own log while
+// rebuilding the database reads all of them
+func decideStartupRepair(issues []*messengertypes.DatabaseDoctor_Issue, groupPKs []string, activeGroups int, opts StartupCheckOpts) (messengertypes.SystemInfo_StartupCheck_Decision, string) {
+	for _, issue := range issues {
+		switch issue.GetKind() {
+		case messengertypes.DatabaseDoctor_KindCorruptedIndex,
+			messengertypes.DatabaseDoctor_KindCheckpointBehind:
+			return messengertypes.SystemInfo_StartupCheck_DecisionFullReplay, fmt.Sprintf("%s: %s", issue.GetKind(), issue.GetDetail())
+		}
+	}
+
+	switch {
+	case len(groupPKs) == 0:
+		return messengertypes.SystemInfo_StartupCheck_DecisionNone, "no issue found"
+	case len(groupPKs) > opts.MaxGroupReplays:
+		return messengertypes.SystemInfo_StartupCheck_DecisionFullReplay, fmt.Sprintf("%d broken groups, more than %d", len(groupPKs), opts.MaxGroupReplays)
+	case float64(len(groupPKs)) > opts.MaxGroupReplayRatio*float64(activeGroups):
+		return messengertypes.SystemInfo_StartupCheck_DecisionFullReplay, fmt.Sprintf("%d broken groups out of %d", len(groupPKs), activeGroups)
+	default:
+		return messengertypes.SystemInfo_StartupCheck_DecisionGroupReplay, fmt.Sprintf("%d broken groups", len(groupPKs))
+	}
+}
+
+// runStartupCheck checks the database and rebuilds it from the logs when it is the decided repair, the replays of
+// the groups are left to completeStartupCheck once they are activated
+func runStartupCheck(ctx context.Context, client protocoltypes.ProtocolServiceClient, db *dbWrapper, opts StartupCheckOpts, window ReplayOptions, logger *zap.Logger) (*messengertypes.SystemInfo_StartupCheck, error) {
+	started := time.Now()
+	check := &messengertypes.SystemInfo_StartupCheck{CheckedDate: timestampMs(started)}
+
+	issues, groupPKs, activeGroups, err := checkStartupDatabase(db, opts)
+	if err != nil {
+		// the messenger starts anyway, DatabaseDoctor lists the issues on request
+		logger.Warn("unable to check the database", zap.Error(err))
+
+		check.Decision = messengertypes.SystemInfo_StartupCheck_DecisionSkipped
+		check.State = messengertypes.SystemInfo_StartupCheck_StateDone
+		check.Error = err.Error()
+		return check, nil
+	}
+
+	check.Duration = time.Since(started).Milliseconds()
+	check.Issues = issues
+	check.Decision, check.Reason = decideStartupRepair(issues, groupPKs, activeGroups, opts)
+
+	logger.Info("database checked", zap.Int("issues", len(issues)), zap.String("decision", check.Decision.String()), zap.String("reason", check.Reason))
+
+	switch check.Decision {
+	case messengertypes.SystemInfo_StartupCheck_DecisionGroupReplay:
+		check.State = messengertypes.SystemInfo_StartupCheck_StateRepairing
+		check.ReplayedGroupPKs = groupPKs
+	case messengertypes.SystemInfo_StartupCheck_DecisionFullReplay:
+		state := keepDatabaseLocalState(db.db, logger)
+		if err := replayLogsWithLocalState(ctx, client, db, state, window); err != nil {
+			return nil, err
+		}
+
+		check.State = messengertypes.SystemInfo_StartupCheck_StateDone
+		check.RepairedDate = timestampMs(time.Now())
+	default:
+		check.State = messengertypes.SystemInfo_StartupCheck_StateDone
+	}
+
+	return check, nil
+}
+
+// completeStartupCheck dispatches the decision of the startup check and replays the groups it found broken, the
+// groups skipped by the last replay are replayed again otherwise
+func (svc *service) completeStartupCheck(ctx context.Context) {
+	check := svc.startupCheck.snapshot()
+	svc.dispatchStartupCheck(check)
+
+	if check.GetDecision() != messengertypes.SystemInfo_StartupCheck_DecisionGroupReplay {
+		svc.retryReplaySkippedGroups(ctx)
+		return
+	}
+
+	var lastErr error
+	for _, groupPK := range check.GetReplayedGroupPKs() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := svc.retryReplaySkippedGroup(ctx, groupPK); err != nil {
+			svc.logger.Warn("unable to replay a group found broken at startup", logGroup(groupPK), zap.Error(err))
+			check.FailedGroupPKs = append(check.FailedGroupPKs, groupPK)
+			lastErr = err
+		}
+	}
+
+	check.State = messengertypes.SystemInfo_StartupCheck_StateDone
+	check.RepairedDate = timestampMs(time.Now())
+	if lastErr != nil {
+		check.State = messengertypes.SystemInfo_StartupCheck_StateFailed
+		check.Error = lastErr.Error()
+	}
+
+	svc.startupCheck.set(check)
+	svc.dispatchStartupCheck(check)
+}
+
+func (svc *service) dispatchStartupCheck(check *messengertypes.SystemInfo_StartupCheck) {
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeStartupCheckUpdated, &messengertypes.StreamEvent_StartupCheckUpdated{Check: check}, false); err != nil {
+		svc.logger.Warn("unable to dispatch the startup check", zap.Error(err))
+	}
+}
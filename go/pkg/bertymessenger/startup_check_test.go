@@ -0,0 +1,105 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_checkStartupDatabase(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	opts := StartupCheckOpts{}
+	require.NoError(t, opts.applyDefaults())
+
+	issues, groupPKs, _, err := checkStartupDatabase(db, opts)
+	require.NoError(t, err)
+	require.Empty(t, issues)
+	require.Empty(t, groupPKs)
+
+	// the ledger is older than the last snapshot
+	require.NoError(t, db.db.Create(&messengertypes.DBSnapshot{ID: "snapshot_1", CreatedDate: 1, LastProcessedDate: 10}).Error)
+
+	issues, _, _, err = checkStartupDatabase(db, opts)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	require.Equal(t, messengertypes.DatabaseDoctor_KindCheckpointBehind, issues[0].GetKind())
+
+	require.NoError(t, db.markEventProcessed("cid_1", "conv_1", "hash_1", 20))
+
+	require.NoError(t, db.addAccount("account_pk", ""))
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2", IsPaused: true}).Error)
+	require.NoError(t, db.addReplaySkippedGroup(&messengertypes.ReplaySkippedGroup{GroupPK: "conv_1", Attempts: 3, Error: "failed"}))
+	// the paused conversations are replayed once resumed
+	require.NoError(t, db.addReplaySkippedGroup(&messengertypes.ReplaySkippedGroup{GroupPK: "conv_2", Attempts: 3, Error: "failed"}))
+
+	issues, groupPKs, activeGroups, err := checkStartupDatabase(db, opts)
+	require.NoError(t, err)
+	require.Len(t, issues, 1)
+	require.Equal(t, messengertypes.DatabaseDoctor_KindSkippedReplayGroup, issues[0].GetKind())
+	require.Equal(t, []string{"conv_1"}, groupPKs)
+	require.Equal(t, 2, activeGroups)
+
+	// the groups with quarantined events are replayed too, until their events failed too many times
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_3"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_4"}).Error)
+	require.NoError(t, db.addQuarantinedEvent(&messengertypes.QuarantinedEvent{CID: "cid_2", GroupPK: "conv_1", Attempts: 1, Error: "failed", LastFailedDate: 1}))
+	require.NoError(t, db.addQuarantinedEvent(&messengertypes.QuarantinedEvent{CID: "cid_3", GroupPK: "conv_3", Attempts: 1, Error: "failed", LastFailedDate: 1}))
+	require.NoError(t, db.addQuarantinedEvent(&messengertypes.QuarantinedEvent{CID: "cid_4", GroupPK: "conv_4", Attempts: quarantineMaxStartupReplays, Error: "failed", LastFailedDate: 1}))
+
+	issues, groupPKs, activeGroups, err = checkStartupDatabase(db, opts)
+	require.NoError(t, err)
+	require.Len(t, issues, 3)
+	require.Equal(t, messengertypes.DatabaseDoctor_KindQuarantinedEvents, issues[2].GetKind())
+	require.Equal(t, "cid_3", issues[2].GetCID())
+	require.Equal(t, []string{"conv_1", "conv_3"}, groupPKs)
+	require.Equal(t, 4, activeGroups)
+}
+
+func Test_decideStartupRepair(t *testing.T) {
+	opts := StartupCheckOpts{MaxGroupReplays: 2}
+	require.NoError(t, opts.applyDefaults())
+
+	skipped := func(pks ...string) []*messengertypes.DatabaseDoctor_Issue {
+		issues := []*messengertypes.DatabaseDoctor_Issue(nil)
+		for _, pk := range pks {
+			issues = append(issues, &messengertypes.DatabaseDoctor_Issue{Kind: messengertypes.DatabaseDoctor_KindSkippedReplayGroup, ConversationPublicKey: pk})
+		}
+		return issues
+	}
+
+	for _, tc := range []struct {
+		name         string
+		issues       []*messengertypes.DatabaseDoctor_Issue
+		groupPKs     []string
+		activeGroups int
+		expected     messengertypes.SystemInfo_StartupCheck_Decision
+	}{
+		{"healthy", nil, nil, 10, messengertypes.SystemInfo_StartupCheck_DecisionNone},
+		{"few broken groups", skipped("conv_1"), []string{"conv_1"}, 10, messengertypes.SystemInfo_StartupCheck_DecisionGroupReplay},
+		{"too many broken groups", skipped("conv_1", "conv_2", "conv_3"), []string{"conv_1", "conv_2", "conv_3"}, 10, messengertypes.SystemInfo_StartupCheck_DecisionFullReplay},
+		{"most groups broken", skipped("conv_1", "conv_2"), []string{"conv_1", "conv_2"}, 3, messengertypes.SystemInfo_StartupCheck_DecisionFullReplay},
+		{"corrupted index", []*messengertypes.DatabaseDoctor_Issue{{Kind: messengertypes.DatabaseDoctor_KindCorruptedIndex}}, nil, 10, messengertypes.SystemInfo_StartupCheck_DecisionFullReplay},
+		{"checkpoint behind", []*messengertypes.DatabaseDoctor_Issue{{Kind: messengertypes.DatabaseDoctor_KindCheckpointBehind}}, nil, 10, messengertypes.SystemInfo_StartupCheck_DecisionFullReplay},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decision, reason := decideStartupRepair(tc.issues, tc.groupPKs, tc.activeGroups, opts)
+			require.Equal(t, tc.expected, decision)
+			require.NotEmpty(t, reason)
+		})
+	}
+}
+
+func TestStartupCheckOpts_applyDefaults(t *testing.T) {
+	opts := StartupCheckOpts{}
+	require.NoError(t, opts.applyDefaults())
+	require.Equal(t, defaultStartupMaxGroupReplays, opts.MaxGroupReplays)
+	require.Equal(t, defaultStartupMaxGroupReplayRatio, opts.MaxGroupReplayRatio)
+
+	require.Error(t, (&StartupCheckOpts{MaxGroupReplays: -1}).applyDefaults())
+	require.Error(t, (&StartupCheckOpts{MaxGroupReplayRatio: 1.5}).applyDefaults())
+}
@@ -0,0 +1,299 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// PostgresStorageBackend is the name of the gorm dialector selecting the Postgres storage backend, the records are
+// stored with the same queries but the engine specific operations of storageBackend differ
+const PostgresStorageBackend = "postgres"
+
+// storageBackend implements the operations of the messenger database which depend on its engine, the records
+// themselves are accessed through gorm
+type storageBackend interface {
+	// getSchemaVersion returns the version of the last migration applied to the database, it is kept when the tables
+	// are dropped
+	getSchemaVersion(db *gorm.DB) (int64, error)
+	setSchemaVersion(db *gorm.DB, version int64) error
+	// listTables returns the names of the tables of the messenger
+	listTables(db *gorm.DB) ([]string, error)
+	// ensureSchema creates the missing tables and columns, it fails when the schema can't be updated in place and the
+	// database must be rebuilt
+	ensureSchema(db *gorm.DB, models []interface{}) error
+	getDatabaseSize(db *gorm.DB) (int64, error)
+	isConstraintError(err error) bool
+	// insertionOrder is the column ordering the rows of a table by insertion
+	insertionOrder() string
+	// maintenanceStatement returns the statement of a maintenance step, an empty one when the step is not supported
+	maintenanceStatement(step messengertypes.MaintenanceRun_Step) string
+	// snapshot writes a consistent copy of the database to a new file while it is used by the other connections
+	snapshot(ctx context.Context, db *gorm.DB, path string) error
+	// checkIntegrity returns the problems found in the pages and the indexes of the database, none when it is sound
+	checkIntegrity(db *gorm.DB) ([]string, error)
+}
+
+// getStorageBackend returns the backend matching the dialector of a connection, SQLite is used by default
+func getStorageBackend(db *gorm.DB) storageBackend {
+	if db.Dialector != nil && db.Dialector.Name() == PostgresStorageBackend {
+		return postgresStorageBackend{}
+	}
+
+	return sqliteStorageBackend{}
+}
+
+func (d *dbWrapper) backend() storageBackend {
+	return getStorageBackend(d.db)
+}
+
+type sqliteStorageBackend struct{}
+
+// getSchemaVersion reads the user_version of sqlite, which is not lost when the tables are dropped
+func (sqliteStorageBackend) getSchemaVersion(db *gorm.DB) (int64, error) {
+	version := int64(0)
+	if err := db.Raw("PRAGMA user_version").Scan(&version).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return version, nil
+}
+
+func (sqliteStorageBackend) setSchemaVersion(db *gorm.DB, version int64) error {
+	if err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)).Error; err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func (sqliteStorageBackend) listTables(db *gorm.DB) ([]string, error) {
+	tables := []string(nil)
+	if err := db.Raw("SELECT name FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'").Scan(&tables).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tables, nil
+}
+
+// ensureSchema compares the columns with the ones of a new database, AutoMigrate can't change all of them in place
+func (sqliteStorageBackend) ensureSchema(db *gorm.DB, models []interface{}) error {
+	return ensureSeamlessDBUpdate(db, models)
+}
+
+func (sqliteStorageBackend) getDatabaseSize(db *gorm.DB) (int64, error) {
+	size := int64(0)
+	if err := db.Raw("SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return size, nil
+}
+
+func (sqliteStorageBackend) isConstraintError(err error) bool {
+	return isSQLiteError(err, sqlite3.ErrConstraint)
+}
+
+func (sqliteStorageBackend) insertionOrder() string {
+	return "ROWID"
+}
+
+// sqliteIntegrityMaxErrors bounds the problems listed by the integrity check
+const sqliteIntegrityMaxErrors = 20
+
+// checkIntegrity uses quick_check, it verifies the pages and the indexes without matching their content with the
+// tables so it is fast enough to run at each start
+func (sqliteStorageBackend) checkIntegrity(db *gorm.DB) ([]string, error) {
+	results := []string(nil)
+	if err := db.Raw(fmt.Sprintf("PRAGMA quick_check(%d)", sqliteIntegrityMaxErrors)).Scan(&results).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	if len(results) == 1 && results[0] == "ok" {
+		return nil, nil
+	}
+
+	return results, nil
+}
+
+func (sqliteStorageBackend) maintenanceStatement(step messengertypes.MaintenanceRun_Step) string {
+	switch step {
+	case messengertypes.MaintenanceRun_StepReindex:
+		return "REINDEX"
+	case messengertypes.MaintenanceRun_StepVacuum:
+		return "VACUUM"
+	case messengertypes.MaintenanceRun_StepAnalyze:
+		return "ANALYZE"
+	default:
+		return ""
+	}
+}
+
+// sqliteSnapshotSchema is the name of the copy attached to the connection during a snapshot
+const sqliteSnapshotSchema = "snapshot"
+
+// snapshot copies the pages of the database with the backup API of sqlite, in a single step so the copy is consistent.
+// The copy is attached to the connection of the source, so an encrypted database is copied with its key.
+func (sqliteStorageBackend) snapshot(ctx context.Context, db *gorm.DB, path string) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+sqliteSnapshotSchema, path); err != nil {
+		return errcode.ErrDBWrite.Wrap(err)
+	}
+
+	err = conn.Raw(func(dc interface{}) error {
+		sc, err := rawSQLiteConn(dc)
+		if err != nil {
+			return err
+		}
+
+		backup, err := sc.Backup(sqliteSnapshotSchema, sc, "main")
+		if err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if _, err := backup.Step(-1); err != nil {
+			_ = backup.Finish()
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := backup.Finish(); err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+
+	if _, detachErr := conn.ExecContext(ctx, "DETACH DATABASE "+sqliteSnapshotSchema); detachErr != nil && err == nil {
+		err = errcode.ErrDBWrite.Wrap(detachErr)
+	}
+
+	return err
+}
+
+// rawSQLiteConn returns the sqlite connection of a driver connection, the encrypted connections wrap it
+func rawSQLiteConn(dc interface{}) (*sqlite3.SQLiteConn, error) {
+	switch c := dc.(type) {
+	case *sqlite3.SQLiteConn:
+		return c, nil
+	case interface{ Unwrap() *sqlite3.SQLiteConn }:
+		return c.Unwrap(), nil
+	default:
+		return nil, errcode.ErrNotImplemented.Wrap(fmt.Errorf("unexpected sqlite connection type %T", dc))
+	}
+}
+
+// postgresSchemaVersionTable keeps the schema version, it is not listed with the tables of the messenger so it is not
+// dropped with them
+const postgresSchemaVersionTable = "messenger_schema_version"
+
+// postgresStorageBackend stores the messenger database on a Postgres server, it allows several nodes of a headless
+// deployment to share a server instead of a single writer file
+type postgresStorageBackend struct{}
+
+func (postgresStorageBackend) getSchemaVersion(db *gorm.DB) (int64, error) {
+	if err := db.Exec("CREATE TABLE IF NOT EXISTS " + postgresSchemaVersionTable + " (version BIGINT NOT NULL)").Error; err != nil {
+		return 0, errcode.ErrDBWrite.Wrap(err)
+	}
+
+	version := int64(0)
+	if err := db.Raw("SELECT COALESCE(MAX(version), 0) FROM " + postgresSchemaVersionTable).Scan(&version).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return version, nil
+}
+
+func (b postgresStorageBackend) setSchemaVersion(db *gorm.DB, version int64) error {
+	// creates the table if needed
+	if _, err := b.getSchemaVersion(db); err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM " + postgresSchemaVersionTable).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if err := tx.Exec("INSERT INTO "+postgresSchemaVersionTable+" (version) VALUES (?)", version).Error; err != nil {
+			return errcode.ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+func (postgresStorageBackend) listTables(db *gorm.DB) ([]string, error) {
+	tables := []string(nil)
+	if err := db.Raw(
+		"SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_type = 'BASE TABLE' AND table_name <> ?",
+		postgresSchemaVersionTable,
+	).Scan(&tables).Error; err != nil {
+		return nil, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return tables, nil
+}
+
+// ensureSchema relies on AutoMigrate, the migrator of Postgres alters the existing columns in place
+func (postgresStorageBackend) ensureSchema(db *gorm.DB, models []interface{}) error {
+	return db.AutoMigrate(models...)
+}
+
+func (postgresStorageBackend) getDatabaseSize(db *gorm.DB) (int64, error) {
+	size := int64(0)
+	if err := db.Raw("SELECT pg_database_size(current_database())").Scan(&size).Error; err != nil {
+		return 0, errcode.ErrDBRead.Wrap(err)
+	}
+
+	return size, nil
+}
+
+// isConstraintError matches the integrity constraint violations, the class 23 of the SQLSTATE codes
+func (postgresStorageBackend) isConstraintError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "(SQLSTATE 23")
+}
+
+// insertionOrder uses the physical location of the rows, it follows the insertion order as long as the rows are not
+// updated or the table vacuumed
+func (postgresStorageBackend) insertionOrder() string {
+	return "ctid"
+}
+
+// checkIntegrity is not supported, the server checks its own pages
+func (postgresStorageBackend) checkIntegrity(*gorm.DB) ([]string, error) {
+	return nil, nil
+}
+
+// maintenanceStatement doesn't rebuild the indexes, REINDEX would block the writers of the other nodes sharing the
+// server
+func (postgresStorageBackend) maintenanceStatement(step messengertypes.MaintenanceRun_Step) string {
+	switch step {
+	case messengertypes.MaintenanceRun_StepVacuum:
+		return "VACUUM"
+	case messengertypes.MaintenanceRun_StepAnalyze:
+		return "ANALYZE"
+	default:
+		return ""
+	}
+}
+
+// snapshot is not supported, the server is backed up with its own tools
+func (postgresStorageBackend) snapshot(context.Context, *gorm.DB, string) error {
+	return errcode.ErrNotImplemented.Wrap(fmt.Errorf("the snapshots of a postgres database are taken on the server"))
+}
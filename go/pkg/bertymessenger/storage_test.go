@@ -0,0 +1,38 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_getStorageBackend(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	backend := db.backend()
+	require.IsType(t, sqliteStorageBackend{}, backend)
+	require.Equal(t, "ROWID", backend.insertionOrder())
+
+	tables, err := backend.listTables(db.db)
+	require.NoError(t, err)
+	require.Len(t, tables, len(getDBModels()))
+
+	require.NoError(t, backend.setSchemaVersion(db.db, 42))
+	version, err := backend.getSchemaVersion(db.db)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), version)
+
+	require.True(t, backend.isConstraintError(sqlite3.Error{Code: sqlite3.ErrConstraint}))
+	require.False(t, backend.isConstraintError(fmt.Errorf("err")))
+}
+
+func Test_postgresStorageBackend_isConstraintError(t *testing.T) {
+	backend := postgresStorageBackend{}
+
+	require.True(t, backend.isConstraintError(fmt.Errorf(`ERROR: duplicate key value violates unique constraint "conversations_pkey" (SQLSTATE 23505)`)))
+	require.False(t, backend.isConstraintError(fmt.Errorf(`ERROR: relation "conversations" does not exist (SQLSTATE 42P01)`)))
+	require.False(t, backend.isConstraintError(nil))
+}
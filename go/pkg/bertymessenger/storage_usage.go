@@ -0,0 +1,91 @@
+package bertymessenger
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func (svc *service) StorageUsage(ctx context.Context, req *messengertypes.StorageUsage_Request) (*messengertypes.StorageUsage_Reply, error) {
+	defer svc.writer.enter()()
+
+	conversations, err := svc.db.getStorageUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := svc.db.getDatabaseSize()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &messengertypes.StorageUsage_Reply{DatabaseSize: size, Conversations: conversations}
+	for _, conv := range conversations {
+		reply.InteractionCount += conv.GetInteractionCount()
+		reply.MediaCount += conv.GetMediaCount()
+		reply.MediaSize += conv.GetMediaSize()
+	}
+
+	return reply, nil
+}
+
+func (svc *service) StorageMediaPrune(ctx context.Context, req *messengertypes.StorageMediaPrune_Request) (*messengertypes.StorageMediaPrune_Reply, error) {
+	if req.GetConversationPublicKey() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	reply := &messengertypes.StorageMediaPrune_Reply{}
+	removed, err := svc.pruneConversationMedias(req.GetConversationPublicKey(), req.GetBefore())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, media := range removed {
+		reply.MediaCount++
+		reply.MediaSize += media.GetSize_()
+	}
+
+	svc.removeAttachments(ctx, removed)
+
+	svc.logger.Info("pruned conversation medias", logGroup(req.GetConversationPublicKey()), zap.Int64("count", reply.GetMediaCount()))
+
+	return reply, nil
+}
+
+// pruneConversationMedias marks the medias received in a conversation before a date as pruned, the interactions are
+// kept and the medias sent by the account stay available to the other members
+func (svc *service) pruneConversationMedias(convPK string, before int64) ([]*messengertypes.Media, error) {
+	defer svc.writer.enter()()
+
+	if _, err := svc.db.getConversationByPK(convPK); err != nil {
+		return nil, errcode.ErrNotFound.Wrap(err)
+	}
+
+	medias, err := svc.db.getConversationDownloadedMedias(convPK, before)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []*messengertypes.Media(nil)
+	for _, media := range medias {
+		media, updated, err := svc.db.updateMediaState(media.GetCID(), messengertypes.Media_StatePruned)
+		if err != nil {
+			return nil, errcode.ErrDBWrite.Wrap(err)
+		}
+
+		if !updated {
+			continue
+		}
+
+		if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeMediaUpdated, &messengertypes.StreamEvent_MediaUpdated{Media: media}, false); err != nil {
+			return nil, err
+		}
+
+		removed = append(removed, media)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,76 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_pruneConversationMedias(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_2"}).Error)
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "cid_1", ConversationPublicKey: "conv_1", SentDate: 1000},
+		{CID: "cid_2", ConversationPublicKey: "conv_1", SentDate: 2000},
+		{CID: "cid_3", ConversationPublicKey: "conv_1", SentDate: 3000},
+		{CID: "cid_4", ConversationPublicKey: "conv_2", SentDate: 1000},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+
+	for _, m := range []*messengertypes.Media{
+		{CID: "media_1", InteractionCID: "cid_1", Size_: 100, State: messengertypes.Media_StateDownloaded},
+		{CID: "media_2", InteractionCID: "cid_1", Size_: 10, State: messengertypes.Media_StateAttached},
+		{CID: "media_3", InteractionCID: "cid_2", Size_: 50, State: messengertypes.Media_StateInCache},
+		{CID: "media_4", InteractionCID: "cid_3", Size_: 20, State: messengertypes.Media_StateDownloaded},
+		{CID: "media_5", InteractionCID: "cid_3", Size_: 500, State: messengertypes.Media_StateNeverDownloaded},
+		{CID: "media_6", InteractionCID: "cid_4", Size_: 30, State: messengertypes.Media_StateDownloaded},
+	} {
+		require.NoError(t, db.db.Create(m).Error)
+	}
+
+	usage, err := db.getStorageUsage()
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+	require.Equal(t, "conv_1", usage[0].GetConversationPublicKey())
+	require.Equal(t, int64(3), usage[0].GetInteractionCount())
+	require.Equal(t, int64(4), usage[0].GetMediaCount())
+	require.Equal(t, int64(180), usage[0].GetMediaSize())
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	_, err = svc.pruneConversationMedias("conv_unknown", 0)
+	require.Error(t, err)
+
+	// the medias sent by the account are kept
+	removed, err := svc.pruneConversationMedias("conv_1", 3000)
+	require.NoError(t, err)
+	require.Len(t, removed, 2)
+	require.Equal(t, "media_1", removed[0].GetCID())
+	require.Equal(t, "media_3", removed[1].GetCID())
+	require.Equal(t, messengertypes.Media_StatePruned, removed[0].GetState())
+
+	usage, err = db.getStorageUsage()
+	require.NoError(t, err)
+	require.Equal(t, "conv_1", usage[0].GetConversationPublicKey())
+	require.Equal(t, int64(3), usage[0].GetInteractionCount())
+	require.Equal(t, int64(2), usage[0].GetMediaCount())
+	require.Equal(t, int64(30), usage[0].GetMediaSize())
+
+	removed, err = svc.pruneConversationMedias("conv_1", 0)
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	require.Equal(t, "media_4", removed[0].GetCID())
+
+	// the interactions are kept
+	interactions, err := db.getAllInteractions()
+	require.NoError(t, err)
+	require.Len(t, interactions, 4)
+}
@@ -0,0 +1,348 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"sync"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const (
+	// streamEventBufferSize is the number of dispatched events kept in memory for the EventStream subscribers
+	streamEventBufferSize = 1024
+	// streamEventSubscriberBufferSize is the default number of events waiting to be sent to a subscriber before its
+	// overflow policy is applied
+	streamEventSubscriberBufferSize = 256
+)
+
+// streamEventLog buffers the events dispatched to the EventStream subscribers, each subscriber reads them from its own
+// offset so a slow one doesn't hold the dispatch of the events to the others
+type streamEventLog struct {
+	mutex       sync.Mutex
+	events      []*streamEventEntry
+	next        uint64
+	subscribers map[chan struct{}]struct{}
+}
+
+type streamEventEntry struct {
+	offset uint64
+	event  *messengertypes.StreamEvent
+	// conversationPK is the conversation of the event, empty when it is not tied to one
+	conversationPK string
+}
+
+func newStreamEventLog(size int) *streamEventLog {
+	return &streamEventLog{
+		events:      make([]*streamEventEntry, size),
+		next:        1,
+		subscribers: map[chan struct{}]struct{}{},
+	}
+}
+
+// StreamEvent assigns the next offset to a dispatched event and notifies the subscribers, the oldest event is dropped
+// when the buffer is full
+func (l *streamEventLog) StreamEvent(e *messengertypes.StreamEvent) error {
+	entry := &streamEventEntry{event: e, conversationPK: streamEventConversation(e)}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry.offset = l.next
+	l.events[(l.next-1)%uint64(len(l.events))] = entry
+	l.next++
+
+	for notify := range l.subscribers {
+		select {
+		case notify <- struct{}{}:
+		default: // already notified
+		}
+	}
+
+	return nil
+}
+
+// last returns the offset of the most recent event, 0 when none has been dispatched yet
+func (l *streamEventLog) last() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.next - 1
+}
+
+// since returns the buffered events more recent than an offset, and the number of events more recent than it which
+// have already been dropped
+func (l *streamEventLog) since(offset uint64) ([]*streamEventEntry, uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	first, missed := offset+1, uint64(0)
+	if size := uint64(len(l.events)); l.next > size && first < l.next-size {
+		missed = l.next - size - first
+		first = l.next - size
+	}
+
+	entries := []*streamEventEntry(nil)
+	for o := first; o < l.next; o++ {
+		entries = append(entries, l.events[(o-1)%uint64(len(l.events))])
+	}
+
+	return entries, missed
+}
+
+func (l *streamEventLog) subscribe() (<-chan struct{}, func()) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	notify := make(chan struct{}, 1)
+	l.subscribers[notify] = struct{}{}
+
+	return notify, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		delete(l.subscribers, notify)
+	}
+}
+
+var _ Notifiee = (*streamEventLog)(nil)
+
+// streamEventConversation returns the public key of the conversation of an event, empty for the events which are not
+// tied to a conversation
+func streamEventConversation(e *messengertypes.StreamEvent) string {
+	payload, err := e.UnmarshalPayload()
+	if err != nil {
+		return ""
+	}
+
+	switch p := payload.(type) {
+	case *messengertypes.StreamEvent_ConversationUpdated:
+		return p.GetConversation().GetPublicKey()
+	case *messengertypes.StreamEvent_ConversationDeleted:
+		return p.GetPublicKey()
+	case *messengertypes.StreamEvent_ConversationConsistent:
+		return p.GetConversation().GetPublicKey()
+	case *messengertypes.StreamEvent_InteractionUpdated:
+		return p.GetInteraction().GetConversationPublicKey()
+	case *messengertypes.StreamEvent_MemberUpdated:
+		return p.GetMember().GetConversationPublicKey()
+	case *messengertypes.StreamEvent_LocationUpdated:
+		return p.GetLocation().GetConversationPublicKey()
+	case *messengertypes.StreamEvent_BoardEntryUpdated:
+		return p.GetEntry().GetConversationPublicKey()
+	case *messengertypes.StreamEvent_MediaUploadUpdated:
+		return p.GetUpload().GetConversationPublicKey()
+	case *messengertypes.StreamEvent_EventHandlingFailed:
+		return p.GetConversationPublicKey()
+	case *messengertypes.StreamEvent_Notified:
+		if p.GetType() != messengertypes.StreamEvent_Notified_TypeMessageReceived {
+			return ""
+		}
+
+		notif, err := p.UnmarshalPayload()
+		if err != nil {
+			return ""
+		}
+
+		return notif.(*messengertypes.StreamEvent_Notified_MessageReceived).GetConversation().GetPublicKey()
+	default:
+		return ""
+	}
+}
+
+// streamEventFilter selects the events sent to an EventStream subscriber, the zero value selects all of them
+type streamEventFilter struct {
+	conversationPKs map[string]struct{}
+	types           map[messengertypes.StreamEvent_Type]struct{}
+	// skipMembers doesn't list the existing members, their updates are still sent
+	skipMembers bool
+}
+
+func newStreamEventFilter(req *messengertypes.EventStream_Request) streamEventFilter {
+	filter := streamEventFilter{skipMembers: req.GetSkipMembers()}
+
+	if len(req.GetConversationPublicKeys()) > 0 {
+		filter.conversationPKs = map[string]struct{}{}
+		for _, pk := range req.GetConversationPublicKeys() {
+			filter.conversationPKs[pk] = struct{}{}
+		}
+	}
+
+	if len(req.GetTypes()) > 0 {
+		filter.types = map[messengertypes.StreamEvent_Type]struct{}{}
+		for _, typ := range req.GetTypes() {
+			filter.types[typ] = struct{}{}
+		}
+	}
+
+	return filter
+}
+
+// matches returns whether an event is sent, the end of the list of the existing models is always sent
+func (f streamEventFilter) matches(typ messengertypes.StreamEvent_Type, conversationPK string) bool {
+	if typ == messengertypes.StreamEvent_TypeListEnded {
+		return true
+	}
+
+	if f.types != nil {
+		if _, ok := f.types[typ]; !ok {
+			return false
+		}
+	}
+
+	if f.conversationPKs != nil && conversationPK != "" {
+		if _, ok := f.conversationPKs[conversationPK]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// streamEventKey identifies the model updated by an event so its updates can be coalesced, empty for the events which
+// can't be coalesced
+func streamEventKey(e *messengertypes.StreamEvent) string {
+	payload, err := e.UnmarshalPayload()
+	if err != nil {
+		return ""
+	}
+
+	key := ""
+	switch p := payload.(type) {
+	case *messengertypes.StreamEvent_ConversationUpdated:
+		key = p.GetConversation().GetPublicKey()
+	case *messengertypes.StreamEvent_InteractionUpdated:
+		key = p.GetInteraction().GetCID()
+	case *messengertypes.StreamEvent_ContactUpdated:
+		key = p.GetContact().GetPublicKey()
+	case *messengertypes.StreamEvent_AccountUpdated:
+		key = "account"
+	case *messengertypes.StreamEvent_MemberUpdated:
+		key = p.GetMember().GetConversationPublicKey() + "/" + p.GetMember().GetPublicKey()
+	case *messengertypes.StreamEvent_DeviceUpdated:
+		key = p.GetDevice().GetPublicKey()
+	case *messengertypes.StreamEvent_MediaUpdated:
+		key = p.GetMedia().GetCID()
+	case *messengertypes.StreamEvent_LocationUpdated:
+		key = p.GetLocation().GetConversationPublicKey() + "/" + p.GetLocation().GetDevicePublicKey()
+	case *messengertypes.StreamEvent_BoardEntryUpdated:
+		key = p.GetEntry().GetConversationPublicKey() + "/" + p.GetEntry().GetKey()
+	case *messengertypes.StreamEvent_MediaUploadUpdated:
+		key = p.GetUpload().GetID()
+	default:
+		return ""
+	}
+
+	return fmt.Sprintf("%d/%s", e.GetType(), key)
+}
+
+// streamEventSubscriber bounds the events waiting to be sent to an EventStream subscriber, so a slow one only delays
+// its own events
+type streamEventSubscriber struct {
+	filter     streamEventFilter
+	bufferSize int
+	policy     messengertypes.EventStream_Request_OverflowPolicy
+}
+
+func newStreamEventSubscriber(req *messengertypes.EventStream_Request) streamEventSubscriber {
+	size := int(req.GetBufferSize())
+	if size == 0 || size > streamEventBufferSize {
+		size = streamEventSubscriberBufferSize
+	}
+
+	return streamEventSubscriber{filter: newStreamEventFilter(req), bufferSize: size, policy: req.GetOverflowPolicy()}
+}
+
+// pending selects the events to send among the ones read from the log after cursor, dropped is the number of events
+// which were already dropped from the log. The gap describes the events left out by the overflow policy, it is nil
+// when none has been.
+func (s streamEventSubscriber) pending(cursor uint64, entries []*streamEventEntry, dropped uint64) ([]*streamEventEntry, *messengertypes.StreamEvent_StreamGap, error) {
+	matching := []*streamEventEntry(nil)
+	for _, entry := range entries {
+		if s.filter.matches(entry.event.GetType(), entry.conversationPK) {
+			matching = append(matching, entry)
+		}
+	}
+
+	if dropped == 0 && len(matching) <= s.bufferSize {
+		return matching, nil, nil
+	}
+
+	if s.policy == messengertypes.EventStream_Request_OverflowDisconnect {
+		return nil, nil, errcode.ErrStreamSlowConsumer.Wrap(fmt.Errorf("%d events waiting to be sent", uint64(len(matching))+dropped))
+	}
+
+	var gap *messengertypes.StreamEvent_StreamGap
+	if dropped > 0 {
+		// the events dropped from the log are not known anymore
+		gap = &messengertypes.StreamEvent_StreamGap{Missed: dropped, FromOffset: cursor + 1, UntilOffset: cursor + dropped, ResyncAll: true}
+	}
+
+	if s.policy == messengertypes.EventStream_Request_OverflowCoalesce {
+		matching = coalesceStreamEvents(matching)
+	}
+
+	if overflow := len(matching) - s.bufferSize; overflow > 0 {
+		if gap == nil {
+			gap = &messengertypes.StreamEvent_StreamGap{FromOffset: matching[0].offset}
+		}
+
+		conversations, types := map[string]struct{}{}, map[messengertypes.StreamEvent_Type]struct{}{}
+		for _, entry := range matching[:overflow] {
+			gap.Missed++
+			gap.UntilOffset = entry.offset
+
+			if gap.ResyncAll {
+				continue
+			}
+
+			if entry.conversationPK != "" {
+				if _, ok := conversations[entry.conversationPK]; !ok {
+					conversations[entry.conversationPK] = struct{}{}
+					gap.ConversationPublicKeys = append(gap.ConversationPublicKeys, entry.conversationPK)
+				}
+			} else if _, ok := types[entry.event.GetType()]; !ok {
+				types[entry.event.GetType()] = struct{}{}
+				gap.Types = append(gap.Types, entry.event.GetType())
+			}
+		}
+
+		matching = matching[overflow:]
+	}
+
+	return matching, gap, nil
+}
+
+// coalesceStreamEvents only keeps the most recent update of each model, at its place in the events, the update is sent
+// as new if one of the updates coalesced was
+func coalesceStreamEvents(entries []*streamEventEntry) []*streamEventEntry {
+	keys := make([]string, len(entries))
+	last, isNew := map[string]int{}, map[string]bool{}
+	for i, entry := range entries {
+		if keys[i] = streamEventKey(entry.event); keys[i] == "" {
+			continue
+		}
+
+		last[keys[i]] = i
+		isNew[keys[i]] = isNew[keys[i]] || entry.event.GetIsNew()
+	}
+
+	coalesced := []*streamEventEntry(nil)
+	for i, entry := range entries {
+		if keys[i] != "" {
+			if last[keys[i]] != i {
+				continue
+			}
+
+			// the entries are shared by the subscribers, they are copied to be changed
+			if isNew[keys[i]] && !entry.event.GetIsNew() {
+				event := &messengertypes.StreamEvent{Type: entry.event.GetType(), Payload: entry.event.GetPayload(), IsNew: true}
+				entry = &streamEventEntry{offset: entry.offset, event: event, conversationPK: entry.conversationPK}
+			}
+		}
+
+		coalesced = append(coalesced, entry)
+	}
+
+	return coalesced
+}
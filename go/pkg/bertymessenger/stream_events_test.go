@@ -0,0 +1,165 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func testStreamEvent(t *testing.T, typ messengertypes.StreamEvent_Type, msg proto.Message) *messengertypes.StreamEvent {
+	t.Helper()
+
+	payload, err := proto.Marshal(msg)
+	require.NoError(t, err)
+
+	return &messengertypes.StreamEvent{Type: typ, Payload: payload}
+}
+
+func Test_streamEventLog_since(t *testing.T) {
+	log := newStreamEventLog(2)
+	require.Equal(t, uint64(0), log.last())
+
+	for _, pk := range []string{"conv_1", "conv_2", "conv_3"} {
+		require.NoError(t, log.StreamEvent(testStreamEvent(t, messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{
+			Conversation: &messengertypes.Conversation{PublicKey: pk},
+		})))
+	}
+	require.Equal(t, uint64(3), log.last())
+
+	// the oldest event has been dropped
+	entries, missed := log.since(0)
+	require.Len(t, entries, 2)
+	require.Equal(t, uint64(1), missed)
+	require.Equal(t, uint64(2), entries[0].offset)
+	require.Equal(t, "conv_2", entries[0].conversationPK)
+
+	entries, missed = log.since(2)
+	require.Len(t, entries, 1)
+	require.Equal(t, uint64(0), missed)
+	require.Equal(t, "conv_3", entries[0].conversationPK)
+
+	entries, _ = log.since(3)
+	require.Empty(t, entries)
+}
+
+func Test_streamEventConversation(t *testing.T) {
+	require.Equal(t, "conv_1", streamEventConversation(testStreamEvent(t, messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{
+		Interaction: &messengertypes.Interaction{ConversationPublicKey: "conv_1"},
+	})))
+	require.Equal(t, "conv_2", streamEventConversation(testStreamEvent(t, messengertypes.StreamEvent_TypeConversationDeleted, &messengertypes.StreamEvent_ConversationDeleted{
+		PublicKey: "conv_2",
+	})))
+	require.Empty(t, streamEventConversation(testStreamEvent(t, messengertypes.StreamEvent_TypeContactUpdated, &messengertypes.StreamEvent_ContactUpdated{
+		Contact: &messengertypes.Contact{PublicKey: "contact_1"},
+	})))
+}
+
+func Test_streamEventFilter_matches(t *testing.T) {
+	all := newStreamEventFilter(&messengertypes.EventStream_Request{})
+	require.True(t, all.matches(messengertypes.StreamEvent_TypeInteractionUpdated, "conv_1"))
+
+	filter := newStreamEventFilter(&messengertypes.EventStream_Request{
+		ConversationPublicKeys: []string{"conv_1"},
+		Types:                  []messengertypes.StreamEvent_Type{messengertypes.StreamEvent_TypeInteractionUpdated, messengertypes.StreamEvent_TypeAccountUpdated},
+	})
+	require.True(t, filter.matches(messengertypes.StreamEvent_TypeInteractionUpdated, "conv_1"))
+	require.False(t, filter.matches(messengertypes.StreamEvent_TypeInteractionUpdated, "conv_2"))
+	require.False(t, filter.matches(messengertypes.StreamEvent_TypeMemberUpdated, "conv_1"))
+
+	// the events which are not tied to a conversation are only filtered by type
+	require.True(t, filter.matches(messengertypes.StreamEvent_TypeAccountUpdated, ""))
+	require.True(t, filter.matches(messengertypes.StreamEvent_TypeListEnded, ""))
+}
+
+func Test_streamEventSubscriber_pending(t *testing.T) {
+	log := newStreamEventLog(8)
+	for _, pk := range []string{"conv_1", "conv_2", "conv_1", "conv_3"} {
+		require.NoError(t, log.StreamEvent(testStreamEvent(t, messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{
+			Conversation: &messengertypes.Conversation{PublicKey: pk},
+		})))
+	}
+	require.NoError(t, log.StreamEvent(testStreamEvent(t, messengertypes.StreamEvent_TypeAccountUpdated, &messengertypes.StreamEvent_AccountUpdated{})))
+
+	offsets := func(entries []*streamEventEntry) []uint64 {
+		ret := []uint64(nil)
+		for _, entry := range entries {
+			ret = append(ret, entry.offset)
+		}
+		return ret
+	}
+
+	entries, dropped := log.since(0)
+
+	// the events fit in the buffer
+	pending, gap, err := newStreamEventSubscriber(&messengertypes.EventStream_Request{}).pending(0, entries, dropped)
+	require.NoError(t, err)
+	require.Nil(t, gap)
+	require.Len(t, pending, 5)
+
+	// the oldest events are dropped and described by the gap
+	pending, gap, err = newStreamEventSubscriber(&messengertypes.EventStream_Request{BufferSize: 2}).pending(0, entries, dropped)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5}, offsets(pending))
+	require.Equal(t, uint64(3), gap.GetMissed())
+	require.Equal(t, uint64(1), gap.GetFromOffset())
+	require.Equal(t, uint64(3), gap.GetUntilOffset())
+	require.Equal(t, []string{"conv_1", "conv_2"}, gap.GetConversationPublicKeys())
+	require.False(t, gap.GetResyncAll())
+
+	// the updates of a conversation are coalesced first
+	pending, gap, err = newStreamEventSubscriber(&messengertypes.EventStream_Request{BufferSize: 3, OverflowPolicy: messengertypes.EventStream_Request_OverflowCoalesce}).pending(0, entries, dropped)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4, 5}, offsets(pending))
+	require.Equal(t, uint64(1), gap.GetMissed())
+	require.Equal(t, []string{"conv_2"}, gap.GetConversationPublicKeys())
+
+	_, _, err = newStreamEventSubscriber(&messengertypes.EventStream_Request{BufferSize: 2, OverflowPolicy: messengertypes.EventStream_Request_OverflowDisconnect}).pending(0, entries, dropped)
+	require.True(t, errcode.Is(err, errcode.ErrStreamSlowConsumer))
+
+	// the events filtered out don't count
+	pending, gap, err = newStreamEventSubscriber(&messengertypes.EventStream_Request{BufferSize: 2, ConversationPublicKeys: []string{"conv_1"}, Types: []messengertypes.StreamEvent_Type{messengertypes.StreamEvent_TypeConversationUpdated}}).pending(0, entries, dropped)
+	require.NoError(t, err)
+	require.Nil(t, gap)
+	require.Equal(t, []uint64{1, 3}, offsets(pending))
+
+	// the events dropped from the log are not known anymore
+	pending, gap, err = newStreamEventSubscriber(&messengertypes.EventStream_Request{}).pending(0, entries[2:], 2)
+	require.NoError(t, err)
+	require.Len(t, pending, 3)
+	require.True(t, gap.GetResyncAll())
+	require.Equal(t, uint64(2), gap.GetMissed())
+	require.Equal(t, uint64(2), gap.GetUntilOffset())
+}
+
+func Test_coalesceStreamEvents(t *testing.T) {
+	entry := func(offset uint64, typ messengertypes.StreamEvent_Type, msg proto.Message, isNew bool) *streamEventEntry {
+		event := testStreamEvent(t, typ, msg)
+		event.IsNew = isNew
+		return &streamEventEntry{offset: offset, event: event}
+	}
+
+	interaction := func(cid string) *messengertypes.StreamEvent_InteractionUpdated {
+		return &messengertypes.StreamEvent_InteractionUpdated{Interaction: &messengertypes.Interaction{CID: cid}}
+	}
+
+	entries := []*streamEventEntry{
+		entry(1, messengertypes.StreamEvent_TypeInteractionUpdated, interaction("cid_1"), true),
+		entry(2, messengertypes.StreamEvent_TypeInteractionUpdated, interaction("cid_2"), true),
+		entry(3, messengertypes.StreamEvent_TypeInteractionDeleted, &messengertypes.StreamEvent_InteractionDeleted{CID: "cid_2"}, false),
+		entry(4, messengertypes.StreamEvent_TypeInteractionUpdated, interaction("cid_1"), false),
+	}
+
+	coalesced := coalesceStreamEvents(entries)
+	require.Len(t, coalesced, 3)
+	require.Equal(t, uint64(2), coalesced[0].offset)
+	require.Equal(t, uint64(3), coalesced[1].offset)
+	require.Equal(t, uint64(4), coalesced[2].offset)
+
+	// the most recent update is sent as new, the entry of the log is left unchanged
+	require.True(t, coalesced[2].event.GetIsNew())
+	require.False(t, entries[3].event.GetIsNew())
+}
@@ -0,0 +1,55 @@
+package bertymessenger
+
+import (
+	"fmt"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// systemInteractionCID derives the cid of a system interaction from the cid of the event it renders
+func systemInteractionCID(eventCID string, t messengertypes.AppMessage_SystemEvent_Type) string {
+	return fmt.Sprintf("__system-%s-%d", eventCID, t)
+}
+
+// addSystemInteraction adds a local interaction rendering a change of a group in its timeline, it is ordered with
+// the event it renders and it is only added once when the logs are replayed
+func (h *eventHandler) addSystemInteraction(tx *dbWrapper, eventCID, convPK string, lamportTime uint64, date int64, event *messengertypes.AppMessage_SystemEvent) error {
+	if eventCID == "" {
+		return nil
+	}
+
+	payload, err := proto.Marshal(event)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	i, isNew, err := tx.addInteraction(messengertypes.Interaction{
+		CID:                   systemInteractionCID(eventCID, event.GetType()),
+		Type:                  messengertypes.AppMessage_TypeSystemEvent,
+		ConversationPublicKey: convPK,
+		MemberPublicKey:       event.GetActorMemberPublicKey(),
+		Payload:               payload,
+		SentDate:              date,
+		LamportTime:           lamportTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !isNew || h.svc == nil {
+		return nil
+	}
+
+	return h.svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, true)
+}
+
+// addInteractionSystemEvent adds the system interaction of a moderation message, the sender is the actor
+func (h *eventHandler) addInteractionSystemEvent(tx *dbWrapper, i *messengertypes.Interaction, event *messengertypes.AppMessage_SystemEvent) error {
+	event.ActorMemberPublicKey = interactionSenderMemberPK(i)
+
+	return h.addSystemInteraction(tx, i.GetCID(), i.GetConversationPublicKey(), i.GetLamportTime(), i.GetSentDate(), event)
+}
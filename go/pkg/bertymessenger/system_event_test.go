@@ -0,0 +1,70 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	// nolint:staticcheck // cannot use the new protobuf API while keeping gogoproto
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_eventHandler_systemInteractions(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1", Type: messengertypes.Conversation_MultiMemberType, DisplayName: "group", AccountMemberPublicKey: "member_me"}).Error)
+	_, err := db.addMember("member_me", "conv_1", "", "", true, true)
+	require.NoError(t, err)
+	_, err = db.addMember("member_1", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+	_, err = db.addMember("member_2", "conv_1", "", "", false, false)
+	require.NoError(t, err)
+
+	h := &eventHandler{db: db, logger: zap.NewNop()}
+	interaction := func(cid string, isMe bool, memberPK string, lamportTime uint64) *messengertypes.Interaction {
+		conv, err := db.getConversationByPK("conv_1")
+		require.NoError(t, err)
+
+		return &messengertypes.Interaction{CID: cid, Conversation: conv, ConversationPublicKey: "conv_1", IsMe: isMe, MemberPublicKey: memberPK, SentDate: int64(lamportTime) * 1000, LamportTime: lamportTime}
+	}
+
+	// only the admins can leave with a removal of their own
+	_, _, err = h.handleAppMessageSetMemberRole(db, interaction("cid_role", true, "", 0), &messengertypes.AppMessage_SetMemberRole{MemberPublicKey: "member_2", Role: messengertypes.Member_RoleAdmin})
+	require.NoError(t, err)
+
+	// the logs are handled twice, as when they are replayed
+	for n := 0; n < 2; n++ {
+		_, _, err = h.handleAppMessageSetGroupInfo(db, interaction("cid_rename", true, "", 1), &messengertypes.AppMessage_SetGroupInfo{DisplayName: "renamed"})
+		require.NoError(t, err)
+		_, _, err = h.handleAppMessageRemoveMember(db, interaction("cid_remove", true, "", 2), &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_1"})
+		require.NoError(t, err)
+		_, _, err = h.handleAppMessageRemoveMember(db, interaction("cid_leave", false, "member_2", 3), &messengertypes.AppMessage_RemoveMember{MemberPublicKey: "member_2"})
+		require.NoError(t, err)
+	}
+
+	// the group info sent again with the same name is not rendered
+	_, _, err = h.handleAppMessageSetGroupInfo(db, interaction("cid_topic", true, "", 4), &messengertypes.AppMessage_SetGroupInfo{DisplayName: "renamed", Topic: "topic"})
+	require.NoError(t, err)
+
+	interactions := []*messengertypes.Interaction(nil)
+	require.NoError(t, db.db.Where("type = ?", messengertypes.AppMessage_TypeSystemEvent).Order("lamport_time").Find(&interactions).Error)
+	require.Len(t, interactions, 3)
+
+	expected := []*messengertypes.AppMessage_SystemEvent{
+		{Type: messengertypes.AppMessage_SystemEvent_TypeGroupRenamed, ActorMemberPublicKey: "member_me", DisplayName: "renamed"},
+		{Type: messengertypes.AppMessage_SystemEvent_TypeMemberRemoved, ActorMemberPublicKey: "member_me", MemberPublicKey: "member_1"},
+		{Type: messengertypes.AppMessage_SystemEvent_TypeMemberLeft, ActorMemberPublicKey: "member_2", MemberPublicKey: "member_2"},
+	}
+	for n, i := range interactions {
+		event := &messengertypes.AppMessage_SystemEvent{}
+		require.NoError(t, proto.Unmarshal(i.GetPayload(), event))
+		require.Equal(t, expected[n].GetType(), event.GetType())
+		require.Equal(t, expected[n].GetActorMemberPublicKey(), event.GetActorMemberPublicKey())
+		require.Equal(t, expected[n].GetMemberPublicKey(), event.GetMemberPublicKey())
+		require.Equal(t, expected[n].GetDisplayName(), event.GetDisplayName())
+		require.Equal(t, uint64(n+1), i.GetLamportTime())
+	}
+}
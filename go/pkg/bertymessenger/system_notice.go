@@ -0,0 +1,50 @@
+package bertymessenger
+
+import (
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The node reports the events clients should surface about its health and its security as system notices, the
+// interactions of a local conversation of the account type whose public key is the one of the account. The clients list
+// them with InteractionList and are told about them with the interaction and conversation updates like any message.
+
+// addSystemNotice adds a notice to the account conversation and streams it, the failures are only logged as the notices
+// never prevent the operation they report
+func (svc *service) addSystemNotice(notice *messengertypes.AppMessage_SystemNotice) {
+	if err := svc.addSystemNoticeAt(notice, time.Now()); err != nil {
+		svc.logger.Error("unable to add system notice", zap.String("type", notice.GetType().String()), zap.Error(err))
+	}
+}
+
+func (svc *service) addSystemNoticeAt(notice *messengertypes.AppMessage_SystemNotice, now time.Time) error {
+	acc, err := svc.db.getAccount()
+	if err != nil {
+		return errcode.ErrDBRead.Wrap(err)
+	}
+
+	payload, err := proto.Marshal(notice)
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	conv, i, err := svc.db.addSystemNotice(acc.GetPublicKey(), payload, now)
+	if err != nil {
+		return err
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeInteractionUpdated, &messengertypes.StreamEvent_InteractionUpdated{Interaction: i}, true); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	if err := svc.dispatcher.StreamEvent(messengertypes.StreamEvent_TypeConversationUpdated, &messengertypes.StreamEvent_ConversationUpdated{Conversation: conv}, false); err != nil {
+		return errcode.TODO.Wrap(err)
+	}
+
+	return nil
+}
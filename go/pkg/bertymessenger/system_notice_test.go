@@ -0,0 +1,46 @@
+package bertymessenger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_service_addSystemNotice(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	require.NoError(t, db.db.Create(&messengertypes.Account{PublicKey: "account_1"}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop(), dispatcher: NewDispatcher()}
+
+	now := time.Now()
+	require.NoError(t, svc.addSystemNoticeAt(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeDeviceLinked, DevicePublicKey: "device_1"}, now))
+	require.NoError(t, svc.addSystemNoticeAt(&messengertypes.AppMessage_SystemNotice{Type: messengertypes.AppMessage_SystemNotice_TypeReplicationLagging, ConversationPublicKey: "conv_1", Lag: 5000}, now.Add(time.Second)))
+
+	conv, err := db.getConversationByPK("account_1")
+	require.NoError(t, err)
+	require.Equal(t, messengertypes.Conversation_AccountType, conv.GetType())
+	require.Equal(t, int32(2), conv.GetUnreadCount())
+	require.Equal(t, timestampMs(now.Add(time.Second)), conv.GetLastUpdate())
+
+	interactions, err := db.getPaginatedInteractions("account_1", false, messengertypes.Account_OrderLogical, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, interactions, 2)
+	require.Equal(t, messengertypes.AppMessage_TypeSystemNotice, interactions[0].GetType())
+
+	// the most recent notice is listed first
+	var notice messengertypes.AppMessage_SystemNotice
+	require.NoError(t, proto.Unmarshal(interactions[0].GetPayload(), &notice))
+	require.Equal(t, messengertypes.AppMessage_SystemNotice_TypeReplicationLagging, notice.GetType())
+	require.Equal(t, int64(5000), notice.GetLag())
+
+	require.NoError(t, proto.Unmarshal(interactions[1].GetPayload(), &notice))
+	require.Equal(t, messengertypes.AppMessage_SystemNotice_TypeDeviceLinked, notice.GetType())
+	require.Equal(t, "device_1", notice.GetDevicePublicKey())
+}
@@ -0,0 +1,126 @@
+package bertymessenger
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+const translationTimeout = 30 * time.Second
+
+// translationLanguageRegexp matches the BCP 47 language tags, ie. "fr" or "pt-BR"
+var translationLanguageRegexp = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// Translator translates the messages on the request of the user, it is provided by the application (ie. an on-device
+// model or a service configured by the user)
+type Translator interface {
+	// Name identifies the provider in the cached translations
+	Name() string
+	// IsLocal reports whether the provider runs on this device, the messages are only sent to a remote provider when
+	// the user allows it
+	IsLocal() bool
+	// Translate returns the text in the target language and the language of the text
+	Translate(ctx context.Context, text, language string) (translated string, sourceLanguage string, err error)
+}
+
+func (svc *service) InteractionTranslate(ctx context.Context, req *messengertypes.InteractionTranslate_Request) (*messengertypes.InteractionTranslate_Reply, error) {
+	if req.GetCID() == "" {
+		return nil, errcode.ErrMissingInput
+	}
+
+	if req.GetLanguage() != "" && !translationLanguageRegexp.MatchString(req.GetLanguage()) {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid language %q", req.GetLanguage()))
+	}
+
+	var body string
+	language := req.GetLanguage()
+	if err := func() error {
+		defer svc.writer.enter()()
+
+		i, err := svc.db.getInteractionByCID(req.GetCID())
+		if err != nil {
+			return errcode.ErrNotFound.Wrap(err)
+		}
+
+		if i.GetType() != messengertypes.AppMessage_TypeUserMessage {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the user messages can be translated"))
+		}
+
+		payload, err := i.UnmarshalPayload()
+		if err != nil {
+			return errcode.ErrDeserialization.Wrap(err)
+		}
+		body = payload.(*messengertypes.AppMessage_UserMessage).GetBody()
+
+		// the messages are translated to the primary language of the conversation by default
+		if language == "" {
+			conv, err := svc.db.getConversationByPK(i.GetConversationPublicKey())
+			if err != nil {
+				return errcode.ErrNotFound.Wrap(err)
+			}
+
+			if language = conv.GetPrimaryLanguage(); language == "" {
+				return errcode.ErrMissingInput.Wrap(fmt.Errorf("a language is required, the conversation has no primary language"))
+			}
+		}
+
+		return nil
+	}(); err != nil {
+		return nil, err
+	}
+
+	if body == "" {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the message has no text"))
+	}
+
+	if !req.GetRefresh() {
+		translation, err := svc.db.getInteractionTranslation(req.GetCID(), language)
+		if err != nil {
+			return nil, err
+		}
+
+		if translation != nil {
+			return &messengertypes.InteractionTranslate_Reply{Translation: translation, Cached: true}, nil
+		}
+	}
+
+	if svc.translator == nil {
+		return nil, errcode.ErrTranslationUnavailable.Wrap(fmt.Errorf("no translation provider"))
+	}
+
+	if !svc.translator.IsLocal() && !req.GetAllowRemote() {
+		return nil, errcode.ErrTranslationUnavailable.Wrap(fmt.Errorf("the translation provider is remote, it must be allowed by the request"))
+	}
+
+	// the provider is called without holding the lock, it may perform network requests
+	tctx, cancel := context.WithTimeout(ctx, translationTimeout)
+	defer cancel()
+
+	text, sourceLanguage, err := svc.translator.Translate(tctx, body, language)
+	if err != nil {
+		return nil, errcode.ErrTranslation.Wrap(err)
+	}
+
+	translation := &messengertypes.InteractionTranslation{
+		InteractionCID: req.GetCID(),
+		Language:       language,
+		Text:           text,
+		SourceLanguage: sourceLanguage,
+		Provider:       svc.translator.Name(),
+		CreatedDate:    timestampMs(time.Now()),
+	}
+
+	if err := svc.db.setInteractionTranslation(translation); err != nil {
+		return nil, err
+	}
+
+	svc.logger.Debug("translated interaction", zap.String("cid", req.GetCID()), zap.String("language", language), zap.String("provider", translation.GetProvider()))
+
+	return &messengertypes.InteractionTranslate_Reply{Translation: translation}, nil
+}
@@ -0,0 +1,91 @@
+package bertymessenger
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+type testTranslator struct {
+	local bool
+	calls int
+}
+
+func (t *testTranslator) Name() string { return "test" }
+
+func (t *testTranslator) IsLocal() bool { return t.local }
+
+func (t *testTranslator) Translate(ctx context.Context, text, language string) (string, string, error) {
+	t.calls++
+	return strings.ToUpper(text) + " (" + language + ")", "en", nil
+}
+
+func Test_service_InteractionTranslate(t *testing.T) {
+	ctx := context.Background()
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	payload, err := proto.Marshal(&messengertypes.AppMessage_UserMessage{Body: "hello"})
+	require.NoError(t, err)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage, Payload: payload}).Error)
+	require.NoError(t, db.db.Create(&messengertypes.Interaction{CID: "cid_info", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeSetUserInfo}).Error)
+
+	svc := &service{db: db, logger: zap.NewNop()}
+
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr"})
+	require.True(t, errcode.Is(err, errcode.ErrTranslationUnavailable))
+
+	// a remote provider is only called when the request allows it
+	translator := &testTranslator{}
+	svc.translator = translator
+
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr"})
+	require.True(t, errcode.Is(err, errcode.ErrTranslationUnavailable))
+	require.Equal(t, 0, translator.calls)
+
+	reply, err := svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr", AllowRemote: true})
+	require.NoError(t, err)
+	require.False(t, reply.GetCached())
+	require.Equal(t, "HELLO (fr)", reply.GetTranslation().GetText())
+	require.Equal(t, "en", reply.GetTranslation().GetSourceLanguage())
+	require.Equal(t, "test", reply.GetTranslation().GetProvider())
+
+	// the cached translation is returned without calling the provider
+	reply, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr"})
+	require.NoError(t, err)
+	require.True(t, reply.GetCached())
+	require.Equal(t, 1, translator.calls)
+
+	translator.local = true
+	reply, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr", Refresh: true})
+	require.NoError(t, err)
+	require.False(t, reply.GetCached())
+	require.Equal(t, 2, translator.calls)
+
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1", Language: "fr; DROP"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_info", Language: "fr"})
+	require.True(t, errcode.Is(err, errcode.ErrInvalidInput))
+
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_unknown", Language: "fr"})
+	require.True(t, errcode.Is(err, errcode.ErrNotFound))
+
+	// the primary language of the conversation is the default target
+	require.NoError(t, db.db.Create(&messengertypes.Conversation{PublicKey: "conv_1"}).Error)
+	_, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1"})
+	require.True(t, errcode.Is(err, errcode.ErrMissingInput))
+
+	require.NoError(t, db.db.Model(&messengertypes.Conversation{}).Where("public_key = ?", "conv_1").Update("primary_language", "de").Error)
+	reply, err = svc.InteractionTranslate(ctx, &messengertypes.InteractionTranslate_Request{CID: "cid_1"})
+	require.NoError(t, err)
+	require.Equal(t, "de", reply.GetTranslation().GetLanguage())
+	require.Equal(t, "HELLO (de)", reply.GetTranslation().GetText())
+}
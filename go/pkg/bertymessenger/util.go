@@ -5,6 +5,8 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"berty.tech/berty/v2/go/pkg/errcode"
@@ -52,3 +54,23 @@ func b64DecodeBytes(s string) ([]byte, error) {
 func timestampMs(t time.Time) int64 {
 	return t.UnixNano() / 1000000
 }
+
+// likePatternEscaper escapes the wildcards of a LIKE pattern, the queries declare the backslash as their escape
+// character
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLikePattern(s string) string {
+	return likePatternEscaper.Replace(s)
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,184 @@
+package bertymessenger
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"gorm.io/gorm"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+// The incoming app messages are checked against the semantic rules of their type before they are handled, live or
+// during a replay. A message breaking a rule is never handled, it is marked as processed so it isn't checked again on
+// the next replay, and the rejections are counted by rule in SystemInfo.
+
+// appMessageRule is a semantic rule of a type of app message, check returns the reason of the rejection of a message,
+// empty when it is valid
+type appMessageRule struct {
+	name  string
+	check func(tx *dbWrapper, i *messengertypes.Interaction, payload proto.Message) (string, error)
+}
+
+// appMessageRules are the rules checked for each type of app message, the types without rules are always handled
+var appMessageRules = map[messengertypes.AppMessage_Type][]appMessageRule{
+	messengertypes.AppMessage_TypeUserMessage: {
+		{name: "quote-format", check: checkQuoteFormatRule},
+	},
+	messengertypes.AppMessage_TypeUserReaction: {
+		{name: "reaction-target", check: checkUserReactionRule},
+	},
+	messengertypes.AppMessage_TypePollClose: {
+		{name: "poll-close-author", check: checkPollCloseRule},
+	},
+	messengertypes.AppMessage_TypeInteractionRetract: {
+		{name: "retract-author", check: checkInteractionRetractRule},
+	},
+}
+
+// appMessageRejection is returned when an app message breaks a rule, the reason never contains the content of the
+// message
+type appMessageRejection struct {
+	rule   string
+	reason string
+}
+
+func (r *appMessageRejection) Error() string {
+	return fmt.Sprintf("app message rejected by rule %s: %s", r.rule, r.reason)
+}
+
+// validateAppMessage checks an app message against the rules of its type, an *appMessageRejection is returned when it
+// breaks one of them
+func validateAppMessage(tx *dbWrapper, i *messengertypes.Interaction, payload proto.Message) error {
+	for _, rule := range appMessageRules[i.GetType()] {
+		reason, err := rule.check(tx, i, payload)
+		if err != nil {
+			return err
+		}
+
+		if reason != "" {
+			return &appMessageRejection{rule: rule.name, reason: reason}
+		}
+	}
+
+	return nil
+}
+
+// checkReactionTarget returns why a reaction to target can't be added to a conversation, the reactions to an
+// interaction not received yet are kept until it is
+func checkReactionTarget(tx *dbWrapper, convPK, target string) (string, error) {
+	i, err := tx.getInteractionByCID(target)
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	if i.GetConversationPublicKey() != convPK {
+		return "the target is in another conversation", nil
+	}
+
+	// the system events are added by the messenger itself, they are never reacted to
+	if i.GetType() >= localAppMessageTypesStart {
+		return "the target is a system event", nil
+	}
+
+	return "", nil
+}
+
+func checkUserReactionRule(tx *dbWrapper, i *messengertypes.Interaction, payload proto.Message) (string, error) {
+	return checkReactionTarget(tx, i.GetConversationPublicKey(), payload.(*messengertypes.AppMessage_UserReaction).GetTarget())
+}
+
+// checkPollCloseRule only accepts the close of a poll from the device which created it, the close of a poll not
+// received yet is kept until it is
+func checkPollCloseRule(tx *dbWrapper, i *messengertypes.Interaction, payload proto.Message) (string, error) {
+	poll, err := tx.getPoll(payload.(*messengertypes.AppMessage_PollClose).GetPollCID())
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	if poll.GetSentDate() != 0 && poll.GetDevicePublicKey() != i.GetDevicePublicKey() {
+		return "the poll was created by another device", nil
+	}
+
+	return "", nil
+}
+
+// checkQuoteFormatRule rejects the replies with a malformed quote, a quote not matching the quoted message is kept and
+// marked as tampered since the members which haven't received the message can't check it
+func checkQuoteFormatRule(_ *dbWrapper, _ *messengertypes.Interaction, payload proto.Message) (string, error) {
+	if err := payload.(*messengertypes.AppMessage_UserMessage).CheckQuote(); err != nil {
+		return "the quote is malformed", nil
+	}
+
+	return "", nil
+}
+
+// checkInteractionRetractRule only accepts the retraction of a message by its sender, the retraction of a message not
+// received yet is kept until it is
+func checkInteractionRetractRule(tx *dbWrapper, i *messengertypes.Interaction, payload proto.Message) (string, error) {
+	target, err := tx.getInteractionByCID(payload.(*messengertypes.AppMessage_InteractionRetract).GetTarget())
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+
+	if target.GetConversationPublicKey() != i.GetConversationPublicKey() {
+		return "the target is in another conversation", nil
+	}
+
+	if target.GetType() >= localAppMessageTypesStart {
+		return "the target is a system event", nil
+	}
+
+	if target.GetIsMe() != i.GetIsMe() || target.GetMemberPublicKey() != i.GetMemberPublicKey() {
+		return "the target was sent by another member", nil
+	}
+
+	return "", nil
+}
+
+// appMessageValidationStats counts the app messages rejected by each rule since the messenger started
+type appMessageValidationStats struct {
+	mu       sync.Mutex
+	rejected map[string]int64
+}
+
+func newAppMessageValidationStats() *appMessageValidationStats {
+	return &appMessageValidationStats{rejected: map[string]int64{}}
+}
+
+func (s *appMessageValidationStats) reject(rule string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejected[rule]++
+}
+
+func (s *appMessageValidationStats) snapshot() *messengertypes.SystemInfo_Validation {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &messengertypes.SystemInfo_Validation{}
+	for rule, rejected := range s.rejected {
+		stats.Rejected += rejected
+		stats.Rules = append(stats.Rules, &messengertypes.SystemInfo_Validation_Rule{Name: rule, Rejected: rejected})
+	}
+
+	sort.Slice(stats.Rules, func(i, j int) bool { return stats.Rules[i].GetName() < stats.Rules[j].GetName() })
+
+	return stats
+}
@@ -0,0 +1,71 @@
+package bertymessenger
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/messengertypes"
+)
+
+func Test_validateAppMessage(t *testing.T) {
+	db, dispose := getInMemoryTestDB(t)
+	defer dispose()
+
+	for _, i := range []*messengertypes.Interaction{
+		{CID: "message_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "message_2", ConversationPublicKey: "conv_2", Type: messengertypes.AppMessage_TypeUserMessage},
+		{CID: "system_1", ConversationPublicKey: "conv_1", Type: messengertypes.AppMessage_TypeSystemEvent},
+	} {
+		require.NoError(t, db.db.Create(i).Error)
+	}
+	require.NoError(t, db.db.Create(testPoll(false)).Error)
+
+	validate := func(i *messengertypes.Interaction, payload proto.Message) string {
+		t.Helper()
+
+		i.ConversationPublicKey = "conv_1"
+		err := validateAppMessage(db, i, payload)
+		if err == nil {
+			return ""
+		}
+
+		rejection, ok := err.(*appMessageRejection)
+		require.True(t, ok, err)
+		return rejection.rule
+	}
+
+	reaction := &messengertypes.Interaction{Type: messengertypes.AppMessage_TypeUserReaction}
+	require.Empty(t, validate(reaction, &messengertypes.AppMessage_UserReaction{Target: "message_1", Emoji: "+1"}))
+
+	// the reactions to an interaction not received yet are kept
+	require.Empty(t, validate(reaction, &messengertypes.AppMessage_UserReaction{Target: "unknown", Emoji: "+1"}))
+
+	require.Equal(t, "reaction-target", validate(reaction, &messengertypes.AppMessage_UserReaction{Target: "system_1", Emoji: "+1"}))
+	require.Equal(t, "reaction-target", validate(reaction, &messengertypes.AppMessage_UserReaction{Target: "message_2", Emoji: "+1"}))
+
+	// only the author of a poll closes it
+	require.Empty(t, validate(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypePollClose, DevicePublicKey: "author"}, &messengertypes.AppMessage_PollClose{PollCID: "poll_1"}))
+	require.Equal(t, "poll-close-author", validate(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypePollClose, DevicePublicKey: "other"}, &messengertypes.AppMessage_PollClose{PollCID: "poll_1"}))
+	require.Empty(t, validate(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypePollClose, DevicePublicKey: "other"}, &messengertypes.AppMessage_PollClose{PollCID: "poll_2"}))
+
+	// the types without rules are always handled
+	require.Empty(t, validate(&messengertypes.Interaction{Type: messengertypes.AppMessage_TypeUserMessage}, &messengertypes.AppMessage_UserMessage{}))
+}
+
+func Test_appMessageValidationStats(t *testing.T) {
+	var stats *appMessageValidationStats
+	require.Nil(t, stats.snapshot())
+
+	stats = newAppMessageValidationStats()
+	stats.reject("reaction-target")
+	stats.reject("reaction-target")
+	stats.reject("poll-close-author")
+
+	snapshot := stats.snapshot()
+	require.Equal(t, int64(3), snapshot.GetRejected())
+	require.Len(t, snapshot.GetRules(), 2)
+	require.Equal(t, "poll-close-author", snapshot.GetRules()[0].GetName())
+	require.Equal(t, int64(2), snapshot.GetRules()[1].GetRejected())
+}
@@ -3,6 +3,7 @@ package bertyprotocol
 import (
 	"context"
 
+	"berty.tech/berty/v2/go/internal/tracer"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
 )
@@ -26,6 +27,10 @@ func (s *service) AppMessageSend(ctx context.Context, req *protocoltypes.AppMess
 		return nil, errcode.ErrGroupMissing.Wrap(err)
 	}
 
+	// the span context is injected in the headers of the message, the receiving devices continue its trace
+	ctx, span := tracer.From(ctx).Start(ctx, "Append Group Message")
+	defer span.End()
+
 	if _, err := g.MessageStore().AddMessage(ctx, req.Payload, req.GetAttachmentCIDs()); err != nil {
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
 	}
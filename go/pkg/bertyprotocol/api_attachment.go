@@ -1,12 +1,18 @@
 package bertyprotocol
 
 import (
+	"context"
 	"errors"
+	"sync"
+	"time"
 
 	ipfscid "github.com/ipfs/go-cid"
 	ipfsfiles "github.com/ipfs/go-ipfs-files"
 	ipfsoptions "github.com/ipfs/interface-go-ipfs-core/options"
 	ipfspath "github.com/ipfs/interface-go-ipfs-core/path"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"go.uber.org/zap"
 
 	"berty.tech/berty/v2/go/internal/streamutil"
 	"berty.tech/berty/v2/go/pkg/errcode"
@@ -78,6 +84,9 @@ func (s *service) AttachmentRetrieve(req *protocoltypes.AttachmentRetrieve_Reque
 		return errcode.ErrKeystoreGet.Wrap(err)
 	}
 
+	// the peers known to hold the blocks are connected so they can provide them when the author of the attachment is offline
+	s.connectAttachmentProviders(stream.Context(), req.GetProviderPeerIDs())
+
 	// open ciphertext reader
 	ipfsNode, err := s.ipfsCoreAPI.Unixfs().Get(stream.Context(), ipfspath.IpfsPath(cid))
 	if err != nil {
@@ -105,6 +114,42 @@ func (s *service) AttachmentRetrieve(req *protocoltypes.AttachmentRetrieve_Reque
 	return nil
 }
 
+func (s *service) AttachmentRemove(ctx context.Context, req *protocoltypes.AttachmentRemove_Request) (*protocoltypes.AttachmentRemove_Reply, error) {
+	cid, err := ipfscid.Cast(req.GetAttachmentCID())
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	// the attachments prepared by this device are pinned
+	if err := s.ipfsCoreAPI.Pin().Rm(ctx, ipfspath.IpfsPath(cid), ipfsoptions.Pin.RmRecursive(true)); err != nil {
+		s.logger.Debug("attachment not pinned", zap.String("cid", cid.String()), zap.Error(err))
+	}
+
+	// only the blocks available locally are walked, nothing is fetched from the network
+	offline, err := s.ipfsCoreAPI.WithOptions(ipfsoptions.Api.Offline(true))
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	cids := []ipfscid.Cid{cid}
+	for len(cids) > 0 {
+		c := cids[len(cids)-1]
+		cids = cids[:len(cids)-1]
+
+		if node, err := offline.Dag().Get(ctx, c); err == nil {
+			for _, link := range node.Links() {
+				cids = append(cids, link.Cid)
+			}
+		}
+
+		if err := offline.Block().Rm(ctx, ipfspath.IpfsPath(c)); err != nil {
+			s.logger.Debug("unable to remove attachment block", zap.String("cid", c.String()), zap.Error(err))
+		}
+	}
+
+	return &protocoltypes.AttachmentRemove_Reply{}, nil
+}
+
 func attachmentForcePin(settings *ipfsoptions.UnixfsAddSettings) error {
 	if settings == nil {
 		return errcode.ErrInvalidInput.Wrap(errors.New("nil ipfs settings"))
@@ -112,3 +157,41 @@ func attachmentForcePin(settings *ipfsoptions.UnixfsAddSettings) error {
 	settings.Pin = true
 	return nil
 }
+
+// attachmentProviderConnectTimeout bounds the time spent connecting to each of the peers providing an attachment
+const attachmentProviderConnectTimeout = 10 * time.Second
+
+// connectAttachmentProviders connects to the peers holding the blocks of an attachment at once, the peers which can't
+// be reached are ignored, the blocks are then fetched from any of the connected peers
+func (s *service) connectAttachmentProviders(ctx context.Context, peerIDs []string) {
+	if s.host == nil {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for _, rawID := range peerIDs {
+		id, err := peer.Decode(rawID)
+		if err != nil {
+			s.logger.Debug("ignoring invalid attachment provider", zap.String("peer-id", rawID), zap.Error(err))
+			continue
+		}
+
+		if id == s.host.ID() || s.host.Network().Connectedness(id) == network.Connected {
+			continue
+		}
+
+		wg.Add(1)
+		go func(id peer.ID) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, attachmentProviderConnectTimeout)
+			defer cancel()
+
+			if err := s.host.Connect(ctx, peer.AddrInfo{ID: id}); err != nil {
+				s.logger.Debug("unable to connect to attachment provider", zap.String("peer-id", id.String()), zap.Error(err))
+			}
+		}(id)
+	}
+
+	wg.Wait()
+}
@@ -2,13 +2,19 @@ package bertyprotocol
 
 import (
 	"context"
+	"time"
 
 	"github.com/libp2p/go-libp2p-core/crypto"
+	"go.uber.org/zap"
 
+	"berty.tech/berty/v2/go/internal/ipfsutil"
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
 )
 
+// connectionHintTimeout bounds the dial of each connection hint of a contact request
+const connectionHintTimeout = 10 * time.Second
+
 // ContactRequestReference retrieves the necessary information to create a contact link
 func (s *service) ContactRequestReference(context.Context, *protocoltypes.ContactRequestReference_Request) (*protocoltypes.ContactRequestReference_Reply, error) {
 	enabled, shareableContact := s.accountGroup.MetadataStore().GetIncomingContactRequestsStatus()
@@ -80,9 +86,31 @@ func (s *service) ContactRequestSend(ctx context.Context, req *protocoltypes.Con
 		return nil, errcode.ErrOrbitDBAppend.Wrap(err)
 	}
 
+	// the request itself is sent once the contact is found on the rendezvous points
+	if len(req.ConnectionHints) > 0 {
+		go s.connectToHints(req.ConnectionHints)
+	}
+
 	return &protocoltypes.ContactRequestSend_Reply{}, nil
 }
 
+// connectToHints dials the peers of the connection hints of a contact, the contact is found sooner through a rendezvous
+// point or a relay already connected. The unreachable hints are ignored
+func (s *service) connectToHints(hints []string) {
+	for _, hint := range hints {
+		ctx, cancel := context.WithTimeout(s.ctx, connectionHintTimeout)
+		info, err := ipfsutil.ParseAndResolveIpfsAddr(ctx, hint)
+		if err == nil {
+			err = s.ipfsCoreAPI.Swarm().Connect(ctx, *info)
+		}
+		cancel()
+
+		if err != nil {
+			s.logger.Debug("unable to connect to connection hint", zap.String("hint", hint), zap.Error(err))
+		}
+	}
+}
+
 // ContactRequestAccept accepts a contact request
 func (s *service) ContactRequestAccept(ctx context.Context, req *protocoltypes.ContactRequestAccept_Request) (*protocoltypes.ContactRequestAccept_Reply, error) {
 	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPK)
@@ -0,0 +1,133 @@
+package bertyprotocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/cryptoutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+const (
+	ephemeralTopicPrefix = "/berty/ephemeral/1.0.0/"
+
+	// ephemeralMinDataSize is the size of the gcm nonce and tag surrounding the encrypted envelope
+	ephemeralMinDataSize = 12 + 16
+)
+
+// ephemeralTopicAndKey derives the pubsub topic and the encryption key of the ephemeral channel of a group from its secret,
+// so only its members can find and read it
+func ephemeralTopicAndKey(g *protocoltypes.Group) (string, []byte) {
+	topic := cryptoutil.ConcatAndHashSha256(g.GetSecret(), []byte("ephemeral-topic"))
+	key := cryptoutil.ConcatAndHashSha256(g.GetSecret(), []byte("ephemeral-key"))
+
+	return ephemeralTopicPrefix + hex.EncodeToString(topic[:]), key[:]
+}
+
+func (s *service) GroupEphemeralSend(ctx context.Context, req *protocoltypes.GroupEphemeralSend_Request) (*protocoltypes.GroupEphemeralSend_Reply, error) {
+	cg, err := s.getContextGroupForID(req.GroupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	memberPK, err := cg.MemberPubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	devicePK, err := cg.DevicePubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	envelope, err := proto.Marshal(&protocoltypes.GroupEphemeralEnvelope{MemberPK: memberPK, DevicePK: devicePK, Payload: req.GetPayload()})
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	topic, key := ephemeralTopicAndKey(cg.Group())
+
+	data, err := cryptoutil.AESGCMEncrypt(key, envelope)
+	if err != nil {
+		return nil, errcode.ErrCryptoEncrypt.Wrap(err)
+	}
+
+	if err := s.ipfsCoreAPI.PubSub().Publish(ctx, topic, data); err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return &protocoltypes.GroupEphemeralSend_Reply{}, nil
+}
+
+func (s *service) GroupEphemeralSubscribe(req *protocoltypes.GroupEphemeralSubscribe_Request, sub protocoltypes.ProtocolService_GroupEphemeralSubscribeServer) error {
+	cg, err := s.getContextGroupForID(req.GroupPK)
+	if err != nil {
+		return errcode.ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	ownDevicePK, err := cg.DevicePubKey().Raw()
+	if err != nil {
+		return errcode.ErrSerialization.Wrap(err)
+	}
+
+	topic, key := ephemeralTopicAndKey(cg.Group())
+
+	psub, err := s.ipfsCoreAPI.PubSub().Subscribe(sub.Context(), topic)
+	if err != nil {
+		return errcode.ErrInternal.Wrap(err)
+	}
+	defer psub.Close()
+
+	for {
+		msg, err := psub.Next(sub.Context())
+		if err != nil {
+			if sub.Context().Err() != nil {
+				return nil
+			}
+			return errcode.ErrInternal.Wrap(err)
+		}
+
+		envelope, err := openEphemeralEnvelope(key, msg.Data())
+		if err != nil {
+			s.logger.Debug("unable to open ephemeral payload", zap.Error(err))
+			continue
+		}
+
+		// the payloads sent by the current device are not forwarded
+		if bytes.Equal(envelope.GetDevicePK(), ownDevicePK) {
+			continue
+		}
+
+		if err := sub.Send(&protocoltypes.GroupEphemeralEvent{
+			GroupPK:  req.GroupPK,
+			MemberPK: envelope.GetMemberPK(),
+			DevicePK: envelope.GetDevicePK(),
+			Payload:  envelope.GetPayload(),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func openEphemeralEnvelope(key, data []byte) (*protocoltypes.GroupEphemeralEnvelope, error) {
+	if len(data) < ephemeralMinDataSize {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	clear, err := cryptoutil.AESGCMDecrypt(key, data)
+	if err != nil {
+		return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+	}
+
+	envelope := &protocoltypes.GroupEphemeralEnvelope{}
+	if err := proto.Unmarshal(clear, envelope); err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	return envelope, nil
+}
@@ -94,6 +94,33 @@ func (s *service) DeactivateGroup(_ context.Context, req *protocoltypes.Deactiva
 	return &protocoltypes.DeactivateGroup_Reply{}, nil
 }
 
+func (s *service) GroupDeviceSecretRotate(ctx context.Context, req *protocoltypes.GroupDeviceSecretRotate_Request) (*protocoltypes.GroupDeviceSecretRotate_Reply, error) {
+	cg, err := s.getContextGroupForID(req.GroupPK)
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	excluded := make([]crypto.PubKey, len(req.ExcludedMemberPKs))
+	for i, raw := range req.ExcludedMemberPKs {
+		if excluded[i], err = crypto.UnmarshalEd25519PublicKey(raw); err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+	}
+
+	for _, pk := range excluded {
+		if pk.Equals(cg.MemberPubKey()) {
+			return nil, errcode.ErrInvalidInput.Wrap(errors.New("the local member can't be excluded"))
+		}
+	}
+
+	count, err := cg.MetadataStore().RotateSecret(ctx, excluded)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	return &protocoltypes.GroupDeviceSecretRotate_Reply{MembersCount: int64(count)}, nil
+}
+
 func (s *service) MonitorGroup(req *protocoltypes.MonitorGroup_Request, srv protocoltypes.ProtocolService_MonitorGroupServer) error {
 	g, err := s.getContextGroupForID(req.GroupPK)
 	if err != nil {
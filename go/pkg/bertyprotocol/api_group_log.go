@@ -0,0 +1,320 @@
+package bertyprotocol
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+
+	"berty.tech/berty/v2/go/internal/streamutil"
+	"berty.tech/berty/v2/go/pkg/errcode"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+	ipfslogentry "berty.tech/go-ipfs-log/entry"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/stores/operation"
+)
+
+const (
+	groupLogImportTimeout      = 30 * time.Second
+	groupLogImportPollInterval = 100 * time.Millisecond
+
+	groupLogEntriesSigPrefix = "berty group log entries"
+)
+
+// GroupLogExport uses the format of the account export restricted to the entries and the heads of a group, the archive
+// holds no key and can only be read by the members of the group
+func (s *service) GroupLogExport(req *protocoltypes.GroupLogExport_Request, server protocoltypes.ProtocolService_GroupLogExportServer) error {
+	gc, err := s.getContextGroupForID(req.GetGroupPK())
+	if err != nil {
+		return errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	go func() {
+		tw := tar.NewWriter(w)
+		err := s.exportGroupContext(server.Context(), gc, tw)
+		if closeErr := tw.Close(); err == nil {
+			err = closeErr
+		}
+
+		_ = w.CloseWithError(err)
+	}()
+
+	return streamutil.FuncSink(make([]byte, 4096), r, func(block []byte) error {
+		return server.Send(&protocoltypes.GroupLogExport_Reply{ExportedData: block})
+	})
+}
+
+func (s *service) GroupLogImport(stream protocoltypes.ProtocolService_GroupLogImportServer) error {
+	archive := streamutil.FuncReader(func() ([]byte, error) {
+		msg, err := stream.Recv()
+		return msg.GetExportedData(), err
+	}, s.logger)
+	defer archive.Close()
+
+	groupPK, err := s.importGroupLog(stream.Context(), archive)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&protocoltypes.GroupLogImport_Reply{GroupPK: groupPK})
+}
+
+// importGroupLog adds the entries of an archive to the logs of its group, the group must be activated so its members can
+// decrypt them. It returns once the imported heads are loaded in the stores
+func (s *service) importGroupLog(ctx context.Context, reader io.Reader) ([]byte, error) {
+	tr := tar.NewReader(reader)
+	restoreEntry := restoreOrbitDBEntry(ctx, s.ipfsCoreAPI)
+
+	var (
+		gc                    *groupContext
+		metaCIDs, messageCIDs []cid.Cid
+	)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errcode.ErrStreamRead.Wrap(err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			s.logger.Warn("invalid entry type", zap.String("filename", header.Name), zap.Any("type", header.Typeflag))
+			continue
+		}
+
+		// the heads are written after the entries
+		if strings.HasPrefix(header.Name, exportOrbitDBHeadsPrefix) {
+			if gc != nil {
+				return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the archive holds several groups"))
+			}
+
+			heads, meta, messages, err := readExportOrbitDBGroupHeads(header.Size, tr)
+			if err != nil {
+				return nil, errcode.ErrInvalidInput.Wrap(err)
+			}
+
+			if gc, err = s.getContextGroupForID(heads.PublicKey); err != nil {
+				return nil, errcode.ErrInvalidInput.Wrap(err)
+			}
+
+			metaCIDs, messageCIDs = meta, messages
+			continue
+		}
+
+		handled, err := restoreEntry.Handler(header, tr)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		if !handled {
+			s.logger.Warn("unknown export entry", zap.String("filename", header.Name))
+		}
+	}
+
+	if gc == nil {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("no group found in the archive"))
+	}
+
+	if err := s.odb.setHeadsForGroup(ctx, gc.group, metaCIDs, messageCIDs); err != nil {
+		return nil, errcode.ErrOrbitDBAppend.Wrap(fmt.Errorf("error while importing group heads: %w", err))
+	}
+
+	if err := waitForLogHeads(ctx, gc.metadataStore, metaCIDs); err != nil {
+		return nil, err
+	}
+
+	if err := waitForLogHeads(ctx, gc.messageStore, messageCIDs); err != nil {
+		return nil, err
+	}
+
+	return gc.group.PublicKey, nil
+}
+
+// waitForLogHeads waits for the replicator of a store to join the loaded heads to its log
+func waitForLogHeads(ctx context.Context, store orbitdb.Store, heads []cid.Cid) error {
+	ctx, cancel := context.WithTimeout(ctx, groupLogImportTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(groupLogImportPollInterval)
+	defer ticker.Stop()
+
+	for {
+		loaded := true
+		for _, head := range heads {
+			if _, ok := store.OpLog().Get(head); !ok {
+				loaded = false
+				break
+			}
+		}
+
+		if loaded {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errcode.ErrInternal.Wrap(fmt.Errorf("the imported entries are not loaded: %w", ctx.Err()))
+		case <-ticker.C:
+		}
+	}
+}
+
+// groupLogEntriesSignedPayload returns the payload signed by the device exporting entries, the signature binds the
+// entries to the group and to the device
+func groupLogEntriesSignedPayload(groupPK []byte, entries [][]byte) []byte {
+	payload := append([]byte(groupLogEntriesSigPrefix), groupPK...)
+	for _, entry := range entries {
+		hash := sha256.Sum256(entry)
+		payload = append(payload, hash[:]...)
+	}
+
+	return payload
+}
+
+func (s *service) GroupLogEntriesExport(ctx context.Context, req *protocoltypes.GroupLogEntriesExport_Request) (*protocoltypes.GroupLogEntriesExport_Reply, error) {
+	gc, err := s.getContextGroupForID(req.GetGroupPK())
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	devicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	entries := make([][]byte, len(req.GetCIDs()))
+	for i, rawCID := range req.GetCIDs() {
+		id, err := cid.Cast(rawCID)
+		if err != nil {
+			return nil, errcode.ErrInvalidInput.Wrap(err)
+		}
+
+		e, ok := gc.messageStore.OpLog().Get(id)
+		if !ok {
+			return nil, errcode.ErrNotFound.Wrap(fmt.Errorf("unknown entry %s", id))
+		}
+
+		op, err := operation.ParseOperation(e)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		_, headers, err := openEnvelopeHeaders(op.GetValue(), gc.Group())
+		if err != nil {
+			return nil, errcode.ErrCryptoDecrypt.Wrap(err)
+		}
+
+		if !bytes.Equal(headers.GetDevicePK(), devicePK) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the entry %s has been sent by another device", id))
+		}
+
+		node, err := s.ipfsCoreAPI.Dag().Get(ctx, id)
+		if err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		entries[i] = node.RawData()
+	}
+
+	sig, err := gc.memberDevice.device.Sign(groupLogEntriesSignedPayload(gc.Group().GetPublicKey(), entries))
+	if err != nil {
+		return nil, errcode.ErrCryptoSignature.Wrap(err)
+	}
+
+	return &protocoltypes.GroupLogEntriesExport_Reply{DevicePK: devicePK, Entries: entries, Sig: sig}, nil
+}
+
+// GroupLogEntriesOpen only returns the messages of entries signed by the exporting device, which must be a known device
+// of a member of the group, the ids of the events are the hashes of the entries so they can't be replaced
+func (s *service) GroupLogEntriesOpen(ctx context.Context, req *protocoltypes.GroupLogEntriesOpen_Request) (*protocoltypes.GroupLogEntriesOpen_Reply, error) {
+	gc, err := s.getContextGroupForID(req.GetGroupPK())
+	if err != nil {
+		return nil, errcode.ErrGroupMissing.Wrap(err)
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(req.GetDevicePK())
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := gc.metadataStore.GetMemberByDevice(devicePK); err != nil {
+		return nil, errcode.ErrGroupMemberUnknownGroupID.Wrap(fmt.Errorf("the device isn't a device of a member of the group: %w", err))
+	}
+
+	if ok, err := devicePK.Verify(groupLogEntriesSignedPayload(gc.Group().GetPublicKey(), req.GetEntries()), req.GetSig()); err != nil || !ok {
+		return nil, errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("the entries aren't signed by the device"))
+	}
+
+	sigPK, err := gc.Group().GetSigningPubKey()
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	sigPKRaw, err := sigPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	sigPKBytes, err := crypto.MarshalPublicKey(sigPK)
+	if err != nil {
+		return nil, errcode.ErrSerialization.Wrap(err)
+	}
+
+	provider := s.odb.keyStore.getIdentityProvider()
+	events := make([]*protocoltypes.GroupMessageEvent, len(req.GetEntries()))
+
+	for i, raw := range req.GetEntries() {
+		// the cid of the entry is the hash of its block
+		node, err := cbornode.Decode(raw, mh.SHA2_256, -1)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		if err := s.ipfsCoreAPI.Dag().Add(ctx, node); err != nil {
+			return nil, errcode.ErrInternal.Wrap(err)
+		}
+
+		e, err := ipfslogentry.FromMultihash(ctx, s.ipfsCoreAPI, node.Cid(), provider)
+		if err != nil {
+			return nil, errcode.ErrDeserialization.Wrap(err)
+		}
+
+		// like the access controller of the group, the entries must be signed with the signing key of the group
+		if e.GetIdentity().ID != hex.EncodeToString(sigPKRaw) || !bytes.Equal(e.GetKey(), sigPKBytes) {
+			return nil, errcode.ErrGroupMemberLogEventSignature.Wrap(fmt.Errorf("the entry %s isn't signed by the group", node.Cid()))
+		}
+
+		if err := e.Verify(provider); err != nil {
+			return nil, errcode.ErrGroupMemberLogEventSignature.Wrap(err)
+		}
+
+		// the message is opened with the keys of its device and its signature is checked
+		evt, err := gc.messageStore.openMessage(ctx, e, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.Equal(evt.GetHeaders().GetDevicePK(), req.GetDevicePK()) {
+			return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("the entry %s has been sent by another device", node.Cid()))
+		}
+
+		events[i] = evt
+	}
+
+	return &protocoltypes.GroupLogEntriesOpen_Reply{Events: events}, nil
+}
@@ -0,0 +1,149 @@
+package bertyprotocol
+
+import (
+	"archive/tar"
+	"bytes"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/internal/testutil"
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func TestUnstableGroupLogImport(t *testing.T) {
+	testutil.FilterStability(t, testutil.Unstable)
+
+	ctx, cancel, mn, rdvPeer := testHelperIPFSSetUp(t)
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	archive := new(bytes.Buffer)
+	expectedMessages := map[cid.Cid][]byte{}
+
+	{
+		nodeA, closeNodeA := NewTestingProtocol(ctx, t, &TestingOpts{
+			Mocknet: mn,
+			RDVPeer: rdvPeer.Peerstore().PeerInfo(rdvPeer.ID()),
+		}, dsync.MutexWrap(ds.NewMapDatastore()))
+
+		_, err = nodeA.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+		require.NoError(t, err)
+
+		_, err = nodeA.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPK: g.PublicKey})
+		require.NoError(t, err)
+
+		serviceA, ok := nodeA.Service.(*service)
+		require.True(t, ok)
+
+		gc := serviceA.openedGroups[string(g.PublicKey)]
+		for _, payload := range [][]byte{[]byte("testMessage1"), []byte("testMessage2")} {
+			op, err := gc.messageStore.AddMessage(ctx, payload, nil)
+			require.NoError(t, err)
+
+			expectedMessages[op.GetEntry().GetHash()] = payload
+		}
+
+		tw := tar.NewWriter(archive)
+		require.NoError(t, serviceA.exportGroupContext(ctx, gc, tw))
+		require.NoError(t, tw.Close())
+
+		closeNodeA()
+	}
+
+	nodeB, closeNodeB := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet: mn,
+		RDVPeer: rdvPeer.Peerstore().PeerInfo(rdvPeer.ID()),
+	}, dsync.MutexWrap(ds.NewMapDatastore()))
+	defer closeNodeB()
+
+	serviceB, ok := nodeB.Service.(*service)
+	require.True(t, ok)
+
+	// the group must be known to import its logs
+	_, err = serviceB.importGroupLog(ctx, bytes.NewReader(archive.Bytes()))
+	require.Error(t, err)
+
+	_, err = nodeB.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = nodeB.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPK: g.PublicKey})
+	require.NoError(t, err)
+
+	groupPK, err := serviceB.importGroupLog(ctx, bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, g.PublicKey, groupPK)
+
+	for c := range expectedMessages {
+		_, ok := serviceB.openedGroups[string(g.PublicKey)].messageStore.OpLog().Get(c)
+		require.True(t, ok)
+	}
+}
+
+func TestGroupLogEntriesOpen(t *testing.T) {
+	ctx, cancel, mn, rdvPeer := testHelperIPFSSetUp(t)
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	node, closeNode := NewTestingProtocol(ctx, t, &TestingOpts{
+		Mocknet: mn,
+		RDVPeer: rdvPeer.Peerstore().PeerInfo(rdvPeer.ID()),
+	}, dsync.MutexWrap(ds.NewMapDatastore()))
+	defer closeNode()
+
+	_, err = node.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = node.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPK: g.PublicKey})
+	require.NoError(t, err)
+
+	s, ok := node.Service.(*service)
+	require.True(t, ok)
+
+	gc := s.openedGroups[string(g.PublicKey)]
+	op, err := gc.messageStore.AddMessage(ctx, []byte("testMessage"), nil)
+	require.NoError(t, err)
+
+	id := op.GetEntry().GetHash()
+	exported, err := node.Client.GroupLogEntriesExport(ctx, &protocoltypes.GroupLogEntriesExport_Request{GroupPK: g.PublicKey, CIDs: [][]byte{id.Bytes()}})
+	require.NoError(t, err)
+	require.Len(t, exported.GetEntries(), 1)
+
+	req := &protocoltypes.GroupLogEntriesOpen_Request{GroupPK: g.PublicKey, DevicePK: exported.GetDevicePK(), Entries: exported.GetEntries(), Sig: exported.GetSig()}
+	opened, err := node.Client.GroupLogEntriesOpen(ctx, req)
+	require.NoError(t, err)
+	require.Len(t, opened.GetEvents(), 1)
+	require.Equal(t, id.Bytes(), opened.GetEvents()[0].GetEventContext().GetID())
+	require.Equal(t, []byte("testMessage"), opened.GetEvents()[0].GetMessage())
+
+	// the entries must be signed by the device
+	altered := *req
+	altered.Sig = append([]byte{}, req.GetSig()...)
+	altered.Sig[0] ^= 1
+	_, err = node.Client.GroupLogEntriesOpen(ctx, &altered)
+	require.Error(t, err)
+
+	// the device must be a device of a member of the group
+	_, otherPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	altered = *req
+	altered.DevicePK, err = otherPK.Raw()
+	require.NoError(t, err)
+	_, err = node.Client.GroupLogEntriesOpen(ctx, &altered)
+	require.Error(t, err)
+
+	// an altered entry doesn't match the signature
+	altered = *req
+	altered.Entries = [][]byte{append(append([]byte{}, req.GetEntries()[0]...), 0)}
+	_, err = node.Client.GroupLogEntriesOpen(ctx, &altered)
+	require.Error(t, err)
+}
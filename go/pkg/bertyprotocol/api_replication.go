@@ -24,13 +24,59 @@ func (s *service) ReplicationServiceRegisterGroup(ctx context.Context, request *
 		return nil, errcode.TODO.Wrap(err)
 	}
 
-	token, err := s.accountGroup.metadataStore.getServiceToken(request.TokenID)
+	token, endpoint, cc, err := s.dialReplicationService(request.TokenID)
 	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+
+	client := NewReplicationServiceClient(cc)
+
+	if _, err = client.ReplicateGroup(ctx, &protocoltypes.ReplicationServiceReplicateGroup_Request{
+		Group: replGroup,
+	}); err != nil {
+		return nil, errcode.ErrServiceReplicationServer.Wrap(err)
+	}
+
+	s.logger.Info("group will be replicated", zap.String("public-key", base64.RawURLEncoding.EncodeToString(request.GroupPK)))
+
+	if _, err := gc.metadataStore.SendGroupReplicating(ctx, token, endpoint); err != nil {
+		s.logger.Error("error while notifying group about replication", zap.Error(err))
+	}
+
+	return &protocoltypes.ReplicationServiceRegisterGroup_Reply{}, nil
+}
+
+func (s *service) ReplicationServiceGroupStatus(ctx context.Context, request *protocoltypes.ReplicationServiceGroupStatus_Request) (*protocoltypes.ReplicationServiceGroupStatus_Reply, error) {
+	if _, err := s.getContextGroupForID(request.GroupPK); err != nil {
 		return nil, errcode.ErrInvalidInput.Wrap(err)
 	}
 
+	_, _, cc, err := s.dialReplicationService(request.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+
+	reply, err := NewReplicationServiceClient(cc).GroupHeads(ctx, &protocoltypes.ReplicationServiceGroupHeads_Request{
+		GroupPK: request.GroupPK,
+	})
+	if err != nil {
+		return nil, errcode.ErrServiceReplicationServer.Wrap(err)
+	}
+
+	return &protocoltypes.ReplicationServiceGroupStatus_Reply{MessageHeads: reply.MessageHeads}, nil
+}
+
+// dialReplicationService opens a connection to the replication service of a token, the caller must close it
+func (s *service) dialReplicationService(tokenID string) (*protocoltypes.ServiceToken, string, *grpc.ClientConn, error) {
+	token, err := s.accountGroup.metadataStore.getServiceToken(tokenID)
+	if err != nil {
+		return nil, "", nil, errcode.ErrInvalidInput.Wrap(err)
+	}
+
 	if token == nil {
-		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+		return nil, "", nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
 	}
 
 	endpoint := ""
@@ -44,7 +90,7 @@ func (s *service) ReplicationServiceRegisterGroup(ctx context.Context, request *
 	}
 
 	if endpoint == "" {
-		return nil, errcode.ErrServiceReplicationMissingEndpoint
+		return nil, "", nil, errcode.ErrServiceReplicationMissingEndpoint
 	}
 
 	cc, err := grpc.Dial(endpoint, []grpc.DialOption{
@@ -52,22 +98,8 @@ func (s *service) ReplicationServiceRegisterGroup(ctx context.Context, request *
 		grpc.WithInsecure(), // TODO: remove this, enforce security
 	}...)
 	if err != nil {
-		return nil, errcode.ErrStreamWrite.Wrap(err)
+		return nil, "", nil, errcode.ErrStreamWrite.Wrap(err)
 	}
 
-	client := NewReplicationServiceClient(cc)
-
-	if _, err = client.ReplicateGroup(ctx, &protocoltypes.ReplicationServiceReplicateGroup_Request{
-		Group: replGroup,
-	}); err != nil {
-		return nil, errcode.ErrServiceReplicationServer.Wrap(err)
-	}
-
-	s.logger.Info("group will be replicated", zap.String("public-key", base64.RawURLEncoding.EncodeToString(request.GroupPK)))
-
-	if _, err := gc.metadataStore.SendGroupReplicating(ctx, token, endpoint); err != nil {
-		s.logger.Error("error while notifying group about replication", zap.Error(err))
-	}
-
-	return &protocoltypes.ReplicationServiceRegisterGroup_Reply{}, nil
+	return token, endpoint, cc, nil
 }
@@ -41,7 +41,7 @@ var eventTypesMapper = map[protocoltypes.EventType]struct {
 	protocoltypes.EventTypeGroupReplicating:                       {Message: &protocoltypes.GroupReplicating{}, SigChecker: sigCheckerDeviceSigned},
 }
 
-func newEventContext(eventID cid.Cid, parentIDs []cid.Cid, g *protocoltypes.Group, attachmentsCIDs [][]byte) *protocoltypes.EventContext {
+func newEventContext(eventID cid.Cid, parentIDs []cid.Cid, lamportTime int, g *protocoltypes.Group, attachmentsCIDs [][]byte) *protocoltypes.EventContext {
 	parentIDsBytes := make([][]byte, len(parentIDs))
 	for i, parentID := range parentIDs {
 		parentIDsBytes[i] = parentID.Bytes()
@@ -52,6 +52,7 @@ func newEventContext(eventID cid.Cid, parentIDs []cid.Cid, g *protocoltypes.Grou
 		ParentIDs:      parentIDsBytes,
 		GroupPK:        g.PublicKey,
 		AttachmentCIDs: attachmentsCIDs,
+		LamportTime:    uint64(lamportTime),
 	}
 }
 
@@ -92,7 +93,7 @@ func newGroupMetadataEventFromEntry(log ipfslog.Log, e ipfslog.Entry, metadata *
 		return nil, errcode.ErrSerialization
 	}
 
-	evtCtx := newEventContext(e.GetHash(), getParentsForCID(log, e.GetHash()), g, attachmentsCIDs)
+	evtCtx := newEventContext(e.GetHash(), getParentsForCID(log, e.GetHash()), e.GetClock().GetTime(), g, attachmentsCIDs)
 
 	gme := protocoltypes.GroupMetadataEvent{
 		EventContext: evtCtx,
@@ -1,7 +1,9 @@
 package bertyprotocol
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"fmt"
 	"sync"
 
@@ -188,6 +190,49 @@ func (m *messageKeystore) RegisterChainKey(g *protocoltypes.Group, devicePK cryp
 	return m.registerChainKey(g, devicePK, ds, isOwnPK)
 }
 
+// RotateDeviceSecret replaces the secret of the local device for a group by a new chain key, the counter of the new
+// secret starts after the keys the other members have precomputed for the previous one so both can be used to open
+// the messages
+func (m *messageKeystore) RotateDeviceSecret(g *protocoltypes.Group, acc DeviceKeystore) (*protocoltypes.DeviceSecret, error) {
+	if m == nil {
+		return nil, errcode.ErrInvalidInput
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	md, err := acc.MemberDeviceForGroup(g)
+	if err != nil {
+		return nil, errcode.ErrInternal.Wrap(err)
+	}
+
+	groupPK, err := g.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrDeserialization.Wrap(err)
+	}
+
+	current, err := m.getDeviceChainKey(groupPK, md.device.GetPublic())
+	if err != nil {
+		return nil, errcode.ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	chainKey := make([]byte, 32)
+	if _, err := crand.Read(chainKey); err != nil {
+		return nil, errcode.ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	ds := &protocoltypes.DeviceSecret{
+		ChainKey: chainKey,
+		Counter:  current.Counter + uint64(m.getPrecomputedKeyExpectedCount()) + 1,
+	}
+
+	if err := m.putDeviceChainKey(groupPK, md.device.GetPublic(), ds); err != nil {
+		return nil, errcode.ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return ds, nil
+}
+
 func (m *messageKeystore) registerChainKey(g *protocoltypes.Group, devicePK crypto.PubKey, ds *protocoltypes.DeviceSecret, isOwnPK bool) error {
 	if m == nil {
 		return errcode.ErrInvalidInput
@@ -198,9 +243,11 @@ func (m *messageKeystore) registerChainKey(g *protocoltypes.Group, devicePK cryp
 		return errcode.ErrDeserialization.Wrap(err)
 	}
 
-	if _, err := m.getDeviceChainKey(groupPK, devicePK); err == nil {
-		// device is already registered, ignore it
-		return nil
+	if known, err := m.getDeviceChainKey(groupPK, devicePK); err == nil {
+		// device is already registered, ignore it unless its secret has been rotated
+		if isOwnPK || ds.Counter <= known.Counter || bytes.Equal(ds.ChainKey, known.ChainKey) {
+			return nil
+		}
 	}
 
 	// If own device store key as is, no need to precompute future keys
@@ -373,6 +420,12 @@ func (m *messageKeystore) OpenEnvelope(ctx context.Context, g *protocoltypes.Gro
 		return headers, nil, nil, errcode.ErrCryptoDecryptPayload.Wrap(err)
 	}
 
+	// the keys of the device are shared with the members of the group, only the signature proves that the device wrote
+	// the message
+	if err := verifyPayloadSignature(headers, msgBytes); err != nil {
+		return nil, nil, nil, err
+	}
+
 	if err := m.postDecryptActions(decryptInfo, g, ownPK, headers); err != nil {
 		return nil, nil, nil, errcode.TODO.Wrap(err)
 	}
@@ -0,0 +1,72 @@
+package bertyprotocol
+
+import (
+	"context"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	keystore "github.com/ipfs/go-ipfs-keystore"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/berty/v2/go/pkg/protocoltypes"
+)
+
+func Test_RotateDeviceSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	acc1 := NewDeviceKeystore(keystore.NewMemKeystore())
+	omd1, err := acc1.MemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	acc2 := NewDeviceKeystore(keystore.NewMemKeystore())
+	omd2, err := acc2.MemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	mkh1, cleanup := newInMemMessageKeystore()
+	defer cleanup()
+
+	mkh2, cleanup := newInMemMessageKeystore()
+	defer cleanup()
+
+	ds1, err := mkh1.GetDeviceSecret(g, acc1)
+	require.NoError(t, err)
+	require.NoError(t, mkh2.RegisterChainKey(g, omd1.device.GetPublic(), ds1, false))
+
+	ds2, err := mkh1.RotateDeviceSecret(g, acc1)
+	require.NoError(t, err)
+	require.NotEqual(t, ds1.ChainKey, ds2.ChainKey)
+	require.Equal(t, ds1.Counter+uint64(mkh1.getPrecomputedKeyExpectedCount())+1, ds2.Counter)
+	require.Equal(t, ds2, mustDeviceSecret(t)(mkh1.getDeviceChainKey(gPK, omd1.device.GetPublic())))
+
+	// the messages sealed with the new secret are only opened once it is received
+	payload, err := (&protocoltypes.EncryptedMessage{Plaintext: []byte("after rotation")}).Marshal()
+	require.NoError(t, err)
+
+	env, err := mkh1.SealEnvelope(ctx, g, omd1.device, payload, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = mkh2.OpenEnvelope(ctx, g, omd2.device.GetPublic(), env, cid.Undef)
+	require.Error(t, err)
+
+	require.NoError(t, mkh2.RegisterChainKey(g, omd1.device.GetPublic(), ds2, false))
+
+	_, msg, _, err := mkh2.OpenEnvelope(ctx, g, omd2.device.GetPublic(), env, cid.Undef)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after rotation"), msg.Plaintext)
+
+	// the keys of the previous secret are kept for the late messages
+	_, err = mkh2.getPrecomputedKey(gPK, omd1.device.GetPublic(), ds1.Counter+1)
+	require.NoError(t, err)
+
+	// the previous secret received again doesn't replace the new one
+	require.NoError(t, mkh2.RegisterChainKey(g, omd1.device.GetPublic(), ds1, false))
+	current := mustDeviceSecret(t)(mkh2.getDeviceChainKey(gPK, omd1.device.GetPublic()))
+	require.Greater(t, current.Counter, ds2.Counter)
+}
@@ -89,6 +89,25 @@ func sealEnvelopeInternal(ctx context.Context, payload []byte, ds *protocoltypes
 	return env, nil
 }
 
+// verifyPayloadSignature checks that the payload of a message has been signed by the device of its headers
+func verifyPayloadSignature(headers *protocoltypes.MessageHeaders, payload []byte) error {
+	pk, err := crypto.UnmarshalEd25519PublicKey(headers.GetDevicePK())
+	if err != nil {
+		return errcode.ErrDeserialization.Wrap(err)
+	}
+
+	ok, err := pk.Verify(payload, headers.GetSig())
+	if err != nil {
+		return errcode.ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if !ok {
+		return errcode.ErrCryptoSignatureVerification.Wrap(fmt.Errorf("the payload isn't signed by the device"))
+	}
+
+	return nil
+}
+
 func openEnvelopeHeaders(data []byte, g *protocoltypes.Group) (*protocoltypes.MessageEnvelope, *protocoltypes.MessageHeaders, error) {
 	env := &protocoltypes.MessageEnvelope{}
 	err := env.Unmarshal(data)
@@ -299,39 +299,40 @@ func (s *BertyOrbitDB) openGroup(ctx context.Context, g *protocoltypes.Group, op
 	return gc, nil
 }
 
-func (s *BertyOrbitDB) openGroupReplication(ctx context.Context, g *protocoltypes.Group, options *orbitdb.CreateDBOptions) error {
+// openGroupReplication opens the stores of a group to replicate them, it returns the message store
+func (s *BertyOrbitDB) openGroupReplication(ctx context.Context, g *protocoltypes.Group, options *orbitdb.CreateDBOptions) (iface.Store, error) {
 	if g == nil || len(g.PublicKey) == 0 {
-		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing group or group pubkey"))
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("missing group or group pubkey"))
 	}
 
 	id := g.GroupIDAsString()
 
-	_, err := s.getGroupContext(id)
+	existingGC, err := s.getGroupContext(id)
 	if err != nil && !errcode.Is(err, errcode.ErrMissingMapKey) {
-		return errcode.ErrInternal.Wrap(err)
+		return nil, errcode.ErrInternal.Wrap(err)
 	}
 	if err == nil {
-		return nil
+		return existingGC.messageStore, nil
 	}
 
 	groupID := g.GroupIDAsString()
 	s.groups.Store(groupID, g)
 
 	if err := s.registerGroupSigningPubKey(g); err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = s.storeForGroup(ctx, s, g, options, groupMetadataStoreType, GroupOpenModeReplicate)
 	if err != nil {
-		return errors.Wrap(err, "unable to open database")
+		return nil, errors.Wrap(err, "unable to open database")
 	}
 
-	_, err = s.storeForGroup(ctx, s, g, options, groupMessageStoreType, GroupOpenModeReplicate)
+	messageStore, err := s.storeForGroup(ctx, s, g, options, groupMessageStoreType, GroupOpenModeReplicate)
 	if err != nil {
-		return errors.Wrap(err, "unable to open database")
+		return nil, errors.Wrap(err, "unable to open database")
 	}
 
-	return nil
+	return messageStore, nil
 }
 
 func (s *BertyOrbitDB) getGroupContext(id string) (*groupContext, error) {
@@ -3,6 +3,7 @@ package bertyprotocol
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
@@ -10,6 +11,7 @@ import (
 
 	"berty.tech/berty/v2/go/pkg/errcode"
 	"berty.tech/berty/v2/go/pkg/protocoltypes"
+	"berty.tech/go-orbit-db/iface"
 )
 
 const (
@@ -22,6 +24,8 @@ type replicationService struct {
 	ds     ds.Datastore
 	logger *zap.Logger
 	ctx    context.Context
+	// messageStores are the message stores of the replicated groups by group pk
+	messageStores sync.Map // map[string]iface.Store
 }
 
 func (s *replicationService) GroupRegister(token string, group *protocoltypes.Group) error {
@@ -42,7 +46,14 @@ func (s *replicationService) GroupRegister(token string, group *protocoltypes.Gr
 }
 
 func (s *replicationService) GroupSubscribe(group *protocoltypes.Group) error {
-	return s.odb.openGroupReplication(s.ctx, group, nil)
+	messageStore, err := s.odb.openGroupReplication(s.ctx, group, nil)
+	if err != nil {
+		return err
+	}
+
+	s.messageStores.Store(string(group.PublicKey), messageStore)
+
+	return nil
 }
 
 func (s *replicationService) ReplicateGroup(_ context.Context, req *protocoltypes.ReplicationServiceReplicateGroup_Request) (*protocoltypes.ReplicationServiceReplicateGroup_Reply, error) {
@@ -52,6 +63,24 @@ func (s *replicationService) ReplicateGroup(_ context.Context, req *protocoltype
 	return &protocoltypes.ReplicationServiceReplicateGroup_Reply{}, err
 }
 
+// GroupHeads returns the heads of the message log of a replicated group, the members compare them with their own log
+// to check the replication is up to date
+func (s *replicationService) GroupHeads(_ context.Context, req *protocoltypes.ReplicationServiceGroupHeads_Request) (*protocoltypes.ReplicationServiceGroupHeads_Reply, error) {
+	// TODO: retrieve auth token
+	value, ok := s.messageStores.Load(string(req.GroupPK))
+	if !ok {
+		return nil, errcode.ErrInvalidInput.Wrap(fmt.Errorf("group is not replicated"))
+	}
+
+	heads := value.(iface.Store).OpLog().RawHeads().Slice()
+	reply := &protocoltypes.ReplicationServiceGroupHeads_Reply{MessageHeads: make([]string, len(heads))}
+	for i, head := range heads {
+		reply.MessageHeads[i] = head.GetHash().String()
+	}
+
+	return reply, nil
+}
+
 func (s *replicationService) Close() error {
 	return nil
 }
@@ -122,7 +122,7 @@ func (m *messageStore) openMessage(ctx context.Context, e ipfslog.Entry, enableC
 		return nil, err
 	}
 
-	eventContext := newEventContext(e.GetHash(), e.GetNext(), m.g, attachmentsCIDs)
+	eventContext := newEventContext(e.GetHash(), e.GetNext(), e.GetClock().GetTime(), m.g, attachmentsCIDs)
 	return &protocoltypes.GroupMessageEvent{
 		EventContext: eventContext,
 		Headers:      headers,
@@ -194,6 +194,42 @@ func (m *metadataStore) SendSecret(ctx context.Context, memberPK crypto.PubKey)
 	return metadataStoreSendSecret(ctx, m, m.g, md, memberPK, ds)
 }
 
+// RotateSecret replaces the secret of the local device and sends it to the members of the group, the excluded members
+// can't open the messages sent afterwards, the number of members the secret has been sent to is returned
+func (m *metadataStore) RotateSecret(ctx context.Context, excluded []crypto.PubKey) (int, error) {
+	md, err := m.devKS.MemberDeviceForGroup(m.g)
+	if err != nil {
+		return 0, errcode.ErrInternal.Wrap(err)
+	}
+
+	ds, err := m.mks.RotateDeviceSecret(m.g, m.devKS)
+	if err != nil {
+		return 0, errcode.ErrInvalidInput.Wrap(err)
+	}
+
+	sent := 0
+	for _, memberPK := range m.ListMembers() {
+		isExcluded := false
+		for _, pk := range excluded {
+			if pk.Equals(memberPK) {
+				isExcluded = true
+				break
+			}
+		}
+
+		if isExcluded {
+			continue
+		}
+
+		if _, err := metadataStoreSendSecret(ctx, m, m.g, md, memberPK, ds); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, nil
+}
+
 func metadataStoreSendSecret(ctx context.Context, m *metadataStore, g *protocoltypes.Group, md *ownMemberDevice, memberPK crypto.PubKey, ds *protocoltypes.DeviceSecret) (operation.Operation, error) {
 	payload, err := newSecretEntryPayload(md.device, memberPK, ds, g)
 	if err != nil {
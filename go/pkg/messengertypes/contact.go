@@ -0,0 +1,83 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"strings"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	// MaxContactRequestIntroLength is the maximum number of characters of a contact request intro message
+	MaxContactRequestIntroLength = 500
+	// MaxContactRequestAvatarSize is the maximum size in bytes of the avatar sent along with a contact request
+	MaxContactRequestAvatarSize = 32 * 1024
+	// MaxNicknameLength is the maximum number of characters of the nickname of a contact or a member
+	MaxNicknameLength = 64
+	// MaxNicknameNoteLength is the maximum number of characters of the note of a contact or a member
+	MaxNicknameNoteLength = 2048
+)
+
+// IsValidIntro checks the intro message and avatar attached to a contact request
+func (m *ContactMetadata) IsValidIntro() error {
+	if m == nil {
+		return nil
+	}
+
+	if utf8.RuneCountInString(m.GetIntroMessage()) > MaxContactRequestIntroLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("intro message can't be longer than %d characters", MaxContactRequestIntroLength))
+	}
+
+	if len(m.GetAvatar()) > MaxContactRequestAvatarSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("avatar can't be bigger than %d bytes", MaxContactRequestAvatarSize))
+	}
+
+	if len(m.GetAvatar()) > 0 && !strings.HasPrefix(m.GetAvatarMimeType(), "image/") {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("avatar must be an image, got %q", m.GetAvatarMimeType()))
+	}
+
+	return nil
+}
+
+// SanitizeIntro drops the intro message and avatar of a received contact request when they are invalid
+func (m *ContactMetadata) SanitizeIntro() {
+	if m.IsValidIntro() == nil {
+		return
+	}
+
+	m.IntroMessage = ""
+	m.Avatar = nil
+	m.AvatarMimeType = ""
+}
+
+// IsValidNickname checks a nickname and a note set on a contact or a member
+func IsValidNickname(nickname, note string) error {
+	if utf8.RuneCountInString(nickname) > MaxNicknameLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("nickname can't be longer than %d characters", MaxNicknameLength))
+	}
+
+	if utf8.RuneCountInString(note) > MaxNicknameNoteLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("note can't be longer than %d characters", MaxNicknameNoteLength))
+	}
+
+	return nil
+}
+
+// ApplyNickname replaces the display name of a contact by its nickname, the display name is kept in OriginalDisplayName
+func (m *Contact) ApplyNickname() {
+	if m == nil || m.Nickname == "" || m.OriginalDisplayName != "" || m.DisplayName == m.Nickname {
+		return
+	}
+
+	m.OriginalDisplayName, m.DisplayName = m.DisplayName, m.Nickname
+}
+
+// ApplyNickname replaces the display name of a member by its nickname, the display name is kept in OriginalDisplayName
+func (m *Member) ApplyNickname() {
+	if m == nil || m.Nickname == "" || m.OriginalDisplayName != "" || m.DisplayName == m.Nickname {
+		return
+	}
+
+	m.OriginalDisplayName, m.DisplayName = m.DisplayName, m.Nickname
+}
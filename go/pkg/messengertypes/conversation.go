@@ -0,0 +1,32 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"unicode/utf8"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	// MaxConversationTopicLength is the maximum number of characters of a group topic
+	MaxConversationTopicLength = 256
+	// MaxConversationDescriptionLength is the maximum number of characters of a group description
+	MaxConversationDescriptionLength = 2048
+)
+
+// IsValid checks the profile of a group
+func (m *AppMessage_SetGroupInfo) IsValid() error {
+	if m.GetDisplayName() == "" {
+		return errcode.ErrMissingInput.Wrap(fmt.Errorf("a display name is required"))
+	}
+
+	if utf8.RuneCountInString(m.GetTopic()) > MaxConversationTopicLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("topic can't be longer than %d characters", MaxConversationTopicLength))
+	}
+
+	if utf8.RuneCountInString(m.GetDescription()) > MaxConversationDescriptionLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("description can't be longer than %d characters", MaxConversationDescriptionLength))
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"sort"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+const (
+	// MaxExtensionsCount is the maximum number of client extensions of an app message
+	MaxExtensionsCount = 16
+	// MaxExtensionKeySize is the maximum size of the key of a client extension
+	MaxExtensionKeySize = 64
+	// MaxExtensionsSize is the maximum size of the keys and the values of the client extensions of an app message
+	MaxExtensionsSize = 4096
+)
+
+// CheckExtensions checks the count and the size of the client extensions of an app message
+func CheckExtensions(extensions map[string][]byte) error {
+	if len(extensions) > MaxExtensionsCount {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d extensions can be sent", MaxExtensionsCount))
+	}
+
+	size := 0
+	for key, value := range extensions {
+		if key == "" || len(key) > MaxExtensionKeySize {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the key of an extension must be between 1 and %d bytes", MaxExtensionKeySize))
+		}
+		size += len(key) + len(value)
+	}
+
+	if size > MaxExtensionsSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the extensions can't be larger than %d bytes", MaxExtensionsSize))
+	}
+
+	return nil
+}
+
+// MarshalExtendedPayload is MarshalPayload for the messages carrying client extensions
+func (x AppMessage_Type) MarshalExtendedPayload(sentDate int64, medias []*Media, payload proto.Message, viaGateway bool, extensions map[string][]byte) ([]byte, error) {
+	if err := CheckExtensions(extensions); err != nil {
+		return nil, err
+	}
+
+	p, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(&AppMessage{Type: x, Payload: p, SentDate: sentDate, Medias: mediaSliceFilterForNetwork(medias), ViaGateway: viaGateway, PayloadVersion: x.PayloadVersion(), Extensions: extensions})
+}
+
+// InteractionExtensions returns the client extensions of an app message as stored with its interaction, ordered by key
+func (am *AppMessage) InteractionExtensions(cid, convPK string) []*InteractionExtension {
+	if len(am.GetExtensions()) == 0 {
+		return nil
+	}
+
+	extensions := make([]*InteractionExtension, 0, len(am.GetExtensions()))
+	for key, value := range am.GetExtensions() {
+		extensions = append(extensions, &InteractionExtension{
+			InteractionCID:        cid,
+			Key:                   key,
+			ConversationPublicKey: convPK,
+			Value:                 value,
+		})
+	}
+
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i].Key < extensions[j].Key })
+
+	return extensions
+}
+
+// ExtensionsMap returns the client extensions of an interaction by key, nil when it has none
+func (interaction *Interaction) ExtensionsMap() map[string][]byte {
+	if len(interaction.GetExtensions()) == 0 {
+		return nil
+	}
+
+	extensions := make(map[string][]byte, len(interaction.GetExtensions()))
+	for _, extension := range interaction.GetExtensions() {
+		extensions[extension.GetKey()] = extension.GetValue()
+	}
+
+	return extensions
+}
@@ -0,0 +1,60 @@
+package messengertypes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckExtensions(t *testing.T) {
+	tooMany := map[string][]byte{}
+	for i := 0; i <= MaxExtensionsCount; i++ {
+		tooMany[strings.Repeat("k", i+1)] = nil
+	}
+
+	cases := []struct {
+		name       string
+		extensions map[string][]byte
+		valid      bool
+	}{
+		{"nil", nil, true},
+		{"plain", map[string][]byte{"bridge.id": []byte("42")}, true},
+		{"empty key", map[string][]byte{"": []byte("42")}, false},
+		{"key too long", map[string][]byte{strings.Repeat("k", MaxExtensionKeySize+1): nil}, false},
+		{"too many", tooMany, false},
+		{"too large", map[string][]byte{"format": make([]byte, MaxExtensionsSize)}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := CheckExtensions(c.extensions)
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestAppMessageInteractionExtensions(t *testing.T) {
+	raw, err := AppMessage_TypeUserMessage.MarshalExtendedPayload(1000, nil, &AppMessage_UserMessage{Body: "hello"}, false, map[string][]byte{"b": []byte("2"), "a": []byte("1")})
+	require.NoError(t, err)
+
+	am := AppMessage{}
+	require.NoError(t, proto.Unmarshal(raw, &am))
+
+	extensions := am.InteractionExtensions("cid_1", "conv_1")
+	require.Equal(t, []*InteractionExtension{
+		{InteractionCID: "cid_1", Key: "a", ConversationPublicKey: "conv_1", Value: []byte("1")},
+		{InteractionCID: "cid_1", Key: "b", ConversationPublicKey: "conv_1", Value: []byte("2")},
+	}, extensions)
+
+	i := &Interaction{Extensions: extensions}
+	require.Equal(t, am.GetExtensions(), i.ExtensionsMap())
+
+	_, err = AppMessage_TypeUserMessage.MarshalExtendedPayload(1000, nil, &AppMessage_UserMessage{}, false, map[string][]byte{"": nil})
+	require.Error(t, err)
+}
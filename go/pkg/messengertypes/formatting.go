@@ -0,0 +1,91 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"sort"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// MaxFormattingEntities is the maximum number of formatting entities of a user message
+const MaxFormattingEntities = 256
+
+// CheckFormatting checks the formatting entities of a user message against its body
+func (um *AppMessage_UserMessage) CheckFormatting() error {
+	if len(um.GetFormatting()) > MaxFormattingEntities {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a message can't have more than %d formatting entities", MaxFormattingEntities))
+	}
+
+	body := []rune(um.GetBody())
+	for idx, entity := range um.GetFormatting() {
+		if idx > 0 && entity.GetOffset() < um.GetFormatting()[idx-1].GetOffset() {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the formatting entities must be ordered by offset"))
+		}
+
+		if err := checkFormattingEntity(body, um.GetFormatting()[:idx], entity); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SanitizeFormatting orders the formatting entities of a user message and drops the invalid ones, it returns whether
+// the entities changed
+func (um *AppMessage_UserMessage) SanitizeFormatting() bool {
+	if len(um.GetFormatting()) == 0 {
+		return false
+	}
+
+	sorted := append([]*AppMessage_UserMessage_Formatting(nil), um.GetFormatting()...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].GetOffset() < sorted[j].GetOffset() })
+
+	body := []rune(um.GetBody())
+	kept := []*AppMessage_UserMessage_Formatting(nil)
+	for _, entity := range sorted {
+		if len(kept) < MaxFormattingEntities && checkFormattingEntity(body, kept, entity) == nil {
+			kept = append(kept, entity)
+		}
+	}
+
+	changed := len(kept) != len(um.GetFormatting())
+	for idx := 0; !changed && idx < len(kept); idx++ {
+		changed = kept[idx] != um.GetFormatting()[idx]
+	}
+
+	um.Formatting = kept
+
+	return changed
+}
+
+// checkFormattingEntity checks an entity against the body in code points and the entities before it
+func checkFormattingEntity(body []rune, previous []*AppMessage_UserMessage_Formatting, entity *AppMessage_UserMessage_Formatting) error {
+	if _, ok := AppMessage_UserMessage_Formatting_Type_name[int32(entity.GetType())]; !ok || entity.GetType() == AppMessage_UserMessage_Formatting_Undefined {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid formatting type: %d", entity.GetType()))
+	}
+
+	start, end := int(entity.GetOffset()), int(entity.GetOffset())+int(entity.GetLength())
+	if entity.GetLength() == 0 || end > len(body) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the formatting range [%d, %d) is out of the body", start, end))
+	}
+
+	if entity.GetType() == AppMessage_UserMessage_Formatting_TypeBlockQuote && start > 0 && body[start-1] != '\n' {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a block quote must start a line"))
+	}
+
+	for _, other := range previous {
+		if int(other.GetOffset()+other.GetLength()) <= start || end <= int(other.GetOffset()) {
+			continue
+		}
+
+		if other.GetType() == entity.GetType() {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the %s ranges can't overlap", entity.GetType()))
+		}
+
+		if other.GetType() == AppMessage_UserMessage_Formatting_TypeCode || entity.GetType() == AppMessage_UserMessage_Formatting_TypeCode {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a code range can't overlap another range"))
+		}
+	}
+
+	return nil
+}
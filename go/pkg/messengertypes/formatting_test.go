@@ -0,0 +1,60 @@
+package messengertypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserMessageCheckFormatting(t *testing.T) {
+	entity := func(t AppMessage_UserMessage_Formatting_Type, offset, length uint32) *AppMessage_UserMessage_Formatting {
+		return &AppMessage_UserMessage_Formatting{Type: t, Offset: offset, Length: length}
+	}
+
+	cases := []struct {
+		name       string
+		body       string
+		formatting []*AppMessage_UserMessage_Formatting
+		valid      bool
+	}{
+		{"none", "hello", nil, true},
+		{"nested", "hello world", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 0, 11), entity(AppMessage_UserMessage_Formatting_TypeItalic, 6, 5)}, true},
+		{"code points", "héllo", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 0, 5)}, true},
+		{"out of body", "héllo", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 0, 6)}, false},
+		{"empty", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 1, 0)}, false},
+		{"undefined", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_Undefined, 0, 1)}, false},
+		{"unknown", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_Type(42), 0, 1)}, false},
+		{"unordered", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 2, 1), entity(AppMessage_UserMessage_Formatting_TypeItalic, 0, 1)}, false},
+		{"same type overlap", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBold, 0, 3), entity(AppMessage_UserMessage_Formatting_TypeBold, 2, 3)}, false},
+		{"code overlap", "hello", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeCode, 0, 3), entity(AppMessage_UserMessage_Formatting_TypeBold, 2, 3)}, false},
+		{"block quote", "hi\n> quote", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBlockQuote, 3, 7)}, true},
+		{"block quote mid line", "hi > quote", []*AppMessage_UserMessage_Formatting{entity(AppMessage_UserMessage_Formatting_TypeBlockQuote, 3, 7)}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			um := &AppMessage_UserMessage{Body: c.body, Formatting: c.formatting}
+			err := um.CheckFormatting()
+			if c.valid {
+				require.NoError(t, err)
+				require.False(t, um.SanitizeFormatting())
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestUserMessageSanitizeFormatting(t *testing.T) {
+	bold := &AppMessage_UserMessage_Formatting{Type: AppMessage_UserMessage_Formatting_TypeBold, Offset: 2, Length: 2}
+	code := &AppMessage_UserMessage_Formatting{Type: AppMessage_UserMessage_Formatting_TypeCode, Offset: 0, Length: 3}
+	spoiler := &AppMessage_UserMessage_Formatting{Type: AppMessage_UserMessage_Formatting_TypeSpoiler, Offset: 4, Length: 1}
+
+	um := &AppMessage_UserMessage{Body: "hello", Formatting: []*AppMessage_UserMessage_Formatting{spoiler, bold, code}}
+	require.True(t, um.SanitizeFormatting())
+
+	// the entities are ordered, the bold range overlapping the code range is dropped
+	require.Equal(t, []*AppMessage_UserMessage_Formatting{code, spoiler}, um.GetFormatting())
+	require.NoError(t, um.CheckFormatting())
+	require.False(t, um.SanitizeFormatting())
+}
@@ -3,6 +3,8 @@ package messengertypes
 import (
 	fmt "fmt"
 
+	ma "github.com/multiformats/go-multiaddr"
+
 	"berty.tech/berty/v2/go/pkg/errcode"
 	protocoltypes "berty.tech/berty/v2/go/pkg/protocoltypes"
 )
@@ -18,7 +20,7 @@ func (link *BertyLink) IsValid() error {
 			link.BertyID.PublicRendezvousSeed == nil {
 			return errcode.ErrMissingInput
 		}
-		return nil
+		return link.BertyID.ConnectionHints.IsValid()
 
 	case BertyLink_GroupV1Kind:
 		if link.BertyGroup == nil {
@@ -51,6 +53,42 @@ func (link *BertyLink) IsValid() error {
 	return errcode.ErrInvalidInput
 }
 
+// ConnectionHintsMaxCount is the maximum number of rendezvous points and of relays in the connection hints of a link,
+// it keeps the QR codes scannable
+const ConnectionHintsMaxCount = 4
+
+// IsValid checks the connection hints of a link, the links without hints are valid. Each relay must name its peer so
+// it can be dialed without a lookup
+func (hints *ConnectionHints) IsValid() error {
+	if hints == nil {
+		return nil
+	}
+
+	if len(hints.RendezvousPoints) > ConnectionHintsMaxCount || len(hints.Relays) > ConnectionHintsMaxCount {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("at most %d rendezvous points and %d relays can be embedded", ConnectionHintsMaxCount, ConnectionHintsMaxCount))
+	}
+
+	for _, addrs := range [][]string{hints.RendezvousPoints, hints.Relays} {
+		for _, addr := range addrs {
+			maddr, err := ma.NewMultiaddr(addr)
+			if err != nil {
+				return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid connection hint %q: %w", addr, err))
+			}
+
+			if _, err := maddr.ValueForProtocol(ma.P_P2P); err != nil {
+				return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the connection hint %q must have a peer id", addr))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Addrs returns the multiaddrs of the connection hints, the rendezvous points are first
+func (hints *ConnectionHints) Addrs() []string {
+	return append(append([]string(nil), hints.GetRendezvousPoints()...), hints.GetRelays()...)
+}
+
 func (link *BertyLink) IsContact() bool {
 	return link.Kind == BertyLink_ContactInviteV1Kind &&
 		link.IsValid() == nil
@@ -0,0 +1,51 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"math"
+	"time"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// MaxLiveLocationDuration is the maximum duration of a live location share
+const MaxLiveLocationDuration = 8 * time.Hour
+
+// IsLive returns true if the location is part of a live share
+func (l *AppMessage_Location) IsLive() bool {
+	return l.GetShareID() != ""
+}
+
+// IsValid checks the coordinates and the live share parameters of a location
+func (l *AppMessage_Location) IsValid() error {
+	if l == nil {
+		return errcode.ErrMissingInput
+	}
+
+	if l.IsLive() && l.GetExpiresAt() <= 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a live location requires an expiry date"))
+	}
+
+	if !l.IsLive() && (l.GetExpiresAt() != 0 || l.GetStopped()) {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a one-shot location can't have an expiry date or be stopped"))
+	}
+
+	// a stop message doesn't need to carry a position
+	if l.GetStopped() {
+		return nil
+	}
+
+	if math.IsNaN(l.GetLatitude()) || l.GetLatitude() < -90 || l.GetLatitude() > 90 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid latitude: %f", l.GetLatitude()))
+	}
+
+	if math.IsNaN(l.GetLongitude()) || l.GetLongitude() < -180 || l.GetLongitude() > 180 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid longitude: %f", l.GetLongitude()))
+	}
+
+	if math.IsNaN(l.GetAccuracy()) || l.GetAccuracy() < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid accuracy: %f", l.GetAccuracy()))
+	}
+
+	return nil
+}
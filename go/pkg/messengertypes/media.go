@@ -0,0 +1,88 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// MaxWaveformSamples is the maximum number of samples a voice note waveform can contain
+const MaxWaveformSamples = 256
+
+const (
+	// MaxThumbnailSize is the maximum size in bytes of the thumbnail of an image
+	MaxThumbnailSize = 16 * 1024
+	// MaxBlurhashLength is the length of a blurhash of 9x9 components, the largest one
+	MaxBlurhashLength = 166
+)
+
+// IsValidMetadata checks the kind specific metadata of a media
+func (m *Media) IsValidMetadata() error {
+	if m == nil {
+		return errcode.ErrMissingInput
+	}
+
+	if m.DurationMs < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("duration can't be negative"))
+	}
+
+	if err := m.isValidPreview(); err != nil {
+		return err
+	}
+
+	switch m.Kind {
+	case Media_KindUnknown:
+		if len(m.Waveform) > 0 {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("waveform is only supported for voice notes"))
+		}
+		return nil
+
+	case Media_KindVoiceNote:
+		if m.MimeType != "" && !strings.HasPrefix(m.MimeType, "audio/") {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("voice note must be an audio file, got %q", m.MimeType))
+		}
+		if len(m.Waveform) > MaxWaveformSamples {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("waveform can't have more than %d samples, got %d", MaxWaveformSamples, len(m.Waveform)))
+		}
+		return nil
+	}
+
+	return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown media kind %q", m.Kind))
+}
+
+// isValidPreview checks the placeholder of an image shown until it is downloaded
+func (m *Media) isValidPreview() error {
+	if (len(m.Thumbnail) > 0 || m.Blurhash != "") && !strings.HasPrefix(m.MimeType, "image/") {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("only the images have a preview, got %q", m.MimeType))
+	}
+	if len(m.Thumbnail) > MaxThumbnailSize {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("thumbnail can't be larger than %d bytes, got %d", MaxThumbnailSize, len(m.Thumbnail)))
+	}
+	if len(m.Blurhash) > MaxBlurhashLength {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("blurhash can't be longer than %d characters, got %d", MaxBlurhashLength, len(m.Blurhash)))
+	}
+	if m.Width < 0 || m.Height < 0 {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("dimensions can't be negative"))
+	}
+
+	return nil
+}
+
+// SanitizeMetadata drops the kind specific metadata and the preview of a received media when they are invalid
+func (m *Media) SanitizeMetadata() {
+	if m.isValidPreview() != nil {
+		m.Thumbnail = nil
+		m.Blurhash = ""
+		m.Width = 0
+		m.Height = 0
+	}
+
+	if m.IsValidMetadata() == nil {
+		return
+	}
+
+	m.Kind = Media_KindUnknown
+	m.DurationMs = 0
+	m.Waveform = nil
+}
@@ -0,0 +1,55 @@
+package messengertypes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMediaIsValidMetadata(t *testing.T) {
+	cases := []struct {
+		name  string
+		media *Media
+		valid bool
+	}{
+		{"nil", nil, false},
+		{"plain", &Media{MimeType: "image/png"}, true},
+		{"negative duration", &Media{DurationMs: -1}, false},
+		{"waveform without kind", &Media{Waveform: []byte{1, 2}}, false},
+		{"voice note", &Media{Kind: Media_KindVoiceNote, MimeType: "audio/aac", DurationMs: 1500, Waveform: []byte{1, 2}}, true},
+		{"voice note not audio", &Media{Kind: Media_KindVoiceNote, MimeType: "image/png"}, false},
+		{"voice note waveform too long", &Media{Kind: Media_KindVoiceNote, Waveform: make([]byte, MaxWaveformSamples+1)}, false},
+		{"unknown kind", &Media{Kind: Media_Kind(42)}, false},
+		{"image preview", &Media{MimeType: "image/jpeg", Thumbnail: []byte{1, 2}, Blurhash: "L0TSUA", Width: 640, Height: 480}, true},
+		{"preview not image", &Media{MimeType: "audio/aac", Blurhash: "L0TSUA"}, false},
+		{"thumbnail too large", &Media{MimeType: "image/jpeg", Thumbnail: make([]byte, MaxThumbnailSize+1)}, false},
+		{"blurhash too long", &Media{MimeType: "image/jpeg", Blurhash: string(make([]byte, MaxBlurhashLength+1))}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.media.IsValidMetadata()
+			if c.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestMediaSanitizeMetadata(t *testing.T) {
+	m := &Media{Kind: Media_KindVoiceNote, MimeType: "audio/aac", DurationMs: 1500, Waveform: make([]byte, MaxWaveformSamples+1)}
+	m.SanitizeMetadata()
+	require.Equal(t, Media_KindUnknown, m.Kind)
+	require.Zero(t, m.DurationMs)
+	require.Nil(t, m.Waveform)
+
+	// an invalid preview is dropped alone
+	m = &Media{MimeType: "image/jpeg", Thumbnail: make([]byte, MaxThumbnailSize+1), Blurhash: "L0TSUA", Width: 640, Height: 480}
+	m.SanitizeMetadata()
+	require.Nil(t, m.Thumbnail)
+	require.Empty(t, m.Blurhash)
+	require.Zero(t, m.Width)
+	require.Equal(t, "image/jpeg", m.MimeType)
+}
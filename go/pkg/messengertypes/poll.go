@@ -0,0 +1,73 @@
+package messengertypes
+
+import (
+	fmt "fmt"
+	"strings"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// MaxPollOptions is the maximum number of options of a poll
+const MaxPollOptions = 12
+
+func (p *AppMessage_PollCreate) IsValid() error {
+	if p == nil {
+		return errcode.ErrMissingInput
+	}
+
+	if strings.TrimSpace(p.GetQuestion()) == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a question is required"))
+	}
+
+	if len(p.GetOptions()) < 2 || len(p.GetOptions()) > MaxPollOptions {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll requires between 2 and %d options, got %d", MaxPollOptions, len(p.GetOptions())))
+	}
+
+	for i, option := range p.GetOptions() {
+		if strings.TrimSpace(option) == "" {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("option %d is empty", i))
+		}
+	}
+
+	if _, ok := Poll_Visibility_name[int32(p.GetVisibility())]; !ok {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("unknown visibility %q", p.GetVisibility()))
+	}
+
+	return nil
+}
+
+func (p *AppMessage_PollVote) IsValid() error {
+	if p == nil {
+		return errcode.ErrMissingInput
+	}
+
+	if p.GetPollCID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	seen := map[int32]bool{}
+	for _, index := range p.GetOptionIndexes() {
+		if index < 0 || index >= MaxPollOptions {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("invalid option index %d", index))
+		}
+
+		if seen[index] {
+			return errcode.ErrInvalidInput.Wrap(fmt.Errorf("duplicate option index %d", index))
+		}
+		seen[index] = true
+	}
+
+	return nil
+}
+
+func (p *AppMessage_PollClose) IsValid() error {
+	if p == nil {
+		return errcode.ErrMissingInput
+	}
+
+	if p.GetPollCID() == "" {
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("a poll cid is required"))
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package messengertypes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	fmt "fmt"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+
+	"berty.tech/berty/v2/go/pkg/errcode"
+)
+
+// QuoteExcerptMaxLength is the maximum length in code points of the excerpt of a quoted message
+const QuoteExcerptMaxLength = 280
+
+// NewQuote builds the quote of a user message from its body
+func NewQuote(cid, devicePK string, sentDate int64, body string) *AppMessage_UserMessage_Quote {
+	return &AppMessage_UserMessage_Quote{
+		CID:             cid,
+		Hash:            quoteHash(body),
+		Excerpt:         quoteExcerpt(body),
+		DevicePublicKey: devicePK,
+		SentDate:        sentDate,
+	}
+}
+
+func quoteHash(body string) []byte {
+	hash := sha256.Sum256([]byte(body))
+	return hash[:]
+}
+
+func quoteExcerpt(body string) string {
+	if utf8.RuneCountInString(body) <= QuoteExcerptMaxLength {
+		return body
+	}
+
+	return string([]rune(body)[:QuoteExcerptMaxLength])
+}
+
+// CheckQuote checks the format of the quote of a user message, it is checked against the quoted message by Matches
+func (um *AppMessage_UserMessage) CheckQuote() error {
+	quote := um.GetQuote()
+	if quote == nil {
+		return nil
+	}
+
+	switch {
+	case quote.GetCID() == "":
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the quote has no cid"))
+	case len(quote.GetHash()) != sha256.Size:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the hash of the quote must be %d bytes long", sha256.Size))
+	case !utf8.ValidString(quote.GetExcerpt()):
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the excerpt of the quote isn't valid utf-8"))
+	case utf8.RuneCountInString(quote.GetExcerpt()) > QuoteExcerptMaxLength:
+		return errcode.ErrInvalidInput.Wrap(fmt.Errorf("the excerpt of the quote is longer than %d characters", QuoteExcerptMaxLength))
+	}
+
+	return nil
+}
+
+// Matches checks a quote against the quoted message, it is false when the quote has been changed by the sender of the
+// reply or doesn't quote a user message
+func (q *AppMessage_UserMessage_Quote) Matches(quoted *Interaction) bool {
+	if quoted.GetType() != AppMessage_TypeUserMessage {
+		return false
+	}
+
+	var um AppMessage_UserMessage
+	if err := proto.Unmarshal(quoted.GetPayload(), &um); err != nil {
+		return false
+	}
+
+	body := um.GetBody()
+	return bytes.Equal(q.GetHash(), quoteHash(body)) &&
+		q.GetExcerpt() == quoteExcerpt(body) &&
+		q.GetDevicePublicKey() == quoted.GetDevicePublicKey() &&
+		q.GetSentDate() == quoted.GetSentDate()
+}
@@ -0,0 +1,37 @@
+package messengertypes
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuote(t *testing.T) {
+	body := strings.Repeat("é", QuoteExcerptMaxLength+10)
+	payload, err := proto.Marshal(&AppMessage_UserMessage{Body: body})
+	require.NoError(t, err)
+
+	quoted := &Interaction{CID: "cid_1", Type: AppMessage_TypeUserMessage, Payload: payload, DevicePublicKey: "device_1", SentDate: 42}
+	quote := NewQuote(quoted.CID, quoted.DevicePublicKey, quoted.SentDate, body)
+	require.Equal(t, QuoteExcerptMaxLength, utf8.RuneCountInString(quote.GetExcerpt()))
+	require.NoError(t, (&AppMessage_UserMessage{Quote: quote}).CheckQuote())
+	require.True(t, quote.Matches(quoted))
+
+	tampered := *quote
+	tampered.Excerpt = "something else"
+	require.NoError(t, (&AppMessage_UserMessage{Quote: &tampered}).CheckQuote())
+	require.False(t, tampered.Matches(quoted))
+
+	tampered = *quote
+	tampered.DevicePublicKey = "device_2"
+	require.False(t, tampered.Matches(quoted))
+
+	require.False(t, quote.Matches(&Interaction{CID: "cid_1", Type: AppMessage_TypeUserReaction, DevicePublicKey: "device_1", SentDate: 42}))
+
+	require.Error(t, (&AppMessage_UserMessage{Quote: &AppMessage_UserMessage_Quote{Hash: quote.GetHash()}}).CheckQuote())
+	require.Error(t, (&AppMessage_UserMessage{Quote: &AppMessage_UserMessage_Quote{CID: "cid_1", Hash: []byte("short")}}).CheckQuote())
+	require.Error(t, (&AppMessage_UserMessage{Quote: &AppMessage_UserMessage_Quote{CID: "cid_1", Hash: quote.GetHash(), Excerpt: body}}).CheckQuote())
+}
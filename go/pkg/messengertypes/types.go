@@ -41,12 +41,41 @@ func (x *AppMessage_Type) MarshalJSON() ([]byte, error) {
 }
 
 func (x AppMessage_Type) MarshalPayload(sentDate int64, medias []*Media, payload proto.Message) ([]byte, error) {
-	p, err := proto.Marshal(payload)
-	if err != nil {
-		return nil, err
+	return x.marshalPayload(sentDate, medias, payload, false)
+}
+
+// MarshalGatewayPayload is MarshalPayload for the messages relayed from another chat protocol
+func (x AppMessage_Type) MarshalGatewayPayload(sentDate int64, medias []*Media, payload proto.Message) ([]byte, error) {
+	return x.marshalPayload(sentDate, medias, payload, true)
+}
+
+func (x AppMessage_Type) marshalPayload(sentDate int64, medias []*Media, payload proto.Message, viaGateway bool) ([]byte, error) {
+	return x.MarshalExtendedPayload(sentDate, medias, payload, viaGateway, nil)
+}
+
+// payloadVersions are the versions of the payload schemas understood by this node, the version of a type is bumped
+// when its payload changes in a way the older nodes can't ignore. The types missing from it are at the first version
+var payloadVersions = map[AppMessage_Type]uint32{}
+
+// PayloadVersion returns the version of the payload schema of a type sent by this node
+func (x AppMessage_Type) PayloadVersion() uint32 {
+	if version, ok := payloadVersions[x]; ok {
+		return version
 	}
 
-	return proto.Marshal(&AppMessage{Type: x, Payload: p, SentDate: sentDate, Medias: mediaSliceFilterForNetwork(medias)})
+	return 1
+}
+
+// IsKnown returns whether the type is known by this node, the types added by a newer version are not
+func (x AppMessage_Type) IsKnown() bool {
+	_, ok := AppMessage_Type_name[int32(x)]
+	return ok
+}
+
+// IsPayloadSupported returns whether the payload of a message can be read by this node, the messages sent by a newer
+// version may use a type or a payload version it doesn't know yet
+func (am *AppMessage) IsPayloadSupported() bool {
+	return am.GetType().IsKnown() && am.GetPayloadVersion() <= am.GetType().PayloadVersion()
 }
 
 func mediaSliceFilterForNetwork(dbMedias []*Media) []*Media {
@@ -57,6 +86,10 @@ func mediaSliceFilterForNetwork(dbMedias []*Media) []*Media {
 			MimeType:    dbMedia.GetMimeType(),
 			Filename:    dbMedia.GetFilename(),
 			DisplayName: dbMedia.GetDisplayName(),
+			Size_:       dbMedia.GetSize_(),
+			Kind:        dbMedia.GetKind(),
+			DurationMs:  dbMedia.GetDurationMs(),
+			Waveform:    dbMedia.GetWaveform(),
 		}
 	}
 	return networkMedias
@@ -82,8 +115,82 @@ func (am AppMessage) UnmarshalPayload() (proto.Message, error) {
 		message = &AppMessage_SetUserInfo{}
 	case AppMessage_TypeReplyOptions:
 		message = &AppMessage_ReplyOptions{}
+	case AppMessage_TypeLocation:
+		message = &AppMessage_Location{}
+	case AppMessage_TypePollCreate:
+		message = &AppMessage_PollCreate{}
+	case AppMessage_TypePollVote:
+		message = &AppMessage_PollVote{}
+	case AppMessage_TypePollClose:
+		message = &AppMessage_PollClose{}
+	case AppMessage_TypeSetMemberRole:
+		message = &AppMessage_SetMemberRole{}
+	case AppMessage_TypeRemoveMember:
+		message = &AppMessage_RemoveMember{}
+	case AppMessage_TypeSetPostingRestricted:
+		message = &AppMessage_SetPostingRestricted{}
+	case AppMessage_TypeGroupInvitationLinkUsed:
+		message = &AppMessage_GroupInvitationLinkUsed{}
+	case AppMessage_TypePresence:
+		message = &AppMessage_Presence{}
+	case AppMessage_TypeDeviceSyncSnapshot:
+		message = &AppMessage_DeviceSyncSnapshot{}
+	case AppMessage_TypeDeviceSyncConversation:
+		message = &AppMessage_DeviceSyncConversation{}
+	case AppMessage_TypeDeviceSyncContact:
+		message = &AppMessage_DeviceSyncContact{}
+	case AppMessage_TypeAbuseReport:
+		message = &AppMessage_AbuseReport{}
+	case AppMessage_TypeBoardEntrySet:
+		message = &AppMessage_BoardEntrySet{}
+	case AppMessage_TypeDeviceSyncStar:
+		message = &AppMessage_DeviceSyncStar{}
+	case AppMessage_TypeDeviceSyncTag:
+		message = &AppMessage_DeviceSyncTag{}
+	case AppMessage_TypeMediaAvailability:
+		message = &AppMessage_MediaAvailability{}
+	case AppMessage_TypeHistoryBundle:
+		message = &AppMessage_HistoryBundle{}
+	case AppMessage_TypeSetJoinApproval:
+		message = &AppMessage_SetJoinApproval{}
+	case AppMessage_TypeMemberJoinDecision:
+		message = &AppMessage_MemberJoinDecision{}
+	case AppMessage_TypeChunk:
+		message = &AppMessage_Chunk{}
+	case AppMessage_TypeRecoveryShard:
+		message = &AppMessage_RecoveryShard{}
+	case AppMessage_TypeSetAnnouncementMode:
+		message = &AppMessage_SetAnnouncementMode{}
+	case AppMessage_TypeAnnouncement:
+		message = &AppMessage_Announcement{}
+	case AppMessage_TypeKeyRotation:
+		message = &AppMessage_KeyRotation{}
+	case AppMessage_TypeSetConversationPreferences:
+		message = &AppMessage_SetConversationPreferences{}
+	case AppMessage_TypeContactIntroduction:
+		message = &AppMessage_ContactIntroduction{}
+	case AppMessage_TypeConversationMigrated:
+		message = &AppMessage_ConversationMigrated{}
+	case AppMessage_TypeSetMemberCap:
+		message = &AppMessage_SetMemberCap{}
+	case AppMessage_TypeSetConversationRetention:
+		message = &AppMessage_SetConversationRetention{}
+	case AppMessage_TypeDeviceSyncSummary:
+		message = &AppMessage_DeviceSyncSummary{}
+	case AppMessage_TypeDeviceSyncDigest:
+		message = &AppMessage_DeviceSyncDigest{}
+	case AppMessage_TypeDeviceSyncDiff:
+		message = &AppMessage_DeviceSyncDiff{}
+	case AppMessage_TypeInteractionRetract:
+		message = &AppMessage_InteractionRetract{}
 	case AppMessage_TypeMonitorMetadata:
 		message = &AppMessage_MonitorMetadata{}
+	case AppMessage_TypeRateLimitNotice:
+		message = &AppMessage_RateLimitNotice{}
+	case AppMessage_TypeSystemEvent:
+		message = &AppMessage_SystemEvent{}
+	case AppMessage_TypeSystemNotice:
+		message = &AppMessage_SystemNotice{}
 
 	default:
 		return nil, errcode.TODO.Wrap(fmt.Errorf("unsupported AppMessage type: %q", am.GetType()))
@@ -126,6 +233,46 @@ func (event *StreamEvent) UnmarshalPayload() (proto.Message, error) {
 		message = &StreamEvent_DeviceUpdated{}
 	case StreamEvent_TypeMediaUpdated:
 		message = &StreamEvent_MediaUpdated{}
+	case StreamEvent_TypeLocationUpdated:
+		message = &StreamEvent_LocationUpdated{}
+	case StreamEvent_TypePollUpdated:
+		message = &StreamEvent_PollUpdated{}
+	case StreamEvent_TypeContactKeyChanged:
+		message = &StreamEvent_ContactKeyChanged{}
+	case StreamEvent_TypeBoardEntryUpdated:
+		message = &StreamEvent_BoardEntryUpdated{}
+	case StreamEvent_TypeMemberJoinRequested:
+		message = &StreamEvent_MemberJoinRequested{}
+	case StreamEvent_TypeInteractionDelivered:
+		message = &StreamEvent_InteractionDelivered{}
+	case StreamEvent_TypeAnnouncementReceived:
+		message = &StreamEvent_AnnouncementReceived{}
+	case StreamEvent_TypeScheduledAnnouncementUpdated:
+		message = &StreamEvent_ScheduledAnnouncementUpdated{}
+	case StreamEvent_TypeOutboxFlushing:
+		message = &StreamEvent_OutboxFlushing{}
+	case StreamEvent_TypeBatchUpdated:
+		message = &StreamEvent_BatchUpdated{}
+	case StreamEvent_TypeConversationReplicationStale:
+		message = &StreamEvent_ConversationReplicationStale{}
+	case StreamEvent_TypeOutboxMessageExpired:
+		message = &StreamEvent_OutboxMessageExpired{}
+	case StreamEvent_TypeBroadcastUpdated:
+		message = &StreamEvent_BroadcastUpdated{}
+	case StreamEvent_TypeConversationConsistent:
+		message = &StreamEvent_ConversationConsistent{}
+	case StreamEvent_TypeStreamGap:
+		message = &StreamEvent_StreamGap{}
+	case StreamEvent_TypeMediaUploadUpdated:
+		message = &StreamEvent_MediaUploadUpdated{}
+	case StreamEvent_TypeEventHandlingFailed:
+		message = &StreamEvent_EventHandlingFailed{}
+	case StreamEvent_TypeContactRequestUpdated:
+		message = &StreamEvent_ContactRequestUpdated{}
+	case StreamEvent_TypeAccountDataExportUpdated:
+		message = &StreamEvent_AccountDataExportUpdated{}
+	case StreamEvent_TypeStartupCheckUpdated:
+		message = &StreamEvent_StartupCheckUpdated{}
 	case StreamEvent_TypeNotified:
 		message = &StreamEvent_Notified{}
 	case StreamEvent_TypeListEnded: